@@ -292,12 +292,15 @@ static DOKAN_CALLBACK NTSTATUS kbfsLibdokanC_SetFileSecurity(LPCWSTR FileName,
 	return kbfsLibdokanSetFileSecurity(FileName, SecurityInformation, SecurityDescriptor, SecurityDescriptorLength, FileInfo);
 }
 
-/*
 extern NTSTATUS kbfsLibdokanFindStreams(LPCWSTR FileName,
 										  // call this function with PWIN32_FIND_STREAM_DATA
-										  PFillFindStreamData FindStreamData, 
+										  PFillFindStreamData FindStreamData,
 										  PDOKAN_FILE_INFO FileInfo);
-*/
+static DOKAN_CALLBACK NTSTATUS kbfsLibdokanC_FindStreams(LPCWSTR FileName,
+										  PFillFindStreamData FindStreamData,
+										  PDOKAN_FILE_INFO FileInfo) {
+	return kbfsLibdokanFindStreams(FileName, FindStreamData, FileInfo);
+}
 
 
 
@@ -333,8 +336,6 @@ struct kbfsLibdokanCtx* kbfsLibdokanAllocCtx(ULONG64 slot) {
   ctx->dokan_operations.Mounted = kbfsLibdokanC_Mounted;
   ctx->dokan_operations.GetFileSecurity = kbfsLibdokanC_GetFileSecurity;
   ctx->dokan_operations.SetFileSecurity = kbfsLibdokanC_SetFileSecurity;
-  // FIXME: Multiple streams per file for e.g. resource forks
-  //   ctx->dokan_operations.FindStreams = kbfsLibdokanC_FindStreams;
   return ctx;
 }
 
@@ -362,6 +363,9 @@ error_t kbfsLibdokanRun(struct kbfsLibdokanCtx* ctx) {
 	  ctx->dokan_options.Options &= ~kbfsLibdokanUseFindFilesWithPattern;
 	  ctx->dokan_operations.FindFilesWithPattern = kbfsLibdokanC_FindFilesWithPattern;
 	}
+	if((ctx->dokan_options.Options & kbfsLibdokanAltStream) != 0) {
+	  ctx->dokan_operations.FindStreams = kbfsLibdokanC_FindStreams;
+	}
 	int status = (*kbfsLibdokanPtr_Main)(&ctx->dokan_options, &ctx->dokan_operations);
 	return status;
 }
@@ -370,6 +374,10 @@ int kbfsLibdokanFill_find(PFillFindData fptr, PWIN32_FIND_DATAW a1, PDOKAN_FILE_
   return fptr(a1, a2);
 }
 
+int kbfsLibdokanFill_find_stream(PFillFindStreamData fptr, PWIN32_FIND_STREAM_DATA a1, PDOKAN_FILE_INFO a2) {
+  return fptr(a1, a2);
+}
+
 BOOL kbfsLibdokan_RemoveMountPoint(LPCWSTR MountPoint) {
 	if(!kbfsLibdokanPtr_RemoveMountPoint)
 		return 0;
@@ -42,6 +42,7 @@ error_t kbfsLibdokanRun(struct kbfsLibdokanCtx* ctx);
 void kbfsLibdokanSet_path(struct kbfsLibdokanCtx* ctx, void*);
 
 int kbfsLibdokanFill_find(PFillFindData, PWIN32_FIND_DATAW, PDOKAN_FILE_INFO);
+int kbfsLibdokanFill_find_stream(PFillFindStreamData, PWIN32_FIND_STREAM_DATA, PDOKAN_FILE_INFO);
 
 BOOL kbfsLibdokan_RemoveMountPoint(LPCWSTR MountPoint);
 HANDLE kbfsLibdokan_OpenRequestorToken(PDOKAN_FILE_INFO DokanFileInfo);
@@ -52,6 +53,7 @@ enum {
   kbfsLibdokanRemovable = DOKAN_OPTION_REMOVABLE,
   kbfsLibdokanMountManager = DOKAN_OPTION_MOUNT_MANAGER,
   kbfsLibdokanCurrentSession = DOKAN_OPTION_CURRENT_SESSION,
+  kbfsLibdokanAltStream = DOKAN_OPTION_ALT_STREAM,
   kbfsLibdokanUseFindFilesWithPattern = 1<<24,
 
   kbfsLibDokan_ERROR = DOKAN_ERROR,
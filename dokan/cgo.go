@@ -35,6 +35,7 @@ const (
 	kbfsLibdokanRemovable               = MountFlag(C.kbfsLibdokanRemovable)
 	kbfsLibdokanMountManager            = MountFlag(C.kbfsLibdokanMountManager)
 	kbfsLibdokanCurrentSession          = MountFlag(C.kbfsLibdokanCurrentSession)
+	kbfsLibdokanAltStream               = MountFlag(C.kbfsLibdokanAltStream)
 	kbfsLibdokanUseFindFilesWithPattern = MountFlag(C.kbfsLibdokanUseFindFilesWithPattern)
 )
 
@@ -514,17 +515,35 @@ func kbfsLibdokanSetFileSecurity(
 	return ntstatusOk
 }
 
-/* FIXME add support for multiple streams per file?
 //export kbfsLibdokanFindStreams
-func kbfsLibdokanFindStreams (
+func kbfsLibdokanFindStreams(
 	fname C.LPCWSTR,
-	// call this function with PWIN32_FIND_STREAM_DATA
-	FindStreamData uintptr,
+	FindStreamData C.PFillFindStreamData, // call this function with PWIN32_FIND_STREAM_DATA
 	pfi C.PDOKAN_FILE_INFO) C.NTSTATUS {
-
-
+	debugf("FindStreams '%v' %v", d16{fname}, *pfi)
+	ctx, cancel := getContext(pfi)
+	if cancel != nil {
+		defer cancel()
+	}
+	sf, ok := getfi(pfi).(StreamFinder)
+	if !ok {
+		return errToNT(ErrNotSupported)
+	}
+	var sdata C.kbfs_WIN32_FIND_STREAM_DATA
+	fun := func(ns *NamedStream) error {
+		*(*int64)(unsafe.Pointer(&sdata.StreamSize)) = ns.Size
+		stringToUtf16Buffer(":"+ns.Name+":$DATA",
+			C.LPWSTR(unsafe.Pointer(&sdata.cStreamName)),
+			C.DWORD(C.MAX_PATH+36))
+		v := C.kbfsLibdokanFill_find_stream(FindStreamData, &sdata, pfi)
+		if v != 0 {
+			return errFindNoSpace
+		}
+		return nil
+	}
+	err := sf.FindStreams(ctx, makeFI(fname, pfi), fun)
+	return errToNT(err)
 }
-*/
 
 // FileInfo contains information about a file including the path.
 type FileInfo struct {
@@ -71,6 +71,11 @@ func (fi *FileInfo) IsDeleteOnClose() bool {
 	return fi.ptr.DeleteOnClose != 0
 }
 
+// ProcessID returns the ID of the process that made the request.
+func (fi *FileInfo) ProcessID() uint32 {
+	return uint32(fi.ptr.ProcessId)
+}
+
 // IsRequestorUserSidEqualTo returns true if the argument is equal
 // to the sid of the user associated with the filesystem request.
 func (fi *FileInfo) IsRequestorUserSidEqualTo(sid *SID) bool {
@@ -20,6 +20,7 @@ func loadDokanDLL(fullpath string) error { return errNotWindows }
 type FileInfo struct {
 	ptr *struct {
 		DeleteOnClose int
+		ProcessId     uint32
 	}
 	rawPath struct{}
 }
@@ -47,6 +48,7 @@ const (
 	kbfsLibdokanRemovable
 	kbfsLibdokanMountManager
 	kbfsLibdokanCurrentSession
+	kbfsLibdokanAltStream
 	kbfsLibdokanUseFindFilesWithPattern
 )
 
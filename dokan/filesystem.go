@@ -62,6 +62,10 @@ const (
 	// UseFindFilesWithPattern enables FindFiles calls to be with a search
 	// pattern string. Otherwise the string will be empty in all calls.
 	UseFindFilesWithPattern = MountFlag(kbfsLibdokanUseFindFilesWithPattern)
+	// AltStream enables alternate data streams, i.e. "file:stream"
+	// paths are passed to CreateFile, and files implementing
+	// StreamFinder can list their streams.
+	AltStream = MountFlag(kbfsLibdokanAltStream)
 )
 
 // CreateData contains all the info needed to create a file.
@@ -104,6 +108,7 @@ const (
 	FileAttributeDirectory    = FileAttribute(0x00000010)
 	FileAttributeArchive      = FileAttribute(0x00000020)
 	FileAttributeNormal       = FileAttribute(0x00000080)
+	FileAttributeSparseFile   = FileAttribute(0x00000200)
 	FileAttributeReparsePoint = FileAttribute(0x00000400)
 	IOReparseTagSymlink       = 0xA000000C
 )
@@ -157,6 +162,24 @@ type File interface {
 	CloseFile(ctx context.Context, fi *FileInfo)
 }
 
+// NamedStream describes an alternate data stream of a file.
+type NamedStream struct {
+	// Name is the stream name, without the leading ':' or the
+	// trailing ":$DATA".
+	Name string
+	Size int64
+}
+
+// StreamFinder is an optional interface for Files that have
+// alternate data streams. It is only used when mounted with
+// AltStream.
+type StreamFinder interface {
+	// FindStreams lists the streams. The function is a callback
+	// that should be called with each stream. The same NamedStream
+	// may be reused for subsequent calls.
+	FindStreams(ctx context.Context, fi *FileInfo, fillStreamCallback func(*NamedStream) error) error
+}
+
 // FreeSpace - semantics as with WINAPI GetDiskFreeSpaceEx
 type FreeSpace struct {
 	FreeBytesAvailable, TotalNumberOfBytes, TotalNumberOfFreeBytes uint64
@@ -253,6 +276,18 @@ const (
 	ErrFileAlreadyExists = NtStatus(0xC0000035)
 	// ErrNotSameDevice - MoveFile is denied, please use copy+delete.
 	ErrNotSameDevice = NtStatus(0xC00000D4)
+	// ErrLockNotGranted - a byte-range lock conflicts with one held elsewhere (EAGAIN).
+	ErrLockNotGranted = NtStatus(0xC0000055)
+	// ErrInvalidParameter - an argument is invalid (EINVAL).
+	ErrInvalidParameter = NtStatus(0xC000000D)
+	// ErrDiskFull - out of space (ENOSPC, EDQUOT).
+	ErrDiskFull = NtStatus(0xC000007F)
+	// ErrIoTimeout - the operation timed out (ETIMEDOUT).
+	ErrIoTimeout = NtStatus(0xC00000B5)
+	// ErrNetworkUnreachable - the network is down (ENETDOWN).
+	ErrNetworkUnreachable = NtStatus(0xC000023C)
+	// ErrMediaWriteProtected - writes aren't allowed (EROFS).
+	ErrMediaWriteProtected = NtStatus(0xC00000A2)
 	// StatusObjectNameExists - already exists, may be non-fatal...
 	StatusObjectNameExists = NtStatus(0x40000000)
 )
@@ -30,14 +30,14 @@ const usageFormatStr = `Usage:
   kbfsdokan -version
 
 To run against remote KBFS servers:
-  kbfsdokan [-debug] [-cpuprofile=path/to/dir]
+  kbfsdokan [-debug] [-cpuprofile=path/to/dir] [-profile=name]
     [-bserver=%s] [-mdserver=%s]
     [-runtime-dir=path/to/dir] [-label=label] [-mount-type=force]
     [-log-to-file] [-log-file=path/to/file]
     /path/to/mountpoint
 
 To run in a local testing environment:
-  kbfsdokan [-debug] [-cpuprofile=path/to/dir]
+  kbfsdokan [-debug] [-cpuprofile=path/to/dir] [-profile=name]
     [-server-in-memory|-server-root=path/to/dir] [-localuser=<user>]
     [-runtime-dir=path/to/dir] [-label=label] [-mount-type=force]
     [-log-to-file] [-log-file=path/to/file]
@@ -73,6 +73,10 @@ func start() *libfs.Error {
 		return nil
 	}
 
+	if err := libkbfs.ApplyInitProfile(flag.CommandLine, kbfsParams); err != nil {
+		return libfs.InitError(err.Error())
+	}
+
 	if len(flag.Args()) < 1 {
 		fmt.Print(getUsageStr(ctx))
 		return libfs.InitError("no mount specified")
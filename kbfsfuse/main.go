@@ -7,9 +7,11 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"strconv"
 
 	"bazil.org/fuse"
 
@@ -24,19 +26,35 @@ var runtimeDir = flag.String("runtime-dir", os.Getenv("KEYBASE_RUNTIME_DIR"), "r
 var label = flag.String("label", os.Getenv("KEYBASE_LABEL"), "label to help identify if running as a service")
 var mountType = flag.String("mount-type", defaultMountType, "mount type: default, force")
 var version = flag.Bool("version", false, "Print version")
+var subdir = flag.String("subdir", "", "only mount this directory, e.g. private/alice/project")
+var allowOther = flag.Bool("allow-other", false, "let all users on this machine use the mount (needs user_allow_other in /etc/fuse.conf)")
+var allowRoot = flag.Bool("allow-root", false, "let root use the mount too (needs user_allow_other in /etc/fuse.conf)")
+var uid = flag.Int("uid", os.Getuid(), "uid that owns files without an owner of their own")
+var gid = flag.Int("gid", os.Getgid(), "gid that owns files without an owner of their own")
+var uidMap = flag.String("uid-map", "", "map stored uids to local ones, e.g. 1000:1001,1002:1003")
+var gidMap = flag.String("gid-map", "", "map stored gids to local ones, e.g. 1000:1001,1002:1003")
+var fileMode = flag.String("file-mode", "", "octal permissions of files without a mode of their own, e.g. 0640")
+var dirMode = flag.String("dir-mode", "", "octal permissions of directories without a mode of their own, e.g. 0750")
+var debugListen = flag.String("debug-listen", "", "if set, loopback TCP address to serve pprof, expvar and JSON inspectors of caches and journals on, e.g. 127.0.0.1:8082")
+var httpListen = flag.String("http-listen", "", "if set, TCP address to serve public folders over HTTP on, e.g. 127.0.0.1:8081")
 
 const usageFormatStr = `Usage:
   kbfsfuse -version
 
 To run against remote KBFS servers:
-  kbfsfuse [-debug] [-cpuprofile=path/to/dir]
+  kbfsfuse [-debug] [-cpuprofile=path/to/dir] [-profile=name]
     [-bserver=%s] [-mdserver=%s]
     [-runtime-dir=path/to/dir] [-label=label] [-mount-type=force]
+    [-subdir=private/user/path/to/dir] [-http-listen=host:port]
+    [-debug-listen=127.0.0.1:port]
+    [-allow-other|-allow-root] [-uid=uid] [-gid=gid]
+    [-uid-map=from:to,...] [-gid-map=from:to,...]
+    [-file-mode=0644] [-dir-mode=0755]
     [-log-to-file] [-log-file=path/to/file]]
     %s/path/to/mountpoint
 
 To run in a local testing environment:
-  kbfsfuse [-debug] [-cpuprofile=path/to/dir]
+  kbfsfuse [-debug] [-cpuprofile=path/to/dir] [-profile=name]
     [-server-in-memory|-server-root=path/to/dir] [-localuser=<user>]
     [-runtime-dir=path/to/dir] [-label=label] [-mount-type=force]
     [-log-to-file] [-log-file=path/to/file]]
@@ -59,6 +77,45 @@ func getUsageStr(ctx libkbfs.Context) string {
 		platformUsageString, platformUsageString)
 }
 
+// parsePerm parses an octal permission flag, which may be empty.
+func parsePerm(name, s string) (os.FileMode, error) {
+	if s == "" {
+		return 0, nil
+	}
+	perm, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || perm&^uint64(os.ModePerm) != 0 {
+		return 0, fmt.Errorf("bad -%s %q", name, s)
+	}
+	return os.FileMode(perm), nil
+}
+
+func getMountOptions() (libfuse.MountOptions, error) {
+	if *allowOther && *allowRoot {
+		return libfuse.MountOptions{}, errors.New(
+			"only one of -allow-other and -allow-root can be given")
+	}
+	options := libfuse.MountOptions{
+		AllowOther: *allowOther,
+		AllowRoot:  *allowRoot,
+		UID:        uint32(*uid),
+		GID:        uint32(*gid),
+	}
+	var err error
+	if options.UIDMap, err = libfuse.ParseIDMap(*uidMap); err != nil {
+		return libfuse.MountOptions{}, err
+	}
+	if options.GIDMap, err = libfuse.ParseIDMap(*gidMap); err != nil {
+		return libfuse.MountOptions{}, err
+	}
+	if options.FileMode, err = parsePerm("file-mode", *fileMode); err != nil {
+		return libfuse.MountOptions{}, err
+	}
+	if options.DirMode, err = parsePerm("dir-mode", *dirMode); err != nil {
+		return libfuse.MountOptions{}, err
+	}
+	return options, nil
+}
+
 func start() *libfs.Error {
 	ctx := env.NewContext()
 
@@ -72,6 +129,10 @@ func start() *libfs.Error {
 		return nil
 	}
 
+	if err := libkbfs.ApplyInitProfile(flag.CommandLine, kbfsParams); err != nil {
+		return libfs.InitError(err.Error())
+	}
+
 	if len(flag.Args()) < 1 {
 		fmt.Print(getUsageStr(ctx))
 		return libfs.InitError("no mount specified")
@@ -90,18 +151,29 @@ func start() *libfs.Error {
 		}
 	}
 
+	mountOptions, err := getMountOptions()
+	if err != nil {
+		return libfs.InitError(err.Error())
+	}
+
 	mountpoint := flag.Arg(0)
 	var mounter libfuse.Mounter
 	if *mountType == "force" {
-		mounter = libfuse.NewForceMounter(mountpoint, *platformParams)
+		mounter = libfuse.NewForceMounter(
+			mountpoint, *platformParams, mountOptions)
 	} else {
-		mounter = libfuse.NewDefaultMounter(mountpoint, *platformParams)
+		mounter = libfuse.NewDefaultMounter(
+			mountpoint, *platformParams, mountOptions)
 	}
 
 	options := libfuse.StartOptions{
-		KbfsParams: *kbfsParams,
-		RuntimeDir: *runtimeDir,
-		Label:      *label,
+		KbfsParams:      *kbfsParams,
+		RuntimeDir:      *runtimeDir,
+		Label:           *label,
+		Subdir:          *subdir,
+		HTTPListenAddr:  *httpListen,
+		DebugListenAddr: *debugListen,
+		MountOptions:    mountOptions,
 	}
 
 	return libfuse.Start(mounter, options, ctx)
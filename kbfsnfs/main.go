@@ -0,0 +1,127 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// Keybase file system, served over NFSv3
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/keybase/kbfs/env"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/keybase/kbfs/libnfs"
+)
+
+var listen = flag.String("listen", "127.0.0.1:2049", "TCP address to serve NFS and MOUNT on")
+var subdir = flag.String("subdir", "", "only export this directory, e.g. private/alice/project")
+var readOnly = flag.Bool("read-only", false, "refuse all changes")
+var allow = flag.String("allow", "", "comma-separated networks clients may connect from, e.g. 192.168.1.0/24 (default: loopback only)")
+var ownerUID = flag.Int("owner-uid", os.Getuid(), "only serve calls made for this uid on the client")
+var secretFile = flag.String("secret-file", "", "file holding a secret that lets clients call from unprivileged ports, by sending it as their AUTH_SYS machine name")
+var version = flag.Bool("version", false, "Print version")
+
+const usageFormatStr = `Usage:
+  kbfsnfs -version
+
+To run against remote KBFS servers:
+  kbfsnfs [-debug] [-cpuprofile=path/to/dir] [-profile=name]
+    [-bserver=%s] [-mdserver=%s]
+    [-listen=host:port] [-subdir=private/user/path/to/dir]
+    [-read-only] [-allow=network[,network...]]
+    [-owner-uid=uid] [-secret-file=path/to/file]
+    [-log-to-file] [-log-file=path/to/file]]
+
+To run in a local testing environment:
+  kbfsnfs [-debug] [-cpuprofile=path/to/dir] [-profile=name]
+    [-server-in-memory|-server-root=path/to/dir] [-localuser=<user>]
+    [-listen=host:port] [-subdir=private/user/path/to/dir]
+    [-read-only] [-allow=network[,network...]]
+    [-owner-uid=uid] [-secret-file=path/to/file]
+    [-log-to-file] [-log-file=path/to/file]]
+
+Calls are only served for -owner-uid, and, unless -secret-file is
+given, only from privileged ports, i.e. from root on the client.
+There's no portmapper, so clients have to be told the port, e.g.:
+  mount -t nfs -o vers=3,proto=tcp,port=2049,mountport=2049,nolock \
+    127.0.0.1:/ /path/to/mountpoint
+
+`
+
+func getUsageStr(ctx libkbfs.Context) string {
+	defaultBServer := libkbfs.GetDefaultBServer(ctx)
+	if len(defaultBServer) == 0 {
+		defaultBServer = "host:port"
+	}
+	defaultMDServer := libkbfs.GetDefaultMDServer(ctx)
+	if len(defaultMDServer) == 0 {
+		defaultMDServer = "host:port"
+	}
+	return fmt.Sprintf(usageFormatStr, defaultBServer, defaultMDServer)
+}
+
+func start() *libfs.Error {
+	ctx := env.NewContext()
+
+	kbfsParams := libkbfs.AddFlags(flag.CommandLine, ctx)
+
+	flag.Parse()
+
+	if *version {
+		fmt.Printf("%s\n", libkbfs.VersionString())
+		return nil
+	}
+
+	if err := libkbfs.ApplyInitProfile(flag.CommandLine, kbfsParams); err != nil {
+		return libfs.InitError(err.Error())
+	}
+
+	if len(flag.Args()) > 0 {
+		fmt.Print(getUsageStr(ctx))
+		return libfs.InitError("extra arguments specified (flags go before the first argument)")
+	}
+
+	networks, err := libnfs.ParseAllowedNetworks(*allow)
+	if err != nil {
+		return libfs.InitError(err.Error())
+	}
+
+	var secret string
+	if *secretFile != "" {
+		b, err := ioutil.ReadFile(*secretFile)
+		if err != nil {
+			return libfs.InitError(err.Error())
+		}
+		secret = strings.TrimSpace(string(b))
+	}
+
+	options := libnfs.StartOptions{
+		KbfsParams: *kbfsParams,
+		Export: libnfs.ExportOptions{
+			Subdir:          *subdir,
+			ReadOnly:        *readOnly,
+			AllowedNetworks: networks,
+			OwnerUID:        uint32(*ownerUID),
+			Secret:          secret,
+		},
+		ListenAddr: *listen,
+	}
+
+	return libnfs.Start(options, ctx)
+}
+
+func main() {
+	err := start()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kbfsnfs error: (%d) %s\n", err.Code, err.Message)
+
+		os.Exit(err.Code)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,110 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// Keybase file system, served over SFTP as an sshd subsystem
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/keybase/kbfs/env"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/keybase/kbfs/libsftp"
+)
+
+var version = flag.Bool("version", false, "Print version")
+var authorizedKeys = flag.Bool("authorized-keys", false,
+	"Print the logged-in user's Keybase keys as SSH authorized keys, and exit")
+var allowAnySSHKey = flag.Bool("allow-any-ssh-key", false,
+	"Serve clients however sshd authenticated them, not just those using a Keybase key")
+
+const usageFormatStr = `Usage:
+  kbfssftp -version
+
+kbfssftp speaks SFTP on stdin and stdout, so it's meant to be run by
+sshd, as a subsystem.  Clients log in with one of the Keybase device
+or paper keys of the user logged in on the host.  Add to sshd_config:
+  Subsystem sftp /path/to/kbfssftp [flags]
+  AuthorizedKeysCommand /path/to/kbfssftp -authorized-keys [flags]
+  AuthorizedKeysCommandUser <user logged in to Keybase>
+  ExposeAuthInfo yes
+
+To run against remote KBFS servers:
+  kbfssftp [-debug] [-cpuprofile=path/to/dir] [-profile=name]
+    [-bserver=%s] [-mdserver=%s]
+    [-log-to-file] [-log-file=path/to/file]]
+
+To run in a local testing environment:
+  kbfssftp [-debug] [-cpuprofile=path/to/dir] [-profile=name]
+    [-server-in-memory|-server-root=path/to/dir] [-localuser=<user>]
+    [-log-to-file] [-log-file=path/to/file]]
+
+`
+
+func getUsageStr(ctx libkbfs.Context) string {
+	defaultBServer := libkbfs.GetDefaultBServer(ctx)
+	if len(defaultBServer) == 0 {
+		defaultBServer = "host:port"
+	}
+	defaultMDServer := libkbfs.GetDefaultMDServer(ctx)
+	if len(defaultMDServer) == 0 {
+		defaultMDServer = "host:port"
+	}
+	return fmt.Sprintf(usageFormatStr, defaultBServer, defaultMDServer)
+}
+
+// stdio is the connection to the SFTP client.
+type stdio struct {
+	io.Reader
+	io.Writer
+}
+
+func start() *libfs.Error {
+	ctx := env.NewContext()
+
+	kbfsParams := libkbfs.AddFlags(flag.CommandLine, ctx)
+
+	flag.Parse()
+
+	if *version {
+		fmt.Printf("%s\n", libkbfs.VersionString())
+		return nil
+	}
+
+	if err := libkbfs.ApplyInitProfile(flag.CommandLine, kbfsParams); err != nil {
+		return libfs.InitError(err.Error())
+	}
+
+	if len(flag.Args()) > 0 {
+		fmt.Fprint(os.Stderr, getUsageStr(ctx))
+		return libfs.InitError("extra arguments specified (flags go before the first argument)")
+	}
+
+	options := libsftp.StartOptions{
+		KbfsParams:     *kbfsParams,
+		AuthInfoFile:   os.Getenv("SSH_USER_AUTH"),
+		AllowAnySSHKey: *allowAnySSHKey,
+	}
+
+	if *authorizedKeys {
+		return libsftp.PrintAuthorizedKeys(options, ctx, os.Stdout)
+	}
+
+	return libsftp.Start(options, ctx, stdio{os.Stdin, os.Stdout})
+}
+
+func main() {
+	err := start()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kbfssftp error: (%d) %s\n", err.Code, err.Message)
+
+		os.Exit(err.Code)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,247 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// An encrypted archive is a tar archive split into chunks, each
+// sealed with secretbox under a key derived from a passphrase with
+// scrypt.  It starts with archiveMagic, then the scrypt salt, then a
+// random nonce prefix.  Each chunk is a big-endian uint32 length
+// followed by that many sealed bytes.  A chunk's nonce is the prefix
+// followed by its index, with the top bit set for the last chunk, so
+// that chunks can't be reordered or dropped, and a truncated archive
+// is detected.
+
+const (
+	archiveTarSuffix       = ".tar"
+	archiveEncryptedSuffix = ".tar.enc"
+
+	archiveMagic           = "KBFSARC1"
+	archiveSaltLen         = 16
+	archiveNoncePrefixLen  = 16
+	archiveChunkSize       = 64 * 1024
+	archiveLastChunkFlag   = uint64(1) << 63
+	archiveScryptN         = 1 << 15
+	archiveScryptR         = 8
+	archiveScryptP         = 1
+	archiveMaxSealedLength = archiveChunkSize + secretbox.Overhead
+)
+
+var errArchiveTruncated = errors.New("encrypted archive is truncated")
+
+// isArchivePath returns whether p names a tar archive, rather than a
+// directory export, and whether that archive is encrypted.
+func isArchivePath(p string) (isArchive, encrypted bool) {
+	switch {
+	case strings.HasSuffix(p, archiveEncryptedSuffix):
+		return true, true
+	case strings.HasSuffix(p, archiveTarSuffix):
+		return true, false
+	}
+	return false, false
+}
+
+// readPassphrase reads the passphrase for an encrypted archive from
+// the first line of the given file.
+func readPassphrase(passphraseFile string) ([]byte, error) {
+	if passphraseFile == "" {
+		return nil, fmt.Errorf(
+			"a passphrase file is needed for %s archives",
+			archiveEncryptedSuffix)
+	}
+	buf, err := ioutil.ReadFile(passphraseFile)
+	if err != nil {
+		return nil, err
+	}
+	if i := bytes.IndexByte(buf, '\n'); i >= 0 {
+		buf = buf[:i]
+	}
+	buf = bytes.TrimSuffix(buf, []byte("\r"))
+	if len(buf) == 0 {
+		return nil, fmt.Errorf("%s has an empty passphrase", passphraseFile)
+	}
+	return buf, nil
+}
+
+func archiveKey(passphrase, salt []byte) (*[32]byte, error) {
+	buf, err := scrypt.Key(passphrase, salt,
+		archiveScryptN, archiveScryptR, archiveScryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	var key [32]byte
+	copy(key[:], buf)
+	return &key, nil
+}
+
+func archiveNonce(prefix []byte, index uint64, last bool) *[24]byte {
+	var nonce [24]byte
+	copy(nonce[:], prefix)
+	if last {
+		index |= archiveLastChunkFlag
+	}
+	binary.BigEndian.PutUint64(nonce[archiveNoncePrefixLen:], index)
+	return &nonce
+}
+
+// archiveEncrypter encrypts everything written to it into an
+// encrypted archive.  It must be closed to write the last chunk.
+type archiveEncrypter struct {
+	w      io.Writer
+	key    *[32]byte
+	prefix []byte
+	index  uint64
+	buf    []byte
+}
+
+var _ io.WriteCloser = (*archiveEncrypter)(nil)
+
+func newArchiveEncrypter(w io.Writer, passphrase []byte) (
+	*archiveEncrypter, error) {
+	header := make([]byte, archiveSaltLen+archiveNoncePrefixLen)
+	_, err := rand.Read(header)
+	if err != nil {
+		return nil, err
+	}
+	salt, prefix := header[:archiveSaltLen], header[archiveSaltLen:]
+	key, err := archiveKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(append([]byte(archiveMagic), header...))
+	if err != nil {
+		return nil, err
+	}
+	return &archiveEncrypter{w: w, key: key, prefix: prefix}, nil
+}
+
+func (e *archiveEncrypter) sealChunk(chunk []byte, last bool) error {
+	sealed := secretbox.Seal(nil, chunk,
+		archiveNonce(e.prefix, e.index, last), e.key)
+	e.index++
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(sealed)))
+	_, err := e.w.Write(append(length[:], sealed...))
+	return err
+}
+
+func (e *archiveEncrypter) Write(p []byte) (int, error) {
+	e.buf = append(e.buf, p...)
+	// Hold back a full chunk, since it may turn out to be the
+	// last one.
+	for len(e.buf) > archiveChunkSize {
+		err := e.sealChunk(e.buf[:archiveChunkSize], false)
+		if err != nil {
+			return 0, err
+		}
+		e.buf = e.buf[archiveChunkSize:]
+	}
+	return len(p), nil
+}
+
+// Close writes the last chunk, which may be empty.  It doesn't close
+// the underlying writer.
+func (e *archiveEncrypter) Close() error {
+	err := e.sealChunk(e.buf, true)
+	e.buf = nil
+	return err
+}
+
+// archiveDecrypter decrypts an encrypted archive read from r.
+type archiveDecrypter struct {
+	r      io.Reader
+	key    *[32]byte
+	prefix []byte
+	index  uint64
+	buf    []byte
+	done   bool
+}
+
+var _ io.Reader = (*archiveDecrypter)(nil)
+
+func newArchiveDecrypter(r io.Reader, passphrase []byte) (
+	*archiveDecrypter, error) {
+	header := make([]byte,
+		len(archiveMagic)+archiveSaltLen+archiveNoncePrefixLen)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	if string(header[:len(archiveMagic)]) != archiveMagic {
+		return nil, errors.New("not an encrypted KBFS archive")
+	}
+	header = header[len(archiveMagic):]
+	salt, prefix := header[:archiveSaltLen], header[archiveSaltLen:]
+	key, err := archiveKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	return &archiveDecrypter{r: r, key: key, prefix: prefix}, nil
+}
+
+func (d *archiveDecrypter) openChunk() error {
+	var length [4]byte
+	_, err := io.ReadFull(d.r, length[:])
+	if err == io.EOF {
+		return errArchiveTruncated
+	} else if err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n > archiveMaxSealedLength {
+		return fmt.Errorf("encrypted archive chunk %d is too big: %d",
+			d.index, n)
+	}
+	sealed := make([]byte, n)
+	_, err = io.ReadFull(d.r, sealed)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errArchiveTruncated
+	} else if err != nil {
+		return err
+	}
+
+	chunk, ok := secretbox.Open(nil, sealed,
+		archiveNonce(d.prefix, d.index, false), d.key)
+	if !ok {
+		chunk, ok = secretbox.Open(nil, sealed,
+			archiveNonce(d.prefix, d.index, true), d.key)
+		if !ok {
+			return fmt.Errorf("could not decrypt archive chunk %d; "+
+				"wrong passphrase?", d.index)
+		}
+		d.done = true
+	}
+	d.index++
+	d.buf = chunk
+	return nil
+}
+
+func (d *archiveDecrypter) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		err := d.openChunk()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const auditUsageStr = `Usage:
+  kbfstool audit [-v] /keybase/[public|private]/user1,assertion2 [tlfs...]
+
+Fetches every block reachable from the head of each TLF, and reports
+any that are missing, corrupt, or referenced more than once.
+
+`
+
+func printAuditProblems(kind string, problems []libkbfs.BlockAuditProblem,
+	verbose bool) {
+	for _, problem := range problems {
+		if verbose {
+			fmt.Printf("  %s: %s (%v): %v\n",
+				kind, problem.Path, problem.Ptr, problem.Err)
+		} else {
+			fmt.Printf("  %s: %s: %v\n", kind, problem.Path, problem.Err)
+		}
+	}
+}
+
+func auditOne(ctx context.Context, config libkbfs.Config,
+	tlfStr string, verbose bool) (clean bool, err error) {
+	handle, err := getTlfHandle(ctx, config, tlfStr)
+	if err != nil {
+		return false, err
+	}
+
+	report, err := config.KBFSOps().AuditTLF(ctx, handle)
+	if err != nil {
+		return false, err
+	}
+
+	fmt.Printf("%s (TLF %s, revision %d): checked %d blocks\n",
+		tlfStr, report.Tlf, report.Revision, report.BlocksChecked)
+	printAuditProblems("missing", report.Missing, verbose)
+	printAuditProblems("corrupt", report.Corrupt, verbose)
+	printAuditProblems("duplicate ref", report.DuplicateRefs, verbose)
+	return report.IsClean(), nil
+}
+
+func audit(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs audit", flag.ContinueOnError)
+	verbose := flags.Bool("v", false, "Print block pointers for problems.")
+	flags.Parse(args)
+
+	inputs := flags.Args()
+	if len(inputs) < 1 {
+		fmt.Print(auditUsageStr)
+		return 1
+	}
+
+	for _, input := range inputs {
+		clean, err := auditOne(ctx, config, input, *verbose)
+		if err != nil {
+			printError("audit", err)
+			return 1
+		}
+		if !clean {
+			exitStatus = 1
+		}
+	}
+
+	return exitStatus
+}
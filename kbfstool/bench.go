@@ -0,0 +1,90 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const benchUsageStr = `Usage:
+  kbfstool bench [-bench=regexp] [-benchtime=duration] /keybase/[public|private]/user1,assertion2/dir
+  kbfstool bench -list
+
+Runs the core I/O benchmarks against the configured servers, in new
+subdirectories of the given directory, which is left with one
+subdirectory per benchmark run for you to remove.  Results are printed
+the way "go test -bench" prints them, so runs against different
+releases can be compared with benchcmp or benchstat.  The benchmarks
+that need a journal are skipped unless journaling is on.
+
+The benchmarks are:
+  %s
+
+`
+
+func benchHelper(ctx context.Context, config libkbfs.Config,
+	dirPathStr, pattern string, benchTime time.Duration) error {
+	p, err := fsrpc.NewPath(dirPathStr)
+	if err != nil {
+		return err
+	}
+	if p.PathType != fsrpc.TLFPathType {
+		return cannotWriteErr{dirPathStr, nil}
+	}
+	dir, err := p.GetDirNode(ctx, config)
+	if err != nil {
+		return err
+	}
+	return libkbfs.RunBenchmarks(ctx, config, dir, pattern, benchTime,
+		func(r libkbfs.BenchResult) {
+			fmt.Println(r)
+		})
+}
+
+func bench(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs bench", flag.ContinueOnError)
+	pattern := flags.String("bench", ".",
+		"Run only the benchmarks matching this regexp.")
+	benchTime := flags.Duration("benchtime", time.Second,
+		"Run each benchmark for at least this long.")
+	list := flags.Bool("list", false, "List the benchmarks and exit.")
+	flags.Parse(args)
+
+	usage := fmt.Sprintf(benchUsageStr,
+		strings.Join(libkbfs.BenchNames(), "\n  "))
+	if *list {
+		fmt.Print(strings.Join(libkbfs.BenchNames(), "\n") + "\n")
+		return 0
+	}
+	if flags.NArg() != 1 {
+		fmt.Print(usage)
+		return 1
+	}
+
+	// Syncs need a context that can delay its cancellation, as the
+	// mounted file systems give them.
+	ctx, err := libkbfs.NewContextWithCancellationDelayer(
+		libkbfs.NewContextReplayable(ctx,
+			func(ctx context.Context) context.Context { return ctx }))
+	if err != nil {
+		printError("bench", err)
+		return 1
+	}
+	defer libkbfs.CleanupCancellationDelayer(ctx)
+
+	err = benchHelper(ctx, config, flags.Arg(0), *pattern, *benchTime)
+	if err != nil {
+		printError("bench", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,165 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const blockGetUsageStr = `Usage:
+  kbfstool block get [-dir] /keybase/[public|private]/user1,assertion2 pointer
+
+pointer is a block pointer as printed by md dump or block refs, e.g.
+
+  'BlockPointer{ID: 01ab..., KeyGen: 1, DataVer: 1, Context: BlockContext{Creator: 23cd...}}'
+
+Fetches the block with the pointer's context, verifies and decrypts
+it with the TLF's keys, and decodes it as a file block, or as a
+directory block if -dir is given.  The contents of a direct file
+block are written to stdout as they are; anything else is listed.
+
+`
+
+var blockPointerRegexp = regexp.MustCompile(
+	`^BlockPointer\{ID: ([0-9a-f]+), KeyGen: (-?[0-9]+), ` +
+		`DataVer: ([0-9]+), Context: BlockContext\{Creator: ([0-9a-f]+)` +
+		`(?:, Writer: ([0-9a-f]+))?(?:, RefNonce: ([0-9a-f]{16}))?\}\}$`)
+
+// parseBlockPointer parses the String() of a libkbfs.BlockPointer.
+func parseBlockPointer(s string) (libkbfs.BlockPointer, error) {
+	matches := blockPointerRegexp.FindStringSubmatch(s)
+	if matches == nil {
+		return libkbfs.BlockPointer{},
+			fmt.Errorf("Could not parse block pointer %q", s)
+	}
+
+	var ptr libkbfs.BlockPointer
+	var err error
+	ptr.ID, err = libkbfs.BlockIDFromString(matches[1])
+	if err != nil {
+		return libkbfs.BlockPointer{}, err
+	}
+	keyGen, err := strconv.Atoi(matches[2])
+	if err != nil {
+		return libkbfs.BlockPointer{}, err
+	}
+	ptr.KeyGen = libkbfs.KeyGen(keyGen)
+	dataVer, err := strconv.Atoi(matches[3])
+	if err != nil {
+		return libkbfs.BlockPointer{}, err
+	}
+	ptr.DataVer = libkbfs.DataVer(dataVer)
+	ptr.Creator, err = keybase1.UIDFromString(matches[4])
+	if err != nil {
+		return libkbfs.BlockPointer{}, err
+	}
+	if matches[5] != "" {
+		writer, err := keybase1.UIDFromString(matches[5])
+		if err != nil {
+			return libkbfs.BlockPointer{}, err
+		}
+		ptr.SetWriter(writer)
+	}
+	if matches[6] != "" {
+		n, err := strconv.ParseUint(matches[6], 16, 64)
+		if err != nil {
+			return libkbfs.BlockPointer{}, err
+		}
+		for i := len(ptr.RefNonce) - 1; i >= 0; i-- {
+			ptr.RefNonce[i] = byte(n)
+			n >>= 8
+		}
+	}
+	return ptr, nil
+}
+
+func blockGetFile(ctx context.Context, config libkbfs.Config,
+	head libkbfs.ImmutableRootMetadata, ptr libkbfs.BlockPointer) error {
+	var fblock libkbfs.FileBlock
+	err := config.BlockOps().Get(ctx, head, ptr, &fblock)
+	if err != nil {
+		return err
+	}
+	if !fblock.IsInd {
+		_, err = os.Stdout.Write(fblock.Contents)
+		return err
+	}
+	for _, iptr := range fblock.IPtrs {
+		fmt.Printf("off=%d holes=%t: %v\n", iptr.Off, iptr.Holes,
+			iptr.BlockInfo)
+	}
+	return nil
+}
+
+func blockGetDir(ctx context.Context, config libkbfs.Config,
+	head libkbfs.ImmutableRootMetadata, ptr libkbfs.BlockPointer) error {
+	var dblock libkbfs.DirBlock
+	err := config.BlockOps().Get(ctx, head, ptr, &dblock)
+	if err != nil {
+		return err
+	}
+	for _, iptr := range dblock.IPtrs {
+		fmt.Printf("off=%q: %v\n", iptr.Off, iptr.BlockInfo)
+	}
+	names := make([]string, 0, len(dblock.Children))
+	for name := range dblock.Children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		de := dblock.Children[name]
+		if de.Type == libkbfs.Sym {
+			fmt.Printf("%s (%s) -> %s\n", name, de.Type, de.SymPath)
+			continue
+		}
+		fmt.Printf("%s (%s, %s): %v\n", name, de.Type,
+			byteCountStr(int(de.Size)), de.BlockInfo)
+	}
+	return nil
+}
+
+func blockGet(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs block get", flag.ContinueOnError)
+	isDir := flags.Bool("dir", false, "Decode the block as a directory block.")
+	flags.Parse(args)
+
+	inputs := flags.Args()
+	if len(inputs) != 2 {
+		fmt.Print(blockGetUsageStr)
+		return 1
+	}
+
+	ptr, err := parseBlockPointer(inputs[1])
+	if err != nil {
+		printError("block get", err)
+		return 1
+	}
+	// The head has the keys for every key generation.
+	head, _, err := getBlockTLFHead(ctx, config, inputs[0], ptr.ID.String())
+	if err != nil {
+		printError("block get", err)
+		return 1
+	}
+
+	if *isDir {
+		err = blockGetDir(ctx, config, head, ptr)
+	} else {
+		err = blockGetFile(ctx, config, head, ptr)
+	}
+	if err != nil {
+		printError("block get", err)
+		return 1
+	}
+	return 0
+}
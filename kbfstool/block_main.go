@@ -0,0 +1,44 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const blockUsageStr = `Usage:
+  kbfstool block [<subcommand>] [<args>]
+
+The possible subcommands are:
+  stat		Show a block's size, references and reference status
+  get		Fetch and decrypt a block, and dump it to stdout
+  refs		Find everything that references a block
+
+`
+
+func blockMain(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	if len(args) < 1 {
+		fmt.Print(blockUsageStr)
+		return 1
+	}
+
+	cmd := args[0]
+	args = args[1:]
+
+	switch cmd {
+	case "stat":
+		return blockStat(ctx, config, args)
+	case "get":
+		return blockGet(ctx, config, args)
+	case "refs":
+		return blockRefs(ctx, config, args)
+	default:
+		printError("block", fmt.Errorf("unknown command '%s'", cmd))
+		return 1
+	}
+}
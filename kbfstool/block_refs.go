@@ -0,0 +1,248 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path"
+	"sort"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const blockRefsUsageStr = `Usage:
+  kbfstool block refs /keybase/[public|private]/user1,assertion2 blockID
+
+Goes through every merged MD revision of the TLF, and every block
+reachable from its head, and prints each place the block with the
+given ID is referenced from, along with the full pointer used there,
+which block get takes.
+
+`
+
+// blockRefKind says how a block is referenced.
+type blockRefKind int
+
+const (
+	// The block is reachable from the head.
+	blockRefHead blockRefKind = iota
+	// An op in the revision referenced the block.
+	blockRefRef
+	// An op in the revision unreferenced the block.
+	blockRefUnref
+	// An op in the revision replaced the block with another one,
+	// which leaves it archived for history.
+	blockRefReplaced
+	// The block holds the revision's changes.
+	blockRefChanges
+)
+
+// blockReference is one place a block is referenced from.
+type blockReference struct {
+	ptr      libkbfs.BlockPointer
+	revision libkbfs.MetadataRevision
+	kind     blockRefKind
+	// where says what referenced the block: an op for history
+	// references, and a path for references from the head.
+	where string
+}
+
+func (r blockReference) String() string {
+	switch r.kind {
+	case blockRefHead:
+		return fmt.Sprintf("revision %s (head): at %s", r.revision, r.where)
+	case blockRefRef:
+		return fmt.Sprintf("revision %s: referenced by %s",
+			r.revision, r.where)
+	case blockRefUnref:
+		return fmt.Sprintf("revision %s: unreferenced by %s",
+			r.revision, r.where)
+	case blockRefReplaced:
+		return fmt.Sprintf("revision %s: replaced by %s", r.revision, r.where)
+	case blockRefChanges:
+		return fmt.Sprintf("revision %s: MD changes block", r.revision)
+	}
+	return fmt.Sprintf("revision %s: %s", r.revision, r.where)
+}
+
+type blockRefFinder struct {
+	config libkbfs.Config
+	id     libkbfs.BlockID
+	head   libkbfs.ImmutableRootMetadata
+	refs   []blockReference
+	// unscanned counts revisions whose changes are in a separate
+	// block, and so weren't scanned.
+	unscanned int
+}
+
+func (f *blockRefFinder) add(ptr libkbfs.BlockPointer,
+	rev libkbfs.MetadataRevision, kind blockRefKind, where string) {
+	if ptr.ID == f.id {
+		f.refs = append(f.refs, blockReference{ptr, rev, kind, where})
+	}
+}
+
+func (f *blockRefFinder) scanHistory(ctx context.Context) error {
+	tlfID := f.head.TlfID()
+	for start := libkbfs.MetadataRevisionInitial; start <= f.head.Revision(); start += mdBatchSize {
+		end := start + mdBatchSize - 1
+		if end > f.head.Revision() {
+			end = f.head.Revision()
+		}
+		irmds, err := mdGetRange(
+			ctx, f.config, tlfID, libkbfs.NullBranchID, start, end)
+		if err != nil {
+			return err
+		}
+
+		for _, irmd := range irmds {
+			rev := irmd.Revision()
+			data := irmd.Data()
+			if changes := data.ChangesBlockInfo(); changes != (libkbfs.BlockInfo{}) {
+				f.add(changes.BlockPointer, rev, blockRefChanges, "")
+				if len(data.Changes.Ops) == 0 {
+					f.unscanned++
+				}
+			}
+			for _, op := range data.Changes.Ops {
+				where := op.String()
+				for _, ptr := range op.Refs() {
+					f.add(ptr, rev, blockRefRef, where)
+				}
+				for _, ptr := range op.Unrefs() {
+					f.add(ptr, rev, blockRefUnref, where)
+				}
+				for _, update := range op.AllUpdates() {
+					f.add(update.Unref, rev, blockRefReplaced, where)
+					f.add(update.Ref, rev, blockRefRef, where)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (f *blockRefFinder) scanFile(ctx context.Context, p string,
+	info libkbfs.BlockInfo) {
+	f.add(info.BlockPointer, f.head.Revision(), blockRefHead, p)
+	var fblock libkbfs.FileBlock
+	err := f.config.BlockOps().Get(ctx, f.head, info.BlockPointer, &fblock)
+	if err != nil {
+		printError("block refs", fmt.Errorf("%s: %v", p, err))
+		return
+	}
+	for _, iptr := range fblock.IPtrs {
+		f.scanFile(ctx, fmt.Sprintf("%s (off=%d)", p, iptr.Off),
+			iptr.BlockInfo)
+	}
+}
+
+func (f *blockRefFinder) scanDir(ctx context.Context, p string,
+	info libkbfs.BlockInfo) {
+	f.add(info.BlockPointer, f.head.Revision(), blockRefHead, p)
+	var dblock libkbfs.DirBlock
+	err := f.config.BlockOps().Get(ctx, f.head, info.BlockPointer, &dblock)
+	if err != nil {
+		printError("block refs", fmt.Errorf("%s: %v", p, err))
+		return
+	}
+	for _, iptr := range dblock.IPtrs {
+		f.scanDir(ctx, fmt.Sprintf("%s (dir block %q)", p, iptr.Off),
+			iptr.BlockInfo)
+	}
+	for name, de := range dblock.Children {
+		switch de.Type {
+		case libkbfs.File, libkbfs.Exec:
+			f.scanFile(ctx, path.Join(p, name), de.BlockInfo)
+		case libkbfs.Dir:
+			f.scanDir(ctx, path.Join(p, name), de.BlockInfo)
+		}
+	}
+}
+
+// findBlockReferences returns every reference to the block with the
+// given ID in the merged history of head's TLF and the tree
+// reachable from head, sorted by revision, along with the number of
+// revisions whose changes couldn't be scanned.
+func findBlockReferences(ctx context.Context, config libkbfs.Config,
+	head libkbfs.ImmutableRootMetadata, id libkbfs.BlockID) (
+	refs []blockReference, unscanned int, err error) {
+	f := &blockRefFinder{config: config, id: id, head: head}
+	err = f.scanHistory(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	f.scanDir(ctx, "/", head.Data().Dir.BlockInfo)
+	sort.Stable(blockReferencesByRevision(f.refs))
+	return f.refs, f.unscanned, nil
+}
+
+type blockReferencesByRevision []blockReference
+
+func (r blockReferencesByRevision) Len() int      { return len(r) }
+func (r blockReferencesByRevision) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r blockReferencesByRevision) Less(i, j int) bool {
+	return r[i].revision < r[j].revision
+}
+
+// getBlockTLFHead parses a TLF and a block ID, and returns the TLF's
+// merged head.
+func getBlockTLFHead(ctx context.Context, config libkbfs.Config,
+	tlfStr, idStr string) (
+	libkbfs.ImmutableRootMetadata, libkbfs.BlockID, error) {
+	id, err := libkbfs.BlockIDFromString(idStr)
+	if err != nil {
+		return libkbfs.ImmutableRootMetadata{}, libkbfs.BlockID{}, err
+	}
+	tlfID, err := getTlfID(ctx, config, tlfStr)
+	if err != nil {
+		return libkbfs.ImmutableRootMetadata{}, libkbfs.BlockID{}, err
+	}
+	head, err := config.MDOps().GetForTLF(ctx, tlfID)
+	if err != nil {
+		return libkbfs.ImmutableRootMetadata{}, libkbfs.BlockID{}, err
+	}
+	if head == (libkbfs.ImmutableRootMetadata{}) {
+		return libkbfs.ImmutableRootMetadata{}, libkbfs.BlockID{},
+			fmt.Errorf("%q has no revisions", tlfStr)
+	}
+	return head, id, nil
+}
+
+func blockRefs(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs block refs", flag.ContinueOnError)
+	flags.Parse(args)
+
+	inputs := flags.Args()
+	if len(inputs) != 2 {
+		fmt.Print(blockRefsUsageStr)
+		return 1
+	}
+
+	head, id, err := getBlockTLFHead(ctx, config, inputs[0], inputs[1])
+	if err != nil {
+		printError("block refs", err)
+		return 1
+	}
+	refs, unscanned, err := findBlockReferences(ctx, config, head, id)
+	if err != nil {
+		printError("block refs", err)
+		return 1
+	}
+
+	for _, ref := range refs {
+		fmt.Printf("%s\n  %v\n", ref, ref.ptr)
+	}
+	if len(refs) == 0 {
+		fmt.Printf("No references to %s found\n", id)
+	}
+	if unscanned > 0 {
+		fmt.Printf("%d revisions with separate changes blocks "+
+			"weren't scanned\n", unscanned)
+	}
+	return 0
+}
@@ -0,0 +1,115 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const blockStatUsageStr = `Usage:
+  kbfstool block stat /keybase/[public|private]/user1,assertion2 blockID
+
+Prints the block's status in the TLF: whether it's reachable from
+the head, or else the revision that archived or unreferenced it, along
+with the revisions that reference it.  Each distinct reference to the
+block is also looked up on the block server, which gives the block's
+(encrypted) size, or why the server doesn't have it.
+
+`
+
+// blockStatus describes where a block stands in its TLF, given every
+// reference to it.
+func blockStatus(refs []blockReference) string {
+	var lastUnref, lastReplaced libkbfs.MetadataRevision
+	for _, ref := range refs {
+		switch ref.kind {
+		case blockRefHead:
+			return "live (reachable from the head)"
+		case blockRefUnref:
+			lastUnref = ref.revision
+		case blockRefReplaced:
+			lastReplaced = ref.revision
+		}
+	}
+	switch {
+	case lastUnref != libkbfs.MetadataRevisionUninitialized:
+		return fmt.Sprintf("unreferenced at revision %s", lastUnref)
+	case lastReplaced != libkbfs.MetadataRevisionUninitialized:
+		return fmt.Sprintf("archived at revision %s", lastReplaced)
+	case len(refs) > 0:
+		return "referenced, but not reachable from the head"
+	}
+	return "not referenced"
+}
+
+// blockServerStatus looks up one reference to a block on the block
+// server.
+func blockServerStatus(ctx context.Context, config libkbfs.Config,
+	tlfID libkbfs.TlfID, ptr libkbfs.BlockPointer) string {
+	buf, _, err := config.BlockServer().Get(
+		ctx, tlfID, ptr.ID, ptr.BlockContext)
+	switch err.(type) {
+	case nil:
+		return fmt.Sprintf("OK, %s", byteCountStr(len(buf)))
+	case libkbfs.BServerErrorBlockNonExistent:
+		return "non-existent"
+	case libkbfs.BServerErrorBlockDeleted:
+		return "deleted"
+	default:
+		return fmt.Sprintf("error: %v", err)
+	}
+}
+
+func blockStat(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs block stat", flag.ContinueOnError)
+	flags.Parse(args)
+
+	inputs := flags.Args()
+	if len(inputs) != 2 {
+		fmt.Print(blockStatUsageStr)
+		return 1
+	}
+
+	head, id, err := getBlockTLFHead(ctx, config, inputs[0], inputs[1])
+	if err != nil {
+		printError("block stat", err)
+		return 1
+	}
+	refs, unscanned, err := findBlockReferences(ctx, config, head, id)
+	if err != nil {
+		printError("block stat", err)
+		return 1
+	}
+
+	fmt.Printf("Block %s (head is revision %s)\n", id, head.Revision())
+	fmt.Printf("Status: %s\n", blockStatus(refs))
+
+	var revs []libkbfs.MetadataRevision
+	for _, ref := range refs {
+		if len(revs) == 0 || revs[len(revs)-1] != ref.revision {
+			revs = append(revs, ref.revision)
+		}
+	}
+	fmt.Printf("Referenced in revisions: %v\n", revs)
+	if unscanned > 0 {
+		fmt.Printf("(%d revisions with separate changes blocks "+
+			"weren't scanned)\n", unscanned)
+	}
+
+	seen := make(map[libkbfs.BlockContext]bool)
+	for _, ref := range refs {
+		if seen[ref.ptr.BlockContext] {
+			continue
+		}
+		seen[ref.ptr.BlockContext] = true
+		fmt.Printf("%v\n  server: %s\n", ref.ptr.BlockContext,
+			blockServerStatus(ctx, config, head.TlfID(), ref.ptr))
+	}
+	return 0
+}
@@ -0,0 +1,338 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+const branchUsageStr = `Usage:
+  kbfstool branch [-mount=/keybase] <subcommand> [<args>]
+
+Like the journal commands, these don't start KBFS themselves, but
+talk to the KBFS instance that has the file system mounted at the
+given mount point, since a device's unmerged branch, and the journal
+that may be holding it, belong to that instance.
+
+The possible subcommands are:
+  status tlf [tlfs...]	Show whether TLFs are on unmerged branches, and why
+  resolve tlf [tlfs...]	Force a conflict resolution attempt
+  discard tlf outdir	Export a TLF's unmerged view to outdir, then,
+			once confirmed, throw its unmerged branch away
+
+`
+
+// branchChainSummary is a summary of the changes made to one path
+// on one side of a conflict.
+type branchChainSummary struct {
+	Path string
+	Ops  []string
+}
+
+// branchTLFStatus is the part of a TLF's status file that the branch
+// commands use.
+type branchTLFStatus struct {
+	Staged       bool
+	BranchID     string
+	FolderID     string
+	Revision     libkbfs.MetadataRevision
+	Unmerged     []branchChainSummary
+	Merged       []branchChainSummary
+	CRInProgress bool
+	CRHeld       bool
+	LastCRError  string
+}
+
+// branchExportManifest is written by branch discard.  Unlike the
+// manifest written by export, it isn't signed, since it's made from
+// outside of KBFS.
+type branchExportManifest struct {
+	Tlf      string
+	TlfID    string
+	BranchID string
+	Revision libkbfs.MetadataRevision
+	Time     time.Time
+	Entries  []exportEntry
+}
+
+func readBranchTLFStatus(mount, tlfStr string) (
+	dir string, status branchTLFStatus, err error) {
+	dir, err = journalTLFDir(mount, tlfStr)
+	if err != nil {
+		return "", branchTLFStatus{}, err
+	}
+	err = readStatusFile(dir, &status)
+	if err != nil {
+		return "", branchTLFStatus{}, err
+	}
+	return dir, status, nil
+}
+
+func printChainSummaries(title string, summaries []branchChainSummary) {
+	if len(summaries) == 0 {
+		return
+	}
+	fmt.Printf("  %s:\n", title)
+	for _, s := range summaries {
+		fmt.Printf("    %s: %s\n", s.Path, strings.Join(s.Ops, ", "))
+	}
+}
+
+func branchStatus(mount string, tlfStrs []string) error {
+	for _, tlfStr := range tlfStrs {
+		_, status, err := readBranchTLFStatus(mount, tlfStr)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s:\n", tlfStr)
+		if !status.Staged {
+			fmt.Printf("  merged, at revision %d\n", status.Revision)
+			continue
+		}
+		fmt.Printf("  on unmerged branch %s, at revision %d\n",
+			status.BranchID, status.Revision)
+		switch {
+		case status.CRInProgress:
+			fmt.Print("  conflict resolution: in progress\n")
+		case status.CRHeld:
+			fmt.Print("  conflict resolution: held for manual resolution\n")
+		case status.LastCRError != "":
+			fmt.Printf("  conflict resolution: last attempt failed: %s\n",
+				status.LastCRError)
+		default:
+			fmt.Print("  conflict resolution: waiting\n")
+		}
+		printChainSummaries("unmerged changes", status.Unmerged)
+		printChainSummaries("merged changes since the branch point",
+			status.Merged)
+	}
+	return nil
+}
+
+func branchResolve(mount string, tlfStrs []string) error {
+	for _, tlfStr := range tlfStrs {
+		dir, status, err := readBranchTLFStatus(mount, tlfStr)
+		if err != nil {
+			return err
+		}
+		if !status.Staged {
+			fmt.Printf("%s is not on an unmerged branch\n", tlfStr)
+			continue
+		}
+		// The write returns once resolution has taken the TLF
+		// off of its branch, or failed.
+		err = ioutil.WriteFile(
+			filepath.Join(dir, libfs.ResolveMergedFileName),
+			[]byte("on"), 0644)
+		if err != nil {
+			return fmt.Errorf("%s: %v", tlfStr, err)
+		}
+		fmt.Printf("%s resolved\n", tlfStr)
+	}
+	return nil
+}
+
+// exportMountedFile copies the file at src to dst, and returns its
+// hash.
+func exportMountedFile(src, dst string, mode os.FileMode) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, h), in)
+	if err != nil {
+		return "", err
+	}
+	if err := out.Sync(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// exportMountedTLF copies everything under the mounted TLF directory
+// dir into outDir, laid out like the output of export.
+func exportMountedTLF(dir, outDir, tlfStr string,
+	status branchTLFStatus) (int, error) {
+	filesDir := filepath.Join(outDir, exportFilesDir)
+	err := os.MkdirAll(filesDir, 0755)
+	if err != nil {
+		return 0, err
+	}
+
+	manifest := branchExportManifest{
+		Tlf:      tlfStr,
+		TlfID:    status.FolderID,
+		BranchID: status.BranchID,
+		Revision: status.Revision,
+		Time:     time.Now(),
+	}
+	err = filepath.Walk(dir, func(
+		p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == dir {
+			return nil
+		}
+		if strings.HasPrefix(fi.Name(), ".kbfs_") {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		localPath := filepath.Join(filesDir, rel)
+		entry := exportEntry{
+			Path:  rel,
+			Mtime: fi.ModTime().UnixNano(),
+		}
+
+		switch {
+		case fi.IsDir():
+			entry.Type = libkbfs.Dir.String()
+			err = os.MkdirAll(localPath, 0755)
+		case fi.Mode()&os.ModeSymlink != 0:
+			entry.Type = libkbfs.Sym.String()
+			entry.SymPath, err = os.Readlink(p)
+			if err == nil {
+				err = os.Symlink(entry.SymPath, localPath)
+			}
+		default:
+			entry.Type = libkbfs.File.String()
+			mode := os.FileMode(0644)
+			if fi.Mode()&0100 != 0 {
+				entry.Type = libkbfs.Exec.String()
+				mode = 0755
+			}
+			entry.Size = uint64(fi.Size())
+			entry.SHA256, err = exportMountedFile(p, localPath, mode)
+		}
+		if err != nil {
+			return err
+		}
+		manifest.Entries = append(manifest.Entries, entry)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	buf, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	err = writeFileAtomically(
+		filepath.Join(outDir, exportManifestFile), append(buf, '\n'))
+	if err != nil {
+		return 0, err
+	}
+	return len(manifest.Entries), nil
+}
+
+func branchDiscard(mount, tlfStr, outDir string, confirm io.Reader) error {
+	dir, status, err := readBranchTLFStatus(mount, tlfStr)
+	if err != nil {
+		return err
+	}
+	if !status.Staged {
+		return fmt.Errorf("%s is not on an unmerged branch", tlfStr)
+	}
+
+	n, err := exportMountedTLF(dir, outDir, tlfStr, status)
+	if err != nil {
+		return fmt.Errorf("exporting %s: %v", tlfStr, err)
+	}
+	fmt.Printf("Exported %d entries of %s to %s\n", n, tlfStr, outDir)
+
+	fmt.Printf("This throws away every unmerged change to %s on branch "+
+		"%s.\nType the TLF name to confirm: ", tlfStr, status.BranchID)
+	line, err := bufio.NewReader(confirm).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if strings.TrimSpace(line) != tlfStr {
+		return fmt.Errorf("not confirmed; %s was left as it is", tlfStr)
+	}
+
+	err = ioutil.WriteFile(
+		filepath.Join(dir, libfs.ResolveKeepRemoteFileName),
+		[]byte("on"), 0644)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Discarded the unmerged branch of %s\n", tlfStr)
+	return nil
+}
+
+func branchMain(args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs branch", flag.ContinueOnError)
+	mount := flags.String("mount", "/keybase",
+		"Where the KBFS instance to talk to is mounted.")
+	flags.Parse(args)
+
+	args = flags.Args()
+	if len(args) < 1 {
+		fmt.Print(branchUsageStr)
+		return 1
+	}
+
+	cmd := args[0]
+	args = args[1:]
+
+	var err error
+	switch cmd {
+	case "status":
+		if len(args) < 1 {
+			err = errAtLeastOnePath
+			break
+		}
+		err = branchStatus(*mount, args)
+	case "resolve":
+		if len(args) < 1 {
+			err = errAtLeastOnePath
+			break
+		}
+		err = branchResolve(*mount, args)
+	case "discard":
+		if len(args) != 2 {
+			fmt.Print(branchUsageStr)
+			return 1
+		}
+		err = branchDiscard(*mount, args[0], args[1], os.Stdin)
+	default:
+		err = fmt.Errorf("unknown command '%s'", cmd)
+	}
+	if err != nil {
+		printError("branch", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,105 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const duUsageStr = `Usage:
+  kbfstool du [-json] /keybase/[public|private]/user1,assertion2[/path]...
+
+Walks each given file or directory, without going through a mount,
+and prints the logical size of its files, the bytes its blocks take
+up on the block server, and how many files, directories and symlinks
+it holds, broken down by each of its direct children.  For the root
+of a TLF, the bytes of archived blocks, which only older revisions
+still reference, are printed too.
+
+`
+
+func duPrintRow(w *tabwriter.Writer, name string, usage libkbfs.SubtreeUsage) {
+	fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%d\t  %s\n", usage.LogicalBytes,
+		usage.BlockBytes, usage.Files, usage.Dirs, usage.Symlinks, name)
+}
+
+func duNode(ctx context.Context, config libkbfs.Config,
+	nodePathStr string, asJSON bool) error {
+	p, err := fsrpc.NewPath(nodePathStr)
+	if err != nil {
+		return err
+	}
+	if p.PathType != fsrpc.TLFPathType {
+		return fmt.Errorf("%q is not a path within a TLF", nodePathStr)
+	}
+	n, _, err := p.GetNode(ctx, config)
+	if err != nil {
+		return err
+	}
+	usage, err := config.KBFSOps().GetSubtreeUsage(ctx, n)
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		buf, err := json.MarshalIndent(usage, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", buf)
+		return nil
+	}
+
+	names := make([]string, 0, len(usage.Children))
+	for name := range usage.Children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprint(w, "LOGICAL\tBLOCKS\tFILES\tDIRS\tLINKS\t\n")
+	for _, name := range names {
+		duPrintRow(w, p.String()+"/"+name, usage.Children[name])
+	}
+	duPrintRow(w, p.String(), usage)
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	if usage.ArchivedBytes > 0 {
+		fmt.Printf("%s archived\n", byteCountStr(int(usage.ArchivedBytes)))
+	}
+	return nil
+}
+
+func du(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs du", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "Print the usage as JSON.")
+	flags.Parse(args)
+
+	nodePaths := flags.Args()
+	if len(nodePaths) == 0 {
+		fmt.Print(duUsageStr)
+		return 1
+	}
+
+	for _, nodePath := range nodePaths {
+		err := duNode(ctx, config, nodePath, *asJSON)
+		if err != nil {
+			printError("du", err)
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,517 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const exportUsageStr = `Usage:
+  kbfstool export [-v] [-resume] /keybase/[public|private]/user1,assertion2 outdir
+  kbfstool export [-v] [-rev=N] [-passphrase-file=f] /keybase/[public|private]/user1,assertion2/path out.tar[.enc]
+
+Copies the current contents of a TLF into outdir/files, and writes
+outdir/manifest.json, listing the SHA-256 hash of every file along
+with the revision exported and the TLF's participants, and
+outdir/manifest.sig, a signature of the manifest by the current
+device's signing key.
+
+An interrupted export can be continued with -resume, which skips
+files already copied that haven't changed since, after checking
+their copies against the hashes recorded for them.  If the TLF changes
+while it's being exported, the export fails and should be resumed.
+
+If the output ends in .tar, the directory at the given path, which
+may be anywhere within the TLF, is instead written into a tar
+archive, with modes, mtimes and symlinks preserved, as of revision
+N or the current revision.  If it ends in .tar.enc, the archive is
+also encrypted with the passphrase on the first line of the
+passphrase file.  Such archives can be brought back with import.
+
+`
+
+const (
+	exportFilesDir     = "files"
+	exportManifestFile = "manifest.json"
+	exportSigFile      = "manifest.sig"
+	exportProgressFile = "progress.jsonl"
+)
+
+// exportEntry describes one exported file, directory or symlink.
+type exportEntry struct {
+	Path    string
+	Type    string
+	Size    uint64 `json:",omitempty"`
+	Mtime   int64
+	SHA256  string `json:",omitempty"`
+	SymPath string `json:",omitempty"`
+}
+
+type exportManifest struct {
+	Tlf        string
+	TlfID      string
+	Revision   libkbfs.MetadataRevision
+	Writers    []string
+	Readers    []string `json:",omitempty"`
+	ExportedBy string
+	Time       time.Time
+	Entries    []exportEntry
+}
+
+type exportSignature struct {
+	Version      libkbfs.SigVer
+	Signature    string
+	VerifyingKey string
+}
+
+type exporter struct {
+	kbfsOps libkbfs.KBFSOps
+	outDir  string
+	verbose bool
+
+	// done holds the entries copied by an earlier, interrupted
+	// export, by path.
+	done     map[string]exportEntry
+	progress *os.File
+
+	entries     []exportEntry
+	bytesCopied uint64
+}
+
+func (e *exporter) loadProgress() error {
+	f, err := os.Open(filepath.Join(e.outDir, exportProgressFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry exportEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// The last line may have been cut off by whatever
+			// interrupted the export.
+			break
+		}
+		e.done[entry.Path] = entry
+	}
+	return scanner.Err()
+}
+
+func (e *exporter) recordEntry(entry exportEntry) error {
+	e.entries = append(e.entries, entry)
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = e.progress.Write(append(buf, '\n'))
+	return err
+}
+
+// hashLocalFile returns the SHA-256 hash of the regular file at
+// localPath, in hex.
+func hashLocalFile(localPath string) (string, error) {
+	fi, err := os.Lstat(localPath)
+	if err != nil {
+		return "", err
+	}
+	if !fi.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", localPath)
+	}
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// reusableEntry returns the entry recorded by an earlier export for
+// p, if the file hasn't changed since and its copy is intact.  The
+// copy is hashed again rather than trusted, since whatever
+// interrupted the export may also have damaged it.
+func (e *exporter) reusableEntry(p string, ei libkbfs.EntryInfo) (
+	exportEntry, bool) {
+	entry, ok := e.done[p]
+	if !ok || entry.SHA256 == "" || entry.Size != ei.Size ||
+		entry.Mtime != ei.Mtime {
+		return exportEntry{}, false
+	}
+	sum, err := hashLocalFile(filepath.Join(e.outDir, exportFilesDir, p))
+	if err != nil || sum != entry.SHA256 {
+		if e.verbose {
+			fmt.Fprintf(os.Stderr, "Copy of %s is damaged; exporting again\n",
+				p)
+		}
+		return exportEntry{}, false
+	}
+	return entry, true
+}
+
+func (e *exporter) exportFile(ctx context.Context, node libkbfs.Node,
+	p string, ei libkbfs.EntryInfo) (exportEntry, error) {
+	entry := exportEntry{
+		Path:  p,
+		Type:  ei.Type.String(),
+		Size:  ei.Size,
+		Mtime: ei.Mtime,
+	}
+	if done, ok := e.reusableEntry(p, ei); ok {
+		if e.verbose {
+			fmt.Fprintf(os.Stderr, "Already exported %s\n", p)
+		}
+		return done, nil
+	}
+
+	mode := os.FileMode(0644)
+	if ei.Type == libkbfs.Exec {
+		mode = 0755
+	}
+	// Don't write through whatever an earlier export left here,
+	// in case it was a symlink.
+	localPath := filepath.Join(e.outDir, exportFilesDir, p)
+	err := os.Remove(localPath)
+	if err != nil && !os.IsNotExist(err) {
+		return exportEntry{}, err
+	}
+	f, err := os.OpenFile(
+		localPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return exportEntry{}, err
+	}
+	defer f.Close()
+
+	nr := nodeReader{
+		ctx:     ctx,
+		kbfsOps: e.kbfsOps,
+		node:    node,
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), &nr)
+	if err != nil {
+		return exportEntry{}, err
+	}
+	if uint64(n) != ei.Size {
+		return exportEntry{}, fmt.Errorf(
+			"%s: read %d bytes, expected %d", p, n, ei.Size)
+	}
+	if err := f.Sync(); err != nil {
+		return exportEntry{}, err
+	}
+
+	entry.SHA256 = hex.EncodeToString(h.Sum(nil))
+	e.bytesCopied += uint64(n)
+	if e.verbose {
+		fmt.Fprintf(os.Stderr, "Exported %s (%s)\n", p, byteCountStr(int(n)))
+	}
+	return entry, nil
+}
+
+func (e *exporter) exportDir(
+	ctx context.Context, dir libkbfs.Node, dirPath string) error {
+	children, err := e.kbfsOps.GetDirChildren(ctx, dir)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		p := filepath.Join(dirPath, name)
+		localPath := filepath.Join(e.outDir, exportFilesDir, p)
+		node, ei, err := e.kbfsOps.Lookup(ctx, dir, name)
+		if err != nil {
+			return err
+		}
+
+		var entry exportEntry
+		switch ei.Type {
+		case libkbfs.Dir:
+			err := os.MkdirAll(localPath, 0755)
+			if err != nil {
+				return err
+			}
+			entry = exportEntry{Path: p, Type: ei.Type.String(),
+				Mtime: ei.Mtime}
+		case libkbfs.Sym:
+			err := os.Remove(localPath)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			err = os.Symlink(ei.SymPath, localPath)
+			if err != nil {
+				return err
+			}
+			entry = exportEntry{Path: p, Type: ei.Type.String(),
+				Mtime: ei.Mtime, SymPath: ei.SymPath}
+		default:
+			entry, err = e.exportFile(ctx, node, p, ei)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = e.recordEntry(entry)
+		if err != nil {
+			return err
+		}
+		if !e.verbose && len(e.entries)%100 == 0 {
+			fmt.Fprintf(os.Stderr, "Exported %d entries (%s copied)\n",
+				len(e.entries), byteCountStr(int(e.bytesCopied)))
+		}
+
+		if ei.Type == libkbfs.Dir {
+			err = e.exportDir(ctx, node, p)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func getUsernames(ctx context.Context, config libkbfs.Config,
+	uids []keybase1.UID, unresolved []keybase1.SocialAssertion) (
+	[]string, error) {
+	var names []string
+	for _, uid := range uids {
+		name, err := config.KBPKI().GetNormalizedUsername(ctx, uid)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name.String())
+	}
+	for _, assertion := range unresolved {
+		names = append(names, assertion.String())
+	}
+	return names, nil
+}
+
+func writeManifest(ctx context.Context, config libkbfs.Config,
+	outDir string, manifest exportManifest) error {
+	buf, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	// The signature covers the manifest file's exact bytes.
+	buf = append(buf, '\n')
+	sigInfo, err := config.Crypto().Sign(ctx, buf)
+	if err != nil {
+		return err
+	}
+	sigBuf, err := json.MarshalIndent(exportSignature{
+		Version:      sigInfo.Version,
+		Signature:    base64.StdEncoding.EncodeToString(sigInfo.Signature),
+		VerifyingKey: sigInfo.VerifyingKey.String(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	sigBuf = append(sigBuf, '\n')
+
+	err = writeFileAtomically(
+		filepath.Join(outDir, exportManifestFile), buf)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(filepath.Join(outDir, exportSigFile), sigBuf)
+}
+
+func writeFileAtomically(p string, buf []byte) error {
+	tmp := p + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+var errExportChanged = errors.New(
+	"TLF changed while it was being exported; run again with -resume")
+
+func exportHelper(ctx context.Context, config libkbfs.Config,
+	tlfStr, outDir string, resume, verbose bool) (err error) {
+	handle, err := getTlfHandle(ctx, config, tlfStr)
+	if err != nil {
+		return err
+	}
+
+	kbfsOps := config.KBFSOps()
+	rootNode, _, err := kbfsOps.GetRootNode(ctx, handle, libkbfs.MasterBranch)
+	if err != nil {
+		return err
+	}
+	if rootNode == nil {
+		return fmt.Errorf("%s has not been created yet", tlfStr)
+	}
+
+	status, _, err := kbfsOps.FolderStatus(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		return err
+	}
+
+	if !resume {
+		if _, err := os.Stat(outDir); err == nil {
+			return fmt.Errorf(
+				"%s already exists; use -resume to continue an export",
+				outDir)
+		}
+	}
+	err = os.MkdirAll(filepath.Join(outDir, exportFilesDir), 0755)
+	if err != nil {
+		return err
+	}
+
+	e := &exporter{
+		kbfsOps: kbfsOps,
+		outDir:  outDir,
+		verbose: verbose,
+		done:    make(map[string]exportEntry),
+	}
+	if resume {
+		err = e.loadProgress()
+		if err != nil {
+			return err
+		}
+		if verbose {
+			fmt.Fprintf(os.Stderr, "Resuming export with %d entries done\n",
+				len(e.done))
+		}
+	}
+	e.progress, err = os.Create(filepath.Join(outDir, exportProgressFile))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		closeErr := e.progress.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+
+	err = e.exportDir(ctx, rootNode, "")
+	if err != nil {
+		return err
+	}
+
+	// Only the contents of a single revision may be signed for.
+	endStatus, _, err := kbfsOps.FolderStatus(
+		ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		return err
+	}
+	if endStatus.Revision != status.Revision || len(endStatus.DirtyPaths) > 0 {
+		return errExportChanged
+	}
+
+	writers, err := getUsernames(ctx, config, handle.ResolvedWriters(),
+		handle.UnresolvedWriters())
+	if err != nil {
+		return err
+	}
+	readers, err := getUsernames(ctx, config, handle.ResolvedReaders(),
+		handle.UnresolvedReaders())
+	if err != nil {
+		return err
+	}
+	exportedBy, _, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = writeManifest(ctx, config, outDir, exportManifest{
+		Tlf:        string(handle.GetCanonicalName()),
+		TlfID:      status.FolderID,
+		Revision:   status.Revision,
+		Writers:    writers,
+		Readers:    readers,
+		ExportedBy: exportedBy.String(),
+		Time:       config.Clock().Now(),
+		Entries:    e.entries,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: exported %d entries at revision %d to %s\n",
+		tlfStr, len(e.entries), status.Revision, outDir)
+	return os.Remove(filepath.Join(outDir, exportProgressFile))
+}
+
+func export(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs export", flag.ContinueOnError)
+	verbose := flags.Bool("v", false, "Print extra status output.")
+	resume := flags.Bool("resume", false,
+		"Continue an interrupted export into the same directory.")
+	rev := flags.String("rev", "",
+		"Archive the given revision rather than the current one.")
+	passphraseFile := flags.String("passphrase-file", "",
+		"File holding the passphrase for an encrypted archive.")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		fmt.Print(exportUsageStr)
+		return 1
+	}
+
+	var err error
+	if isArchive, _ := isArchivePath(flags.Arg(1)); isArchive {
+		if *resume {
+			printError("export", errors.New(
+				"-resume only applies to directory exports"))
+			return 1
+		}
+		err = exportArchive(ctx, config, flags.Arg(0), flags.Arg(1),
+			*rev, *passphraseFile, *verbose)
+	} else {
+		if *rev != "" || *passphraseFile != "" {
+			printError("export", errors.New(
+				"-rev and -passphrase-file only apply to archives"))
+			return 1
+		}
+		err = exportHelper(ctx, config, flags.Arg(0), flags.Arg(1),
+			*resume, *verbose)
+	}
+	if err != nil {
+		printError("export", err)
+		return 1
+	}
+	return 0
+}
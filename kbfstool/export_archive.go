@@ -0,0 +1,261 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// splitTLFPath splits a path within a TLF into the TLF's root path,
+// and the path of the rest relative to that root.
+func splitTLFPath(pathStr string) (tlfStr, subPath string, err error) {
+	p, err := fsrpc.NewPath(pathStr)
+	if err != nil {
+		return "", "", err
+	}
+	if p.PathType != fsrpc.TLFPathType {
+		return "", "", fmt.Errorf("%q is not a path within a TLF", pathStr)
+	}
+	root := fsrpc.Path{
+		PathType: fsrpc.TLFPathType,
+		Public:   p.Public,
+		TLFName:  p.TLFName,
+	}
+	return root.String(), strings.Join(p.TLFComponents, "/"), nil
+}
+
+// snapshotReader reads a file through a read snapshot.
+type snapshotReader struct {
+	ctx  context.Context
+	snap *libkbfs.ReadSnapshot
+	path string
+	off  int64
+}
+
+var _ io.Reader = (*snapshotReader)(nil)
+
+func (sr *snapshotReader) Read(p []byte) (int, error) {
+	n, err := sr.snap.Read(sr.ctx, sr.path, p, sr.off)
+	sr.off += n
+	if n == 0 && err == nil {
+		err = io.EOF
+	}
+	return int(n), err
+}
+
+// archiveExporter writes a subtree of a read snapshot into a tar
+// archive.  Entries are named relative to the root of the subtree.
+type archiveExporter struct {
+	snap    *libkbfs.ReadSnapshot
+	tw      *tar.Writer
+	verbose bool
+	entries int
+	bytes   uint64
+}
+
+func (a *archiveExporter) header(name string, ei libkbfs.EntryInfo) *tar.Header {
+	h := &tar.Header{
+		Name:    name,
+		ModTime: time.Unix(0, ei.Mtime),
+	}
+	switch ei.Type {
+	case libkbfs.Dir:
+		h.Typeflag = tar.TypeDir
+		h.Name += "/"
+		h.Mode = 0755
+	case libkbfs.Sym:
+		h.Typeflag = tar.TypeSymlink
+		h.Linkname = ei.SymPath
+		h.Mode = 0777
+	case libkbfs.Exec:
+		h.Typeflag = tar.TypeReg
+		h.Size = int64(ei.Size)
+		h.Mode = 0755
+	default:
+		h.Typeflag = tar.TypeReg
+		h.Size = int64(ei.Size)
+		h.Mode = 0644
+	}
+	return h
+}
+
+func (a *archiveExporter) exportEntry(ctx context.Context,
+	snapPath, name string, ei libkbfs.EntryInfo) error {
+	err := a.tw.WriteHeader(a.header(name, ei))
+	if err != nil {
+		return err
+	}
+	if ei.Type == libkbfs.File || ei.Type == libkbfs.Exec {
+		n, err := io.Copy(a.tw, &snapshotReader{
+			ctx:  ctx,
+			snap: a.snap,
+			path: snapPath,
+		})
+		if err != nil {
+			return err
+		}
+		if uint64(n) != ei.Size {
+			return fmt.Errorf(
+				"%s: read %d bytes, expected %d", snapPath, n, ei.Size)
+		}
+		a.bytes += uint64(n)
+	}
+	a.entries++
+	if a.verbose {
+		fmt.Fprintf(os.Stderr, "Archived %s\n", name)
+	}
+	if ei.Type == libkbfs.Dir {
+		return a.exportDir(ctx, snapPath, name)
+	}
+	return nil
+}
+
+func (a *archiveExporter) exportDir(
+	ctx context.Context, snapPath, name string) error {
+	children, err := a.snap.GetDirChildren(ctx, snapPath)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(children))
+	for childName := range children {
+		names = append(names, childName)
+	}
+	sort.Strings(names)
+
+	for _, childName := range names {
+		err := a.exportEntry(ctx, path.Join(snapPath, childName),
+			path.Join(name, childName), children[childName])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportArchive writes the subtree at pathStr, as of the given
+// revision or the current one if revStr is empty, into a tar
+// archive at outFile, encrypting it if outFile ends in
+// archiveEncryptedSuffix.
+func exportArchive(ctx context.Context, config libkbfs.Config,
+	pathStr, outFile, revStr, passphraseFile string,
+	verbose bool) (err error) {
+	_, encrypted := isArchivePath(outFile)
+	var passphrase []byte
+	if encrypted {
+		passphrase, err = readPassphrase(passphraseFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	tlfStr, subPath, err := splitTLFPath(pathStr)
+	if err != nil {
+		return err
+	}
+	handle, err := getTlfHandle(ctx, config, tlfStr)
+	if err != nil {
+		return err
+	}
+	kbfsOps := config.KBFSOps()
+	rootNode, _, err := kbfsOps.GetRootNode(ctx, handle, libkbfs.MasterBranch)
+	if err != nil {
+		return err
+	}
+	if rootNode == nil {
+		return fmt.Errorf("%s has not been created yet", tlfStr)
+	}
+
+	// Reading through a snapshot keeps the archive consistent, even
+	// if the TLF changes while it's being written.
+	var snap *libkbfs.ReadSnapshot
+	if revStr == "" {
+		snap, err = kbfsOps.BeginReadSnapshot(ctx, rootNode.GetFolderBranch())
+	} else {
+		var rev libkbfs.MetadataRevision
+		rev, err = getRevision(ctx, config, rootNode.GetFolderBranch().Tlf,
+			libkbfs.NullBranchID, revStr)
+		if err != nil {
+			return err
+		}
+		snap, err = kbfsOps.BeginReadSnapshotAtRevision(
+			ctx, rootNode.GetFolderBranch(), rev)
+	}
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+
+	ei, err := snap.Stat(ctx, subPath)
+	if err != nil {
+		return err
+	}
+	if ei.Type != libkbfs.Dir {
+		return fmt.Errorf("%s is not a directory", pathStr)
+	}
+
+	f, err := os.OpenFile(outFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		closeErr := f.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(outFile)
+		}
+	}()
+
+	var w io.Writer = f
+	var enc *archiveEncrypter
+	if encrypted {
+		enc, err = newArchiveEncrypter(f, passphrase)
+		if err != nil {
+			return err
+		}
+		w = enc
+	}
+
+	a := &archiveExporter{
+		snap:    snap,
+		tw:      tar.NewWriter(w),
+		verbose: verbose,
+	}
+	err = a.exportDir(ctx, subPath, "")
+	if err != nil {
+		return err
+	}
+	err = a.tw.Close()
+	if err != nil {
+		return err
+	}
+	if enc != nil {
+		err = enc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: archived %d entries (%s) at revision %d to %s\n",
+		pathStr, a.entries, byteCountStr(int(a.bytes)), snap.Revision(),
+		outFile)
+	return nil
+}
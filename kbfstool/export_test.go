@@ -0,0 +1,162 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func makeExportTestTlf(t *testing.T) (
+	context.Context, *libkbfs.ConfigLocal, map[string]string) {
+	ctx := libkbfs.BackgroundContextWithCancellationDelayer()
+	config := libkbfs.MakeTestConfigOrBust(t, "alice")
+	kbfsOps := config.KBFSOps()
+	rootNode := libkbfs.GetRootNodeOrBust(t, config, "alice", false)
+
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	files := map[string]string{
+		"a":   "hello",
+		"d/b": "world, at some length",
+	}
+	for p, data := range files {
+		dir, name := rootNode, p
+		if filepath.Dir(p) == "d" {
+			dir, name = dirNode, filepath.Base(p)
+		}
+		n, _, err := kbfsOps.CreateFile(ctx, dir, name, false, libkbfs.NoExcl)
+		require.NoError(t, err)
+		require.NoError(t, kbfsOps.Write(ctx, n, []byte(data), 0))
+		require.NoError(t, kbfsOps.Sync(ctx, n))
+	}
+	_, err = kbfsOps.CreateLink(ctx, rootNode, "s", "a")
+	require.NoError(t, err)
+	return ctx, config, files
+}
+
+func readExportManifest(t *testing.T, outDir string) (
+	exportManifest, []byte, exportSignature) {
+	buf, err := ioutil.ReadFile(filepath.Join(outDir, exportManifestFile))
+	require.NoError(t, err)
+	var manifest exportManifest
+	require.NoError(t, json.Unmarshal(buf, &manifest))
+	sigBuf, err := ioutil.ReadFile(filepath.Join(outDir, exportSigFile))
+	require.NoError(t, err)
+	var sig exportSignature
+	require.NoError(t, json.Unmarshal(sigBuf, &sig))
+	return manifest, buf, sig
+}
+
+func TestExport(t *testing.T) {
+	ctx, config, files := makeExportTestTlf(t)
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "kbfstool_export")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempdir)
+	outDir := filepath.Join(tempdir, "out")
+
+	err = exportHelper(ctx, config, "/keybase/private/alice", outDir,
+		false, false)
+	require.NoError(t, err)
+
+	manifest, buf, sig := readExportManifest(t, outDir)
+	require.Equal(t, "alice", manifest.Tlf)
+	require.Equal(t, []string{"alice"}, manifest.Writers)
+	require.Equal(t, "alice", manifest.ExportedBy)
+
+	types := make(map[string]string)
+	for _, entry := range manifest.Entries {
+		types[entry.Path] = entry.Type
+		data, ok := files[entry.Path]
+		if !ok {
+			continue
+		}
+		sum := sha256.Sum256([]byte(data))
+		require.Equal(t, hex.EncodeToString(sum[:]), entry.SHA256)
+		got, err := ioutil.ReadFile(
+			filepath.Join(outDir, exportFilesDir, entry.Path))
+		require.NoError(t, err)
+		require.Equal(t, data, string(got))
+	}
+	require.Equal(t, map[string]string{
+		"a": "FILE", "d": "DIR", "d/b": "FILE", "s": "SYM"}, types)
+	target, err := os.Readlink(filepath.Join(outDir, exportFilesDir, "s"))
+	require.NoError(t, err)
+	require.Equal(t, "a", target)
+
+	// The signature covers the manifest, by the exporting device.
+	key, err := config.KBPKI().GetCurrentVerifyingKey(ctx)
+	require.NoError(t, err)
+	require.Equal(t, key.String(), sig.VerifyingKey)
+	sigBytes, err := base64.StdEncoding.DecodeString(sig.Signature)
+	require.NoError(t, err)
+	sigInfo := libkbfs.SignatureInfo{
+		Version:      sig.Version,
+		Signature:    sigBytes,
+		VerifyingKey: key,
+	}
+	require.NoError(t, config.Crypto().Verify(buf, sigInfo))
+	require.Error(t, config.Crypto().Verify(append(buf, ' '), sigInfo))
+
+	// The progress file is gone once the export finishes, and
+	// another export into the same place needs -resume.
+	_, err = os.Stat(filepath.Join(outDir, exportProgressFile))
+	require.True(t, os.IsNotExist(err))
+	err = exportHelper(ctx, config, "/keybase/private/alice", outDir,
+		false, false)
+	require.Error(t, err)
+}
+
+func TestExportResumeRehashes(t *testing.T) {
+	ctx, config, files := makeExportTestTlf(t)
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "kbfstool_export")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempdir)
+	outDir := filepath.Join(tempdir, "out")
+
+	err = exportHelper(ctx, config, "/keybase/private/alice", outDir,
+		false, false)
+	require.NoError(t, err)
+	manifest, _, _ := readExportManifest(t, outDir)
+
+	// Pretend the export was interrupted just before writing the
+	// manifest, after damaging one copy without changing its size.
+	var progress []byte
+	for _, entry := range manifest.Entries {
+		buf, err := json.Marshal(entry)
+		require.NoError(t, err)
+		progress = append(append(progress, buf...), '\n')
+	}
+	require.NoError(t, ioutil.WriteFile(
+		filepath.Join(outDir, exportProgressFile), progress, 0644))
+	damaged := filepath.Join(outDir, exportFilesDir, "d", "b")
+	buf := []byte(files["d/b"])
+	buf[0] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(damaged, buf, 0644))
+
+	err = exportHelper(ctx, config, "/keybase/private/alice", outDir,
+		true, false)
+	require.NoError(t, err)
+
+	got, err := ioutil.ReadFile(damaged)
+	require.NoError(t, err)
+	require.Equal(t, files["d/b"], string(got))
+	resumed, _, _ := readExportManifest(t, outDir)
+	require.Equal(t, manifest.Entries, resumed.Entries)
+}
@@ -0,0 +1,96 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const fsckUsageStr = `Usage:
+  kbfstool fsck [-v] [-repair] /keybase/[public|private]/user1,assertion2 [tlfs...]
+
+Checks that each TLF's merged MD chain is intact, that every block
+reachable from its head exists and decrypts, that the head's disk
+usage matches those blocks, and that its journal, if it has one,
+still has the data for every block it has yet to flush.
+
+Nothing is changed unless -repair is given, in which case data
+missing from the journal is fetched back from the server where
+possible.
+
+`
+
+func fsckOne(ctx context.Context, config libkbfs.Config,
+	tlfStr string, repair, verbose bool) (clean bool, err error) {
+	handle, err := getTlfHandle(ctx, config, tlfStr)
+	if err != nil {
+		return false, err
+	}
+
+	report, err := config.KBFSOps().FsckTLF(ctx, handle, repair)
+	if err != nil {
+		return false, err
+	}
+
+	audit := report.Audit
+	fmt.Printf("%s (TLF %s, revision %d): checked %d revisions "+
+		"and %d blocks\n", tlfStr, audit.Tlf, audit.Revision,
+		report.MDRevisionsChecked, audit.BlocksChecked)
+	for _, problem := range report.MDChain {
+		fmt.Printf("  bad revision: %d: %v\n",
+			problem.Revision, problem.Err)
+	}
+	printAuditProblems("missing", audit.Missing, verbose)
+	printAuditProblems("corrupt", audit.Corrupt, verbose)
+	printAuditProblems("duplicate ref", audit.DuplicateRefs, verbose)
+	if report.DiskUsageMismatch() {
+		fmt.Printf("  disk usage: head accounts for %d bytes, "+
+			"but %d are reachable\n",
+			report.DiskUsage, report.ReachableBytes)
+	}
+	for _, problem := range report.JournalData {
+		switch {
+		case problem.Repaired:
+			fmt.Printf("  journal: restored data for %v\n", problem.Ptr)
+		case problem.Err != nil:
+			fmt.Printf("  journal: missing data for %v: %v\n",
+				problem.Ptr, problem.Err)
+		default:
+			fmt.Printf("  journal: missing data for %v\n", problem.Ptr)
+		}
+	}
+	return report.IsClean(), nil
+}
+
+func fsck(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs fsck", flag.ContinueOnError)
+	verbose := flags.Bool("v", false, "Print block pointers for problems.")
+	repair := flags.Bool("repair", false,
+		"Restore data missing from journals from the server.")
+	flags.Parse(args)
+
+	inputs := flags.Args()
+	if len(inputs) < 1 {
+		fmt.Print(fsckUsageStr)
+		return 1
+	}
+
+	for _, input := range inputs {
+		clean, err := fsckOne(ctx, config, input, *repair, *verbose)
+		if err != nil {
+			printError("fsck", err)
+			return 1
+		}
+		if !clean {
+			exitStatus = 1
+		}
+	}
+
+	return exitStatus
+}
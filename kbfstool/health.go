@@ -0,0 +1,126 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+const healthUsageStr = `Usage:
+  kbfstool health [-mount=/keybase] [-v]
+
+Like the journal commands, this talks to the KBFS instance that has
+the file system mounted at the given mount point, through its special
+files.  It prints whether KBFS is ok, degraded or down, and why: the
+servers it can't reach, the TLFs whose journal flushes, syncs, rekeys
+or conflict resolutions are failing, and the disk caches it can't
+use.  With -v, every open TLF and the most recent errors are printed
+too.  The exit status is 0 only if KBFS is ok.
+
+`
+
+func printServiceHealth(name string, s libkbfs.ServiceHealth) {
+	if s.Connected {
+		fmt.Printf("%s: connected\n", name)
+	} else if s.Error != "" {
+		fmt.Printf("%s: not connected: %s\n", name, s.Error)
+	} else {
+		fmt.Printf("%s: not connected\n", name)
+	}
+}
+
+func printHealth(h libkbfs.KBFSHealth, verbose bool) {
+	fmt.Printf("KBFS is %s\n", h.State)
+	for _, p := range h.Problems {
+		fmt.Printf("  %s\n", p)
+	}
+	fmt.Printf("\n")
+	printServiceHealth("MD server", h.MDServer)
+	printServiceHealth("Block server", h.BlockServer)
+	printServiceHealth("Keybase service", h.KeybaseService)
+	fmt.Printf("Offline: %t, network: %s\n", h.Offline, h.NetworkState)
+	fmt.Printf("TLFs waiting for a rekey: %d, with unmerged changes: %d\n",
+		h.RekeyBacklog, h.CRBacklog)
+
+	var tlfPaths []string
+	for tlfPath, tlf := range h.TLFs {
+		if verbose || tlf.State != libkbfs.HealthOK {
+			tlfPaths = append(tlfPaths, tlfPath)
+		}
+	}
+	sort.Strings(tlfPaths)
+	for _, tlfPath := range tlfPaths {
+		tlf := h.TLFs[tlfPath]
+		fmt.Printf("%s: %s", tlfPath, tlf.State)
+		if tlf.Journal != nil {
+			fmt.Printf(", %d unflushed bytes", tlf.Journal.UnflushedBytes)
+		}
+		fmt.Printf("\n")
+		for _, p := range tlf.Problems {
+			fmt.Printf("  %s\n", p)
+		}
+	}
+
+	for _, cache := range h.DiskCaches {
+		fmt.Printf("%s cache in %s: %d bytes", cache.Name, cache.Dir,
+			cache.Bytes)
+		if cache.CapacityBytes != 0 {
+			fmt.Printf(" of %d", cache.CapacityBytes)
+		}
+		if cache.Error != "" {
+			fmt.Printf(", unusable: %s", cache.Error)
+		}
+		fmt.Printf("\n")
+	}
+
+	if verbose {
+		for _, e := range h.RecentErrors {
+			fmt.Printf("%s: [%s] %s\n",
+				e.Time.Format("2006-01-02 15:04:05.000"), e.Code, e.Error)
+			if e.Remediation != "" {
+				fmt.Printf("    %s %s\n", e.Message, e.Remediation)
+			}
+		}
+	}
+}
+
+func healthMain(args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs health", flag.ContinueOnError)
+	mount := flags.String("mount", "/keybase",
+		"Where the KBFS instance to talk to is mounted.")
+	verbose := flags.Bool("v", false,
+		"Print every open TLF, and the most recent errors.")
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		fmt.Print(healthUsageStr)
+		return 1
+	}
+
+	buf, err := ioutil.ReadFile(filepath.Join(*mount, libfs.HealthFileName))
+	if err != nil {
+		printError("health", err)
+		return 1
+	}
+	var h libkbfs.KBFSHealth
+	err = json.Unmarshal(buf, &h)
+	if err != nil {
+		printError("health", err)
+		return 1
+	}
+	printHealth(h, *verbose)
+	if h.State != libkbfs.HealthOK {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,298 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const importUsageStr = `Usage:
+  kbfstool import [-v] [-passphrase-file=f] in.tar[.enc] /keybase/[public|private]/user1,assertion2/path
+
+Unpacks a tar archive, as written by export, into the directory at
+the given path, creating that directory if it doesn't exist yet.
+Existing directories are merged into, but existing files and
+symlinks are never overwritten.  Archives ending in .tar.enc are
+decrypted with the passphrase on the first line of the passphrase
+file.
+
+`
+
+type importDirMtime struct {
+	node  libkbfs.Node
+	mtime time.Time
+}
+
+// archiveImporter unpacks a tar archive into a KBFS directory.
+type archiveImporter struct {
+	kbfsOps libkbfs.KBFSOps
+	verbose bool
+	// dirs maps each directory unpacked so far, relative to the
+	// destination, to its node; the destination itself is "".
+	dirs map[string]libkbfs.Node
+	// dirMtimes are set once everything has been unpacked, since
+	// unpacking into a directory changes its mtime.
+	dirMtimes []importDirMtime
+	entries   int
+	bytes     uint64
+}
+
+// cleanArchiveName returns the path of a tar entry relative to the
+// destination, or an error if it would land outside of it.
+func cleanArchiveName(name string) (string, error) {
+	clean := path.Clean(strings.TrimSuffix(name, "/"))
+	if path.IsAbs(clean) || clean == ".." ||
+		strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("archive entry %q is outside of the archive",
+			name)
+	}
+	if clean == "." {
+		return "", nil
+	}
+	return clean, nil
+}
+
+func (i *archiveImporter) parent(name string) (libkbfs.Node, error) {
+	dir := path.Dir(name)
+	if dir == "." {
+		dir = ""
+	}
+	node, ok := i.dirs[dir]
+	if !ok {
+		return nil, fmt.Errorf(
+			"archive entry %q comes before its directory", name)
+	}
+	return node, nil
+}
+
+func (i *archiveImporter) importDir(ctx context.Context,
+	parent libkbfs.Node, name string, h *tar.Header) error {
+	base := path.Base(name)
+	node, ei, err := i.kbfsOps.Lookup(ctx, parent, base)
+	switch err.(type) {
+	case nil:
+		if ei.Type != libkbfs.Dir {
+			return fmt.Errorf("%s already exists, and isn't a directory",
+				name)
+		}
+	case libkbfs.NoSuchNameError:
+		node, _, err = i.kbfsOps.CreateDir(ctx, parent, base)
+		if err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+	i.dirs[name] = node
+	i.dirMtimes = append(i.dirMtimes, importDirMtime{node, h.ModTime})
+	return nil
+}
+
+func (i *archiveImporter) importFile(ctx context.Context,
+	parent libkbfs.Node, name string, h *tar.Header, r io.Reader) error {
+	node, _, err := i.kbfsOps.CreateFile(ctx, parent, path.Base(name),
+		h.Mode&0100 != 0, libkbfs.WithExcl)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	n, err := io.Copy(&nodeWriter{
+		ctx:     ctx,
+		kbfsOps: i.kbfsOps,
+		node:    node,
+	}, r)
+	if err != nil {
+		return err
+	}
+	err = i.kbfsOps.Sync(ctx, node)
+	if err != nil {
+		return err
+	}
+	mtime := h.ModTime
+	err = i.kbfsOps.SetMtime(ctx, node, &mtime)
+	if err != nil {
+		return err
+	}
+	i.bytes += uint64(n)
+	return nil
+}
+
+func (i *archiveImporter) importEntry(ctx context.Context,
+	h *tar.Header, r io.Reader) error {
+	name, err := cleanArchiveName(h.Name)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		// The destination itself.
+		return nil
+	}
+	parent, err := i.parent(name)
+	if err != nil {
+		return err
+	}
+
+	switch h.Typeflag {
+	case tar.TypeDir:
+		err = i.importDir(ctx, parent, name, h)
+	case tar.TypeReg:
+		err = i.importFile(ctx, parent, name, h, r)
+	case tar.TypeSymlink:
+		_, err = i.kbfsOps.CreateLink(
+			ctx, parent, path.Base(name), h.Linkname)
+		if err != nil {
+			err = fmt.Errorf("%s: %v", name, err)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Skipping %s, of unsupported type %q\n",
+			name, h.Typeflag)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	i.entries++
+	if i.verbose {
+		fmt.Fprintf(os.Stderr, "Imported %s\n", name)
+	}
+	return nil
+}
+
+// getImportDestNode returns the node for the directory at pathStr,
+// creating it if its parent exists but it doesn't.
+func getImportDestNode(ctx context.Context, config libkbfs.Config,
+	pathStr string) (libkbfs.Node, error) {
+	p, err := fsrpc.NewPath(pathStr)
+	if err != nil {
+		return nil, err
+	}
+	if p.PathType != fsrpc.TLFPathType {
+		return nil, fmt.Errorf("%q is not a path within a TLF", pathStr)
+	}
+	if len(p.TLFComponents) == 0 {
+		return p.GetDirNode(ctx, config)
+	}
+
+	dir, name, err := p.DirAndBasename()
+	if err != nil {
+		return nil, err
+	}
+	parentNode, err := dir.GetDirNode(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	kbfsOps := config.KBFSOps()
+	node, ei, err := kbfsOps.Lookup(ctx, parentNode, name)
+	switch err.(type) {
+	case nil:
+		if ei.Type != libkbfs.Dir {
+			return nil, fmt.Errorf("%s is not a directory", pathStr)
+		}
+		return node, nil
+	case libkbfs.NoSuchNameError:
+		node, _, err = kbfsOps.CreateDir(ctx, parentNode, name)
+		return node, err
+	default:
+		return nil, err
+	}
+}
+
+func importHelper(ctx context.Context, config libkbfs.Config,
+	inFile, pathStr, passphraseFile string, verbose bool) error {
+	isArchive, encrypted := isArchivePath(inFile)
+	if !isArchive {
+		return fmt.Errorf("%s does not end in %s or %s", inFile,
+			archiveTarSuffix, archiveEncryptedSuffix)
+	}
+	var passphrase []byte
+	if encrypted {
+		var err error
+		passphrase, err = readPassphrase(passphraseFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Open(inFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if encrypted {
+		r, err = newArchiveDecrypter(f, passphrase)
+		if err != nil {
+			return err
+		}
+	}
+
+	destNode, err := getImportDestNode(ctx, config, pathStr)
+	if err != nil {
+		return err
+	}
+
+	i := &archiveImporter{
+		kbfsOps: config.KBFSOps(),
+		verbose: verbose,
+		dirs:    map[string]libkbfs.Node{"": destNode},
+	}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		err = i.importEntry(ctx, h, tr)
+		if err != nil {
+			return err
+		}
+	}
+
+	for j := len(i.dirMtimes) - 1; j >= 0; j-- {
+		dm := i.dirMtimes[j]
+		err := i.kbfsOps.SetMtime(ctx, dm.node, &dm.mtime)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("%s: imported %d entries (%s) from %s\n",
+		pathStr, i.entries, byteCountStr(int(i.bytes)), inFile)
+	return nil
+}
+
+func importArchive(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs import", flag.ContinueOnError)
+	verbose := flags.Bool("v", false, "Print extra status output.")
+	passphraseFile := flags.String("passphrase-file", "",
+		"File holding the passphrase for an encrypted archive.")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		fmt.Print(importUsageStr)
+		return 1
+	}
+
+	err := importHelper(ctx, config, flags.Arg(0), flags.Arg(1),
+		*passphraseFile, *verbose)
+	if err != nil {
+		printError("import", err)
+		return 1
+	}
+	return 0
+}
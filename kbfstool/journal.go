@@ -0,0 +1,214 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+const journalUsageStr = `Usage:
+  kbfstool journal [-mount=/keybase] <subcommand> [<args>]
+
+Unlike the other commands, these don't start KBFS themselves, but
+talk to the KBFS instance that has the file system mounted at the
+given mount point, through its special files, since that instance
+is the one whose journals matter.  TLFs are given as
+/keybase/[public|private]/user1,assertion2 as usual, whatever the
+mount point is.
+
+The possible subcommands are:
+  status [tlfs...]	Show unflushed bytes, revisions and branch state
+  dump tlf		Dump everything in a TLF's journal as JSON
+  flush tlf [tlfs...]	Flush journals, returning once they're done
+  pause tlf [tlfs...]	Pause journal background work
+  resume tlf [tlfs...]	Resume journal background work
+
+`
+
+// journalTLFStatus is the part of a TLF's status file that the
+// journal commands print.
+type journalTLFStatus struct {
+	Staged      bool
+	BranchID    string
+	Revision    libkbfs.MetadataRevision
+	IsConnected bool
+	Journal     *libkbfs.TLFJournalStatus
+}
+
+// journalServerStatus is the part of the top-level status file that
+// the journal commands print.
+type journalServerStatus struct {
+	JournalServer *libkbfs.JournalServerStatus
+}
+
+// journalTLFDir returns the directory for tlfStr under mount.
+func journalTLFDir(mount, tlfStr string) (string, error) {
+	p, err := fsrpc.NewPath(tlfStr)
+	if err != nil {
+		return "", err
+	}
+	if p.PathType != fsrpc.TLFPathType || len(p.TLFComponents) > 0 {
+		return "", fmt.Errorf("%q is not the root path of a TLF", tlfStr)
+	}
+	visibility := privateName
+	if p.Public {
+		visibility = publicName
+	}
+	return filepath.Join(mount, visibility, p.TLFName), nil
+}
+
+func readStatusFile(dir string, status interface{}) error {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, libfs.StatusFileName))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, status)
+}
+
+func journalStatus(mount string, tlfStrs []string) error {
+	if len(tlfStrs) == 0 {
+		var status journalServerStatus
+		err := readStatusFile(mount, &status)
+		if err != nil {
+			return err
+		}
+		if status.JournalServer == nil {
+			fmt.Print("Journaling is off\n")
+			return nil
+		}
+		fmt.Printf("%d journals in %s, %s unflushed\n",
+			status.JournalServer.JournalCount,
+			status.JournalServer.RootDir,
+			byteCountStr(int(status.JournalServer.UnflushedBytes)))
+		return nil
+	}
+
+	for _, tlfStr := range tlfStrs {
+		dir, err := journalTLFDir(mount, tlfStr)
+		if err != nil {
+			return err
+		}
+		var status journalTLFStatus
+		err = readStatusFile(dir, &status)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s:\n", tlfStr)
+		fmt.Printf("  revision %d, connected: %t, staged: %t",
+			status.Revision, status.IsConnected, status.Staged)
+		if status.Staged {
+			fmt.Printf(" (branch %s)", status.BranchID)
+		}
+		fmt.Print("\n")
+		j := status.Journal
+		if j == nil {
+			fmt.Print("  journal: off\n")
+			continue
+		}
+		if j.RevisionStart == libkbfs.MetadataRevisionUninitialized {
+			fmt.Print("  journal: no unflushed revisions")
+		} else {
+			fmt.Printf("  journal: revisions %d to %d unflushed",
+				j.RevisionStart, j.RevisionEnd)
+		}
+		if j.BranchID != libkbfs.NullBranchID.String() {
+			fmt.Printf(" on branch %s", j.BranchID)
+		}
+		fmt.Printf(", %d block ops, %s unflushed\n",
+			j.BlockOpCount, byteCountStr(int(j.UnflushedBytes)))
+		if j.FlushDeferred {
+			fmt.Print("  flush deferred until on an unmetered network\n")
+		}
+	}
+	return nil
+}
+
+func journalDump(mount, tlfStr string) error {
+	dir, err := journalTLFDir(mount, tlfStr)
+	if err != nil {
+		return err
+	}
+	buf, err := ioutil.ReadFile(
+		filepath.Join(dir, libfs.JournalContentsFileName))
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(buf)
+	return err
+}
+
+// journalControl writes to the given control file of each TLF, which
+// makes the mounted KBFS instance act on that TLF's journal before
+// the write returns.
+func journalControl(mount, controlFileName string, tlfStrs []string) error {
+	for _, tlfStr := range tlfStrs {
+		dir, err := journalTLFDir(mount, tlfStr)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(
+			filepath.Join(dir, controlFileName), []byte("on"), 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func journalMain(args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs journal", flag.ContinueOnError)
+	mount := flags.String("mount", "/keybase",
+		"Where the KBFS instance to talk to is mounted.")
+	flags.Parse(args)
+
+	args = flags.Args()
+	if len(args) < 1 {
+		fmt.Print(journalUsageStr)
+		return 1
+	}
+
+	cmd := args[0]
+	args = args[1:]
+
+	var err error
+	switch cmd {
+	case "status":
+		err = journalStatus(*mount, args)
+	case "dump":
+		if len(args) != 1 {
+			err = errExactlyOnePath
+			break
+		}
+		err = journalDump(*mount, args[0])
+	case "flush", "pause", "resume":
+		if len(args) < 1 {
+			err = errAtLeastOnePath
+			break
+		}
+		controlFileName := map[string]string{
+			"flush":  libfs.FlushJournalFileName,
+			"pause":  libfs.PauseJournalBackgroundWorkFileName,
+			"resume": libfs.ResumeJournalBackgroundWorkFileName,
+		}[cmd]
+		err = journalControl(*mount, controlFileName, args)
+	default:
+		err = fmt.Errorf("unknown command '%s'", cmd)
+	}
+	if err != nil {
+		printError("journal", err)
+		return 1
+	}
+	return 0
+}
@@ -37,11 +37,29 @@ To run in a local testing environment:
 
 The possible commands are:
   stat		Display file status
+  du		Show the space used by files and directories
+  quota		Show quota usage, broken down by TLF
   ls		List directory contents
   mkdir		Make directories
   read		Dump file to stdout
   write		Write stdin to file
   md            Operate on metadata objects
+  block		Inspect individual blocks of a TLF
+  audit		Check all blocks in a TLF for errors
+  fsck		Check a TLF's metadata, blocks and journal, and repair them
+  statecheck	Check a TLF's block references against its history
+  journal	Inspect and control the journals of the mounted KBFS
+  branch	Inspect and resolve unmerged branches of the mounted KBFS
+  offline	Put the mounted KBFS in or out of offline mode
+  sync		Keep directories of the mounted KBFS on disk for offline use
+  network	Tell the mounted KBFS what kind of network it's on
+  slowops	Show what the mounted KBFS's slowest recent operations waited on
+  health	Show whether anything keeps the mounted KBFS from working
+  usage		Show how much network each TLF of the mounted KBFS has used
+  export	Export a TLF with a signed manifest, or a subtree as an archive
+  import	Import an archive made by export
+  namecheck	Find names that are a problem on other platforms
+  bench		Benchmark reads, writes and syncs against the servers
 
 `
 
@@ -74,6 +92,38 @@ func realMain() (exitStatus int) {
 		return 1
 	}
 
+	// The journal, branch, offline, sync, network, slowops, health
+	// and usage commands talk to the mounted KBFS instance, and mustn't start
+	// one of their own, which would flush the same journals, or
+	// resolve the same branches, from under it.
+	switch flag.Arg(0) {
+	case "journal":
+		return journalMain(flag.Args()[1:])
+	case "branch":
+		return branchMain(flag.Args()[1:])
+	case "offline":
+		return offlineMain(flag.Args()[1:])
+	case "sync":
+		return syncMain(flag.Args()[1:])
+	case "network":
+		return networkMain(flag.Args()[1:])
+	case "slowops":
+		return slowOpsMain(flag.Args()[1:])
+	case "health":
+		return healthMain(flag.Args()[1:])
+	case "usage":
+		return usageMain(flag.Args()[1:])
+	}
+
+	if err := libkbfs.ApplyInitProfile(flag.CommandLine, kbfsParams); err != nil {
+		printError("kbfs", err)
+		return 1
+	}
+
+	// Sync subscriptions belong to the mounted instance too, so
+	// don't resume them here.
+	kbfsParams.SyncCacheRoot = ""
+
 	log := logger.NewWithCallDepth("", 1)
 
 	// TODO: Turn off the rekey queue and other background tasks.
@@ -98,6 +148,10 @@ func realMain() (exitStatus int) {
 	switch cmd {
 	case "stat":
 		return stat(ctx, config, args)
+	case "du":
+		return du(ctx, config, args)
+	case "quota":
+		return quota(ctx, config, args)
 	case "ls":
 		return ls(ctx, config, args)
 	case "mkdir":
@@ -108,6 +162,22 @@ func realMain() (exitStatus int) {
 		return write(ctx, config, args)
 	case "md":
 		return mdMain(ctx, config, args)
+	case "block":
+		return blockMain(ctx, config, args)
+	case "audit":
+		return audit(ctx, config, args)
+	case "fsck":
+		return fsck(ctx, config, args)
+	case "statecheck":
+		return stateCheck(ctx, config, args)
+	case "export":
+		return export(ctx, config, args)
+	case "import":
+		return importArchive(ctx, config, args)
+	case "namecheck":
+		return namecheck(ctx, config, args)
+	case "bench":
+		return bench(ctx, config, args)
 	default:
 		printError("kbfs", fmt.Errorf("unknown command '%s'", cmd))
 		return 1
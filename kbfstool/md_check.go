@@ -42,6 +42,11 @@ func checkDirBlock(ctx context.Context, config libkbfs.Config,
 		return err
 	}
 
+	// The shards of a sharded directory hold its entries.
+	for _, iptr := range dirBlock.IPtrs {
+		_ = checkDirBlock(ctx, config, name, kmd, iptr.BlockInfo, verbose)
+	}
+
 	for entryName, entry := range dirBlock.Children {
 		switch entry.Type {
 		case libkbfs.File, libkbfs.Exec:
@@ -13,37 +13,26 @@ import (
 
 var mdGetRegexp = regexp.MustCompile("^(.+?)(?::(.*?))?(?:\\^(.*?))?$")
 
-func getTlfID(
+func getTlfHandle(
 	ctx context.Context, config libkbfs.Config, tlfStr string) (
-	libkbfs.TlfID, error) {
-	tlfID, err := libkbfs.ParseTlfID(tlfStr)
-	if err == nil {
-		return tlfID, nil
-	}
-
-	var handle *libkbfs.TlfHandle
+	*libkbfs.TlfHandle, error) {
 	p, err := fsrpc.NewPath(tlfStr)
 	if err != nil {
-		return libkbfs.TlfID{}, err
+		return nil, err
 	}
 	if p.PathType != fsrpc.TLFPathType {
-		return libkbfs.TlfID{}, fmt.Errorf(
-			"%q is not a TLF path", tlfStr)
+		return nil, fmt.Errorf("%q is not a TLF path", tlfStr)
 	}
 	if len(p.TLFComponents) > 0 {
-		return libkbfs.TlfID{}, fmt.Errorf(
-			"%q is not the root path of a TLF", tlfStr)
+		return nil, fmt.Errorf("%q is not the root path of a TLF", tlfStr)
 	}
 	name := p.TLFName
-outer:
 	for {
-		var err error
-		handle, err = libkbfs.ParseTlfHandle(
+		handle, err := libkbfs.ParseTlfHandle(
 			ctx, config.KBPKI(), name, p.Public)
 		switch err := err.(type) {
 		case nil:
-			// No error.
-			break outer
+			return handle, nil
 
 		case libkbfs.TlfNameNotCanonical:
 			// Non-canonical name, so try again.
@@ -51,9 +40,23 @@ outer:
 
 		default:
 			// Some other error.
-			return libkbfs.TlfID{}, err
+			return nil, err
 		}
 	}
+}
+
+func getTlfID(
+	ctx context.Context, config libkbfs.Config, tlfStr string) (
+	libkbfs.TlfID, error) {
+	tlfID, err := libkbfs.ParseTlfID(tlfStr)
+	if err == nil {
+		return tlfID, nil
+	}
+
+	handle, err := getTlfHandle(ctx, config, tlfStr)
+	if err != nil {
+		return libkbfs.TlfID{}, err
+	}
 
 	_, irmd, err := config.MDOps().GetForHandle(ctx, handle, libkbfs.Merged)
 	if err != nil {
@@ -176,3 +179,17 @@ func mdParseAndGet(ctx context.Context, config libkbfs.Config, input string) (
 
 	return mdGet(ctx, config, tlfID, branchID, rev)
 }
+
+// mdBatchSize is how many revisions to fetch at once when going
+// through a range of them.
+const mdBatchSize = 100
+
+func mdGetRange(ctx context.Context, config libkbfs.Config,
+	tlfID libkbfs.TlfID, branchID libkbfs.BranchID,
+	start, end libkbfs.MetadataRevision) (
+	[]libkbfs.ImmutableRootMetadata, error) {
+	if branchID == libkbfs.NullBranchID {
+		return config.MDOps().GetRange(ctx, tlfID, start, end)
+	}
+	return config.MDOps().GetUnmergedRange(ctx, tlfID, branchID, start, end)
+}
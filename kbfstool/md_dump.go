@@ -46,6 +46,7 @@ func mdDumpOne(ctx context.Context, config libkbfs.Config,
 	fmt.Print("---------------\n")
 	fmt.Printf("Last modifying writer: %s\n",
 		getUserString(ctx, config, rmd.LastModifyingWriter()))
+	fmt.Printf("Signed by key: %s\n", rmd.LastModifyingWriterKID())
 	// TODO: Print Writers/WKeys and unresolved writers.
 	fmt.Printf("TLF ID: %s\n", rmd.TlfID())
 	fmt.Printf("Branch ID: %s\n", rmd.BID())
@@ -69,6 +70,15 @@ func mdDumpOne(ctx context.Context, config libkbfs.Config,
 	}
 	for i, op := range data.Changes.Ops {
 		fmt.Printf("Op[%d]: %v\n", i, op)
+		for _, ptr := range op.Refs() {
+			fmt.Printf("  Ref: %v\n", ptr)
+		}
+		for _, ptr := range op.Unrefs() {
+			fmt.Printf("  Unref: %v\n", ptr)
+		}
+		for _, update := range op.AllUpdates() {
+			fmt.Printf("  Update: %v -> %v\n", update.Unref, update.Ref)
+		}
 	}
 	// TODO: Print unknown fields.
 
@@ -78,6 +88,11 @@ func mdDumpOne(ctx context.Context, config libkbfs.Config,
 const mdDumpUsageStr = `Usage:
   kbfstool md dump input [inputs...]
 
+Fetches each MD object from the journal, if it has it, or the
+server, verifies its signature and writer, decrypts its private
+metadata with this device's keys, and prints it along with the
+block pointers each op references, unreferences and updates.
+
 Each input must be in the following format:
 
   TLF
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const mdVerifyRangeUsageStr = `Usage:
+  kbfstool md verify-range [-v] input [start [end]]
+
+Fetches the MD objects from revision start to revision end, both
+inclusive, and checks that each one verifies, was made by a writer of
+the TLF, and is a valid successor of the one before it, including
+the one just before start.  start defaults to 1, and end to "latest".
+
+input must be in the same format as in md dump, but without a
+revision, and start and end in the same format as a revision there.
+
+`
+
+// mdVerifyOne checks rmd, and its link to prev if prev is set.
+func mdVerifyOne(prev, rmd libkbfs.ImmutableRootMetadata) error {
+	writer := rmd.LastModifyingWriter()
+	if !rmd.GetTlfHandle().IsWriter(writer) {
+		return fmt.Errorf("last modified by %s, who isn't a writer", writer)
+	}
+	if prev == (libkbfs.ImmutableRootMetadata{}) {
+		return nil
+	}
+	return prev.CheckValidSuccessor(prev.MdID(), rmd.ReadOnlyRootMetadata)
+}
+
+func mdVerifyRangeOne(ctx context.Context, config libkbfs.Config,
+	input, startStr, endStr string, verbose bool) (clean bool, err error) {
+	matches := mdGetRegexp.FindStringSubmatch(input)
+	if matches == nil || matches[3] != "" {
+		return false, fmt.Errorf("Could not parse %q", input)
+	}
+
+	tlfID, err := getTlfID(ctx, config, matches[1])
+	if err != nil {
+		return false, err
+	}
+	branchID, err := getBranchID(ctx, config, tlfID, matches[2])
+	if err != nil {
+		return false, err
+	}
+	start, err := getRevision(ctx, config, tlfID, branchID, startStr)
+	if err != nil {
+		return false, err
+	}
+	end, err := getRevision(ctx, config, tlfID, branchID, endStr)
+	if err != nil {
+		return false, err
+	}
+	if start < libkbfs.MetadataRevisionInitial || end < start {
+		return false, fmt.Errorf("Invalid range %s to %s", start, end)
+	}
+
+	// Fetch the revision before start too, to check start's link
+	// to it.
+	fetchStart := start
+	if fetchStart > libkbfs.MetadataRevisionInitial {
+		fetchStart--
+	}
+
+	clean = true
+	var prev libkbfs.ImmutableRootMetadata
+	next := fetchStart
+	for next <= end {
+		batchEnd := next + mdBatchSize - 1
+		if batchEnd > end {
+			batchEnd = end
+		}
+		irmds, err := mdGetRange(ctx, config, tlfID, branchID, next, batchEnd)
+		if err != nil {
+			fmt.Printf("Revisions %s to %s: %v\n", next, batchEnd, err)
+			return false, nil
+		}
+
+		for _, irmd := range irmds {
+			if irmd.Revision() < start {
+				prev = irmd
+				continue
+			}
+			err := mdVerifyOne(prev, irmd)
+			switch {
+			case err != nil:
+				fmt.Printf("Revision %s: %v\n", irmd.Revision(), err)
+				clean = false
+			case verbose:
+				fmt.Printf("Revision %s: OK (%s)\n",
+					irmd.Revision(), irmd.MdID())
+			}
+			prev = irmd
+		}
+
+		if len(irmds) < int(batchEnd-next)+1 {
+			fmt.Printf("Revisions %s to %s: only got %d\n",
+				next, batchEnd, len(irmds))
+			return false, nil
+		}
+		next = batchEnd + 1
+	}
+
+	fmt.Printf("Checked %q revisions %s to %s\n", input, start, end)
+	return clean, nil
+}
+
+func mdVerifyRange(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs md verify-range", flag.ContinueOnError)
+	verbose := flags.Bool("v", false, "Print each revision that checks out.")
+	flags.Parse(args)
+
+	inputs := flags.Args()
+	if len(inputs) < 1 || len(inputs) > 3 {
+		fmt.Print(mdVerifyRangeUsageStr)
+		return 1
+	}
+
+	startStr, endStr := "1", "latest"
+	if len(inputs) > 1 {
+		startStr = inputs[1]
+	}
+	if len(inputs) > 2 {
+		endStr = inputs[2]
+	}
+
+	clean, err := mdVerifyRangeOne(
+		ctx, config, inputs[0], startStr, endStr, *verbose)
+	if err != nil {
+		printError("md verify-range", err)
+		return 1
+	}
+	if !clean {
+		return 1
+	}
+	return 0
+}
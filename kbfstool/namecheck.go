@@ -0,0 +1,90 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const namecheckUsageStr = `Usage:
+  kbfstool namecheck [-fix] /keybase/[public|private]/user1,assertion2
+
+Reports entries in a TLF that would be a problem on other platforms:
+names differing only in case, names Windows doesn't allow, and paths
+too long for Windows.  With -fix, renames the entries that renaming
+can fix to the suggested names.
+
+`
+
+func namecheckHelper(ctx context.Context, config libkbfs.Config,
+	tlfStr string, fix bool) (clean bool, err error) {
+	handle, err := getTlfHandle(ctx, config, tlfStr)
+	if err != nil {
+		return false, err
+	}
+
+	kbfsOps := config.KBFSOps()
+	rootNode, _, err := kbfsOps.GetRootNode(ctx, handle, libkbfs.MasterBranch)
+	if err != nil {
+		return false, err
+	}
+	if rootNode == nil {
+		return true, nil
+	}
+
+	conflicts, err := libkbfs.ScanPlatformConflicts(ctx, kbfsOps, rootNode)
+	if err != nil {
+		return false, err
+	}
+	for _, c := range conflicts {
+		if c.SuggestedName != "" {
+			fmt.Printf("%s: %s (rename to %q)\n", c.Path, c.Kind,
+				c.SuggestedName)
+		} else {
+			fmt.Printf("%s: %s\n", c.Path, c.Kind)
+		}
+	}
+	if !fix || len(conflicts) == 0 {
+		return len(conflicts) == 0, nil
+	}
+
+	err = libkbfs.FixPlatformConflicts(ctx, kbfsOps, rootNode, conflicts)
+	if err != nil {
+		return false, err
+	}
+
+	// Too-long paths are still there.
+	for _, c := range conflicts {
+		if c.SuggestedName == "" {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func namecheck(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs namecheck", flag.ContinueOnError)
+	fix := flags.Bool("fix", false, "Rename entries to the suggested names.")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Print(namecheckUsageStr)
+		return 1
+	}
+
+	clean, err := namecheckHelper(ctx, config, flags.Arg(0), *fix)
+	if err != nil {
+		printError("namecheck", err)
+		return 1
+	}
+	if !clean {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,105 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+const networkUsageStr = `Usage:
+  kbfstool network [-mount=/keybase] unmetered|metered|none|status
+  kbfstool network [-mount=/keybase] parallelism [puts=N|auto] [gets=N|auto]
+
+Like the journal commands, this talks to the KBFS instance that has
+the file system mounted at the given mount point, through its special
+files.  It's meant for scripts hooked up to a connectivity notifier of
+the OS.
+
+On a "metered" network, background journal flushes of more than 1 MB,
+and fetches for synced directories, wait for an "unmetered" one, and
+resume as soon as KBFS is told it's on one.  With no network at all
+("none"), KBFS acts as if it were in offline mode.  Coming back from
+"none" also registers for MD updates again right away.
+
+"parallelism" sets how many blocks KBFS puts and gets at once.  By
+default, it's about twice the measured bandwidth-delay product to the
+block server, so raising it mostly helps on links it hasn't measured
+yet, and lowering it cuts contention on weak links.  "auto", or no
+settings at all, goes back to the measured default.
+
+`
+
+// networkStatus is the part of the top-level status file that the
+// network command prints.
+type networkStatus struct {
+	IsConnected    bool
+	NetworkState   string
+	BlockTransfers libkbfs.BlockTransferStatus
+}
+
+func networkMain(args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs network", flag.ContinueOnError)
+	mount := flags.String("mount", "/keybase",
+		"Where the KBFS instance to talk to is mounted.")
+	flags.Parse(args)
+
+	if flags.NArg() < 1 ||
+		(flags.NArg() > 1 && flags.Arg(0) != "parallelism") {
+		fmt.Print(networkUsageStr)
+		return 1
+	}
+
+	var err error
+	switch cmd := flags.Arg(0); cmd {
+	case "status":
+		var status networkStatus
+		err = readStatusFile(*mount, &status)
+		if err != nil {
+			break
+		}
+		fmt.Printf("network: %s, connected: %t\n",
+			status.NetworkState, status.IsConnected)
+		xfers := status.BlockTransfers
+		fmt.Printf("block puts: %d at once, %.0f B/s, %s latency\n",
+			xfers.PutParallelism, xfers.PutBytesPerSec, xfers.PutLatency)
+		fmt.Printf("block gets: %d at once, %.0f B/s, %s latency\n",
+			xfers.GetParallelism, xfers.GetBytesPerSec, xfers.GetLatency)
+	case "parallelism":
+		setting := strings.Join(flags.Args()[1:], " ")
+		if setting == "" {
+			setting = "auto"
+		}
+		// Check the setting here, for a better error than the
+		// write would give.
+		_, _, err = libkbfs.ParseBlockParallelism(setting, 0, 0)
+		if err != nil {
+			break
+		}
+		err = ioutil.WriteFile(
+			filepath.Join(*mount, libfs.BlockParallelismFileName),
+			[]byte(setting), 0644)
+	default:
+		_, err = libkbfs.ParseNetworkState(cmd)
+		if err != nil {
+			err = fmt.Errorf("unknown command '%s'", cmd)
+			break
+		}
+		err = ioutil.WriteFile(
+			filepath.Join(*mount, libfs.NetworkStateFileName),
+			[]byte(cmd), 0644)
+	}
+	if err != nil {
+		printError("network", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,74 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/keybase/kbfs/libfs"
+)
+
+const offlineUsageStr = `Usage:
+  kbfstool offline [-mount=/keybase] on|off|status
+
+Like the journal commands, this talks to the KBFS instance that has
+the file system mounted at the given mount point, through its special
+files.
+
+While offline, KBFS doesn't talk to the MD or block servers at all.
+Files already in its caches or journals can still be read, writes to
+TLFs with journaling enabled are queued in their journals, and
+anything else fails right away instead of waiting for the servers.
+Turning offline mode off starts flushing the journals again.
+
+`
+
+// offlineStatus is the part of the top-level status file that the
+// offline command prints.
+type offlineStatus struct {
+	IsConnected bool
+	Offline     bool
+}
+
+func offlineMain(args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs offline", flag.ContinueOnError)
+	mount := flags.String("mount", "/keybase",
+		"Where the KBFS instance to talk to is mounted.")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Print(offlineUsageStr)
+		return 1
+	}
+
+	var err error
+	switch cmd := flags.Arg(0); cmd {
+	case "on", "off":
+		controlFileName := libfs.EnableOfflineFileName
+		if cmd == "off" {
+			controlFileName = libfs.DisableOfflineFileName
+		}
+		err = ioutil.WriteFile(filepath.Join(*mount, controlFileName),
+			[]byte("on"), 0644)
+	case "status":
+		var status offlineStatus
+		err = readStatusFile(*mount, &status)
+		if err != nil {
+			break
+		}
+		fmt.Printf("offline: %t, connected: %t\n",
+			status.Offline, status.IsConnected)
+	default:
+		err = fmt.Errorf("unknown command '%s'", cmd)
+	}
+	if err != nil {
+		printError("offline", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,263 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const quotaUsageStr = `Usage:
+  kbfstool quota [-json] [-watch=interval] [/keybase/[public|private]/user1,assertion2...]
+
+Prints how many bytes count against the current user's quota, and the
+limit.  It then attributes that usage to each of the given TLFs, or
+to each favorite TLF if none are given, by walking their blocks and
+adding up the ones the current user created.  That breakdown is only
+a best effort: blocks that only older revisions still reference
+count against quota too, but which writer created them isn't known,
+so they are only shown as each TLF's archived total.
+
+With -watch, the usage is printed again every interval, until
+interrupted.  TLFs that haven't changed since the last time aren't
+walked again.
+
+`
+
+// quotaTLFUsage is the usage attributed to one TLF.
+type quotaTLFUsage struct {
+	TLF string
+	// OwnBytes is the size of the blocks reachable from the head
+	// of the TLF that the current user created.
+	OwnBytes uint64
+	// BlockBytes is the size of every block reachable from the
+	// head of the TLF, whoever created it.
+	BlockBytes    uint64
+	ArchivedBytes uint64
+	Revision      libkbfs.MetadataRevision
+}
+
+// quotaTLFUsageByOwnBytes sorts the TLFs using the most of the
+// current user's quota first.
+type quotaTLFUsageByOwnBytes []quotaTLFUsage
+
+func (u quotaTLFUsageByOwnBytes) Len() int      { return len(u) }
+func (u quotaTLFUsageByOwnBytes) Swap(i, j int) { u[i], u[j] = u[j], u[i] }
+func (u quotaTLFUsageByOwnBytes) Less(i, j int) bool {
+	return u[i].OwnBytes > u[j].OwnBytes
+}
+
+// quotaReport is everything printed for one round of quota.
+type quotaReport struct {
+	Time          time.Time
+	UsedBytes     int64
+	ArchivedBytes int64
+	LimitBytes    int64
+	TLFs          []quotaTLFUsage
+	// UnattributedBytes is the part of UsedBytes not attributed
+	// to any TLF's live blocks, such as archived blocks and
+	// TLFs that weren't walked.
+	UnattributedBytes int64
+}
+
+// quotaWatcher computes quota reports, remembering the usage of each
+// TLF so it isn't walked again while its head stays the same.
+type quotaWatcher struct {
+	config libkbfs.Config
+	tlfs   []string
+	cache  map[string]quotaTLFUsage
+}
+
+// getTLFs returns the TLFs to attribute usage to.
+func (q *quotaWatcher) getTLFs(ctx context.Context) ([]string, error) {
+	if len(q.tlfs) > 0 {
+		return q.tlfs, nil
+	}
+	favs, err := q.config.KBFSOps().GetFavorites(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tlfs := make([]string, 0, len(favs))
+	for _, fav := range favs {
+		p := fsrpc.Path{
+			PathType: fsrpc.TLFPathType,
+			Public:   fav.Public,
+			TLFName:  fav.Name,
+		}
+		tlfs = append(tlfs, p.String())
+	}
+	sort.Strings(tlfs)
+	return tlfs, nil
+}
+
+// getTLFUsage returns the usage attributed to the given TLF, or false
+// if it hasn't been created yet.
+func (q *quotaWatcher) getTLFUsage(ctx context.Context, tlfStr string,
+	uid keybase1.UID) (quotaTLFUsage, bool, error) {
+	handle, err := getTlfHandle(ctx, q.config, tlfStr)
+	if err != nil {
+		return quotaTLFUsage{}, false, err
+	}
+	kbfsOps := q.config.KBFSOps()
+	rootNode, _, err := kbfsOps.GetRootNode(ctx, handle, libkbfs.MasterBranch)
+	if err != nil {
+		return quotaTLFUsage{}, false, err
+	}
+	if rootNode == nil {
+		return quotaTLFUsage{}, false, nil
+	}
+	status, _, err := kbfsOps.FolderStatus(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		return quotaTLFUsage{}, false, err
+	}
+	if cached, ok := q.cache[tlfStr]; ok &&
+		cached.Revision == status.Revision {
+		return cached, true, nil
+	}
+
+	usage, err := kbfsOps.GetSubtreeUsage(ctx, rootNode)
+	if err != nil {
+		return quotaTLFUsage{}, false, err
+	}
+	tlfUsage := quotaTLFUsage{
+		TLF:           tlfStr,
+		OwnBytes:      usage.CreatorBytes[uid],
+		BlockBytes:    usage.BlockBytes,
+		ArchivedBytes: usage.ArchivedBytes,
+		Revision:      status.Revision,
+	}
+	q.cache[tlfStr] = tlfUsage
+	return tlfUsage, true, nil
+}
+
+func (q *quotaWatcher) getReport(ctx context.Context) (quotaReport, error) {
+	info, err := q.config.KBFSOps().GetUserQuotaInfo(ctx)
+	if err != nil {
+		return quotaReport{}, err
+	}
+	report := quotaReport{
+		Time:       q.config.Clock().Now(),
+		UsedBytes:  info.UsedBytes(),
+		LimitBytes: info.Limit,
+	}
+	if info.Total != nil {
+		report.ArchivedBytes = info.Total.Bytes[libkbfs.UsageArchive]
+	}
+
+	_, uid, err := q.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return quotaReport{}, err
+	}
+	tlfs, err := q.getTLFs(ctx)
+	if err != nil {
+		return quotaReport{}, err
+	}
+	report.UnattributedBytes = report.UsedBytes
+	for _, tlfStr := range tlfs {
+		tlfUsage, ok, err := q.getTLFUsage(ctx, tlfStr, uid)
+		if err != nil {
+			// The breakdown is best-effort, so one broken TLF
+			// shouldn't hide the rest.
+			printError("quota", fmt.Errorf("%s: %v", tlfStr, err))
+			continue
+		}
+		if !ok {
+			continue
+		}
+		report.TLFs = append(report.TLFs, tlfUsage)
+		report.UnattributedBytes -= int64(tlfUsage.OwnBytes)
+	}
+	sort.Stable(quotaTLFUsageByOwnBytes(report.TLFs))
+	return report, nil
+}
+
+func printQuotaReport(report quotaReport) error {
+	fmt.Printf("%s: %s used", report.Time.Format(time.RFC3339),
+		byteCountStr(int(report.UsedBytes)))
+	if report.LimitBytes > 0 && report.LimitBytes < math.MaxInt64 {
+		fmt.Printf(" of %s (%.1f%%)", byteCountStr(int(report.LimitBytes)),
+			100*float64(report.UsedBytes)/float64(report.LimitBytes))
+	}
+	fmt.Printf(", %s of it archived\n",
+		byteCountStr(int(report.ArchivedBytes)))
+	if len(report.TLFs) == 0 {
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprint(w, "YOURS\tBLOCKS\tARCHIVED\t\n")
+	for _, tlfUsage := range report.TLFs {
+		fmt.Fprintf(w, "%d\t%d\t%d\t  %s\n", tlfUsage.OwnBytes,
+			tlfUsage.BlockBytes, tlfUsage.ArchivedBytes, tlfUsage.TLF)
+	}
+	err := w.Flush()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s not attributed to the live blocks of any TLF above\n",
+		byteCountStr(int(report.UnattributedBytes)))
+	return nil
+}
+
+func quota(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs quota", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "Print each report as JSON.")
+	watch := flags.Duration("watch", 0,
+		"If non-zero, print the usage again at this interval.")
+	flags.Parse(args)
+
+	if *watch < 0 {
+		fmt.Print(quotaUsageStr)
+		return 1
+	}
+
+	q := &quotaWatcher{
+		config: config,
+		tlfs:   flags.Args(),
+		cache:  make(map[string]quotaTLFUsage),
+	}
+	for {
+		report, err := q.getReport(ctx)
+		if err != nil {
+			printError("quota", err)
+			return 1
+		}
+		if *asJSON {
+			buf, err := json.MarshalIndent(report, "", "  ")
+			if err != nil {
+				printError("quota", err)
+				return 1
+			}
+			fmt.Printf("%s\n", buf)
+		} else {
+			err := printQuotaReport(report)
+			if err != nil {
+				printError("quota", err)
+				return 1
+			}
+		}
+
+		if *watch == 0 {
+			return 0
+		}
+		select {
+		case <-time.After(*watch):
+		case <-ctx.Done():
+			return 0
+		}
+		fmt.Println()
+	}
+}
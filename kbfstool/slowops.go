@@ -0,0 +1,103 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+const slowOpsUsageStr = `Usage:
+  kbfstool slowops [-mount=/keybase] [-stacks]
+
+Like the journal commands, this talks to the KBFS instance that has
+the file system mounted at the given mount point, through its special
+files.  It prints the diagnostics KBFS dumped for its most recent
+operations that ran longer than its -slow-op-threshold: the locks
+every operation held or waited for, the RPCs still waiting on a
+server or on the Keybase service, and the state of the journals.
+With -stacks, the goroutine stacks of the slow operation and of the
+lock holders are printed too.
+
+`
+
+func printSlowOpReport(r libkbfs.SlowOpReport, stacks bool) {
+	fmt.Printf("%s: %s running for %s, tags %v\n",
+		r.Time.Format("2006-01-02 15:04:05.000"), r.Op, r.Elapsed, r.Tags)
+	for _, l := range r.Locks {
+		fmt.Printf("  goroutine %d holds %v", l.Goroutine, l.Held)
+		if l.Waiting != "" {
+			fmt.Printf(", waiting for %s", l.Waiting)
+			if l.WaitingSince != nil {
+				fmt.Printf(" for %s", r.Time.Sub(*l.WaitingSince))
+			}
+		}
+		fmt.Printf("\n")
+	}
+	for _, call := range r.PendingRPCs {
+		fmt.Printf("  %s RPC %s pending for %s, tags %v\n",
+			call.Server, call.Method, r.Time.Sub(call.Start), call.Tags)
+	}
+	if r.Journal != nil {
+		fmt.Printf("  %d journals, %d unflushed bytes\n",
+			r.Journal.JournalCount, r.Journal.UnflushedBytes)
+	}
+	if !stacks {
+		return
+	}
+	// The op's own stack first, then those of the lock holders.
+	fmt.Printf("\n%s\n", r.Stacks[r.Goroutine])
+	var others []int
+	for id := range r.Stacks {
+		if id != r.Goroutine {
+			others = append(others, int(id))
+		}
+	}
+	sort.Ints(others)
+	for _, id := range others {
+		fmt.Printf("\n%s\n", r.Stacks[uint64(id)])
+	}
+	fmt.Printf("\n")
+}
+
+func slowOpsMain(args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs slowops", flag.ContinueOnError)
+	mount := flags.String("mount", "/keybase",
+		"Where the KBFS instance to talk to is mounted.")
+	stacks := flags.Bool("stacks", false,
+		"Print the goroutine stacks of each slow operation.")
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		fmt.Print(slowOpsUsageStr)
+		return 1
+	}
+
+	buf, err := ioutil.ReadFile(filepath.Join(*mount, libfs.SlowOpsFileName))
+	if err != nil {
+		printError("slowops", err)
+		return 1
+	}
+	var reports []libkbfs.SlowOpReport
+	err = json.Unmarshal(buf, &reports)
+	if err != nil {
+		printError("slowops", err)
+		return 1
+	}
+	if len(reports) == 0 {
+		fmt.Printf("No slow operations.\n")
+	}
+	for _, r := range reports {
+		printSlowOpReport(r, *stacks)
+	}
+	return 0
+}
@@ -0,0 +1,90 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const stateCheckUsageStr = `Usage:
+  kbfstool statecheck [-rate=n] [-v] /keybase/[public|private]/user1,assertion2 [tlfs...]
+
+Replays the block changes of every revision of each TLF, and reports
+blocks that are referenced but unreachable from the head (leaked),
+reachable but never referenced, missing from the block server, or
+whose sizes don't add up to the head's disk usage.  Changes made to a
+TLF while it's checked can show up as problems, so check again before
+acting on them.
+
+`
+
+func stateCheckOne(ctx context.Context, config libkbfs.Config,
+	tlfStr string, opts libkbfs.StateCheckOptions,
+	verbose bool) (clean bool, err error) {
+	handle, err := getTlfHandle(ctx, config, tlfStr)
+	if err != nil {
+		return false, err
+	}
+	rootNode, _, err := config.KBFSOps().GetRootNode(
+		ctx, handle, libkbfs.MasterBranch)
+	if err != nil {
+		return false, err
+	}
+	if rootNode == nil {
+		fmt.Printf("%s: no revisions to check\n", tlfStr)
+		return true, nil
+	}
+
+	report, err := libkbfs.NewStateChecker(config).Check(
+		ctx, rootNode.GetFolderBranch().Tlf, opts)
+	if err != nil {
+		return false, err
+	}
+
+	fmt.Printf("%s (TLF %s, revision %d): checked %d revisions, "+
+		"%d live blocks\n", tlfStr, report.Tlf, report.Revision,
+		report.RevisionsChecked, report.LiveBlocks)
+	for _, problem := range report.Problems {
+		if verbose {
+			fmt.Printf("  %s\n", problem)
+		} else {
+			fmt.Printf("  %s: %s\n", problem.Kind, problem.Detail)
+		}
+	}
+	return report.IsClean(), nil
+}
+
+func stateCheck(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs statecheck", flag.ContinueOnError)
+	rate := flags.Int("rate", 0,
+		"Fetch at most this many MD batches and blocks per second (0 for no limit).")
+	verbose := flags.Bool("v", false,
+		"Print block pointers and revisions for problems.")
+	flags.Parse(args)
+
+	inputs := flags.Args()
+	if len(inputs) < 1 {
+		fmt.Print(stateCheckUsageStr)
+		return 1
+	}
+
+	opts := libkbfs.StateCheckOptions{RequestsPerSecond: *rate}
+	for _, input := range inputs {
+		clean, err := stateCheckOne(ctx, config, input, opts, *verbose)
+		if err != nil {
+			printError("statecheck", err)
+			return 1
+		}
+		if !clean {
+			exitStatus = 1
+		}
+	}
+
+	return exitStatus
+}
@@ -0,0 +1,136 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+const syncUsageStr = `Usage:
+  kbfstool sync [-mount=/keybase] on|off|status /keybase/[public|private]/user1,assertion2[/path]...
+
+Like the journal commands, this talks to the KBFS instance that has
+the file system mounted at the given mount point, through its special
+files.
+
+"on" keeps every block under each given directory, as of the latest
+revision of its TLF, on local disk, so that it stays readable while
+offline.  The blocks are fetched in the background, and again
+whenever the TLF changes.  "off" undoes "on" for the same directory,
+and drops the blocks no longer needed.  "status" shows how far along
+syncing the TLF of each given path is.
+
+`
+
+// syncTLFStatus is the part of a TLF's status file that the sync
+// command prints.
+type syncTLFStatus struct {
+	Revision libkbfs.MetadataRevision
+	Sync     *libkbfs.TLFSyncStatus
+}
+
+// syncDir returns the directory for pathStr under mount.
+func syncDir(mount, pathStr string) (string, error) {
+	p, err := fsrpc.NewPath(pathStr)
+	if err != nil {
+		return "", err
+	}
+	if p.PathType != fsrpc.TLFPathType {
+		return "", fmt.Errorf("%q is not a path within a TLF", pathStr)
+	}
+	visibility := privateName
+	if p.Public {
+		visibility = publicName
+	}
+	components := append(
+		[]string{mount, visibility, p.TLFName}, p.TLFComponents...)
+	return filepath.Join(components...), nil
+}
+
+func syncStatus(dir, pathStr string) error {
+	var status syncTLFStatus
+	err := readStatusFile(dir, &status)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s:\n", pathStr)
+	s := status.Sync
+	if s == nil {
+		fmt.Print("  not synced\n")
+		return nil
+	}
+	paths := make([]string, 0, len(s.Paths))
+	for _, p := range s.Paths {
+		if p == "" {
+			p = "/"
+		}
+		paths = append(paths, p)
+	}
+	fmt.Printf("  paths: %s\n", strings.Join(paths, ", "))
+	fmt.Printf("  %.1f%% of %s on disk", s.PercentDone,
+		byteCountStr(int(s.BytesTotal)))
+	switch {
+	case s.Syncing:
+		fmt.Printf(", syncing revision %d", status.Revision)
+	case s.Revision == libkbfs.MetadataRevisionUninitialized:
+		fmt.Print(", not synced yet")
+	default:
+		fmt.Printf(", synced as of revision %d", s.Revision)
+	}
+	fmt.Print("\n")
+	if s.WaitingForUnmetered {
+		fmt.Print("  waiting for an unmetered network\n")
+	}
+	if s.LastError != "" {
+		fmt.Printf("  last error: %s\n", s.LastError)
+	}
+	return nil
+}
+
+func syncMain(args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs sync", flag.ContinueOnError)
+	mount := flags.String("mount", "/keybase",
+		"Where the KBFS instance to talk to is mounted.")
+	flags.Parse(args)
+
+	if flags.NArg() < 2 {
+		fmt.Print(syncUsageStr)
+		return 1
+	}
+
+	cmd := flags.Arg(0)
+	for _, pathStr := range flags.Args()[1:] {
+		dir, err := syncDir(*mount, pathStr)
+		if err == nil {
+			switch cmd {
+			case "on", "off":
+				controlFileName := libfs.EnableSyncFileName
+				if cmd == "off" {
+					controlFileName = libfs.DisableSyncFileName
+				}
+				err = ioutil.WriteFile(filepath.Join(dir, controlFileName),
+					[]byte("on"), 0644)
+			case "status":
+				err = syncStatus(dir, pathStr)
+			default:
+				err = fmt.Errorf("unknown command '%s'", cmd)
+			}
+		}
+		if err != nil {
+			printError("sync", err)
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,135 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+const usageUsageStr = `Usage:
+  kbfstool usage [-mount=/keybase] [-days=N] [-daily]
+
+Like the journal commands, this talks to the KBFS instance that has
+the file system mounted at the given mount point, through its special
+files.  It prints how many bytes each TLF has sent to and received
+from the block and MD servers, and how many RPCs it took, over the
+last N days, today included, biggest users first.  KBFS remembers
+the last 30 days.  With -daily, each day is printed separately.
+
+`
+
+// usageTLF is the usage of one TLF over some days.
+type usageTLF struct {
+	TLF string
+	libkbfs.TLFUsage
+}
+
+// usageTLFByBytes sorts the TLFs that used the most network first.
+type usageTLFByBytes []usageTLF
+
+func (u usageTLFByBytes) Len() int      { return len(u) }
+func (u usageTLFByBytes) Swap(i, j int) { u[i], u[j] = u[j], u[i] }
+func (u usageTLFByBytes) Less(i, j int) bool {
+	bi := u[i].BytesUp + u[i].BytesDown
+	bj := u[j].BytesUp + u[j].BytesDown
+	if bi != bj {
+		return bi > bj
+	}
+	return u[i].TLF < u[j].TLF
+}
+
+// sumUsage adds up the usage of each TLF over the given days.
+func sumUsage(days []libkbfs.UsageDay) []usageTLF {
+	byID := make(map[string]*usageTLF)
+	for _, day := range days {
+		for id, u := range day.TLFs {
+			total, ok := byID[id]
+			if !ok {
+				total = &usageTLF{TLF: id}
+				byID[id] = total
+			}
+			if u.Name != "" {
+				total.TLF = u.Name
+			}
+			total.BytesUp += u.BytesUp
+			total.BytesDown += u.BytesDown
+			total.BlockRPCs += u.BlockRPCs
+			total.MDRPCs += u.MDRPCs
+		}
+	}
+	tlfs := make([]usageTLF, 0, len(byID))
+	for _, u := range byID {
+		tlfs = append(tlfs, *u)
+	}
+	sort.Sort(usageTLFByBytes(tlfs))
+	return tlfs
+}
+
+func printUsage(title string, tlfs []usageTLF) {
+	fmt.Printf("%s:\n", title)
+	if len(tlfs) == 0 {
+		fmt.Printf("  No network usage.\n")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "  TLF\tBytes up\tBytes down\tBlock RPCs\tMD RPCs\n")
+	for _, u := range tlfs {
+		fmt.Fprintf(w, "  %s\t%d\t%d\t%d\t%d\n",
+			u.TLF, u.BytesUp, u.BytesDown, u.BlockRPCs, u.MDRPCs)
+	}
+	w.Flush()
+}
+
+func usageMain(args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs usage", flag.ContinueOnError)
+	mount := flags.String("mount", "/keybase",
+		"Where the KBFS instance to talk to is mounted.")
+	numDays := flags.Int("days", 30,
+		"How many days, counting today, to print the usage of.")
+	daily := flags.Bool("daily", false, "Print each day separately.")
+	flags.Parse(args)
+
+	if flags.NArg() != 0 || *numDays <= 0 {
+		fmt.Print(usageUsageStr)
+		return 1
+	}
+
+	buf, err := ioutil.ReadFile(filepath.Join(*mount, libfs.UsageFileName))
+	if err != nil {
+		printError("usage", err)
+		return 1
+	}
+	var days []libkbfs.UsageDay
+	err = json.Unmarshal(buf, &days)
+	if err != nil {
+		printError("usage", err)
+		return 1
+	}
+	// Days with no usage aren't recorded, so go by date.
+	since := time.Now().AddDate(0, 0, 1-*numDays).Format("2006-01-02")
+	for len(days) > 0 && days[0].Date < since {
+		days = days[1:]
+	}
+
+	if !*daily {
+		printUsage(fmt.Sprintf("Since %s", since), sumUsage(days))
+		return 0
+	}
+	for _, day := range days {
+		printUsage(day.Date, sumUsage([]libkbfs.UsageDay{day}))
+	}
+	return 0
+}
@@ -0,0 +1,138 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// Keybase file system, served over WebDAV
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/keybase/kbfs/env"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/keybase/kbfs/libwebdav"
+)
+
+var listen = flag.String("listen", "127.0.0.1:8080", "TCP address to serve WebDAV on")
+var passwordFile = flag.String("password-file", "", "file holding the password clients must give (default: a new one for each run, printed at startup)")
+var allowedHosts = flag.String("allowed-hosts", "", "comma-separated host:port values requests may be addressed to (default: the -listen address, and localhost for a loopback one)")
+var version = flag.Bool("version", false, "Print version")
+
+const usageFormatStr = `Usage:
+  kbfswebdav -version
+
+To run against remote KBFS servers:
+  kbfswebdav [-debug] [-cpuprofile=path/to/dir] [-profile=name]
+    [-bserver=%s] [-mdserver=%s]
+    [-listen=host:port] [-password-file=path/to/file]
+    [-allowed-hosts=host:port[,host:port...]]
+    [-log-to-file] [-log-file=path/to/file]]
+
+To run in a local testing environment:
+  kbfswebdav [-debug] [-cpuprofile=path/to/dir] [-profile=name]
+    [-server-in-memory|-server-root=path/to/dir] [-localuser=<user>]
+    [-listen=host:port] [-password-file=path/to/file]
+    [-allowed-hosts=host:port[,host:port...]]
+    [-log-to-file] [-log-file=path/to/file]]
+
+Clients must give the password, with any user name, through HTTP
+Basic authentication, and then see KBFS as the logged-in user does.
+The password is sent in the clear, so only listen on a non-loopback
+address if the network can't be snooped on.
+
+`
+
+func getUsageStr(ctx libkbfs.Context) string {
+	defaultBServer := libkbfs.GetDefaultBServer(ctx)
+	if len(defaultBServer) == 0 {
+		defaultBServer = "host:port"
+	}
+	defaultMDServer := libkbfs.GetDefaultMDServer(ctx)
+	if len(defaultMDServer) == 0 {
+		defaultMDServer = "host:port"
+	}
+	return fmt.Sprintf(usageFormatStr, defaultBServer, defaultMDServer)
+}
+
+func start() *libfs.Error {
+	ctx := env.NewContext()
+
+	kbfsParams := libkbfs.AddFlags(flag.CommandLine, ctx)
+
+	flag.Parse()
+
+	if *version {
+		fmt.Printf("%s\n", libkbfs.VersionString())
+		return nil
+	}
+
+	if err := libkbfs.ApplyInitProfile(flag.CommandLine, kbfsParams); err != nil {
+		return libfs.InitError(err.Error())
+	}
+
+	if len(flag.Args()) > 0 {
+		fmt.Fprint(os.Stderr, getUsageStr(ctx))
+		return libfs.InitError("extra arguments specified (flags go before the first argument)")
+	}
+
+	var password string
+	if *passwordFile != "" {
+		b, err := ioutil.ReadFile(*passwordFile)
+		if err != nil {
+			return libfs.InitError(err.Error())
+		}
+		password = strings.TrimSpace(string(b))
+		if password == "" {
+			return libfs.InitError("empty password file")
+		}
+	} else {
+		var err error
+		password, err = libwebdav.MakeSessionPassword()
+		if err != nil {
+			return libfs.InitError(err.Error())
+		}
+		fmt.Printf("Password for this session: %s\n", password)
+	}
+
+	var hosts []string
+	if *allowedHosts != "" {
+		for _, host := range strings.Split(*allowedHosts, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				hosts = append(hosts, host)
+			}
+		}
+	} else {
+		var err error
+		hosts, err = libwebdav.HostsForListenAddr(*listen)
+		if err != nil {
+			return libfs.InitError(err.Error())
+		}
+	}
+
+	options := libwebdav.StartOptions{
+		KbfsParams: *kbfsParams,
+		ListenAddr: *listen,
+		Access: libwebdav.AccessOptions{
+			Password:     password,
+			AllowedHosts: hosts,
+		},
+	}
+
+	return libwebdav.Start(options, ctx)
+}
+
+func main() {
+	err := start()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kbfswebdav error: (%d) %s\n", err.Code, err.Message)
+
+		os.Exit(err.Code)
+	}
+	os.Exit(0)
+}
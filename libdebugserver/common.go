@@ -0,0 +1,46 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdebugserver
+
+const (
+	// InspectorPrefix is the URL path under which the JSON
+	// inspectors are served.  It lists them.
+	InspectorPrefix = "/debug/kbfs/"
+
+	// StatusInspector serves the same status as the top-level
+	// status file of a mount.
+	StatusInspector = "status"
+	// BlockCacheInspector serves a summary of the contents of the
+	// block cache.
+	BlockCacheInspector = "blockcache"
+	// NodeCacheInspector serves how many nodes are in memory for
+	// each open folder-branch.
+	NodeCacheInspector = "nodecache"
+	// JournalsInspector serves the status of every journal.
+	JournalsInspector = "journals"
+	// FoldersInspector serves the status of every open
+	// folder-branch.
+	FoldersInspector = "folders"
+	// SlowOpsInspector serves the diagnostics of the most recent
+	// slow operations.
+	SlowOpsInspector = "slowops"
+	// HealthInspector serves the summary returned by
+	// KBFSOps.Health.
+	HealthInspector = "health"
+	// UsageInspector serves the daily network usage of each TLF.
+	UsageInspector = "usage"
+
+	// KBFSVarName is the name the KBFS counters are served under
+	// in /debug/vars.
+	KBFSVarName = "kbfs"
+)
+
+// inspectorNames lists the inspectors, in the order they're listed at
+// InspectorPrefix.
+var inspectorNames = []string{
+	StatusInspector, BlockCacheInspector, NodeCacheInspector,
+	JournalsInspector, FoldersInspector, SlowOpsInspector,
+	HealthInspector, UsageInspector,
+}
@@ -0,0 +1,181 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdebugserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+func doRequest(s *Server, method, p string) *httptest.ResponseRecorder {
+	return doRequestForHost(s, method, "127.0.0.1:8082", p)
+}
+
+func doRequestForHost(s *Server, method, host, p string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, p, nil)
+	r.Host = host
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func getJSONOrBust(t *testing.T, s *Server, p string, value interface{}) {
+	w := doRequest(s, "GET", p)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s: status %d: %s", p, w.Code, w.Body.String())
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), value); err != nil {
+		t.Fatalf("GET %s: %v", p, err)
+	}
+}
+
+func TestInspectors(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	root := libkbfs.GetRootNodeOrBust(t, config, "jdoe", false)
+	ctx := libkbfs.BackgroundContextWithCancellationDelayer()
+	defer libkbfs.CleanupCancellationDelayer(ctx)
+	_, _, err := config.KBFSOps().CreateFile(
+		ctx, root, "a", false, libkbfs.NoExcl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(config)
+
+	w := doRequest(s, "GET", InspectorPrefix)
+	for _, name := range inspectorNames {
+		if !strings.Contains(w.Body.String(), InspectorPrefix+name) {
+			t.Errorf("%s not listed in %q", name, w.Body.String())
+		}
+	}
+
+	var status libkbfs.KBFSStatus
+	getJSONOrBust(t, s, InspectorPrefix+StatusInspector, &status)
+	if status.CurrentUser != "jdoe" {
+		t.Errorf("Unexpected user %q", status.CurrentUser)
+	}
+
+	var nodes NodeCacheStatus
+	getJSONOrBust(t, s, InspectorPrefix+NodeCacheInspector, &nodes)
+	if len(nodes.Nodes) != 1 || nodes.TotalNodes < 2 {
+		t.Errorf("Unexpected node cache status %+v", nodes)
+	}
+
+	var folders map[string]libkbfs.FolderBranchStatus
+	getJSONOrBust(t, s, InspectorPrefix+FoldersInspector, &folders)
+	if len(folders) != 1 {
+		t.Errorf("Unexpected folder statuses %+v", folders)
+	}
+	for _, f := range folders {
+		if len(f.DirtyPaths) != 0 || f.NodeCacheSize != nodes.TotalNodes {
+			t.Errorf("Unexpected folder status %+v", f)
+		}
+	}
+
+	var bcache libkbfs.BlockCacheStatus
+	getJSONOrBust(t, s, InspectorPrefix+BlockCacheInspector, &bcache)
+	if bcache.CleanBytesCapacity == 0 {
+		t.Errorf("Unexpected block cache status %+v", bcache)
+	}
+
+	var reports []libkbfs.SlowOpReport
+	getJSONOrBust(t, s, InspectorPrefix+SlowOpsInspector, &reports)
+	if len(reports) != 0 {
+		t.Errorf("Unexpected slow ops %+v", reports)
+	}
+
+	var health libkbfs.KBFSHealth
+	getJSONOrBust(t, s, InspectorPrefix+HealthInspector, &health)
+	if health.State != libkbfs.HealthOK || len(health.TLFs) != 1 {
+		t.Errorf("Unexpected health %+v", health)
+	}
+
+	var usage []libkbfs.UsageDay
+	getJSONOrBust(t, s, InspectorPrefix+UsageInspector, &usage)
+	if len(usage) != 0 {
+		// The test servers are local, and cost no network.
+		t.Errorf("Unexpected usage %+v", usage)
+	}
+
+	// There's no journal server to inspect.
+	w = doRequest(s, "GET", InspectorPrefix+JournalsInspector)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Unexpected status %d for journals", w.Code)
+	}
+}
+
+func TestVarsAndProfiles(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	libkbfs.GetRootNodeOrBust(t, config, "jdoe", false)
+	s := New(config)
+
+	var vars map[string]json.RawMessage
+	getJSONOrBust(t, s, "/debug/vars", &vars)
+	if _, ok := vars["memstats"]; !ok {
+		t.Errorf("No memstats in %v", vars)
+	}
+	var kbfs kbfsVars
+	if err := json.Unmarshal(vars[KBFSVarName], &kbfs); err != nil {
+		t.Fatal(err)
+	}
+	if kbfs.OpenFolders != 1 || kbfs.Nodes == 0 || kbfs.BlockCache == nil {
+		t.Errorf("Unexpected KBFS vars %+v", kbfs)
+	}
+
+	w := doRequest(s, "GET", "/debug/pprof/goroutine?debug=1")
+	if w.Code != http.StatusOK ||
+		!strings.Contains(w.Body.String(), "goroutine") {
+		t.Errorf("Unexpected goroutine profile: %d %q", w.Code, w.Body)
+	}
+
+	// Nothing can be changed.
+	w = doRequest(s, "POST", InspectorPrefix+StatusInspector)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Unexpected status %d for POST", w.Code)
+	}
+}
+
+func TestCheckLoopback(t *testing.T) {
+	for _, addr := range []string{
+		"127.0.0.1:8082", "localhost:8082", "[::1]:8082"} {
+		if err := checkLoopback(addr); err != nil {
+			t.Errorf("%s: %v", addr, err)
+		}
+	}
+	for _, addr := range []string{":8082", "0.0.0.0:8082", "10.0.0.1:8082",
+		"example.com:8082", "127.0.0.1"} {
+		if err := checkLoopback(addr); err == nil {
+			t.Errorf("%s unexpectedly allowed", addr)
+		}
+	}
+}
+
+func TestHostHeader(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	s := New(config)
+
+	for _, host := range []string{"127.0.0.1:8082", "localhost:8082",
+		"LOCALHOST.:8082", "[::1]:8082", "localhost"} {
+		w := doRequestForHost(s, "GET", host, "/debug/vars")
+		if w.Code != http.StatusOK {
+			t.Errorf("Unexpected status %d for host %s", w.Code, host)
+		}
+	}
+	// A DNS-rebound page keeps its own host name.
+	for _, host := range []string{"evil.example.com:8082",
+		"evil.example.com", "10.0.0.1:8082", ""} {
+		w := doRequestForHost(s, "GET", host, "/debug/vars")
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Unexpected status %d for host %q", w.Code, host)
+		}
+	}
+}
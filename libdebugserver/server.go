@@ -0,0 +1,368 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdebugserver
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/keybase/kbfs/metricsutil"
+	"golang.org/x/net/context"
+)
+
+// Server serves diagnostics of a KBFS instance over HTTP: profiles
+// under /debug/pprof/, expvar variables under /debug/vars, and
+// read-only JSON inspectors under InspectorPrefix.  It's for
+// tracking down memory and latency problems in production, so it
+// changes nothing.
+//
+// The diagnostics give away TLF IDs, the paths of dirty files and
+// goroutine stacks, and pprof can be made to work hard, so
+// ListenAndServe only ever listens on a loopback address, and
+// ServeHTTP only answers requests for a loopback host name.
+type Server struct {
+	config libkbfs.Config
+	log    logger.Logger
+	mux    *http.ServeMux
+}
+
+var _ http.Handler = (*Server)(nil)
+
+// New creates a Server for the KBFS instance of config.
+func New(config libkbfs.Config) *Server {
+	s := &Server{
+		config: config,
+		log:    config.MakeLogger("kbfsdebug"),
+		mux:    http.NewServeMux(),
+	}
+	// Don't use the handlers net/http/pprof registers on
+	// http.DefaultServeMux, so that nothing else in the process
+	// serves them by accident.
+	s.mux.HandleFunc("/debug/pprof/", pprof.Index)
+	s.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	s.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	s.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	s.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	s.mux.HandleFunc("/debug/vars", s.serveVars)
+	s.mux.HandleFunc(InspectorPrefix, s.serveInspectorIndex)
+	for name, inspect := range s.inspectors() {
+		inspect := inspect
+		s.mux.HandleFunc(InspectorPrefix+name,
+			func(w http.ResponseWriter, r *http.Request) {
+				s.serveJSON(w, r, inspect)
+			})
+	}
+	return s
+}
+
+// isLoopbackHost returns whether host, which may be followed by a
+// port, names a loopback address.
+func isLoopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+// checkLoopback returns an error unless addr is a loopback address.
+func checkLoopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if !isLoopbackHost(host) {
+		return fmt.Errorf("%s is not a loopback address", addr)
+	}
+	return nil
+}
+
+// ListenAndServe serves s on addr, which must be a loopback address
+// like "127.0.0.1:8082", until ctx is canceled.
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	if err := checkLoopback(addr); err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.log.Debug("Serving debug info over HTTP on %s", l.Addr())
+	go func() {
+		<-ctx.Done()
+		// Closing the listener makes Serve return.
+		l.Close()
+	}()
+	err = (&http.Server{Handler: s}).Serve(l)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// ServeHTTP implements the http.Handler interface for Server.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Listening on loopback isn't enough by itself: a web page
+	// can point its own host name at 127.0.0.1 (DNS rebinding)
+	// and then read our responses as same-origin.  Such requests
+	// still carry the page's host name, so refuse any that don't
+	// name a loopback host.
+	if !isLoopbackHost(r.Host) {
+		s.log.Debug("Refusing request for host %q", r.Host)
+		status := http.StatusForbidden
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		status := http.StatusMethodNotAllowed
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	s.log.Debug("%s %s", r.Method, r.URL.Path)
+	s.mux.ServeHTTP(w, r)
+}
+
+// inspector returns the value an inspector serves as JSON.
+type inspector func(ctx context.Context) (interface{}, error)
+
+// inspectors returns the inspectors of s, by name under
+// InspectorPrefix.
+func (s *Server) inspectors() map[string]inspector {
+	return map[string]inspector{
+		StatusInspector:     s.inspectStatus,
+		BlockCacheInspector: s.inspectBlockCache,
+		NodeCacheInspector:  s.inspectNodeCache,
+		JournalsInspector:   s.inspectJournals,
+		FoldersInspector:    s.inspectFolders,
+		SlowOpsInspector:    s.inspectSlowOps,
+		HealthInspector:     s.inspectHealth,
+		UsageInspector:      s.inspectUsage,
+	}
+}
+
+func (s *Server) serveInspectorIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != InspectorPrefix {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, name := range inspectorNames {
+		fmt.Fprintf(w, "%s%s\n", InspectorPrefix, name)
+	}
+}
+
+func (s *Server) serveJSON(w http.ResponseWriter, r *http.Request,
+	inspect inspector) {
+	ctx := libkbfs.BackgroundContextWithCancellationDelayer()
+	defer libkbfs.CleanupCancellationDelayer(ctx)
+	value, err := inspect(ctx)
+	if err != nil {
+		s.log.CDebugf(ctx, "Error inspecting %s: %v", r.URL.Path, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data, err := libfs.PrettyJSON(value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(data)
+}
+
+func (s *Server) inspectStatus(ctx context.Context) (interface{}, error) {
+	status, _, err := s.config.KBFSOps().Status(ctx)
+	// The status is worth showing even with an error.
+	if err != nil {
+		s.log.CDebugf(ctx, "Error getting status: %v", err)
+	}
+	return status, nil
+}
+
+func (s *Server) inspectBlockCache(ctx context.Context) (interface{}, error) {
+	bcache, ok := s.config.BlockCache().(*libkbfs.BlockCacheStandard)
+	if !ok {
+		return nil, fmt.Errorf(
+			"Can't inspect a block cache of type %T", s.config.BlockCache())
+	}
+	return bcache.Status(), nil
+}
+
+// openFolderBranches returns the folder-branches open in the KBFS
+// instance, or an error if its KBFSOps can't say.
+func (s *Server) openFolderBranches() ([]libkbfs.FolderBranch, error) {
+	kbfsOps, ok := s.config.KBFSOps().(*libkbfs.KBFSOpsStandard)
+	if !ok {
+		return nil, fmt.Errorf(
+			"Can't list the folders of a KBFSOps of type %T",
+			s.config.KBFSOps())
+	}
+	return kbfsOps.OpenFolderBranches(), nil
+}
+
+// folderStatuses returns the status of each open folder-branch, keyed
+// by its string form.
+func (s *Server) folderStatuses(ctx context.Context) (
+	map[string]libkbfs.FolderBranchStatus, error) {
+	fbs, err := s.openFolderBranches()
+	if err != nil {
+		return nil, err
+	}
+	statuses := make(map[string]libkbfs.FolderBranchStatus, len(fbs))
+	for _, fb := range fbs {
+		status, _, err := s.config.KBFSOps().FolderStatus(ctx, fb)
+		if err != nil {
+			return nil, err
+		}
+		statuses[fb.String()] = status
+	}
+	return statuses, nil
+}
+
+// NodeCacheStatus is what NodeCacheInspector serves.
+type NodeCacheStatus struct {
+	TotalNodes int
+	// Nodes is how many nodes are cached for each open
+	// folder-branch.
+	Nodes map[string]int
+}
+
+func (s *Server) inspectNodeCache(ctx context.Context) (interface{}, error) {
+	statuses, err := s.folderStatuses(ctx)
+	if err != nil {
+		return nil, err
+	}
+	status := NodeCacheStatus{Nodes: make(map[string]int, len(statuses))}
+	for fb, fbStatus := range statuses {
+		status.Nodes[fb] = fbStatus.NodeCacheSize
+		status.TotalNodes += fbStatus.NodeCacheSize
+	}
+	return status, nil
+}
+
+// JournalsStatus is what JournalsInspector serves.
+type JournalsStatus struct {
+	Server libkbfs.JournalServerStatus
+	// TLFs holds the status of each journal, by TLF ID.  A
+	// journal's queues are its MD revisions and block operations.
+	TLFs map[string]libkbfs.TLFJournalStatus
+}
+
+func (s *Server) inspectJournals(ctx context.Context) (interface{}, error) {
+	jServer, err := libkbfs.GetJournalServer(s.config)
+	if err != nil {
+		return nil, err
+	}
+	tlfStatuses := jServer.JournalStatuses()
+	status := JournalsStatus{
+		Server: jServer.Status(),
+		TLFs: make(map[string]libkbfs.TLFJournalStatus,
+			len(tlfStatuses)),
+	}
+	for tlfID, tlfStatus := range tlfStatuses {
+		status.TLFs[tlfID.String()] = tlfStatus
+	}
+	return status, nil
+}
+
+func (s *Server) inspectFolders(ctx context.Context) (interface{}, error) {
+	return s.folderStatuses(ctx)
+}
+
+func (s *Server) inspectSlowOps(ctx context.Context) (interface{}, error) {
+	reports := s.config.KBFSOps().SlowOpReports()
+	if reports == nil {
+		reports = []libkbfs.SlowOpReport{}
+	}
+	return reports, nil
+}
+
+func (s *Server) inspectHealth(ctx context.Context) (interface{}, error) {
+	return s.config.KBFSOps().Health(ctx)
+}
+
+func (s *Server) inspectUsage(ctx context.Context) (interface{}, error) {
+	days := s.config.UsageMeter().Days()
+	if days == nil {
+		days = []libkbfs.UsageDay{}
+	}
+	return days, nil
+}
+
+// kbfsVars are the KBFS counters served under KBFSVarName.
+type kbfsVars struct {
+	// Metrics are those of the metrics registry, if it's on.
+	Metrics           map[string]interface{}    `json:",omitempty"`
+	BlockCache        *libkbfs.BlockCacheStatus `json:",omitempty"`
+	OpenFolders       int
+	Nodes             int
+	JournalCount      int
+	UnflushedBytes    int64
+	SlowOpsRemembered int
+}
+
+func (s *Server) getKBFSVars(ctx context.Context) kbfsVars {
+	var vars kbfsVars
+	if registry := s.config.MetricsRegistry(); registry != nil {
+		vars.Metrics = metricsutil.RegistryToInterfaceMap(registry)
+	}
+	if bcache, ok :=
+		s.config.BlockCache().(*libkbfs.BlockCacheStandard); ok {
+		status := bcache.Status()
+		// The breakdown by type is for BlockCacheInspector.
+		status.TransientByType = nil
+		vars.BlockCache = &status
+	}
+	if statuses, err := s.folderStatuses(ctx); err == nil {
+		vars.OpenFolders = len(statuses)
+		for _, status := range statuses {
+			vars.Nodes += status.NodeCacheSize
+		}
+	}
+	if jServer, err := libkbfs.GetJournalServer(s.config); err == nil {
+		status := jServer.Status()
+		vars.JournalCount = status.JournalCount
+		vars.UnflushedBytes = status.UnflushedBytes
+	}
+	vars.SlowOpsRemembered = len(s.config.KBFSOps().SlowOpReports())
+	return vars
+}
+
+// serveVars serves the published expvar variables like
+// expvar.Handler does, along with the KBFS counters under
+// KBFSVarName.  The KBFS counters aren't published to expvar itself,
+// since that's global to the process and there may be more than one
+// KBFS instance in it.
+func (s *Server) serveVars(w http.ResponseWriter, r *http.Request) {
+	ctx := libkbfs.BackgroundContextWithCancellationDelayer()
+	defer libkbfs.CleanupCancellationDelayer(ctx)
+	kbfs, err := json.Marshal(s.getKBFSVars(ctx))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(w, "{\n")
+	expvar.Do(func(kv expvar.KeyValue) {
+		if kv.Key == KBFSVarName {
+			return
+		}
+		fmt.Fprintf(w, "%q: %s,\n", kv.Key, kv.Value)
+	})
+	fmt.Fprintf(w, "%q: %s\n}\n", KBFSVarName, kbfs)
+}
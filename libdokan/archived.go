@@ -0,0 +1,145 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdokan
+
+import (
+	"strings"
+
+	"github.com/keybase/kbfs/dokan"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// ArchivedDir is the libfs.ArchivedDirName directory of a folder.
+// It lists nothing, but opening "rev=N\..." or "date=T\..." under it
+// opens that path in a read-only view of the folder as of that
+// revision.
+type ArchivedDir struct {
+	folder *Folder
+	emptyFile
+}
+
+// GetFileInformation for dokan.
+func (d *ArchivedDir) GetFileInformation(ctx context.Context, fi *dokan.FileInfo) (*dokan.Stat, error) {
+	st, err := defaultDirectoryInformation()
+	st.FileAttributes |= dokan.FileAttributeReadonly
+	return st, err
+}
+
+// FindFiles does readdir for dokan.  There are too many revisions
+// to list.
+func (d *ArchivedDir) FindFiles(ctx context.Context, fi *dokan.FileInfo, ignored string, callback func(*dokan.NamedStat) error) error {
+	return dokan.ErrObjectNameNotFound
+}
+
+// open tries to open a file in an archived view.
+func (d *ArchivedDir) open(ctx context.Context, oc *openContext, path []string) (
+	f dokan.File, isDir bool, err error) {
+	d.folder.fs.log.CDebugf(ctx, "ArchivedDir open %v", path)
+	defer func() { d.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	if oc.isTruncate() || oc.CreateDisposition == dokan.FileCreate {
+		return nil, false, dokan.ErrAccessDenied
+	}
+	if len(path) == 0 {
+		return oc.returnDirNoCleanup(d)
+	}
+
+	snap, err := libfs.BeginArchivedSnapshot(ctx, d.folder.fs.config,
+		d.folder.getFolderBranch(), path[0])
+	if err != nil {
+		return nil, false, err
+	}
+	return openSnapshotEntry(ctx, oc, d.folder, snap, path[1:])
+}
+
+// openSnapshotEntry opens the given path in snap, which the returned
+// entry takes over; snap is closed on failure.
+func openSnapshotEntry(ctx context.Context, oc *openContext, folder *Folder,
+	snap *libkbfs.ReadSnapshot, path []string) (
+	f dokan.File, isDir bool, err error) {
+	p := strings.Join(path, "/")
+	ei, err := snap.Stat(ctx, p)
+	if err != nil {
+		snap.Close()
+		return nil, false, err
+	}
+	e := &ArchivedEntry{folder: folder, snap: snap, path: p}
+	if ei.Type != libkbfs.Dir {
+		return e, false, nil
+	}
+	f, isDir, err = oc.returnDirNoCleanup(e)
+	if err != nil {
+		snap.Close()
+	}
+	return f, isDir, err
+}
+
+// ArchivedEntry is an open file or directory in a read-only view of
+// a folder as of an older revision.  Each one has a snapshot of its
+// own, which it closes on Cleanup.
+type ArchivedEntry struct {
+	folder *Folder
+	snap   *libkbfs.ReadSnapshot
+	// path is relative to the root of the folder, and is empty
+	// for the root itself.
+	path string
+	emptyFile
+}
+
+// GetFileInformation for dokan.
+func (e *ArchivedEntry) GetFileInformation(ctx context.Context, fi *dokan.FileInfo) (
+	st *dokan.Stat, err error) {
+	e.folder.fs.logEnterf(ctx, "ArchivedEntry GetFileInformation %s", e.path)
+	defer func() { e.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	st, err = eiToStat(e.snap.Stat(ctx, e.path))
+	if err != nil {
+		return nil, err
+	}
+	st.FileAttributes |= dokan.FileAttributeReadonly
+	return st, nil
+}
+
+// ReadFile for dokan reads.
+func (e *ArchivedEntry) ReadFile(ctx context.Context, fi *dokan.FileInfo, bs []byte, offset int64) (n int, err error) {
+	e.folder.fs.logEnterf(ctx, "ArchivedEntry ReadFile %s", e.path)
+	defer func() { e.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	nlarge, err := e.snap.Read(ctx, e.path, bs, offset)
+	// This is safe since length of slices always fits into an int
+	return int(nlarge), err
+}
+
+// FindFiles does readdir for dokan.
+func (e *ArchivedEntry) FindFiles(ctx context.Context, fi *dokan.FileInfo, ignored string, callback func(*dokan.NamedStat) error) (err error) {
+	e.folder.fs.logEnterf(ctx, "ArchivedEntry FindFiles %s", e.path)
+	defer func() { e.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	children, err := e.snap.GetDirChildren(ctx, e.path)
+	if err != nil {
+		return err
+	}
+	if len(children) == 0 {
+		return dokan.ErrObjectNameNotFound
+	}
+	var ns dokan.NamedStat
+	for name, ei := range children {
+		ns.Name = name
+		fillStat(&ns.Stat, &ei)
+		ns.FileAttributes |= dokan.FileAttributeReadonly
+		err = callback(&ns)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Cleanup closes the entry's snapshot.
+func (e *ArchivedEntry) Cleanup(ctx context.Context, fi *dokan.FileInfo) {
+	e.snap.Close()
+}
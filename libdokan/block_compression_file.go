@@ -0,0 +1,43 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdokan
+
+import (
+	"strings"
+
+	"github.com/keybase/kbfs/dokan"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// BlockCompressionFile represents a write-only file where writing
+// "none", "snappy" or "flate" sets how this device compresses new
+// blocks in the folder.
+type BlockCompressionFile struct {
+	folder *Folder
+	specialWriteFile
+}
+
+// WriteFile performs writes for dokan.
+func (f *BlockCompressionFile) WriteFile(ctx context.Context, fi *dokan.FileInfo, bs []byte, offset int64) (n int, err error) {
+	f.folder.fs.logEnter(ctx, "BlockCompressionFile WriteFile")
+	defer func() { f.folder.fs.reportErr(ctx, libkbfs.WriteMode, err) }()
+	if len(bs) == 0 {
+		return 0, nil
+	}
+
+	compression, err := libkbfs.ParseBlockCompressionType(
+		strings.TrimSpace(string(bs)))
+	if err != nil {
+		return 0, err
+	}
+	err = f.folder.fs.config.SetBlockCompressionForTLF(
+		f.folder.getFolderBranch().Tlf, compression)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(bs), nil
+}
@@ -0,0 +1,39 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdokan
+
+import (
+	"github.com/keybase/kbfs/dokan"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// BlockParallelismFile represents a write-only file where writing a
+// setting like "puts=8 gets=auto" sets how many blocks KBFS puts and
+// gets at once.  It can be reached from any directory.
+type BlockParallelismFile struct {
+	fs *FS
+	specialWriteFile
+}
+
+// WriteFile implements writes for dokan.
+func (f *BlockParallelismFile) WriteFile(ctx context.Context, fi *dokan.FileInfo, bs []byte, offset int64) (n int, err error) {
+	f.fs.logEnter(ctx, "BlockParallelismFile Write")
+	defer func() { f.fs.reportErr(ctx, libkbfs.WriteMode, err) }()
+	if len(bs) == 0 {
+		return 0, nil
+	}
+	meter := f.fs.config.BlockTransferMeter()
+	puts, gets := meter.ConfiguredParallelism()
+	puts, gets, err = libkbfs.ParseBlockParallelism(string(bs), puts, gets)
+	if err != nil {
+		return 0, err
+	}
+	err = meter.SetParallelism(puts, gets)
+	if err != nil {
+		return 0, err
+	}
+	return len(bs), nil
+}
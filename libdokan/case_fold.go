@@ -0,0 +1,73 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdokan
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// caseConflictError is returned when a name given in a different
+// case matches more than one entry of a directory, which KBFS allows
+// but Windows can't tell apart.
+type caseConflictError struct {
+	name    string
+	matches []string
+}
+
+// Error implements the error interface for caseConflictError.
+func (e caseConflictError) Error() string {
+	return fmt.Sprintf("%q matches %q, which differ only by case",
+		e.name, e.matches)
+}
+
+// caseFoldMatches returns the names in children that equal name when
+// case-folded, sorted.
+func caseFoldMatches(children map[string]libkbfs.EntryInfo, name string) []string {
+	var matches []string
+	for child := range children {
+		if strings.EqualFold(child, name) {
+			matches = append(matches, child)
+		}
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+// lookupCaseInsensitive looks up name in dir the way NTFS does: an
+// exact match wins, and failing that the one entry whose name equals
+// name when case-folded.  It also returns the name the entry actually
+// has, which is what to pass on to KBFS.  Windows keeps the case
+// names are created with, so only lookups are folded.
+func (f *Folder) lookupCaseInsensitive(ctx context.Context, dir libkbfs.Node,
+	name string) (libkbfs.Node, libkbfs.EntryInfo, string, error) {
+	kbfsOps := f.fs.config.KBFSOps()
+	node, ei, err := kbfsOps.Lookup(ctx, dir, name)
+	if !isNoSuchNameError(err) {
+		return node, ei, name, err
+	}
+
+	children, err2 := kbfsOps.GetDirChildren(ctx, dir)
+	if err2 != nil {
+		return nil, libkbfs.EntryInfo{}, name, err2
+	}
+	matches := caseFoldMatches(children, name)
+	switch len(matches) {
+	case 0:
+		return nil, libkbfs.EntryInfo{}, name, err
+	case 1:
+		f.fs.log.CDebugf(ctx, "Case-folded %q to %q", name, matches[0])
+		node, ei, err = kbfsOps.Lookup(ctx, dir, matches[0])
+		return node, ei, matches[0], err
+	default:
+		f.fs.log.CDebugf(ctx, "Case conflict for %q: %q", name, matches)
+		return nil, libkbfs.EntryInfo{}, name,
+			caseConflictError{name: name, matches: matches}
+	}
+}
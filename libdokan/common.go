@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/keybase/kbfs/dokan"
+	"github.com/keybase/kbfs/libfs"
 	"github.com/keybase/kbfs/libkbfs"
 )
 
@@ -64,6 +65,8 @@ func fillStat(a *dokan.Stat, de *libkbfs.EntryInfo) {
 }
 
 // errToDokan makes some libkbfs errors easier to digest in dokan. Not needed in most places.
+// Errors without a more specific mapping get an NTSTATUS picked
+// by their libkbfs.ErrorCode.
 func errToDokan(err error) error {
 	switch err.(type) {
 	case libkbfs.NoSuchNameError:
@@ -72,9 +75,46 @@ func errToDokan(err error) error {
 		return dokan.ErrObjectNameNotFound
 	case libkbfs.MDServerErrorUnauthorized:
 		return dokan.ErrAccessDenied
+	case libkbfs.WritesPausedError:
+		return dokan.ErrAccessDenied
+	case libkbfs.RangeLockConflictError:
+		return dokan.ErrLockNotGranted
+	case libkbfs.NoSuchXattrError:
+		return dokan.ErrObjectNameNotFound
+	case libkbfs.ReadOnlyXattrError:
+		return dokan.ErrAccessDenied
+	case caseConflictError:
+		return dokan.ErrObjectNameCollision
+	case libfs.LocalFileOverDirError:
+		return dokan.ErrFileIsADirectory
 	case nil:
 		return nil
 	}
+	switch libkbfs.ClassifyError(err) {
+	case libkbfs.ErrorCodeNotFound:
+		return dokan.ErrObjectNameNotFound
+	case libkbfs.ErrorCodeAlreadyExists:
+		return dokan.ErrObjectNameCollision
+	case libkbfs.ErrorCodeNotEmpty:
+		return dokan.ErrDirectoryNotEmpty
+	case libkbfs.ErrorCodeAccessDenied, libkbfs.ErrorCodeNeedsRekey,
+		libkbfs.ErrorCodeNotLoggedIn:
+		return dokan.ErrAccessDenied
+	case libkbfs.ErrorCodeOverQuota:
+		return dokan.ErrDiskFull
+	case libkbfs.ErrorCodeInvalidArgument:
+		return dokan.ErrInvalidParameter
+	case libkbfs.ErrorCodeNotSupported:
+		return dokan.ErrNotSupported
+	case libkbfs.ErrorCodeReadOnly:
+		return dokan.ErrMediaWriteProtected
+	case libkbfs.ErrorCodeBusy, libkbfs.ErrorCodeConflict:
+		return dokan.ErrLockNotGranted
+	case libkbfs.ErrorCodeOffline:
+		return dokan.ErrNetworkUnreachable
+	case libkbfs.ErrorCodeTimeout:
+		return dokan.ErrIoTimeout
+	}
 	return err
 }
 
@@ -0,0 +1,41 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdokan
+
+import (
+	"fmt"
+
+	"github.com/keybase/kbfs/dokan"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// ConflictControlFile is a special file used to control manual
+// conflict resolution.
+type ConflictControlFile struct {
+	specialWriteFile
+	folder *Folder
+	action libfs.ConflictAction
+}
+
+// WriteFile implements writes for dokan.
+func (f *ConflictControlFile) WriteFile(ctx context.Context,
+	fi *dokan.FileInfo, bs []byte, offset int64) (n int, err error) {
+	f.folder.fs.logEnter(ctx,
+		fmt.Sprintf("ConflictControlFile (f.action=%s) Write", f.action))
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	if len(bs) == 0 {
+		return 0, nil
+	}
+
+	err = f.action.Execute(
+		ctx, f.folder.fs.config.KBFSOps(), f.folder.getFolderBranch())
+	if err != nil {
+		return 0, err
+	}
+
+	return len(bs), nil
+}
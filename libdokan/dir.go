@@ -49,6 +49,11 @@ type Folder struct {
 	// noForget is turned on when the folder may not be forgotten
 	// because it has attached special file state with it.
 	noForget bool
+
+	// localFiles holds the files in this folder that are kept
+	// local-only because they're ignored.  The folder isn't
+	// forgotten while there are any, since they'd be lost.
+	localFiles *libfs.LocalFiles
 }
 
 func newFolder(fl *FolderList, h *libkbfs.TlfHandle) *Folder {
@@ -57,6 +62,8 @@ func newFolder(fl *FolderList, h *libkbfs.TlfHandle) *Folder {
 		list:  fl,
 		h:     h,
 		nodes: map[libkbfs.NodeID]dokan.File{},
+
+		localFiles: libfs.NewLocalFiles(fl.fs.config),
 	}
 	return f
 }
@@ -109,7 +116,7 @@ func (f *Folder) forgetNode(node libkbfs.Node) {
 	defer f.mu.Unlock()
 
 	delete(f.nodes, node.GetID())
-	if len(f.nodes) == 0 && !f.noForget {
+	if len(f.nodes) == 0 && !f.noForget && !f.localFiles.Has() {
 		ctx := context.Background()
 		f.unsetFolderBranch(ctx)
 		f.list.forgetFolder(string(f.name()))
@@ -242,6 +249,20 @@ func (d *Dir) open(ctx context.Context, oc *openContext, path []string) (dokan.F
 		return specialNode, false, nil
 	}
 
+	// A stream of the last component is stored as one of its xattrs.
+	var stream string
+	if len(path) > 0 {
+		name, s, err := splitStreamName(path[len(path)-1])
+		if err != nil {
+			return nil, false, err
+		}
+		if name == "" {
+			return nil, false, dokan.ErrObjectNameNotFound
+		}
+		path[len(path)-1] = name
+		stream = s
+	}
+
 	origPath := path
 	rootDir := d
 	for len(path) > 0 {
@@ -262,6 +283,13 @@ func (d *Dir) open(ctx context.Context, oc *openContext, path []string) (dokan.F
 			path[0] = hit
 		}
 
+		if path[0] == libfs.ArchivedDirName {
+			return (&ArchivedDir{folder: d.folder}).open(ctx, oc, path[1:])
+		}
+		if path[0] == libfs.UnmergedDirName {
+			return (&UnmergedDir{folder: d.folder}).open(ctx, oc, path[1:])
+		}
+
 		leaf := len(path) == 1
 
 		// Check if this is a per-file metainformation file, if so
@@ -278,7 +306,36 @@ func (d *Dir) open(ctx context.Context, oc *openContext, path []string) (dokan.F
 			return &SpecialReadFile{read: fileInfo(nmd).read, fs: d.folder.fs}, false, nil
 		}
 
-		newNode, de, err := d.folder.fs.config.KBFSOps().Lookup(ctx, d.node, path[0])
+		switch {
+		case leaf && path[0] == libfs.EnableSyncFileName:
+			return &SyncControlFile{
+				folder: d.folder, node: d.node, subscribed: true}, false, nil
+		case leaf && path[0] == libfs.DisableSyncFileName:
+			return &SyncControlFile{folder: d.folder, node: d.node}, false, nil
+		}
+
+		if leaf && stream == "" {
+			lf, err := d.openLocalFile(ctx, oc, path[0])
+			if err != nil {
+				return nil, false, err
+			} else if lf != nil {
+				return lf, false, nil
+			}
+		}
+
+		newNode, de, name, err := d.folder.lookupCaseInsensitive(
+			ctx, d.node, path[0])
+		path[0] = name
+
+		if leaf && stream != "" {
+			if err != nil {
+				return nil, false, err
+			}
+			if de.Type == libkbfs.Sym {
+				return nil, false, dokan.ErrNotSupported
+			}
+			return openXattrStream(ctx, oc, d.folder, newNode, stream)
+		}
 
 		// If we are in the final component, check if it is a creation.
 		if leaf {
@@ -401,6 +458,13 @@ func (d *Dir) create(ctx context.Context, oc *openContext, name string) (f dokan
 	d.folder.fs.log.CDebugf(ctx, "Dir Create %s", name)
 	defer func() { d.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
 
+	lf, err := d.createLocalFile(ctx, name)
+	if err != nil {
+		return nil, false, err
+	} else if lf != nil {
+		return lf, false, nil
+	}
+
 	isExec := false // Windows lacks executable modes.
 	excl := getExclFromOpenContext(oc)
 	newNode, _, err := d.folder.fs.config.KBFSOps().CreateFile(
@@ -451,6 +515,19 @@ func (d *Dir) FindFiles(ctx context.Context, fi *dokan.FileInfo, ignored string,
 			return err
 		}
 	}
+	for _, name := range d.folder.localFiles.Names(d.node) {
+		lf := d.folder.localFiles.Get(d.node, name)
+		if lf == nil {
+			continue
+		}
+		empty = false
+		ns.Name = name
+		ns.Stat = *localFileStat(lf.Stat())
+		err = callback(&ns)
+		if err != nil {
+			return err
+		}
+	}
 	if empty {
 		return dokan.ErrObjectNameNotFound
 	}
@@ -467,7 +544,7 @@ func (d *Dir) CanDeleteDirectory(ctx context.Context, fi *dokan.FileInfo) (err e
 	if err != nil {
 		return errToDokan(err)
 	}
-	if len(children) > 0 {
+	if len(children) > 0 || len(d.folder.localFiles.Names(d.node)) > 0 {
 		return dokan.ErrDirectoryNotEmpty
 	}
 
@@ -32,6 +32,17 @@ func (f *File) GetFileInformation(ctx context.Context, fi *dokan.FileInfo) (a *d
 	defer func() { f.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
 
 	a, err = eiToStat(f.folder.fs.config.KBFSOps().Stat(ctx, f.node))
+	if err == nil {
+		// Files with holes show up as sparse files.
+		var allocated uint64
+		allocated, err = f.folder.fs.config.KBFSOps().GetAllocatedSize(
+			ctx, f.node)
+		if err != nil {
+			a = nil
+		} else if int64(allocated) < a.FileSize {
+			a.FileAttributes = dokan.FileAttributeSparseFile
+		}
+	}
 	if a != nil {
 		f.folder.fs.log.CDebugf(ctx, "File GetFileInformation node=%v => %v", f.node, *a)
 	} else {
@@ -139,3 +150,50 @@ func (f *File) SetFileAttributes(ctx context.Context, fi *dokan.FileInfo, fileAt
 	// TODO handle attributes for real.
 	return nil
 }
+
+// rangeLockForDokan converts a Windows byte-range lock into a
+// libkbfs.RangeLock.  Windows locks made through LockFile are
+// exclusive, and are owned by the locking process.  The second
+// return value is false for an empty range, which locks nothing.
+func rangeLockForDokan(fi *dokan.FileInfo, offset int64, length int64) (
+	libkbfs.RangeLock, bool) {
+	if offset < 0 || length <= 0 {
+		return libkbfs.RangeLock{}, false
+	}
+	return libkbfs.RangeLock{
+		Type:  libkbfs.RangeLockWrite,
+		Start: uint64(offset),
+		End:   uint64(offset) + uint64(length),
+		Owner: uint64(fi.ProcessID()),
+	}, true
+}
+
+// LockFile for Dokan.
+func (f *File) LockFile(ctx context.Context, fi *dokan.FileInfo, offset int64, length int64) (err error) {
+	f.folder.fs.logEnterf(ctx, "File LockFile %d+%d", offset, length)
+	defer func() {
+		// Someone else holding the lock isn't worth reporting.
+		if _, ok := err.(libkbfs.RangeLockConflictError); !ok {
+			f.folder.reportErr(ctx, libkbfs.ReadMode, err)
+		}
+		err = errToDokan(err)
+	}()
+
+	lock, ok := rangeLockForDokan(fi, offset, length)
+	if !ok {
+		return nil
+	}
+	return f.folder.fs.config.KBFSOps().LockRange(ctx, f.node, lock)
+}
+
+// UnlockFile for Dokan.
+func (f *File) UnlockFile(ctx context.Context, fi *dokan.FileInfo, offset int64, length int64) (err error) {
+	f.folder.fs.logEnterf(ctx, "File UnlockFile %d+%d", offset, length)
+	defer func() { f.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	lock, ok := rangeLockForDokan(fi, offset, length)
+	if !ok {
+		return nil
+	}
+	return f.folder.fs.config.KBFSOps().UnlockRange(ctx, f.node, lock)
+}
@@ -35,7 +35,7 @@ type FS struct {
 }
 
 // DefaultMountFlags are the default mount flags for libdokan.
-const DefaultMountFlags = dokan.CurrentSession
+const DefaultMountFlags = dokan.CurrentSession | dokan.AltStream
 
 // NewFS creates an FS
 func NewFS(ctx context.Context, config libkbfs.Config, log logger.Logger) (*FS, error) {
@@ -111,7 +111,8 @@ var vinfo = dokan.VolumeInformation{
 	MaximumComponentLength: 0xFF, // This can be changed.
 	FileSystemFlags: dokan.FileCasePreservedNames | dokan.FileCaseSensitiveSearch |
 		dokan.FileUnicodeOnDisk | dokan.FileSupportsReparsePoints |
-		dokan.FileSupportsRemoteStorage,
+		dokan.FileSupportsRemoteStorage | dokan.FileNamedStreams |
+		dokan.FileSupportsSparseFiles,
 	FileSystemName: "KBFS",
 }
 
@@ -139,18 +140,18 @@ func (f *FS) GetDiskFreeSpace(ctx context.Context) (freeSpace dokan.FreeSpace, e
 		}, nil
 	}
 	defer func() { f.reportErr(ctx, libkbfs.ReadMode, err) }()
-	uqi, err := f.config.BlockServer().GetUserQuotaInfo(ctx)
+	uqi, err := f.config.KBFSOps().GetUserQuotaInfo(ctx)
 	if err != nil {
 		return dokan.FreeSpace{}, errToDokan(err)
 	}
-	free := uint64(uqi.Limit)
-	if uqi.Total != nil {
-		free -= uint64(uqi.Total.Bytes[libkbfs.UsageWrite])
+	free := uqi.Limit - uqi.UsedBytes()
+	if free < 0 {
+		free = 0
 	}
 	return dokan.FreeSpace{
 		TotalNumberOfBytes:     uint64(uqi.Limit),
-		TotalNumberOfFreeBytes: free,
-		FreeBytesAvailable:     free,
+		TotalNumberOfFreeBytes: uint64(free),
+		FreeBytesAvailable:     uint64(free),
 	}, nil
 }
 
@@ -270,6 +271,21 @@ func (f *FS) open(ctx context.Context, oc *openContext, ps []string) (dokan.File
 		return NewErrorFile(f), false, nil
 	case libfs.MetricsFileName == ps[psl-1]:
 		return NewMetricsFile(f), false, nil
+	case libfs.SlowOpsFileName == ps[psl-1]:
+		return NewSlowOpsFile(f), false, nil
+	case libfs.HealthFileName == ps[psl-1]:
+		return NewHealthFile(f), false, nil
+	case libfs.UsageFileName == ps[psl-1]:
+		return NewUsageFile(f), false, nil
+	case libfs.EnableOfflineFileName == ps[psl-1]:
+		return &OfflineControlFile{
+			fs: f.root.private.fs, offline: true}, false, nil
+	case libfs.DisableOfflineFileName == ps[psl-1]:
+		return &OfflineControlFile{fs: f.root.private.fs}, false, nil
+	case libfs.NetworkStateFileName == ps[psl-1]:
+		return &NetworkStateFile{fs: f.root.private.fs}, false, nil
+	case libfs.BlockParallelismFileName == ps[psl-1]:
+		return &BlockParallelismFile{fs: f.root.private.fs}, false, nil
 		// TODO: Make the two cases below available from any
 		// directory.
 	case libfs.ProfileListDirName == ps[0]:
@@ -284,6 +300,12 @@ func (f *FS) open(ctx context.Context, oc *openContext, ps []string) (dokan.File
 		// non-TLF directory.
 	case libfs.StatusFileName == ps[0]:
 		return NewNonTLFStatusFile(f.root.private.fs), false, nil
+	case psl == 1 && libfs.RootStatusFileName == ps[0]:
+		return NewNonTLFStatusFile(f.root.private.fs), false, nil
+	case psl == 1 && libfs.RootMetricsFileName == ps[0]:
+		return NewMetricsFile(f), false, nil
+	case psl == 1 && libfs.RootErrorsFileName == ps[0]:
+		return NewErrorFile(f), false, nil
 	case libfs.HumanErrorFileName == ps[0], libfs.HumanNoLoginFileName == ps[0]:
 		return &SpecialReadFile{
 			read: f.remoteStatus.NewSpecialReadFunc,
@@ -404,12 +426,57 @@ func (f *FS) MoveFile(ctx context.Context, source *dokan.FileInfo, targetPath st
 	case *Dir:
 	case *File:
 	case *TLF:
+	case *LocalFile:
 	default:
 		return dokan.ErrAccessDenied
 	}
 
+	if lf, ok := src.(*LocalFile); ok {
+		if srcFolder != ddst.folder {
+			return dokan.ErrNotSameDevice
+		}
+		if !replaceExisting {
+			x, _, err := f.open(ctx, oc, dstPath)
+			if err == nil {
+				defer x.Cleanup(ctx, nil)
+			}
+			if !isNoSuchNameError(err) {
+				return errors.New("Refusing to replace existing target!")
+			}
+		}
+		return srcFolder.renameLocalFile(
+			ctx, lf, ddst.node, dstPath[len(dstPath)-1])
+	}
+
+	// Names are case-insensitive on Windows, so the source may be
+	// named in a different case than it has, and the target may be
+	// an existing entry named in a different case, which is what to
+	// replace rather than creating a second one beside it.
+	_, _, srcName, err = srcFolder.lookupCaseInsensitive(
+		ctx, srcParent, srcName)
+	if err != nil {
+		return errToDokan(err)
+	}
+	dstName := dstPath[len(dstPath)-1]
+	caseOnly := false
+	_, _, existing, err := ddst.folder.lookupCaseInsensitive(
+		ctx, ddst.node, dstName)
+	switch {
+	case isNoSuchNameError(err):
+	case err != nil:
+		return errToDokan(err)
+	case srcParent.GetID() == ddst.node.GetID() && existing == srcName:
+		// Renaming an entry to a different case of its own name.
+		if existing == dstName {
+			return nil
+		}
+		caseOnly = true
+	default:
+		dstName = existing
+	}
+
 	// here we race...
-	if !replaceExisting {
+	if !replaceExisting && !caseOnly {
 		x, _, err := f.open(ctx, oc, dstPath)
 		if err == nil {
 			defer x.Cleanup(ctx, nil)
@@ -428,12 +495,16 @@ func (f *FS) MoveFile(ctx context.Context, source *dokan.FileInfo, targetPath st
 	// overwritten node, if any, will be removed from Folder.nodes, if
 	// it is there in the first place, by its Forget
 
-	f.log.CDebugf(ctx, "FS Rename KBFSOps().Rename(ctx,%v,%v,%v,%v)", srcParent, srcName, ddst.node, dstPath[len(dstPath)-1])
+	f.log.CDebugf(ctx, "FS Rename KBFSOps().Rename(ctx,%v,%v,%v,%v)", srcParent, srcName, ddst.node, dstName)
 	if err := srcFolder.fs.config.KBFSOps().Rename(
-		ctx, srcParent, srcName, ddst.node, dstPath[len(dstPath)-1]); err != nil {
+		ctx, srcParent, srcName, ddst.node, dstName); err != nil {
 		f.log.CDebugf(ctx, "FS Rename KBFSOps().Rename FAILED %v", err)
 		return err
 	}
+	// A synced file replaces any local-only one.
+	if _, err := ddst.folder.localFiles.Remove(ddst.node, dstName); err != nil {
+		return err
+	}
 
 	switch x := src.(type) {
 	case *Dir:
@@ -547,6 +618,14 @@ func (r *Root) FindFiles(ctx context.Context, fi *dokan.FileInfo, ignored string
 			return err
 		}
 	}
+	ns.FileAttributes = dokan.FileAttributeReadonly
+	for _, name := range libfs.RootSpecialFileNames {
+		ns.Name = name
+		err = callback(&ns)
+		if err != nil {
+			return err
+		}
+	}
 	if ename != "" {
 		ns.Name = ename
 		ns.FileAttributes = dokan.FileAttributeNormal
@@ -0,0 +1,15 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdokan
+
+import (
+	"github.com/keybase/kbfs/libfs"
+)
+
+// NewHealthFile returns a special read file that contains the health
+// summary of KBFS.
+func NewHealthFile(fs *FS) *SpecialReadFile {
+	return &SpecialReadFile{read: libfs.GetEncodedHealth(fs.config), fs: fs}
+}
@@ -0,0 +1,197 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdokan
+
+import (
+	"time"
+
+	"github.com/keybase/kbfs/dokan"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// LocalFile represents a file that's kept local-only, because its
+// name matches an ignore file (see libkbfs.KBFSIgnoreFileName) when
+// it's created.  See libfs.LocalFile.
+type LocalFile struct {
+	emptyFile
+	folder *Folder
+	// dir and name locate the file, for deletes on close.
+	dir  libkbfs.Node
+	name string
+	lf   *libfs.LocalFile
+}
+
+func localFileStat(st libfs.LocalFileStat) *dokan.Stat {
+	return &dokan.Stat{
+		FileSize:       int64(st.Size),
+		LastWrite:      st.Mtime,
+		LastAccess:     st.Mtime,
+		Creation:       st.Ctime,
+		FileAttributes: dokan.FileAttributeNormal,
+	}
+}
+
+// GetFileInformation for dokan.
+func (f *LocalFile) GetFileInformation(ctx context.Context, fi *dokan.FileInfo) (*dokan.Stat, error) {
+	f.folder.fs.logEnter(ctx, "LocalFile GetFileInformation")
+	return localFileStat(f.lf.Stat()), nil
+}
+
+// CanDeleteFile - return just nil.
+func (f *LocalFile) CanDeleteFile(ctx context.Context, fi *dokan.FileInfo) error {
+	f.folder.fs.logEnterf(ctx, "LocalFile CanDeleteFile for %q", f.name)
+	return nil
+}
+
+// Cleanup - for dokan, remember to handle deletions.
+func (f *LocalFile) Cleanup(ctx context.Context, fi *dokan.FileInfo) {
+	var err error
+	f.folder.fs.logEnter(ctx, "LocalFile Cleanup")
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+
+	if fi != nil && fi.IsDeleteOnClose() {
+		f.folder.fs.log.CDebugf(ctx, "Removing (Delete) local-only file in cleanup %s", f.name)
+		// Only remove it if it hasn't been replaced or renamed since
+		// it was opened.
+		if f.folder.localFiles.Get(f.dir, f.name) == f.lf {
+			_, err = f.folder.localFiles.Remove(f.dir, f.name)
+		}
+	}
+}
+
+// FlushFileBuffers does nothing, since the contents don't outlive
+// KBFS.
+func (f *LocalFile) FlushFileBuffers(ctx context.Context, fi *dokan.FileInfo) error {
+	f.folder.fs.logEnter(ctx, "LocalFile FlushFileBuffers")
+	return nil
+}
+
+// ReadFile for dokan reads.
+func (f *LocalFile) ReadFile(ctx context.Context, fi *dokan.FileInfo, bs []byte, offset int64) (n int, err error) {
+	f.folder.fs.logEnter(ctx, "LocalFile ReadFile")
+	defer func() { f.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	return f.lf.Read(bs, offset)
+}
+
+// WriteFile for dokan writes.
+func (f *LocalFile) WriteFile(ctx context.Context, fi *dokan.FileInfo, bs []byte, offset int64) (n int, err error) {
+	f.folder.fs.logEnter(ctx, "LocalFile WriteFile")
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+
+	if offset == -1 {
+		offset = int64(f.lf.Stat().Size)
+	}
+	err = f.lf.Write(bs, offset)
+	if err != nil {
+		return 0, errToDokan(err)
+	}
+	return len(bs), nil
+}
+
+// SetEndOfFile for dokan (f)truncates.
+func (f *LocalFile) SetEndOfFile(ctx context.Context, fi *dokan.FileInfo, length int64) (err error) {
+	f.folder.fs.logEnter(ctx, "LocalFile SetEndOfFile")
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+
+	return errToDokan(f.lf.Truncate(uint64(length)))
+}
+
+// SetAllocationSize for dokan (f)truncates but does not grow file
+// size.
+func (f *LocalFile) SetAllocationSize(ctx context.Context, fi *dokan.FileInfo, newSize int64) (err error) {
+	f.folder.fs.logEnter(ctx, "LocalFile SetAllocationSize")
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+
+	// Refuse to grow the file.
+	if int64(f.lf.Stat().Size) <= newSize {
+		return nil
+	}
+	return errToDokan(f.lf.Truncate(uint64(newSize)))
+}
+
+// SetFileTime for dokan.  Only the last write time is kept.
+func (f *LocalFile) SetFileTime(ctx context.Context, fi *dokan.FileInfo, creation time.Time, lastAccess time.Time, lastWrite time.Time) error {
+	f.folder.fs.logEnter(ctx, "LocalFile SetFileTime")
+	if !lastWrite.IsZero() {
+		f.lf.SetMtime(lastWrite)
+	}
+	return nil
+}
+
+// SetFileAttributes for Dokan.
+func (f *LocalFile) SetFileAttributes(ctx context.Context, fi *dokan.FileInfo, fileAttributes dokan.FileAttribute) error {
+	f.folder.fs.logEnter(ctx, "LocalFile SetFileAttributes")
+	return nil
+}
+
+// openLocalFile returns the local-only file with the given name in
+// d, or nil if there isn't one.
+func (d *Dir) openLocalFile(ctx context.Context, oc *openContext,
+	name string) (*LocalFile, error) {
+	lf := d.folder.localFiles.Get(d.node, name)
+	if lf == nil {
+		return nil, nil
+	}
+	if oc.isExistingError() {
+		return nil, dokan.ErrFileAlreadyExists
+	}
+	if oc.isTruncate() {
+		err := lf.Truncate(0)
+		if err != nil {
+			return nil, errToDokan(err)
+		}
+	}
+	return &LocalFile{folder: d.folder, dir: d.node, name: name, lf: lf}, nil
+}
+
+// createLocalFile makes a new local-only file, if name is ignored in
+// d and isn't already taken in KBFS.  It returns nil otherwise.
+func (d *Dir) createLocalFile(ctx context.Context, name string) (
+	*LocalFile, error) {
+	root, err := d.folder.rootNode(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Windows lacks executable modes.
+	lf, err := d.folder.localFiles.Create(ctx, root, d.node, name, 0644)
+	if err != nil || lf == nil {
+		return nil, err
+	}
+	d.folder.fs.log.CDebugf(ctx, "Keeping ignored file %s local-only", name)
+	return &LocalFile{folder: d.folder, dir: d.node, name: name, lf: lf}, nil
+}
+
+func (f *Folder) rootNode(ctx context.Context) (libkbfs.Node, error) {
+	f.handleMu.RLock()
+	h := f.h
+	f.handleMu.RUnlock()
+	root, _, err := f.fs.config.KBFSOps().GetRootNode(
+		ctx, h, libkbfs.MasterBranch)
+	return root, err
+}
+
+// renameLocalFile moves the local-only file lf to newName in newDir,
+// copying it into KBFS if the new name isn't ignored.
+func (f *Folder) renameLocalFile(ctx context.Context, lf *LocalFile,
+	newDir libkbfs.Node, newName string) error {
+	root, err := f.rootNode(ctx)
+	if err != nil {
+		return err
+	}
+	copied, err := f.localFiles.Rename(
+		ctx, root, lf.lf, lf.dir, lf.name, newDir, newName)
+	if err != nil {
+		return errToDokan(err)
+	}
+	if copied {
+		f.fs.log.CDebugf(ctx, "Copied local-only file %s into KBFS as %s",
+			lf.name, newName)
+	}
+	lf.dir, lf.name = newDir, newName
+	return nil
+}
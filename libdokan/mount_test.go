@@ -255,8 +255,11 @@ func TestReaddirRoot(t *testing.T) {
 	defer cancelFn()
 
 	checkDir(t, mnt.Dir, map[string]fileInfoCheck{
-		PrivateName: mustBeDir,
-		PublicName:  mustBeDir,
+		PrivateName:               mustBeDir,
+		PublicName:                mustBeDir,
+		libfs.RootStatusFileName:  nil,
+		libfs.RootMetricsFileName: nil,
+		libfs.RootErrorsFileName:  nil,
 	})
 }
 
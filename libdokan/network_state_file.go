@@ -0,0 +1,36 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdokan
+
+import (
+	"strings"
+
+	"github.com/keybase/kbfs/dokan"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// NetworkStateFile represents a write-only file where writing the
+// name of a network state, like "metered", tells KBFS it's on that
+// kind of network.  It can be reached from any directory.
+type NetworkStateFile struct {
+	fs *FS
+	specialWriteFile
+}
+
+// WriteFile implements writes for dokan.
+func (f *NetworkStateFile) WriteFile(ctx context.Context, fi *dokan.FileInfo, bs []byte, offset int64) (n int, err error) {
+	f.fs.logEnter(ctx, "NetworkStateFile Write")
+	defer func() { f.fs.reportErr(ctx, libkbfs.WriteMode, err) }()
+	if len(bs) == 0 {
+		return 0, nil
+	}
+	state, err := libkbfs.ParseNetworkState(strings.TrimSpace(string(bs)))
+	if err != nil {
+		return 0, err
+	}
+	f.fs.config.SetNetworkState(state)
+	return len(bs), nil
+}
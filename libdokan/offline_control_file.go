@@ -0,0 +1,31 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdokan
+
+import (
+	"github.com/keybase/kbfs/dokan"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// OfflineControlFile represents a write-only file where any write of
+// at least one byte puts KBFS in or out of offline mode.  It can be
+// reached from any directory.
+type OfflineControlFile struct {
+	fs      *FS
+	offline bool
+	specialWriteFile
+}
+
+// WriteFile implements writes for dokan.
+func (f *OfflineControlFile) WriteFile(ctx context.Context, fi *dokan.FileInfo, bs []byte, offset int64) (n int, err error) {
+	f.fs.logEnter(ctx, "OfflineControlFile Write")
+	defer func() { f.fs.reportErr(ctx, libkbfs.WriteMode, err) }()
+	if len(bs) == 0 {
+		return 0, nil
+	}
+	f.fs.config.SetOffline(f.offline)
+	return len(bs), nil
+}
@@ -0,0 +1,15 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdokan
+
+import (
+	"github.com/keybase/kbfs/libfs"
+)
+
+// NewSlowOpsFile returns a special read file that contains the
+// diagnostics of the last few slow KBFS operations.
+func NewSlowOpsFile(fs *FS) *SpecialReadFile {
+	return &SpecialReadFile{read: libfs.GetEncodedSlowOps(fs.config), fs: fs}
+}
@@ -22,6 +22,9 @@ func handleTLFSpecialFile(name string, folder *Folder) dokan.File {
 	case libfs.EditHistoryName:
 		return NewTlfEditHistoryFile(folder)
 
+	case libfs.JournalContentsFileName:
+		return NewJournalContentsFile(folder)
+
 	case libfs.UnstageFileName:
 		return &UnstageFile{
 			folder: folder,
@@ -38,6 +41,32 @@ func handleTLFSpecialFile(name string, folder *Folder) dokan.File {
 			enable: true,
 		}
 
+	case libfs.PauseWritesFileName:
+		return &WritesControlFile{
+			folder: folder,
+		}
+
+	case libfs.ResumeWritesFileName:
+		return &WritesControlFile{
+			folder: folder,
+			resume: true,
+		}
+
+	case libfs.SyncDurabilityFileName:
+		return &SyncDurabilityFile{
+			folder: folder,
+		}
+
+	case libfs.BlockCompressionFileName:
+		return &BlockCompressionFile{
+			folder: folder,
+		}
+
+	case libfs.BlockChunkingFileName:
+		return &BlockChunkingFile{
+			folder: folder,
+		}
+
 	case libfs.RekeyFileName:
 		return &RekeyFile{
 			folder: folder,
@@ -82,6 +111,36 @@ func handleTLFSpecialFile(name string, folder *Folder) dokan.File {
 			folder: folder,
 			action: libfs.JournalDisable,
 		}
+
+	case libfs.EnableManualCRFileName:
+		return &ConflictControlFile{
+			folder: folder,
+			action: libfs.ConflictEnableManual,
+		}
+
+	case libfs.DisableManualCRFileName:
+		return &ConflictControlFile{
+			folder: folder,
+			action: libfs.ConflictDisableManual,
+		}
+
+	case libfs.ResolveMergedFileName:
+		return &ConflictControlFile{
+			folder: folder,
+			action: libfs.ConflictResolveMerged,
+		}
+
+	case libfs.ResolveKeepLocalFileName:
+		return &ConflictControlFile{
+			folder: folder,
+			action: libfs.ConflictResolveKeepLocal,
+		}
+
+	case libfs.ResolveKeepRemoteFileName:
+		return &ConflictControlFile{
+			folder: folder,
+			action: libfs.ConflictResolveKeepRemote,
+		}
 	}
 
 	return nil
@@ -0,0 +1,36 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdokan
+
+import (
+	"github.com/keybase/kbfs/dokan"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// SyncControlFile represents a write-only file where any write of at
+// least one byte subscribes the directory it's in to be synced to
+// local disk, or unsubscribes it.
+type SyncControlFile struct {
+	folder     *Folder
+	node       libkbfs.Node
+	subscribed bool
+	specialWriteFile
+}
+
+// WriteFile implements writes for dokan.
+func (f *SyncControlFile) WriteFile(ctx context.Context, fi *dokan.FileInfo, bs []byte, offset int64) (n int, err error) {
+	f.folder.fs.logEnter(ctx, "SyncControlFile Write")
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	if len(bs) == 0 {
+		return 0, nil
+	}
+	err = f.folder.fs.config.KBFSOps().SetSyncSubscription(
+		ctx, f.node, f.subscribed)
+	if err != nil {
+		return 0, err
+	}
+	return len(bs), nil
+}
@@ -0,0 +1,43 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdokan
+
+import (
+	"strings"
+
+	"github.com/keybase/kbfs/dokan"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// SyncDurabilityFile represents a write-only file where writing
+// "local" or "server" sets how durable syncs make writes to the
+// folder.
+type SyncDurabilityFile struct {
+	folder *Folder
+	specialWriteFile
+}
+
+// WriteFile performs writes for dokan.
+func (f *SyncDurabilityFile) WriteFile(ctx context.Context, fi *dokan.FileInfo, bs []byte, offset int64) (n int, err error) {
+	f.folder.fs.logEnter(ctx, "SyncDurabilityFile WriteFile")
+	defer func() { f.folder.fs.reportErr(ctx, libkbfs.WriteMode, err) }()
+	if len(bs) == 0 {
+		return 0, nil
+	}
+
+	durability, err := libkbfs.ParseWriteDurability(
+		strings.TrimSpace(string(bs)))
+	if err != nil {
+		return 0, err
+	}
+	err = f.folder.fs.config.KBFSOps().SetSyncDurability(
+		ctx, f.folder.getFolderBranch(), durability)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(bs), nil
+}
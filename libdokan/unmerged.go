@@ -0,0 +1,74 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdokan
+
+import (
+	"github.com/keybase/kbfs/dokan"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// UnmergedDir is the libfs.UnmergedDirName directory of a folder.
+// While the folder is on an unmerged branch, it lists "local" and
+// "remote", read-only views of the two sides of the conflict.
+type UnmergedDir struct {
+	folder *Folder
+	emptyFile
+}
+
+// GetFileInformation for dokan.
+func (d *UnmergedDir) GetFileInformation(ctx context.Context, fi *dokan.FileInfo) (*dokan.Stat, error) {
+	st, err := defaultDirectoryInformation()
+	st.FileAttributes |= dokan.FileAttributeReadonly
+	return st, err
+}
+
+// FindFiles does readdir for dokan.
+func (d *UnmergedDir) FindFiles(ctx context.Context, fi *dokan.FileInfo, ignored string, callback func(*dokan.NamedStat) error) (err error) {
+	d.folder.fs.logEnter(ctx, "UnmergedDir FindFiles")
+	defer func() { d.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	names, err := libfs.UnmergedNames(ctx, d.folder.fs.config,
+		d.folder.getFolderBranch())
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return dokan.ErrObjectNameNotFound
+	}
+	var ns dokan.NamedStat
+	ns.FileAttributes = dokan.FileAttributeDirectory |
+		dokan.FileAttributeReadonly
+	for _, name := range names {
+		ns.Name = name
+		err = callback(&ns)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// open tries to open a file in one side of the conflict.
+func (d *UnmergedDir) open(ctx context.Context, oc *openContext, path []string) (
+	f dokan.File, isDir bool, err error) {
+	d.folder.fs.log.CDebugf(ctx, "UnmergedDir open %v", path)
+	defer func() { d.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	if oc.isTruncate() || oc.CreateDisposition == dokan.FileCreate {
+		return nil, false, dokan.ErrAccessDenied
+	}
+	if len(path) == 0 {
+		return oc.returnDirNoCleanup(d)
+	}
+
+	snap, err := libfs.BeginUnmergedSnapshot(ctx, d.folder.fs.config,
+		d.folder.getFolderBranch(), path[0])
+	if err != nil {
+		return nil, false, err
+	}
+	return openSnapshotEntry(ctx, oc, d.folder, snap, path[1:])
+}
@@ -0,0 +1,43 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdokan
+
+import (
+	"github.com/keybase/kbfs/dokan"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// WritesControlFile represents a write-only file where any write of
+// at least one byte either pauses or resumes all mutating operations
+// on the folder.
+type WritesControlFile struct {
+	folder *Folder
+	resume bool
+	specialWriteFile
+}
+
+// WriteFile performs writes for dokan.
+func (f *WritesControlFile) WriteFile(ctx context.Context, fi *dokan.FileInfo, bs []byte, offset int64) (n int, err error) {
+	f.folder.fs.logEnter(ctx, "WritesControlFile WriteFile")
+	defer func() { f.folder.fs.reportErr(ctx, libkbfs.WriteMode, err) }()
+	f.folder.fs.log.CDebugf(ctx, "WritesControlFile (resume: %t) Write",
+		f.resume)
+	if len(bs) == 0 {
+		return 0, nil
+	}
+
+	kbfsOps := f.folder.fs.config.KBFSOps()
+	if f.resume {
+		err = kbfsOps.ResumeWrites(ctx, f.folder.getFolderBranch())
+	} else {
+		err = kbfsOps.PauseWrites(ctx, f.folder.getFolderBranch())
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return len(bs), nil
+}
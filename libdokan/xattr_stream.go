@@ -0,0 +1,236 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdokan
+
+import (
+	"strings"
+
+	"github.com/keybase/kbfs/dokan"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// Alternate data streams are stored as xattrs in the user
+// namespace, so that "file:foo" on Windows is "user.foo" under FUSE.
+const xattrStreamPrefix = "user."
+
+// splitStreamName splits a "name:stream[:$DATA]" path component.
+// The stream is empty for the default data stream, or if there is
+// no stream at all.
+func splitStreamName(s string) (name string, stream string, err error) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return s, "", nil
+	}
+	name, stream = s[:i], s[i+1:]
+	if j := strings.IndexByte(stream, ':'); j >= 0 {
+		// Only data streams are supported.
+		if !strings.EqualFold(stream[j+1:], "$DATA") {
+			return "", "", dokan.ErrObjectNameNotFound
+		}
+		stream = stream[:j]
+	}
+	return name, stream, nil
+}
+
+// xattrStream is an open alternate data stream of a file or directory.
+type xattrStream struct {
+	folder *Folder
+	node   libkbfs.Node
+	name   string
+	emptyFile
+}
+
+// openXattrStream opens the given stream of node, creating or
+// truncating it as requested by oc.
+func openXattrStream(ctx context.Context, oc *openContext, folder *Folder,
+	node libkbfs.Node, stream string) (dokan.File, bool, error) {
+	s := &xattrStream{
+		folder: folder,
+		node:   node,
+		name:   xattrStreamPrefix + stream,
+	}
+	kbfsOps := folder.fs.config.KBFSOps()
+	_, err := kbfsOps.GetXattr(ctx, node, s.name)
+	_, notFound := err.(libkbfs.NoSuchXattrError)
+	switch {
+	case err != nil && !notFound:
+		return nil, false, err
+	case notFound && !oc.isCreation():
+		return nil, false, dokan.ErrObjectNameNotFound
+	case !notFound && oc.isExistingError():
+		return nil, false, dokan.ErrFileAlreadyExists
+	case notFound || oc.isTruncate():
+		err = kbfsOps.SetXattr(ctx, node, s.name, nil)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	return s, false, nil
+}
+
+func (s *xattrStream) value(ctx context.Context) ([]byte, error) {
+	return s.folder.fs.config.KBFSOps().GetXattr(ctx, s.node, s.name)
+}
+
+// GetFileInformation for dokan.
+func (s *xattrStream) GetFileInformation(ctx context.Context, fi *dokan.FileInfo) (st *dokan.Stat, err error) {
+	s.folder.fs.logEnterf(ctx, "xattrStream GetFileInformation %s", s.name)
+	defer func() { s.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	value, err := s.value(ctx)
+	if err != nil {
+		return nil, err
+	}
+	st, _ = defaultFileInformation()
+	st.FileSize = int64(len(value))
+	return st, nil
+}
+
+// ReadFile for dokan reads.
+func (s *xattrStream) ReadFile(ctx context.Context, fi *dokan.FileInfo, bs []byte, offset int64) (n int, err error) {
+	s.folder.fs.logEnterf(ctx, "xattrStream ReadFile %s", s.name)
+	defer func() { s.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	value, err := s.value(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if offset >= int64(len(value)) {
+		return 0, nil
+	}
+	return copy(bs, value[offset:]), nil
+}
+
+// WriteFile for dokan writes.  The whole value is rewritten on each
+// write, which is fine given how small xattrs are.
+func (s *xattrStream) WriteFile(ctx context.Context, fi *dokan.FileInfo, bs []byte, offset int64) (n int, err error) {
+	s.folder.fs.logEnterf(ctx, "xattrStream WriteFile %s", s.name)
+	defer func() { s.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+
+	value, err := s.value(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if offset == -1 {
+		offset = int64(len(value))
+	}
+	end := offset + int64(len(bs))
+	if end > int64(len(value)) {
+		value = append(value, make([]byte, end-int64(len(value)))...)
+	}
+	copy(value[offset:], bs)
+	err = s.folder.fs.config.KBFSOps().SetXattr(ctx, s.node, s.name, value)
+	if err != nil {
+		return 0, err
+	}
+	return len(bs), nil
+}
+
+// SetEndOfFile for dokan truncates or extends the stream.
+func (s *xattrStream) SetEndOfFile(ctx context.Context, fi *dokan.FileInfo, length int64) (err error) {
+	s.folder.fs.logEnterf(ctx, "xattrStream SetEndOfFile %s", s.name)
+	defer func() { s.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+
+	value, err := s.value(ctx)
+	if err != nil {
+		return err
+	}
+	if length <= int64(len(value)) {
+		value = value[:length]
+	} else {
+		value = append(value, make([]byte, length-int64(len(value)))...)
+	}
+	return s.folder.fs.config.KBFSOps().SetXattr(ctx, s.node, s.name, value)
+}
+
+// SetAllocationSize for dokan truncates but does not grow the stream.
+func (s *xattrStream) SetAllocationSize(ctx context.Context, fi *dokan.FileInfo, newSize int64) (err error) {
+	value, err := s.value(ctx)
+	if err != nil {
+		return err
+	}
+	if int64(len(value)) <= newSize {
+		return nil
+	}
+	return s.SetEndOfFile(ctx, fi, newSize)
+}
+
+// FlushFileBuffers does nothing, since every write is already synced.
+func (s *xattrStream) FlushFileBuffers(ctx context.Context, fi *dokan.FileInfo) error {
+	return nil
+}
+
+// CanDeleteFile - streams can always be deleted.
+func (s *xattrStream) CanDeleteFile(ctx context.Context, fi *dokan.FileInfo) error {
+	return nil
+}
+
+// Cleanup removes the stream if it was marked for deletion.
+func (s *xattrStream) Cleanup(ctx context.Context, fi *dokan.FileInfo) {
+	if fi == nil || !fi.IsDeleteOnClose() {
+		return
+	}
+	var err error
+	s.folder.fs.logEnterf(ctx, "xattrStream Cleanup removing %s", s.name)
+	defer func() { s.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	err = s.folder.fs.config.KBFSOps().RemoveXattr(ctx, s.node, s.name)
+}
+
+// findXattrStreams lists the user xattrs of node as streams.
+func findXattrStreams(ctx context.Context, folder *Folder, node libkbfs.Node,
+	callback func(*dokan.NamedStream) error) error {
+	kbfsOps := folder.fs.config.KBFSOps()
+	names, err := kbfsOps.ListXattr(ctx, node)
+	if err != nil {
+		return err
+	}
+	var ns dokan.NamedStream
+	for _, name := range names {
+		if !strings.HasPrefix(name, xattrStreamPrefix) {
+			continue
+		}
+		value, err := kbfsOps.GetXattr(ctx, node, name)
+		if err != nil {
+			return err
+		}
+		ns.Name = name[len(xattrStreamPrefix):]
+		ns.Size = int64(len(value))
+		err = callback(&ns)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ dokan.StreamFinder = (*File)(nil)
+
+// FindStreams for dokan lists the default data stream and the
+// file's xattrs.
+func (f *File) FindStreams(ctx context.Context, fi *dokan.FileInfo, callback func(*dokan.NamedStream) error) (err error) {
+	f.folder.fs.logEnter(ctx, "File FindStreams")
+	defer func() { f.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	ei, err := f.folder.fs.config.KBFSOps().Stat(ctx, f.node)
+	if err != nil {
+		return err
+	}
+	err = callback(&dokan.NamedStream{Size: int64(ei.Size)})
+	if err != nil {
+		return err
+	}
+	return findXattrStreams(ctx, f.folder, f.node, callback)
+}
+
+var _ dokan.StreamFinder = (*Dir)(nil)
+
+// FindStreams for dokan lists the directory's xattrs.
+func (d *Dir) FindStreams(ctx context.Context, fi *dokan.FileInfo, callback func(*dokan.NamedStream) error) (err error) {
+	d.folder.fs.logEnter(ctx, "Dir FindStreams")
+	defer func() { d.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	return findXattrStreams(ctx, d.folder, d.node, callback)
+}
@@ -0,0 +1,66 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const (
+	// ArchivedRevisionPrefix starts the names of entries of
+	// ArchivedDirName that show a folder as of a revision number,
+	// like "rev=1234".
+	ArchivedRevisionPrefix = "rev="
+	// ArchivedDatePrefix starts the names of entries of
+	// ArchivedDirName that show a folder as of a time, like
+	// "date=2016-08-01T00:00:00".  The time is in RFC 3339 format,
+	// and in local time if it has no zone.
+	ArchivedDatePrefix = "date="
+)
+
+// archivedDateFormat is the RFC 3339 format without a zone.
+const archivedDateFormat = "2006-01-02T15:04:05"
+
+// BeginArchivedSnapshot returns a read snapshot of the given folder
+// as of the revision that name, an entry of ArchivedDirName, refers
+// to.  It returns a libkbfs.NoSuchNameError if name isn't of either
+// form.  The caller must Close the snapshot.
+func BeginArchivedSnapshot(ctx context.Context, config libkbfs.Config,
+	fb libkbfs.FolderBranch, name string) (*libkbfs.ReadSnapshot, error) {
+	kbfsOps := config.KBFSOps()
+	switch {
+	case strings.HasPrefix(name, ArchivedRevisionPrefix):
+		rev, err := strconv.ParseInt(
+			name[len(ArchivedRevisionPrefix):], 10, 64)
+		if err != nil {
+			return nil, libkbfs.NoSuchNameError{Name: name}
+		}
+		return kbfsOps.BeginReadSnapshotAtRevision(
+			ctx, fb, libkbfs.MetadataRevision(rev))
+
+	case strings.HasPrefix(name, ArchivedDatePrefix):
+		s := name[len(ArchivedDatePrefix):]
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t, err = time.ParseInLocation(archivedDateFormat, s, time.Local)
+			if err != nil {
+				return nil, libkbfs.NoSuchNameError{Name: name}
+			}
+		}
+		rev, err := kbfsOps.GetRevisionAtTime(ctx, fb, t)
+		if err != nil {
+			return nil, err
+		}
+		return kbfsOps.BeginReadSnapshotAtRevision(ctx, fb, rev)
+
+	default:
+		return nil, libkbfs.NoSuchNameError{Name: name}
+	}
+}
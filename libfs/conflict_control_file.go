@@ -0,0 +1,71 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+// ConflictAction enumerates all the possible actions to take on a
+// TLF's conflict resolution.
+type ConflictAction int
+
+const (
+	// ConflictEnableManual is to hold conflicts for the user.
+	ConflictEnableManual ConflictAction = iota
+	// ConflictDisableManual is to go back to resolving conflicts
+	// automatically.
+	ConflictDisableManual
+	// ConflictResolveMerged is to resolve a held conflict by
+	// keeping both sides.
+	ConflictResolveMerged
+	// ConflictResolveKeepLocal is to resolve a held conflict in
+	// favor of the local changes.
+	ConflictResolveKeepLocal
+	// ConflictResolveKeepRemote is to resolve a held conflict by
+	// discarding the local changes.
+	ConflictResolveKeepRemote
+)
+
+func (a ConflictAction) String() string {
+	switch a {
+	case ConflictEnableManual:
+		return "Enable manual conflict resolution"
+	case ConflictDisableManual:
+		return "Disable manual conflict resolution"
+	case ConflictResolveMerged:
+		return "Resolve conflict, keeping both"
+	case ConflictResolveKeepLocal:
+		return "Resolve conflict, keeping local"
+	case ConflictResolveKeepRemote:
+		return "Resolve conflict, keeping remote"
+	}
+	return fmt.Sprintf("ConflictAction(%d)", int(a))
+}
+
+// Execute performs the action using the given KBFSOps for the given
+// folder-branch.
+func (a ConflictAction) Execute(
+	ctx context.Context, kbfsOps libkbfs.KBFSOps,
+	fb libkbfs.FolderBranch) error {
+	switch a {
+	case ConflictEnableManual:
+		return kbfsOps.SetManualConflictResolution(ctx, fb, true)
+	case ConflictDisableManual:
+		return kbfsOps.SetManualConflictResolution(ctx, fb, false)
+	case ConflictResolveMerged:
+		return kbfsOps.ResolveMerged(ctx, fb)
+	case ConflictResolveKeepLocal:
+		return kbfsOps.ResolveKeepLocal(ctx, fb)
+	case ConflictResolveKeepRemote:
+		return kbfsOps.ResolveKeepRemote(ctx, fb)
+	default:
+		return fmt.Errorf("Unknown action %s", a)
+	}
+}
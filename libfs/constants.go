@@ -20,6 +20,41 @@ const RekeyFileName = ".kbfs_rekey"
 // anywhere within a top-level folder or inside the Keybase root
 const StatusFileName = ".kbfs_status"
 
+// RootStatusFileName is the name of a read-only file at the root of
+// the mount (outside of any top-level folder) with the same contents
+// as StatusFileName there, but listed, so admins can find it.
+const RootStatusFileName = "status"
+
+// RootMetricsFileName is like RootStatusFileName, but for
+// MetricsFileName.
+const RootMetricsFileName = "metrics"
+
+// RootErrorsFileName is like RootStatusFileName, but for the list of
+// recent errors.
+const RootErrorsFileName = "errors"
+
+// RootSpecialFileNames lists, in order, the files above that are
+// shown at the root of the mount.
+var RootSpecialFileNames = []string{
+	RootStatusFileName, RootMetricsFileName, RootErrorsFileName,
+}
+
+// SlowOpsFileName is the name of the read-only file listing the
+// diagnostics dumped for the most recent KBFS operations that took
+// longer than the slow-op threshold.  It can be reached from any
+// directory.
+const SlowOpsFileName = ".kbfs_slow_ops"
+
+// HealthFileName is the name of the read-only file summarizing the
+// health of KBFS, as returned by KBFSOps.Health.  It can be reached
+// from any directory.
+const HealthFileName = ".kbfs_health"
+
+// UsageFileName is the name of the read-only file listing how many
+// bytes and RPCs each TLF has cost on the network, by day.  It can
+// be reached from any directory.
+const UsageFileName = ".kbfs_usage"
+
 // SyncFromServerFileName is the name of the KBFS sync-from-server
 // file -- it can be reached anywhere within a top-level folder.
 const SyncFromServerFileName = ".kbfs_sync_from_server"
@@ -36,9 +71,64 @@ const DisableUpdatesFileName = ".kbfs_disable_updates"
 // file -- it can be reached anywhere within a top-level folder.
 const EnableUpdatesFileName = ".kbfs_enable_updates"
 
+// PauseWritesFileName is the name of the file that, when written
+// to, makes all mutating operations on a top-level folder fail until
+// writes are resumed.  It can be reached anywhere within a top-level
+// folder.
+const PauseWritesFileName = ".kbfs_pause_writes"
+
+// ResumeWritesFileName is the name of the file that undoes
+// PauseWritesFileName. It can be reached anywhere within a top-level
+// folder.
+const ResumeWritesFileName = ".kbfs_resume_writes"
+
+// SyncDurabilityFileName is the name of the file that sets how
+// durable syncs make writes to a top-level folder.  Writing "local"
+// to it makes them return once the writes are in the local journal,
+// and writing "server" makes them wait until the journal has been
+// flushed to the servers.  It can be reached anywhere within a
+// top-level folder.
+const SyncDurabilityFileName = ".kbfs_sync_durability"
+
+// BlockCompressionFileName is the name of the file that sets how
+// this device compresses the new blocks it writes to a top-level
+// folder.  Writing "none", "snappy" or "flate" to it sets that, and
+// the setting is kept across restarts.  It can be reached anywhere
+// within a top-level folder.
+const BlockCompressionFileName = ".kbfs_block_compression"
+
+// BlockChunkingFileName is the name of the file that sets how this
+// device splits the files it writes in a top-level folder into
+// blocks.  Writing "fixed" or "content" to it sets that, and the
+// setting is kept across restarts.  It can be reached anywhere
+// within a top-level folder.
+const BlockChunkingFileName = ".kbfs_block_chunking"
+
 // ResetCachesFileName is the name of the KBFS unstaging file.
 const ResetCachesFileName = ".kbfs_reset_caches"
 
+// EnableOfflineFileName is the name of the file that puts KBFS in
+// offline mode, where it stops talking to the servers.  It can be
+// reached from any directory.
+const EnableOfflineFileName = ".kbfs_enable_offline"
+
+// DisableOfflineFileName is the name of the file that takes KBFS out
+// of offline mode.  It can be reached from any directory.
+const DisableOfflineFileName = ".kbfs_disable_offline"
+
+// NetworkStateFileName is the name of the file that tells KBFS what
+// kind of network it's on.  Writing "unmetered", "metered" or "none"
+// to it sets the network state.  It can be reached from any
+// directory.
+const NetworkStateFileName = ".kbfs_network_state"
+
+// BlockParallelismFileName is the name of the file that sets how
+// many blocks KBFS puts and gets at once.  Writing "puts=N gets=N"
+// to it, where either can be left out or set to "auto", sets them,
+// and writing "auto" derives both from the measured bandwidth and
+// latency again.  It can be reached from any directory.
+const BlockParallelismFileName = ".kbfs_block_parallelism"
+
 // EnableJournalFileName is the name of the journal-enabling file. It
 // can be reached anywhere within a top-level folder.
 const EnableJournalFileName = ".kbfs_enable_journal"
@@ -67,3 +157,58 @@ const EditHistoryName = ".kbfs_edit_history"
 
 // FileInfoPrefix is the prefix of the per-file metadata files.
 const FileInfoPrefix = ".kbfs_fileinfo_"
+
+// EnableManualCRFileName is the name of the file that puts a
+// top-level folder into manual conflict resolution mode. It can be
+// reached anywhere within a top-level folder.
+const EnableManualCRFileName = ".kbfs_enable_manual_cr"
+
+// DisableManualCRFileName is the name of the file that takes a
+// top-level folder out of manual conflict resolution mode, resolving
+// any held conflict automatically. It can be reached anywhere within
+// a top-level folder.
+const DisableManualCRFileName = ".kbfs_disable_manual_cr"
+
+// ResolveMergedFileName is the name of the file that resolves a
+// held conflict by keeping both sides, or retries resolution if it
+// failed. It can be reached anywhere within a top-level folder.
+const ResolveMergedFileName = ".kbfs_resolve_merged"
+
+// ResolveKeepLocalFileName is the name of the file that resolves a
+// held conflict in favor of this device's changes. It can be reached
+// anywhere within a top-level folder.
+const ResolveKeepLocalFileName = ".kbfs_resolve_keep_local"
+
+// ResolveKeepRemoteFileName is the name of the file that resolves a
+// held conflict by discarding this device's changes. It can be
+// reached anywhere within a top-level folder.
+const ResolveKeepRemoteFileName = ".kbfs_resolve_keep_remote"
+
+// JournalContentsFileName is the name of the read-only file that
+// dumps the decoded contents of a top-level folder's journal. It can
+// be reached anywhere within a top-level folder.
+const JournalContentsFileName = ".kbfs_journal_contents"
+
+// ArchivedDirName is the name of the read-only directory through
+// which older revisions of a top-level folder can be browsed. It can
+// be reached anywhere within a top-level folder; see
+// BeginArchivedSnapshot for the names of its entries.
+const ArchivedDirName = ".kbfs_archived"
+
+// UnmergedDirName is the name of the read-only directory through
+// which both sides of a held conflict can be browsed, while a
+// top-level folder is on an unmerged branch. It can be reached
+// anywhere within a top-level folder; see BeginUnmergedSnapshot for
+// the names of its entries.
+const UnmergedDirName = ".kbfs_unmerged"
+
+// EnableSyncFileName is the name of the file that keeps every block
+// under the directory it's in on local disk, so that it stays
+// readable offline.  It can be reached from any directory within a
+// top-level folder.
+const EnableSyncFileName = ".kbfs_enable_sync"
+
+// DisableSyncFileName is the name of the file that undoes
+// EnableSyncFileName for the directory it's in.  It can be reached
+// from any directory within a top-level folder.
+const DisableSyncFileName = ".kbfs_disable_sync"
@@ -12,11 +12,14 @@ import (
 	"golang.org/x/net/context"
 )
 
-// JSONReportedError stringifies the reported error before marshalling
+// JSONReportedError stringifies the reported error before marshalling,
+// and adds its user-facing description.
 type JSONReportedError struct {
 	Time  time.Time
 	Error string
+	libkbfs.ErrorDescription
 	Stack []errors.StackFrame
+	Tags  map[string]string `json:",omitempty"`
 }
 
 func convertStack(stack []uintptr) []errors.StackFrame {
@@ -34,11 +37,15 @@ func convertStack(stack []uintptr) []errors.StackFrame {
 func GetEncodedErrors(config libkbfs.Config) func(context.Context) ([]byte, time.Time, error) {
 	return func(_ context.Context) ([]byte, time.Time, error) {
 		errors := config.Reporter().AllKnownErrors()
+		locale := libkbfs.ErrorLocale()
 		jsonErrors := make([]JSONReportedError, len(errors))
 		for i, e := range errors {
 			jsonErrors[i].Time = e.Time
 			jsonErrors[i].Error = e.Error.Error()
+			jsonErrors[i].ErrorDescription = libkbfs.DescribeError(
+				e.Error, locale)
 			jsonErrors[i].Stack = convertStack(e.Stack)
+			jsonErrors[i].Tags = e.Tags
 		}
 		data, err := PrettyJSON(jsonErrors)
 		var t time.Time
@@ -0,0 +1,25 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// GetEncodedHealth returns the health summary of KBFS, encoded as
+// JSON, for the health file.
+func GetEncodedHealth(config libkbfs.Config) func(context.Context) ([]byte, time.Time, error) {
+	return func(ctx context.Context) ([]byte, time.Time, error) {
+		health, err := config.KBFSOps().Health(ctx)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		data, err := PrettyJSON(health)
+		return data, time.Time{}, err
+	}
+}
@@ -0,0 +1,31 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// GetEncodedJournalContents returns serialized JSON containing the
+// decoded contents of a folder's journal.
+func GetEncodedJournalContents(ctx context.Context, config libkbfs.Config,
+	folderBranch libkbfs.FolderBranch) (
+	data []byte, t time.Time, err error) {
+	jServer, err := libkbfs.GetJournalServer(config)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	contents, err := jServer.JournalContents(ctx, folderBranch.Tlf)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	data, err = PrettyJSON(contents)
+	return data, time.Time{}, err
+}
@@ -0,0 +1,323 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// localFileCopyChunkBytes is how much of a local-only file is copied
+// into KBFS at a time.
+const localFileCopyChunkBytes = 512 << 10
+
+// LocalFile is a file that's kept local-only, because its name
+// matches an ignore file (see libkbfs.KBFSIgnoreFileName) when it's
+// created.  It never goes through KBFSOps, so it makes no revisions
+// and isn't seen by other devices.  Its contents are kept in the
+// config's libkbfs.LocalFileStore until it's removed, or KBFS
+// restarts, which is fine for the editor swap files and build
+// outputs it's meant for.
+type LocalFile struct {
+	data  *libkbfs.LocalFileData
+	clock libkbfs.Clock
+
+	lock sync.Mutex
+	// dir is the parent directory, which is held on to so that its
+	// node ID stays valid for as long as the file exists.
+	dir   libkbfs.Node
+	mode  os.FileMode
+	mtime time.Time
+	ctime time.Time
+}
+
+// LocalFileStat describes a local-only file.
+type LocalFileStat struct {
+	Size  uint64
+	Mode  os.FileMode
+	Mtime time.Time
+	Ctime time.Time
+}
+
+// Stat returns the size, mode and times of the file.
+func (lf *LocalFile) Stat() LocalFileStat {
+	lf.lock.Lock()
+	defer lf.lock.Unlock()
+	return LocalFileStat{
+		Size:  lf.data.Size(),
+		Mode:  lf.mode,
+		Mtime: lf.mtime,
+		Ctime: lf.ctime,
+	}
+}
+
+// Read reads into p from off, and returns how many bytes it read.
+func (lf *LocalFile) Read(p []byte, off int64) (int, error) {
+	return lf.data.ReadAt(p, off)
+}
+
+// Write writes p at off, growing the file if needed.
+func (lf *LocalFile) Write(p []byte, off int64) error {
+	err := lf.data.WriteAt(p, off)
+	if err != nil {
+		return err
+	}
+	lf.touch()
+	return nil
+}
+
+// Truncate grows or shrinks the file to size.
+func (lf *LocalFile) Truncate(size uint64) error {
+	err := lf.data.Truncate(size)
+	if err != nil {
+		return err
+	}
+	lf.touch()
+	return nil
+}
+
+func (lf *LocalFile) touch() {
+	lf.lock.Lock()
+	defer lf.lock.Unlock()
+	lf.mtime = lf.clock.Now()
+	lf.ctime = lf.mtime
+}
+
+// SetMode sets the permission bits of the file.
+func (lf *LocalFile) SetMode(mode os.FileMode) {
+	lf.lock.Lock()
+	defer lf.lock.Unlock()
+	lf.mode = mode
+	lf.ctime = lf.clock.Now()
+}
+
+// SetMtime sets the modification time of the file.
+func (lf *LocalFile) SetMtime(mtime time.Time) {
+	lf.lock.Lock()
+	defer lf.lock.Unlock()
+	lf.mtime = mtime
+	lf.ctime = lf.clock.Now()
+}
+
+// LocalFileOverDirError indicates that a local-only file can't be
+// renamed over a directory.
+type LocalFileOverDirError struct {
+	Name string
+}
+
+// Error implements the error interface for LocalFileOverDirError.
+func (e LocalFileOverDirError) Error() string {
+	return fmt.Sprintf("Can't rename a file over directory %s", e.Name)
+}
+
+// localFileKey identifies a local-only file by its parent directory
+// and name.
+type localFileKey struct {
+	dir  libkbfs.NodeID
+	name string
+}
+
+// LocalFiles holds the local-only files of one TLF, for a frontend
+// to show alongside the TLF's synced files.
+type LocalFiles struct {
+	config libkbfs.Config
+
+	lock  sync.Mutex
+	files map[localFileKey]*LocalFile
+}
+
+// NewLocalFiles returns an empty set of local-only files.
+func NewLocalFiles(config libkbfs.Config) *LocalFiles {
+	return &LocalFiles{
+		config: config,
+		files:  make(map[localFileKey]*LocalFile),
+	}
+}
+
+// Get returns the local-only file with the given name in dir, or nil
+// if there isn't one.
+func (lfs *LocalFiles) Get(dir libkbfs.Node, name string) *LocalFile {
+	lfs.lock.Lock()
+	defer lfs.lock.Unlock()
+	return lfs.files[localFileKey{dir.GetID(), name}]
+}
+
+// Has returns whether there are any local-only files.  A frontend
+// shouldn't forget a TLF while there are, since they'd be lost.
+func (lfs *LocalFiles) Has() bool {
+	lfs.lock.Lock()
+	defer lfs.lock.Unlock()
+	return len(lfs.files) > 0
+}
+
+// Names returns the names of the local-only files in dir.
+func (lfs *LocalFiles) Names(dir libkbfs.Node) (names []string) {
+	lfs.lock.Lock()
+	defer lfs.lock.Unlock()
+	for key := range lfs.files {
+		if key.dir == dir.GetID() {
+			names = append(names, key.name)
+		}
+	}
+	return names
+}
+
+// set puts lf in dir under name, removing any local-only file
+// already there.
+func (lfs *LocalFiles) set(dir libkbfs.Node, name string, lf *LocalFile) {
+	lfs.lock.Lock()
+	defer lfs.lock.Unlock()
+	key := localFileKey{dir.GetID(), name}
+	if old := lfs.files[key]; old != nil && old != lf {
+		_ = old.data.Remove()
+	}
+	lf.lock.Lock()
+	lf.dir = dir
+	lf.lock.Unlock()
+	lfs.files[key] = lf
+}
+
+// take removes the local-only file with the given name in dir from
+// the set, and returns it, or nil if there isn't one.
+func (lfs *LocalFiles) take(dir libkbfs.Node, name string) *LocalFile {
+	lfs.lock.Lock()
+	defer lfs.lock.Unlock()
+	key := localFileKey{dir.GetID(), name}
+	lf := lfs.files[key]
+	delete(lfs.files, key)
+	return lf
+}
+
+// Remove deletes the local-only file with the given name in dir, and
+// returns whether there was one.
+func (lfs *LocalFiles) Remove(dir libkbfs.Node, name string) (bool, error) {
+	lf := lfs.take(dir, name)
+	if lf == nil {
+		return false, nil
+	}
+	return true, lf.data.Remove()
+}
+
+// Create makes a new local-only file, if the config has a
+// libkbfs.LocalFileStore, name is ignored in dir, and name isn't
+// already taken in KBFS.  It returns nil otherwise.  root is the root
+// directory of the TLF.
+func (lfs *LocalFiles) Create(ctx context.Context, root, dir libkbfs.Node,
+	name string, mode os.FileMode) (*LocalFile, error) {
+	store := libkbfs.GetLocalFileStore(lfs.config)
+	if store == nil {
+		return nil, nil
+	}
+	kbfsOps := lfs.config.KBFSOps()
+	ignored, err := libkbfs.IsIgnored(ctx, kbfsOps, root, dir, name)
+	if err != nil || !ignored {
+		return nil, err
+	}
+	_, _, err = kbfsOps.Lookup(ctx, dir, name)
+	if err == nil {
+		// Files that were synced before they were ignored stay in
+		// KBFS.
+		return nil, nil
+	} else if _, ok := err.(libkbfs.NoSuchNameError); !ok {
+		return nil, err
+	}
+
+	data, err := store.Create()
+	if err != nil {
+		return nil, err
+	}
+	now := lfs.config.Clock().Now()
+	lf := &LocalFile{
+		data:  data,
+		clock: lfs.config.Clock(),
+		mode:  mode,
+		mtime: now,
+		ctime: now,
+	}
+	lfs.set(dir, name, lf)
+	return lf, nil
+}
+
+// Rename moves the local-only file oldName in oldDir to newName in
+// newDir.  If the new name isn't ignored, or already exists in KBFS,
+// the file's contents are copied into KBFS instead, so that editors
+// that save by writing to an ignored temporary file and renaming it
+// over the real one work as expected.  It returns whether the file
+// was copied.  root is the root directory of the TLF.
+func (lfs *LocalFiles) Rename(ctx context.Context, root libkbfs.Node,
+	lf *LocalFile, oldDir libkbfs.Node, oldName string,
+	newDir libkbfs.Node, newName string) (copied bool, err error) {
+	kbfsOps := lfs.config.KBFSOps()
+	ignored, err := libkbfs.IsIgnored(ctx, kbfsOps, root, newDir, newName)
+	if err != nil {
+		return false, err
+	}
+	node, ei, err := kbfsOps.Lookup(ctx, newDir, newName)
+	exists := err == nil
+	if _, ok := err.(libkbfs.NoSuchNameError); err != nil && !ok {
+		return false, err
+	}
+	if ignored && !exists {
+		lfs.take(oldDir, oldName)
+		lfs.set(newDir, newName, lf)
+		return false, nil
+	}
+
+	isExec := lf.Stat().Mode&0100 != 0
+	if !exists {
+		node, _, err = kbfsOps.CreateFile(
+			ctx, newDir, newName, isExec, libkbfs.NoExcl)
+		if err != nil {
+			return false, err
+		}
+	} else if ei.Type == libkbfs.Dir {
+		return false, LocalFileOverDirError{newName}
+	} else if ei.Type == libkbfs.Sym {
+		// Renames replace symlinks rather than writing through them.
+		err = kbfsOps.RemoveEntry(ctx, newDir, newName)
+		if err != nil {
+			return false, err
+		}
+		node, _, err = kbfsOps.CreateFile(
+			ctx, newDir, newName, isExec, libkbfs.NoExcl)
+		if err != nil {
+			return false, err
+		}
+	} else {
+		err = kbfsOps.Truncate(ctx, node, 0)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	// Copy a chunk at a time, so a big file doesn't need to fit in
+	// memory.
+	buf := make([]byte, localFileCopyChunkBytes)
+	for off := int64(0); ; {
+		n, err := lf.Read(buf, off)
+		if err != nil {
+			return false, err
+		}
+		if n == 0 {
+			break
+		}
+		err = kbfsOps.Write(ctx, node, buf[:n], off)
+		if err != nil {
+			return false, err
+		}
+		off += int64(n)
+	}
+	err = kbfsOps.Sync(ctx, node)
+	if err != nil {
+		return false, err
+	}
+	_, err = lfs.Remove(oldDir, oldName)
+	return true, err
+}
@@ -0,0 +1,29 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// GetEncodedSlowOps returns the diagnostics of the most recent slow
+// KBFSOps calls, encoded as JSON, for the slow ops file.
+func GetEncodedSlowOps(config libkbfs.Config) func(context.Context) ([]byte, time.Time, error) {
+	return func(_ context.Context) ([]byte, time.Time, error) {
+		reports := config.KBFSOps().SlowOpReports()
+		if reports == nil {
+			reports = []libkbfs.SlowOpReport{}
+		}
+		data, err := PrettyJSON(reports)
+		var t time.Time
+		if len(reports) > 0 {
+			t = reports[len(reports)-1].Time
+		}
+		return data, t, err
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const (
+	// UnmergedLocalName is the entry of UnmergedDirName that shows
+	// this device's side of a conflict, as the folder itself does
+	// while the conflict is held.
+	UnmergedLocalName = "local"
+	// UnmergedRemoteName is the entry of UnmergedDirName that shows
+	// the latest merged revision, the other side of the conflict.
+	UnmergedRemoteName = "remote"
+)
+
+// BeginUnmergedSnapshot returns a read snapshot of one side of the
+// conflict that the given folder is stuck on, for name, an entry of
+// UnmergedDirName.  It returns a libkbfs.NoSuchNameError if name is
+// neither entry, or if the folder isn't on an unmerged branch.  The
+// caller must Close the snapshot.
+func BeginUnmergedSnapshot(ctx context.Context, config libkbfs.Config,
+	fb libkbfs.FolderBranch, name string) (*libkbfs.ReadSnapshot, error) {
+	if name != UnmergedLocalName && name != UnmergedRemoteName {
+		return nil, libkbfs.NoSuchNameError{Name: name}
+	}
+	kbfsOps := config.KBFSOps()
+	status, err := kbfsOps.GetConflictStatus(ctx, fb)
+	if err != nil {
+		return nil, err
+	}
+	if !status.Staged {
+		return nil, libkbfs.NoSuchNameError{Name: name}
+	}
+	if name == UnmergedLocalName {
+		return kbfsOps.BeginReadSnapshot(ctx, fb)
+	}
+	md, err := config.MDOps().GetForTLF(ctx, fb.Tlf)
+	if err != nil {
+		return nil, err
+	}
+	return kbfsOps.BeginReadSnapshotAtRevision(ctx, fb, md.Revision())
+}
+
+// UnmergedNames returns the entries of UnmergedDirName for the given
+// folder, which are only there while it is on an unmerged branch.
+func UnmergedNames(ctx context.Context, config libkbfs.Config,
+	fb libkbfs.FolderBranch) ([]string, error) {
+	status, err := config.KBFSOps().GetConflictStatus(ctx, fb)
+	if err != nil {
+		return nil, err
+	}
+	if !status.Staged {
+		return nil, nil
+	}
+	return []string{UnmergedLocalName, UnmergedRemoteName}, nil
+}
@@ -0,0 +1,25 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// GetEncodedUsage returns the daily network usage of each TLF,
+// encoded as JSON, for the usage file.
+func GetEncodedUsage(config libkbfs.Config) func(context.Context) ([]byte, time.Time, error) {
+	return func(_ context.Context) ([]byte, time.Time, error) {
+		days := config.UsageMeter().Days()
+		if days == nil {
+			days = []libkbfs.UsageDay{}
+		}
+		data, err := PrettyJSON(days)
+		return data, time.Time{}, err
+	}
+}
@@ -23,6 +23,7 @@ var _ fs.Node = (*Alias)(nil)
 // Attr implements the fs.Node interface for Alias.
 func (*Alias) Attr(ctx context.Context, a *fuse.Attr) error {
 	a.Mode = os.ModeSymlink | 0777
+	fillOwner(ctx, a)
 	return nil
 }
 
@@ -0,0 +1,202 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"os"
+	"path"
+	"sync"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// ArchivedDir is the libfs.ArchivedDirName directory of a folder.
+// It lists nothing, but looking up "rev=N" or "date=T" in it gives a
+// read-only view of the whole folder as of that revision.
+type ArchivedDir struct {
+	folder *Folder
+}
+
+var _ fs.Node = (*ArchivedDir)(nil)
+
+// Attr implements the fs.Node interface for ArchivedDir.
+func (d *ArchivedDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0555
+	fillOwner(ctx, a)
+	return nil
+}
+
+var _ fs.NodeRequestLookuper = (*ArchivedDir)(nil)
+
+// Lookup implements the fs.NodeRequestLookuper interface for
+// ArchivedDir.
+func (d *ArchivedDir) Lookup(ctx context.Context, req *fuse.LookupRequest,
+	resp *fuse.LookupResponse) (node fs.Node, err error) {
+	d.folder.fs.log.CDebugf(ctx, "ArchivedDir Lookup %s", req.Name)
+	defer func() { d.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	snap, err := libfs.BeginArchivedSnapshot(ctx, d.folder.fs.config,
+		d.folder.getFolderBranch(), req.Name)
+	if err != nil {
+		if _, ok := err.(libkbfs.NoSuchNameError); ok {
+			return nil, fuse.ENOENT
+		}
+		return nil, err
+	}
+	return &ArchivedEntry{
+		folder: d.folder,
+		snap:   &archivedSnapshot{snap: snap},
+	}, nil
+}
+
+var _ fs.Handle = (*ArchivedDir)(nil)
+
+var _ fs.HandleReadDirAller = (*ArchivedDir)(nil)
+
+// ReadDirAll implements the fs.HandleReadDirAller interface for
+// ArchivedDir.  There are too many revisions to list.
+func (d *ArchivedDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	return nil, nil
+}
+
+// archivedSnapshot closes a read snapshot once the kernel has
+// forgotten the root of its view, which it only does after
+// forgetting everything under it.
+type archivedSnapshot struct {
+	snap *libkbfs.ReadSnapshot
+	once sync.Once
+}
+
+func (s *archivedSnapshot) close() {
+	s.once.Do(s.snap.Close)
+}
+
+// ArchivedEntry is a file, directory or symlink in a read-only view
+// of a folder as of an older revision.
+type ArchivedEntry struct {
+	folder *Folder
+	snap   *archivedSnapshot
+	// path is relative to the root of the folder, and is empty
+	// for the root itself.
+	path string
+}
+
+var _ fs.Node = (*ArchivedEntry)(nil)
+
+// Attr implements the fs.Node interface for ArchivedEntry.
+func (e *ArchivedEntry) Attr(ctx context.Context, a *fuse.Attr) (err error) {
+	e.folder.fs.log.CDebugf(ctx, "ArchivedEntry Attr %s", e.path)
+	defer func() { e.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	ei, err := e.snap.snap.Stat(ctx, e.path)
+	if err != nil {
+		return err
+	}
+	fillAttr(ctx, &ei, a)
+	if ei.Type == libkbfs.Sym {
+		a.Mode = os.ModeSymlink | 0555
+	} else {
+		a.Mode = entryMode(ctx, ei, e.folder.list.public) &^ 0222
+	}
+	return nil
+}
+
+var _ fs.NodeRequestLookuper = (*ArchivedEntry)(nil)
+
+// Lookup implements the fs.NodeRequestLookuper interface for
+// ArchivedEntry.
+func (e *ArchivedEntry) Lookup(ctx context.Context, req *fuse.LookupRequest,
+	resp *fuse.LookupResponse) (node fs.Node, err error) {
+	e.folder.fs.log.CDebugf(ctx, "ArchivedEntry Lookup %s %s",
+		e.path, req.Name)
+	defer func() { e.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	p := path.Join(e.path, req.Name)
+	if _, err := e.snap.snap.Stat(ctx, p); err != nil {
+		if _, ok := err.(libkbfs.NoSuchNameError); ok {
+			return nil, fuse.ENOENT
+		}
+		return nil, err
+	}
+	return &ArchivedEntry{folder: e.folder, snap: e.snap, path: p}, nil
+}
+
+var _ fs.Handle = (*ArchivedEntry)(nil)
+
+var _ fs.HandleReadDirAller = (*ArchivedEntry)(nil)
+
+// ReadDirAll implements the fs.HandleReadDirAller interface for
+// ArchivedEntry.
+func (e *ArchivedEntry) ReadDirAll(ctx context.Context) (
+	res []fuse.Dirent, err error) {
+	e.folder.fs.log.CDebugf(ctx, "ArchivedEntry ReadDirAll %s", e.path)
+	defer func() { e.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	children, err := e.snap.snap.GetDirChildren(ctx, e.path)
+	if err != nil {
+		return nil, err
+	}
+	for name, ei := range children {
+		fde := fuse.Dirent{Name: name}
+		switch ei.Type {
+		case libkbfs.File, libkbfs.Exec:
+			fde.Type = fuse.DT_File
+		case libkbfs.Dir:
+			fde.Type = fuse.DT_Dir
+		case libkbfs.Sym:
+			fde.Type = fuse.DT_Link
+		}
+		res = append(res, fde)
+	}
+	return res, nil
+}
+
+var _ fs.HandleReader = (*ArchivedEntry)(nil)
+
+// Read implements the fs.HandleReader interface for ArchivedEntry.
+func (e *ArchivedEntry) Read(ctx context.Context, req *fuse.ReadRequest,
+	resp *fuse.ReadResponse) (err error) {
+	e.folder.fs.log.CDebugf(ctx, "ArchivedEntry Read %s off=%d sz=%d",
+		e.path, req.Offset, req.Size)
+	defer func() { e.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	n, err := e.snap.snap.Read(ctx, e.path, resp.Data[:cap(resp.Data)],
+		req.Offset)
+	if err != nil {
+		return err
+	}
+	resp.Data = resp.Data[:n]
+	return nil
+}
+
+var _ fs.NodeReadlinker = (*ArchivedEntry)(nil)
+
+// Readlink implements the fs.NodeReadlinker interface for
+// ArchivedEntry.
+func (e *ArchivedEntry) Readlink(ctx context.Context,
+	req *fuse.ReadlinkRequest) (link string, err error) {
+	e.folder.fs.log.CDebugf(ctx, "ArchivedEntry Readlink %s", e.path)
+	defer func() { e.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	ei, err := e.snap.snap.Stat(ctx, e.path)
+	if err != nil {
+		return "", err
+	}
+	return ei.SymPath, nil
+}
+
+var _ fs.NodeForgetter = (*ArchivedEntry)(nil)
+
+// Forget implements the fs.NodeForgetter interface for
+// ArchivedEntry.
+func (e *ArchivedEntry) Forget() {
+	if e.path == "" {
+		e.snap.close()
+	}
+}
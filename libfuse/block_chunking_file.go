@@ -0,0 +1,60 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"strings"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// BlockChunkingFile represents a write-only file where writing
+// "fixed" or "content" sets how this device splits the files it
+// writes in the folder into blocks.
+type BlockChunkingFile struct {
+	folder *Folder
+}
+
+var _ fs.Node = (*BlockChunkingFile)(nil)
+
+// Attr implements the fs.Node interface for BlockChunkingFile.
+func (f *BlockChunkingFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Size = 0
+	a.Mode = 0222
+	fillOwner(ctx, a)
+	return nil
+}
+
+var _ fs.Handle = (*BlockChunkingFile)(nil)
+
+var _ fs.HandleWriter = (*BlockChunkingFile)(nil)
+
+// Write implements the fs.HandleWriter interface for
+// BlockChunkingFile.
+func (f *BlockChunkingFile) Write(ctx context.Context,
+	req *fuse.WriteRequest, resp *fuse.WriteResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "BlockChunkingFile Write")
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	if len(req.Data) == 0 {
+		return nil
+	}
+
+	chunking, err := libkbfs.ParseBlockChunking(
+		strings.TrimSpace(string(req.Data)))
+	if err != nil {
+		return err
+	}
+	err = f.folder.fs.config.SetBlockChunkingForTLF(
+		f.folder.getFolderBranch().Tlf, chunking)
+	if err != nil {
+		return err
+	}
+
+	resp.Size = len(req.Data)
+	return nil
+}
@@ -0,0 +1,60 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"strings"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// BlockCompressionFile represents a write-only file where writing
+// "none", "snappy" or "flate" sets how this device compresses new
+// blocks in the folder.
+type BlockCompressionFile struct {
+	folder *Folder
+}
+
+var _ fs.Node = (*BlockCompressionFile)(nil)
+
+// Attr implements the fs.Node interface for BlockCompressionFile.
+func (f *BlockCompressionFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Size = 0
+	a.Mode = 0222
+	fillOwner(ctx, a)
+	return nil
+}
+
+var _ fs.Handle = (*BlockCompressionFile)(nil)
+
+var _ fs.HandleWriter = (*BlockCompressionFile)(nil)
+
+// Write implements the fs.HandleWriter interface for
+// BlockCompressionFile.
+func (f *BlockCompressionFile) Write(ctx context.Context,
+	req *fuse.WriteRequest, resp *fuse.WriteResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "BlockCompressionFile Write")
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	if len(req.Data) == 0 {
+		return nil
+	}
+
+	compression, err := libkbfs.ParseBlockCompressionType(
+		strings.TrimSpace(string(req.Data)))
+	if err != nil {
+		return err
+	}
+	err = f.folder.fs.config.SetBlockCompressionForTLF(
+		f.folder.getFolderBranch().Tlf, compression)
+	if err != nil {
+		return err
+	}
+
+	resp.Size = len(req.Data)
+	return nil
+}
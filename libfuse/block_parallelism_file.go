@@ -0,0 +1,58 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// BlockParallelismFile represents a write-only file where writing a
+// setting like "puts=8 gets=auto" sets how many blocks KBFS puts and
+// gets at once.  It can be reached from any directory under the FUSE
+// mountpoint.
+type BlockParallelismFile struct {
+	fs *FS
+}
+
+var _ fs.Node = (*BlockParallelismFile)(nil)
+
+// Attr implements the fs.Node interface for BlockParallelismFile.
+func (f *BlockParallelismFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Size = 0
+	a.Mode = 0222
+	fillOwner(ctx, a)
+	return nil
+}
+
+var _ fs.Handle = (*BlockParallelismFile)(nil)
+
+var _ fs.HandleWriter = (*BlockParallelismFile)(nil)
+
+// Write implements the fs.HandleWriter interface for
+// BlockParallelismFile.
+func (f *BlockParallelismFile) Write(ctx context.Context,
+	req *fuse.WriteRequest, resp *fuse.WriteResponse) (err error) {
+	f.fs.log.CDebugf(ctx, "BlockParallelismFile Write")
+	defer func() { f.fs.reportErr(ctx, libkbfs.WriteMode, err) }()
+	if len(req.Data) == 0 {
+		return nil
+	}
+	meter := f.fs.config.BlockTransferMeter()
+	puts, gets := meter.ConfiguredParallelism()
+	puts, gets, err = libkbfs.ParseBlockParallelism(
+		string(req.Data), puts, gets)
+	if err != nil {
+		return err
+	}
+	err = meter.SetParallelism(puts, gets)
+	if err != nil {
+		return err
+	}
+	resp.Size = len(req.Data)
+	return nil
+}
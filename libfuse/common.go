@@ -9,6 +9,7 @@ import (
 
 	"bazil.org/fuse"
 	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
 )
 
 const (
@@ -35,10 +36,40 @@ const (
 
 // fillAttr sets attributes based on the entry info. It only handles fields
 // common to all entryinfo types.
-func fillAttr(ei *libkbfs.EntryInfo, a *fuse.Attr) {
+func fillAttr(ctx context.Context, ei *libkbfs.EntryInfo, a *fuse.Attr) {
 	a.Valid = 1 * time.Minute
 
 	a.Size = ei.Size
 	a.Mtime = time.Unix(0, ei.Mtime)
 	a.Ctime = time.Unix(0, ei.Ctime)
+	fillOwner(ctx, a)
+	if uid, gid, ok := ownerHints(ctx, *ei); ok {
+		o := mountOptionsFromContext(ctx)
+		if uid >= 0 {
+			a.Uid = uint32(uid)
+			if mapped, ok := o.UIDMap[a.Uid]; ok {
+				a.Uid = mapped
+			}
+		}
+		if gid >= 0 {
+			a.Gid = uint32(gid)
+			if mapped, ok := o.GIDMap[a.Gid]; ok {
+				a.Gid = mapped
+			}
+		}
+	}
+}
+
+// setOwnerFromRequest stores the uid and/or gid from a chown as
+// ownership hints on node.
+func setOwnerFromRequest(ctx context.Context, kbfsOps libkbfs.KBFSOps,
+	node libkbfs.Node, req *fuse.SetattrRequest) error {
+	uid, gid := -1, -1
+	if req.Valid.Uid() {
+		uid = int(req.Uid)
+	}
+	if req.Valid.Gid() {
+		gid = int(req.Gid)
+	}
+	return kbfsOps.SetOwner(ctx, node, uid, gid)
 }
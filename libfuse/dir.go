@@ -44,6 +44,11 @@ type Folder struct {
 	// FUSE Forget request.
 	nodes map[libkbfs.NodeID]fs.Node
 
+	// localFiles holds the files in this folder that are kept
+	// local-only because they're ignored.  The folder isn't
+	// forgotten while there are any, since they'd be lost.
+	localFiles *libfs.LocalFiles
+
 	// Protects the updateChan.
 	updateMu sync.Mutex
 	// updateChan is non-nil when the user disables updates via the
@@ -58,6 +63,8 @@ func newFolder(fl *FolderList, h *libkbfs.TlfHandle) *Folder {
 		list:  fl,
 		h:     h,
 		nodes: map[libkbfs.NodeID]fs.Node{},
+
+		localFiles: libfs.NewLocalFiles(fl.fs.config),
 	}
 	return f
 }
@@ -126,7 +133,7 @@ func (f *Folder) forgetNode(node libkbfs.Node) {
 	defer f.nodesMu.Unlock()
 
 	delete(f.nodes, node.GetID())
-	if len(f.nodes) == 0 {
+	if len(f.nodes) == 0 && !f.localFiles.Has() {
 		ctx := libkbfs.BackgroundContextWithCancellationDelayer()
 		f.unsetFolderBranch(ctx)
 		f.list.forgetFolder(string(f.name()))
@@ -362,12 +369,8 @@ func (d *Dir) attr(ctx context.Context, a *fuse.Attr) (err error) {
 		}
 		return err
 	}
-	fillAttr(&de, a)
-
-	a.Mode = os.ModeDir | 0700
-	if d.folder.list.public {
-		a.Mode |= 0055
-	}
+	fillAttr(ctx, &de, a)
+	a.Mode = entryMode(ctx, de, d.folder.list.public)
 	return nil
 }
 
@@ -389,6 +392,14 @@ func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.Lo
 		return specialNode, nil
 	}
 
+	switch req.Name {
+	case libfs.EnableSyncFileName:
+		return &SyncControlFile{
+			folder: d.folder, node: d.node, subscribed: true}, nil
+	case libfs.DisableSyncFileName:
+		return &SyncControlFile{folder: d.folder, node: d.node}, nil
+	}
+
 	// Check if this is a per-file metainformation file, if so
 	// return the corresponding SpecialReadFile.
 	if strings.HasPrefix(req.Name, libfs.FileInfoPrefix) {
@@ -403,6 +414,10 @@ func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.Lo
 		return &SpecialReadFile{fileInfo(nmd).read}, nil
 	}
 
+	if lf := d.folder.getLocalFile(d.node, req.Name); lf != nil {
+		return lf, nil
+	}
+
 	newNode, de, err := d.folder.fs.config.KBFSOps().Lookup(ctx, d.node, req.Name)
 	if err != nil {
 		if _, ok := err.(libkbfs.NoSuchNameError); ok {
@@ -468,10 +483,39 @@ func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.Cr
 	d.folder.fs.log.CDebugf(ctx, "Dir Create %s", req.Name)
 	defer func() { d.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
 
+	mode := (req.Mode &^ req.Umask) &
+		(os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if lf := d.folder.getLocalFile(d.node, req.Name); lf != nil {
+		if getEXCLFromCreateRequest(req) == libkbfs.WithExcl {
+			return nil, nil, fuse.EEXIST
+		}
+		return lf, lf, nil
+	}
+	lf, err := d.folder.createLocalFile(ctx, d.node, req.Name, mode)
+	if err != nil {
+		return nil, nil, err
+	} else if lf != nil {
+		return lf, lf, nil
+	}
+
 	isExec := (req.Mode.Perm() & 0100) != 0
 	excl := getEXCLFromCreateRequest(req)
-	newNode, _, err := d.folder.fs.config.KBFSOps().CreateFile(
-		ctx, d.node, req.Name, isExec, excl)
+	// Only record the mode if it isn't the default, so that most
+	// files keep following the mount's FileMode.
+	entryType := libkbfs.File
+	if isExec {
+		entryType = libkbfs.Exec
+	}
+	kbfsOps := d.folder.fs.config.KBFSOps()
+	var newNode libkbfs.Node
+	if mode != (libkbfs.EntryInfo{Type: entryType}).PosixMode(
+		d.folder.list.public) {
+		newNode, _, err = kbfsOps.CreateFileWithMode(
+			ctx, d.node, req.Name, mode, excl)
+	} else {
+		newNode, _, err = kbfsOps.CreateFile(
+			ctx, d.node, req.Name, isExec, excl)
+	}
 	if err != nil {
 		return nil, nil, err
 	}
@@ -538,6 +582,43 @@ func (d *Dir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (
 	return child, nil
 }
 
+var _ fs.NodeLinker = (*Dir)(nil)
+
+// Link implements the fs.NodeLinker interface for Dir.
+func (d *Dir) Link(ctx context.Context, req *fuse.LinkRequest,
+	old fs.Node) (node fs.Node, err error) {
+	d.folder.fs.log.CDebugf(ctx, "Dir Link %s", req.NewName)
+	defer func() { d.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+
+	// This fits in situation 1 as described in libkbfs/delayed_cancellation.go
+	err = libkbfs.EnableDelayedCancellationWithGracePeriod(
+		ctx, d.folder.fs.config.DelayedCancellationGracePeriod())
+	if err != nil {
+		return nil, err
+	}
+
+	f, ok := old.(*File)
+	if !ok {
+		// Directories can't be linked, and neither can local-only
+		// files, which aren't in KBFS.
+		return nil, fuse.Errno(syscall.EPERM)
+	}
+	if f.folder != d.folder {
+		return nil, fuse.Errno(syscall.EXDEV)
+	}
+	if d.folder.getLocalFile(d.node, req.NewName) != nil {
+		return nil, fuse.EEXIST
+	}
+
+	if err := d.folder.fs.config.KBFSOps().Link(
+		ctx, f.node, d.node, req.NewName); err != nil {
+		return nil, err
+	}
+
+	// All the links share the same node.
+	return f, nil
+}
+
 // Rename implements the fs.NodeRenamer interface for Dir.
 func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest,
 	newDir fs.Node) (err error) {
@@ -575,6 +656,32 @@ func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest,
 		return fuse.Errno(syscall.EXDEV)
 	}
 
+	if lf := d.folder.getLocalFile(d.node, req.OldName); lf != nil {
+		copied, err := d.folder.renameLocalFile(
+			ctx, lf, d.node, req.OldName, realNewDir.node, req.NewName)
+		if err != nil {
+			return err
+		}
+		if copied {
+			// The kernel still thinks the new name is the local
+			// file, so make it look up the copy in KBFS.
+			d.folder.fs.queueNotification(func() {
+				err := d.folder.fs.fuse.InvalidateEntry(
+					realNewDir, req.NewName)
+				if err != nil && err != fuse.ErrNotCached {
+					d.folder.fs.log.CErrorf(
+						ctx, "FUSE invalidate error: %v", err)
+				}
+			})
+		}
+		return nil
+	}
+	// A synced file replaces any local-only one.
+	if _, err := d.folder.localFiles.Remove(
+		realNewDir.node, req.NewName); err != nil {
+		return err
+	}
+
 	// overwritten node, if any, will be removed from Folder.nodes, if
 	// it is there in the first place, by its Forget
 
@@ -591,6 +698,23 @@ func (d *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) (err error) {
 	d.folder.fs.log.CDebugf(ctx, "Dir Remove %s", req.Name)
 	defer func() { d.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
 
+	if !req.Dir {
+		removed, err := d.folder.localFiles.Remove(d.node, req.Name)
+		if removed || err != nil {
+			return err
+		}
+	}
+	if req.Dir && d.folder.localFiles.Has() {
+		child, _, err := d.folder.fs.config.KBFSOps().Lookup(
+			ctx, d.node, req.Name)
+		if err != nil {
+			return err
+		}
+		if len(d.folder.localFiles.Names(child)) > 0 {
+			return fuse.Errno(syscall.ENOTEMPTY)
+		}
+	}
+
 	// node will be removed from Folder.nodes, if it is there in the
 	// first place, by its Forget
 
@@ -630,6 +754,9 @@ func (d *Dir) ReadDirAll(ctx context.Context) (res []fuse.Dirent, err error) {
 		}
 		res = append(res, fde)
 	}
+	for _, name := range d.folder.localFiles.Names(d.node) {
+		res = append(res, fuse.Dirent{Name: name, Type: fuse.DT_File})
+	}
 	return res, nil
 }
 
@@ -646,13 +773,10 @@ func (d *Dir) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.
 	valid := req.Valid
 
 	if valid.Mode() {
-		// You can't set the mode on KBFS directories, but we don't
-		// want to return EPERM because that unnecessarily fails some
-		// applications like unzip.  Instead ignore it, print a debug
-		// message, and advertise this behavior on the
-		// "understand_kbfs" doc online.
-		d.folder.fs.log.CDebugf(ctx, "Ignoring unsupported attempt to set "+
-			"the mode on a directory")
+		err := d.folder.fs.config.KBFSOps().SetMode(ctx, d.node, req.Mode)
+		if err != nil {
+			return err
+		}
 		valid &^= fuse.SetattrMode
 	}
 
@@ -672,13 +796,11 @@ func (d *Dir) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.
 	valid &^= fuse.SetattrLockOwner | fuse.SetattrHandle
 
 	if valid.Uid() || valid.Gid() {
-		// You can't set the UID/GID on KBFS directories, but we don't
-		// want to return ENOSYS because that causes scary warnings on
-		// some programs like mv.  Instead ignore it, print a debug
-		// message, and advertise this behavior on the
-		// "understand_kbfs" doc online.
-		d.folder.fs.log.CDebugf(ctx, "Ignoring unsupported attempt to set "+
-			"the UID/GID on a directory")
+		err := setOwnerFromRequest(
+			ctx, d.folder.fs.config.KBFSOps(), d.node, req)
+		if err != nil {
+			return err
+		}
 		valid &^= fuse.SetattrUid | fuse.SetattrGid
 	}
 
@@ -43,11 +43,17 @@ func (f *File) attr(ctx context.Context, a *fuse.Attr) (err error) {
 		return err
 	}
 
-	fillAttr(&de, a)
-	a.Mode = 0644
-	if de.Type == libkbfs.Exec {
-		a.Mode |= 0111
+	fillAttr(ctx, &de, a)
+	a.Mode = entryMode(ctx, de, f.folder.list.public)
+	a.Nlink = de.LinkCount()
+
+	// Holes don't count towards the blocks a file uses.
+	allocated, err := f.folder.fs.config.KBFSOps().GetAllocatedSize(
+		ctx, f.node)
+	if err != nil {
+		return err
 	}
+	a.Blocks = (allocated + 511) / 512
 	return nil
 }
 
@@ -87,12 +93,21 @@ func (f *File) Read(ctx context.Context, req *fuse.ReadRequest,
 	f.folder.fs.log.CDebugf(ctx, "File Read")
 	defer func() { f.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
 
-	n, err := f.folder.fs.config.KBFSOps().Read(
-		ctx, f.node, resp.Data[:cap(resp.Data)], req.Offset)
+	slices, err := f.folder.fs.config.KBFSOps().ReadSlices(
+		ctx, f.node, req.Offset, int64(req.Size))
 	if err != nil {
 		return err
 	}
-	resp.Data = resp.Data[:n]
+	if len(slices) == 1 {
+		// Respond straight from the cached block; fuse copies it
+		// into the reply without modifying it.
+		resp.Data = slices[0]
+		return nil
+	}
+	resp.Data = resp.Data[:0]
+	for _, s := range slices {
+		resp.Data = append(resp.Data, s...)
+	}
 	return nil
 }
 
@@ -158,10 +173,9 @@ func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest,
 	}
 
 	if valid.Mode() {
-		// Unix has 3 exec bits, KBFS has one; we follow the user-exec bit.
-		exec := req.Mode&0100 != 0
-		err := f.folder.fs.config.KBFSOps().SetEx(
-			ctx, f.node, exec)
+		// This also sets the exec bit, from the user-exec bit.
+		err := f.folder.fs.config.KBFSOps().SetMode(
+			ctx, f.node, req.Mode)
 		if err != nil {
 			return err
 		}
@@ -178,13 +192,11 @@ func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest,
 	}
 
 	if valid.Uid() || valid.Gid() {
-		// You can't set the UID/GID on KBFS files, but we don't want
-		// to return ENOSYS because that causes scary warnings on some
-		// programs like mv.  Instead ignore it, print a debug
-		// message, and advertise this behavior on the
-		// "understand_kbfs" doc online.
-		f.folder.fs.log.CDebugf(ctx, "Ignoring unsupported attempt to set "+
-			"the UID/GID on a file")
+		err := setOwnerFromRequest(
+			ctx, f.folder.fs.config.KBFSOps(), f.node, req)
+		if err != nil {
+			return err
+		}
 		valid &^= fuse.SetattrUid | fuse.SetattrGid
 	}
 
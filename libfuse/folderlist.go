@@ -34,7 +34,8 @@ var _ fs.Node = (*FolderList)(nil)
 
 // Attr implements the fs.Node interface.
 func (*FolderList) Attr(ctx context.Context, a *fuse.Attr) error {
-	a.Mode = os.ModeDir | 0755
+	a.Mode = dirMode(ctx, os.ModeDir|0755)
+	fillOwner(ctx, a)
 	return nil
 }
 
@@ -31,6 +31,13 @@ type FS struct {
 	// remoteStatus is the current status of remote connections.
 	remoteStatus libfs.RemoteStatus
 
+	// subdir, if set, is the path (e.g. "private/alice/project")
+	// of the only directory this FS shows, as its root.
+	subdir string
+
+	// mountOptions control the owners and permissions shown.
+	mountOptions MountOptions
+
 	// this is like time.AfterFunc, except that in some tests this can be
 	// overridden to execute f without any delay.
 	execAfterDelay func(d time.Duration, f func())
@@ -170,6 +177,9 @@ func (f *FS) reportErr(ctx context.Context,
 
 // Root implements the fs.FS interface for FS.
 func (f *FS) Root() (fs.Node, error) {
+	if f.subdir != "" {
+		return f.subdirRoot(context.Background())
+	}
 	n := &Root{
 		private: &FolderList{
 			fs:      f,
@@ -184,9 +194,10 @@ func (f *FS) Root() (fs.Node, error) {
 	return n, nil
 }
 
-// Statfs implements the fs.FSStatfser interface for FS.
+// Statfs implements the fs.FSStatfser interface for FS.  The size
+// of the file system is the user's quota, and what's left of the
+// quota is free.
 func (f *FS) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.StatfsResponse) error {
-	// TODO: Fill in real values for these.
 	var bsize uint32 = 32 * 1024
 	*resp = fuse.StatfsResponse{
 		Blocks:  ^uint64(0) / uint64(bsize),
@@ -196,8 +207,23 @@ func (f *FS) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.Sta
 		Ffree:   0,
 		Bsize:   bsize,
 		Namelen: ^uint32(0),
-		Frsize:  0,
+		Frsize:  bsize,
+	}
+
+	// Without quota info, e.g. while logged out, the space looks
+	// unlimited.
+	quotaInfo, err := f.config.KBFSOps().GetUserQuotaInfo(ctx)
+	if err != nil {
+		f.log.CDebugf(ctx, "Couldn't get quota info for statfs: %v", err)
+		return nil
+	}
+	free := quotaInfo.Limit - quotaInfo.UsedBytes()
+	if free < 0 {
+		free = 0
 	}
+	resp.Blocks = uint64(quotaInfo.Limit) / uint64(bsize)
+	resp.Bfree = uint64(free) / uint64(bsize)
+	resp.Bavail = resp.Bfree
 	return nil
 }
 
@@ -211,7 +237,8 @@ var _ fs.Node = (*Root)(nil)
 
 // Attr implements the fs.Node interface for Root.
 func (*Root) Attr(ctx context.Context, a *fuse.Attr) error {
-	a.Mode = os.ModeDir | 0755
+	a.Mode = dirMode(ctx, os.ModeDir|0755)
+	fillOwner(ctx, a)
 	return nil
 }
 
@@ -238,6 +265,12 @@ func (r *Root) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.L
 		return r.private, nil
 	case PublicName:
 		return r.public, nil
+	case libfs.RootStatusFileName:
+		return NewNonTLFStatusFile(r.private.fs, &resp.EntryValid), nil
+	case libfs.RootMetricsFileName:
+		return NewMetricsFile(r.private.fs, &resp.EntryValid), nil
+	case libfs.RootErrorsFileName:
+		return NewErrorFile(r.private.fs, &resp.EntryValid), nil
 	}
 
 	// Don't want to pop up errors on special OS files.
@@ -271,6 +304,10 @@ func (r *Root) ReadDirAll(ctx context.Context) (res []fuse.Dirent, err error) {
 		},
 	}
 
+	for _, name := range libfs.RootSpecialFileNames {
+		res = append(res, fuse.Dirent{Type: fuse.DT_File, Name: name})
+	}
+
 	if name := r.private.fs.remoteStatus.ExtraFileName(); name != "" {
 		res = append(res, fuse.Dirent{Type: fuse.DT_File, Name: name})
 	}
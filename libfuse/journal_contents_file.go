@@ -0,0 +1,26 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/keybase/kbfs/libfs"
+)
+
+// NewJournalContentsFile returns a special read file that contains a
+// JSON dump of the journal for that TLF.
+func NewJournalContentsFile(
+	folder *Folder, entryValid *time.Duration) *SpecialReadFile {
+	*entryValid = 0
+	return &SpecialReadFile{
+		read: func(ctx context.Context) ([]byte, time.Time, error) {
+			return libfs.GetEncodedJournalContents(
+				ctx, folder.fs.config, folder.getFolderBranch())
+		},
+	}
+}
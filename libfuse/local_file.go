@@ -0,0 +1,167 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// LocalFile represents a file that's kept local-only, because its
+// name matches an ignore file (see libkbfs.KBFSIgnoreFileName) when
+// it's created.  See libfs.LocalFile.
+type LocalFile struct {
+	folder *Folder
+	lf     *libfs.LocalFile
+}
+
+var _ fs.Node = (*LocalFile)(nil)
+
+// Attr implements the fs.Node interface for LocalFile.
+func (f *LocalFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	st := f.lf.Stat()
+	a.Valid = 1 * time.Minute
+	a.Size = st.Size
+	a.Blocks = (a.Size + 511) / 512
+	a.Mode = st.Mode
+	fillOwner(ctx, a)
+	a.Mtime = st.Mtime
+	a.Ctime = st.Ctime
+	return nil
+}
+
+var _ fs.Handle = (*LocalFile)(nil)
+
+var _ fs.HandleReader = (*LocalFile)(nil)
+
+// Read implements the fs.HandleReader interface for LocalFile.
+func (f *LocalFile) Read(ctx context.Context, req *fuse.ReadRequest,
+	resp *fuse.ReadResponse) error {
+	n, err := f.lf.Read(resp.Data[:cap(resp.Data)], req.Offset)
+	if err != nil {
+		return err
+	}
+	resp.Data = resp.Data[:n]
+	return nil
+}
+
+var _ fs.HandleWriter = (*LocalFile)(nil)
+
+// Write implements the fs.HandleWriter interface for LocalFile.
+func (f *LocalFile) Write(ctx context.Context, req *fuse.WriteRequest,
+	resp *fuse.WriteResponse) error {
+	err := f.lf.Write(req.Data, req.Offset)
+	if err != nil {
+		return err
+	}
+	resp.Size = len(req.Data)
+	return nil
+}
+
+var _ fs.NodeFsyncer = (*LocalFile)(nil)
+
+// Fsync implements the fs.NodeFsyncer interface for LocalFile.
+// There's nothing to sync, since the contents don't outlive KBFS.
+func (f *LocalFile) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	return nil
+}
+
+var _ fs.NodeSetattrer = (*LocalFile)(nil)
+
+// Setattr implements the fs.NodeSetattrer interface for LocalFile.
+func (f *LocalFile) Setattr(ctx context.Context, req *fuse.SetattrRequest,
+	resp *fuse.SetattrResponse) error {
+	valid := req.Valid
+	if valid.Size() {
+		err := f.lf.Truncate(req.Size)
+		if err != nil {
+			return err
+		}
+		valid &^= fuse.SetattrSize
+	}
+	if valid.Mode() {
+		f.lf.SetMode(req.Mode)
+		valid &^= fuse.SetattrMode
+	}
+	if valid.Mtime() {
+		f.lf.SetMtime(req.Mtime)
+		valid &^= fuse.SetattrMtime | fuse.SetattrMtimeNow
+	}
+
+	// Ownership and atime aren't kept for local-only files either.
+	valid &^= fuse.SetattrUid | fuse.SetattrGid |
+		fuse.SetattrAtime | fuse.SetattrAtimeNow
+	valid &^= fuse.SetattrLockOwner | fuse.SetattrHandle | fuse.SetattrFlags
+
+	if valid != 0 {
+		f.folder.fs.log.CInfof(ctx, "Setattr did not handle %v", valid)
+		return fuse.ENOSYS
+	}
+	return f.Attr(ctx, &resp.Attr)
+}
+
+func (f *Folder) getLocalFile(dir libkbfs.Node, name string) *LocalFile {
+	lf := f.localFiles.Get(dir, name)
+	if lf == nil {
+		return nil
+	}
+	return &LocalFile{folder: f, lf: lf}
+}
+
+func (f *Folder) rootNode(ctx context.Context) (libkbfs.Node, error) {
+	f.handleMu.RLock()
+	h := f.h
+	f.handleMu.RUnlock()
+	root, _, err := f.fs.config.KBFSOps().GetRootNode(
+		ctx, h, libkbfs.MasterBranch)
+	return root, err
+}
+
+// createLocalFile makes a new local-only file, if name is ignored in
+// dir and isn't already taken in KBFS.  It returns nil otherwise.
+func (f *Folder) createLocalFile(ctx context.Context, dir libkbfs.Node,
+	name string, mode os.FileMode) (*LocalFile, error) {
+	root, err := f.rootNode(ctx)
+	if err != nil {
+		return nil, err
+	}
+	lf, err := f.localFiles.Create(ctx, root, dir, name, mode)
+	if err != nil || lf == nil {
+		return nil, err
+	}
+	f.fs.log.CDebugf(ctx, "Keeping ignored file %s local-only", name)
+	return &LocalFile{folder: f, lf: lf}, nil
+}
+
+// renameLocalFile moves the local-only file oldName in oldDir to
+// newName in newDir, copying it into KBFS if the new name isn't
+// ignored.  It returns whether it was copied.
+func (f *Folder) renameLocalFile(ctx context.Context, lf *LocalFile,
+	oldDir libkbfs.Node, oldName string, newDir libkbfs.Node,
+	newName string) (copied bool, err error) {
+	root, err := f.rootNode(ctx)
+	if err != nil {
+		return false, err
+	}
+	copied, err = f.localFiles.Rename(
+		ctx, root, lf.lf, oldDir, oldName, newDir, newName)
+	if _, ok := err.(libfs.LocalFileOverDirError); ok {
+		return false, fuse.Errno(syscall.EISDIR)
+	} else if err != nil {
+		return false, err
+	}
+	if copied {
+		f.fs.log.CDebugf(ctx, "Copied local-only file %s into KBFS as %s",
+			oldName, newName)
+	}
+	return copied, nil
+}
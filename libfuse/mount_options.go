@@ -0,0 +1,150 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"bazil.org/fuse"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// MountOptions control which users besides the one running KBFS can
+// use the mount, and the owners and permissions it shows them.  The
+// zero value shows everything as owned by root, with KBFS's default
+// permissions, to the mounting user only.
+type MountOptions struct {
+	// AllowOther lets every user on the machine use the mount,
+	// and AllowRoot lets root use it too; at most one may be set.
+	// Unless KBFS runs as root, either one needs user_allow_other
+	// in /etc/fuse.conf.  Either one also has the kernel check
+	// permissions (default_permissions), so that other users are
+	// held to the owners and modes shown.
+	AllowOther bool
+	AllowRoot  bool
+
+	// UID and GID own everything that has no owner hint of its
+	// own (see libkbfs.EntryInfo.PosixOwner), including all of
+	// KBFS's special files and directories.
+	UID uint32
+	GID uint32
+	// UIDMap and GIDMap translate owner hints, which are the IDs
+	// on whichever of the logged-in user's devices set them, to
+	// IDs on this machine.  Unmapped hints are shown as they are.
+	UIDMap map[uint32]uint32
+	GIDMap map[uint32]uint32
+
+	// FileMode and DirMode, if non-zero, are the permissions shown
+	// for files and directories that have no mode of their own,
+	// instead of KBFS's defaults.  Executable files also get
+	// execute permission wherever FileMode grants read permission.
+	FileMode os.FileMode
+	DirMode  os.FileMode
+}
+
+// fuseOptions returns the FUSE mount options for o.
+func (o MountOptions) fuseOptions() []fuse.MountOption {
+	var options []fuse.MountOption
+	if o.AllowOther {
+		options = append(options, fuse.AllowOther())
+	}
+	if o.AllowRoot {
+		options = append(options, fuse.AllowRoot())
+	}
+	if o.AllowOther || o.AllowRoot {
+		options = append(options, fuse.DefaultPermissions())
+	}
+	return options
+}
+
+// ParseIDMap parses a comma-separated list of from:to ID pairs, like
+// "1000:1001,1002:1003", for MountOptions.UIDMap or GIDMap.
+func ParseIDMap(s string) (map[uint32]uint32, error) {
+	m := make(map[uint32]uint32)
+	if s == "" {
+		return m, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		ids := strings.Split(pair, ":")
+		if len(ids) != 2 {
+			return nil, fmt.Errorf("Bad ID mapping %q", pair)
+		}
+		from, err := strconv.ParseUint(ids[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Bad ID mapping %q: %v", pair, err)
+		}
+		to, err := strconv.ParseUint(ids[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Bad ID mapping %q: %v", pair, err)
+		}
+		m[uint32(from)] = uint32(to)
+	}
+	return m, nil
+}
+
+// mountOptionsFromContext returns the mount options of the FS serving
+// the request ctx belongs to, or the zero options if there isn't one.
+// Going through the context saves threading the FS through special
+// files that otherwise have no use for it.
+func mountOptionsFromContext(ctx context.Context) MountOptions {
+	if fs, ok := ctx.Value(CtxAppIDKey).(*FS); ok && fs != nil {
+		return fs.mountOptions
+	}
+	return MountOptions{}
+}
+
+// ownerHints returns the owner hints of ei that apply to the user
+// logged in to the FS serving ctx, if any; see
+// libkbfs.EntryInfo.PosixOwner.
+func ownerHints(ctx context.Context, ei libkbfs.EntryInfo) (
+	uid, gid int, ok bool) {
+	fs, ok := ctx.Value(CtxAppIDKey).(*FS)
+	if !ok || fs == nil || fs.config == nil {
+		return -1, -1, false
+	}
+	return libkbfs.PosixOwnerForCurrentUser(ctx, fs.config, ei)
+}
+
+// fillOwner sets the owner of a node that has no owner hints.
+func fillOwner(ctx context.Context, a *fuse.Attr) {
+	o := mountOptionsFromContext(ctx)
+	a.Uid = o.UID
+	a.Gid = o.GID
+}
+
+// dirMode returns the mode to show for a directory that has no mode
+// of its own, and would otherwise be shown with def.
+func dirMode(ctx context.Context, def os.FileMode) os.FileMode {
+	if o := mountOptionsFromContext(ctx); o.DirMode != 0 {
+		return os.ModeDir | o.DirMode.Perm()
+	}
+	return def
+}
+
+// entryMode returns the mode to show for the entry ei.
+func entryMode(ctx context.Context, ei libkbfs.EntryInfo,
+	public bool) os.FileMode {
+	if ei.Mode != nil {
+		return ei.PosixMode(public)
+	}
+	o := mountOptionsFromContext(ctx)
+	switch ei.Type {
+	case libkbfs.Dir:
+		if o.DirMode != 0 {
+			return os.ModeDir | o.DirMode.Perm()
+		}
+	case libkbfs.File, libkbfs.Exec:
+		if o.FileMode != 0 {
+			// Let PosixMode take care of the exec bits.
+			bits := uint32(o.FileMode.Perm())
+			ei.Mode = &bits
+		}
+	}
+	return ei.PosixMode(public)
+}
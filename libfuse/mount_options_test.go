@@ -0,0 +1,85 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+func TestParseIDMap(t *testing.T) {
+	m, err := ParseIDMap("1000:1001,5:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[uint32]uint32{1000: 1001, 5: 0}
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("Got %v, expected %v", m, expected)
+	}
+	for _, bad := range []string{"1000", "1000:x", "1:2:3", "-1:2"} {
+		if _, err := ParseIDMap(bad); err == nil {
+			t.Errorf("No error for %q", bad)
+		}
+	}
+}
+
+func TestMountOptionsAttrs(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	filesys := &FS{config: config, mountOptions: MountOptions{
+		UID:      1000,
+		GID:      100,
+		UIDMap:   map[uint32]uint32{501: 1001},
+		FileMode: 0640,
+		DirMode:  0750,
+	}}
+	ctx := context.WithValue(context.Background(), CtxAppIDKey, filesys)
+	_, user, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uid, gid := uint32(501), uint32(20)
+	ei := libkbfs.EntryInfo{
+		Type: libkbfs.Exec, UID: &uid, GID: &gid, OwnerUser: user}
+	var a fuse.Attr
+	fillAttr(ctx, &ei, &a)
+	if a.Uid != 1001 || a.Gid != 20 {
+		t.Errorf("Got owner %d:%d", a.Uid, a.Gid)
+	}
+	if mode := entryMode(ctx, ei, false); mode != 0750 {
+		t.Errorf("Got exec mode %v", mode)
+	}
+
+	// Another user's hints don't apply.
+	ei.OwnerUser = keybase1.MakeTestUID(1000)
+	a = fuse.Attr{}
+	fillAttr(ctx, &ei, &a)
+	if a.Uid != 1000 || a.Gid != 100 {
+		t.Errorf("Got other user's owner %d:%d", a.Uid, a.Gid)
+	}
+	ei = libkbfs.EntryInfo{Type: libkbfs.Dir}
+	a = fuse.Attr{}
+	fillAttr(ctx, &ei, &a)
+	if a.Uid != 1000 || a.Gid != 100 {
+		t.Errorf("Got default owner %d:%d", a.Uid, a.Gid)
+	}
+	if mode := entryMode(ctx, ei, false); mode != os.ModeDir|0750 {
+		t.Errorf("Got dir mode %v", mode)
+	}
+
+	// A mode of the entry's own wins.
+	own := uint32(0600)
+	ei = libkbfs.EntryInfo{Type: libkbfs.File, Mode: &own}
+	if mode := entryMode(ctx, ei, false); mode != 0600 {
+		t.Errorf("Got mode %v", mode)
+	}
+}
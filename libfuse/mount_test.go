@@ -308,8 +308,11 @@ func TestReaddirRoot(t *testing.T) {
 	defer cancelFn()
 
 	checkDir(t, mnt.Dir, map[string]fileInfoCheck{
-		PrivateName: mustBeDir,
-		PublicName:  mustBeDir,
+		PrivateName:               mustBeDir,
+		PublicName:                mustBeDir,
+		libfs.RootStatusFileName:  nil,
+		libfs.RootMetricsFileName: nil,
+		libfs.RootErrorsFileName:  nil,
 	})
 }
 
@@ -1370,6 +1373,194 @@ func TestTruncateGrow(t *testing.T) {
 	}
 }
 
+func TestWritePastEOFLeavesHole(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	mnt, _, cancelFn := makeFS(t, config)
+	defer mnt.Close()
+	defer cancelFn()
+
+	p := path.Join(mnt.Dir, PrivateName, "jdoe", "myfile")
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	const input = "hello, world\n"
+	const holeSize = 4 * 1024 * 1024
+	if _, err := f.WriteAt([]byte(input), holeSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Lstat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := fi.Size(), int64(holeSize+len(input)); g != e {
+		t.Errorf("wrong size: %v != %v", g, e)
+	}
+	// Only the block with the data counts.
+	if g := fi.Sys().(*syscall.Stat_t).Blocks; g*512 >= holeSize {
+		t.Errorf("hole counted towards blocks: %d", g)
+	}
+
+	buf := make([]byte, len(input))
+	if _, err := f.ReadAt(buf, holeSize-int64(len(input))); err != nil {
+		t.Fatal(err)
+	}
+	if g, e := string(buf), strings.Repeat("\x00", len(input)); g != e {
+		t.Errorf("read wrong content from hole: %q != %q", g, e)
+	}
+}
+
+func TestIgnoredFileStaysLocal(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	tempdir, err := ioutil.TempDir(os.TempDir(), "local_files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempdir)
+	err = config.EnableLocalFileStore(
+		tempdir, libkbfs.LocalFilesLimitBytesDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mnt, _, cancelFn := makeFS(t, config)
+	defer mnt.Close()
+	defer cancelFn()
+
+	dir := path.Join(mnt.Dir, PrivateName, "jdoe")
+	if err := ioutil.WriteFile(path.Join(dir, libkbfs.KBFSIgnoreFileName),
+		[]byte("*.swp\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	const input = "hello, world\n"
+	p := path.Join(dir, "myfile.swp")
+	if err := ioutil.WriteFile(p, []byte(input), 0644); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := string(buf), input; g != e {
+		t.Errorf("wrong content: %q != %q", g, e)
+	}
+	checkDir(t, dir, map[string]fileInfoCheck{
+		libkbfs.KBFSIgnoreFileName: nil,
+		"myfile.swp": func(fi os.FileInfo) error {
+			return mustBeFileWithSize(fi, int64(len(input)))
+		},
+	})
+
+	ctx := libkbfs.BackgroundContextWithCancellationDelayer()
+	defer libkbfs.CleanupCancellationDelayer(ctx)
+	jdoe := libkbfs.GetRootNodeOrBust(t, config, "jdoe", false)
+	ops := config.KBFSOps()
+	children, err := ops.GetDirChildren(ctx, jdoe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := children["myfile.swp"]; ok {
+		t.Errorf("ignored file was synced")
+	}
+	ignored, err := libkbfs.IsPathIgnored(ctx, ops, jdoe, "myfile.swp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ignored {
+		t.Errorf("myfile.swp not reported as ignored")
+	}
+
+	// Renaming to a name that isn't ignored syncs it.
+	p2 := path.Join(dir, "myfile")
+	if err := os.Rename(p, p2); err != nil {
+		t.Fatal(err)
+	}
+	children, err = ops.GetDirChildren(ctx, jdoe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := children["myfile"]; !ok {
+		t.Errorf("renamed file was not synced")
+	}
+	checkDir(t, dir, map[string]fileInfoCheck{
+		libkbfs.KBFSIgnoreFileName: nil,
+		"myfile": func(fi os.FileInfo) error {
+			return mustBeFileWithSize(fi, int64(len(input)))
+		},
+	})
+
+	// Removing an ignored file never touches KBFS.
+	p3 := path.Join(dir, "other.swp")
+	if err := ioutil.WriteFile(p3, []byte(input), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(p3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(p3); !os.IsNotExist(err) {
+		t.Errorf("removed file still exists: %v", err)
+	}
+}
+
+func TestHardLink(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	mnt, _, cancelFn := makeFS(t, config)
+	defer mnt.Close()
+	defer cancelFn()
+
+	dir := path.Join(mnt.Dir, PrivateName, "jdoe")
+	p := path.Join(dir, "myfile")
+	if err := ioutil.WriteFile(p, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := path.Join(dir, "mylink")
+	if err := os.Link(p, link); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := fi.Sys().(*syscall.Stat_t).Nlink, uint64(2); uint64(g) != e {
+		t.Errorf("wrong link count: %d != %d", g, e)
+	}
+
+	const input = "hello, world\n"
+	if err := ioutil.WriteFile(link, []byte(input), 0644); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := string(buf), input; g != e {
+		t.Errorf("wrong content: %q != %q", g, e)
+	}
+
+	if err := os.Remove(p); err != nil {
+		t.Fatal(err)
+	}
+	fi, err = os.Stat(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := fi.Sys().(*syscall.Stat_t).Nlink, uint64(1); uint64(g) != e {
+		t.Errorf("wrong link count: %d != %d", g, e)
+	}
+	checkDir(t, dir, map[string]fileInfoCheck{
+		"mylink": func(fi os.FileInfo) error {
+			return mustBeFileWithSize(fi, int64(len(input)))
+		},
+	})
+}
+
 func TestTruncateShrink(t *testing.T) {
 	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
 	defer libkbfs.CheckConfigAndShutdown(t, config)
@@ -1452,12 +1643,50 @@ func TestChmodNonExec(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if g, e := fi.Mode().String(), `-rw-r--r--`; g != e {
+	if g, e := fi.Mode().String(), `-rw-r-xr-x`; g != e {
 		t.Errorf("wrong mode: %q != %q", g, e)
 	}
 }
 
-func TestChownFileIgnored(t *testing.T) {
+func TestChmodSecret(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	mnt, _, cancelFn := makeFS(t, config)
+	defer mnt.Close()
+	defer cancelFn()
+
+	p := path.Join(mnt.Dir, PrivateName, "jdoe", "myfile")
+	const input = "hello, world\n"
+	if err := ioutil.WriteFile(p, []byte(input), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chmod(p, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Lstat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := fi.Mode().String(), `-rw-------`; g != e {
+		t.Errorf("wrong mode: %q != %q", g, e)
+	}
+
+	// Making it executable only adds exec bits for the user.
+	if err := os.Chmod(p, 0700); err != nil {
+		t.Fatal(err)
+	}
+	fi, err = os.Lstat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := fi.Mode().String(), `-rwx------`; g != e {
+		t.Errorf("wrong mode: %q != %q", g, e)
+	}
+}
+
+func TestChownFile(t *testing.T) {
 	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
 	defer libkbfs.CheckConfigAndShutdown(t, config)
 	mnt, _, cancelFn := makeFS(t, config)
@@ -1477,8 +1706,7 @@ func TestChownFileIgnored(t *testing.T) {
 	oldOwner := int(fi.Sys().(*syscall.Stat_t).Uid)
 
 	if err := os.Chown(p, oldOwner+1, oldOwner+1); err != nil {
-		t.Fatalf("Expecting the file chown to get swallowed silently, "+
-			"but got: %v", err)
+		t.Fatalf("File chown failed: %v", err)
 	}
 
 	newFi, err := os.Lstat(p)
@@ -1486,12 +1714,12 @@ func TestChownFileIgnored(t *testing.T) {
 		t.Fatal(err)
 	}
 	newOwner := int(newFi.Sys().(*syscall.Stat_t).Uid)
-	if oldOwner != newOwner {
-		t.Fatalf("Owner changed unexpectedly to %d after a chown", newOwner)
+	if newOwner != oldOwner+1 {
+		t.Fatalf("Owner is %d after a chown to %d", newOwner, oldOwner+1)
 	}
 }
 
-func TestChmodDirIgnored(t *testing.T) {
+func TestChmodDir(t *testing.T) {
 	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
 	defer libkbfs.CheckConfigAndShutdown(t, config)
 	mnt, _, cancelFn := makeFS(t, config)
@@ -1504,12 +1732,19 @@ func TestChmodDirIgnored(t *testing.T) {
 	}
 
 	if err := os.Chmod(p, 0655); err != nil {
-		t.Fatalf("Expecting the dir chmod to get swallowed silently, "+
-			"but got: %v", err)
+		t.Fatalf("Dir chmod failed: %v", err)
+	}
+
+	fi, err := os.Lstat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := fi.Mode().String(), `drw-r-xr-x`; g != e {
+		t.Errorf("wrong mode: %q != %q", g, e)
 	}
 }
 
-func TestChownDirIgnored(t *testing.T) {
+func TestChownDir(t *testing.T) {
 	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
 	defer libkbfs.CheckConfigAndShutdown(t, config)
 	mnt, _, cancelFn := makeFS(t, config)
@@ -1527,9 +1762,8 @@ func TestChownDirIgnored(t *testing.T) {
 	}
 	oldOwner := int(fi.Sys().(*syscall.Stat_t).Uid)
 
-	if err := os.Chown(p, 1, 1); err != nil {
-		t.Fatalf("Expecting the dir chown to get swallowed silently, "+
-			"but got: %v", err)
+	if err := os.Chown(p, oldOwner+1, -1); err != nil {
+		t.Fatalf("Dir chown failed: %v", err)
 	}
 
 	newFi, err := os.Lstat(p)
@@ -1537,8 +1771,8 @@ func TestChownDirIgnored(t *testing.T) {
 		t.Fatal(err)
 	}
 	newOwner := int(newFi.Sys().(*syscall.Stat_t).Uid)
-	if oldOwner != newOwner {
-		t.Fatalf("Owner changed unexpectedly to %d after a chown", newOwner)
+	if newOwner != oldOwner+1 {
+		t.Fatalf("Owner is %d after a chown to %d", newOwner, oldOwner+1)
 	}
 }
 
@@ -25,16 +25,19 @@ type Mounter interface {
 type DefaultMounter struct {
 	dir            string
 	platformParams PlatformParams
+	mountOptions   MountOptions
 }
 
 // NewDefaultMounter creates a default mounter.
-func NewDefaultMounter(dir string, platformParams PlatformParams) DefaultMounter {
-	return DefaultMounter{dir: dir, platformParams: platformParams}
+func NewDefaultMounter(dir string, platformParams PlatformParams,
+	mountOptions MountOptions) DefaultMounter {
+	return DefaultMounter{dir: dir, platformParams: platformParams,
+		mountOptions: mountOptions}
 }
 
 // Mount uses default mount
 func (m DefaultMounter) Mount() (*fuse.Conn, error) {
-	return fuseMountDir(m.dir, m.platformParams)
+	return fuseMountDir(m.dir, m.platformParams, m.mountOptions)
 }
 
 // Unmount uses default unmount
@@ -51,16 +54,19 @@ func (m DefaultMounter) Dir() string {
 type ForceMounter struct {
 	dir            string
 	platformParams PlatformParams
+	mountOptions   MountOptions
 }
 
 // NewForceMounter creates a force mounter.
-func NewForceMounter(dir string, platformParams PlatformParams) ForceMounter {
-	return ForceMounter{dir: dir, platformParams: platformParams}
+func NewForceMounter(dir string, platformParams PlatformParams,
+	mountOptions MountOptions) ForceMounter {
+	return ForceMounter{dir: dir, platformParams: platformParams,
+		mountOptions: mountOptions}
 }
 
 // Mount tries to mount and then unmount, re-mount if unsuccessful
 func (m ForceMounter) Mount() (*fuse.Conn, error) {
-	c, err := fuseMountDir(m.dir, m.platformParams)
+	c, err := fuseMountDir(m.dir, m.platformParams, m.mountOptions)
 	if err == nil {
 		return c, nil
 	}
@@ -69,7 +75,7 @@ func (m ForceMounter) Mount() (*fuse.Conn, error) {
 	// if unmounting errors here.
 	m.Unmount()
 
-	c, err = fuseMountDir(m.dir, m.platformParams)
+	c, err = fuseMountDir(m.dir, m.platformParams, m.mountOptions)
 	return c, err
 }
 
@@ -100,11 +106,13 @@ func (m ForceMounter) Dir() string {
 	return m.dir
 }
 
-func fuseMountDir(dir string, platformParams PlatformParams) (*fuse.Conn, error) {
+func fuseMountDir(dir string, platformParams PlatformParams,
+	mountOptions MountOptions) (*fuse.Conn, error) {
 	options, err := getPlatformSpecificMountOptions(dir, platformParams)
 	if err != nil {
 		return nil, err
 	}
+	options = append(options, mountOptions.fuseOptions()...)
 	c, err := fuse.Mount(dir, options...)
 	if err != nil {
 		err = translatePlatformSpecificError(err, platformParams)
@@ -0,0 +1,54 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"strings"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// NetworkStateFile represents a write-only file where writing the
+// name of a network state, like "metered", tells KBFS it's on that
+// kind of network.  It can be reached from any directory under the
+// FUSE mountpoint.
+type NetworkStateFile struct {
+	fs *FS
+}
+
+var _ fs.Node = (*NetworkStateFile)(nil)
+
+// Attr implements the fs.Node interface for NetworkStateFile.
+func (f *NetworkStateFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Size = 0
+	a.Mode = 0222
+	fillOwner(ctx, a)
+	return nil
+}
+
+var _ fs.Handle = (*NetworkStateFile)(nil)
+
+var _ fs.HandleWriter = (*NetworkStateFile)(nil)
+
+// Write implements the fs.HandleWriter interface for NetworkStateFile.
+func (f *NetworkStateFile) Write(ctx context.Context, req *fuse.WriteRequest,
+	resp *fuse.WriteResponse) (err error) {
+	f.fs.log.CDebugf(ctx, "NetworkStateFile Write")
+	defer func() { f.fs.reportErr(ctx, libkbfs.WriteMode, err) }()
+	if len(req.Data) == 0 {
+		return nil
+	}
+	state, err := libkbfs.ParseNetworkState(
+		strings.TrimSpace(string(req.Data)))
+	if err != nil {
+		return err
+	}
+	f.fs.config.SetNetworkState(state)
+	resp.Size = len(req.Data)
+	return nil
+}
@@ -0,0 +1,48 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// OfflineControlFile represents a write-only file where any write of
+// at least one byte puts KBFS in or out of offline mode.  It can be
+// reached from any directory under the FUSE mountpoint.
+type OfflineControlFile struct {
+	fs      *FS
+	offline bool
+}
+
+var _ fs.Node = (*OfflineControlFile)(nil)
+
+// Attr implements the fs.Node interface for OfflineControlFile.
+func (f *OfflineControlFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Size = 0
+	a.Mode = 0222
+	fillOwner(ctx, a)
+	return nil
+}
+
+var _ fs.Handle = (*OfflineControlFile)(nil)
+
+var _ fs.HandleWriter = (*OfflineControlFile)(nil)
+
+// Write implements the fs.HandleWriter interface for OfflineControlFile.
+func (f *OfflineControlFile) Write(ctx context.Context, req *fuse.WriteRequest,
+	resp *fuse.WriteResponse) (err error) {
+	f.fs.log.CDebugf(ctx, "OfflineControlFile (offline: %t) Write",
+		f.offline)
+	defer func() { f.fs.reportErr(ctx, libkbfs.WriteMode, err) }()
+	if len(req.Data) == 0 {
+		return nil
+	}
+	f.fs.config.SetOffline(f.offline)
+	resp.Size = len(req.Data)
+	return nil
+}
@@ -23,8 +23,9 @@ type ProfileList struct{}
 var _ fs.Node = ProfileList{}
 
 // Attr implements the fs.Node interface.
-func (ProfileList) Attr(_ context.Context, a *fuse.Attr) error {
-	a.Mode = os.ModeDir | 0755
+func (ProfileList) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = dirMode(ctx, os.ModeDir|0755)
+	fillOwner(ctx, a)
 	return nil
 }
 
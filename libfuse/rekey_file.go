@@ -23,6 +23,7 @@ var _ fs.Node = (*RekeyFile)(nil)
 func (f *RekeyFile) Attr(ctx context.Context, a *fuse.Attr) error {
 	a.Size = 0
 	a.Mode = 0222
+	fillOwner(ctx, a)
 	return nil
 }
 
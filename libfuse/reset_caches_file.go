@@ -28,6 +28,7 @@ var _ fs.Node = (*ResetCachesFile)(nil)
 func (f *ResetCachesFile) Attr(ctx context.Context, a *fuse.Attr) error {
 	a.Size = 0
 	a.Mode = 0222
+	fillOwner(ctx, a)
 	return nil
 }
 
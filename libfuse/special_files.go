@@ -21,10 +21,24 @@ func handleCommonSpecialFile(
 		return NewErrorFile(fs, entryValid)
 	case libfs.MetricsFileName:
 		return NewMetricsFile(fs, entryValid)
+	case libfs.SlowOpsFileName:
+		return NewSlowOpsFile(fs, entryValid)
+	case libfs.HealthFileName:
+		return NewHealthFile(fs, entryValid)
+	case libfs.UsageFileName:
+		return NewUsageFile(fs, entryValid)
 	case libfs.ProfileListDirName:
 		return ProfileList{}
 	case libfs.ResetCachesFileName:
 		return &ResetCachesFile{fs}
+	case libfs.EnableOfflineFileName:
+		return &OfflineControlFile{fs: fs, offline: true}
+	case libfs.DisableOfflineFileName:
+		return &OfflineControlFile{fs: fs}
+	case libfs.NetworkStateFileName:
+		return &NetworkStateFile{fs}
+	case libfs.BlockParallelismFileName:
+		return &BlockParallelismFile{fs}
 	}
 
 	return nil
@@ -68,6 +82,15 @@ func handleTLFSpecialFile(
 	case libfs.EditHistoryName:
 		return NewTlfEditHistoryFile(folder, entryValid)
 
+	case libfs.JournalContentsFileName:
+		return NewJournalContentsFile(folder, entryValid)
+
+	case libfs.ArchivedDirName:
+		return &ArchivedDir{folder: folder}
+
+	case libfs.UnmergedDirName:
+		return &UnmergedDir{folder: folder}
+
 	case libfs.UnstageFileName:
 		return &UnstageFile{
 			folder: folder,
@@ -84,6 +107,32 @@ func handleTLFSpecialFile(
 			enable: true,
 		}
 
+	case libfs.PauseWritesFileName:
+		return &WritesControlFile{
+			folder: folder,
+		}
+
+	case libfs.ResumeWritesFileName:
+		return &WritesControlFile{
+			folder: folder,
+			resume: true,
+		}
+
+	case libfs.SyncDurabilityFileName:
+		return &SyncDurabilityFile{
+			folder: folder,
+		}
+
+	case libfs.BlockCompressionFileName:
+		return &BlockCompressionFile{
+			folder: folder,
+		}
+
+	case libfs.BlockChunkingFileName:
+		return &BlockChunkingFile{
+			folder: folder,
+		}
+
 	case libfs.RekeyFileName:
 		return &RekeyFile{
 			folder: folder,
@@ -132,6 +181,36 @@ func handleTLFSpecialFile(
 			folder: folder,
 			action: libfs.JournalDisable,
 		}
+
+	case libfs.EnableManualCRFileName:
+		return &ConflictControlFile{
+			folder: folder,
+			action: libfs.ConflictEnableManual,
+		}
+
+	case libfs.DisableManualCRFileName:
+		return &ConflictControlFile{
+			folder: folder,
+			action: libfs.ConflictDisableManual,
+		}
+
+	case libfs.ResolveMergedFileName:
+		return &ConflictControlFile{
+			folder: folder,
+			action: libfs.ConflictResolveMerged,
+		}
+
+	case libfs.ResolveKeepLocalFileName:
+		return &ConflictControlFile{
+			folder: folder,
+			action: libfs.ConflictResolveKeepLocal,
+		}
+
+	case libfs.ResolveKeepRemoteFileName:
+		return &ConflictControlFile{
+			folder: folder,
+			action: libfs.ConflictResolveKeepRemote,
+		}
 	}
 	return nil
 }
@@ -37,6 +37,7 @@ func (f *SpecialReadFile) Attr(ctx context.Context, a *fuse.Attr) error {
 	a.Mtime = t
 	a.Ctime = t
 	a.Mode = 0444
+	fillOwner(ctx, a)
 	return nil
 }
 
@@ -9,7 +9,9 @@ import (
 	"path"
 
 	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/kbfs/libdebugserver"
 	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libhttpserver"
 	"github.com/keybase/kbfs/libkbfs"
 	"golang.org/x/net/context"
 )
@@ -19,6 +21,18 @@ type StartOptions struct {
 	KbfsParams libkbfs.InitParams
 	RuntimeDir string
 	Label      string
+	// Subdir, if set, mounts just the given directory (such as
+	// "private/alice/project") instead of the whole of KBFS.
+	Subdir string
+	// HTTPListenAddr, if set, is the TCP address to serve public
+	// folders on over HTTP, read-only, alongside the mount.
+	HTTPListenAddr string
+	// DebugListenAddr, if set, is the loopback TCP address to
+	// serve profiles and diagnostics on over HTTP.
+	DebugListenAddr string
+	// MountOptions must match the ones the mounter was created
+	// with.
+	MountOptions MountOptions
 }
 
 // Start the filesystem
@@ -73,9 +87,30 @@ func Start(mounter Mounter, options StartOptions, kbCtx libkbfs.Context) *libfs.
 
 	log.Debug("Creating filesystem")
 	fs := NewFS(config, c, options.KbfsParams.Debug)
+	fs.subdir = options.Subdir
+	fs.mountOptions = options.MountOptions
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	ctx = context.WithValue(ctx, CtxAppIDKey, fs)
+	if options.HTTPListenAddr != "" {
+		go func() {
+			err := libhttpserver.New(config).ListenAndServe(
+				ctx, options.HTTPListenAddr)
+			if err != nil {
+				log.Warning("Couldn't serve public folders over HTTP: %v",
+					err)
+			}
+		}()
+	}
+	if options.DebugListenAddr != "" {
+		go func() {
+			err := libdebugserver.New(config).ListenAndServe(
+				ctx, options.DebugListenAddr)
+			if err != nil {
+				log.Warning("Couldn't serve debug info over HTTP: %v", err)
+			}
+		}()
+	}
 	log.Debug("Serving filesystem")
 	fs.Serve(ctx)
 
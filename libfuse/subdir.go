@@ -0,0 +1,71 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"fmt"
+	"strings"
+
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// subdirRoot returns the root node of a mount that only shows
+// f.subdir.  It is a plain Dir, so everything under it works just as
+// in a full mount, and the kernel won't let lookups escape above it.
+func (f *FS) subdirRoot(ctx context.Context) (fs.Node, error) {
+	parts := strings.SplitN(strings.Trim(f.subdir, "/"), "/", 3)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("Subdirectory %q doesn't name a folder",
+			f.subdir)
+	}
+	var public bool
+	switch parts[0] {
+	case PrivateName:
+	case PublicName:
+		public = true
+	default:
+		return nil, libkbfs.NoSuchFolderListError{
+			Name:     parts[0],
+			PrivName: PrivateName,
+			PubName:  PublicName,
+		}
+	}
+	var subdir string
+	if len(parts) == 3 {
+		subdir = parts[2]
+	}
+
+	h, err := libkbfs.ParseTlfHandle(ctx, f.config.KBPKI(), parts[1], public)
+	if err != nil {
+		return nil, err
+	}
+	rootNode, _, err := f.config.KBFSOps().GetOrCreateRootNode(
+		ctx, h, libkbfs.MasterBranch)
+	if err != nil {
+		return nil, err
+	}
+	view, err := libkbfs.NewSubdirView(ctx, f.config, rootNode, subdir)
+	if err != nil {
+		return nil, err
+	}
+
+	fl := &FolderList{
+		fs:      f,
+		public:  public,
+		folders: make(map[string]*TLF),
+	}
+	folder := newFolder(fl, h)
+	err = folder.setFolderBranch(view.FolderBranch())
+	if err != nil {
+		return nil, err
+	}
+	dir := newDir(folder, view.Root())
+	folder.nodesMu.Lock()
+	defer folder.nodesMu.Unlock()
+	folder.nodes[view.Root().GetID()] = dir
+	return dir, nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// SyncControlFile represents a write-only file where any write of at
+// least one byte subscribes the directory it's in to be synced to
+// local disk, or unsubscribes it.
+type SyncControlFile struct {
+	folder     *Folder
+	node       libkbfs.Node
+	subscribed bool
+}
+
+var _ fs.Node = (*SyncControlFile)(nil)
+
+// Attr implements the fs.Node interface for SyncControlFile.
+func (f *SyncControlFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Size = 0
+	a.Mode = 0222
+	fillOwner(ctx, a)
+	return nil
+}
+
+var _ fs.Handle = (*SyncControlFile)(nil)
+
+var _ fs.HandleWriter = (*SyncControlFile)(nil)
+
+// Write implements the fs.HandleWriter interface for SyncControlFile.
+func (f *SyncControlFile) Write(ctx context.Context, req *fuse.WriteRequest,
+	resp *fuse.WriteResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "SyncControlFile (subscribed: %t) Write",
+		f.subscribed)
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	if len(req.Data) == 0 {
+		return nil
+	}
+	err = f.folder.fs.config.KBFSOps().SetSyncSubscription(
+		ctx, f.node, f.subscribed)
+	if err != nil {
+		return err
+	}
+	resp.Size = len(req.Data)
+	return nil
+}
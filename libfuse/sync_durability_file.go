@@ -0,0 +1,59 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"strings"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// SyncDurabilityFile represents a write-only file where writing
+// "local" or "server" sets how durable syncs make writes to the
+// folder.
+type SyncDurabilityFile struct {
+	folder *Folder
+}
+
+var _ fs.Node = (*SyncDurabilityFile)(nil)
+
+// Attr implements the fs.Node interface for SyncDurabilityFile.
+func (f *SyncDurabilityFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Size = 0
+	a.Mode = 0222
+	fillOwner(ctx, a)
+	return nil
+}
+
+var _ fs.Handle = (*SyncDurabilityFile)(nil)
+
+var _ fs.HandleWriter = (*SyncDurabilityFile)(nil)
+
+// Write implements the fs.HandleWriter interface for SyncDurabilityFile.
+func (f *SyncDurabilityFile) Write(ctx context.Context, req *fuse.WriteRequest,
+	resp *fuse.WriteResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "SyncDurabilityFile Write")
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	if len(req.Data) == 0 {
+		return nil
+	}
+
+	durability, err := libkbfs.ParseWriteDurability(
+		strings.TrimSpace(string(req.Data)))
+	if err != nil {
+		return err
+	}
+	err = f.folder.fs.config.KBFSOps().SetSyncDurability(
+		ctx, f.folder.getFolderBranch(), durability)
+	if err != nil {
+		return err
+	}
+
+	resp.Size = len(req.Data)
+	return nil
+}
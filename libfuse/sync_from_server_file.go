@@ -32,6 +32,7 @@ var _ fs.Node = (*SyncFromServerFile)(nil)
 func (f *SyncFromServerFile) Attr(ctx context.Context, a *fuse.Attr) error {
 	a.Size = 0
 	a.Mode = 0222
+	fillOwner(ctx, a)
 	return nil
 }
 
@@ -140,6 +140,8 @@ func (tlf *TLF) Attr(ctx context.Context, a *fuse.Attr) error {
 		if tlf.isPublic() {
 			a.Mode |= 0055
 		}
+		a.Mode = dirMode(ctx, a.Mode)
+		fillOwner(ctx, a)
 		return nil
 	}
 
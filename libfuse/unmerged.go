@@ -0,0 +1,79 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"os"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// UnmergedDir is the libfs.UnmergedDirName directory of a folder.
+// While the folder is on an unmerged branch, it lists "local" and
+// "remote", read-only views of the two sides of the conflict.
+type UnmergedDir struct {
+	folder *Folder
+}
+
+var _ fs.Node = (*UnmergedDir)(nil)
+
+// Attr implements the fs.Node interface for UnmergedDir.
+func (d *UnmergedDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0555
+	fillOwner(ctx, a)
+	return nil
+}
+
+var _ fs.NodeRequestLookuper = (*UnmergedDir)(nil)
+
+// Lookup implements the fs.NodeRequestLookuper interface for
+// UnmergedDir.
+func (d *UnmergedDir) Lookup(ctx context.Context, req *fuse.LookupRequest,
+	resp *fuse.LookupResponse) (node fs.Node, err error) {
+	d.folder.fs.log.CDebugf(ctx, "UnmergedDir Lookup %s", req.Name)
+	defer func() { d.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	snap, err := libfs.BeginUnmergedSnapshot(ctx, d.folder.fs.config,
+		d.folder.getFolderBranch(), req.Name)
+	if err != nil {
+		if _, ok := err.(libkbfs.NoSuchNameError); ok {
+			return nil, fuse.ENOENT
+		}
+		return nil, err
+	}
+	// The sides change as the conflict does, so don't let the
+	// kernel hold on to them.
+	resp.EntryValid = 0
+	return &ArchivedEntry{
+		folder: d.folder,
+		snap:   &archivedSnapshot{snap: snap},
+	}, nil
+}
+
+var _ fs.Handle = (*UnmergedDir)(nil)
+
+var _ fs.HandleReadDirAller = (*UnmergedDir)(nil)
+
+// ReadDirAll implements the fs.HandleReadDirAller interface for
+// UnmergedDir.
+func (d *UnmergedDir) ReadDirAll(ctx context.Context) (
+	res []fuse.Dirent, err error) {
+	d.folder.fs.log.CDebugf(ctx, "UnmergedDir ReadDirAll")
+	defer func() { d.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	names, err := libfs.UnmergedNames(ctx, d.folder.fs.config,
+		d.folder.getFolderBranch())
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		res = append(res, fuse.Dirent{Name: name, Type: fuse.DT_Dir})
+	}
+	return res, nil
+}
@@ -25,6 +25,7 @@ var _ fs.Node = (*UnstageFile)(nil)
 func (f *UnstageFile) Attr(ctx context.Context, a *fuse.Attr) error {
 	a.Size = 0
 	a.Mode = 0222
+	fillOwner(ctx, a)
 	return nil
 }
 
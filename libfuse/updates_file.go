@@ -28,6 +28,7 @@ var _ fs.Node = (*UpdatesFile)(nil)
 func (f *UpdatesFile) Attr(ctx context.Context, a *fuse.Attr) error {
 	a.Size = 0
 	a.Mode = 0222
+	fillOwner(ctx, a)
 	return nil
 }
 
@@ -0,0 +1,58 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// WritesControlFile represents a write-only file where any write of
+// at least one byte either pauses or resumes all mutating operations
+// on the folder.
+type WritesControlFile struct {
+	folder *Folder
+	resume bool
+}
+
+var _ fs.Node = (*WritesControlFile)(nil)
+
+// Attr implements the fs.Node interface for WritesControlFile.
+func (f *WritesControlFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Size = 0
+	a.Mode = 0222
+	fillOwner(ctx, a)
+	return nil
+}
+
+var _ fs.Handle = (*WritesControlFile)(nil)
+
+var _ fs.HandleWriter = (*WritesControlFile)(nil)
+
+// Write implements the fs.HandleWriter interface for WritesControlFile.
+func (f *WritesControlFile) Write(ctx context.Context, req *fuse.WriteRequest,
+	resp *fuse.WriteResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "WritesControlFile (resume: %t) Write",
+		f.resume)
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	if len(req.Data) == 0 {
+		return nil
+	}
+
+	kbfsOps := f.folder.fs.config.KBFSOps()
+	if f.resume {
+		err = kbfsOps.ResumeWrites(ctx, f.folder.getFolderBranch())
+	} else {
+		err = kbfsOps.PauseWrites(ctx, f.folder.getFolderBranch())
+	}
+	if err != nil {
+		return err
+	}
+
+	resp.Size = len(req.Data)
+	return nil
+}
@@ -0,0 +1,26 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libhttpserver
+
+const (
+	// PathPrefix is the URL path under which public top-level
+	// folders are served.  Nothing outside of it is.
+	PathPrefix = "/keybase/public/"
+
+	// IndexName is the file served in place of a directory listing,
+	// if a directory has one.
+	IndexName = "index.html"
+
+	// CtxOpID is the display name for the unique operation HTTP ID tag.
+	CtxOpID = "HID"
+)
+
+// CtxTagKey is the type used for unique context tags
+type CtxTagKey int
+
+const (
+	// CtxIDKey is the type of the tag for unique operation IDs.
+	CtxIDKey CtxTagKey = iota
+)
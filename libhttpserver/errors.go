@@ -0,0 +1,38 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libhttpserver
+
+import (
+	"net/http"
+
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+// httpError is an HTTP status to fail a request with.  Handlers can
+// return one directly when no KBFS error is involved.
+type httpError int
+
+// Error implements the error interface for httpError.
+func (e httpError) Error() string {
+	return http.StatusText(int(e))
+}
+
+// errToHTTPStatus returns the HTTP status to report for err.
+func errToHTTPStatus(err error) int {
+	switch err := err.(type) {
+	case nil:
+		return http.StatusOK
+	case httpError:
+		return int(err)
+	case libkbfs.NoSuchNameError, libkbfs.NoSuchUserError,
+		libkbfs.BadTLFNameError, libfs.TlfDoesNotExist,
+		libkbfs.NotDirError:
+		return http.StatusNotFound
+	case libkbfs.ReadAccessError, libkbfs.MDServerErrorUnauthorized:
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
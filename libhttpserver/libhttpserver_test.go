@@ -0,0 +1,141 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libhttpserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+func writeFileOrBust(t *testing.T, config libkbfs.Config, dir libkbfs.Node,
+	name, contents string) {
+	ctx := libkbfs.BackgroundContextWithCancellationDelayer()
+	defer libkbfs.CleanupCancellationDelayer(ctx)
+	kbfsOps := config.KBFSOps()
+	n, _, err := kbfsOps.CreateFile(ctx, dir, name, false, libkbfs.NoExcl)
+	if err != nil {
+		t.Fatalf("Couldn't create %s: %v", name, err)
+	}
+	if err := kbfsOps.Write(ctx, n, []byte(contents), 0); err != nil {
+		t.Fatalf("Couldn't write %s: %v", name, err)
+	}
+	if err := kbfsOps.Sync(ctx, n); err != nil {
+		t.Fatalf("Couldn't sync %s: %v", name, err)
+	}
+}
+
+func makeDirOrBust(t *testing.T, config libkbfs.Config, dir libkbfs.Node,
+	name string) libkbfs.Node {
+	ctx := libkbfs.BackgroundContextWithCancellationDelayer()
+	defer libkbfs.CleanupCancellationDelayer(ctx)
+	n, _, err := config.KBFSOps().CreateDir(ctx, dir, name)
+	if err != nil {
+		t.Fatalf("Couldn't create %s: %v", name, err)
+	}
+	return n
+}
+
+func doGet(s *Server, p string, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", p, nil)
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestServeFileWithRangeAndType(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	root := libkbfs.GetRootNodeOrBust(t, config, "jdoe", true)
+	writeFileOrBust(t, config, root, "hello.txt", "hello world")
+	s := New(config)
+
+	const p = "/keybase/public/jdoe/hello.txt"
+	w := doGet(s, p, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET: got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Got Content-Type %q", ct)
+	}
+	if body := w.Body.String(); body != "hello world" {
+		t.Errorf("GET: got %q", body)
+	}
+
+	w = doGet(s, p, map[string]string{"Range": "bytes=6-"})
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("GET range: got %d", w.Code)
+	}
+	if body, _ := ioutil.ReadAll(w.Body); string(body) != "world" {
+		t.Errorf("GET range: got %q", body)
+	}
+
+	w = doGet(s, p, map[string]string{"If-None-Match": w.Header().Get("ETag")})
+	if w.Code != http.StatusNotModified {
+		t.Errorf("Conditional GET: got %d", w.Code)
+	}
+
+	r := httptest.NewRequest("PUT", p, strings.NewReader("bye"))
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT: got %d", w.Code)
+	}
+}
+
+func TestServeDirectories(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	root := libkbfs.GetRootNodeOrBust(t, config, "jdoe", true)
+	docs := makeDirOrBust(t, config, root, "docs")
+	writeFileOrBust(t, config, docs, "a b.txt", "a")
+	site := makeDirOrBust(t, config, root, "site")
+	writeFileOrBust(t, config, site, IndexName, "<p>home</p>")
+	s := New(config)
+
+	w := doGet(s, "/keybase/public/jdoe/docs", nil)
+	if w.Code != http.StatusMovedPermanently {
+		t.Fatalf("GET without a slash: got %d", w.Code)
+	}
+	if loc := w.Header().Get("Location"); loc != "docs/" {
+		t.Errorf("Redirected to %q", loc)
+	}
+
+	w = doGet(s, "/keybase/public/jdoe/docs/", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET listing: got %d", w.Code)
+	}
+	if body := w.Body.String(); !strings.Contains(body, `href="a%20b.txt"`) {
+		t.Errorf("Listing is missing the file: %s", body)
+	}
+
+	w = doGet(s, "/keybase/public/jdoe/site/", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET index: got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("Got Content-Type %q", ct)
+	}
+	if body := w.Body.String(); body != "<p>home</p>" {
+		t.Errorf("GET index: got %q", body)
+	}
+
+	for _, p := range []string{
+		"/keybase/private/jdoe/",
+		"/keybase/public/jdoe/missing",
+		"/keybase/public/jdoe/../../private/jdoe/",
+	} {
+		if w := doGet(s, p, nil); w.Code != http.StatusNotFound {
+			t.Errorf("GET %s: got %d", p, w.Code)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libhttpserver
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// fileReader reads a KBFS file, for http.ServeContent.  Each Read
+// goes straight to KBFSOps.Read, so only the blocks a response
+// needs are ever fetched, and nothing is staged on disk.
+type fileReader struct {
+	ctx  context.Context
+	ops  libkbfs.KBFSOps
+	node libkbfs.Node
+	size int64
+	off  int64
+}
+
+var _ io.ReadSeeker = (*fileReader)(nil)
+
+func (r *fileReader) Read(p []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	n, err := r.ops.Read(r.ctx, r.node, p, r.off)
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 && len(p) > 0 {
+		return 0, io.EOF
+	}
+	r.off += n
+	return int(n), nil
+}
+
+func (r *fileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, fmt.Errorf("Bad whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("Negative offset %d", offset)
+	}
+	r.off = offset
+	return offset, nil
+}
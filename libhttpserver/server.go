@@ -0,0 +1,397 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libhttpserver
+
+import (
+	"fmt"
+	"html"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// maxSymlinkDepth bounds how many symlinks are followed to resolve a
+// single path.
+const maxSymlinkDepth = 16
+
+// entry is a resolved path under PathPrefix.
+type entry struct {
+	// path is the cleaned URL path of the entry.
+	path string
+	// node is nil for the list of public folders itself.
+	node libkbfs.Node
+	ei   libkbfs.EntryInfo
+}
+
+func (e entry) isDir() bool {
+	return e.node == nil || e.ei.Type == libkbfs.Dir
+}
+
+// Server is a read-only HTTP gateway to public top-level folders,
+// for previewing files in a browser and light static hosting.  URL
+// paths are like the paths under a KBFS mount, such as
+// "/keybase/public/alice/site/index.html".  Files are streamed from
+// KBFS as they're served, with range requests supported, and
+// directories are served as their index.html or, failing that, as a
+// generated listing.
+//
+// Server only ever serves public data, so it needs no
+// authentication of its own, and can be embedded in any process
+// that has a libkbfs.Config.
+type Server struct {
+	config libkbfs.Config
+	log    logger.Logger
+}
+
+var _ http.Handler = (*Server)(nil)
+
+// New creates a Server serving public folders as seen through
+// config.
+func New(config libkbfs.Config) *Server {
+	return &Server{
+		config: config,
+		log:    config.MakeLogger("kbfshttp"),
+	}
+}
+
+// ListenAndServe serves s on addr until ctx is canceled.
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.log.Debug("Serving public folders over HTTP on %s", l.Addr())
+	go func() {
+		<-ctx.Done()
+		// Closing the listener makes Serve return.
+		l.Close()
+	}()
+	err = (&http.Server{Handler: s}).Serve(l)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// withContext adds request-specific values to the context of an
+// HTTP request.
+func (s *Server) withContext(ctx context.Context) context.Context {
+	id, errRandomReqID := libkbfs.MakeRandomRequestID()
+	if errRandomReqID != nil {
+		s.log.Errorf("Couldn't make request ID: %v", errRandomReqID)
+	}
+
+	ctx, err := libkbfs.NewContextWithCancellationDelayer(
+		libkbfs.NewContextReplayable(ctx, func(ctx context.Context) context.Context {
+			logTags := make(logger.CtxLogTags)
+			logTags[CtxIDKey] = CtxOpID
+			ctx = logger.NewContextWithLogTags(ctx, logTags)
+
+			if errRandomReqID == nil {
+				// Add a unique ID to this context, identifying a
+				// particular request.
+				ctx = context.WithValue(ctx, CtxIDKey, id)
+			}
+			return ctx
+		}))
+	if err != nil {
+		panic(err) // this should never happen
+	}
+	return ctx
+}
+
+// ServeHTTP implements the http.Handler interface for Server.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := s.withContext(context.Background())
+	s.log.CDebugf(ctx, "%s %s", r.Method, r.URL.Path)
+
+	var err error
+	switch r.Method {
+	case "GET", "HEAD":
+		err = s.get(ctx, w, r)
+	default:
+		w.Header().Set("Allow", "GET, HEAD")
+		err = httpError(http.StatusMethodNotAllowed)
+	}
+	if err == nil {
+		return
+	}
+	if _, ok := err.(httpError); !ok {
+		s.config.Reporter().ReportErr(ctx, "", true, libkbfs.ReadMode, err)
+	}
+	// Most errors, like a lookup of a missing name, are expected.
+	s.log.CDebugf(ctx, "Error: %v", err)
+	status := errToHTTPStatus(err)
+	http.Error(w, http.StatusText(status), status)
+}
+
+func (s *Server) get(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) error {
+	e, err := s.resolve(ctx, r.URL.Path)
+	if err != nil {
+		return err
+	}
+
+	// Like http.FileServer, make sure directory URLs end in a slash
+	// and file URLs don't, so that relative links work.
+	hasSlash := strings.HasSuffix(r.URL.Path, "/")
+	if e.isDir() && !hasSlash {
+		redirect(w, r, path.Base(r.URL.Path)+"/")
+		return nil
+	} else if !e.isDir() && hasSlash {
+		redirect(w, r, "../"+path.Base(r.URL.Path))
+		return nil
+	}
+
+	if e.isDir() && e.node != nil {
+		index, err := s.lookup(ctx, e, IndexName)
+		switch errToHTTPStatus(err) {
+		case http.StatusOK:
+			if !index.isDir() {
+				e = index
+			}
+		case http.StatusNotFound:
+		default:
+			return err
+		}
+	}
+	if e.isDir() {
+		return s.listDir(ctx, w, r, e)
+	}
+	return s.serveFile(ctx, w, r, e)
+}
+
+// redirect sends the client to target, relative to the request's
+// URL, keeping the query string.
+func redirect(w http.ResponseWriter, r *http.Request, target string) {
+	if q := r.URL.RawQuery; q != "" {
+		target += "?" + q
+	}
+	w.Header().Set("Location", target)
+	w.WriteHeader(http.StatusMovedPermanently)
+}
+
+// etag returns the entity tag of the file or directory e.  It comes
+// from the pointer to the block holding the entry, which changes
+// with every change that's synced.
+func (s *Server) etag(ctx context.Context, e entry) (string, error) {
+	md, err := s.config.KBFSOps().GetNodeMetadata(ctx, e.node)
+	if err != nil {
+		return "", err
+	}
+	ptr := md.BlockInfo.BlockPointer
+	return fmt.Sprintf(`"%s-%s-%x-%x"`, ptr.ID, ptr.RefNonce, e.ei.Mtime,
+		e.ei.Size), nil
+}
+
+func (s *Server) serveFile(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, e entry) error {
+	etag, err := s.etag(ctx, e)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("ETag", etag)
+	if ct := mime.TypeByExtension(path.Ext(e.path)); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	// Otherwise ServeContent sniffs the type from the first block.
+	// It also takes care of Range, If-None-Match and
+	// If-Modified-Since.
+	http.ServeContent(w, r, path.Base(e.path), time.Unix(0, e.ei.Mtime),
+		&fileReader{ctx: ctx, ops: s.config.KBFSOps(), node: e.node,
+			size: int64(e.ei.Size)})
+	return nil
+}
+
+// listDir responds with an HTML listing of the directory dir.
+func (s *Server) listDir(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, dir entry) error {
+	if dir.node != nil {
+		etag, err := s.etag(ctx, dir)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("ETag", etag)
+		// The directory's mtime doesn't change when its children
+		// do, so only the ETag, which does, can tell whether the
+		// client's copy is current.
+		if inm := r.Header.Get("If-None-Match"); strings.Contains(inm, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return nil
+		}
+	}
+
+	entries, err := s.readDir(ctx, dir)
+	if err != nil {
+		return err
+	}
+	sort.Sort(entriesByName(entries))
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == "HEAD" {
+		return nil
+	}
+	title := html.EscapeString(dir.path)
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\">"+
+		"<title>%s</title></head><body><h1>%s</h1>\n<table>\n", title, title)
+	if dir.path+"/" != PathPrefix {
+		fmt.Fprintf(w, "<tr><td><a href=\"../\">../</a></td></tr>\n")
+	}
+	for _, e := range entries {
+		name := path.Base(e.path)
+		size := ""
+		if e.isDir() {
+			name += "/"
+		} else {
+			size = fmt.Sprintf("%d", e.ei.Size)
+		}
+		mtime := ""
+		if e.node != nil {
+			mtime = time.Unix(0, e.ei.Mtime).UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "<tr><td><a href=\"%s\">%s</a></td>"+
+			"<td align=\"right\">%s</td><td>%s</td></tr>\n",
+			(&url.URL{Path: name}).EscapedPath(), html.EscapeString(name),
+			size, mtime)
+	}
+	fmt.Fprintf(w, "</table></body></html>\n")
+	return nil
+}
+
+type entriesByName []entry
+
+func (e entriesByName) Len() int           { return len(e) }
+func (e entriesByName) Less(i, j int) bool { return e[i].path < e[j].path }
+func (e entriesByName) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+
+// resolve looks up the entry at the URL path p, following symlinks.
+func (s *Server) resolve(ctx context.Context, p string) (entry, error) {
+	return s.resolveDepth(ctx, path.Clean("/"+p), 0)
+}
+
+func (s *Server) resolveDepth(ctx context.Context, p string, depth int) (
+	entry, error) {
+	root := strings.TrimSuffix(PathPrefix, "/")
+	if p != root && !strings.HasPrefix(p, PathPrefix) {
+		return entry{}, httpError(http.StatusNotFound)
+	}
+	e := entry{path: root}
+	if p == root {
+		return e, nil
+	}
+	components := strings.Split(strings.TrimPrefix(p, PathPrefix), "/")
+	for i, name := range components {
+		var err error
+		e, err = s.lookup(ctx, e, name)
+		if err != nil {
+			return entry{}, err
+		}
+		if e.ei.Type != libkbfs.Sym {
+			continue
+		}
+
+		// Symlinks within KBFS are always relative; absolute ones
+		// point outside of it.  Relative ones that lead out of the
+		// public folders are caught on the next pass.
+		if depth >= maxSymlinkDepth || path.IsAbs(e.ei.SymPath) {
+			return entry{}, httpError(http.StatusNotFound)
+		}
+		target := path.Join(append(
+			[]string{path.Dir(e.path), e.ei.SymPath},
+			components[i+1:]...)...)
+		return s.resolveDepth(ctx, target, depth+1)
+	}
+	return e, nil
+}
+
+// lookup returns the entry called name in the directory dir,
+// without following it if it's a symlink.
+func (s *Server) lookup(ctx context.Context, dir entry, name string) (
+	entry, error) {
+	p := path.Join(dir.path, name)
+	kbfsOps := s.config.KBFSOps()
+	if dir.node == nil {
+		h, err := libkbfs.ParseTlfHandle(ctx, s.config.KBPKI(), name, true)
+		if nc, ok := err.(libkbfs.TlfNameNotCanonical); ok {
+			h, err = libkbfs.ParseTlfHandle(
+				ctx, s.config.KBPKI(), nc.NameToTry, true)
+		}
+		if err != nil {
+			return entry{}, err
+		}
+		// Never create a folder just because someone asked for it.
+		node, ei, err := kbfsOps.GetRootNode(ctx, h, libkbfs.MasterBranch)
+		if err != nil {
+			return entry{}, err
+		}
+		if node == nil {
+			return entry{}, libfs.TlfDoesNotExist{}
+		}
+		return entry{path: p, node: node, ei: ei}, nil
+	}
+
+	if !dir.isDir() {
+		return entry{}, libkbfs.NotDirError{}
+	}
+	node, ei, err := kbfsOps.Lookup(ctx, dir.node, name)
+	if err != nil {
+		return entry{}, err
+	}
+	return entry{path: p, node: node, ei: ei}, nil
+}
+
+// readDir returns the entries of the directory dir, following
+// symlinks.  Entries that can't be resolved, like dangling symlinks,
+// are left out.
+func (s *Server) readDir(ctx context.Context, dir entry) ([]entry, error) {
+	var names []string
+	if dir.node == nil {
+		if _, _, err := s.config.KBPKI().GetCurrentUserInfo(ctx); err != nil {
+			// Logged out, so there are no favorites.
+			return nil, nil
+		}
+		favs, err := s.config.KBFSOps().GetFavorites(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, fav := range favs {
+			if fav.Public {
+				names = append(names, fav.Name)
+			}
+		}
+	} else {
+		children, err := s.config.KBFSOps().GetDirChildren(ctx, dir.node)
+		if err != nil {
+			return nil, err
+		}
+		for name := range children {
+			names = append(names, name)
+		}
+	}
+
+	entries := make([]entry, 0, len(names))
+	for _, name := range names {
+		e, err := s.resolve(ctx, path.Join(dir.path, name))
+		if err != nil {
+			s.log.CDebugf(ctx, "Skipping %s in listing: %v", name, err)
+			continue
+		}
+		// Keep the name the entry was listed under, rather than
+		// what a symlink points to.
+		e.path = path.Join(dir.path, name)
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
@@ -101,7 +101,7 @@ func (a *AuthToken) SignUserless(ctx context.Context, key VerifyingKey) (
 	string, error) {
 	// Pass in a reserved, meaningless UID.
 	return a.signWithUserAndKeyInfo(ctx,
-		keybase1.ChallengeInfo{Now: time.Now().Unix()},
+		keybase1.ChallengeInfo{Now: a.config.Clock().Now().Unix()},
 		keybase1.PublicUID, "", key)
 }
 
@@ -122,13 +122,21 @@ func (a *AuthToken) startTicker(intervalSeconds int) {
 	var ctx context.Context
 	ctx, a.tickerCancel = context.WithCancel(context.Background())
 	go func() {
-		ticker := time.NewTicker(time.Duration(intervalSeconds) * time.Second)
+		interval := time.Duration(intervalSeconds) * time.Second
+		ticker := time.NewTicker(interval)
+		// The token's expiration is in wall-clock time, so it may
+		// have run out during a suspend.
+		jumpChan, unregister := a.config.ClockJumpDetector().Register()
 		for {
 			select {
 			case <-ticker.C:
 				a.refreshHandler.RefreshAuthToken(ctx)
+			case <-jumpChan:
+				a.refreshHandler.RefreshAuthToken(ctx)
+				ticker.Reset(interval)
 			case <-ctx.Done():
 				ticker.Stop()
+				unregister()
 				return
 			}
 		}
@@ -874,11 +874,8 @@ func (md *BareRootMetadataV3) FakeInitialRekey(codec Codec, h BareTlfHandle) (
 			k.kid: TLFCryptKeyInfo{},
 		}
 	}
-	buf, err := codec.Encode(wkb)
-	if err != nil {
-		return nil, err
-	}
-	md.WriterMetadata.WKeyBundleID, err = TLFWriterKeyBundleIDFromBytes(buf)
+	var err error
+	md.WriterMetadata.WKeyBundleID, err = makeTLFWriterKeyBundleID(codec, *wkb)
 	if err != nil {
 		return nil, err
 	}
@@ -893,11 +890,7 @@ func (md *BareRootMetadataV3) FakeInitialRekey(codec Codec, h BareTlfHandle) (
 			k.kid: TLFCryptKeyInfo{},
 		}
 	}
-	buf, err = codec.Encode(rkb)
-	if err != nil {
-		return nil, err
-	}
-	md.RKeyBundleID, err = TLFReaderKeyBundleIDFromBytes(buf)
+	md.RKeyBundleID, err = makeTLFReaderKeyBundleID(codec, *rkb)
 	if err != nil {
 		return nil, err
 	}
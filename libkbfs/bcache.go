@@ -34,6 +34,21 @@ type BlockCacheStandard struct {
 	cleanTotalBytes uint64
 }
 
+// BlockCacheStatus summarizes what's in a BlockCacheStandard.  It is
+// suitable for encoding directly as JSON.
+type BlockCacheStatus struct {
+	TransientBlocks    int
+	PermanentBlocks    int
+	CleanBytes         uint64
+	CleanBytesCapacity uint64
+	// KnownPtrs is how many file blocks can be found by their
+	// contents, for CheckForKnownPtr.
+	KnownPtrs int
+	// TransientByType counts the transient blocks by their Go
+	// type, e.g. "*libkbfs.FileBlock".
+	TransientByType map[string]int `json:",omitempty"`
+}
+
 // NewBlockCacheStandard constructs a new BlockCacheStandard instance
 // with the given transient capacity (in number of entries) and the
 // clean bytes capacity, which is the total of number of bytes allowed
@@ -113,6 +128,34 @@ func (b *BlockCacheStandard) onEvict(key interface{}, value interface{}) {
 	b.cleanTotalBytes -= uint64(getCachedBlockSize(block))
 }
 
+// Status returns a summary of the contents of the cache, suitable for
+// diagnostics.
+func (b *BlockCacheStandard) Status() BlockCacheStatus {
+	status := BlockCacheStatus{CleanBytesCapacity: b.cleanBytesCapacity}
+	if b.cleanTransient != nil {
+		status.TransientByType = make(map[string]int)
+		for _, key := range b.cleanTransient.Keys() {
+			// Peek doesn't count as a use of the block.
+			if block, ok := b.cleanTransient.Peek(key); ok {
+				status.TransientByType[fmt.Sprintf("%T", block)]++
+				status.TransientBlocks++
+			}
+		}
+	}
+	if b.ids != nil {
+		status.KnownPtrs = b.ids.Len()
+	}
+	func() {
+		b.cleanLock.RLock()
+		defer b.cleanLock.RUnlock()
+		status.PermanentBlocks = len(b.cleanPermanent)
+	}()
+	b.bytesLock.Lock()
+	defer b.bytesLock.Unlock()
+	status.CleanBytes = b.cleanTotalBytes
+	return status
+}
+
 // CheckForKnownPtr implements the BlockCache interface for BlockCacheStandard.
 func (b *BlockCacheStandard) CheckForKnownPtr(tlf TlfID, block *FileBlock) (
 	BlockPointer, error) {
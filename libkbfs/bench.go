@@ -0,0 +1,451 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// The benchmarks below cover the core I/O paths of KBFSOps: reads
+// and writes at a few sizes, creating many entries in one directory,
+// and Sync with and without a journal.  The same cases run as Go
+// benchmarks in the tests, against in-memory servers, and from
+// "kbfstool bench", against whatever servers a config talks to, so
+// numbers from both can be compared with the usual benchmark tools.
+
+// benchFileSize is the size of the file the read and write
+// benchmarks work within.
+const benchFileSize = 8 << 20
+
+// BenchTimer controls which parts of a benchmark are timed.
+// *testing.B implements it.
+type BenchTimer interface {
+	StartTimer()
+	StopTimer()
+	ResetTimer()
+}
+
+// benchOp does the ith operation of a benchmark.
+type benchOp func(ctx context.Context, i int) error
+
+type benchCase struct {
+	name string
+	// bytes is the number of bytes each operation reads or
+	// writes, if any.
+	bytes int64
+	// journal, if non-nil, says whether the benchmark needs the
+	// TLF's journal on or off.
+	journal *bool
+	// setup prepares a benchmark in dir, an empty directory, and
+	// returns its operation and an optional function to call,
+	// timed, once all the operations are done.
+	setup func(ctx context.Context, kbfsOps KBFSOps, dir Node) (
+		op benchOp, finish func(context.Context) error, err error)
+}
+
+func benchSizeName(n int64) string {
+	if n >= 1<<10 {
+		return fmt.Sprintf("%dk", n>>10)
+	}
+	return fmt.Sprintf("%d", n)
+}
+
+// benchData returns n bytes that don't compress or dedup well.
+func benchData(n int64) []byte {
+	buf := make([]byte, n)
+	rand.New(rand.NewSource(n)).Read(buf)
+	return buf
+}
+
+// benchOffset returns the offset of the ith n-byte operation in a
+// file of benchFileSize bytes, sequential or random.
+func benchOffset(r *rand.Rand, i int, n int64) int64 {
+	slots := benchFileSize / n
+	if r != nil {
+		return r.Int63n(slots) * n
+	}
+	return (int64(i) % slots) * n
+}
+
+func benchWriteCase(n int64, random bool) benchCase {
+	kind := "Seq"
+	if random {
+		kind = "Rand"
+	}
+	return benchCase{
+		name:  "Write" + kind + benchSizeName(n),
+		bytes: n,
+		setup: func(ctx context.Context, kbfsOps KBFSOps, dir Node) (
+			benchOp, func(context.Context) error, error) {
+			file, _, err := kbfsOps.CreateFile(ctx, dir, "f", false, NoExcl)
+			if err != nil {
+				return nil, nil, err
+			}
+			var r *rand.Rand
+			if random {
+				r = rand.New(rand.NewSource(1))
+			}
+			buf := benchData(n)
+			op := func(ctx context.Context, i int) error {
+				return kbfsOps.Write(ctx, file, buf, benchOffset(r, i, n))
+			}
+			finish := func(ctx context.Context) error {
+				return kbfsOps.Sync(ctx, file)
+			}
+			return op, finish, nil
+		},
+	}
+}
+
+func benchReadCase(n int64, random bool) benchCase {
+	kind := "Seq"
+	if random {
+		kind = "Rand"
+	}
+	return benchCase{
+		name:  "Read" + kind + benchSizeName(n),
+		bytes: n,
+		setup: func(ctx context.Context, kbfsOps KBFSOps, dir Node) (
+			benchOp, func(context.Context) error, error) {
+			file, _, err := kbfsOps.CreateFile(ctx, dir, "f", false, NoExcl)
+			if err != nil {
+				return nil, nil, err
+			}
+			err = kbfsOps.Write(ctx, file, benchData(benchFileSize), 0)
+			if err != nil {
+				return nil, nil, err
+			}
+			err = kbfsOps.Sync(ctx, file)
+			if err != nil {
+				return nil, nil, err
+			}
+			var r *rand.Rand
+			if random {
+				r = rand.New(rand.NewSource(1))
+			}
+			buf := make([]byte, n)
+			op := func(ctx context.Context, i int) error {
+				read, err := kbfsOps.Read(
+					ctx, file, buf, benchOffset(r, i, n))
+				if err != nil {
+					return err
+				}
+				if read != n {
+					return fmt.Errorf("Short read: %d of %d bytes", read, n)
+				}
+				return nil
+			}
+			return op, nil, nil
+		},
+	}
+}
+
+func benchCreateDirCase() benchCase {
+	return benchCase{
+		name: "CreateManyEntries",
+		setup: func(ctx context.Context, kbfsOps KBFSOps, dir Node) (
+			benchOp, func(context.Context) error, error) {
+			op := func(ctx context.Context, i int) error {
+				name := fmt.Sprintf("e%d", i)
+				var err error
+				if i%2 == 0 {
+					_, _, err = kbfsOps.CreateFile(
+						ctx, dir, name, false, NoExcl)
+				} else {
+					_, _, err = kbfsOps.CreateDir(ctx, dir, name)
+				}
+				return err
+			}
+			return op, nil, nil
+		},
+	}
+}
+
+func benchSyncCase(journal bool) benchCase {
+	name := "SyncNoJournal"
+	if journal {
+		name = "SyncJournal"
+	}
+	const n = 4 << 10
+	return benchCase{
+		name:    name,
+		bytes:   n,
+		journal: &journal,
+		setup: func(ctx context.Context, kbfsOps KBFSOps, dir Node) (
+			benchOp, func(context.Context) error, error) {
+			file, _, err := kbfsOps.CreateFile(ctx, dir, "f", false, NoExcl)
+			if err != nil {
+				return nil, nil, err
+			}
+			buf := benchData(n)
+			op := func(ctx context.Context, i int) error {
+				// Change the block each time, so each Sync
+				// puts a new one.
+				buf[0] = byte(i)
+				buf[1] = byte(i >> 8)
+				err := kbfsOps.Write(ctx, file, buf, 0)
+				if err != nil {
+					return err
+				}
+				return kbfsOps.Sync(ctx, file)
+			}
+			return op, nil, nil
+		},
+	}
+}
+
+// benchCases returns all the benchmarks, in the order they run.
+func benchCases() []benchCase {
+	var cases []benchCase
+	for _, random := range []bool{false, true} {
+		for _, n := range []int64{4 << 10, 64 << 10, 512 << 10} {
+			cases = append(cases, benchWriteCase(n, random))
+		}
+	}
+	for _, random := range []bool{false, true} {
+		for _, n := range []int64{4 << 10, 64 << 10, 512 << 10} {
+			cases = append(cases, benchReadCase(n, random))
+		}
+	}
+	cases = append(cases, benchCreateDirCase(),
+		benchSyncCase(false), benchSyncCase(true))
+	return cases
+}
+
+// BenchNames returns the names of all the benchmarks.
+func BenchNames() []string {
+	var names []string
+	for _, c := range benchCases() {
+		names = append(names, c.name)
+	}
+	return names
+}
+
+// errBenchNeedsJournal is returned for a benchmark that needs a
+// journal, when config has none.
+var errBenchNeedsJournal = errors.New("Benchmark needs a journal server")
+
+// setBenchJournal turns the journal for tlfID on or off, and returns
+// a function to put it back how it was.
+func setBenchJournal(ctx context.Context, config Config, tlfID TlfID,
+	on bool) (undo func(context.Context) error, err error) {
+	jServer, err := GetJournalServer(config)
+	if err != nil {
+		if on {
+			return nil, errBenchNeedsJournal
+		}
+		return func(context.Context) error { return nil }, nil
+	}
+	wasOn := TLFJournalEnabled(config, tlfID)
+	set := func(ctx context.Context, on bool) error {
+		if on {
+			return jServer.Enable(
+				ctx, tlfID, TLFJournalBackgroundWorkEnabled)
+		}
+		err := jServer.Wait(ctx, tlfID)
+		if err != nil {
+			return err
+		}
+		_, err = jServer.Disable(ctx, tlfID)
+		return err
+	}
+	if on != wasOn {
+		if err := set(ctx, on); err != nil {
+			return nil, err
+		}
+	}
+	return func(ctx context.Context) error {
+		if on == wasOn {
+			return nil
+		}
+		return set(ctx, wasOn)
+	}, nil
+}
+
+// RunBenchCase runs the named benchmark n times in dir, which must
+// be an empty, writable directory, timing it with timer.  The
+// benchmark leaves its files in dir.  It returns the number of bytes
+// each operation reads or writes, if any.  config should do
+// background flushes, as real clients do, or the write benchmarks
+// can fill the dirty block cache and wait forever.
+func RunBenchCase(ctx context.Context, config Config, dir Node,
+	name string, n int, timer BenchTimer) (bytes int64, err error) {
+	var c *benchCase
+	for _, bc := range benchCases() {
+		if bc.name == name {
+			bc := bc
+			c = &bc
+			break
+		}
+	}
+	if c == nil {
+		return 0, fmt.Errorf("No benchmark %s", name)
+	}
+
+	timer.StopTimer()
+	if c.journal != nil {
+		undo, err := setBenchJournal(
+			ctx, config, dir.GetFolderBranch().Tlf, *c.journal)
+		if err != nil {
+			return 0, err
+		}
+		defer func() {
+			timer.StopTimer()
+			if undoErr := undo(ctx); err == nil {
+				err = undoErr
+			}
+		}()
+	}
+
+	kbfsOps := config.KBFSOps()
+	op, finish, err := c.setup(ctx, kbfsOps, dir)
+	if err != nil {
+		return 0, err
+	}
+	timer.ResetTimer()
+	timer.StartTimer()
+	for i := 0; i < n; i++ {
+		if err := op(ctx, i); err != nil {
+			return 0, err
+		}
+	}
+	if finish != nil {
+		if err := finish(ctx); err != nil {
+			return 0, err
+		}
+	}
+	timer.StopTimer()
+	return c.bytes, nil
+}
+
+// BenchResult is the result of one benchmark run by RunBenchmarks.
+type BenchResult struct {
+	Name string
+	// N is the number of operations timed.
+	N int
+	// Bytes is the number of bytes each operation read or wrote.
+	Bytes   int64
+	Elapsed time.Duration
+}
+
+// String formats r the way "go test -bench" does, so results can be
+// compared with the usual tools.
+func (r BenchResult) String() string {
+	s := fmt.Sprintf("Benchmark%s\t%8d\t%10d ns/op",
+		r.Name, r.N, r.Elapsed.Nanoseconds()/int64(r.N))
+	if r.Bytes > 0 && r.Elapsed > 0 {
+		mbps := float64(r.Bytes) * float64(r.N) / 1e6 /
+			r.Elapsed.Seconds()
+		s += fmt.Sprintf("\t%7.2f MB/s", mbps)
+	}
+	return s
+}
+
+// benchStopwatch is a BenchTimer that measures real time.
+type benchStopwatch struct {
+	start   time.Time
+	elapsed time.Duration
+	running bool
+}
+
+func (s *benchStopwatch) StartTimer() {
+	if !s.running {
+		s.start = time.Now()
+		s.running = true
+	}
+}
+
+func (s *benchStopwatch) StopTimer() {
+	if s.running {
+		s.elapsed += time.Since(s.start)
+		s.running = false
+	}
+}
+
+func (s *benchStopwatch) ResetTimer() {
+	if s.running {
+		s.start = time.Now()
+	}
+	s.elapsed = 0
+}
+
+// maxBenchN is the most operations RunBenchmarks times in one run.
+const maxBenchN = 100000
+
+// RunBenchmarks runs the benchmarks whose names match pattern under
+// parent, each in its own new subdirectory, and calls report with
+// each result.  Like "go test -bench", it keeps running a benchmark
+// with more operations until a run takes at least benchTime.  It
+// skips benchmarks that need a journal if config has none.  The
+// subdirectories are left behind, named after the benchmarks and
+// the time the run started, for the caller to inspect or remove.
+func RunBenchmarks(ctx context.Context, config Config, parent Node,
+	pattern string, benchTime time.Duration,
+	report func(BenchResult)) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	kbfsOps := config.KBFSOps()
+	stamp := config.Clock().Now().Format("20060102T150405")
+	for _, c := range benchCases() {
+		if !re.MatchString(c.name) {
+			continue
+		}
+		if c.journal != nil && *c.journal {
+			if _, err := GetJournalServer(config); err != nil {
+				continue
+			}
+		}
+		n := 1
+		for run := 0; ; run++ {
+			dir, _, err := kbfsOps.CreateDir(ctx, parent,
+				fmt.Sprintf("bench-%s-%s-%d", stamp, c.name, run))
+			if err != nil {
+				return err
+			}
+			var timer benchStopwatch
+			bytes, err := RunBenchCase(ctx, config, dir, c.name, n, &timer)
+			if err != nil {
+				return fmt.Errorf("%s: %v", c.name, err)
+			}
+			if timer.elapsed >= benchTime || n >= maxBenchN {
+				report(BenchResult{c.name, n, bytes, timer.elapsed})
+				break
+			}
+			n = nextBenchN(n, timer.elapsed, benchTime)
+		}
+	}
+	return nil
+}
+
+// nextBenchN predicts how many operations will take benchTime,
+// given that n took elapsed, growing by at least one and at most a
+// hundredfold, as the testing package does.
+func nextBenchN(n int, elapsed, benchTime time.Duration) int {
+	next := 100 * n
+	if elapsed > 0 {
+		// Aim a little past benchTime, so the next run is
+		// likely the last.
+		predicted := int64(benchTime) * int64(n) / int64(elapsed)
+		predicted += predicted / 5
+		if predicted < int64(next) {
+			next = int(predicted)
+		}
+	}
+	if next <= n {
+		next = n + 1
+	}
+	if next > maxBenchN {
+		next = maxBenchN
+	}
+	return next
+}
@@ -0,0 +1,177 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// These benchmarks can be run with:
+// go test -run=XXX -bench=BenchmarkSuite -benchmem
+// and compared across builds with benchcmp or benchstat.
+
+package libkbfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/stretchr/testify/require"
+)
+
+// makeBenchConfig returns a config for alice, with a journal server
+// if journal is set, and the root of her private TLF.  The returned
+// function cleans up.
+func makeBenchConfig(tb testing.TB, journal bool) (
+	config *ConfigLocal, root Node, cleanup func()) {
+	config = MakeTestConfigOrBust(tb, "alice")
+	// Flush dirty data in the background, as a real client does,
+	// so the write benchmarks don't fill the dirty block cache.
+	config.SetDoBackgroundFlushes(true)
+	var tempdir string
+	if journal {
+		var err error
+		tempdir, err = ioutil.TempDir(os.TempDir(), "bench_journal")
+		require.NoError(tb, err)
+		config.EnableJournaling(tempdir)
+	}
+	root = GetRootNodeOrBust(tb, config, "alice", false)
+	return config, root, func() {
+		config.Shutdown()
+		if tempdir != "" {
+			os.RemoveAll(tempdir)
+		}
+	}
+}
+
+func benchmarkSuiteCase(b *testing.B, name string) {
+	config, root, cleanup := makeBenchConfig(b, true)
+	defer cleanup()
+	ctx := BackgroundContextWithCancellationDelayer()
+	defer CleanupCancellationDelayer(ctx)
+
+	dir, _, err := config.KBFSOps().CreateDir(ctx, root, "bench")
+	require.NoError(b, err)
+	bytes, err := RunBenchCase(ctx, config, dir, name, b.N, b)
+	require.NoError(b, err)
+	b.SetBytes(bytes)
+}
+
+func BenchmarkSuiteWriteSeq4k(b *testing.B) {
+	benchmarkSuiteCase(b, "WriteSeq4k")
+}
+func BenchmarkSuiteWriteSeq64k(b *testing.B) {
+	benchmarkSuiteCase(b, "WriteSeq64k")
+}
+func BenchmarkSuiteWriteSeq512k(b *testing.B) {
+	benchmarkSuiteCase(b, "WriteSeq512k")
+}
+func BenchmarkSuiteWriteRand4k(b *testing.B) {
+	benchmarkSuiteCase(b, "WriteRand4k")
+}
+func BenchmarkSuiteWriteRand64k(b *testing.B) {
+	benchmarkSuiteCase(b, "WriteRand64k")
+}
+func BenchmarkSuiteWriteRand512k(b *testing.B) {
+	benchmarkSuiteCase(b, "WriteRand512k")
+}
+func BenchmarkSuiteReadSeq4k(b *testing.B) {
+	benchmarkSuiteCase(b, "ReadSeq4k")
+}
+func BenchmarkSuiteReadSeq64k(b *testing.B) {
+	benchmarkSuiteCase(b, "ReadSeq64k")
+}
+func BenchmarkSuiteReadSeq512k(b *testing.B) {
+	benchmarkSuiteCase(b, "ReadSeq512k")
+}
+func BenchmarkSuiteReadRand4k(b *testing.B) {
+	benchmarkSuiteCase(b, "ReadRand4k")
+}
+func BenchmarkSuiteReadRand64k(b *testing.B) {
+	benchmarkSuiteCase(b, "ReadRand64k")
+}
+func BenchmarkSuiteReadRand512k(b *testing.B) {
+	benchmarkSuiteCase(b, "ReadRand512k")
+}
+func BenchmarkSuiteCreateManyEntries(b *testing.B) {
+	benchmarkSuiteCase(b, "CreateManyEntries")
+}
+func BenchmarkSuiteSyncNoJournal(b *testing.B) {
+	benchmarkSuiteCase(b, "SyncNoJournal")
+}
+func BenchmarkSuiteSyncJournal(b *testing.B) {
+	benchmarkSuiteCase(b, "SyncJournal")
+}
+
+// benchmarkSuiteCRConflicts measures how long conflict resolution
+// takes for a TLF where a second user has rewritten n files that
+// the first user rewrote too.
+func benchmarkSuiteCRConflicts(b *testing.B, n int) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	name := userName1.String() + "," + userName2.String()
+	ctx := BackgroundContextWithCancellationDelayer()
+	defer CleanupCancellationDelayer(ctx)
+
+	b.StopTimer()
+	for i := 0; i < b.N; i++ {
+		config1 := MakeTestConfigOrBust(b, userName1, userName2)
+		config2 := ConfigAsUser(config1, userName2)
+		fixture := MakeTLFFixtureOrBust(b, ctx, config1, config2, name,
+			false, TLFFixtureSpec{
+				Seed:        int64(i),
+				FilesPerDir: 2 * n,
+				FileSize:    UniformFileSize(1, 4<<10),
+				Conflicts:   n,
+			})
+		b.StartTimer()
+		err := fixture.ResolveConflicts(ctx)
+		b.StopTimer()
+		require.NoError(b, err)
+		config2.Shutdown()
+		config1.Shutdown()
+	}
+}
+
+func BenchmarkSuiteCRConflicts1(b *testing.B) {
+	benchmarkSuiteCRConflicts(b, 1)
+}
+func BenchmarkSuiteCRConflicts10(b *testing.B) {
+	benchmarkSuiteCRConflicts(b, 10)
+}
+func BenchmarkSuiteCRConflicts100(b *testing.B) {
+	benchmarkSuiteCRConflicts(b, 100)
+}
+
+// TestRunBenchmarks runs every benchmark once, so they keep working
+// between the times anyone measures them.
+func TestRunBenchmarks(t *testing.T) {
+	config, root, cleanup := makeBenchConfig(t, true)
+	defer cleanup()
+	ctx := BackgroundContextWithCancellationDelayer()
+	defer CleanupCancellationDelayer(ctx)
+
+	var names []string
+	err := RunBenchmarks(ctx, config, root, ".", 0,
+		func(r BenchResult) {
+			require.Equal(t, 1, r.N)
+			names = append(names, r.Name)
+		})
+	require.NoError(t, err)
+	require.Equal(t, BenchNames(), names)
+
+	// Only the sync benchmarks change the journal, and they put it
+	// back how it was.
+	require.False(t, TLFJournalEnabled(config, root.GetFolderBranch().Tlf))
+
+	r := BenchResult{Name: "ReadSeq4k", N: 1000, Bytes: 4 << 10,
+		Elapsed: 1e9}
+	require.Equal(t, fmt.Sprintf(
+		"BenchmarkReadSeq4k\t%8d\t%10d ns/op\t%7.2f MB/s",
+		1000, 1000000, 4.10), r.String())
+}
+
+func TestNextBenchN(t *testing.T) {
+	require.Equal(t, 100, nextBenchN(1, 0, 1e9))
+	require.Equal(t, 120, nextBenchN(10, 1e8, 1e9))
+	require.Equal(t, 11, nextBenchN(10, 2e9, 1e9))
+	require.Equal(t, maxBenchN, nextBenchN(maxBenchN/2, 1, 1e9))
+}
@@ -0,0 +1,164 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/golang/snappy"
+)
+
+// BlockCompressionType is the algorithm used to compress an encoded
+// block before it is padded and encrypted.
+type BlockCompressionType byte
+
+const (
+	// BlockCompressionNone leaves blocks uncompressed.
+	BlockCompressionNone BlockCompressionType = 0
+	// BlockCompressionSnappy compresses blocks with snappy, which is
+	// fast but doesn't compress as well as flate.
+	BlockCompressionSnappy BlockCompressionType = 1
+	// BlockCompressionFlate compresses blocks with DEFLATE.
+	BlockCompressionFlate BlockCompressionType = 2
+)
+
+func (t BlockCompressionType) String() string {
+	switch t {
+	case BlockCompressionNone:
+		return "none"
+	case BlockCompressionSnappy:
+		return "snappy"
+	case BlockCompressionFlate:
+		return "flate"
+	default:
+		return fmt.Sprintf("BlockCompressionType(%d)", t)
+	}
+}
+
+// ParseBlockCompressionType returns the BlockCompressionType named
+// by s, as returned by its String method.
+func ParseBlockCompressionType(s string) (BlockCompressionType, error) {
+	for _, t := range []BlockCompressionType{BlockCompressionNone,
+		BlockCompressionSnappy, BlockCompressionFlate} {
+		if s == t.String() {
+			return t, nil
+		}
+	}
+	return BlockCompressionNone, fmt.Errorf(
+		"Unknown block compression type %q", s)
+}
+
+const (
+	// minCompressibleBlockSize is the smallest encoded block that
+	// compressBlock will try to compress; padding rounds anything
+	// smaller up to the same size either way.
+	minCompressibleBlockSize = 2 * minBlockSize
+	// compressionSampleSize is how much of a block compressBlock
+	// compresses first, to cheaply skip blocks that are already
+	// compressed (media files, archives) or encrypted.
+	compressionSampleSize = 8 * 1024
+	// maxDecompressedBlockSize bounds how much a compressed block may
+	// expand to, so a malicious block can't make a reader allocate
+	// without limit.
+	maxDecompressedBlockSize = 64 * 1024 * 1024
+)
+
+func compressWith(t BlockCompressionType, data []byte) ([]byte, error) {
+	switch t {
+	case BlockCompressionSnappy:
+		return snappy.Encode(nil, data), nil
+	case BlockCompressionFlate:
+		var buf bytes.Buffer
+		w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("Unknown block compression type %s", t)
+	}
+}
+
+// compressBlock compresses an encoded block with the given algorithm,
+// and returns the algorithm byte followed by the compressed data.  It
+// returns nil if the block should be stored uncompressed, either
+// because compression is off or because it wouldn't save any space
+// once the block is padded.
+func compressBlock(t BlockCompressionType, encodedBlock []byte) (
+	[]byte, error) {
+	if t == BlockCompressionNone ||
+		len(encodedBlock) < minCompressibleBlockSize {
+		return nil, nil
+	}
+
+	if len(encodedBlock) > 2*compressionSampleSize {
+		sample := snappy.Encode(nil, encodedBlock[:compressionSampleSize])
+		if len(sample) > compressionSampleSize*7/8 {
+			return nil, nil
+		}
+	}
+
+	compressed, err := compressWith(t, encodedBlock)
+	if err != nil {
+		return nil, err
+	}
+	// Padding rounds both up to a power of two, so a smaller
+	// compressed block only helps if it rounds to a smaller size.
+	if nextPowerOfTwo(uint32(len(compressed)+1)) >=
+		nextPowerOfTwo(uint32(len(encodedBlock))) {
+		return nil, nil
+	}
+	return append([]byte{byte(t)}, compressed...), nil
+}
+
+// decompressBlock undoes compressBlock.
+func decompressBlock(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, BlockDecompressionError{"empty compressed block"}
+	}
+	t, compressed := BlockCompressionType(data[0]), data[1:]
+	switch t {
+	case BlockCompressionSnappy:
+		n, err := snappy.DecodedLen(compressed)
+		if err != nil {
+			return nil, BlockDecompressionError{err.Error()}
+		}
+		if n > maxDecompressedBlockSize {
+			return nil, BlockDecompressionError{
+				fmt.Sprintf("decompressed size %d is too big", n)}
+		}
+		decompressed, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			return nil, BlockDecompressionError{err.Error()}
+		}
+		return decompressed, nil
+	case BlockCompressionFlate:
+		r := flate.NewReader(bytes.NewReader(compressed))
+		defer r.Close()
+		decompressed, err := ioutil.ReadAll(
+			io.LimitReader(r, maxDecompressedBlockSize+1))
+		if err != nil {
+			return nil, BlockDecompressionError{err.Error()}
+		}
+		if len(decompressed) > maxDecompressedBlockSize {
+			return nil, BlockDecompressionError{
+				"decompressed size is too big"}
+		}
+		return decompressed, nil
+	default:
+		return nil, BlockDecompressionError{
+			fmt.Sprintf("unknown compression type %s", t)}
+	}
+}
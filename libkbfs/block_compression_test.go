@@ -0,0 +1,216 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testBlockCompressionTypes = []BlockCompressionType{
+	BlockCompressionSnappy, BlockCompressionFlate}
+
+func TestBlockCompressionRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("all work and no play "), 1000)
+	for _, ct := range testBlockCompressionTypes {
+		compressed, err := compressBlock(ct, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compressed == nil {
+			t.Fatalf("%s: repetitive data wasn't compressed", ct)
+		}
+		decompressed, err := decompressBlock(compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decompressed, data) {
+			t.Errorf("%s: data changed after a round trip", ct)
+		}
+	}
+}
+
+func TestBlockCompressionSkipsIncompressible(t *testing.T) {
+	random := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(random)
+	small := bytes.Repeat([]byte{'a'}, minCompressibleBlockSize-1)
+	for _, ct := range testBlockCompressionTypes {
+		for _, data := range [][]byte{random, small} {
+			compressed, err := compressBlock(ct, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if compressed != nil {
+				t.Errorf("%s: compressed %d bytes that should have been "+
+					"skipped", ct, len(data))
+			}
+		}
+	}
+	if compressed, err := compressBlock(BlockCompressionNone,
+		bytes.Repeat([]byte{'a'}, 64*1024)); err != nil || compressed != nil {
+		t.Errorf("Compressed with compression off: %v", err)
+	}
+}
+
+func TestBlockDecompressionErrors(t *testing.T) {
+	for _, data := range [][]byte{
+		nil,
+		{byte(BlockCompressionSnappy), 0xff, 0xff, 0xff},
+		{byte(BlockCompressionFlate), 0xff, 0xff, 0xff},
+		{0x7f, 1, 2, 3},
+	} {
+		if _, err := decompressBlock(data); err == nil {
+			t.Errorf("Decompressing %v didn't fail", data)
+		} else if _, ok := err.(BlockDecompressionError); !ok {
+			t.Errorf("Unexpected error type %T: %v", err, err)
+		}
+	}
+}
+
+// Test that compressed blocks survive a trip through EncryptBlock and
+// DecryptBlock, and end up smaller than uncompressed ones.
+func TestEncryptBlockCompressed(t *testing.T) {
+	c := MakeCryptoCommon(NewCodecMsgpack())
+	cryptKey := makeFakeBlockCryptKey(t)
+
+	block := NewFileBlock().(*FileBlock)
+	block.Contents = bytes.Repeat([]byte("all work and no play "), 1000)
+
+	_, uncompressed, err := c.EncryptBlock(block, cryptKey,
+		BlockCompressionNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ct := range testBlockCompressionTypes {
+		plainSize, encryptedBlock, err := c.EncryptBlock(block, cryptKey, ct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encodedBlock, err := c.codec.Encode(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plainSize != len(encodedBlock) {
+			t.Errorf("%s: expected plain size %d, got %d", ct,
+				len(encodedBlock), plainSize)
+		}
+		if len(encryptedBlock.EncryptedData) >=
+			len(uncompressed.EncryptedData) {
+			t.Errorf("%s: compressed block is %d bytes, uncompressed is %d",
+				ct, len(encryptedBlock.EncryptedData),
+				len(uncompressed.EncryptedData))
+		}
+
+		decryptedBlock := NewFileBlock().(*FileBlock)
+		if err := c.DecryptBlock(
+			encryptedBlock, cryptKey, decryptedBlock); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decryptedBlock.Contents, block.Contents) {
+			t.Errorf("%s: contents changed after a round trip", ct)
+		}
+	}
+}
+
+func TestParseBlockCompressionType(t *testing.T) {
+	for _, ct := range append(testBlockCompressionTypes,
+		BlockCompressionNone) {
+		parsed, err := ParseBlockCompressionType(ct.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed != ct {
+			t.Errorf("Parsed %s as %s", ct, parsed)
+		}
+	}
+	if _, err := ParseBlockCompressionType("lz4"); err == nil {
+		t.Error("Unknown compression type was accepted")
+	}
+}
+
+func TestKBFSOpsCompressedBlocksDataVer(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	tlfID := rootNode.GetFolderBranch().Tlf
+	err := config.SetBlockCompressionForTLF(tlfID, BlockCompressionSnappy)
+	require.NoError(t, err)
+
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, tlfID)
+	writeFile := func(name string, data []byte) func() BlockPointer {
+		fileNode, _, err := kbfsOps.CreateFile(
+			ctx, rootNode, name, false, NoExcl)
+		require.NoError(t, err)
+		err = kbfsOps.Write(ctx, fileNode, data, 0)
+		require.NoError(t, err)
+		err = kbfsOps.Sync(ctx, fileNode)
+		require.NoError(t, err)
+		return func() BlockPointer {
+			return ops.nodeCache.PathFromNode(fileNode).tailPointer()
+		}
+	}
+	small := bytes.Repeat([]byte("all work and no play "), 1000)
+	smallPtr := writeFile("small", small)
+	require.Equal(t, DataVer(CompressedBlocksDataVer), smallPtr().DataVer)
+
+	// A file deep enough to have two levels of children still says
+	// so, along with being compressed.
+	bsplitter, err := NewBlockSplitterSimple(20, 8*1024, config.Codec())
+	require.NoError(t, err)
+	config.SetBlockSplitter(bsplitter)
+	big := make([]byte, 1200)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	bigPtr := writeFile("big", big)
+	require.Equal(t, DataVer(CompressedTwoLevelsOfChildrenDataVer),
+		bigPtr().DataVer)
+
+	// Turning compression off doesn't lower the version of a file
+	// that still has compressed blocks.
+	err = config.SetBlockCompressionForTLF(tlfID, BlockCompressionNone)
+	require.NoError(t, err)
+	bigNode, _, err := kbfsOps.Lookup(ctx, rootNode, "big")
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, bigNode, []byte{0xff}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, bigNode)
+	require.NoError(t, err)
+	big[0] = 0xff
+	require.Equal(t, DataVer(CompressedTwoLevelsOfChildrenDataVer),
+		bigPtr().DataVer)
+	plain := []byte("plain")
+	plainPtr := writeFile("plain", plain)
+	require.Equal(t, DataVer(FirstValidDataVer), plainPtr().DataVer)
+
+	// Another device, with nothing cached, reads everything back.
+	config2 := ConfigAsUser(config, "test_user")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(t, config2, "test_user", false)
+	for name, data := range map[string][]byte{
+		"small": small, "big": big, "plain": plain} {
+		fileNode2, _, err := config2.KBFSOps().Lookup(ctx, rootNode2, name)
+		require.NoError(t, err)
+		buf := make([]byte, len(data))
+		n, err := config2.KBFSOps().Read(ctx, fileNode2, buf, 0)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(data)), n)
+		require.True(t, bytes.Equal(data, buf), name)
+	}
+
+	// A client that doesn't know about compression refuses to read
+	// the compressed files.
+	err = ops.checkDataVersion(path{}, smallPtr())
+	require.NoError(t, err)
+	err = ops.checkDataVersion(path{}, BlockPointer{
+		DataVer: CompressedTwoLevelsOfChildrenDataVer + 1})
+	require.IsType(t, NewDataVersionError{}, err)
+}
@@ -6,6 +6,7 @@ package libkbfs
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -133,6 +134,20 @@ func (e blockJournalEntry) getSingleContext() (
 		"getSingleContext() erroneously called on op %s", e.Op)
 }
 
+// check returns an error if e is malformed, as it could be if it was
+// read back from a corrupted journal.
+func (e blockJournalEntry) check() error {
+	switch e.Op {
+	case blockPutOp, addRefOp:
+		_, _, err := e.getSingleContext()
+		return err
+	case removeRefsOp, archiveRefsOp:
+		return nil
+	default:
+		return fmt.Errorf("Unknown op %s", e.Op)
+	}
+}
+
 // makeBlockJournal returns a new blockJournal for the given
 // directory. Any existing journal entries are read.
 func makeBlockJournal(
@@ -189,7 +204,12 @@ func (j *blockJournal) readJournalEntry(ordinal journalOrdinal) (
 		return blockJournalEntry{}, err
 	}
 
-	return entry.(blockJournalEntry), nil
+	e := entry.(blockJournalEntry)
+	if err := e.check(); err != nil {
+		return blockJournalEntry{}, JournalEntryDecodeError{
+			j.j.journalEntryPath(ordinal), err}
+	}
+	return e, nil
 }
 
 // readJournal reads the journal and returns a map of all the block
@@ -380,42 +400,77 @@ func (j *blockJournal) getDataSize(id BlockID) (int64, error) {
 	return fi.Size(), nil
 }
 
-func (j *blockJournal) getData(id BlockID) (
-	[]byte, BlockCryptKeyServerHalf, error) {
-	data, err := ioutil.ReadFile(j.blockDataPath(id))
-	if os.IsNotExist(err) {
-		return nil, BlockCryptKeyServerHalf{}, blockNonExistentError{id}
-	} else if err != nil {
-		return nil, BlockCryptKeyServerHalf{}, err
+// readVerifiedBlockData reads the block data in the file at p,
+// checking its integrity against id as it's read.  A file that's
+// shorter than it claims to be when opened fails the read right
+// away, and data that doesn't match id is dropped before the caller
+// does anything else with it.
+func readVerifiedBlockData(p string, id BlockID) ([]byte, error) {
+	v, err := newHashVerifier(id.h)
+	if err != nil {
+		return nil, err
 	}
 
-	keyServerHalfPath := j.keyServerHalfPath(id)
-	buf, err := ioutil.ReadFile(keyServerHalfPath)
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, fi.Size())
+	_, err = io.ReadFull(io.TeeReader(f, v), data)
+	if err != nil {
+		return nil, err
+	}
+	// A file that grew since it was opened is being rewritten
+	// under us, so whatever was read can't be trusted.
+	var extra [1]byte
+	if n, _ := f.Read(extra[:]); n != 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	err = v.Verify()
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (j *blockJournal) getData(id BlockID) (
+	[]byte, BlockCryptKeyServerHalf, error) {
+	data, err := readVerifiedBlockData(j.blockDataPath(id), id)
 	if os.IsNotExist(err) {
 		return nil, BlockCryptKeyServerHalf{}, blockNonExistentError{id}
 	} else if err != nil {
 		return nil, BlockCryptKeyServerHalf{}, err
 	}
 
-	// Check integrity.
-
-	dataID, err := j.crypto.MakePermanentBlockID(data)
+	serverHalf, err := j.getServerHalf(id)
 	if err != nil {
 		return nil, BlockCryptKeyServerHalf{}, err
 	}
 
-	if id != dataID {
-		return nil, BlockCryptKeyServerHalf{}, fmt.Errorf(
-			"Block ID mismatch: expected %s, got %s", id, dataID)
+	return data, serverHalf, nil
+}
+
+func (j *blockJournal) getServerHalf(id BlockID) (
+	BlockCryptKeyServerHalf, error) {
+	buf, err := ioutil.ReadFile(j.keyServerHalfPath(id))
+	if os.IsNotExist(err) {
+		return BlockCryptKeyServerHalf{}, blockNonExistentError{id}
+	} else if err != nil {
+		return BlockCryptKeyServerHalf{}, err
 	}
 
 	var serverHalf BlockCryptKeyServerHalf
 	err = serverHalf.UnmarshalBinary(buf)
 	if err != nil {
-		return nil, BlockCryptKeyServerHalf{}, err
+		return BlockCryptKeyServerHalf{}, err
 	}
-
-	return data, serverHalf, nil
+	return serverHalf, nil
 }
 
 // All functions below are public functions.
@@ -459,6 +514,28 @@ func (j *blockJournal) getAll() (
 	return res, nil
 }
 
+// writeData stores the data and key server half for the given block
+// ID, without touching the journal itself.
+func (j *blockJournal) writeData(id BlockID, buf []byte,
+	serverHalf BlockCryptKeyServerHalf) error {
+	err := os.MkdirAll(j.blockPath(id), 0700)
+	if err != nil {
+		return err
+	}
+
+	// Write atomically, so that a crash can't leave a truncated
+	// copy behind for flushing to trip over later.
+	err = writeFileAtomic(j.blockDataPath(id), buf)
+	if err != nil {
+		return err
+	}
+	j.unflushedBytes += int64(len(buf))
+
+	// TODO: Add integrity-checking for key server half?
+
+	return writeFileAtomic(j.keyServerHalfPath(id), serverHalf.data[:])
+}
+
 func (j *blockJournal) putData(
 	ctx context.Context, id BlockID, context BlockContext, buf []byte,
 	serverHalf BlockCryptKeyServerHalf) (err error) {
@@ -477,8 +554,18 @@ func (j *blockJournal) putData(
 		return err
 	}
 
-	// Check the data and retrieve the server half, if they exist.
-	_, existingServerHalf, err := j.getDataWithContext(id, context)
+	// Retrieve the server half, if the entry exists.  The
+	// existing data isn't read: buf has been checked against id,
+	// and it overwrites the data below, so a copy on disk that's
+	// been corrupted gets replaced rather than failing the put.
+	var existingServerHalf BlockCryptKeyServerHalf
+	refEntry, err := j.getRefEntry(id, context.GetRefNonce())
+	if err == nil {
+		err = refEntry.checkContext(context)
+	}
+	if err == nil {
+		existingServerHalf, err = j.getServerHalf(id)
+	}
 	var exists bool
 	switch err.(type) {
 	case blockNonExistentError:
@@ -494,8 +581,11 @@ func (j *blockJournal) putData(
 		// the same, except for possibly additional
 		// references.
 
-		// We checked that both buf and the existing data hash
-		// to id, so no need to check that they're both equal.
+		if size, err := j.getDataSize(id); err == nil &&
+			size != int64(len(buf)) {
+			j.log.CWarningf(ctx, "Replacing %d bytes of corrupt "+
+				"data for block %s", size, id)
+		}
 
 		if existingServerHalf != serverHalf {
 			return fmt.Errorf(
@@ -504,21 +594,7 @@ func (j *blockJournal) putData(
 		}
 	}
 
-	err = os.MkdirAll(j.blockPath(id), 0700)
-	if err != nil {
-		return err
-	}
-
-	err = ioutil.WriteFile(j.blockDataPath(id), buf, 0600)
-	if err != nil {
-		return err
-	}
-	j.unflushedBytes += int64(len(buf))
-
-	// TODO: Add integrity-checking for key server half?
-
-	err = ioutil.WriteFile(
-		j.keyServerHalfPath(id), serverHalf.data[:], 0600)
+	err = j.writeData(id, buf, serverHalf)
 	if err != nil {
 		return err
 	}
@@ -548,6 +624,11 @@ func (j *blockJournal) addReference(
 		}
 	}()
 
+	err = context.checkForAddReference()
+	if err != nil {
+		return err
+	}
+
 	ordinal, err := j.appendJournalEntry(addRefOp,
 		map[BlockID][]BlockContext{id: {context}})
 	if err != nil {
@@ -729,15 +810,19 @@ func (j *blockJournal) getNextEntriesToFlush(
 				return blockEntriesToFlush{}, err
 			}
 
+			// The data is checked against id as it's read, so
+			// a corrupt block stops the batch here, before
+			// any of it is sent or the rest of it is read.
 			data, serverHalf, err = j.getData(id)
 			if err != nil {
-				return blockEntriesToFlush{}, err
+				return blockEntriesToFlush{}, blockJournalDataError{
+					ordinal, id, err}
 			}
 
 			entries.puts.addNewBlock(
 				BlockPointer{ID: id, BlockContext: bctx},
 				nil, /* only used by folderBranchOps */
-				ReadyBlockData{data, serverHalf}, nil)
+				ReadyBlockData{buf: data, serverHalf: serverHalf}, nil)
 
 		case addRefOp:
 			id, bctx, err := entry.getSingleContext()
@@ -791,7 +876,8 @@ func flushNonBPSBlockJournalEntry(
 
 func flushBlockEntries(ctx context.Context, log logger.Logger,
 	bserver BlockServer, bcache BlockCache, reporter Reporter, tlfID TlfID,
-	tlfName CanonicalTlfName, entries blockEntriesToFlush) error {
+	tlfName CanonicalTlfName, entries blockEntriesToFlush,
+	parallelism int) error {
 	if !entries.flushNeeded() {
 		// Avoid logging anything when there's nothing to flush.
 		return nil
@@ -802,7 +888,7 @@ func flushBlockEntries(ctx context.Context, log logger.Logger,
 	// reference the former.
 	log.CDebugf(ctx, "Putting %d blocks", len(entries.puts.blockStates))
 	blocksToRemove, err := doBlockPuts(ctx, bserver, bcache, reporter,
-		log, tlfID, tlfName, *entries.puts)
+		log, tlfID, tlfName, *entries.puts, parallelism)
 	if err != nil {
 		if isRecoverableBlockError(err) {
 			log.CWarningf(ctx,
@@ -816,7 +902,7 @@ func flushBlockEntries(ctx context.Context, log logger.Logger,
 	log.CDebugf(ctx, "Adding %d block references",
 		len(entries.adds.blockStates))
 	blocksToRemove, err = doBlockPuts(ctx, bserver, bcache, reporter,
-		log, tlfID, tlfName, *entries.adds)
+		log, tlfID, tlfName, *entries.adds, parallelism)
 	if err != nil {
 		if isRecoverableBlockError(err) {
 			log.CWarningf(ctx,
@@ -927,6 +1013,66 @@ func (j *blockJournal) removeFlushedEntries(ctx context.Context,
 	return nil
 }
 
+// getPutsMissingData returns the pointers put by entries in the
+// journal whose data or key server half isn't stored anymore, or
+// whose data has been corrupted.
+// Flushing can't get past such an entry, so each one wedges the
+// journal until its data is restored with restoreData.
+func (j *blockJournal) getPutsMissingData(ctx context.Context) (
+	[]BlockPointer, error) {
+	first, err := j.j.readEarliestOrdinal()
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	last, err := j.j.readLatestOrdinal()
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []BlockPointer
+	for i := first; i <= last; i++ {
+		e, err := j.readJournalEntry(i)
+		if err != nil {
+			return nil, err
+		}
+		if e.Op != blockPutOp {
+			continue
+		}
+		id, context, err := e.getSingleContext()
+		if err != nil {
+			return nil, err
+		}
+		_, _, err = j.getData(id)
+		switch err.(type) {
+		case nil:
+		case blockNonExistentError, HashMismatchError:
+			j.log.CDebugf(ctx, "Put entry %d for block %s has no "+
+				"usable data: %v", i, id, err)
+			missing = append(missing,
+				BlockPointer{ID: id, BlockContext: context})
+		default:
+			return nil, err
+		}
+	}
+	return missing, nil
+}
+
+// restoreData stores data for a block that the journal has a put
+// entry for, but whose data has gone missing, e.g. as fetched back
+// from the server.
+func (j *blockJournal) restoreData(ctx context.Context, id BlockID,
+	buf []byte, serverHalf BlockCryptKeyServerHalf) error {
+	j.log.CDebugf(ctx, "Restoring %d bytes of data for block %s",
+		len(buf), id)
+	err := j.crypto.VerifyBlockID(buf, id)
+	if err != nil {
+		return err
+	}
+	return j.writeData(id, buf, serverHalf)
+}
+
 func (j *blockJournal) checkInSync(ctx context.Context) error {
 	refs, _, err := j.readJournal(ctx)
 	if err != nil {
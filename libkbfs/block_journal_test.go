@@ -135,6 +135,51 @@ func TestBlockJournalBasic(t *testing.T) {
 	getAndCheckBlockData(ctx, t, j, bID, bCtx2, data, serverHalf)
 }
 
+func TestBlockJournalCorruptData(t *testing.T) {
+	ctx, tempdir, j := setupBlockJournalTest(t)
+	defer teardownBlockJournalTest(t, tempdir, j)
+
+	data := []byte{1, 2, 3, 4}
+	bID, bCtx, _ := putBlockData(ctx, t, j, data)
+
+	err := ioutil.WriteFile(j.blockDataPath(bID), []byte{1, 2, 3, 5}, 0600)
+	require.NoError(t, err)
+	_, _, err = j.getDataWithContext(bID, bCtx)
+	require.IsType(t, HashMismatchError{}, err)
+
+	err = ioutil.WriteFile(j.blockDataPath(bID), data, 0600)
+	require.NoError(t, err)
+	_, _, err = j.getDataWithContext(bID, bCtx)
+	require.NoError(t, err)
+}
+
+func TestBlockJournalCorruptDataWriteAndFlush(t *testing.T) {
+	ctx, tempdir, j := setupBlockJournalTest(t)
+	defer teardownBlockJournalTest(t, tempdir, j)
+
+	data := []byte{1, 2, 3, 4}
+	bID, bCtx, serverHalf := putBlockData(ctx, t, j, data)
+	err := ioutil.WriteFile(j.blockDataPath(bID), []byte{1, 2}, 0600)
+	require.NoError(t, err)
+
+	// Flushing stops at the corrupt block, and fsck reports it.
+	end, err := j.end()
+	require.NoError(t, err)
+	_, err = j.getNextEntriesToFlush(ctx, end)
+	require.IsType(t, blockJournalDataError{}, err)
+	missing, err := j.getPutsMissingData(ctx)
+	require.NoError(t, err)
+	require.Equal(t,
+		[]BlockPointer{{ID: bID, BlockContext: bCtx}}, missing)
+
+	// Putting the block again replaces the corrupt copy.
+	err = j.putData(ctx, bID, bCtx, data, serverHalf)
+	require.NoError(t, err)
+	getAndCheckBlockData(ctx, t, j, bID, bCtx, data, serverHalf)
+	_, err = j.getNextEntriesToFlush(ctx, end)
+	require.NoError(t, err)
+}
+
 func TestBlockJournalAddReference(t *testing.T) {
 	ctx, tempdir, j := setupBlockJournalTest(t)
 	defer teardownBlockJournalTest(t, tempdir, j)
@@ -151,6 +196,41 @@ func TestBlockJournalAddReference(t *testing.T) {
 	require.Equal(t, blockNonExistentError{bID}, err)
 }
 
+func TestBlockJournalInvalidContexts(t *testing.T) {
+	ctx, tempdir, j := setupBlockJournalTest(t)
+	defer teardownBlockJournalTest(t, tempdir, j)
+
+	data := []byte{1, 2, 3, 4}
+	bID, err := j.crypto.MakePermanentBlockID(data)
+	require.NoError(t, err)
+	serverHalf, err := j.crypto.MakeRandomBlockCryptKeyServerHalf()
+	require.NoError(t, err)
+	nonce, err := j.crypto.MakeBlockRefNonce()
+	require.NoError(t, err)
+
+	uid1 := keybase1.MakeTestUID(1)
+	uid2 := keybase1.MakeTestUID(2)
+
+	// Puts need a creator, no separate writer, and a zero nonce.
+	err = j.putData(ctx, bID, makeFirstBlockContext(""), data, serverHalf)
+	require.IsType(t, BlockContextMissingCreatorError{}, err)
+	err = j.putData(ctx, bID, BlockContext{uid1, uid2, zeroBlockRefNonce},
+		data, serverHalf)
+	require.IsType(t, BlockContextWriterMismatchError{}, err)
+	err = j.putData(ctx, bID, makeBlockContext(uid1, uid1, nonce),
+		data, serverHalf)
+	require.IsType(t, BlockContextRefNonceError{}, err)
+
+	// Adding a reference needs a creator and a non-zero nonce.
+	err = j.addReference(ctx, bID, makeBlockContext("", uid2, nonce))
+	require.IsType(t, BlockContextMissingCreatorError{}, err)
+	err = j.addReference(ctx, bID, makeFirstBlockContext(uid1))
+	require.IsType(t, BlockContextRefNonceError{}, err)
+
+	// None of the above should have touched the journal.
+	require.Equal(t, 0, getBlockJournalLength(t, j))
+}
+
 func TestBlockJournalRemoveReferences(t *testing.T) {
 	ctx, tempdir, j := setupBlockJournalTest(t)
 	defer teardownBlockJournalTest(t, tempdir, j)
@@ -282,7 +362,8 @@ func TestBlockJournalFlush(t *testing.T) {
 
 		err = flushBlockEntries(
 			ctx, j.log, blockServer, bcache, reporter,
-			tlfID, CanonicalTlfName("fake TLF"), entries)
+			tlfID, CanonicalTlfName("fake TLF"), entries,
+			maxParallelBlockPuts)
 		require.NoError(t, err)
 
 		err = j.removeFlushedEntries(ctx, entries, tlfID, reporter)
@@ -368,7 +449,7 @@ func TestBlockJournalFlushInterleaved(t *testing.T) {
 		require.Equal(t, 1, entries.length())
 		err = flushBlockEntries(ctx, j.log, blockServer,
 			bcache, reporter, tlfID, CanonicalTlfName("fake TLF"),
-			entries)
+			entries, maxParallelBlockPuts)
 		require.NoError(t, err)
 		err = j.removeFlushedEntries(ctx, entries, tlfID, reporter)
 		require.NoError(t, err)
@@ -20,7 +20,10 @@ var _ BlockOps = (*BlockOpsStandard)(nil)
 
 // Get implements the BlockOps interface for BlockOpsStandard.
 func (b *BlockOpsStandard) Get(ctx context.Context, kmd KeyMetadata,
-	blockPtr BlockPointer, block Block) error {
+	blockPtr BlockPointer, block Block) (err error) {
+	ctx, span := startSpan(ctx, nil, "BlockOps.Get")
+	span.SetTag("block", blockPtr.ID.String())
+	defer func() { span.Finish(err) }()
 	bserv := b.config.BlockServer()
 	buf, blockServerHalf, err := bserv.Get(
 		ctx, kmd.TlfID(), blockPtr.ID, blockPtr.BlockContext)
@@ -53,7 +56,11 @@ func (b *BlockOpsStandard) Get(ctx context.Context, kmd KeyMetadata,
 		return err
 	}
 
-	var encryptedBlock EncryptedBlock
+	// Decode the ciphertext into a pooled buffer, which the decoder
+	// fills in if it's big enough.  The ciphertext is garbage once
+	// the block is decrypted.
+	ciphertext := blockBufferPool.get(len(buf))
+	encryptedBlock := EncryptedBlock{EncryptedData: ciphertext}
 	err = b.config.Codec().Decode(buf, &encryptedBlock)
 	if err != nil {
 		return err
@@ -64,6 +71,12 @@ func (b *BlockOpsStandard) Get(ctx context.Context, kmd KeyMetadata,
 	if err != nil {
 		return err
 	}
+	// Only recycle the buffer if the decoder actually used it, so
+	// that nothing it might share with the block server is reused.
+	if len(encryptedBlock.EncryptedData) > 0 &&
+		&encryptedBlock.EncryptedData[0] == &ciphertext[:1][0] {
+		blockBufferPool.put(ciphertext)
+	}
 
 	block.SetEncodedSize(uint32(len(buf)))
 	return nil
@@ -100,7 +113,9 @@ func (b *BlockOpsStandard) Ready(ctx context.Context, kmd KeyMetadata,
 		return
 	}
 
-	plainSize, encryptedBlock, err := crypto.EncryptBlock(block, blockKey)
+	compression := b.config.BlockCompressionForTLF(kmd.TlfID())
+	plainSize, encryptedBlock, err := crypto.EncryptBlock(
+		block, blockKey, compression)
 	if err != nil {
 		return
 	}
@@ -111,12 +126,14 @@ func (b *BlockOpsStandard) Ready(ctx context.Context, kmd KeyMetadata,
 	}
 
 	readyBlockData = ReadyBlockData{
-		buf:        buf,
-		serverHalf: serverHalf,
+		buf:             buf,
+		serverHalf:      serverHalf,
+		mayBeCompressed: compression != BlockCompressionNone,
 	}
 
+	// A compressed block may well be smaller than its encoding.
 	encodedSize := readyBlockData.GetEncodedSize()
-	if encodedSize < plainSize {
+	if compression == BlockCompressionNone && encodedSize < plainSize {
 		err = TooLowByteCountError{
 			ExpectedMinByteCount: plainSize,
 			ByteCount:            encodedSize,
@@ -99,7 +99,8 @@ func expectBlockEncrypt(config *ConfigMock, kmd KeyMetadata, decData Block, plai
 	encryptedBlock := EncryptedBlock{
 		EncryptedData: encData,
 	}
-	config.mockCrypto.EXPECT().EncryptBlock(decData, BlockCryptKey{}).
+	config.mockCrypto.EXPECT().EncryptBlock(decData, BlockCryptKey{},
+		BlockCompressionNone).
 		Return(plainSize, encryptedBlock, err)
 	if err == nil {
 		config.mockCodec.EXPECT().Encode(encryptedBlock).Return(encData, nil)
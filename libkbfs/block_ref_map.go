@@ -15,6 +15,17 @@ func (e blockContextMismatchError) Error() string {
 		"Context mismatch: expected %s, got %s", e.expected, e.actual)
 }
 
+func (s blockRefLocalStatus) String() string {
+	switch s {
+	case liveBlockRef:
+		return "live"
+	case archivedBlockRef:
+		return "archived"
+	default:
+		return fmt.Sprintf("blockRefLocalStatus(%d)", int(s))
+	}
+}
+
 type blockRefEntry struct {
 	status  blockRefLocalStatus
 	context BlockContext
@@ -0,0 +1,294 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultBlockGetParallelism is how many blocks background
+	// fetchers, like the syncer and GetSubtreeUsage, get at once
+	// until there are measurements to go by.  The default for puts
+	// is maxParallelBlockPuts.
+	defaultBlockGetParallelism = 10
+	// minBlockParallelism and maxBlockParallelism bound the
+	// parallelism derived from measurements.  Explicitly set
+	// values are only bounded by maxBlockParallelism.
+	minBlockParallelism = 2
+	maxBlockParallelism = 1000
+	// blockParallelismHeadroom is how many times the measured
+	// bandwidth-delay product, in blocks, are run at once.  While
+	// the link isn't saturated, that lets the parallelism keep
+	// growing with each measurement; once it is, adding more only
+	// adds contention, so it settles.
+	blockParallelismHeadroom = 2
+	// blockTransferEWMAWeight is the weight of each new sample in
+	// the moving averages.
+	blockTransferEWMAWeight = 0.1
+)
+
+type blockTransferKind int
+
+const (
+	blockTransferPut blockTransferKind = iota
+	blockTransferGet
+	numBlockTransferKinds
+)
+
+// blockTransferStats is what a BlockTransferMeter knows about one
+// kind of transfer.
+type blockTransferStats struct {
+	// configured is the parallelism that was set explicitly, or
+	// zero if it's to be derived from the measurements.
+	configured int
+	inFlight   int
+	// starts counts the transfers started so far.
+	starts uint64
+
+	// bytesPerSec, blockSize and latency are moving averages, and
+	// zero until measured.  bytesPerSec is only measured with
+	// transfers that started while the parallelism limit was
+	// reached, since otherwise it says more about how much there
+	// was to transfer than about the link.
+	bytesPerSec float64
+	blockSize   float64
+	latency     time.Duration
+}
+
+func (s *blockTransferStats) parallelism(def int) int {
+	if s.configured > 0 {
+		return s.configured
+	}
+	if s.bytesPerSec == 0 || s.blockSize == 0 || s.latency == 0 {
+		return def
+	}
+	p := int(math.Ceil(blockParallelismHeadroom * s.bytesPerSec *
+		s.latency.Seconds() / s.blockSize))
+	if p < minBlockParallelism {
+		return minBlockParallelism
+	}
+	if p > maxBlockParallelism {
+		return maxBlockParallelism
+	}
+	return p
+}
+
+func ewma(avg, sample float64) float64 {
+	if avg == 0 {
+		return sample
+	}
+	return avg + blockTransferEWMAWeight*(sample-avg)
+}
+
+// BlockTransferMeter measures the block puts and gets made to the
+// block server, and decides from that how many of each KBFS runs at
+// once: about twice as many as it takes to fill the pipe, given the
+// measured bandwidth and latency.  Either can also be set
+// explicitly.  All methods are safe to call on a nil
+// BlockTransferMeter, which just returns the defaults.
+type BlockTransferMeter struct {
+	clock Clock
+
+	lock  sync.Mutex
+	stats [numBlockTransferKinds]blockTransferStats
+}
+
+// NewBlockTransferMeter returns a BlockTransferMeter with no
+// measurements yet, that times transfers with the given clock.
+func NewBlockTransferMeter(clock Clock) *BlockTransferMeter {
+	return &BlockTransferMeter{clock: clock}
+}
+
+func defaultBlockParallelism(kind blockTransferKind) int {
+	if kind == blockTransferPut {
+		return maxParallelBlockPuts
+	}
+	return defaultBlockGetParallelism
+}
+
+func (m *BlockTransferMeter) parallelism(kind blockTransferKind) int {
+	if m == nil {
+		return defaultBlockParallelism(kind)
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.stats[kind].parallelism(defaultBlockParallelism(kind))
+}
+
+// PutParallelism returns how many blocks a single sync or journal
+// flush puts at once.
+func (m *BlockTransferMeter) PutParallelism() int {
+	return m.parallelism(blockTransferPut)
+}
+
+// GetParallelism returns how many blocks background fetchers, like
+// the syncer and GetSubtreeUsage, get at once.
+func (m *BlockTransferMeter) GetParallelism() int {
+	return m.parallelism(blockTransferGet)
+}
+
+// ConfiguredParallelism returns the parallelism last set with
+// SetParallelism.
+func (m *BlockTransferMeter) ConfiguredParallelism() (puts, gets int) {
+	if m == nil {
+		return 0, 0
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.stats[blockTransferPut].configured,
+		m.stats[blockTransferGet].configured
+}
+
+// SetParallelism sets the put and get parallelism.  Zero for either
+// means it's derived from the measurements again.
+func (m *BlockTransferMeter) SetParallelism(puts, gets int) error {
+	if puts < 0 || puts > maxBlockParallelism ||
+		gets < 0 || gets > maxBlockParallelism {
+		return fmt.Errorf("Block parallelism must be between 0 and %d, "+
+			"not puts=%d gets=%d", maxBlockParallelism, puts, gets)
+	}
+	if m == nil {
+		return nil
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.stats[blockTransferPut].configured = puts
+	m.stats[blockTransferGet].configured = gets
+	return nil
+}
+
+// ParseBlockParallelism parses a parallelism setting of the form
+// "puts=N gets=N", where either may be left out to keep its current
+// value, and "auto" in place of N, or "auto" alone, means derived
+// from the measurements.  It returns the resulting settings, to pass
+// to SetParallelism.
+func ParseBlockParallelism(s string, curPuts, curGets int) (
+	puts, gets int, err error) {
+	puts, gets = curPuts, curGets
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return 0, 0, fmt.Errorf("Empty block parallelism setting")
+	}
+	if len(fields) == 1 && fields[0] == "auto" {
+		return 0, 0, nil
+	}
+	for _, f := range fields {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			return 0, 0, fmt.Errorf(
+				"Block parallelism setting %q isn't key=value", f)
+		}
+		n := 0
+		if kv[1] != "auto" {
+			n, err = strconv.Atoi(kv[1])
+			if err != nil || n <= 0 {
+				return 0, 0, fmt.Errorf(
+					"Bad block parallelism %q", kv[1])
+			}
+		}
+		switch kv[0] {
+		case "puts":
+			puts = n
+		case "gets":
+			gets = n
+		default:
+			return 0, 0, fmt.Errorf(
+				"Unknown block parallelism setting %q", kv[0])
+		}
+	}
+	return puts, gets, nil
+}
+
+// start records the start of a transfer, and returns a function to
+// call with the number of bytes transferred once it's done, and any
+// error.
+func (m *BlockTransferMeter) start(
+	kind blockTransferKind) (done func(bytes int, err error)) {
+	if m == nil {
+		return func(int, error) {}
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	start := m.clock.Now()
+	s := &m.stats[kind]
+	s.inFlight++
+	s.starts++
+	inFlight, starts := s.inFlight, s.starts
+	saturated := inFlight >= s.parallelism(defaultBlockParallelism(kind))
+
+	return func(bytes int, err error) {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		s.inFlight--
+		latency := m.clock.Now().Sub(start)
+		if err != nil || latency <= 0 {
+			return
+		}
+		s.blockSize = ewma(s.blockSize, float64(bytes))
+		if inFlight == 1 && s.starts == starts {
+			// Only a transfer that had the link to itself
+			// the whole time tells the latency, without
+			// any time spent sharing it with others.
+			s.latency = time.Duration(
+				ewma(float64(s.latency), float64(latency)))
+		}
+		if saturated {
+			// By Little's law, the transfers in flight
+			// together move about this many bytes a second.
+			s.bytesPerSec = ewma(s.bytesPerSec,
+				float64(inFlight)*float64(bytes)/latency.Seconds())
+		}
+	}
+}
+
+// BlockTransferStatus describes the block transfers measured by a
+// BlockTransferMeter, and the parallelism derived from them.  It's
+// part of KBFSStatus.
+type BlockTransferStatus struct {
+	PutParallelism int
+	GetParallelism int
+	// PutConfigured and GetConfigured say whether each
+	// parallelism was set explicitly, rather than derived from
+	// the measurements.
+	PutConfigured bool
+	GetConfigured bool
+	// The measurements are zero until there have been enough
+	// transfers.  Bandwidth is only measured once the transfers
+	// of a kind reach their parallelism limit.
+	PutBytesPerSec float64
+	GetBytesPerSec float64
+	PutLatency     time.Duration
+	GetLatency     time.Duration
+}
+
+// Status returns the current measurements and parallelism.
+func (m *BlockTransferMeter) Status() BlockTransferStatus {
+	if m == nil {
+		return BlockTransferStatus{
+			PutParallelism: maxParallelBlockPuts,
+			GetParallelism: defaultBlockGetParallelism,
+		}
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	put := &m.stats[blockTransferPut]
+	get := &m.stats[blockTransferGet]
+	return BlockTransferStatus{
+		PutParallelism: put.parallelism(maxParallelBlockPuts),
+		GetParallelism: get.parallelism(defaultBlockGetParallelism),
+		PutConfigured:  put.configured > 0,
+		GetConfigured:  get.configured > 0,
+		PutBytesPerSec: put.bytesPerSec,
+		GetBytesPerSec: get.bytesPerSec,
+		PutLatency:     put.latency,
+		GetLatency:     get.latency,
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// runBlockTransferRound transfers one block of the given kind and
+// size on its own, and then n at once, finishing them as a link with
+// the given latency and bandwidth would, one after the other.  A zero
+// bandwidth finishes them after just the latency.
+func runBlockTransferRound(m *BlockTransferMeter, clock *TestClock,
+	kind blockTransferKind, n, size int, latency time.Duration,
+	bandwidth int) {
+	d := latency
+	if bandwidth > 0 {
+		d += time.Duration(size) * time.Second / time.Duration(bandwidth)
+	}
+	done := m.start(kind)
+	clock.Add(d)
+	done(size, nil)
+
+	start := clock.Now()
+	dones := make([]func(int, error), n)
+	for i := range dones {
+		dones[i] = m.start(kind)
+	}
+	for i, done := range dones {
+		d := latency
+		if bandwidth > 0 {
+			d += time.Duration(i+1) * time.Duration(size) *
+				time.Second / time.Duration(bandwidth)
+		}
+		clock.Set(start.Add(d))
+		done(size, nil)
+	}
+}
+
+func TestBlockTransferMeterDefaults(t *testing.T) {
+	var nilMeter *BlockTransferMeter
+	require.Equal(t, maxParallelBlockPuts, nilMeter.PutParallelism())
+	require.Equal(t, defaultBlockGetParallelism, nilMeter.GetParallelism())
+	nilMeter.start(blockTransferGet)(10, nil)
+
+	clock := newTestClockNow()
+	m := NewBlockTransferMeter(clock)
+	require.Equal(t, maxParallelBlockPuts, m.PutParallelism())
+	require.Equal(t, defaultBlockGetParallelism, m.GetParallelism())
+
+	// Transfers that never reach the limit don't measure the
+	// bandwidth, so the defaults stay.
+	for i := 0; i < 20; i++ {
+		runBlockTransferRound(
+			m, clock, blockTransferGet, 2, 64<<10, time.Second, 0)
+	}
+	require.Equal(t, defaultBlockGetParallelism, m.GetParallelism())
+	status := m.Status()
+	require.Equal(t, time.Second, status.GetLatency)
+	require.Zero(t, status.GetBytesPerSec)
+
+	// Failed transfers aren't measured at all.
+	m.start(blockTransferPut)(64<<10, errors.New("fail"))
+	require.Zero(t, m.Status().PutLatency)
+}
+
+func TestBlockTransferMeterAdapts(t *testing.T) {
+	clock := newTestClockNow()
+	m := NewBlockTransferMeter(clock)
+	const blockSize = 64 << 10
+	const latency = 100 * time.Millisecond
+
+	// On a link that isn't saturated, each round at the limit
+	// takes the same time, so the parallelism keeps growing.
+	for i := 0; i < 30; i++ {
+		runBlockTransferRound(m, clock, blockTransferGet,
+			m.GetParallelism(), blockSize, latency, 0)
+	}
+	fast := m.GetParallelism()
+	require.True(t, fast > 4*defaultBlockGetParallelism,
+		"Parallelism only grew to %d", fast)
+
+	// On a 1 MB/s link, where a lone block takes 162.5ms, the
+	// parallelism settles on about twice the bandwidth-delay
+	// product, 2 * 1 MB/s * 162.5ms / 64 KB = 5.2 blocks.
+	for i := 0; i < 200; i++ {
+		runBlockTransferRound(m, clock, blockTransferGet,
+			m.GetParallelism(), blockSize, latency, 1<<20)
+	}
+	slow := m.GetParallelism()
+	require.True(t, slow >= 4 && slow <= 8,
+		"Parallelism settled on %d", slow)
+
+	// Puts are measured separately.
+	require.Equal(t, maxParallelBlockPuts, m.PutParallelism())
+}
+
+func TestBlockTransferMeterConfigured(t *testing.T) {
+	clock := newTestClockNow()
+	m := NewBlockTransferMeter(clock)
+	require.NoError(t, m.SetParallelism(7, 0))
+	require.Equal(t, 7, m.PutParallelism())
+	require.Equal(t, defaultBlockGetParallelism, m.GetParallelism())
+	status := m.Status()
+	require.True(t, status.PutConfigured)
+	require.False(t, status.GetConfigured)
+
+	require.Error(t, m.SetParallelism(-1, 0))
+	require.Error(t, m.SetParallelism(0, maxBlockParallelism+1))
+
+	puts, gets := m.ConfiguredParallelism()
+	puts, gets, err := ParseBlockParallelism("gets=3", puts, gets)
+	require.NoError(t, err)
+	require.Equal(t, 7, puts)
+	require.Equal(t, 3, gets)
+	puts, gets, err = ParseBlockParallelism("puts=auto gets=5", puts, gets)
+	require.NoError(t, err)
+	require.Equal(t, 0, puts)
+	require.Equal(t, 5, gets)
+	puts, gets, err = ParseBlockParallelism("auto", puts, gets)
+	require.NoError(t, err)
+	require.Equal(t, 0, puts)
+	require.Equal(t, 0, gets)
+
+	for _, bad := range []string{"", "puts", "puts=0", "puts=x", "foo=1"} {
+		_, _, err = ParseBlockParallelism(bad, 1, 1)
+		require.Error(t, err, bad)
+	}
+}
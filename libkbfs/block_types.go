@@ -72,6 +72,19 @@ type DirBlock struct {
 	IPtrs []IndirectDirPtr `codec:"i,omitempty"`
 }
 
+// DataVersion returns data version for this block.
+func (db *DirBlock) DataVersion() DataVer {
+	if !db.IsInd {
+		return FirstValidDataVer
+	}
+	for i := range db.IPtrs {
+		if db.IPtrs[i].DataVer.mayBeCompressed() {
+			return CompressedBlocksDataVer
+		}
+	}
+	return IndirectDirsDataVer
+}
+
 // NewDirBlock creates a new, empty DirBlock.
 func NewDirBlock() Block {
 	return &DirBlock{
@@ -92,6 +105,24 @@ func (db DirBlock) DeepCopy(codec Codec) (*DirBlock, error) {
 	return &dirBlockCopy, nil
 }
 
+// copyChildren makes a copy of a DirBlock whose entries can be added,
+// replaced and removed without affecting the original, without
+// encoding it.  The entries are copied as values, so, like any
+// DirEntry taken out of a cached block, they must be replaced rather
+// than modified in place.
+func (db DirBlock) copyChildren() *DirBlock {
+	dirBlockCopy := DirBlock{
+		CommonBlock: db.CommonBlock,
+		Children:    make(map[string]DirEntry, len(db.Children)),
+		IPtrs:       append([]IndirectDirPtr(nil), db.IPtrs...),
+	}
+	dirBlockCopy.SetEncodedSize(0)
+	for name, de := range db.Children {
+		dirBlockCopy.Children[name] = de
+	}
+	return &dirBlockCopy
+}
+
 // FileBlock is the contents of a file
 type FileBlock struct {
 	CommonBlock
@@ -103,6 +134,15 @@ type FileBlock struct {
 	// this is used for caching plaintext (block.Contents) hash. It is used by
 	// only direct blocks.
 	hash *RawDefaultHash
+
+	// parents is only set for the top block of a file with more
+	// than one level of indirect blocks as getFileTreeLocked puts it
+	// together, whose IPtrs are then those of all the bottom-level
+	// ones.  It holds the pointers
+	// to the indirect blocks in between, level by level from the
+	// bottom; the last level is what's encoded as the top block's
+	// own IPtrs.  It isn't encoded.
+	parents [][]IndirectFilePtr
 }
 
 // NewFileBlock creates a new, empty FileBlock.
@@ -115,13 +155,27 @@ func NewFileBlock() Block {
 // DataVersion returns data version for this block.
 func (fb *FileBlock) DataVersion() DataVer {
 	for i := range fb.IPtrs {
-		if fb.IPtrs[i].Holes {
-			return FilesWithHolesDataVer
+		if fb.IPtrs[i].DataVer.mayBeCompressed() {
+			return CompressedBlocksDataVer
 		}
 	}
+	if fb.hasHoles() {
+		return FilesWithHolesDataVer
+	}
 	return FirstValidDataVer
 }
 
+// hasHoles returns whether any of the pointers of this indirect block
+// lead to holes.
+func (fb *FileBlock) hasHoles() bool {
+	for i := range fb.IPtrs {
+		if fb.IPtrs[i].Holes {
+			return true
+		}
+	}
+	return false
+}
+
 // DeepCopy makes a complete copy of a FileBlock
 func (fb FileBlock) DeepCopy(codec Codec) (*FileBlock, error) {
 	var fileBlockCopy FileBlock
@@ -129,6 +183,9 @@ func (fb FileBlock) DeepCopy(codec Codec) (*FileBlock, error) {
 	if err != nil {
 		return nil, err
 	}
+	// The parents are never modified in place, so they can be
+	// shared.
+	fileBlockCopy.parents = fb.parents
 	return &fileBlockCopy, nil
 }
 
@@ -180,6 +180,7 @@ func makeFakeFileBlockFuture(t *testing.T) fileBlockFuture {
 			[]byte{0xa, 0xb},
 			nil,
 			nil,
+			nil,
 		},
 		[]indirectFilePtrFuture{
 			makeFakeIndirectFilePtrFuture(t),
@@ -191,3 +192,28 @@ func makeFakeFileBlockFuture(t *testing.T) fileBlockFuture {
 func TestFileBlockUnknownFields(t *testing.T) {
 	testStructUnknownFields(t, makeFakeFileBlockFuture(t))
 }
+
+func TestDirBlockCopyChildren(t *testing.T) {
+	dblock := NewDirBlock().(*DirBlock)
+	dblock.IsInd = true
+	dblock.IPtrs = []IndirectDirPtr{{BlockInfo: makeFakeBlockInfo(t)}}
+	dblock.Children["a"] = DirEntry{BlockInfo: makeFakeBlockInfo(t)}
+	dblock.Children["b"] = DirEntry{EntryInfo: EntryInfo{Type: Dir}}
+	dblock.SetEncodedSize(100)
+
+	dcopy := dblock.copyChildren()
+	require.Equal(t, dblock.Children, dcopy.Children)
+	require.Equal(t, dblock.IPtrs, dcopy.IPtrs)
+	require.True(t, dcopy.IsInd)
+	require.Equal(t, uint32(0), dcopy.GetEncodedSize())
+
+	// Changing the copy leaves the original alone.
+	de := dcopy.Children["a"]
+	de.Size = 10
+	dcopy.Children["a"] = de
+	delete(dcopy.Children, "b")
+	dcopy.IPtrs[0].Off = "x"
+	require.Equal(t, uint64(0), dblock.Children["a"].Size)
+	require.Contains(t, dblock.Children, "b")
+	require.Equal(t, "", dblock.IPtrs[0].Off)
+}
@@ -22,9 +22,12 @@ func isRecoverableBlockError(err error) bool {
 // putBlockToServer either puts the full block to the block server, or
 // just adds a reference, depending on the refnonce in blockPtr.
 func putBlockToServer(ctx context.Context, bserv BlockServer, tlfID TlfID,
-	blockPtr BlockPointer, readyBlockData ReadyBlockData) error {
-	var err error
+	blockPtr BlockPointer, readyBlockData ReadyBlockData) (err error) {
+	ctx, span := startSpan(ctx, nil, "BlockServer.Put")
+	span.SetTag("block", blockPtr.ID.String())
+	defer func() { span.Finish(err) }()
 	if blockPtr.RefNonce == zeroBlockRefNonce {
+		span.SetTag("size", len(readyBlockData.buf))
 		err = bserv.Put(ctx, tlfID, blockPtr.ID, blockPtr.BlockContext,
 			readyBlockData.buf, readyBlockData.serverHalf)
 	} else {
@@ -48,29 +51,183 @@ func putBlockCheckQuota(ctx context.Context, bserv BlockServer,
 	return err
 }
 
-func doOneBlockPut(ctx context.Context, bserv BlockServer, reporter Reporter,
-	tlfID TlfID, tlfName CanonicalTlfName, blockState blockState,
-	errChan chan error, blocksToRemoveChan chan *FileBlock) {
-	err := putBlockCheckQuota(ctx, bserv, reporter, tlfID, blockState.blockPtr,
-		blockState.readyBlockData, tlfName)
-	if err == nil && blockState.syncedCb != nil {
-		err = blockState.syncedCb()
-	}
-	if err != nil {
-		if isRecoverableBlockError(err) {
-			fblock, ok := blockState.block.(*FileBlock)
-			if ok && !fblock.IsInd {
-				blocksToRemoveChan <- fblock
-			}
+// blockPutPipeline puts blocks to a block server (or journal) as
+// they're handed to it, with up to a given number of puts at once,
+// so that a sync can start putting its first blocks while later ones
+// are still being readied.  A put error doesn't stop the other puts,
+// to amortize the work of redoing the put if the error is
+// recoverable, but a canceled context does.
+type blockPutPipeline struct {
+	ctx         context.Context
+	cancel      context.CancelFunc
+	bserv       BlockServer
+	reporter    Reporter
+	log         logger.Logger
+	tlfID       TlfID
+	tlfName     CanonicalTlfName
+	parallelism int
+
+	// errChan holds the first put error.
+	errChan chan error
+	wg      sync.WaitGroup
+
+	lock    sync.Mutex
+	queue   []blockState
+	workers int
+	closed  bool
+	// toRemove holds the file blocks whose puts got recoverable
+	// errors.
+	toRemove []blockState
+}
+
+// newBlockPutPipeline returns a blockPutPipeline that puts blocks
+// under a child of the given context.  Either wait or cancel must
+// eventually be called on it.
+func newBlockPutPipeline(ctx context.Context, bserv BlockServer,
+	reporter Reporter, log logger.Logger, tlfID TlfID,
+	tlfName CanonicalTlfName, parallelism int) *blockPutPipeline {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return &blockPutPipeline{
+		ctx:         ctx,
+		cancel:      cancel,
+		bserv:       bserv,
+		reporter:    reporter,
+		log:         log,
+		tlfID:       tlfID,
+		tlfName:     tlfName,
+		parallelism: parallelism,
+		errChan:     make(chan error, 1),
+	}
+}
+
+func (p *blockPutPipeline) setErr(err error) {
+	select {
+	case p.errChan <- err:
+	default:
+	}
+}
+
+func (p *blockPutPipeline) putOne(bs blockState) {
+	err := putBlockCheckQuota(p.ctx, p.bserv, p.reporter, p.tlfID,
+		bs.blockPtr, bs.readyBlockData, p.tlfName)
+	if err == nil && bs.syncedCb != nil {
+		err = bs.syncedCb()
+	}
+	if err == nil {
+		return
+	}
+	if isRecoverableBlockError(err) {
+		fblock, ok := bs.block.(*FileBlock)
+		if ok && !fblock.IsInd {
+			p.lock.Lock()
+			p.toRemove = append(p.toRemove, bs)
+			p.lock.Unlock()
+		}
+	}
+	p.setErr(err)
+}
+
+func (p *blockPutPipeline) work() {
+	defer p.wg.Done()
+	for {
+		p.lock.Lock()
+		if len(p.queue) == 0 {
+			p.workers--
+			p.lock.Unlock()
+			return
 		}
+		if err := p.ctx.Err(); err != nil {
+			// Leave the rest of the queue unput.
+			p.queue = nil
+			p.workers--
+			p.lock.Unlock()
+			p.setErr(err)
+			return
+		}
+		bs := p.queue[0]
+		p.queue = p.queue[1:]
+		p.lock.Unlock()
+
+		p.putOne(bs)
+	}
+}
+
+// put queues bs to be put.  It never blocks on the puts themselves;
+// how many blocks a sync can have readied at once is already bounded
+// by the dirty block cache.  It returns an error only if the
+// pipeline's context is done.
+func (p *blockPutPipeline) put(bs blockState) error {
+	if err := p.ctx.Err(); err != nil {
+		return err
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		panic("put on a blockPutPipeline that's being waited on")
+	}
+	p.queue = append(p.queue, bs)
+	if p.workers < p.parallelism {
+		p.workers++
+		p.wg.Add(1)
+		go p.work()
+	}
+	return nil
+}
+
+// wait waits for all the queued puts to finish, or for the first
+// error, and then cancels any puts still running.  If the error
+// satisfies isRecoverableBlockError(err), the caller should retry its
+// entire operation, starting from when the MD successor was created.
+// In that case, it also waits for all the puts to finish first, and
+// returns the pointers of the blocks that got recoverable errors and
+// should be removed by the caller from any saved state; the blocks
+// are removed from bcache, so the redo can just make new ones
+// instead.
+func (p *blockPutPipeline) wait(bcache BlockCache) (
+	[]BlockPointer, error) {
+	defer p.cancel()
+	p.lock.Lock()
+	p.closed = true
+	p.lock.Unlock()
 
-		// one error causes everything else to cancel
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case err = <-p.errChan:
+	case <-done:
 		select {
-		case errChan <- err:
+		case err = <-p.errChan:
 		default:
-			return
 		}
 	}
+	if !isRecoverableBlockError(err) {
+		return nil, err
+	}
+
+	// Wait for all the outstanding puts to finish, to amortize the
+	// work of re-doing the put.
+	<-done
+	var blocksToRemove []BlockPointer
+	for _, bs := range p.toRemove {
+		// Let the caller know which blocks shouldn't be retried.
+		blocksToRemove = append(blocksToRemove, bs.blockPtr)
+
+		// Remove each problematic block from the cache so the
+		// redo can just make a new block instead.
+		if err := bcache.DeleteKnownPtr(
+			p.tlfID, bs.block.(*FileBlock)); err != nil {
+			p.log.CWarningf(p.ctx,
+				"Couldn't delete ptr for a block: %v", err)
+		}
+	}
+	return blocksToRemove, err
 }
 
 // doBlockPuts writes all the pending block puts to the cache and
@@ -78,75 +235,20 @@ func doOneBlockPut(ctx context.Context, bserv BlockServer, reporter Reporter,
 // isRecoverableBlockError(err), the caller should retry its entire
 // operation, starting from when the MD successor was created.
 //
+// At most parallelism blocks are put at once.
+//
 // Returns a slice of block pointers that resulted in recoverable
 // errors and should be removed by the caller from any saved state.
 func doBlockPuts(ctx context.Context, bserv BlockServer, bcache BlockCache,
 	reporter Reporter, log logger.Logger, tlfID TlfID, tlfName CanonicalTlfName,
-	bps blockPutState) ([]BlockPointer, error) {
-	errChan := make(chan error, 1)
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-	blocks := make(chan blockState, len(bps.blockStates))
-	var wg sync.WaitGroup
-
-	numWorkers := len(bps.blockStates)
-	if numWorkers > maxParallelBlockPuts {
-		numWorkers = maxParallelBlockPuts
-	}
-	wg.Add(numWorkers)
-	// A channel to list any blocks that have been archived or
-	// deleted.  Any of these will result in an error, so the maximum
-	// we'll get is the same as the number of workers.
-	blocksToRemoveChan := make(chan *FileBlock, numWorkers)
-
-	worker := func() {
-		defer wg.Done()
-		for blockState := range blocks {
-			doOneBlockPut(ctx, bserv, reporter, tlfID, tlfName,
-				blockState, errChan, blocksToRemoveChan)
-			select {
-			// return early if the context has been canceled
-			case <-ctx.Done():
-				return
-			default:
-			}
-		}
-	}
-	for i := 0; i < numWorkers; i++ {
-		go worker()
-	}
-
-	for _, blockState := range bps.blockStates {
-		blocks <- blockState
-	}
-	close(blocks)
-
-	go func() {
-		wg.Wait()
-		close(errChan)
-		close(blocksToRemoveChan)
-	}()
-	err := <-errChan
-	var blocksToRemove []BlockPointer
-	if isRecoverableBlockError(err) {
-		// Wait for all the outstanding puts to finish, to amortize
-		// the work of re-doing the put.
-		for fblock := range blocksToRemoveChan {
-			for i, bs := range bps.blockStates {
-				if bs.block == fblock {
-					// Let the caller know which blocks shouldn't be
-					// retried.
-					blocksToRemove = append(blocksToRemove,
-						bps.blockStates[i].blockPtr)
-				}
-			}
-
-			// Remove each problematic block from the cache so the
-			// redo can just make a new block instead.
-			if err := bcache.DeleteKnownPtr(tlfID, fblock); err != nil {
-				log.CWarningf(ctx, "Couldn't delete ptr for a block: %v", err)
-			}
+	bps blockPutState, parallelism int) ([]BlockPointer, error) {
+	p := newBlockPutPipeline(
+		ctx, bserv, reporter, log, tlfID, tlfName, parallelism)
+	for _, bs := range bps.blockStates {
+		if err := p.put(bs); err != nil {
+			p.cancel()
+			return nil, err
 		}
 	}
-	return blocksToRemove, err
+	return p.wait(bcache)
 }
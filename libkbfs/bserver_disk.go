@@ -163,8 +163,9 @@ func (b *BlockServerDisk) Put(ctx context.Context, tlfID TlfID, id BlockID,
 	b.log.CDebugf(ctx, "BlockServerDisk.Put id=%s tlfID=%s context=%s size=%d",
 		id, tlfID, context, len(buf))
 
-	if context.GetRefNonce() != zeroBlockRefNonce {
-		return fmt.Errorf("Can't Put() a block with a non-zero refnonce.")
+	err = context.checkForPut()
+	if err != nil {
+		return err
 	}
 
 	tlfStorage, err := b.getStorage(ctx, tlfID)
@@ -186,6 +187,11 @@ func (b *BlockServerDisk) AddBlockReference(ctx context.Context, tlfID TlfID,
 	id BlockID, context BlockContext) error {
 	b.log.CDebugf(ctx, "BlockServerDisk.AddBlockReference id=%s "+
 		"tlfID=%s context=%s", id, tlfID, context)
+	err := context.checkForAddReference()
+	if err != nil {
+		return err
+	}
+
 	tlfStorage, err := b.getStorage(ctx, tlfID)
 	if err != nil {
 		return err
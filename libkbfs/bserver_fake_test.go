@@ -0,0 +1,375 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// fakeBlockServerOp is a BlockServer operation whose behavior a
+// fakeBlockServer test can script.
+type fakeBlockServerOp int
+
+const (
+	fakeBServerGet fakeBlockServerOp = iota
+	fakeBServerPut
+	fakeBServerAddReference
+	fakeBServerRemoveReferences
+	fakeBServerArchiveReferences
+	numFakeBServerOps
+)
+
+func (op fakeBlockServerOp) String() string {
+	switch op {
+	case fakeBServerGet:
+		return "Get"
+	case fakeBServerPut:
+		return "Put"
+	case fakeBServerAddReference:
+		return "AddBlockReference"
+	case fakeBServerRemoveReferences:
+		return "RemoveBlockReferences"
+	case fakeBServerArchiveReferences:
+		return "ArchiveBlockReferences"
+	default:
+		return fmt.Sprintf("fakeBlockServerOp(%d)", int(op))
+	}
+}
+
+// fakeBlockServerGate holds calls until the test lets them through.
+// Each call sends on ready (if non-nil) when it arrives, waits to
+// receive from proceed (or for it to be closed, or for its context
+// to be canceled), and then sends on finished (if non-nil) once it's
+// done, even if it failed.
+type fakeBlockServerGate struct {
+	ready    chan struct{}
+	proceed  chan struct{}
+	finished chan struct{}
+}
+
+func newFakeBlockServerGate() *fakeBlockServerGate {
+	return &fakeBlockServerGate{
+		ready:    make(chan struct{}),
+		proceed:  make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+}
+
+// fakeBlockServerStep says what happens to one call.
+type fakeBlockServerStep struct {
+	// delay is how long the call sleeps before doing anything
+	// else, unless its context is canceled first.
+	delay time.Duration
+	// gate, if non-nil, holds the call after the delay.
+	gate *fakeBlockServerGate
+	// err, if non-nil, is returned without handling the call.
+	err error
+}
+
+// fakeBlockServerCall records one call made to a fakeBlockServer.
+// For the reference operations, there's one record per block ID.
+type fakeBlockServerCall struct {
+	op  fakeBlockServerOp
+	id  BlockID
+	ctx BlockContext
+	err error
+}
+
+// fakeBlockServer is a BlockServer test double backed by a
+// BlockServerMemory.  For each operation, a test can script delays,
+// gates, and errors, either for the next few calls or for all of
+// them, and can limit how many calls run at once.  It records every
+// call, and checks that the client's use of block references makes
+// sense; see checkInvariants.
+type fakeBlockServer struct {
+	*BlockServerMemory
+
+	lock       sync.Mutex
+	scripts    [numFakeBServerOps][]fakeBlockServerStep
+	defaults   [numFakeBServerOps]fakeBlockServerStep
+	throttles  [numFakeBServerOps]chan struct{}
+	inFlight   [numFakeBServerOps]int
+	maxFlight  [numFakeBServerOps]int
+	calls      []fakeBlockServerCall
+	refs       map[BlockID]map[BlockRefNonce]bool
+	violations []string
+}
+
+var _ blockServerLocal = (*fakeBlockServer)(nil)
+
+func newFakeBlockServer(config Config) *fakeBlockServer {
+	return &fakeBlockServer{
+		BlockServerMemory: NewBlockServerMemory(
+			blockServerLocalConfigAdapter{config}),
+		refs: make(map[BlockID]map[BlockRefNonce]bool),
+	}
+}
+
+// script queues up steps for the next calls of op, one per call.
+// Once they've been used up, calls go back to the default step.
+func (fbs *fakeBlockServer) script(
+	op fakeBlockServerOp, steps ...fakeBlockServerStep) {
+	fbs.lock.Lock()
+	defer fbs.lock.Unlock()
+	fbs.scripts[op] = append(fbs.scripts[op], steps...)
+}
+
+// setDefault sets the step for calls of op that haven't been
+// scripted.
+func (fbs *fakeBlockServer) setDefault(
+	op fakeBlockServerOp, step fakeBlockServerStep) {
+	fbs.lock.Lock()
+	defer fbs.lock.Unlock()
+	fbs.defaults[op] = step
+}
+
+// setThrottle limits the number of calls of op that run at once to
+// n, or removes the limit if n is 0.  Calls that are already running
+// don't count against a new limit.
+func (fbs *fakeBlockServer) setThrottle(op fakeBlockServerOp, n int) {
+	fbs.lock.Lock()
+	defer fbs.lock.Unlock()
+	if n == 0 {
+		fbs.throttles[op] = nil
+		return
+	}
+	fbs.throttles[op] = make(chan struct{}, n)
+}
+
+// maxInFlight returns the largest number of calls of op that have
+// run at once.
+func (fbs *fakeBlockServer) maxInFlight(op fakeBlockServerOp) int {
+	fbs.lock.Lock()
+	defer fbs.lock.Unlock()
+	return fbs.maxFlight[op]
+}
+
+// getCalls returns every call made so far, in the order they
+// finished.
+func (fbs *fakeBlockServer) getCalls() []fakeBlockServerCall {
+	fbs.lock.Lock()
+	defer fbs.lock.Unlock()
+	return append([]fakeBlockServerCall(nil), fbs.calls...)
+}
+
+// checkInvariants returns an error describing every misuse of block
+// references seen so far: references removed or archived that were
+// never added, or that were already removed, and live counts from
+// the server that don't match the references the client has added.
+func (fbs *fakeBlockServer) checkInvariants() error {
+	fbs.lock.Lock()
+	defer fbs.lock.Unlock()
+	if len(fbs.violations) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d block reference invariant violations: %v",
+		len(fbs.violations), fbs.violations)
+}
+
+func (fbs *fakeBlockServer) nextStep(
+	op fakeBlockServerOp) fakeBlockServerStep {
+	fbs.lock.Lock()
+	defer fbs.lock.Unlock()
+	if len(fbs.scripts[op]) > 0 {
+		step := fbs.scripts[op][0]
+		fbs.scripts[op] = fbs.scripts[op][1:]
+		return step
+	}
+	return fbs.defaults[op]
+}
+
+// begin runs the scripted step for a call of op, and returns a
+// function to call when it's done, along with any error the call
+// should return instead of being handled.
+func (fbs *fakeBlockServer) begin(ctx context.Context,
+	op fakeBlockServerOp) (done func(), err error) {
+	fbs.lock.Lock()
+	throttle := fbs.throttles[op]
+	fbs.lock.Unlock()
+	if throttle != nil {
+		select {
+		case throttle <- struct{}{}:
+		case <-ctx.Done():
+			return func() {}, ctx.Err()
+		}
+	}
+
+	fbs.lock.Lock()
+	fbs.inFlight[op]++
+	if fbs.inFlight[op] > fbs.maxFlight[op] {
+		fbs.maxFlight[op] = fbs.inFlight[op]
+	}
+	fbs.lock.Unlock()
+
+	step := fbs.nextStep(op)
+	done = func() {
+		if step.gate != nil && step.gate.finished != nil {
+			step.gate.finished <- struct{}{}
+		}
+		fbs.lock.Lock()
+		fbs.inFlight[op]--
+		fbs.lock.Unlock()
+		if throttle != nil {
+			<-throttle
+		}
+	}
+
+	if step.delay > 0 {
+		select {
+		case <-time.After(step.delay):
+		case <-ctx.Done():
+			return done, ctx.Err()
+		}
+	}
+	if step.gate != nil {
+		if step.gate.ready != nil {
+			step.gate.ready <- struct{}{}
+		}
+		select {
+		case <-step.gate.proceed:
+		case <-ctx.Done():
+			return done, ctx.Err()
+		}
+	}
+	return done, step.err
+}
+
+// fbs.lock should be taken by the caller.
+func (fbs *fakeBlockServer) violationLocked(format string,
+	args ...interface{}) {
+	fbs.violations = append(fbs.violations, fmt.Sprintf(format, args...))
+}
+
+func (fbs *fakeBlockServer) recordLocked(op fakeBlockServerOp, id BlockID,
+	bctx BlockContext, err error) {
+	fbs.calls = append(fbs.calls, fakeBlockServerCall{op, id, bctx, err})
+}
+
+// Get implements the BlockServer interface for fakeBlockServer.
+func (fbs *fakeBlockServer) Get(ctx context.Context, tlfID TlfID, id BlockID,
+	bctx BlockContext) (
+	buf []byte, serverHalf BlockCryptKeyServerHalf, err error) {
+	done, err := fbs.begin(ctx, fakeBServerGet)
+	defer done()
+	if err == nil {
+		buf, serverHalf, err = fbs.BlockServerMemory.Get(ctx, tlfID, id, bctx)
+	}
+	fbs.lock.Lock()
+	defer fbs.lock.Unlock()
+	fbs.recordLocked(fakeBServerGet, id, bctx, err)
+	return buf, serverHalf, err
+}
+
+// Put implements the BlockServer interface for fakeBlockServer.
+func (fbs *fakeBlockServer) Put(ctx context.Context, tlfID TlfID, id BlockID,
+	bctx BlockContext, buf []byte,
+	serverHalf BlockCryptKeyServerHalf) error {
+	done, err := fbs.begin(ctx, fakeBServerPut)
+	defer done()
+	if err == nil {
+		err = fbs.BlockServerMemory.Put(
+			ctx, tlfID, id, bctx, buf, serverHalf)
+	}
+	fbs.lock.Lock()
+	defer fbs.lock.Unlock()
+	fbs.recordLocked(fakeBServerPut, id, bctx, err)
+	if err == nil {
+		if fbs.refs[id] == nil {
+			fbs.refs[id] = make(map[BlockRefNonce]bool)
+		}
+		fbs.refs[id][bctx.GetRefNonce()] = true
+	}
+	return err
+}
+
+// AddBlockReference implements the BlockServer interface for
+// fakeBlockServer.
+func (fbs *fakeBlockServer) AddBlockReference(ctx context.Context,
+	tlfID TlfID, id BlockID, bctx BlockContext) error {
+	done, err := fbs.begin(ctx, fakeBServerAddReference)
+	defer done()
+	if err == nil {
+		err = fbs.BlockServerMemory.AddBlockReference(ctx, tlfID, id, bctx)
+	}
+	fbs.lock.Lock()
+	defer fbs.lock.Unlock()
+	fbs.recordLocked(fakeBServerAddReference, id, bctx, err)
+	if err == nil {
+		if fbs.refs[id] == nil {
+			fbs.violationLocked("%s added to unknown block %s", bctx, id)
+			fbs.refs[id] = make(map[BlockRefNonce]bool)
+		}
+		fbs.refs[id][bctx.GetRefNonce()] = true
+	}
+	return err
+}
+
+// RemoveBlockReferences implements the BlockServer interface for
+// fakeBlockServer.
+func (fbs *fakeBlockServer) RemoveBlockReferences(ctx context.Context,
+	tlfID TlfID, contexts map[BlockID][]BlockContext) (
+	liveCounts map[BlockID]int, err error) {
+	done, err := fbs.begin(ctx, fakeBServerRemoveReferences)
+	defer done()
+	if err == nil {
+		liveCounts, err = fbs.BlockServerMemory.RemoveBlockReferences(
+			ctx, tlfID, contexts)
+	}
+	fbs.lock.Lock()
+	defer fbs.lock.Unlock()
+	for id, idContexts := range contexts {
+		for _, bctx := range idContexts {
+			fbs.recordLocked(fakeBServerRemoveReferences, id, bctx, err)
+			if err != nil {
+				continue
+			}
+			nonce := bctx.GetRefNonce()
+			if !fbs.refs[id][nonce] {
+				fbs.violationLocked("%s of block %s removed but not live",
+					bctx, id)
+			}
+			delete(fbs.refs[id], nonce)
+		}
+		if err != nil {
+			continue
+		}
+		if len(fbs.refs[id]) == 0 {
+			delete(fbs.refs, id)
+		}
+		if count := len(fbs.refs[id]); liveCounts[id] != count {
+			fbs.violationLocked("block %s has %d live references, "+
+				"but the client added %d", id, liveCounts[id], count)
+		}
+	}
+	return liveCounts, err
+}
+
+// ArchiveBlockReferences implements the BlockServer interface for
+// fakeBlockServer.
+func (fbs *fakeBlockServer) ArchiveBlockReferences(ctx context.Context,
+	tlfID TlfID, contexts map[BlockID][]BlockContext) error {
+	done, err := fbs.begin(ctx, fakeBServerArchiveReferences)
+	defer done()
+	if err == nil {
+		err = fbs.BlockServerMemory.ArchiveBlockReferences(
+			ctx, tlfID, contexts)
+	}
+	fbs.lock.Lock()
+	defer fbs.lock.Unlock()
+	for id, idContexts := range contexts {
+		for _, bctx := range idContexts {
+			fbs.recordLocked(fakeBServerArchiveReferences, id, bctx, err)
+			if err == nil && !fbs.refs[id][bctx.GetRefNonce()] {
+				fbs.violationLocked("%s of block %s archived but not live",
+					bctx, id)
+			}
+		}
+	}
+	return err
+}
@@ -25,8 +25,12 @@ var _ BlockServer = BlockServerMeasured{}
 // NewBlockServerMeasured creates and returns a new
 // BlockServerMeasured instance with the given delegate and registry.
 func NewBlockServerMeasured(delegate BlockServer, r metrics.Registry) BlockServerMeasured {
-	getTimer := metrics.GetOrRegisterTimer("BlockServer.Get", r)
-	putTimer := metrics.GetOrRegisterTimer("BlockServer.Put", r)
+	// Name the timers for stallable ops after the op, like
+	// MDOpsMeasured does.
+	getTimer := metrics.GetOrRegisterTimer(
+		"BlockServer."+string(StallableBlockGet), r)
+	putTimer := metrics.GetOrRegisterTimer(
+		"BlockServer."+string(StallableBlockPut), r)
 	addBlockReferenceTimer := metrics.GetOrRegisterTimer("BlockServer.AddBlockReference", r)
 	removeBlockReferencesTimer := metrics.GetOrRegisterTimer("BlockServer.RemoveBlockReferences", r)
 	archiveBlockReferencesTimer := metrics.GetOrRegisterTimer("BlockServer.ArchiveBlockReferences", r)
@@ -29,6 +29,8 @@ type BlockServerMemory struct {
 	lock sync.RWMutex
 	// m is nil after Shutdown() is called.
 	m map[BlockID]blockMemEntry
+	// netsim, if non-nil, simulates the network to the server.
+	netsim *NetworkSimulator
 }
 
 var _ blockServerLocal = (*BlockServerMemory)(nil)
@@ -37,13 +39,28 @@ var _ blockServerLocal = (*BlockServerMemory)(nil)
 // its data in memory.
 func NewBlockServerMemory(config blockServerLocalConfig) *BlockServerMemory {
 	return &BlockServerMemory{
-		config.cryptoPure(),
-		config.MakeLogger("BSM"),
-		sync.RWMutex{},
-		make(map[BlockID]blockMemEntry),
+		crypto: config.cryptoPure(),
+		log:    config.MakeLogger("BSM"),
+		m:      make(map[BlockID]blockMemEntry),
 	}
 }
 
+// SetNetworkSimulator makes calls to b go through the given network
+// simulator, or through none if it's nil.  Since all the users of a
+// test share their block server, they all share the simulated
+// network too.
+func (b *BlockServerMemory) SetNetworkSimulator(ns *NetworkSimulator) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.netsim = ns
+}
+
+func (b *BlockServerMemory) networkSimulator() *NetworkSimulator {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.netsim
+}
+
 var errBlockServerMemoryShutdown = errors.New("BlockServerMemory is shutdown")
 
 // Get implements the BlockServer interface for BlockServerMemory.
@@ -55,6 +72,22 @@ func (b *BlockServerMemory) Get(ctx context.Context, tlfID TlfID, id BlockID,
 	}()
 	b.log.CDebugf(ctx, "BlockServerMemory.Get id=%s tlfID=%s context=%s",
 		id, tlfID, context)
+	ns := b.networkSimulator()
+	if err := ns.request(ctx, "Get", 0); err != nil {
+		return nil, BlockCryptKeyServerHalf{}, err
+	}
+	data, serverHalf, err = b.get(tlfID, id, context)
+	if err != nil {
+		return nil, BlockCryptKeyServerHalf{}, err
+	}
+	if err := ns.reply(ctx, "Get", len(data)); err != nil {
+		return nil, BlockCryptKeyServerHalf{}, err
+	}
+	return data, serverHalf, nil
+}
+
+func (b *BlockServerMemory) get(tlfID TlfID, id BlockID,
+	context BlockContext) ([]byte, BlockCryptKeyServerHalf, error) {
 	b.lock.RLock()
 	defer b.lock.RUnlock()
 
@@ -73,7 +106,7 @@ func (b *BlockServerMemory) Get(ctx context.Context, tlfID TlfID, id BlockID,
 				entry.tlfID, tlfID)
 	}
 
-	err = entry.refs.checkExists(context)
+	err := entry.refs.checkExists(context)
 	if err != nil {
 		return nil, BlockCryptKeyServerHalf{}, err
 	}
@@ -83,13 +116,9 @@ func (b *BlockServerMemory) Get(ctx context.Context, tlfID TlfID, id BlockID,
 
 func validateBlockServerPut(
 	crypto cryptoPure, id BlockID, context BlockContext, buf []byte) error {
-	if context.GetCreator() != context.GetWriter() {
-		return fmt.Errorf("Can't Put() a block with creator=%s != writer=%s",
-			context.GetCreator(), context.GetWriter())
-	}
-
-	if context.GetRefNonce() != zeroBlockRefNonce {
-		return fmt.Errorf("Can't Put() a block with a non-zero refnonce.")
+	err := context.checkForPut()
+	if err != nil {
+		return err
 	}
 
 	bufID, err := crypto.MakePermanentBlockID(buf)
@@ -120,6 +149,11 @@ func (b *BlockServerMemory) Put(ctx context.Context, tlfID TlfID, id BlockID,
 		return err
 	}
 
+	err = b.networkSimulator().request(ctx, "Put", len(buf))
+	if err != nil {
+		return err
+	}
+
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
@@ -174,6 +208,16 @@ func (b *BlockServerMemory) AddBlockReference(ctx context.Context, tlfID TlfID,
 	b.log.CDebugf(ctx, "BlockServerMemory.AddBlockReference id=%s "+
 		"tlfID=%s context=%s", id, tlfID, context)
 
+	err = context.checkForAddReference()
+	if err != nil {
+		return err
+	}
+
+	err = b.networkSimulator().request(ctx, "AddBlockReference", 0)
+	if err != nil {
+		return err
+	}
+
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
@@ -244,6 +288,10 @@ func (b *BlockServerMemory) RemoveBlockReferences(ctx context.Context,
 	}()
 	b.log.CDebugf(ctx, "BlockServerMemory.RemoveBlockReference "+
 		"tlfID=%s contexts=%v", tlfID, contexts)
+	err = b.networkSimulator().request(ctx, "RemoveBlockReferences", 0)
+	if err != nil {
+		return nil, err
+	}
 	liveCounts = make(map[BlockID]int)
 	for id, idContexts := range contexts {
 		count, err := b.removeBlockReference(tlfID, id, idContexts)
@@ -295,6 +343,10 @@ func (b *BlockServerMemory) ArchiveBlockReferences(ctx context.Context,
 	}()
 	b.log.CDebugf(ctx, "BlockServerMemory.ArchiveBlockReferences "+
 		"tlfID=%s contexts=%v", tlfID, contexts)
+	err = b.networkSimulator().request(ctx, "ArchiveBlockReferences", 0)
+	if err != nil {
+		return err
+	}
 
 	for id, idContexts := range contexts {
 		for _, context := range idContexts {
@@ -0,0 +1,195 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// negativeBlockCacheTTL is how long a block the server said
+	// doesn't exist is assumed to still not exist.
+	negativeBlockCacheTTL = 30 * time.Second
+	// negativeBlockCacheMaxEntries caps the number of remembered
+	// misses, so a long walk over reclaimed history can't grow the
+	// cache without bound.
+	negativeBlockCacheMaxEntries = 10000
+)
+
+// BlockServerNegativeCache delegates to another BlockServer, but
+// remembers for a short while which blocks the delegate said don't
+// exist, and fails repeated gets of them without asking it again.
+// A put of, or new reference to, a block forgets its misses; since
+// journals flush through the block server they were given, this
+// happens as soon as a journaled block reaches the server.
+type BlockServerNegativeCache struct {
+	delegate BlockServer
+	clock    Clock
+
+	lock sync.Mutex
+	// misses maps each missing block to the contexts that were
+	// looked up for it, and when they were found missing.
+	misses     map[BlockID]map[BlockContext]time.Time
+	numEntries int
+}
+
+var _ BlockServer = (*BlockServerNegativeCache)(nil)
+
+// NewBlockServerNegativeCache creates and returns a new
+// BlockServerNegativeCache instance with the given delegate, which
+// uses the given clock to expire its entries.
+func NewBlockServerNegativeCache(
+	delegate BlockServer, clock Clock) *BlockServerNegativeCache {
+	return &BlockServerNegativeCache{
+		delegate: delegate,
+		clock:    clock,
+		misses:   make(map[BlockID]map[BlockContext]time.Time),
+	}
+}
+
+func (b *BlockServerNegativeCache) isKnownMissing(
+	id BlockID, context BlockContext) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	contexts, ok := b.misses[id]
+	if !ok {
+		return false
+	}
+	missTime, ok := contexts[context]
+	if !ok {
+		return false
+	}
+	if b.clock.Now().Sub(missTime) < negativeBlockCacheTTL {
+		return true
+	}
+	delete(contexts, context)
+	b.numEntries--
+	if len(contexts) == 0 {
+		delete(b.misses, id)
+	}
+	return false
+}
+
+// expireLocked drops all expired misses, and if that doesn't free
+// up enough room, all the rest too.
+func (b *BlockServerNegativeCache) expireLocked() {
+	now := b.clock.Now()
+	for id, contexts := range b.misses {
+		for context, missTime := range contexts {
+			if now.Sub(missTime) >= negativeBlockCacheTTL {
+				delete(contexts, context)
+				b.numEntries--
+			}
+		}
+		if len(contexts) == 0 {
+			delete(b.misses, id)
+		}
+	}
+	if b.numEntries >= negativeBlockCacheMaxEntries {
+		b.misses = make(map[BlockID]map[BlockContext]time.Time)
+		b.numEntries = 0
+	}
+}
+
+func (b *BlockServerNegativeCache) addMiss(
+	id BlockID, context BlockContext) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.numEntries >= negativeBlockCacheMaxEntries {
+		b.expireLocked()
+	}
+	contexts, ok := b.misses[id]
+	if !ok {
+		contexts = make(map[BlockContext]time.Time)
+		b.misses[id] = contexts
+	}
+	if _, ok := contexts[context]; !ok {
+		b.numEntries++
+	}
+	contexts[context] = b.clock.Now()
+}
+
+func (b *BlockServerNegativeCache) forget(id BlockID) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.numEntries -= len(b.misses[id])
+	delete(b.misses, id)
+}
+
+// Get implements the BlockServer interface for
+// BlockServerNegativeCache.
+func (b *BlockServerNegativeCache) Get(ctx context.Context, tlfID TlfID,
+	id BlockID, context BlockContext) (
+	[]byte, BlockCryptKeyServerHalf, error) {
+	if b.isKnownMissing(id, context) {
+		return nil, BlockCryptKeyServerHalf{}, BServerErrorBlockNonExistent{
+			"Block ID " + id.String() + " recently found not to exist"}
+	}
+	buf, serverHalf, err := b.delegate.Get(ctx, tlfID, id, context)
+	if _, ok := err.(BServerErrorBlockNonExistent); ok {
+		b.addMiss(id, context)
+	}
+	return buf, serverHalf, err
+}
+
+// Put implements the BlockServer interface for
+// BlockServerNegativeCache.
+func (b *BlockServerNegativeCache) Put(ctx context.Context, tlfID TlfID,
+	id BlockID, context BlockContext, buf []byte,
+	serverHalf BlockCryptKeyServerHalf) error {
+	err := b.delegate.Put(ctx, tlfID, id, context, buf, serverHalf)
+	// Forget the misses even on error, since the put may have
+	// succeeded on the server anyway.
+	b.forget(id)
+	return err
+}
+
+// AddBlockReference implements the BlockServer interface for
+// BlockServerNegativeCache.
+func (b *BlockServerNegativeCache) AddBlockReference(ctx context.Context,
+	tlfID TlfID, id BlockID, context BlockContext) error {
+	err := b.delegate.AddBlockReference(ctx, tlfID, id, context)
+	b.forget(id)
+	return err
+}
+
+// RemoveBlockReferences implements the BlockServer interface for
+// BlockServerNegativeCache.
+func (b *BlockServerNegativeCache) RemoveBlockReferences(
+	ctx context.Context, tlfID TlfID,
+	contexts map[BlockID][]BlockContext) (
+	liveCounts map[BlockID]int, err error) {
+	return b.delegate.RemoveBlockReferences(ctx, tlfID, contexts)
+}
+
+// ArchiveBlockReferences implements the BlockServer interface for
+// BlockServerNegativeCache.
+func (b *BlockServerNegativeCache) ArchiveBlockReferences(
+	ctx context.Context, tlfID TlfID,
+	contexts map[BlockID][]BlockContext) error {
+	return b.delegate.ArchiveBlockReferences(ctx, tlfID, contexts)
+}
+
+// Shutdown implements the BlockServer interface for
+// BlockServerNegativeCache.
+func (b *BlockServerNegativeCache) Shutdown() {
+	b.delegate.Shutdown()
+}
+
+// RefreshAuthToken implements the BlockServer interface for
+// BlockServerNegativeCache.
+func (b *BlockServerNegativeCache) RefreshAuthToken(ctx context.Context) {
+	b.delegate.RefreshAuthToken(ctx)
+}
+
+// GetUserQuotaInfo implements the BlockServer interface for
+// BlockServerNegativeCache.
+func (b *BlockServerNegativeCache) GetUserQuotaInfo(ctx context.Context) (
+	*UserQuotaInfo, error) {
+	return b.delegate.GetUserQuotaInfo(ctx)
+}
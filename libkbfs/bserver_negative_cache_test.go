@@ -0,0 +1,79 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// countingMissingBlockServer says every block is missing until it
+// is put, and counts the gets that reach it.
+type countingMissingBlockServer struct {
+	BlockServer
+	gets int
+	put  map[BlockID]bool
+}
+
+func (b *countingMissingBlockServer) Get(ctx context.Context, tlfID TlfID,
+	id BlockID, context BlockContext) (
+	[]byte, BlockCryptKeyServerHalf, error) {
+	b.gets++
+	if b.put[id] {
+		return []byte{1}, BlockCryptKeyServerHalf{}, nil
+	}
+	return nil, BlockCryptKeyServerHalf{}, BServerErrorBlockNonExistent{}
+}
+
+func (b *countingMissingBlockServer) Put(ctx context.Context, tlfID TlfID,
+	id BlockID, context BlockContext, buf []byte,
+	serverHalf BlockCryptKeyServerHalf) error {
+	b.put[id] = true
+	return nil
+}
+
+func TestBlockServerNegativeCache(t *testing.T) {
+	ctx := context.Background()
+	delegate := &countingMissingBlockServer{put: make(map[BlockID]bool)}
+	clock := newTestClockNow()
+	b := NewBlockServerNegativeCache(delegate, clock)
+
+	tlfID := FakeTlfID(1, false)
+	id := fakeBlockID(1)
+	bCtx := BlockContext{Creator: "fake uid"}
+
+	// The second miss is served from the cache.
+	for i := 0; i < 2; i++ {
+		_, _, err := b.Get(ctx, tlfID, id, bCtx)
+		require.IsType(t, BServerErrorBlockNonExistent{}, err)
+		require.Equal(t, 1, delegate.gets)
+	}
+
+	// A different context for the same block is asked about
+	// separately.
+	otherCtx := BlockContext{Creator: "fake uid", Writer: "other uid"}
+	_, _, err := b.Get(ctx, tlfID, id, otherCtx)
+	require.IsType(t, BServerErrorBlockNonExistent{}, err)
+	require.Equal(t, 2, delegate.gets)
+
+	// Misses expire.
+	clock.Add(negativeBlockCacheTTL)
+	_, _, err = b.Get(ctx, tlfID, id, bCtx)
+	require.IsType(t, BServerErrorBlockNonExistent{}, err)
+	require.Equal(t, 3, delegate.gets)
+
+	// Putting the block, e.g. while flushing a journal, forgets all
+	// its misses.
+	err = b.Put(ctx, tlfID, id, bCtx, []byte{1}, BlockCryptKeyServerHalf{})
+	require.NoError(t, err)
+	_, _, err = b.Get(ctx, tlfID, id, bCtx)
+	require.NoError(t, err)
+	_, _, err = b.Get(ctx, tlfID, id, otherCtx)
+	require.NoError(t, err)
+	require.Equal(t, 5, delegate.gets)
+	require.Equal(t, 0, b.numEntries)
+}
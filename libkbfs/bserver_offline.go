@@ -0,0 +1,124 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import "golang.org/x/net/context"
+
+// BlockServerOffline delegates to another BlockServer, except while
+// the config it was made with is offline, when every call that would
+// reach the server fails right away with an OfflineUnavailableError
+// instead.  Since journals flush through the block server they were
+// given, this sits under the journal, which keeps serving the blocks
+// it holds.
+type BlockServerOffline struct {
+	config   Config
+	delegate BlockServer
+}
+
+var _ BlockServer = BlockServerOffline{}
+
+// NewBlockServerOffline creates and returns a new BlockServerOffline
+// instance with the given delegate, which checks whether the given
+// config is offline before each call.
+func NewBlockServerOffline(
+	config Config, delegate BlockServer) BlockServerOffline {
+	return BlockServerOffline{config: config, delegate: delegate}
+}
+
+func (b BlockServerOffline) checkOnline(op string) error {
+	if b.config.Offline() {
+		return OfflineUnavailableError{op}
+	}
+	return nil
+}
+
+// Get implements the BlockServer interface for BlockServerOffline.
+func (b BlockServerOffline) Get(ctx context.Context, tlfID TlfID, id BlockID,
+	context BlockContext) ([]byte, BlockCryptKeyServerHalf, error) {
+	if err := b.checkOnline("Getting block " + id.String()); err != nil {
+		return nil, BlockCryptKeyServerHalf{}, err
+	}
+	return b.delegate.Get(ctx, tlfID, id, context)
+}
+
+// Put implements the BlockServer interface for BlockServerOffline.
+func (b BlockServerOffline) Put(ctx context.Context, tlfID TlfID, id BlockID,
+	context BlockContext, buf []byte,
+	serverHalf BlockCryptKeyServerHalf) error {
+	if err := b.checkOnline("Putting block " + id.String()); err != nil {
+		return err
+	}
+	return b.delegate.Put(ctx, tlfID, id, context, buf, serverHalf)
+}
+
+// AddBlockReference implements the BlockServer interface for
+// BlockServerOffline.
+func (b BlockServerOffline) AddBlockReference(ctx context.Context,
+	tlfID TlfID, id BlockID, context BlockContext) error {
+	if err := b.checkOnline("Referencing block " + id.String()); err != nil {
+		return err
+	}
+	return b.delegate.AddBlockReference(ctx, tlfID, id, context)
+}
+
+// RemoveBlockReferences implements the BlockServer interface for
+// BlockServerOffline.
+func (b BlockServerOffline) RemoveBlockReferences(ctx context.Context,
+	tlfID TlfID, contexts map[BlockID][]BlockContext) (
+	liveCounts map[BlockID]int, err error) {
+	if err := b.checkOnline("Removing block references"); err != nil {
+		return nil, err
+	}
+	return b.delegate.RemoveBlockReferences(ctx, tlfID, contexts)
+}
+
+// ArchiveBlockReferences implements the BlockServer interface for
+// BlockServerOffline.
+func (b BlockServerOffline) ArchiveBlockReferences(ctx context.Context,
+	tlfID TlfID, contexts map[BlockID][]BlockContext) error {
+	if err := b.checkOnline("Archiving block references"); err != nil {
+		return err
+	}
+	return b.delegate.ArchiveBlockReferences(ctx, tlfID, contexts)
+}
+
+// Shutdown implements the BlockServer interface for
+// BlockServerOffline.
+func (b BlockServerOffline) Shutdown() {
+	b.delegate.Shutdown()
+}
+
+// RefreshAuthToken implements the BlockServer interface for
+// BlockServerOffline.  While offline, the token is left to be
+// refreshed when the server is next used.
+func (b BlockServerOffline) RefreshAuthToken(ctx context.Context) {
+	if b.config.Offline() {
+		return
+	}
+	b.delegate.RefreshAuthToken(ctx)
+}
+
+// GetUserQuotaInfo implements the BlockServer interface for
+// BlockServerOffline.
+func (b BlockServerOffline) GetUserQuotaInfo(ctx context.Context) (
+	info *UserQuotaInfo, err error) {
+	if err := b.checkOnline("Getting quota info"); err != nil {
+		return nil, err
+	}
+	return b.delegate.GetUserQuotaInfo(ctx)
+}
+
+// unwrapBlockServer returns the BlockServer that bserver ultimately
+// delegates to, looking past the journal and BlockServerOffline
+// wrappers that may sit on top of it.
+func unwrapBlockServer(bserver BlockServer) BlockServer {
+	if jbs, ok := bserver.(journalBlockServer); ok {
+		bserver = jbs.BlockServer
+	}
+	if b, ok := bserver.(BlockServerOffline); ok {
+		bserver = b.delegate
+	}
+	return bserver
+}
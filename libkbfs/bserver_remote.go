@@ -61,7 +61,8 @@ func NewBlockServerRemote(config Config, blkSrvAddr string, ctx Context) *BlockS
 	conn := rpc.NewTLSConnection(blkSrvAddr, GetRootCerts(blkSrvAddr),
 		bServerErrorUnwrapper{}, bs, false, ctx.NewRPCLogFactory(),
 		libkb.WrapError, config.MakeLogger(""), LogTagsFromContext)
-	bs.client = keybase1.BlockClient{Cli: conn.GetClient()}
+	bs.client = keybase1.BlockClient{
+		Cli: newPendingRPCClient("bserver", conn.GetClient())}
 	bs.shutdownFn = conn.Shutdown
 	return bs
 }
@@ -95,7 +96,11 @@ func (b *BlockServerRemote) OnConnect(ctx context.Context,
 	_ *rpc.Connection, client rpc.GenericClient, _ *rpc.Server) error {
 	// reset auth -- using b.client here would cause problematic recursion.
 	c := keybase1.BlockClient{Cli: client}
-	return b.resetAuth(ctx, c)
+	if err := b.resetAuth(ctx, c); err != nil {
+		return err
+	}
+	b.config.KBFSOps().PushConnectionStatusChange(BServiceName, nil)
+	return nil
 }
 
 // resetAuth is called to reset the authorization on a BlockServer
@@ -138,12 +143,14 @@ func (b *BlockServerRemote) OnConnectError(err error, wait time.Duration) {
 	}
 	// TODO: it might make sense to show something to the user if this is
 	// due to authentication, for example.
+	b.config.KBFSOps().PushConnectionStatusChange(BServiceName, err)
 }
 
 // OnDoCommandError implements the ConnectionHandler interface.
 func (b *BlockServerRemote) OnDoCommandError(err error, wait time.Duration) {
 	b.log.Warning("DoCommand error: %v; retrying in %s",
 		err, wait)
+	b.config.KBFSOps().PushConnectionStatusChange(BServiceName, err)
 }
 
 // OnDisconnected implements the ConnectionHandler interface.
@@ -228,7 +235,10 @@ func (b *BlockServerRemote) Get(ctx context.Context, tlfID TlfID, id BlockID,
 		Folder: tlfID.String(),
 	}
 
+	done := b.config.BlockTransferMeter().start(blockTransferGet)
 	res, err := b.client.GetBlock(ctx, arg)
+	done(len(res.Buf), err)
+	b.config.UsageMeter().recordBlockRPC(tlfID, 0, len(res.Buf))
 	if err != nil {
 		return nil, BlockCryptKeyServerHalf{}, err
 	}
@@ -261,6 +271,11 @@ func (b *BlockServerRemote) Put(ctx context.Context, tlfID TlfID, id BlockID,
 		}
 	}()
 
+	err = context.checkForPut()
+	if err != nil {
+		return err
+	}
+
 	arg := keybase1.PutBlockArg{
 		Bid: makeBlockIDCombo(id, context),
 		// BlockKey is misnamed -- it contains just the server
@@ -271,7 +286,11 @@ func (b *BlockServerRemote) Put(ctx context.Context, tlfID TlfID, id BlockID,
 	}
 
 	// Handle OverQuota errors at the caller
-	return b.client.PutBlock(ctx, arg)
+	done := b.config.BlockTransferMeter().start(blockTransferPut)
+	err = b.client.PutBlock(ctx, arg)
+	done(size, err)
+	b.config.UsageMeter().recordBlockRPC(tlfID, size, 0)
+	return err
 }
 
 // AddBlockReference implements the BlockServer interface for BlockServerRemote
@@ -290,7 +309,13 @@ func (b *BlockServerRemote) AddBlockReference(ctx context.Context, tlfID TlfID,
 		}
 	}()
 
+	err = context.checkForAddReference()
+	if err != nil {
+		return err
+	}
+
 	// Handle OverQuota errors at the caller
+	b.config.UsageMeter().recordBlockRPC(tlfID, 0, 0)
 	return b.client.AddReference(ctx, keybase1.AddReferenceArg{
 		Ref:    makeBlockReference(id, context),
 		Folder: tlfID.String(),
@@ -346,6 +371,7 @@ func (b *BlockServerRemote) batchDowngradeReferences(ctx context.Context,
 	throttleErr := backoff.Retry(func() error {
 		var res keybase1.DowngradeReferenceRes
 		var err error
+		b.config.UsageMeter().recordBlockRPC(tlfID, 0, 0)
 		if archive {
 			res, err = b.client.ArchiveReferenceWithCount(ctx, keybase1.ArchiveReferenceWithCountArg{
 				Refs:   notDone,
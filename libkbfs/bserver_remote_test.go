@@ -15,47 +15,17 @@ import (
 	"golang.org/x/net/context"
 )
 
+// FakeBServerClient is a fake of the block server RPC client, for
+// testing BlockServerRemote.  Tests that just need a scriptable
+// BlockServer should use fakeBlockServer instead.
 type FakeBServerClient struct {
 	bserverMem *BlockServerMemory
-
-	readyChan  chan<- struct{}
-	goChan     <-chan struct{}
-	finishChan chan<- struct{}
 }
 
-func NewFakeBServerClient(
-	config Config,
-	readyChan chan<- struct{},
-	goChan <-chan struct{},
-	finishChan chan<- struct{}) *FakeBServerClient {
+func NewFakeBServerClient(config Config) *FakeBServerClient {
 	return &FakeBServerClient{
 		bserverMem: NewBlockServerMemory(
 			blockServerLocalConfigAdapter{config}),
-		readyChan:  readyChan,
-		goChan:     goChan,
-		finishChan: finishChan,
-	}
-}
-
-func (fc *FakeBServerClient) maybeWaitOnChannel(ctx context.Context) error {
-	if fc.readyChan == nil {
-		return nil
-	}
-
-	// say we're ready, and wait for a signal to proceed or a
-	// cancellation.
-	fc.readyChan <- struct{}{}
-	select {
-	case <-fc.goChan:
-		return nil
-	case <-ctx.Done():
-		return ctx.Err()
-	}
-}
-
-func (fc *FakeBServerClient) maybeFinishOnChannel() {
-	if fc.finishChan != nil {
-		fc.finishChan <- struct{}{}
 	}
 }
 
@@ -68,12 +38,6 @@ func (fc *FakeBServerClient) AuthenticateSession(context.Context, string) error
 }
 
 func (fc *FakeBServerClient) PutBlock(ctx context.Context, arg keybase1.PutBlockArg) error {
-	err := fc.maybeWaitOnChannel(ctx)
-	defer fc.maybeFinishOnChannel()
-	if err != nil {
-		return err
-	}
-
 	id, err := BlockIDFromString(arg.Bid.BlockHash)
 	if err != nil {
 		return err
@@ -97,12 +61,6 @@ func (fc *FakeBServerClient) PutBlock(ctx context.Context, arg keybase1.PutBlock
 }
 
 func (fc *FakeBServerClient) GetBlock(ctx context.Context, arg keybase1.GetBlockArg) (keybase1.GetBlockRes, error) {
-	err := fc.maybeWaitOnChannel(ctx)
-	defer fc.maybeFinishOnChannel()
-	if err != nil {
-		return keybase1.GetBlockRes{}, err
-	}
-
 	id, err := BlockIDFromString(arg.Bid.BlockHash)
 	if err != nil {
 		return keybase1.GetBlockRes{}, err
@@ -183,9 +141,10 @@ func TestBServerRemotePutAndGet(t *testing.T) {
 	localUsers := MakeLocalUsers([]libkb.NormalizedUsername{"user1", "user2"})
 	currentUID := localUsers[0].UID
 	crypto := &CryptoLocal{CryptoCommon: MakeCryptoCommon(codec)}
-	config := &ConfigLocal{codec: codec, crypto: crypto}
+	config := &ConfigLocal{codec: codec, crypto: crypto,
+		usage: NewUsageMeter(wallClock{})}
 	setTestLogger(config, t)
-	fc := NewFakeBServerClient(config, nil, nil, nil)
+	fc := NewFakeBServerClient(config)
 	b := newBlockServerRemoteWithClient(config, fc)
 
 	tlfID := FakeTlfID(2, false)
@@ -246,6 +205,13 @@ func TestBServerRemotePutAndGet(t *testing.T) {
 	if key != serverHalf {
 		t.Errorf("Got bad key -- got %v, expected %v", key, serverHalf)
 	}
+
+	// Every call was counted against the TLF.
+	days := config.UsageMeter().Days()
+	expectedUsage := TLFUsage{BytesUp: 4, BytesDown: 8, BlockRPCs: 4}
+	if len(days) != 1 || days[0].TLFs[tlfID.String()] != expectedUsage {
+		t.Errorf("Unexpected usage %+v", days)
+	}
 }
 
 // If we cancel the RPC before the RPC returns, the call should error quickly.
@@ -0,0 +1,247 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import "fmt"
+
+// BlockChunking is how files are split into blocks.
+type BlockChunking byte
+
+const (
+	// BlockChunkingFixed splits files at fixed offsets, with
+	// BlockSplitterSimple.
+	BlockChunkingFixed BlockChunking = 0
+	// BlockChunkingContent splits files by content, with
+	// BlockSplitterCDC.
+	BlockChunkingContent BlockChunking = 1
+)
+
+func (c BlockChunking) String() string {
+	switch c {
+	case BlockChunkingFixed:
+		return "fixed"
+	case BlockChunkingContent:
+		return "content"
+	default:
+		return fmt.Sprintf("BlockChunking(%d)", c)
+	}
+}
+
+// ParseBlockChunking returns the BlockChunking named by s, as
+// returned by its String method.
+func ParseBlockChunking(s string) (BlockChunking, error) {
+	for _, c := range []BlockChunking{
+		BlockChunkingFixed, BlockChunkingContent} {
+		if s == c.String() {
+			return c, nil
+		}
+	}
+	return BlockChunkingFixed, fmt.Errorf("Unknown block chunking %q", s)
+}
+
+// MakeBlockSplitter returns a BlockSplitter with the default block
+// sizes, that splits files the given way.
+func MakeBlockSplitter(chunking BlockChunking, codec Codec) (
+	BlockSplitter, error) {
+	switch chunking {
+	case BlockChunkingFixed:
+		return NewBlockSplitterSimple(MaxBlockSizeBytesDefault, 8*1024,
+			codec)
+	case BlockChunkingContent:
+		return NewBlockSplitterCDC(32*1024, 128*1024,
+			MaxBlockSizeBytesDefault, 8*1024, codec)
+	default:
+		return nil, fmt.Errorf("Unknown block chunking %s", chunking)
+	}
+}
+
+// cdcWindowSize is the number of bytes the rolling hash of
+// BlockSplitterCDC covers.  Whether there's a block boundary at some
+// offset depends only on the cdcWindowSize bytes before it.
+const cdcWindowSize = 48
+
+// cdcHashTable maps each byte to a random-looking value for the
+// buzhash.  It must be the same for every client, so that they all
+// find the same boundaries in the same data, and so it's generated
+// from a fixed seed rather than from a random source.
+var cdcHashTable = func() (table [256]uint32) {
+	// splitmix64
+	x := uint64(0x6b62667320636463)
+	for i := range table {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = uint32(z ^ (z >> 31))
+	}
+	return table
+}()
+
+func rotl32(x uint32, n uint) uint32 {
+	n %= 32
+	return x<<n | x>>(32-n)
+}
+
+// BlockSplitterCDC implements the BlockSplitter interface with
+// content-defined chunking: a file block ends wherever a rolling hash
+// (buzhash) of the bytes before it matches a pattern, subject to
+// minimum and maximum block sizes.  Since boundaries depend on the
+// data rather than on offsets, inserting or removing bytes in the
+// middle of a file only changes the blocks around the edit, rather
+// than shifting every block after it.  The blocks after the edit are
+// then recognized by folderBlockOps.ReadyBlock, through
+// BlockCache.CheckForKnownPtr, as ones the TLF already has, and only
+// get new references rather than being uploaded again.  That needs
+// the old blocks to still be in the block cache, which they are when
+// they were just read to be rewritten.
+//
+// Indirect file blocks record the offset of each child block, so
+// files split this way can be read by any client, and files split by
+// another BlockSplitter are simply re-chunked around the parts that
+// get written.
+type BlockSplitterCDC struct {
+	minSize int64
+	// mask has a bit set for each bit of the hash that must be zero
+	// at a boundary, which makes the average block size mask+1
+	// (plus minSize).
+	mask                    uint32
+	maxSize                 int64
+	blockChangeEmbedMaxSize uint64
+}
+
+// NewBlockSplitterCDC creates a new BlockSplitterCDC, which makes
+// file blocks with contents of at least minSize bytes, averageSize
+// bytes on average, and at most as many bytes as fit in an encoded
+// block of desiredMaxBlockSize bytes.  averageSize must be a power of
+// 2.
+func NewBlockSplitterCDC(minSize, averageSize, desiredMaxBlockSize int64,
+	blockChangeEmbedMaxSize uint64, codec Codec) (*BlockSplitterCDC, error) {
+	if averageSize <= 0 || averageSize&(averageSize-1) != 0 {
+		return nil, fmt.Errorf("Average block size %d is not a power of 2",
+			averageSize)
+	}
+	if minSize < cdcWindowSize || minSize >= averageSize {
+		return nil, fmt.Errorf("Min block size %d is not between %d and "+
+			"the average block size %d", minSize, cdcWindowSize, averageSize)
+	}
+	maxSize, err := maxContentsSizeForBlockSize(desiredMaxBlockSize, codec)
+	if err != nil {
+		return nil, err
+	}
+	if maxSize <= averageSize {
+		return nil, fmt.Errorf("Max block size %d is not bigger than the "+
+			"average block size %d", maxSize, averageSize)
+	}
+
+	return &BlockSplitterCDC{
+		minSize:                 minSize,
+		mask:                    uint32(averageSize - 1),
+		maxSize:                 maxSize,
+		blockChangeEmbedMaxSize: blockChangeEmbedMaxSize,
+	}, nil
+}
+
+// findBoundary returns the first offset in [from, to] in data at
+// which a block may end, or -1 if there isn't one.  from must be at
+// least cdcWindowSize.
+func (b *BlockSplitterCDC) findBoundary(data []byte, from, to int64) int64 {
+	if from > to {
+		return -1
+	}
+	var hash uint32
+	for _, c := range data[from-cdcWindowSize : from] {
+		hash = rotl32(hash, 1) ^ cdcHashTable[c]
+	}
+	for p := from; ; p++ {
+		if hash&b.mask == 0 {
+			return p
+		}
+		if p == to {
+			return -1
+		}
+		hash = rotl32(hash, 1) ^
+			rotl32(cdcHashTable[data[p-cdcWindowSize]], cdcWindowSize) ^
+			cdcHashTable[data[p]]
+	}
+}
+
+// CopyUntilSplit implements the BlockSplitter interface for
+// BlockSplitterCDC.
+func (b *BlockSplitterCDC) CopyUntilSplit(
+	block *FileBlock, lastBlock bool, data []byte, off int64) int64 {
+	currLen := int64(len(block.Contents))
+	if off != currLen {
+		// Writing into the middle of the block (or past its end);
+		// CheckSplit will find the boundaries once the writes are
+		// done.
+		return copyUntilMaxSize(block, b.maxSize, data, off)
+	}
+
+	// Appending, possibly from the start of the next block during a
+	// sync, so stop at the first boundary.
+	if currLen >= b.maxSize {
+		return 0
+	}
+	if currLen >= b.minSize &&
+		b.findBoundary(block.Contents, currLen, currLen) >= 0 {
+		return 0
+	}
+	end := currLen + int64(len(data))
+	if end > b.maxSize {
+		end = b.maxSize
+	}
+	from := currLen + 1
+	if from < b.minSize {
+		from = b.minSize
+	}
+	combined := append(block.Contents, data[:end-currLen]...)
+	if p := b.findBoundary(combined, from, end); p >= 0 {
+		end = p
+	}
+	block.Contents = combined[:end]
+	return end - currLen
+}
+
+// CheckSplit implements the BlockSplitter interface for
+// BlockSplitterCDC.
+func (b *BlockSplitterCDC) CheckSplit(block *FileBlock) int64 {
+	currLen := int64(len(block.Contents))
+	to := currLen
+	if to > b.maxSize {
+		to = b.maxSize
+	}
+	p := b.findBoundary(block.Contents, b.minSize, to)
+	switch {
+	case p == currLen:
+		return 0
+	case p >= 0:
+		return p
+	case currLen > b.maxSize:
+		return b.maxSize
+	case currLen == b.maxSize:
+		return 0
+	default:
+		return -1
+	}
+}
+
+// ShouldEmbedBlockChanges implements the BlockSplitter interface for
+// BlockSplitterCDC.
+func (b *BlockSplitterCDC) ShouldEmbedBlockChanges(
+	bc *BlockChanges) bool {
+	return bc.SizeEstimate() <= b.blockChangeEmbedMaxSize
+}
+
+// MaxDirEntriesPerBlock implements the BlockSplitter interface for
+// BlockSplitterCDC.
+func (b *BlockSplitterCDC) MaxDirEntriesPerBlock() int {
+	return maxDirEntriesForBlockSize(b.maxSize)
+}
+
+// MaxPtrsPerBlock implements the BlockSplitter interface for
+// BlockSplitterCDC.
+func (b *BlockSplitterCDC) MaxPtrsPerBlock() int {
+	return maxPtrsForBlockSize(b.maxSize)
+}
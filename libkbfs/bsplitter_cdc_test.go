@@ -0,0 +1,268 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func testCDCSplitter() *BlockSplitterCDC {
+	return &BlockSplitterCDC{
+		minSize:                 256,
+		mask:                    1023,
+		maxSize:                 4096,
+		blockChangeEmbedMaxSize: 10,
+	}
+}
+
+// cdcChunks splits data into blocks by appending it, the way a
+// sequential write does.
+func cdcChunks(t *testing.T, bsplit *BlockSplitterCDC, data []byte) [][]byte {
+	var chunks [][]byte
+	for len(data) > 0 {
+		fblock := NewFileBlock().(*FileBlock)
+		n := bsplit.CopyUntilSplit(fblock, true, data, 0)
+		if n <= 0 {
+			t.Fatalf("Copied %d bytes into an empty block", n)
+		}
+		if m := bsplit.CopyUntilSplit(fblock, true, data[n:], n); m != 0 {
+			t.Fatalf("Copied %d more bytes into a full block", m)
+		}
+		if n < int64(len(data)) && bsplit.CheckSplit(fblock) != 0 {
+			t.Fatalf("Block of %d bytes doesn't end at a split", n)
+		}
+		chunks = append(chunks, fblock.Contents)
+		data = data[n:]
+	}
+	return chunks
+}
+
+func TestBsplitterCDCSizes(t *testing.T) {
+	bsplit := testCDCSplitter()
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	chunks := cdcChunks(t, bsplit, data)
+	for i, chunk := range chunks[:len(chunks)-1] {
+		if l := int64(len(chunk)); l < bsplit.minSize || l > bsplit.maxSize {
+			t.Errorf("Chunk %d has bad size %d", i, l)
+		}
+	}
+	if !bytes.Equal(bytes.Join(chunks, nil), data) {
+		t.Errorf("Chunks don't add up to the data")
+	}
+	// The average is about minSize + mask + 1.
+	if n := len(chunks); n < 128 || n > 320 {
+		t.Errorf("Unexpected number of chunks: %d", n)
+	}
+}
+
+func TestBsplitterCDCInsertKeepsBoundaries(t *testing.T) {
+	bsplit := testCDCSplitter()
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(2)).Read(data)
+	chunks := cdcChunks(t, bsplit, data)
+
+	edited := append([]byte{}, data[:1000]...)
+	edited = append(edited, 0xff)
+	edited = append(edited, data[1000:]...)
+	editedChunks := cdcChunks(t, bsplit, edited)
+
+	old := make(map[string]bool)
+	for _, chunk := range chunks {
+		old[string(chunk)] = true
+	}
+	changed := 0
+	for _, chunk := range editedChunks {
+		if !old[string(chunk)] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Errorf("Inserting one byte changed %d of %d chunks", changed,
+			len(editedChunks))
+	}
+}
+
+func TestBsplitterCDCCheckSplit(t *testing.T) {
+	bsplit := testCDCSplitter()
+	data := make([]byte, 64*1024)
+	rand.New(rand.NewSource(3)).Read(data)
+	first := cdcChunks(t, bsplit, data)[0]
+	l := int64(len(first))
+
+	fblock := NewFileBlock().(*FileBlock)
+	fblock.Contents = data[:l]
+	if s := bsplit.CheckSplit(fblock); s != 0 {
+		t.Errorf("Block at a boundary should not split: %d", s)
+	}
+	fblock.Contents = data[:l+100]
+	if s := bsplit.CheckSplit(fblock); s != l {
+		t.Errorf("Block past a boundary should split at %d: %d", l, s)
+	}
+	fblock.Contents = data[:l-1]
+	if s := bsplit.CheckSplit(fblock); s != -1 {
+		t.Errorf("Block before a boundary should need more bytes: %d", s)
+	}
+	fblock.Contents = data[:bsplit.minSize-1]
+	if s := bsplit.CheckSplit(fblock); s != -1 {
+		t.Errorf("Small block should need more bytes: %d", s)
+	}
+
+	// Pulling bytes in from the next block stops at the boundary.
+	fblock.Contents = append([]byte{}, data[:l-1]...)
+	if n := bsplit.CopyUntilSplit(fblock, false, data[l-1:], l-1); n != 1 {
+		t.Errorf("Copied %d bytes instead of 1", n)
+	}
+}
+
+func TestBsplitterCDCCheckSplitNoBoundary(t *testing.T) {
+	bsplit := testCDCSplitter()
+	// Data repeating one byte has the same hash everywhere; find a
+	// byte for which that hash isn't a boundary.
+	fblock := NewFileBlock().(*FileBlock)
+	var data []byte
+	for c := 0; c < 256; c++ {
+		data = bytes.Repeat([]byte{byte(c)}, int(2*bsplit.maxSize))
+		fblock.Contents = data[:bsplit.minSize]
+		if bsplit.CheckSplit(fblock) != 0 {
+			break
+		}
+	}
+
+	fblock.Contents = data
+	if s := bsplit.CheckSplit(fblock); s != bsplit.maxSize {
+		t.Errorf("Oversized block should split at the max size: %d", s)
+	}
+	fblock.Contents = data[:bsplit.maxSize]
+	if s := bsplit.CheckSplit(fblock); s != 0 {
+		t.Errorf("Max-sized block should not split: %d", s)
+	}
+}
+
+func TestBsplitterCDCOverwrite(t *testing.T) {
+	bsplit := testCDCSplitter()
+	fblock := NewFileBlock().(*FileBlock)
+	fblock.Contents = make([]byte, 10)
+	data := make([]byte, bsplit.maxSize)
+
+	// Writes into the middle copy up to the max size, like
+	// BlockSplitterSimple.
+	if n := bsplit.CopyUntilSplit(fblock, false, data, 5); n != bsplit.maxSize-5 {
+		t.Errorf("Did not copy expected number of bytes: %d", n)
+	}
+	if l := int64(len(fblock.Contents)); l != bsplit.maxSize {
+		t.Errorf("Unexpected block size %d", l)
+	}
+}
+
+func TestNewBlockSplitterCDCBadSizes(t *testing.T) {
+	codec := NewCodecMsgpack()
+	if _, err := NewBlockSplitterCDC(1024, 3000, 16*1024, 10, codec); err == nil {
+		t.Error("Average size that isn't a power of 2 was accepted")
+	}
+	if _, err := NewBlockSplitterCDC(10, 4096, 16*1024, 10, codec); err == nil {
+		t.Error("Min size smaller than the hash window was accepted")
+	}
+	if _, err := NewBlockSplitterCDC(1024, 16*1024, 16*1024, 10, codec); err == nil {
+		t.Error("Average size as big as the max size was accepted")
+	}
+	bsplit, err := NewBlockSplitterCDC(1024, 4096, 16*1024, 10, codec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bsplit.mask != 4095 {
+		t.Errorf("Unexpected mask %d", bsplit.mask)
+	}
+}
+
+// fileLeafIDsOrBust returns the IDs of the blocks of data of the
+// given file, as synced.
+func fileLeafIDsOrBust(ctx context.Context, t *testing.T, config Config,
+	ops *folderBranchOps, ptr BlockPointer) map[BlockID]bool {
+	kmd := ops.getHead(makeFBOLockState())
+	ids := make(map[BlockID]bool)
+	var walk func(ptr BlockPointer)
+	walk = func(ptr BlockPointer) {
+		fblock := NewFileBlock().(*FileBlock)
+		err := config.BlockOps().Get(ctx, kmd, ptr, fblock)
+		require.NoError(t, err)
+		if !fblock.IsInd {
+			ids[ptr.ID] = true
+			return
+		}
+		for _, iptr := range fblock.IPtrs {
+			walk(iptr.BlockPointer)
+		}
+	}
+	walk(ptr)
+	return ids
+}
+
+func TestKBFSOpsCDCInsertReusesBlocks(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	config.SetBlockSplitter(testCDCSplitter())
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "f", false, NoExcl)
+	require.NoError(t, err)
+	data := make([]byte, 64*1024)
+	rand.New(rand.NewSource(3)).Read(data)
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	filePtr := func() BlockPointer {
+		return ops.nodeCache.PathFromNode(fileNode).tailPointer()
+	}
+	oldIDs := fileLeafIDsOrBust(ctx, t, config, ops, filePtr())
+
+	// Another device, with nothing cached, inserts a byte by
+	// rewriting everything after it, the way an editor saving the
+	// file would.  The blocks it reads to do so are enough to
+	// recognize the unchanged ones.
+	config2 := ConfigAsUser(config, "test_user")
+	defer CheckConfigAndShutdown(t, config2)
+	config2.SetBlockSplitter(testCDCSplitter())
+	kbfsOps2 := config2.KBFSOps()
+	rootNode2 := GetRootNodeOrBust(t, config2, "test_user", false)
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "f")
+	require.NoError(t, err)
+	edited := append([]byte{}, data[:1000]...)
+	edited = append(edited, 0xff)
+	edited = append(edited, data[1000:]...)
+	err = kbfsOps2.Write(ctx, fileNode2, edited[1000:], 1000)
+	require.NoError(t, err)
+	err = kbfsOps2.Sync(ctx, fileNode2)
+	require.NoError(t, err)
+	err = kbfsOps.SyncFromServerForTesting(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	newIDs := fileLeafIDsOrBust(ctx, t, config, ops, filePtr())
+	changed := 0
+	for id := range newIDs {
+		if !oldIDs[id] {
+			changed++
+		}
+	}
+	require.True(t, changed <= 2, "Inserting one byte changed %d of %d "+
+		"blocks", changed, len(newIDs))
+
+	buf := make([]byte, len(edited))
+	n, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(edited)), n)
+	require.True(t, bytes.Equal(edited, buf))
+}
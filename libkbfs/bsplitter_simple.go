@@ -13,12 +13,12 @@ type BlockSplitterSimple struct {
 	blockChangeEmbedMaxSize uint64
 }
 
-// NewBlockSplitterSimple creates a new BlockSplittleSimple and
-// adjusts the max size to try to match the desired size for file
-// blocks, given the overhead of encoding a file block and the
-// round-up padding we do.
-func NewBlockSplitterSimple(desiredBlockSize int64,
-	blockChangeEmbedMaxSize uint64, codec Codec) (*BlockSplitterSimple, error) {
+// maxContentsSizeForBlockSize returns the largest file block
+// contents size whose encoded block, given the overhead of encoding
+// a file block and the round-up padding we do, matches the desired
+// block size.
+func maxContentsSizeForBlockSize(
+	desiredBlockSize int64, codec Codec) (int64, error) {
 	// If the desired block size is exactly a power of 2, subtract one
 	// from it to account for the padding we will do, which rounds up
 	// when the encoded size is exactly a power of 2.
@@ -46,12 +46,12 @@ func NewBlockSplitterSimple(desiredBlockSize int64,
 		block.Contents = fullData[:maxSize]
 		encodedBlock, err := codec.Encode(block)
 		if err != nil {
-			return nil, err
+			return 0, err
 		}
 
 		encodedLen = int64(len(encodedBlock))
 		if encodedLen >= 2*desiredBlockSize {
-			return nil, fmt.Errorf("Encoded block of %d bytes is more than "+
+			return 0, fmt.Errorf("Encoded block of %d bytes is more than "+
 				"twice as big as the desired block size %d",
 				encodedLen, desiredBlockSize)
 		}
@@ -64,38 +64,91 @@ func NewBlockSplitterSimple(desiredBlockSize int64,
 	}
 
 	if encodedLen != desiredBlockSize {
-		return nil, fmt.Errorf("Couldn't converge on a max block size for a "+
+		return 0, fmt.Errorf("Couldn't converge on a max block size for a "+
 			"desired size of %d", desiredBlockSize)
 	}
 
+	return maxSize, nil
+}
+
+const (
+	// estimatedDirEntrySize is roughly how many bytes an encoded
+	// directory entry takes up, for figuring how many entries fit
+	// in a block.
+	estimatedDirEntrySize = 256
+	// minDirEntriesPerBlock is the fewest entries a directory block
+	// may hold, however small the blocks are; no directory with
+	// this many entries or fewer is ever sharded.
+	minDirEntriesPerBlock = 8
+	// estimatedIndirectFilePtrSize is roughly how many bytes an
+	// encoded indirect file pointer takes up, for figuring how many
+	// fit in a block.
+	estimatedIndirectFilePtrSize = 128
+	// minPtrsPerBlock is the fewest indirect pointers a file block
+	// may hold, however small the blocks are; no file with this
+	// many blocks or fewer has more than one level of indirection.
+	minPtrsPerBlock = 4
+)
+
+// maxDirEntriesForBlockSize returns how many directory entries fit in
+// a block whose contents may be up to maxSize bytes.
+func maxDirEntriesForBlockSize(maxSize int64) int {
+	n := int(maxSize / estimatedDirEntrySize)
+	if n < minDirEntriesPerBlock {
+		return minDirEntriesPerBlock
+	}
+	return n
+}
+
+// maxPtrsForBlockSize returns how many indirect file pointers fit in
+// a block whose contents may be up to maxSize bytes.
+func maxPtrsForBlockSize(maxSize int64) int {
+	n := int(maxSize / estimatedIndirectFilePtrSize)
+	if n < minPtrsPerBlock {
+		return minPtrsPerBlock
+	}
+	return n
+}
+
+// NewBlockSplitterSimple creates a new BlockSplittleSimple and
+// adjusts the max size to try to match the desired size for file
+// blocks, given the overhead of encoding a file block and the
+// round-up padding we do.
+func NewBlockSplitterSimple(desiredBlockSize int64,
+	blockChangeEmbedMaxSize uint64, codec Codec) (*BlockSplitterSimple, error) {
+	maxSize, err := maxContentsSizeForBlockSize(desiredBlockSize, codec)
+	if err != nil {
+		return nil, err
+	}
+
 	return &BlockSplitterSimple{
 		maxSize:                 maxSize,
 		blockChangeEmbedMaxSize: blockChangeEmbedMaxSize,
 	}, nil
 }
 
-// CopyUntilSplit implements the BlockSplitter interface for
-// BlockSplitterSimple.
-func (b *BlockSplitterSimple) CopyUntilSplit(
-	block *FileBlock, lastBlock bool, data []byte, off int64) int64 {
+// copyUntilMaxSize copies as much of data into block at off as fits
+// without taking the block over maxSize, and returns how much was
+// copied.
+func copyUntilMaxSize(
+	block *FileBlock, maxSize int64, data []byte, off int64) int64 {
 	n := int64(len(data))
 	currLen := int64(len(block.Contents))
-	// lastBlock is irrelevant since we only copy fixed sizes
 
 	toCopy := n
 	if currLen < (off + n) {
 		moreNeeded := (n + off) - currLen
 		// Reduce the number of additional bytes if it will take this block
 		// over maxSize.
-		if moreNeeded+currLen > b.maxSize {
-			moreNeeded = b.maxSize - currLen
+		if moreNeeded+currLen > maxSize {
+			moreNeeded = maxSize - currLen
 			if moreNeeded < 0 {
 				// If it is already over maxSize w/o any added bytes,
 				// just give up.
 				return 0
 			}
 			// only copy to the end of the block
-			toCopy = b.maxSize - off
+			toCopy = maxSize - off
 		}
 
 		if moreNeeded > 0 {
@@ -112,6 +165,14 @@ func (b *BlockSplitterSimple) CopyUntilSplit(
 	return toCopy
 }
 
+// CopyUntilSplit implements the BlockSplitter interface for
+// BlockSplitterSimple.
+func (b *BlockSplitterSimple) CopyUntilSplit(
+	block *FileBlock, lastBlock bool, data []byte, off int64) int64 {
+	// lastBlock is irrelevant since we only copy fixed sizes
+	return copyUntilMaxSize(block, b.maxSize, data, off)
+}
+
 // CheckSplit implements the BlockSplitter interface for
 // BlockSplitterSimple.
 func (b *BlockSplitterSimple) CheckSplit(block *FileBlock) int64 {
@@ -125,3 +186,15 @@ func (b *BlockSplitterSimple) ShouldEmbedBlockChanges(
 	bc *BlockChanges) bool {
 	return bc.SizeEstimate() <= b.blockChangeEmbedMaxSize
 }
+
+// MaxDirEntriesPerBlock implements the BlockSplitter interface for
+// BlockSplitterSimple.
+func (b *BlockSplitterSimple) MaxDirEntriesPerBlock() int {
+	return maxDirEntriesForBlockSize(b.maxSize)
+}
+
+// MaxPtrsPerBlock implements the BlockSplitter interface for
+// BlockSplitterSimple.
+func (b *BlockSplitterSimple) MaxPtrsPerBlock() int {
+	return maxPtrsForBlockSize(b.maxSize)
+}
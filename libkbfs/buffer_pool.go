@@ -0,0 +1,72 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import "sync"
+
+const (
+	// minPooledBufferShift and maxPooledBufferShift bound the
+	// capacities, as powers of two, of the buffers a bufferPool
+	// keeps.  Smaller buffers are cheap to allocate, and bigger ones
+	// are rare enough not to be worth holding on to.
+	minPooledBufferShift = 10
+	maxPooledBufferShift = 24
+)
+
+// bufferPool recycles byte slices by size class, where each class
+// holds buffers whose capacity is a given power of two.  It's for
+// the intermediate buffers of putting and getting blocks -- the
+// encoded, padded, and encrypted forms of each block -- which are
+// otherwise garbage as soon as each block is done, and make up most
+// of the allocations of a large sync.
+//
+// A buffer must only be put back into the pool once nothing refers
+// to it anymore.
+type bufferPool struct {
+	classes [maxPooledBufferShift + 1]sync.Pool
+}
+
+// blockBufferPool is the pool shared by the block put and get paths.
+var blockBufferPool bufferPool
+
+// bufferClass returns the smallest shift such that 1<<shift >= size.
+func bufferClass(size int) uint {
+	shift := uint(minPooledBufferShift)
+	for 1<<shift < size {
+		shift++
+	}
+	return shift
+}
+
+// get returns an empty buffer with at least the given capacity.
+func (p *bufferPool) get(size int) []byte {
+	shift := bufferClass(size)
+	if shift > maxPooledBufferShift {
+		return make([]byte, 0, size)
+	}
+	if buf, ok := p.classes[shift].Get().(*[]byte); ok {
+		return (*buf)[:0]
+	}
+	return make([]byte, 0, 1<<shift)
+}
+
+// put makes buf available to future callers of get.  buf may have
+// come from anywhere, as long as nothing else refers to it.
+func (p *bufferPool) put(buf []byte) {
+	c := cap(buf)
+	if c < 1<<minPooledBufferShift {
+		return
+	}
+	// Use the largest class that buf can satisfy.
+	shift := bufferClass(c)
+	if 1<<shift > c {
+		shift--
+	}
+	if shift > maxPooledBufferShift {
+		return
+	}
+	buf = buf[:0]
+	p.classes[shift].Put(&buf)
+}
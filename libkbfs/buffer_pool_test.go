@@ -0,0 +1,74 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBufferPoolSizeClasses(t *testing.T) {
+	var p bufferPool
+
+	buf := p.get(1)
+	require.Equal(t, 0, len(buf))
+	require.Equal(t, 1<<minPooledBufferShift, cap(buf))
+
+	buf = p.get(1<<minPooledBufferShift + 1)
+	require.Equal(t, 1<<(minPooledBufferShift+1), cap(buf))
+
+	// Buffers too big for any class aren't rounded up.
+	big := 1<<maxPooledBufferShift + 1
+	require.Equal(t, big, cap(p.get(big)))
+}
+
+func TestBufferPoolPut(t *testing.T) {
+	var p bufferPool
+
+	// A buffer in between classes goes into the smaller one, so it
+	// can satisfy any get from that class.
+	buf := make([]byte, 10, 3<<minPooledBufferShift)
+	p.put(buf)
+	got := p.get(2 << minPooledBufferShift)
+	require.Equal(t, 0, len(got))
+	require.True(t, cap(got) >= 2<<minPooledBufferShift)
+
+	// Buffers that are too small or too big are dropped.
+	p.put(make([]byte, 0, 1<<minPooledBufferShift-1))
+	p.put(make([]byte, 0, 1<<(maxPooledBufferShift+1)))
+}
+
+// Test that a decrypted block doesn't share memory with the pooled
+// buffers used to decrypt it.
+func TestDecryptBlockDoesNotRetainPooledBuffers(t *testing.T) {
+	c := MakeCryptoCommon(NewCodecMsgpack())
+	cryptKey := makeFakeBlockCryptKey(t)
+
+	block := NewFileBlock().(*FileBlock)
+	block.Contents = make([]byte, 100*1024)
+	for i := range block.Contents {
+		block.Contents[i] = byte(i)
+	}
+	_, encryptedBlock, err := c.EncryptBlock(
+		block, cryptKey, BlockCompressionNone)
+	require.NoError(t, err)
+
+	var decryptedBlock FileBlock
+	err = c.DecryptBlock(encryptedBlock, cryptKey, &decryptedBlock)
+	require.NoError(t, err)
+	require.Equal(t, block.Contents, decryptedBlock.Contents)
+
+	// Scribble over everything the pool hands out for the next
+	// block of the same size.
+	for i := 0; i < 10; i++ {
+		buf := blockBufferPool.get(len(encryptedBlock.EncryptedData))
+		buf = buf[:cap(buf)]
+		for j := range buf {
+			buf[j] = 0xff
+		}
+	}
+	require.Equal(t, block.Contents, decryptedBlock.Contents)
+}
@@ -0,0 +1,147 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"golang.org/x/net/context"
+)
+
+const (
+	// clockJumpCheckPeriod is how often the wall clock is compared
+	// against the monotonic clock.
+	clockJumpCheckPeriod = 10 * time.Second
+	// clockJumpThreshold is the smallest discrepancy between the
+	// two clocks that counts as a jump, so that NTP slewing and
+	// scheduling delays don't.
+	clockJumpThreshold = 5 * time.Second
+)
+
+// ClockJumpDetector watches for the wall clock jumping relative to
+// the monotonic clock, as happens when the machine resumes from
+// suspend or when NTP steps the clock, and tells registered listeners
+// about it.
+//
+// Go timers and tickers run on the monotonic clock, which on most
+// platforms doesn't advance while the machine is suspended.  So
+// anything that uses one to keep up with a wall-clock deadline, like
+// a lease held on the server or a token that expires, should check
+// again as soon as it hears about a jump, rather than on its next
+// tick.
+//
+// Jumps can only be detected if Config.Clock returns times that carry
+// a monotonic clock reading, as wallClock does; with a clock that
+// doesn't, like TestClock, listeners never hear anything.
+type ClockJumpDetector struct {
+	config Config
+
+	lock      sync.Mutex
+	listeners map[chan time.Duration]bool
+	// stopChan is non-nil while the detection goroutine is
+	// running, which is whenever there are listeners.
+	stopChan chan struct{}
+}
+
+func newClockJumpDetector(config Config) *ClockJumpDetector {
+	return &ClockJumpDetector{
+		config:    config,
+		listeners: make(map[chan time.Duration]bool),
+	}
+}
+
+// Register returns a channel that receives the size of each detected
+// jump, positive if the wall clock moved ahead of the monotonic clock
+// and negative otherwise, and a function that unregisters it.  The
+// channel holds one jump; later ones are dropped until it's drained,
+// since listeners only need to know that something happened.  On a
+// nil ClockJumpDetector, the channel never receives anything.
+func (d *ClockJumpDetector) Register() (<-chan time.Duration, func()) {
+	c := make(chan time.Duration, 1)
+	if d == nil {
+		return c, func() {}
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.listeners[c] = true
+	if d.stopChan == nil {
+		d.stopChan = make(chan struct{})
+		go d.detectLoop(d.stopChan)
+	}
+	return c, func() { d.unregister(c) }
+}
+
+func (d *ClockJumpDetector) unregister(c chan time.Duration) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.listeners, c)
+	if len(d.listeners) == 0 && d.stopChan != nil {
+		close(d.stopChan)
+		d.stopChan = nil
+	}
+}
+
+// clockJump returns how far the wall clock moved relative to the
+// monotonic clock between prev and now.  It's zero if either time
+// lacks a monotonic clock reading.
+func clockJump(prev, now time.Time) time.Duration {
+	return now.Round(0).Sub(prev.Round(0)) - now.Sub(prev)
+}
+
+func (d *ClockJumpDetector) detectLoop(stopChan <-chan struct{}) {
+	ticker := time.NewTicker(clockJumpCheckPeriod)
+	defer ticker.Stop()
+	log := d.config.MakeLogger("CJD")
+	prev := d.config.Clock().Now()
+	for {
+		select {
+		case <-ticker.C:
+			now := d.config.Clock().Now()
+			jump := clockJump(prev, now)
+			prev = now
+			if jump < clockJumpThreshold && jump > -clockJumpThreshold {
+				continue
+			}
+			ctx := ctxWithRandomIDReplayable(context.Background(),
+				CtxCJDIDKey, CtxCJDOpID, log)
+			d.notify(ctx, log, jump)
+		case <-stopChan:
+			return
+		}
+	}
+}
+
+// notify logs the given jump and passes it on to all listeners.
+func (d *ClockJumpDetector) notify(
+	ctx context.Context, log logger.Logger, jump time.Duration) {
+	log.CInfof(ctx, "The wall clock jumped by %s relative to the "+
+		"monotonic clock; resetting timers", jump)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for c := range d.listeners {
+		select {
+		case c <- jump:
+		default:
+		}
+	}
+}
+
+// CtxCJDTagKey is the type used for unique context tags within
+// ClockJumpDetector.
+type CtxCJDTagKey int
+
+const (
+	// CtxCJDIDKey is the type of the tag for unique operation IDs
+	// within ClockJumpDetector.
+	CtxCJDIDKey CtxCJDTagKey = iota
+)
+
+// CtxCJDOpID is the display name for the unique operation
+// ClockJumpDetector ID tag.
+const CtxCJDOpID = "CJDID"
@@ -0,0 +1,68 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestClockJumpWithoutMonotonicReadings(t *testing.T) {
+	now := time.Now()
+	later := now.Add(time.Hour)
+	require.Equal(t, time.Duration(0), clockJump(now, later))
+	require.Equal(t, time.Duration(0), clockJump(now.Round(0), later))
+	require.Equal(t, time.Duration(0),
+		clockJump(now.Round(0), later.Round(0)))
+}
+
+func TestClockJumpDetectorNotify(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "u1")
+	defer CheckConfigAndShutdown(t, config)
+	ctx := context.Background()
+	log := logger.NewTestLogger(t)
+	d := config.ClockJumpDetector()
+
+	c1, unregister1 := d.Register()
+	c2, unregister2 := d.Register()
+	d.notify(ctx, log, time.Hour)
+	require.Equal(t, time.Hour, <-c1)
+	require.Equal(t, time.Hour, <-c2)
+
+	// Undrained jumps are coalesced rather than blocking.
+	d.notify(ctx, log, time.Minute)
+	d.notify(ctx, log, -time.Minute)
+	require.Equal(t, time.Minute, <-c1)
+
+	unregister2()
+	d.notify(ctx, log, time.Hour)
+	require.Equal(t, time.Hour, <-c1)
+	require.Equal(t, time.Minute, <-c2)
+	select {
+	case jump := <-c2:
+		t.Fatalf("Unexpected jump %s after unregistering", jump)
+	default:
+	}
+
+	unregister1()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	require.Nil(t, d.stopChan)
+}
+
+func TestClockJumpDetectorNil(t *testing.T) {
+	var d *ClockJumpDetector
+	c, unregister := d.Register()
+	defer unregister()
+	select {
+	case jump := <-c:
+		t.Fatalf("Unexpected jump %s", jump)
+	default:
+	}
+}
@@ -6,7 +6,9 @@ package libkbfs
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"reflect"
 
 	"github.com/keybase/go-codec/codec"
@@ -153,16 +155,128 @@ func newCodecMsgpackHelper(handleUnknownFields bool) *CodecMsgpack {
 
 // Decode implements the Codec interface for CodecMsgpack
 func (c *CodecMsgpack) Decode(buf []byte, obj interface{}) (err error) {
+	err = checkMsgpackLengths(buf)
+	if err != nil {
+		return err
+	}
 	err = codec.NewDecoderBytes(buf, c.h).Decode(obj)
 	return
 }
 
+// checkMsgpackLengths walks the headers of the first msgpack object
+// in buf, and returns io.ErrUnexpectedEOF if any string, binary or
+// extension length, or any array or map size, claims more than the
+// rest of buf could hold.  go-codec allocates whatever a header
+// claims before noticing the input is short, so without this a few
+// corrupt bytes from a server or a journal could make us allocate
+// gigabytes.  Anything else that's malformed is left to the decoder.
+func checkMsgpackLengths(buf []byte) error {
+	// The number of objects whose headers we still need to read.
+	// Each one takes at least a byte, so there can never be more
+	// than what's left of buf.
+	pending := uint64(1)
+	for pending > 0 {
+		if len(buf) == 0 {
+			return io.ErrUnexpectedEOF
+		}
+		b := buf[0]
+		buf = buf[1:]
+		pending--
+
+		// Find how many bytes of length follow the header byte,
+		// and what they count.
+		var lenSize int
+		var skip, children uint64
+		switch {
+		case b <= 0x7f || b >= 0xe0:
+			// fixint
+		case b <= 0x8f:
+			children = 2 * uint64(b&0x0f)
+		case b <= 0x9f:
+			children = uint64(b & 0x0f)
+		case b <= 0xbf:
+			skip = uint64(b & 0x1f)
+		case b == 0xc4 || b == 0xd9:
+			lenSize = 1
+		case b == 0xc5 || b == 0xda:
+			lenSize = 2
+		case b == 0xc6 || b == 0xdb:
+			lenSize = 4
+		case b == 0xc7:
+			lenSize, skip = 1, 1
+		case b == 0xc8:
+			lenSize, skip = 2, 1
+		case b == 0xc9:
+			lenSize, skip = 4, 1
+		case b == 0xca:
+			skip = 4
+		case b == 0xcb:
+			skip = 8
+		case b >= 0xcc && b <= 0xcf:
+			skip = 1 << (b - 0xcc)
+		case b >= 0xd0 && b <= 0xd3:
+			skip = 1 << (b - 0xd0)
+		case b >= 0xd4 && b <= 0xd8:
+			skip = 1 + 1<<(b-0xd4)
+		case b == 0xdc || b == 0xde:
+			lenSize = 2
+		case b == 0xdd || b == 0xdf:
+			lenSize = 4
+		}
+
+		if lenSize > len(buf) {
+			return io.ErrUnexpectedEOF
+		}
+		var n uint64
+		switch lenSize {
+		case 1:
+			n = uint64(buf[0])
+		case 2:
+			n = uint64(binary.BigEndian.Uint16(buf))
+		case 4:
+			n = uint64(binary.BigEndian.Uint32(buf))
+		}
+		buf = buf[lenSize:]
+
+		switch b {
+		case 0xdc, 0xdd:
+			children = n
+		case 0xde, 0xdf:
+			children = 2 * n
+		default:
+			skip += n
+		}
+
+		// Extension payloads are skipped whole; registered
+		// extensions decode their payloads with Decode too, so
+		// they get checked then.
+		if skip > uint64(len(buf)) {
+			return io.ErrUnexpectedEOF
+		}
+		buf = buf[skip:]
+		pending += children
+		if pending > uint64(len(buf)) {
+			return io.ErrUnexpectedEOF
+		}
+	}
+	return nil
+}
+
 // Encode implements the Codec interface for CodecMsgpack
 func (c *CodecMsgpack) Encode(obj interface{}) (buf []byte, err error) {
 	err = codec.NewEncoderBytes(&buf, c.h).Encode(obj)
 	return
 }
 
+// encodeTo implements the codecBufferEncoder interface for
+// CodecMsgpack.
+func (c *CodecMsgpack) encodeTo(buf []byte, obj interface{}) (
+	[]byte, error) {
+	buf = buf[:cap(buf)]
+	err := codec.NewEncoderBytes(&buf, c.h).Encode(obj)
+	return buf, err
+}
+
 // RegisterType implements the Codec interface for CodecMsgpack
 func (c *CodecMsgpack) RegisterType(rt reflect.Type, code extCode) {
 	c.h.(*codec.MsgpackHandle).SetExt(rt, uint64(code), ext{c.extCodec})
@@ -174,6 +288,32 @@ func (c *CodecMsgpack) RegisterIfaceSliceType(rt reflect.Type, code extCode,
 	c.h.(*codec.MsgpackHandle).SetExt(rt, uint64(code), extSlice{c, typer})
 }
 
+// codecBufferEncoder is implemented by Codecs that can encode into
+// a buffer supplied by the caller.
+type codecBufferEncoder interface {
+	// encodeTo encodes obj, overwriting buf if it's big enough, and
+	// returns the encoded bytes.
+	encodeTo(buf []byte, obj interface{}) ([]byte, error)
+}
+
+// encodeToPooledBuffer encodes obj into a buffer from
+// blockBufferPool, with room for at least sizeHint bytes, if c
+// supports it.  It returns the encoded bytes, and whether they may be
+// put back into the pool once they're no longer needed.
+func encodeToPooledBuffer(c Codec, obj interface{}, sizeHint int) (
+	buf []byte, pooled bool, err error) {
+	bc, ok := c.(codecBufferEncoder)
+	if !ok {
+		buf, err = c.Encode(obj)
+		return buf, false, err
+	}
+	buf, err = bc.encodeTo(blockBufferPool.get(sizeHint), obj)
+	if err != nil {
+		return nil, false, err
+	}
+	return buf, true, nil
+}
+
 // CodecEqual returns whether or not the given objects serialize to
 // the same byte string. x or y (or both) can be nil.
 func CodecEqual(c Codec, x, y interface{}) (bool, error) {
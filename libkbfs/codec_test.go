@@ -6,6 +6,7 @@ package libkbfs
 
 import (
 	"bytes"
+	"io"
 	"testing"
 )
 
@@ -35,3 +36,39 @@ func TestCodecEncodeMap(t *testing.T) {
 		t.Errorf("%v != %v", b1, b2)
 	}
 }
+
+// TestCodecDecodeBadLengths tests that codec.Decode() rejects
+// lengths that claim more than the input holds, before allocating
+// them.
+func TestCodecDecodeBadLengths(t *testing.T) {
+	codec := NewCodecMsgpack()
+
+	good, err := codec.Encode(map[string][]interface{}{
+		"a": {[]byte("bin"), "str", 1.5, -3, uint64(1 << 40), nil},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkMsgpackLengths(good); err != nil {
+		t.Errorf("Good input rejected: %v", err)
+	}
+
+	for _, buf := range [][]byte{
+		// bin32 claiming 4GB.
+		{0xc6, 0xff, 0xff, 0xff, 0xff, 0x00},
+		// str32 claiming 4GB.
+		{0xdb, 0xff, 0xff, 0xff, 0xff, 0x00},
+		// array32 with 4G elements.
+		{0xdd, 0xff, 0xff, 0xff, 0xff, 0x00},
+		// map with one key nested in an array, value missing.
+		{0x91, 0x81, 0x01},
+		// Truncated length.
+		{0xc5, 0x01},
+	} {
+		var v interface{}
+		if err := codec.Decode(buf, &v); err != io.ErrUnexpectedEOF {
+			t.Errorf("Decoding %v: got %v, expected %v",
+				buf, err, io.ErrUnexpectedEOF)
+		}
+	}
+}
@@ -34,10 +34,24 @@ const (
 	delayedCancellationGracePeriodDefault = 2 * time.Second
 	// How often do we check for stuff to reclaim?
 	qrPeriodDefault = 1 * time.Minute
+	// How long can a file stay dirty before it's synced in the
+	// background?
+	bgFlushAgeDefault = 30 * time.Second
 	// How long must something be unreferenced before we reclaim it?
 	qrUnrefAgeDefault = 1 * time.Minute
+	// How long can a KBFSOps call take before a diagnostic of
+	// what it's stuck on is dumped to the log?
+	slowOpThresholdDefault = 2 * time.Minute
 	// tlfValidDurationDefault is the default for tlf validity before redoing identify.
 	tlfValidDurationDefault = 6 * time.Hour
+	// Maximum total encoded size of the key bundles we keep
+	// around, in memory and on disk.
+	keyBundleCacheCapacityBytesDefault = 64 * 1024 * 1024
+	// Limit the block cache to 1024 blocks (currently 512MiB) of
+	// clean data.
+	blockCacheCapacityBytesDefault = MaxBlockSizeBytesDefault * 1024
+	// Number of MD objects we keep in memory.
+	mdCacheCapacityDefault = 5000
 )
 
 // ConfigLocal implements the Config interface using purely local
@@ -48,6 +62,8 @@ type ConfigLocal struct {
 	keyman      KeyManager
 	rep         Reporter
 	kcache      KeyCache
+	kbcache     KeyBundleCache
+	crJournal   CRJournal
 	bcache      BlockCache
 	dirtyBcache DirtyBlockCache
 	codec       Codec
@@ -61,13 +77,33 @@ type ConfigLocal struct {
 	keyserv     KeyServer
 	service     KeybaseService
 	bsplit      BlockSplitter
+	tlfBsplits  map[TlfID]BlockSplitter
+	tlfChunking map[TlfID]BlockChunking
+	compression BlockCompressionType
+	tlfCompress map[TlfID]BlockCompressionType
+	tlfManualCR map[TlfID]bool
+	tlfDurable  map[TlfID]WriteDurability
 	notifier    Notifier
 	clock       Clock
+	clockJumps  *ClockJumpDetector
+	cryptoCaps  CryptoCapabilities
+	bxfers      *BlockTransferMeter
+	usage       *UsageMeter
 	kbpki       KBPKI
 	renamer     ConflictRenamer
+	merger      ConflictFileMerger
 	registry    metrics.Registry
+	tracer      Tracer
 	loggerFn    func(prefix string) logger.Logger
 	noBGFlush   bool // logic opposite so the default value is the common setting
+	bgFlushAge  time.Duration
+	mdCoalesce  time.Duration
+	readahead   int
+	slowOp      time.Duration
+	stateCheck  time.Duration
+	diskLimit   float64
+	offline     bool
+	netState    NetworkState
 	rwpWaitTime time.Duration
 
 	maxFileBytes uint64
@@ -85,6 +121,29 @@ type ConfigLocal struct {
 
 	// tlfValidDuration is the time TLFs are valid before redoing identification.
 	tlfValidDuration time.Duration
+
+	// Used by ResetCaches to size the block and MD caches.
+	bcacheCapacityBytes uint64
+	mdcacheCapacity     int
+
+	// syncCache, if non-nil, keeps the blocks of subscribed TLFs on
+	// local disk.  See EnableSyncCache.
+	syncCache *syncCache
+
+	// tlfSettingsDir, if non-empty, is where the settings made for
+	// individual TLFs are persisted.  See
+	// EnableTLFSettingsPersistence.
+	tlfSettingsDir string
+
+	// localFileStore, if non-nil, keeps the contents of local-only
+	// files on disk.  See EnableLocalFileStore.
+	localFileStore *LocalFileStore
+
+	// diskLimiter, if non-nil, limits the local disk space taken
+	// up by the journals and the sync cache.  It's made by
+	// whichever of EnableSyncCache and EnableJournaling is called
+	// first.
+	diskLimiter *diskLimiter
 }
 
 var _ Config = (*ConfigLocal)(nil)
@@ -195,10 +254,19 @@ func MakeLocalUsers(users []libkb.NormalizedUsername) []LocalUser {
 func NewConfigLocal() *ConfigLocal {
 	config := &ConfigLocal{}
 	config.SetClock(wallClock{})
+	config.clockJumps = newClockJumpDetector(config)
+	config.cryptoCaps = defaultCryptoCapabilities()
+	config.bxfers = NewBlockTransferMeter(wallClock{})
+	config.usage = NewUsageMeter(wallClock{})
 	config.SetReporter(NewReporterSimple(config.Clock(), 10))
 	config.SetConflictRenamer(WriterDeviceDateConflictRenamer{config})
+	config.bcacheCapacityBytes = blockCacheCapacityBytesDefault
+	config.mdcacheCapacity = mdCacheCapacityDefault
 	config.ResetCaches()
 	config.SetCodec(NewCodecMsgpack())
+	config.SetKeyBundleCache(NewKeyBundleCacheStandard(
+		config.Codec(), keyBundleCacheCapacityBytesDefault))
+	config.SetCRJournal(NewCRJournalStandard())
 	config.SetBlockOps(&BlockOpsStandard{config})
 	config.SetKeyOps(&KeyOpsStandard{config})
 	config.SetRekeyQueue(NewRekeyQueueStandard(config))
@@ -211,6 +279,9 @@ func NewConfigLocal() *ConfigLocal {
 	config.delayedCancellationGracePeriod = delayedCancellationGracePeriodDefault
 	config.qrPeriod = qrPeriodDefault
 	config.qrUnrefAge = qrUnrefAgeDefault
+	config.bgFlushAge = bgFlushAgeDefault
+	config.readahead = maxReadaheadBlocksDefault
+	config.diskLimit = diskLimitFractionDefault
 
 	// Don't bother creating the registry if UseNilMetrics is set.
 	if !metrics.UseNilMetrics {
@@ -293,6 +364,34 @@ func (c *ConfigLocal) SetKeyCache(k KeyCache) {
 	c.kcache = k
 }
 
+// KeyBundleCache implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) KeyBundleCache() KeyBundleCache {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.kbcache
+}
+
+// SetKeyBundleCache implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetKeyBundleCache(k KeyBundleCache) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.kbcache = k
+}
+
+// CRJournal implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) CRJournal() CRJournal {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.crJournal
+}
+
+// SetCRJournal implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetCRJournal(j CRJournal) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.crJournal = j
+}
+
 // BlockCache implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) BlockCache() BlockCache {
 	c.lock.RLock()
@@ -476,6 +575,249 @@ func (c *ConfigLocal) SetBlockSplitter(b BlockSplitter) {
 	c.bsplit = b
 }
 
+// BlockSplitterForTLF implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) BlockSplitterForTLF(tlfID TlfID) BlockSplitter {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if b, ok := c.tlfBsplits[tlfID]; ok {
+		return b
+	}
+	return c.bsplit
+}
+
+// SetBlockChunkingForTLF implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetBlockChunkingForTLF(
+	tlfID TlfID, chunking BlockChunking) error {
+	b, err := MakeBlockSplitter(chunking, c.Codec())
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	old, hadOld := c.tlfChunking[tlfID]
+	oldB := c.tlfBsplits[tlfID]
+	c.setBlockChunkingLocked(tlfID, chunking, b)
+	err = c.persistTLFSettingsLocked()
+	if err != nil {
+		if hadOld {
+			c.setBlockChunkingLocked(tlfID, old, oldB)
+		} else {
+			delete(c.tlfChunking, tlfID)
+			delete(c.tlfBsplits, tlfID)
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *ConfigLocal) setBlockChunkingLocked(
+	tlfID TlfID, chunking BlockChunking, b BlockSplitter) {
+	if c.tlfBsplits == nil {
+		c.tlfBsplits = make(map[TlfID]BlockSplitter)
+		c.tlfChunking = make(map[TlfID]BlockChunking)
+	}
+	c.tlfBsplits[tlfID] = b
+	c.tlfChunking[tlfID] = chunking
+}
+
+// BlockCompression implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) BlockCompression() BlockCompressionType {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.compression
+}
+
+// SetBlockCompression implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetBlockCompression(t BlockCompressionType) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.compression = t
+}
+
+// BlockCompressionForTLF implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) BlockCompressionForTLF(
+	tlfID TlfID) BlockCompressionType {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if t, ok := c.tlfCompress[tlfID]; ok {
+		return t
+	}
+	return c.compression
+}
+
+// SetBlockCompressionForTLF implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetBlockCompressionForTLF(
+	tlfID TlfID, t BlockCompressionType) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.tlfCompress == nil {
+		c.tlfCompress = make(map[TlfID]BlockCompressionType)
+	}
+	old, hadOld := c.tlfCompress[tlfID]
+	c.tlfCompress[tlfID] = t
+	err := c.persistTLFSettingsLocked()
+	if err != nil {
+		if hadOld {
+			c.tlfCompress[tlfID] = old
+		} else {
+			delete(c.tlfCompress, tlfID)
+		}
+		return err
+	}
+	return nil
+}
+
+// ManualConflictResolutionForTLF implements the Config interface
+// for ConfigLocal.
+func (c *ConfigLocal) ManualConflictResolutionForTLF(tlfID TlfID) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.tlfManualCR[tlfID]
+}
+
+// SetManualConflictResolutionForTLF implements the Config interface
+// for ConfigLocal.
+func (c *ConfigLocal) SetManualConflictResolutionForTLF(
+	tlfID TlfID, manual bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	old := c.tlfManualCR[tlfID]
+	c.setManualConflictResolutionLocked(tlfID, manual)
+	err := c.persistTLFSettingsLocked()
+	if err != nil {
+		c.setManualConflictResolutionLocked(tlfID, old)
+		return err
+	}
+	return nil
+}
+
+func (c *ConfigLocal) setManualConflictResolutionLocked(
+	tlfID TlfID, manual bool) {
+	if !manual {
+		delete(c.tlfManualCR, tlfID)
+		return
+	}
+	if c.tlfManualCR == nil {
+		c.tlfManualCR = make(map[TlfID]bool)
+	}
+	c.tlfManualCR[tlfID] = true
+}
+
+// SyncDurabilityForTLF implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SyncDurabilityForTLF(tlfID TlfID) WriteDurability {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.tlfDurable[tlfID]
+}
+
+// SetSyncDurabilityForTLF implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetSyncDurabilityForTLF(
+	tlfID TlfID, durability WriteDurability) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	old := c.tlfDurable[tlfID]
+	c.setSyncDurabilityLocked(tlfID, durability)
+	err := c.persistTLFSettingsLocked()
+	if err != nil {
+		c.setSyncDurabilityLocked(tlfID, old)
+		return err
+	}
+	return nil
+}
+
+func (c *ConfigLocal) setSyncDurabilityLocked(
+	tlfID TlfID, durability WriteDurability) {
+	if durability == WriteDurabilityLocal {
+		delete(c.tlfDurable, tlfID)
+		return
+	}
+	if c.tlfDurable == nil {
+		c.tlfDurable = make(map[TlfID]WriteDurability)
+	}
+	c.tlfDurable[tlfID] = durability
+}
+
+// EnableTLFSettingsPersistence loads the settings for individual TLFs
+// previously persisted in the given directory, and persists them
+// there whenever they change from now on.
+func (c *ConfigLocal) EnableTLFSettingsPersistence(dir string) error {
+	record, err := readTLFSettings(c.Codec(), dir)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for s, t := range record.Compression {
+		tlfID, err := ParseTlfID(s)
+		if err != nil {
+			return err
+		}
+		if c.tlfCompress == nil {
+			c.tlfCompress = make(map[TlfID]BlockCompressionType)
+		}
+		c.tlfCompress[tlfID] = t
+	}
+	for s, chunking := range record.Chunking {
+		tlfID, err := ParseTlfID(s)
+		if err != nil {
+			return err
+		}
+		b, err := MakeBlockSplitter(chunking, c.codec)
+		if err != nil {
+			return err
+		}
+		c.setBlockChunkingLocked(tlfID, chunking, b)
+	}
+	for s, manual := range record.ManualCR {
+		tlfID, err := ParseTlfID(s)
+		if err != nil {
+			return err
+		}
+		c.setManualConflictResolutionLocked(tlfID, manual)
+	}
+	for s, durability := range record.Durability {
+		tlfID, err := ParseTlfID(s)
+		if err != nil {
+			return err
+		}
+		c.setSyncDurabilityLocked(tlfID, durability)
+	}
+	c.tlfSettingsDir = dir
+	return nil
+}
+
+func (c *ConfigLocal) persistTLFSettingsLocked() error {
+	if c.tlfSettingsDir == "" {
+		return nil
+	}
+	record := tlfSettingsRecord{
+		Compression: make(map[string]BlockCompressionType),
+		Chunking:    make(map[string]BlockChunking),
+		ManualCR:    make(map[string]bool),
+		Durability:  make(map[string]WriteDurability),
+	}
+	for tlfID, t := range c.tlfCompress {
+		record.Compression[tlfID.String()] = t
+	}
+	for tlfID, chunking := range c.tlfChunking {
+		record.Chunking[tlfID.String()] = chunking
+	}
+	for tlfID := range c.tlfManualCR {
+		record.ManualCR[tlfID.String()] = true
+	}
+	for tlfID, durability := range c.tlfDurable {
+		record.Durability[tlfID.String()] = durability
+	}
+	return writeTLFSettings(c.codec, c.tlfSettingsDir, record)
+}
+
 // Notifier implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) Notifier() Notifier {
 	c.lock.RLock()
@@ -504,6 +846,42 @@ func (c *ConfigLocal) SetClock(cl Clock) {
 	c.clock = cl
 }
 
+// ClockJumpDetector implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) ClockJumpDetector() *ClockJumpDetector {
+	return c.clockJumps
+}
+
+// CryptoCapabilities implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) CryptoCapabilities() CryptoCapabilities {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.cryptoCaps
+}
+
+// SetCryptoCapabilities implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetCryptoCapabilities(caps CryptoCapabilities) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.cryptoCaps = caps
+}
+
+// BlockTransferMeter implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) BlockTransferMeter() *BlockTransferMeter {
+	return c.bxfers
+}
+
+// UsageMeter implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) UsageMeter() *UsageMeter {
+	return c.usage
+}
+
+// EnableUsagePersistence keeps the usage counted by UsageMeter in
+// the given directory, across restarts.
+func (c *ConfigLocal) EnableUsagePersistence(usageRoot string) error {
+	return c.usage.enablePersistence(
+		c.Codec(), c.MakeLogger("USG"), usageRoot)
+}
+
 // ConflictRenamer implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) ConflictRenamer() ConflictRenamer {
 	c.lock.RLock()
@@ -518,6 +896,20 @@ func (c *ConfigLocal) SetConflictRenamer(cr ConflictRenamer) {
 	c.renamer = cr
 }
 
+// ConflictFileMerger implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) ConflictFileMerger() ConflictFileMerger {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.merger
+}
+
+// SetConflictFileMerger implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetConflictFileMerger(cfm ConflictFileMerger) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.merger = cfm
+}
+
 // MetadataVersion implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) MetadataVersion() MetadataVer {
 	return InitialExtraMetadataVer
@@ -542,6 +934,154 @@ func (c *ConfigLocal) SetDoBackgroundFlushes(doBGFlush bool) {
 	c.noBGFlush = !doBGFlush
 }
 
+// BackgroundFlushAge implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) BackgroundFlushAge() time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.bgFlushAge
+}
+
+// SetBackgroundFlushAge implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetBackgroundFlushAge(age time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.bgFlushAge = age
+}
+
+// MDCoalesceWindow implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) MDCoalesceWindow() time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.mdCoalesce
+}
+
+// SetMDCoalesceWindow implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetMDCoalesceWindow(window time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.mdCoalesce = window
+}
+
+// MaxReadaheadBlocks implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) MaxReadaheadBlocks() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.readahead
+}
+
+// SetMaxReadaheadBlocks implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetMaxReadaheadBlocks(blocks int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.readahead = blocks
+}
+
+// SlowOpThreshold implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SlowOpThreshold() time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.slowOp
+}
+
+// SetSlowOpThreshold implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetSlowOpThreshold(threshold time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.slowOp = threshold
+}
+
+// StateCheckPeriod implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) StateCheckPeriod() time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.stateCheck
+}
+
+// SetStateCheckPeriod implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetStateCheckPeriod(period time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.stateCheck = period
+}
+
+// DiskLimitFraction implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) DiskLimitFraction() float64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.diskLimit
+}
+
+// SetDiskLimitFraction implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetDiskLimitFraction(fraction float64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.diskLimit = fraction
+}
+
+// Offline implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) Offline() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.offline || c.netState == NetworkNone
+}
+
+// SetOffline implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetOffline(offline bool) {
+	c.lock.Lock()
+	wasOffline, wasMetered := c.offline || c.netState == NetworkNone,
+		c.netState == NetworkMetered
+	c.offline = offline
+	c.lock.Unlock()
+	c.resumeDeferredWork(wasOffline, wasMetered)
+}
+
+// NetworkState implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) NetworkState() NetworkState {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.netState
+}
+
+// SetNetworkState implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetNetworkState(state NetworkState) {
+	c.lock.Lock()
+	wasOffline, wasMetered := c.offline || c.netState == NetworkNone,
+		c.netState == NetworkMetered
+	c.netState = state
+	c.lock.Unlock()
+	c.resumeDeferredWork(wasOffline, wasMetered)
+}
+
+// resumeDeferredWork restarts the background work that waited, or
+// failed, because KBFS was offline or on a metered network, if it
+// isn't anymore.  Journals and syncers won't try again until they're
+// told there's work to do, and registrations for MD updates may be
+// backing off.
+func (c *ConfigLocal) resumeDeferredWork(wasOffline, wasMetered bool) {
+	reconnected := wasOffline && !c.Offline()
+	if !reconnected && !(wasMetered && c.NetworkState() == NetworkUnmetered) {
+		return
+	}
+
+	if jServer, err := GetJournalServer(c); err == nil {
+		jServer.signalWork()
+	}
+	if sc := c.getSyncCache(); sc != nil {
+		sc.signalWork()
+	}
+	if reconnected {
+		if listener, ok := c.KBFSOps().(reconnectListener); ok {
+			listener.onReconnect(context.Background())
+		}
+	}
+}
+
 // RekeyWithPromptWaitTime implements the Config interface for
 // ConfigLocal.
 func (c *ConfigLocal) RekeyWithPromptWaitTime() time.Duration {
@@ -591,10 +1131,11 @@ func (c *ConfigLocal) MaxDirBytes() uint64 {
 func (c *ConfigLocal) resetCachesWithoutShutdown() DirtyBlockCache {
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	c.mdcache = NewMDCacheStandard(5000)
+	c.mdcache = NewMDCacheStandard(c.mdcacheCapacity)
 	c.kcache = NewKeyCacheStandard(5000)
-	// Limit the block cache to 10K entries or 1024 blocks (currently 512MiB)
-	c.bcache = NewBlockCacheStandard(10000, MaxBlockSizeBytesDefault*1024)
+	// Limit the block cache to 10K entries or the configured number
+	// of bytes.
+	c.bcache = NewBlockCacheStandard(10000, c.bcacheCapacityBytes)
 	oldDirtyBcache := c.dirtyBcache
 
 	// TODO: we should probably fail or re-schedule this reset if
@@ -627,6 +1168,25 @@ func (c *ConfigLocal) resetCachesWithoutShutdown() DirtyBlockCache {
 	return oldDirtyBcache
 }
 
+// SetCacheCapacities sets the number of bytes of clean blocks and
+// the number of MD objects to keep in memory, and resets the caches
+// so the new sizes take effect.  A zero value keeps the current
+// setting.
+func (c *ConfigLocal) SetCacheCapacities(
+	bcacheCapacityBytes uint64, mdcacheCapacity int) {
+	func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if bcacheCapacityBytes > 0 {
+			c.bcacheCapacityBytes = bcacheCapacityBytes
+		}
+		if mdcacheCapacity > 0 {
+			c.mdcacheCapacity = mdcacheCapacity
+		}
+	}()
+	c.ResetCaches()
+}
+
 // ResetCaches implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) ResetCaches() {
 	oldDirtyBcache := c.resetCachesWithoutShutdown()
@@ -705,6 +1265,20 @@ func (c *ConfigLocal) SetMetricsRegistry(r metrics.Registry) {
 	c.registry = r
 }
 
+// Tracer implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) Tracer() Tracer {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.tracer
+}
+
+// SetTracer implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetTracer(t Tracer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.tracer = t
+}
+
 // SetTLFValidDuration implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) SetTLFValidDuration(r time.Duration) {
 	c.tlfValidDuration = r
@@ -758,6 +1332,10 @@ func (c *ConfigLocal) Shutdown() error {
 		}
 	}
 
+	if sc := c.getSyncCache(); sc != nil {
+		sc.shutdown()
+	}
+
 	var errors []error
 	err := c.KBFSOps().Shutdown()
 	if err != nil {
@@ -770,6 +1348,10 @@ func (c *ConfigLocal) Shutdown() error {
 	c.BlockServer().Shutdown()
 	c.Crypto().Shutdown()
 	c.Reporter().Shutdown()
+	err = c.usage.shutdown()
+	if err != nil {
+		errors = append(errors, err)
+	}
 	err = c.DirtyBlockCache().Shutdown()
 	if err != nil {
 		errors = append(errors, err)
@@ -786,7 +1368,7 @@ func (c *ConfigLocal) Shutdown() error {
 
 // CheckStateOnShutdown implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) CheckStateOnShutdown() bool {
-	if md, ok := c.MDServer().(mdServerLocal); ok {
+	if md, ok := unwrapMDServer(c.MDServer()).(mdServerLocal); ok {
 		return !md.isShutdown()
 	}
 	return false
@@ -822,6 +1404,71 @@ func (c *ConfigLocal) journalizeBcaches() error {
 	return nil
 }
 
+func (c *ConfigLocal) getSyncCache() *syncCache {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.syncCache
+}
+
+// EnableLocalFileStore makes the frontends keep files that match an
+// ignore file out of KBFS, with their contents in the given
+// directory, up to limit bytes of them.  Anything already in the
+// directory is deleted.
+func (c *ConfigLocal) EnableLocalFileStore(dir string, limit int64) error {
+	store, err := newLocalFileStore(dir, limit)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.localFileStore = store
+	return nil
+}
+
+func (c *ConfigLocal) getLocalFileStore() *LocalFileStore {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.localFileStore
+}
+
+func (c *ConfigLocal) getDiskLimiter() *diskLimiter {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.diskLimiter
+}
+
+// makeDiskLimiterIfNeeded makes the disk limiter, which looks at the
+// free space of the disk dir is on, if there isn't one yet.
+func (c *ConfigLocal) makeDiskLimiterIfNeeded(dir string) *diskLimiter {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.diskLimiter == nil {
+		c.diskLimiter = newDiskLimiter(c, dir)
+	}
+	return c.diskLimiter
+}
+
+// EnableSyncCache makes the TLFs, and paths within them, subscribed to
+// with KBFSOps.SetSyncSubscription keep all of their blocks in the
+// given directory.  It wraps the current block server, so it should
+// be called before EnableJournaling.  Subscriptions already recorded
+// in the directory are resumed in the background.
+func (c *ConfigLocal) EnableSyncCache(syncCacheRoot string) {
+	if c.getSyncCache() != nil {
+		panic(errors.New("Trying to enable the sync cache twice"))
+	}
+
+	log := c.MakeLogger("")
+	limiter := c.makeDiskLimiterIfNeeded(syncCacheRoot)
+	sc := makeSyncCache(c, log, syncCacheRoot, limiter)
+	c.lock.Lock()
+	c.syncCache = sc
+	c.lock.Unlock()
+	c.SetBlockServer(syncCacheBlockServer{sc, c.BlockServer()})
+	go sc.resumeSubscriptions(ctxWithRandomIDReplayable(
+		context.Background(), CtxSyncIDKey, CtxSyncOpID, log))
+}
+
 // EnableJournaling creates a JournalServer, but journaling must still
 // be enabled manually for individual folders.
 func (c *ConfigLocal) EnableJournaling(journalRoot string) {
@@ -836,6 +1483,7 @@ func (c *ConfigLocal) EnableJournaling(journalRoot string) {
 	// it if it doesn't exist, make sure that it doesn't
 	// point to /keybase itself, etc.
 	log := c.MakeLogger("")
+	c.makeDiskLimiterIfNeeded(journalRoot)
 	branchListener := c.KBFSOps().(branchChangeListener)
 	flushListener := c.KBFSOps().(mdFlushListener)
 	jServer = makeJournalServer(c, log, journalRoot, c.BlockCache(),
@@ -46,6 +46,7 @@ type ConfigMock struct {
 	mockRep         *MockReporter
 	mockMdcache     *MockMDCache
 	mockKcache      *MockKeyCache
+	mockKbcache     *MockKeyBundleCache
 	mockBcache      *MockBlockCache
 	mockDirtyBcache *MockDirtyBlockCache
 	mockCrypto      *MockCrypto
@@ -76,10 +77,16 @@ func NewConfigMock(c *gomock.Controller, ctr *SafeTestReporter) *ConfigMock {
 	config.SetKeyManager(config.mockKeyman)
 	config.mockRep = NewMockReporter(c)
 	config.SetReporter(config.mockRep)
+	// Structured events are reported from many places; tests that
+	// care about them use a real ReporterPipeline instead.
+	config.mockRep.EXPECT().ReportEvent(gomock.Any(), gomock.Any()).AnyTimes()
 	config.mockMdcache = NewMockMDCache(c)
 	config.SetMDCache(config.mockMdcache)
 	config.mockKcache = NewMockKeyCache(c)
 	config.SetKeyCache(config.mockKcache)
+	config.mockKbcache = NewMockKeyBundleCache(c)
+	config.SetKeyBundleCache(config.mockKbcache)
+	config.SetCRJournal(NewCRJournalStandard())
 	config.mockBcache = NewMockBlockCache(c)
 	config.SetBlockCache(config.mockBcache)
 	config.mockDirtyBcache = NewMockDirtyBlockCache(c)
@@ -0,0 +1,96 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// contentSniffLen is how much of a file ConflictFileMergerRegistry
+// looks at to guess its content type.
+const contentSniffLen = 512
+
+// ConflictFileMergerRegistry is a ConflictFileMerger that hands each
+// file off to the merger registered for its extension or, failing
+// that, for its content type as sniffed from the local version.
+type ConflictFileMergerRegistry struct {
+	lock          sync.RWMutex
+	byExt         map[string]ConflictFileMerger
+	byContentType map[string]ConflictFileMerger
+}
+
+var _ ConflictFileMerger = (*ConflictFileMergerRegistry)(nil)
+
+// NewConflictFileMergerRegistry returns an empty
+// ConflictFileMergerRegistry.
+func NewConflictFileMergerRegistry() *ConflictFileMergerRegistry {
+	return &ConflictFileMergerRegistry{
+		byExt:         make(map[string]ConflictFileMerger),
+		byContentType: make(map[string]ConflictFileMerger),
+	}
+}
+
+// RegisterForExtension makes m the merger for files with the given
+// extension (e.g., ".txt"), regardless of case.
+func (r *ConflictFileMergerRegistry) RegisterForExtension(
+	ext string, m ConflictFileMerger) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.byExt[strings.ToLower(ext)] = m
+}
+
+// RegisterForContentType makes m the merger for files whose sniffed
+// MIME type (see net/http.DetectContentType) starts with the given
+// prefix, e.g. "text/".  The longest matching prefix wins.
+func (r *ConflictFileMergerRegistry) RegisterForContentType(
+	prefix string, m ConflictFileMerger) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.byContentType[prefix] = m
+}
+
+func (r *ConflictFileMergerRegistry) lookup(
+	name string, head []byte) ConflictFileMerger {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if m, ok := r.byExt[strings.ToLower(filepath.Ext(name))]; ok {
+		return m
+	}
+	if len(r.byContentType) == 0 {
+		return nil
+	}
+	contentType := http.DetectContentType(head)
+	var m ConflictFileMerger
+	longest := -1
+	for prefix, pm := range r.byContentType {
+		if strings.HasPrefix(contentType, prefix) && len(prefix) > longest {
+			m = pm
+			longest = len(prefix)
+		}
+	}
+	return m
+}
+
+// MergeFile implements the ConflictFileMerger interface for
+// ConflictFileMergerRegistry.
+func (r *ConflictFileMergerRegistry) MergeFile(ctx context.Context,
+	name string, base, local, remote io.Reader) ([]byte, error) {
+	localBuf := bufio.NewReaderSize(local, contentSniffLen)
+	// A short file just returns what it has, along with an error
+	// we don't care about.
+	head, _ := localBuf.Peek(contentSniffLen)
+	m := r.lookup(name, head)
+	if m == nil {
+		return nil, NoConflictFileMergerError{name}
+	}
+	return m.MergeFile(ctx, name, base, localBuf, remote)
+}
@@ -0,0 +1,148 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// testAppendMerger merges files by appending the local version to
+// the remote one, as long as the base was empty.
+type testAppendMerger struct{}
+
+func (testAppendMerger) MergeFile(ctx context.Context, name string,
+	base, local, remote io.Reader) ([]byte, error) {
+	b, err := ioutil.ReadAll(base)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 0 {
+		return nil, errors.New("Non-empty base")
+	}
+	r, err := ioutil.ReadAll(remote)
+	if err != nil {
+		return nil, err
+	}
+	l, err := ioutil.ReadAll(local)
+	if err != nil {
+		return nil, err
+	}
+	return append(r, l...), nil
+}
+
+func TestConflictFileMergerRegistryLookup(t *testing.T) {
+	r := NewConflictFileMergerRegistry()
+	_, err := r.MergeFile(context.Background(), "a.txt", nil,
+		bytesReader("hello"), nil)
+	require.Equal(t, NoConflictFileMergerError{"a.txt"}, err)
+
+	txt := testAppendMerger{}
+	r.RegisterForExtension(".TXT", txt)
+	require.Equal(t, txt, r.lookup("a.txt", nil))
+	require.Nil(t, r.lookup("a.bin", []byte{0, 1, 2}))
+
+	r.RegisterForContentType("text/", txt)
+	require.Equal(t, txt, r.lookup("README", []byte("plain words")))
+	require.Nil(t, r.lookup("a.bin", []byte{0, 1, 2}))
+}
+
+func bytesReader(s string) io.Reader {
+	return &crFileReader{read: func(dest []byte, off int64) (int64, error) {
+		if off >= int64(len(s)) {
+			return 0, nil
+		}
+		return int64(copy(dest, s[off:])), nil
+	}}
+}
+
+func TestCRFileConflictMerged(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+	mergers := NewConflictFileMergerRegistry()
+	mergers.RegisterForExtension(".txt", testAppendMerger{})
+	config2.SetConflictFileMerger(mergers)
+
+	name := userName1.String() + "," + userName2.String()
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	fileA1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a.txt", false, NoExcl)
+	require.NoError(t, err)
+	// A file with no registered merger.
+	fileB1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "b.bin", false, NoExcl)
+	require.NoError(t, err)
+
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	fileA2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a.txt")
+	require.NoError(t, err)
+	fileB2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "b.bin")
+	require.NoError(t, err)
+
+	fb := rootNode2.GetFolderBranch()
+	c, err := DisableUpdatesForTesting(config2, fb)
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, fb)
+	require.NoError(t, err)
+
+	for _, f := range []Node{fileA1, fileB1} {
+		err = kbfsOps1.Write(ctx, f, []byte("remote\n"), 0)
+		require.NoError(t, err)
+		err = kbfsOps1.Sync(ctx, f)
+		require.NoError(t, err)
+	}
+	for _, f := range []Node{fileA2, fileB2} {
+		err = kbfsOps2.Write(ctx, f, []byte("local\n"), 0)
+		require.NoError(t, err)
+		err = kbfsOps2.Sync(ctx, f)
+		require.NoError(t, err)
+	}
+
+	rev := kbfsOps1.(*KBFSOpsStandard).getOpsNoAdd(fb).getCurrMDRevision(
+		makeFBOLockState())
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2, fb)
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+
+	// The merge was part of the resolution, a single revision on
+	// top of user 1's.
+	head := kbfsOps1.(*KBFSOpsStandard).getOpsNoAdd(fb).getCurrMDRevision(
+		makeFBOLockState())
+	require.Equal(t, rev+1, head)
+	status, err := kbfsOps2.GetConflictStatus(ctx, fb)
+	require.NoError(t, err)
+	require.Len(t, status.ConflictFiles, 1)
+
+	// Only b.bin should have a conflict copy.
+	children, err := kbfsOps1.GetDirChildren(ctx, rootNode1)
+	require.NoError(t, err)
+	require.Len(t, children, 3)
+	require.Contains(t, children, "a.txt")
+	require.Contains(t, children, "b.bin")
+
+	buf := make([]byte, 100)
+	n, err := kbfsOps1.Read(ctx, fileA1, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, "remote\nlocal\n", string(buf[:n]))
+	n, err = kbfsOps2.Read(ctx, fileA2, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, "remote\nlocal\n", string(buf[:n]))
+}
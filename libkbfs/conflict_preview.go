@@ -0,0 +1,167 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sort"
+
+	"golang.org/x/net/context"
+)
+
+// ConflictPreviewAction describes one change that conflict
+// resolution plans to make to a directory in the merged branch.
+type ConflictPreviewAction struct {
+	// Dir is the path of the merged directory being changed.
+	Dir string
+	// Type is one of "copyUnmergedEntry", "copyUnmergedAttr",
+	// "rmMergedEntry", "renameUnmerged", "renameMerged" or
+	// "dropUnmerged".
+	Type string
+	// Name is the entry the action applies to, and NewName is
+	// where it ends up, if that's different.
+	Name    string `json:",omitempty"`
+	NewName string `json:",omitempty"`
+	// Description is a human-readable form of the action.
+	Description string
+}
+
+// ConflictPreview describes what conflict resolution would do to a
+// folder-branch, if it ran now.
+type ConflictPreview struct {
+	// Staged is false if there is nothing to resolve, in which
+	// case the rest is empty.
+	Staged bool
+	// Actions lists the planned changes, grouped by directory.
+	Actions []ConflictPreviewAction
+	// ConflictFiles lists the paths of the conflict copies that
+	// resolution would make, and MergedFiles the subset of them
+	// that the configured ConflictFileMerger would try to fold into
+	// the original file instead.
+	ConflictFiles []string
+	MergedFiles   []string `json:",omitempty"`
+}
+
+func makeConflictPreviewAction(
+	dir path, action crAction) ConflictPreviewAction {
+	pa := ConflictPreviewAction{
+		Dir:         dir.String(),
+		Description: action.String(),
+	}
+	switch a := action.(type) {
+	case *copyUnmergedEntryAction:
+		pa.Type = "copyUnmergedEntry"
+		pa.Name = a.fromName
+		pa.NewName = a.toName
+	case *copyUnmergedAttrAction:
+		pa.Type = "copyUnmergedAttr"
+		pa.Name = a.fromName
+		pa.NewName = a.toName
+	case *rmMergedEntryAction:
+		pa.Type = "rmMergedEntry"
+		pa.Name = a.name
+	case *renameUnmergedAction:
+		pa.Type = "renameUnmerged"
+		pa.Name = a.fromName
+		pa.NewName = a.toName
+	case *renameMergedAction:
+		pa.Type = "renameMerged"
+		pa.Name = a.fromName
+		pa.NewName = a.toName
+	case *dropUnmergedAction:
+		pa.Type = "dropUnmerged"
+	}
+	if pa.NewName == pa.Name {
+		pa.NewName = ""
+	}
+	return pa
+}
+
+type conflictPreviewActionsByDir []ConflictPreviewAction
+
+func (l conflictPreviewActionsByDir) Len() int      { return len(l) }
+func (l conflictPreviewActionsByDir) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l conflictPreviewActionsByDir) Less(i, j int) bool {
+	return l[i].Dir < l[j].Dir
+}
+
+// preview runs the planning steps of conflict resolution (building
+// the chains and paths, and computing the actions) against the
+// current unmerged and merged branches, without applying anything
+// or changing the resolver's state.
+func (cr *ConflictResolver) preview(ctx context.Context) (
+	ConflictPreview, error) {
+	lState := makeFBOLockState()
+	preview := ConflictPreview{Staged: true}
+
+	unmerged, merged, err := cr.getMDs(ctx, lState, false)
+	if err != nil {
+		return ConflictPreview{}, err
+	}
+	if len(unmerged) == 0 || len(merged) == 0 {
+		return preview, nil
+	}
+
+	unmergedChains, mergedChains, unmergedPaths, err :=
+		cr.makeChainsAndUnmergedPaths(ctx, unmerged, merged)
+	if err != nil {
+		return ConflictPreview{}, err
+	}
+	mergedPaths, recOps, newUnmergedPaths, err := cr.resolveMergedPaths(
+		ctx, lState, unmergedPaths, unmergedChains, mergedChains)
+	if err != nil {
+		return ConflictPreview{}, err
+	}
+	unmergedPaths = append(unmergedPaths, newUnmergedPaths...)
+	if len(mergedPaths) == 0 {
+		return preview, nil
+	}
+
+	var mergeCandidates map[crFileMergeKey]crFileMerge
+	if cr.config.ConflictFileMerger() != nil {
+		mergeCandidates = cr.findFileMergeCandidates(
+			unmergedChains, mergedChains, mergedPaths)
+	}
+
+	actionMap, _, err := cr.computeActions(ctx, unmergedChains,
+		mergedChains, unmergedPaths, mergedPaths, recOps)
+	if err != nil {
+		return ConflictPreview{}, err
+	}
+
+	dirs := make(map[BlockPointer]path, len(mergedPaths))
+	for _, p := range mergedPaths {
+		dirs[p.tailPointer()] = p
+	}
+	for ptr, actions := range actionMap {
+		dir, ok := dirs[ptr]
+		if !ok {
+			continue
+		}
+		for _, action := range actions {
+			preview.Actions = append(preview.Actions,
+				makeConflictPreviewAction(dir, action))
+		}
+	}
+	// Keep the order of actions within a directory, since that's
+	// the order they'd be applied in.
+	sort.Stable(conflictPreviewActionsByDir(preview.Actions))
+
+	// Copies would be moved into the conflict directory, if there
+	// is one, though the names they'd get there aren't known yet.
+	dirName := conflictDirName(cr.config)
+	for _, c := range getConflictCopies(mergedPaths, actionMap) {
+		if dirName != "" && c.name != c.copyName &&
+			!c.isInConflictDir(dirName) {
+			c = c.inConflictDir(dirName, c.copyName)
+		}
+		preview.ConflictFiles = append(preview.ConflictFiles, c.String())
+	}
+	sort.Strings(preview.ConflictFiles)
+	for _, fm := range getFileMerges(mergeCandidates, actionMap) {
+		preview.MergedFiles = append(preview.MergedFiles, fm.conflictPath())
+	}
+	sort.Strings(preview.MergedFiles)
+	return preview, nil
+}
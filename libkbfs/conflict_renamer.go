@@ -6,6 +6,8 @@ package libkbfs
 
 import (
 	"fmt"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/keybase/client/go/protocol/keybase1"
@@ -38,6 +40,104 @@ func (WriterDeviceDateConflictRenamer) ConflictRenameHelper(t time.Time, user, d
 		base, user, device, date, ext)
 }
 
+// DefaultConflictNameTemplate is the TemplateConflictRenamer template
+// that produces the same names as WriterDeviceDateConflictRenamer.
+const DefaultConflictNameTemplate = "{base}.conflicted ({user}'s {device} copy {date}){ext}"
+
+var conflictNamePlaceholderRegexp = regexp.MustCompile(`\{[^{}]*\}`)
+
+// TemplateConflictRenamer renames a file according to a template, so
+// that an organization can standardize how conflicted copies are
+// named.  The template may use these placeholders:
+//
+//   {base}    the original name, minus its extension
+//   {ext}     the original extension, including the leading dot
+//   {user}    the user who made the conflicting write
+//   {device}  the device the conflicting write came from
+//   {date}    the date of the resolution, as 2006-01-02
+//   {time}    the time of the resolution, as 150405
+//
+// The template may start with a directory name and a slash, as in
+// ".conflicts/{base} ({user})", to collect the conflicted copies in
+// that directory at the root of the TLF.  The directory is made if
+// needed, and the copies of files, directories and symlinks are all
+// moved there after the resolution that makes them.  The conflict
+// names of extended attributes just use the rest of the template.
+type TemplateConflictRenamer struct {
+	config   Config
+	dir      string
+	template string
+}
+
+var _ ConflictDirRenamer = TemplateConflictRenamer{}
+
+// NewTemplateConflictRenamer checks the given template and returns a
+// renamer that uses it.
+func NewTemplateConflictRenamer(config Config, template string) (
+	TemplateConflictRenamer, error) {
+	if !strings.Contains(template, "{base}") {
+		return TemplateConflictRenamer{}, InvalidConflictNameTemplateError{
+			template, "it must contain {base}"}
+	}
+	var dir string
+	name := template
+	if i := strings.Index(template, "/"); i >= 0 {
+		dir, name = template[:i], template[i+1:]
+		if dir == "" || dir == "." || dir == ".." ||
+			strings.ContainsAny(dir, "{}\\") {
+			return TemplateConflictRenamer{},
+				InvalidConflictNameTemplateError{template, fmt.Sprintf(
+					"%q can't be used as the conflict directory", dir)}
+		}
+	}
+	if strings.ContainsAny(name, "/\\") {
+		return TemplateConflictRenamer{}, InvalidConflictNameTemplateError{
+			template, "only one directory level is allowed"}
+	}
+	for _, p := range conflictNamePlaceholderRegexp.FindAllString(
+		template, -1) {
+		switch p {
+		case "{base}", "{ext}", "{user}", "{device}", "{date}", "{time}":
+		default:
+			return TemplateConflictRenamer{},
+				InvalidConflictNameTemplateError{
+					template, fmt.Sprintf("unknown placeholder %s", p)}
+		}
+	}
+	return TemplateConflictRenamer{config, dir, name}, nil
+}
+
+// ConflictDir implements the ConflictDirRenamer interface for
+// TemplateConflictRenamer.
+func (cr TemplateConflictRenamer) ConflictDir() string {
+	return cr.dir
+}
+
+// ConflictRename implements the ConflictRename interface for
+// TemplateConflictRenamer.
+func (cr TemplateConflictRenamer) ConflictRename(op op, original string) string {
+	now := cr.config.Clock().Now()
+	winfo := op.getWriterInfo()
+	return cr.ConflictRenameHelper(now, string(winfo.name), winfo.deviceName, original)
+}
+
+// ConflictRenameHelper is a helper for ConflictRename especially useful from
+// tests.
+func (cr TemplateConflictRenamer) ConflictRenameHelper(t time.Time, user, device, original string) string {
+	if device == "" {
+		device = "unknown"
+	}
+	base, ext := splitExtension(original)
+	return strings.NewReplacer(
+		"{base}", base,
+		"{ext}", ext,
+		"{user}", user,
+		"{device}", device,
+		"{date}", t.Format("2006-01-02"),
+		"{time}", t.Format("150405"),
+	).Replace(cr.template)
+}
+
 // splitExtension splits filename into a base name and the extension.
 func splitExtension(path string) (string, string) {
 	for i := len(path) - 1; i > 0; i-- {
@@ -6,6 +6,10 @@ package libkbfs
 
 import (
 	"testing"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/stretchr/testify/require"
 )
 
 func testSplitExtension(t *testing.T, s, base, ext string) {
@@ -30,3 +34,220 @@ func TestSplitExtension(t *testing.T) {
 	testSplitExtension(t, "weird. is this?", "weird. is this?", "")
 	testSplitExtension(t, "", "", "")
 }
+
+func TestTemplateConflictRenamer(t *testing.T) {
+	now := time.Date(2016, time.November, 3, 14, 5, 9, 0, time.UTC)
+
+	cr, err := NewTemplateConflictRenamer(nil, DefaultConflictNameTemplate)
+	require.NoError(t, err)
+	require.Equal(t,
+		WriterDeviceDateConflictRenamer{}.ConflictRenameHelper(
+			now, "alice", "laptop", "foo.tar.gz"),
+		cr.ConflictRenameHelper(now, "alice", "laptop", "foo.tar.gz"))
+
+	cr, err = NewTemplateConflictRenamer(
+		nil, ".conflict.{base}.{user}.{device}.{date}T{time}{ext}")
+	require.NoError(t, err)
+	require.Equal(t, ".conflict.foo.alice.unknown.2016-11-03T140509.txt",
+		cr.ConflictRenameHelper(now, "alice", "", "foo.txt"))
+
+	cr, err = NewTemplateConflictRenamer(nil, ".conflicts/{base}.{user}{ext}")
+	require.NoError(t, err)
+	require.Equal(t, ".conflicts", cr.ConflictDir())
+	require.Equal(t, "foo.alice.txt",
+		cr.ConflictRenameHelper(now, "alice", "", "foo.txt"))
+
+	for _, bad := range []string{
+		"{user}-copy",
+		"a/b/{base}",
+		"../{base}",
+		"/{base}",
+		"{user}/{base}",
+		"{base} ({writer})",
+	} {
+		_, err := NewTemplateConflictRenamer(nil, bad)
+		require.IsType(t, InvalidConflictNameTemplateError{}, err, bad)
+	}
+}
+
+func testConflictDirWrite(t *testing.T, kbfsOps KBFSOps, n Node, b byte) {
+	ctx := BackgroundContextWithCancellationDelayer()
+	defer CleanupCancellationDelayer(ctx)
+	require.NoError(t, kbfsOps.Write(ctx, n, []byte{b}, 0))
+	require.NoError(t, kbfsOps.Sync(ctx, n))
+}
+
+func testConflictDirRead(t *testing.T, kbfsOps KBFSOps, dir Node,
+	name string) []byte {
+	ctx := BackgroundContextWithCancellationDelayer()
+	defer CleanupCancellationDelayer(ctx)
+	n, _, err := kbfsOps.Lookup(ctx, dir, name)
+	require.NoError(t, err)
+	buf := make([]byte, 10)
+	nr, err := kbfsOps.Read(ctx, n, buf, 0)
+	require.NoError(t, err)
+	return buf[:nr]
+}
+
+// Tests that conflicted copies go into the directory named by the
+// template, at the root of the TLF, once the resolution that makes
+// them is done.
+func TestCRConflictDir(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+	renamer, err := NewTemplateConflictRenamer(
+		config2, ".conflicts/{base}.{user}{ext}")
+	require.NoError(t, err)
+	config2.SetConflictRenamer(renamer)
+
+	name := userName1.String() + "," + userName2.String()
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	fileB1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "b", false, NoExcl)
+	require.NoError(t, err)
+
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	fileB2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "b")
+	require.NoError(t, err)
+	fb := rootNode2.GetFolderBranch()
+
+	// Both users write b, and both make c.
+	c, err := DisableUpdatesForTesting(config2, fb)
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, fb)
+	require.NoError(t, err)
+	testConflictDirWrite(t, kbfsOps1, fileB1, 1)
+	fileC1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "c", false, NoExcl)
+	require.NoError(t, err)
+	testConflictDirWrite(t, kbfsOps1, fileC1, 1)
+	testConflictDirWrite(t, kbfsOps2, fileB2, 2)
+	fileC2, _, err := kbfsOps2.CreateFile(ctx, rootNode2, "c", false, NoExcl)
+	require.NoError(t, err)
+	testConflictDirWrite(t, kbfsOps2, fileC2, 2)
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2, fb)
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+
+	status, err := kbfsOps2.GetConflictStatus(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		name + "/.conflicts/b.u2", name + "/.conflicts/c.u2"},
+		status.ConflictFiles)
+
+	for _, user := range []struct {
+		kbfsOps KBFSOps
+		root    Node
+	}{{kbfsOps1, rootNode1}, {kbfsOps2, rootNode2}} {
+		children, err := user.kbfsOps.GetDirChildren(ctx, user.root)
+		require.NoError(t, err)
+		require.Len(t, children, 3)
+		require.Equal(t, Dir, children[".conflicts"].Type)
+		conflicts, _, err := user.kbfsOps.Lookup(ctx, user.root, ".conflicts")
+		require.NoError(t, err)
+		children, err = user.kbfsOps.GetDirChildren(ctx, conflicts)
+		require.NoError(t, err)
+		require.Len(t, children, 2)
+		for _, f := range []string{"b", "c"} {
+			require.Equal(t, []byte{1},
+				testConflictDirRead(t, user.kbfsOps, user.root, f))
+			require.Equal(t, []byte{2},
+				testConflictDirRead(t, user.kbfsOps, conflicts, f+".u2"))
+		}
+	}
+	// Another conflict on b goes into the existing directory.
+	c, err = DisableUpdatesForTesting(config2, fb)
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, fb)
+	require.NoError(t, err)
+	testConflictDirWrite(t, kbfsOps1, fileB1, 3)
+	testConflictDirWrite(t, kbfsOps2, fileB2, 4)
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2, fb)
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+
+	conflicts, _, err := kbfsOps1.Lookup(ctx, rootNode1, ".conflicts")
+	require.NoError(t, err)
+	children, err := kbfsOps1.GetDirChildren(ctx, conflicts)
+	require.NoError(t, err)
+	require.Len(t, children, 3)
+	require.Equal(t, []byte{4},
+		testConflictDirRead(t, kbfsOps1, conflicts, "b (1).u2"))
+	require.Equal(t, []byte{3},
+		testConflictDirRead(t, kbfsOps2, rootNode2, "b"))
+
+	// Copies made in subdirectories, and the copies that move merged
+	// entries aside, go there too.  A symlink keeps pointing at the
+	// same place.
+	dirD1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "d")
+	require.NoError(t, err)
+	fileE1, _, err := kbfsOps1.CreateFile(ctx, dirD1, "e", false, NoExcl)
+	require.NoError(t, err)
+	testConflictDirWrite(t, kbfsOps1, fileE1, 5)
+	err = kbfsOps2.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+	dirD2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "d")
+	require.NoError(t, err)
+	fileE2, _, err := kbfsOps2.Lookup(ctx, dirD2, "e")
+	require.NoError(t, err)
+	c, err = DisableUpdatesForTesting(config2, fb)
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, fb)
+	require.NoError(t, err)
+	testConflictDirWrite(t, kbfsOps1, fileE1, 6)
+	_, _, err = kbfsOps1.CreateFile(ctx, rootNode1, "f", false, NoExcl)
+	require.NoError(t, err)
+	_, _, err = kbfsOps1.CreateFile(ctx, rootNode1, "g", false, NoExcl)
+	require.NoError(t, err)
+	testConflictDirWrite(t, kbfsOps2, fileE2, 7)
+	_, _, err = kbfsOps2.CreateDir(ctx, rootNode2, "f")
+	require.NoError(t, err)
+	_, err = kbfsOps2.CreateLink(ctx, rootNode2, "g", "d/e")
+	require.NoError(t, err)
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2, fb)
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+
+	status, err = kbfsOps2.GetConflictStatus(ctx, fb)
+	require.NoError(t, err)
+	require.Len(t, status.ConflictFiles, 6)
+	require.Equal(t, []string{name + "/.conflicts/e.u2",
+		name + "/.conflicts/f.u1", name + "/.conflicts/g.u2"},
+		status.ConflictFiles[3:])
+	children, err = kbfsOps1.GetDirChildren(ctx, conflicts)
+	require.NoError(t, err)
+	require.Len(t, children, 6)
+	require.Equal(t, File, children["f.u1"].Type)
+	require.Equal(t, Sym, children["g.u2"].Type)
+	require.Equal(t, "../d/e", children["g.u2"].SymPath)
+	children, err = kbfsOps1.GetDirChildren(ctx, rootNode1)
+	require.NoError(t, err)
+	require.Equal(t, Dir, children["f"].Type)
+	require.Equal(t, []byte{7},
+		testConflictDirRead(t, kbfsOps1, conflicts, "e.u2"))
+	require.Equal(t, []byte{6},
+		testConflictDirRead(t, kbfsOps2, dirD2, "e"))
+	children, err = kbfsOps2.GetDirChildren(ctx, dirD2)
+	require.NoError(t, err)
+	require.Len(t, children, 1)
+}
@@ -5,8 +5,10 @@
 package libkbfs
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"sort"
 	"strings"
 	"sync"
@@ -45,6 +47,9 @@ const CtxCROpID = "CRID"
 type conflictInput struct {
 	unmerged MetadataRevision
 	merged   MetadataRevision
+	// keepLocal is set if the user asked for the unmerged version
+	// of each conflicting file to replace the merged one.
+	keepLocal bool
 }
 
 // ConflictResolver is responsible for resolving conflicts in the
@@ -57,6 +62,11 @@ type ConflictResolver struct {
 
 	inputChanLock sync.RWMutex
 	inputChan     chan conflictInput
+	// inputStart starts processInput on inputChan the first time
+	// there's input, so that folders without conflicts don't each
+	// keep an idle goroutine.  It's replaced along with inputChan.
+	inputStart *sync.Once
+	inputCtx   context.Context
 
 	// resolveGroup tracks the outstanding resolves.
 	resolveGroup RepeatedWaitGroup
@@ -64,6 +74,20 @@ type ConflictResolver struct {
 	inputLock    sync.Mutex
 	currInput    conflictInput
 	lockNextTime bool
+
+	// manualLock protects manual and heldInput.  When manual is
+	// set, inputs given to Resolve are held, rather than acted on,
+	// until ResolveHeld is called or manual mode is turned off.
+	manualLock sync.Mutex
+	manual     bool
+	heldInput  *conflictInput
+
+	// statusLock protects the fields below, which feed
+	// getStatus.
+	statusLock    sync.Mutex
+	inProgress    bool
+	lastErr       error
+	conflictFiles []string
 }
 
 // NewConflictResolver constructs a new ConflictResolver (and launches
@@ -84,16 +108,20 @@ func NewConflictResolver(
 		fbo:              fbo,
 		log:              log,
 		maxRevsThreshold: crMaxRevsThresholdDefault,
+		manual:           config.ManualConflictResolutionForTLF(fbo.id()),
 		currInput: conflictInput{
 			unmerged: MetadataRevisionUninitialized,
 			merged:   MetadataRevisionUninitialized,
 		},
 	}
 
-	cr.startProcessing(BackgroundContextWithCancellationDelayer())
+	cr.startProcessing(nil)
 	return cr
 }
 
+// startProcessing gets ready to process input with the given base
+// context.  If baseCtx is nil, a background context is made once
+// there's input, since it needs a goroutine of its own.
 func (cr *ConflictResolver) startProcessing(baseCtx context.Context) {
 	cr.inputChanLock.Lock()
 	defer cr.inputChanLock.Unlock()
@@ -102,7 +130,8 @@ func (cr *ConflictResolver) startProcessing(baseCtx context.Context) {
 		return
 	}
 	cr.inputChan = make(chan conflictInput)
-	go cr.processInput(baseCtx, cr.inputChan)
+	cr.inputStart = &sync.Once{}
+	cr.inputCtx = baseCtx
 }
 
 func (cr *ConflictResolver) stopProcessing() {
@@ -185,14 +214,137 @@ func (cr *ConflictResolver) processInput(baseCtx context.Context,
 // numbers, and kicks off the resolution process.
 func (cr *ConflictResolver) Resolve(unmerged MetadataRevision,
 	merged MetadataRevision) {
+	ci := conflictInput{unmerged: unmerged, merged: merged}
+	if cr.holdInput(ci) {
+		return
+	}
+	cr.queueInput(ci)
+}
+
+func (cr *ConflictResolver) queueInput(ci conflictInput) {
 	cr.inputChanLock.RLock()
 	defer cr.inputChanLock.RUnlock()
 	if cr.inputChan == nil {
 		return
 	}
 
+	inputChan, baseCtx := cr.inputChan, cr.inputCtx
+	cr.inputStart.Do(func() {
+		if baseCtx == nil {
+			baseCtx = BackgroundContextWithCancellationDelayer()
+		}
+		go cr.processInput(baseCtx, inputChan)
+	})
 	cr.resolveGroup.Add(1)
-	cr.inputChan <- conflictInput{unmerged, merged}
+	cr.inputChan <- ci
+}
+
+// holdInput merges ci into the held input and returns true if manual
+// mode is on; otherwise it returns false.
+func (cr *ConflictResolver) holdInput(ci conflictInput) bool {
+	cr.manualLock.Lock()
+	defer cr.manualLock.Unlock()
+	if !cr.manual {
+		return false
+	}
+	if cr.heldInput == nil {
+		cr.heldInput = &ci
+		return true
+	}
+	if ci.unmerged > cr.heldInput.unmerged {
+		cr.heldInput.unmerged = ci.unmerged
+	}
+	if ci.merged > cr.heldInput.merged {
+		cr.heldInput.merged = ci.merged
+	}
+	return true
+}
+
+// takeHeldInput returns and clears the held input, if any.
+func (cr *ConflictResolver) takeHeldInput() *conflictInput {
+	cr.manualLock.Lock()
+	defer cr.manualLock.Unlock()
+	ci := cr.heldInput
+	cr.heldInput = nil
+	return ci
+}
+
+// SetManual turns manual mode on or off.  While it is on, conflicts
+// are left unresolved until ResolveHeld is called.  Turning it off
+// kicks off the resolution of any held conflict.
+func (cr *ConflictResolver) SetManual(manual bool) {
+	func() {
+		cr.manualLock.Lock()
+		defer cr.manualLock.Unlock()
+		cr.manual = manual
+	}()
+	if !manual {
+		cr.ResolveHeld(false)
+	}
+}
+
+// ResolveHeld kicks off the resolution of the conflict held in manual
+// mode, if there is one, and returns whether there was.  If keepLocal
+// is set, the unmerged version of each conflicting file replaces the
+// merged one.
+func (cr *ConflictResolver) ResolveHeld(keepLocal bool) bool {
+	ci := cr.takeHeldInput()
+	if ci == nil {
+		return false
+	}
+	ci.keepLocal = keepLocal
+	cr.queueInput(*ci)
+	return true
+}
+
+// Retry kicks off a fresh resolution starting from the given
+// unmerged revision, along with any conflict held in manual mode,
+// even if the same input has already been tried and failed.  Any
+// resolution in progress is canceled in favor of the new one.
+// keepLocal is as for ResolveHeld.
+func (cr *ConflictResolver) Retry(
+	unmerged MetadataRevision, keepLocal bool) {
+	ci := conflictInput{
+		unmerged:  unmerged,
+		merged:    MetadataRevisionUninitialized,
+		keepLocal: keepLocal,
+	}
+	if held := cr.takeHeldInput(); held != nil {
+		if held.unmerged > ci.unmerged {
+			ci.unmerged = held.unmerged
+		}
+		ci.merged = held.merged
+	}
+	func() {
+		cr.inputLock.Lock()
+		defer cr.inputLock.Unlock()
+		// Forget what's been looked at, so that processInput
+		// doesn't ignore the input as uninteresting.
+		cr.currInput = conflictInput{
+			unmerged: MetadataRevisionUninitialized,
+			merged:   MetadataRevisionUninitialized,
+		}
+	}()
+	cr.queueInput(ci)
+}
+
+// DropHeld forgets about any conflict held in manual mode, e.g. after
+// the unmerged branch has been thrown away.
+func (cr *ConflictResolver) DropHeld() {
+	_ = cr.takeHeldInput()
+}
+
+func (cr *ConflictResolver) isManual() (manual bool, held bool) {
+	cr.manualLock.Lock()
+	defer cr.manualLock.Unlock()
+	return cr.manual, cr.heldInput != nil
+}
+
+// getLastErr returns the error from the most recent resolution.
+func (cr *ConflictResolver) getLastErr() error {
+	cr.statusLock.Lock()
+	defer cr.statusLock.Unlock()
+	return cr.lastErr
 }
 
 // Wait blocks until the current set of submitted resolutions are
@@ -544,8 +696,8 @@ func (cr *ConflictResolver) addChildBlocksIfIndirectFile(ctx context.Context,
 	if fblock.IsInd {
 		cr.log.CDebugf(ctx, "Adding child pointers for recreated "+
 			"file %s", currPath)
-		for _, ptr := range fblock.IPtrs {
-			op.AddRefBlock(ptr.BlockPointer)
+		for _, info := range fileBlockChildInfos(fblock) {
+			op.AddRefBlock(info.BlockPointer)
 		}
 	}
 	return nil
@@ -982,10 +1134,42 @@ func (cr *ConflictResolver) buildChainsAndPaths(
 		return nil, nil, nil, nil, nil, nil, nil, err
 	}
 
+	unmergedChains, mergedChains, unmergedPaths, err =
+		cr.makeChainsAndUnmergedPaths(ctx, unmerged, merged)
+	if err != nil {
+		return nil, nil, nil, nil, nil, nil, nil, err
+	}
+
+	// Find the corresponding path in the merged branch for each of
+	// these unmerged paths, and the set of any createOps needed to
+	// apply these unmerged operations in the merged branch.
+	mergedPaths, recreateOps, newUnmergedPaths, err := cr.resolveMergedPaths(
+		ctx, lState, unmergedPaths, unmergedChains, mergedChains)
+	if err != nil {
+		// Return mergedChains in this error case, to allow the error
+		// handling code to unstage if necessary.
+		return nil, nil, nil, nil, nil, nil, merged, err
+	}
+	unmergedPaths = append(unmergedPaths, newUnmergedPaths...)
+	if len(newUnmergedPaths) > 0 {
+		sort.Sort(crSortedPaths(unmergedPaths))
+	}
+
+	return unmergedChains, mergedChains, unmergedPaths, mergedPaths,
+		recreateOps, unmerged, merged, nil
+}
+
+// makeChainsAndUnmergedPaths makes the chains for the given MDs, and
+// gets the paths of the changed unmerged nodes, without touching any
+// of the resolver's state.
+func (cr *ConflictResolver) makeChainsAndUnmergedPaths(ctx context.Context,
+	unmerged, merged []ImmutableRootMetadata) (
+	unmergedChains, mergedChains *crChains, unmergedPaths []path,
+	err error) {
 	// Make the chains
 	unmergedChains, mergedChains, err = cr.makeChains(ctx, unmerged, merged)
 	if err != nil {
-		return nil, nil, nil, nil, nil, nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	// TODO: if the root node didn't change in either chain, we can
@@ -998,37 +1182,21 @@ func (cr *ConflictResolver) buildChainsAndPaths(
 	unmergedPaths, err = unmergedChains.getPaths(ctx, &cr.fbo.blocks,
 		cr.log, cr.fbo.nodeCache, false)
 	if err != nil {
-		return nil, nil, nil, nil, nil, nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	// Add in any directory paths that were created in both branches.
 	newUnmergedPaths, err := cr.findCreatedDirsToMerge(ctx, unmergedPaths,
 		unmergedChains, mergedChains)
 	if err != nil {
-		return nil, nil, nil, nil, nil, nil, nil, err
-	}
-	unmergedPaths = append(unmergedPaths, newUnmergedPaths...)
-	if len(newUnmergedPaths) > 0 {
-		sort.Sort(crSortedPaths(unmergedPaths))
-	}
-
-	// Find the corresponding path in the merged branch for each of
-	// these unmerged paths, and the set of any createOps needed to
-	// apply these unmerged operations in the merged branch.
-	mergedPaths, recreateOps, newUnmergedPaths, err = cr.resolveMergedPaths(
-		ctx, lState, unmergedPaths, unmergedChains, mergedChains)
-	if err != nil {
-		// Return mergedChains in this error case, to allow the error
-		// handling code to unstage if necessary.
-		return nil, nil, nil, nil, nil, nil, merged, err
+		return nil, nil, nil, err
 	}
 	unmergedPaths = append(unmergedPaths, newUnmergedPaths...)
 	if len(newUnmergedPaths) > 0 {
 		sort.Sort(crSortedPaths(unmergedPaths))
 	}
 
-	return unmergedChains, mergedChains, unmergedPaths, mergedPaths,
-		recreateOps, unmerged, merged, nil
+	return unmergedChains, mergedChains, unmergedPaths, nil
 }
 
 // addRecreateOpsToUnmergedChains inserts each recreateOp, into its
@@ -1625,6 +1793,12 @@ func (cr *ConflictResolver) getActionsToMerge(unmergedChains *crChains,
 	map[BlockPointer]crActionList, error) {
 	actionMap := make(map[BlockPointer]crActionList)
 	for unmergedMostRecent, unmergedChain := range unmergedChains.byMostRecent {
+		// Prune the chains that are only there to map pointers;
+		// without ops they can't produce any actions, and in a
+		// wide directory they far outnumber the changed ones.
+		if len(unmergedChain.ops) == 0 {
+			continue
+		}
 		original := unmergedChain.original
 		// If this is a file that has been deleted in the merged
 		// branch, a corresponding recreate op will take care of it,
@@ -1664,7 +1838,19 @@ func (cr *ConflictResolver) getActionsToMerge(unmergedChains *crChains,
 func collapseActions(unmergedChains *crChains, unmergedPaths []path,
 	mergedPaths map[BlockPointer]path,
 	actionMap map[BlockPointer]crActionList) (newUnmergedPaths []path) {
+	unmergedPathsByPtr := make(map[BlockPointer][]path, len(unmergedPaths))
+	for _, unmergedPath := range unmergedPaths {
+		ptr := unmergedPath.tailPointer()
+		unmergedPathsByPtr[ptr] = append(unmergedPathsByPtr[ptr], unmergedPath)
+	}
 	for unmergedMostRecent, chain := range unmergedChains.byMostRecent {
+		// An unchanged chain only gets actions moved into it from
+		// its children, and those are already marked as moved, so
+		// there's nothing to combine.
+		if len(chain.ops) == 0 {
+			continue
+		}
+
 		// Find the parent directory path and combine
 		p, ok := mergedPaths[unmergedMostRecent]
 		if !ok {
@@ -1676,8 +1862,9 @@ func collapseActions(unmergedChains *crChains, unmergedPaths []path,
 			continue
 		}
 
-		// If this is a directory with setAttr(mtime)-related actions,
-		// just those action should be collapsed into the parent.
+		// If this is a directory with setAttr(mtime, xattr, mode
+		// or owner)-related actions, just those action should be
+		// collapsed into the parent.
 		if !chain.isFile() {
 			var parentActions crActionList
 			var otherDirActions crActionList
@@ -1685,7 +1872,8 @@ func collapseActions(unmergedChains *crChains, unmergedPaths []path,
 				moved := false
 				switch realAction := action.(type) {
 				case *copyUnmergedAttrAction:
-					if realAction.attr[0] == mtimeAttr && !realAction.moved {
+					if realAction.attr[0].canBeDirAttr() &&
+						!realAction.moved {
 						realAction.moved = true
 						parentActions = append(parentActions, realAction)
 						moved = true
@@ -1737,10 +1925,7 @@ func collapseActions(unmergedChains *crChains, unmergedPaths []path,
 			// executed.
 			//
 			// Find the unmerged path to get the unmerged parent.
-			for _, unmergedPath := range unmergedPaths {
-				if unmergedPath.tailPointer() != unmergedMostRecent {
-					continue
-				}
+			for _, unmergedPath := range unmergedPathsByPtr[unmergedMostRecent] {
 				unmergedParentPath := *unmergedPath.parentPath()
 				newUnmergedPaths = append(newUnmergedPaths, unmergedParentPath)
 				unmergedParent := unmergedParentPath.tailPointer()
@@ -1796,6 +1981,11 @@ func (cr *ConflictResolver) computeActions(ctx context.Context,
 	return actionMap, append(newUnmergedPaths, moreNewUnmergedPaths...), nil
 }
 
+// fetchDirBlockCopy gets a copy of a directory block that the
+// resolution can change, and adds it to lbc.  Only the map of entries
+// is copied, not the entries themselves: decoding a very large
+// directory all over again just to change a few entries in it is
+// expensive.
 func (cr *ConflictResolver) fetchDirBlockCopy(ctx context.Context,
 	lState *lockState, kmd KeyMetadata, dir path, lbc localBcache) (
 	*DirBlock, error) {
@@ -1809,11 +1999,33 @@ func (cr *ConflictResolver) fetchDirBlockCopy(ctx context.Context,
 	if err != nil {
 		return nil, err
 	}
-	dblock, err = dblock.DeepCopy(cr.config.Codec())
+	dblock = dblock.copyChildren()
+	lbc[ptr] = dblock
+	return dblock, nil
+}
+
+// fetchUnmergedDirBlock gets a directory block that will only be
+// used as the source of actions.  Unlike fetchDirBlockCopy, it
+// doesn't copy the block or add it to lbc, since it won't be synced;
+// copying a very large directory just to read a few entries out of it
+// is expensive.  It prefers a copy already in lbc, though, so that it
+// sees any changes already made to that block.
+func (cr *ConflictResolver) fetchUnmergedDirBlock(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, dir path, lbc localBcache,
+	sources localBcache) (*DirBlock, error) {
+	ptr := dir.tailPointer()
+	if block, ok := lbc[ptr]; ok {
+		return block, nil
+	}
+	if block, ok := sources[ptr]; ok {
+		return block, nil
+	}
+	dblock, err := cr.fbo.blocks.GetDirBlockForReading(
+		ctx, lState, kmd, ptr, dir.Branch, dir)
 	if err != nil {
 		return nil, err
 	}
-	lbc[ptr] = dblock
+	sources[ptr] = dblock
 	return dblock, nil
 }
 
@@ -1847,20 +2059,17 @@ func (cr *ConflictResolver) makeFileBlockDeepCopy(ctx context.Context,
 			return BlockPointer{}, err
 		}
 		newPtr = BlockPointer{
-			ID:      newID,
-			KeyGen:  md.LatestKeyGeneration(),
-			DataVer: cr.config.DataVersion(),
-			BlockContext: BlockContext{
-				Creator:  uid,
-				RefNonce: zeroBlockRefNonce,
-			},
+			ID:           newID,
+			KeyGen:       md.LatestKeyGeneration(),
+			DataVer:      cr.config.DataVersion(),
+			BlockContext: makeFirstBlockContext(uid),
 		}
 	} else {
-		newPtr.RefNonce, err = cr.config.Crypto().MakeBlockRefNonce()
+		refNonce, err := cr.config.Crypto().MakeBlockRefNonce()
 		if err != nil {
 			return BlockPointer{}, err
 		}
-		newPtr.SetWriter(uid)
+		newPtr.BlockContext = makeBlockContext(newPtr.Creator, uid, refNonce)
 	}
 	cr.log.CDebugf(ctx, "Deep copying file %s: %v -> %v", name, ptr, newPtr)
 	// Mark this as having been created during this chain, so that
@@ -1882,20 +2091,29 @@ func (cr *ConflictResolver) makeFileBlockDeepCopy(ctx context.Context,
 		blocks[mergedMostRecent] = make(map[string]*FileBlock)
 	}
 
-	// Dup all of the leaf blocks.
-	// TODO: deal with multiple levels of indirection.
+	// Dup all of the leaf blocks.  The copy gets indirect blocks of
+	// its own when it's synced.
 	if fblock.IsInd {
+		for _, parents := range fblock.parents {
+			for _, iptr := range parents {
+				if newlyCreated {
+					chains.toUnrefPointers[iptr.BlockPointer] = true
+				}
+			}
+		}
+		fblock.parents = nil
 		for i, iptr := range fblock.IPtrs {
 			if newlyCreated {
 				chains.toUnrefPointers[iptr.BlockPointer] = true
 			}
 
 			// Generate a new nonce for each one.
-			iptr.RefNonce, err = cr.config.Crypto().MakeBlockRefNonce()
+			refNonce, err := cr.config.Crypto().MakeBlockRefNonce()
 			if err != nil {
 				return BlockPointer{}, err
 			}
-			iptr.SetWriter(uid)
+			iptr.BlockContext = makeBlockContext(
+				iptr.Creator, uid, refNonce)
 			fblock.IPtrs[i] = iptr
 			chains.createdOriginals[iptr.BlockPointer] = true
 		}
@@ -1922,6 +2140,7 @@ func (cr *ConflictResolver) doActions(ctx context.Context,
 	// updated merged blocks.  A future phase will update the pointers
 	// in standard Merkle-tree-fashion.
 	doneActions := make(map[BlockPointer]bool)
+	sources := make(localBcache)
 	for _, unmergedPath := range unmergedPaths {
 		unmergedMostRecent := unmergedPath.tailPointer()
 		unmergedChain, ok :=
@@ -1950,12 +2169,19 @@ func (cr *ConflictResolver) doActions(ctx context.Context,
 		}
 
 		actions := actionMap[mergedPath.tailPointer()]
-		// Now get the directory blocks.
-		unmergedBlock, err := cr.fetchDirBlockCopy(ctx, lState,
-			unmergedChains.mostRecentMD.ReadOnly(),
-			unmergedPath, lbc)
-		if err != nil {
-			return err
+
+		// Now get the directory blocks.  The unmerged block is only
+		// needed if there are actions to read from it, but the
+		// merged block is on a path that will be synced either way.
+		var unmergedBlock *DirBlock
+		var err error
+		if len(actions) > 0 {
+			unmergedBlock, err = cr.fetchUnmergedDirBlock(ctx, lState,
+				unmergedChains.mostRecentMD.ReadOnly(),
+				unmergedPath, lbc, sources)
+			if err != nil {
+				return err
+			}
 		}
 
 		// recreateOps update the merged paths using original
@@ -1975,6 +2201,12 @@ func (cr *ConflictResolver) doActions(ctx context.Context,
 			}
 		}
 
+		// Actions are keyed by the merged directory they modify, so
+		// that's what to dedup on.  Several merged directories can
+		// take actions sourced from the same unmerged directory (for
+		// example when the merged branch has moved one of its
+		// children elsewhere), so the unmerged path must not be used
+		// here.
 		if len(actions) > 0 && !doneActions[mergedPath.tailPointer()] {
 			// Make sure we don't try to execute the same actions twice.
 			doneActions[mergedPath.tailPointer()] = true
@@ -2029,6 +2261,10 @@ func (cr *ConflictResolver) doActions(ctx context.Context,
 					return err
 				}
 			}
+
+			// The actions may have added or removed hard links, or
+			// turned unmerged ones into copies.
+			fixLinkCounts(mergedBlock)
 		}
 
 		// Now update the ops related to this exact path (not the ops
@@ -2195,6 +2431,8 @@ func (cr *ConflictResolver) createResolvedMD(ctx context.Context,
 	if err != nil {
 		return nil, err
 	}
+	newMD.data.Trash = mergeTrashInfo(
+		newMD.data.Trash, unmergedChains.mostRecentMD.data.Trash)
 
 	// We also need to add in any creates that happened within
 	// newly-created directories (which aren't being merged with other
@@ -2250,11 +2488,12 @@ func (cr *ConflictResolver) createResolvedMD(ctx context.Context,
 					return nil, err
 				}
 				if fblock.IsInd {
+					infos := fileBlockChildInfos(fblock)
 					newCreateOp.RefBlocks = make([]BlockPointer,
-						len(fblock.IPtrs)+1)
+						len(infos)+1)
 					newCreateOp.RefBlocks[0] = cop.Refs()[0]
-					for j, iptr := range fblock.IPtrs {
-						newCreateOp.RefBlocks[j+1] = iptr.BlockPointer
+					for j, info := range infos {
+						newCreateOp.RefBlocks[j+1] = info.BlockPointer
 					}
 				}
 			}
@@ -2272,6 +2511,19 @@ func (cr *ConflictResolver) createResolvedMD(ctx context.Context,
 		return nil, err
 	}
 
+	// The big xattr values of files created in this branch are only
+	// referenced by setAttrOps in the files' own chains, which are
+	// skipped above, so reference them from the create ops.
+	for _, op := range ops {
+		cop, ok := op.(*createOp)
+		if !ok || cop.Type == Dir || len(cop.Refs()) == 0 {
+			continue
+		}
+		for _, ptr := range unmergedChains.liveXattrPointers(cop.Refs()[0]) {
+			cop.AddRefBlock(ptr)
+		}
+	}
+
 	cr.log.CDebugf(ctx, "Remote notifications: %v", ops)
 	for _, op := range ops {
 		cr.log.CDebugf(ctx, "%s: refs %v", op, op.Refs())
@@ -2354,6 +2606,12 @@ func crFixOpPointers(oldOps []op, updates map[BlockPointer]BlockPointer,
 
 		for _, update := range updatesToFix {
 			newPtr, ok := updates[update.Unref]
+			if !ok {
+				// A later op in a directory that was created on
+				// both branches unrefs an intermediate unmerged
+				// version of it, which only its original maps.
+				newPtr, ok = updates[chains.originalOf(update.Unref)]
+			}
 			if !ok {
 				continue
 			}
@@ -2615,6 +2873,74 @@ func (cr *ConflictResolver) syncTree(ctx context.Context, lState *lockState,
 	return bps, nil
 }
 
+// unmergedDirShards returns the shards, created on the unmerged
+// branch, of the most recent unmerged version of each sharded
+// directory changed there.  Those are only referenced by unmerged
+// directory blocks, which the resolution replaces, since it rewrites
+// every shard of the directories it syncs.
+func (cr *ConflictResolver) unmergedDirShards(ctx context.Context,
+	lState *lockState, unmergedChains *crChains) (
+	map[BlockPointer]bool, error) {
+	shards := make(map[BlockPointer]bool)
+	for _, chain := range unmergedChains.byOriginal {
+		if chain.isFile() {
+			continue
+		}
+		dblock, err := cr.fbo.blocks.GetDirBlockForReading(ctx, lState,
+			unmergedChains.mostRecentMD.ReadOnly(), chain.mostRecent,
+			cr.fbo.branch(), path{})
+		if _, notDir := err.(NotDirBlockError); notDir {
+			// Chains whose type was never needed aren't
+			// marked as files.
+			continue
+		} else if isRecoverableBlockError(err) {
+			// The directory may since have been removed, and
+			// its blocks reclaimed, on the merged branch.
+			cr.log.CDebugf(ctx, "Couldn't get unmerged directory %v "+
+				"to look for shards: %v", chain.mostRecent, err)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, iptr := range dblock.IPtrs {
+			if unmergedChains.isCreated(iptr.BlockPointer) {
+				shards[iptr.BlockPointer] = true
+			}
+		}
+	}
+	return shards, nil
+}
+
+// replacedEntryPointers returns the pointers to all the blocks of
+// entry, a merged entry that the resolution replaced.
+func (cr *ConflictResolver) replacedEntryPointers(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, entry DirEntry) (
+	[]BlockPointer, error) {
+	var ptrs []BlockPointer
+	for _, xv := range entry.Xattrs {
+		if xv.Block.BlockPointer != zeroPtr {
+			ptrs = append(ptrs, xv.Block.BlockPointer)
+		}
+	}
+	if entry.Type == Sym || entry.BlockPointer == zeroPtr {
+		return ptrs, nil
+	}
+	ptrs = append(ptrs, entry.BlockPointer)
+	file := path{
+		FolderBranch: cr.fbo.folderBranch,
+		path:         []pathNode{{BlockPointer: entry.BlockPointer}},
+	}
+	fblock, err := cr.fbo.blocks.GetFileBlockForReading(ctx, lState, kmd,
+		entry.BlockPointer, file.Branch, file)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range fileBlockChildInfos(fblock) {
+		ptrs = append(ptrs, info.BlockPointer)
+	}
+	return ptrs, nil
+}
+
 // calculateResolutionBytes figured out how many bytes are referenced
 // and unreferenced in the merged branch by this resolution.  It
 // should be called before the block changes are unembedded in md.
@@ -2625,16 +2951,49 @@ func (cr *ConflictResolver) calculateResolutionUsage(ctx context.Context,
 	md.SetUnrefBytes(0)
 	md.SetDiskUsage(mergedChains.mostRecentMD.DiskUsage())
 
+	unmergedShards, err := cr.unmergedDirShards(ctx, lState, unmergedChains)
+	if err != nil {
+		return err
+	}
+
+	// The resolution replaced these merged xattr values, so their
+	// blocks are no longer referenced.
+	for ptr := range unmergedChains.replacedXattrPointers {
+		md.data.Changes.Ops[len(md.data.Changes.Ops)-1].AddUnrefBlock(ptr)
+	}
+	// Likewise for the merged entries that unmerged ones replaced,
+	// except for the top blocks of merged files, which are already
+	// unreferenced by their updates.
+	resOp := md.data.Changes.Ops[len(md.data.Changes.Ops)-1]
+	updated := make(map[BlockPointer]bool)
+	for _, update := range resOp.AllUpdates() {
+		updated[update.Unref] = true
+	}
+	for _, entry := range unmergedChains.replacedMergedEntries {
+		ptrs, err := cr.replacedEntryPointers(
+			ctx, lState, mergedChains.mostRecentMD, entry)
+		if err != nil {
+			return err
+		}
+		for _, ptr := range ptrs {
+			if !updated[ptr] {
+				resOp.AddUnrefBlock(ptr)
+			}
+		}
+	}
+
 	// Track the refs and unrefs in a set, to ensure no duplicates
 	refs := make(map[BlockPointer]bool)
 	unrefs := make(map[BlockPointer]bool)
 	for _, op := range md.data.Changes.Ops {
 		for _, ptr := range op.Refs() {
 			// Don't add usage if it's an unembedded block change
-			// pointer.  Also, we shouldn't be referencing this
-			// anymore!
+			// pointer, or the shard of an unmerged directory.
+			// Also, we shouldn't be referencing these anymore!
 			if _, ok := unmergedChains.blockChangePointers[ptr]; ok {
 				op.DelRefBlock(ptr)
+			} else if unmergedShards[ptr] {
+				op.DelRefBlock(ptr)
 			} else {
 				refs[ptr] = true
 			}
@@ -2660,7 +3019,6 @@ func (cr *ConflictResolver) calculateResolutionUsage(ctx context.Context,
 	}
 
 	// Add bytes for every ref'd block.
-	var err error
 	for ptr := range refs {
 		block, ok := localBlocks[ptr]
 		if !ok {
@@ -2738,6 +3096,15 @@ func (cr *ConflictResolver) calculateResolutionUsage(ctx context.Context,
 			toUnref[ptr] = true
 		} else if _, ok := unmergedChains.toUnrefPointers[ptr]; ok {
 			toUnref[ptr] = true
+		} else if !refs[ptr] && !unrefs[ptr] &&
+			unmergedChains.xattrPointers[ptr] {
+			// An xattr value whose setAttrOp was dropped.
+			toUnref[ptr] = true
+		}
+	}
+	for ptr := range unmergedShards {
+		if !unrefs[ptr] {
+			toUnref[ptr] = true
 		}
 	}
 	for ptr := range toUnref {
@@ -2873,6 +3240,20 @@ func (cr *ConflictResolver) syncBlocks(ctx context.Context, lState *lockState,
 			updates[chain.original] = update.Ref
 		}
 
+		// The copy of the local version of a merged file is an
+		// update of the merged version of the file.
+		if merged, ok := unmergedChains.mergedFileCopies[update.Unref]; ok {
+			cr.log.CDebugf(ctx, "Fixing resOp update from merged file "+
+				"copy %v to merged most recent %v", update.Unref, merged)
+			err = update.setUnref(merged)
+			if err != nil {
+				return nil, nil, err
+			}
+			resOp.Updates[i] = update
+			updates[update.Unref] = update.Ref
+			continue
+		}
+
 		// Fix the gc updates to make sure they all unref the most
 		// recent block pointer.  In cases where the two users create
 		// the same directory independently, the update might
@@ -2919,13 +3300,20 @@ func (cr *ConflictResolver) syncBlocks(ctx context.Context, lState *lockState,
 	// updated as part of the resolution.  (For example, if a file was
 	// moved out of a directory in the merged branch, but an attr was
 	// set on that file in the unmerged branch.)
-	for unmergedOriginal := range unmergedChains.byOriginal {
+	// Merged nodes that were replaced by unmerged ones update to the
+	// unmerged most recent pointer instead.
+	replaced := unmergedChains.replacedMergedPointers()
+	for unmergedOriginal, unmergedChain := range unmergedChains.byOriginal {
 		mergedChain, ok := mergedChains.byOriginal[unmergedOriginal]
 		if !ok {
 			continue
 		}
 		if _, ok := updates[unmergedOriginal]; !ok {
-			updates[unmergedOriginal] = mergedChain.mostRecent
+			if replaced[mergedChain.mostRecent] {
+				updates[unmergedOriginal] = unmergedChain.mostRecent
+			} else {
+				updates[unmergedOriginal] = mergedChain.mostRecent
+			}
 		}
 	}
 
@@ -2934,7 +3322,7 @@ func (cr *ConflictResolver) syncBlocks(ctx context.Context, lState *lockState,
 	// version.
 	for original := range unmergedChains.renamedOriginals {
 		mergedChain, ok := mergedChains.byOriginal[original]
-		if !ok {
+		if !ok || replaced[mergedChain.mostRecent] {
 			continue
 		}
 		updates[original] = mergedChain.mostRecent
@@ -3052,10 +3440,16 @@ func (cr *ConflictResolver) getOpsForLocalNotification(ctx context.Context,
 		newPtrs[newMostRecent] = true
 	}
 
+	replaced := unmergedChains.replacedMergedPointers()
 	var ptrs []BlockPointer
 	chainsToUpdate := make(map[BlockPointer]BlockPointer)
 	chainsToAdd := make(map[BlockPointer]*crChain)
 	for ptr, chain := range mergedChains.byMostRecent {
+		if replaced[ptr] {
+			// The unmerged node took this one's place, and already
+			// has its own update above.
+			continue
+		}
 		if newMostRecent, ok := updates[chain.original]; ok {
 			ptrs = append(ptrs, newMostRecent)
 			chainsToUpdate[chain.mostRecent] = newMostRecent
@@ -3203,17 +3597,48 @@ func (cr *ConflictResolver) completeResolution(ctx context.Context,
 		return err
 	}
 
+	// Record the resolution before putting anything, so that if we
+	// die partway through, the next CR attempt can tell whether it
+	// landed.
+	entry := CRJournalEntry{
+		Tlf:      md.TlfID(),
+		BID:      cr.fbo.bid,
+		Revision: md.Revision(),
+		Root:     md.data.Dir.BlockPointer,
+	}
+	for _, bs := range bps.blockStates {
+		entry.Blocks = append(entry.Blocks, bs.blockPtr)
+	}
+	journal := cr.config.CRJournal()
+	err = journal.PutPendingResolution(entry)
+	if err != nil {
+		return err
+	}
+
 	defer func() {
 		if err != nil {
 			cr.fbo.fbm.cleanUpBlockState(
 				md.ReadOnly(), bps, blockDeleteOnMDFail)
 		}
+		// Either way, the block manager owns any cleanup from here.
+		if clearErr := journal.ClearPendingResolution(
+			md.TlfID()); clearErr != nil {
+			cr.log.CWarningf(ctx, "Couldn't clear the CR journal: %v",
+				clearErr)
+		}
 	}()
 
 	// Put all the blocks.  TODO: deal with recoverable block errors?
 	_, err = doBlockPuts(ctx, cr.config.BlockServer(), cr.config.BlockCache(),
 		cr.config.Reporter(), cr.log, md.TlfID(),
-		md.GetTlfHandle().GetCanonicalName(), *bps)
+		md.GetTlfHandle().GetCanonicalName(), *bps,
+		cr.config.BlockTransferMeter().PutParallelism())
+	if err != nil {
+		return err
+	}
+
+	entry.BlocksPut = true
+	err = journal.PutPendingResolution(entry)
 	if err != nil {
 		return err
 	}
@@ -3226,6 +3651,76 @@ func (cr *ConflictResolver) completeResolution(ctx context.Context,
 	return nil
 }
 
+// recoverFromJournal deals with a resolution left pending in the CR
+// journal by an earlier attempt that never finished (most likely
+// because the process died).  If that resolution made it to the
+// merged branch, the unmerged branch it resolved is dropped and true
+// is returned, since there's nothing left to resolve.  If the server
+// says it didn't, the block references it put are removed, so that
+// this attempt can start from scratch.  If the server can't say
+// either way, the entry is kept and the error is returned, so that a
+// later attempt can check again.
+func (cr *ConflictResolver) recoverFromJournal(ctx context.Context,
+	lState *lockState, writerLocked bool) (resolved bool, err error) {
+	journal := cr.config.CRJournal()
+	entry, ok, err := journal.GetPendingResolution(cr.fbo.id())
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, nil
+	}
+	cr.log.CDebugf(ctx, "Found a pending resolution of branch %s at "+
+		"revision %d (blocks put: %t)", entry.BID, entry.Revision,
+		entry.BlocksPut)
+
+	if entry.BlocksPut {
+		// Only roll back once the server has definitely said the
+		// resolution didn't land: either there's no such revision,
+		// or it has a different root.
+		rmds, err := getMDRange(ctx, cr.config, entry.Tlf, NullBranchID,
+			entry.Revision, entry.Revision, Merged)
+		if err != nil {
+			cr.log.CDebugf(ctx, "Couldn't tell whether the pending "+
+				"resolution landed, since revision %d couldn't be "+
+				"fetched: %v", entry.Revision, err)
+			return false, err
+		}
+		if len(rmds) == 1 && rmds[0].data.Dir.BlockPointer == entry.Root {
+			cr.log.CDebugf(ctx, "Pending resolution was successful; "+
+				"dropping branch %s", entry.BID)
+			if writerLocked {
+				err = cr.fbo.dropResolvedBranchLocked(ctx, lState, entry.BID)
+			} else {
+				err = cr.fbo.dropResolvedBranch(ctx, lState, entry.BID)
+			}
+			if err != nil {
+				return false, err
+			}
+			return true, journal.ClearPendingResolution(entry.Tlf)
+		} else if len(rmds) == 0 {
+			cr.log.CDebugf(ctx, "Pending resolution failed, since "+
+				"revision %d doesn't exist", entry.Revision)
+		} else {
+			cr.log.CDebugf(ctx, "Pending resolution failed, since "+
+				"revision %d has a different root", entry.Revision)
+		}
+	}
+
+	cr.log.CDebugf(ctx, "Rolling back the %d block references of the "+
+		"pending resolution", len(entry.Blocks))
+	if len(entry.Blocks) > 0 {
+		// Some of the blocks may never have been put, so just
+		// log any errors rather than failing this resolution.
+		_, err := cr.config.BlockOps().Delete(ctx, entry.Tlf, entry.Blocks)
+		if err != nil {
+			cr.log.CDebugf(ctx, "Couldn't remove all the pending block "+
+				"references: %v", err)
+		}
+	}
+	return false, journal.ClearPendingResolution(entry.Tlf)
+}
+
 // maybeUnstageAfterFailure abandons this branch if there was a
 // conflict resolution failure due to missing blocks, caused by a
 // concurrent gcOp on the main branch.
@@ -3281,11 +3776,30 @@ func (e CRWrapError) Error() string {
 func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 	cr.log.CDebugf(ctx, "Starting conflict resolution with input %v", ci)
 	var err error
-	lState := makeFBOLockState()
+	ctx, span := startSpan(ctx, cr.config.Tracer(), "CR.Resolve")
+	defer func() { span.Finish(err) }()
+	lState := makeBackgroundFBOLockState()
 	defer func() {
 		cr.log.CDebugf(ctx, "Finished conflict resolution: %v", err)
+		outcome := ReportEvent{
+			Type:     EventCROutcome,
+			Severity: SeverityInfo,
+			Public:   cr.fbo.id().IsPublic(),
+			TlfID:    cr.fbo.id().String(),
+			Err:      err,
+			Message:  "Conflict resolution succeeded",
+		}
 		if err != nil {
-			handle := cr.fbo.getHead(lState).GetTlfHandle()
+			outcome.Severity = SeverityError
+			outcome.Message = ""
+		}
+		head := cr.fbo.getHead(lState)
+		if head != (ImmutableRootMetadata{}) {
+			outcome.TlfName = head.GetTlfHandle().GetCanonicalName()
+		}
+		cr.config.Reporter().ReportEvent(ctx, outcome)
+		if err != nil {
+			handle := head.GetTlfHandle()
 			cr.config.Reporter().ReportErr(ctx,
 				handle.GetCanonicalName(), handle.IsPublic(),
 				WriteMode, CRWrapError{err})
@@ -3311,6 +3825,20 @@ func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 		}
 	}()
 
+	// The finished event must not use the time-limited context
+	// below.
+	merger := cr.config.ConflictFileMerger()
+	var conflictCopies []crConflictCopy
+	finishCtx := ctx
+	cr.startResolution(ctx)
+	defer func() {
+		if err != nil {
+			// A failed attempt made no copies.
+			conflictCopies = nil
+		}
+		cr.finishResolution(finishCtx, conflictCopies, err)
+	}()
+
 	// Check if we need to deploy the nuclear option and completely
 	// block unmerged writes while we try to resolve.
 	doLock := func() bool {
@@ -3346,6 +3874,12 @@ func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 		return
 	}
 
+	// Finish off any resolution interrupted by a restart.
+	resolved, err := cr.recoverFromJournal(ctx, lState, doLock)
+	if err != nil || resolved {
+		return
+	}
+
 	// Step 1: Build the chains for each branch, as well as the paths
 	// and necessary extra recreate ops.  The result of this step is:
 	//   * A set of conflict resolution "chains" for both the unmerged and
@@ -3355,9 +3889,11 @@ func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 	//   * A set of "recreate" ops that must be applied on the merged branch
 	//     to recreate any directories that were modified in the unmerged
 	//     branch but removed in the merged branch.
+	phaseCtx, phase := startSpan(ctx, nil, "CR.BuildChains")
 	unmergedChains, mergedChains, unmergedPaths, mergedPaths, recOps,
 		unmergedMDs, mergedMDs, err :=
-		cr.buildChainsAndPaths(ctx, lState, doLock)
+		cr.buildChainsAndPaths(phaseCtx, lState, doLock)
+	phase.Finish(err)
 	if err != nil {
 		return
 	}
@@ -3389,6 +3925,12 @@ func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 	}
 	cr.log.CDebugf(ctx, "Recreate ops: %s", recOps)
 
+	var mergeCandidates map[crFileMergeKey]crFileMerge
+	if merger != nil && !ci.keepLocal {
+		mergeCandidates = cr.findFileMergeCandidates(
+			unmergedChains, mergedChains, mergedPaths)
+	}
+
 	// Step 2: Figure out which actions need to be taken in the merged
 	// branch to best reflect the unmerged changes.  The result of
 	// this step is a map containing, for each node in the merged path
@@ -3397,8 +3939,10 @@ func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 	// actions contains the logic needed to manipulate the data into
 	// the final merged state, including the resolution of any
 	// conflicts that occurred between the two branches.
-	actionMap, newUnmergedPaths, err := cr.computeActions(ctx, unmergedChains,
-		mergedChains, unmergedPaths, mergedPaths, recOps)
+	phaseCtx, phase = startSpan(ctx, nil, "CR.ComputeActions")
+	actionMap, newUnmergedPaths, err := cr.computeActions(phaseCtx,
+		unmergedChains, mergedChains, unmergedPaths, mergedPaths, recOps)
+	phase.Finish(err)
 	if err != nil {
 		return
 	}
@@ -3414,6 +3958,17 @@ func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 		return
 	}
 
+	if ci.keepLocal {
+		keepUnmergedEntries(actionMap)
+	}
+	// Files whose contents can be merged keep their local version,
+	// with the merged contents, instead of getting a conflict copy.
+	var fileMerges []crFileMerge
+	if len(mergeCandidates) > 0 {
+		fileMerges = cr.mergeConflictFiles(ctx, lState, merger,
+			unmergedChains, mergedChains,
+			getFileMerges(mergeCandidates, actionMap))
+	}
 	cr.log.CDebugf(ctx, "Action map: %v", actionMap)
 
 	// Step 3: Apply the actions by looking up the corresponding
@@ -3440,8 +3995,10 @@ func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 	// references for all indirect pointers inside it.  If it is not
 	// an indirect block, just add a new reference to the block.
 	newFileBlocks := make(fileBlockMap)
-	err = cr.doActions(ctx, lState, unmergedChains, mergedChains,
+	phaseCtx, phase = startSpan(ctx, nil, "CR.DoActions")
+	err = cr.doActions(phaseCtx, lState, unmergedChains, mergedChains,
 		unmergedPaths, mergedPaths, actionMap, lbc, newFileBlocks)
+	phase.Finish(err)
 	if err != nil {
 		return
 	}
@@ -3453,14 +4010,27 @@ func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 	cr.log.CDebugf(ctx, "Executed all actions, %d updated directory blocks",
 		len(lbc))
 
+	fileMerges, err = applyFileMerges(
+		unmergedChains, actionMap, lbc, newFileBlocks, fileMerges)
+	if err != nil {
+		return
+	}
+	// The actions have now picked the final conflict names.
+	conflictCopies = getConflictCopies(mergedPaths, actionMap)
+
 	// Step 4: finish up by syncing all the blocks, computing and
 	// putting the final resolved MD, and issuing all the local
 	// notifications.
-	err = cr.completeResolution(ctx, lState, unmergedChains, mergedChains,
-		unmergedPaths, mergedPaths, lbc, newFileBlocks, unmergedMDs, doLock)
+	phaseCtx, phase = startSpan(ctx, nil, "CR.CompleteResolution")
+	err = cr.completeResolution(phaseCtx, lState, unmergedChains,
+		mergedChains, unmergedPaths, mergedPaths, lbc, newFileBlocks,
+		unmergedMDs, doLock)
+	phase.Finish(err)
 	if err != nil {
 		return
 	}
+	cr.notifyMergedFiles(ctx, fileMerges)
+	conflictCopies = cr.moveConflictCopies(ctx, lState, conflictCopies, doLock)
 
 	// TODO: If conflict resolution fails after some blocks were put,
 	// remember these and include them in the later resolution so they
@@ -3468,3 +4038,455 @@ func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 	// completely fail, we'll need to rely on a future complete scan
 	// to clean up the quota anyway . . .)
 }
+
+type crFileMergeKey struct {
+	mergedParent BlockPointer
+	unmergedName string
+}
+
+// crFileMerge describes a file that was written on both branches,
+// and whose unmerged version conflict resolution would move aside
+// to conflictName.
+type crFileMerge struct {
+	mergedPath   path
+	conflictName string
+	base         BlockPointer
+	local        BlockPointer
+	remote       BlockPointer
+	// action is the rename that makes the conflict copy.
+	action *renameUnmergedAction
+	// contents is set once the file has been merged.
+	contents []byte
+}
+
+// conflictPath returns the path of the conflict file, as a string.
+func (fm crFileMerge) conflictPath() string {
+	return fm.mergedPath.parentPath().String() + "/" + fm.conflictName
+}
+
+func firstSyncOp(chain *crChain) *syncOp {
+	for _, op := range chain.ops {
+		if so, ok := op.(*syncOp); ok {
+			return so
+		}
+	}
+	return nil
+}
+
+// findFileMergeCandidates returns every file that was synced on both
+// branches, keyed the way the resulting renameUnmergedAction will
+// identify it.  It must be called before computeActions, which
+// rewrites mergedPaths for files.
+func (cr *ConflictResolver) findFileMergeCandidates(
+	unmergedChains, mergedChains *crChains,
+	mergedPaths map[BlockPointer]path) map[crFileMergeKey]crFileMerge {
+	candidates := make(map[crFileMergeKey]crFileMerge)
+	for unmergedMostRecent, unmergedChain := range unmergedChains.byMostRecent {
+		if !unmergedChain.isFile() {
+			continue
+		}
+		mergedChain, ok := mergedChains.byOriginal[unmergedChain.original]
+		if !ok {
+			continue
+		}
+		unmergedSync := firstSyncOp(unmergedChain)
+		mergedSync := firstSyncOp(mergedChain)
+		if unmergedSync == nil || mergedSync == nil {
+			continue
+		}
+		mergedPath, ok := mergedPaths[unmergedMostRecent]
+		if !ok {
+			continue
+		}
+		key := crFileMergeKey{
+			mergedSync.getFinalPath().parentPath().tailPointer(),
+			unmergedSync.getFinalPath().tailName(),
+		}
+		candidates[key] = crFileMerge{
+			mergedPath: mergedPath,
+			base:       unmergedChain.original,
+			local:      unmergedMostRecent,
+			remote:     mergedChain.mostRecent,
+		}
+	}
+	return candidates
+}
+
+// getFileMerges matches the given candidates against the
+// write-conflict renames in actionMap.
+func getFileMerges(candidates map[crFileMergeKey]crFileMerge,
+	actionMap map[BlockPointer]crActionList) (merges []crFileMerge) {
+	if len(candidates) == 0 {
+		return nil
+	}
+	for _, actions := range actionMap {
+		for _, action := range actions {
+			rua, ok := action.(*renameUnmergedAction)
+			if !ok || rua.mergedParentMostRecent == zeroPtr {
+				continue
+			}
+			key := crFileMergeKey{rua.mergedParentMostRecent, rua.fromName}
+			fm, ok := candidates[key]
+			if !ok {
+				continue
+			}
+			fm.conflictName = rua.toName
+			fm.action = rua
+			merges = append(merges, fm)
+			delete(candidates, key)
+		}
+	}
+	return merges
+}
+
+// crFileReader streams the contents of a file from a read function
+// with the signature of KBFSOps.Read.
+type crFileReader struct {
+	read func(dest []byte, off int64) (int64, error)
+	off  int64
+}
+
+func (r *crFileReader) Read(p []byte) (int, error) {
+	n, err := r.read(p, r.off)
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 && len(p) > 0 {
+		return 0, io.EOF
+	}
+	r.off += n
+	return int(n), nil
+}
+
+// mergeConflictFiles tries to merge the contents of each given
+// file, before the actions in the resolution are done.  For each
+// file that it merges, it sets its action to keep the local version
+// of the file in place of the merged one; applyFileMerges then puts
+// the merged contents in it.  Only a file whose local version and
+// merged contents each fit in a single block can be merged, since
+// the local version's block is what gets the new contents.  Any
+// other file keeps its conflict copy.  It returns the merged files.
+func (cr *ConflictResolver) mergeConflictFiles(ctx context.Context,
+	lState *lockState, merger ConflictFileMerger,
+	unmergedChains, mergedChains *crChains,
+	merges []crFileMerge) (merged []crFileMerge) {
+	for _, fm := range merges {
+		contents, err := cr.mergeConflictFile(ctx, lState, merger,
+			unmergedChains, mergedChains, fm)
+		if err != nil {
+			cr.log.CDebugf(ctx, "Keeping conflict file %s: %v",
+				fm.conflictName, err)
+			continue
+		}
+		cr.log.CDebugf(ctx, "Merged %s instead of making conflict "+
+			"file %s", fm.mergedPath.tailName(), fm.conflictName)
+		fm.contents = contents
+		fm.action.keepUnmerged = true
+		merged = append(merged, fm)
+	}
+	return merged
+}
+
+func (cr *ConflictResolver) mergeConflictFile(ctx context.Context,
+	lState *lockState, merger ConflictFileMerger,
+	unmergedChains, mergedChains *crChains, fm crFileMerge) ([]byte, error) {
+	pathNodes := fm.mergedPath.path
+	name := fm.mergedPath.tailName()
+	filePath := func(ptr BlockPointer) path {
+		return path{
+			FolderBranch: fm.mergedPath.FolderBranch,
+			path: append(append([]pathNode(nil),
+				pathNodes[:len(pathNodes)-1]...), pathNode{ptr, name}),
+		}
+	}
+
+	localPath := filePath(fm.local)
+	localBlock, err := cr.fbo.blocks.GetFileBlockForReading(ctx, lState,
+		unmergedChains.mostRecentMD.ReadOnly(), fm.local,
+		localPath.Branch, localPath)
+	if err != nil {
+		return nil, err
+	}
+	if localBlock.IsInd {
+		return nil, FileTooBigToMergeError{name}
+	}
+
+	// The base and remote versions are read from their blocks, as
+	// of the merged branch.
+	kmd := mergedChains.mostRecentMD.ReadOnly()
+	basePath := filePath(fm.base)
+	baseReader := &crFileReader{read: func(dest []byte, off int64) (
+		int64, error) {
+		return cr.fbo.blocks.Read(ctx, lState, kmd, basePath, dest, off)
+	}}
+	remotePath := filePath(fm.remote)
+	remoteReader := &crFileReader{read: func(dest []byte, off int64) (
+		int64, error) {
+		return cr.fbo.blocks.Read(ctx, lState, kmd, remotePath, dest, off)
+	}}
+	merged, err := merger.MergeFile(ctx, name, baseReader,
+		bytes.NewReader(localBlock.Contents), remoteReader)
+	if err != nil {
+		return nil, err
+	}
+
+	block := NewFileBlock().(*FileBlock)
+	if cr.config.BlockSplitter().CopyUntilSplit(block, true, merged, 0) <
+		int64(len(merged)) {
+		return nil, FileTooBigToMergeError{name}
+	}
+	return merged, nil
+}
+
+// applyFileMerges puts the merged contents of each given file into
+// the copy of its local version's block that the resolution syncs,
+// and makes the sync of the file tell other devices that the whole
+// file changed.  A merged file whose local version couldn't replace
+// the merged one after all keeps its conflict copy.  Unlike a file
+// kept with ResolveKeepLocal, the merged file is updated to the
+// copy, so other devices keep any nodes they have for it.  It
+// returns the files that were merged.
+func applyFileMerges(unmergedChains *crChains,
+	actionMap map[BlockPointer]crActionList, lbc localBcache,
+	newFileBlocks fileBlockMap, merges []crFileMerge) (
+	merged []crFileMerge, err error) {
+	if len(merges) == 0 {
+		return nil, nil
+	}
+	dirs := make(map[*renameUnmergedAction]BlockPointer, len(merges))
+	for mergedDir, actions := range actionMap {
+		for _, action := range actions {
+			if rua, ok := action.(*renameUnmergedAction); ok {
+				dirs[rua] = mergedDir
+			}
+		}
+	}
+	for _, fm := range merges {
+		rua := fm.action
+		if !rua.keepUnmerged {
+			continue
+		}
+		mergedDir, ok := dirs[rua]
+		if !ok {
+			return nil, fmt.Errorf("No directory for merged file %s",
+				rua.toName)
+		}
+		dblock, ok := lbc[mergedDir]
+		if !ok {
+			return nil, fmt.Errorf("No block for directory %v of merged "+
+				"file %s", mergedDir, rua.toName)
+		}
+		fblock, ok := newFileBlocks[mergedDir][rua.toName]
+		if !ok {
+			return nil, fmt.Errorf("No block for merged file %s",
+				rua.toName)
+		}
+		fblock.Contents = fm.contents
+		de := dblock.Children[rua.toName]
+		de.Size = uint64(len(fm.contents))
+		dblock.Children[rua.toName] = de
+		unmergedChains.mergedFileCopies[de.BlockPointer] = fm.remote
+
+		if chain, ok := unmergedChains.byMostRecent[rua.unmergedFile]; ok {
+			if so := firstSyncOp(chain); so != nil {
+				so.Writes = nil
+				if len(fm.contents) > 0 {
+					so.addWrite(0, uint64(len(fm.contents)))
+				}
+				so.addTruncate(uint64(len(fm.contents)))
+			}
+		}
+		merged = append(merged, fm)
+	}
+	return merged, nil
+}
+
+// notifyMergedFiles tells local observers that the whole of each
+// given merged file changed, once the resolution is done.  The
+// resolution only tells them about the local version of each file
+// being kept.
+func (cr *ConflictResolver) notifyMergedFiles(
+	ctx context.Context, merges []crFileMerge) {
+	var changes []NodeChange
+	for _, fm := range merges {
+		parent, err := cr.lookupMergedDir(ctx, *fm.mergedPath.parentPath())
+		if err != nil {
+			cr.log.CDebugf(ctx, "Couldn't notify about merged file %s: %v",
+				fm.mergedPath.tailName(), err)
+			continue
+		}
+		n, _, err := cr.fbo.Lookup(ctx, parent, fm.mergedPath.tailName())
+		if err != nil {
+			cr.log.CDebugf(ctx, "Couldn't notify about merged file %s: %v",
+				fm.mergedPath.tailName(), err)
+			continue
+		}
+		changes = append(changes, NodeChange{
+			Node: n,
+			FileUpdated: []WriteRange{
+				{Off: 0, Len: uint64(len(fm.contents))},
+				{Off: uint64(len(fm.contents))},
+			},
+		})
+	}
+	if len(changes) > 0 {
+		cr.fbo.observers.batchChanges(ctx, changes)
+	}
+}
+
+// lookupMergedDir returns the Node for the given directory path in
+// the merged branch, looking it up by name from the root.
+func (cr *ConflictResolver) lookupMergedDir(
+	ctx context.Context, dir path) (Node, error) {
+	n, _, _, err := cr.fbo.getRootNode(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, pn := range dir.path[1:] {
+		n, _, err = cr.fbo.Lookup(ctx, n, pn.Name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// crConflictCopy describes an entry that conflict resolution moved
+// aside, from name to copyName, within dir, or that it then moved
+// into the conflict directory copyDir at the root of the TLF, in
+// which case dir is the root.
+type crConflictCopy struct {
+	dir      path
+	name     string
+	copyDir  string
+	copyName string
+	// unmerged is true if the entry moved aside was the local,
+	// unmerged one; otherwise the merged one was moved aside, and
+	// the local one took its name.
+	unmerged bool
+}
+
+func (c crConflictCopy) String() string {
+	if c.copyDir != "" {
+		return c.dir.String() + "/" + c.copyDir + "/" + c.copyName
+	}
+	return c.dir.String() + "/" + c.copyName
+}
+
+type crConflictCopiesByName []crConflictCopy
+
+func (l crConflictCopiesByName) Len() int      { return len(l) }
+func (l crConflictCopiesByName) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l crConflictCopiesByName) Less(i, j int) bool {
+	return l[i].String() < l[j].String()
+}
+
+// keepUnmergedEntries marks the conflict renames in actionMap, so
+// that the unmerged version of each conflicting entry replaces the
+// merged one rather than being kept beside it.  Renames that
+// aren't due to conflicts keep their names, and an unmerged
+// directory that becomes a symlink can't replace anything.
+func keepUnmergedEntries(actionMap map[BlockPointer]crActionList) {
+	for _, actions := range actionMap {
+		for _, action := range actions {
+			switch a := action.(type) {
+			case *renameUnmergedAction:
+				a.keepUnmerged = a.fromName != a.toName && a.symPath == ""
+			case *renameMergedAction:
+				a.keepUnmerged = true
+			}
+		}
+	}
+}
+
+// getConflictCopies returns the conflict copies that the renames in
+// actionMap make.  The names are only final once the actions have
+// been done.
+func getConflictCopies(mergedPaths map[BlockPointer]path,
+	actionMap map[BlockPointer]crActionList) (copies []crConflictCopy) {
+	dirs := make(map[BlockPointer]path, len(mergedPaths))
+	for _, p := range mergedPaths {
+		dirs[p.tailPointer()] = p
+	}
+	for ptr, actions := range actionMap {
+		dir, ok := dirs[ptr]
+		if !ok {
+			continue
+		}
+		for _, action := range actions {
+			switch a := action.(type) {
+			case *renameUnmergedAction:
+				if !a.keepUnmerged {
+					copies = append(copies, crConflictCopy{
+						dir, a.fromName, "", a.toName, true})
+				}
+			case *renameMergedAction:
+				if !a.keepUnmerged {
+					copies = append(copies, crConflictCopy{
+						dir, a.fromName, "", a.toName, false})
+				}
+			}
+		}
+	}
+	sort.Sort(crConflictCopiesByName(copies))
+	return copies
+}
+
+func (cr *ConflictResolver) startResolution(ctx context.Context) {
+	func() {
+		cr.statusLock.Lock()
+		defer cr.statusLock.Unlock()
+		cr.inProgress = true
+	}()
+	cr.fbo.observers.conflictResolutionEvent(ctx, ConflictEvent{
+		Type:         ConflictResolutionStarted,
+		FolderBranch: cr.fbo.folderBranch,
+	})
+}
+
+// finishResolution records the outcome of a resolution for
+// getStatus, and tells the reporter and any ConflictObservers about
+// it.
+func (cr *ConflictResolver) finishResolution(
+	ctx context.Context, copies []crConflictCopy, err error) {
+	conflictFiles := make([]string, 0, len(copies))
+	for _, c := range copies {
+		conflictFiles = append(conflictFiles, c.String())
+	}
+	func() {
+		cr.statusLock.Lock()
+		defer cr.statusLock.Unlock()
+		cr.inProgress = false
+		cr.lastErr = err
+		cr.conflictFiles = append(cr.conflictFiles, conflictFiles...)
+		if extra := len(cr.conflictFiles) - maxConflictFilesRemembered; extra > 0 {
+			cr.conflictFiles = cr.conflictFiles[extra:]
+		}
+	}()
+	public := cr.fbo.id().IsPublic()
+	for _, f := range conflictFiles {
+		cr.config.Reporter().Notify(ctx, conflictCopyNotification(f, public))
+	}
+	cr.fbo.observers.conflictResolutionEvent(ctx, ConflictEvent{
+		Type:          ConflictResolutionFinished,
+		FolderBranch:  cr.fbo.folderBranch,
+		ConflictFiles: conflictFiles,
+		Err:           err,
+	})
+}
+
+// getStatus returns the parts of a ConflictStatus that the
+// ConflictResolver knows about.
+func (cr *ConflictResolver) getStatus() ConflictStatus {
+	cr.statusLock.Lock()
+	defer cr.statusLock.Unlock()
+	cs := ConflictStatus{
+		CRInProgress:  cr.inProgress,
+		ConflictFiles: append([]string(nil), cr.conflictFiles...),
+	}
+	cs.ManualCR, cs.CRHeld = cr.isManual()
+	if cr.lastErr != nil {
+		cs.LastCRError = cr.lastErr.Error()
+	}
+	return cs
+}
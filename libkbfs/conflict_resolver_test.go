@@ -6,6 +6,7 @@ package libkbfs
 
 import (
 	"errors"
+	"fmt"
 	"reflect"
 	"testing"
 	"time"
@@ -23,7 +24,8 @@ func crTestInit(t *testing.T) (mockCtrl *gomock.Controller, config *ConfigMock,
 	config = NewConfigMock(mockCtrl, ctr)
 	config.SetCodec(NewCodecMsgpack())
 	id := FakeTlfID(1, false)
-	fbo := newFolderBranchOps(config, FolderBranch{id, MasterBranch}, standard)
+	fbo := newFolderBranchOps(
+		config, FolderBranch{id, MasterBranch}, standard, nil)
 	// usernames don't matter for these tests
 	config.mockKbpki.EXPECT().GetNormalizedUsername(gomock.Any(), gomock.Any()).
 		AnyTimes().Return(libkb.NormalizedUsername("mockUser"), nil)
@@ -434,7 +436,7 @@ func TestCRMergedChainsSimple(t *testing.T) {
 	mergedPaths[expectedUnmergedPath.tailPointer()] = mergedPath
 	expectedActions := map[BlockPointer]crActionList{
 		mergedPath.tailPointer(): {&copyUnmergedEntryAction{
-			"file2", "file2", "", false, false, DirEntry{}, nil}},
+			"file2", "file2", "", false, false, DirEntry{}, nil, nil, nil}},
 	}
 	testCRCheckPathsAndActions(t, cr2, []path{expectedUnmergedPath},
 		mergedPaths, nil, expectedActions)
@@ -497,7 +499,7 @@ func TestCRMergedChainsDifferentDirectories(t *testing.T) {
 	mergedPaths[expectedUnmergedPath.tailPointer()] = mergedPath
 	expectedActions := map[BlockPointer]crActionList{
 		mergedPath.tailPointer(): {&copyUnmergedEntryAction{
-			"file2", "file2", "", false, false, DirEntry{}, nil}},
+			"file2", "file2", "", false, false, DirEntry{}, nil, nil, nil}},
 	}
 	testCRCheckPathsAndActions(t, cr2, []path{expectedUnmergedPath},
 		mergedPaths, nil, expectedActions)
@@ -590,11 +592,11 @@ func TestCRMergedChainsDeletedDirectories(t *testing.T) {
 	dirAPtr1 := cr1.fbo.nodeCache.PathFromNode(dirA1).tailPointer()
 	expectedActions := map[BlockPointer]crActionList{
 		dirCPtr: {&copyUnmergedEntryAction{"file2", "file2", "",
-			false, false, DirEntry{}, nil}},
+			false, false, DirEntry{}, nil, nil, nil}},
 		dirBPtr: {&copyUnmergedEntryAction{"dirC", "dirC", "", false, false,
-			DirEntry{}, nil}},
+			DirEntry{}, nil, nil, nil}},
 		dirAPtr1: {&copyUnmergedEntryAction{"dirB", "dirB", "", false, false,
-			DirEntry{}, nil}},
+			DirEntry{}, nil, nil, nil}},
 	}
 
 	testCRCheckPathsAndActions(t, cr2, []path{expectedUnmergedPath},
@@ -675,7 +677,7 @@ func TestCRMergedChainsRenamedDirectory(t *testing.T) {
 
 	expectedActions := map[BlockPointer]crActionList{
 		mergedPath.tailPointer(): {&copyUnmergedEntryAction{
-			"file2", "file2", "", false, false, DirEntry{}, nil}},
+			"file2", "file2", "", false, false, DirEntry{}, nil, nil, nil}},
 	}
 
 	testCRCheckPathsAndActions(t, cr2, []path{expectedUnmergedPath},
@@ -851,13 +853,13 @@ func TestCRMergedChainsComplex(t *testing.T) {
 	mergedPathE := cr1.fbo.nodeCache.PathFromNode(dirE1)
 	expectedActions := map[BlockPointer]crActionList{
 		mergedPathA.tailPointer(): {&copyUnmergedEntryAction{
-			"dirJ", "dirJ", "", false, false, DirEntry{}, nil}},
+			"dirJ", "dirJ", "", false, false, DirEntry{}, nil, nil, nil}},
 		mergedPathE.tailPointer(): {&copyUnmergedEntryAction{
-			"dirF", "dirF", "", false, false, DirEntry{}, nil}},
+			"dirF", "dirF", "", false, false, DirEntry{}, nil, nil, nil}},
 		mergedPathF.tailPointer(): {&copyUnmergedEntryAction{
-			"file3", "file3", "", false, false, DirEntry{}, nil}},
+			"file3", "file3", "", false, false, DirEntry{}, nil, nil, nil}},
 		mergedPathH.tailPointer(): {&copyUnmergedEntryAction{
-			"file4", "file4", "", false, false, DirEntry{}, nil}},
+			"file4", "file4", "", false, false, DirEntry{}, nil, nil, nil}},
 		mergedPathB.tailPointer(): {&rmMergedEntryAction{"dirD"}},
 	}
 	// `rm file5` doesn't get an action because the parent directory
@@ -950,7 +952,7 @@ func TestCRMergedChainsRenameCycleSimple(t *testing.T) {
 	expectedActions := map[BlockPointer]crActionList{
 		mergedPathRoot.tailPointer(): {&dropUnmergedAction{ro}},
 		mergedPathB.tailPointer(): {&copyUnmergedEntryAction{
-			"dirA", "dirA", "./../", false, false, DirEntry{}, nil}},
+			"dirA", "dirA", "./../", false, false, DirEntry{}, nil, nil, nil}},
 	}
 
 	testCRCheckPathsAndActions(t, cr2, []path{unmergedPathRoot, unmergedPathB},
@@ -1019,7 +1021,9 @@ func TestCRMergedChainsConflictSimple(t *testing.T) {
 		mergedPathRoot.tailPointer(): {&renameUnmergedAction{
 			"file1",
 			cre.ConflictRenameHelper(now, "u2", "dev1", "file1"),
-			"", 0, false, zeroPtr, zeroPtr}},
+			"", 0, false, zeroPtr, zeroPtr,
+			false, DirEntry{},
+			zeroPtr}},
 	}
 
 	testCRCheckPathsAndActions(t, cr2, []path{unmergedPathRoot},
@@ -1128,7 +1132,9 @@ func TestCRMergedChainsConflictFileCollapse(t *testing.T) {
 		mergedPathRoot.tailPointer(): {&renameUnmergedAction{
 			"file",
 			cre.ConflictRenameHelper(now, "u2", "dev1", "file"),
-			"", 0, false, zeroPtr, zeroPtr}},
+			"", 0, false, zeroPtr, zeroPtr,
+			false, DirEntry{},
+			zeroPtr}},
 	}
 
 	testCRCheckPathsAndActions(t, cr2, []path{unmergedPathFile},
@@ -1345,3 +1351,96 @@ func TestCRDoActionsWriteConflict(t *testing.T) {
 	// NOTE: the action doesn't actually create the entry, so this
 	// test can only check that newFileBlocks looks correct.
 }
+
+// benchmarkCRWideDirectory measures the planning and action steps of
+// conflict resolution for a conflict in a directory with n entries,
+// where the unmerged branch touches the mtimes of a few of them and
+// both branches add a new file.
+func benchmarkCRWideDirectory(b *testing.B, n int) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1 := MakeTestConfigOrBust(b, userName1, userName2)
+	// Leave plenty of room for entries of about 200 bytes each.
+	config1.maxDirBytes = uint64(n+100) * 400
+	defer config1.Shutdown()
+	config2 := ConfigAsUser(config1, userName2)
+	config2.maxDirBytes = config1.maxDirBytes
+	defer config2.Shutdown()
+	ctx := BackgroundContextWithCancellationDelayer()
+	defer CleanupCancellationDelayer(ctx)
+
+	name := userName1.String() + "," + userName2.String()
+	fixture := MakeTLFFixtureOrBust(b, ctx, config1, nil, name, false,
+		TLFFixtureSpec{Seed: 1, FilesPerDir: n, BatchFiles: true})
+	fb := fixture.Root.GetFolderBranch()
+	kbfsOps1 := config1.KBFSOps()
+	dir1 := fixture.Root
+
+	kbfsOps2 := config2.KBFSOps()
+	dir2 := GetRootNodeOrBust(b, config2, name, false)
+	const touched = 10
+	var files2 []Node
+	for i := 0; i < touched && i < n; i++ {
+		file, _, err := kbfsOps2.Lookup(ctx, dir2, fmt.Sprintf("f%d", i))
+		require.NoError(b, err)
+		files2 = append(files2, file)
+	}
+	// Hold each conflict so that the steps can be run by hand below.
+	err := kbfsOps2.SetManualConflictResolution(ctx, fb, true)
+	require.NoError(b, err)
+	cr2 := config2.KBFSOps().(*KBFSOpsStandard).getOpsNoAdd(fb).cr
+	lState := makeFBOLockState()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		c, err := DisableUpdatesForTesting(config2, fb)
+		require.NoError(b, err)
+		_, _, err = kbfsOps1.CreateFile(
+			ctx, dir1, fmt.Sprintf("merged%d", i), false, NoExcl)
+		require.NoError(b, err)
+		mtime := config2.Clock().Now()
+		for _, file := range files2 {
+			err = kbfsOps2.SetMtime(ctx, file, &mtime)
+			require.NoError(b, err)
+		}
+		_, _, err = kbfsOps2.CreateFile(
+			ctx, dir2, fmt.Sprintf("unmerged%d", i), false, NoExcl)
+		require.NoError(b, err)
+		b.StartTimer()
+
+		unmergedChains, mergedChains, unmergedPaths, mergedPaths,
+			recreateOps, _, _, err := cr2.buildChainsAndPaths(ctx, lState, false)
+		require.NoError(b, err)
+		actionMap, _, err := cr2.computeActions(ctx, unmergedChains,
+			mergedChains, unmergedPaths, mergedPaths, recreateOps)
+		require.NoError(b, err)
+		err = cr2.doActions(ctx, lState, unmergedChains, mergedChains,
+			unmergedPaths, mergedPaths, actionMap, make(localBcache),
+			make(fileBlockMap))
+		require.NoError(b, err)
+
+		b.StopTimer()
+		err = kbfsOps2.ResolveKeepRemote(ctx, fb)
+		require.NoError(b, err)
+		c <- struct{}{}
+		err = kbfsOps2.SyncFromServerForTesting(ctx, fb)
+		require.NoError(b, err)
+		b.StartTimer()
+	}
+}
+
+func BenchmarkCRWideDirectory100(b *testing.B) {
+	benchmarkCRWideDirectory(b, 100)
+}
+
+func BenchmarkCRWideDirectory1000(b *testing.B) {
+	benchmarkCRWideDirectory(b, 1000)
+}
+
+func BenchmarkCRWideDirectory10000(b *testing.B) {
+	benchmarkCRWideDirectory(b, 10000)
+}
+
+func BenchmarkCRWideDirectory100000(b *testing.B) {
+	benchmarkCRWideDirectory(b, 100000)
+}
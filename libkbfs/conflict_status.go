@@ -0,0 +1,77 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+// maxConflictFilesRemembered caps how many conflict files a
+// ConflictResolver lists in its ConflictStatus.
+const maxConflictFilesRemembered = 100
+
+// ConflictEventType says which step of conflict resolution a
+// ConflictEvent is about.
+type ConflictEventType int
+
+const (
+	// ConflictResolutionStarted means conflict resolution has
+	// started on a folder branch.
+	ConflictResolutionStarted ConflictEventType = iota
+	// ConflictResolutionFinished means conflict resolution has
+	// finished, whether or not it succeeded.
+	ConflictResolutionFinished
+)
+
+func (t ConflictEventType) String() string {
+	switch t {
+	case ConflictResolutionStarted:
+		return "started"
+	case ConflictResolutionFinished:
+		return "finished"
+	default:
+		return "unknown"
+	}
+}
+
+// ConflictEvent is passed to ConflictObservers as conflict
+// resolution progresses.
+type ConflictEvent struct {
+	Type         ConflictEventType
+	FolderBranch FolderBranch
+	// ConflictFiles, for a finished resolution, holds the paths of
+	// the conflict copies it created.
+	ConflictFiles []string
+	// Err, for a finished resolution, is why it failed, if it did.
+	// A failed resolution is retried later.
+	Err error
+}
+
+// ConflictStatus describes the state of conflict resolution in a
+// folder branch.  It is suitable for encoding directly as JSON.
+type ConflictStatus struct {
+	// Staged is true if this device has changes on an unmerged
+	// branch that haven't been resolved yet; BranchID is the ID
+	// of that branch, and Unmerged summarizes its changes.
+	// Merged summarizes the changes made by others since the
+	// branch point.
+	Staged   bool
+	BranchID string
+	Unmerged []*crChainSummary
+	Merged   []*crChainSummary
+
+	// ManualCR is true if conflicts in this folder are only
+	// resolved on request; CRHeld is true if there is a conflict
+	// waiting for one of the KBFSOps.Resolve* calls.
+	ManualCR bool
+	CRHeld   bool
+
+	// CRInProgress is true while conflict resolution is running.
+	CRInProgress bool
+	// LastCRError is the error from the most recent resolution,
+	// if it failed.
+	LastCRError string `json:",omitempty"`
+	// ConflictFiles lists the paths of the conflict copies made
+	// by resolutions in this process, oldest first.  They are not
+	// removed from the list if the user later deletes or renames
+	// them.
+	ConflictFiles []string
+}
@@ -0,0 +1,403 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type testConflictObserver struct {
+	FakeObserver
+
+	lock   sync.Mutex
+	events []ConflictEvent
+}
+
+func (o *testConflictObserver) ConflictResolutionEvent(
+	ctx context.Context, event ConflictEvent) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.events = append(o.events, event)
+}
+
+func (o *testConflictObserver) getEvents() []ConflictEvent {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return append([]ConflictEvent(nil), o.events...)
+}
+
+func TestCRConflictStatusAndEvents(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+	clock, now := newTestClockAndTimeNow()
+	config2.SetClock(clock)
+
+	name := userName1.String() + "," + userName2.String()
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	fileB1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "b", false, NoExcl)
+	require.NoError(t, err)
+
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	fileB2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "b")
+	require.NoError(t, err)
+
+	fb := rootNode2.GetFolderBranch()
+	obs := &testConflictObserver{}
+	err = config2.Notifier().RegisterForChanges([]FolderBranch{fb}, obs)
+	require.NoError(t, err)
+	c, err := DisableUpdatesForTesting(config2, fb)
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, fb)
+	require.NoError(t, err)
+
+	err = kbfsOps1.Write(ctx, fileB1, []byte{1}, 0)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(ctx, fileB1)
+	require.NoError(t, err)
+	err = kbfsOps2.Write(ctx, fileB2, []byte{2}, 0)
+	require.NoError(t, err)
+	err = kbfsOps2.Sync(ctx, fileB2)
+	require.NoError(t, err)
+
+	status, err := kbfsOps2.GetConflictStatus(ctx, fb)
+	require.NoError(t, err)
+	require.True(t, status.Staged)
+	require.NotEqual(t, "", status.BranchID)
+	require.Len(t, status.ConflictFiles, 0)
+
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2, fb)
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+
+	cre := WriterDeviceDateConflictRenamer{}
+	conflictPath := name + "/" + cre.ConflictRenameHelper(now, "u2", "dev1", "b")
+	status, err = kbfsOps2.GetConflictStatus(ctx, fb)
+	require.NoError(t, err)
+	require.False(t, status.Staged)
+	require.False(t, status.CRInProgress)
+	require.Equal(t, "", status.LastCRError)
+	require.Equal(t, []string{conflictPath}, status.ConflictFiles)
+
+	events := obs.getEvents()
+	require.True(t, len(events) >= 2)
+	require.Equal(t, ConflictResolutionStarted, events[0].Type)
+	last := events[len(events)-1]
+	require.Equal(t, ConflictResolutionFinished, last.Type)
+	require.Equal(t, fb, last.FolderBranch)
+	require.NoError(t, last.Err)
+	require.Equal(t, []string{conflictPath}, last.ConflictFiles)
+}
+
+func TestCRManualResolveKeepLocal(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	fileB1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "b", false, NoExcl)
+	require.NoError(t, err)
+
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	fileB2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "b")
+	require.NoError(t, err)
+
+	fb := rootNode2.GetFolderBranch()
+	err = kbfsOps2.SetManualConflictResolution(ctx, fb, true)
+	require.NoError(t, err)
+	c, err := DisableUpdatesForTesting(config2, fb)
+	require.NoError(t, err)
+
+	err = kbfsOps1.Write(ctx, fileB1, []byte{1}, 0)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(ctx, fileB1)
+	require.NoError(t, err)
+	err = kbfsOps2.Write(ctx, fileB2, []byte{2}, 0)
+	require.NoError(t, err)
+	err = kbfsOps2.Sync(ctx, fileB2)
+	require.NoError(t, err)
+
+	// Even with updates back on, the conflict stays put.
+	c <- struct{}{}
+	status, err := kbfsOps2.GetConflictStatus(ctx, fb)
+	require.NoError(t, err)
+	require.True(t, status.Staged)
+	require.True(t, status.ManualCR)
+	require.True(t, status.CRHeld)
+
+	ops1 := getOps(config1, rootNode1.GetFolderBranch().Tlf)
+	mergedRev := ops1.getCurrMDRevision(makeFBOLockState())
+	err = kbfsOps2.ResolveKeepLocal(ctx, fb)
+	require.NoError(t, err)
+	status, err = kbfsOps2.GetConflictStatus(ctx, fb)
+	require.NoError(t, err)
+	require.False(t, status.Staged)
+	require.False(t, status.CRHeld)
+	require.Empty(t, status.ConflictFiles)
+
+	// The whole resolution is a single merged revision.
+	ops2 := getOps(config2, fb.Tlf)
+	require.Equal(t, mergedRev+1,
+		ops2.getCurrMDRevision(makeFBOLockState()))
+
+	// The local file node is still good, and both users see only
+	// its contents.
+	buf := make([]byte, 1)
+	_, err = kbfsOps2.Read(ctx, fileB2, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte{2}, buf)
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+	checkB := func(kbfsOps KBFSOps, root Node) {
+		children, err := kbfsOps.GetDirChildren(ctx, root)
+		require.NoError(t, err)
+		require.Len(t, children, 1)
+		fileB, _, err := kbfsOps.Lookup(ctx, root, "b")
+		require.NoError(t, err)
+		buf := make([]byte, 1)
+		_, err = kbfsOps.Read(ctx, fileB, buf, 0)
+		require.NoError(t, err)
+		require.Equal(t, []byte{2}, buf)
+	}
+	checkB(kbfsOps1, rootNode1)
+	checkB(kbfsOps2, rootNode2)
+}
+
+// A local directory replaces a merged file of the same name, but a
+// merged directory is never replaced.
+func TestCRManualResolveKeepLocalDirs(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+
+	fb := rootNode2.GetFolderBranch()
+	err := kbfsOps2.SetManualConflictResolution(ctx, fb, true)
+	require.NoError(t, err)
+	c, err := DisableUpdatesForTesting(config2, fb)
+	require.NoError(t, err)
+
+	_, _, err = kbfsOps1.CreateFile(ctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+	_, _, err = kbfsOps1.CreateDir(ctx, rootNode1, "b")
+	require.NoError(t, err)
+	_, _, err = kbfsOps2.CreateDir(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	_, _, err = kbfsOps2.CreateFile(ctx, rootNode2, "b", false, NoExcl)
+	require.NoError(t, err)
+	c <- struct{}{}
+
+	err = kbfsOps2.ResolveKeepLocal(ctx, fb)
+	require.NoError(t, err)
+	status, err := kbfsOps2.GetConflictStatus(ctx, fb)
+	require.NoError(t, err)
+	require.False(t, status.Staged)
+	require.Len(t, status.ConflictFiles, 1)
+
+	children, err := kbfsOps2.GetDirChildren(ctx, rootNode2)
+	require.NoError(t, err)
+	require.Len(t, children, 3)
+	require.Equal(t, Dir, children["a"].Type)
+	require.Equal(t, Dir, children["b"].Type)
+}
+
+func TestCRManualResolutionPersisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kbfs_manual_cr")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var userName libkb.NormalizedUsername = "u1"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+	err = config.EnableTLFSettingsPersistence(dir)
+	require.NoError(t, err)
+
+	rootNode := GetRootNodeOrBust(t, config, userName.String(), false)
+	fb := rootNode.GetFolderBranch()
+	err = config.KBFSOps().SetManualConflictResolution(ctx, fb, true)
+	require.NoError(t, err)
+
+	config2 := ConfigAsUser(config, userName)
+	defer CheckConfigAndShutdown(t, config2)
+	err = config2.EnableTLFSettingsPersistence(dir)
+	require.NoError(t, err)
+	rootNode2 := GetRootNodeOrBust(t, config2, userName.String(), false)
+	status, err := config2.KBFSOps().GetConflictStatus(
+		ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	require.True(t, status.ManualCR)
+
+	err = config2.KBFSOps().SetManualConflictResolution(
+		ctx, rootNode2.GetFolderBranch(), false)
+	require.NoError(t, err)
+	record, err := readTLFSettings(config2.Codec(), dir)
+	require.NoError(t, err)
+	require.Empty(t, record.ManualCR)
+}
+
+// Conflict input that shows up while a held conflict is being
+// resolved must not still be held once the resolution is done.
+func TestCRManualResolveDropsInputHeldDuringResolution(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	fileB1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "b", false, NoExcl)
+	require.NoError(t, err)
+
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	fileB2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "b")
+	require.NoError(t, err)
+
+	fb := rootNode2.GetFolderBranch()
+	err = kbfsOps2.SetManualConflictResolution(ctx, fb, true)
+	require.NoError(t, err)
+	c, err := DisableUpdatesForTesting(config2, fb)
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, fb)
+	require.NoError(t, err)
+
+	err = kbfsOps1.Write(ctx, fileB1, []byte{1}, 0)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(ctx, fileB1)
+	require.NoError(t, err)
+	err = kbfsOps2.Write(ctx, fileB2, []byte{2}, 0)
+	require.NoError(t, err)
+	err = kbfsOps2.Sync(ctx, fileB2)
+	require.NoError(t, err)
+	c <- struct{}{}
+
+	ops := getOps(config2, fb.Tlf)
+	unmergedRev := ops.getCurrMDRevision(makeFBOLockState())
+
+	// Stall the resolution's block put, so that more input can
+	// come in while it's in progress.
+	onPutStalledCh, putUnstallCh, putCtx :=
+		StallBlockOp(ctx, config2, StallableBlockPut, 1)
+	err = RestartCRForTesting(putCtx, config2, fb)
+	require.NoError(t, err)
+	resolveErrCh := make(chan error, 1)
+	go func() {
+		resolveErrCh <- kbfsOps2.ResolveMerged(ctx, fb)
+	}()
+	<-onPutStalledCh
+	// An update coming in now gets held again.
+	ops.cr.Resolve(unmergedRev, MetadataRevisionUninitialized)
+	close(putUnstallCh)
+	require.NoError(t, <-resolveErrCh)
+
+	status, err := kbfsOps2.GetConflictStatus(ctx, fb)
+	require.NoError(t, err)
+	require.False(t, status.Staged)
+	require.False(t, status.CRHeld)
+}
+
+func TestCRPreviewConflictResolution(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+	clock, now := newTestClockAndTimeNow()
+	config2.SetClock(clock)
+
+	name := userName1.String() + "," + userName2.String()
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	fileB1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "b", false, NoExcl)
+	require.NoError(t, err)
+
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	fileB2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "b")
+	require.NoError(t, err)
+
+	fb := rootNode2.GetFolderBranch()
+	preview, err := kbfsOps2.PreviewConflictResolution(ctx, fb)
+	require.NoError(t, err)
+	require.False(t, preview.Staged)
+
+	err = kbfsOps2.SetManualConflictResolution(ctx, fb, true)
+	require.NoError(t, err)
+	c, err := DisableUpdatesForTesting(config2, fb)
+	require.NoError(t, err)
+
+	err = kbfsOps1.Write(ctx, fileB1, []byte{1}, 0)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(ctx, fileB1)
+	require.NoError(t, err)
+	err = kbfsOps2.Write(ctx, fileB2, []byte{2}, 0)
+	require.NoError(t, err)
+	err = kbfsOps2.Sync(ctx, fileB2)
+	require.NoError(t, err)
+	c <- struct{}{}
+
+	conflictName := WriterDeviceDateConflictRenamer{}.ConflictRenameHelper(
+		now, "u2", "dev1", "b")
+	preview, err = kbfsOps2.PreviewConflictResolution(ctx, fb)
+	require.NoError(t, err)
+	require.True(t, preview.Staged)
+	require.Equal(t, []string{name + "/" + conflictName},
+		preview.ConflictFiles)
+	found := false
+	for _, a := range preview.Actions {
+		if a.Type == "renameUnmerged" {
+			require.Equal(t, name, a.Dir)
+			require.Equal(t, "b", a.Name)
+			require.Equal(t, conflictName, a.NewName)
+			found = true
+		}
+	}
+	require.True(t, found, "%+v", preview.Actions)
+
+	// Nothing was actually resolved.
+	status, err := kbfsOps2.GetConflictStatus(ctx, fb)
+	require.NoError(t, err)
+	require.True(t, status.Staged)
+	require.True(t, status.CRHeld)
+}
@@ -12,6 +12,7 @@ import (
 const (
 	KeybaseServiceName = "keybase-service"
 	MDServiceName      = "md-server"
+	BServiceName       = "block-server"
 )
 
 type errDisconnected struct{}
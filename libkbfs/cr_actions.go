@@ -27,6 +27,10 @@ type copyUnmergedEntryAction struct {
 	unique        bool
 	unmergedEntry DirEntry
 	attr          []attrChange
+	xattrs        []string // names of changed xattrs, for xattrAttr
+	// replacedXattrs holds the blocks of the large merged xattr
+	// values that do() replaced.
+	replacedXattrs []BlockPointer
 }
 
 func fixupNamesInOps(fromName string, toName string, ops []op,
@@ -101,6 +105,7 @@ func (cuea *copyUnmergedEntryAction) swapUnmergedBlock(
 			// attributes so we can re-apply them during do().
 			if sao, ok := op.(*setAttrOp); ok {
 				cuea.attr = append(cuea.attr, sao.Attr)
+				cuea.xattrs = append(cuea.xattrs, sao.xattrNames()...)
 			} else {
 				return false, zeroPtr, nil
 			}
@@ -135,6 +140,22 @@ func (cuea *copyUnmergedEntryAction) swapUnmergedBlock(
 	return true, parentMostRecent, nil
 }
 
+// copyUnmergedXattrs copies the named xattrs from unmerged into
+// entry, a merged entry, and returns the blocks of the large values
+// that they replaced there.  Those blocks must be unreferenced by the
+// resolution.
+func copyUnmergedXattrs(entry *DirEntry, unmerged map[string]XattrValue,
+	names []string) (replaced []BlockPointer) {
+	for _, name := range names {
+		old := entry.Xattrs[name].Block.BlockPointer
+		if old != zeroPtr && old != unmerged[name].Block.BlockPointer {
+			replaced = append(replaced, old)
+		}
+	}
+	entry.Xattrs = copyXattrs(entry.Xattrs, unmerged, names)
+	return replaced
+}
+
 func uniquifyName(block *DirBlock, name string) (string, error) {
 	if _, ok := block.Children[name]; !ok {
 		return name, nil
@@ -179,7 +200,7 @@ func (cuea *copyUnmergedEntryAction) do(ctx context.Context,
 			entry.Size = unmergedEntry.Size
 			entry.EncodedSize = unmergedEntry.EncodedSize
 			entry.BlockPointer = unmergedEntry.BlockPointer
-			mergedBlock.Children[cuea.toName] = entry
+			setEntryAndLinks(mergedBlock, cuea.toName, entry)
 			return nil
 		}
 		// copy any attrs that were explicitly set on the unmerged
@@ -190,6 +211,17 @@ func (cuea *copyUnmergedEntryAction) do(ctx context.Context,
 				unmergedEntry.Type = cuea.unmergedEntry.Type
 			case mtimeAttr:
 				unmergedEntry.Mtime = cuea.unmergedEntry.Mtime
+			case xattrAttr:
+				// unmergedEntry is the merged version here.
+				cuea.replacedXattrs = append(cuea.replacedXattrs,
+					copyUnmergedXattrs(&unmergedEntry,
+						cuea.unmergedEntry.Xattrs, cuea.xattrs)...)
+			case modeAttr:
+				copyModeAttr(&unmergedEntry, cuea.unmergedEntry)
+			case ownerAttr:
+				unmergedEntry.UID = cuea.unmergedEntry.UID
+				unmergedEntry.GID = cuea.unmergedEntry.GID
+				unmergedEntry.OwnerUser = cuea.unmergedEntry.OwnerUser
 			}
 		}
 	}
@@ -336,6 +368,9 @@ func (cuea *copyUnmergedEntryAction) updateOps(unmergedMostRecent BlockPointer,
 	cuea.trackSyncPtrChangesInCreate(mostRecentTargetPtr, unmergedChain,
 		unmergedChains)
 
+	for _, ptr := range cuea.replacedXattrs {
+		unmergedChains.replacedXattrPointers[ptr] = true
+	}
 	return nil
 }
 
@@ -351,7 +386,15 @@ type copyUnmergedAttrAction struct {
 	fromName string
 	toName   string
 	attr     []attrChange
-	moved    bool // move this action to the parent at most one time
+	xattrs   []string // names of changed xattrs, for xattrAttr
+	moved    bool     // move this action to the parent at most one time
+	// xattrRenames maps the names of xattrs that were changed on
+	// both branches to the conflict names their unmerged values
+	// are kept under.
+	xattrRenames map[string]string
+	// replacedXattrs holds the blocks of the large merged xattr
+	// values that do() replaced.
+	replacedXattrs []BlockPointer
 }
 
 func (cuaa *copyUnmergedAttrAction) swapUnmergedBlock(
@@ -383,6 +426,28 @@ func (cuaa *copyUnmergedAttrAction) do(ctx context.Context,
 			mergedEntry.Size = unmergedEntry.Size
 			mergedEntry.EncodedSize = unmergedEntry.EncodedSize
 			mergedEntry.BlockPointer = unmergedEntry.BlockPointer
+		case xattrAttr:
+			cuaa.replacedXattrs = append(cuaa.replacedXattrs,
+				copyUnmergedXattrs(&mergedEntry, unmergedEntry.Xattrs,
+					cuaa.xattrs)...)
+			for name, newName := range cuaa.xattrRenames {
+				v, ok := unmergedEntry.Xattrs[name]
+				if !ok {
+					// Removed on the unmerged branch, so there's
+					// nothing to keep.
+					continue
+				}
+				cuaa.replacedXattrs = append(cuaa.replacedXattrs,
+					copyUnmergedXattrs(&mergedEntry,
+						map[string]XattrValue{newName: v},
+						[]string{newName})...)
+			}
+		case modeAttr:
+			copyModeAttr(&mergedEntry, unmergedEntry)
+		case ownerAttr:
+			mergedEntry.UID = unmergedEntry.UID
+			mergedEntry.GID = unmergedEntry.GID
+			mergedEntry.OwnerUser = unmergedEntry.OwnerUser
 		}
 	}
 	mergedBlock.Children[cuaa.toName] = mergedEntry
@@ -409,10 +474,21 @@ func (cuaa *copyUnmergedAttrAction) updateOps(unmergedMostRecent BlockPointer,
 			fixupNamesInOps(cuaa.fromName, cuaa.toName, unmergedChain.ops,
 				unmergedChains)
 	}
+	for _, ptr := range cuaa.replacedXattrs {
+		unmergedChains.replacedXattrPointers[ptr] = true
+	}
 	return nil
 }
 
 func (cuaa *copyUnmergedAttrAction) String() string {
+	if len(cuaa.xattrRenames) > 0 {
+		return fmt.Sprintf("copyUnmergedAttr: %s -> %s (%s %s %v)",
+			cuaa.fromName, cuaa.toName, cuaa.attr, cuaa.xattrs,
+			cuaa.xattrRenames)
+	} else if len(cuaa.xattrs) > 0 {
+		return fmt.Sprintf("copyUnmergedAttr: %s -> %s (%s %s)",
+			cuaa.fromName, cuaa.toName, cuaa.attr, cuaa.xattrs)
+	}
 	return fmt.Sprintf("copyUnmergedAttr: %s -> %s (%s)",
 		cuaa.fromName, cuaa.toName, cuaa.attr)
 }
@@ -460,6 +536,15 @@ type renameUnmergedAction struct {
 	// chains need to be updated with new create/rename operations.
 	unmergedParentMostRecent BlockPointer
 	mergedParentMostRecent   BlockPointer
+
+	// Set if the unmerged copy should replace the merged entry,
+	// rather than sit beside it.  do() clears it if the merged
+	// entry can't be replaced, and otherwise sets replacedMerged.
+	keepUnmerged   bool
+	replacedMerged DirEntry
+
+	// Set by updateOps to the file chain it updated the ops of.
+	unmergedFile BlockPointer
 }
 
 func crActionCopyFile(ctx context.Context, copier fileBlockDeepCopier,
@@ -502,13 +587,23 @@ func crActionCopyFile(ctx context.Context, copier fileBlockDeepCopier,
 		}
 	}
 
-	// Set the entry with the new pointer.
+	// Set the entry with the new pointer.  The copy isn't linked to
+	// anything.
 	oldPointer := fromEntry.BlockPointer
 	fromEntry.BlockPointer = ptr
+	fromEntry.Nlink = 0
 	toBlock.Children[name] = fromEntry
 	return oldPointer, name, nil
 }
 
+// canReplaceMergedEntry returns whether an unmerged entry can take
+// the place of mergedEntry.  A directory may hold merged changes of
+// its own, and the blocks of a hard-linked file are still in use by
+// its other links.
+func canReplaceMergedEntry(mergedEntry DirEntry) bool {
+	return mergedEntry.Type != Dir && mergedEntry.LinkCount() <= 1
+}
+
 func (rua *renameUnmergedAction) swapUnmergedBlock(
 	unmergedChains *crChains, mergedChains *crChains,
 	unmergedBlock *DirBlock) (bool, BlockPointer, error) {
@@ -518,8 +613,20 @@ func (rua *renameUnmergedAction) swapUnmergedBlock(
 func (rua *renameUnmergedAction) do(ctx context.Context,
 	unmergedCopier fileBlockDeepCopier, mergedCopier fileBlockDeepCopier,
 	unmergedBlock *DirBlock, mergedBlock *DirBlock) error {
+	toName := rua.toName
+	if rua.keepUnmerged {
+		// Drop the merged entry first, so that the copy gets its
+		// name.
+		mergedEntry, ok := mergedBlock.Children[rua.fromName]
+		rua.keepUnmerged = ok && canReplaceMergedEntry(mergedEntry)
+		if rua.keepUnmerged {
+			rua.replacedMerged = mergedEntry
+			delete(mergedBlock.Children, rua.fromName)
+			toName = rua.fromName
+		}
+	}
 	_, name, err := crActionCopyFile(ctx, unmergedCopier, rua.fromName,
-		rua.toName, rua.symPath, unmergedBlock, mergedBlock)
+		toName, rua.symPath, unmergedBlock, mergedBlock)
 	if err != nil {
 		return err
 	}
@@ -557,6 +664,7 @@ func (rua *renameUnmergedAction) updateOps(unmergedMostRecent BlockPointer,
 	}
 
 	if unmergedChain.isFile() {
+		rua.unmergedFile = unmergedMostRecent
 		// Replace the updates on all file operations
 		for _, op := range unmergedChain.ops {
 			switch realOp := op.(type) {
@@ -623,11 +731,22 @@ func (rua *renameUnmergedAction) updateOps(unmergedMostRecent BlockPointer,
 		rop.AddUpdate(unmergedEntry.BlockPointer,
 			newMergedEntry.BlockPointer)
 	}
-	co, err := newCreateOp(rua.fromName, mergedMostRecent, mergedEntry.Type)
-	if err != nil {
-		return err
+	localOps := []op{rop}
+	if rua.keepUnmerged {
+		// The local entry stays where it is, and the merged one
+		// never shows up locally; the rename only carries the
+		// pointer update.
+		unmergedChains.replacedMergedEntries = append(
+			unmergedChains.replacedMergedEntries, rua.replacedMerged)
+	} else {
+		co, err := newCreateOp(
+			rua.fromName, mergedMostRecent, mergedEntry.Type)
+		if err != nil {
+			return err
+		}
+		localOps = append(localOps, co)
 	}
-	err = prependOpsToChain(mergedMostRecent, mergedChains, rop, co)
+	err = prependOpsToChain(mergedMostRecent, mergedChains, localOps...)
 	if err != nil {
 		return err
 	}
@@ -635,7 +754,7 @@ func (rua *renameUnmergedAction) updateOps(unmergedMostRecent BlockPointer,
 	// Before merging the unmerged ops, create a file with the new
 	// name, unless the create already exists.
 	found := false
-	co = nil
+	var co *createOp
 	for _, op := range unmergedChain.ops {
 		var ok bool
 		if co, ok = op.(*createOp); ok && co.NewName == rua.toName {
@@ -660,12 +779,14 @@ func (rua *renameUnmergedAction) updateOps(unmergedMostRecent BlockPointer,
 		}
 	}
 	// Since we copied the node, unref the old block but only if
-	// it's not a symlink and the name changed.  If the name is
-	// the same, it means the old block pointer is still in use
-	// because we just did a copy of a node still in use in the
-	// merged branch.
+	// it's not a symlink and the name changed (or the copy took
+	// the place of the merged entry).  If the name is the same,
+	// it means the old block pointer is still in use because we
+	// just did a copy of a node still in use in the merged
+	// branch.
 	if unmergedEntry.BlockPointer != newMergedEntry.BlockPointer &&
-		rua.fromName != rua.toName && rua.symPath == "" {
+		(rua.fromName != rua.toName || rua.keepUnmerged) &&
+		rua.symPath == "" {
 		co.AddUnrefBlock(unmergedEntry.BlockPointer)
 	}
 
@@ -690,6 +811,12 @@ type renameMergedAction struct {
 	fromName string
 	toName   string
 	symPath  string
+
+	// Set if the merged entry should be dropped, rather than
+	// renamed.  do() clears it if the merged entry can't be
+	// dropped, and otherwise sets replacedMerged.
+	keepUnmerged   bool
+	replacedMerged DirEntry
 }
 
 func (rma *renameMergedAction) swapUnmergedBlock(
@@ -707,14 +834,19 @@ func (rma *renameMergedAction) do(ctx context.Context,
 		return NoSuchNameError{rma.fromName}
 	}
 
-	// Make sure this entry is unique.
-	newName, err := uniquifyName(mergedBlock, rma.toName)
-	if err != nil {
-		return err
-	}
-	rma.toName = newName
+	if rma.keepUnmerged && canReplaceMergedEntry(mergedEntry) {
+		rma.replacedMerged = mergedEntry
+	} else {
+		rma.keepUnmerged = false
+		// Make sure this entry is unique.
+		newName, err := uniquifyName(mergedBlock, rma.toName)
+		if err != nil {
+			return err
+		}
+		rma.toName = newName
 
-	mergedBlock.Children[rma.toName] = mergedEntry
+		mergedBlock.Children[rma.toName] = mergedEntry
+	}
 
 	// Add the unmerged entry as the new "fromName".
 	unmergedEntry, ok := unmergedBlock.Children[rma.fromName]
@@ -756,6 +888,14 @@ func (rma *renameMergedAction) updateOps(unmergedMostRecent BlockPointer,
 				mergedChains)
 	}
 
+	if rma.keepUnmerged {
+		// There's nothing to rename; the merged entry is just
+		// gone.
+		unmergedChains.replacedMergedEntries = append(
+			unmergedChains.replacedMergedEntries, rma.replacedMerged)
+		return nil
+	}
+
 	if !unmergedChain.isFile() {
 		// The entry that gets renamed in the unmerged branch:
 		mergedEntry, ok := mergedBlock.Children[rma.toName]
@@ -929,6 +1069,26 @@ func (cal crActionList) collapse() crActionList {
 						topAction.attr = append(topAction.attr, a)
 					}
 				}
+				for _, x := range action.xattrs {
+					found := false
+					for _, topX := range topAction.xattrs {
+						if x == topX {
+							found = true
+							break
+						}
+					}
+					if !found {
+						topAction.xattrs = append(topAction.xattrs, x)
+					}
+				}
+				for x, newX := range action.xattrRenames {
+					if topAction.xattrRenames == nil {
+						topAction.xattrRenames = make(map[string]string)
+					}
+					if _, ok := topAction.xattrRenames[x]; !ok {
+						topAction.xattrRenames[x] = newX
+					}
+				}
 				indicesToRemove[i] = true
 			default:
 				setTopAction(action, action.fromName, i, infoMap,
@@ -12,12 +12,15 @@ import (
 func TestCRActionsCollapseNoChange(t *testing.T) {
 	al := crActionList{
 		&copyUnmergedEntryAction{"old1", "new1", "", false, false,
-			DirEntry{}, nil},
+			DirEntry{}, nil, nil, nil},
 		&copyUnmergedEntryAction{"old2", "new2", "", false, false,
-			DirEntry{}, nil},
-		&renameUnmergedAction{"old3", "new3", "", 0, false, zeroPtr, zeroPtr},
-		&renameMergedAction{"old4", "new4", ""},
-		&copyUnmergedAttrAction{"old5", "new5", []attrChange{mtimeAttr}, false},
+			DirEntry{}, nil, nil, nil},
+		&renameUnmergedAction{"old3", "new3", "", 0, false, zeroPtr, zeroPtr,
+			false, DirEntry{},
+			zeroPtr},
+		&renameMergedAction{"old4", "new4", "", false, DirEntry{}},
+		&copyUnmergedAttrAction{"old5", "new5", []attrChange{mtimeAttr}, nil,
+			false, nil, nil},
 	}
 
 	newList := al.collapse()
@@ -28,10 +31,13 @@ func TestCRActionsCollapseNoChange(t *testing.T) {
 
 func TestCRActionsCollapseEntry(t *testing.T) {
 	al := crActionList{
-		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr}, false},
+		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr}, nil,
+			false, nil, nil},
 		&copyUnmergedEntryAction{"old", "new", "", false, false,
-			DirEntry{}, nil},
-		&renameUnmergedAction{"old", "new", "", 0, false, zeroPtr, zeroPtr},
+			DirEntry{}, nil, nil, nil},
+		&renameUnmergedAction{"old", "new", "", 0, false, zeroPtr, zeroPtr,
+			false, DirEntry{},
+			zeroPtr},
 	}
 
 	expected := crActionList{
@@ -65,14 +71,42 @@ func TestCRActionsCollapseEntry(t *testing.T) {
 }
 func TestCRActionsCollapseAttr(t *testing.T) {
 	al := crActionList{
-		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr}, false},
-		&copyUnmergedAttrAction{"old", "new", []attrChange{exAttr}, false},
-		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr}, false},
+		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr}, nil,
+			false, nil, nil},
+		&copyUnmergedAttrAction{"old", "new", []attrChange{exAttr}, nil,
+			false, nil, nil},
+		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr}, nil,
+			false, nil, nil},
 	}
 
 	expected := crActionList{
 		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr, exAttr},
-			false},
+			nil, false, nil, nil},
+	}
+
+	newList := al.collapse()
+	if !reflect.DeepEqual(expected, newList) {
+		t.Errorf("Collapse returned unexpected list: %v vs %v",
+			expected, newList)
+	}
+}
+
+func TestCRActionsCollapseXattrs(t *testing.T) {
+	al := crActionList{
+		&copyUnmergedAttrAction{"old", "new", []attrChange{xattrAttr},
+			[]string{"user.a"}, false, nil, nil},
+		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr}, nil,
+			false, nil, nil},
+		&copyUnmergedAttrAction{"old", "new", []attrChange{xattrAttr},
+			[]string{"user.b"}, false, nil, nil},
+		&copyUnmergedAttrAction{"old", "new", []attrChange{xattrAttr},
+			[]string{"user.a"}, false, nil, nil},
+	}
+
+	expected := crActionList{
+		&copyUnmergedAttrAction{"old", "new",
+			[]attrChange{xattrAttr, mtimeAttr},
+			[]string{"user.a", "user.b"}, false, nil, nil},
 	}
 
 	newList := al.collapse()
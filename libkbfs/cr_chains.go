@@ -25,9 +25,9 @@ type crChain struct {
 // collapse finds complementary pairs of operations that cancel each
 // other out, and remove the relevant operations from the chain.
 // Examples include:
-//  * A create followed by a remove for the same name (delete both ops)
-//  * A create followed by a create (renamed == true) for the same name
-//    (delete the create op)
+//   - A create followed by a remove for the same name (delete both ops)
+//   - A create followed by a create (renamed == true) for the same name
+//     (delete the create op)
 func (cc *crChain) collapse() {
 	createsSeen := make(map[string]int)
 	indicesToRemove := make(map[int]bool)
@@ -150,20 +150,28 @@ func (cc *crChain) isFile() bool {
 	return cc.file
 }
 
+// crEntryTypes maps the most recent pointer of a directory to the
+// types of its children, keyed by their block pointers.
+type crEntryTypes map[BlockPointer]map[BlockPointer]EntryType
+
 // identifyType figures out whether this chain represents a file or
 // directory.  It tries to figure it out based purely on operation
 // state, but setAttr(mtime) can apply to either type; in that case,
-// we need to fetch the block to figure out the type.
+// we need to fetch the block to figure out the type.  Fetched
+// directories are indexed in parentTypes, so that a directory with
+// many such children is only scanned once.
 func (cc *crChain) identifyType(ctx context.Context, fbo *folderBlockOps,
-	md ImmutableRootMetadata, chains *crChains) error {
+	md ImmutableRootMetadata, chains *crChains,
+	parentTypes crEntryTypes) error {
 	if len(cc.ops) == 0 {
 		return nil
 	}
 
 	// If any op is setAttr (ex or size) or sync, this is a file
-	// chain.  If it only has a setAttr/mtime, we don't know what it
-	// is, so fall through and fetch the block unless we come across
-	// another op that can determine the type.
+	// chain.  If it only has setAttrs that can also apply to
+	// directories (e.g., mtime), we don't know what it is, so fall
+	// through and fetch the block unless we come across another op
+	// that can determine the type.
 	var parentDir BlockPointer
 	for _, op := range cc.ops {
 		switch realOp := op.(type) {
@@ -171,12 +179,13 @@ func (cc *crChain) identifyType(ctx context.Context, fbo *folderBlockOps,
 			cc.file = true
 			return nil
 		case *setAttrOp:
-			if realOp.Attr != mtimeAttr {
+			if !realOp.Attr.canBeDirAttr() {
 				cc.file = true
 				return nil
 			}
-			// We can't tell the file type from an mtimeAttr, so we
-			// may have to actually fetch the block to figure it out.
+			// We can't tell the file type from this attr, so we
+			// may have to actually fetch the block to figure it
+			// out.
 			parentDir = realOp.Dir.Ref
 		default:
 			return nil
@@ -202,32 +211,23 @@ func (cc *crChain) identifyType(ctx context.Context, fbo *folderBlockOps,
 
 	// If we get down here, we have an ambiguity, and need to fetch
 	// the block to figure out the file type.
-	dblock, err := fbo.GetDirBlockForReading(ctx, makeFBOLockState(),
-		md.ReadOnly(),
-		parentMostRecent, fbo.folderBranch.Branch, path{})
-	if err != nil {
-		return err
-	}
-	// We don't have the file name handy, so search for the pointer.
-	found := false
-	for _, entry := range dblock.Children {
-		if entry.BlockPointer != cc.mostRecent {
-			continue
+	types, ok := parentTypes[parentMostRecent]
+	if !ok {
+		dblock, err := fbo.GetDirBlockForReading(ctx, makeFBOLockState(),
+			md.ReadOnly(),
+			parentMostRecent, fbo.folderBranch.Branch, path{})
+		if err != nil {
+			return err
 		}
-		switch entry.Type {
-		case Dir:
-			cc.file = false
-		case File:
-			cc.file = true
-		case Exec:
-			cc.file = true
-		default:
-			return fmt.Errorf("Unexpected chain type: %s", entry.Type)
+		// We don't have the file name handy, so index by pointer.
+		types = make(map[BlockPointer]EntryType, len(dblock.Children))
+		for _, entry := range dblock.Children {
+			types[entry.BlockPointer] = entry.Type
 		}
-		found = true
-		break
+		parentTypes[parentMostRecent] = types
 	}
 
+	entryType, found := types[cc.mostRecent]
 	if !found {
 		// Give up nicely if the node has been deleted, since quota
 		// reclamation has probably already happened and there won't
@@ -238,6 +238,17 @@ func (cc *crChain) identifyType(ctx context.Context, fbo *folderBlockOps,
 
 		return fmt.Errorf("Couldn't find directory entry for %v", cc.mostRecent)
 	}
+
+	switch entryType {
+	case Dir:
+		cc.file = false
+	case File:
+		cc.file = true
+	case Exec:
+		cc.file = true
+	default:
+		return fmt.Errorf("Unexpected chain type: %s", entryType)
+	}
 	return nil
 }
 
@@ -280,6 +291,23 @@ type crChains struct {
 	// Pointers that should be explicitly cleaned up in the resolution.
 	toUnrefPointers map[BlockPointer]bool
 
+	// The blocks of large xattr values set during this chain, and,
+	// for the unmerged chains, those of the merged values that the
+	// resolution replaced.
+	xattrPointers         map[BlockPointer]bool
+	replacedXattrPointers map[BlockPointer]bool
+
+	// For the unmerged chains, the merged entries that the
+	// resolution replaced with unmerged ones, whose blocks are no
+	// longer referenced.
+	replacedMergedEntries []DirEntry
+
+	// For the unmerged chains, maps the copy of the local version
+	// of each file whose contents the resolution merged to the
+	// merged most recent pointer of the file, which the copy
+	// replaces.
+	mergedFileCopies map[BlockPointer]BlockPointer
+
 	// Also keep a reference to the most recent MD that's part of this
 	// chain.
 	mostRecentMD ImmutableRootMetadata
@@ -332,6 +360,11 @@ func (ccs *crChains) makeChainForOp(op op) error {
 	for _, ptr := range op.Refs() {
 		ccs.createdOriginals[ptr] = true
 	}
+	if sao, ok := op.(*setAttrOp); ok && sao.Attr == xattrAttr {
+		for _, ptr := range op.Refs() {
+			ccs.xattrPointers[ptr] = true
+		}
+	}
 
 	for _, ptr := range op.Unrefs() {
 		// Look up the original pointer corresponding to this most
@@ -595,6 +628,54 @@ func (ccs *crChains) originalFromMostRecentOrSame(mostRecent BlockPointer) (
 	return mostRecent, nil
 }
 
+// originalOf follows ptr back through any intermediate versions, and
+// any originals changed since, to the original it now descends from.
+func (ccs *crChains) originalOf(ptr BlockPointer) BlockPointer {
+	// The bound only guards against a cycle.
+	for i := 0; i <= len(ccs.originals); i++ {
+		original, ok := ccs.originals[ptr]
+		if !ok || original == ptr {
+			break
+		}
+		ptr = original
+	}
+	return ptr
+}
+
+// liveXattrPointers returns the blocks of the big xattr values that
+// were set on the given created node during this chain, and that are
+// still in use at the end of it.
+func (ccs *crChains) liveXattrPointers(original BlockPointer) []BlockPointer {
+	chain, ok := ccs.byOriginal[original]
+	if !ok || !ccs.isCreated(original) {
+		return nil
+	}
+	live := make(map[BlockPointer]bool)
+	var ptrs []BlockPointer
+	for _, op := range chain.ops {
+		sao, ok := op.(*setAttrOp)
+		if !ok || sao.Attr != xattrAttr {
+			continue
+		}
+		for _, ptr := range sao.Unrefs() {
+			delete(live, ptr)
+		}
+		for _, ptr := range sao.Refs() {
+			if !live[ptr] {
+				live[ptr] = true
+				ptrs = append(ptrs, ptr)
+			}
+		}
+	}
+	result := ptrs[:0]
+	for _, ptr := range ptrs {
+		if live[ptr] {
+			result = append(result, ptr)
+		}
+	}
+	return result
+}
+
 func (ccs *crChains) isCreated(original BlockPointer) bool {
 	return ccs.createdOriginals[original]
 }
@@ -603,6 +684,16 @@ func (ccs *crChains) isDeleted(original BlockPointer) bool {
 	return ccs.deletedOriginals[original]
 }
 
+// replacedMergedPointers returns the set of merged most recent
+// pointers for the entries in replacedMergedEntries.
+func (ccs *crChains) replacedMergedPointers() map[BlockPointer]bool {
+	replaced := make(map[BlockPointer]bool, len(ccs.replacedMergedEntries))
+	for _, entry := range ccs.replacedMergedEntries {
+		replaced[entry.BlockPointer] = true
+	}
+	return replaced
+}
+
 func (ccs *crChains) renamedParentAndName(original BlockPointer) (
 	BlockPointer, string, bool) {
 	info, ok := ccs.renamedOriginals[original]
@@ -614,14 +705,17 @@ func (ccs *crChains) renamedParentAndName(original BlockPointer) (
 
 func newCRChainsEmpty() *crChains {
 	return &crChains{
-		byOriginal:          make(map[BlockPointer]*crChain),
-		byMostRecent:        make(map[BlockPointer]*crChain),
-		deletedOriginals:    make(map[BlockPointer]bool),
-		createdOriginals:    make(map[BlockPointer]bool),
-		renamedOriginals:    make(map[BlockPointer]renameInfo),
-		blockChangePointers: make(map[BlockPointer]bool),
-		toUnrefPointers:     make(map[BlockPointer]bool),
-		originals:           make(map[BlockPointer]BlockPointer),
+		byOriginal:            make(map[BlockPointer]*crChain),
+		byMostRecent:          make(map[BlockPointer]*crChain),
+		deletedOriginals:      make(map[BlockPointer]bool),
+		createdOriginals:      make(map[BlockPointer]bool),
+		renamedOriginals:      make(map[BlockPointer]renameInfo),
+		blockChangePointers:   make(map[BlockPointer]bool),
+		toUnrefPointers:       make(map[BlockPointer]bool),
+		xattrPointers:         make(map[BlockPointer]bool),
+		replacedXattrPointers: make(map[BlockPointer]bool),
+		mergedFileCopies:      make(map[BlockPointer]BlockPointer),
+		originals:             make(map[BlockPointer]BlockPointer),
 	}
 }
 
@@ -674,6 +768,7 @@ func newCRChains(ctx context.Context, cfg Config, rmds []ImmutableRootMetadata,
 		}
 	}
 
+	parentTypes := make(crEntryTypes)
 	for _, chain := range ccs.byOriginal {
 		chain.collapse()
 		// NOTE: even if we've removed all its ops, still keep the
@@ -685,7 +780,8 @@ func newCRChains(ctx context.Context, cfg Config, rmds []ImmutableRootMetadata,
 		// progress, since in that case all actions are already
 		// completed.
 		if len(rmds) > 0 && identifyTypes {
-			err := chain.identifyType(ctx, fbo, rmds[len(rmds)-1], ccs)
+			err := chain.identifyType(
+				ctx, fbo, rmds[len(rmds)-1], ccs, parentTypes)
 			if err != nil {
 				return nil, err
 			}
@@ -814,6 +910,22 @@ func (ccs *crChains) changeOriginal(oldOriginal BlockPointer,
 		delete(ccs.renamedOriginals, oldOriginal)
 		ccs.renamedOriginals[newOriginal] = ri
 	}
+	// Entries renamed into or out of this directory must now find
+	// it by its new original.
+	for ptr, ri := range ccs.renamedOriginals {
+		changed := false
+		if ri.originalOldParent == oldOriginal {
+			ri.originalOldParent = newOriginal
+			changed = true
+		}
+		if ri.originalNewParent == oldOriginal {
+			ri.originalNewParent = newOriginal
+			changed = true
+		}
+		if changed {
+			ccs.renamedOriginals[ptr] = ri
+		}
+	}
 	return nil
 }
 
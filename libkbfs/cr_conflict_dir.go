@@ -0,0 +1,236 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// conflictDirName returns the directory, if any, at the root of the
+// TLF that the configured ConflictRenamer wants conflicted copies
+// in.
+func conflictDirName(config Config) string {
+	renamer, ok := config.ConflictRenamer().(ConflictDirRenamer)
+	if !ok {
+		return ""
+	}
+	return renamer.ConflictDir()
+}
+
+// inConflictDir returns c as it would be once moved, as copyName,
+// into the directory dirName at the root of the TLF.
+func (c crConflictCopy) inConflictDir(
+	dirName string, copyName string) crConflictCopy {
+	c.dir = path{FolderBranch: c.dir.FolderBranch, path: c.dir.path[:1]}
+	c.copyDir = dirName
+	c.copyName = copyName
+	return c
+}
+
+// isInConflictDir returns whether c is already in the directory
+// dirName at the root of the TLF, or is that directory.
+func (c crConflictCopy) isInConflictDir(dirName string) bool {
+	if len(c.dir.path) > 1 {
+		return c.dir.path[1].Name == dirName
+	}
+	return c.copyDir == dirName || c.copyName == dirName
+}
+
+// getDirNodeByNameLocked returns the node of the directory reached by
+// following names from the root of the TLF.  If create is true, any
+// missing directory is made along the way.
+func (fbo *folderBranchOps) getDirNodeByNameLocked(ctx context.Context,
+	lState *lockState, names []string, create bool) (Node, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := fbo.nodeCache.GetOrCreate(md.data.Dir.BlockPointer,
+		string(md.GetTlfHandle().GetCanonicalName()), nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		md, err := fbo.getMDForWriteLocked(ctx, lState)
+		if err != nil {
+			return nil, err
+		}
+		dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
+		if err != nil {
+			return nil, err
+		}
+		dblock, err := fbo.blocks.GetDir(
+			ctx, lState, md.ReadOnly(), dirPath, blockRead)
+		if err != nil {
+			return nil, err
+		}
+		de, ok := dblock.Children[name]
+		if !ok && create {
+			dir, _, err = fbo.createEntryLocked(
+				ctx, lState, dir, name, Dir, NoExcl)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		} else if !ok {
+			return nil, NoSuchNameError{name}
+		}
+		if de.Type != Dir {
+			return nil, NotDirError{dirPath.ChildPathNoPtr(name)}
+		}
+		dir, err = fbo.nodeCache.GetOrCreate(de.BlockPointer, name, dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dir, nil
+}
+
+// moveToConflictDirLocked moves the conflict copy c into the
+// directory dirName at the root of the TLF, making that directory if
+// there isn't one yet, and returns the copy as moved.  A symlink with
+// a relative target is remade there with a target that leads to the
+// same place.
+func (fbo *folderBranchOps) moveToConflictDirLocked(ctx context.Context,
+	lState *lockState, dirName string, c crConflictCopy) (
+	crConflictCopy, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	conflictDir, err := fbo.getDirNodeByNameLocked(
+		ctx, lState, []string{dirName}, true)
+	if err != nil {
+		return crConflictCopy{}, err
+	}
+	names := make([]string, 0, len(c.dir.path)-1)
+	for _, pn := range c.dir.path[1:] {
+		names = append(names, pn.Name)
+	}
+	dir, err := fbo.getDirNodeByNameLocked(ctx, lState, names, false)
+	if err != nil {
+		return crConflictCopy{}, err
+	}
+
+	md, err := fbo.getMDForCoalescedWriteLocked(ctx, lState)
+	if err != nil {
+		return crConflictCopy{}, err
+	}
+	dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
+	if err != nil {
+		return crConflictCopy{}, err
+	}
+	conflictPath, err := fbo.pathFromNodeForMDWriteLocked(lState, conflictDir)
+	if err != nil {
+		return crConflictCopy{}, err
+	}
+	dblock, err := fbo.blocks.GetDir(
+		ctx, lState, md.ReadOnly(), dirPath, blockRead)
+	if err != nil {
+		return crConflictCopy{}, err
+	}
+	de, ok := dblock.Children[c.copyName]
+	if !ok {
+		return crConflictCopy{}, NoSuchNameError{c.copyName}
+	}
+	cblock, err := fbo.blocks.GetDir(
+		ctx, lState, md.ReadOnly(), conflictPath, blockRead)
+	if err != nil {
+		return crConflictCopy{}, err
+	}
+	name, err := uniquifyName(cblock, c.copyName)
+	if err != nil {
+		return crConflictCopy{}, err
+	}
+	moved := c.inConflictDir(dirName, name)
+
+	if de.Type != Sym || strings.HasPrefix(de.SymPath, "/") {
+		fbo.log.CDebugf(ctx, "Moving conflict copy %s into %s", c, moved)
+		err = fbo.renameWithMDLocked(
+			ctx, lState, md, dirPath, c.copyName, conflictPath, name)
+		if err != nil {
+			return crConflictCopy{}, err
+		}
+		return moved, nil
+	}
+
+	// The new target climbs out of the conflict directory, and back
+	// down to where the symlink was.
+	target := strings.Join(append(append([]string{".."}, names...),
+		de.SymPath), "/")
+	fbo.log.CDebugf(ctx, "Remaking conflict copy %s as %s, to %s",
+		c, moved, target)
+	_, err = fbo.createLinkLocked(ctx, lState, conflictDir, name, target)
+	if err != nil {
+		return crConflictCopy{}, err
+	}
+	md, err = fbo.getMDForCoalescedWriteLocked(ctx, lState)
+	if err != nil {
+		return crConflictCopy{}, err
+	}
+	dirPath, err = fbo.pathFromNodeForMDWriteLocked(lState, dir)
+	if err != nil {
+		return crConflictCopy{}, err
+	}
+	err = fbo.removeEntryLocked(ctx, lState, md, dirPath, c.copyName)
+	if err != nil {
+		return crConflictCopy{}, err
+	}
+	return moved, nil
+}
+
+// moveConflictCopies moves the copies made by a finished resolution
+// into the directory at the root of the TLF named by the configured
+// ConflictDirRenamer, if any, and returns the copies as they ended
+// up.  The moves are ordinary writes made after the resolution, one
+// revision each unless they coalesce.  A copy that can't be moved,
+// such as one of several links to a file, stays where it is.
+func (cr *ConflictResolver) moveConflictCopies(ctx context.Context,
+	lState *lockState, copies []crConflictCopy,
+	doLock bool) []crConflictCopy {
+	dirName := conflictDirName(cr.config)
+	if dirName == "" || len(copies) == 0 {
+		return copies
+	}
+
+	// The resolution is done, so newer input, which cancels ctx,
+	// mustn't stop the moves; only shutting down does.
+	if replayCtx, err := NewContextWithReplayFrom(ctx); err == nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(replayCtx)
+		defer cancel()
+		go func() {
+			select {
+			case <-cr.fbo.shutdownChan:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	// If unmerged writes are blocked, this resolution already
+	// holds the lock.
+	if !doLock {
+		cr.fbo.mdWriterLock.Lock(lState)
+		defer cr.fbo.mdWriterLock.Unlock(lState)
+	}
+	for i, c := range copies {
+		if c.name == c.copyName || c.isInConflictDir(dirName) {
+			continue
+		}
+		moved, err := cr.fbo.moveToConflictDirLocked(ctx, lState, dirName, c)
+		if err != nil {
+			cr.log.CDebugf(ctx, "Leaving conflict copy %s where it is: %+v",
+				c, err)
+			continue
+		}
+		copies[i] = moved
+	}
+	sort.Sort(crConflictCopiesByName(copies))
+	return copies
+}
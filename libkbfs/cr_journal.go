@@ -0,0 +1,137 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/keybase/go-codec/codec"
+)
+
+// CRJournalEntry describes a conflict resolution that has started
+// putting its blocks, but hasn't yet been confirmed to be on the
+// merged branch.
+type CRJournalEntry struct {
+	Tlf TlfID
+	// BID is the unmerged branch being resolved.
+	BID BranchID
+	// Revision is the merged revision of the resolution MD.
+	Revision MetadataRevision
+	// Root is the root directory pointer of the resolution MD,
+	// used to tell whether the MD at Revision is ours.
+	Root BlockPointer
+	// Blocks are the block references put by the resolution.
+	Blocks []BlockPointer
+	// BlocksPut is set once all of Blocks have been put, and so
+	// the MD put may have started.
+	BlocksPut bool
+
+	codec.UnknownFieldSetHandler
+}
+
+// CRJournalStandard is the standard implementation of the CRJournal
+// interface.  If it has a directory, each pending resolution is
+// written there as a single file named after its TLF, so it
+// survives restarts; otherwise it only lives in memory.
+type CRJournalStandard struct {
+	codec Codec
+	// dirPath is empty if this journal is purely in-memory.
+	dirPath string
+
+	// lock protects entries, and serializes access to the files.
+	lock    sync.Mutex
+	entries map[TlfID]CRJournalEntry
+}
+
+var _ CRJournal = (*CRJournalStandard)(nil)
+
+// NewCRJournalStandard constructs a new in-memory CRJournalStandard.
+func NewCRJournalStandard() *CRJournalStandard {
+	return &CRJournalStandard{entries: make(map[TlfID]CRJournalEntry)}
+}
+
+// NewCRJournalDisk constructs a new CRJournalStandard that keeps its
+// entries in the given directory.
+func NewCRJournalDisk(codec Codec, dirPath string) *CRJournalStandard {
+	return &CRJournalStandard{codec: codec, dirPath: dirPath}
+}
+
+func (j *CRJournalStandard) path(tlfID TlfID) string {
+	return filepath.Join(j.dirPath, tlfID.String())
+}
+
+// GetPendingResolution implements the CRJournal interface for
+// CRJournalStandard.
+func (j *CRJournalStandard) GetPendingResolution(tlfID TlfID) (
+	CRJournalEntry, bool, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.dirPath == "" {
+		entry, ok := j.entries[tlfID]
+		return entry, ok, nil
+	}
+
+	buf, err := ioutil.ReadFile(j.path(tlfID))
+	if os.IsNotExist(err) {
+		return CRJournalEntry{}, false, nil
+	} else if err != nil {
+		return CRJournalEntry{}, false, err
+	}
+	var entry CRJournalEntry
+	err = j.codec.Decode(buf, &entry)
+	if err != nil {
+		return CRJournalEntry{}, false, err
+	}
+	return entry, true, nil
+}
+
+// PutPendingResolution implements the CRJournal interface for
+// CRJournalStandard.
+func (j *CRJournalStandard) PutPendingResolution(entry CRJournalEntry) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.dirPath == "" {
+		j.entries[entry.Tlf] = entry
+		return nil
+	}
+
+	buf, err := j.codec.Encode(entry)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(j.dirPath, 0700)
+	if err != nil {
+		return err
+	}
+	// Write to a temp file first, so a crash never leaves a
+	// truncated entry behind.
+	path := j.path(entry.Tlf)
+	tmpPath := path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, buf, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// ClearPendingResolution implements the CRJournal interface for
+// CRJournalStandard.
+func (j *CRJournalStandard) ClearPendingResolution(tlfID TlfID) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.dirPath == "" {
+		delete(j.entries, tlfID)
+		return nil
+	}
+
+	err := os.Remove(j.path(tlfID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
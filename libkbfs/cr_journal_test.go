@@ -0,0 +1,80 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testCRJournalRoundTrip(t *testing.T, journal CRJournal,
+	reopen func() CRJournal) {
+	tlfID := FakeTlfID(1, false)
+	_, ok, err := journal.GetPendingResolution(tlfID)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	entry := CRJournalEntry{
+		Tlf:      tlfID,
+		BID:      FakeBranchID(1),
+		Revision: MetadataRevision(10),
+		Root:     BlockPointer{ID: fakeBlockID(1)},
+		Blocks: []BlockPointer{
+			{ID: fakeBlockID(1)}, {ID: fakeBlockID(2)},
+		},
+	}
+	err = journal.PutPendingResolution(entry)
+	require.NoError(t, err)
+
+	entry.BlocksPut = true
+	err = journal.PutPendingResolution(entry)
+	require.NoError(t, err)
+
+	if reopen != nil {
+		journal = reopen()
+	}
+	got, ok, err := journal.GetPendingResolution(tlfID)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, entry, got)
+
+	// Other TLFs are unaffected.
+	_, ok, err = journal.GetPendingResolution(FakeTlfID(2, false))
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	err = journal.ClearPendingResolution(tlfID)
+	require.NoError(t, err)
+	_, ok, err = journal.GetPendingResolution(tlfID)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// Clearing twice is fine.
+	err = journal.ClearPendingResolution(tlfID)
+	require.NoError(t, err)
+}
+
+func TestCRJournalMemory(t *testing.T) {
+	testCRJournalRoundTrip(t, NewCRJournalStandard(), nil)
+}
+
+func TestCRJournalDisk(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "cr_journal")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	codec := NewCodecMsgpack()
+	testCRJournalRoundTrip(t, NewCRJournalDisk(codec, tempdir),
+		func() CRJournal {
+			// Simulate a restart.
+			return NewCRJournalDisk(codec, tempdir)
+		})
+}
@@ -77,6 +77,27 @@ func (c *CryptoClient) Sign(ctx context.Context, msg []byte) (
 	return
 }
 
+// SignBatch implements the Crypto interface for CryptoClient.  The
+// service protocol has no batch signing call, so the messages are
+// signed one RPC at a time.
+func (c *CryptoClient) SignBatch(ctx context.Context, msgs [][]byte) (
+	sigInfos []SignatureInfo, err error) {
+	c.log.CDebugf(ctx, "Signing batch of %d messages", len(msgs))
+	defer func() {
+		c.deferLog.CDebugf(ctx, "Signed batch of %d messages: err=%v",
+			len(msgs), err)
+	}()
+
+	sigInfos = make([]SignatureInfo, len(msgs))
+	for i, msg := range msgs {
+		sigInfos[i], err = c.Sign(ctx, msg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sigInfos, nil
+}
+
 // SignToString implements the Crypto interface for CryptoClient.
 func (c *CryptoClient) SignToString(ctx context.Context, msg []byte) (
 	signature string, err error) {
@@ -33,7 +33,8 @@ func NewCryptoClientRPC(config Config, kbCtx Context) *CryptoClientRPC {
 		},
 	}
 	conn := NewSharedKeybaseConnection(kbCtx, config, c)
-	c.CryptoClient.client = keybase1.CryptoClient{Cli: conn.GetClient()}
+	c.CryptoClient.client = keybase1.CryptoClient{
+		Cli: newPendingRPCClient("service", conn.GetClient())}
 	c.CryptoClient.shutdownFn = conn.Shutdown
 	return c
 }
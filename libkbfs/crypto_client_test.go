@@ -161,6 +161,33 @@ func TestCryptoClientSignAndVerify(t *testing.T) {
 	}
 }
 
+// Test that batch-signing messages one at a time, and then
+// verifying them, works.
+func TestCryptoClientSignBatchAndVerify(t *testing.T) {
+	signingKey := MakeFakeSigningKeyOrBust("client sign")
+	cryptPrivateKey := MakeFakeCryptPrivateKeyOrBust("client crypt private")
+	config := testCryptoClientConfig(t)
+	fc := NewFakeCryptoClient(config, signingKey, cryptPrivateKey, nil, nil)
+	c := newCryptoClientWithClient(config, fc)
+
+	msgs := [][]byte{[]byte("message1"), []byte("message2")}
+	sigInfos, err := c.SignBatch(context.Background(), msgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.VerifyBatch(msgs, sigInfos)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Swapping the signatures should make verification fail.
+	err = c.VerifyBatch(msgs, []SignatureInfo{sigInfos[1], sigInfos[0]})
+	if _, ok := err.(libkb.VerificationError); !ok {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
 // Test that canceling a signing RPC returns the correct error
 func TestCryptoClientSignCanceled(t *testing.T) {
 	config := testCryptoClientConfig(t)
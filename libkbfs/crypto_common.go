@@ -8,7 +8,7 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/binary"
-	"io"
+	"fmt"
 
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/protocol/keybase1"
@@ -253,6 +253,69 @@ func (c CryptoCommon) Verify(msg []byte, sigInfo SignatureInfo) (err error) {
 	return
 }
 
+// VerifyBatch implements the Crypto interface for CryptoCommon.
+func (c CryptoCommon) VerifyBatch(
+	msgs [][]byte, sigInfos []SignatureInfo) error {
+	if len(msgs) != len(sigInfos) {
+		return fmt.Errorf("Got %d messages but %d signatures",
+			len(msgs), len(sigInfos))
+	}
+	for i, msg := range msgs {
+		err := c.Verify(msg, sigInfos[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sigBatch is a cryptoPure whose Verify and VerifyBatch only collect
+// the signatures they're given, so that verify can check them all
+// with a single VerifyBatch call.  Until then, nothing it has
+// collected has been verified.
+type sigBatch struct {
+	cryptoPure
+	msgs     [][]byte
+	sigInfos []SignatureInfo
+}
+
+var _ cryptoPure = (*sigBatch)(nil)
+
+func newSigBatch(crypto cryptoPure) *sigBatch {
+	return &sigBatch{cryptoPure: crypto}
+}
+
+// Verify implements the cryptoPure interface for sigBatch.
+func (b *sigBatch) Verify(msg []byte, sigInfo SignatureInfo) error {
+	b.msgs = append(b.msgs, msg)
+	b.sigInfos = append(b.sigInfos, sigInfo)
+	return nil
+}
+
+// VerifyBatch implements the cryptoPure interface for sigBatch.  It
+// collects the signatures too, so that batches can be nested.
+func (b *sigBatch) VerifyBatch(
+	msgs [][]byte, sigInfos []SignatureInfo) error {
+	if len(msgs) != len(sigInfos) {
+		return fmt.Errorf("Got %d messages but %d signatures",
+			len(msgs), len(sigInfos))
+	}
+	b.msgs = append(b.msgs, msgs...)
+	b.sigInfos = append(b.sigInfos, sigInfos...)
+	return nil
+}
+
+// verify checks all the signatures collected so far.
+func (b *sigBatch) verify() error {
+	if len(b.msgs) == 0 {
+		return nil
+	}
+	err := b.cryptoPure.VerifyBatch(b.msgs, b.sigInfos)
+	b.msgs = nil
+	b.sigInfos = nil
+	return err
+}
+
 // EncryptTLFCryptKeyClientHalf implements the Crypto interface for
 // CryptoCommon.
 func (c CryptoCommon) EncryptTLFCryptKeyClientHalf(privateKey TLFEphemeralPrivateKey, publicKey CryptPublicKey, clientHalf TLFCryptKeyClientHalf) (encryptedClientHalf EncryptedTLFCryptKeyClientHalf, err error) {
@@ -316,6 +379,13 @@ func (c CryptoCommon) EncryptPrivateMetadata(pmd *PrivateMetadata, key TLFCryptK
 }
 
 func (c CryptoCommon) decryptData(encryptedData encryptedData, key [32]byte) ([]byte, error) {
+	return c.decryptDataTo(nil, encryptedData, key)
+}
+
+// decryptDataTo is like decryptData, but appends the decrypted data
+// to out.
+func (c CryptoCommon) decryptDataTo(out []byte, encryptedData encryptedData,
+	key [32]byte) ([]byte, error) {
 	if encryptedData.Version != EncryptionSecretbox {
 		return nil, UnknownEncryptionVer{encryptedData.Version}
 	}
@@ -326,7 +396,7 @@ func (c CryptoCommon) decryptData(encryptedData encryptedData, key [32]byte) ([]
 	}
 	copy(nonce[:], encryptedData.Nonce)
 
-	decryptedData, ok := secretbox.Open(nil, encryptedData.EncryptedData, &nonce, &key)
+	decryptedData, ok := secretbox.Open(out, encryptedData.EncryptedData, &nonce, &key)
 	if !ok {
 		return nil, libkb.DecryptionError{}
 	}
@@ -376,62 +446,115 @@ func nextPowerOfTwo(n uint32) uint32 {
 
 const padPrefixSize = 4
 
-// padBlock adds random padding to an encoded block.
+// padPrefixCompressed is set in the length prefix of a padded block
+// whose data was compressed by compressBlock.  Pointers to such
+// blocks have CompressedBlocksDataVer or above, so clients that
+// predate compression refuse to read them, rather than reading the
+// prefix as an impossible length.
+const padPrefixCompressed = 1 << 31
+
+// padBlock adds random padding to an encoded block.  The padded
+// block is in a buffer from blockBufferPool.
 func (c CryptoCommon) padBlock(block []byte) ([]byte, error) {
+	return c.padBlockData(block, false)
+}
+
+func (c CryptoCommon) padBlockData(block []byte, compressed bool) (
+	[]byte, error) {
 	blockLen := uint32(len(block))
 	overallLen := nextPowerOfTwo(blockLen)
-	padLen := int64(overallLen - blockLen)
+	padLen := int(overallLen - blockLen)
 
-	buf := bytes.NewBuffer(make([]byte, 0, overallLen+padPrefixSize))
+	buf := blockBufferPool.get(int(overallLen + padPrefixSize))
 
-	// first 4 bytes contain the length of the block data
-	if err := binary.Write(buf, binary.LittleEndian, blockLen); err != nil {
-		return nil, err
+	// first 4 bytes contain the length of the block data, and
+	// whether it's compressed
+	prefix := blockLen
+	if compressed {
+		prefix |= padPrefixCompressed
 	}
+	buf = buf[:padPrefixSize]
+	binary.LittleEndian.PutUint32(buf, prefix)
 
 	// followed by the actual block data
-	buf.Write(block)
+	buf = append(buf, block...)
 
 	// followed by random data
-	n, err := io.CopyN(buf, rand.Reader, padLen)
-	if err != nil {
+	dataEnd := len(buf)
+	buf = buf[:dataEnd+padLen]
+	if err := cryptoRandRead(buf[dataEnd:]); err != nil {
 		return nil, err
 	}
-	if n != padLen {
-		return nil, UnexpectedShortCryptoRandRead{}
-	}
 
-	return buf.Bytes(), nil
+	return buf, nil
 }
 
-// depadBlock extracts the actual block data from a padded block.
+// depadBlock extracts the actual block data from a padded block,
+// decompressing it if needed.
 func (c CryptoCommon) depadBlock(paddedBlock []byte) ([]byte, error) {
+	if len(paddedBlock) < padPrefixSize {
+		return nil, PaddedBlockReadError{
+			ActualLen: len(paddedBlock), ExpectedLen: padPrefixSize}
+	}
 	buf := bytes.NewBuffer(paddedBlock)
 
-	var blockLen uint32
-	if err := binary.Read(buf, binary.LittleEndian, &blockLen); err != nil {
+	var prefix uint32
+	if err := binary.Read(buf, binary.LittleEndian, &prefix); err != nil {
 		return nil, err
 	}
+	blockLen := prefix &^ padPrefixCompressed
 	blockEndPos := int(blockLen + padPrefixSize)
 
 	if len(paddedBlock) < blockEndPos {
 		return nil, PaddedBlockReadError{ActualLen: len(paddedBlock), ExpectedLen: blockEndPos}
 	}
-	return buf.Next(int(blockLen)), nil
+	block := buf.Next(int(blockLen))
+	if prefix&padPrefixCompressed != 0 {
+		return decompressBlock(block)
+	}
+	return block, nil
+}
+
+// encodedSizeHint guesses how big the encoding of the given block
+// is, so that it can be encoded into a big enough buffer.
+func encodedSizeHint(block Block) int {
+	if fBlock, ok := block.(*FileBlock); ok {
+		return len(fBlock.Contents) + minBlockSize
+	}
+	return 0
 }
 
 // EncryptBlock implements the Crypto interface for CryptoCommon.
-func (c CryptoCommon) EncryptBlock(block Block, key BlockCryptKey) (plainSize int, encryptedBlock EncryptedBlock, err error) {
-	encodedBlock, err := c.codec.Encode(block)
+func (c CryptoCommon) EncryptBlock(block Block, key BlockCryptKey,
+	compression BlockCompressionType) (
+	plainSize int, encryptedBlock EncryptedBlock, err error) {
+	// The encoded and padded blocks are only needed until the block
+	// is encrypted, so reuse their buffers.
+	encodedBlock, pooled, err := encodeToPooledBuffer(
+		c.codec, block, encodedSizeHint(block))
 	if err != nil {
 		return
 	}
+	if pooled {
+		defer blockBufferPool.put(encodedBlock)
+	}
 
-	paddedBlock, err := c.padBlock(encodedBlock)
+	compressedBlock, err := compressBlock(compression, encodedBlock)
 	if err != nil {
 		return
 	}
 
+	var paddedBlock []byte
+	if compressedBlock != nil {
+		paddedBlock, err = c.padBlockData(compressedBlock, true)
+	} else {
+		paddedBlock, err = c.padBlock(encodedBlock)
+	}
+	if err != nil {
+		return
+	}
+	defer blockBufferPool.put(paddedBlock)
+
 	encryptedData, err := c.encryptData(paddedBlock, key.data)
 	if err != nil {
 		return
@@ -444,11 +567,22 @@ func (c CryptoCommon) EncryptBlock(block Block, key BlockCryptKey) (plainSize in
 
 // DecryptBlock implements the Crypto interface for CryptoCommon.
 func (c CryptoCommon) DecryptBlock(encryptedBlock EncryptedBlock, key BlockCryptKey, block Block) error {
-	paddedBlock, err := c.decryptData(encryptedData(encryptedBlock), key.data)
+	// The padded block is only needed until it's decoded, which
+	// copies everything the block keeps.
+	paddedBlock, err := c.decryptDataTo(
+		blockBufferPool.get(len(encryptedBlock.EncryptedData)),
+		encryptedData(encryptedBlock), key.data)
 	if err != nil {
 		return err
 	}
+	defer blockBufferPool.put(paddedBlock)
+
+	return c.decodePaddedBlock(paddedBlock, block)
+}
 
+// decodePaddedBlock depads and decodes a decrypted block into block.
+func (c CryptoCommon) decodePaddedBlock(
+	paddedBlock []byte, block Block) error {
 	encodedBlock, err := c.depadBlock(paddedBlock)
 	if err != nil {
 		return err
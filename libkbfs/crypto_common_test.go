@@ -249,7 +249,7 @@ func TestCryptoCommonEncryptDecryptBlock(t *testing.T) {
 	block := TestBlock{42}
 	key := BlockCryptKey{}
 
-	_, encryptedBlock, err := c.EncryptBlock(block, key)
+	_, encryptedBlock, err := c.EncryptBlock(block, key, BlockCompressionNone)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -655,7 +655,7 @@ func TestEncryptBlock(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	plainSize, encryptedBlock, err := c.EncryptBlock(block, cryptKey)
+	plainSize, encryptedBlock, err := c.EncryptBlock(block, cryptKey, BlockCompressionNone)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -716,7 +716,7 @@ func TestDecryptEncryptedBlock(t *testing.T) {
 
 	block := TestBlock{50}
 
-	_, encryptedBlock, err := c.EncryptBlock(&block, cryptKey)
+	_, encryptedBlock, err := c.EncryptBlock(&block, cryptKey, BlockCompressionNone)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -740,7 +740,7 @@ func TestDecryptBlockFailures(t *testing.T) {
 
 	block := TestBlock{50}
 
-	_, encryptedBlock, err := c.EncryptBlock(&block, cryptKey)
+	_, encryptedBlock, err := c.EncryptBlock(&block, cryptKey, BlockCompressionNone)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -897,7 +897,7 @@ func TestBlockEncryptedLen(t *testing.T) {
 	var expectedLen int
 	for i := 1025; i < 2000; i++ {
 		data := randomData[:i]
-		_, encBlock, err := c.EncryptBlock(data, cryptKey)
+		_, encBlock, err := c.EncryptBlock(data, cryptKey, BlockCompressionNone)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -913,3 +913,37 @@ func TestBlockEncryptedLen(t *testing.T) {
 		}
 	}
 }
+
+// BenchmarkEncryptDecryptBlocks1gb encrypts and decrypts 1GB worth of
+// full-size file blocks per iteration, like a sync of a large file
+// followed by reading it back.  Run it with -benchmem to see the
+// allocations.
+func BenchmarkEncryptDecryptBlocks1gb(b *testing.B) {
+	c := MakeCryptoCommon(NewCodecMsgpack())
+	var cryptKey BlockCryptKey
+	err := cryptoRandRead(cryptKey.data[:])
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	const total = 1 << 30
+	block := NewFileBlock().(*FileBlock)
+	block.Contents = make([]byte, MaxBlockSizeBytesDefault)
+	b.SetBytes(total)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for n := 0; n < total; n += len(block.Contents) {
+			_, encryptedBlock, err := c.EncryptBlock(
+				block, cryptKey, BlockCompressionNone)
+			if err != nil {
+				b.Fatal(err)
+			}
+			var decryptedBlock FileBlock
+			err = c.DecryptBlock(encryptedBlock, cryptKey, &decryptedBlock)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
@@ -88,6 +88,18 @@ func (c cryptoSignerLocal) Sign(ctx context.Context, msg []byte) (
 	return
 }
 
+func (c cryptoSignerLocal) SignBatch(ctx context.Context, msgs [][]byte) (
+	sigInfos []SignatureInfo, err error) {
+	sigInfos = make([]SignatureInfo, len(msgs))
+	for i, msg := range msgs {
+		sigInfos[i], err = c.Sign(ctx, msg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sigInfos, nil
+}
+
 func (c cryptoSignerLocal) SignToString(ctx context.Context, msg []byte) (
 	signature string, err error) {
 	signature, _, err = c.signingKey.kp.SignToString(msg)
@@ -0,0 +1,204 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"math"
+	"runtime"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// cryptoProbeDuration is how long ProbeCryptoCapabilities
+	// measures each primitive for.
+	cryptoProbeDuration = 50 * time.Millisecond
+	// blockReadyTargetBytesPerSec is how fast file syncs should be
+	// able to ready blocks, which is well above what most uplinks
+	// can put.  Block readying gets as many workers as it takes to
+	// reach this, up to the number of CPUs.
+	blockReadyTargetBytesPerSec = 256 << 20
+)
+
+// CryptoCapabilities describes how fast this machine does the crypto
+// KBFS needs, and how KBFS was tuned for it.  It's part of
+// KBFSStatus, so slowness that's down to a slow CPU can be told
+// apart from slowness that's down to the network.
+type CryptoCapabilities struct {
+	GOARCH string
+	NumCPU int
+	// Accelerated names the primitives that have an assembly
+	// implementation on this architecture.  The others run as
+	// plain Go.
+	Accelerated []string `json:",omitempty"`
+
+	// The rates are for a single core, and are zero until the
+	// probe has run.  Encryption and decryption are of whole
+	// blocks, including encoding; hashing is of encrypted blocks,
+	// to make block IDs.  Signatures are made with a local key,
+	// so they leave out the round trip to the Keybase service
+	// that signing MD revisions also takes.
+	EncryptBytesPerSec float64
+	DecryptBytesPerSec float64
+	HashBytesPerSec    float64
+	SignsPerSec        float64
+	VerifiesPerSec     float64
+	ProbeTime          time.Duration
+
+	// BlockReadyWorkers is how many blocks a file sync readies at
+	// once.
+	BlockReadyWorkers int
+}
+
+// acceleratedCryptoPrimitives returns the primitives with assembly
+// implementations for goarch, in the crypto packages KBFS is built
+// with.
+func acceleratedCryptoPrimitives(goarch string) []string {
+	var accelerated []string
+	switch goarch {
+	case "amd64":
+		accelerated = append(accelerated, "salsa20", "poly1305")
+	case "arm":
+		accelerated = append(accelerated, "poly1305")
+	}
+	switch goarch {
+	case "386", "amd64", "arm", "arm64", "ppc64le", "s390x":
+		accelerated = append(accelerated, "sha256")
+	}
+	return accelerated
+}
+
+// defaultCryptoCapabilities returns the capabilities to assume until
+// the probe has run.
+func defaultCryptoCapabilities() CryptoCapabilities {
+	return CryptoCapabilities{
+		GOARCH:            runtime.GOARCH,
+		NumCPU:            runtime.NumCPU(),
+		Accelerated:       acceleratedCryptoPrimitives(runtime.GOARCH),
+		BlockReadyWorkers: runtime.NumCPU(),
+	}
+}
+
+// blockReadyWorkersFor returns how many workers it takes to ready
+// blocks at blockReadyTargetBytesPerSec, given the single-core
+// rates of the two steps of readying a block.
+func blockReadyWorkersFor(numCPU int, encryptBytesPerSec,
+	hashBytesPerSec float64) int {
+	if encryptBytesPerSec <= 0 || hashBytesPerSec <= 0 {
+		return numCPU
+	}
+	perWorker := 1 / (1/encryptBytesPerSec + 1/hashBytesPerSec)
+	workers := int(math.Ceil(blockReadyTargetBytesPerSec / perWorker))
+	if workers > numCPU {
+		workers = numCPU
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	return workers
+}
+
+// measureRate runs f over and over for at least d, and returns how
+// many times per second it ran.
+func measureRate(d time.Duration, f func() error) (float64, error) {
+	start := time.Now()
+	n := 0
+	for {
+		if err := f(); err != nil {
+			return 0, err
+		}
+		n++
+		if elapsed := time.Since(start); elapsed >= d {
+			return float64(n) / elapsed.Seconds(), nil
+		}
+	}
+}
+
+// ProbeCryptoCapabilities measures how fast this machine does the
+// crypto KBFS needs, with throwaway keys, and picks the block
+// readying worker count to match.  It takes a fraction of a second,
+// so callers that care about startup time should run it in the
+// background; see Config.SetCryptoCapabilities.
+func ProbeCryptoCapabilities(codec Codec) (CryptoCapabilities, error) {
+	caps := defaultCryptoCapabilities()
+	start := time.Now()
+
+	var keyData [32]byte
+	if err := cryptoRandRead(keyData[:]); err != nil {
+		return CryptoCapabilities{}, err
+	}
+	key := MakeBlockCryptKey(keyData)
+	var secret SigningKeySecret
+	if err := cryptoRandRead(secret.secret[:]); err != nil {
+		return CryptoCapabilities{}, err
+	}
+	signingKey, err := makeSigningKey(secret)
+	if err != nil {
+		return CryptoCapabilities{}, err
+	}
+	crypto := NewCryptoLocal(codec, signingKey, CryptPrivateKey{})
+
+	block := NewFileBlock().(*FileBlock)
+	block.Contents = make([]byte, MaxBlockSizeBytesDefault)
+	if err := cryptoRandRead(block.Contents); err != nil {
+		return CryptoCapabilities{}, err
+	}
+	blockSize := float64(len(block.Contents))
+
+	var encrypted EncryptedBlock
+	rate, err := measureRate(cryptoProbeDuration, func() (err error) {
+		_, encrypted, err = crypto.EncryptBlock(
+			block, key, BlockCompressionNone)
+		return err
+	})
+	if err != nil {
+		return CryptoCapabilities{}, err
+	}
+	caps.EncryptBytesPerSec = rate * blockSize
+
+	rate, err = measureRate(cryptoProbeDuration, func() error {
+		return crypto.DecryptBlock(encrypted, key, NewFileBlock())
+	})
+	if err != nil {
+		return CryptoCapabilities{}, err
+	}
+	caps.DecryptBytesPerSec = rate * blockSize
+
+	encoded, err := codec.Encode(encrypted)
+	if err != nil {
+		return CryptoCapabilities{}, err
+	}
+	rate, err = measureRate(cryptoProbeDuration, func() error {
+		_, err := crypto.MakePermanentBlockID(encoded)
+		return err
+	})
+	if err != nil {
+		return CryptoCapabilities{}, err
+	}
+	caps.HashBytesPerSec = rate * float64(len(encoded))
+
+	// MD revisions are a few KB once encoded.
+	msg := make([]byte, 4096)
+	var sigInfo SignatureInfo
+	caps.SignsPerSec, err = measureRate(cryptoProbeDuration, func() (err error) {
+		sigInfo, err = crypto.Sign(context.Background(), msg)
+		return err
+	})
+	if err != nil {
+		return CryptoCapabilities{}, err
+	}
+	caps.VerifiesPerSec, err = measureRate(cryptoProbeDuration, func() error {
+		return crypto.Verify(msg, sigInfo)
+	})
+	if err != nil {
+		return CryptoCapabilities{}, err
+	}
+
+	caps.ProbeTime = time.Since(start)
+	caps.BlockReadyWorkers = blockReadyWorkersFor(
+		caps.NumCPU, caps.EncryptBytesPerSec, caps.HashBytesPerSec)
+	return caps, nil
+}
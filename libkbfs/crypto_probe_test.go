@@ -0,0 +1,35 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbeCryptoCapabilities(t *testing.T) {
+	caps, err := ProbeCryptoCapabilities(NewCodecMsgpack())
+	require.NoError(t, err)
+	require.True(t, caps.EncryptBytesPerSec > 0)
+	require.True(t, caps.DecryptBytesPerSec > 0)
+	require.True(t, caps.HashBytesPerSec > 0)
+	require.True(t, caps.SignsPerSec > 0)
+	require.True(t, caps.VerifiesPerSec > 0)
+	require.True(t, caps.BlockReadyWorkers >= 1)
+	require.True(t, caps.BlockReadyWorkers <= caps.NumCPU)
+}
+
+func TestBlockReadyWorkersFor(t *testing.T) {
+	const mb = 1 << 20
+	// Unprobed rates use every CPU.
+	require.Equal(t, 8, blockReadyWorkersFor(8, 0, 0))
+	// Fast crypto needs a single worker.
+	require.Equal(t, 1, blockReadyWorkersFor(8, 2048*mb, 2048*mb))
+	// 64MB/s per worker takes 4 workers to reach 256MB/s.
+	require.Equal(t, 4, blockReadyWorkersFor(8, 128*mb, 128*mb))
+	// Slow crypto is capped at the number of CPUs.
+	require.Equal(t, 2, blockReadyWorkersFor(2, 10*mb, 10*mb))
+}
@@ -192,8 +192,63 @@ const (
 	// FilesWithHolesDataVer is the data version for files
 	// with holes.
 	FilesWithHolesDataVer = 2
+	// AtLeastTwoLevelsOfChildrenDataVer is the data version for
+	// indirect file blocks whose indirect pointers point to other
+	// indirect blocks, rather than to blocks of data.
+	AtLeastTwoLevelsOfChildrenDataVer = 3
+	// IndirectDirsDataVer is the data version for directories whose
+	// top block is indirect, pointing to shards of their entries.
+	IndirectDirsDataVer = 4
+	// CompressedBlocksDataVer is the data version for blocks that
+	// may have been compressed before they were encrypted, and for
+	// indirect blocks with any such block under them.
+	CompressedBlocksDataVer = 5
+	// CompressedTwoLevelsOfChildrenDataVer is the data version for
+	// indirect file blocks that would otherwise have
+	// AtLeastTwoLevelsOfChildrenDataVer, but have compressed blocks
+	// under them.
+	CompressedTwoLevelsOfChildrenDataVer = 6
 )
 
+// Since each data version is needed to read everything written with
+// the ones before it, a pointer can only carry one of them, and the
+// versions that also say how deep a file's tree of blocks is come in
+// pairs: one with compression, and one without.
+
+// hasTwoLevelsOfChildren returns whether a file block pointer with
+// this data version points to an indirect block whose pointers lead
+// to other indirect blocks.
+func (v DataVer) hasTwoLevelsOfChildren() bool {
+	return v == AtLeastTwoLevelsOfChildrenDataVer ||
+		v == CompressedTwoLevelsOfChildrenDataVer
+}
+
+// mayBeCompressed returns whether a block pointer with this data
+// version may lead to compressed blocks.
+func (v DataVer) mayBeCompressed() bool {
+	return v == CompressedBlocksDataVer ||
+		v == CompressedTwoLevelsOfChildrenDataVer
+}
+
+// withTwoLevelsOfChildren returns the data version for a file block
+// pointer with version v, whose block's pointers lead to other
+// indirect blocks.
+func (v DataVer) withTwoLevelsOfChildren() DataVer {
+	if v.mayBeCompressed() {
+		return CompressedTwoLevelsOfChildrenDataVer
+	}
+	return AtLeastTwoLevelsOfChildrenDataVer
+}
+
+// withCompression returns the data version for a block pointer with
+// version v, which may lead to compressed blocks.
+func (v DataVer) withCompression() DataVer {
+	if v.hasTwoLevelsOfChildren() {
+		return CompressedTwoLevelsOfChildrenDataVer
+	}
+	return CompressedBlocksDataVer
+}
+
 // BlockRefNonce is a 64-bit unique sequence of bytes for identifying
 // this reference of a block ID from other references to the same
 // (duplicated) block.
@@ -252,6 +307,28 @@ type BlockContext struct {
 	RefNonce BlockRefNonce `codec:"r,omitempty"`
 }
 
+// makeFirstBlockContext makes the context for the initial reference
+// to a new block, which must be put by its creator.
+func makeFirstBlockContext(creator keybase1.UID) BlockContext {
+	return BlockContext{
+		Creator:  creator,
+		RefNonce: zeroBlockRefNonce,
+	}
+}
+
+// makeBlockContext makes the context for a subsequent reference to
+// an existing block, charged to the given writer.  refNonce must be
+// non-zero.
+func makeBlockContext(
+	creator, writer keybase1.UID, refNonce BlockRefNonce) BlockContext {
+	c := BlockContext{
+		Creator:  creator,
+		RefNonce: refNonce,
+	}
+	c.SetWriter(writer)
+	return c
+}
+
 // GetCreator returns the creator of the associated block.
 func (c BlockContext) GetCreator() keybase1.UID {
 	return c.Creator
@@ -287,6 +364,35 @@ func (c BlockContext) IsFirstRef() bool {
 	return c.RefNonce == zeroBlockRefNonce
 }
 
+// checkForPut returns an error if c can't be used to put a new
+// block: the creator must be set, the writer (if any) must match
+// the creator, and the ref nonce must be zero.
+func (c BlockContext) checkForPut() error {
+	if c.Creator.IsNil() {
+		return BlockContextMissingCreatorError{blockPutOp, c}
+	}
+	if c.GetWriter() != c.GetCreator() {
+		return BlockContextWriterMismatchError{c}
+	}
+	if !c.IsFirstRef() {
+		return BlockContextRefNonceError{blockPutOp, c}
+	}
+	return nil
+}
+
+// checkForAddReference returns an error if c can't be used to add a
+// reference to an existing block: the creator must be set, and the
+// ref nonce must be non-zero.  The writer may be anyone.
+func (c BlockContext) checkForAddReference() error {
+	if c.Creator.IsNil() {
+		return BlockContextMissingCreatorError{addRefOp, c}
+	}
+	if c.IsFirstRef() {
+		return BlockContextRefNonceError{addRefOp, c}
+	}
+	return nil
+}
+
 func (c BlockContext) String() string {
 	s := fmt.Sprintf("BlockContext{Creator: %s", c.Creator)
 	if len(c.Writer) > 0 {
@@ -365,6 +471,9 @@ type ReadyBlockData struct {
 	// These fields should not be used outside of BlockOps.Put().
 	buf        []byte
 	serverHalf BlockCryptKeyServerHalf
+	// mayBeCompressed is set if the block was readied with
+	// compression on, whether or not compressing it saved space.
+	mayBeCompressed bool
 }
 
 // GetEncodedSize returns the size of the encoded (and encrypted)
@@ -698,6 +807,20 @@ type EntryInfo struct {
 	Mtime int64
 	// Ctime is in unix nanoseconds
 	Ctime int64
+	// Mode holds the POSIX permission bits last set with SetMode,
+	// or is nil if they've never been set.  Readers should use
+	// PosixMode rather than looking at it directly.
+	Mode *uint32 `codec:",omitempty"`
+	// UID and GID are the ownership hints last set with SetOwner,
+	// if any, and OwnerUser is the user who set them; see
+	// PosixOwner.
+	UID       *uint32      `codec:",omitempty"`
+	GID       *uint32      `codec:",omitempty"`
+	OwnerUser keybase1.UID `codec:",omitempty"`
+	// Nlink is the number of entries in the parent directory that
+	// are hard links to this file, or 0 if there's only this one.
+	// Readers should use LinkCount.
+	Nlink uint32 `codec:",omitempty"`
 }
 
 // extCode is used to register codec extensions
@@ -715,6 +838,9 @@ type ReportedError struct {
 	Time  time.Time
 	Error error
 	Stack []uintptr
+	// Tags are the log tags of the context the error happened in,
+	// such as the ID of the operation that got it.
+	Tags map[string]string
 }
 
 // MergeStatus represents the merge status of a TLF.
@@ -828,6 +954,14 @@ func NewUserQuotaInfo() *UserQuotaInfo {
 	}
 }
 
+// UsedBytes returns how many bytes count against the user's limit.
+func (u *UserQuotaInfo) UsedBytes() int64 {
+	if u.Total == nil {
+		return 0
+	}
+	return u.Total.Bytes[UsageWrite]
+}
+
 // AccumOne combines one quota charge to the existing UserQuotaInfo
 func (u *UserQuotaInfo) AccumOne(change int, folder string, usage UsageType) {
 	if _, ok := u.Folders[folder]; !ok {
@@ -6,10 +6,37 @@ package libkbfs
 
 import "github.com/keybase/go-codec/codec"
 
+const (
+	// maxXattrNameLen is the longest allowed extended attribute
+	// name, matching Linux's XATTR_NAME_MAX.
+	maxXattrNameLen = 255
+	// maxXattrSize is the biggest allowed extended attribute
+	// value, matching Linux's XATTR_SIZE_MAX.
+	maxXattrSize = 64 * 1024
+	// maxInlineXattrSize is the biggest extended attribute value
+	// that's stored directly in its DirEntry.
+	maxInlineXattrSize = 1024
+)
+
+// XattrValue is the value of one extended attribute of a directory
+// entry.  Small values are stored inline; bigger ones are stored in
+// a file block of their own.
+type XattrValue struct {
+	Inline []byte `codec:"i,omitempty"`
+	// Block is the block holding the value, if it's not inline.
+	Block BlockInfo `codec:"b,omitempty"`
+
+	codec.UnknownFieldSetHandler
+}
+
 // DirEntry is all the data info a directory know about its child.
 type DirEntry struct {
 	BlockInfo
 	EntryInfo
+	// Xattrs maps extended attribute names to their values.  It
+	// must be replaced, never modified in place, since DirEntries
+	// are shallow-copied out of cached blocks.
+	Xattrs map[string]XattrValue `codec:"x,omitempty"`
 
 	codec.UnknownFieldSetHandler
 }
@@ -18,3 +45,25 @@ type DirEntry struct {
 func (de *DirEntry) IsInitialized() bool {
 	return de.BlockPointer.IsInitialized()
 }
+
+// copyXattrs returns a copy of xattrs in which each of the given
+// names has the value it has in from, or is missing if it's missing
+// from from.
+func copyXattrs(xattrs map[string]XattrValue, from map[string]XattrValue,
+	names []string) map[string]XattrValue {
+	newXattrs := make(map[string]XattrValue, len(xattrs))
+	for name, v := range xattrs {
+		newXattrs[name] = v
+	}
+	for _, name := range names {
+		if v, ok := from[name]; ok {
+			newXattrs[name] = v
+		} else {
+			delete(newXattrs, name)
+		}
+	}
+	if len(newXattrs) == 0 {
+		return nil
+	}
+	return newXattrs
+}
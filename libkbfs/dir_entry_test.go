@@ -7,6 +7,7 @@ package libkbfs
 import (
 	"testing"
 
+	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/go-codec/codec"
 )
 
@@ -24,6 +25,7 @@ func (cof dirEntryFuture) toCurrentStruct() currentStruct {
 }
 
 func makeFakeDirEntryFuture(t *testing.T) dirEntryFuture {
+	mode, uid, gid := uint32(0750), uint32(1000), uint32(1001)
 	cof := dirEntryFuture{
 		DirEntry{
 			makeFakeBlockInfo(t),
@@ -33,6 +35,14 @@ func makeFakeDirEntryFuture(t *testing.T) dirEntryFuture {
 				"fake sym path",
 				101,
 				102,
+				&mode,
+				&uid,
+				&gid,
+				keybase1.MakeTestUID(1),
+				2,
+			},
+			map[string]XattrValue{
+				"user.fake": {Inline: []byte{1, 2, 3}},
 			},
 			codec.UnknownFieldSetHandler{},
 		},
@@ -0,0 +1,259 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/hex"
+	"reflect"
+	"sort"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"golang.org/x/net/context"
+)
+
+// A directory with more entries than the BlockSplitter allows in one
+// block is sharded: its top block is indirect, with an IndirectDirPtr
+// for each shard, and each shard is a direct DirBlock holding the
+// entries whose names hash into its range.  The Off of each
+// IndirectDirPtr is the first shard key in the range of that shard,
+// and the first one is always the empty string.
+//
+// Shards are only ever split, when they get too big, so an entry
+// stays in the same shard until then, and changing it only rewrites
+// that shard and the top block.  Once the directory shrinks to half
+// the limit, it goes back to being a single block.
+//
+// Everything above folderBlockOps sees a sharded directory as a
+// single DirBlock, with all of its entries in Children, and with
+// IsInd and IPtrs describing the shards it was read from.
+
+// dirShardKeyLen is the number of bytes of the name hash that make up
+// a shard key.
+const dirShardKeyLen = 8
+
+// dirShardKey returns the key that decides which shard of a sharded
+// directory the entry with the given name belongs in.
+func dirShardKey(name string) string {
+	_, h := DoRawDefaultHash([]byte(name))
+	return hex.EncodeToString(h[:dirShardKeyLen])
+}
+
+// findDirShard returns the index of the shard, among the given
+// sorted IndirectDirPtrs, whose range holds key.
+func findDirShard(iptrs []IndirectDirPtr, key string) int {
+	return sort.Search(len(iptrs), func(i int) bool {
+		return iptrs[i].Off > key
+	}) - 1
+}
+
+// dirShard is one shard of the new layout of a sharded directory.
+type dirShard struct {
+	off      string
+	children map[string]DirEntry
+	// old is the existing shard with the same range, if any.
+	old *IndirectDirPtr
+}
+
+// layoutDirShards divides the entries of dblock into shards of at
+// most maxEntries entries each, starting from the shards dblock
+// already has, if any, and splitting those that are too big.
+func layoutDirShards(dblock *DirBlock, maxEntries int) []dirShard {
+	var shards []dirShard
+	if dblock.IsInd {
+		for i := range dblock.IPtrs {
+			shards = append(shards, dirShard{
+				off:      dblock.IPtrs[i].Off,
+				children: make(map[string]DirEntry),
+				old:      &dblock.IPtrs[i],
+			})
+		}
+	} else {
+		shards = []dirShard{{children: make(map[string]DirEntry)}}
+	}
+	bounds := make([]IndirectDirPtr, len(shards))
+	for i, s := range shards {
+		bounds[i].Off = s.off
+	}
+	for name, de := range dblock.Children {
+		shards[findDirShard(bounds, dirShardKey(name))].children[name] = de
+	}
+
+	for i := 0; i < len(shards); i++ {
+		s := shards[i]
+		if len(s.children) <= maxEntries {
+			continue
+		}
+		// Split at the median key.  The new shard is re-checked on
+		// the next iteration.
+		keys := make(map[string]string, len(s.children))
+		sorted := make([]string, 0, len(s.children))
+		for name := range s.children {
+			key := dirShardKey(name)
+			keys[name] = key
+			sorted = append(sorted, key)
+		}
+		sort.Strings(sorted)
+		mid := sorted[len(sorted)/2]
+		if mid == s.off {
+			// All these names hash to the start of the range, and
+			// can't be split any further.
+			continue
+		}
+		right := dirShard{off: mid, children: make(map[string]DirEntry)}
+		for name, de := range s.children {
+			if keys[name] >= mid {
+				right.children[name] = de
+				delete(s.children, name)
+			}
+		}
+		s.old = nil
+		shards[i] = s
+		shards = append(shards, dirShard{})
+		copy(shards[i+2:], shards[i+1:])
+		shards[i+1] = right
+		// Check this shard again, in case it's still too big.
+		i--
+	}
+	return shards
+}
+
+func dirEntriesEqual(a, b map[string]DirEntry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, de := range a {
+		other, ok := b[name]
+		if !ok || !reflect.DeepEqual(de, other) {
+			return false
+		}
+	}
+	return true
+}
+
+// getDirShardsLocked fetches the shards of the sharded directory
+// whose top block is dblock, and returns a copy of dblock with all of
+// their entries.
+func (fbo *folderBlockOps) getDirShardsLocked(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, dblock *DirBlock,
+	branch BranchName, p path) (*DirBlock, error) {
+	fbo.blockLock.AssertAnyLocked(lState)
+
+	merged := &DirBlock{
+		CommonBlock: dblock.CommonBlock,
+		Children:    make(map[string]DirEntry),
+		IPtrs:       dblock.IPtrs,
+	}
+	ptrs := make([]BlockPointer, len(dblock.IPtrs))
+	for i, iptr := range dblock.IPtrs {
+		ptrs[i] = iptr.BlockPointer
+	}
+	// The shards get cached too, so that unchanged ones can be
+	// recognized, and kept, when the directory is next written.
+	blocks, err := fbo.getBlocksHelperLocked(
+		ctx, lState, kmd, ptrs, branch, NewDirBlock)
+	if err != nil {
+		return nil, err
+	}
+	for i, block := range blocks {
+		shard, ok := block.(*DirBlock)
+		if !ok || shard.IsInd {
+			return nil, NotDirBlockError{ptrs[i], branch, p}
+		}
+		for name, de := range shard.Children {
+			merged.Children[name] = de
+		}
+	}
+	return merged, nil
+}
+
+// readyDirBlockMultiple readies dblock, to be put along with the
+// other blocks in bps.  If dblock has too many entries for a single
+// block, it's sharded (or re-sharded), and only the shards whose
+// entries changed, or that are on an older key generation, are
+// readied; the others are kept as they are.
+// dblock's IsInd and IPtrs are updated to match.  With reuseShards
+// false, every shard is rewritten.
+//
+// The returned plain size, used as the size of the directory, is
+// that of the top block plus the encoded sizes of any shards.
+func (fbo *folderBranchOps) readyDirBlockMultiple(ctx context.Context,
+	md *RootMetadata, dblock *DirBlock, uid keybase1.UID,
+	bps *blockPutState, reuseShards bool) (
+	info BlockInfo, plainSize int, err error) {
+	if !dblock.IsInd && len(dblock.Children) <= minDirEntriesPerBlock {
+		return fbo.readyBlockMultiple(ctx, md.ReadOnly(), dblock, uid, bps)
+	}
+
+	maxEntries := fbo.config.BlockSplitter().MaxDirEntriesPerBlock()
+	if !dblock.IsInd && len(dblock.Children) <= maxEntries {
+		return fbo.readyBlockMultiple(ctx, md.ReadOnly(), dblock, uid, bps)
+	}
+	if dblock.IsInd && len(dblock.Children) <= maxEntries/2 {
+		fbo.log.CDebugf(ctx, "Unsharding directory with %d entries",
+			len(dblock.Children))
+		for _, iptr := range dblock.IPtrs {
+			md.AddUnrefBlock(iptr.BlockInfo)
+		}
+		dblock.IsInd = false
+		dblock.IPtrs = nil
+		return fbo.readyBlockMultiple(ctx, md.ReadOnly(), dblock, uid, bps)
+	}
+
+	shards := layoutDirShards(dblock, maxEntries)
+	bcache := fbo.config.BlockCache()
+	kept := make(map[BlockPointer]bool)
+	iptrs := make([]IndirectDirPtr, 0, len(shards))
+	shardsSize := 0
+	for _, s := range shards {
+		if reuseShards && s.old != nil &&
+			s.old.KeyGen == md.LatestKeyGeneration() {
+			if block, err := bcache.Get(s.old.BlockPointer); err == nil {
+				if old, ok := block.(*DirBlock); ok &&
+					dirEntriesEqual(old.Children, s.children) {
+					kept[s.old.BlockPointer] = true
+					iptrs = append(iptrs, *s.old)
+					shardsSize += int(s.old.EncodedSize)
+					continue
+				}
+			}
+		}
+
+		shard := &DirBlock{Children: s.children}
+		shardInfo, _, err := fbo.readyBlockMultiple(
+			ctx, md.ReadOnly(), shard, uid, bps)
+		if err != nil {
+			return BlockInfo{}, 0, err
+		}
+		md.AddRefBlock(shardInfo)
+		iptrs = append(iptrs, IndirectDirPtr{BlockInfo: shardInfo, Off: s.off})
+		shardsSize += int(shardInfo.EncodedSize)
+	}
+	if dblock.IsInd {
+		for _, iptr := range dblock.IPtrs {
+			if !kept[iptr.BlockPointer] {
+				md.AddUnrefBlock(iptr.BlockInfo)
+			}
+		}
+	}
+	fbo.log.CDebugf(ctx, "Directory with %d entries has %d shards, "+
+		"%d of them unchanged", len(dblock.Children), len(iptrs), len(kept))
+
+	// Only the top block is put as such, but the block cached for it
+	// is the whole directory.
+	top := &DirBlock{
+		CommonBlock: CommonBlock{IsInd: true},
+		IPtrs:       iptrs,
+	}
+	info, plainSize, readyBlockData, err :=
+		fbo.blocks.ReadyBlock(ctx, md.ReadOnly(), top, uid)
+	if err != nil {
+		return BlockInfo{}, 0, err
+	}
+	dblock.IsInd = true
+	dblock.IPtrs = iptrs
+	dblock.SetEncodedSize(info.EncodedSize)
+	bps.addNewBlock(info.BlockPointer, dblock, readyBlockData, nil)
+	return info, plainSize + shardsSize, nil
+}
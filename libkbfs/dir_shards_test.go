@@ -0,0 +1,182 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func makeDirBlockWithEntries(n int) *DirBlock {
+	dblock := NewDirBlock().(*DirBlock)
+	for i := 0; i < n; i++ {
+		dblock.Children[fmt.Sprintf("file%d", i)] = DirEntry{
+			BlockInfo: BlockInfo{BlockPointer: BlockPointer{
+				ID: fakeBlockID(fakeBlockIDByte(i))}},
+			EntryInfo: EntryInfo{Type: File},
+		}
+	}
+	return dblock
+}
+
+func fakeBlockIDByte(i int) byte {
+	return byte(i%250 + 1)
+}
+
+func checkDirShardLayout(t *testing.T, shards []dirShard, maxEntries,
+	numEntries int) {
+	require.NotEmpty(t, shards)
+	require.Equal(t, "", shards[0].off)
+	bounds := make([]IndirectDirPtr, len(shards))
+	total := 0
+	for i, s := range shards {
+		if i > 0 {
+			require.True(t, s.off > shards[i-1].off)
+		}
+		bounds[i].Off = s.off
+		require.True(t, len(s.children) <= maxEntries,
+			"Shard %d has %d entries", i, len(s.children))
+		total += len(s.children)
+	}
+	require.Equal(t, numEntries, total)
+	for i, s := range shards {
+		for name := range s.children {
+			require.Equal(t, i, findDirShard(bounds, dirShardKey(name)))
+		}
+	}
+}
+
+func TestLayoutDirShards(t *testing.T) {
+	dblock := makeDirBlockWithEntries(100)
+	shards := layoutDirShards(dblock, 8)
+	checkDirShardLayout(t, shards, 8, 100)
+	for _, s := range shards {
+		require.Nil(t, s.old)
+	}
+
+	// Lay out the same entries again on top of those shards, plus one
+	// new one; only the shard it lands in may change.
+	dblock.IsInd = true
+	for i, s := range shards {
+		dblock.IPtrs = append(dblock.IPtrs, IndirectDirPtr{
+			BlockInfo: BlockInfo{BlockPointer: BlockPointer{
+				ID: fakeBlockID(fakeBlockIDByte(i))}},
+			Off: s.off,
+		})
+	}
+	dblock.Children["new"] = DirEntry{EntryInfo: EntryInfo{Type: File}}
+	newShards := layoutDirShards(dblock, 8)
+	checkDirShardLayout(t, newShards, 8, 101)
+	changed := 0
+	for _, s := range newShards {
+		if s.old == nil {
+			changed++
+			continue
+		}
+		old := shards[findDirShard(dblock.IPtrs, s.off)]
+		if !dirEntriesEqual(old.children, s.children) {
+			changed++
+		}
+	}
+	// Either the one shard got the entry, or it was split in two.
+	require.True(t, changed == 1 || changed == 2, "%d shards changed",
+		changed)
+}
+
+func getRawDirBlockOrBust(ctx context.Context, t *testing.T, config Config,
+	ops *folderBranchOps, ptr BlockPointer) *DirBlock {
+	dblock := NewDirBlock().(*DirBlock)
+	err := config.BlockOps().Get(
+		ctx, ops.getHead(makeFBOLockState()), ptr, dblock)
+	require.NoError(t, err)
+	return dblock
+}
+
+func TestKBFSOpsShardedDir(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	// Use the smallest possible block size, so that directories
+	// shard after minDirEntriesPerBlock entries.
+	bsplitter, err := NewBlockSplitterSimple(20, 8*1024, config.Codec())
+	require.NoError(t, err)
+	config.SetBlockSplitter(bsplitter)
+	require.Equal(t, minDirEntriesPerBlock, bsplitter.MaxDirEntriesPerBlock())
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	const numEntries = 50
+	for i := 0; i < numEntries; i++ {
+		_, _, err := kbfsOps.CreateFile(
+			ctx, dirNode, fmt.Sprintf("file%d", i), false, NoExcl)
+		require.NoError(t, err)
+	}
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	dirPtr := func() BlockPointer {
+		return ops.nodeCache.PathFromNode(dirNode).tailPointer()
+	}
+	// Older clients can't read sharded directories, so their
+	// pointers must say so.
+	require.Equal(t, DataVer(IndirectDirsDataVer), dirPtr().DataVer)
+	top := getRawDirBlockOrBust(ctx, t, config, ops, dirPtr())
+	require.True(t, top.IsInd)
+	require.Empty(t, top.Children)
+	require.True(t, len(top.IPtrs) > 1)
+	total := 0
+	for _, iptr := range top.IPtrs {
+		shard := getRawDirBlockOrBust(ctx, t, config, ops, iptr.BlockPointer)
+		require.False(t, shard.IsInd)
+		require.True(t, len(shard.Children) <= minDirEntriesPerBlock)
+		total += len(shard.Children)
+	}
+	require.Equal(t, numEntries, total)
+
+	children, err := kbfsOps.GetDirChildren(ctx, dirNode)
+	require.NoError(t, err)
+	require.Len(t, children, numEntries)
+
+	// Removing one entry only rewrites its shard.
+	err = kbfsOps.RemoveEntry(ctx, dirNode, "file0")
+	require.NoError(t, err)
+	newTop := getRawDirBlockOrBust(ctx, t, config, ops, dirPtr())
+	require.Len(t, newTop.IPtrs, len(top.IPtrs))
+	changed := 0
+	for i := range top.IPtrs {
+		if top.IPtrs[i].BlockPointer != newTop.IPtrs[i].BlockPointer {
+			changed++
+		}
+	}
+	require.Equal(t, 1, changed)
+
+	// Another user, with nothing cached, sees all the entries.
+	config2 := ConfigAsUser(config, "test_user")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(t, config2, "test_user", false)
+	dirNode2, _, err := config2.KBFSOps().Lookup(ctx, rootNode2, "d")
+	require.NoError(t, err)
+	children, err = config2.KBFSOps().GetDirChildren(ctx, dirNode2)
+	require.NoError(t, err)
+	require.Len(t, children, numEntries-1)
+	_, ok := children["file0"]
+	require.False(t, ok)
+
+	// Shrinking the directory enough puts it back in one block.
+	for i := 1; i < numEntries-minDirEntriesPerBlock/2; i++ {
+		err := kbfsOps.RemoveEntry(ctx, dirNode, fmt.Sprintf("file%d", i))
+		require.NoError(t, err)
+	}
+	require.Equal(t, DataVer(FirstValidDataVer), dirPtr().DataVer)
+	top = getRawDirBlockOrBust(ctx, t, config, ops, dirPtr())
+	require.False(t, top.IsInd)
+	require.Empty(t, top.IPtrs)
+	require.Len(t, top.Children, minDirEntriesPerBlock/2)
+}
@@ -0,0 +1,238 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// diskBlockCache stores encrypted blocks on local disk, along with
+// their server key halves, so that they can be read without the
+// block server.  Blocks are kept per TLF, laid out like the blocks of
+// a block journal:
+//
+//	dir/<tlfID>/blocks/0100/0...01/data
+//	dir/<tlfID>/blocks/0100/0...01/key_server_half
+//	...
+//
+// Since a block's data can be checked against its ID, but its key
+// server half can't, blocks are only ever put into the cache after
+// having been fetched from, or put to, the block server.
+type diskBlockCache struct {
+	dir     string
+	limiter *diskLimiter
+
+	// lock protects the files under dir against a prune removing
+	// a block that's being put.
+	lock sync.RWMutex
+}
+
+// makeDiskBlockCache makes a cache in the given directory, counting
+// the block data already there, and all that's put later, against
+// limiter.  limiter may be nil.
+func makeDiskBlockCache(dir string, limiter *diskLimiter) *diskBlockCache {
+	limiter.addCacheBytes(blockDataBytes(dir))
+	return &diskBlockCache{dir: dir, limiter: limiter}
+}
+
+// blockDataBytes returns the size of all the block data under dir,
+// skipping anything it can't read.
+func blockDataBytes(dir string) int64 {
+	var total int64
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() && fi.Name() == "data" {
+			total += fi.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+// The functions below are for building various paths.
+
+func (c *diskBlockCache) tlfPath(tlfID TlfID) string {
+	return filepath.Join(c.dir, tlfID.String())
+}
+
+func (c *diskBlockCache) blocksPath(tlfID TlfID) string {
+	return filepath.Join(c.tlfPath(tlfID), "blocks")
+}
+
+func (c *diskBlockCache) blockPath(tlfID TlfID, id BlockID) string {
+	idStr := id.String()
+	return filepath.Join(c.blocksPath(tlfID), idStr[:4], idStr[4:])
+}
+
+func (c *diskBlockCache) blockDataPath(tlfID TlfID, id BlockID) string {
+	return filepath.Join(c.blockPath(tlfID, id), "data")
+}
+
+func (c *diskBlockCache) keyServerHalfPath(tlfID TlfID, id BlockID) string {
+	return filepath.Join(c.blockPath(tlfID, id), "key_server_half")
+}
+
+// get returns the data and server key half of the given block, or
+// blockNonExistentError if it isn't in the cache.
+func (c *diskBlockCache) get(tlfID TlfID, id BlockID) (
+	[]byte, BlockCryptKeyServerHalf, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	data, err := readVerifiedBlockData(c.blockDataPath(tlfID, id), id)
+	if os.IsNotExist(err) {
+		return nil, BlockCryptKeyServerHalf{}, blockNonExistentError{id}
+	} else if err != nil {
+		return nil, BlockCryptKeyServerHalf{}, err
+	}
+
+	buf, err := ioutil.ReadFile(c.keyServerHalfPath(tlfID, id))
+	if os.IsNotExist(err) {
+		return nil, BlockCryptKeyServerHalf{}, blockNonExistentError{id}
+	} else if err != nil {
+		return nil, BlockCryptKeyServerHalf{}, err
+	}
+
+	var serverHalf BlockCryptKeyServerHalf
+	err = serverHalf.UnmarshalBinary(buf)
+	if err != nil {
+		return nil, BlockCryptKeyServerHalf{}, err
+	}
+	return data, serverHalf, nil
+}
+
+// has returns whether the given block is in the cache, and its size
+// on disk if so.
+func (c *diskBlockCache) has(tlfID TlfID, id BlockID) (bool, int64, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	// The key server half is written last, so a block is only
+	// complete once it exists.
+	_, err := os.Stat(c.keyServerHalfPath(tlfID, id))
+	if os.IsNotExist(err) {
+		return false, 0, nil
+	} else if err != nil {
+		return false, 0, err
+	}
+	fi, err := os.Stat(c.blockDataPath(tlfID, id))
+	if err != nil {
+		return false, 0, err
+	}
+	return true, fi.Size(), nil
+}
+
+// writeFileAtomic writes buf to a temp file first, so a crash never
+// leaves a truncated file behind.
+func writeFileAtomic(path string, buf []byte) error {
+	tmpPath := path + ".tmp"
+	err := ioutil.WriteFile(tmpPath, buf, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// put stores the given block, unless it's already in the cache.
+func (c *diskBlockCache) put(tlfID TlfID, id BlockID, buf []byte,
+	serverHalf BlockCryptKeyServerHalf) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, err := os.Stat(c.keyServerHalfPath(tlfID, id)); err == nil {
+		return nil
+	}
+	// Don't spend disk space, or the limiter's bytes, on data that
+	// get would only reject.
+	if err := id.h.Verify(buf); err != nil {
+		return err
+	}
+
+	// A half-written block left over from before is overwritten,
+	// and was never counted.
+	err := c.limiter.reserveCacheBytes(int64(len(buf)))
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(c.blockPath(tlfID, id), 0700)
+	if err == nil {
+		err = writeFileAtomic(c.blockDataPath(tlfID, id), buf)
+	}
+	if err == nil {
+		err = writeFileAtomic(
+			c.keyServerHalfPath(tlfID, id), serverHalf.data[:])
+	}
+	if err != nil {
+		c.limiter.releaseCacheBytes(int64(len(buf)))
+		return err
+	}
+	return nil
+}
+
+// prune removes every block of the given TLF not in keep, and
+// returns how many bytes of block data were removed.
+func (c *diskBlockCache) prune(tlfID TlfID, keep map[BlockID]bool) (
+	int64, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	blocksPath := c.blocksPath(tlfID)
+	prefixes, err := ioutil.ReadDir(blocksPath)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	var removed int64
+	defer func() { c.limiter.releaseCacheBytes(removed) }()
+	for _, prefix := range prefixes {
+		prefixPath := filepath.Join(blocksPath, prefix.Name())
+		rests, err := ioutil.ReadDir(prefixPath)
+		if err != nil {
+			return removed, err
+		}
+		left := len(rests)
+		for _, rest := range rests {
+			id, err := BlockIDFromString(prefix.Name() + rest.Name())
+			if err == nil && keep[id] {
+				continue
+			}
+			// Anything that isn't a block shouldn't be here
+			// either.
+			blockPath := filepath.Join(prefixPath, rest.Name())
+			if fi, err := os.Stat(
+				filepath.Join(blockPath, "data")); err == nil {
+				removed += fi.Size()
+			}
+			err = os.RemoveAll(blockPath)
+			if err != nil {
+				return removed, err
+			}
+			left--
+		}
+		if left == 0 {
+			err := os.Remove(prefixPath)
+			if err != nil {
+				return removed, err
+			}
+		}
+	}
+	return removed, nil
+}
+
+// removeTLF removes every block of the given TLF, and anything else
+// stored for it under the cache directory.
+func (c *diskBlockCache) removeTLF(tlfID TlfID) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	removed := blockDataBytes(c.tlfPath(tlfID))
+	err := os.RemoveAll(c.tlfPath(tlfID))
+	if err != nil {
+		// Some of it may be gone; count it again the next time
+		// the cache is made.
+		return err
+	}
+	c.limiter.releaseCacheBytes(removed)
+	return nil
+}
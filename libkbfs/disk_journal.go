@@ -191,10 +191,17 @@ func (j diskJournal) readJournalEntry(o journalOrdinal) (interface{}, error) {
 		return nil, err
 	}
 
+	return j.decodeJournalEntry(p, buf)
+}
+
+// decodeJournalEntry decodes buf, read from the given path, as an
+// entry of this journal's type.
+func (j diskJournal) decodeJournalEntry(p string, buf []byte) (
+	interface{}, error) {
 	entry := reflect.New(j.entryType)
-	err = j.codec.Decode(buf, entry)
+	err := j.codec.Decode(buf, entry)
 	if err != nil {
-		return nil, err
+		return nil, JournalEntryDecodeError{p, err}
 	}
 
 	return entry.Elem().Interface(), nil
@@ -220,7 +227,10 @@ func (j diskJournal) writeJournalEntry(
 		return err
 	}
 
-	return ioutil.WriteFile(p, buf, 0600)
+	// Entries may be overwritten in place (e.g., by
+	// mdIDJournal.replaceHead), so never leave a partial one
+	// behind.
+	return writeFileAtomic(p, buf)
 }
 
 // appendJournalEntry appends the given entry to the journal. If o is
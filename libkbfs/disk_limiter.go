@@ -0,0 +1,321 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// diskLimitFractionDefault is the default fraction of the disk
+	// space available to KBFS that its journals and caches may
+	// take up.
+	diskLimitFractionDefault = 0.15
+	// diskBackpressureStart is the fraction of the disk limit the
+	// journals can fill before writes to journaled TLFs start
+	// being slowed down.
+	diskBackpressureStart = 0.5
+	// diskBackpressureMaxDelay is how long each write to a
+	// journaled TLF is held up once the journals fill the limit.
+	diskBackpressureMaxDelay = 1 * time.Second
+	// diskFreeBytesRefresh is how often the free space of the disk
+	// is looked up again.
+	diskFreeBytesRefresh = 10 * time.Second
+)
+
+// DiskLimiterStatus describes how much local disk space KBFS takes
+// up, for display in diagnostics.  It is suitable for encoding
+// directly as JSON.
+type DiskLimiterStatus struct {
+	Dir           string
+	LimitFraction float64
+	// AvailableBytes is the free space of the disk Dir is on, plus
+	// what KBFS already takes up on it.
+	AvailableBytes int64
+	// LimitBytes is LimitFraction of AvailableBytes, or zero if
+	// there's no limit.
+	LimitBytes   int64
+	JournalBytes int64
+	CacheBytes   int64
+	// WriteDelay is how long each write to a journaled TLF is
+	// currently held up, to let the journals flush.
+	WriteDelay time.Duration
+}
+
+// diskLimiterConfig is the subset of Config a diskLimiter needs.
+type diskLimiterConfig interface {
+	DiskLimitFraction() float64
+	Clock() Clock
+}
+
+// diskLimiter keeps the bytes KBFS stores on local disk, in the
+// block journals and the sync cache, under a configurable fraction of
+// the space available on that disk.
+//
+// Journal puts wait for the journals to flush once the journals alone
+// fill the limit, and writes to journaled TLFs are slowed down as they
+// get close to it, so that they don't get far ahead of the flushes.
+// The sync cache, whose blocks can always be fetched again, stops
+// taking new blocks once the journals and the cache together fill the
+// limit.  Journals don't make the cache give space back, so together
+// they can take up to twice the limit.
+//
+// A nil *diskLimiter limits nothing, so callers don't have to check
+// whether one is set up.
+type diskLimiter struct {
+	config    diskLimiterConfig
+	dir       string
+	freeBytes func(dir string) (int64, error)
+
+	lock         sync.Mutex
+	journalBytes int64
+	cacheBytes   int64
+	// availableBytes is the free space of dir, plus the bytes
+	// counted here, as of sampledAt.
+	availableBytes int64
+	sampledAt      time.Time
+	// freedCh is closed, and replaced, whenever bytes are released.
+	freedCh chan struct{}
+}
+
+func newDiskLimiter(config diskLimiterConfig, dir string) *diskLimiter {
+	return &diskLimiter{
+		config:    config,
+		dir:       dir,
+		freeBytes: freeDiskBytes,
+		freedCh:   make(chan struct{}),
+	}
+}
+
+type diskLimiterGetter interface {
+	getDiskLimiter() *diskLimiter
+}
+
+// getDiskLimiter returns the disk limiter of the given config, or nil
+// if there isn't one.
+func getDiskLimiter(config Config) *diskLimiter {
+	if getter, ok := config.(diskLimiterGetter); ok {
+		return getter.getDiskLimiter()
+	}
+	return nil
+}
+
+// existingDir returns dir, or its nearest ancestor that exists, so
+// that the free space of a journal or cache directory can be looked
+// up before it's first created.
+func existingDir(dir string) string {
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// limitLocked returns the current limit in bytes, or zero if there
+// isn't one.
+func (l *diskLimiter) limitLocked() int64 {
+	fraction := l.config.DiskLimitFraction()
+	if fraction <= 0 {
+		return 0
+	}
+	now := l.config.Clock().Now()
+	if l.sampledAt.IsZero() || now.Before(l.sampledAt) ||
+		now.Sub(l.sampledAt) >= diskFreeBytesRefresh {
+		// Keep the last sample if the disk can't be looked at
+		// right now.
+		if free, err := l.freeBytes(existingDir(l.dir)); err == nil {
+			l.availableBytes = free + l.journalBytes + l.cacheBytes
+			l.sampledAt = now
+		}
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+	return int64(fraction * float64(l.availableBytes))
+}
+
+func (l *diskLimiter) signalFreedLocked() {
+	close(l.freedCh)
+	l.freedCh = make(chan struct{})
+}
+
+// beforeBlockPut counts n more bytes against the journals, first
+// waiting for the journals to flush enough to fit them under the
+// limit, if needed.  A put is never held up while the journals are
+// empty, however big it is.  Bytes the put doesn't end up storing
+// must be given back with releaseJournalBytes.
+func (l *diskLimiter) beforeBlockPut(ctx context.Context, n int64) error {
+	if l == nil {
+		return nil
+	}
+	for {
+		l.lock.Lock()
+		limit := l.limitLocked()
+		if limit == 0 || l.journalBytes == 0 ||
+			l.journalBytes+n <= limit {
+			l.journalBytes += n
+			l.lock.Unlock()
+			return nil
+		}
+		freedCh := l.freedCh
+		l.lock.Unlock()
+
+		// Free space made elsewhere on the disk counts too, so
+		// look again every so often.
+		select {
+		case <-freedCh:
+		case <-time.After(diskFreeBytesRefresh):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// reserveJournalBytes counts n more bytes against the journals, or
+// returns DiskLimitReachedError if that would take them over the
+// limit.  Unlike beforeBlockPut, it never waits for the journals to
+// flush.  The bytes must be given back with releaseJournalBytes.
+func (l *diskLimiter) reserveJournalBytes(n int64) error {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	limit := l.limitLocked()
+	if limit != 0 && l.journalBytes+n > limit {
+		return DiskLimitReachedError{l.journalBytes, limit}
+	}
+	l.journalBytes += n
+	return nil
+}
+
+// addJournalBytes counts n more bytes against the journals, without
+// waiting, for journal data that's already on disk.
+func (l *diskLimiter) addJournalBytes(n int64) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.journalBytes += n
+}
+
+// releaseJournalBytes stops counting n bytes against the journals,
+// e.g. once they've been flushed.
+func (l *diskLimiter) releaseJournalBytes(n int64) {
+	if l == nil || n == 0 {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.journalBytes -= n
+	l.signalFreedLocked()
+}
+
+// reserveCacheBytes counts n more bytes against the cache, or
+// returns DiskLimitReachedError if that would take the journals and
+// the cache over the limit.
+func (l *diskLimiter) reserveCacheBytes(n int64) error {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	limit := l.limitLocked()
+	used := l.journalBytes + l.cacheBytes
+	if limit != 0 && used+n > limit {
+		return DiskLimitReachedError{used, limit}
+	}
+	l.cacheBytes += n
+	return nil
+}
+
+// addCacheBytes counts n more bytes against the cache, without
+// checking the limit, for cache data that's already on disk.
+func (l *diskLimiter) addCacheBytes(n int64) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.cacheBytes += n
+}
+
+// releaseCacheBytes stops counting n bytes against the cache.
+func (l *diskLimiter) releaseCacheBytes(n int64) {
+	if l == nil || n == 0 {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.cacheBytes -= n
+	l.signalFreedLocked()
+}
+
+// writeDelayLocked returns how long each write to a journaled TLF
+// should be held up: nothing until the journals fill
+// diskBackpressureStart of the limit, and then more the closer they
+// get to it, up to diskBackpressureMaxDelay.
+func (l *diskLimiter) writeDelayLocked() time.Duration {
+	limit := l.limitLocked()
+	if limit == 0 {
+		return 0
+	}
+	fill := float64(l.journalBytes) / float64(limit)
+	if fill <= diskBackpressureStart {
+		return 0
+	}
+	if fill >= 1 {
+		return diskBackpressureMaxDelay
+	}
+	return time.Duration(float64(diskBackpressureMaxDelay) *
+		(fill - diskBackpressureStart) / (1 - diskBackpressureStart))
+}
+
+// delayWrite holds up a write to a journaled TLF for as long as the
+// journals' use of the disk calls for.
+func (l *diskLimiter) delayWrite(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	delay := l.writeDelayLocked()
+	l.lock.Unlock()
+	if delay == 0 {
+		return nil
+	}
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// status returns the current usage and limit.
+func (l *diskLimiter) status() DiskLimiterStatus {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	limit := l.limitLocked()
+	return DiskLimiterStatus{
+		Dir:            l.dir,
+		LimitFraction:  l.config.DiskLimitFraction(),
+		AvailableBytes: l.availableBytes,
+		LimitBytes:     limit,
+		JournalBytes:   l.journalBytes,
+		CacheBytes:     l.cacheBytes,
+		WriteDelay:     l.writeDelayLocked(),
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type testDiskLimiterConfig struct {
+	fraction float64
+	clock    *TestClock
+}
+
+func (c testDiskLimiterConfig) DiskLimitFraction() float64 {
+	return c.fraction
+}
+
+func (c testDiskLimiterConfig) Clock() Clock {
+	return c.clock
+}
+
+// makeTestDiskLimiter returns a limiter on a disk with the given
+// free space, which doesn't change as bytes are counted.
+func makeTestDiskLimiter(fraction float64, free int64) (
+	*diskLimiter, *TestClock) {
+	clock := &TestClock{}
+	clock.Set(time.Now())
+	l := newDiskLimiter(testDiskLimiterConfig{fraction, clock}, "dir")
+	l.freeBytes = func(string) (int64, error) {
+		return free, nil
+	}
+	return l, clock
+}
+
+func TestDiskLimiterLimit(t *testing.T) {
+	l, clock := makeTestDiskLimiter(0.1, 1000)
+	l.addJournalBytes(100)
+	l.addCacheBytes(100)
+	status := l.status()
+	require.Equal(t, int64(1200), status.AvailableBytes)
+	require.Equal(t, int64(120), status.LimitBytes)
+
+	// The free space is only looked at again once it's stale.
+	l.freeBytes = func(string) (int64, error) {
+		return 2000, nil
+	}
+	require.Equal(t, int64(120), l.status().LimitBytes)
+	clock.Add(diskFreeBytesRefresh)
+	require.Equal(t, int64(220), l.status().LimitBytes)
+
+	// No limit at all.
+	l.config = testDiskLimiterConfig{0, clock}
+	require.Equal(t, int64(0), l.status().LimitBytes)
+	require.NoError(t, l.reserveCacheBytes(1<<40))
+
+	// A nil limiter allows everything.
+	var nilLimiter *diskLimiter
+	require.NoError(t, nilLimiter.reserveCacheBytes(1<<40))
+	require.NoError(t, nilLimiter.beforeBlockPut(context.Background(), 1))
+	nilLimiter.releaseJournalBytes(1)
+}
+
+func TestDiskLimiterBlockPut(t *testing.T) {
+	l, _ := makeTestDiskLimiter(0.5, 100)
+	ctx := context.Background()
+
+	// The first put always goes through.
+	require.NoError(t, l.beforeBlockPut(ctx, 80))
+
+	putDone := make(chan error, 1)
+	go func() {
+		putDone <- l.beforeBlockPut(ctx, 20)
+	}()
+	select {
+	case err := <-putDone:
+		t.Fatalf("Put went through over the limit: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// Flushing the first block makes room.
+	l.releaseJournalBytes(80)
+	select {
+	case err := <-putDone:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Put didn't go through after the journal flushed")
+	}
+	require.Equal(t, int64(20), l.status().JournalBytes)
+
+	// A waiting put can be canceled.
+	l.addJournalBytes(30)
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	require.Equal(t, context.Canceled, l.beforeBlockPut(ctx, 10))
+	require.Equal(t, int64(50), l.status().JournalBytes)
+}
+
+func TestDiskLimiterCache(t *testing.T) {
+	l, _ := makeTestDiskLimiter(0.5, 100)
+	l.addJournalBytes(30)
+	// The journal's bytes count towards the available space.
+	require.NoError(t, l.reserveCacheBytes(35))
+	require.Equal(t, DiskLimitReachedError{65, 65}, l.reserveCacheBytes(1))
+
+	l.releaseJournalBytes(10)
+	require.NoError(t, l.reserveCacheBytes(10))
+	status := l.status()
+	require.Equal(t, int64(20), status.JournalBytes)
+	require.Equal(t, int64(45), status.CacheBytes)
+}
+
+func TestDiskLimiterWriteDelay(t *testing.T) {
+	l, _ := makeTestDiskLimiter(0.5, 200)
+	require.Equal(t, time.Duration(0), l.status().WriteDelay)
+	l.addJournalBytes(50)
+	require.Equal(t, time.Duration(0), l.status().WriteDelay)
+
+	// Halfway from the start of the backpressure to the limit.
+	l.addJournalBytes(25)
+	require.Equal(t, diskBackpressureMaxDelay/2, l.status().WriteDelay)
+
+	l.addJournalBytes(100)
+	require.Equal(t, diskBackpressureMaxDelay, l.status().WriteDelay)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Equal(t, context.Canceled, l.delayWrite(ctx))
+}
+
+func TestDiskBlockCacheLimit(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "disk_block_cache")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	l, _ := makeTestDiskLimiter(0.5, 100)
+	cache := makeDiskBlockCache(tempdir, l)
+	tlfID := FakeTlfID(1, false)
+	serverHalf := BlockCryptKeyServerHalf{}
+
+	crypto := MakeCryptoCommon(NewCodecMsgpack())
+	data1 := make([]byte, 30)
+	id1, err := crypto.MakePermanentBlockID(data1)
+	require.NoError(t, err)
+	require.NoError(t, cache.put(tlfID, id1, data1, serverHalf))
+	// Putting the same block again doesn't count it twice.
+	require.NoError(t, cache.put(tlfID, id1, data1, serverHalf))
+	require.Equal(t, int64(30), l.status().CacheBytes)
+
+	// Data that doesn't match its ID isn't stored.
+	err = cache.put(tlfID, fakeBlockID(1), data1, serverHalf)
+	require.IsType(t, HashMismatchError{}, err)
+	require.Equal(t, int64(30), l.status().CacheBytes)
+
+	data2 := make([]byte, 30)
+	data2[0] = 1
+	id2, err := crypto.MakePermanentBlockID(data2)
+	require.NoError(t, err)
+	err = cache.put(tlfID, id2, data2, serverHalf)
+	require.IsType(t, DiskLimitReachedError{}, err)
+	ok, _, err := cache.has(tlfID, id2)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	removed, err := cache.prune(tlfID, nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(30), removed)
+	require.Equal(t, int64(0), l.status().CacheBytes)
+
+	require.NoError(t, cache.put(tlfID, id2, data2, serverHalf))
+	require.NoError(t, cache.removeTLF(tlfID))
+	require.Equal(t, int64(0), l.status().CacheBytes)
+}
+
+func TestDiskLimiterReserveJournal(t *testing.T) {
+	l, _ := makeTestDiskLimiter(0.5, 100)
+	require.NoError(t, l.reserveJournalBytes(40))
+	// Unlike a put, a reservation is refused rather than waiting,
+	// even if the journals are empty otherwise.
+	require.Equal(t, DiskLimitReachedError{40, 50}, l.reserveJournalBytes(11))
+	require.NoError(t, l.reserveJournalBytes(10))
+	l.releaseJournalBytes(50)
+	require.Equal(t, int64(0), l.status().JournalBytes)
+
+	var nilLimiter *diskLimiter
+	require.NoError(t, nilLimiter.reserveJournalBytes(1<<40))
+}
@@ -0,0 +1,267 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"os"
+	"strings"
+)
+
+// ErrorCode is a stable, user-facing classification of an error.
+// Unlike the error types themselves, codes are part of KBFS's
+// external interface: they show up in the status files, and scripts
+// and GUIs may match on them, so existing codes must never be
+// renamed or reused for something else.
+type ErrorCode string
+
+const (
+	// ErrorCodeNone is the code of a nil error.
+	ErrorCodeNone ErrorCode = ""
+	// ErrorCodeInternal is for errors KBFS doesn't classify; it
+	// usually means a bug, or a corrupted cache.
+	ErrorCodeInternal ErrorCode = "internal"
+	// ErrorCodeNotFound is for files, folders, users and other
+	// things that don't exist.
+	ErrorCodeNotFound ErrorCode = "not-found"
+	// ErrorCodeAlreadyExists is for creating something whose name
+	// is taken.
+	ErrorCodeAlreadyExists ErrorCode = "already-exists"
+	// ErrorCodeNotEmpty is for removing a non-empty directory.
+	ErrorCodeNotEmpty ErrorCode = "not-empty"
+	// ErrorCodeAccessDenied is for reads and writes the user has no
+	// permission for.
+	ErrorCodeAccessDenied ErrorCode = "access-denied"
+	// ErrorCodeNeedsRekey is for folders this device can't read
+	// until it, or another device, is rekeyed.
+	ErrorCodeNeedsRekey ErrorCode = "needs-rekey"
+	// ErrorCodeNotLoggedIn is for operations that need a logged-in
+	// user.
+	ErrorCodeNotLoggedIn ErrorCode = "not-logged-in"
+	// ErrorCodeOverQuota is for writes refused because the user is
+	// out of storage.
+	ErrorCodeOverQuota ErrorCode = "over-quota"
+	// ErrorCodeTooBig is for files, directories and names that are
+	// over KBFS's size limits.
+	ErrorCodeTooBig ErrorCode = "too-big"
+	// ErrorCodeInvalidArgument is for requests KBFS can't make
+	// sense of.
+	ErrorCodeInvalidArgument ErrorCode = "invalid-argument"
+	// ErrorCodeNotSupported is for operations KBFS doesn't
+	// implement.
+	ErrorCodeNotSupported ErrorCode = "not-supported"
+	// ErrorCodeReadOnly is for writes to something that can't be
+	// written right now, such as a folder with paused writes.
+	ErrorCodeReadOnly ErrorCode = "read-only"
+	// ErrorCodeConflict is for writes that lost a race with another
+	// writer and couldn't be resolved automatically.
+	ErrorCodeConflict ErrorCode = "conflict"
+	// ErrorCodeBusy is for requests refused because a server is
+	// overloaded, or a resource is locked.
+	ErrorCodeBusy ErrorCode = "busy"
+	// ErrorCodeOffline is for data that isn't available without a
+	// network connection.
+	ErrorCodeOffline ErrorCode = "offline"
+	// ErrorCodeTimeout is for operations that took too long.
+	ErrorCodeTimeout ErrorCode = "timeout"
+	// ErrorCodeShuttingDown is for operations cut short because
+	// KBFS is shutting down.
+	ErrorCodeShuttingDown ErrorCode = "shutting-down"
+)
+
+// ClassifyError returns the ErrorCode of err.
+func ClassifyError(err error) ErrorCode {
+	switch e := err.(type) {
+	case nil:
+		return ErrorCodeNone
+	case CRWrapError:
+		return ClassifyError(e.err)
+	case NoSuchNameError, NoSuchUserError, NoSuchFolderListError,
+		NoSuchXattrError, NoArchivedRevisionError, NoSuchTlfHandleError,
+		NoSuchMDError, NoSuchBlockError, BServerErrorBlockNonExistent,
+		BServerErrorBlockDeleted:
+		return ErrorCodeNotFound
+	case NameExistsError:
+		return ErrorCodeAlreadyExists
+	case DirNotEmptyError:
+		return ErrorCodeNotEmpty
+	case ReadAccessError, WriteAccessError, TlfAccessError,
+		RekeyPermissionError, DisallowedPrefixError, ReadOnlyXattrError,
+		BServerErrorUnauthorized, BServerErrorNoPermission,
+		MDServerErrorUnauthorized, MDServerErrorWriteAccess:
+		return ErrorCodeAccessDenied
+	case NeedSelfRekeyError, NeedOtherRekeyError:
+		return ErrorCodeNeedsRekey
+	case NoCurrentSessionError:
+		return ErrorCodeNotLoggedIn
+	case BServerErrorOverQuota, OverQuotaWarning, DiskLimitReachedError:
+		return ErrorCodeOverQuota
+	case FileTooBigError, DirTooBigError, NameTooLongError,
+		XattrTooBigError:
+		return ErrorCodeTooBig
+	case InvalidRangeLockError, InvalidXattrNameError, EmptyNameError,
+		BadTLFNameError, InvalidPathError, InvalidParentPathError:
+		return ErrorCodeInvalidArgument
+	case InvalidAllocateModeError, NoRootXattrsError, CrossDirLinkError,
+		RenameAcrossDirsError, RangeLocksUnsupportedError,
+		KeyBundlesUnsupportedError:
+		return ErrorCodeNotSupported
+	case WritesPausedError:
+		return ErrorCodeReadOnly
+	case MDServerErrorConflictRevision, MDServerErrorConflictPrevRoot,
+		MDServerErrorConflictDiskUsage, MDServerErrorConflictFolderMapping,
+		MDJournalConflictError, UnmergedError, UnmergedSelfConflictError:
+		return ErrorCodeConflict
+	case BServerErrorThrottle, MDServerErrorThrottle, MDServerErrorLocked,
+		RangeLockConflictError:
+		return ErrorCodeBusy
+	case OfflineUnavailableError:
+		return ErrorCodeOffline
+	case TimeoutError:
+		return ErrorCodeTimeout
+	case ShutdownHappenedError:
+		return ErrorCodeShuttingDown
+	default:
+		return ErrorCodeInternal
+	}
+}
+
+// errorText is how one ErrorCode is explained to users in one
+// language.
+type errorText struct {
+	message     string
+	remediation string
+}
+
+// DefaultErrorLocale is the language error descriptions fall back to
+// when there's no translation for the requested one.
+const DefaultErrorLocale = "en"
+
+// errorTexts holds the translations of the error descriptions, by
+// language code.  Every code must be described in
+// DefaultErrorLocale; other languages may leave codes out.
+var errorTexts = map[string]map[ErrorCode]errorText{
+	DefaultErrorLocale: {
+		ErrorCodeInternal: {
+			"Something went wrong inside KBFS.",
+			"Try again.  If it keeps happening, run `keybase log send` " +
+				"and report a bug.",
+		},
+		ErrorCodeNotFound: {
+			"It doesn't exist.",
+			"Check the spelling of the path, and that the user or team " +
+				"exists.",
+		},
+		ErrorCodeAlreadyExists: {
+			"Something with that name already exists.",
+			"Pick a different name, or remove the existing one first.",
+		},
+		ErrorCodeNotEmpty: {
+			"The directory isn't empty.",
+			"Remove what's in it first.",
+		},
+		ErrorCodeAccessDenied: {
+			"You don't have permission to do that.",
+			"Ask a writer of the folder to add you, or use a folder " +
+				"you can write to.",
+		},
+		ErrorCodeNeedsRekey: {
+			"This device can't read the folder's keys yet.",
+			"Rekey the folder from one of your other devices, or wait " +
+				"for one of its writers to do it.",
+		},
+		ErrorCodeNotLoggedIn: {
+			"You're not logged in.",
+			"Log in with `keybase login`.",
+		},
+		ErrorCodeOverQuota: {
+			"You're out of storage space.",
+			"Delete some files, including old archived versions, to " +
+				"free up space.",
+		},
+		ErrorCodeTooBig: {
+			"It's too big for KBFS.",
+			"Use a shorter name, split the file, or spread the " +
+				"directory's entries over subdirectories.",
+		},
+		ErrorCodeInvalidArgument: {
+			"KBFS couldn't make sense of the request.",
+			"Check the name and options you used.",
+		},
+		ErrorCodeNotSupported: {
+			"KBFS doesn't support that operation.",
+			"Do it another way, e.g. copy and remove instead of moving " +
+				"between folders.",
+		},
+		ErrorCodeReadOnly: {
+			"The folder can't be written to right now.",
+			"If you paused writes to it, resume them.",
+		},
+		ErrorCodeConflict: {
+			"Someone else changed the folder at the same time, and the " +
+				"changes couldn't be merged automatically.",
+			"Look for conflicted copies of the files, and try again.",
+		},
+		ErrorCodeBusy: {
+			"The server or file is busy.",
+			"Wait a bit, and try again.",
+		},
+		ErrorCodeOffline: {
+			"That isn't available while offline.",
+			"Reconnect to the network, or sync the folder ahead of " +
+				"time next time.",
+		},
+		ErrorCodeTimeout: {
+			"The operation took too long.",
+			"Check your network connection, and try again.",
+		},
+		ErrorCodeShuttingDown: {
+			"KBFS is shutting down.",
+			"Try again once it's running again.",
+		},
+	},
+}
+
+// ErrorDescription explains an error to users.
+type ErrorDescription struct {
+	Code        ErrorCode
+	Message     string
+	Remediation string
+}
+
+// DescribeError explains err in the language of the given locale,
+// like "de_DE.UTF-8" or "de", falling back to DefaultErrorLocale
+// where there's no translation.  A nil error gets an empty
+// description.
+func DescribeError(err error, locale string) ErrorDescription {
+	code := ClassifyError(err)
+	if code == ErrorCodeNone {
+		return ErrorDescription{}
+	}
+	lang := locale
+	if i := strings.IndexAny(lang, "_.@"); i >= 0 {
+		lang = lang[:i]
+	}
+	text, ok := errorTexts[strings.ToLower(lang)][code]
+	if !ok {
+		text = errorTexts[DefaultErrorLocale][code]
+	}
+	return ErrorDescription{
+		Code:        code,
+		Message:     text.message,
+		Remediation: text.remediation,
+	}
+}
+
+// ErrorLocale returns the locale error descriptions shown to the
+// local user should use, taken from the usual environment
+// variables.
+func ErrorLocale() string {
+	for _, env := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if locale := os.Getenv(env); locale != "" {
+			return locale
+		}
+	}
+	return DefaultErrorLocale
+}
@@ -0,0 +1,46 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyError(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		code ErrorCode
+	}{
+		{nil, ErrorCodeNone},
+		{errors.New("oops"), ErrorCodeInternal},
+		{NoSuchNameError{"foo"}, ErrorCodeNotFound},
+		{NameExistsError{"foo"}, ErrorCodeAlreadyExists},
+		{BServerErrorOverQuota{Usage: 10, Limit: 5}, ErrorCodeOverQuota},
+		{MDServerErrorConflictRevision{}, ErrorCodeConflict},
+		{MDServerErrorThrottle{}, ErrorCodeBusy},
+		{WritesPausedError{}, ErrorCodeReadOnly},
+		{OfflineUnavailableError{}, ErrorCodeOffline},
+		{CRWrapError{NoCurrentSessionError{}}, ErrorCodeNotLoggedIn},
+	} {
+		require.Equal(t, test.code, ClassifyError(test.err), "%v", test.err)
+	}
+}
+
+func TestDescribeError(t *testing.T) {
+	require.Equal(t, ErrorDescription{}, DescribeError(nil, "en"))
+
+	err := BServerErrorOverQuota{Usage: 10, Limit: 5}
+	d := DescribeError(err, "en_US.UTF-8")
+	require.Equal(t, ErrorCodeOverQuota, d.Code)
+	require.Equal(t, "You're out of storage space.", d.Message)
+	require.NotEmpty(t, d.Remediation)
+
+	// Languages without a translation fall back to the default.
+	require.Equal(t, d, DescribeError(err, "xx_XX"))
+	require.Equal(t, d, DescribeError(err, ""))
+}
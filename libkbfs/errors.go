@@ -6,6 +6,7 @@ package libkbfs
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/protocol/keybase1"
@@ -283,6 +284,47 @@ func (e BlockDecodeError) Error() string {
 	return fmt.Sprintf("Decode error for a block: %v", e.decodeErr)
 }
 
+// MDDecodeError indicates that a signed MD object couldn't be decoded
+// at the version it was supposed to have.
+type MDDecodeError struct {
+	Tlf TlfID
+	Ver MetadataVer
+	Err error
+}
+
+// Error implements the error interface for MDDecodeError.
+func (e MDDecodeError) Error() string {
+	return fmt.Sprintf("Decode error for MD of folder %s at version %d: %v",
+		e.Tlf, e.Ver, e.Err)
+}
+
+// JournalEntryDecodeError indicates that something read back from a
+// journal couldn't be decoded, or made no sense once decoded.
+type JournalEntryDecodeError struct {
+	Path string
+	Err  error
+}
+
+// Error implements the error interface for JournalEntryDecodeError.
+func (e JournalEntryDecodeError) Error() string {
+	return fmt.Sprintf("Decode error for journal entry %s: %v",
+		e.Path, e.Err)
+}
+
+// MDRangeRevisionError indicates that a range of MD objects read from
+// a server or journal had one with an unexpected revision, which
+// means the server or journal is broken or corrupted.
+type MDRangeRevisionError struct {
+	Expected MetadataRevision
+	Actual   MetadataRevision
+}
+
+// Error implements the error interface for MDRangeRevisionError.
+func (e MDRangeRevisionError) Error() string {
+	return fmt.Sprintf("Expected revision %d in MD range, got %d",
+		e.Expected, e.Actual)
+}
+
 // BadDataError indicates that KBFS is storing corrupt data for a block.
 type BadDataError struct {
 	ID BlockID
@@ -688,6 +730,17 @@ func (e PaddedBlockReadError) Error() string {
 		e.ActualLen, e.ExpectedLen)
 }
 
+// BlockDecompressionError occurs if a compressed block can't be
+// decompressed.
+type BlockDecompressionError struct {
+	reason string
+}
+
+// Error implements the error interface of BlockDecompressionError.
+func (e BlockDecompressionError) Error() string {
+	return fmt.Sprintf("Couldn't decompress block: %s", e.reason)
+}
+
 // NotDirectFileBlockError indicates that a direct file block was
 // expected, but something else (e.g., an indirect file block) was
 // given instead.
@@ -1129,6 +1182,36 @@ func (w OverQuotaWarning) Error() string {
 		"to %d bytes.  Please delete some data.", w.UsageBytes, w.LimitBytes)
 }
 
+// WritesThrottledWarning indicates that this device has been making
+// revisions to a folder so quickly that KBFS has started delaying
+// them, which usually means some application is stuck in a write
+// loop.
+type WritesThrottledWarning struct {
+	Tlf   TlfID
+	Delay time.Duration
+}
+
+// Error implements the error interface for WritesThrottledWarning.
+func (w WritesThrottledWarning) Error() string {
+	return fmt.Sprintf("Writes to folder %s are being delayed by up to "+
+		"%s because they are happening too quickly; an application may "+
+		"be stuck in a write loop", w.Tlf, w.Delay)
+}
+
+// InvalidConflictNameTemplateError indicates that a template given to
+// NewTemplateConflictRenamer can't be used.
+type InvalidConflictNameTemplateError struct {
+	Template string
+	Reason   string
+}
+
+// Error implements the error interface for
+// InvalidConflictNameTemplateError.
+func (e InvalidConflictNameTemplateError) Error() string {
+	return fmt.Sprintf("Invalid conflict name template %q: %s",
+		e.Template, e.Reason)
+}
+
 // OpsCantHandleFavorite means that folderBranchOps wasn't able to
 // deal with a favorites request.
 type OpsCantHandleFavorite struct {
@@ -1204,3 +1287,359 @@ type blockNonExistentError struct {
 func (e blockNonExistentError) Error() string {
 	return fmt.Sprintf("block %s does not exist", e.id)
 }
+
+// blockJournalDataError is returned when the data for a block put in
+// a journal can't be read back for flushing.
+type blockJournalDataError struct {
+	ordinal journalOrdinal
+	id      BlockID
+	err     error
+}
+
+func (e blockJournalDataError) Error() string {
+	return fmt.Sprintf("Data for block %s put by journal entry %d "+
+		"can't be flushed: %v", e.id, e.ordinal, e.err)
+}
+
+// KeyBundleIDMismatchError is returned when a key bundle doesn't hash
+// to the ID it was fetched or stored under.
+type KeyBundleIDMismatchError struct {
+	Expected string
+	Actual   string
+}
+
+// Error implements the error interface for KeyBundleIDMismatchError.
+func (e KeyBundleIDMismatchError) Error() string {
+	return fmt.Sprintf("Key bundle ID mismatch: expected %s, got %s",
+		e.Expected, e.Actual)
+}
+
+// BlockContextMissingCreatorError indicates that a block operation
+// was attempted with a context that doesn't have a creator.
+type BlockContextMissingCreatorError struct {
+	Op      blockOpType
+	Context BlockContext
+}
+
+// Error implements the error interface for
+// BlockContextMissingCreatorError.
+func (e BlockContextMissingCreatorError) Error() string {
+	return fmt.Sprintf("Can't do %s with no creator in %s", e.Op, e.Context)
+}
+
+// BlockContextWriterMismatchError indicates that a block was about
+// to be put by someone other than its creator.
+type BlockContextWriterMismatchError struct {
+	Context BlockContext
+}
+
+// Error implements the error interface for
+// BlockContextWriterMismatchError.
+func (e BlockContextWriterMismatchError) Error() string {
+	return fmt.Sprintf("Can't Put() a block with creator=%s != writer=%s",
+		e.Context.GetCreator(), e.Context.GetWriter())
+}
+
+// BlockContextRefNonceError indicates that a block operation was
+// attempted with the wrong kind of ref nonce: a put needs the zero
+// ref nonce, and adding a reference needs a non-zero one.
+type BlockContextRefNonceError struct {
+	Op      blockOpType
+	Context BlockContext
+}
+
+// Error implements the error interface for BlockContextRefNonceError.
+func (e BlockContextRefNonceError) Error() string {
+	if e.Context.IsFirstRef() {
+		return fmt.Sprintf("Can't do %s with a zero refnonce", e.Op)
+	}
+	return fmt.Sprintf("Can't do %s with a non-zero refnonce %s",
+		e.Op, e.Context.GetRefNonce())
+}
+
+// WritesPausedError indicates that a mutating operation was attempted
+// on a folder whose writes have been paused via
+// KBFSOps.PauseWrites.
+type WritesPausedError struct {
+	Tlf TlfID
+}
+
+// Error implements the error interface for WritesPausedError.
+func (e WritesPausedError) Error() string {
+	return fmt.Sprintf("Writes to folder %s are paused", e.Tlf)
+}
+
+// SyncNotOnServerError indicates that a sync asking for
+// WriteDurabilityServer got the writes into the local journal, but
+// the journal couldn't be flushed to the servers.  The writes are
+// still in the journal, and will be flushed later.
+type SyncNotOnServerError struct {
+	Tlf TlfID
+	Err error
+}
+
+// Error implements the error interface for SyncNotOnServerError.
+func (e SyncNotOnServerError) Error() string {
+	return fmt.Sprintf("Synced to the local journal of folder %s, but "+
+		"couldn't flush it to the server: %v", e.Tlf, e.Err)
+}
+
+// RangeLockConflictError indicates that an advisory byte-range lock
+// couldn't be taken, because someone else holds a conflicting one.
+type RangeLockConflictError struct {
+	File     string
+	Conflict RangeLock
+}
+
+// Error implements the error interface for RangeLockConflictError.
+func (e RangeLockConflictError) Error() string {
+	return fmt.Sprintf("%s is locked (%s)", e.File, e.Conflict)
+}
+
+// InvalidRangeLockError indicates that a byte-range lock had an
+// unknown type or an empty range.
+type InvalidRangeLockError struct {
+	Lock RangeLock
+}
+
+// Error implements the error interface for InvalidRangeLockError.
+func (e InvalidRangeLockError) Error() string {
+	return fmt.Sprintf("Invalid byte-range lock %s", e.Lock)
+}
+
+// RangeLocksUnsupportedError indicates that the MD server can't
+// coordinate byte-range locks.
+type RangeLocksUnsupportedError struct{}
+
+// Error implements the error interface for RangeLocksUnsupportedError.
+func (e RangeLocksUnsupportedError) Error() string {
+	return "The MD server doesn't support byte-range locks"
+}
+
+// KeyBundlesUnsupportedError indicates that the MD server can't
+// serve the segregated key bundles of MDv3 TLFs.
+type KeyBundlesUnsupportedError struct{}
+
+// Error implements the error interface for KeyBundlesUnsupportedError.
+func (e KeyBundlesUnsupportedError) Error() string {
+	return "The MD server doesn't support fetching key bundles"
+}
+
+// NoSuchXattrError indicates that a file or directory has no
+// extended attribute with the given name.
+type NoSuchXattrError struct {
+	Name string
+}
+
+// Error implements the error interface for NoSuchXattrError.
+func (e NoSuchXattrError) Error() string {
+	return fmt.Sprintf("No extended attribute named %q", e.Name)
+}
+
+// InvalidXattrNameError indicates that an extended attribute name
+// was empty or too long.
+type InvalidXattrNameError struct {
+	Name string
+}
+
+// Error implements the error interface for InvalidXattrNameError.
+func (e InvalidXattrNameError) Error() string {
+	return fmt.Sprintf("Invalid extended attribute name %q", e.Name)
+}
+
+// XattrTooBigError indicates that an extended attribute value was
+// bigger than the maximum allowed size.
+type XattrTooBigError struct {
+	Name    string
+	Size    uint64
+	MaxSize uint64
+}
+
+// Error implements the error interface for XattrTooBigError.
+func (e XattrTooBigError) Error() string {
+	return fmt.Sprintf("Value of extended attribute %q is too big: "+
+		"%d bytes (max is %d)", e.Name, e.Size, e.MaxSize)
+}
+
+// ReadOnlyXattrError indicates an attempt to set or remove an
+// extended attribute that KBFS provides itself, like
+// SyncStateXattrName.
+type ReadOnlyXattrError struct {
+	Name string
+}
+
+// Error implements the error interface for ReadOnlyXattrError.
+func (e ReadOnlyXattrError) Error() string {
+	return fmt.Sprintf("Extended attribute %q is read-only", e.Name)
+}
+
+// NoRootXattrsError indicates an attempt to change the extended
+// attributes of a TLF's root directory, which can't have any.
+type NoRootXattrsError struct{}
+
+// Error implements the error interface for NoRootXattrsError.
+func (e NoRootXattrsError) Error() string {
+	return "The root of a TLF can't have extended attributes"
+}
+
+// NoConflictFileMergerError indicates that no ConflictFileMerger is
+// registered for a given file.
+type NoConflictFileMergerError struct {
+	Name string
+}
+
+// Error implements the error interface for NoConflictFileMergerError.
+func (e NoConflictFileMergerError) Error() string {
+	return fmt.Sprintf("No conflict file merger for %s", e.Name)
+}
+
+// FileTooBigToMergeError indicates that a file, or its merged
+// contents, don't fit in the single block that conflict resolution
+// can merge a file into.
+type FileTooBigToMergeError struct {
+	Name string
+}
+
+// Error implements the error interface for FileTooBigToMergeError.
+func (e FileTooBigToMergeError) Error() string {
+	return fmt.Sprintf("%s is too big to merge", e.Name)
+}
+
+// InvalidAllocateModeError indicates an unsupported combination of
+// flags passed to KBFSOps.Allocate.
+type InvalidAllocateModeError struct {
+	Mode AllocateMode
+}
+
+// Error implements the error interface for InvalidAllocateModeError.
+func (e InvalidAllocateModeError) Error() string {
+	return fmt.Sprintf("Invalid allocate mode %#x", int(e.Mode))
+}
+
+// CrossDirLinkError indicates an attempt to make a hard link to a
+// file from a different directory, or to move a file with more than
+// one hard link into a different directory.  All the links to a file
+// must be in the same directory.
+type CrossDirLinkError struct {
+	Name string
+}
+
+// Error implements the error interface for CrossDirLinkError.
+func (e CrossDirLinkError) Error() string {
+	return fmt.Sprintf("Hard links to %s must stay in its directory", e.Name)
+}
+
+// NoFileVersionError indicates that a file didn't exist yet as of
+// the requested revision, or that its history doesn't go back that
+// far.
+type NoFileVersionError struct {
+	Name     string
+	Revision MetadataRevision
+}
+
+// Error implements the error interface for NoFileVersionError.
+func (e NoFileVersionError) Error() string {
+	return fmt.Sprintf("No version of %s as of revision %d",
+		e.Name, e.Revision)
+}
+
+// NoArchivedRevisionError indicates that a folder has no merged
+// revision with the given number or, if Time is set, none made at or
+// before that time.
+type NoArchivedRevisionError struct {
+	Revision MetadataRevision
+	Time     time.Time
+}
+
+// Error implements the error interface for NoArchivedRevisionError.
+func (e NoArchivedRevisionError) Error() string {
+	if !e.Time.IsZero() {
+		return fmt.Sprintf("No revision made at or before %s", e.Time)
+	}
+	return fmt.Sprintf("No revision %d", e.Revision)
+}
+
+// ReadSnapshotClosedError indicates that a read was attempted
+// through a ReadSnapshot after it was closed.
+type ReadSnapshotClosedError struct {
+	Revision MetadataRevision
+}
+
+// Error implements the error interface for ReadSnapshotClosedError.
+func (e ReadSnapshotClosedError) Error() string {
+	return fmt.Sprintf("The read snapshot of revision %d is closed",
+		e.Revision)
+}
+
+// FileVersionReaderClosedError indicates that a read was attempted
+// through a FileVersionReader after it was closed.
+type FileVersionReaderClosedError struct {
+	Name     string
+	Revision MetadataRevision
+}
+
+// Error implements the error interface for
+// FileVersionReaderClosedError.
+func (e FileVersionReaderClosedError) Error() string {
+	return fmt.Sprintf("The reader of %s as of revision %d is closed",
+		e.Name, e.Revision)
+}
+
+// OfflineUnavailableError indicates that an operation needed the MD
+// or block server, or data that isn't cached locally, while KBFS was
+// offline.
+type OfflineUnavailableError struct {
+	Op string
+}
+
+// Error implements the error interface for OfflineUnavailableError.
+func (e OfflineUnavailableError) Error() string {
+	return fmt.Sprintf("%s needs the server, which is unavailable "+
+		"while KBFS is offline", e.Op)
+}
+
+// SyncCacheDisabledError indicates that a TLF couldn't be subscribed
+// to for syncing, because no sync cache was enabled.
+type SyncCacheDisabledError struct{}
+
+// Error implements the error interface for SyncCacheDisabledError.
+func (e SyncCacheDisabledError) Error() string {
+	return "Syncing TLFs to local disk is not enabled"
+}
+
+// NotSyncSubscribedError indicates that the sync status of a TLF was
+// asked for, but no path of it is subscribed to.
+type NotSyncSubscribedError struct {
+	Tlf TlfID
+}
+
+// Error implements the error interface for NotSyncSubscribedError.
+func (e NotSyncSubscribedError) Error() string {
+	return fmt.Sprintf("%s is not subscribed to for syncing", e.Tlf)
+}
+
+// StateCheckBusyError indicates that a TLF's state couldn't be
+// checked, because the TLF has local changes that haven't been
+// synced to the server yet, or was written to during the check.
+type StateCheckBusyError struct {
+	Tlf TlfID
+}
+
+// Error implements the error interface for StateCheckBusyError.
+func (e StateCheckBusyError) Error() string {
+	return fmt.Sprintf("%s is being written to, and can't be checked "+
+		"until the writes are synced", e.Tlf)
+}
+
+// DiskLimitReachedError indicates that KBFS's journals and caches
+// already take up as much local disk space as they're allowed to.
+type DiskLimitReachedError struct {
+	UsedBytes  int64
+	LimitBytes int64
+}
+
+// Error implements the error interface for DiskLimitReachedError.
+func (e DiskLimitReachedError) Error() string {
+	return fmt.Sprintf("KBFS already uses %d bytes of local disk, "+
+		"and is limited to %d", e.UsedBytes, e.LimitBytes)
+}
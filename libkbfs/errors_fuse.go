@@ -124,3 +124,219 @@ var _ fuse.ErrorNumber = NoSuchFolderListError{}
 func (e NoSuchFolderListError) Errno() fuse.Errno {
 	return fuse.Errno(syscall.ENOENT)
 }
+
+var _ fuse.ErrorNumber = WritesPausedError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// WritesPausedError.
+func (e WritesPausedError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EROFS)
+}
+
+var _ fuse.ErrorNumber = NoSuchXattrError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// NoSuchXattrError.
+func (e NoSuchXattrError) Errno() fuse.Errno {
+	return fuse.ErrNoXattr
+}
+
+var _ fuse.ErrorNumber = InvalidXattrNameError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// InvalidXattrNameError.
+func (e InvalidXattrNameError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.ERANGE)
+}
+
+var _ fuse.ErrorNumber = XattrTooBigError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// XattrTooBigError.
+func (e XattrTooBigError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.E2BIG)
+}
+
+var _ fuse.ErrorNumber = ReadOnlyXattrError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// ReadOnlyXattrError.
+func (e ReadOnlyXattrError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EPERM)
+}
+
+var _ fuse.ErrorNumber = NoArchivedRevisionError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// NoArchivedRevisionError.
+func (e NoArchivedRevisionError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.ENOENT)
+}
+
+var _ fuse.ErrorNumber = NoRootXattrsError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// NoRootXattrsError.
+func (e NoRootXattrsError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.ENOTSUP)
+}
+
+var _ fuse.ErrorNumber = InvalidAllocateModeError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// InvalidAllocateModeError.
+func (e InvalidAllocateModeError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EOPNOTSUPP)
+}
+
+var _ fuse.ErrorNumber = CrossDirLinkError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// CrossDirLinkError.
+func (e CrossDirLinkError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EXDEV)
+}
+
+var _ fuse.ErrorNumber = OfflineUnavailableError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// OfflineUnavailableError.
+func (e OfflineUnavailableError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.ENETDOWN)
+}
+
+// errorCodeErrnos maps each ErrorCode to the errno to return for
+// errors of that code that don't pick a more specific one.
+var errorCodeErrnos = map[ErrorCode]syscall.Errno{
+	ErrorCodeInternal:        syscall.EIO,
+	ErrorCodeNotFound:        syscall.ENOENT,
+	ErrorCodeAlreadyExists:   syscall.EEXIST,
+	ErrorCodeNotEmpty:        syscall.ENOTEMPTY,
+	ErrorCodeAccessDenied:    syscall.EACCES,
+	ErrorCodeNeedsRekey:      syscall.EACCES,
+	ErrorCodeNotLoggedIn:     syscall.EACCES,
+	ErrorCodeOverQuota:       syscall.EDQUOT,
+	ErrorCodeTooBig:          syscall.EFBIG,
+	ErrorCodeInvalidArgument: syscall.EINVAL,
+	ErrorCodeNotSupported:    syscall.EOPNOTSUPP,
+	ErrorCodeReadOnly:        syscall.EROFS,
+	ErrorCodeConflict:        syscall.EAGAIN,
+	ErrorCodeBusy:            syscall.EAGAIN,
+	ErrorCodeOffline:         syscall.ENETDOWN,
+	ErrorCodeTimeout:         syscall.ETIMEDOUT,
+	ErrorCodeShuttingDown:    syscall.ESHUTDOWN,
+}
+
+// ErrnoForError returns the errno to return for err, going by its
+// ErrorCode.
+func ErrnoForError(err error) fuse.Errno {
+	errno, ok := errorCodeErrnos[ClassifyError(err)]
+	if !ok {
+		return fuse.DefaultErrno
+	}
+	return fuse.Errno(errno)
+}
+
+var _ fuse.ErrorNumber = NameExistsError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// NameExistsError.
+func (e NameExistsError) Errno() fuse.Errno {
+	return ErrnoForError(e)
+}
+
+var _ fuse.ErrorNumber = NoSuchNameError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// NoSuchNameError.
+func (e NoSuchNameError) Errno() fuse.Errno {
+	return ErrnoForError(e)
+}
+
+var _ fuse.ErrorNumber = NoSuchTlfHandleError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// NoSuchTlfHandleError.
+func (e NoSuchTlfHandleError) Errno() fuse.Errno {
+	return ErrnoForError(e)
+}
+
+var _ fuse.ErrorNumber = BServerErrorOverQuota{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// BServerErrorOverQuota.
+func (e BServerErrorOverQuota) Errno() fuse.Errno {
+	return ErrnoForError(e)
+}
+
+var _ fuse.ErrorNumber = BServerErrorThrottle{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// BServerErrorThrottle.
+func (e BServerErrorThrottle) Errno() fuse.Errno {
+	return ErrnoForError(e)
+}
+
+var _ fuse.ErrorNumber = MDServerErrorThrottle{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// MDServerErrorThrottle.
+func (e MDServerErrorThrottle) Errno() fuse.Errno {
+	return ErrnoForError(e)
+}
+
+var _ fuse.ErrorNumber = MDServerErrorLocked{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// MDServerErrorLocked.
+func (e MDServerErrorLocked) Errno() fuse.Errno {
+	return ErrnoForError(e)
+}
+
+var _ fuse.ErrorNumber = MDServerErrorConflictRevision{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// MDServerErrorConflictRevision.
+func (e MDServerErrorConflictRevision) Errno() fuse.Errno {
+	return ErrnoForError(e)
+}
+
+var _ fuse.ErrorNumber = MDServerErrorConflictPrevRoot{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// MDServerErrorConflictPrevRoot.
+func (e MDServerErrorConflictPrevRoot) Errno() fuse.Errno {
+	return ErrnoForError(e)
+}
+
+var _ fuse.ErrorNumber = MDServerErrorConflictDiskUsage{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// MDServerErrorConflictDiskUsage.
+func (e MDServerErrorConflictDiskUsage) Errno() fuse.Errno {
+	return ErrnoForError(e)
+}
+
+var _ fuse.ErrorNumber = MDServerErrorConflictFolderMapping{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// MDServerErrorConflictFolderMapping.
+func (e MDServerErrorConflictFolderMapping) Errno() fuse.Errno {
+	return ErrnoForError(e)
+}
+
+var _ fuse.ErrorNumber = TimeoutError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// TimeoutError.
+func (e TimeoutError) Errno() fuse.Errno {
+	return ErrnoForError(e)
+}
+
+var _ fuse.ErrorNumber = ShutdownHappenedError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// ShutdownHappenedError.
+func (e ShutdownHappenedError) Errno() fuse.Errno {
+	return ErrnoForError(e)
+}
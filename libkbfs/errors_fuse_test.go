@@ -0,0 +1,34 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package libkbfs
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrnoForError(t *testing.T) {
+	require.Equal(t, fuse.Errno(syscall.EDQUOT),
+		BServerErrorOverQuota{Usage: 10, Limit: 5}.Errno())
+	require.Equal(t, fuse.Errno(syscall.EAGAIN),
+		MDServerErrorConflictRevision{}.Errno())
+	require.Equal(t, fuse.DefaultErrno, ErrnoForError(errors.New("oops")))
+
+	// Every code gets an errno and a description.
+	texts := errorTexts[DefaultErrorLocale]
+	for code := range errorCodeErrnos {
+		text, ok := texts[code]
+		require.True(t, ok, "%s has no description", code)
+		require.NotEmpty(t, text.message, "%s", code)
+		require.NotEmpty(t, text.remediation, "%s", code)
+	}
+	require.Len(t, errorCodeErrnos, len(texts))
+}
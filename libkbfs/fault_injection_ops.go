@@ -0,0 +1,315 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"golang.org/x/net/context"
+)
+
+// faultyMDOps is an implementation of MDOps that injects faults
+// into its calls, as picked by a FaultInjector.
+type faultyMDOps struct {
+	fi       *FaultInjector
+	delegate MDOps
+}
+
+var _ MDOps = faultyMDOps{}
+
+func (m faultyMDOps) GetForHandle(
+	ctx context.Context, handle *TlfHandle, mStatus MergeStatus) (
+	tlfID TlfID, md ImmutableRootMetadata, err error) {
+	err = m.fi.do(ctx, FaultLayerMD, "GetForHandle",
+		func(ctx context.Context) (err error) {
+			tlfID, md, err = m.delegate.GetForHandle(ctx, handle, mStatus)
+			return err
+		})
+	return tlfID, md, err
+}
+
+func (m faultyMDOps) GetForTLF(ctx context.Context, id TlfID) (
+	md ImmutableRootMetadata, err error) {
+	err = m.fi.do(ctx, FaultLayerMD, "GetForTLF",
+		func(ctx context.Context) (err error) {
+			md, err = m.delegate.GetForTLF(ctx, id)
+			return err
+		})
+	return md, err
+}
+
+func (m faultyMDOps) GetUnmergedForTLF(ctx context.Context, id TlfID,
+	bid BranchID) (md ImmutableRootMetadata, err error) {
+	err = m.fi.do(ctx, FaultLayerMD, "GetUnmergedForTLF",
+		func(ctx context.Context) (err error) {
+			md, err = m.delegate.GetUnmergedForTLF(ctx, id, bid)
+			return err
+		})
+	return md, err
+}
+
+func (m faultyMDOps) GetRange(ctx context.Context, id TlfID,
+	start, stop MetadataRevision) (mds []ImmutableRootMetadata, err error) {
+	err = m.fi.do(ctx, FaultLayerMD, "GetRange",
+		func(ctx context.Context) (err error) {
+			mds, err = m.delegate.GetRange(ctx, id, start, stop)
+			return err
+		})
+	return mds, err
+}
+
+func (m faultyMDOps) GetUnmergedRange(ctx context.Context, id TlfID,
+	bid BranchID, start, stop MetadataRevision) (
+	mds []ImmutableRootMetadata, err error) {
+	err = m.fi.do(ctx, FaultLayerMD, "GetUnmergedRange",
+		func(ctx context.Context) (err error) {
+			mds, err = m.delegate.GetUnmergedRange(ctx, id, bid, start, stop)
+			return err
+		})
+	return mds, err
+}
+
+func (m faultyMDOps) Put(ctx context.Context, rmd *RootMetadata) (
+	mdID MdID, err error) {
+	err = m.fi.do(ctx, FaultLayerMD, "Put",
+		func(ctx context.Context) (err error) {
+			mdID, err = m.delegate.Put(ctx, rmd)
+			return err
+		})
+	return mdID, err
+}
+
+func (m faultyMDOps) PutUnmerged(ctx context.Context, rmd *RootMetadata) (
+	mdID MdID, err error) {
+	err = m.fi.do(ctx, FaultLayerMD, "PutUnmerged",
+		func(ctx context.Context) (err error) {
+			mdID, err = m.delegate.PutUnmerged(ctx, rmd)
+			return err
+		})
+	return mdID, err
+}
+
+func (m faultyMDOps) PruneBranch(
+	ctx context.Context, id TlfID, bid BranchID) error {
+	return m.fi.do(ctx, FaultLayerMD, "PruneBranch",
+		func(ctx context.Context) error {
+			return m.delegate.PruneBranch(ctx, id, bid)
+		})
+}
+
+func (m faultyMDOps) GetLatestHandleForTLF(ctx context.Context, id TlfID) (
+	h BareTlfHandle, err error) {
+	err = m.fi.do(ctx, FaultLayerMD, "GetLatestHandleForTLF",
+		func(ctx context.Context) (err error) {
+			h, err = m.delegate.GetLatestHandleForTLF(ctx, id)
+			return err
+		})
+	return h, err
+}
+
+// faultyBlockOps is an implementation of BlockOps that injects
+// faults into its calls, as picked by a FaultInjector.
+type faultyBlockOps struct {
+	fi       *FaultInjector
+	delegate BlockOps
+}
+
+var _ BlockOps = faultyBlockOps{}
+
+func (b faultyBlockOps) Get(ctx context.Context, kmd KeyMetadata,
+	blockPtr BlockPointer, block Block) error {
+	return b.fi.do(ctx, FaultLayerBlock, "Get",
+		func(ctx context.Context) error {
+			return b.delegate.Get(ctx, kmd, blockPtr, block)
+		})
+}
+
+func (b faultyBlockOps) Ready(ctx context.Context, kmd KeyMetadata,
+	block Block) (id BlockID, plainSize int,
+	readyBlockData ReadyBlockData, err error) {
+	err = b.fi.do(ctx, FaultLayerBlock, "Ready",
+		func(ctx context.Context) (err error) {
+			id, plainSize, readyBlockData, err =
+				b.delegate.Ready(ctx, kmd, block)
+			return err
+		})
+	return id, plainSize, readyBlockData, err
+}
+
+func (b faultyBlockOps) Delete(ctx context.Context, tlfID TlfID,
+	ptrs []BlockPointer) (liveCounts map[BlockID]int, err error) {
+	err = b.fi.do(ctx, FaultLayerBlock, "Delete",
+		func(ctx context.Context) (err error) {
+			liveCounts, err = b.delegate.Delete(ctx, tlfID, ptrs)
+			return err
+		})
+	return liveCounts, err
+}
+
+func (b faultyBlockOps) Archive(ctx context.Context, tlfID TlfID,
+	ptrs []BlockPointer) error {
+	return b.fi.do(ctx, FaultLayerBlock, "Archive",
+		func(ctx context.Context) error {
+			return b.delegate.Archive(ctx, tlfID, ptrs)
+		})
+}
+
+// faultyKeyOps is an implementation of KeyOps that injects faults
+// into its calls, as picked by a FaultInjector.
+type faultyKeyOps struct {
+	fi       *FaultInjector
+	delegate KeyOps
+}
+
+var _ KeyOps = faultyKeyOps{}
+
+func (k faultyKeyOps) GetTLFCryptKeyServerHalf(ctx context.Context,
+	serverHalfID TLFCryptKeyServerHalfID,
+	cryptPublicKey CryptPublicKey) (
+	serverHalf TLFCryptKeyServerHalf, err error) {
+	err = k.fi.do(ctx, FaultLayerKey, "GetTLFCryptKeyServerHalf",
+		func(ctx context.Context) (err error) {
+			serverHalf, err = k.delegate.GetTLFCryptKeyServerHalf(
+				ctx, serverHalfID, cryptPublicKey)
+			return err
+		})
+	return serverHalf, err
+}
+
+func (k faultyKeyOps) PutTLFCryptKeyServerHalves(ctx context.Context,
+	serverKeyHalves map[keybase1.UID]map[keybase1.KID]TLFCryptKeyServerHalf) error {
+	return k.fi.do(ctx, FaultLayerKey, "PutTLFCryptKeyServerHalves",
+		func(ctx context.Context) error {
+			return k.delegate.PutTLFCryptKeyServerHalves(ctx, serverKeyHalves)
+		})
+}
+
+func (k faultyKeyOps) DeleteTLFCryptKeyServerHalf(ctx context.Context,
+	uid keybase1.UID, kid keybase1.KID,
+	serverHalfID TLFCryptKeyServerHalfID) error {
+	return k.fi.do(ctx, FaultLayerKey, "DeleteTLFCryptKeyServerHalf",
+		func(ctx context.Context) error {
+			return k.delegate.DeleteTLFCryptKeyServerHalf(
+				ctx, uid, kid, serverHalfID)
+		})
+}
+
+// faultyKeybaseService is an implementation of KeybaseService that
+// injects faults into its calls, as picked by a FaultInjector.
+// Calls that can't fail aren't touched.
+type faultyKeybaseService struct {
+	fi       *FaultInjector
+	delegate KeybaseService
+}
+
+var _ KeybaseService = faultyKeybaseService{}
+
+func (k faultyKeybaseService) Resolve(ctx context.Context, assertion string) (
+	name libkb.NormalizedUsername, uid keybase1.UID, err error) {
+	err = k.fi.do(ctx, FaultLayerService, "Resolve",
+		func(ctx context.Context) (err error) {
+			name, uid, err = k.delegate.Resolve(ctx, assertion)
+			return err
+		})
+	return name, uid, err
+}
+
+func (k faultyKeybaseService) Identify(
+	ctx context.Context, assertion, reason string) (
+	userInfo UserInfo, err error) {
+	err = k.fi.do(ctx, FaultLayerService, "Identify",
+		func(ctx context.Context) (err error) {
+			userInfo, err = k.delegate.Identify(ctx, assertion, reason)
+			return err
+		})
+	return userInfo, err
+}
+
+func (k faultyKeybaseService) LoadUserPlusKeys(
+	ctx context.Context, uid keybase1.UID) (userInfo UserInfo, err error) {
+	err = k.fi.do(ctx, FaultLayerService, "LoadUserPlusKeys",
+		func(ctx context.Context) (err error) {
+			userInfo, err = k.delegate.LoadUserPlusKeys(ctx, uid)
+			return err
+		})
+	return userInfo, err
+}
+
+func (k faultyKeybaseService) LoadUnverifiedKeys(
+	ctx context.Context, uid keybase1.UID) (
+	keys []keybase1.PublicKey, err error) {
+	err = k.fi.do(ctx, FaultLayerService, "LoadUnverifiedKeys",
+		func(ctx context.Context) (err error) {
+			keys, err = k.delegate.LoadUnverifiedKeys(ctx, uid)
+			return err
+		})
+	return keys, err
+}
+
+func (k faultyKeybaseService) CurrentSession(
+	ctx context.Context, sessionID int) (session SessionInfo, err error) {
+	err = k.fi.do(ctx, FaultLayerService, "CurrentSession",
+		func(ctx context.Context) (err error) {
+			session, err = k.delegate.CurrentSession(ctx, sessionID)
+			return err
+		})
+	return session, err
+}
+
+func (k faultyKeybaseService) FavoriteAdd(
+	ctx context.Context, folder keybase1.Folder) error {
+	return k.fi.do(ctx, FaultLayerService, "FavoriteAdd",
+		func(ctx context.Context) error {
+			return k.delegate.FavoriteAdd(ctx, folder)
+		})
+}
+
+func (k faultyKeybaseService) FavoriteDelete(
+	ctx context.Context, folder keybase1.Folder) error {
+	return k.fi.do(ctx, FaultLayerService, "FavoriteDelete",
+		func(ctx context.Context) error {
+			return k.delegate.FavoriteDelete(ctx, folder)
+		})
+}
+
+func (k faultyKeybaseService) FavoriteList(
+	ctx context.Context, sessionID int) (folders []keybase1.Folder, err error) {
+	err = k.fi.do(ctx, FaultLayerService, "FavoriteList",
+		func(ctx context.Context) (err error) {
+			folders, err = k.delegate.FavoriteList(ctx, sessionID)
+			return err
+		})
+	return folders, err
+}
+
+func (k faultyKeybaseService) Notify(ctx context.Context,
+	notification *keybase1.FSNotification) error {
+	return k.fi.do(ctx, FaultLayerService, "Notify",
+		func(ctx context.Context) error {
+			return k.delegate.Notify(ctx, notification)
+		})
+}
+
+func (k faultyKeybaseService) NotifySyncStatus(ctx context.Context,
+	status *keybase1.FSPathSyncStatus) error {
+	return k.fi.do(ctx, FaultLayerService, "NotifySyncStatus",
+		func(ctx context.Context) error {
+			return k.delegate.NotifySyncStatus(ctx, status)
+		})
+}
+
+func (k faultyKeybaseService) FlushUserFromLocalCache(
+	ctx context.Context, uid keybase1.UID) {
+	k.delegate.FlushUserFromLocalCache(ctx, uid)
+}
+
+func (k faultyKeybaseService) FlushUserUnverifiedKeysFromLocalCache(
+	ctx context.Context, uid keybase1.UID) {
+	k.delegate.FlushUserUnverifiedKeysFromLocalCache(ctx, uid)
+}
+
+func (k faultyKeybaseService) Shutdown() {
+	k.delegate.Shutdown()
+}
@@ -0,0 +1,375 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"golang.org/x/net/context"
+)
+
+// FaultLayer names one of the interfaces a FaultInjector can wrap.
+type FaultLayer string
+
+// The layers a FaultInjector can inject faults into.
+const (
+	FaultLayerMD      FaultLayer = "md"
+	FaultLayerBlock   FaultLayer = "block"
+	FaultLayerKey     FaultLayer = "key"
+	FaultLayerService FaultLayer = "service"
+)
+
+// FaultKind is what a FaultRule does to the calls it applies to.
+type FaultKind int
+
+const (
+	// FaultDelay delays the call by the rule's Delay, then makes
+	// it.
+	FaultDelay FaultKind = iota
+	// FaultError fails the call with the rule's Err, without
+	// making it.
+	FaultError
+	// FaultPartial makes the call, then fails it with the rule's
+	// Err anyway, as if the reply got lost.
+	FaultPartial
+	// FaultReorder delays the call by a random duration up to the
+	// rule's Delay, so that concurrent calls finish out of order.
+	FaultReorder
+)
+
+var faultKindNames = []string{"delay", "error", "partial", "reorder"}
+
+func (k FaultKind) String() string {
+	if k < 0 || int(k) >= len(faultKindNames) {
+		return fmt.Sprintf("FaultKind(%d)", int(k))
+	}
+	return faultKindNames[k]
+}
+
+// FaultInjectedError is the error injected by rules that don't name
+// one.
+type FaultInjectedError struct {
+	Layer FaultLayer
+	Op    string
+}
+
+// Error implements the error interface for FaultInjectedError.
+func (e FaultInjectedError) Error() string {
+	return fmt.Sprintf("Injected fault in %s.%s", e.Layer, e.Op)
+}
+
+// faultErrors are the errors that fault schedules can name.
+var faultErrors = map[string]error{
+	"timeout":        TimeoutError{},
+	"offline":        OfflineUnavailableError{},
+	"over-quota":     BServerErrorOverQuota{Msg: "injected"},
+	"block-throttle": BServerErrorThrottle{Msg: "injected"},
+	"md-throttle":    MDServerErrorThrottle{Err: errors.New("injected")},
+	"conflict":       MDServerErrorConflictRevision{Desc: "injected"},
+	"no-session":     NoCurrentSessionError{},
+}
+
+// FaultRule says which calls to inject a fault into, and what fault.
+type FaultRule struct {
+	// Layer and Op select the calls the rule applies to, by layer
+	// and method name; empty ones match everything.
+	Layer FaultLayer
+	Op    string
+	Kind  FaultKind
+	// Delay is how long FaultDelay delays calls, and the most
+	// FaultReorder does.
+	Delay time.Duration
+	// Err is what FaultError and FaultPartial fail calls with.
+	// If nil, a FaultInjectedError is used.
+	Err error
+	// Probability is the chance of the rule applying to each
+	// matching call.  Zero means it always does.
+	Probability float64
+	// Skip is how many matching calls to leave alone before the
+	// rule starts applying.
+	Skip int
+	// Count, if positive, is how many calls the rule applies to
+	// before it's used up.
+	Count int
+}
+
+func (r FaultRule) matches(layer FaultLayer, op string) bool {
+	return (r.Layer == "" || r.Layer == layer) && (r.Op == "" || r.Op == op)
+}
+
+// ParseFaultSchedule parses fault rules, separated by semicolons or
+// newlines.  Each rule looks like
+//
+//	md.Put error=conflict prob=0.5 skip=2 count=1
+//
+// The first word is the layer and method the rule applies to, where
+// either may be "*".  Then comes exactly one of delay=DURATION,
+// reorder=DURATION, error[=NAME] or partial[=NAME], where NAME is
+// one of timeout, offline, over-quota, block-throttle, md-throttle,
+// conflict or no-session.  The prob, skip and count options set the
+// FaultRule fields of the same names.
+func ParseFaultSchedule(s string) ([]FaultRule, error) {
+	var rules []FaultRule
+	for _, line := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ';' || r == '\n'
+	}) {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		rule, err := parseFaultRule(fields)
+		if err != nil {
+			return nil, fmt.Errorf("Bad fault rule %q: %v", line, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseFaultRule(fields []string) (rule FaultRule, err error) {
+	target := strings.SplitN(fields[0], ".", 2)
+	if target[0] != "*" {
+		rule.Layer = FaultLayer(target[0])
+		switch rule.Layer {
+		case FaultLayerMD, FaultLayerBlock, FaultLayerKey, FaultLayerService:
+		default:
+			return FaultRule{}, fmt.Errorf("unknown layer %q", target[0])
+		}
+	}
+	if len(target) == 2 && target[1] != "*" {
+		rule.Op = target[1]
+	}
+
+	haveKind := false
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(field, "=", 2)
+		key, value := kv[0], ""
+		if len(kv) == 2 {
+			value = kv[1]
+		}
+		switch key {
+		case "delay", "reorder", "error", "partial":
+			if haveKind {
+				return FaultRule{}, errors.New("more than one fault")
+			}
+			haveKind = true
+		}
+		switch key {
+		case "delay", "reorder":
+			rule.Kind = FaultDelay
+			if key == "reorder" {
+				rule.Kind = FaultReorder
+			}
+			rule.Delay, err = time.ParseDuration(value)
+		case "error", "partial":
+			rule.Kind = FaultError
+			if key == "partial" {
+				rule.Kind = FaultPartial
+			}
+			if value != "" {
+				var ok bool
+				rule.Err, ok = faultErrors[value]
+				if !ok {
+					err = fmt.Errorf("unknown error %q", value)
+				}
+			}
+		case "prob":
+			rule.Probability, err = strconv.ParseFloat(value, 64)
+		case "skip":
+			rule.Skip, err = strconv.Atoi(value)
+		case "count":
+			rule.Count, err = strconv.Atoi(value)
+		default:
+			err = fmt.Errorf("unknown option %q", key)
+		}
+		if err != nil {
+			return FaultRule{}, err
+		}
+	}
+	if !haveKind {
+		return FaultRule{}, errors.New("no fault given")
+	}
+	return rule, nil
+}
+
+type faultRuleState struct {
+	FaultRule
+	matched int
+	applied int
+}
+
+// FaultInjector injects delays, errors, partial failures and
+// reordering into calls through the MDOps, BlockOps, KeyOps and
+// KeybaseService of a Config, once installed with InjectFaults.
+// Each call goes by the first of its rules that applies to it, if
+// any.  Random choices come from a seeded source, so that a schedule
+// can be replayed.  It generalizes the stallers in test_stallers.go,
+// which remain the way to pause single calls step by step.
+type FaultInjector struct {
+	log logger.Logger
+
+	lock     sync.Mutex
+	rng      *rand.Rand
+	rules    []*faultRuleState
+	injected map[string]int
+	// hook, if set, is called before every call, faulty or not.
+	hook func(ctx context.Context, layer FaultLayer, op string)
+}
+
+// NewFaultInjector returns a FaultInjector going by the given rules,
+// with random choices seeded by seed.  log may be nil.
+func NewFaultInjector(
+	seed int64, log logger.Logger, rules ...FaultRule) *FaultInjector {
+	fi := &FaultInjector{
+		log:      log,
+		rng:      rand.New(rand.NewSource(seed)),
+		injected: make(map[string]int),
+	}
+	fi.SetRules(rules...)
+	return fi
+}
+
+// SetRules replaces the rules of fi, starting their counts over.
+func (fi *FaultInjector) SetRules(rules ...FaultRule) {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	fi.rules = make([]*faultRuleState, 0, len(rules))
+	for _, rule := range rules {
+		fi.rules = append(fi.rules, &faultRuleState{FaultRule: rule})
+	}
+}
+
+// SetCallHook makes fi call hook before every call it wraps, whether
+// or not it injects a fault into it.  A Simulation uses this to
+// sequence goroutines at each call.
+func (fi *FaultInjector) SetCallHook(
+	hook func(ctx context.Context, layer FaultLayer, op string)) {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	fi.hook = hook
+}
+
+// Injected returns how many faults were injected into each call, by
+// "layer.Op".
+func (fi *FaultInjector) Injected() map[string]int {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	injected := make(map[string]int, len(fi.injected))
+	for op, n := range fi.injected {
+		injected[op] = n
+	}
+	return injected
+}
+
+// String returns a summary of the injected faults, for logs.
+func (fi *FaultInjector) String() string {
+	injected := fi.Injected()
+	ops := make([]string, 0, len(injected))
+	for op, n := range injected {
+		ops = append(ops, fmt.Sprintf("%s=%d", op, n))
+	}
+	sort.Strings(ops)
+	return strings.Join(ops, " ")
+}
+
+// pick returns the rule to apply to a call, if any, and how long to
+// delay the call by.
+func (fi *FaultInjector) pick(layer FaultLayer, op string) (
+	rule FaultRule, delay time.Duration, ok bool) {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	for _, r := range fi.rules {
+		if !r.matches(layer, op) {
+			continue
+		}
+		r.matched++
+		if r.matched <= r.Skip || (r.Count > 0 && r.applied >= r.Count) {
+			continue
+		}
+		if r.Probability > 0 && fi.rng.Float64() >= r.Probability {
+			continue
+		}
+		r.applied++
+		fi.injected[fmt.Sprintf("%s.%s", layer, op)]++
+		delay = r.Delay
+		if r.Kind == FaultReorder && delay > 0 {
+			delay = time.Duration(fi.rng.Int63n(int64(delay)))
+		}
+		return r.FaultRule, delay, true
+	}
+	return FaultRule{}, 0, false
+}
+
+// do runs call, the layer.op call being wrapped, after injecting
+// whatever fault the rules call for.
+func (fi *FaultInjector) do(ctx context.Context, layer FaultLayer,
+	op string, call func(ctx context.Context) error) error {
+	fi.lock.Lock()
+	hook := fi.hook
+	fi.lock.Unlock()
+	if hook != nil {
+		hook(ctx, layer, op)
+	}
+	rule, delay, ok := fi.pick(layer, op)
+	if !ok {
+		return call(ctx)
+	}
+	if fi.log != nil {
+		fi.log.CDebugf(ctx, "Injecting %s fault into %s.%s",
+			rule.Kind, layer, op)
+	}
+	err := rule.Err
+	if err == nil {
+		err = FaultInjectedError{layer, op}
+	}
+	switch rule.Kind {
+	case FaultError:
+		return err
+	case FaultPartial:
+		if callErr := call(ctx); callErr != nil {
+			return callErr
+		}
+		return err
+	default:
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return call(ctx)
+	}
+}
+
+// InjectFaults wraps the MDOps, BlockOps, KeyOps and KeybaseService
+// of config so that calls through them go through fi.  It returns a
+// function that puts the unwrapped ones back.
+func InjectFaults(config Config, fi *FaultInjector) (undo func()) {
+	mdOps := config.MDOps()
+	blockOps := config.BlockOps()
+	keyOps := config.KeyOps()
+	service := config.KeybaseService()
+	config.SetMDOps(faultyMDOps{fi, mdOps})
+	config.SetBlockOps(faultyBlockOps{fi, blockOps})
+	config.SetKeyOps(faultyKeyOps{fi, keyOps})
+	config.SetKeybaseService(faultyKeybaseService{fi, service})
+	return func() {
+		config.SetMDOps(mdOps)
+		config.SetBlockOps(blockOps)
+		config.SetKeyOps(keyOps)
+		config.SetKeybaseService(service)
+	}
+}
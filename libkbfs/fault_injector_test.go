@@ -0,0 +1,135 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestParseFaultSchedule(t *testing.T) {
+	rules, err := ParseFaultSchedule(
+		"md.Put error=conflict prob=0.5 skip=2 count=1; block.* delay=10ms\n" +
+			"* reorder=1s;service.Identify partial")
+	require.NoError(t, err)
+	require.Equal(t, []FaultRule{
+		{
+			Layer:       FaultLayerMD,
+			Op:          "Put",
+			Kind:        FaultError,
+			Err:         faultErrors["conflict"],
+			Probability: 0.5,
+			Skip:        2,
+			Count:       1,
+		},
+		{Layer: FaultLayerBlock, Kind: FaultDelay, Delay: 10 * time.Millisecond},
+		{Kind: FaultReorder, Delay: time.Second},
+		{Layer: FaultLayerService, Op: "Identify", Kind: FaultPartial},
+	}, rules)
+
+	for _, s := range []string{
+		"md.Put", "disk.Put error", "md.Put error=nope",
+		"md.Put error delay=1s", "md.Put delay=soon", "md.Put color=red",
+	} {
+		_, err := ParseFaultSchedule(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestFaultInjectorRules(t *testing.T) {
+	ctx := context.Background()
+	fi := NewFaultInjector(1, nil, FaultRule{
+		Layer: FaultLayerMD,
+		Op:    "Put",
+		Kind:  FaultError,
+		Skip:  1,
+		Count: 2,
+	}, FaultRule{
+		Layer: FaultLayerMD,
+		Kind:  FaultPartial,
+		Err:   TimeoutError{},
+	})
+
+	calls := 0
+	call := func(context.Context) error {
+		calls++
+		return nil
+	}
+	// The first Put is skipped by the first rule, so the second
+	// one applies to it.
+	require.Equal(t, TimeoutError{},
+		fi.do(ctx, FaultLayerMD, "Put", call))
+	require.Equal(t, 1, calls)
+	for i := 0; i < 2; i++ {
+		require.Equal(t, FaultInjectedError{FaultLayerMD, "Put"},
+			fi.do(ctx, FaultLayerMD, "Put", call))
+	}
+	require.Equal(t, 1, calls)
+	// The first rule is used up.
+	require.Equal(t, TimeoutError{},
+		fi.do(ctx, FaultLayerMD, "Put", call))
+	require.Equal(t, 2, calls)
+	// No rule applies to block calls.
+	require.NoError(t, fi.do(ctx, FaultLayerBlock, "Get", call))
+	require.Equal(t, 3, calls)
+	require.Equal(t, map[string]int{"md.Put": 4}, fi.Injected())
+}
+
+func TestFaultInjectorSeeded(t *testing.T) {
+	ctx := context.Background()
+	outcomes := func(seed int64) (outcomes []bool) {
+		fi := NewFaultInjector(seed, nil, FaultRule{
+			Kind:        FaultError,
+			Probability: 0.5,
+		})
+		for i := 0; i < 20; i++ {
+			err := fi.do(ctx, FaultLayerKey, "GetTLFCryptKeyServerHalf",
+				func(context.Context) error { return nil })
+			outcomes = append(outcomes, err != nil)
+		}
+		return outcomes
+	}
+	require.Equal(t, outcomes(42), outcomes(42))
+	require.Contains(t, outcomes(42), true)
+	require.Contains(t, outcomes(42), false)
+}
+
+func TestFaultInjectorDelayCanceled(t *testing.T) {
+	fi := NewFaultInjector(1, nil, FaultRule{Kind: FaultDelay, Delay: time.Hour})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := fi.do(ctx, FaultLayerBlock, "Get", func(context.Context) error {
+		t.Fatal("Call made despite cancellation")
+		return nil
+	})
+	require.Equal(t, context.Canceled, err)
+}
+
+func TestInjectFaultsKBFSOps(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "jdoe")
+	defer CheckConfigAndShutdown(t, config)
+	ctx := BackgroundContextWithCancellationDelayer()
+	defer CleanupCancellationDelayer(ctx)
+	rootNode := GetRootNodeOrBust(t, config, "jdoe", false)
+
+	fi := NewFaultInjector(1, nil, FaultRule{
+		Layer: FaultLayerMD,
+		Op:    "Put",
+		Kind:  FaultError,
+		Count: 1,
+	})
+	undo := InjectFaults(config, fi)
+	defer undo()
+
+	kbfsOps := config.KBFSOps()
+	_, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.Equal(t, FaultInjectedError{FaultLayerMD, "Put"}, err)
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{"md.Put": 1}, fi.Injected())
+}
@@ -0,0 +1,277 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sort"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"golang.org/x/net/context"
+)
+
+// A file with more blocks than the BlockSplitter allows pointers to
+// in one indirect block gets more levels of indirect blocks: each
+// bottom-level one points to up to that many blocks of data, each one
+// above to up to that many below it, and so on up to the top block.
+// Every level is full except for the last block of each, so appending
+// to the file only rewrites the last indirect block of each level.
+// A pointer to a block whose own pointers lead to indirect blocks has
+// AtLeastTwoLevelsOfChildrenDataVer, or
+// CompressedTwoLevelsOfChildrenDataVer if it may lead to compressed
+// blocks.
+//
+// Reads walk down from the top block to the block of data at the
+// offset they want, so they only fetch the indirect blocks on the way
+// there, and the blocks are cached just as they are on the server.
+// Writes, and the internal operations that go over every block of a
+// file, see it as a single level of indirection instead: its top
+// block along with all the indirect blocks under it, with the
+// pointers to all of the blocks of data as its IPtrs, and the ones in
+// between as its parents.  That view is only kept as the dirty top
+// block while the file is being written.
+
+// fileBlockChildInfos returns the BlockInfos of all the blocks under
+// the given top block of a file.
+func fileBlockChildInfos(fblock *FileBlock) []BlockInfo {
+	if !fblock.IsInd {
+		return nil
+	}
+	infos := make([]BlockInfo, 0, len(fblock.IPtrs))
+	for _, iptr := range fblock.IPtrs {
+		infos = append(infos, iptr.BlockInfo)
+	}
+	for _, level := range fblock.parents {
+		for _, iptr := range level {
+			infos = append(infos, iptr.BlockInfo)
+		}
+	}
+	return infos
+}
+
+func indirectFilePtrsEqual(a, b []IndirectFilePtr) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].BlockInfo != b[i].BlockInfo || a[i].Off != b[i].Off ||
+			a[i].Holes != b[i].Holes {
+			return false
+		}
+	}
+	return true
+}
+
+// getFileTreeLocked retrieves the file block pointed to by ptr like
+// getFileBlockHelperLocked, but if it's the top block of a file with
+// more than one level of indirect blocks, it also retrieves all the
+// indirect blocks under it, and returns it as a single level of
+// indirection, with the pointers in between as its parents.  That
+// result isn't cached.
+func (fbo *folderBlockOps) getFileTreeLocked(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, ptr BlockPointer,
+	branch BranchName, p path) (*FileBlock, error) {
+	fbo.blockLock.AssertAnyLocked(lState)
+
+	top, err := fbo.getFileBlockHelperLocked(ctx, lState, kmd, ptr, branch, p)
+	if err != nil {
+		return nil, err
+	}
+	if !ptr.DataVer.hasTwoLevelsOfChildren() || !top.IsInd ||
+		top.parents != nil {
+		// A single level already, or a dirty top block that's
+		// already been put together.
+		return top, nil
+	}
+	if len(top.IPtrs) == 0 {
+		return nil, NotFileBlockError{ptr, branch, p}
+	}
+
+	// Every level is as deep as the others, so its first pointer
+	// tells whether the one below it is the last.  The blocks of
+	// each level are fetched in parallel.
+	level := top.IPtrs
+	var parents [][]IndirectFilePtr
+	for {
+		parents = append([][]IndirectFilePtr{level}, parents...)
+		ptrs := make([]BlockPointer, len(level))
+		for i, iptr := range level {
+			ptrs[i] = iptr.BlockPointer
+		}
+		// The indirect blocks are cached, so that unchanged ones can
+		// be recognized, and kept, when the file is next synced.
+		blocks, err := fbo.getBlocksHelperLocked(
+			ctx, lState, kmd, ptrs, branch, NewFileBlock)
+		if err != nil {
+			return nil, err
+		}
+		var next []IndirectFilePtr
+		for i, block := range blocks {
+			child, ok := block.(*FileBlock)
+			if !ok || !child.IsInd {
+				return nil, NotFileBlockError{ptrs[i], branch, p}
+			}
+			next = append(next, child.IPtrs...)
+		}
+		deeper := level[0].DataVer.hasTwoLevelsOfChildren()
+		level = next
+		if !deeper {
+			break
+		}
+	}
+
+	fblock := &FileBlock{
+		CommonBlock: CommonBlock{IsInd: true},
+		IPtrs:       level,
+		parents:     parents,
+	}
+	fblock.SetEncodedSize(top.GetEncodedSize())
+	return fblock, nil
+}
+
+// getLeafParentLocked returns the bottom-level indirect block, under
+// the top block fblock of file, whose pointers cover off.  That's
+// fblock itself unless the file has more than one level of indirect
+// blocks, and fblock is the top block as it is on the server; only
+// the indirect blocks on the way to off are fetched.
+func (fbo *folderBlockOps) getLeafParentLocked(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, file path, fblock *FileBlock,
+	off int64) (*FileBlock, error) {
+	fbo.blockLock.AssertAnyLocked(lState)
+
+	deeper := file.tailPointer().DataVer.hasTwoLevelsOfChildren()
+	if !deeper || !fblock.IsInd || fblock.parents != nil {
+		return fblock, nil
+	}
+	for deeper {
+		i := sort.Search(len(fblock.IPtrs), func(i int) bool {
+			return fblock.IPtrs[i].Off > off
+		}) - 1
+		if i < 0 {
+			i = 0
+		}
+		iptr := fblock.IPtrs[i]
+		child, err := fbo.getFileBlockLocked(
+			ctx, lState, kmd, iptr.BlockPointer, file, blockRead)
+		if err != nil {
+			return nil, err
+		}
+		if !child.IsInd {
+			return nil, NotFileBlockError{iptr.BlockPointer, file.Branch, file}
+		}
+		deeper = iptr.DataVer.hasTwoLevelsOfChildren()
+		fblock = child
+	}
+	return fblock, nil
+}
+
+// readyFileBlockMultiple readies fblock, the top block of a file, to
+// be put along with the other blocks in bps.  If it has too many
+// pointers for a single block, the indirect blocks between it and the
+// blocks of data are readied too, except for those whose pointers
+// didn't change and are on the latest key generation; with reuse
+// false, every one of them is rewritten.
+// fblock itself isn't modified: the block added to bps in its place
+// is the new top block, as it is on the server.
+func (fbo *folderBranchOps) readyFileBlockMultiple(ctx context.Context,
+	md *RootMetadata, fblock *FileBlock, uid keybase1.UID,
+	bps *blockPutState, reuse bool) (
+	info BlockInfo, plainSize int, err error) {
+	if !fblock.IsInd ||
+		(len(fblock.IPtrs) <= minPtrsPerBlock && fblock.parents == nil) {
+		return fbo.readyBlockMultiple(ctx, md.ReadOnly(), fblock, uid, bps)
+	}
+
+	maxPtrs := fbo.config.BlockSplitterForTLF(fbo.id()).MaxPtrsPerBlock()
+	if len(fblock.IPtrs) <= maxPtrs && fblock.parents == nil {
+		return fbo.readyBlockMultiple(ctx, md.ReadOnly(), fblock, uid, bps)
+	}
+	synced := *fblock
+	synced.parents = nil
+	kept := make(map[BlockPointer]bool)
+	level := fblock.IPtrs
+	bcache := fbo.config.BlockCache()
+	for depth := 0; len(level) > maxPtrs; depth++ {
+		old := make(map[int64]IndirectFilePtr)
+		if depth < len(fblock.parents) {
+			for _, iptr := range fblock.parents[depth] {
+				old[iptr.Off] = iptr
+			}
+		}
+		next := make([]IndirectFilePtr, 0, (len(level)+maxPtrs-1)/maxPtrs)
+		for start := 0; start < len(level); start += maxPtrs {
+			end := start + maxPtrs
+			if end > len(level) {
+				end = len(level)
+			}
+			block := &FileBlock{
+				CommonBlock: CommonBlock{IsInd: true},
+				IPtrs:       append([]IndirectFilePtr(nil), level[start:end]...),
+			}
+			iptr := IndirectFilePtr{Off: block.IPtrs[0].Off}
+			for _, child := range block.IPtrs {
+				iptr.Holes = iptr.Holes || child.Holes
+			}
+
+			// A block on an older key generation is rewritten, so
+			// re-encryption can't leave it behind.
+			if oldPtr, ok := old[iptr.Off]; reuse && ok &&
+				oldPtr.KeyGen == md.LatestKeyGeneration() {
+				if b, err := bcache.Get(oldPtr.BlockPointer); err == nil {
+					if ob, ok := b.(*FileBlock); ok &&
+						indirectFilePtrsEqual(ob.IPtrs, block.IPtrs) {
+						kept[oldPtr.BlockPointer] = true
+						iptr.BlockInfo = oldPtr.BlockInfo
+						next = append(next, iptr)
+						continue
+					}
+				}
+			}
+
+			newInfo, _, readyBlockData, err :=
+				fbo.blocks.ReadyBlock(ctx, md.ReadOnly(), block, uid)
+			if err != nil {
+				return BlockInfo{}, 0, err
+			}
+			if depth > 0 {
+				newInfo.DataVer =
+					newInfo.DataVer.withTwoLevelsOfChildren()
+			}
+			md.AddRefBlock(newInfo)
+			bps.addNewBlock(newInfo.BlockPointer, block, readyBlockData, nil)
+			iptr.BlockInfo = newInfo
+			next = append(next, iptr)
+		}
+		synced.parents = append(synced.parents, next)
+		level = next
+	}
+	for _, parents := range fblock.parents {
+		for _, iptr := range parents {
+			if !kept[iptr.BlockPointer] {
+				md.AddUnrefBlock(iptr.BlockInfo)
+			}
+		}
+	}
+	if synced.parents == nil {
+		fbo.log.CDebugf(ctx, "File with %d blocks is back to one level "+
+			"of indirect blocks", len(fblock.IPtrs))
+		return fbo.readyBlockMultiple(ctx, md.ReadOnly(), &synced, uid, bps)
+	}
+	fbo.log.CDebugf(ctx, "File with %d blocks has %d levels of "+
+		"indirect blocks; kept %d unchanged ones", len(fblock.IPtrs),
+		len(synced.parents)+1, len(kept))
+
+	top := &FileBlock{
+		CommonBlock: CommonBlock{IsInd: true},
+		IPtrs:       level,
+	}
+	info, plainSize, readyBlockData, err :=
+		fbo.blocks.ReadyBlock(ctx, md.ReadOnly(), top, uid)
+	if err != nil {
+		return BlockInfo{}, 0, err
+	}
+	info.DataVer = info.DataVer.withTwoLevelsOfChildren()
+	bps.addNewBlock(info.BlockPointer, top, readyBlockData, nil)
+	return info, plainSize, nil
+}
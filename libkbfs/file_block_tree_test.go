@@ -0,0 +1,162 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// getRawFileTreeOrBust reads the file block tree under ptr straight
+// from the block server, and returns the pointers to its indirect
+// blocks (other than the top one), along with the number of levels of
+// indirection.
+func getRawFileTreeOrBust(ctx context.Context, t *testing.T, config Config,
+	ops *folderBranchOps, ptr BlockPointer) (
+	indirect map[BlockPointer]bool, depth int) {
+	indirect = make(map[BlockPointer]bool)
+	kmd := ops.getHead(makeFBOLockState())
+	level := []BlockPointer{ptr}
+	for {
+		var next []BlockPointer
+		isInd := false
+		for _, p := range level {
+			fblock := NewFileBlock().(*FileBlock)
+			err := config.BlockOps().Get(ctx, kmd, p, fblock)
+			require.NoError(t, err)
+			require.True(t, len(fblock.IPtrs) <= minPtrsPerBlock)
+			if !fblock.IsInd {
+				continue
+			}
+			isInd = true
+			if p != ptr {
+				indirect[p] = true
+			}
+			for _, iptr := range fblock.IPtrs {
+				next = append(next, iptr.BlockPointer)
+			}
+		}
+		if !isInd {
+			return indirect, depth
+		}
+		depth++
+		level = next
+	}
+}
+
+func TestKBFSOpsMultiLevelFile(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	// Use the smallest possible block size, so that every indirect
+	// block holds just minPtrsPerBlock pointers.
+	bsplitter, err := NewBlockSplitterSimple(20, 8*1024, config.Codec())
+	require.NoError(t, err)
+	config.SetBlockSplitter(bsplitter)
+	require.Equal(t, minPtrsPerBlock, bsplitter.MaxPtrsPerBlock())
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "f", false, NoExcl)
+	require.NoError(t, err)
+	data := make([]byte, 1200)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	filePtr := func() BlockPointer {
+		return ops.nodeCache.PathFromNode(fileNode).tailPointer()
+	}
+	require.Equal(t, DataVer(AtLeastTwoLevelsOfChildrenDataVer),
+		filePtr().DataVer)
+	indirect, depth := getRawFileTreeOrBust(ctx, t, config, ops, filePtr())
+	require.True(t, depth > 2, "Only %d levels", depth)
+
+	// Another user, with nothing cached, reads from the middle of
+	// the file, which only fetches the indirect blocks on the way
+	// there.
+	config2 := ConfigAsUser(config, "test_user")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(t, config2, "test_user", false)
+	fileNode2, _, err := config2.KBFSOps().Lookup(ctx, rootNode2, "f")
+	require.NoError(t, err)
+	readahead := config2.MaxReadaheadBlocks()
+	config2.SetMaxReadaheadBlocks(0)
+	buf := make([]byte, 10)
+	n, err := config2.KBFSOps().Read(ctx, fileNode2, buf, 600)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(buf)), n)
+	require.True(t, bytes.Equal(data[600:610], buf))
+	fetched := 0
+	for p := range indirect {
+		if _, err := config2.BlockCache().Get(p); err == nil {
+			fetched++
+		}
+	}
+	require.Equal(t, depth-1, fetched)
+	config2.SetMaxReadaheadBlocks(readahead)
+
+	// Then it reads the whole file.
+	buf = make([]byte, len(data))
+	n, err = config2.KBFSOps().Read(ctx, fileNode2, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.True(t, bytes.Equal(data, buf))
+
+	// Overwriting the first byte only rewrites the indirect blocks
+	// leading to it.
+	data[0] = 0xff
+	err = kbfsOps.Write(ctx, fileNode, data[:1], 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	newIndirect, newDepth := getRawFileTreeOrBust(
+		ctx, t, config, ops, filePtr())
+	require.Equal(t, depth, newDepth)
+	require.Len(t, newIndirect, len(indirect))
+	changed := 0
+	for p := range newIndirect {
+		if !indirect[p] {
+			changed++
+		}
+	}
+	require.Equal(t, depth-1, changed)
+
+	// Appending keeps the tree balanced.
+	more := make([]byte, 300)
+	err = kbfsOps.Write(ctx, fileNode, more, int64(len(data)))
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	data = append(data, more...)
+	_, _ = getRawFileTreeOrBust(ctx, t, config, ops, filePtr())
+
+	err = config2.KBFSOps().SyncFromServerForTesting(
+		ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	buf = make([]byte, len(data))
+	n, err = config2.KBFSOps().Read(ctx, fileNode2, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.True(t, bytes.Equal(data, buf))
+
+	// Truncating the file back down leaves it with one level.
+	err = kbfsOps.Truncate(ctx, fileNode, 40)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	require.True(t, filePtr().DataVer < AtLeastTwoLevelsOfChildrenDataVer)
+	_, depth = getRawFileTreeOrBust(ctx, t, config, ops, filePtr())
+	require.Equal(t, 1, depth)
+}
@@ -0,0 +1,286 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"golang.org/x/net/context"
+)
+
+// FileVersion describes one version of a file's contents, as
+// returned by KBFSOps.GetFileHistory.
+type FileVersion struct {
+	// Revision is the merged TLF revision that made this version.
+	Revision MetadataRevision
+	// Mtime is the file's modification time as of this version.
+	Mtime  time.Time
+	Writer libkb.NormalizedUsername
+	Size   uint64
+}
+
+// walkFileHistory calls fn for each version of file, newest first,
+// until fn returns false or there are no more.  It follows the
+// file's top block pointer, and that of its parent directory, back
+// through the ops of each merged revision; a revision that changes
+// the file's pointer makes a new version.  The walk ends at the
+// revision that created the file, or at the first revision whose
+// directory can no longer be read (e.g., because its blocks have
+// been reclaimed).
+func (fbo *folderBranchOps) walkFileHistory(ctx context.Context,
+	lState *lockState, head ImmutableRootMetadata, file Node,
+	fn func(v FileVersion, ptr BlockPointer) bool) error {
+	if head.MergedStatus() != Merged {
+		return UnmergedError{}
+	}
+
+	filePath, err := fbo.pathFromNodeForRead(file)
+	if err != nil {
+		return err
+	}
+	if !filePath.hasValidParent() {
+		return NotFileError{filePath}
+	}
+	ptr := filePath.tailPointer()
+	parent := filePath.parentPath().tailPointer()
+
+	writerNames := make(map[keybase1.UID]libkb.NormalizedUsername)
+	currHead := head.Revision()
+	for currHead >= MetadataRevisionInitial {
+		startRev := currHead - maxMDsAtATime + 1
+		if startRev < MetadataRevisionInitial {
+			startRev = MetadataRevisionInitial
+		}
+		rmds, err := getMDRange(ctx, fbo.config, fbo.id(), NullBranchID,
+			startRev, currHead, Merged)
+		if err != nil {
+			return err
+		}
+		if len(rmds) == 0 {
+			return nil
+		}
+
+		for i := len(rmds) - 1; i >= 0; i-- {
+			rmd := rmds[i]
+			ptrAfter, parentAfter := ptr, parent
+			created := false
+			ops := rmd.data.Changes.Ops
+			for j := len(ops) - 1; j >= 0; j-- {
+				op := ops[j]
+				movedParent := false
+				switch realOp := op.(type) {
+				case *createOp:
+					for _, ref := range realOp.Refs() {
+						if ref == ptr {
+							created = true
+						}
+					}
+				case *renameOp:
+					if realOp.Renamed == ptr &&
+						realOp.NewDir != (blockUpdate{}) &&
+						realOp.NewDir.Ref == parent {
+						parent = realOp.OldDir.Unref
+						movedParent = true
+					}
+				}
+				for _, update := range op.AllUpdates() {
+					if update.Ref == ptr {
+						ptr = update.Unref
+					}
+					if !movedParent && update.Ref == parent {
+						parent = update.Unref
+					}
+				}
+			}
+			if ptr == ptrAfter && !created {
+				continue
+			}
+
+			// Look up the entry to find the version's size.
+			dblock, err := fbo.blocks.GetDirBlockForReading(ctx, lState,
+				head.ReadOnly(), parentAfter, fbo.branch(), path{})
+			if err != nil {
+				fbo.log.CDebugf(ctx, "Stopping file history at "+
+					"revision %d: %v", rmd.Revision(), err)
+				return nil
+			}
+			var de DirEntry
+			found := false
+			for _, child := range dblock.Children {
+				if child.BlockPointer == ptrAfter {
+					de, found = child, true
+					break
+				}
+			}
+			if !found {
+				return nil
+			}
+
+			uid := rmd.LastModifyingWriter()
+			writer, ok := writerNames[uid]
+			if !ok {
+				writer, err = fbo.config.KBPKI().GetNormalizedUsername(
+					ctx, uid)
+				if err != nil {
+					return err
+				}
+				writerNames[uid] = writer
+			}
+			v := FileVersion{
+				Revision: rmd.Revision(),
+				Mtime:    time.Unix(0, de.Mtime),
+				Writer:   writer,
+				Size:     de.Size,
+			}
+			if !fn(v, ptrAfter) || created {
+				return nil
+			}
+		}
+		currHead = rmds[0].Revision() - 1
+	}
+	return nil
+}
+
+// GetFileHistory implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) GetFileHistory(
+	ctx context.Context, file Node, limit int) (
+	versions []FileVersion, err error) {
+	fbo.log.CDebugf(ctx, "GetFileHistory %p %d", file.GetID(), limit)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return nil, err
+	}
+
+	lState := makeFBOLockState()
+	head, err := fbo.getMDForReadHelper(ctx, lState, mdReadNeedIdentify)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fbo.walkFileHistory(ctx, lState, head, file,
+		func(v FileVersion, _ BlockPointer) bool {
+			versions = append(versions, v)
+			return limit <= 0 || len(versions) < limit
+		})
+	if err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// FileVersionReader reads one version of a file, as returned by
+// KBFSOps.OpenFileAtRevision.  The version is looked up once, when
+// the reader is opened, so reads through it don't walk the folder's
+// history again.  Its revision stays pinned until Close, so quota
+// reclamation can't delete the version's blocks in the meantime.
+type FileVersionReader struct {
+	fbo     *folderBranchOps
+	md      ImmutableRootMetadata
+	file    path
+	version FileVersion
+
+	closeLock sync.Mutex
+	closed    bool
+}
+
+// OpenFileAtRevision implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) OpenFileAtRevision(
+	ctx context.Context, file Node, rev MetadataRevision) (
+	r *FileVersionReader, err error) {
+	fbo.log.CDebugf(ctx, "OpenFileAtRevision %p %d", file.GetID(), rev)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return nil, err
+	}
+
+	lState := makeFBOLockState()
+	head, err := fbo.getMDForReadHelper(ctx, lState, mdReadNeedIdentify)
+	if err != nil {
+		return nil, err
+	}
+
+	var version FileVersion
+	var ptr BlockPointer
+	err = fbo.walkFileHistory(ctx, lState, head, file,
+		func(v FileVersion, p BlockPointer) bool {
+			if v.Revision > rev {
+				return true
+			}
+			version, ptr = v, p
+			return false
+		})
+	if err != nil {
+		return nil, err
+	}
+	filePath, err := fbo.pathFromNodeForRead(file)
+	if err != nil {
+		return nil, err
+	}
+	if ptr == zeroPtr {
+		return nil, NoFileVersionError{filePath.tailName(), rev}
+	}
+
+	// Only the tail pointer is used to read the old blocks; the
+	// rest of the path is just for logging.
+	filePath.path[len(filePath.path)-1].BlockPointer = ptr
+	fbo.fbm.pinRevision(version.Revision)
+	return &FileVersionReader{
+		fbo:     fbo,
+		md:      head,
+		file:    filePath,
+		version: version,
+	}, nil
+}
+
+// Version returns the version of the file that the reader reads.
+func (r *FileVersionReader) Version() FileVersion {
+	return r.version
+}
+
+// Read reads from the version of the file, like KBFSOps.Read does
+// for the current version.
+func (r *FileVersionReader) Read(ctx context.Context, dest []byte,
+	off int64) (n int64, err error) {
+	fbo := r.fbo
+	fbo.log.CDebugf(ctx, "FileVersionReader.Read %d %d %d",
+		r.version.Revision, len(dest), off)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	r.closeLock.Lock()
+	closed := r.closed
+	r.closeLock.Unlock()
+	if closed {
+		return 0, FileVersionReaderClosedError{
+			r.file.tailName(), r.version.Revision}
+	}
+
+	if off >= int64(r.version.Size) {
+		return 0, nil
+	}
+	if rem := int64(r.version.Size) - off; int64(len(dest)) > rem {
+		dest = dest[:rem]
+	}
+	lState := makeFBOLockState()
+	return fbo.blocks.Read(ctx, lState, r.md.ReadOnly(), r.file, dest, off)
+}
+
+// Close releases the reader.  Reads through it fail afterwards.
+func (r *FileVersionReader) Close() {
+	r.closeLock.Lock()
+	defer r.closeLock.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	r.fbo.fbm.unpinRevision(r.version.Revision)
+}
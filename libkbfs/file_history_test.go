@@ -0,0 +1,85 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKBFSOpsFileHistory(t *testing.T) {
+	var userName libkb.NormalizedUsername = "u1"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, userName.String(), false)
+	kbfsOps := config.KBFSOps()
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	contents := []string{"hello", "hello, world", "bye"}
+	for i, data := range contents {
+		err = kbfsOps.Truncate(ctx, fileNode, 0)
+		require.NoError(t, err)
+		err = kbfsOps.Write(ctx, fileNode, []byte(data), 0)
+		require.NoError(t, err)
+		err = kbfsOps.Sync(ctx, fileNode)
+		require.NoError(t, err)
+		if i == 1 {
+			// Moving the file doesn't make a new version, or lose
+			// the old ones.
+			err = kbfsOps.Rename(ctx, rootNode, "a", dirNode, "b")
+			require.NoError(t, err)
+		}
+	}
+
+	versions, err := kbfsOps.GetFileHistory(ctx, fileNode, 0)
+	require.NoError(t, err)
+	require.Len(t, versions, len(contents)+1)
+	for i, v := range versions {
+		require.Equal(t, userName, v.Writer)
+		if i > 0 {
+			require.True(t, v.Revision < versions[i-1].Revision)
+		}
+	}
+	// The oldest version is the empty file that was created.
+	require.Equal(t, uint64(0), versions[len(contents)].Size)
+
+	for i, data := range contents {
+		v := versions[len(contents)-1-i]
+		require.Equal(t, uint64(len(data)), v.Size)
+		r, err := kbfsOps.OpenFileAtRevision(ctx, fileNode, v.Revision)
+		require.NoError(t, err)
+		require.Equal(t, v, r.Version())
+		// Read in small chunks, all through the one lookup.
+		var got []byte
+		buf := make([]byte, 2)
+		for off := int64(0); ; off += int64(len(buf)) {
+			n, err := r.Read(ctx, buf, off)
+			require.NoError(t, err)
+			if n == 0 {
+				break
+			}
+			got = append(got, buf[:n]...)
+		}
+		require.Equal(t, data, string(got))
+		r.Close()
+		_, err = r.Read(ctx, buf, 0)
+		require.IsType(t, FileVersionReaderClosedError{}, err)
+	}
+
+	limited, err := kbfsOps.GetFileHistory(ctx, fileNode, 2)
+	require.NoError(t, err)
+	require.Equal(t, versions[:2], limited)
+
+	_, err = kbfsOps.OpenFileAtRevision(
+		ctx, fileNode, versions[len(contents)].Revision-1)
+	require.IsType(t, NoFileVersionError{}, err)
+}
@@ -0,0 +1,90 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"math"
+
+	"golang.org/x/net/context"
+)
+
+// SyncStateXattrName is the name of a read-only extended attribute
+// that every file has, whose value is the String() of the file's
+// SyncState, for file managers to badge files with.  It isn't listed
+// by ListXattr.
+const SyncStateXattrName = "user.kbfs.sync_state"
+
+// SyncState says how far a file's writes have made it towards the
+// KBFS servers.
+type SyncState int
+
+const (
+	// SyncStateSynced means all of the file's writes are on the
+	// servers.
+	SyncStateSynced SyncState = iota
+	// SyncStateJournaled means all of the file's writes have been
+	// synced, but some are still in the local journal, waiting to
+	// be flushed to the servers.
+	SyncStateJournaled
+	// SyncStateDirty means the file has writes that are only in
+	// memory, and haven't been synced yet.
+	SyncStateDirty
+)
+
+func (s SyncState) String() string {
+	switch s {
+	case SyncStateSynced:
+		return "synced"
+	case SyncStateJournaled:
+		return "journaled"
+	case SyncStateDirty:
+		return "dirty"
+	default:
+		return fmt.Sprintf("SyncState(%d)", int(s))
+	}
+}
+
+// FileSyncState implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) FileSyncState(ctx context.Context, file Node) (
+	state SyncState, err error) {
+	fbo.log.CDebugf(ctx, "FileSyncState %p", file.GetID())
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %s %v", state, err) }()
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return SyncStateSynced, err
+	}
+	filePath, err := fbo.pathFromNodeForRead(file)
+	if err != nil {
+		return SyncStateSynced, err
+	}
+
+	lState := makeFBOLockState()
+	dirty, rev := fbo.blocks.GetSyncInfo(lState, filePath)
+	if dirty {
+		return SyncStateDirty, nil
+	}
+	if rev == MetadataRevisionUninitialized {
+		return SyncStateSynced, nil
+	}
+
+	// Whatever is older than the oldest revision still in the
+	// journal has been flushed, including everything if the journal
+	// is empty or disabled.
+	flushedBefore := MetadataRevision(math.MaxInt64)
+	if jServer, err := GetJournalServer(fbo.config); err == nil {
+		jStatus, err := jServer.JournalStatus(fbo.id())
+		if err == nil && jStatus.RevisionStart != MetadataRevisionUninitialized {
+			flushedBefore = jStatus.RevisionStart
+		}
+	}
+	fbo.blocks.ForgetSyncsBefore(lState, flushedBefore)
+	if rev >= flushedBefore {
+		return SyncStateJournaled, nil
+	}
+	return SyncStateSynced, nil
+}
@@ -0,0 +1,186 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func requireSyncState(t *testing.T, ctx context.Context, kbfsOps KBFSOps,
+	node Node, expected SyncState) {
+	state, err := kbfsOps.FileSyncState(ctx, node)
+	require.NoError(t, err)
+	require.Equal(t, expected, state)
+	value, err := kbfsOps.GetXattr(ctx, node, SyncStateXattrName)
+	require.NoError(t, err)
+	require.Equal(t, expected.String(), string(value))
+}
+
+func TestKBFSOpsFileSyncState(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	requireSyncState(t, ctx, kbfsOps, fileNode, SyncStateSynced)
+
+	err = kbfsOps.Write(ctx, fileNode, []byte("hello"), 0)
+	require.NoError(t, err)
+	requireSyncState(t, ctx, kbfsOps, fileNode, SyncStateDirty)
+
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	requireSyncState(t, ctx, kbfsOps, fileNode, SyncStateSynced)
+
+	// The attribute is read-only, and isn't listed.
+	err = kbfsOps.SetXattr(ctx, fileNode, SyncStateXattrName, []byte("x"))
+	require.IsType(t, ReadOnlyXattrError{}, err)
+	err = kbfsOps.RemoveXattr(ctx, fileNode, SyncStateXattrName)
+	require.IsType(t, ReadOnlyXattrError{}, err)
+	names, err := kbfsOps.ListXattr(ctx, fileNode)
+	require.NoError(t, err)
+	require.NotContains(t, names, SyncStateXattrName)
+}
+
+func TestKBFSOpsFileSyncStateJournaled(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "file_sync_state")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+	config.EnableJournaling(tempdir)
+	jServer, err := GetJournalServer(config)
+	require.NoError(t, err)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	tlfID := rootNode.GetFolderBranch().Tlf
+	err = jServer.Enable(ctx, tlfID, TLFJournalBackgroundWorkPaused)
+	require.NoError(t, err)
+
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte("hello"), 0)
+	require.NoError(t, err)
+	requireSyncState(t, ctx, kbfsOps, fileNode, SyncStateDirty)
+
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	requireSyncState(t, ctx, kbfsOps, fileNode, SyncStateJournaled)
+
+	err = jServer.Flush(ctx, tlfID)
+	require.NoError(t, err)
+	requireSyncState(t, ctx, kbfsOps, fileNode, SyncStateSynced)
+
+	// Let the journal flush whatever the flush above left behind,
+	// like archived references, before the shutdown state check.
+	jServer.ResumeBackgroundWork(ctx, tlfID)
+}
+
+func TestKBFSOpsSyncDurability(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "sync_durability")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+	config.EnableJournaling(tempdir)
+	jServer, err := GetJournalServer(config)
+	require.NoError(t, err)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	fb := rootNode.GetFolderBranch()
+	err = jServer.Enable(ctx, fb.Tlf, TLFJournalBackgroundWorkPaused)
+	require.NoError(t, err)
+
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	write := func(data string) {
+		err := kbfsOps.Write(ctx, fileNode, []byte(data), 0)
+		require.NoError(t, err)
+	}
+
+	// By default, a sync only waits for the journal.
+	write("hello")
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	requireSyncState(t, ctx, kbfsOps, fileNode, SyncStateJournaled)
+
+	// Asking for server durability flushes the paused journal.
+	write("world")
+	err = kbfsOps.SyncWithDurability(ctx, fileNode, WriteDurabilityServer)
+	require.NoError(t, err)
+	requireSyncState(t, ctx, kbfsOps, fileNode, SyncStateSynced)
+
+	// So does setting it for the whole TLF.
+	err = kbfsOps.SetSyncDurability(ctx, fb, WriteDurabilityServer)
+	require.NoError(t, err)
+	status, _, err := kbfsOps.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, "server", status.SyncDurability)
+	write("again")
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	requireSyncState(t, ctx, kbfsOps, fileNode, SyncStateSynced)
+
+	// Per-call durability overrides the TLF's.
+	write("local")
+	err = kbfsOps.SyncWithDurability(ctx, fileNode, WriteDurabilityLocal)
+	require.NoError(t, err)
+	requireSyncState(t, ctx, kbfsOps, fileNode, SyncStateJournaled)
+
+	// Let the journal flush whatever is left before the shutdown
+	// state check.
+	jServer.ResumeBackgroundWork(ctx, fb.Tlf)
+}
+
+func TestSyncDurabilityPersisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kbfs_sync_durability")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+	err = config.EnableTLFSettingsPersistence(dir)
+	require.NoError(t, err)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	fb := rootNode.GetFolderBranch()
+	err = config.KBFSOps().SetSyncDurability(ctx, fb, WriteDurabilityServer)
+	require.NoError(t, err)
+
+	config2 := ConfigAsUser(config, "test_user")
+	defer CheckConfigAndShutdown(t, config2)
+	err = config2.EnableTLFSettingsPersistence(dir)
+	require.NoError(t, err)
+	rootNode2 := GetRootNodeOrBust(t, config2, "test_user", false)
+	status, _, err := config2.KBFSOps().FolderStatus(
+		ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	require.Equal(t, "server", status.SyncDurability)
+
+	err = config2.KBFSOps().SetSyncDurability(
+		ctx, rootNode2.GetFolderBranch(), WriteDurabilityLocal)
+	require.NoError(t, err)
+	record, err := readTLFSettings(config2.Codec(), dir)
+	require.NoError(t, err)
+	require.Empty(t, record.Durability)
+}
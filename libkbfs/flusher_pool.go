@@ -0,0 +1,196 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultFlusherPoolSize is how many goroutines KBFSOpsStandard uses
+// to flush dirty files in the background, however many folders it
+// has.
+const defaultFlusherPoolSize = 4
+
+// flusherPool runs the background flushes of many folderBranchOps on
+// a fixed number of goroutines, so that a folder doesn't need a
+// flusher goroutine of its own.  Every period, each registered folder
+// with dirty files is queued for a flush; a folder can also queue a
+// forced flush of itself when the dirty buffer fills up.  A folder is
+// only ever flushed by one goroutine at a time.
+type flusherPool struct {
+	config       Config
+	size         int
+	wakeChan     chan struct{}
+	shutdownChan chan struct{}
+	startOnce    sync.Once
+	done         sync.WaitGroup
+
+	lock sync.Mutex
+	// fbos maps each registered folder to the progress of its
+	// flushes.
+	fbos map[*folderBranchOps]*flushProgress
+	// pending maps each queued folder to whether its flush is
+	// forced.
+	pending map[*folderBranchOps]bool
+	// busy holds the folders being flushed right now.
+	busy map[*folderBranchOps]bool
+}
+
+func newFlusherPool(config Config, size int) *flusherPool {
+	return &flusherPool{
+		config:       config,
+		size:         size,
+		wakeChan:     make(chan struct{}, 1),
+		shutdownChan: make(chan struct{}),
+		fbos:         make(map[*folderBranchOps]*flushProgress),
+		pending:      make(map[*folderBranchOps]bool),
+		busy:         make(map[*folderBranchOps]bool),
+	}
+}
+
+// start launches the goroutines of the pool.  It waits until the
+// first folder is added, so that the period reflects the config at
+// that point.
+func (p *flusherPool) start() {
+	p.done.Add(p.size + 1)
+	for i := 0; i < p.size; i++ {
+		go p.worker()
+	}
+	go p.ticker(backgroundFlushPeriod(p.config))
+}
+
+// add registers fbo for background flushes.
+func (p *flusherPool) add(fbo *folderBranchOps) {
+	p.startOnce.Do(p.start)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.fbos[fbo] = &flushProgress{}
+}
+
+// remove stops the background flushes of fbo.  A flush of it that's
+// already running finishes on its own, and fails once fbo is shut
+// down.
+func (p *flusherPool) remove(fbo *folderBranchOps) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.fbos, fbo)
+	delete(p.pending, fbo)
+}
+
+// queue asks for a background flush of fbo, and returns false if
+// one (at least as forced) is already queued, or fbo isn't
+// registered.
+func (p *flusherPool) queue(fbo *folderBranchOps, forced bool) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, ok := p.fbos[fbo]; !ok {
+		return false
+	}
+	if wasForced, ok := p.pending[fbo]; ok && (wasForced || !forced) {
+		return false
+	}
+	p.pending[fbo] = forced
+	p.wakeLocked()
+	return true
+}
+
+func (p *flusherPool) wakeLocked() {
+	select {
+	case p.wakeChan <- struct{}{}:
+	default:
+	}
+}
+
+// next takes a queued folder that isn't being flushed, and marks it
+// busy.  It returns a nil fbo if there is none.
+func (p *flusherPool) next() (
+	fbo *folderBranchOps, forced bool, progress *flushProgress) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for f, isForced := range p.pending {
+		if p.busy[f] {
+			continue
+		}
+		delete(p.pending, f)
+		p.busy[f] = true
+		if len(p.pending) > 0 {
+			// Let another goroutine help.
+			p.wakeLocked()
+		}
+		return f, isForced, p.fbos[f]
+	}
+	return nil, false, nil
+}
+
+func (p *flusherPool) finish(fbo *folderBranchOps) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.busy, fbo)
+	if len(p.pending) > 0 {
+		// A folder might have been skipped while it was busy.
+		p.wakeLocked()
+	}
+}
+
+func (p *flusherPool) worker() {
+	defer p.done.Done()
+	lState := makeFBOLockState()
+	for {
+		select {
+		case <-p.wakeChan:
+		case <-p.shutdownChan:
+			return
+		}
+		for {
+			fbo, forced, progress := p.next()
+			if fbo == nil {
+				break
+			}
+			fbo.flushInBackground(lState, forced, progress)
+			p.finish(fbo)
+			if fbo.needsForcedFlush(lState) {
+				p.queue(fbo, true)
+			}
+		}
+	}
+}
+
+func (p *flusherPool) ticker(betweenFlushes time.Duration) {
+	defer p.done.Done()
+	ticker := time.NewTicker(betweenFlushes)
+	defer ticker.Stop()
+	lState := makeFBOLockState()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.shutdownChan:
+			return
+		}
+		var fbos []*folderBranchOps
+		func() {
+			p.lock.Lock()
+			defer p.lock.Unlock()
+			fbos = make([]*folderBranchOps, 0, len(p.fbos))
+			for fbo := range p.fbos {
+				fbos = append(fbos, fbo)
+			}
+		}()
+		for _, fbo := range fbos {
+			if fbo.blocks.GetState(lState) == dirtyState {
+				p.queue(fbo, false)
+			}
+		}
+	}
+}
+
+// shutdown stops the goroutines of the pool, and waits for any
+// running flushes to finish.
+func (p *flusherPool) shutdown() {
+	// Make sure start can't run after this.
+	p.startOnce.Do(func() {})
+	close(p.shutdownChan)
+	p.done.Wait()
+}
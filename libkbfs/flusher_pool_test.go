@@ -0,0 +1,77 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlusherPoolFlushesFolders(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+	config.SetDoBackgroundFlushes(true)
+	config.SetBackgroundFlushAge(1 * time.Millisecond)
+
+	kbfsOps := config.KBFSOps().(*KBFSOpsStandard)
+	var ops []*folderBranchOps
+	for _, public := range []bool{false, true} {
+		rootNode := GetRootNodeOrBust(t, config, "test_user", public)
+		fileNode, _, err := kbfsOps.CreateFile(
+			ctx, rootNode, "a", false, NoExcl)
+		require.NoError(t, err)
+		err = kbfsOps.Write(ctx, fileNode, []byte{1}, 0)
+		require.NoError(t, err)
+		fbo := getOps(config, rootNode.GetFolderBranch().Tlf)
+		require.Equal(t, kbfsOps.flushers, fbo.flushers)
+		ops = append(ops, fbo)
+	}
+
+	// Both folders get flushed by the shared goroutines.
+	lState := makeFBOLockState()
+	deadline := time.Now().Add(10 * time.Second)
+	for _, fbo := range ops {
+		for fbo.blocks.GetState(lState) != cleanState {
+			require.True(t, time.Now().Before(deadline),
+				"Timed out waiting for the background flush")
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestFlusherPoolQueue(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+	fbo := getOps(config, GetRootNodeOrBust(
+		t, config, "test_user", false).GetFolderBranch().Tlf)
+
+	// Without starting any goroutines, check what gets queued.
+	p := newFlusherPool(config, 1)
+	require.False(t, p.queue(fbo, false))
+	p.fbos[fbo] = &flushProgress{}
+	require.True(t, p.queue(fbo, false))
+	require.False(t, p.queue(fbo, false))
+	// A forced flush upgrades a queued one, once.
+	require.True(t, p.queue(fbo, true))
+	require.False(t, p.queue(fbo, true))
+
+	f, forced, _ := p.next()
+	require.Equal(t, fbo, f)
+	require.True(t, forced)
+	// A busy folder can be queued again, but isn't handed out
+	// until it's done.
+	require.True(t, p.queue(fbo, false))
+	f, _, _ = p.next()
+	require.Nil(t, f)
+	p.finish(fbo)
+	f, forced, _ = p.next()
+	require.Equal(t, fbo, f)
+	require.False(t, forced)
+
+	p.remove(fbo)
+	require.False(t, p.queue(fbo, true))
+}
@@ -18,6 +18,7 @@ type fbmHelper interface {
 	getMostRecentFullyMergedMD(ctx context.Context) (
 		ImmutableRootMetadata, error)
 	finalizeGCOp(ctx context.Context, gco *gcOp) error
+	expireTrash(ctx context.Context) error
 }
 
 const (
@@ -106,6 +107,14 @@ type folderBlockManager struct {
 	reclamationCancelLock sync.Mutex
 	reclamationCancel     context.CancelFunc
 
+	// The background goroutines are only started once there's
+	// something for them to do, so that a folder this device never
+	// writes to doesn't keep three idle goroutines around.
+	archiveStart   sync.Once
+	deleteStart    sync.Once
+	reclaimStart   sync.Once
+	reclaimEnabled bool
+
 	helper fbmHelper
 
 	// Remembers what happened last time during quota reclamation.
@@ -114,6 +123,11 @@ type folderBlockManager struct {
 	lastQROldEnoughRev  MetadataRevision
 	wasLastQRComplete   bool
 	lastReclamationTime time.Time
+
+	// pinnedRevs counts the open read snapshots of each revision.
+	// QR won't reclaim blocks that any of them can still see.
+	pinnedRevsLock sync.Mutex
+	pinnedRevs     map[MetadataRevision]int
 }
 
 func newFolderBlockManager(config Config, fb FolderBranch,
@@ -131,18 +145,44 @@ func newFolderBlockManager(config Config, fb FolderBranch,
 		blocksToDeletePauseChan: make(chan (<-chan struct{})),
 		forceReclamationChan:    make(chan struct{}, 1),
 		helper:                  helper,
-	}
-	// Pass in the BlockOps here so that the archive goroutine
-	// doesn't do possibly-racy-in-tests access to
-	// fbm.config.BlockOps().
-	go fbm.archiveBlocksInBackground()
-	go fbm.deleteBlocksInBackground()
-	if fb.Branch == MasterBranch {
-		go fbm.reclaimQuotaInBackground()
+		pinnedRevs:              make(map[MetadataRevision]int),
+		reclaimEnabled:          fb.Branch == MasterBranch,
 	}
 	return fbm
 }
 
+// startArchiving starts the archive goroutine if it isn't running
+// yet.  Only this device's own writes need archiving, and only a
+// writer can reclaim quota, so this is also when quota reclamation
+// starts.
+func (fbm *folderBlockManager) startArchiving() {
+	fbm.archiveStart.Do(func() { go fbm.archiveBlocksInBackground() })
+	fbm.startReclaiming()
+}
+
+// startDeleting starts the goroutine that deletes blocks left over
+// from failed writes, if it isn't running yet.
+func (fbm *folderBlockManager) startDeleting() {
+	fbm.deleteStart.Do(func() { go fbm.deleteBlocksInBackground() })
+}
+
+// startReclaiming starts the quota reclamation goroutine if it isn't
+// running yet, and this is the master branch.
+func (fbm *folderBlockManager) startReclaiming() {
+	if !fbm.reclaimEnabled {
+		return
+	}
+	fbm.reclaimStart.Do(func() { go fbm.reclaimQuotaInBackground() })
+}
+
+// hasPendingWork returns true if any archives, deletes or quota
+// reclamations are queued or in progress.
+func (fbm *folderBlockManager) hasPendingWork() bool {
+	return fbm.archiveGroup.count() > 0 ||
+		fbm.blocksToDeleteWaitGroup.count() > 0 ||
+		fbm.reclamationGroup.count() > 0
+}
+
 func (fbm *folderBlockManager) setBlocksToDeleteCancel(cancel context.CancelFunc) {
 	fbm.blocksToDeleteCancelLock.Lock()
 	defer fbm.blocksToDeleteCancelLock.Unlock()
@@ -240,12 +280,14 @@ func (fbm *folderBlockManager) cleanUpBlockState(
 }
 
 func (fbm *folderBlockManager) enqueueBlocksToDelete(toDelete blocksToDelete) {
+	fbm.startDeleting()
 	fbm.blocksToDeleteWaitGroup.Add(1)
 	fbm.blocksToDeleteChan <- toDelete
 }
 
 func (fbm *folderBlockManager) enqueueBlocksToDeleteAfterShortDelay(
 	toDelete blocksToDelete) {
+	fbm.startDeleting()
 	fbm.blocksToDeleteWaitGroup.Add(1)
 	time.AfterFunc(deleteBlocksRetryDelay,
 		func() {
@@ -271,6 +313,7 @@ func (fbm *folderBlockManager) enqueueBlocksToDeleteAfterShortDelay(
 //    drains it is waiting for sending on the same channel.
 // 5. Deadlock!
 func (fbm *folderBlockManager) enqueueBlocksToDeleteNoWait(toDelete blocksToDelete) {
+	fbm.startDeleting()
 	fbm.blocksToDeleteWaitGroup.Add(1)
 
 	select {
@@ -288,6 +331,7 @@ func (fbm *folderBlockManager) archiveUnrefBlocks(md ReadOnlyRootMetadata) {
 		return
 	}
 
+	fbm.startArchiving()
 	fbm.archiveGroup.Add(1)
 	fbm.archiveChan <- md
 }
@@ -303,6 +347,7 @@ func (fbm *folderBlockManager) archiveUnrefBlocksNoWait(md ReadOnlyRootMetadata)
 		return
 	}
 
+	fbm.startArchiving()
 	fbm.archiveGroup.Add(1)
 
 	// Don't block if the channel is full; instead do the send in a
@@ -330,6 +375,7 @@ func (fbm *folderBlockManager) waitForQuotaReclamations(
 }
 
 func (fbm *folderBlockManager) forceQuotaReclamation() {
+	fbm.startReclaiming()
 	fbm.reclamationGroup.Add(1)
 	select {
 	case fbm.forceReclamationChan <- struct{}{}:
@@ -352,8 +398,9 @@ func (fbm *folderBlockManager) doChunkedDowngrades(ctx context.Context,
 	numChunks := (len(ptrs) + numPointersToDowngradePerChunk - 1) /
 		numPointersToDowngradePerChunk
 	numWorkers := numChunks
-	if numWorkers > maxParallelBlockPuts {
-		numWorkers = maxParallelBlockPuts
+	parallelism := fbm.config.BlockTransferMeter().PutParallelism()
+	if numWorkers > parallelism {
+		numWorkers = parallelism
 	}
 	chunks := make(chan []BlockPointer, numChunks)
 
@@ -643,6 +690,37 @@ func (fbm *folderBlockManager) deleteBlocksInBackground() {
 	}
 }
 
+// pinRevision keeps QR from reclaiming any block that's referenced
+// as of rev, until a matching unpinRevision.
+func (fbm *folderBlockManager) pinRevision(rev MetadataRevision) {
+	fbm.pinnedRevsLock.Lock()
+	defer fbm.pinnedRevsLock.Unlock()
+	fbm.pinnedRevs[rev]++
+}
+
+func (fbm *folderBlockManager) unpinRevision(rev MetadataRevision) {
+	fbm.pinnedRevsLock.Lock()
+	defer fbm.pinnedRevsLock.Unlock()
+	fbm.pinnedRevs[rev]--
+	if fbm.pinnedRevs[rev] <= 0 {
+		delete(fbm.pinnedRevs, rev)
+	}
+}
+
+// oldestPinnedRevision returns the earliest pinned revision, or
+// MetadataRevisionUninitialized if none are pinned.
+func (fbm *folderBlockManager) oldestPinnedRevision() MetadataRevision {
+	fbm.pinnedRevsLock.Lock()
+	defer fbm.pinnedRevsLock.Unlock()
+	oldest := MetadataRevisionUninitialized
+	for rev := range fbm.pinnedRevs {
+		if oldest == MetadataRevisionUninitialized || rev < oldest {
+			oldest = rev
+		}
+	}
+	return oldest
+}
+
 func (fbm *folderBlockManager) isOldEnough(rmd ReadOnlyRootMetadata) bool {
 	// Trust the client-provided timestamp -- it's
 	// possible that a writer with a bad clock could cause
@@ -909,6 +987,12 @@ func (fbm *folderBlockManager) doReclamation(timer *time.Timer) (err error) {
 		return NewWriteAccessError(head.GetTlfHandle(), username)
 	}
 
+	// Trash entries expire with time, whether or not anything else
+	// has changed.
+	if err := fbm.helper.expireTrash(ctx); err != nil {
+		fbm.log.CDebugf(ctx, "Couldn't expire the trash: %v", err)
+	}
+
 	if !fbm.isQRNecessary(head.ReadOnly()) {
 		// Nothing has changed since last time, so no need to do any QR.
 		return nil
@@ -957,11 +1041,21 @@ func (fbm *folderBlockManager) doReclamation(timer *time.Timer) (err error) {
 	if err != nil {
 		return err
 	}
+	// Blocks unreferenced after a pinned revision are still visible
+	// to a read snapshot, so leave them for a later QR.
+	pinned := false
+	if pinnedRev := fbm.oldestPinnedRevision(); pinnedRev !=
+		MetadataRevisionUninitialized && mostRecentOldEnoughRev > pinnedRev {
+		fbm.log.CDebugf(ctx, "Not reclaiming past revision %d, which "+
+			"is pinned by a read snapshot", pinnedRev)
+		mostRecentOldEnoughRev = pinnedRev
+		pinned = true
+	}
 	if mostRecentOldEnoughRev == MetadataRevisionUninitialized ||
 		mostRecentOldEnoughRev <= lastGCRev {
 		// TODO: need a log level more fine-grained than Debug to
 		// print out that we're not doing reclamation.
-		complete = true
+		complete = !pinned
 		return nil
 	}
 
@@ -985,7 +1079,8 @@ func (fbm *folderBlockManager) doReclamation(timer *time.Timer) (err error) {
 	if err != nil {
 		return err
 	}
-	if len(ptrs) == 0 && !shortened {
+	complete = complete && !pinned
+	if len(ptrs) == 0 && !shortened && !pinned {
 		complete = true
 		return nil
 	}
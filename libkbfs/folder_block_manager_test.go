@@ -58,7 +58,8 @@ func testQuotaReclamation(t *testing.T, ctx context.Context, config Config,
 		t.Fatalf("Couldn't get blocks: %v", err)
 	}
 
-	ops := kbfsOps.(*KBFSOpsStandard).getOpsByNode(ctx, rootNode)
+	ops, release := kbfsOps.(*KBFSOpsStandard).getOpsByNode(ctx, rootNode)
+	defer release()
 	ops.fbm.forceQuotaReclamation()
 	err = ops.fbm.waitForQuotaReclamations(ctx)
 	if err != nil {
@@ -177,7 +178,8 @@ func TestQuotaReclamationIncrementalReclamation(t *testing.T) {
 	clock.Set(now.Add(2 * config.QuotaReclamationMinUnrefAge()))
 
 	// Run it.
-	ops := kbfsOps.(*KBFSOpsStandard).getOpsByNode(ctx, rootNode)
+	ops, release := kbfsOps.(*KBFSOpsStandard).getOpsByNode(ctx, rootNode)
+	defer release()
 	ops.fbm.forceQuotaReclamation()
 	err := ops.fbm.waitForQuotaReclamations(ctx)
 	if err != nil {
@@ -326,7 +328,8 @@ func TestQuotaReclamationDeletedBlocks(t *testing.T) {
 	}
 
 	clock.Set(now.Add(2 * config1.QuotaReclamationMinUnrefAge()))
-	ops1 := kbfsOps1.(*KBFSOpsStandard).getOpsByNode(ctx, rootNode1)
+	ops1, release := kbfsOps1.(*KBFSOpsStandard).getOpsByNode(ctx, rootNode1)
+	defer release()
 	ops1.fbm.forceQuotaReclamation()
 	err = ops1.fbm.waitForQuotaReclamations(ctx)
 	if err != nil {
@@ -500,7 +503,8 @@ func TestQuotaReclamationFailAfterRekeyRequest(t *testing.T) {
 	}
 
 	// Make sure QR returns an error.
-	ops := config2Dev2.KBFSOps().(*KBFSOpsStandard).getOpsByNode(ctx, rootNode1)
+	ops, release := config2Dev2.KBFSOps().(*KBFSOpsStandard).getOpsByNode(ctx, rootNode1)
+	defer release()
 	timer := time.NewTimer(config2Dev2.QuotaReclamationPeriod())
 	ops.fbm.reclamationGroup.Add(1)
 	err = ops.fbm.doReclamation(timer)
@@ -6,6 +6,8 @@ package libkbfs
 
 import (
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/keybase/client/go/logger"
@@ -34,6 +36,31 @@ const (
 	blockWrite
 )
 
+const (
+	// maxReadaheadBlocksDefault is the default for
+	// Config.MaxReadaheadBlocks.
+	maxReadaheadBlocksDefault = 32
+	// maxReadaheadFiles is the most files whose read pattern is
+	// tracked at once.
+	maxReadaheadFiles = 256
+)
+
+// fileReadahead is the recent read pattern of one file.
+type fileReadahead struct {
+	// path is the file's path, for reporting.
+	path string
+	// nextOff is where the next read starts if the reader is
+	// sequential.
+	nextOff int64
+	// window is how many child blocks past the one being read are
+	// prefetched.  It doubles with each sequential read, and drops
+	// to zero on a random one.
+	window int
+	// prefetchedThrough is the offset of the last child block that
+	// has been prefetched, or -1 if none has.
+	prefetchedThrough int64
+}
+
 type mdToCleanIfUnused struct {
 	md  ReadOnlyRootMetadata
 	bps *blockPutState
@@ -171,9 +198,9 @@ type folderBlockOps struct {
 	folderBranch FolderBranch
 	observers    *observerList
 
-	// forceSyncChan can be sent on to trigger an immediate
-	// Sync().  It is a blocking channel.
-	forceSyncChan chan<- struct{}
+	// forceSync triggers an immediate background Sync(), and
+	// returns false if one is already in progress or pending.
+	forceSync func() bool
 
 	// protects access to blocks in this folder and all fields
 	// below.
@@ -202,10 +229,33 @@ type folderBlockOps struct {
 	// set to true if this write or truncate should be deferred
 	doDeferWrite bool
 
+	// The MD revision that last synced each file, keyed by the
+	// file's pointer as of that sync, for as long as the revision
+	// might still be in the journal.
+	syncedRevs map[BlockPointer]MetadataRevision
+
+	// The bytes of the journals' disk budget that Allocate has set
+	// aside for each dirty file, keyed by the file's pointer, until
+	// the file starts syncing and its blocks take their place.
+	allocReserved map[BlockPointer]int64
+
+	// The dirty files whose only changes are Rewrites, keyed by
+	// the file's pointer.  Syncing one of them leaves its times
+	// alone, since its contents haven't changed.  Any other change
+	// to the file takes it out of the set.
+	rewriteOnly map[BlockPointer]bool
+
 	// nodeCache itself is goroutine-safe, but write/truncate must
 	// call PathFromNode() only under blockLock (see nodeCache
 	// comments in folder_branch_ops.go).
 	nodeCache NodeCache
+
+	// readaheadLock protects readahead, which holds the read
+	// pattern of recently-read files, keyed by their tail
+	// pointers.  It may be taken while holding blockLock, but not
+	// the other way around.
+	readaheadLock sync.Mutex
+	readahead     map[BlockPointer]*fileReadahead
 }
 
 // Only exported methods of folderBlockOps should be used outside of this
@@ -300,13 +350,91 @@ func (fbo *folderBlockOps) getBlockHelperLocked(ctx context.Context,
 	return block, nil
 }
 
+// getBlocksHelperLocked is like getBlockHelperLocked, but for
+// several blocks at once, of which up to the block transfer meter's
+// parallelism are fetched at the same time.  The blocks are returned
+// in the order of ptrs, and the fetched ones are cached.
+func (fbo *folderBlockOps) getBlocksHelperLocked(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, ptrs []BlockPointer,
+	branch BranchName, newBlock makeNewBlock) ([]Block, error) {
+	fbo.blockLock.AssertAnyLocked(lState)
+
+	blocks := make([]Block, len(ptrs))
+	var toFetch []int
+	for i, ptr := range ptrs {
+		if !ptr.IsValid() {
+			return nil, InvalidBlockRefError{ptr.ref()}
+		}
+		if block, err := fbo.getBlockFromDirtyOrCleanCache(
+			ptr, branch); err == nil {
+			blocks[i] = block
+			continue
+		}
+		blocks[i] = newBlock()
+		toFetch = append(toFetch, i)
+	}
+	if len(toFetch) == 0 {
+		return blocks, nil
+	}
+
+	numWorkers := fbo.config.BlockTransferMeter().GetParallelism()
+	if numWorkers > len(toFetch) {
+		numWorkers = len(toFetch)
+	}
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	indices := make(chan int, len(toFetch))
+	for _, i := range toFetch {
+		indices <- i
+	}
+	close(indices)
+	// The first error is the one that canceled the others.
+	errs := make(chan error, numWorkers)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	bops := fbo.config.BlockOps()
+	// As in getBlockHelperLocked, only unlock while waiting for the
+	// network if the lock is held for reading.
+	fbo.blockLock.DoRUnlockedIfPossible(lState, func(*lockState) {
+		var wg sync.WaitGroup
+		wg.Add(numWorkers)
+		for w := 0; w < numWorkers; w++ {
+			go func() {
+				defer wg.Done()
+				for i := range indices {
+					err := bops.Get(ctx, kmd, ptrs[i], blocks[i])
+					if err != nil {
+						errs <- err
+						cancel()
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	})
+	close(errs)
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+
+	for _, i := range toFetch {
+		if err := fbo.config.BlockCache().Put(ptrs[i], fbo.id(), blocks[i],
+			TransientEntry); err != nil {
+			return nil, err
+		}
+	}
+	return blocks, nil
+}
+
 // getFileBlockHelperLocked retrieves the block pointed to by ptr,
 // which must be valid, either from an internal cache, the block
 // cache, or from the server. An error is returned if the retrieved
 // block is not a file block.
 //
 // This must be called only by GetFileBlockForReading(),
-// getFileBlockLocked(), and getFileLocked().
+// getFileBlockLocked(), getFileLocked(), and getFileTreeLocked().
 //
 // p is used only when reporting errors and sending read
 // notifications, and can be empty.
@@ -373,6 +501,21 @@ func (fbo *folderBlockOps) getDirBlockHelperLocked(ctx context.Context,
 		return nil, NotDirBlockError{ptr, branch, p}
 	}
 
+	// A sharded directory is cached with all of its entries, so an
+	// indirect block without any is one just fetched; fetch its
+	// shards too, and cache the whole directory in its place.
+	if dblock.IsInd && len(dblock.Children) == 0 {
+		dblock, err = fbo.getDirShardsLocked(
+			ctx, lState, kmd, dblock, branch, p)
+		if err != nil {
+			return nil, err
+		}
+		if err := fbo.config.BlockCache().Put(ptr, fbo.id(), dblock,
+			TransientEntry); err != nil {
+			return nil, err
+		}
+	}
+
 	return dblock, nil
 }
 
@@ -382,7 +525,9 @@ func (fbo *folderBlockOps) getDirBlockHelperLocked(ctx context.Context,
 //
 // This should be called for "internal" operations, like conflict
 // resolution and state checking. "Real" operations should use
-// getFileBlockLocked() and getFileLocked() instead.
+// getFileBlockLocked() and getFileLocked() instead.  The top block of
+// a file with more than one level of indirect blocks comes back as a
+// single level, as getFileTreeLocked makes it.
 //
 // p is used only when reporting errors, and can be empty.
 func (fbo *folderBlockOps) GetFileBlockForReading(ctx context.Context,
@@ -390,7 +535,7 @@ func (fbo *folderBlockOps) GetFileBlockForReading(ctx context.Context,
 	branch BranchName, p path) (*FileBlock, error) {
 	fbo.blockLock.RLock(lState)
 	defer fbo.blockLock.RUnlock(lState)
-	return fbo.getFileBlockHelperLocked(ctx, lState, kmd, ptr, branch, p)
+	return fbo.getFileTreeLocked(ctx, lState, kmd, ptr, branch, p)
 }
 
 // GetDirBlockForReading retrieves the block pointed to by ptr, which
@@ -429,9 +574,9 @@ func (fbo *folderBlockOps) GetDirBlockForReading(ctx context.Context,
 // operation, it is the caller's responsibility to write that block
 // back to the cache as dirty.
 //
-// Note that blockLock must be locked exactly when rtype ==
-// blockWrite, and must be r-locked otherwise.  (This differs from
-// getDirLocked.)  This is because a write operation (like write,
+// Note that blockLock must be locked when rtype == blockWrite, and
+// at least r-locked otherwise; Rewrite reads under the write lock.
+// (This differs from getDirLocked.)  This is because a write operation (like write,
 // truncate and sync which lock blockLock) fetching a file block will
 // almost always need to modify that block, and so will pass in
 // blockWrite.
@@ -439,7 +584,7 @@ func (fbo *folderBlockOps) getFileBlockLocked(ctx context.Context,
 	lState *lockState, kmd KeyMetadata, ptr BlockPointer,
 	file path, rtype blockReqType) (*FileBlock, error) {
 	if rtype == blockRead {
-		fbo.blockLock.AssertRLocked(lState)
+		fbo.blockLock.AssertAnyLocked(lState)
 	} else {
 		fbo.blockLock.AssertLocked(lState)
 	}
@@ -450,8 +595,13 @@ func (fbo *folderBlockOps) getFileBlockLocked(ctx context.Context,
 		return nil, InvalidPathError{file}
 	}
 
-	fblock, err := fbo.getFileBlockHelperLocked(
-		ctx, lState, kmd, ptr, file.Branch, file)
+	// Writes change the pointers to the blocks of data in a file's
+	// top block, so they need all of them there.
+	getBlock := fbo.getFileBlockHelperLocked
+	if rtype == blockWrite {
+		getBlock = fbo.getFileTreeLocked
+	}
+	fblock, err := getBlock(ctx, lState, kmd, ptr, file.Branch, file)
 	if err != nil {
 		return nil, err
 	}
@@ -482,32 +632,21 @@ func (fbo *folderBlockOps) getFileLocked(ctx context.Context,
 }
 
 // GetIndirectFileBlockInfos returns a list of BlockInfos for all
-// indirect blocks of the given file. If the returned error is a
-// recoverable one (as determined by
-// isRecoverableBlockErrorForRemoval), the returned list may still be
-// non-empty, and holds all the BlockInfos for all found indirect
-// blocks. (This will be relevant when we handle multiple levels of
-// indirection.)
+// indirect blocks of the given file, at every level.  If the returned
+// error is a recoverable one (as determined by
+// isRecoverableBlockErrorForRemoval), the returned list is empty.
 func (fbo *folderBlockOps) GetIndirectFileBlockInfos(ctx context.Context,
 	lState *lockState, kmd KeyMetadata, file path) ([]BlockInfo, error) {
-	// TODO: handle multiple levels of indirection.
 	fBlock, err := func() (*FileBlock, error) {
 		fbo.blockLock.RLock(lState)
 		defer fbo.blockLock.RUnlock(lState)
-		return fbo.getFileBlockLocked(
-			ctx, lState, kmd, file.tailPointer(), file, blockRead)
+		return fbo.getFileTreeLocked(
+			ctx, lState, kmd, file.tailPointer(), file.Branch, file)
 	}()
 	if err != nil {
 		return nil, err
 	}
-	if !fBlock.IsInd {
-		return nil, nil
-	}
-	blockInfos := make([]BlockInfo, len(fBlock.IPtrs))
-	for i, ptr := range fBlock.IPtrs {
-		blockInfos[i] = ptr.BlockInfo
-	}
-	return blockInfos, nil
+	return fileBlockChildInfos(fBlock), nil
 }
 
 // getDirLocked retrieves the block pointed to by the tail pointer of
@@ -596,18 +735,17 @@ func (fbo *folderBlockOps) getFileBlockAtOffsetLocked(ctx context.Context,
 	startOff = 0
 	// search until it's not an indirect block
 	for block.IsInd {
+		// Find the last ptr starting at or before off.  The first
+		// ptr always has an offset at the beginning of the range,
+		// so there always is one.  Appends, which land in the last
+		// ptr, are the common case, so check that one first, and
+		// otherwise search rather than scan, since a big file has
+		// a lot of them.
 		nextIndex := len(block.IPtrs) - 1
-		for i, ptr := range block.IPtrs {
-			if ptr.Off == off {
-				// small optimization to avoid iterating past the right ptr
-				nextIndex = i
-				break
-			} else if ptr.Off > off {
-				// i can never be 0, because the first ptr always has
-				// an offset at the beginning of the range
-				nextIndex = i - 1
-				break
-			}
+		if block.IPtrs[nextIndex].Off > off {
+			nextIndex = sort.Search(len(block.IPtrs), func(i int) bool {
+				return block.IPtrs[i].Off > off
+			}) - 1
 		}
 		nextPtr := block.IPtrs[nextIndex]
 		parentBlock = block
@@ -659,6 +797,8 @@ func (fbo *folderBlockOps) updateWithDirtyEntriesLocked(ctx context.Context,
 			}
 		}
 
+		// The dirty entry may predate any new hard links.
+		de.Nlink = v.Nlink
 		dblockCopy.Children[k] = de
 	}
 
@@ -756,11 +896,31 @@ func (fbo *folderBlockOps) GetDirtyParentAndEntry(
 // file must have a valid parent.
 func (fbo *folderBlockOps) getDirtyEntryLocked(ctx context.Context,
 	lState *lockState, kmd KeyMetadata, file path) (DirEntry, error) {
-	// TODO: Since we only need a single DirEntry, avoid having to
-	// look up every entry in the DirBlock.
-	_, de, err := fbo.getDirtyParentAndEntryLocked(
-		ctx, lState, kmd, file, blockRead)
-	return de, err
+	fbo.blockLock.AssertAnyLocked(lState)
+
+	if !file.hasValidParent() {
+		return DirEntry{}, InvalidParentPathError{file}
+	}
+
+	// Only look up the one entry, rather than copying the whole
+	// parent block with every dirty entry in it, since this is
+	// called on every write.
+	dblock, err := fbo.getDirLocked(
+		ctx, lState, kmd, *file.parentPath(), blockRead)
+	if err != nil {
+		return DirEntry{}, err
+	}
+	name := file.tailName()
+	de, ok := dblock.Children[name]
+	if !ok {
+		return DirEntry{}, NoSuchNameError{name}
+	}
+	if dirtyDe, ok := fbo.deCache[de.ref()]; ok {
+		// The dirty entry may predate any new hard links.
+		dirtyDe.Nlink = de.Nlink
+		return dirtyDe, nil
+	}
+	return de, nil
 }
 
 // GetDirtyEntry returns the possibly-dirty DirEntry of the given file
@@ -826,13 +986,10 @@ func (fbo *folderBlockOps) newRightBlockLocked(
 	rblock := &FileBlock{}
 
 	newPtr := BlockPointer{
-		ID:      newRID,
-		KeyGen:  kmd.LatestKeyGeneration(),
-		DataVer: DefaultNewBlockDataVersion(fbo.config, false),
-		BlockContext: BlockContext{
-			Creator:  uid,
-			RefNonce: zeroBlockRefNonce,
-		},
+		ID:           newRID,
+		KeyGen:       kmd.LatestKeyGeneration(),
+		DataVer:      DefaultNewBlockDataVersion(fbo.config, false),
+		BlockContext: makeFirstBlockContext(uid),
 	}
 
 	pblock.IPtrs = append(pblock.IPtrs, IndirectFilePtr{
@@ -854,6 +1011,133 @@ func (fbo *folderBlockOps) newRightBlockLocked(
 	return nil
 }
 
+// maxTailBlocks is how many blocks that aren't full can pile up at
+// the end of a file, from appends synced one after another, before
+// they're compacted into full blocks.
+const maxTailBlocks = 8
+
+// blockIsFull returns whether bsplit wouldn't let anything more be
+// appended to block.
+func blockIsFull(bsplit BlockSplitter, block *FileBlock) bool {
+	n := len(block.Contents)
+	scratch := &FileBlock{Contents: block.Contents[:n:n]}
+	return bsplit.CopyUntilSplit(scratch, true, []byte{0}, int64(n)) == 0
+}
+
+// prepareAppendLocked readies file for a write that appends to it,
+// if that's the first write since the file was synced.  Rather than
+// dirtying the last block again, which the next sync would then put
+// in full, it starts a new tail block for the appended bytes, so
+// each sync of an appending file only puts the bytes appended since
+// the last one, along with the indirect blocks that point to them.
+// Once maxTailBlocks partial blocks have piled up at the end of the
+// file, they're compacted into full blocks instead, which later
+// appends leave alone.  It returns the blocks it dirtied, and how
+// many bytes they hold.
+func (fbo *folderBlockOps) prepareAppendLocked(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, file path, fblock *FileBlock,
+	de DirEntry, si *syncInfo) (
+	dirtyPtrs []BlockPointer, dirtiedBytes int64, err error) {
+	fbo.blockLock.AssertLocked(lState)
+
+	if !fblock.IsInd || fblock.hasHoles() {
+		return nil, 0, nil
+	}
+	top := file.tailPointer()
+	if df := fbo.dirtyFiles[top]; df != nil && df.isBlockSyncing(top) {
+		return nil, 0, nil
+	}
+	dirtyBcache := fbo.config.DirtyBlockCache()
+	isClean := func(iptr IndirectFilePtr) bool {
+		return iptr.EncodedSize > 0 &&
+			!dirtyBcache.IsDirty(fbo.id(), iptr.BlockPointer, file.Branch)
+	}
+	last := len(fblock.IPtrs) - 1
+	if !isClean(fblock.IPtrs[last]) {
+		// The file has been written since it was synced.
+		return nil, 0, nil
+	}
+
+	bsplit := fbo.config.BlockSplitterForTLF(fbo.id())
+	first := last + 1
+	var tail [][]byte
+	for i := last; i >= 0 && len(tail) < maxTailBlocks; i-- {
+		if !isClean(fblock.IPtrs[i]) {
+			break
+		}
+		block, err := fbo.getFileBlockLocked(ctx, lState, kmd,
+			fblock.IPtrs[i].BlockPointer, file, blockRead)
+		if err != nil {
+			return nil, 0, err
+		}
+		if blockIsFull(bsplit, block) {
+			break
+		}
+		tail = append([][]byte{block.Contents}, tail...)
+		first = i
+	}
+	if len(tail) == 0 {
+		// The last block is full, so the write starts a new one
+		// anyway.
+		return nil, 0, nil
+	}
+
+	if len(tail) < maxTailBlocks {
+		err := fbo.newRightBlockLocked(
+			ctx, lState, top, file, fblock, int64(de.Size), kmd)
+		if err != nil {
+			return nil, 0, err
+		}
+		return []BlockPointer{fblock.IPtrs[last+1].BlockPointer, top}, 0, nil
+	}
+
+	fbo.log.CDebugf(ctx, "Compacting %d partial blocks at the end of %v",
+		len(tail), top)
+	var data []byte
+	for _, contents := range tail {
+		data = append(data, contents...)
+	}
+	for _, iptr := range fblock.IPtrs[first:] {
+		si.unrefs = append(si.unrefs, iptr.BlockInfo)
+	}
+	fblock.IPtrs = fblock.IPtrs[:first+1]
+	fblock.IPtrs[first].EncodedSize = 0
+	ptr := fblock.IPtrs[first].BlockPointer
+	block := &FileBlock{}
+	if err := fbo.cacheBlockIfNotYetDirtyLocked(
+		lState, ptr, file, block); err != nil {
+		return nil, 0, err
+	}
+	off := fblock.IPtrs[first].Off
+	for {
+		n := bsplit.CopyUntilSplit(
+			block, true, data, int64(len(block.Contents)))
+		data = data[n:]
+		off += n
+		dirtiedBytes += int64(len(block.Contents))
+		dirtyPtrs = append(dirtyPtrs, ptr)
+		if len(data) == 0 {
+			break
+		}
+		err := fbo.newRightBlockLocked(
+			ctx, lState, top, file, fblock, off, kmd)
+		if err != nil {
+			return nil, 0, err
+		}
+		ptr = fblock.IPtrs[len(fblock.IPtrs)-1].BlockPointer
+		b, err := dirtyBcache.Get(fbo.id(), ptr, file.Branch)
+		if err != nil {
+			return nil, 0, err
+		}
+		block = b.(*FileBlock)
+	}
+	if err := fbo.cacheBlockIfNotYetDirtyLocked(
+		lState, top, file, fblock); err != nil {
+		return nil, 0, err
+	}
+	return append(dirtyPtrs, top), dirtiedBytes, nil
+}
+
 func (fbo *folderBlockOps) getOrCreateSyncInfoLocked(
 	lState *lockState, de DirEntry) (*syncInfo, error) {
 	fbo.blockLock.AssertLocked(lState)
@@ -1033,14 +1317,21 @@ func (fbo *folderBlockOps) PrepRename(
 // The amount that the read timeout is smaller than the global one.
 const readTimeoutSmallerBy = 2 * time.Second
 
-// Read reads from the given file into the given buffer at the given
-// offset. It returns the number of bytes read and nil, or 0 and the
-// error if there was one.
-func (fbo *folderBlockOps) Read(
+// zeroContents backs the slices that ReadSlices returns for holes.
+// It must never be modified.
+var zeroContents = make([]byte, 64*1024)
+
+// readLocked reads up to n bytes from the given file at the given
+// offset, passing them, in order, to emit.  The data passed to emit
+// may be the contents of a cached block; if dirty is false, it's a
+// clean block that will never be modified, but if dirty is true, it
+// may be modified once blockLock is released.  emit must not modify
+// the data either way.  It returns the number of bytes passed to
+// emit.
+func (fbo *folderBlockOps) readLocked(
 	ctx context.Context, lState *lockState, kmd KeyMetadata, file path,
-	dest []byte, off int64) (int64, error) {
-	fbo.blockLock.RLock(lState)
-	defer fbo.blockLock.RUnlock(lState)
+	off, n int64, emit func(data []byte, dirty bool)) (int64, error) {
+	fbo.blockLock.AssertAnyLocked(lState)
 
 	// getFileLocked already checks read permissions
 	fblock, err := fbo.getFileLocked(ctx, lState, kmd, file, blockRead)
@@ -1063,12 +1354,11 @@ func (fbo *folderBlockOps) Read(
 	}
 
 	nRead := int64(0)
-	n := int64(len(dest))
 
 	for nRead < n {
 		nextByte := nRead + off
 		toRead := n - nRead
-		_, _, _, block, nextBlockOff, startOff, err := fbo.getFileBlockAtOffsetLocked(
+		ptr, _, _, block, nextBlockOff, startOff, err := fbo.getFileBlockAtOffsetLocked(
 			ctx, lState, kmd, file, fblock, nextByte, blockRead)
 		if err != nil {
 			// If we hit a timeout while reading then return the bytes already read
@@ -1096,10 +1386,15 @@ func (fbo *folderBlockOps) Read(
 					fbo.log.CErrorf(ctx, "Read invalid file fill <= 0 while reading hole")
 					return nRead, BadSplitError{}
 				}
-				for i := 0; i < int(fill); i++ {
-					dest[int(nRead)+i] = 0
+				for fill > 0 {
+					chunk := fill
+					if chunk > int64(len(zeroContents)) {
+						chunk = int64(len(zeroContents))
+					}
+					emit(zeroContents[:chunk], false)
+					nRead += chunk
+					fill -= chunk
 				}
-				nRead += fill
 				continue
 			}
 			return nRead, nil
@@ -1108,14 +1403,188 @@ func (fbo *folderBlockOps) Read(
 		}
 
 		firstByteToRead := nextByte - startOff
-		copy(dest[nRead:nRead+toRead],
-			block.Contents[firstByteToRead:toRead+firstByteToRead])
+		dirty := fbo.config.DirtyBlockCache().IsDirty(
+			fbo.id(), ptr, file.Branch)
+		emit(block.Contents[firstByteToRead:toRead+firstByteToRead], dirty)
 		nRead += toRead
 	}
 
 	return n, nil
 }
 
+// Read reads from the given file into the given buffer at the given
+// offset. It returns the number of bytes read and nil, or 0 and the
+// error if there was one.
+func (fbo *folderBlockOps) Read(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file path,
+	dest []byte, off int64) (int64, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	nCopied := 0
+	return fbo.readLocked(ctx, lState, kmd, file, off, int64(len(dest)),
+		func(data []byte, _ bool) {
+			nCopied += copy(dest[nCopied:], data)
+		})
+}
+
+// ReadSlices reads up to n bytes from the given file at the given
+// offset, like Read, but without copying them into a buffer where
+// possible.  Instead it returns, in order, slices that may share
+// memory with clean cached blocks, or with each other.  Clean blocks
+// are never modified, so the slices stay valid even once the blocks
+// are evicted from the cache; data from dirty blocks is copied
+// instead.  The caller must not modify the returned slices.
+func (fbo *folderBlockOps) ReadSlices(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file path,
+	off, n int64) ([][]byte, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	var slices [][]byte
+	_, err := fbo.readLocked(ctx, lState, kmd, file, off, n,
+		func(data []byte, dirty bool) {
+			if dirty {
+				data = append([]byte(nil), data...)
+			}
+			slices = append(slices, data)
+		})
+	if err != nil {
+		return nil, err
+	}
+	return slices, nil
+}
+
+// ReadAhead records that a user read n bytes from the given file at
+// the given offset, and returns the pointers of the child blocks that
+// should be prefetched next.  Sequential reads scale the prefetch
+// window up, while any random read shrinks it back to zero.
+func (fbo *folderBlockOps) ReadAhead(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file path,
+	off, n int64) ([]BlockPointer, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	fbo.readaheadLock.Lock()
+	defer fbo.readaheadLock.Unlock()
+
+	ptr := file.tailPointer()
+	ra, ok := fbo.readahead[ptr]
+	if !ok {
+		if fbo.readahead == nil {
+			fbo.readahead = make(map[BlockPointer]*fileReadahead)
+		} else if len(fbo.readahead) >= maxReadaheadFiles {
+			// Forget some arbitrary file to make room.
+			for p := range fbo.readahead {
+				delete(fbo.readahead, p)
+				break
+			}
+		}
+		// A reader starting at the beginning of the file counts as
+		// sequential.
+		ra = &fileReadahead{prefetchedThrough: -1}
+		fbo.readahead[ptr] = ra
+	}
+	ra.path = file.String()
+
+	if n <= 0 {
+		return nil, nil
+	}
+	maxWindow := fbo.config.MaxReadaheadBlocks()
+	if off != ra.nextOff {
+		if ra.window > 0 {
+			fbo.log.CDebugf(ctx, "Random read of %v at %d; "+
+				"stopping readahead", ptr, off)
+		}
+		ra.window = 0
+		ra.prefetchedThrough = -1
+	} else if ra.window == 0 {
+		ra.window = 1
+	} else if ra.window < maxWindow {
+		ra.window *= 2
+	}
+	if ra.window > maxWindow {
+		// Also turns readahead off if maxWindow is zero or less.
+		ra.window = maxWindow
+		if ra.window < 0 {
+			ra.window = 0
+		}
+	}
+	ra.nextOff = off + n
+	if ra.window == 0 {
+		return nil, nil
+	}
+
+	// Blocks of a dirty file may not be on the server yet.
+	if fbo.config.DirtyBlockCache().IsDirty(fbo.id(), ptr, file.Branch) {
+		return nil, nil
+	}
+	fblock, err := fbo.getFileLocked(ctx, lState, kmd, file, blockRead)
+	if err != nil {
+		return nil, err
+	}
+	if !fblock.IsInd {
+		return nil, nil
+	}
+
+	// In a file with more levels of indirection, readahead stops at
+	// the end of the bottom-level indirect block the read is in.
+	fblock, err = fbo.getLeafParentLocked(
+		ctx, lState, kmd, file, fblock, ra.nextOff)
+	if err != nil {
+		return nil, err
+	}
+	next := len(fblock.IPtrs)
+	for i, iptr := range fblock.IPtrs {
+		if iptr.Off >= ra.nextOff {
+			next = i
+			break
+		}
+	}
+	end := next + ra.window
+	if end > len(fblock.IPtrs) {
+		end = len(fblock.IPtrs)
+	}
+	var ptrs []BlockPointer
+	for _, iptr := range fblock.IPtrs[next:end] {
+		if iptr.Off <= ra.prefetchedThrough {
+			continue
+		}
+		ptrs = append(ptrs, iptr.BlockPointer)
+		ra.prefetchedThrough = iptr.Off
+	}
+	return ptrs, nil
+}
+
+// Prefetch fetches the given file blocks into the block cache, in
+// parallel, unless they're there already.  It stops at the first
+// error.
+func (fbo *folderBlockOps) Prefetch(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, ptrs []BlockPointer,
+	branch BranchName) error {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	_, err := fbo.getBlocksHelperLocked(
+		ctx, lState, kmd, ptrs, branch, NewFileBlock)
+	return err
+}
+
+// getReadaheadWindows returns the current readahead window, in
+// blocks, of each file whose read pattern is being tracked, keyed by
+// path.
+func (fbo *folderBlockOps) getReadaheadWindows() map[string]int {
+	fbo.readaheadLock.Lock()
+	defer fbo.readaheadLock.Unlock()
+	if len(fbo.readahead) == 0 {
+		return nil
+	}
+	windows := make(map[string]int, len(fbo.readahead))
+	for _, ra := range fbo.readahead {
+		windows[ra.path] = ra.window
+	}
+	return windows
+}
+
 func (fbo *folderBlockOps) maybeWaitOnDeferredWrites(
 	ctx context.Context, lState *lockState, file Node,
 	c DirtyPermChan) error {
@@ -1216,13 +1685,10 @@ func (fbo *folderBlockOps) createIndirectBlockLocked(lState *lockState,
 			{
 				BlockInfo: BlockInfo{
 					BlockPointer: BlockPointer{
-						ID:      newID,
-						KeyGen:  kmd.LatestKeyGeneration(),
-						DataVer: dver,
-						BlockContext: BlockContext{
-							Creator:  uid,
-							RefNonce: zeroBlockRefNonce,
-						},
+						ID:           newID,
+						KeyGen:       kmd.LatestKeyGeneration(),
+						DataVer:      dver,
+						BlockContext: makeFirstBlockContext(uid),
 					},
 					EncodedSize: 0,
 				},
@@ -1266,13 +1732,32 @@ func (fbo *folderBlockOps) writeDataLocked(
 			FileTooBigError{file, sz, fbo.config.MaxFileBytes()}
 	}
 
+	// Writing far enough past the end of the file leaves a hole,
+	// just like an extending truncate would, rather than filling
+	// the gap with zeroes.
+	de, err := fbo.getDirtyEntryLocked(ctx, lState, kmd, file)
+	if err != nil {
+		return WriteRange{}, nil, 0, err
+	}
+	if int64(de.Size)+truncateExtendCutoffPoint < off {
+		_, dirtyPtrs, err = fbo.truncateExtendLocked(
+			ctx, lState, kmd, file, uint64(off))
+		if err != nil {
+			return WriteRange{}, dirtyPtrs, 0, err
+		}
+		de, err = fbo.getDirtyEntryLocked(ctx, lState, kmd, file)
+		if err != nil {
+			return WriteRange{}, nil, 0, err
+		}
+	}
+
 	fblock, uid, err := fbo.writeGetFileLocked(ctx, lState, kmd, file)
 	if err != nil {
 		return WriteRange{}, nil, 0, err
 	}
 
 	dirtyBcache := fbo.config.DirtyBlockCache()
-	bsplit := fbo.config.BlockSplitter()
+	bsplit := fbo.config.BlockSplitterForTLF(fbo.id())
 	n := int64(len(data))
 	nCopied := int64(0)
 	df := fbo.getOrCreateDirtyFileLocked(lState, file)
@@ -1281,21 +1766,11 @@ func (fbo *folderBlockOps) writeDataLocked(
 		// even on an error, since the previously-dirty bytes stay in
 		// the cache.
 		df.updateNotYetSyncingBytes(newlyDirtiedChildBytes)
-		if dirtyBcache.ShouldForceSync(fbo.id()) {
-			select {
-			// If we can't send on the channel, that means a sync is
-			// already in progress.
-			case fbo.forceSyncChan <- struct{}{}:
-				fbo.log.CDebugf(ctx, "Forcing a sync due to full buffer")
-			default:
-			}
+		if dirtyBcache.ShouldForceSync(fbo.id()) && fbo.forceSync() {
+			fbo.log.CDebugf(ctx, "Forcing a sync due to full buffer")
 		}
 	}()
 
-	de, err := fbo.getDirtyEntryLocked(ctx, lState, kmd, file)
-	if err != nil {
-		return WriteRange{}, nil, 0, err
-	}
 	if de.BlockPointer != file.tailPointer() {
 		fbo.log.CDebugf(ctx, "DirEntry and file tail pointer don't match: "+
 			"%v vs %v", de.BlockPointer, file.tailPointer())
@@ -1306,6 +1781,15 @@ func (fbo *folderBlockOps) writeDataLocked(
 	if err != nil {
 		return WriteRange{}, nil, 0, err
 	}
+	if off == int64(de.Size) && n > 0 {
+		tailPtrs, tailBytes, err := fbo.prepareAppendLocked(
+			ctx, lState, kmd, file, fblock, de, si)
+		if err != nil {
+			return WriteRange{}, nil, newlyDirtiedChildBytes, err
+		}
+		dirtyPtrs = append(dirtyPtrs, tailPtrs...)
+		newlyDirtiedChildBytes += tailBytes
+	}
 	for nCopied < n {
 		ptr, parentBlock, indexInParent, block, nextBlockOff, startOff, err :=
 			fbo.getFileBlockAtOffsetLocked(
@@ -1330,10 +1814,6 @@ func (fbo *folderBlockOps) writeDataLocked(
 		nCopied += bsplit.CopyUntilSplit(block, nextBlockOff < 0, data[nCopied:max],
 			off+nCopied-startOff)
 
-		// TODO: support multiple levels of indirection.  Right now the
-		// code only does one but it should be straightforward to
-		// generalize, just annoying
-
 		// if we need another block but there are no more, then make one
 		switchToIndirect := false
 		if nCopied < n && nextBlockOff < 0 {
@@ -1380,8 +1860,11 @@ func (fbo *folderBlockOps) writeDataLocked(
 		// Nothing was copied, no need to dirty anything.  This can
 		// happen when trying to append to the contents of the file
 		// (i.e., either to the end of the file or right before the
-		// "hole"), and the last block is already full.
-		if nCopied == oldNCopied && !switchToIndirect {
+		// "hole"), and the last block is already full.  A write
+		// into a hole can pad the block with zeroes without copying
+		// anything into it, though, and then it's still dirty.
+		if nCopied == oldNCopied && !switchToIndirect &&
+			oldLen == len(block.Contents) {
 			continue
 		}
 
@@ -1404,8 +1887,12 @@ func (fbo *folderBlockOps) writeDataLocked(
 			newlyDirtiedChildBytes -= int64(oldLen)
 		}
 
-		if parentBlock != nil {
-			// remember how many bytes it was
+		if parentBlock != nil &&
+			parentBlock.IPtrs[indexInParent].EncodedSize > 0 {
+			// remember how many bytes it was.  A block that's
+			// already dirty has nothing left to unref, and
+			// skipping it keeps appends to the same block from
+			// growing the unrefs with every write.
 			si.unrefs = append(si.unrefs,
 				parentBlock.IPtrs[indexInParent].BlockInfo)
 			parentBlock.IPtrs[indexInParent].EncodedSize = 0
@@ -1470,6 +1957,7 @@ func (fbo *folderBlockOps) Write(
 	if err != nil {
 		return err
 	}
+	delete(fbo.rewriteOnly, filePath.tailPointer())
 
 	defer func() {
 		fbo.doDeferWrite = false
@@ -1552,10 +2040,6 @@ func (fbo *folderBlockOps) truncateExtendLocked(
 		fbo.log.CDebugf(ctx, "truncateExtendLocked: new zero data block %v", fblock.IPtrs[0].BlockPointer)
 	}
 
-	// TODO: support multiple levels of indirection.  Right now the
-	// code only does one but it should be straightforward to
-	// generalize, just annoying
-
 	err = fbo.newRightBlockLocked(ctx, lState, file.tailPointer(),
 		file, fblock, int64(size), kmd)
 	if err != nil {
@@ -1599,14 +2083,9 @@ func (fbo *folderBlockOps) truncateExtendLocked(
 	dirtyPtrs = append(dirtyPtrs, file.tailPointer())
 	latestWrite := si.op.addTruncate(size)
 
-	if fbo.config.DirtyBlockCache().ShouldForceSync(fbo.id()) {
-		select {
-		// If we can't send on the channel, that means a sync is
-		// already in progress
-		case fbo.forceSyncChan <- struct{}{}:
-			fbo.log.CDebugf(ctx, "Forcing a sync due to full buffer")
-		default:
-		}
+	if fbo.config.DirtyBlockCache().ShouldForceSync(fbo.id()) &&
+		fbo.forceSync() {
+		fbo.log.CDebugf(ctx, "Forcing a sync due to full buffer")
 	}
 
 	fbo.log.CDebugf(ctx, "truncateExtendLocked: done")
@@ -1614,9 +2093,113 @@ func (fbo *folderBlockOps) truncateExtendLocked(
 }
 
 // truncateExtendCutoffPoint is the amount of data in extending
-// truncate that will trigger the extending with a hole algorithm.
+// truncate, or in the gap before a write past the end of the file,
+// that will trigger the extending with a hole algorithm.
 const truncateExtendCutoffPoint = 128 * 1024
 
+// GetDataRanges returns the ranges of the given file that hold data,
+// as opposed to holes.  Only files that have been extended with a
+// hole need their child blocks fetched to find out.
+func (fbo *folderBlockOps) GetDataRanges(
+	ctx context.Context, lState *lockState, kmd KeyMetadata,
+	file path) ([]DataRange, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	de, err := fbo.getDirtyEntryLocked(ctx, lState, kmd, file)
+	if err != nil {
+		return nil, err
+	}
+	fblock, err := fbo.getFileLocked(ctx, lState, kmd, file, blockRead)
+	if err != nil {
+		return nil, err
+	}
+	if !fblock.hasHoles() {
+		if de.Size == 0 {
+			return nil, nil
+		}
+		return []DataRange{{0, de.Size}}, nil
+	}
+	fblock, err = fbo.getFileTreeLocked(
+		ctx, lState, kmd, file.tailPointer(), file.Branch, file)
+	if err != nil {
+		return nil, err
+	}
+
+	var ranges []DataRange
+	for i, iptr := range fblock.IPtrs {
+		block, err := fbo.getFileBlockLocked(
+			ctx, lState, kmd, iptr.BlockPointer, file, blockRead)
+		if err != nil {
+			return nil, err
+		}
+		start := uint64(iptr.Off)
+		end := start + uint64(len(block.Contents))
+		if i+1 < len(fblock.IPtrs) && end > uint64(fblock.IPtrs[i+1].Off) {
+			end = uint64(fblock.IPtrs[i+1].Off)
+		}
+		if end > de.Size {
+			end = de.Size
+		}
+		ranges = addDataRange(ranges, start, end)
+	}
+	return ranges, nil
+}
+
+// GetAllocatedSize returns roughly how many bytes of the given file
+// are backed by blocks, leaving out its holes, without fetching any
+// of its blocks of data.  Blocks that are cached count at their real
+// length; the rest count at their encoded size, capped by the space
+// before the next block, so the result can overstate a block's data
+// by its padding but never counts a hole.
+func (fbo *folderBlockOps) GetAllocatedSize(
+	ctx context.Context, lState *lockState, kmd KeyMetadata,
+	file path) (uint64, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	de, err := fbo.getDirtyEntryLocked(ctx, lState, kmd, file)
+	if err != nil {
+		return 0, err
+	}
+	fblock, err := fbo.getFileLocked(ctx, lState, kmd, file, blockRead)
+	if err != nil {
+		return 0, err
+	}
+	if !fblock.hasHoles() {
+		return de.Size, nil
+	}
+	fblock, err = fbo.getFileTreeLocked(
+		ctx, lState, kmd, file.tailPointer(), file.Branch, file)
+	if err != nil {
+		return 0, err
+	}
+
+	var total uint64
+	for i, iptr := range fblock.IPtrs {
+		start := uint64(iptr.Off)
+		if start >= de.Size {
+			break
+		}
+		end := de.Size
+		if i+1 < len(fblock.IPtrs) && end > uint64(fblock.IPtrs[i+1].Off) {
+			end = uint64(fblock.IPtrs[i+1].Off)
+		}
+		length := end - start
+		block, err := fbo.getBlockFromDirtyOrCleanCache(
+			iptr.BlockPointer, file.Branch)
+		if fb, ok := block.(*FileBlock); err == nil && ok {
+			if l := uint64(len(fb.Contents)); l < length {
+				length = l
+			}
+		} else if l := uint64(iptr.EncodedSize); l < length {
+			length = l
+		}
+		total += length
+	}
+	return total, nil
+}
+
 // Returns the set of newly-ID'd blocks created during this truncate
 // that might need to be cleaned up if the truncate is deferred.
 func (fbo *folderBlockOps) truncateLocked(
@@ -1734,12 +2317,142 @@ func (fbo *folderBlockOps) truncateLocked(
 	return &latestWrite, nil, newlyDirtiedChildBytes, nil
 }
 
+// punchHoleZeroChunkBytes is how many zeroes punchHoleLocked writes
+// at a time, which is about a block's worth.
+const punchHoleZeroChunkBytes = MaxBlockSizeBytesDefault
+
+// punchHoleLocked zeroes the part of the given range that's within
+// the file.  Child blocks that the range covers entirely are dropped
+// from files that can have holes, except for the first and last ones,
+// which mark where the file starts and ends; the rest of the range is
+// overwritten with zeroes.  Returns the set of newly-ID'd blocks
+// that might need to be cleaned up if the punch is deferred.
+func (fbo *folderBlockOps) punchHoleLocked(
+	ctx context.Context, lState *lockState, kmd KeyMetadata,
+	file path, off, length uint64) (*WriteRange, []BlockPointer, int64, error) {
+	if jServer, err := GetJournalServer(fbo.config); err == nil {
+		jServer.dirtyOpStart(fbo.id())
+		defer jServer.dirtyOpEnd(fbo.id())
+	}
+
+	fblock, _, err := fbo.writeGetFileLocked(ctx, lState, kmd, file)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	de, err := fbo.getDirtyEntryLocked(ctx, lState, kmd, file)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	end := off + length
+	if end > de.Size {
+		end = de.Size
+	}
+	if off >= end {
+		return nil, nil, 0, nil
+	}
+	si, err := fbo.getOrCreateSyncInfoLocked(lState, de)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	var zeroRanges []DataRange
+	var dirtyPtrs []BlockPointer
+	if !fblock.IsInd || !fblock.hasHoles() {
+		zeroRanges = []DataRange{{off, end - off}}
+	} else {
+		iptrs := make([]IndirectFilePtr, 0, len(fblock.IPtrs))
+		for i, iptr := range fblock.IPtrs {
+			start := uint64(iptr.Off)
+			spanEnd := de.Size
+			if i+1 < len(fblock.IPtrs) {
+				spanEnd = uint64(fblock.IPtrs[i+1].Off)
+			}
+			if i > 0 && i+1 < len(fblock.IPtrs) &&
+				off <= start && spanEnd <= end {
+				fbo.log.CDebugf(ctx, "punchHoleLocked: dropping block %v",
+					iptr.BlockPointer)
+				si.unrefs = append(si.unrefs, iptr.BlockInfo)
+				continue
+			}
+			iptrs = append(iptrs, iptr)
+			if spanEnd <= off || end <= start {
+				continue
+			}
+			block, err := fbo.getFileBlockLocked(
+				ctx, lState, kmd, iptr.BlockPointer, file, blockWrite)
+			if err != nil {
+				return nil, nil, 0, err
+			}
+			zeroStart, zeroEnd := start, start+uint64(len(block.Contents))
+			if zeroStart < off {
+				zeroStart = off
+			}
+			if zeroEnd > end {
+				zeroEnd = end
+			}
+			zeroRanges = addDataRange(zeroRanges, zeroStart, zeroEnd)
+		}
+
+		if len(iptrs) < len(fblock.IPtrs) {
+			fblock.IPtrs = iptrs
+			for i := range fblock.IPtrs {
+				fblock.IPtrs[i].Holes = true
+			}
+			// Always make the top block dirty, so we will sync the
+			// new set of indirect blocks.
+			err = fbo.cacheBlockIfNotYetDirtyLocked(lState,
+				file.tailPointer(), file, fblock)
+			if err != nil {
+				return nil, nil, 0, err
+			}
+			dirtyPtrs = append(dirtyPtrs, file.tailPointer())
+			de.EncodedSize = 0
+			fbo.deCache[file.tailPointer().ref()] = de
+		}
+	}
+
+	// Write the zeroes a block's worth at a time, so that punching a
+	// big hole in a file that can't have one doesn't need a buffer
+	// the size of the hole.
+	zeroes := make([]byte, punchHoleZeroChunkBytes)
+	var newlyDirtiedChildBytes int64
+	for _, r := range zeroRanges {
+		for zOff, zEnd := r.Off, r.Off+r.Len; zOff < zEnd; {
+			n := zEnd - zOff
+			if n > uint64(len(zeroes)) {
+				n = uint64(len(zeroes))
+			}
+			_, ptrs, bytes, err := fbo.writeDataLocked(
+				ctx, lState, kmd, file, zeroes[:n], int64(zOff))
+			if err != nil {
+				return nil, nil, newlyDirtiedChildBytes, err
+			}
+			dirtyPtrs = append(dirtyPtrs, ptrs...)
+			newlyDirtiedChildBytes += bytes
+			zOff += n
+		}
+	}
+
+	// To everyone else, this is the same as writing zeroes over the
+	// whole range.
+	latestWrite := si.op.addWrite(off, end-off)
+	return &latestWrite, dirtyPtrs, newlyDirtiedChildBytes, nil
+}
+
 // Truncate truncates or extends the given file to the given size.
 // May block if there is too much unflushed data; in that case, it
 // will be unblocked by a future sync.
 func (fbo *folderBlockOps) Truncate(
 	ctx context.Context, lState *lockState, kmd KeyMetadata,
 	file Node, size uint64) error {
+	return fbo.truncate(ctx, lState, kmd, file, size, false)
+}
+
+// truncate does the work of Truncate.  If extendOnly is true, it
+// leaves files that are already at least size bytes long alone.
+func (fbo *folderBlockOps) truncate(
+	ctx context.Context, lState *lockState, kmd KeyMetadata,
+	file Node, size uint64, extendOnly bool) error {
 	// If there is too much unflushed data, we should wait until some
 	// of it gets flush so our memory usage doesn't grow without
 	// bound.
@@ -1766,6 +2479,17 @@ func (fbo *folderBlockOps) Truncate(
 	if err != nil {
 		return err
 	}
+	delete(fbo.rewriteOnly, filePath.tailPointer())
+
+	if extendOnly {
+		de, err := fbo.getDirtyEntryLocked(ctx, lState, kmd, filePath)
+		if err != nil {
+			return err
+		}
+		if de.Size >= size {
+			return nil
+		}
+	}
 
 	defer func() {
 		fbo.doDeferWrite = false
@@ -1808,6 +2532,170 @@ func (fbo *folderBlockOps) Truncate(
 	return nil
 }
 
+// checkAllocateQuota returns BServerErrorOverQuota if writing length
+// more bytes would take the current user over their quota.  If the
+// quota can't be looked up right now, the writes that follow will
+// find out for themselves.
+func (fbo *folderBlockOps) checkAllocateQuota(
+	ctx context.Context, length uint64) error {
+	info, err := fbo.config.BlockServer().GetUserQuotaInfo(ctx)
+	if err != nil {
+		fbo.log.CDebugf(ctx, "Couldn't get quota info to "+
+			"preallocate: %v", err)
+		return nil
+	}
+	if info.Limit > 0 && info.UsedBytes()+int64(length) > info.Limit {
+		return BServerErrorOverQuota{
+			Msg:   "not enough quota left to preallocate",
+			Usage: info.UsedBytes(),
+			Limit: info.Limit,
+		}
+	}
+	return nil
+}
+
+// reserveAllocationLocked sets length bytes of the journals' disk
+// budget aside for the given file, if the TLF is journaled, until
+// the file next starts syncing.  Returns DiskLimitReachedError if the
+// journals don't have that much room left.
+func (fbo *folderBlockOps) reserveAllocationLocked(
+	lState *lockState, file path, length uint64) error {
+	fbo.blockLock.AssertLocked(lState)
+	jServer, err := GetJournalServer(fbo.config)
+	if err != nil {
+		return nil
+	}
+	if _, err := jServer.JournalStatus(fbo.id()); err != nil {
+		// Not journaled, so the writes don't take up local disk.
+		return nil
+	}
+	err = getDiskLimiter(fbo.config).reserveJournalBytes(int64(length))
+	if err != nil {
+		return err
+	}
+	fbo.allocReserved[file.tailPointer()] += int64(length)
+	return nil
+}
+
+// releaseAllocationLocked gives back the disk budget Allocate set
+// aside for the file with the given pointer, if any.
+func (fbo *folderBlockOps) releaseAllocationLocked(
+	lState *lockState, ptr BlockPointer) {
+	fbo.blockLock.AssertLocked(lState)
+	if n, ok := fbo.allocReserved[ptr]; ok {
+		getDiskLimiter(fbo.config).releaseJournalBytes(n)
+		delete(fbo.allocReserved, ptr)
+	}
+}
+
+// Allocate preallocates, or punches a hole in, the given range of
+// the file, according to mode.  KBFS never allocates blocks ahead of
+// time, since an unwritten range can just be a hole.  Instead,
+// preallocating checks that the user's quota has room for the range,
+// sets aside room for it in the journals' local disk budget until
+// the file next syncs, and waits for the dirty block cache to have
+// room for it, to apply any backpressure up front rather than in the
+// middle of the writes that follow.  It also extends the file unless
+// AllocateKeepSize is set.  May block if there is too much unflushed
+// data; in that case, it will be unblocked by a future sync.
+func (fbo *folderBlockOps) Allocate(
+	ctx context.Context, lState *lockState, kmd KeyMetadata,
+	file Node, off, length uint64, mode AllocateMode) error {
+	if mode&AllocatePunchHole != 0 && mode&AllocateKeepSize == 0 {
+		return InvalidAllocateModeError{mode}
+	}
+	if mode&AllocatePunchHole == 0 {
+		err := fbo.checkAllocateQuota(ctx, length)
+		if err != nil {
+			return err
+		}
+		err = func() error {
+			fbo.blockLock.Lock(lState)
+			defer fbo.blockLock.Unlock(lState)
+			filePath, err := fbo.pathFromNodeForBlockWriteLocked(
+				lState, file)
+			if err != nil {
+				return err
+			}
+			return fbo.reserveAllocationLocked(lState, filePath, length)
+		}()
+		if err != nil {
+			return err
+		}
+
+		if mode&AllocateKeepSize == 0 {
+			return fbo.truncate(ctx, lState, kmd, file, off+length, true)
+		}
+		c, err := fbo.config.DirtyBlockCache().RequestPermissionToDirty(
+			ctx, fbo.id(), int64(length))
+		if err != nil {
+			return err
+		}
+		defer fbo.config.DirtyBlockCache().UpdateUnsyncedBytes(
+			fbo.id(), -int64(length), false)
+		return fbo.maybeWaitOnDeferredWrites(ctx, lState, file, c)
+	}
+
+	// Assume the whole range will be dirtied, as it is for files
+	// that can't have holes.
+	c, err := fbo.config.DirtyBlockCache().RequestPermissionToDirty(ctx,
+		fbo.id(), int64(length))
+	if err != nil {
+		return err
+	}
+	defer fbo.config.DirtyBlockCache().UpdateUnsyncedBytes(fbo.id(),
+		-int64(length), false)
+	err = fbo.maybeWaitOnDeferredWrites(ctx, lState, file, c)
+	if err != nil {
+		return err
+	}
+
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+
+	filePath, err := fbo.pathFromNodeForBlockWriteLocked(lState, file)
+	if err != nil {
+		return err
+	}
+	delete(fbo.rewriteOnly, filePath.tailPointer())
+
+	defer func() {
+		fbo.doDeferWrite = false
+	}()
+
+	latestWrite, dirtyPtrs, newlyDirtiedChildBytes, err :=
+		fbo.punchHoleLocked(ctx, lState, kmd, filePath, off, length)
+	if err != nil {
+		return err
+	}
+
+	if latestWrite != nil {
+		fbo.observers.localChange(ctx, file, *latestWrite)
+	}
+
+	if fbo.doDeferWrite {
+		// There's an ongoing sync, and punching the hole altered
+		// dirty blocks that are in the process of syncing.  So, we
+		// have to punch it again once the sync is complete, using
+		// the new file path.
+		fbo.log.CDebugf(ctx, "Deferring a hole punch to file %v",
+			filePath.tailPointer())
+		fbo.deferredDirtyDeletes = append(fbo.deferredDirtyDeletes,
+			dirtyPtrs...)
+		fbo.deferredWrites = append(fbo.deferredWrites,
+			func(ctx context.Context, lState *lockState, kmd KeyMetadata, f path) error {
+				df := fbo.getOrCreateDirtyFileLocked(lState, filePath)
+				df.updateNotYetSyncingBytes(-newlyDirtiedChildBytes)
+
+				_, _, _, err := fbo.punchHoleLocked(
+					ctx, lState, kmd, f, off, length)
+				return err
+			})
+	}
+
+	return nil
+}
+
 // IsDirty returns whether the given file is dirty; if false is
 // returned, then the file doesn't need to be synced.
 func (fbo *folderBlockOps) IsDirty(lState *lockState, file path) bool {
@@ -1820,6 +2708,8 @@ func (fbo *folderBlockOps) IsDirty(lState *lockState, file path) bool {
 func (fbo *folderBlockOps) clearCacheInfoLocked(lState *lockState,
 	file path) error {
 	fbo.blockLock.AssertLocked(lState)
+	fbo.releaseAllocationLocked(lState, file.tailPointer())
+	delete(fbo.rewriteOnly, file.tailPointer())
 	ref := file.tailPointer().ref()
 	delete(fbo.deCache, ref)
 	delete(fbo.unrefCache, ref)
@@ -1841,6 +2731,26 @@ func (fbo *folderBlockOps) ClearCacheInfo(lState *lockState, file path) error {
 	return fbo.clearCacheInfoLocked(lState, file)
 }
 
+// ReleaseDirtyBytes stops counting file's dirty data against the
+// dirty buffer, but keeps the dirty blocks and the cached entry, so
+// that the data stays visible through any open handles.  It's for
+// removed files whose data has been saved elsewhere.
+func (fbo *folderBlockOps) ReleaseDirtyBytes(
+	lState *lockState, file path) error {
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+	df := fbo.dirtyFiles[file.tailPointer()]
+	if df == nil {
+		return nil
+	}
+	err := df.finishSync()
+	if err != nil {
+		return err
+	}
+	delete(fbo.dirtyFiles, file.tailPointer())
+	return nil
+}
+
 // revertSyncInfoAfterRecoverableError updates the saved sync info to
 // include all the blocks from before the error, except for those that
 // have encountered recoverable block errors themselves.
@@ -1893,6 +2803,82 @@ func (fbo *folderBlockOps) revertSyncInfoAfterRecoverableError(
 	}
 }
 
+// readiedBlock is the result of readying one block in readyBlocks.
+type readiedBlock struct {
+	info BlockInfo
+	data ReadyBlockData
+}
+
+// readyBlocks readies each of blocks with ReadyBlock, up to
+// Config.CryptoCapabilities().BlockReadyWorkers at a time.  It passes
+// each result to onReady, in order, as soon as it and all the ones
+// before it are ready, so the caller can start putting the first
+// blocks while later ones are still being readied.  onReady is
+// called from the calling goroutine, and readyBlocks doesn't return
+// until it's done with blocks.
+func (fbo *folderBlockOps) readyBlocks(ctx context.Context, kmd KeyMetadata,
+	blocks []*FileBlock, uid keybase1.UID,
+	onReady func(i int, rb readiedBlock) error) error {
+	numWorkers := fbo.config.CryptoCapabilities().BlockReadyWorkers
+	if numWorkers > len(blocks) {
+		numWorkers = len(blocks)
+	}
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+
+	type result struct {
+		i   int
+		rb  readiedBlock
+		err error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	indices := make(chan int, len(blocks))
+	for i := range blocks {
+		indices <- i
+	}
+	close(indices)
+	results := make(chan result, len(blocks))
+	var wg sync.WaitGroup
+	// The workers read the blocks, which the caller may only
+	// hold locked until we return.
+	defer wg.Wait()
+	defer cancel()
+	wg.Add(numWorkers)
+	for w := 0; w < numWorkers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				if ctx.Err() != nil {
+					return
+				}
+				info, _, data, err := fbo.ReadyBlock(ctx, kmd, blocks[i], uid)
+				results <- result{i, readiedBlock{info, data}, err}
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	readied := make([]*readiedBlock, len(blocks))
+	next := 0
+	for next < len(blocks) {
+		r := <-results
+		if r.err != nil {
+			return r.err
+		}
+		readied[r.i] = &r.rb
+		for ; next < len(blocks) && readied[next] != nil; next++ {
+			if err := onReady(next, *readied[next]); err != nil {
+				return err
+			}
+			readied[next] = nil
+		}
+	}
+	return nil
+}
+
 // ReadyBlock is a thin wrapper around BlockOps.Ready() that handles
 // checking for duplicates.
 func (fbo *folderBlockOps) ReadyBlock(ctx context.Context, kmd KeyMetadata,
@@ -1905,6 +2891,12 @@ func (fbo *folderBlockOps) ReadyBlock(ctx context.Context, kmd KeyMetadata,
 		if err != nil {
 			return
 		}
+		// A block encrypted under an older key generation can't
+		// be reused, or rotating the key (and re-encrypting)
+		// would leave it behind.
+		if ptr.IsInitialized() && ptr.KeyGen != kmd.LatestKeyGeneration() {
+			ptr = BlockPointer{}
+		}
 	}
 
 	// Ready the block, even in the case where we can reuse an
@@ -1917,20 +2909,23 @@ func (fbo *folderBlockOps) ReadyBlock(ctx context.Context, kmd KeyMetadata,
 	}
 
 	if ptr.IsInitialized() {
-		ptr.RefNonce, err = fbo.config.Crypto().MakeBlockRefNonce()
+		var refNonce BlockRefNonce
+		refNonce, err = fbo.config.Crypto().MakeBlockRefNonce()
 		if err != nil {
 			return
 		}
-		ptr.SetWriter(uid)
+		ptr.BlockContext = makeBlockContext(ptr.Creator, uid, refNonce)
 	} else {
 		ptr = BlockPointer{
-			ID:      id,
-			KeyGen:  kmd.LatestKeyGeneration(),
-			DataVer: block.DataVersion(),
-			BlockContext: BlockContext{
-				Creator:  uid,
-				RefNonce: zeroBlockRefNonce,
-			},
+			ID:           id,
+			KeyGen:       kmd.LatestKeyGeneration(),
+			DataVer:      block.DataVersion(),
+			BlockContext: makeFirstBlockContext(uid),
+		}
+		// Clients that can't decompress blocks must not try to
+		// read this one.
+		if readyBlockData.mayBeCompressed {
+			ptr.DataVer = ptr.DataVer.withCompression()
 		}
 	}
 
@@ -1978,18 +2973,28 @@ type fileSyncState struct {
 	//
 	// TODO: This can be a list of IDs instead.
 	newIndirectFileBlockPtrs []BlockPointer
+
+	// rewriteOnly is set if the only changes being synced are
+	// Rewrites, so the file's times should stay as they are.
+	rewriteOnly bool
 }
 
 // startSyncWrite contains the portion of StartSync() that's done
 // while write-locking blockLock.  If there is no dirty de cache
-// entry, dirtyDe will be nil.
+// entry, dirtyDe will be nil.  Each block added to bps is also
+// handed to puts.
 func (fbo *folderBlockOps) startSyncWrite(ctx context.Context,
-	lState *lockState, md *RootMetadata, uid keybase1.UID, file path) (
+	lState *lockState, md *RootMetadata, uid keybase1.UID, file path,
+	puts *blockPutPipeline) (
 	fblock *FileBlock, bps *blockPutState, syncState fileSyncState,
 	dirtyDe *DirEntry, err error) {
 	fbo.blockLock.Lock(lState)
 	defer fbo.blockLock.Unlock(lState)
 
+	// The blocks about to be put take the place of whatever disk
+	// budget was set aside for them.
+	fbo.releaseAllocationLocked(lState, file.tailPointer())
+
 	// update the parent directories, and write all the new blocks out
 	// to disk
 	fblock, err = fbo.getFileLocked(ctx, lState, md.ReadOnly(), file, blockWrite)
@@ -2007,6 +3012,8 @@ func (fbo *folderBlockOps) startSyncWrite(ctx context.Context,
 	md.AddOp(si.op)
 
 	// Fill in syncState.
+	syncState.rewriteOnly = fbo.rewriteOnly[file.tailPointer()]
+	delete(fbo.rewriteOnly, file.tailPointer())
 	if fblock.IsInd {
 		fblockCopy, err := fblock.DeepCopy(fbo.config.Codec())
 		if err != nil {
@@ -2025,6 +3032,14 @@ func (fbo *folderBlockOps) startSyncWrite(ctx context.Context,
 	if si.bps == nil {
 		si.bps = newBlockPutState(1)
 	} else {
+		// The blocks kept from the previous Sync still need
+		// to be put.
+		for _, bs := range si.bps.blockStates {
+			if err := puts.put(bs); err != nil {
+				return nil, nil, syncState, nil, err
+			}
+		}
+
 		// reinstate byte accounting from the previous Sync
 		md.SetRefBytes(si.refBytes)
 		md.AddDiskUsage(si.refBytes)
@@ -2056,7 +3071,7 @@ func (fbo *folderBlockOps) startSyncWrite(ctx context.Context,
 	//      from the next block and mark it dirty
 	//   4) Then go through once more, and ready and finalize each
 	//      dirty block, updating its ID in the indirect pointer list
-	bsplit := fbo.config.BlockSplitter()
+	bsplit := fbo.config.BlockSplitterForTLF(fbo.id())
 	if fblock.IsInd {
 		// TODO: Verify that any getFileBlock... calls here
 		// only use the dirty cache and not the network, since
@@ -2154,9 +3169,12 @@ func (fbo *folderBlockOps) startSyncWrite(ctx context.Context,
 			}
 		}
 
+		// Gather all the dirty blocks first, so they can be readied
+		// in parallel, and put as soon as each is finalized.
+		var dirtyIndices []int
+		var dirtyBlocks []*FileBlock
 		for i, ptr := range fblock.IPtrs {
-			localPtr := ptr.BlockPointer
-			isDirty := dirtyBcache.IsDirty(fbo.id(), localPtr, file.Branch)
+			isDirty := dirtyBcache.IsDirty(fbo.id(), ptr.BlockPointer, file.Branch)
 			if (ptr.EncodedSize > 0) && isDirty {
 				return nil, nil, syncState, nil,
 					InconsistentEncodedSizeError{ptr.BlockInfo}
@@ -2167,19 +3185,23 @@ func (fbo *folderBlockOps) startSyncWrite(ctx context.Context,
 				if err != nil {
 					return nil, nil, syncState, nil, err
 				}
-
-				newInfo, _, readyBlockData, err :=
-					fbo.ReadyBlock(ctx, md.ReadOnly(), block, uid)
-				if err != nil {
-					return nil, nil, syncState, nil, err
-				}
+				dirtyIndices = append(dirtyIndices, i)
+				dirtyBlocks = append(dirtyBlocks, block)
+			}
+		}
+		err = fbo.readyBlocks(ctx, md.ReadOnly(), dirtyBlocks, uid,
+			func(j int, rb readiedBlock) error {
+				i := dirtyIndices[j]
+				localPtr := fblock.IPtrs[i].BlockPointer
+				block := dirtyBlocks[j]
+				newInfo, readyBlockData := rb.info, rb.data
 
 				syncState.newIndirectFileBlockPtrs = append(syncState.newIndirectFileBlockPtrs, newInfo.BlockPointer)
-				err = bcache.Put(newInfo.BlockPointer, fbo.id(), block, PermanentEntry)
+				err := bcache.Put(newInfo.BlockPointer, fbo.id(), block, PermanentEntry)
 				if err != nil {
-					return nil, nil, syncState, nil, err
+					return err
 				}
-				df.setBlockOrphaned(ptr.BlockPointer, true)
+				df.setBlockOrphaned(localPtr, true)
 
 				// Defer the DirtyBlockCache.Delete until after the
 				// new path is ready, in case anyone tries to read the
@@ -2195,16 +3217,24 @@ func (fbo *folderBlockOps) startSyncWrite(ctx context.Context,
 				// refs list, and avoid unrefing it as well.
 				si.removeReplacedBlock(ctx, fbo.log, localPtr)
 
-				si.bps.addNewBlock(newInfo.BlockPointer, block, readyBlockData,
-					func() error {
-						return df.setBlockSynced(localPtr)
-					})
+				syncedCb := func() error {
+					return df.setBlockSynced(localPtr)
+				}
+				si.bps.addNewBlock(newInfo.BlockPointer, block,
+					readyBlockData, syncedCb)
 				err = df.setBlockSyncing(localPtr)
 				if err != nil {
-					return nil, nil, syncState, nil, err
+					return err
 				}
 				syncState.redirtyOnRecoverableError[newInfo.BlockPointer] = localPtr
-			}
+
+				// Start putting the block right away, while
+				// the rest are readied.
+				return puts.put(blockState{newInfo.BlockPointer, block,
+					readyBlockData, syncedCb})
+			})
+		if err != nil {
+			return nil, nil, syncState, nil, err
 		}
 	}
 
@@ -2247,7 +3277,7 @@ func (fbo *folderBlockOps) makeLocalBcache(ctx context.Context,
 	// Update the file's directory entry to the cached copy.
 	if dirtyDe != nil {
 		dirtyDe.EncodedSize = si.oldInfo.EncodedSize
-		dblock.Children[file.tailName()] = *dirtyDe
+		setEntryAndLinks(dblock, file.tailName(), *dirtyDe)
 		lbc[parentPath.tailPointer()] = dblock
 	}
 
@@ -2256,11 +3286,13 @@ func (fbo *folderBlockOps) makeLocalBcache(ctx context.Context,
 
 // StartSync starts a sync for the given file. It returns the new
 // FileBlock which has the readied top-level block which includes all
-// writes since the last sync. Must be used with CleanupSyncState()
-// and FinishSync() like so:
+// writes since the last sync.  The blocks in the returned
+// blockPutState have already been handed to puts, as they were
+// readied, so only blocks added to it later still need to be.  Must
+// be used with CleanupSyncState() and FinishSync() like so:
 //
 // 	fblock, bps, lbc, syncState, err :=
-//		...fbo.StartSync(ctx, lState, md, uid, file)
+//		...fbo.StartSync(ctx, lState, md, uid, file, puts)
 //	defer func() {
 //		...fbo.CleanupSyncState(
 //			ctx, lState, md, file, ..., syncState, err)
@@ -2272,7 +3304,8 @@ func (fbo *folderBlockOps) makeLocalBcache(ctx context.Context,
 //
 //	... = ...fbo.FinishSync(ctx, lState, file, ..., syncState)
 func (fbo *folderBlockOps) StartSync(ctx context.Context,
-	lState *lockState, md *RootMetadata, uid keybase1.UID, file path) (
+	lState *lockState, md *RootMetadata, uid keybase1.UID, file path,
+	puts *blockPutPipeline) (
 	fblock *FileBlock, bps *blockPutState, lbc localBcache,
 	syncState fileSyncState, err error) {
 	if jServer, err := GetJournalServer(fbo.config); err == nil {
@@ -2280,7 +3313,7 @@ func (fbo *folderBlockOps) StartSync(ctx context.Context,
 	}
 
 	fblock, bps, syncState, dirtyDe, err := fbo.startSyncWrite(
-		ctx, lState, md, uid, file)
+		ctx, lState, md, uid, file, puts)
 	if err != nil {
 		return nil, nil, nil, syncState, err
 	}
@@ -2486,9 +3519,38 @@ func (fbo *folderBlockOps) FinishSync(
 		return true, err
 	}
 
+	delete(fbo.syncedRevs, oldPath.tailPointer())
+	fbo.syncedRevs[newPath.tailPointer()] = md.Revision()
+
 	return stillDirty, nil
 }
 
+// GetSyncInfo returns whether file has writes that haven't been
+// synced yet and, either way, the MD revision that last synced it,
+// or MetadataRevisionUninitialized if that revision is known to have
+// left the journal.
+func (fbo *folderBlockOps) GetSyncInfo(lState *lockState, file path) (
+	dirty bool, rev MetadataRevision) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	ptr := file.tailPointer()
+	dirty = fbo.config.DirtyBlockCache().IsDirty(fbo.id(), ptr, file.Branch)
+	return dirty, fbo.syncedRevs[ptr]
+}
+
+// ForgetSyncsBefore forgets the revisions that last synced files,
+// for revisions before rev, once those have left the journal.
+func (fbo *folderBlockOps) ForgetSyncsBefore(
+	lState *lockState, rev MetadataRevision) {
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+	for ptr, r := range fbo.syncedRevs {
+		if r < rev {
+			delete(fbo.syncedRevs, ptr)
+		}
+	}
+}
+
 // notifyErrListeners notifies any write operations that are blocked
 // on a file so that they can learn about unrecoverable sync errors.
 func (fbo *folderBlockOps) notifyErrListenersLocked(lState *lockState,
@@ -2810,6 +3872,13 @@ func (fbo *folderBlockOps) setCachedAttr(
 		fileEntry.Type = realEntry.Type
 	case mtimeAttr:
 		fileEntry.Mtime = realEntry.Mtime
+	case xattrAttr:
+		fileEntry.Xattrs = realEntry.Xattrs
+	case modeAttr:
+		copyModeAttr(&fileEntry, *realEntry)
+	case ownerAttr:
+		fileEntry.UID = realEntry.UID
+		fileEntry.GID = realEntry.GID
 	}
 	fileEntry.Ctime = realEntry.Ctime
 	fbo.deCache[ref] = fileEntry
@@ -2863,10 +3932,18 @@ func (fbo *folderBlockOps) UpdateCachedEntryAttributesOnRemovedFile(
 	fbo.setCachedAttr(ctx, lState, de.ref(), op, &de, true)
 }
 
-func (fbo *folderBlockOps) getDeferredWriteCountForTest(lState *lockState) int {
+// fillStateForTesting fills in the block-related fields of state,
+// all under a single hold of blockLock.
+func (fbo *folderBlockOps) fillStateForTesting(
+	lState *lockState, state *FolderBranchOpsState) {
 	fbo.blockLock.RLock(lState)
 	defer fbo.blockLock.RUnlock(lState)
-	return len(fbo.deferredWrites)
+	state.Dirty = len(fbo.deCache) != 0
+	state.DirtyFiles = len(fbo.dirtyFiles)
+	state.DirtyEntries = len(fbo.deCache)
+	state.UnrefCacheEntries = len(fbo.unrefCache)
+	state.DeferredWrites = len(fbo.deferredWrites)
+	state.DeferredDirtyDeletes = len(fbo.deferredDirtyDeletes)
 }
 
 // UpdatePointers updates all the pointers in the node cache
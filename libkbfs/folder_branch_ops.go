@@ -9,8 +9,10 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/keybase/backoff"
@@ -63,13 +65,24 @@ const (
 	// Total history size for 2097152-byte blocks: 1134341128192 bytes
 	// Total history size for 4194304-byte blocks: 2216672886784 bytes
 	MaxBlockSizeBytesDefault = 512 << 10
-	// Maximum number of blocks that can be sent in parallel
+	// Number of blocks sent in parallel, until the
+	// BlockTransferMeter has measurements to go by.  The dirty
+	// byte limits are sized for it.
 	maxParallelBlockPuts = 100
 	// Max response size for a single DynamoDB query is 1MB.
 	maxMDsAtATime = 10
 	// Time between checks for dirty files to flush, in case Sync is
 	// never called.
 	secondsBetweenBackgroundFlushes = 10
+	// Files that have been dirty for less than the configured age
+	// aren't synced in the background while a TLF's journal holds
+	// more than this many unflushed bytes.
+	backgroundFlushMaxJournalBytes = 64 * 1024 * 1024
+	// While journaled, files synced in the background are folded
+	// into the same MD revision for at least this long, so a pass
+	// over several dirty files makes one revision.  A pass stops
+	// after a second anyway.
+	backgroundFlushCoalesceWindow = 1 * time.Second
 	// Cap the number of times we retry after a recoverable error
 	maxRetriesOnRecoverableErrors = 10
 	// When the number of dirty bytes exceeds this level, force a sync.
@@ -123,6 +136,15 @@ func makeFBOLockState() *lockState {
 	return makeLevelState(fboMutexLevelToString)
 }
 
+// makeBackgroundFBOLockState is like makeFBOLockState, but for
+// maintenance work that should wait for mdWriterLock behind any user
+// requests.
+func makeBackgroundFBOLockState() *lockState {
+	lState := makeFBOLockState()
+	lState.priority = lockPriorityBackground
+	return lState
+}
+
 // blockLock is just like a sync.RWMutex, but with an extra operation
 // (DoRUnlockedIfPossible).
 type blockLock struct {
@@ -163,7 +185,9 @@ func (bl *blockLock) DoRUnlockedIfPossible(lState *lockState, f func(*lockState)
 //
 // 1) mdWriterLock: Any "remote-sync" operation (one which modifies the
 //    folder's metadata) must take this lock during the entirety of
-//    its operation, to avoid forking the MD.
+//    its operation, to avoid forking the MD.  Waiters are queued
+//    fairly, with user requests ahead of background work (see
+//    priorityMutex and makeBackgroundFBOLockState).
 //
 // 2) headLock: This is a read/write mutex.  It must be taken for
 //    reading before accessing any part of the current head MD.  It
@@ -207,6 +231,15 @@ func (bl *blockLock) DoRUnlockedIfPossible(lState *lockState, f func(*lockState)
 // blocks, so we can't just reuse the blocks that were modified during
 // the sync.)
 type folderBranchOps struct {
+	// lastUse is the value of KBFSOpsStandard's use counter the
+	// last time it handed out this object.  It must be accessed
+	// atomically, and is first in the struct for 64-bit alignment.
+	lastUse uint64
+	// refs counts the KBFSOpsStandard callers currently using this
+	// object, which must not be evicted while it's non-zero.  It
+	// must be accessed atomically.
+	refs int32
+
 	config       Config
 	folderBranch FolderBranch
 	bid          BranchID // protected by mdWriterLock
@@ -254,6 +287,21 @@ type folderBranchOps struct {
 	identifyDone bool
 	identifyTime time.Time
 
+	// Whether all mutating operations on this folder have been
+	// paused by the user, e.g. to stop a runaway process.  Reads
+	// and journal flushes are still allowed.
+	writesPausedLock sync.Mutex
+	writesPaused     bool
+
+	// How durable Sync makes writes to this folder, unless the
+	// caller asks for a specific level.
+	syncDurabilityLock sync.Mutex
+	syncDurability     WriteDurability
+
+	// Delays new revisions when this device is writing to the
+	// folder pathologically fast.
+	writeThrottler *writeThrottler
+
 	// The current status summary for this folder
 	status *folderBranchStatusKeeper
 
@@ -271,9 +319,21 @@ type folderBranchOps struct {
 	// goroutine completes.
 	updateDoneChan chan struct{}
 
+	// cancelUpdateBackoff, if non-nil, cuts short the wait before
+	// the next attempt to register for updates, once reconnected.
+	// cancelUpdates, if non-nil, stops the update goroutine for
+	// good on shutdown.
+	updateBackoffLock   sync.Mutex
+	cancelUpdateBackoff context.CancelFunc
+	cancelUpdates       context.CancelFunc
+
 	// forceSyncChan is read from by the background sync process
-	// to know when it should sync immediately.
+	// to know when it should sync immediately, unless flushers
+	// does the background syncs.
 	forceSyncChan <-chan struct{}
+	// flushers, if non-nil, runs the background syncs of this
+	// folder along with those of other folders.
+	flushers *flusherPool
 
 	// How to resolve conflicts
 	cr *ConflictResolver
@@ -286,8 +346,30 @@ type folderBranchOps struct {
 	// Protected by mdWriterLock
 	rekeyWithPromptTimer *time.Timer
 
+	// coalesceMdID is the ID of the head if this device put it
+	// with a coalescing window (see Config.MDCoalesceWindow) that
+	// is open until coalesceUntil.  Until then, directory ops
+	// replace the head instead of making new revisions.
+	// Protected by mdWriterLock.
+	coalesceMdID  MdID
+	coalesceUntil time.Time
+
+	// shardPutRaces counts how many times the current op has been
+	// redone after its MD put for a writer shard lost a race (see
+	// RootMetadata.shardOnly).  Protected by mdWriterLock.
+	shardPutRaces int
+
 	editHistory *TlfEditHistory
 
+	// rangeLocks tracks the byte-range locks this device holds in
+	// this folder.
+	rangeLocks *folderRangeLocks
+
+	// tombstones marks files removed by other devices, so that
+	// writes racing with the removal aren't lost.  Protected by
+	// mdWriterLock.
+	tombstones map[blockRef]*tombstone
+
 	mdFlushes RepeatedWaitGroup
 }
 
@@ -295,9 +377,11 @@ var _ KBFSOps = (*folderBranchOps)(nil)
 
 var _ fbmHelper = (*folderBranchOps)(nil)
 
-// newFolderBranchOps constructs a new folderBranchOps object.
+// newFolderBranchOps constructs a new folderBranchOps object.  If
+// flushers is non-nil, it runs the background flushes of the new
+// object; otherwise the object runs its own.
 func newFolderBranchOps(config Config, fb FolderBranch,
-	bType branchType) *folderBranchOps {
+	bType branchType, flushers *flusherPool) *folderBranchOps {
 	nodeCache := newNodeCacheStandard(fb)
 
 	// make logger
@@ -315,34 +399,38 @@ func newFolderBranchOps(config Config, fb FolderBranch,
 
 	observers := newObserverList()
 
-	mdWriterLock := makeLeveledMutex(mutexLevel(fboMDWriter), &sync.Mutex{})
+	mdWriterLock := makeLeveledMutex(mutexLevel(fboMDWriter),
+		newPriorityMutex("MDWriterLock", config.MetricsRegistry()))
 	headLock := makeLeveledRWMutex(mutexLevel(fboHead), &sync.RWMutex{})
 	blockLockMu := makeLeveledRWMutex(mutexLevel(fboBlock), &sync.RWMutex{})
 
 	forceSyncChan := make(chan struct{})
 
 	fbo := &folderBranchOps{
-		config:       config,
-		folderBranch: fb,
-		bid:          BranchID{},
-		bType:        bType,
-		observers:    observers,
-		status:       newFolderBranchStatusKeeper(config, nodeCache),
-		mdWriterLock: mdWriterLock,
-		headLock:     headLock,
+		config:         config,
+		folderBranch:   fb,
+		bid:            BranchID{},
+		bType:          bType,
+		observers:      observers,
+		status:         newFolderBranchStatusKeeper(config, nodeCache),
+		writeThrottler: newWriteThrottler(wallClock{}),
+		mdWriterLock:   mdWriterLock,
+		headLock:       headLock,
 		blocks: folderBlockOps{
-			config:        config,
-			log:           log,
-			folderBranch:  fb,
-			observers:     observers,
-			forceSyncChan: forceSyncChan,
+			config:       config,
+			log:          log,
+			folderBranch: fb,
+			observers:    observers,
 			blockLock: blockLock{
 				leveledRWMutex: blockLockMu,
 			},
-			dirtyFiles: make(map[BlockPointer]*dirtyFile),
-			unrefCache: make(map[blockRef]*syncInfo),
-			deCache:    make(map[blockRef]DirEntry),
-			nodeCache:  nodeCache,
+			dirtyFiles:    make(map[BlockPointer]*dirtyFile),
+			unrefCache:    make(map[blockRef]*syncInfo),
+			deCache:       make(map[blockRef]DirEntry),
+			syncedRevs:    make(map[BlockPointer]MetadataRevision),
+			allocReserved: make(map[BlockPointer]int64),
+			rewriteOnly:   make(map[BlockPointer]bool),
+			nodeCache:     nodeCache,
 		},
 		nodeCache:       nodeCache,
 		log:             log,
@@ -350,12 +438,35 @@ func newFolderBranchOps(config Config, fb FolderBranch,
 		shutdownChan:    make(chan struct{}),
 		updatePauseChan: make(chan (<-chan struct{})),
 		forceSyncChan:   forceSyncChan,
+		tombstones:      make(map[blockRef]*tombstone),
 	}
+	fbo.syncDurability = config.SyncDurabilityForTLF(fb.Tlf)
+	fbo.status.setSyncDurability(fbo.syncDurability)
 	fbo.cr = NewConflictResolver(config, fbo)
 	fbo.fbm = newFolderBlockManager(config, fb, fbo)
 	fbo.editHistory = NewTlfEditHistory(config, fbo, log)
+	fbo.rangeLocks = newFolderRangeLocks(config, fb.Tlf, log)
+	fbo.blocks.forceSync = func() bool {
+		select {
+		case forceSyncChan <- struct{}{}:
+			return true
+		default:
+			return false
+		}
+	}
 	if config.DoBackgroundFlushes() {
-		go fbo.backgroundFlusher(secondsBetweenBackgroundFlushes * time.Second)
+		if flushers != nil {
+			fbo.flushers = flushers
+			fbo.blocks.forceSync = func() bool {
+				return flushers.queue(fbo, true)
+			}
+			flushers.add(fbo)
+		} else {
+			go fbo.backgroundFlusher(backgroundFlushPeriod(config))
+		}
+	}
+	if period := config.StateCheckPeriod(); period > 0 {
+		go fbo.backgroundStateChecker(period)
 	}
 
 	return fbo
@@ -397,10 +508,19 @@ func (fbo *folderBranchOps) Shutdown() error {
 		}
 	}
 
+	if fbo.flushers != nil {
+		fbo.flushers.remove(fbo)
+	}
 	close(fbo.shutdownChan)
+	fbo.updateBackoffLock.Lock()
+	if fbo.cancelUpdates != nil {
+		fbo.cancelUpdates()
+	}
+	fbo.updateBackoffLock.Unlock()
 	fbo.cr.Shutdown()
 	fbo.fbm.shutdown()
 	fbo.editHistory.Shutdown()
+	fbo.rangeLocks.shutdown(context.TODO())
 	// Wait for the update goroutine to finish, so that we don't have
 	// any races with logging during test reporting.
 	if fbo.updateDoneChan != nil {
@@ -489,6 +609,29 @@ func (fbo *folderBranchOps) isMasterBranch(lState *lockState) bool {
 	return fbo.bid == NullBranchID
 }
 
+// isMDWriterStateIdle returns true if this folder is on the master
+// branch, and none of the state protected by mdWriterLock that would
+// be lost on shutdown is set: a pending rekey prompt, an open
+// coalescing window, or a tombstone that's still in its grace
+// window.
+func (fbo *folderBranchOps) isMDWriterStateIdle(lState *lockState) bool {
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
+	if fbo.bid != NullBranchID || fbo.rekeyWithPromptTimer != nil {
+		return false
+	}
+	now := fbo.config.Clock().Now()
+	if now.Before(fbo.coalesceUntil) {
+		return false
+	}
+	for _, ts := range fbo.tombstones {
+		if now.Sub(ts.removedAt) <= tombstoneGraceWindow {
+			return false
+		}
+	}
+	return true
+}
+
 func (fbo *folderBranchOps) isMasterBranchLocked(lState *lockState) bool {
 	fbo.mdWriterLock.AssertLocked(lState)
 
@@ -501,6 +644,9 @@ func (fbo *folderBranchOps) setBranchIDLocked(lState *lockState, bid BranchID) {
 	fbo.bid = bid
 	if bid == NullBranchID {
 		fbo.status.setCRSummary(nil, nil)
+		// Any conflict input that was held while resolving is
+		// stale now that we're back on the master branch.
+		fbo.cr.DropHeld()
 	}
 }
 
@@ -509,7 +655,7 @@ func (fbo *folderBranchOps) checkDataVersion(p path, ptr BlockPointer) error {
 		return InvalidDataVersionError{ptr.DataVer}
 	}
 	// TODO: migrate back to fbo.config.DataVersion
-	if ptr.DataVer > FilesWithHolesDataVer {
+	if ptr.DataVer > CompressedTwoLevelsOfChildrenDataVer {
 		return NewDataVersionError{p, ptr.DataVer}
 	}
 	return nil
@@ -560,12 +706,18 @@ func (fbo *folderBranchOps) setHeadLocked(
 	fbo.head = md
 	fbo.status.setRootMetadata(md)
 	if isFirstHead {
+		fbo.config.UsageMeter().setTLFName(
+			md.TlfID(), md.GetTlfHandle().GetCanonicalPath())
 		// Start registering for updates right away, using this MD
 		// as a starting point. For now only the master branch can
 		// get updates
 		if fbo.branch() == MasterBranch {
 			fbo.updateDoneChan = make(chan struct{})
-			go fbo.registerAndWaitForUpdates()
+			ctx, cancel := fbo.newCtxWithFBOID()
+			fbo.updateBackoffLock.Lock()
+			fbo.cancelUpdates = cancel
+			fbo.updateBackoffLock.Unlock()
+			go fbo.registerAndWaitForUpdates(ctx)
 		}
 	}
 	if !wasReadable && md.IsReadable() {
@@ -684,6 +836,20 @@ func (fbo *folderBranchOps) setHeadSuccessorLocked(ctx context.Context,
 	return nil
 }
 
+// setHeadCoalescedLocked is for when a directory op was folded into
+// the head revision, within its coalescing window.
+func (fbo *folderBranchOps) setHeadCoalescedLocked(ctx context.Context,
+	lState *lockState, md ImmutableRootMetadata) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+	fbo.headLock.AssertLocked(lState)
+	if fbo.head.Revision() != md.Revision() ||
+		fbo.head.PrevRoot() != md.PrevRoot() {
+		return fmt.Errorf("Coalesced MD (revision %d) doesn't replace "+
+			"the head (revision %d)", md.Revision(), fbo.head.Revision())
+	}
+	return fbo.setHeadLocked(ctx, lState, md)
+}
+
 // setHeadPredecessorLocked is for when we're unstaging updates.
 func (fbo *folderBranchOps) setHeadPredecessorLocked(ctx context.Context,
 	lState *lockState, md ImmutableRootMetadata) error {
@@ -954,6 +1120,55 @@ func (fbo *folderBranchOps) getMDForWriteLocked(
 	return newMd, nil
 }
 
+// getMDForCoalescedWriteLocked is like getMDForWriteLocked, but for
+// a directory op that may be folded into the current head, if this
+// device put the head and its coalescing window is still open.  In
+// that case, the returned object has the head's revision, and
+// already holds the head's ops.  Either way, the caller must pass it
+// into syncBlockAndFinalizeLocked.
+func (fbo *folderBranchOps) getMDForCoalescedWriteLocked(
+	ctx context.Context, lState *lockState) (*RootMetadata, error) {
+	return fbo.getMDForCoalescedWriteWithWindowLocked(
+		ctx, lState, fbo.config.MDCoalesceWindow())
+}
+
+// getMDForCoalescedWriteWithWindowLocked is like
+// getMDForCoalescedWriteLocked, but a new coalescing window stays
+// open for the given duration.  Background file syncs use it too.
+func (fbo *folderBranchOps) getMDForCoalescedWriteWithWindowLocked(
+	ctx context.Context, lState *lockState, window time.Duration) (
+	*RootMetadata, error) {
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return nil, err
+	}
+
+	if window <= 0 || !fbo.isMasterBranchLocked(lState) ||
+		md.MergedStatus() != Merged ||
+		!TLFJournalEnabled(fbo.config, fbo.id()) {
+		return md, nil
+	}
+
+	now := time.Now()
+	head := fbo.getHead(lState)
+	if head.mdID != fbo.coalesceMdID || !now.Before(fbo.coalesceUntil) ||
+		head.data.Changes.Info.BlockPointer != zeroPtr {
+		// Start a new window.
+		md.coalesceUntil = now.Add(window)
+		return md, nil
+	}
+
+	fbo.log.CDebugf(ctx, "Coalescing into revision %d", head.Revision())
+	md.SetRevision(head.Revision())
+	md.SetPrevRoot(head.PrevRoot())
+	md.SetRefBytes(head.RefBytes())
+	md.SetUnrefBytes(head.UnrefBytes())
+	md.data.Changes.Ops = append([]op(nil), head.data.Changes.Ops...)
+	md.coalesceUntil = fbo.coalesceUntil
+	md.replacesHead = true
+	return md, nil
+}
+
 func (fbo *folderBranchOps) getMDForRekeyWriteLocked(
 	ctx context.Context, lState *lockState) (rmd *RootMetadata, wasRekeySet bool, err error) {
 	fbo.mdWriterLock.AssertLocked(lState)
@@ -1019,7 +1234,8 @@ func (fbo *folderBranchOps) maybeUnembedAndPutOneBlock(ctx context.Context,
 
 	ptrsToDelete, err := doBlockPuts(ctx, fbo.config.BlockServer(),
 		fbo.config.BlockCache(), fbo.config.Reporter(), fbo.log, md.TlfID(),
-		md.GetTlfHandle().GetCanonicalName(), *bps)
+		md.GetTlfHandle().GetCanonicalName(), *bps,
+		fbo.config.BlockTransferMeter().PutParallelism())
 	if err != nil {
 		return err
 	}
@@ -1141,6 +1357,16 @@ func (fbo *folderBranchOps) GetTLFCryptKeys(ctx context.Context,
 	return nil, TlfID{}, errors.New("GetTLFCryptKeys is not supported by folderBranchOps")
 }
 
+func (fbo *folderBranchOps) AuditTLF(
+	ctx context.Context, h *TlfHandle) (TLFAuditReport, error) {
+	return TLFAuditReport{}, errors.New("AuditTLF is not supported by folderBranchOps")
+}
+
+func (fbo *folderBranchOps) FsckTLF(ctx context.Context, h *TlfHandle,
+	repair bool) (TLFFsckReport, error) {
+	return TLFFsckReport{}, errors.New("FsckTLF is not supported by folderBranchOps")
+}
+
 func (fbo *folderBranchOps) GetOrCreateRootNode(
 	ctx context.Context, h *TlfHandle, branch BranchName) (
 	node Node, ei EntryInfo, err error) {
@@ -1161,6 +1387,47 @@ func (fbo *folderBranchOps) checkNode(node Node) error {
 	return nil
 }
 
+func (fbo *folderBranchOps) checkWritesNotPaused() error {
+	fbo.writesPausedLock.Lock()
+	defer fbo.writesPausedLock.Unlock()
+	if fbo.writesPaused {
+		return WritesPausedError{fbo.id()}
+	}
+	return nil
+}
+
+// throttleRevision delays the caller if this device has recently
+// been making too many revisions to this folder, or to the given
+// node in particular.  The first time that happens, it also alerts
+// the user via the reporter.
+func (fbo *folderBranchOps) throttleRevision(
+	ctx context.Context, node Node) error {
+	delay, newlyThrottled := fbo.writeThrottler.recordRev(node.GetID())
+	if newlyThrottled {
+		fbo.log.CWarningf(ctx, "Throttling writes to %s (node %p) by %s",
+			fbo.id(), node.GetID(), delay)
+		lState := makeFBOLockState()
+		head := fbo.getHead(lState)
+		if head != (ImmutableRootMetadata{}) {
+			handle := head.GetTlfHandle()
+			fbo.config.Reporter().ReportErr(ctx,
+				handle.GetCanonicalName(), handle.IsPublic(), WriteMode,
+				WritesThrottledWarning{fbo.id(), delay})
+		}
+	}
+	return fbo.writeThrottler.wait(ctx, delay)
+}
+
+// checkNodeForWrite is like checkNode, but also fails if writes to
+// this folder have been paused via PauseWrites.
+func (fbo *folderBranchOps) checkNodeForWrite(node Node) error {
+	err := fbo.checkNode(node)
+	if err != nil {
+		return err
+	}
+	return fbo.checkWritesNotPaused()
+}
+
 // SetInitialHeadFromServer sets the head to the given
 // ImmutableRootMetadata, which must be retrieved from the MD server.
 func (fbo *folderBranchOps) SetInitialHeadFromServer(
@@ -1387,11 +1654,27 @@ func (fbo *folderBranchOps) GetDirChildren(ctx context.Context, dir Node) (
 			return err
 		}
 
+		sharded, _, err := fbo.getShardedChildren(
+			ctx, lState, md.ReadOnly(), dirPath)
+		if err != nil {
+			return err
+		}
+		if sharded != nil {
+			children = make(map[string]EntryInfo, len(sharded))
+			for name, se := range sharded {
+				children[name] = se.ei
+			}
+			return nil
+		}
+
 		children, err = fbo.blocks.GetDirtyDirChildren(
 			ctx, lState, md.ReadOnly(), dirPath)
 		if err != nil {
 			return err
 		}
+		if !dirPath.hasValidParent() {
+			delete(children, TrashDirName)
+		}
 		return nil
 	})
 	if err != nil {
@@ -1400,6 +1683,68 @@ func (fbo *folderBranchOps) GetDirChildren(ctx context.Context, dir Node) (
 	return children, nil
 }
 
+func (fbo *folderBranchOps) BatchStat(
+	ctx context.Context, dir Node, names []string) (
+	eis map[string]EntryInfo, errs map[string]error, err error) {
+	fbo.log.CDebugf(ctx, "BatchStat %p (%d names)", dir.GetID(), len(names))
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done BatchStat: %v", err) }()
+
+	err = fbo.checkNode(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var children map[string]EntryInfo
+	var dirPath path
+	err = runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+
+		md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+		if err != nil {
+			return err
+		}
+
+		dirPath, err = fbo.pathFromNodeForRead(dir)
+		if err != nil {
+			return err
+		}
+
+		// All the entries come from the same read of the directory.
+		sharded, _, err := fbo.getShardedChildren(
+			ctx, lState, md.ReadOnly(), dirPath)
+		if err != nil {
+			return err
+		}
+		if sharded != nil {
+			children = make(map[string]EntryInfo, len(sharded))
+			for name, se := range sharded {
+				children[name] = se.ei
+			}
+			return nil
+		}
+		children, err = fbo.blocks.GetDirtyDirChildren(
+			ctx, lState, md.ReadOnly(), dirPath)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	eis = make(map[string]EntryInfo, len(names))
+	for _, name := range names {
+		ei, ok := children[name]
+		if !ok || isTrashDir(dirPath, name) {
+			if errs == nil {
+				errs = make(map[string]error)
+			}
+			errs[name] = NoSuchNameError{name}
+			continue
+		}
+		eis[name] = ei
+	}
+	return eis, errs, nil
+}
+
 func (fbo *folderBranchOps) Lookup(ctx context.Context, dir Node, name string) (
 	node Node, ei EntryInfo, err error) {
 	fbo.log.CDebugf(ctx, "Lookup %p %s", dir.GetID(), name)
@@ -1423,8 +1768,37 @@ func (fbo *folderBranchOps) Lookup(ctx context.Context, dir Node, name string) (
 		if err != nil {
 			return err
 		}
+		if isTrashDir(dirPath, name) {
+			return NoSuchNameError{name}
+		}
+
+		// Entries in other shards are looked up in their shard.
+		parent, childName := dir, name
+		sharded, shardsPtr, err := fbo.getShardedChildren(
+			ctx, lState, md.ReadOnly(), dirPath)
+		if err != nil {
+			return err
+		}
+		if sharded != nil {
+			se, ok := sharded[name]
+			if !ok {
+				return NoSuchNameError{name}
+			}
+			if se.shard != "" {
+				parent, err = fbo.getShardNode(
+					dir, shardsPtr, se.shard, se.shardPtr)
+				if err != nil {
+					return err
+				}
+				childName = se.name
+				dirPath, err = fbo.pathFromNodeForRead(parent)
+				if err != nil {
+					return err
+				}
+			}
+		}
 
-		childPath := dirPath.ChildPathNoPtr(name)
+		childPath := dirPath.ChildPathNoPtr(childName)
 
 		de, err = fbo.blocks.GetDirtyEntry(
 			ctx, lState, md.ReadOnly(), childPath)
@@ -1440,7 +1814,8 @@ func (fbo *folderBranchOps) Lookup(ctx context.Context, dir Node, name string) (
 				return err
 			}
 
-			node, err = fbo.nodeCache.GetOrCreate(de.BlockPointer, name, dir)
+			node, err = fbo.nodeCache.GetOrCreate(
+				de.BlockPointer, childName, parent)
 			if err != nil {
 				return err
 			}
@@ -1637,12 +2012,15 @@ type localBcache map[BlockPointer]*DirBlock
 //
 // entryType must not be Sym.
 //
-// TODO: deal with multiple nodes for indirect blocks
+// With reuseBlocks, the shards of sharded directories whose entries
+// didn't change, and the indirect blocks of big files whose pointers
+// didn't, are kept rather than rewritten.
 func (fbo *folderBranchOps) syncBlock(
 	ctx context.Context, lState *lockState, uid keybase1.UID,
 	md *RootMetadata, newBlock Block, dir path, name string,
-	entryType EntryType, mtime bool, ctime bool, stopAt BlockPointer,
-	lbc localBcache) (path, DirEntry, *blockPutState, error) {
+	entryType EntryType, newMode *uint32, mtime bool, ctime bool,
+	stopAt BlockPointer, lbc localBcache, reuseBlocks bool) (
+	path, DirEntry, *blockPutState, error) {
 	// now ready each dblock and write the DirEntry for the next one
 	// in the path
 	currBlock := newBlock
@@ -1657,8 +2035,20 @@ func (fbo *folderBranchOps) syncBlock(
 	doSetTime := true
 	now := fbo.nowUnixNano()
 	for len(newPath.path) < len(dir.path)+1 {
-		info, plainSize, err := fbo.readyBlockMultiple(
-			ctx, md.ReadOnly(), currBlock, uid, bps)
+		var info BlockInfo
+		var plainSize int
+		var err error
+		switch b := currBlock.(type) {
+		case *DirBlock:
+			info, plainSize, err = fbo.readyDirBlockMultiple(
+				ctx, md, b, uid, bps, reuseBlocks)
+		case *FileBlock:
+			info, plainSize, err = fbo.readyFileBlockMultiple(
+				ctx, md, b, uid, bps, reuseBlocks)
+		default:
+			info, plainSize, err = fbo.readyBlockMultiple(
+				ctx, md.ReadOnly(), currBlock, uid, bps)
+		}
 		if err != nil {
 			return path{}, DirEntry{}, nil, err
 		}
@@ -1723,6 +2113,7 @@ func (fbo *folderBranchOps) syncBlock(
 					EntryInfo: EntryInfo{
 						Type: entryType,
 						Size: 0,
+						Mode: newMode,
 					},
 				}
 				// If we're creating a new directory entry, the
@@ -1735,9 +2126,6 @@ func (fbo *folderBranchOps) syncBlock(
 		}
 
 		if de.Type == Dir {
-			// TODO: When we use indirect dir blocks,
-			// we'll have to calculate the size some other
-			// way.
 			de.Size = uint64(plainSize)
 		}
 
@@ -1770,7 +2158,7 @@ func (fbo *folderBranchOps) syncBlock(
 		if prevIdx < 0 {
 			md.data.Dir = de
 		} else {
-			prevDblock.Children[currName] = de
+			setEntryAndLinks(prevDblock, currName, de)
 		}
 		currName = nextName
 
@@ -1792,20 +2180,25 @@ func (fbo *folderBranchOps) syncBlock(
 	return newPath, newDe, bps, nil
 }
 
-// syncBlockLock calls syncBlock under mdWriterLock.
+// syncBlockLock calls syncBlock under mdWriterLock.  If it creates
+// the entry for name, the entry gets newMode as its mode.
 func (fbo *folderBranchOps) syncBlockLocked(
 	ctx context.Context, lState *lockState, uid keybase1.UID,
 	md *RootMetadata, newBlock Block, dir path, name string,
-	entryType EntryType, mtime bool, ctime bool, stopAt BlockPointer,
-	lbc localBcache) (path, DirEntry, *blockPutState, error) {
+	entryType EntryType, newMode *uint32, mtime bool, ctime bool,
+	stopAt BlockPointer, lbc localBcache) (
+	path, DirEntry, *blockPutState, error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 	return fbo.syncBlock(ctx, lState, uid, md, newBlock, dir, name,
-		entryType, mtime, ctime, stopAt, lbc)
+		entryType, newMode, mtime, ctime, stopAt, lbc, true)
 }
 
 // syncBlockForConflictResolution calls syncBlock unlocked, since
 // conflict resolution can handle MD revision number conflicts
-// correctly.
+// correctly.  It rewrites every shard of the sharded directories, and
+// every indirect block of the files, that it syncs, since a kept one
+// might have been created on the unmerged branch, which the
+// resolution doesn't otherwise reference.
 func (fbo *folderBranchOps) syncBlockForConflictResolution(
 	ctx context.Context, lState *lockState, uid keybase1.UID,
 	md *RootMetadata, newBlock Block, dir path, name string,
@@ -1813,14 +2206,14 @@ func (fbo *folderBranchOps) syncBlockForConflictResolution(
 	lbc localBcache) (path, DirEntry, *blockPutState, error) {
 	return fbo.syncBlock(
 		ctx, lState, uid, md, newBlock, dir,
-		name, entryType, mtime, ctime, stopAt, lbc)
+		name, entryType, nil, mtime, ctime, stopAt, lbc, false)
 }
 
 // entryType must not be Sym.
 func (fbo *folderBranchOps) syncBlockAndCheckEmbedLocked(ctx context.Context,
 	lState *lockState, md *RootMetadata, newBlock Block, dir path,
-	name string, entryType EntryType, mtime bool, ctime bool,
-	stopAt BlockPointer, lbc localBcache) (
+	name string, entryType EntryType, newMode *uint32, mtime bool,
+	ctime bool, stopAt BlockPointer, lbc localBcache) (
 	path, DirEntry, *blockPutState, error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
@@ -1830,8 +2223,8 @@ func (fbo *folderBranchOps) syncBlockAndCheckEmbedLocked(ctx context.Context,
 	}
 
 	newPath, newDe, bps, err := fbo.syncBlockLocked(
-		ctx, lState, uid, md, newBlock, dir, name, entryType, mtime,
-		ctime, stopAt, lbc)
+		ctx, lState, uid, md, newBlock, dir, name, entryType, newMode,
+		mtime, ctime, stopAt, lbc)
 	if err != nil {
 		return path{}, DirEntry{}, nil, err
 	}
@@ -1865,6 +2258,7 @@ func isRetriableError(err error, retries int) bool {
 	_, isExclOnUnmergedError := err.(ExclOnUnmergedError)
 	_, isUnmergedSelfConflictError := err.(UnmergedSelfConflictError)
 	recoverable := isExclOnUnmergedError || isUnmergedSelfConflictError ||
+		err == errTLFJournalCoalesceClosed || err == errShardPutRaced ||
 		isRecoverableBlockError(err)
 	return recoverable && retries < maxRetriesOnRecoverableErrors
 }
@@ -1947,7 +2341,17 @@ func (fbo *folderBranchOps) finalizeMDWriteLocked(ctx context.Context,
 	// have already succeeded. Returning EINTR makes application thinks the file
 	// is not created successfully.
 
-	if fbo.isMasterBranchLocked(lState) {
+	if md.replacesHead {
+		// The journal turns down the replacement if the window
+		// closed in the meantime, and the retry then makes a new
+		// revision instead.
+		fbo.coalesceMdID = MdID{}
+		mdID, err = mdops.Put(ctx, md)
+		if err != nil {
+			return err
+		}
+		doUnmergedPut = false
+	} else if fbo.isMasterBranchLocked(lState) {
 		// only do a normal Put if we're not already staged.
 		mdID, err = mdops.Put(ctx, md)
 		if doUnmergedPut = isRevisionConflict(err); doUnmergedPut {
@@ -1964,6 +2368,18 @@ func (fbo *folderBranchOps) finalizeMDWriteLocked(ctx context.Context,
 				}
 				return ExclOnUnmergedError{}
 			}
+			if md.shardOnly && fbo.shardPutRaces < maxShardPutRaces {
+				// Nothing else edits this device's shards, so
+				// rather than going unmerged, catch up and redo
+				// the op on top of the new head.
+				fbo.shardPutRaces++
+				err = fbo.getAndApplyMDUpdates(
+					ctx, lState, fbo.applyMDUpdatesLocked)
+				if err != nil {
+					return err
+				}
+				return errShardPutRaced
+			}
 		} else if err != nil {
 			return err
 		}
@@ -2018,10 +2434,18 @@ func (fbo *folderBranchOps) finalizeMDWriteLocked(ctx context.Context,
 	fbo.headLock.Lock(lState)
 	defer fbo.headLock.Unlock(lState)
 	irmd := MakeImmutableRootMetadata(md, mdID, fbo.config.Clock().Now())
-	err = fbo.setHeadSuccessorLocked(ctx, lState, irmd, rebased)
+	if md.replacesHead {
+		err = fbo.setHeadCoalescedLocked(ctx, lState, irmd)
+	} else {
+		err = fbo.setHeadSuccessorLocked(ctx, lState, irmd, rebased)
+	}
 	if err != nil {
 		return err
 	}
+	if !md.coalesceUntil.IsZero() && !doUnmergedPut && !rebased {
+		fbo.coalesceMdID = mdID
+		fbo.coalesceUntil = md.coalesceUntil
+	}
 
 	// Archive the old, unref'd blocks if journaling is off.
 	if !TLFJournalEnabled(fbo.config, fbo.id()) {
@@ -2074,7 +2498,7 @@ func (fbo *folderBranchOps) finalizeMDRekeyWriteLocked(ctx context.Context,
 
 func (fbo *folderBranchOps) finalizeGCOp(ctx context.Context, gco *gcOp) (
 	err error) {
-	lState := makeFBOLockState()
+	lState := makeBackgroundFBOLockState()
 	// Lock the folder so we can get an internally-consistent MD
 	// revision number.
 	fbo.mdWriterLock.Lock(lState)
@@ -2130,13 +2554,40 @@ func (fbo *folderBranchOps) syncBlockAndFinalizeLocked(ctx context.Context,
 	lState *lockState, md *RootMetadata, newBlock Block, dir path,
 	name string, entryType EntryType, mtime bool, ctime bool,
 	stopAt BlockPointer, excl Excl) (de DirEntry, err error) {
+	return fbo.syncBlockAndFinalizeWithBlocksLocked(ctx, lState, md,
+		newBlock, dir, name, entryType, mtime, ctime, stopAt, excl, nil)
+}
+
+// syncBlockAndFinalizeWithBlocksLocked is like
+// syncBlockAndFinalizeLocked, but also puts the blocks in extraBps,
+// if it's non-nil, along with the updated directory blocks.
+func (fbo *folderBranchOps) syncBlockAndFinalizeWithBlocksLocked(
+	ctx context.Context, lState *lockState, md *RootMetadata,
+	newBlock Block, dir path, name string, entryType EntryType,
+	mtime bool, ctime bool, stopAt BlockPointer, excl Excl,
+	extraBps *blockPutState) (de DirEntry, err error) {
+	return fbo.syncNewBlockAndFinalizeLocked(ctx, lState, md, newBlock,
+		dir, name, entryType, nil, mtime, ctime, stopAt, excl, extraBps)
+}
+
+// syncNewBlockAndFinalizeLocked is like
+// syncBlockAndFinalizeWithBlocksLocked, but if it creates the entry
+// for name, the entry gets newMode as its mode.
+func (fbo *folderBranchOps) syncNewBlockAndFinalizeLocked(
+	ctx context.Context, lState *lockState, md *RootMetadata,
+	newBlock Block, dir path, name string, entryType EntryType,
+	newMode *uint32, mtime bool, ctime bool, stopAt BlockPointer,
+	excl Excl, extraBps *blockPutState) (de DirEntry, err error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 	_, de, bps, err := fbo.syncBlockAndCheckEmbedLocked(
-		ctx, lState, md, newBlock, dir, name, entryType, mtime,
+		ctx, lState, md, newBlock, dir, name, entryType, newMode, mtime,
 		ctime, zeroPtr, nil)
 	if err != nil {
 		return DirEntry{}, err
 	}
+	if extraBps != nil {
+		bps.mergeOtherBps(extraBps)
+	}
 
 	defer func() {
 		if err != nil {
@@ -2147,7 +2598,8 @@ func (fbo *folderBranchOps) syncBlockAndFinalizeLocked(ctx context.Context,
 
 	_, err = doBlockPuts(ctx, fbo.config.BlockServer(),
 		fbo.config.BlockCache(), fbo.config.Reporter(), fbo.log, md.TlfID(),
-		md.GetTlfHandle().GetCanonicalName(), *bps)
+		md.GetTlfHandle().GetCanonicalName(), *bps,
+		fbo.config.BlockTransferMeter().PutParallelism())
 	if err != nil {
 		return DirEntry{}, err
 	}
@@ -2159,6 +2611,10 @@ func (fbo *folderBranchOps) syncBlockAndFinalizeLocked(ctx context.Context,
 }
 
 func checkDisallowedPrefixes(name string) error {
+	// Ignore files are made by users, despite their prefix.
+	if name == KBFSIgnoreFileName {
+		return nil
+	}
 	for _, prefix := range disallowedPrefixes {
 		if strings.HasPrefix(name, prefix) {
 			return DisallowedPrefixError{name, prefix}
@@ -2197,12 +2653,19 @@ func (fbo *folderBranchOps) checkNewDirSize(ctx context.Context,
 func (fbo *folderBranchOps) createEntryLocked(
 	ctx context.Context, lState *lockState, dir Node, name string,
 	entryType EntryType, excl Excl) (Node, DirEntry, error) {
-	fbo.mdWriterLock.AssertLocked(lState)
+	return fbo.createEntryWithModeLocked(
+		ctx, lState, dir, name, entryType, nil, excl)
+}
 
-	if err := checkDisallowedPrefixes(name); err != nil {
-		return nil, DirEntry{}, err
-	}
+// createEntryWithModeLocked is like createEntryLocked, but gives the
+// new entry mode as its POSIX permission bits, if mode is non-nil.
+func (fbo *folderBranchOps) createEntryWithModeLocked(
+	ctx context.Context, lState *lockState, dir Node, name string,
+	entryType EntryType, mode *uint32, excl Excl) (Node, DirEntry, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
 
+	// Callers creating entries on behalf of the user must have
+	// already checked name with checkDisallowedPrefixes.
 	if uint32(len(name)) > fbo.config.MaxNameBytes() {
 		return nil, DirEntry{},
 			NameTooLongError{name, fbo.config.MaxNameBytes()}
@@ -2215,13 +2678,21 @@ func (fbo *folderBranchOps) createEntryLocked(
 		}
 	}
 
-	// verify we have permission to write
-	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
 	if err != nil {
 		return nil, DirEntry{}, err
 	}
 
-	dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
+	// verify we have permission to write
+	getMD := fbo.getMDForCoalescedWriteLocked
+	if excl == WithExcl {
+		// An exclusive create has to be checked by the server
+		// on its own.
+		getMD = fbo.getMDForWriteLocked
+	} else if isWriterShardPath(dirPath) {
+		getMD = fbo.getMDForShardWriteLocked
+	}
+	md, err := getMD(ctx, lState)
 	if err != nil {
 		return nil, DirEntry{}, err
 	}
@@ -2309,9 +2780,9 @@ func (fbo *folderBranchOps) createEntryLocked(
 		}
 	}
 
-	de, err := fbo.syncBlockAndFinalizeLocked(
-		ctx, lState, md, newBlock, dirPath, name, entryType,
-		true, true, zeroPtr, excl)
+	de, err := fbo.syncNewBlockAndFinalizeLocked(
+		ctx, lState, md, newBlock, dirPath, name, entryType, mode,
+		true, true, zeroPtr, excl, nil)
 	if err != nil {
 		return nil, DirEntry{}, err
 	}
@@ -2344,6 +2815,9 @@ func (fbo *folderBranchOps) doMDWriteWithRetry(ctx context.Context,
 		}
 
 		err := fn(lState)
+		if err != errShardPutRaced {
+			fbo.shardPutRaces = 0
+		}
 		if isRetriableError(err, i) {
 			fbo.log.CDebugf(ctx, "Trying again after retriable error: %v", err)
 			// Release the lock to give someone else a chance
@@ -2389,6 +2863,7 @@ func (fbo *folderBranchOps) doMDWriteWithRetryUnlessCanceled(
 	ctx context.Context, fn func(lState *lockState) error) error {
 	return runUnlessCanceled(ctx, func() error {
 		lState := makeFBOLockState()
+		lState.priority = lockPriorityFromContext(ctx)
 		return fbo.doMDWriteWithRetry(ctx, lState, fn)
 	})
 }
@@ -2405,7 +2880,17 @@ func (fbo *folderBranchOps) CreateDir(
 		}
 	}()
 
-	err = fbo.checkNode(dir)
+	err = fbo.checkNodeForWrite(dir)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+
+	err = checkDisallowedPrefixes(path)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+
+	err = fbo.throttleRevision(ctx, dir)
 	if err != nil {
 		return nil, EntryInfo{}, err
 	}
@@ -2414,6 +2899,11 @@ func (fbo *folderBranchOps) CreateDir(
 	var retEntryInfo EntryInfo
 	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
 		func(lState *lockState) error {
+			dir, path, err := fbo.routeShardedLocked(
+				ctx, lState, dir, path, true)
+			if err != nil {
+				return err
+			}
 			node, de, err :=
 				fbo.createEntryLocked(ctx, lState, dir, path, Dir, NoExcl)
 			// Don't set node and ei directly, as that can cause a
@@ -2433,6 +2923,22 @@ func (fbo *folderBranchOps) CreateFile(
 	n Node, ei EntryInfo, err error) {
 	fbo.log.CDebugf(ctx, "CreateFile %p %s isExec=%v Excl=%s",
 		dir.GetID(), path, isExec, excl)
+	return fbo.createFile(ctx, dir, path, isExec, nil, excl)
+}
+
+func (fbo *folderBranchOps) CreateFileWithMode(
+	ctx context.Context, dir Node, path string, mode os.FileMode,
+	excl Excl) (n Node, ei EntryInfo, err error) {
+	fbo.log.CDebugf(ctx, "CreateFileWithMode %p %s mode=%v Excl=%s",
+		dir.GetID(), path, mode, excl)
+	bits := posixBitsFromFileMode(mode)
+	return fbo.createFile(
+		ctx, dir, path, bits&posixUserExec != 0, &bits, excl)
+}
+
+func (fbo *folderBranchOps) createFile(
+	ctx context.Context, dir Node, path string, isExec bool, mode *uint32,
+	excl Excl) (n Node, ei EntryInfo, err error) {
 	defer func() {
 		if err != nil {
 			fbo.deferLog.CDebugf(ctx, "Error: %v", err)
@@ -2441,7 +2947,17 @@ func (fbo *folderBranchOps) CreateFile(
 		}
 	}()
 
-	err = fbo.checkNode(dir)
+	err = fbo.checkNodeForWrite(dir)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+
+	err = checkDisallowedPrefixes(path)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+
+	err = fbo.throttleRevision(ctx, dir)
 	if err != nil {
 		return nil, EntryInfo{}, err
 	}
@@ -2463,10 +2979,15 @@ func (fbo *folderBranchOps) CreateFile(
 	var retEntryInfo EntryInfo
 	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
 		func(lState *lockState) error {
+			dir, path, err := fbo.routeShardedLocked(
+				ctx, lState, dir, path, true)
+			if err != nil {
+				return err
+			}
 			// Don't set node and ei directly, as that can cause a
 			// race when the Create is canceled.
-			node, de, err :=
-				fbo.createEntryLocked(ctx, lState, dir, path, entryType, excl)
+			node, de, err := fbo.createEntryWithModeLocked(
+				ctx, lState, dir, path, entryType, mode, excl)
 			retNode = node
 			retEntryInfo = de.EntryInfo
 			return err
@@ -2492,7 +3013,7 @@ func (fbo *folderBranchOps) createLinkLocked(
 	}
 
 	// verify we have permission to write
-	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	md, err := fbo.getMDForCoalescedWriteLocked(ctx, lState)
 	if err != nil {
 		return DirEntry{}, err
 	}
@@ -2554,7 +3075,17 @@ func (fbo *folderBranchOps) CreateLink(
 		dir.GetID(), fromName, toPath)
 	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
 
-	err = fbo.checkNode(dir)
+	err = fbo.checkNodeForWrite(dir)
+	if err != nil {
+		return EntryInfo{}, err
+	}
+
+	err = checkDisallowedPrefixes(fromName)
+	if err != nil {
+		return EntryInfo{}, err
+	}
+
+	err = fbo.throttleRevision(ctx, dir)
 	if err != nil {
 		return EntryInfo{}, err
 	}
@@ -2562,6 +3093,11 @@ func (fbo *folderBranchOps) CreateLink(
 	var retEntryInfo EntryInfo
 	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
 		func(lState *lockState) error {
+			dir, fromName, err := fbo.routeShardedLocked(
+				ctx, lState, dir, fromName, true)
+			if err != nil {
+				return err
+			}
 			// Don't set ei directly, as that can cause a race when
 			// the Create is canceled.
 			de, err := fbo.createLinkLocked(ctx, lState, dir, fromName, toPath)
@@ -2580,6 +3116,11 @@ func (fbo *folderBranchOps) unrefEntry(ctx context.Context,
 	lState *lockState, md *RootMetadata, dir path, de DirEntry,
 	name string) error {
 	md.AddUnrefBlock(de.BlockInfo)
+	for _, v := range de.Xattrs {
+		if v.Block.BlockPointer != zeroPtr {
+			md.AddUnrefBlock(v.Block)
+		}
+	}
 	// construct a path for the child so we can unlink with it.
 	childPath := dir.ChildPath(name, de.BlockPointer)
 
@@ -2625,13 +3166,27 @@ func (fbo *folderBranchOps) removeEntryLocked(ctx context.Context,
 		return err
 	}
 	md.AddOp(ro)
-	err = fbo.unrefEntry(ctx, lState, md, dir, de, name)
-	if err != nil {
-		return err
-	}
+	if de.LinkCount() > 1 {
+		// The other links still need the file's blocks, and see
+		// the change in its ctime and link count.
+		delete(pblock.Children, name)
+		now := fbo.nowUnixNano()
+		for n, other := range pblock.Children {
+			if other.isLinkOf(de) {
+				other.Ctime = now
+				pblock.Children[n] = other
+			}
+		}
+		fixLinkCounts(pblock)
+	} else {
+		err = fbo.unrefEntry(ctx, lState, md, dir, de, name)
+		if err != nil {
+			return err
+		}
 
-	// the actual unlink
-	delete(pblock.Children, name)
+		// the actual unlink
+		delete(pblock.Children, name)
+	}
 
 	// sync the parent directory
 	_, err = fbo.syncBlockAndFinalizeLocked(
@@ -2648,7 +3203,7 @@ func (fbo *folderBranchOps) removeDirLocked(ctx context.Context,
 	fbo.mdWriterLock.AssertLocked(lState)
 
 	// verify we have permission to write
-	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	md, err := fbo.getMDForCoalescedWriteLocked(ctx, lState)
 	if err != nil {
 		return err
 	}
@@ -2661,7 +3216,7 @@ func (fbo *folderBranchOps) removeDirLocked(ctx context.Context,
 	pblock, err := fbo.blocks.GetDir(
 		ctx, lState, md.ReadOnly(), dirPath, blockRead)
 	de, ok := pblock.Children[dirName]
-	if !ok {
+	if !ok || isTrashDir(dirPath, dirName) {
 		return NoSuchNameError{dirName}
 	}
 
@@ -2680,6 +3235,11 @@ func (fbo *folderBranchOps) removeDirLocked(ctx context.Context,
 		return DirNotEmptyError{dirName}
 	}
 
+	trashed, err := fbo.moveToTrashLocked(ctx, lState, md, dirPath, dirName)
+	if err != nil || trashed {
+		return err
+	}
+
 	return fbo.removeEntryLocked(ctx, lState, md, dirPath, dirName)
 }
 
@@ -2688,13 +3248,23 @@ func (fbo *folderBranchOps) RemoveDir(
 	fbo.log.CDebugf(ctx, "RemoveDir %p %s", dir.GetID(), dirName)
 	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
 
-	err = fbo.checkNode(dir)
+	err = fbo.checkNodeForWrite(dir)
+	if err != nil {
+		return
+	}
+
+	err = fbo.throttleRevision(ctx, dir)
 	if err != nil {
 		return
 	}
 
 	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
 		func(lState *lockState) error {
+			dir, dirName, err := fbo.routeShardedLocked(
+				ctx, lState, dir, dirName, false)
+			if err != nil {
+				return err
+			}
 			return fbo.removeDirLocked(ctx, lState, dir, dirName)
 		})
 }
@@ -2704,15 +3274,26 @@ func (fbo *folderBranchOps) RemoveEntry(ctx context.Context, dir Node,
 	fbo.log.CDebugf(ctx, "RemoveEntry %p %s", dir.GetID(), name)
 	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
 
-	err = fbo.checkNode(dir)
+	err = fbo.checkNodeForWrite(dir)
+	if err != nil {
+		return err
+	}
+
+	err = fbo.throttleRevision(ctx, dir)
 	if err != nil {
 		return err
 	}
 
 	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
 		func(lState *lockState) error {
+			dir, name, err := fbo.routeShardedLocked(
+				ctx, lState, dir, name, false)
+			if err != nil {
+				return err
+			}
+
 			// verify we have permission to write
-			md, err := fbo.getMDForWriteLocked(ctx, lState)
+			md, err := fbo.getMDForCoalescedWriteLocked(ctx, lState)
 			if err != nil {
 				return err
 			}
@@ -2722,7 +3303,13 @@ func (fbo *folderBranchOps) RemoveEntry(ctx context.Context, dir Node,
 				return err
 			}
 
-			return fbo.removeEntryLocked(ctx, lState, md, dirPath, name)
+			trashed, err := fbo.moveToTrashLocked(
+				ctx, lState, md, dirPath, name)
+			if err != nil || trashed {
+				return err
+			}
+
+			return fbo.removeEntryLocked(ctx, lState, md, dirPath, name)
 		})
 }
 
@@ -2732,11 +3319,23 @@ func (fbo *folderBranchOps) renameLocked(
 	fbo.mdWriterLock.AssertLocked(lState)
 
 	// verify we have permission to write
-	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	md, err := fbo.getMDForCoalescedWriteLocked(ctx, lState)
 	if err != nil {
 		return err
 	}
 
+	return fbo.renameWithMDLocked(
+		ctx, lState, md, oldParent, oldName, newParent, newName)
+}
+
+// renameWithMDLocked is like renameLocked, but makes the rename part
+// of md, which the caller may have already changed.
+func (fbo *folderBranchOps) renameWithMDLocked(
+	ctx context.Context, lState *lockState, md *RootMetadata,
+	oldParent path, oldName string, newParent path, newName string) (
+	err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
 	oldPBlock, newPBlock, newDe, lbc, err := fbo.blocks.PrepRename(
 		ctx, lState, md, oldParent, oldName, newParent, newName)
 
@@ -2744,8 +3343,21 @@ func (fbo *folderBranchOps) renameLocked(
 		return err
 	}
 
+	// Every link to a file has to stay in the same directory.
+	if newDe.LinkCount() > 1 &&
+		oldParent.tailPointer() != newParent.tailPointer() {
+		return CrossDirLinkError{oldName}
+	}
+
 	// does name exist?
+	replacedLink := false
 	if de, ok := newPBlock.Children[newName]; ok {
+		if de.isLinkOf(newDe) {
+			// POSIX says renaming a file over another link to
+			// itself does nothing.
+			return nil
+		}
+
 		// Usually higher-level programs check these, but just in case.
 		if de.Type == Dir && newDe.Type != Dir {
 			return NotDirError{newParent.ChildPathNoPtr(newName)}
@@ -2768,10 +3380,15 @@ func (fbo *folderBranchOps) renameLocked(
 			}
 		}
 
-		// Delete the old block pointed to by this direntry.
-		err := fbo.unrefEntry(ctx, lState, md, newParent, de, newName)
-		if err != nil {
-			return err
+		if de.LinkCount() > 1 {
+			// The replaced file lives on through its other links.
+			replacedLink = true
+		} else {
+			// Delete the old block pointed to by this direntry.
+			err := fbo.unrefEntry(ctx, lState, md, newParent, de, newName)
+			if err != nil {
+				return err
+			}
 		}
 	}
 
@@ -2779,6 +3396,9 @@ func (fbo *folderBranchOps) renameLocked(
 	newDe.Ctime = fbo.nowUnixNano()
 	newPBlock.Children[newName] = newDe
 	delete(oldPBlock.Children, oldName)
+	if replacedLink {
+		fixLinkCounts(newPBlock)
+	}
 
 	// find the common ancestor
 	var i int
@@ -2829,7 +3449,7 @@ func (fbo *folderBranchOps) renameLocked(
 		// TODO: optimize by pushing blocks from both paths in parallel
 		newOldPath, _, oldBps, err = fbo.syncBlockAndCheckEmbedLocked(
 			ctx, lState, md, oldPBlock, *oldParent.parentPath(), oldParent.tailName(),
-			Dir, true, true, commonAncestor, lbc)
+			Dir, nil, true, true, commonAncestor, lbc)
 		if err != nil {
 			return err
 		}
@@ -2837,7 +3457,7 @@ func (fbo *folderBranchOps) renameLocked(
 
 	newNewPath, _, newBps, err := fbo.syncBlockAndCheckEmbedLocked(
 		ctx, lState, md, newPBlock, *newParent.parentPath(), newParent.tailName(),
-		Dir, true, true, zeroPtr, lbc)
+		Dir, nil, true, true, zeroPtr, lbc)
 	if err != nil {
 		return err
 	}
@@ -2861,7 +3481,8 @@ func (fbo *folderBranchOps) renameLocked(
 
 	_, err = doBlockPuts(ctx, fbo.config.BlockServer(), fbo.config.BlockCache(),
 		fbo.config.Reporter(), fbo.log, md.TlfID(),
-		md.GetTlfHandle().GetCanonicalName(), *newBps)
+		md.GetTlfHandle().GetCanonicalName(), *newBps,
+		fbo.config.BlockTransferMeter().PutParallelism())
 	if err != nil {
 		return err
 	}
@@ -2876,13 +3497,29 @@ func (fbo *folderBranchOps) Rename(
 		oldName, newParent.GetID(), newName)
 	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
 
-	err = fbo.checkNode(newParent)
+	err = fbo.checkNodeForWrite(newParent)
+	if err != nil {
+		return err
+	}
+
+	err = fbo.throttleRevision(ctx, newParent)
 	if err != nil {
 		return err
 	}
 
 	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
 		func(lState *lockState) error {
+			oldParent, oldName, err := fbo.routeShardedLocked(
+				ctx, lState, oldParent, oldName, false)
+			if err != nil {
+				return err
+			}
+			newParent, newName, err := fbo.routeShardedLocked(
+				ctx, lState, newParent, newName, true)
+			if err != nil {
+				return err
+			}
+
 			oldParentPath, err := fbo.pathFromNodeForMDWriteLocked(lState, oldParent)
 			if err != nil {
 				return err
@@ -2898,25 +3535,35 @@ func (fbo *folderBranchOps) Rename(
 				return RenameAcrossDirsError{}
 			}
 
+			// The trash directory is hidden, and can't be replaced.
+			if isTrashDir(oldParentPath, oldName) {
+				return NoSuchNameError{oldName}
+			}
+			if isTrashDir(newParentPath, newName) {
+				return DisallowedPrefixError{newName, disallowedPrefixes[0]}
+			}
+
 			return fbo.renameLocked(ctx, lState, oldParentPath, oldName,
 				newParentPath, newName)
 		})
 }
 
-func (fbo *folderBranchOps) Read(
-	ctx context.Context, file Node, dest []byte, off int64) (
-	n int64, err error) {
-	fbo.log.CDebugf(ctx, "Read %p %d %d", file.GetID(), len(dest), off)
-	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
-
-	err = fbo.checkNode(file)
+// readHelper does the work common to Read and ReadSlices: it calls
+// doRead for the given file, which should read from it at off and
+// return how many bytes it read, and then prefetches ahead of the
+// reader if it looks sequential.
+func (fbo *folderBranchOps) readHelper(
+	ctx context.Context, file Node, off int64,
+	doRead func(ctx context.Context, lState *lockState, kmd KeyMetadata,
+		filePath path) (int64, error)) error {
+	err := fbo.checkNode(file)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
 	filePath, err := fbo.pathFromNodeForRead(file)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
 	{
@@ -2940,12 +3587,7 @@ func (fbo *folderBranchOps) Read(
 		}
 	}
 
-	// Don't let the goroutine below write directly to the return
-	// variable, since if the context is canceled the goroutine might
-	// outlast this function call, and end up in a read/write race
-	// with the caller.
-	var bytesRead int64
-	err = runUnlessCanceled(ctx, func() error {
+	return runUnlessCanceled(ctx, func() error {
 		lState := makeFBOLockState()
 
 		// verify we have permission to read
@@ -2954,9 +3596,40 @@ func (fbo *folderBranchOps) Read(
 			return err
 		}
 
+		bytesRead, err := doRead(ctx, lState, md.ReadOnly(), filePath)
+		if err != nil {
+			return err
+		}
+
+		ptrs, err := fbo.blocks.ReadAhead(
+			ctx, lState, md.ReadOnly(), filePath, off, bytesRead)
+		if err != nil {
+			// Readahead is only an optimization.
+			fbo.log.CDebugf(ctx, "Couldn't compute readahead: %v", err)
+		} else if len(ptrs) > 0 {
+			go fbo.prefetchInBackground(md.ReadOnly(), ptrs)
+		}
+		return nil
+	})
+}
+
+func (fbo *folderBranchOps) Read(
+	ctx context.Context, file Node, dest []byte, off int64) (
+	n int64, err error) {
+	fbo.log.CDebugf(ctx, "Read %p %d %d", file.GetID(), len(dest), off)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	// Don't let the goroutine below write directly to the return
+	// variable, since if the context is canceled the goroutine might
+	// outlast this function call, and end up in a read/write race
+	// with the caller.
+	var bytesRead int64
+	err = fbo.readHelper(ctx, file, off, func(ctx context.Context,
+		lState *lockState, kmd KeyMetadata, filePath path) (int64, error) {
+		var err error
 		bytesRead, err = fbo.blocks.Read(
-			ctx, lState, md.ReadOnly(), filePath, dest, off)
-		return err
+			ctx, lState, kmd, filePath, dest, off)
+		return bytesRead, err
 	})
 	if err != nil {
 		return 0, err
@@ -2964,12 +3637,51 @@ func (fbo *folderBranchOps) Read(
 	return bytesRead, nil
 }
 
+func (fbo *folderBranchOps) ReadSlices(
+	ctx context.Context, file Node, off, size int64) (
+	slices [][]byte, err error) {
+	fbo.log.CDebugf(ctx, "ReadSlices %p %d %d", file.GetID(), size, off)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	// As in Read, the goroutine below can't set slices directly.
+	var readSlices [][]byte
+	err = fbo.readHelper(ctx, file, off, func(ctx context.Context,
+		lState *lockState, kmd KeyMetadata, filePath path) (int64, error) {
+		var err error
+		readSlices, err = fbo.blocks.ReadSlices(
+			ctx, lState, kmd, filePath, off, size)
+		var n int64
+		for _, s := range readSlices {
+			n += int64(len(s))
+		}
+		return n, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return readSlices, nil
+}
+
+// prefetchInBackground fetches the given file blocks into the block
+// cache, without anyone waiting on it.
+func (fbo *folderBranchOps) prefetchInBackground(
+	kmd KeyMetadata, ptrs []BlockPointer) {
+	lState := makeFBOLockState()
+	err := fbo.runUnlessShutdown(func(ctx context.Context) error {
+		return fbo.blocks.Prefetch(ctx, lState, kmd, ptrs, fbo.branch())
+	})
+	if err != nil {
+		fbo.log.CDebugf(nil, "Prefetch of %d blocks failed: %v",
+			len(ptrs), err)
+	}
+}
+
 func (fbo *folderBranchOps) Write(
 	ctx context.Context, file Node, data []byte, off int64) (err error) {
 	fbo.log.CDebugf(ctx, "Write %p %d %d", file.GetID(), len(data), off)
 	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
 
-	err = fbo.checkNode(file)
+	err = fbo.checkNodeForWrite(file)
 	if err != nil {
 		return err
 	}
@@ -3001,7 +3713,7 @@ func (fbo *folderBranchOps) Truncate(
 	fbo.log.CDebugf(ctx, "Truncate %p %d", file.GetID(), size)
 	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
 
-	err = fbo.checkNode(file)
+	err = fbo.checkNodeForWrite(file)
 	if err != nil {
 		return err
 	}
@@ -3028,13 +3740,114 @@ func (fbo *folderBranchOps) Truncate(
 	})
 }
 
+func (fbo *folderBranchOps) Allocate(
+	ctx context.Context, file Node, off, length uint64,
+	mode AllocateMode) (err error) {
+	fbo.log.CDebugf(ctx, "Allocate %p %d %d %#x", file.GetID(), off, length,
+		int(mode))
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNodeForWrite(file)
+	if err != nil {
+		return err
+	}
+
+	return runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+
+		// Like Truncate, track the changes on the side rather than in
+		// the MD.
+		md, err := fbo.getMDLocked(ctx, lState, mdReadNeedIdentify)
+		if err != nil {
+			return err
+		}
+
+		err = fbo.blocks.Allocate(
+			ctx, lState, md.ReadOnly(), file, off, length, mode)
+		if err != nil {
+			return err
+		}
+
+		fbo.status.addDirtyNode(file)
+		return nil
+	})
+}
+
+func (fbo *folderBranchOps) GetDataRanges(
+	ctx context.Context, file Node) (ranges []DataRange, err error) {
+	fbo.log.CDebugf(ctx, "GetDataRanges %p", file.GetID())
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return nil, err
+	}
+
+	filePath, err := fbo.pathFromNodeForRead(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var rangesRead []DataRange
+	err = runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+
+		md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+		if err != nil {
+			return err
+		}
+
+		rangesRead, err = fbo.blocks.GetDataRanges(
+			ctx, lState, md.ReadOnly(), filePath)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rangesRead, nil
+}
+
+func (fbo *folderBranchOps) GetAllocatedSize(
+	ctx context.Context, file Node) (size uint64, err error) {
+	fbo.log.CDebugf(ctx, "GetAllocatedSize %p", file.GetID())
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %d %v", size, err) }()
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return 0, err
+	}
+
+	filePath, err := fbo.pathFromNodeForRead(file)
+	if err != nil {
+		return 0, err
+	}
+
+	var sizeRead uint64
+	err = runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+
+		md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+		if err != nil {
+			return err
+		}
+
+		sizeRead, err = fbo.blocks.GetAllocatedSize(
+			ctx, lState, md.ReadOnly(), filePath)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return sizeRead, nil
+}
+
 func (fbo *folderBranchOps) setExLocked(
 	ctx context.Context, lState *lockState, file path,
 	ex bool) (err error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
 	// verify we have permission to write
-	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	md, err := fbo.getMDForCoalescedWriteLocked(ctx, lState)
 	if err != nil {
 		return
 	}
@@ -3086,39 +3899,350 @@ func (fbo *folderBranchOps) setExLocked(
 
 	md.AddOp(sao)
 
-	dblock.Children[file.tailName()] = de
-	_, err = fbo.syncBlockAndFinalizeLocked(
-		ctx, lState, md, dblock, *parentPath.parentPath(), parentPath.tailName(),
-		Dir, false, false, zeroPtr, NoExcl)
-	return err
+	setEntryAndLinks(dblock, file.tailName(), de)
+	_, err = fbo.syncBlockAndFinalizeLocked(
+		ctx, lState, md, dblock, *parentPath.parentPath(), parentPath.tailName(),
+		Dir, false, false, zeroPtr, NoExcl)
+	return err
+}
+
+func (fbo *folderBranchOps) SetEx(
+	ctx context.Context, file Node, ex bool) (err error) {
+	fbo.log.CDebugf(ctx, "SetEx %p %t", file.GetID(), ex)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNodeForWrite(file)
+	if err != nil {
+		return
+	}
+
+	err = fbo.throttleRevision(ctx, file)
+	if err != nil {
+		return
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
+			if err != nil {
+				return err
+			}
+
+			return fbo.setExLocked(ctx, lState, filePath, ex)
+		})
+}
+
+func (fbo *folderBranchOps) setMtimeLocked(
+	ctx context.Context, lState *lockState, file path,
+	mtime *time.Time) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	// verify we have permission to write
+	md, err := fbo.getMDForCoalescedWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+
+	dblock, de, err := fbo.blocks.GetDirtyParentAndEntry(
+		ctx, lState, md.ReadOnly(), file)
+	if err != nil {
+		return err
+	}
+	de.Mtime = mtime.UnixNano()
+	// setting the mtime counts as changing the file MD, so must set ctime too
+	de.Ctime = fbo.nowUnixNano()
+
+	parentPath := file.parentPath()
+	sao, err := newSetAttrOp(file.tailName(), parentPath.tailPointer(),
+		mtimeAttr, file.tailPointer())
+	if err != nil {
+		return err
+	}
+
+	// If the MD doesn't match the MD expected by the path, that
+	// implies we are using a cached path, which implies the node has
+	// been unlinked.  In that case, we can safely ignore this
+	// setmtime.
+	if md.data.Dir.BlockPointer != file.path[0].BlockPointer {
+		fbo.log.CDebugf(ctx, "Skipping setmtime for a removed file %v",
+			file.tailPointer())
+		fbo.blocks.UpdateCachedEntryAttributesOnRemovedFile(
+			ctx, lState, sao, de)
+		return nil
+	}
+
+	md.AddOp(sao)
+
+	setEntryAndLinks(dblock, file.tailName(), de)
+	_, err = fbo.syncBlockAndFinalizeLocked(
+		ctx, lState, md, dblock, *parentPath.parentPath(), parentPath.tailName(),
+		Dir, false, false, zeroPtr, NoExcl)
+	return err
+}
+
+func (fbo *folderBranchOps) SetMtime(
+	ctx context.Context, file Node, mtime *time.Time) (err error) {
+	fbo.log.CDebugf(ctx, "SetMtime %p %v", file.GetID(), mtime)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if mtime == nil {
+		// Can happen on some OSes (e.g. OSX) when trying to set the atime only
+		return nil
+	}
+
+	err = fbo.checkNodeForWrite(file)
+	if err != nil {
+		return
+	}
+
+	err = fbo.throttleRevision(ctx, file)
+	if err != nil {
+		return
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
+			if err != nil {
+				return err
+			}
+
+			return fbo.setMtimeLocked(ctx, lState, filePath, mtime)
+		})
+}
+
+// setPosixAttrLocked applies update, which sets either the mode or
+// the owner hints, to the entry for file.  update returns false if
+// it didn't change anything.  Like setex, this does nothing for the
+// TLF root, whose entry isn't in a directory block.
+func (fbo *folderBranchOps) setPosixAttrLocked(
+	ctx context.Context, lState *lockState, file path, attr attrChange,
+	update func(de *DirEntry) bool) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	if !file.hasValidParent() {
+		fbo.log.CDebugf(ctx, "Ignoring set%s on the TLF root", attr)
+		return nil
+	}
+
+	// verify we have permission to write
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+
+	dblock, de, err := fbo.blocks.GetDirtyParentAndEntry(
+		ctx, lState, md.ReadOnly(), file)
+	if err != nil {
+		return err
+	}
+
+	if !update(&de) {
+		fbo.log.CDebugf(ctx, "Ignoring no-op set%s", attr)
+		return nil
+	}
+	de.Ctime = fbo.nowUnixNano()
+
+	parentPath := file.parentPath()
+	sao, err := newSetAttrOp(file.tailName(), parentPath.tailPointer(),
+		attr, file.tailPointer())
+	if err != nil {
+		return err
+	}
+
+	// If the MD doesn't match the MD expected by the path, that
+	// implies we are using a cached path, which implies the node has
+	// been unlinked.  In that case, just update the cached entry.
+	if md.data.Dir.BlockPointer != file.path[0].BlockPointer {
+		fbo.log.CDebugf(ctx, "Skipping set%s for a removed file %v",
+			attr, file.tailPointer())
+		fbo.blocks.UpdateCachedEntryAttributesOnRemovedFile(
+			ctx, lState, sao, de)
+		return nil
+	}
+
+	md.AddOp(sao)
+
+	setEntryAndLinks(dblock, file.tailName(), de)
+	_, err = fbo.syncBlockAndFinalizeLocked(
+		ctx, lState, md, dblock, *parentPath.parentPath(), parentPath.tailName(),
+		Dir, false, false, zeroPtr, NoExcl)
+	return err
+}
+
+func (fbo *folderBranchOps) changePosixAttr(ctx context.Context,
+	node Node, attr attrChange, update func(de *DirEntry) bool) error {
+	err := fbo.checkNodeForWrite(node)
+	if err != nil {
+		return err
+	}
+
+	err = fbo.throttleRevision(ctx, node)
+	if err != nil {
+		return err
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, node)
+			if err != nil {
+				return err
+			}
+
+			return fbo.setPosixAttrLocked(ctx, lState, filePath, attr, update)
+		})
+}
+
+func (fbo *folderBranchOps) SetMode(
+	ctx context.Context, file Node, mode os.FileMode) (err error) {
+	fbo.log.CDebugf(ctx, "SetMode %p %v", file.GetID(), mode)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	bits := posixBitsFromFileMode(mode)
+	return fbo.changePosixAttr(ctx, file, modeAttr, func(de *DirEntry) bool {
+		// Symlinks have no mode of their own, as with setex.
+		if de.Type == Sym {
+			return false
+		}
+		ex := bits&posixUserExec != 0
+		isFile := de.Type == File || de.Type == Exec
+		if de.Mode != nil && *de.Mode == bits &&
+			(!isFile || ex == (de.Type == Exec)) {
+			return false
+		}
+		de.Mode = &bits
+		if ex && de.Type == File {
+			de.Type = Exec
+		} else if !ex && de.Type == Exec {
+			de.Type = File
+		}
+		return true
+	})
+}
+
+func (fbo *folderBranchOps) SetOwner(
+	ctx context.Context, file Node, uid, gid int) (err error) {
+	fbo.log.CDebugf(ctx, "SetOwner %p %d %d", file.GetID(), uid, gid)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if uid < 0 && gid < 0 {
+		return nil
+	}
+	_, user, err := fbo.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return err
+	}
+	return fbo.changePosixAttr(ctx, file, ownerAttr, func(de *DirEntry) bool {
+		changed := false
+		if de.OwnerUser != user {
+			// Hints from another user's devices mean nothing
+			// next to ours.
+			de.UID, de.GID = nil, nil
+			de.OwnerUser = user
+			changed = true
+		}
+		if uid >= 0 && (de.UID == nil || int(*de.UID) != uid) {
+			u := uint32(uid)
+			de.UID = &u
+			changed = true
+		}
+		if gid >= 0 && (de.GID == nil || int(*de.GID) != gid) {
+			g := uint32(gid)
+			de.GID = &g
+			changed = true
+		}
+		return changed
+	})
+}
+
+// readXattrValue returns the contents of v, fetching its block if
+// it isn't inline.  nodePath is the path of the entry holding v.
+func (fbo *folderBranchOps) readXattrValue(ctx context.Context,
+	lState *lockState, nodePath path, v XattrValue) ([]byte, error) {
+	if v.Block.BlockPointer == zeroPtr {
+		return v.Inline, nil
+	}
+	md, err := fbo.getMDForReadNoIdentify(ctx, lState)
+	if err != nil {
+		return nil, err
+	}
+	block, err := fbo.blocks.GetFileBlockForReading(ctx, lState,
+		md.ReadOnly(), v.Block.BlockPointer, fbo.branch(), nodePath)
+	if err != nil {
+		return nil, err
+	}
+	return block.Contents, nil
 }
 
-func (fbo *folderBranchOps) SetEx(
-	ctx context.Context, file Node, ex bool) (err error) {
-	fbo.log.CDebugf(ctx, "SetEx %p %t", file.GetID(), ex)
+func (fbo *folderBranchOps) GetXattr(
+	ctx context.Context, node Node, name string) (value []byte, err error) {
+	fbo.log.CDebugf(ctx, "GetXattr %p %s", node.GetID(), name)
 	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
 
-	err = fbo.checkNode(file)
+	if name == SyncStateXattrName {
+		state, err := fbo.FileSyncState(ctx, node)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(state.String()), nil
+	}
+
+	err = runUnlessCanceled(ctx, func() error {
+		de, err := fbo.statEntry(ctx, node)
+		if err != nil {
+			return err
+		}
+		v, ok := de.Xattrs[name]
+		if !ok {
+			return NoSuchXattrError{name}
+		}
+		nodePath, err := fbo.pathFromNodeForRead(node)
+		if err != nil {
+			return err
+		}
+		value, err = fbo.readXattrValue(
+			ctx, makeFBOLockState(), nodePath, v)
+		return err
+	})
 	if err != nil {
-		return
+		return nil, err
 	}
+	return value, nil
+}
 
-	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
-		func(lState *lockState) error {
-			filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
-			if err != nil {
-				return err
-			}
+func (fbo *folderBranchOps) ListXattr(
+	ctx context.Context, node Node) (names []string, err error) {
+	fbo.log.CDebugf(ctx, "ListXattr %p", node.GetID())
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
 
-			return fbo.setExLocked(ctx, lState, filePath, ex)
-		})
+	var de DirEntry
+	err = runUnlessCanceled(ctx, func() error {
+		de, err = fbo.statEntry(ctx, node)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for name := range de.Xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
 }
 
-func (fbo *folderBranchOps) setMtimeLocked(
-	ctx context.Context, lState *lockState, file path,
-	mtime *time.Time) error {
+// setXattrLocked sets the named extended attribute of file to value,
+// or removes it if remove is true.
+func (fbo *folderBranchOps) setXattrLocked(ctx context.Context,
+	lState *lockState, file path, name string, value []byte,
+	remove bool) error {
 	fbo.mdWriterLock.AssertLocked(lState)
 
+	// The root's entry lives in the MD rather than in a directory
+	// block, so it can't have any xattrs.
+	if !file.hasValidParent() {
+		return NoRootXattrsError{}
+	}
+
 	// verify we have permission to write
 	md, err := fbo.getMDForWriteLocked(ctx, lState)
 	if err != nil {
@@ -3130,24 +4254,34 @@ func (fbo *folderBranchOps) setMtimeLocked(
 	if err != nil {
 		return err
 	}
-	de.Mtime = mtime.UnixNano()
-	// setting the mtime counts as changing the file MD, so must set ctime too
-	de.Ctime = fbo.nowUnixNano()
+	oldValue, ok := de.Xattrs[name]
+	if remove && !ok {
+		return NoSuchXattrError{name}
+	}
 
 	parentPath := file.parentPath()
 	sao, err := newSetAttrOp(file.tailName(), parentPath.tailPointer(),
-		mtimeAttr, file.tailPointer())
+		xattrAttr, file.tailPointer())
 	if err != nil {
 		return err
 	}
+	sao.XattrName = name
+
+	newXattrs := map[string]XattrValue{}
+	if !remove {
+		newXattrs[name] = XattrValue{Inline: value}
+	}
 
 	// If the MD doesn't match the MD expected by the path, that
 	// implies we are using a cached path, which implies the node has
-	// been unlinked.  In that case, we can safely ignore this
-	// setmtime.
+	// been unlinked.  In that case, just keep the new value in the
+	// cached entry, even if it's too big to be inline, since it
+	// will never be written out.
 	if md.data.Dir.BlockPointer != file.path[0].BlockPointer {
-		fbo.log.CDebugf(ctx, "Skipping setmtime for a removed file %v",
+		fbo.log.CDebugf(ctx, "Skipping setxattr for a removed file %v",
 			file.tailPointer())
+		de.Xattrs = copyXattrs(de.Xattrs, newXattrs, []string{name})
+		de.Ctime = fbo.nowUnixNano()
 		fbo.blocks.UpdateCachedEntryAttributesOnRemovedFile(
 			ctx, lState, sao, de)
 		return nil
@@ -3155,39 +4289,88 @@ func (fbo *folderBranchOps) setMtimeLocked(
 
 	md.AddOp(sao)
 
-	dblock.Children[file.tailName()] = de
-	_, err = fbo.syncBlockAndFinalizeLocked(
+	bps := newBlockPutState(1)
+	if !remove && len(value) > maxInlineXattrSize {
+		_, uid, err := fbo.config.KBPKI().GetCurrentUserInfo(ctx)
+		if err != nil {
+			return err
+		}
+		block := NewFileBlock().(*FileBlock)
+		block.Contents = value
+		info, _, err := fbo.readyBlockMultiple(
+			ctx, md.ReadOnly(), block, uid, bps)
+		if err != nil {
+			return err
+		}
+		md.AddRefBlock(info)
+		newXattrs[name] = XattrValue{Block: info}
+	}
+	if ok && oldValue.Block.BlockPointer != zeroPtr {
+		md.AddUnrefBlock(oldValue.Block)
+	}
+
+	de.Xattrs = copyXattrs(de.Xattrs, newXattrs, []string{name})
+	de.Ctime = fbo.nowUnixNano()
+	setEntryAndLinks(dblock, file.tailName(), de)
+	_, err = fbo.syncBlockAndFinalizeWithBlocksLocked(
 		ctx, lState, md, dblock, *parentPath.parentPath(), parentPath.tailName(),
-		Dir, false, false, zeroPtr, NoExcl)
+		Dir, false, false, zeroPtr, NoExcl, bps)
 	return err
 }
 
-func (fbo *folderBranchOps) SetMtime(
-	ctx context.Context, file Node, mtime *time.Time) (err error) {
-	fbo.log.CDebugf(ctx, "SetMtime %p %v", file.GetID(), mtime)
-	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
-
-	if mtime == nil {
-		// Can happen on some OSes (e.g. OSX) when trying to set the atime only
-		return nil
+func (fbo *folderBranchOps) changeXattr(ctx context.Context, node Node,
+	name string, value []byte, remove bool) error {
+	err := fbo.checkNodeForWrite(node)
+	if err != nil {
+		return err
 	}
 
-	err = fbo.checkNode(file)
+	err = fbo.throttleRevision(ctx, node)
 	if err != nil {
-		return
+		return err
 	}
 
 	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
 		func(lState *lockState) error {
-			filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
+			filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, node)
 			if err != nil {
 				return err
 			}
 
-			return fbo.setMtimeLocked(ctx, lState, filePath, mtime)
+			return fbo.setXattrLocked(
+				ctx, lState, filePath, name, value, remove)
 		})
 }
 
+func (fbo *folderBranchOps) SetXattr(
+	ctx context.Context, node Node, name string, value []byte) (err error) {
+	fbo.log.CDebugf(ctx, "SetXattr %p %s (%d bytes)",
+		node.GetID(), name, len(value))
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if name == SyncStateXattrName {
+		return ReadOnlyXattrError{name}
+	}
+	if len(name) == 0 || len(name) > maxXattrNameLen {
+		return InvalidXattrNameError{name}
+	}
+	if len(value) > maxXattrSize {
+		return XattrTooBigError{name, uint64(len(value)), maxXattrSize}
+	}
+	return fbo.changeXattr(ctx, node, name, value, false)
+}
+
+func (fbo *folderBranchOps) RemoveXattr(
+	ctx context.Context, node Node, name string) (err error) {
+	fbo.log.CDebugf(ctx, "RemoveXattr %p %s", node.GetID(), name)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if name == SyncStateXattrName {
+		return ReadOnlyXattrError{name}
+	}
+	return fbo.changeXattr(ctx, node, name, nil, true)
+}
+
 func (fbo *folderBranchOps) syncLocked(ctx context.Context,
 	lState *lockState, file path) (stillDirty bool, err error) {
 	fbo.mdWriterLock.AssertLocked(lState)
@@ -3200,7 +4383,17 @@ func (fbo *folderBranchOps) syncLocked(ctx context.Context,
 	// Verify we have permission to write.  We do this after the dirty
 	// check because otherwise readers who sync clean files on close
 	// would get an error.
-	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	var md *RootMetadata
+	if ctx.Value(CtxBackgroundSyncKey) != nil {
+		window := fbo.config.MDCoalesceWindow()
+		if window < backgroundFlushCoalesceWindow {
+			window = backgroundFlushCoalesceWindow
+		}
+		md, err = fbo.getMDForCoalescedWriteWithWindowLocked(
+			ctx, lState, window)
+	} else {
+		md, err = fbo.getMDForWriteLocked(ctx, lState)
+	}
 	if err != nil {
 		return true, err
 	}
@@ -3209,6 +4402,14 @@ func (fbo *folderBranchOps) syncLocked(ctx context.Context,
 	// implies we are using a cached path, which implies the node has
 	// been unlinked.  In that case, we can safely ignore this sync.
 	if md.data.Dir.BlockPointer != file.path[0].BlockPointer {
+		if ts := fbo.getTombstoneLocked(
+			lState, file.tailPointer().ref()); ts != nil {
+			err := fbo.preserveRemovedFileLocked(ctx, lState, md, file, ts)
+			if err != nil {
+				return true, err
+			}
+			return false, nil
+		}
 		fbo.log.CDebugf(ctx, "Skipping sync for a removed file %v",
 			file.tailPointer())
 		// Removing the cached info here is a little sketchy,
@@ -3229,10 +4430,18 @@ func (fbo *folderBranchOps) syncLocked(ctx context.Context,
 	fbo.config.Reporter().Notify(ctx, writeNotification(file, false))
 	defer fbo.config.Reporter().Notify(ctx, writeNotification(file, true))
 
-	// Filled in by doBlockPuts below.
+	// The file's blocks are put as soon as StartSync readies each
+	// of them, rather than after they're all ready.
+	puts := newBlockPutPipeline(ctx, fbo.config.BlockServer(),
+		fbo.config.Reporter(), fbo.log, md.TlfID(),
+		md.GetTlfHandle().GetCanonicalName(),
+		fbo.config.BlockTransferMeter().PutParallelism())
+	defer puts.cancel()
+
+	// Filled in by puts.wait below.
 	var blocksToRemove []BlockPointer
 	fblock, bps, lbc, syncState, err :=
-		fbo.blocks.StartSync(ctx, lState, md, uid, file)
+		fbo.blocks.StartSync(ctx, lState, md, uid, file, puts)
 	defer func() {
 		fbo.blocks.CleanupSyncState(
 			ctx, lState, md.ReadOnly(), file, blocksToRemove, syncState, err)
@@ -3244,7 +4453,8 @@ func (fbo *folderBranchOps) syncLocked(ctx context.Context,
 	newPath, _, newBps, err :=
 		fbo.syncBlockAndCheckEmbedLocked(
 			ctx, lState, md, fblock, *file.parentPath(),
-			file.tailName(), File, true, true, zeroPtr, lbc)
+			file.tailName(), File, nil, !syncState.rewriteOnly,
+			!syncState.rewriteOnly, zeroPtr, lbc)
 	if err != nil {
 		return true, err
 	}
@@ -3257,9 +4467,13 @@ func (fbo *folderBranchOps) syncLocked(ctx context.Context,
 	// don't want them cleaned up in that case.  Instead, the
 	// FinishSync call below will take care of that.
 
-	blocksToRemove, err = doBlockPuts(ctx, fbo.config.BlockServer(),
-		fbo.config.BlockCache(), fbo.config.Reporter(), fbo.log, md.TlfID(),
-		md.GetTlfHandle().GetCanonicalName(), *bps)
+	for _, bs := range newBps.blockStates {
+		err = puts.put(bs)
+		if err != nil {
+			return true, err
+		}
+	}
+	blocksToRemove, err = puts.wait(fbo.config.BlockCache())
 	if err != nil {
 		return true, err
 	}
@@ -3284,15 +4498,43 @@ func (fbo *folderBranchOps) syncLocked(ctx context.Context,
 		md.ReadOnly(), syncState, fbo.fbm)
 }
 
-func (fbo *folderBranchOps) Sync(ctx context.Context, file Node) (err error) {
-	fbo.log.CDebugf(ctx, "Sync %p", file.GetID())
+func (fbo *folderBranchOps) Sync(ctx context.Context, file Node) error {
+	fbo.syncDurabilityLock.Lock()
+	durability := fbo.syncDurability
+	fbo.syncDurabilityLock.Unlock()
+	return fbo.SyncWithDurability(ctx, file, durability)
+}
+
+// SyncWithDurability implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) SyncWithDurability(ctx context.Context,
+	file Node, durability WriteDurability) (err error) {
+	fbo.log.CDebugf(ctx, "Sync %p (durability: %s)", file.GetID(), durability)
 	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
 
+	if durability != WriteDurabilityLocal &&
+		durability != WriteDurabilityServer {
+		return fmt.Errorf("Unknown write durability %s", durability)
+	}
 	err = fbo.checkNode(file)
 	if err != nil {
 		return
 	}
 
+	// Syncing a clean file is a no-op (e.g., on close of a file
+	// that was only read), so only refuse it if there's actually
+	// something to write.
+	if fbo.status.isDirtyNode(file) {
+		err = fbo.checkWritesNotPaused()
+		if err != nil {
+			return err
+		}
+		err = fbo.throttleRevision(ctx, file)
+		if err != nil {
+			return err
+		}
+	}
+
 	var stillDirty bool
 	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
 		func(lState *lockState) error {
@@ -3312,6 +4554,52 @@ func (fbo *folderBranchOps) Sync(ctx context.Context, file Node) (err error) {
 		fbo.status.rmDirtyNode(file)
 	}
 
+	if durability == WriteDurabilityServer {
+		return fbo.flushJournalForSync(ctx)
+	}
+	return nil
+}
+
+// flushJournalForSync flushes this folder's journal, if it has one,
+// including the revision just made by a sync.  Unlike waiting for the
+// background flush, this also works while the journal is paused, or
+// deferring its flushes on a metered network.
+func (fbo *folderBranchOps) flushJournalForSync(ctx context.Context) error {
+	jServer, err := GetJournalServer(fbo.config)
+	if err != nil {
+		// No journal, so the sync already went to the servers.
+		return nil
+	}
+	err = jServer.Flush(ctx, fbo.id())
+	if err != nil {
+		return SyncNotOnServerError{fbo.id(), err}
+	}
+	return nil
+}
+
+// SetSyncDurability implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) SetSyncDurability(ctx context.Context,
+	folderBranch FolderBranch, durability WriteDurability) error {
+	fbo.log.CDebugf(ctx, "Setting syncDurability=%s", durability)
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+	if durability != WriteDurabilityLocal &&
+		durability != WriteDurabilityServer {
+		return fmt.Errorf("Unknown write durability %s", durability)
+	}
+
+	fbo.syncDurabilityLock.Lock()
+	defer fbo.syncDurabilityLock.Unlock()
+	// Persist the setting first, so that it doesn't silently go
+	// away on restart.
+	err := fbo.config.SetSyncDurabilityForTLF(fbo.id(), durability)
+	if err != nil {
+		return err
+	}
+	fbo.syncDurability = durability
+	fbo.status.setSyncDurability(durability)
 	return nil
 }
 
@@ -3326,7 +4614,56 @@ func (fbo *folderBranchOps) FolderStatus(
 			WrongOpsError{fbo.folderBranch, folderBranch}
 	}
 
-	return fbo.status.getStatus(ctx)
+	fbo.status.updatePendingDevices(ctx)
+	return fbo.folderStatus(ctx)
+}
+
+// folderStatus returns the current status, without looking up which
+// devices are still waiting for keys first.
+func (fbo *folderBranchOps) folderStatus(ctx context.Context) (
+	fbs FolderBranchStatus, updateChan <-chan StatusUpdate, err error) {
+	fbs, updateChan, err = fbo.status.getStatus(ctx)
+	if err != nil {
+		return FolderBranchStatus{}, nil, err
+	}
+	fbs.IsConnected = fbo.config.MDServer().IsConnected()
+	if pm, ok := fbo.mdWriterLock.locker.(*priorityMutex); ok {
+		fbs.MDWriterWaitingForeground, fbs.MDWriterWaitingBackground =
+			pm.queueLengths()
+	}
+	fbs.ReadaheadWindows = fbo.blocks.getReadaheadWindows()
+	if sc := getSyncCache(fbo.config); sc != nil {
+		if syncStatus, ok := sc.getStatus(fbo.id()); ok {
+			fbs.Sync = &syncStatus
+		}
+	}
+	cs := fbo.cr.getStatus()
+	fbs.CRInProgress = cs.CRInProgress
+	fbs.CRHeld = cs.CRHeld
+	fbs.LastCRError = cs.LastCRError
+	return fbs, updateChan, nil
+}
+
+func (fbo *folderBranchOps) GetConflictStatus(
+	ctx context.Context, folderBranch FolderBranch) (
+	cs ConflictStatus, err error) {
+	fbo.log.CDebugf(ctx, "GetConflictStatus")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return ConflictStatus{}, WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	fbs, _, err := fbo.status.getStatus(ctx)
+	if err != nil {
+		return ConflictStatus{}, err
+	}
+	cs = fbo.cr.getStatus()
+	cs.Staged = fbs.Staged
+	cs.BranchID = fbs.BranchID
+	cs.Unmerged = fbs.Unmerged
+	cs.Merged = fbs.Merged
+	return cs, nil
 }
 
 func (fbo *folderBranchOps) Status(
@@ -3335,6 +4672,20 @@ func (fbo *folderBranchOps) Status(
 	return KBFSStatus{}, nil, InvalidOpError{}
 }
 
+func (fbo *folderBranchOps) Health(ctx context.Context) (KBFSHealth, error) {
+	return KBFSHealth{}, InvalidOpError{}
+}
+
+func (fbo *folderBranchOps) SlowOpReports() []SlowOpReport {
+	// Only KBFSOpsStandard watches for slow ops.
+	return nil
+}
+
+func (fbo *folderBranchOps) GetUserQuotaInfo(ctx context.Context) (
+	*UserQuotaInfo, error) {
+	return nil, InvalidOpError{}
+}
+
 // RegisterForChanges registers a single Observer to receive
 // notifications about this folder/branch.
 func (fbo *folderBranchOps) RegisterForChanges(obs Observer) error {
@@ -3456,6 +4807,13 @@ func (fbo *folderBranchOps) notifyOneOpLocked(ctx context.Context,
 			fbo.log.CErrorf(ctx, "Couldn't unlink from cache: %v", err)
 			return
 		}
+
+		// Removing one of several hard links doesn't unref
+		// anything, and the child node might need a new name.
+		if len(op.Unrefs()) == 0 {
+			fbo.relinkRemovedNameLocked(
+				ctx, lState, md.ReadOnly(), node, realOp.OldName)
+		}
 	case *renameOp:
 		oldNode := fbo.nodeCache.Get(realOp.OldDir.Ref.ref())
 		if oldNode != nil {
@@ -3524,6 +4882,10 @@ func (fbo *folderBranchOps) notifyOneOpLocked(ctx context.Context,
 					fbo.log.CErrorf(ctx, "Couldn't unlink from cache: %v", err)
 					return
 				}
+				if len(op.Unrefs()) == 0 {
+					fbo.relinkRemovedNameLocked(
+						ctx, lState, md.ReadOnly(), newNode, realOp.NewName)
+				}
 				err = fbo.nodeCache.Move(realOp.Renamed.ref(), newNode, realOp.NewName)
 				if err != nil {
 					fbo.log.CErrorf(ctx, "Couldn't move node in cache: %v", err)
@@ -3705,6 +5067,7 @@ func (fbo *folderBranchOps) applyMDUpdatesLocked(ctx context.Context,
 			continue
 		}
 		for _, op := range rmd.data.Changes.Ops {
+			fbo.addTombstonesLocked(ctx, lState, op)
 			fbo.notifyOneOpLocked(ctx, lState, op, rmd)
 		}
 		appliedRevs = append(appliedRevs, rmd)
@@ -3948,47 +5311,282 @@ func (fbo *folderBranchOps) undoUnmergedMDUpdatesLocked(
 		}
 	}
 
-	return unmergedPtrs, nil
+	return unmergedPtrs, nil
+}
+
+func (fbo *folderBranchOps) unstageLocked(ctx context.Context,
+	lState *lockState) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	// fetch all of my unstaged updates, and undo them one at a time
+	bid, wasMasterBranch := fbo.bid, fbo.isMasterBranchLocked(lState)
+	unmergedPtrs, err := fbo.undoUnmergedMDUpdatesLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+
+	// let the server know we no longer have need
+	if !wasMasterBranch {
+		err = fbo.config.MDOps().PruneBranch(ctx, fbo.id(), bid)
+		if err != nil {
+			return err
+		}
+	}
+
+	// now go forward in time, if possible
+	err = fbo.getAndApplyMDUpdates(ctx, lState,
+		fbo.applyMDUpdatesLocked)
+	if err != nil {
+		return err
+	}
+
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+
+	// Finally, create a resolutionOp with the newly-unref'd pointers.
+	resOp := newResolutionOp()
+	for _, ptr := range unmergedPtrs {
+		resOp.AddUnrefBlock(ptr)
+	}
+	md.AddOp(resOp)
+	return fbo.finalizeMDWriteLocked(ctx, lState, md, &blockPutState{}, NoExcl)
+}
+
+func (fbo *folderBranchOps) setWritesPaused(
+	ctx context.Context, folderBranch FolderBranch, paused bool) error {
+	fbo.log.CDebugf(ctx, "Setting writesPaused=%t", paused)
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	fbo.writesPausedLock.Lock()
+	defer fbo.writesPausedLock.Unlock()
+	fbo.writesPaused = paused
+	fbo.status.setWritesPaused(paused)
+	return nil
+}
+
+// FolderBranchOpsState is a snapshot of the internal bookkeeping of
+// one folder-branch.  It's meant for tests and debugging tools, so
+// they don't have to reach into private fields (and take private
+// locks) to find out what a folder is up to.
+type FolderBranchOpsState struct {
+	// Revision and BID describe the current head, if any.
+	Revision MetadataRevision
+	BID      BranchID
+	// WritesPaused is true if PauseWrites is in effect.
+	WritesPaused bool
+
+	// Dirty is true if there are local writes that haven't yet
+	// been synced.
+	Dirty bool
+	// DirtyFiles is the number of files with dirty blocks that
+	// are either being synced, or waiting to be.
+	DirtyFiles int
+	// DirtyEntries is the number of modified but uncommitted
+	// directory entries.
+	DirtyEntries int
+	// UnrefCacheEntries is the number of files with unsynced
+	// block unrefs.
+	UnrefCacheEntries int
+	// DeferredWrites is the number of writes and truncates that
+	// came in during a sync, and will be replayed after it.
+	DeferredWrites int
+	// DeferredDirtyDeletes is the number of dirty blocks that
+	// will be dropped before those writes are replayed.
+	DeferredDirtyDeletes int
+
+	// PendingBlockDeletes is the number of batches of blocks, left
+	// over from failed MD writes, that are queued for deletion.
+	PendingBlockDeletes int
+}
+
+// releaseRef drops a reference taken by KBFSOpsStandard.getOpsRef.
+func (fbo *folderBranchOps) releaseRef() {
+	atomic.AddInt32(&fbo.refs, -1)
+}
+
+// isIdle returns true if nothing depends on this folderBranchOps
+// staying in memory: there are no outstanding local changes or
+// unflushed journal entries, no live Nodes, nobody registered for changes, no
+// background work queued, and no per-folder setting or timer that
+// only lives in memory.  An idle folderBranchOps can be shut down and
+// later recreated from the server on demand, and the recreated one
+// must behave the same.
+func (fbo *folderBranchOps) isIdle() bool {
+	lState := makeFBOLockState()
+	if fbo.blocks.GetState(lState) != cleanState ||
+		!fbo.isMDWriterStateIdle(lState) {
+		return false
+	}
+	if fbo.nodeCache.NumNodes() > 0 || fbo.observers.len() > 0 {
+		return false
+	}
+	if err := fbo.checkWritesNotPaused(); err != nil {
+		return false
+	}
+	if manual, held := fbo.cr.isManual(); manual || held {
+		return false
+	}
+	fbo.syncDurabilityLock.Lock()
+	durability := fbo.syncDurability
+	fbo.syncDurabilityLock.Unlock()
+	if durability != fbo.config.SyncDurabilityForTLF(fbo.id()) {
+		return false
+	}
+	if fbo.rangeLocks.isHolding() || fbo.fbm.hasPendingWork() {
+		return false
+	}
+	if jServer, err := GetJournalServer(fbo.config); err == nil &&
+		jServer.hasUnflushedEntries(fbo.id()) {
+		return false
+	}
+	return true
+}
+
+// getStateForTesting returns a snapshot of this folder-branch's
+// state.  Each group of fields is read under the lock that protects
+// it, but the snapshot as a whole isn't atomic, and it never takes
+// mdWriterLock, so it's safe to call while an operation is stalled
+// in the middle.
+func (fbo *folderBranchOps) getStateForTesting() FolderBranchOpsState {
+	lState := makeFBOLockState()
+	var state FolderBranchOpsState
+	head := fbo.getHead(lState)
+	if head != (ImmutableRootMetadata{}) {
+		state.Revision = head.Revision()
+		state.BID = head.BID()
+	}
+
+	fbo.writesPausedLock.Lock()
+	state.WritesPaused = fbo.writesPaused
+	fbo.writesPausedLock.Unlock()
+
+	fbo.blocks.fillStateForTesting(lState, &state)
+	state.PendingBlockDeletes = len(fbo.fbm.blocksToDeleteChan)
+	return state
+}
+
+// PauseWrites implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) PauseWrites(
+	ctx context.Context, folderBranch FolderBranch) error {
+	return fbo.setWritesPaused(ctx, folderBranch, true)
+}
+
+// ResumeWrites implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) ResumeWrites(
+	ctx context.Context, folderBranch FolderBranch) error {
+	return fbo.setWritesPaused(ctx, folderBranch, false)
 }
 
-func (fbo *folderBranchOps) unstageLocked(ctx context.Context,
-	lState *lockState) error {
-	fbo.mdWriterLock.AssertLocked(lState)
+// WriteFence implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) WriteFence(
+	ctx context.Context, folderBranch FolderBranch,
+	durability WriteDurability) (wf *WriteFence, err error) {
+	fbo.log.CDebugf(ctx, "WriteFence %s", durability)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
 
-	// fetch all of my unstaged updates, and undo them one at a time
-	bid, wasMasterBranch := fbo.bid, fbo.isMasterBranchLocked(lState)
-	unmergedPtrs, err := fbo.undoUnmergedMDUpdatesLocked(ctx, lState)
-	if err != nil {
-		return err
+	if folderBranch != fbo.folderBranch {
+		return nil, WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+	if durability != WriteDurabilityLocal &&
+		durability != WriteDurabilityServer {
+		return nil, fmt.Errorf("Unknown write durability %s", durability)
 	}
 
-	// let the server know we no longer have need
-	if !wasMasterBranch {
-		err = fbo.config.MDOps().PruneBranch(ctx, fbo.id(), bid)
+	// Grab the nodes that are dirty right now; any write issued
+	// before this point is in one of them, or has already been
+	// synced.  A node that's gone from the cache has nothing left
+	// to sync.
+	lState := makeFBOLockState()
+	var nodes []Node
+	for _, ref := range fbo.blocks.GetDirtyRefs(lState) {
+		if node := fbo.nodeCache.Get(ref); node != nil {
+			nodes = append(nodes, node)
+		}
+	}
+
+	wf = newWriteFence(durability)
+	go func() {
+		wf.release(fbo.runUnlessShutdown(func(ctx context.Context) error {
+			return fbo.waitForWriteFence(ctx, nodes, durability)
+		}))
+	}()
+	return wf, nil
+}
+
+func (fbo *folderBranchOps) waitForWriteFence(ctx context.Context,
+	nodes []Node, durability WriteDurability) error {
+	for _, node := range nodes {
+		// If the file was already synced since the fence was
+		// made, this is a no-op.  The journal is waited on
+		// once, below, rather than for each file.
+		err := fbo.SyncWithDurability(ctx, node, WriteDurabilityLocal)
 		if err != nil {
 			return err
 		}
 	}
+	if durability != WriteDurabilityServer {
+		return nil
+	}
+	// This waits for the journal to be completely flushed, which
+	// may include writes made after the fence.
+	return WaitForTLFJournal(ctx, fbo.config, fbo.id(), fbo.log)
+}
 
-	// now go forward in time, if possible
-	err = fbo.getAndApplyMDUpdates(ctx, lState,
-		fbo.applyMDUpdatesLocked)
+func (fbo *folderBranchOps) rangeLockFileForNode(file Node) (string, error) {
+	err := fbo.checkNode(file)
+	if err != nil {
+		return "", err
+	}
+	p, err := fbo.pathFromNodeForRead(file)
+	if err != nil {
+		return "", err
+	}
+	return rangeLockFileName(p), nil
+}
+
+// LockRange implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) LockRange(
+	ctx context.Context, file Node, lock RangeLock) (err error) {
+	fbo.log.CDebugf(ctx, "LockRange %p %s", file.GetID(), lock)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	name, err := fbo.rangeLockFileForNode(file)
 	if err != nil {
 		return err
 	}
+	return fbo.rangeLocks.lockRange(ctx, name, lock)
+}
 
-	md, err := fbo.getMDForWriteLocked(ctx, lState)
+// UnlockRange implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) UnlockRange(
+	ctx context.Context, file Node, lock RangeLock) (err error) {
+	fbo.log.CDebugf(ctx, "UnlockRange %p %s", file.GetID(), lock)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	name, err := fbo.rangeLockFileForNode(file)
 	if err != nil {
 		return err
 	}
+	return fbo.rangeLocks.unlockRange(ctx, name, lock)
+}
 
-	// Finally, create a resolutionOp with the newly-unref'd pointers.
-	resOp := newResolutionOp()
-	for _, ptr := range unmergedPtrs {
-		resOp.AddUnrefBlock(ptr)
+// GetRangeLockConflict implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) GetRangeLockConflict(
+	ctx context.Context, file Node, lock RangeLock) (
+	conflict *RangeLock, err error) {
+	fbo.log.CDebugf(ctx, "GetRangeLockConflict %p %s", file.GetID(), lock)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	name, err := fbo.rangeLockFileForNode(file)
+	if err != nil {
+		return nil, err
 	}
-	md.AddOp(resOp)
-	return fbo.finalizeMDWriteLocked(ctx, lState, md, &blockPutState{}, NoExcl)
+	return fbo.rangeLocks.getConflict(ctx, name, lock)
 }
 
 // TODO: remove once we have automatic conflict resolution
@@ -4001,6 +5599,12 @@ func (fbo *folderBranchOps) UnstageForTesting(
 		return WrongOpsError{fbo.folderBranch, folderBranch}
 	}
 
+	return fbo.unstage(ctx)
+}
+
+// unstage throws away this device's unmerged branch, if any, and
+// fast-forwards to the current merged head.
+func (fbo *folderBranchOps) unstage(ctx context.Context) error {
 	return runUnlessCanceled(ctx, func() error {
 		lState := makeFBOLockState()
 
@@ -4020,7 +5624,7 @@ func (fbo *folderBranchOps) UnstageForTesting(
 		c := make(chan error, 1)
 		freshCtx, cancel := fbo.newCtxWithFBOID()
 		defer cancel()
-		fbo.log.CDebugf(freshCtx, "Launching new context for UnstageForTesting")
+		fbo.log.CDebugf(freshCtx, "Launching new context for unstaging")
 		go func() {
 			lState := makeFBOLockState()
 			c <- fbo.doMDWriteWithRetry(ctx, lState,
@@ -4038,15 +5642,140 @@ func (fbo *folderBranchOps) UnstageForTesting(
 	})
 }
 
+// SetManualConflictResolution implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) SetManualConflictResolution(
+	ctx context.Context, folderBranch FolderBranch, manual bool) (
+	err error) {
+	fbo.log.CDebugf(ctx, "SetManualConflictResolution %t", manual)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	// Persist the setting first, so that it doesn't silently go
+	// away on restart.
+	err = fbo.config.SetManualConflictResolutionForTLF(fbo.id(), manual)
+	if err != nil {
+		return err
+	}
+	fbo.cr.SetManual(manual)
+	return nil
+}
+
+// ResolveMerged implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) ResolveMerged(
+	ctx context.Context, folderBranch FolderBranch) (err error) {
+	fbo.log.CDebugf(ctx, "ResolveMerged")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	return fbo.resolveHeld(ctx, false)
+}
+
+// resolveHeld runs conflict resolution on any held conflict, and
+// waits for it to take this device off of its unmerged branch.  If
+// no conflict is held, e.g. because resolution is automatic and its
+// last attempt failed, it forces a fresh attempt instead.  If
+// keepLocal is set, the resolution replaces the merged version of
+// each conflicting file with the unmerged one.
+func (fbo *folderBranchOps) resolveHeld(
+	ctx context.Context, keepLocal bool) error {
+	lState := makeFBOLockState()
+	if fbo.isMasterBranch(lState) {
+		return nil
+	}
+	if !fbo.cr.ResolveHeld(keepLocal) {
+		fbo.cr.Retry(fbo.getCurrMDRevision(lState), keepLocal)
+	}
+	if err := fbo.cr.Wait(ctx); err != nil {
+		return err
+	}
+	if !fbo.isMasterBranch(lState) {
+		if err := fbo.cr.getLastErr(); err != nil {
+			return err
+		}
+		return UnmergedError{}
+	}
+	return nil
+}
+
+// ResolveKeepLocal implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) ResolveKeepLocal(
+	ctx context.Context, folderBranch FolderBranch) (err error) {
+	fbo.log.CDebugf(ctx, "ResolveKeepLocal")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	return fbo.resolveHeld(ctx, true)
+}
+
+// ResolveKeepRemote implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) ResolveKeepRemote(
+	ctx context.Context, folderBranch FolderBranch) (err error) {
+	fbo.log.CDebugf(ctx, "ResolveKeepRemote")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	if err := fbo.unstage(ctx); err != nil {
+		return err
+	}
+	fbo.cr.DropHeld()
+	return nil
+}
+
+// PreviewConflictResolution implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) PreviewConflictResolution(
+	ctx context.Context, folderBranch FolderBranch) (
+	preview ConflictPreview, err error) {
+	fbo.log.CDebugf(ctx, "PreviewConflictResolution")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return ConflictPreview{}, WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	lState := makeFBOLockState()
+	if fbo.isMasterBranch(lState) {
+		return ConflictPreview{}, nil
+	}
+	return fbo.cr.preview(ctx)
+}
+
 // mdWriterLock must be taken by the caller.
 func (fbo *folderBranchOps) rekeyLocked(ctx context.Context,
-	lState *lockState, promptPaper bool) (err error) {
+	lState *lockState, promptPaper bool, newKeyGen bool) (err error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
 	if !fbo.isMasterBranchLocked(lState) {
 		return errors.New("Can't rekey while staged.")
 	}
 
+	// rekeyErr is what the status reports as the result of this
+	// attempt, which can be an error even if there's nothing more
+	// for the caller to do about it.
+	var rekeyErr error
+	fbo.status.setRekeyStarted()
+	defer func() {
+		if err != nil {
+			rekeyErr = err
+		}
+		fbo.status.setRekeyFinished(rekeyErr)
+	}()
+
 	head := fbo.getHead(lState)
 	if head != (ImmutableRootMetadata{}) {
 		// If we already have a cached revision, make sure we're
@@ -4086,14 +5815,19 @@ func (fbo *folderBranchOps) rekeyLocked(ctx context.Context,
 		}
 	}
 
-	rekeyDone, tlfCryptKey, err := fbo.config.KeyManager().
-		Rekey(ctx, md, promptPaper)
+	var rekeyDone bool
+	var tlfCryptKey *TLFCryptKey
+	if newKeyGen {
+		rekeyDone, tlfCryptKey, err = fbo.config.KeyManager().
+			RekeyWithNewKeyGeneration(ctx, md)
+	} else {
+		rekeyDone, tlfCryptKey, err = fbo.config.KeyManager().
+			Rekey(ctx, md, promptPaper)
+	}
 
 	stillNeedsRekey := false
 	switch err.(type) {
 	case nil:
-		// TODO: implement a "forced" option that rekeys even when the
-		// devices haven't changed?
 		if !rekeyDone {
 			fbo.log.CDebugf(ctx, "No rekey necessary")
 			return nil
@@ -4124,19 +5858,24 @@ func (fbo *folderBranchOps) rekeyLocked(ctx context.Context,
 
 		// Rekey incomplete, fallthrough without early exit, to ensure
 		// we write the metadata with any potential changes
+		rekeyErr = err
 		fbo.log.CDebugf(ctx,
 			"Rekeyed reader devices, but still need writer rekey")
 
-	case NeedOtherRekeyError:
-		stillNeedsRekey = true
-	case NeedSelfRekeyError:
+	case NeedOtherRekeyError, NeedSelfRekeyError:
 		stillNeedsRekey = true
+		rekeyErr = err
+		// Let the user know this device is waiting for access.
+		handle := md.GetTlfHandle()
+		fbo.config.Reporter().ReportErr(ctx, handle.GetCanonicalName(),
+			handle.IsPublic(), ReadMode, err)
 
 	default:
 		if err == context.DeadlineExceeded {
 			fbo.log.CDebugf(ctx, "Paper key prompt timed out")
 			// Reschedule the prompt in the timeout case.
 			stillNeedsRekey = true
+			rekeyErr = err
 		} else {
 			return err
 		}
@@ -4192,6 +5931,14 @@ func (fbo *folderBranchOps) rekeyLocked(ctx context.Context,
 	handle := md.GetTlfHandle()
 	fbo.config.Reporter().Notify(ctx,
 		rekeyNotification(ctx, fbo.config, handle, true))
+	fbo.config.Reporter().ReportEvent(ctx, ReportEvent{
+		Type:     EventRekeyComplete,
+		Severity: SeverityInfo,
+		TlfName:  handle.GetCanonicalName(),
+		Public:   handle.IsPublic(),
+		TlfID:    fbo.id().String(),
+		Message:  "Rekey complete",
+	})
 	if !stillNeedsRekey && fbo.rekeyWithPromptTimer != nil {
 		fbo.log.CDebugf(ctx, "Scheduled rekey timer no longer needed")
 		fbo.rekeyWithPromptTimer.Stop()
@@ -4204,6 +5951,7 @@ func (fbo *folderBranchOps) rekeyWithPrompt() {
 	var err error
 	ctx := ctxWithRandomIDReplayable(
 		context.Background(), CtxRekeyIDKey, CtxRekeyOpID, fbo.log)
+	ctx = ctxWithLockPriority(ctx, lockPriorityBackground)
 	// Only give the user limited time to enter their paper key, so we
 	// don't wait around forever.
 	d := fbo.config.RekeyWithPromptWaitTime()
@@ -4218,7 +5966,7 @@ func (fbo *folderBranchOps) rekeyWithPrompt() {
 
 	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
 		func(lState *lockState) error {
-			return fbo.rekeyLocked(ctx, lState, true)
+			return fbo.rekeyLocked(ctx, lState, true, false)
 		})
 }
 
@@ -4236,7 +5984,27 @@ func (fbo *folderBranchOps) Rekey(ctx context.Context, tlf TlfID) (err error) {
 
 	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
 		func(lState *lockState) error {
-			return fbo.rekeyLocked(ctx, lState, false)
+			return fbo.rekeyLocked(ctx, lState, false, false)
+		})
+}
+
+// RotateKeyGeneration adds a new key generation to the given
+// folder, without rewriting any existing blocks.
+func (fbo *folderBranchOps) RotateKeyGeneration(
+	ctx context.Context, tlf TlfID) (err error) {
+	fbo.log.CDebugf(ctx, "RotateKeyGeneration")
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "Done: %v", err)
+	}()
+
+	fb := FolderBranch{tlf, MasterBranch}
+	if fb != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, fb}
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			return fbo.rekeyLocked(ctx, lState, false, true)
 		})
 }
 
@@ -4344,9 +6112,9 @@ func (fbo *folderBranchOps) runUnlessShutdown(fn func(ctx context.Context) error
 	ctx, cancelFunc := fbo.newCtxWithFBOID()
 	defer cancelFunc()
 	errChan := make(chan error, 1)
-	go func() {
+	goHandingOff(func() {
 		errChan <- fn(ctx)
-	}()
+	})
 
 	select {
 	case err := <-errChan:
@@ -4356,11 +6124,13 @@ func (fbo *folderBranchOps) runUnlessShutdown(fn func(ctx context.Context) error
 	}
 }
 
-func (fbo *folderBranchOps) registerAndWaitForUpdates() {
+// registerAndWaitForUpdates runs for as long as the folder is open,
+// with a context that Shutdown cancels.  Unlike runUnlessShutdown,
+// it doesn't hand the work off to another goroutine, since every
+// folder with a head has one of these.
+func (fbo *folderBranchOps) registerAndWaitForUpdates(ctx context.Context) {
 	defer close(fbo.updateDoneChan)
-	childDone := make(chan struct{})
-	err := fbo.runUnlessShutdown(func(ctx context.Context) error {
-		defer close(childDone)
+	err := func() error {
 		// If we fail to register for or process updates, try again
 		// with an exponential backoff, so we don't overwhelm the
 		// server or ourselves with too many attempts in a hopeless
@@ -4370,7 +6140,12 @@ func (fbo *folderBranchOps) registerAndWaitForUpdates() {
 		expBackoff.MaxElapsedTime = 0
 		// Register and wait in a loop unless we hit an unrecoverable error
 		for {
-			err := backoff.RetryNotifyWithContext(ctx, func() error {
+			// Only the waits between attempts use backoffCtx,
+			// so that onReconnect can cut them short without
+			// interrupting an attempt.
+			backoffCtx, cancel := context.WithCancel(ctx)
+			fbo.setCancelUpdateBackoff(cancel)
+			err := backoff.RetryNotifyWithContext(backoffCtx, func() error {
 				// Replace the FBOID one with a fresh id for every attempt
 				newCtx := fbo.ctxWithFBOID(ctx)
 				updateChan, err := fbo.registerForUpdates(newCtx)
@@ -4403,18 +6178,40 @@ func (fbo *folderBranchOps) registerAndWaitForUpdates() {
 						"Retrying registerForUpdates in %s due to err: %v",
 						nextTime, err)
 				})
+			reconnected := backoffCtx.Err() != nil && ctx.Err() == nil
+			cancel()
+			if err != nil && reconnected {
+				fbo.log.CDebugf(ctx, "Reconnected; registering for "+
+					"updates again right away")
+				continue
+			}
 			if err != nil {
 				return err
 			}
 		}
-	})
+	}()
 
 	if err != nil && err != context.Canceled {
 		fbo.log.CWarningf(context.Background(),
 			"registerAndWaitForUpdates failed unexpectedly with an error: %v",
 			err)
 	}
-	<-childDone
+}
+
+func (fbo *folderBranchOps) setCancelUpdateBackoff(cancel context.CancelFunc) {
+	fbo.updateBackoffLock.Lock()
+	defer fbo.updateBackoffLock.Unlock()
+	fbo.cancelUpdateBackoff = cancel
+}
+
+// onReconnect implements the reconnectListener interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) onReconnect(ctx context.Context) {
+	fbo.updateBackoffLock.Lock()
+	defer fbo.updateBackoffLock.Unlock()
+	if fbo.cancelUpdateBackoff != nil {
+		fbo.cancelUpdateBackoff()
+	}
 }
 
 func (fbo *folderBranchOps) registerForUpdates(ctx context.Context) (
@@ -4434,7 +6231,7 @@ func (fbo *folderBranchOps) waitForAndProcessUpdates(
 	fbo.log.CDebugf(ctx, "Waiting for updates")
 	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
 
-	lState := makeFBOLockState()
+	lState := makeBackgroundFBOLockState()
 
 	for {
 		select {
@@ -4469,97 +6266,172 @@ func (fbo *folderBranchOps) waitForAndProcessUpdates(
 	}
 }
 
+// journalTooFullForBackgroundFlush returns whether this folder's
+// journal holds so much unflushed data that files shouldn't be synced
+// into it just because they've been dirty for a while.
+func (fbo *folderBranchOps) journalTooFullForBackgroundFlush() bool {
+	jServer, err := GetJournalServer(fbo.config)
+	if err != nil {
+		return false
+	}
+	status, err := jServer.JournalStatus(fbo.id())
+	if err != nil {
+		return false
+	}
+	return status.UnflushedBytes > backgroundFlushMaxJournalBytes
+}
+
+// getBackgroundFlushRefs returns the dirty refs that a background
+// flush should sync.  Unless forced, that's only the files that have
+// been dirty for at least the configured age, and none at all while
+// the journal is too full.
+func (fbo *folderBranchOps) getBackgroundFlushRefs(
+	ctx context.Context, lState *lockState, forced bool) []blockRef {
+	dirtyRefs := fbo.blocks.GetDirtyRefs(lState)
+	age := fbo.config.BackgroundFlushAge()
+	if forced || age == 0 || len(dirtyRefs) == 0 {
+		return dirtyRefs
+	}
+	if fbo.journalTooFullForBackgroundFlush() {
+		fbo.log.CDebugf(ctx, "Not syncing dirty files in the background, "+
+			"since the journal is too full")
+		return nil
+	}
+
+	now := fbo.config.Clock().Now()
+	var refs []blockRef
+	for _, ref := range dirtyRefs {
+		node := fbo.nodeCache.Get(ref)
+		if node == nil {
+			continue
+		}
+		// A file whose dirty time wasn't recorded has been
+		// dirty since before the age was set.
+		if t, ok := fbo.status.dirtySinceTime(node); ok &&
+			now.Sub(t) < age {
+			continue
+		}
+		refs = append(refs, ref)
+	}
+	return refs
+}
+
+// backgroundFlushPeriod returns how often the background flushes of
+// a folder should check for dirty files.
+func backgroundFlushPeriod(config Config) time.Duration {
+	betweenFlushes := secondsBetweenBackgroundFlushes * time.Second
+	if age := config.BackgroundFlushAge(); age > 0 && age < betweenFlushes {
+		betweenFlushes = age
+	}
+	return betweenFlushes
+}
+
+// flushProgress tracks whether the background flushes of a folder
+// are getting anywhere.
+type flushProgress struct {
+	prevDirtyRefMap   map[blockRef]bool
+	sameDirtyRefCount int
+}
+
+// needsForcedFlush returns true if this folder has dirty files and
+// the system has a full buffer, so a flush shouldn't wait for a
+// signal.
+func (fbo *folderBranchOps) needsForcedFlush(lState *lockState) bool {
+	return fbo.blocks.GetState(lState) == dirtyState &&
+		fbo.config.DirtyBlockCache().ShouldForceSync(fbo.id())
+}
+
 func (fbo *folderBranchOps) backgroundFlusher(betweenFlushes time.Duration) {
 	ticker := time.NewTicker(betweenFlushes)
 	defer ticker.Stop()
 	lState := makeFBOLockState()
-	var prevDirtyRefMap map[blockRef]bool
-	sameDirtyRefCount := 0
+	var progress flushProgress
 	for {
-		doSelect := true
-		if fbo.blocks.GetState(lState) == dirtyState &&
-			fbo.config.DirtyBlockCache().ShouldForceSync(fbo.id()) {
-			// We have dirty files, and the system has a full buffer,
-			// so don't bother waiting for a signal, just get right to
-			// the main attraction.
-			doSelect = false
-		}
-
-		if doSelect {
+		forced := fbo.needsForcedFlush(lState)
+		if !forced {
 			select {
 			case <-ticker.C:
 			case <-fbo.forceSyncChan:
+				forced = true
 			case <-fbo.shutdownChan:
 				return
 			}
 		}
+		fbo.flushInBackground(lState, forced, &progress)
+	}
+}
 
-		dirtyRefs := fbo.blocks.GetDirtyRefs(lState)
-		if len(dirtyRefs) == 0 {
-			sameDirtyRefCount = 0
-			continue
-		}
+// flushInBackground syncs the dirty files of this folder that a
+// background flush should sync, if any.
+func (fbo *folderBranchOps) flushInBackground(
+	lState *lockState, forced bool, progress *flushProgress) {
+	dirtyRefs := fbo.getBackgroundFlushRefs(
+		context.Background(), lState, forced)
+	if len(dirtyRefs) == 0 {
+		progress.sameDirtyRefCount = 0
+		return
+	}
 
-		// Make sure we are making some progress
-		currDirtyRefMap := make(map[blockRef]bool)
-		for _, ref := range dirtyRefs {
-			currDirtyRefMap[ref] = true
-		}
-		if reflect.DeepEqual(currDirtyRefMap, prevDirtyRefMap) {
-			sameDirtyRefCount++
-		} else {
-			sameDirtyRefCount = 0
-		}
-		if sameDirtyRefCount >= 10 {
-			panic(fmt.Sprintf("Making no Sync progress on dirty refs: %v",
-				dirtyRefs))
-		}
-		prevDirtyRefMap = currDirtyRefMap
+	// Make sure we are making some progress
+	currDirtyRefMap := make(map[blockRef]bool)
+	for _, ref := range dirtyRefs {
+		currDirtyRefMap[ref] = true
+	}
+	if reflect.DeepEqual(currDirtyRefMap, progress.prevDirtyRefMap) {
+		progress.sameDirtyRefCount++
+	} else {
+		progress.sameDirtyRefCount = 0
+	}
+	if progress.sameDirtyRefCount >= 10 {
+		panic(fmt.Sprintf("Making no Sync progress on dirty refs: %v",
+			dirtyRefs))
+	}
+	progress.prevDirtyRefMap = currDirtyRefMap
 
-		fbo.runUnlessShutdown(func(ctx context.Context) (err error) {
-			// Denote that these are coming from a background
-			// goroutine, not directly from any user.
-			ctx = NewContextReplayable(ctx,
-				func(ctx context.Context) context.Context {
-					return context.WithValue(ctx, CtxBackgroundSyncKey, "1")
-				})
-			// Just in case network access or a bug gets stuck for a
-			// long time, time out the sync eventually.
-			longCtx, longCancel :=
-				context.WithTimeout(ctx, backgroundTaskTimeout)
-			defer longCancel()
-
-			// Make sure this loop doesn't starve user requests for
-			// too long.  But use the longer-timeout version in the
-			// actual Sync command, to avoid unnecessary errors.
-			shortCtx, shortCancel := context.WithTimeout(ctx, 1*time.Second)
-			defer shortCancel()
-			for _, ref := range dirtyRefs {
-				select {
-				case <-shortCtx.Done():
-					fbo.log.CDebugf(ctx,
-						"Stopping background sync early due to timeout")
-					return nil
-				default:
-				}
+	fbo.runUnlessShutdown(func(ctx context.Context) (err error) {
+		// Denote that these are coming from a background
+		// goroutine, not directly from any user.
+		ctx = NewContextReplayable(ctx,
+			func(ctx context.Context) context.Context {
+				ctx = ctxWithLockPriority(ctx, lockPriorityBackground)
+				return context.WithValue(ctx, CtxBackgroundSyncKey, "1")
+			})
+		// Just in case network access or a bug gets stuck for a
+		// long time, time out the sync eventually.
+		longCtx, longCancel :=
+			context.WithTimeout(ctx, backgroundTaskTimeout)
+		defer longCancel()
+
+		// Make sure this loop doesn't starve user requests for
+		// too long.  But use the longer-timeout version in the
+		// actual Sync command, to avoid unnecessary errors.
+		shortCtx, shortCancel := context.WithTimeout(ctx, 1*time.Second)
+		defer shortCancel()
+		for _, ref := range dirtyRefs {
+			select {
+			case <-shortCtx.Done():
+				fbo.log.CDebugf(ctx,
+					"Stopping background sync early due to timeout")
+				return nil
+			default:
+			}
 
-				node := fbo.nodeCache.Get(ref)
-				if node == nil {
-					continue
-				}
-				err := fbo.Sync(longCtx, node)
-				if err != nil {
-					// Just log the warning and keep trying to
-					// sync the rest of the dirty files.
-					p := fbo.nodeCache.PathFromNode(node)
-					fbo.log.CWarningf(ctx, "Couldn't sync dirty file with "+
-						"ref=%v, nodeID=%p, and path=%v: %v",
-						ref, node.GetID(), p, err)
-				}
+			node := fbo.nodeCache.Get(ref)
+			if node == nil {
+				continue
 			}
-			return nil
-		})
-	}
+			err := fbo.Sync(longCtx, node)
+			if err != nil {
+				// Just log the warning and keep trying to
+				// sync the rest of the dirty files.
+				p := fbo.nodeCache.PathFromNode(node)
+				fbo.log.CWarningf(ctx, "Couldn't sync dirty file with "+
+					"ref=%v, nodeID=%p, and path=%v: %v",
+					ref, node.GetID(), p, err)
+			}
+		}
+		return nil
+	})
 }
 
 func (fbo *folderBranchOps) blockUnmergedWrites(lState *lockState) {
@@ -4643,6 +6515,7 @@ func (fbo *folderBranchOps) finalizeResolutionLocked(ctx context.Context,
 
 	// notifyOneOp for every fixed-up merged op.
 	for _, op := range newOps {
+		fbo.addTombstonesLocked(ctx, lState, op)
 		fbo.notifyOneOpLocked(ctx, lState, op, irmd)
 	}
 	fbo.editHistory.UpdateHistory(ctx, []ImmutableRootMetadata{irmd})
@@ -4680,6 +6553,38 @@ func (fbo *folderBranchOps) unstageAfterFailedResolution(ctx context.Context,
 	return fbo.unstageLocked(ctx, lState)
 }
 
+// dropResolvedBranchLocked abandons the unmerged branch bid after an
+// earlier resolution of it turned out to have made it to the merged
+// branch.  Unlike unstageLocked, it doesn't unreference the unmerged
+// blocks, since the resolution may still be using them.
+func (fbo *folderBranchOps) dropResolvedBranchLocked(ctx context.Context,
+	lState *lockState, bid BranchID) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	if fbo.bid != bid {
+		// We've already moved off of that branch.
+		return nil
+	}
+
+	_, err := fbo.undoUnmergedMDUpdatesLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+	err = fbo.config.MDOps().PruneBranch(ctx, fbo.id(), bid)
+	if err != nil {
+		return err
+	}
+	return fbo.getAndApplyMDUpdates(ctx, lState, fbo.applyMDUpdatesLocked)
+}
+
+func (fbo *folderBranchOps) dropResolvedBranch(ctx context.Context,
+	lState *lockState, bid BranchID) error {
+	// Take the writer lock.
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
+	return fbo.dropResolvedBranchLocked(ctx, lState, bid)
+}
+
 func (fbo *folderBranchOps) onTLFBranchChange(newBID BranchID) {
 	ctx, cancelFunc := fbo.newCtxWithFBOID()
 	defer cancelFunc()
@@ -4691,7 +6596,7 @@ func (fbo *folderBranchOps) onTLFBranchChange(newBID BranchID) {
 		return
 	}
 
-	lState := makeFBOLockState()
+	lState := makeBackgroundFBOLockState()
 	fbo.mdWriterLock.Lock(lState)
 	defer fbo.mdWriterLock.Unlock(lState)
 
@@ -4764,7 +6669,7 @@ func (fbo *folderBranchOps) handleMDFlush(ctx context.Context, bid BranchID,
 	// We must take the lock so that other users, like exclusive file
 	// creation, can wait for the journal to flush while holding the
 	// lock, and be guaranteed it will stay flushed.
-	lState := makeFBOLockState()
+	lState := makeBackgroundFBOLockState()
 	fbo.mdWriterLock.Lock(lState)
 	defer fbo.mdWriterLock.Unlock(lState)
 
@@ -4773,16 +6678,21 @@ func (fbo *folderBranchOps) handleMDFlush(ctx context.Context, bid BranchID,
 
 func (fbo *folderBranchOps) onMDFlush(bid BranchID, rev MetadataRevision) {
 	ctx, cancelFunc := fbo.newCtxWithFBOID()
-	defer cancelFunc()
 
 	if bid != NullBranchID {
+		defer cancelFunc()
 		fbo.log.CDebugf(ctx, "Ignoring MD flush on branch %v for revision %d",
 			bid, rev)
 		return
 	}
 
+	// The context must outlive this call, for the archiving
+	// goroutine to use.
 	fbo.mdFlushes.Add(1)
-	go fbo.handleMDFlush(ctx, bid, rev)
+	go func() {
+		defer cancelFunc()
+		fbo.handleMDFlush(ctx, bid, rev)
+	}()
 }
 
 // GetUpdateHistory implements the KBFSOps interface for folderBranchOps
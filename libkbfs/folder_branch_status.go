@@ -5,10 +5,13 @@
 package libkbfs
 
 import (
+	"fmt"
 	"reflect"
 	"sync"
+	"time"
 
 	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/keybase1"
 
 	"golang.org/x/net/context"
 )
@@ -25,6 +28,12 @@ type FolderBranchStatus struct {
 	LatestKeyGeneration KeyGen
 	FolderID            string
 	Revision            MetadataRevision
+	WritesPaused        bool
+	// SyncDurability is how durable Sync makes writes to this
+	// folder-branch, as set by KBFSOps.SetSyncDurability.
+	SyncDurability string
+
+	Rekey TLFRekeyStatus
 
 	// DirtyPaths are files that have been written, but not flushed.
 	// They do not represent unstaged changes in your local instance.
@@ -36,6 +45,48 @@ type FolderBranchStatus struct {
 	Merged   []*crChainSummary
 
 	Journal *TLFJournalStatus `json:",omitempty"`
+	Sync    *TLFSyncStatus    `json:",omitempty"`
+
+	// IsConnected is whether this device can reach the MD server
+	// right now.  While it can't, synced writes wait in the journal,
+	// if it's enabled, or fail.
+	IsConnected bool
+	// CRInProgress, CRHeld and LastCRError are as in
+	// ConflictStatus.
+	CRInProgress bool
+	CRHeld       bool
+	LastCRError  string `json:",omitempty"`
+	// MDWriterWaitingForeground and MDWriterWaitingBackground
+	// are how many user requests, and how many pieces of
+	// background work, are queued to make MD changes.
+	MDWriterWaitingForeground int
+	MDWriterWaitingBackground int
+	// ReadaheadWindows is how many blocks are being prefetched
+	// ahead of the reader of each recently-read file, keyed by
+	// path.  It's zero for files being read randomly.
+	ReadaheadWindows map[string]int `json:",omitempty"`
+	// NodeCacheSize is how many nodes of the folder-branch are in
+	// memory.
+	NodeCacheSize int
+}
+
+// TLFRekeyStatus describes where a TLF is in being rekeyed for new
+// devices.  It is suitable for encoding directly as JSON.
+type TLFRekeyStatus struct {
+	// Needed is true if the head revision has the rekey bit set,
+	// meaning some device is waiting for a device with access to
+	// give it the keys.
+	Needed bool
+	// InProgress is true while this device is trying to rekey the
+	// TLF.
+	InProgress bool
+	// LastError is why this device's last rekey attempt failed or
+	// couldn't finish, if it did.
+	LastError string `json:",omitempty"`
+	// DevicesPending lists the devices of the TLF's users, as
+	// "user/device", that don't have keys for the latest key
+	// generation yet.
+	DevicesPending []string `json:",omitempty"`
 }
 
 // KBFSStatus represents the content of the top-level status file. It is
@@ -44,12 +95,31 @@ type FolderBranchStatus struct {
 type KBFSStatus struct {
 	CurrentUser     string
 	IsConnected     bool
+	Offline         bool
+	NetworkState    string
 	UsageBytes      int64
 	LimitBytes      int64
 	FailingServices map[string]error
 	JournalServer   *JournalServerStatus `json:",omitempty"`
+	// DiskLimiter describes the local disk space taken up by the
+	// journals and the sync cache, if either is enabled.
+	DiskLimiter *DiskLimiterStatus `json:",omitempty"`
+	// Rekeys holds the rekey status of each open TLF that needs a
+	// rekey or whose last rekey failed, by canonical path.
+	Rekeys map[string]TLFRekeyStatus `json:",omitempty"`
+	// Crypto describes how fast this machine does crypto.
+	Crypto CryptoCapabilities
+	// BlockTransfers describes the measured block transfers, and
+	// how many of them run at once.
+	BlockTransfers BlockTransferStatus
 }
 
+// pendingDevicesCacheTime is how long the devices pending a rekey
+// are remembered for the same head, before being looked up again for
+// the next status read.  A user can add a device without the head
+// changing.
+const pendingDevicesCacheTime = 1 * time.Minute
+
 // StatusUpdate is a dummy type used to indicate status has been updated.
 type StatusUpdate struct{}
 
@@ -62,9 +132,22 @@ type folderBranchStatusKeeper struct {
 
 	md         ImmutableRootMetadata
 	dirtyNodes map[NodeID]Node
+	// dirtySince is when each of dirtyNodes was first dirtied, if
+	// background flushes wait for dirty files to age.
+	dirtySince map[NodeID]time.Time
 	unmerged   []*crChainSummary
 	merged     []*crChainSummary
-	dataMutex  sync.Mutex
+	paused     bool
+	durability WriteDurability
+	rekeying   bool
+	rekeyErr   error
+	// pendingDevices caches unkeyedDevices for pendingDevicesMD,
+	// as of pendingDevicesAt, since computing it takes an RPC per
+	// user of the TLF.
+	pendingDevices   []string
+	pendingDevicesMD ImmutableRootMetadata
+	pendingDevicesAt time.Time
+	dataMutex        sync.Mutex
 
 	updateChan  chan StatusUpdate
 	updateMutex sync.Mutex
@@ -76,6 +159,7 @@ func newFolderBranchStatusKeeper(
 		config:     config,
 		nodeCache:  nodeCache,
 		dirtyNodes: make(map[NodeID]Node),
+		dirtySince: make(map[NodeID]time.Time),
 		updateChan: make(chan StatusUpdate, 1),
 	}
 }
@@ -113,6 +197,47 @@ func (fbsk *folderBranchStatusKeeper) setCRSummary(unmerged []*crChainSummary,
 	fbsk.signalChangeLocked()
 }
 
+func (fbsk *folderBranchStatusKeeper) setWritesPaused(paused bool) {
+	fbsk.dataMutex.Lock()
+	defer fbsk.dataMutex.Unlock()
+	if fbsk.paused == paused {
+		return
+	}
+	fbsk.paused = paused
+	fbsk.signalChangeLocked()
+}
+
+func (fbsk *folderBranchStatusKeeper) setSyncDurability(
+	durability WriteDurability) {
+	fbsk.dataMutex.Lock()
+	defer fbsk.dataMutex.Unlock()
+	if fbsk.durability == durability {
+		return
+	}
+	fbsk.durability = durability
+	fbsk.signalChangeLocked()
+}
+
+func (fbsk *folderBranchStatusKeeper) setRekeyStarted() {
+	fbsk.dataMutex.Lock()
+	defer fbsk.dataMutex.Unlock()
+	if fbsk.rekeying {
+		return
+	}
+	fbsk.rekeying = true
+	fbsk.signalChangeLocked()
+}
+
+// setRekeyFinished records the result of a rekey attempt; err is
+// nil if the attempt did everything this device could do.
+func (fbsk *folderBranchStatusKeeper) setRekeyFinished(err error) {
+	fbsk.dataMutex.Lock()
+	defer fbsk.dataMutex.Unlock()
+	fbsk.rekeying = false
+	fbsk.rekeyErr = err
+	fbsk.signalChangeLocked()
+}
+
 func (fbsk *folderBranchStatusKeeper) addNode(m map[NodeID]Node, n Node) {
 	fbsk.dataMutex.Lock()
 	defer fbsk.dataMutex.Unlock()
@@ -137,12 +262,40 @@ func (fbsk *folderBranchStatusKeeper) rmNode(m map[NodeID]Node, n Node) {
 	fbsk.signalChangeLocked()
 }
 
+func (fbsk *folderBranchStatusKeeper) isDirtyNode(n Node) bool {
+	fbsk.dataMutex.Lock()
+	defer fbsk.dataMutex.Unlock()
+	_, ok := fbsk.dirtyNodes[n.GetID()]
+	return ok
+}
+
 func (fbsk *folderBranchStatusKeeper) addDirtyNode(n Node) {
 	fbsk.addNode(fbsk.dirtyNodes, n)
+	if fbsk.config.BackgroundFlushAge() == 0 {
+		return
+	}
+	fbsk.dataMutex.Lock()
+	defer fbsk.dataMutex.Unlock()
+	if _, ok := fbsk.dirtySince[n.GetID()]; !ok {
+		fbsk.dirtySince[n.GetID()] = fbsk.config.Clock().Now()
+	}
 }
 
 func (fbsk *folderBranchStatusKeeper) rmDirtyNode(n Node) {
 	fbsk.rmNode(fbsk.dirtyNodes, n)
+	fbsk.dataMutex.Lock()
+	defer fbsk.dataMutex.Unlock()
+	delete(fbsk.dirtySince, n.GetID())
+}
+
+// dirtySinceTime returns when the given node was first dirtied, if
+// that was recorded.
+func (fbsk *folderBranchStatusKeeper) dirtySinceTime(n Node) (
+	time.Time, bool) {
+	fbsk.dataMutex.Lock()
+	defer fbsk.dataMutex.Unlock()
+	t, ok := fbsk.dirtySince[n.GetID()]
+	return t, ok
 }
 
 // dataMutex should be taken by the caller
@@ -155,6 +308,118 @@ func (fbsk *folderBranchStatusKeeper) convertNodesToPathsLocked(
 	return ret
 }
 
+// unkeyedDevices returns the devices, as "user/device", of the users
+// in md's handle that don't have keys for its latest key generation.
+func unkeyedDevices(ctx context.Context, config Config,
+	md ImmutableRootMetadata) ([]string, error) {
+	keyGen := md.LatestKeyGeneration()
+	if keyGen < FirstValidKeyGen {
+		return nil, nil
+	}
+	handle := md.GetTlfHandle()
+	var devices []string
+	for _, uid := range append(handle.ResolvedWriters(),
+		handle.ResolvedReaders()...) {
+		kids, err := md.bareMd.GetDeviceKIDs(keyGen, uid, md.extra)
+		if err != nil {
+			return nil, err
+		}
+		keyed := make(map[keybase1.KID]bool, len(kids))
+		for _, kid := range kids {
+			keyed[kid] = true
+		}
+		ui, err := config.KeybaseService().LoadUserPlusKeys(ctx, uid)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range ui.CryptPublicKeys {
+			if keyed[key.kid] {
+				continue
+			}
+			name := ui.KIDNames[key.kid]
+			if name == "" {
+				name = key.kid.String()
+			}
+			devices = append(devices, fmt.Sprintf("%s/%s", ui.Name, name))
+		}
+	}
+	return devices, nil
+}
+
+// updatePendingDevices looks up the devices still waiting for keys
+// to the current head, if they aren't cached already, so that the
+// next status read reports them.  The lookup takes RPCs, so it's done
+// without holding dataMutex, and only for the status files.
+func (fbsk *folderBranchStatusKeeper) updatePendingDevices(
+	ctx context.Context) {
+	now := fbsk.config.Clock().Now()
+	md := func() ImmutableRootMetadata {
+		fbsk.dataMutex.Lock()
+		defer fbsk.dataMutex.Unlock()
+		if fbsk.md == fbsk.pendingDevicesMD &&
+			now.Sub(fbsk.pendingDevicesAt) < pendingDevicesCacheTime {
+			return ImmutableRootMetadata{}
+		}
+		return fbsk.md
+	}()
+	if md == (ImmutableRootMetadata{}) {
+		return
+	}
+
+	devices, err := unkeyedDevices(ctx, fbsk.config, md)
+	if err != nil {
+		log := fbsk.config.MakeLogger("")
+		log.CWarningf(ctx, "Error getting unkeyed devices for %s: %v",
+			md.TlfID(), err)
+		return
+	}
+
+	fbsk.dataMutex.Lock()
+	defer fbsk.dataMutex.Unlock()
+	if fbsk.md != md {
+		// The head moved on while looking; the next read will
+		// look again.
+		return
+	}
+	fbsk.pendingDevices = devices
+	fbsk.pendingDevicesMD = md
+	fbsk.pendingDevicesAt = now
+}
+
+// dataMutex should be taken by the caller
+func (fbsk *folderBranchStatusKeeper) getRekeyStatusLocked() TLFRekeyStatus {
+	var status TLFRekeyStatus
+	status.InProgress = fbsk.rekeying
+	if fbsk.rekeyErr != nil {
+		status.LastError = fbsk.rekeyErr.Error()
+	}
+	if fbsk.md == (ImmutableRootMetadata{}) {
+		return status
+	}
+	status.Needed = fbsk.md.IsRekeySet()
+	if fbsk.pendingDevicesMD == fbsk.md {
+		status.DevicesPending = fbsk.pendingDevices
+	}
+	return status
+}
+
+// getRekeyStatus returns the rekey part of the current status along
+// with the TLF's canonical path, if there's anything in it worth
+// reporting: a rekey that's needed, running, or failed.  The pending
+// devices are only filled in if updatePendingDevices has looked them
+// up for the current head.
+func (fbsk *folderBranchStatusKeeper) getRekeyStatus() (
+	status TLFRekeyStatus, tlfPath string, ok bool) {
+	fbsk.dataMutex.Lock()
+	defer fbsk.dataMutex.Unlock()
+	if fbsk.md == (ImmutableRootMetadata{}) ||
+		(!fbsk.md.IsRekeySet() && !fbsk.rekeying && fbsk.rekeyErr == nil) {
+		return TLFRekeyStatus{}, "", false
+	}
+	return fbsk.getRekeyStatusLocked(),
+		fbsk.md.GetTlfHandle().GetCanonicalPath(), true
+}
+
 // getStatus returns a FolderBranchStatus-representation of the
 // current status. The returned channel is closed whenever the status
 // changes, except for journal status changes.
@@ -196,7 +461,13 @@ func (fbsk *folderBranchStatusKeeper) getStatus(ctx context.Context) (
 		}
 	}
 
+	fbs.WritesPaused = fbsk.paused
+	fbs.SyncDurability = fbsk.durability.String()
+	fbs.Rekey = fbsk.getRekeyStatusLocked()
 	fbs.DirtyPaths = fbsk.convertNodesToPathsLocked(fbsk.dirtyNodes)
+	if fbsk.nodeCache != nil {
+		fbs.NodeCacheSize = fbsk.nodeCache.NumNodes()
+	}
 
 	fbs.Unmerged = fbsk.unmerged
 	fbs.Merged = fbsk.merged
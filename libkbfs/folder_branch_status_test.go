@@ -8,10 +8,13 @@ import (
 	"fmt"
 	"reflect"
 	"sort"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/golang/mock/gomock"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/net/context"
 )
 
@@ -21,6 +24,7 @@ func fbStatusTestInit(t *testing.T) (*gomock.Controller, *ConfigMock,
 	mockCtrl := gomock.NewController(ctr)
 	config := NewConfigMock(mockCtrl, ctr)
 	nodeCache := NewMockNodeCache(mockCtrl)
+	nodeCache.EXPECT().NumNodes().AnyTimes().Return(0)
 	fbsk := newFolderBranchStatusKeeper(config, nodeCache)
 	interposeDaemonKBPKI(config, "alice", "bob")
 	return mockCtrl, config, fbsk, nodeCache
@@ -138,3 +142,100 @@ func TestFBStatusAllFields(t *testing.T) {
 	expectedDirtyPaths := []string{p1.String(), p2.String()}
 	checkStringSlices(t, expectedDirtyPaths, status.DirtyPaths)
 }
+
+func TestFBStatusRekey(t *testing.T) {
+	mockCtrl, config, fbsk, _ := fbStatusTestInit(t)
+	defer fbStatusTestShutdown(mockCtrl, config)
+	ctx := context.Background()
+
+	_, c, err := fbsk.getStatus(ctx)
+	if err != nil {
+		t.Fatalf("Couldn't get status: %v", err)
+	}
+	fbsk.setRekeyStarted()
+	<-c
+
+	status, c, err := fbsk.getStatus(ctx)
+	if err != nil {
+		t.Fatalf("Couldn't get status: %v", err)
+	}
+	if !status.Rekey.InProgress {
+		t.Errorf("Status does not show a rekey in progress")
+	}
+
+	rekeyErr := NeedOtherRekeyError{"alice,bob"}
+	fbsk.setRekeyFinished(rekeyErr)
+	<-c
+
+	status, _, err = fbsk.getStatus(ctx)
+	if err != nil {
+		t.Fatalf("Couldn't get status: %v", err)
+	}
+	if status.Rekey.InProgress {
+		t.Errorf("Status still shows a rekey in progress")
+	}
+	if status.Rekey.LastError != rekeyErr.Error() {
+		t.Errorf("Unexpected rekey error in status: %s",
+			status.Rekey.LastError)
+	}
+}
+
+// loadUserCountingService is a KeybaseService that counts calls to
+// LoadUserPlusKeys.
+type loadUserCountingService struct {
+	KeybaseService
+	lock  sync.Mutex
+	calls int
+}
+
+func (s *loadUserCountingService) LoadUserPlusKeys(
+	ctx context.Context, uid keybase1.UID) (UserInfo, error) {
+	s.lock.Lock()
+	s.calls++
+	s.lock.Unlock()
+	return s.KeybaseService.LoadUserPlusKeys(ctx, uid)
+}
+
+func (s *loadUserCountingService) getCalls() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.calls
+}
+
+// Test that only FolderStatus looks up the devices pending a rekey,
+// and that it doesn't look them up again for the same head.
+func TestFBStatusPendingDevicesOnlyForStatusReads(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	kbfsOps := config.KBFSOps()
+	counter := &loadUserCountingService{
+		KeybaseService: config.KeybaseService(),
+	}
+	config.SetKeybaseService(counter)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	_, _, err := ops.status.getStatus(ctx)
+	require.NoError(t, err)
+	_, err = kbfsOps.Health(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 0, counter.getCalls())
+
+	status, _, err := kbfsOps.FolderStatus(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	require.Len(t, status.Rekey.DevicesPending, 0)
+	require.Equal(t, 1, counter.getCalls())
+
+	// Same head, so no new lookup.
+	_, _, err = kbfsOps.FolderStatus(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	require.Equal(t, 1, counter.getCalls())
+
+	// A new head needs a new lookup.
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	_, _, err = kbfsOps.FolderStatus(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	require.Equal(t, 2, counter.getCalls())
+}
@@ -0,0 +1,46 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// +build gofuzz
+
+// This file holds the entry points for go-fuzz, for the targets in
+// test_fuzz.go.  To fuzz one, run e.g.
+//
+//	go-fuzz-build -func FuzzRootMetadataSignedV2 \
+//		github.com/keybase/kbfs/libkbfs
+//	go-fuzz -bin libkbfs-fuzz.zip -workdir fuzz/RootMetadataSignedV2
+
+package libkbfs
+
+// fuzz runs the named target on data, and tells go-fuzz to favor the
+// inputs it accepted.
+func fuzz(name string, data []byte) int {
+	if fuzzTargets[name](data) != nil {
+		return 0
+	}
+	return 1
+}
+
+// FuzzRootMetadataSignedV2 is the go-fuzz entry point for decoding
+// signed MD objects of version 2.
+func FuzzRootMetadataSignedV2(data []byte) int {
+	return fuzz("RootMetadataSignedV2", data)
+}
+
+// FuzzRootMetadataSignedV3 is the go-fuzz entry point for decoding
+// signed MD objects of version 3.
+func FuzzRootMetadataSignedV3(data []byte) int {
+	return fuzz("RootMetadataSignedV3", data)
+}
+
+// FuzzBlock is the go-fuzz entry point for decoding blocks.
+func FuzzBlock(data []byte) int {
+	return fuzz("Block", data)
+}
+
+// FuzzJournalEntry is the go-fuzz entry point for decoding journal
+// entries.
+func FuzzJournalEntry(data []byte) int {
+	return fuzz("JournalEntry", data)
+}
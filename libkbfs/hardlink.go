@@ -0,0 +1,218 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import "golang.org/x/net/context"
+
+// Hard links to a file are directory entries that all share the
+// file's top BlockPointer, so a write through any of them is seen
+// through the others.  They must all live in the same directory:
+// that way, when a sync gives the file a new pointer, only one
+// directory block has to be updated to keep them together.  Every
+// link carries the same EntryInfo, including an Nlink count of how
+// many of them there are, and the file's blocks are only
+// unreferenced when the last one is removed.
+
+// LinkCount returns the number of hard links to this entry's file.
+func (ei EntryInfo) LinkCount() uint32 {
+	if ei.Nlink == 0 {
+		return 1
+	}
+	return ei.Nlink
+}
+
+// isLinkOf returns whether de is a hard link to the same file as
+// other.  Symlinks have no pointers, and so are never links of each
+// other.
+func (de DirEntry) isLinkOf(other DirEntry) bool {
+	return (de.Type == File || de.Type == Exec) &&
+		de.BlockPointer != zeroPtr && de.BlockPointer == other.BlockPointer
+}
+
+// setEntryAndLinks sets the entry for name in dblock to de, along
+// with the entries of any other hard links to the file name used to
+// refer to.  The link counts already in dblock are kept.
+func setEntryAndLinks(dblock *DirBlock, name string, de DirEntry) {
+	old, ok := dblock.Children[name]
+	if !ok {
+		dblock.Children[name] = de
+		return
+	}
+	de.Nlink = old.Nlink
+	dblock.Children[name] = de
+	if old.LinkCount() <= 1 {
+		return
+	}
+	for n, other := range dblock.Children {
+		if n != name && other.isLinkOf(old) {
+			dblock.Children[n] = de
+		}
+	}
+}
+
+// fixLinkCounts recomputes the link count of every file in dblock
+// from the pointers its entries share.
+func fixLinkCounts(dblock *DirBlock) {
+	counts := make(map[BlockPointer]uint32)
+	for _, de := range dblock.Children {
+		if de.isLinkOf(de) {
+			counts[de.BlockPointer]++
+		}
+	}
+	for name, de := range dblock.Children {
+		if !de.isLinkOf(de) {
+			continue
+		}
+		nlink := counts[de.BlockPointer]
+		if nlink == 1 {
+			nlink = 0
+		}
+		if de.Nlink != nlink {
+			de.Nlink = nlink
+			dblock.Children[name] = de
+		}
+	}
+}
+
+func (fbo *folderBranchOps) linkLocked(ctx context.Context,
+	lState *lockState, file Node, dir Node, name string) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	if err := checkDisallowedPrefixes(name); err != nil {
+		return err
+	}
+
+	if uint32(len(name)) > fbo.config.MaxNameBytes() {
+		return NameTooLongError{name, fbo.config.MaxNameBytes()}
+	}
+
+	// verify we have permission to write
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+
+	filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
+	if err != nil {
+		return err
+	}
+	dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
+	if err != nil {
+		return err
+	}
+	if !filePath.hasValidParent() ||
+		filePath.parentPath().tailPointer() != dirPath.tailPointer() {
+		return CrossDirLinkError{filePath.tailName()}
+	}
+
+	dblock, err := fbo.blocks.GetDir(
+		ctx, lState, md.ReadOnly(), dirPath, blockWrite)
+	if err != nil {
+		return err
+	}
+
+	de, ok := dblock.Children[filePath.tailName()]
+	if !ok || de.BlockPointer != filePath.tailPointer() {
+		return NoSuchNameError{filePath.tailName()}
+	}
+	if de.Type != File && de.Type != Exec {
+		return NotFileError{filePath}
+	}
+
+	// does name already exist?
+	if _, ok := dblock.Children[name]; ok {
+		return NameExistsError{name}
+	}
+
+	if err := fbo.checkNewDirSize(ctx, lState, md.ReadOnly(),
+		dirPath, name); err != nil {
+		return err
+	}
+
+	co, err := newCreateOp(name, dirPath.tailPointer(), de.Type)
+	if err != nil {
+		return err
+	}
+	co.Link = filePath.tailName()
+	md.AddOp(co)
+
+	// A new link changes the file's ctime, as seen through all of
+	// its names.
+	de.Ctime = fbo.nowUnixNano()
+	setEntryAndLinks(dblock, filePath.tailName(), de)
+	dblock.Children[name] = de
+	fixLinkCounts(dblock)
+
+	_, err = fbo.syncBlockAndFinalizeLocked(
+		ctx, lState, md, dblock, *dirPath.parentPath(),
+		dirPath.tailName(), Dir, true, true, zeroPtr, NoExcl)
+	return err
+}
+
+// Link implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) Link(
+	ctx context.Context, file Node, dir Node, name string) (err error) {
+	fbo.log.CDebugf(ctx, "Link %p %p %s", file.GetID(), dir.GetID(), name)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return err
+	}
+	err = fbo.checkNodeForWrite(dir)
+	if err != nil {
+		return err
+	}
+
+	err = fbo.throttleRevision(ctx, dir)
+	if err != nil {
+		return err
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			return fbo.linkLocked(ctx, lState, file, dir, name)
+		})
+}
+
+// relinkRemovedNameLocked moves any cached node that was reached
+// through name in dir, which has just been removed or renamed over,
+// to one of the remaining hard links to its file.  Nodes of files
+// with no links left are unlinked by the caller instead.
+func (fbo *folderBranchOps) relinkRemovedNameLocked(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, dir Node, name string) {
+	fbo.headLock.AssertLocked(lState)
+
+	dirPath, err := fbo.pathFromNodeForRead(dir)
+	if err != nil {
+		return
+	}
+	dblock, err := fbo.blocks.GetDir(ctx, lState, kmd, dirPath, blockRead)
+	if err != nil {
+		fbo.log.CDebugf(ctx, "Couldn't get dir to relink %s: %v", name, err)
+		return
+	}
+	for n, de := range dblock.Children {
+		if n == name || !de.isLinkOf(de) {
+			continue
+		}
+		node := fbo.nodeCache.Get(de.ref())
+		if node == nil {
+			continue
+		}
+		p := fbo.nodeCache.PathFromNode(node)
+		if p.tailName() != name || !p.hasValidParent() ||
+			p.parentPath().tailPointer() != dirPath.tailPointer() {
+			continue
+		}
+		fbo.log.CDebugf(ctx, "Moving node %p from %s to link %s",
+			node.GetID(), name, n)
+		err := fbo.nodeCache.Move(de.ref(), dir, n)
+		if err != nil {
+			fbo.log.CErrorf(ctx, "Couldn't move node in cache: %v", err)
+		}
+		return
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKBFSOpsHardLink(t *testing.T) {
+	var userName libkb.NormalizedUsername = "u1"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, userName.String(), false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte("hello"), 0)
+	require.NoError(t, err)
+
+	// Link the file while it's still dirty.
+	err = kbfsOps.Link(ctx, fileNode, rootNode, "b")
+	require.NoError(t, err)
+	err = kbfsOps.Link(ctx, fileNode, rootNode, "b")
+	require.IsType(t, NameExistsError{}, err)
+	linkNode, ei, err := kbfsOps.Lookup(ctx, rootNode, "b")
+	require.NoError(t, err)
+	require.Equal(t, fileNode.GetID(), linkNode.GetID())
+	require.Equal(t, uint32(2), ei.LinkCount())
+
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	_, aEI, err := kbfsOps.Lookup(ctx, rootNode, "a")
+	require.NoError(t, err)
+	_, bEI, err := kbfsOps.Lookup(ctx, rootNode, "b")
+	require.NoError(t, err)
+	require.Equal(t, aEI, bEI)
+	require.Equal(t, uint64(5), bEI.Size)
+	require.Equal(t, uint32(2), bEI.LinkCount())
+
+	// Renaming over another link to the same file does nothing.
+	err = kbfsOps.Rename(ctx, rootNode, "a", rootNode, "b")
+	require.NoError(t, err)
+	_, _, err = kbfsOps.Lookup(ctx, rootNode, "a")
+	require.NoError(t, err)
+
+	// Links have to stay in the same directory.
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	err = kbfsOps.Link(ctx, fileNode, dirNode, "c")
+	require.IsType(t, CrossDirLinkError{}, err)
+	err = kbfsOps.Rename(ctx, rootNode, "a", dirNode, "c")
+	require.IsType(t, CrossDirLinkError{}, err)
+
+	// Removing the name the node was found by keeps the file, and
+	// the node, alive through the other link.
+	err = kbfsOps.RemoveEntry(ctx, rootNode, "a")
+	require.NoError(t, err)
+	ei, err = kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), ei.LinkCount())
+	err = kbfsOps.Write(ctx, fileNode, []byte("jello"), 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	linkNode, _, err = kbfsOps.Lookup(ctx, rootNode, "b")
+	require.NoError(t, err)
+	require.Equal(t, fileNode.GetID(), linkNode.GetID())
+	buf := make([]byte, 5)
+	n, err := kbfsOps.Read(ctx, linkNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), n)
+	require.Equal(t, "jello", string(buf))
+
+	// With no links left, it can move anywhere.
+	err = kbfsOps.Rename(ctx, rootNode, "b", dirNode, "c")
+	require.NoError(t, err)
+}
+
+func TestFixLinkCounts(t *testing.T) {
+	ptr1 := BlockPointer{ID: fakeBlockID(1)}
+	ptr2 := BlockPointer{ID: fakeBlockID(2)}
+	dblock := NewDirBlock().(*DirBlock)
+	dblock.Children["a"] = DirEntry{
+		BlockInfo: BlockInfo{BlockPointer: ptr1},
+		EntryInfo: EntryInfo{Type: File},
+	}
+	dblock.Children["b"] = DirEntry{
+		BlockInfo: BlockInfo{BlockPointer: ptr1},
+		EntryInfo: EntryInfo{Type: File},
+	}
+	dblock.Children["c"] = DirEntry{
+		BlockInfo: BlockInfo{BlockPointer: ptr2},
+		EntryInfo: EntryInfo{Type: Exec, Nlink: 2},
+	}
+	dblock.Children["s1"] = DirEntry{EntryInfo: EntryInfo{Type: Sym}}
+	dblock.Children["s2"] = DirEntry{EntryInfo: EntryInfo{Type: Sym}}
+
+	fixLinkCounts(dblock)
+	require.Equal(t, uint32(2), dblock.Children["a"].Nlink)
+	require.Equal(t, uint32(2), dblock.Children["b"].Nlink)
+	require.Equal(t, uint32(0), dblock.Children["c"].Nlink)
+	require.Equal(t, uint32(0), dblock.Children["s1"].Nlink)
+
+	// Updating one link updates the other.
+	de := dblock.Children["a"]
+	de.Size = 10
+	de.Nlink = 0
+	setEntryAndLinks(dblock, "a", de)
+	require.Equal(t, uint64(10), dblock.Children["b"].Size)
+	require.Equal(t, uint32(2), dblock.Children["b"].Nlink)
+	require.Equal(t, uint32(2), dblock.Children["a"].Nlink)
+}
@@ -11,6 +11,8 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash"
+	"io"
 )
 
 // See https://keybase.io/admin-docs/hash-format for the design doc
@@ -194,22 +196,56 @@ func (h *Hash) UnmarshalBinary(data []byte) error {
 // Verify makes sure that the hash matches the given data and returns
 // an error otherwise.
 func (h Hash) Verify(buf []byte) error {
-	if !h.IsValid() {
-		return InvalidHashError{h}
+	v, err := newHashVerifier(h)
+	if err != nil {
+		return err
+	}
+	v.Write(buf)
+	return v.Verify()
+}
+
+// hashVerifier checks data against a hash as the data is written to
+// it, so that data read in pieces can be hashed along the way rather
+// than in a second pass once it's all in memory.  The default hash
+// can't tell that data is bad until it has all been seen, so the
+// only problems caught before then are with the hash itself.
+type hashVerifier struct {
+	expected Hash
+	h        hash.Hash
+}
+
+var _ io.Writer = (*hashVerifier)(nil)
+
+// newHashVerifier returns a verifier for the given hash, or an error
+// if data can't be checked against it.
+func newHashVerifier(expected Hash) (*hashVerifier, error) {
+	if !expected.IsValid() {
+		return nil, InvalidHashError{expected}
 	}
 
 	// Once we have multiple hash types we'll need to expand this.
-	t := h.hashType()
+	t := expected.hashType()
 	if t != DefaultHashType {
-		return UnknownHashTypeError{t}
+		return nil, UnknownHashTypeError{t}
 	}
+	return &hashVerifier{expected, DefaultHashNew()}, nil
+}
+
+// Write implements the io.Writer interface for hashVerifier.  It
+// never returns an error.
+func (v *hashVerifier) Write(p []byte) (int, error) {
+	return v.h.Write(p)
+}
 
-	expectedH, err := DefaultHash(buf)
+// Verify returns an error if the data written so far doesn't match
+// the expected hash.
+func (v *hashVerifier) Verify() error {
+	h, err := HashFromRaw(DefaultHashType, v.h.Sum(nil))
 	if err != nil {
 		return err
 	}
-	if h != expectedH {
-		return HashMismatchError{expectedH, h}
+	if v.expected != h {
+		return HashMismatchError{h, v.expected}
 	}
 	return nil
 }
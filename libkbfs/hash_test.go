@@ -126,6 +126,30 @@ func TestHashVerify(t *testing.T) {
 	assert.IsType(t, HashMismatchError{}, err)
 }
 
+// Make sure data written to a hashVerifier in pieces is checked as a
+// whole.
+func TestHashVerifierPieces(t *testing.T) {
+	data := []byte{1, 2, 3, 4, 5}
+	validH, err := DefaultHash(data)
+	require.NoError(t, err)
+
+	v, err := newHashVerifier(validH)
+	require.NoError(t, err)
+	v.Write(data[:2])
+	v.Write(data[2:])
+	require.NoError(t, v.Verify())
+
+	v, err = newHashVerifier(validH)
+	require.NoError(t, err)
+	v.Write(data[:4])
+	assert.IsType(t, HashMismatchError{}, v.Verify())
+
+	unknownType := validH.hashType() + 1
+	_, err = newHashVerifier(
+		hashFromRawNoCheck(unknownType, validH.hashData()))
+	assert.Equal(t, UnknownHashTypeError{unknownType}, err)
+}
+
 // Make sure HMAC encodes and decodes properly with minimal overhead.
 func TestHMACEncodeDecode(t *testing.T) {
 	codec := NewCodecMsgpack()
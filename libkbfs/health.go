@@ -0,0 +1,383 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// healthRecentErrors is how many of the most recently reported
+// errors KBFSHealth includes.
+const healthRecentErrors = 10
+
+// HealthState is how well some part of KBFS, or KBFS as a whole, is
+// working.
+type HealthState int
+
+const (
+	// HealthOK means nothing is known to be wrong.
+	HealthOK HealthState = iota
+	// HealthDegraded means KBFS works, but some things may be slow,
+	// stale or waiting, e.g. because of a flush or a rekey that
+	// keeps failing.
+	HealthDegraded
+	// HealthDown means KBFS can't do most of its work, e.g.
+	// because it can't reach the MD server.
+	HealthDown
+)
+
+func (s HealthState) String() string {
+	switch s {
+	case HealthOK:
+		return "ok"
+	case HealthDegraded:
+		return "degraded"
+	case HealthDown:
+		return "down"
+	default:
+		return fmt.Sprintf("HealthState(%d)", int(s))
+	}
+}
+
+// MarshalText implements the encoding.TextMarshaler interface for
+// HealthState.
+func (s HealthState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface
+// for HealthState.
+func (s *HealthState) UnmarshalText(text []byte) error {
+	for _, state := range []HealthState{
+		HealthOK, HealthDegraded, HealthDown} {
+		if string(text) == state.String() {
+			*s = state
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown health state %q", text)
+}
+
+// ServiceHealth is whether KBFS can talk to a server or to the
+// Keybase service.
+type ServiceHealth struct {
+	Connected bool
+	// Error is why the last attempt to reach the service failed,
+	// if it did.
+	Error string `json:",omitempty"`
+}
+
+// TLFHealth is the health of one TLF that is open or has a journal.
+type TLFHealth struct {
+	State    HealthState
+	Problems []string `json:",omitempty"`
+
+	Journal *TLFJournalStatus `json:",omitempty"`
+	Sync    *TLFSyncStatus    `json:",omitempty"`
+	// Rekey is set if the TLF needs a rekey, or this device is
+	// rekeying it or failed to.
+	Rekey *TLFRekeyStatus `json:",omitempty"`
+	// Staged, CRInProgress, CRHeld and LastCRError are as in
+	// ConflictStatus.
+	Staged       bool   `json:",omitempty"`
+	CRInProgress bool   `json:",omitempty"`
+	CRHeld       bool   `json:",omitempty"`
+	LastCRError  string `json:",omitempty"`
+}
+
+// DiskCacheHealth describes one of the caches KBFS keeps on local
+// disk.
+type DiskCacheHealth struct {
+	Name string
+	Dir  string
+	// Bytes is how much the cache takes up, as far as KBFS knows.
+	Bytes uint64
+	// CapacityBytes is the most the cache may take up, or 0 if
+	// it's unlimited.
+	CapacityBytes uint64 `json:",omitempty"`
+	// Error is why the cache can't be used, if it can't.
+	Error string `json:",omitempty"`
+}
+
+// HealthError is an error reported by KBFS, without its stack, but
+// with its user-facing description.
+type HealthError struct {
+	Time  time.Time
+	Error string
+	ErrorDescription
+	Tags map[string]string `json:",omitempty"`
+}
+
+// KBFSHealth is a summary of everything that may keep KBFS from
+// working right now, as returned by KBFSOps.Health.  It's meant to
+// be shown to users as is; Problems explains State in words.  It is
+// suitable for encoding directly as JSON.
+type KBFSHealth struct {
+	State    HealthState
+	Problems []string `json:",omitempty"`
+
+	Offline        bool
+	NetworkState   string
+	MDServer       ServiceHealth
+	BlockServer    ServiceHealth
+	KeybaseService ServiceHealth
+
+	// TLFs holds the health of every open TLF, and of every TLF
+	// with a journal, by canonical path, or by TLF ID for those
+	// whose path isn't known.
+	TLFs map[string]TLFHealth `json:",omitempty"`
+	// RekeyBacklog is how many TLFs in TLFs need a rekey.
+	RekeyBacklog int
+	// CRBacklog is how many TLFs in TLFs have unmerged changes.
+	CRBacklog int
+
+	DiskCaches []DiskCacheHealth `json:",omitempty"`
+	// RecentErrors are the most recently reported errors, oldest
+	// first.
+	RecentErrors []HealthError `json:",omitempty"`
+}
+
+// addProblem lowers h's state to at least state, and records why.
+func (h *KBFSHealth) addProblem(state HealthState, format string,
+	args ...interface{}) {
+	if state > h.State {
+		h.State = state
+	}
+	h.Problems = append(h.Problems, fmt.Sprintf(format, args...))
+}
+
+func (h *TLFHealth) addProblem(state HealthState, format string,
+	args ...interface{}) {
+	if state > h.State {
+		h.State = state
+	}
+	h.Problems = append(h.Problems, fmt.Sprintf(format, args...))
+}
+
+// checkProblems fills in h's state from the statuses in it.
+func (h *TLFHealth) checkProblems() {
+	if h.Journal != nil && h.Journal.LastFlushError != "" {
+		h.addProblem(HealthDegraded, "Journal flush failed: %s",
+			h.Journal.LastFlushError)
+	}
+	if h.Sync != nil && h.Sync.LastError != "" {
+		h.addProblem(HealthDegraded, "Sync failed: %s", h.Sync.LastError)
+	}
+	if h.Rekey != nil {
+		if h.Rekey.LastError != "" {
+			h.addProblem(HealthDegraded, "Rekey failed: %s",
+				h.Rekey.LastError)
+		} else if h.Rekey.Needed && !h.Rekey.InProgress {
+			h.addProblem(HealthDegraded,
+				"Waiting for a rekey by another device")
+		}
+	}
+	if h.LastCRError != "" {
+		h.addProblem(HealthDegraded, "Conflict resolution failed: %s",
+			h.LastCRError)
+	} else if h.CRHeld {
+		h.addProblem(HealthDegraded, "Conflict waiting to be resolved")
+	}
+}
+
+func serviceHealth(failures map[string]error, name string) ServiceHealth {
+	if err := failures[name]; err != nil {
+		return ServiceHealth{Error: err.Error()}
+	}
+	return ServiceHealth{Connected: true}
+}
+
+// tlfHealth returns the health of the TLF of fbo, along with its
+// canonical path, or "" if its MD hasn't been read yet.
+func (fbo *folderBranchOps) tlfHealth(ctx context.Context) (
+	h TLFHealth, tlfPath string, err error) {
+	fbs, _, err := fbo.folderStatus(ctx)
+	if err != nil {
+		return TLFHealth{}, "", err
+	}
+	h = TLFHealth{
+		Journal:      fbs.Journal,
+		Sync:         fbs.Sync,
+		Staged:       fbs.Staged,
+		CRInProgress: fbs.CRInProgress,
+		CRHeld:       fbs.CRHeld,
+		LastCRError:  fbs.LastCRError,
+	}
+	md := fbo.getHead(makeFBOLockState())
+	if md != (ImmutableRootMetadata{}) {
+		tlfPath = md.GetTlfHandle().GetCanonicalPath()
+	}
+	if rekey, _, ok := fbo.status.getRekeyStatus(); ok {
+		h.Rekey = &rekey
+	}
+	h.checkProblems()
+	return h, tlfPath, nil
+}
+
+func (fs *KBFSOpsStandard) tlfHealths(ctx context.Context) (
+	tlfs map[string]TLFHealth) {
+	fs.opsLock.RLock()
+	opses := make([]*folderBranchOps, 0, len(fs.ops))
+	for _, ops := range fs.ops {
+		opses = append(opses, ops)
+	}
+	fs.opsLock.RUnlock()
+
+	tlfs = make(map[string]TLFHealth)
+	seen := make(map[TlfID]bool)
+	for _, ops := range opses {
+		h, tlfPath, err := ops.tlfHealth(ctx)
+		if err != nil {
+			fs.log.CDebugf(ctx, "Couldn't get health of %s: %v",
+				ops.id(), err)
+			continue
+		}
+		if tlfPath == "" {
+			tlfPath = ops.id().String()
+		}
+		tlfs[tlfPath] = h
+		seen[ops.id()] = true
+	}
+
+	// TLFs that aren't open may still have something to flush.
+	if jServer, err := GetJournalServer(fs.config); err == nil {
+		for tlfID, status := range jServer.JournalStatuses() {
+			if seen[tlfID] {
+				continue
+			}
+			status := status
+			h := TLFHealth{Journal: &status}
+			h.checkProblems()
+			tlfs[tlfID.String()] = h
+		}
+	}
+	return tlfs
+}
+
+// checkDir returns why dir can't be used as a cache directory, or ""
+// if it can.
+func checkDir(dir string) string {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err.Error()
+	}
+	if !fi.IsDir() {
+		return fmt.Sprintf("%s is not a directory", dir)
+	}
+	return ""
+}
+
+func (fs *KBFSOpsStandard) diskCacheHealths(
+	tlfs map[string]TLFHealth) []DiskCacheHealth {
+	var caches []DiskCacheHealth
+	if sc := getSyncCache(fs.config); sc != nil {
+		cache := DiskCacheHealth{
+			Name:  "sync",
+			Dir:   sc.cache.dir,
+			Error: checkDir(sc.cache.dir),
+		}
+		for _, h := range tlfs {
+			if h.Sync != nil {
+				cache.Bytes += h.Sync.BytesCached
+			}
+		}
+		caches = append(caches, cache)
+	}
+	if kbcache, ok := fs.config.KeyBundleCache().(*KeyBundleCacheStandard); ok {
+		dir, bytes, capacity := kbcache.diskUsage()
+		if dir != "" {
+			if capacity == math.MaxUint64 {
+				capacity = 0
+			}
+			caches = append(caches, DiskCacheHealth{
+				Name:          "key-bundles",
+				Dir:           dir,
+				Bytes:         bytes,
+				CapacityBytes: capacity,
+				Error:         checkDir(dir),
+			})
+		}
+	}
+	return caches
+}
+
+// Health implements the KBFSOps interface for KBFSOpsStandard.
+func (fs *KBFSOpsStandard) Health(ctx context.Context) (KBFSHealth, error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.Health")
+	defer done()
+
+	failures, _ := fs.currentStatus.CurrentStatus()
+	h := KBFSHealth{
+		Offline:        fs.config.Offline(),
+		NetworkState:   fs.config.NetworkState().String(),
+		MDServer:       serviceHealth(failures, MDServiceName),
+		BlockServer:    serviceHealth(failures, BServiceName),
+		KeybaseService: serviceHealth(failures, KeybaseServiceName),
+	}
+	h.MDServer.Connected = h.MDServer.Connected &&
+		fs.config.MDServer().IsConnected()
+
+	switch {
+	case h.Offline:
+		h.addProblem(HealthDegraded, "Offline mode is on")
+	case !h.MDServer.Connected:
+		h.addProblem(HealthDown, "Can't reach the MD server: %s",
+			h.MDServer.Error)
+	}
+	if h.BlockServer.Error != "" && !h.Offline {
+		h.addProblem(HealthDegraded, "Can't reach the block server: %s",
+			h.BlockServer.Error)
+	}
+	if h.KeybaseService.Error != "" {
+		h.addProblem(HealthDown, "Can't reach the Keybase service: %s",
+			h.KeybaseService.Error)
+	}
+
+	h.TLFs = fs.tlfHealths(ctx)
+	for tlfPath, tlf := range h.TLFs {
+		if tlf.Rekey != nil && tlf.Rekey.Needed {
+			h.RekeyBacklog++
+		}
+		if tlf.Staged {
+			h.CRBacklog++
+		}
+		if tlf.State != HealthOK {
+			h.addProblem(tlf.State, "%s: %s", tlfPath,
+				strings.Join(tlf.Problems, "; "))
+		}
+	}
+
+	h.DiskCaches = fs.diskCacheHealths(h.TLFs)
+	for _, cache := range h.DiskCaches {
+		if cache.Error != "" {
+			h.addProblem(HealthDegraded, "The %s cache can't be used: %s",
+				cache.Name, cache.Error)
+		}
+	}
+
+	locale := ErrorLocale()
+	errors := fs.config.Reporter().AllKnownErrors()
+	if len(errors) > healthRecentErrors {
+		errors = errors[len(errors)-healthRecentErrors:]
+	}
+	for _, e := range errors {
+		if e.Error == nil {
+			continue
+		}
+		h.RecentErrors = append(h.RecentErrors, HealthError{
+			Time:             e.Time,
+			Error:            e.Error.Error(),
+			ErrorDescription: DescribeError(e.Error, locale),
+			Tags:             e.Tags,
+		})
+	}
+	return h, nil
+}
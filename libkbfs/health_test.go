@@ -0,0 +1,69 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKBFSOpsHealth(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	h, err := kbfsOps.Health(ctx)
+	require.NoError(t, err)
+	require.Equal(t, HealthOK, h.State, "%v", h.Problems)
+	require.True(t, h.MDServer.Connected)
+	require.True(t, h.BlockServer.Connected)
+	require.Contains(t, h.TLFs, "/keybase/private/test_user")
+	require.Empty(t, h.RecentErrors)
+
+	// A failing block server only slows things down; a missing MD
+	// server stops them.
+	config.Reporter().ReportErr(ctx, "", false, WriteMode,
+		errors.New("test error"))
+	kbfsOps.PushConnectionStatusChange(BServiceName,
+		errors.New("bserver down"))
+	h, err = kbfsOps.Health(ctx)
+	require.NoError(t, err)
+	require.Equal(t, HealthDegraded, h.State)
+	require.Equal(t, "bserver down", h.BlockServer.Error)
+	require.Len(t, h.RecentErrors, 1)
+
+	kbfsOps.PushConnectionStatusChange(MDServiceName,
+		errors.New("mdserver down"))
+	h, err = kbfsOps.Health(ctx)
+	require.NoError(t, err)
+	require.Equal(t, HealthDown, h.State)
+	require.Len(t, h.Problems, 2)
+
+	// The state survives a round trip through JSON.
+	buf, err := json.Marshal(h)
+	require.NoError(t, err)
+	var decoded KBFSHealth
+	require.NoError(t, json.Unmarshal(buf, &decoded))
+	require.Equal(t, HealthDown, decoded.State)
+}
+
+func TestTLFHealthProblems(t *testing.T) {
+	h := TLFHealth{
+		Journal: &TLFJournalStatus{LastFlushError: "flush failed"},
+		Rekey:   &TLFRekeyStatus{Needed: true},
+	}
+	h.checkProblems()
+	require.Equal(t, HealthDegraded, h.State)
+	require.Len(t, h.Problems, 2)
+
+	h = TLFHealth{Rekey: &TLFRekeyStatus{Needed: true, InProgress: true}}
+	h.checkProblems()
+	require.Equal(t, HealthOK, h.State)
+}
@@ -12,6 +12,8 @@ import (
 	"os/signal"
 	"path/filepath"
 	"runtime/pprof"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/keybase/client/go/libkb"
@@ -53,16 +55,152 @@ type InitParams struct {
 	// before marked for lazy revalidation.
 	TLFValidDuration time.Duration
 
+	// BackgroundFlushAge is how long a file can stay dirty before
+	// it's synced in the background, even if it's never fsync'd.
+	// Zero means dirty files are synced on every background flush.
+	BackgroundFlushAge time.Duration
+
+	// MDCoalesceWindow, if non-zero, lets directory ops made
+	// within this long of each other share one MD revision, as
+	// long as the write journal is on.
+	MDCoalesceWindow time.Duration
+
+	// BlockPutParallelism and BlockGetParallelism, if non-zero,
+	// set how many blocks are put and fetched at once.  Zero
+	// derives them from the measured bandwidth and latency to the
+	// block server.
+	BlockPutParallelism int
+	BlockGetParallelism int
+
+	// MaxReadaheadBlocks is the most blocks of a file prefetched
+	// ahead of a sequential reader.  Zero turns readahead off.
+	MaxReadaheadBlocks int
+
 	// LogToFile if true, logs to a default file location.
 	LogToFile bool
 
 	// LogFileConfig tells us where to log and rotation config.
 	LogFileConfig logger.LogFileConfig
 
+	// LogFormat names the LogFormat log messages are written in;
+	// see ParseLogFormat.
+	LogFormat string
+
+	// SlowOpThreshold, if non-zero, is how long a KBFSOps call
+	// can run before a diagnostic of what it's stuck on is logged.
+	SlowOpThreshold time.Duration
+
+	// StateCheckPeriod, if non-zero, is how often each TLF in use
+	// checks its server-side state for leaked blocks, missing
+	// references and size mismatches.
+	StateCheckPeriod time.Duration
+
+	// DiskLimitFraction is the fraction of the free disk space
+	// that the write journals and the sync cache may take up, or
+	// zero or less for no limit.
+	DiskLimitFraction float64
+
+	// FaultSchedule, if non-empty, is a schedule of faults to inject
+	// into the MD, block, key and Keybase service calls, as parsed
+	// by ParseFaultSchedule, with random choices seeded by
+	// FaultSeed.  It's for manual chaos testing only, so there are no
+	// flags for these; they come from the KBFS_FAULT_SCHEDULE and
+	// KBFS_FAULT_SEED environment variables.
+	FaultSchedule string
+	FaultSeed     int64
+
+	// TraceSpans, if true, logs a timed span for each KBFSOps call
+	// and for the block, MD, journal flush and conflict resolution
+	// steps taken on its behalf.
+	TraceSpans bool
+
 	// WriteJournalRoot, if non-empty, points to a path to a local
 	// directory to put write journals in. If non-empty, enables
 	// write journaling to be turned on for TLFs.
 	WriteJournalRoot string
+
+	// SyncCacheRoot, if non-empty, points to a path to a local
+	// directory in which to keep the blocks of TLFs subscribed to
+	// with KBFSOps.SetSyncSubscription.  If empty, subscribing
+	// fails.
+	SyncCacheRoot string
+
+	// KeyBundleCacheRoot, if non-empty, points to a path to a
+	// local directory in which to persist key bundles fetched
+	// for TLFs with segregated key bundles.  If empty, they are
+	// only cached in memory.
+	KeyBundleCacheRoot string
+
+	// UsageRoot, if non-empty, points to a path to a local
+	// directory in which to persist how many bytes and RPCs each
+	// TLF has cost on the network, by day.  If empty, the usage
+	// is only counted in memory.
+	UsageRoot string
+
+	// CRJournalRoot, if non-empty, points to a path to a local
+	// directory in which to record conflict resolutions that are
+	// in progress, so they can be recovered after a restart.  If
+	// empty, they are only recorded in memory.
+	CRJournalRoot string
+
+	// TLFSettingsRoot, if non-empty, points to a path to a local
+	// directory in which to persist the settings made for
+	// individual TLFs on this device, like their block
+	// compression.  If empty, they only last until KBFS exits.
+	TLFSettingsRoot string
+
+	// LocalFilesRoot, if non-empty, points to a path to a local
+	// directory in which to keep the contents of files that are
+	// local-only because they match an ignore file.  If empty,
+	// ignore files have no effect, and every file is synced.
+	LocalFilesRoot string
+	// LocalFilesLimit is how many bytes the local-only files may
+	// take up in LocalFilesRoot.
+	LocalFilesLimit int64
+
+	// ConflictNameTemplate, if non-empty, is the template used to
+	// name conflicted copies of files; see
+	// TemplateConflictRenamer.
+	ConflictNameTemplate string
+
+	// BlockCacheCapacity is the number of bytes of clean blocks
+	// to keep in memory.
+	BlockCacheCapacity int64
+	// MDCacheCapacity is the number of MD objects to keep in
+	// memory.
+	MDCacheCapacity int
+	// MaxOpenTLFs is the number of TLFs to keep loaded before
+	// idle ones start getting unloaded.
+	MaxOpenTLFs int
+
+	// DisableNotifications, if true, keeps KBFS from sending
+	// notifications (e.g., for display in a GUI) to the Keybase
+	// service.  Errors are still recorded for the status file.
+	DisableNotifications bool
+
+	// ReportLogFilter, if non-empty, is a filter, as parsed by
+	// ParseReportFilter, selecting the reported events to log.
+	ReportLogFilter string
+
+	// ReportWebhook, if non-empty, is a URL to POST the reported
+	// events that pass ReportWebhookFilter to, encoded as JSON.
+	ReportWebhook       string
+	ReportWebhookFilter string
+
+	// ContentDefinedChunking, if true, splits files into blocks
+	// with BlockSplitterCDC rather than at fixed offsets, for
+	// every TLF that doesn't have its own BlockSplitter set.
+	ContentDefinedChunking bool
+
+	// BlockCompression names the BlockCompressionType used for new
+	// blocks in every TLF that doesn't have its own set; see
+	// ParseBlockCompressionType.
+	BlockCompression string
+
+	// Profile, if non-empty, names an entry of InitProfiles whose
+	// values are used for any flags not explicitly set; see
+	// ApplyInitProfile.
+	Profile string
 }
 
 // GetDefaultBServer returns the default value for the -bserver flag.
@@ -96,18 +234,38 @@ func defaultLogPath(ctx Context) string {
 // DefaultInitParams returns default init params
 func DefaultInitParams(ctx Context) InitParams {
 	return InitParams{
-		Debug:            BoolForString(os.Getenv("KBFS_DEBUG")),
-		BServerAddr:      GetDefaultBServer(ctx),
-		MDServerAddr:     GetDefaultMDServer(ctx),
-		TLFValidDuration: tlfValidDurationDefault,
+		Debug:              BoolForString(os.Getenv("KBFS_DEBUG")),
+		BServerAddr:        GetDefaultBServer(ctx),
+		MDServerAddr:       GetDefaultMDServer(ctx),
+		TLFValidDuration:   tlfValidDurationDefault,
+		BackgroundFlushAge: bgFlushAgeDefault,
+		SlowOpThreshold:    slowOpThresholdDefault,
+		DiskLimitFraction:  diskLimitFractionDefault,
+		LocalFilesLimit:    LocalFilesLimitBytesDefault,
 		LogFileConfig: logger.LogFileConfig{
 			MaxAge:       30 * 24 * time.Hour,
 			MaxSize:      128 * 1024 * 1024,
 			MaxKeepFiles: 3,
 		},
+		BlockCacheCapacity: blockCacheCapacityBytesDefault,
+		MDCacheCapacity:    mdCacheCapacityDefault,
+		MaxOpenTLFs:        defaultMaxFolderBranchOps,
+		MaxReadaheadBlocks: maxReadaheadBlocksDefault,
+		FaultSchedule:      os.Getenv("KBFS_FAULT_SCHEDULE"),
+		FaultSeed:          faultSeedFromEnv(),
 	}
 }
 
+// faultSeedFromEnv returns the seed in KBFS_FAULT_SEED, or a new one
+// if it's not set.
+func faultSeedFromEnv() int64 {
+	seed, err := strconv.ParseInt(os.Getenv("KBFS_FAULT_SEED"), 10, 64)
+	if err != nil {
+		return time.Now().UnixNano()
+	}
+	return seed
+}
+
 // AddFlags adds libkbfs flags to the given FlagSet. Returns an
 // InitParams that will be filled in once the given FlagSet is parsed.
 func AddFlags(flags *flag.FlagSet, ctx Context) *InitParams {
@@ -126,6 +284,11 @@ func AddFlags(flags *flag.FlagSet, ctx Context) *InitParams {
 	flags.StringVar(&params.ServerRootDir, "server-root", "", "directory to put local server files (and ignore -bserver and -mdserver)")
 	flags.StringVar(&params.LocalUser, "localuser", "", "fake local user (used only with -server-in-memory or -server-root)")
 	flags.DurationVar(&params.TLFValidDuration, "tlf-valid", defaultParams.TLFValidDuration, "time tlfs are valid before redoing identification")
+	flags.DurationVar(&params.BackgroundFlushAge, "bg-flush-age", defaultParams.BackgroundFlushAge, "how long a file can stay dirty before it's synced in the background")
+	flags.DurationVar(&params.MDCoalesceWindow, "md-coalesce-window", 0, "if non-zero, how long directory ops can keep being folded into the same MD revision while journaled (e.g., 200ms)")
+	flags.IntVar(&params.BlockPutParallelism, "block-put-parallelism", 0, "if non-zero, how many blocks to put at once, rather than a number derived from the measured bandwidth and latency")
+	flags.IntVar(&params.BlockGetParallelism, "block-get-parallelism", 0, "if non-zero, how many blocks background fetches get at once, rather than a number derived from the measured bandwidth and latency")
+	flags.IntVar(&params.MaxReadaheadBlocks, "max-readahead-blocks", defaultParams.MaxReadaheadBlocks, "the most blocks of a file to prefetch ahead of a sequential reader; 0 turns readahead off")
 	flags.BoolVar(&params.LogToFile, "log-to-file", false, fmt.Sprintf("Log to default file: %s", defaultLogPath(ctx)))
 	flags.StringVar(&params.LogFileConfig.Path, "log-file", "", "Path to log file")
 	flags.DurationVar(&params.LogFileConfig.MaxAge, "log-file-max-age", defaultParams.LogFileConfig.MaxAge, "Maximum age of a log file before rotation")
@@ -133,7 +296,32 @@ func AddFlags(flags *flag.FlagSet, ctx Context) *InitParams {
 	flags.Var(SizeFlag{&params.LogFileConfig.MaxSize}, "log-file-max-size", "Maximum size of a log file before rotation")
 	// The default is to *DELETE* old log files for kbfs.
 	flags.IntVar(&params.LogFileConfig.MaxKeepFiles, "log-file-max-keep-files", defaultParams.LogFileConfig.MaxKeepFiles, "Maximum number of log files for this service, older ones are deleted. 0 for infinite.")
+	flags.StringVar(&params.LogFormat, "log-format", LogFormatText.String(), "Format of log messages, and the context tags (such as operation IDs) logged with them; one of text, kv, json")
+	flags.DurationVar(&params.SlowOpThreshold, "slow-op-threshold", defaultParams.SlowOpThreshold, "if non-zero, how long an operation can run before a diagnostic of the locks, RPCs and journal it's waiting on is logged, and kept for 'kbfstool slowops'")
+	flags.DurationVar(&params.StateCheckPeriod, "state-check-period", 0, "if non-zero, how often each TLF in use checks its server-side state for leaked blocks, missing references and size mismatches, logging what it finds; see also 'kbfstool statecheck'")
+	flags.Float64Var(&params.DiskLimitFraction, "disk-limit-fraction", defaultParams.DiskLimitFraction, "Fraction of the free disk space the write journals and sync cache may take up; writes slow down as the journals approach it. Zero or less for no limit")
+	flags.BoolVar(&params.TraceSpans, "trace-spans", false, "Log how long each operation, and each block, MD, journal and conflict resolution step under it, takes")
 	flags.StringVar(&params.WriteJournalRoot, "write-journal-root", filepath.Join(ctx.GetDataDir(), "kbfs_journal"), "(EXPERIMENTAL) If non-empty, permits write journals to be turned on for TLFs which will be put in the given directory")
+	flags.StringVar(&params.SyncCacheRoot, "sync-cache-root", filepath.Join(ctx.GetDataDir(), "kbfs_sync_cache"), "If non-empty, the directory in which to keep the blocks of TLFs subscribed to for offline use")
+	flags.StringVar(&params.KeyBundleCacheRoot, "key-bundle-cache-root", filepath.Join(ctx.GetDataDir(), "kbfs_key_bundles"), "If non-empty, the directory in which to persist key bundles")
+	flags.StringVar(&params.UsageRoot, "usage-root", filepath.Join(ctx.GetDataDir(), "kbfs_usage"), "If non-empty, the directory in which to persist the daily network usage of each TLF")
+	flags.StringVar(&params.CRJournalRoot, "cr-journal-root", filepath.Join(ctx.GetDataDir(), "kbfs_cr_journal"), "If non-empty, the directory in which to record in-progress conflict resolutions")
+	flags.StringVar(&params.TLFSettingsRoot, "tlf-settings-root", filepath.Join(ctx.GetDataDir(), "kbfs_tlf_settings"), "If non-empty, the directory in which to persist the settings made for individual folders")
+	flags.StringVar(&params.LocalFilesRoot, "local-files-root", filepath.Join(ctx.GetDataDir(), "kbfs_local_files"), "If non-empty, the directory in which to keep files that match a "+KBFSIgnoreFileName+" file, instead of syncing them; it's emptied on startup")
+	params.LocalFilesLimit = defaultParams.LocalFilesLimit
+	flags.Var(SizeFlag{&params.LocalFilesLimit}, "local-files-size", "Bytes the local-only files may take up in -local-files-root")
+	flags.StringVar(&params.ConflictNameTemplate, "conflict-name-template", "", fmt.Sprintf("If non-empty, the template for naming conflicted copies of files, optionally starting with a directory at the root of the folder to collect them in, as in \".conflicts/{base}{ext}\" (default %q)", DefaultConflictNameTemplate))
+	params.BlockCacheCapacity = defaultParams.BlockCacheCapacity
+	flags.Var(SizeFlag{&params.BlockCacheCapacity}, "block-cache-size", "Bytes of clean blocks to keep in memory")
+	flags.IntVar(&params.MDCacheCapacity, "md-cache-size", defaultParams.MDCacheCapacity, "Number of metadata objects to keep in memory")
+	flags.IntVar(&params.MaxOpenTLFs, "max-open-tlfs", defaultParams.MaxOpenTLFs, "Number of folders to keep loaded before unloading idle ones")
+	flags.BoolVar(&params.DisableNotifications, "disable-notifications", false, "Don't send notifications to the Keybase service")
+	flags.StringVar(&params.ReportLogFilter, "report-log-filter", "", "If non-empty, log the reported events that pass this filter (e.g., severity=warning,type=journal-stall,tlf=alice)")
+	flags.StringVar(&params.ReportWebhook, "report-webhook", "", "If non-empty, a URL to POST reported events to, as JSON")
+	flags.StringVar(&params.ReportWebhookFilter, "report-webhook-filter", "severity=warning", "Which reported events to POST to -report-webhook, in the same form as -report-log-filter")
+	flags.BoolVar(&params.ContentDefinedChunking, "content-defined-chunking", false, "Split files into blocks by content rather than at fixed offsets, so edits only re-upload the changed blocks")
+	flags.StringVar(&params.BlockCompression, "block-compression", BlockCompressionNone.String(), "Compress blocks before encrypting them, when that makes them smaller; one of none, snappy, flate")
+	flags.StringVar(&params.Profile, "profile", "", fmt.Sprintf("If non-empty, a preset for the flags not given explicitly; one of %s", strings.Join(initProfileNames(), ", ")))
 	return &params
 }
 
@@ -214,7 +402,15 @@ func makeBlockServer(config Config, serverInMemory bool, serverRootDir, bserverA
 // Possible errors are logged to the logger returned.
 func InitLog(params InitParams, ctx Context) (logger.Logger, error) {
 	var err error
-	log := logger.NewWithCallDepth("kbfs", 1)
+	var log logger.Logger = logger.NewWithCallDepth("kbfs", 1)
+	logFormat := LogFormatText
+	if params.LogFormat != "" {
+		logFormat, err = ParseLogFormat(params.LogFormat)
+		if err != nil {
+			return log, err
+		}
+	}
+	log = NewStructuredLogger(log, logFormat)
 
 	// Set log file to default if log-to-file was specified
 	if params.LogToFile {
@@ -238,6 +434,43 @@ func InitLog(params InitParams, ctx Context) (logger.Logger, error) {
 	return log, err
 }
 
+// addReportSinks registers the report sinks asked for in params,
+// and one that counts events if metrics are on.
+func addReportSinks(
+	config Config, reporter *ReporterPipeline, params InitParams) error {
+	if registry := config.MetricsRegistry(); registry != nil {
+		err := reporter.AddSink(MetricsReportSinkName,
+			NewMetricsReportSink(registry), ReportFilter{})
+		if err != nil {
+			return err
+		}
+	}
+	if params.ReportLogFilter != "" {
+		filter, err := ParseReportFilter(params.ReportLogFilter)
+		if err != nil {
+			return err
+		}
+		err = reporter.AddSink(LogReportSinkName,
+			NewLogReportSink(config.MakeLogger("REP")), filter)
+		if err != nil {
+			return err
+		}
+	}
+	if params.ReportWebhook != "" {
+		filter, err := ParseReportFilter(params.ReportWebhookFilter)
+		if err != nil {
+			return err
+		}
+		err = reporter.AddSink(WebhookReportSinkName,
+			NewWebhookReportSink(params.ReportWebhook, 1000,
+				config.MakeLogger("REP")), filter)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Init initializes a config and returns it.
 //
 // onInterruptFn is called whenever an interrupt signal is received
@@ -275,13 +508,33 @@ func Init(ctx Context, params InitParams, keybaseServiceCn KeybaseServiceCn, onI
 
 	config := NewConfigLocal()
 
-	bsplitter, err := NewBlockSplitterSimple(MaxBlockSizeBytesDefault, 8*1024,
-		config.Codec())
+	var bsplitter BlockSplitter
+	var err error
+	logFormat := LogFormatText
+	if params.LogFormat != "" {
+		logFormat, err = ParseLogFormat(params.LogFormat)
+		if err != nil {
+			return nil, err
+		}
+	}
+	chunking := BlockChunkingFixed
+	if params.ContentDefinedChunking {
+		chunking = BlockChunkingContent
+	}
+	bsplitter, err = MakeBlockSplitter(chunking, config.Codec())
 	if err != nil {
 		return nil, err
 	}
 	config.SetBlockSplitter(bsplitter)
 
+	if params.BlockCompression != "" {
+		compression, err := ParseBlockCompressionType(params.BlockCompression)
+		if err != nil {
+			return nil, err
+		}
+		config.SetBlockCompression(compression)
+	}
+
 	if registry := config.MetricsRegistry(); registry != nil {
 		keyCache := config.KeyCache()
 		keyCache = NewKeyCacheMeasured(keyCache, registry)
@@ -302,16 +555,92 @@ func Init(ctx Context, params InitParams, keybaseServiceCn KeybaseServiceCn, onI
 			// style to be specified.
 			lg.Configure("", true, "")
 		}
-		return lg
+		return NewStructuredLogger(lg, logFormat)
 	})
 
+	if params.TraceSpans {
+		config.SetTracer(NewTracerStandard(config.Clock(),
+			NewSpanLogExporter(config.MakeLogger("TRC")),
+			config.MakeLogger("")))
+	}
+
 	config.SetTLFValidDuration(params.TLFValidDuration)
+	config.SetBackgroundFlushAge(params.BackgroundFlushAge)
+	config.SetMDCoalesceWindow(params.MDCoalesceWindow)
+	config.SetMaxReadaheadBlocks(params.MaxReadaheadBlocks)
+	config.SetSlowOpThreshold(params.SlowOpThreshold)
+	config.SetStateCheckPeriod(params.StateCheckPeriod)
+	config.SetDiskLimitFraction(params.DiskLimitFraction)
+	err = config.BlockTransferMeter().SetParallelism(
+		params.BlockPutParallelism, params.BlockGetParallelism)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(params.KeyBundleCacheRoot) > 0 {
+		kbcache, err := NewKeyBundleCacheDisk(config.Codec(),
+			config.MakeLogger("KBC"), params.KeyBundleCacheRoot,
+			keyBundleCacheCapacityBytesDefault)
+		if err != nil {
+			return nil, fmt.Errorf("problem creating key bundle cache: %v", err)
+		}
+		config.SetKeyBundleCache(kbcache)
+	}
+
+	if len(params.UsageRoot) > 0 {
+		err := config.EnableUsagePersistence(params.UsageRoot)
+		if err != nil {
+			return nil, fmt.Errorf("problem loading usage: %v", err)
+		}
+	}
+
+	if len(params.CRJournalRoot) > 0 {
+		config.SetCRJournal(
+			NewCRJournalDisk(config.Codec(), params.CRJournalRoot))
+	}
+
+	if len(params.TLFSettingsRoot) > 0 {
+		err := config.EnableTLFSettingsPersistence(params.TLFSettingsRoot)
+		if err != nil {
+			return nil, fmt.Errorf("problem loading TLF settings: %v", err)
+		}
+	}
+
+	if len(params.LocalFilesRoot) > 0 {
+		err := config.EnableLocalFileStore(
+			params.LocalFilesRoot, params.LocalFilesLimit)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"problem setting up the local-only file store: %v", err)
+		}
+	}
+
+	if len(params.ConflictNameTemplate) > 0 {
+		renamer, err := NewTemplateConflictRenamer(
+			config, params.ConflictNameTemplate)
+		if err != nil {
+			return nil, err
+		}
+		config.SetConflictRenamer(renamer)
+	}
+
+	if params.BlockCacheCapacity > 0 || params.MDCacheCapacity > 0 {
+		config.SetCacheCapacities(
+			uint64(params.BlockCacheCapacity), params.MDCacheCapacity)
+	}
 
 	kbfsOps := NewKBFSOpsStandard(config)
+	if params.MaxOpenTLFs > 0 {
+		kbfsOps.maxOps = params.MaxOpenTLFs
+	}
 	config.SetKBFSOps(kbfsOps)
 	config.SetNotifier(kbfsOps)
 	config.SetKeyManager(NewKeyManagerStandard(config))
-	config.SetMDOps(NewMDOpsStandard(config))
+	var mdOps MDOps = NewMDOpsStandard(config)
+	if registry := config.MetricsRegistry(); registry != nil {
+		mdOps = NewMDOpsMeasured(mdOps, registry)
+	}
+	config.SetMDOps(mdOps)
 
 	mdServer, err := makeMDServer(
 		config, params.ServerInMemory || params.MDServerInMemory, params.ServerRootDir, params.MDServerAddr, ctx)
@@ -333,6 +662,10 @@ func Init(ctx Context, params InitParams, keybaseServiceCn KeybaseServiceCn, onI
 
 	config.SetKeyServer(keyServer)
 
+	// Wrap the MD server only now, since the remote key server is
+	// the MD server itself.
+	config.SetMDServer(NewMDServerOffline(config, config.MDServer()))
+
 	if keybaseServiceCn == nil {
 		keybaseServiceCn = keybaseDaemon{}
 	}
@@ -350,7 +683,17 @@ func Init(ctx Context, params InitParams, keybaseServiceCn KeybaseServiceCn, onI
 	k := NewKBPKIClient(config)
 	config.SetKBPKI(k)
 
-	config.SetReporter(NewReporterKBPKI(config, 10, 1000))
+	var reporter *ReporterPipeline
+	if params.DisableNotifications {
+		reporter = NewReporterPipeline(config.Clock(), 10)
+	} else {
+		reporter = NewReporterKBPKI(config, 10, 1000).ReporterPipeline
+	}
+	config.SetReporter(reporter)
+	err = addReportSinks(config, reporter, params)
+	if err != nil {
+		return nil, err
+	}
 
 	crypto, err := keybaseServiceCn.NewCrypto(config, params, ctx, log)
 	if err != nil {
@@ -363,6 +706,18 @@ func Init(ctx Context, params InitParams, keybaseServiceCn KeybaseServiceCn, onI
 
 	config.SetCrypto(crypto)
 
+	// Probing crypto takes a moment, so do it in the background;
+	// until it's done, the defaults stand.
+	go func() {
+		caps, err := ProbeCryptoCapabilities(config.Codec())
+		if err != nil {
+			log.Warning("Couldn't probe crypto capabilities: %v", err)
+			return
+		}
+		log.Debug("Crypto capabilities: %+v", caps)
+		config.SetCryptoCapabilities(caps)
+	}()
+
 	bserv, err := makeBlockServer(config, params.ServerInMemory || params.BServerInMemory, params.ServerRootDir, params.BServerAddr, ctx, log)
 	if err != nil {
 		return nil, fmt.Errorf("cannot open block database: %v", err)
@@ -371,9 +726,19 @@ func Init(ctx Context, params InitParams, keybaseServiceCn KeybaseServiceCn, onI
 	if registry := config.MetricsRegistry(); registry != nil {
 		bserv = NewBlockServerMeasured(bserv, registry)
 	}
+	bserv = NewBlockServerNegativeCache(bserv, config.Clock())
+	// Journaling, if enabled below, wraps this, so that journaled
+	// blocks stay readable while offline.
+	bserv = NewBlockServerOffline(config, bserv)
 
 	config.SetBlockServer(bserv)
 
+	// The sync cache goes over the offline wrapper, so that synced
+	// blocks stay readable while offline.
+	if len(params.SyncCacheRoot) > 0 {
+		config.EnableSyncCache(params.SyncCacheRoot)
+	}
+
 	// TODO: Don't turn on journaling if -server-in-memory is
 	// used.
 
@@ -381,6 +746,19 @@ func Init(ctx Context, params InitParams, keybaseServiceCn KeybaseServiceCn, onI
 		config.EnableJournaling(params.WriteJournalRoot)
 	}
 
+	// Faults go in last, on top of journaling, so that they hit
+	// what folderBranchOps sees.
+	if params.FaultSchedule != "" {
+		rules, err := ParseFaultSchedule(params.FaultSchedule)
+		if err != nil {
+			return nil, err
+		}
+		log.Warning("Injecting faults with seed %d: %s",
+			params.FaultSeed, params.FaultSchedule)
+		InjectFaults(config, NewFaultInjector(
+			params.FaultSeed, config.MakeLogger("FLT"), rules...))
+	}
+
 	return config, nil
 }
 
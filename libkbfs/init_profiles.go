@@ -0,0 +1,115 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+)
+
+// InitProfile is a named set of values for the flags added by
+// AddFlags, tuned for a particular kind of deployment.
+type InitProfile struct {
+	Description string
+	// Flags maps flag names to the values this profile gives them.
+	Flags map[string]string
+}
+
+// InitProfiles holds the profiles that can be selected with the
+// -profile flag.
+var InitProfiles = map[string]InitProfile{
+	"desktop": {
+		Description: "An interactive machine with a GUI; the defaults",
+		Flags:       map[string]string{},
+	},
+	"server": {
+		Description: "A headless machine with plenty of memory, " +
+			"serving many folders",
+		Flags: map[string]string{
+			"block-cache-size":      "4Gi",
+			"md-cache-size":         "50000",
+			"max-open-tlfs":         "10000",
+			"block-put-parallelism": "200",
+			"block-get-parallelism": "100",
+			"max-readahead-blocks":  "128",
+			"disable-notifications": "true",
+		},
+	},
+	"ci": {
+		Description: "A short-lived, headless test run; nothing " +
+			"is persisted locally",
+		Flags: map[string]string{
+			"block-cache-size":      "256Mi",
+			"md-cache-size":         "1000",
+			"max-open-tlfs":         "100",
+			"write-journal-root":    "",
+			"key-bundle-cache-root": "",
+			"cr-journal-root":       "",
+			"tlf-settings-root":     "",
+			"local-files-root":      "",
+			"disable-notifications": "true",
+			// Fixed parallelism and no readahead keep runs
+			// repeatable.
+			"block-put-parallelism": "10",
+			"block-get-parallelism": "10",
+			"max-readahead-blocks":  "0",
+		},
+	},
+	"constrained-memory": {
+		Description: "A machine where KBFS should use as little " +
+			"memory as possible",
+		Flags: map[string]string{
+			"block-cache-size": "32Mi",
+			"md-cache-size":    "500",
+			"max-open-tlfs":    "50",
+			// Every block in flight or prefetched is held in
+			// memory.
+			"block-put-parallelism": "4",
+			"block-get-parallelism": "2",
+			"max-readahead-blocks":  "4",
+		},
+	},
+}
+
+func initProfileNames() []string {
+	names := make([]string, 0, len(InitProfiles))
+	for name := range InitProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ApplyInitProfile sets each flag in the profile named by
+// params.Profile, unless that flag was given explicitly, so that
+// individual settings can still be overridden.  It must be called
+// after flags, which must also have been passed to the AddFlags call
+// that returned params, is parsed.
+func ApplyInitProfile(flags *flag.FlagSet, params *InitParams) error {
+	if params.Profile == "" {
+		return nil
+	}
+	profile, ok := InitProfiles[params.Profile]
+	if !ok {
+		return fmt.Errorf("Unknown profile %q; must be one of %v",
+			params.Profile, initProfileNames())
+	}
+
+	explicit := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	for name, value := range profile.Flags {
+		if explicit[name] {
+			continue
+		}
+		if err := flags.Set(name, value); err != nil {
+			return fmt.Errorf("Couldn't set -%s=%q for profile %s: %v",
+				name, value, params.Profile, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"flag"
+	"net"
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/go-framed-msgpack-rpc"
+	"github.com/stretchr/testify/require"
+)
+
+type testInitContext struct{}
+
+func (testInitContext) GetRunMode() libkb.RunMode { return libkb.DevelRunMode }
+func (testInitContext) GetLogDir() string         { return "/tmp/log" }
+func (testInitContext) GetDataDir() string        { return "/tmp/data" }
+func (testInitContext) ConfigureSocketInfo() error {
+	return errors.New("no socket")
+}
+func (testInitContext) GetSocket(bool) (
+	net.Conn, rpc.Transporter, bool, error) {
+	return nil, nil, false, errors.New("no socket")
+}
+func (testInitContext) NewRPCLogFactory() *libkb.RPCLogFactory { return nil }
+
+func TestApplyInitProfile(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	params := AddFlags(flags, testInitContext{})
+	err := flags.Parse([]string{"-profile=ci", "-md-cache-size=42"})
+	require.NoError(t, err)
+	err = ApplyInitProfile(flags, params)
+	require.NoError(t, err)
+
+	// Profile values apply, except where overridden.
+	require.Equal(t, int64(256*1024*1024), params.BlockCacheCapacity)
+	require.Equal(t, 42, params.MDCacheCapacity)
+	require.Equal(t, 100, params.MaxOpenTLFs)
+	require.Equal(t, 10, params.BlockPutParallelism)
+	require.Equal(t, 10, params.BlockGetParallelism)
+	require.Equal(t, 0, params.MaxReadaheadBlocks)
+	require.Equal(t, "", params.WriteJournalRoot)
+	require.True(t, params.DisableNotifications)
+
+	params.Profile = "bogus"
+	require.Error(t, ApplyInitProfile(flags, params))
+}
+
+func TestInitProfilesValid(t *testing.T) {
+	for name := range InitProfiles {
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		params := AddFlags(flags, testInitContext{})
+		params.Profile = name
+		require.NoError(t, ApplyInitProfile(flags, params), name)
+	}
+}
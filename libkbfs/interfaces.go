@@ -5,6 +5,8 @@
 package libkbfs
 
 import (
+	"io"
+	"os"
 	"reflect"
 	"time"
 
@@ -133,6 +135,15 @@ type KBFSOps interface {
 	// permission for the top-level folder.  This is a remote-access
 	// operation.
 	GetDirChildren(ctx context.Context, dir Node) (map[string]EntryInfo, error)
+	// BatchStat returns the entry info for each of the given names
+	// in the directory, reading the directory only once, so it's
+	// cheaper than a Lookup or Stat per name when listing a
+	// directory.  A name that can't be resolved gets an error in
+	// errs instead, and doesn't stop the rest from being returned;
+	// err is set only if the directory itself can't be read.  This
+	// is a remote-access operation.
+	BatchStat(ctx context.Context, dir Node, names []string) (
+		eis map[string]EntryInfo, errs map[string]error, err error)
 	// Lookup returns the Node and entry info associated with a
 	// given name in a directory, if the logged-in user has read
 	// permissions to the top-level folder.  The returned Node is nil
@@ -158,12 +169,23 @@ type KBFSOps interface {
 	// This is a remote-sync operation.
 	CreateFile(ctx context.Context, dir Node, name string, isExec bool, excl Excl) (
 		Node, EntryInfo, error)
+	// CreateFileWithMode is like CreateFile, but gives the new file
+	// the POSIX permission bits in mode, as SetMode would, in the
+	// same revision.  The user-exec bit decides whether the file is
+	// executable.
+	CreateFileWithMode(ctx context.Context, dir Node, name string,
+		mode os.FileMode, excl Excl) (Node, EntryInfo, error)
 	// CreateLink creates a new symlink under the given node, if the
 	// logged-in user has write permission to the top-level folder.
 	// Returns the new entry info for the created symlink.  This
 	// is a remote-sync operation.
 	CreateLink(ctx context.Context, dir Node, fromName string, toPath string) (
 		EntryInfo, error)
+	// Link makes name in dir a new hard link to the given file, if
+	// the logged-in user has write permission to the top-level
+	// folder.  dir must be the directory the file is already in.
+	// This is a remote-sync operation.
+	Link(ctx context.Context, file Node, dir Node, name string) error
 	// RemoveDir removes the subdirectory represented by the given
 	// node, if the logged-in user has write permission to the
 	// top-level folder.  Will return an error if the subdirectory is
@@ -195,6 +217,14 @@ type KBFSOps interface {
 	// that means EOF has been reached. This is a remote-access
 	// operation.
 	Read(ctx context.Context, file Node, dest []byte, off int64) (int64, error)
+	// ReadSlices is like Read, but rather than copying up to size
+	// bytes into a buffer, it returns them as a list of slices, in
+	// order, that may share memory with cached blocks.  The caller
+	// must not modify the slices, but may keep them for as long as
+	// it likes.  An empty list means EOF has been reached.  This is
+	// a remote-access operation.
+	ReadSlices(ctx context.Context, file Node, off, size int64) (
+		[][]byte, error)
 	// Write modifies the file at the given node, by writing the given
 	// buffer at the given offset within the file, if the logged-in
 	// user has write permission to the top-level folder.  It
@@ -213,6 +243,28 @@ type KBFSOps interface {
 	// on whether or not the necessary blocks have been locally
 	// cached.  This is a remote-access operation.
 	Truncate(ctx context.Context, file Node, size uint64) error
+	// Allocate preallocates the length bytes at off in the file at
+	// the given node, extending the file to cover them unless mode
+	// includes AllocateKeepSize, or, if mode includes
+	// AllocatePunchHole, zeroes them and frees any blocks that only
+	// held them, as fallocate(2) does.  Preallocating fails if the
+	// user's quota, or the journals' local disk budget, has no room
+	// for the range.  The changes are synced like writes.  This is a
+	// remote-access operation.
+	Allocate(ctx context.Context, file Node, off, length uint64,
+		mode AllocateMode) error
+	// GetDataRanges returns the ranges of the file at the given node
+	// that hold data, in order.  The rest of the file, up to its
+	// size, is made of holes left by extending the file, which read
+	// as zeroes and take up no block storage.  This is a
+	// remote-access operation.
+	GetDataRanges(ctx context.Context, file Node) ([]DataRange, error)
+	// GetAllocatedSize returns about how many bytes of the file at
+	// the given node are backed by blocks, leaving out its holes.
+	// Unlike GetDataRanges it never fetches the file's child blocks,
+	// so it's cheap enough to call on every stat.  It can overstate
+	// the data by the padding of uncached blocks.
+	GetAllocatedSize(ctx context.Context, file Node) (uint64, error)
 	// SetEx turns on or off the executable bit on the file
 	// represented by a given node, if the logged-in user has write
 	// permissions to the top-level folder.  This is a remote-sync
@@ -223,29 +275,169 @@ type KBFSOps interface {
 	// the top-level folder.  If mtime is nil, it is a noop.  This is
 	// a remote-sync operation.
 	SetMtime(ctx context.Context, file Node, mtime *time.Time) error
+	// SetMode sets the POSIX permission bits of the file or
+	// directory represented by the given node, including the
+	// setuid, setgid and sticky bits.  For a file, the user-exec
+	// bit also sets the executable bit, as with SetEx.  It is a
+	// noop for symlinks and the TLF root.  This is a remote-sync
+	// operation.
+	SetMode(ctx context.Context, node Node, mode os.FileMode) error
+	// SetOwner records uid and gid as ownership hints for the file
+	// or directory represented by the given node; either may be -1
+	// to leave it as is.  The hints are recorded as the logged-in
+	// user's, and replace any other user's hints.  They aren't
+	// enforced, see EntryInfo.PosixOwner.  It is a noop for the TLF
+	// root.  This is a remote-sync operation.
+	SetOwner(ctx context.Context, node Node, uid, gid int) error
+	// SetXattr sets the named extended attribute of the file or
+	// directory represented by the given node, creating it if
+	// necessary.  This is a remote-sync operation.
+	SetXattr(ctx context.Context, node Node, name string, value []byte) error
+	// GetXattr returns the value of the named extended attribute
+	// of the file or directory represented by the given node, or
+	// a NoSuchXattrError if there isn't one.
+	GetXattr(ctx context.Context, node Node, name string) ([]byte, error)
+	// ListXattr returns the sorted names of all the extended
+	// attributes of the file or directory represented by the given
+	// node.
+	ListXattr(ctx context.Context, node Node) ([]string, error)
+	// RemoveXattr removes the named extended attribute of the file
+	// or directory represented by the given node.  This is a
+	// remote-sync operation.
+	RemoveXattr(ctx context.Context, node Node, name string) error
+	// FileSyncState returns how far the writes to the file
+	// represented by the given node have made it towards the KBFS
+	// servers.  It's also the value of the SyncStateXattrName
+	// extended attribute.
+	FileSyncState(ctx context.Context, file Node) (SyncState, error)
 	// Sync flushes all outstanding writes and truncates for the given
 	// file to the KBFS servers, if the logged-in user has write
 	// permissions to the top-level folder.  If done through a file
 	// system interface, this may include modifications done via
 	// multiple file handles.  This is a remote-sync operation.
+	//
+	// If journaling is enabled, Sync returns once the writes are in
+	// the local journal, unless the TLF's sync durability was set
+	// to WriteDurabilityServer with SetSyncDurability.
 	Sync(ctx context.Context, file Node) error
+	// SyncWithDurability is like Sync, except it uses the given
+	// durability level instead of the TLF's.  With
+	// WriteDurabilityServer, it also flushes the TLF's journal, so
+	// that it only returns once the file's writes are on the block
+	// server and their MD revision was accepted by the MD server.
+	SyncWithDurability(ctx context.Context, file Node,
+		durability WriteDurability) error
+	// SetSyncDurability sets the durability level that Sync uses
+	// for every file in the given folder-branch.  It's
+	// WriteDurabilityLocal until set otherwise.
+	SetSyncDurability(ctx context.Context, folderBranch FolderBranch,
+		durability WriteDurability) error
 	// FolderStatus returns the status of a particular folder/branch, along
 	// with a channel that will be closed when the status has been
 	// updated (to eliminate the need for polling this method).
 	FolderStatus(ctx context.Context, folderBranch FolderBranch) (
 		FolderBranchStatus, <-chan StatusUpdate, error)
+	// GetConflictStatus returns whether the given folder branch
+	// has unresolved local changes, and the conflict files that
+	// conflict resolution has created in it.
+	GetConflictStatus(ctx context.Context, folderBranch FolderBranch) (
+		ConflictStatus, error)
 	// Status returns the status of KBFS, along with a channel that will be
 	// closed when the status has been updated (to eliminate the need for
 	// polling this method). KBFSStatus can be non-empty even if there is an
 	// error.
 	Status(ctx context.Context) (
 		KBFSStatus, <-chan StatusUpdate, error)
+	// SlowOpReports returns the diagnostics dumped for the most
+	// recent calls that ran longer than Config.SlowOpThreshold(),
+	// oldest first.
+	SlowOpReports() []SlowOpReport
+	// Health returns a summary of everything that may keep KBFS
+	// from working right now: server connectivity, journals,
+	// rekeys, conflicts, disk caches and recent errors.
+	Health(ctx context.Context) (KBFSHealth, error)
 	// UnstageForTesting clears out this device's staged state, if
 	// any, and fast-forwards to the current head of this
 	// folder-branch.
 	UnstageForTesting(ctx context.Context, folderBranch FolderBranch) error
+	// SetManualConflictResolution sets whether conflicts in the
+	// given folder-branch are left unresolved, with this device on
+	// its unmerged branch, until one of the Resolve* methods below
+	// is called.  Turning it off resolves any held conflict
+	// automatically, as usual.  The setting is kept across
+	// restarts if the Config persists settings for individual TLFs.
+	SetManualConflictResolution(ctx context.Context,
+		folderBranch FolderBranch, manual bool) error
+	// ResolveMerged resolves a held conflict the same way automatic
+	// conflict resolution would have, keeping both sides of any
+	// conflicting entry.  If no conflict is held but this device
+	// is still on an unmerged branch, e.g. because automatic
+	// resolution failed, it forces a fresh resolution attempt.
+	ResolveMerged(ctx context.Context, folderBranch FolderBranch) error
+	// ResolveKeepLocal resolves a held conflict like ResolveMerged,
+	// except that this device's version of every conflicting file
+	// replaces the merged one, rather than sitting beside it, in
+	// the same merged revision.  Conflicting directories are still
+	// merged, and kept on both sides.
+	ResolveKeepLocal(ctx context.Context, folderBranch FolderBranch) error
+	// ResolveKeepRemote resolves a held conflict by throwing away
+	// this device's unmerged changes, like UnstageForTesting.
+	ResolveKeepRemote(ctx context.Context, folderBranch FolderBranch) error
+	// PreviewConflictResolution plans conflict resolution for the
+	// given folder-branch, as it would run right now, and returns
+	// what it would do without changing anything.
+	PreviewConflictResolution(ctx context.Context,
+		folderBranch FolderBranch) (ConflictPreview, error)
+	// PauseWrites makes every subsequent mutating operation on the
+	// given folder-branch fail with a WritesPausedError, until
+	// ResumeWrites is called.  Reads, and flushes of anything
+	// already in the journal, still proceed.
+	PauseWrites(ctx context.Context, folderBranch FolderBranch) error
+	// ResumeWrites undoes a previous PauseWrites.
+	ResumeWrites(ctx context.Context, folderBranch FolderBranch) error
+	// WriteFence returns a fence that is released once every write
+	// issued to the given folder-branch before this call is durable
+	// at the given level.  External processes can use it to order
+	// their own commits after the writes they depend on.
+	WriteFence(ctx context.Context, folderBranch FolderBranch,
+		durability WriteDurability) (*WriteFence, error)
+	// LockRange takes, or changes, an advisory byte-range lock on
+	// the given file.  If someone else holds a conflicting lock, it
+	// returns a RangeLockConflictError without waiting.  The lock
+	// is held until it's released with UnlockRange, or until this
+	// device stops renewing it.
+	//
+	// Locks are only coordinated with other devices if the MD
+	// server supports it, which the remote one doesn't yet; with
+	// it, locks only hold against other users of this process.
+	LockRange(ctx context.Context, file Node, lock RangeLock) error
+	// UnlockRange releases the parts of the locks held by
+	// lock.Owner on the given file that overlap lock's range.
+	UnlockRange(ctx context.Context, file Node, lock RangeLock) error
+	// GetRangeLockConflict returns a lock that would stop the
+	// given lock from being taken on the given file, or nil if
+	// it could be taken right now.
+	GetRangeLockConflict(ctx context.Context, file Node,
+		lock RangeLock) (*RangeLock, error)
+	// AuditTLF fetches and verifies every block reachable from
+	// the current merged head of the given TLF, and reports any
+	// that are missing, corrupt, or referenced more than once.
+	AuditTLF(ctx context.Context, handle *TlfHandle) (TLFAuditReport, error)
+	// FsckTLF does everything AuditTLF does, and also checks the
+	// merged MD chain up to the head, the head's disk usage, and
+	// the TLF's journal if it has one.  It changes nothing unless
+	// repair is true, in which case it restores data missing from
+	// the journal from the server where it can.
+	FsckTLF(ctx context.Context, handle *TlfHandle, repair bool) (
+		TLFFsckReport, error)
 	// Rekey rekeys this folder.
 	Rekey(ctx context.Context, id TlfID) error
+	// RotateKeyGeneration adds a new key generation to this
+	// private folder, even if no devices have been revoked.  New
+	// blocks are encrypted with the new key, while existing blocks
+	// stay on their old generations; use StartReencryptTLF to
+	// rewrite those.
+	RotateKeyGeneration(ctx context.Context, id TlfID) error
 	// SyncFromServerForTesting blocks until the local client has
 	// contacted the server and guaranteed that all known updates
 	// for the given top-level folder have been applied locally
@@ -267,9 +459,79 @@ type KBFSOps interface {
 	// for the folder.
 	GetEditHistory(ctx context.Context, folderBranch FolderBranch) (
 		edits TlfWriterEdits, err error)
+	// GetFileHistory returns the versions of the given file's
+	// contents, newest first, by walking back through the merged
+	// history of its folder.  At most limit versions are returned,
+	// unless limit is 0.  Like GetUpdateHistory, this can be
+	// expensive, and doesn't include unmerged changes or
+	// outstanding writes from the local device.
+	GetFileHistory(ctx context.Context, file Node, limit int) (
+		[]FileVersion, error)
+	// OpenFileAtRevision returns a reader for the version of the
+	// given file that was current as of the given revision.  The
+	// caller must Close it.
+	OpenFileAtRevision(ctx context.Context, file Node,
+		rev MetadataRevision) (*FileVersionReader, error)
+	// BeginReadSnapshot pins the current MD revision of the given
+	// folder-branch, and returns a snapshot through which reads all
+	// see that revision, even while updates continue to be applied
+	// to the live view.  The caller must Close the snapshot.
+	BeginReadSnapshot(ctx context.Context, folderBranch FolderBranch) (
+		*ReadSnapshot, error)
+	// BeginReadSnapshotAtRevision is like BeginReadSnapshot, but
+	// for the given older merged revision.  Reads through the
+	// snapshot fail if that revision's blocks have already been
+	// reclaimed.
+	BeginReadSnapshotAtRevision(ctx context.Context,
+		folderBranch FolderBranch, rev MetadataRevision) (
+		*ReadSnapshot, error)
+	// GetRevisionAtTime returns the last merged revision of the
+	// given folder-branch that the MD server applied at or before
+	// the given time, going by the server's (untrusted) clock.
+	GetRevisionAtTime(ctx context.Context, folderBranch FolderBranch,
+		t time.Time) (MetadataRevision, error)
+	// SetTrashRetention turns on trash mode for the TLF with the
+	// given root node, where removed entries are kept for the given
+	// duration before being deleted for good, or changes how long
+	// they're kept if it's already on.  A duration of 0 turns trash
+	// mode off, deleting everything in the trash.  See TrashDirName.
+	SetTrashRetention(ctx context.Context, root Node,
+		retention time.Duration) error
+	// ListTrash returns the entries in the trash of the TLF with the
+	// given root node, most recently removed first.
+	ListTrash(ctx context.Context, root Node) ([]TrashEntry, error)
+	// Undelete moves the trash entry with the given ID back to where
+	// it was removed from, in the TLF with the given root node,
+	// recreating any missing directories along the way.
+	Undelete(ctx context.Context, root Node, id string) error
+	// SetWriterSharding turns writer sharding on or off for the
+	// given directory.  While it's on, each device creates its new
+	// entries in the directory in a shard of its own, so that many
+	// devices can add entries without conflicting.  Turning it off
+	// moves the entries of all the shards back into the directory.
+	// See ShardsDirName.
+	SetWriterSharding(ctx context.Context, dir Node, sharded bool) error
 
 	// GetNodeMetadata gets metadata associated with a Node.
 	GetNodeMetadata(ctx context.Context, node Node) (NodeMetadata, error)
+	// GetSubtreeUsage walks the blocks under the given node, a
+	// few at a time, and returns how much space it and everything
+	// under it takes up, broken down by its direct children.
+	GetSubtreeUsage(ctx context.Context, node Node) (SubtreeUsage, error)
+	// SetSyncSubscription subscribes to, or unsubscribes from, the
+	// given node of a TLF on the master branch.  Every block under
+	// a subscribed node, as of the TLF's head, is kept on local
+	// disk in the background, so that it stays readable offline.
+	SetSyncSubscription(ctx context.Context, node Node, subscribed bool) error
+	// GetSyncStatus returns how much of the given folder-branch's
+	// subscribed paths is on local disk, or a
+	// NotSyncSubscribedError if none are subscribed to.
+	GetSyncStatus(ctx context.Context, folderBranch FolderBranch) (
+		TLFSyncStatus, error)
+	// GetUserQuotaInfo returns the current user's quota usage and
+	// limit, as recently reported by the block server.  It may be
+	// a few seconds out of date.
+	GetUserQuotaInfo(ctx context.Context) (*UserQuotaInfo, error)
 
 	// Shutdown is called to clean up any resources associated with
 	// this KBFSOps instance.
@@ -518,6 +780,14 @@ type KeyManager interface {
 	GetTLFCryptKeyOfAllGenerations(ctx context.Context, kmd KeyMetadata) (
 		keys []TLFCryptKey, err error)
 
+	// GetExtraMetadata returns the key bundles referenced by the
+	// given MD, if its version stores them outside of the MD
+	// itself.  The KeyBundleCache is consulted first, and the MD
+	// server only for bundles that aren't cached.  It returns nil
+	// for public TLFs and for MD versions with inline key bundles.
+	GetExtraMetadata(ctx context.Context, md BareRootMetadata) (
+		ExtraMetadata, error)
+
 	// Rekey checks the given MD object, if it is a private TLF,
 	// against the current set of device keys for all valid
 	// readers and writers.  If there are any new devices, it
@@ -537,6 +807,14 @@ type KeyManager interface {
 	// If promptPaper is set, prompts for any unlocked paper keys.
 	// promptPaper shouldn't be set if md is for a public TLF.
 	Rekey(ctx context.Context, md *RootMetadata, promptPaper bool) (bool, *TLFCryptKey, error)
+
+	// RekeyWithNewKeyGeneration is like Rekey, but always adds a
+	// new key generation to a private TLF, even if no devices
+	// have been revoked.  Blocks written after that use the new
+	// key; existing blocks keep their old key generation until
+	// they are rewritten.  Only writers may do this.
+	RekeyWithNewKeyGeneration(ctx context.Context, md *RootMetadata) (
+		bool, *TLFCryptKey, error)
 }
 
 // Reporter exports events (asynchronously) to any number of sinks
@@ -550,6 +828,10 @@ type Reporter interface {
 	Notify(ctx context.Context, notification *keybase1.FSNotification)
 	// NotifySyncStatus sends the given path sync status to any sink.
 	NotifySyncStatus(ctx context.Context, status *keybase1.FSPathSyncStatus)
+	// ReportEvent sends the given event to any sink.  It's for the
+	// events that aren't errors, notifications or sync statuses,
+	// like journal stalls and conflict resolution outcomes.
+	ReportEvent(ctx context.Context, event ReportEvent)
 	// Shutdown frees any resources allocated by a Reporter.
 	Shutdown()
 }
@@ -765,6 +1047,10 @@ type cryptoPure interface {
 	// Verify verifies that sig matches msg being signed with the
 	// private key that corresponds to verifyingKey.
 	Verify(msg []byte, sigInfo SignatureInfo) error
+	// VerifyBatch verifies that each sigInfos[i] matches msgs[i],
+	// as with Verify.  It returns an error for the first mismatch,
+	// or if the slices have different lengths.
+	VerifyBatch(msgs [][]byte, sigInfos []SignatureInfo) error
 
 	// EncryptTLFCryptKeyClientHalf encrypts a TLFCryptKeyClientHalf
 	// using both a TLF's ephemeral private key and a device pubkey.
@@ -777,10 +1063,13 @@ type cryptoPure interface {
 	// DecryptPrivateMetadata decrypts a PrivateMetadata object.
 	DecryptPrivateMetadata(encryptedPMD EncryptedPrivateMetadata, key TLFCryptKey) (*PrivateMetadata, error)
 
-	// EncryptBlocks encrypts a block. plainSize is the size of the encoded
-	// block; EncryptBlock() must guarantee that plainSize <=
+	// EncryptBlocks encrypts a block, first compressing it with the
+	// given algorithm if that makes the encrypted block smaller.
+	// plainSize is the size of the encoded block; unless the block
+	// was compressed, EncryptBlock() must guarantee that plainSize <=
 	// len(encryptedBlock).
-	EncryptBlock(block Block, key BlockCryptKey) (
+	EncryptBlock(block Block, key BlockCryptKey,
+		compression BlockCompressionType) (
 		plainSize int, encryptedBlock EncryptedBlock, err error)
 
 	// DecryptBlock decrypts a block. Similar to EncryptBlock(),
@@ -813,6 +1102,11 @@ type cryptoSigner interface {
 	// Sign signs the msg with the current device's private key and output
 	// the full serialized NaclSigInfo.
 	SignToString(ctx context.Context, msg []byte) (signature string, err error)
+	// SignBatch signs each of the given msgs with the current
+	// device's private key, in order.  Either all msgs are signed,
+	// or an error is returned.
+	SignBatch(ctx context.Context, msgs [][]byte) (
+		sigInfos []SignatureInfo, err error)
 }
 
 // Crypto signs, verifies, encrypts, and decrypts stuff.
@@ -1039,6 +1333,26 @@ type MDServer interface {
 	// released.
 	TruncateUnlock(ctx context.Context, id TlfID) (bool, error)
 
+	// LockRange takes, or changes, an advisory byte-range lock on
+	// the file at the given path within the TLF, on behalf of
+	// this device.  The device's locks on the file are released
+	// automatically if they aren't renewed (by taking them again)
+	// within lease.  It returns a RangeLockConflictError if
+	// another holder has a conflicting lock, and a
+	// RangeLocksUnsupportedError if the server can't coordinate
+	// byte-range locks.
+	LockRange(ctx context.Context, id TlfID, file string, lock RangeLock,
+		lease time.Duration) error
+	// UnlockRange releases the parts of this device's locks held
+	// by lock.Owner on the given file that overlap lock's range.
+	UnlockRange(ctx context.Context, id TlfID, file string,
+		lock RangeLock) error
+	// GetRangeLockConflict returns a lock held by someone else
+	// that would stop the given lock from being taken, or nil if
+	// there isn't one.
+	GetRangeLockConflict(ctx context.Context, id TlfID, file string,
+		lock RangeLock) (*RangeLock, error)
+
 	// DisableRekeyUpdatesForTesting disables processing rekey updates
 	// received from the mdserver while testing.
 	DisableRekeyUpdatesForTesting()
@@ -1062,6 +1376,13 @@ type MDServer interface {
 	// corresponding event.  If the returned bool is false, then we
 	// don't have a current estimate for the offset.
 	OffsetFromServerTime() (time.Duration, bool)
+
+	// GetKeyBundles returns the key bundles for the given key
+	// bundle IDs, for TLFs using MD versions that store key
+	// bundles separately from the MD.
+	GetKeyBundles(ctx context.Context, tlfID TlfID,
+		wkbID TLFWriterKeyBundleID, rkbID TLFReaderKeyBundleID) (
+		*TLFWriterKeyBundleV3, *TLFReaderKeyBundleV3, error)
 }
 
 type mdServerLocal interface {
@@ -1187,6 +1508,16 @@ type BlockSplitter interface {
 	// ShouldEmbedBlockChanges decides whether we should keep the
 	// block changes embedded in the MD or not.
 	ShouldEmbedBlockChanges(bc *BlockChanges) bool
+
+	// MaxDirEntriesPerBlock returns how many entries a directory
+	// block may hold, beyond which the directory is sharded across
+	// several blocks.
+	MaxDirEntriesPerBlock() int
+
+	// MaxPtrsPerBlock returns how many indirect pointers a file
+	// block may hold, beyond which another level of indirect
+	// blocks is added to the file.
+	MaxPtrsPerBlock() int
 }
 
 // KeyServer fetches/writes server-side key halves from/to the key server.
@@ -1245,6 +1576,15 @@ type Observer interface {
 	TlfHandleChange(ctx context.Context, newHandle *TlfHandle)
 }
 
+// ConflictObserver is an Observer that also wants to hear about
+// conflict resolution in the folders it's registered for.
+type ConflictObserver interface {
+	Observer
+	// ConflictResolutionEvent announces a step of conflict
+	// resolution.
+	ConflictResolutionEvent(ctx context.Context, event ConflictEvent)
+}
+
 // Notifier notifies registrants of directory changes
 type Notifier interface {
 	// RegisterForChanges declares that the given Observer wants to
@@ -1258,7 +1598,11 @@ type Notifier interface {
 
 // Clock is an interface for getting the current time
 type Clock interface {
-	// Now returns the current time.
+	// Now returns the current time.  To stay correct across
+	// suspends and wall clock changes, elapsed times should be
+	// measured with Sub on two results of Now, which uses the
+	// monotonic clock reading if the Clock provides one, and never
+	// by comparing Unix times.
 	Now() time.Time
 }
 
@@ -1268,6 +1612,34 @@ type ConflictRenamer interface {
 	ConflictRename(op op, original string) string
 }
 
+// ConflictDirRenamer is a ConflictRenamer that can also collect the
+// conflicted copies into one directory.
+type ConflictDirRenamer interface {
+	ConflictRenamer
+	// ConflictDir returns the name of the directory, at the root of
+	// the TLF, that conflicted copies are moved into once a
+	// resolution has made them, or "" to leave each copy beside the
+	// original.  ConflictRename never includes this directory in its
+	// names.
+	ConflictDir() string
+}
+
+// ConflictFileMerger merges the contents of a file that was written
+// on both the merged and unmerged branches of a TLF.
+type ConflictFileMerger interface {
+	// MergeFile returns the merged contents of the file with the
+	// given name, given its contents as of the last revision both
+	// branches had in common (base), on the local unmerged branch
+	// (local), and on the merged branch (remote).  If it returns
+	// an error, conflict resolution keeps the local version as a
+	// separate conflict file, as usual.  The merge is part of the
+	// resolution, so it's only used for files whose local version
+	// and merged contents each fit in a single block; larger files
+	// get conflict files.
+	MergeFile(ctx context.Context, name string,
+		base, local, remote io.Reader) ([]byte, error)
+}
+
 // Config collects all the singleton instance instantiations needed to
 // run KBFS in one place.  The methods below are self-explanatory and
 // do not require comments.
@@ -1284,6 +1656,10 @@ type Config interface {
 	SetMDCache(MDCache)
 	KeyCache() KeyCache
 	SetKeyCache(KeyCache)
+	KeyBundleCache() KeyBundleCache
+	SetKeyBundleCache(KeyBundleCache)
+	CRJournal() CRJournal
+	SetCRJournal(CRJournal)
 	BlockCache() BlockCache
 	SetBlockCache(BlockCache)
 	DirtyBlockCache() DirtyBlockCache
@@ -1308,12 +1684,61 @@ type Config interface {
 	SetKeybaseService(KeybaseService)
 	BlockSplitter() BlockSplitter
 	SetBlockSplitter(BlockSplitter)
+	// BlockSplitterForTLF returns the BlockSplitter for the files in
+	// the given TLF, which is BlockSplitter() unless a way of
+	// chunking them was set for that TLF with SetBlockChunkingForTLF.
+	BlockSplitterForTLF(TlfID) BlockSplitter
+	// SetBlockChunkingForTLF sets how the files in the given TLF are
+	// split into blocks from now on, and persists it if the Config
+	// persists settings for individual TLFs.
+	SetBlockChunkingForTLF(TlfID, BlockChunking) error
+	// BlockCompression returns the algorithm used to compress new
+	// blocks, where that saves space.
+	BlockCompression() BlockCompressionType
+	SetBlockCompression(BlockCompressionType)
+	// BlockCompressionForTLF returns the compression algorithm for
+	// new blocks in the given TLF, which is BlockCompression() unless
+	// one was set for that TLF with SetBlockCompressionForTLF.
+	BlockCompressionForTLF(TlfID) BlockCompressionType
+	// SetBlockCompressionForTLF sets the compression algorithm for
+	// new blocks in the given TLF, and persists it if the Config
+	// persists settings for individual TLFs.
+	SetBlockCompressionForTLF(TlfID, BlockCompressionType) error
+	// ManualConflictResolutionForTLF returns whether conflicts in
+	// the given TLF are held for the user to resolve, as set by
+	// SetManualConflictResolutionForTLF.
+	ManualConflictResolutionForTLF(TlfID) bool
+	// SetManualConflictResolutionForTLF sets whether conflicts in
+	// the given TLF are held for the user to resolve, and persists
+	// it if the Config persists settings for individual TLFs.
+	SetManualConflictResolutionForTLF(TlfID, bool) error
+	// SyncDurabilityForTLF returns how durable Sync makes writes
+	// to the given TLF, as set by SetSyncDurabilityForTLF.
+	SyncDurabilityForTLF(TlfID) WriteDurability
+	// SetSyncDurabilityForTLF sets how durable Sync makes writes
+	// to the given TLF, and persists it if the Config persists
+	// settings for individual TLFs.
+	SetSyncDurabilityForTLF(TlfID, WriteDurability) error
 	Notifier() Notifier
 	SetNotifier(Notifier)
 	Clock() Clock
 	SetClock(Clock)
+	ClockJumpDetector() *ClockJumpDetector
+	// CryptoCapabilities returns what's known about how fast this
+	// machine does crypto, and how KBFS is tuned for it.  See
+	// ProbeCryptoCapabilities.
+	CryptoCapabilities() CryptoCapabilities
+	SetCryptoCapabilities(CryptoCapabilities)
+	// BlockTransferMeter measures the transfers made to and from
+	// the block server, and sets how many of them run at once.
+	BlockTransferMeter() *BlockTransferMeter
+	// UsageMeter counts the bytes and RPCs each TLF costs on the
+	// network, by day.
+	UsageMeter() *UsageMeter
 	ConflictRenamer() ConflictRenamer
 	SetConflictRenamer(ConflictRenamer)
+	ConflictFileMerger() ConflictFileMerger
+	SetConflictFileMerger(ConflictFileMerger)
 	MetadataVersion() MetadataVer
 	DataVersion() DataVer
 	RekeyQueue() RekeyQueue
@@ -1335,6 +1760,68 @@ type Config interface {
 	// be true except for during some testing.
 	DoBackgroundFlushes() bool
 	SetDoBackgroundFlushes(bool)
+	// BackgroundFlushAge is how long a file must have been dirty
+	// before background flushes sync it.  Zero means every dirty
+	// file is synced on each background flush.
+	BackgroundFlushAge() time.Duration
+	// SetBackgroundFlushAge sets BackgroundFlushAge.
+	SetBackgroundFlushAge(time.Duration)
+	// MDCoalesceWindow is how long after a directory op this
+	// device may fold further directory ops on the same folder
+	// into the same MD revision, while it's still in the write
+	// journal.  Zero, the default, gives every op its own
+	// revision.
+	MDCoalesceWindow() time.Duration
+	// SetMDCoalesceWindow sets MDCoalesceWindow.
+	SetMDCoalesceWindow(time.Duration)
+	// MaxReadaheadBlocks is the most child blocks of a file that
+	// are prefetched ahead of a sequential reader.  Zero turns
+	// readahead off.
+	MaxReadaheadBlocks() int
+	// SetMaxReadaheadBlocks sets MaxReadaheadBlocks.
+	SetMaxReadaheadBlocks(int)
+	// SlowOpThreshold is how long a KBFSOps call may run before a
+	// diagnostic of what it's waiting on is dumped to the log, and
+	// kept for KBFSOps.SlowOpReports.  Zero, the default, turns
+	// the watchdog off.
+	SlowOpThreshold() time.Duration
+	// SetSlowOpThreshold sets SlowOpThreshold.
+	SetSlowOpThreshold(time.Duration)
+	// StateCheckPeriod is how often each TLF in use checks its
+	// server-side state with a StateChecker, logging anything it
+	// finds.  Zero, the default, turns the background check off.
+	StateCheckPeriod() time.Duration
+	// SetStateCheckPeriod sets StateCheckPeriod.
+	SetStateCheckPeriod(time.Duration)
+	// DiskLimitFraction is the fraction of the disk space available
+	// to KBFS that its journals and sync cache may take up.  Writes
+	// to journaled TLFs slow down, and then wait for the journals to
+	// flush, as the journals get close to it.  Zero or less turns
+	// the limit off.
+	DiskLimitFraction() float64
+	// SetDiskLimitFraction sets DiskLimitFraction.
+	SetDiskLimitFraction(float64)
+	// Offline says whether KBFS has been put in offline mode with
+	// SetOffline, or is acting as if it were because the network
+	// state is NetworkNone.
+	Offline() bool
+	// SetOffline puts KBFS in or out of offline mode.  While
+	// offline, anything that needs the MD or block server fails
+	// right away with an OfflineUnavailableError, rather than
+	// waiting on the connection: reads are served from the caches
+	// and journals, and writes to TLFs with journaling enabled are
+	// queued in their journals, which start flushing again once
+	// KBFS is back online.  Only servers wrapped in MDServerOffline
+	// and BlockServerOffline, as Init sets them up, honor it.
+	SetOffline(bool)
+	// NetworkState returns the kind of network this device is on,
+	// as last reported with SetNetworkState.
+	NetworkState() NetworkState
+	// SetNetworkState records the kind of network this device is
+	// on.  It's meant to be called by a connectivity notifier, or
+	// by the app embedding KBFS, whenever that changes.  Work
+	// deferred because of the previous state is resumed right away.
+	SetNetworkState(NetworkState)
 	// RekeyWithPromptWaitTime indicates how long to wait, after
 	// setting the rekey bit, before prompting for a paper key.
 	RekeyWithPromptWaitTime() time.Duration
@@ -1374,6 +1861,9 @@ type Config interface {
 	// objects, which is to use the default registry.
 	MetricsRegistry() metrics.Registry
 	SetMetricsRegistry(metrics.Registry)
+	// Tracer may be nil, which means operations aren't traced.
+	Tracer() Tracer
+	SetTracer(Tracer)
 	// TLFValidDuration is the time TLFs are valid before identification needs to be redone.
 	TLFValidDuration() time.Duration
 	// SetTLFValidDuration sets TLFValidDuration.
@@ -1385,15 +1875,35 @@ type Config interface {
 	CheckStateOnShutdown() bool
 }
 
+// Span is one timed step of an operation, such as a KBFSOps call,
+// or a block fetch made on behalf of one.
+type Span interface {
+	// SetTag attaches a key/value pair to the span.
+	SetTag(key string, value interface{})
+	// Finish records that the step is done, with the given
+	// result.  Only the first call has any effect.
+	Finish(err error)
+}
+
+// Tracer makes the Spans that record where the time of an operation
+// goes.  An adapter to a tracing system like OpenTracing can be used
+// as a Tracer, or as a SpanExporter for TracerStandard.
+type Tracer interface {
+	// StartSpan starts a span named name, as a step of the one
+	// given as parent, or as the first span of a new trace if
+	// parent is nil.  ctx is the context of the step.
+	StartSpan(ctx context.Context, name string, parent Span) Span
+}
+
 // NodeCache holds Nodes, and allows libkbfs to update them when
 // things change about the underlying KBFS blocks.  It is probably
 // most useful to instantiate this on a per-folder-branch basis, so
 // that it can create a Path with the correct DirId and Branch name.
 type NodeCache interface {
 	// GetOrCreate either makes a new Node for the given
-	// BlockPointer, or returns an existing one. TODO: If we ever
-	// support hard links, we will have to revisit the "name" and
-	// "parent" parameters here.  name must not be empty. Returns
+	// BlockPointer, or returns an existing one.  A file with several
+	// hard links gets a single Node, named after whichever link it
+	// was first reached through.  name must not be empty. Returns
 	// an error if parent cannot be found.
 	GetOrCreate(ptr BlockPointer, name string, parent Node) (Node, error)
 	// Get returns the Node associated with the given ptr if one
@@ -1417,6 +1927,9 @@ type NodeCache interface {
 	Unlink(ref blockRef, oldPath path)
 	// PathFromNode creates the path up to a given Node.
 	PathFromNode(node Node) path
+	// NumNodes returns how many Nodes are currently cached, i.e.
+	// still referenced by someone.
+	NumNodes() int
 }
 
 // fileBlockDeepCopier fetches a file block, makes a deep copy of it
@@ -1678,14 +2191,40 @@ type MutableBareRootMetadata interface {
 		readers, writers UserDeviceKeyInfoMap, err error)
 }
 
-// KeyBundleCache is an interface to a key bundle cache for use with v3 metadata.
+// KeyBundleCache is an interface to a key bundle cache for use with
+// v3 metadata.  Key bundles are content-addressed by their IDs, so
+// entries never go stale; implementations are free to evict them at
+// any time.  Returned bundles must not be modified by the caller.
 type KeyBundleCache interface {
-	// GetTLFReaderKeyBundle returns the TLFReaderKeyBundleV2 for the given TLFReaderKeyBundleID.
+	// GetTLFReaderKeyBundle returns the TLFReaderKeyBundleV3 for
+	// the given TLFReaderKeyBundleID, or false if it isn't cached.
 	GetTLFReaderKeyBundle(TLFReaderKeyBundleID) (TLFReaderKeyBundleV3, bool)
-	// GetTLFWriterKeyBundle returns the TLFWriterKeyBundleV3 for the given TLFWriterKeyBundleID.
+	// GetTLFWriterKeyBundle returns the TLFWriterKeyBundleV3 for
+	// the given TLFWriterKeyBundleID, or false if it isn't cached.
 	GetTLFWriterKeyBundle(TLFWriterKeyBundleID) (TLFWriterKeyBundleV3, bool)
-	// PutTLFReaderKeyBundle stores the given TLFReaderKeyBundleV2.
-	PutTLFReaderKeyBundle(TLFReaderKeyBundleV3)
-	// PutTLFWriterKeyBundle stores the given TLFWriterKeyBundleV3.
-	PutTLFWriterKeyBundle(TLFWriterKeyBundleV3)
+	// PutTLFReaderKeyBundle stores the given TLFReaderKeyBundleV3
+	// under the given ID.  It returns a KeyBundleIDMismatchError
+	// if the bundle doesn't hash to the ID.
+	PutTLFReaderKeyBundle(TLFReaderKeyBundleID, TLFReaderKeyBundleV3) error
+	// PutTLFWriterKeyBundle stores the given TLFWriterKeyBundleV3
+	// under the given ID.  It returns a KeyBundleIDMismatchError
+	// if the bundle doesn't hash to the ID.
+	PutTLFWriterKeyBundle(TLFWriterKeyBundleID, TLFWriterKeyBundleV3) error
+}
+
+// CRJournal records conflict resolutions that are partway through
+// putting their blocks and MD, so that a client restarted in the
+// middle of one can tell whether the resolution landed, and clean up
+// after it if it didn't.  There is at most one pending resolution
+// per TLF.
+type CRJournal interface {
+	// GetPendingResolution returns the pending resolution for the
+	// given TLF, or false if there isn't one.
+	GetPendingResolution(TlfID) (CRJournalEntry, bool, error)
+	// PutPendingResolution records the given resolution as
+	// pending, replacing any earlier one for the same TLF.
+	PutPendingResolution(CRJournalEntry) error
+	// ClearPendingResolution forgets the pending resolution for
+	// the given TLF, if any.
+	ClearPendingResolution(TlfID) error
 }
@@ -14,8 +14,7 @@ var _ BlockCache = journalBlockCache{}
 // CheckForKnownPtr implements BlockCache.
 func (j journalBlockCache) CheckForKnownPtr(
 	tlfID TlfID, block *FileBlock) (BlockPointer, error) {
-	_, ok := j.jServer.getTLFJournal(tlfID)
-	if !ok {
+	if !j.jServer.hasTLFJournal(tlfID) {
 		return j.BlockCache.CheckForKnownPtr(tlfID, block)
 	}
 
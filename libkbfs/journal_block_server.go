@@ -17,7 +17,7 @@ var _ BlockServer = journalBlockServer{}
 func (j journalBlockServer) Get(
 	ctx context.Context, tlfID TlfID, id BlockID, context BlockContext) (
 	data []byte, serverHalf BlockCryptKeyServerHalf, err error) {
-	if tlfJournal, ok := j.jServer.getTLFJournal(tlfID); ok {
+	if tlfJournal, ok := j.jServer.getOpenTLFJournal(tlfID); ok {
 		defer func() {
 			err = translateToBlockServerError(err)
 		}()
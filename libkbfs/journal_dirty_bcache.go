@@ -61,6 +61,12 @@ func (j journalDirtyBlockCache) IsAnyDirty(tlfID TlfID) bool {
 func (j journalDirtyBlockCache) RequestPermissionToDirty(ctx context.Context,
 	tlfID TlfID, estimatedDirtyBytes int64) (DirtyPermChan, error) {
 	if j.jServer.hasTLFJournal(tlfID) {
+		// Slow writes down as the journals fill up the disk,
+		// to give them time to flush.
+		err := getDiskLimiter(j.jServer.config).delayWrite(ctx)
+		if err != nil {
+			return nil, err
+		}
 		return j.journalCache.RequestPermissionToDirty(ctx, tlfID,
 			estimatedDirtyBytes)
 	}
@@ -42,7 +42,7 @@ func (j journalMDOps) getHeadFromJournal(
 	ctx context.Context, id TlfID, bid BranchID, mStatus MergeStatus,
 	handle *TlfHandle) (
 	ImmutableRootMetadata, error) {
-	tlfJournal, ok := j.jServer.getTLFJournal(id)
+	tlfJournal, ok := j.jServer.getOpenTLFJournal(id)
 	if !ok {
 		return ImmutableRootMetadata{}, nil
 	}
@@ -125,7 +125,7 @@ func (j journalMDOps) getRangeFromJournal(
 	ctx context.Context, id TlfID, bid BranchID, mStatus MergeStatus,
 	start, stop MetadataRevision) (
 	[]ImmutableRootMetadata, error) {
-	tlfJournal, ok := j.jServer.getTLFJournal(id)
+	tlfJournal, ok := j.jServer.getOpenTLFJournal(id)
 	if !ok {
 		return nil, nil
 	}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sync"
 
 	"github.com/keybase/client/go/logger"
@@ -69,7 +70,12 @@ type JournalServer struct {
 
 	lock        sync.RWMutex
 	tlfJournals map[TlfID]*tlfJournal
-	dirtyOps    uint
+	// lazyJournals holds the existing journals that were empty at
+	// startup and haven't been needed since.  Each is opened, and
+	// moved to tlfJournals, the first time something might write
+	// to it.
+	lazyJournals map[TlfID]TLFJournalBackgroundWorkStatus
+	dirtyOps     uint
 }
 
 func makeJournalServer(
@@ -89,11 +95,53 @@ func makeJournalServer(
 		onBranchChange:          onBranchChange,
 		onMDFlush:               onMDFlush,
 		tlfJournals:             make(map[TlfID]*tlfJournal),
+		lazyJournals:            make(map[TlfID]TLFJournalBackgroundWorkStatus),
 	}
 	return &jServer
 }
 
+// getTLFJournal returns the journal for the given TLF, opening it
+// first if it hasn't been yet.
 func (j *JournalServer) getTLFJournal(tlfID TlfID) (*tlfJournal, bool) {
+	if tlfJournal, ok := j.getOpenTLFJournal(tlfID); ok {
+		return tlfJournal, true
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.getTLFJournalLocked(context.Background(), tlfID)
+}
+
+func (j *JournalServer) getTLFJournalLocked(
+	ctx context.Context, tlfID TlfID) (*tlfJournal, bool) {
+	if tlfJournal, ok := j.tlfJournals[tlfID]; ok {
+		return tlfJournal, true
+	}
+	bws, ok := j.lazyJournals[tlfID]
+	if !ok {
+		return nil, false
+	}
+
+	tlfJournal, err := makeTLFJournal(ctx, j.dir, tlfID,
+		tlfJournalConfigAdapter{j.config}, j.delegateBlockServer,
+		bws, nil, j.onBranchChange, j.onMDFlush)
+	if err != nil {
+		// Leave it to be retried next time; until then, the TLF
+		// goes straight to the server, just like when the journal
+		// couldn't be enabled at startup.
+		j.log.CWarningf(ctx, "Error when opening journal for %s: %v",
+			tlfID, err)
+		return nil, false
+	}
+	delete(j.lazyJournals, tlfID)
+	j.tlfJournals[tlfID] = tlfJournal
+	return tlfJournal, true
+}
+
+// getOpenTLFJournal returns the journal for the given TLF only if
+// it's already open.  It's for reads, which have nothing to find in
+// a journal that's still empty.
+func (j *JournalServer) getOpenTLFJournal(tlfID TlfID) (*tlfJournal, bool) {
 	j.lock.RLock()
 	defer j.lock.RUnlock()
 	tlfJournal, ok := j.tlfJournals[tlfID]
@@ -103,10 +151,30 @@ func (j *JournalServer) getTLFJournal(tlfID TlfID) (*tlfJournal, bool) {
 func (j *JournalServer) hasTLFJournal(tlfID TlfID) bool {
 	j.lock.RLock()
 	defer j.lock.RUnlock()
-	_, ok := j.tlfJournals[tlfID]
+	if _, ok := j.tlfJournals[tlfID]; ok {
+		return true
+	}
+	_, ok := j.lazyJournals[tlfID]
 	return ok
 }
 
+// hasUnflushedEntries returns true if the journal for the given TLF
+// has block or MD entries that haven't been flushed to the server.
+func (j *JournalServer) hasUnflushedEntries(tlfID TlfID) bool {
+	tlfJournal, ok := j.getOpenTLFJournal(tlfID)
+	if !ok {
+		return false
+	}
+	blockEntryCount, mdEntryCount, err := tlfJournal.getJournalEntryCounts()
+	if err == errTLFJournalDisabled {
+		// Only empty journals can be disabled.
+		return false
+	} else if err != nil {
+		return true
+	}
+	return blockEntryCount > 0 || mdEntryCount > 0
+}
+
 // EnableExistingJournals turns on the write journal for all TLFs with
 // an existing journal. This must be the first thing done to a
 // JournalServer. Any returned error is fatal, and means that the
@@ -141,6 +209,21 @@ func (j *JournalServer) EnableExistingJournals(
 			continue
 		}
 
+		// Empty journals don't need flushing, so don't open
+		// them until they're used.  Most TLFs with a journal
+		// have been written to at some point, but have nothing
+		// left to flush.
+		empty, err := isTLFJournalEmpty(
+			j.config.Codec(), filepath.Join(j.dir, name))
+		if err == nil && empty {
+			j.lock.Lock()
+			if _, ok := j.tlfJournals[tlfID]; !ok {
+				j.lazyJournals[tlfID] = bws
+			}
+			j.lock.Unlock()
+			continue
+		}
+
 		err = j.Enable(ctx, tlfID, bws)
 		if err != nil {
 			// Don't treat per-TLF errors as fatal.
@@ -173,6 +256,10 @@ func (j *JournalServer) Enable(
 	if tlfJournal, ok := j.tlfJournals[tlfID]; ok {
 		return tlfJournal.enable()
 	}
+	if _, ok := j.lazyJournals[tlfID]; ok {
+		// Already enabled, and there's nothing in it yet.
+		return nil
+	}
 
 	if j.dirtyOps > 0 {
 		return fmt.Errorf("Can't enable journal for %s while there "+
@@ -241,6 +328,7 @@ func (j *JournalServer) ResumeBackgroundWork(ctx context.Context, tlfID TlfID) {
 func (j *JournalServer) Flush(ctx context.Context, tlfID TlfID) (err error) {
 	j.log.CDebugf(ctx, "Flushing journal for %s", tlfID)
 	if tlfJournal, ok := j.getTLFJournal(tlfID); ok {
+		tlfJournal.closeCoalesceWindow()
 		return tlfJournal.flush(ctx)
 	}
 
@@ -276,7 +364,7 @@ func (j *JournalServer) Disable(ctx context.Context, tlfID TlfID) (
 
 	j.lock.Lock()
 	defer j.lock.Unlock()
-	tlfJournal, ok := j.tlfJournals[tlfID]
+	tlfJournal, ok := j.getTLFJournalLocked(ctx, tlfID)
 	if !ok {
 		j.log.CDebugf(ctx, "Journal already existed for %s", tlfID)
 		return false, nil
@@ -323,6 +411,16 @@ func (j *JournalServer) mdOps() journalMDOps {
 	return journalMDOps{j.delegateMDOps, j}
 }
 
+// signalWork tells every journal that it may have work to do, e.g.
+// after coming back online.
+func (j *JournalServer) signalWork() {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+	for _, tlfJournal := range j.tlfJournals {
+		tlfJournal.signalWork()
+	}
+}
+
 // Status returns a JournalServerStatus object suitable for
 // diagnostics.
 func (j *JournalServer) Status() JournalServerStatus {
@@ -333,7 +431,7 @@ func (j *JournalServer) Status() JournalServerStatus {
 		for _, tlfJournal := range j.tlfJournals {
 			unflushedBytes += tlfJournal.getUnflushedBytes()
 		}
-		return len(j.tlfJournals), unflushedBytes
+		return len(j.tlfJournals) + len(j.lazyJournals), unflushedBytes
 	}()
 	return JournalServerStatus{
 		RootDir:        j.dir,
@@ -345,6 +443,9 @@ func (j *JournalServer) Status() JournalServerStatus {
 // JournalStatus returns a TLFServerStatus object for the given TLF
 // suitable for diagnostics.
 func (j *JournalServer) JournalStatus(tlfID TlfID) (TLFJournalStatus, error) {
+	if status, ok := j.lazyJournalStatus(tlfID); ok {
+		return status, nil
+	}
 	tlfJournal, ok := j.getTLFJournal(tlfID)
 	if !ok {
 		return TLFJournalStatus{},
@@ -354,6 +455,62 @@ func (j *JournalServer) JournalStatus(tlfID TlfID) (TLFJournalStatus, error) {
 	return tlfJournal.getJournalStatus()
 }
 
+// JournalStatuses returns a TLFJournalStatus object for every TLF
+// with a journal, suitable for diagnostics.  TLFs whose status can't
+// be read are left out.
+func (j *JournalServer) JournalStatuses() map[TlfID]TLFJournalStatus {
+	statuses := make(map[TlfID]TLFJournalStatus)
+	j.lock.RLock()
+	tlfJournals := make(map[TlfID]*tlfJournal, len(j.tlfJournals))
+	for tlfID, tlfJournal := range j.tlfJournals {
+		tlfJournals[tlfID] = tlfJournal
+	}
+	for tlfID := range j.lazyJournals {
+		statuses[tlfID] = emptyTLFJournalStatus
+	}
+	j.lock.RUnlock()
+
+	for tlfID, tlfJournal := range tlfJournals {
+		status, err := tlfJournal.getJournalStatus()
+		if err != nil {
+			j.log.CDebugf(context.Background(),
+				"Couldn't get journal status for %s: %v", tlfID, err)
+			continue
+		}
+		statuses[tlfID] = status
+	}
+	return statuses
+}
+
+// emptyTLFJournalStatus is the status of a journal that hasn't been
+// opened, and so is still empty.
+var emptyTLFJournalStatus = TLFJournalStatus{
+	BranchID:      NullBranchID.String(),
+	RevisionStart: MetadataRevisionUninitialized,
+	RevisionEnd:   MetadataRevisionUninitialized,
+}
+
+func (j *JournalServer) lazyJournalStatus(tlfID TlfID) (
+	TLFJournalStatus, bool) {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+	_, ok := j.lazyJournals[tlfID]
+	return emptyTLFJournalStatus, ok
+}
+
+// JournalContents returns everything in the journal for the given
+// TLF, decoded, for diagnostics.
+func (j *JournalServer) JournalContents(ctx context.Context, tlfID TlfID) (
+	TLFJournalContents, error) {
+	tlfJournal, ok := j.getTLFJournal(tlfID)
+	if !ok {
+		return TLFJournalContents{},
+			fmt.Errorf("Journal not enabled for %s", tlfID)
+	}
+
+	return tlfJournal.getJournalContents(ctx)
+}
+
 func (j *JournalServer) shutdown() {
 	j.log.CDebugf(context.Background(), "Shutting down journal")
 	j.lock.Lock()
@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/stretchr/testify/require"
@@ -117,3 +118,246 @@ func TestJournalServerRestart(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, rmd.Revision(), head.Revision())
 }
+
+func TestJournalServerRestartLazy(t *testing.T) {
+	tempdir, config, jServer := setupJournalServerTest(t)
+	defer teardownJournalServerTest(t, tempdir, config)
+
+	ctx := context.Background()
+
+	tlfID := FakeTlfID(2, false)
+	err := jServer.Enable(ctx, tlfID, TLFJournalBackgroundWorkPaused)
+	require.NoError(t, err)
+
+	// Put a block, and flush it, so that the journal is left
+	// empty.
+
+	uid := keybase1.MakeTestUID(1)
+	bCtx := BlockContext{uid, "", zeroBlockRefNonce}
+	data := []byte{1, 2, 3, 4}
+	bID, err := config.Crypto().MakePermanentBlockID(data)
+	require.NoError(t, err)
+	serverHalf, err := config.Crypto().MakeRandomBlockCryptKeyServerHalf()
+	require.NoError(t, err)
+	err = config.BlockServer().Put(ctx, tlfID, bID, bCtx, data, serverHalf)
+	require.NoError(t, err)
+	err = jServer.Flush(ctx, tlfID)
+	require.NoError(t, err)
+
+	// Simulate a restart.  The empty journal is still enabled, but
+	// isn't opened until something might write to it.
+
+	jServer = makeJournalServer(
+		config, jServer.log, tempdir, jServer.delegateBlockCache,
+		jServer.delegateDirtyBlockCache,
+		jServer.delegateBlockServer, jServer.delegateMDOps, nil, nil)
+	err = jServer.EnableExistingJournals(
+		ctx, TLFJournalBackgroundWorkPaused)
+	require.NoError(t, err)
+	config.SetBlockCache(jServer.blockCache())
+	config.SetBlockServer(jServer.blockServer())
+	config.SetMDOps(jServer.mdOps())
+
+	require.True(t, jServer.hasTLFJournal(tlfID))
+	_, ok := jServer.getOpenTLFJournal(tlfID)
+	require.False(t, ok)
+	require.Equal(t, 1, jServer.Status().JournalCount)
+
+	// Reads go straight to the server.
+	buf, key, err := config.BlockServer().Get(ctx, tlfID, bID, bCtx)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+	require.Equal(t, serverHalf, key)
+	_, ok = jServer.getOpenTLFJournal(tlfID)
+	require.False(t, ok)
+
+	// A write opens it.
+	data2 := []byte{5, 6, 7, 8}
+	bID2, err := config.Crypto().MakePermanentBlockID(data2)
+	require.NoError(t, err)
+	err = config.BlockServer().Put(ctx, tlfID, bID2, bCtx, data2, serverHalf)
+	require.NoError(t, err)
+	tlfJournal, ok := jServer.getOpenTLFJournal(tlfID)
+	require.True(t, ok)
+	blockEntryCount, _, err := tlfJournal.getJournalEntryCounts()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), blockEntryCount)
+	require.True(t, jServer.hasUnflushedEntries(tlfID))
+	require.Equal(t, 1, jServer.Status().JournalCount)
+}
+
+func TestJournalServerMDCoalesceWindow(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "journal_server")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+	config.EnableJournaling(tempdir)
+	jServer, err := GetJournalServer(config)
+	require.NoError(t, err)
+	// Long enough that the window never closes on its own here.
+	config.SetMDCoalesceWindow(time.Hour)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	fb := rootNode.GetFolderBranch()
+	err = jServer.Enable(ctx, fb.Tlf, TLFJournalBackgroundWorkEnabled)
+	require.NoError(t, err)
+	kbfsOps := config.KBFSOps()
+	headRevision := func() MetadataRevision {
+		status, _, err := kbfsOps.FolderStatus(ctx, fb)
+		require.NoError(t, err)
+		return status.Revision
+	}
+	startRev := headRevision()
+
+	// All of these directory ops end up in a single revision,
+	// which stays in the journal while the window is open.
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, dirNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Rename(ctx, dirNode, "b", rootNode, "c")
+	require.NoError(t, err)
+	_, err = kbfsOps.CreateLink(ctx, rootNode, "d", "c")
+	require.NoError(t, err)
+	err = kbfsOps.RemoveDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	rev := headRevision()
+	require.Equal(t, startRev+1, rev)
+	status, err := jServer.JournalStatus(fb.Tlf)
+	require.NoError(t, err)
+	require.Equal(t, rev, status.RevisionStart)
+	require.Equal(t, rev, status.RevisionEnd)
+
+	// Waiting closes the window and flushes the revision, with
+	// every op in order.
+	err = jServer.Wait(ctx, fb.Tlf)
+	require.NoError(t, err)
+	status, err = jServer.JournalStatus(fb.Tlf)
+	require.NoError(t, err)
+	require.Equal(t, MetadataRevisionUninitialized, status.RevisionStart)
+	rmd, err := getSingleMD(
+		ctx, config, fb.Tlf, NullBranchID, rev, Merged)
+	require.NoError(t, err)
+	ops := rmd.data.Changes.Ops
+	require.Len(t, ops, 5)
+	require.IsType(t, &createOp{}, ops[0])
+	require.IsType(t, &createOp{}, ops[1])
+	require.IsType(t, &renameOp{}, ops[2])
+	require.IsType(t, &createOp{}, ops[3])
+	require.IsType(t, &rmOp{}, ops[4])
+
+	// Now that the window is closed, the next op gets a new
+	// revision.
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "e", false, NoExcl)
+	require.NoError(t, err)
+	require.Equal(t, rev+1, headRevision())
+}
+
+func TestJournalServerBackgroundSyncCoalescing(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "journal_server")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+	config.EnableJournaling(tempdir)
+	jServer, err := GetJournalServer(config)
+	require.NoError(t, err)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	fb := rootNode.GetFolderBranch()
+	err = jServer.Enable(ctx, fb.Tlf, TLFJournalBackgroundWorkEnabled)
+	require.NoError(t, err)
+	kbfsOps := config.KBFSOps()
+	headRevision := func() MetadataRevision {
+		status, _, err := kbfsOps.FolderStatus(ctx, fb)
+		require.NoError(t, err)
+		return status.Revision
+	}
+
+	var nodes []Node
+	for _, name := range []string{"a", "b", "c"} {
+		n, _, err := kbfsOps.CreateFile(ctx, rootNode, name, false, NoExcl)
+		require.NoError(t, err)
+		err = kbfsOps.Write(ctx, n, []byte(name), 0)
+		require.NoError(t, err)
+		nodes = append(nodes, n)
+	}
+	startRev := headRevision()
+
+	// Background syncs of all the files, and a second one of the
+	// first file, end up in a single revision.
+	bgCtx := context.WithValue(ctx, CtxBackgroundSyncKey, "1")
+	for _, n := range nodes {
+		err = kbfsOps.Sync(bgCtx, n)
+		require.NoError(t, err)
+	}
+	err = kbfsOps.Write(ctx, nodes[0], []byte("aa"), 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(bgCtx, nodes[0])
+	require.NoError(t, err)
+	rev := headRevision()
+	require.Equal(t, startRev+1, rev)
+
+	err = jServer.Wait(ctx, fb.Tlf)
+	require.NoError(t, err)
+	rmd, err := getSingleMD(
+		ctx, config, fb.Tlf, NullBranchID, rev, Merged)
+	require.NoError(t, err)
+	ops := rmd.data.Changes.Ops
+	require.Len(t, ops, 4)
+	for _, op := range ops {
+		require.IsType(t, &syncOp{}, op)
+	}
+	require.Equal(t, "aa", readWholeFile(t, ctx, kbfsOps, rootNode, "a"))
+	require.Equal(t, "c", readWholeFile(t, ctx, kbfsOps, rootNode, "c"))
+
+	// Syncs that aren't in the background still get their own
+	// revisions.
+	err = kbfsOps.Write(ctx, nodes[1], []byte("bb"), 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, nodes[1])
+	require.NoError(t, err)
+	require.Equal(t, rev+1, headRevision())
+}
+
+func TestJournalServerDiskLimit(t *testing.T) {
+	tempdir, config, jServer := setupJournalServerTest(t)
+	defer teardownJournalServerTest(t, tempdir, config)
+
+	limiter := config.(*ConfigLocal).makeDiskLimiterIfNeeded(tempdir)
+
+	ctx := context.Background()
+	tlfID := FakeTlfID(2, false)
+	err := jServer.Enable(ctx, tlfID, TLFJournalBackgroundWorkPaused)
+	require.NoError(t, err)
+
+	uid := keybase1.MakeTestUID(1)
+	bCtx := BlockContext{uid, "", zeroBlockRefNonce}
+	data := []byte{1, 2, 3, 4}
+	bID, err := config.Crypto().MakePermanentBlockID(data)
+	require.NoError(t, err)
+	serverHalf, err := config.Crypto().MakeRandomBlockCryptKeyServerHalf()
+	require.NoError(t, err)
+	err = config.BlockServer().Put(ctx, tlfID, bID, bCtx, data, serverHalf)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), limiter.status().JournalBytes)
+
+	status, _, err := config.KBFSOps().Status(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, status.DiskLimiter)
+	require.Equal(t, int64(len(data)), status.DiskLimiter.JournalBytes)
+
+	// Flushing the block frees up its space.
+	err = jServer.Flush(ctx, tlfID)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), limiter.status().JournalBytes)
+}
@@ -5,12 +5,14 @@
 package libkbfs
 
 import (
+	"errors"
 	"reflect"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/keybase/client/go/libkb"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/net/context"
 )
 
@@ -564,6 +566,237 @@ func TestBasicCRNoConflictWithUnembeddedBlockChanges(t *testing.T) {
 	testBasicCRNoConflict(t, true)
 }
 
+// Tests that a resolution left pending in the CR journal, which
+// never made it to the merged branch, gets rolled back and doesn't
+// stop the next resolution from succeeding.
+func TestCRRollsBackPendingResolution(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	_, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false, NoExcl)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	fb := rootNode2.GetFolderBranch()
+
+	c, err := DisableUpdatesForTesting(config2, fb)
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+	err = DisableCRForTesting(config2, fb)
+	if err != nil {
+		t.Fatalf("Couldn't disable CR: %v", err)
+	}
+
+	_, _, err = kbfsOps1.CreateFile(ctx, rootNode1, "b", false, NoExcl)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	_, _, err = kbfsOps2.CreateFile(ctx, rootNode2, "c", false, NoExcl)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+
+	// Pretend an earlier resolution died after putting its blocks,
+	// but before its MD landed.
+	state, err := GetFolderBranchOpsStateForTesting(config2, fb)
+	if err != nil {
+		t.Fatalf("Couldn't get state: %v", err)
+	}
+	if state.BID == NullBranchID {
+		t.Fatalf("User 2 isn't on an unmerged branch")
+	}
+	journal := config2.CRJournal()
+	err = journal.PutPendingResolution(CRJournalEntry{
+		Tlf:       fb.Tlf,
+		BID:       state.BID,
+		Revision:  MetadataRevision(100),
+		Root:      BlockPointer{ID: fakeBlockID(1)},
+		BlocksPut: true,
+	})
+	if err != nil {
+		t.Fatalf("Couldn't put pending resolution: %v", err)
+	}
+
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2, fb)
+	if err != nil {
+		t.Fatalf("Couldn't restart CR: %v", err)
+	}
+	err = kbfsOps2.SyncFromServerForTesting(ctx, fb)
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+
+	if _, ok, err := journal.GetPendingResolution(fb.Tlf); err != nil {
+		t.Fatalf("Couldn't get pending resolution: %v", err)
+	} else if ok {
+		t.Fatalf("Pending resolution wasn't cleared")
+	}
+
+	children2, err := kbfsOps2.GetDirChildren(ctx, rootNode2)
+	if err != nil {
+		t.Fatalf("Couldn't get children: %v", err)
+	}
+	for _, child := range []string{"a", "b", "c"} {
+		if _, ok := children2[child]; !ok {
+			t.Errorf("Couldn't find child %s", child)
+		}
+	}
+}
+
+// mdOpsFailingRevision fails to fetch one merged revision.
+type mdOpsFailingRevision struct {
+	MDOps
+	rev MetadataRevision
+}
+
+func (m mdOpsFailingRevision) GetRange(ctx context.Context, id TlfID,
+	start, stop MetadataRevision) ([]ImmutableRootMetadata, error) {
+	if start <= m.rev && m.rev <= stop {
+		return nil, errors.New("Fake MD fetch error")
+	}
+	return m.MDOps.GetRange(ctx, id, start, stop)
+}
+
+// Tests that a resolution left pending in the CR journal isn't
+// rolled back when CR can't tell whether it landed, and that the
+// branch gets dropped once it can.
+func TestCRKeepsPendingResolutionOnFetchError(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	_, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false, NoExcl)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	fb := rootNode2.GetFolderBranch()
+
+	c, err := DisableUpdatesForTesting(config2, fb)
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %v", err)
+	}
+	err = DisableCRForTesting(config2, fb)
+	if err != nil {
+		t.Fatalf("Couldn't disable CR: %v", err)
+	}
+
+	_, _, err = kbfsOps1.CreateFile(ctx, rootNode1, "b", false, NoExcl)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	_, _, err = kbfsOps2.CreateFile(ctx, rootNode2, "c", false, NoExcl)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+
+	// Pretend an earlier resolution died right after its MD landed,
+	// as user 1's latest revision.
+	state, err := GetFolderBranchOpsStateForTesting(config2, fb)
+	if err != nil {
+		t.Fatalf("Couldn't get state: %v", err)
+	}
+	if state.BID == NullBranchID {
+		t.Fatalf("User 2 isn't on an unmerged branch")
+	}
+	head, err := config1.MDOps().GetForTLF(ctx, fb.Tlf)
+	if err != nil {
+		t.Fatalf("Couldn't get the merged head: %v", err)
+	}
+	journal := config2.CRJournal()
+	entry := CRJournalEntry{
+		Tlf:       fb.Tlf,
+		BID:       state.BID,
+		Revision:  head.Revision(),
+		Root:      head.data.Dir.BlockPointer,
+		Blocks:    []BlockPointer{head.data.Dir.BlockPointer},
+		BlocksPut: true,
+	}
+	err = journal.PutPendingResolution(entry)
+	if err != nil {
+		t.Fatalf("Couldn't put pending resolution: %v", err)
+	}
+
+	mdOps := config2.MDOps()
+	config2.SetMDOps(mdOpsFailingRevision{mdOps, head.Revision()})
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2, fb)
+	if err != nil {
+		t.Fatalf("Couldn't restart CR: %v", err)
+	}
+	err = kbfsOps2.SyncFromServerForTesting(ctx, fb)
+	if err == nil {
+		t.Fatalf("Unexpected successful CR")
+	}
+
+	// Nothing was rolled back.
+	if got, ok, err := journal.GetPendingResolution(fb.Tlf); err != nil {
+		t.Fatalf("Couldn't get pending resolution: %v", err)
+	} else if !ok || !reflect.DeepEqual(got, entry) {
+		t.Fatalf("Pending resolution changed: %v (ok=%t)", got, ok)
+	}
+	children1, err := kbfsOps1.GetDirChildren(ctx, rootNode1)
+	if err != nil {
+		t.Fatalf("Couldn't get children: %v", err)
+	}
+	if len(children1) != 2 {
+		t.Fatalf("Unexpected children: %v", children1)
+	}
+
+	// Once the revision can be fetched, the branch is dropped.
+	config2.SetMDOps(mdOps)
+	ops2 := getOps(config2, fb.Tlf)
+	ops2.cr.Retry(ops2.getCurrMDRevision(makeFBOLockState()), false)
+	err = kbfsOps2.SyncFromServerForTesting(ctx, fb)
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %v", err)
+	}
+	if _, ok, err := journal.GetPendingResolution(fb.Tlf); err != nil {
+		t.Fatalf("Couldn't get pending resolution: %v", err)
+	} else if ok {
+		t.Fatalf("Pending resolution wasn't cleared")
+	}
+	children2, err := kbfsOps2.GetDirChildren(ctx, rootNode2)
+	if err != nil {
+		t.Fatalf("Couldn't get children: %v", err)
+	}
+	if len(children2) != 2 {
+		t.Fatalf("Unexpected children: %v", children2)
+	}
+
+	// The pretend resolution doesn't reference the blocks of user
+	// 2's dropped branch, so avoid checking state.
+	config2.MDServer().Shutdown()
+}
+
 type registerForUpdateRecord struct {
 	id       TlfID
 	currHead MetadataRevision
@@ -2071,3 +2304,62 @@ func TestUnmergedPutAfterCanceledUnmergedPut(t *testing.T) {
 		}
 	}
 }
+
+// Tests that when one unmerged directory feeds actions into two
+// different merged directories, both sets of actions are applied.
+func TestCRActionsFromOneUnmergedDirIntoTwoMergedDirs(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	dirA1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "a")
+	require.NoError(t, err)
+	dirB1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "b")
+	require.NoError(t, err)
+	_, _, err = kbfsOps1.CreateFile(ctx, dirA1, "f", false, NoExcl)
+	require.NoError(t, err)
+
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	dirA2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	fileF2, _, err := kbfsOps2.Lookup(ctx, dirA2, "f")
+	require.NoError(t, err)
+
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+
+	// User 1 moves the file into b.
+	err = kbfsOps1.Rename(ctx, dirA1, "f", dirB1, "f")
+	require.NoError(t, err)
+
+	// User 2 makes the file executable, and adds a new file to a,
+	// so that a has actions of its own.
+	err = kbfsOps2.SetEx(ctx, fileF2, true)
+	require.NoError(t, err)
+	_, _, err = kbfsOps2.CreateFile(ctx, dirA2, "g", false, NoExcl)
+	require.NoError(t, err)
+
+	c <- struct{}{}
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	children, err := kbfsOps1.GetDirChildren(ctx, dirA1)
+	require.NoError(t, err)
+	require.Len(t, children, 1)
+	require.Contains(t, children, "g")
+	children, err = kbfsOps1.GetDirChildren(ctx, dirB1)
+	require.NoError(t, err)
+	require.Len(t, children, 1)
+	require.Equal(t, Exec, children["f"].Type)
+}
@@ -7,7 +7,10 @@ package libkbfs
 import (
 	"errors"
 	"fmt"
+	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/keybase/client/go/logger"
@@ -15,10 +18,22 @@ import (
 	"golang.org/x/net/context"
 )
 
+// defaultMaxFolderBranchOps is how many folderBranchOps
+// KBFSOpsStandard keeps in memory before it starts shutting down the
+// least recently used idle ones.
+const defaultMaxFolderBranchOps = 1000
+
 // KBFSOpsStandard implements the KBFSOps interface, and is go-routine
 // safe by forwarding requests to individual per-folder-branch
 // handlers that are go-routine-safe.
 type KBFSOpsStandard struct {
+	// opsUseCount is bumped, atomically, every time an fbo is
+	// handed out; it's first in the struct for 64-bit alignment.
+	opsUseCount uint64
+	// evicting is non-zero while evictIdleOps is running.
+	evicting int32
+	maxOps   int
+
 	config   Config
 	log      logger.Logger
 	deferLog logger.Logger
@@ -35,24 +50,70 @@ type KBFSOpsStandard struct {
 	favs *Favorites
 
 	currentStatus kbfsCurrentStatus
+	quotaUsage    *quotaUsage
+	slowOps       *slowOpWatchdog
+	flushers      *flusherPool
 }
 
 var _ KBFSOps = (*KBFSOpsStandard)(nil)
 
+// CtxKBFSOpsTagKey is the type used for unique context tags within
+// KBFSOpsStandard.
+type CtxKBFSOpsTagKey int
+
+const (
+	// CtxKBFSOpsIDKey is the type of the tag for unique operation
+	// IDs of KBFSOps calls.
+	CtxKBFSOpsIDKey CtxKBFSOpsTagKey = iota
+)
+
+// CtxKBFSOpsOpID is the display name for the unique KBFSOps
+// operation ID tag.  Like every log tag, it's also sent along with
+// any RPC made under the operation's context, to the servers and
+// the Keybase service.
+const CtxKBFSOpsOpID = "OPID"
+
+// ctxWithOpID returns a context tagged with a new operation ID,
+// unless ctx is already part of a KBFSOps call that has one.
+func (fs *KBFSOpsStandard) ctxWithOpID(ctx context.Context) context.Context {
+	if ctx.Value(CtxKBFSOpsIDKey) != nil {
+		return ctx
+	}
+	return ctxWithRandomIDReplayable(ctx, CtxKBFSOpsIDKey, CtxKBFSOpsOpID,
+		fs.log)
+}
+
+// startOp tags ctx with a new operation ID and watches the call named
+// name for being slow, until the returned function is called.  Calls
+// made within another call are already covered by it.
+func (fs *KBFSOpsStandard) startOp(ctx context.Context, name string) (
+	context.Context, func()) {
+	if ctx.Value(CtxKBFSOpsIDKey) != nil {
+		return ctx, func() {}
+	}
+	ctx = fs.ctxWithOpID(ctx)
+	return ctx, fs.slowOps.startOp(ctx, name)
+}
+
 // NewKBFSOpsStandard constructs a new KBFSOpsStandard object.
 func NewKBFSOpsStandard(config Config) *KBFSOpsStandard {
 	log := config.MakeLogger("")
 	kops := &KBFSOpsStandard{
+		maxOps:                defaultMaxFolderBranchOps,
 		config:                config,
 		log:                   log,
 		deferLog:              log.CloneWithAddedDepth(1),
 		ops:                   make(map[FolderBranch]*folderBranchOps),
 		opsByFav:              make(map[Favorite]*folderBranchOps),
 		reIdentifyControlChan: make(chan struct{}),
-		favs: NewFavorites(config),
+		favs:                  NewFavorites(config),
+		quotaUsage:            newQuotaUsage(config, log),
+		slowOps:               newSlowOpWatchdog(config, log),
+		flushers:              newFlusherPool(config, defaultFlusherPoolSize),
 	}
 	kops.currentStatus.Init()
 	go kops.markForReIdentifyIfNeededLoop()
+	go kops.slowOps.loop()
 	return kops
 }
 
@@ -64,12 +125,19 @@ func (fs *KBFSOpsStandard) markForReIdentifyIfNeededLoop() {
 	}
 	// Tick ten times the rate of valid duration allowing only overflows of +-10%
 	ticker := time.NewTicker(maxValid / 10)
+	// Identifies are valid for a span of wall-clock time, but the
+	// times compared below measure elapsed time on the monotonic
+	// clock, which misses suspends.
+	jumpChan, unregister := fs.config.ClockJumpDetector().Register()
+	defer unregister()
 	for {
 		var now time.Time
 		select {
 		// Normal case: feed the current time from config and mark fbos needing validation.
 		case <-ticker.C:
 			now = fs.config.Clock().Now()
+		// Mark everything for reidentification after a clock jump.
+		case <-jumpChan:
 		// Mark everything for reidentification via now being the empty value or quit.
 		case _, ok := <-fs.reIdentifyControlChan:
 			if !ok {
@@ -94,6 +162,7 @@ func (fs *KBFSOpsStandard) markForReIdentifyIfNeeded(now time.Time, maxValid tim
 // been launched by KBFSOpsStandard.
 func (fs *KBFSOpsStandard) Shutdown() error {
 	close(fs.reIdentifyControlChan)
+	fs.slowOps.shutdown()
 	var errors []error
 	if err := fs.favs.Shutdown(); err != nil {
 		errors = append(errors, err)
@@ -104,6 +173,7 @@ func (fs *KBFSOpsStandard) Shutdown() error {
 			// Continue on and try to shut down the other FBOs.
 		}
 	}
+	fs.flushers.shutdown()
 	if len(errors) == 1 {
 		return errors[0]
 	} else if len(errors) > 1 {
@@ -122,18 +192,24 @@ func (fs *KBFSOpsStandard) PushConnectionStatusChange(service string, newStatus
 // KBFSOpsStandard.
 func (fs *KBFSOpsStandard) GetFavorites(ctx context.Context) (
 	[]Favorite, error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.GetFavorites")
+	defer done()
 	return fs.favs.Get(ctx)
 }
 
 // RefreshCachedFavorites implements the KBFSOps interface for
 // KBFSOpsStandard.
 func (fs *KBFSOpsStandard) RefreshCachedFavorites(ctx context.Context) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.RefreshCachedFavorites")
+	defer done()
 	fs.favs.RefreshCache(ctx)
 }
 
 // AddFavorite implements the KBFSOps interface for KBFSOpsStandard.
 func (fs *KBFSOpsStandard) AddFavorite(ctx context.Context,
 	fav Favorite) error {
+	ctx, done := fs.startOp(ctx, "KBFSOps.AddFavorite")
+	defer done()
 	kbpki := fs.config.KBPKI()
 	_, _, err := kbpki.GetCurrentUserInfo(ctx)
 	isLoggedIn := err == nil
@@ -152,6 +228,8 @@ func (fs *KBFSOpsStandard) AddFavorite(ctx context.Context,
 // KBFSOpsStandard.
 func (fs *KBFSOpsStandard) DeleteFavorite(ctx context.Context,
 	fav Favorite) error {
+	ctx, done := fs.startOp(ctx, "KBFSOps.DeleteFavorite")
+	defer done()
 	kbpki := fs.config.KBPKI()
 	_, _, err := kbpki.GetCurrentUserInfo(ctx)
 	isLoggedIn := err == nil
@@ -160,9 +238,14 @@ func (fs *KBFSOpsStandard) DeleteFavorite(ctx context.Context,
 	ops := func() *folderBranchOps {
 		fs.opsLock.Lock()
 		defer fs.opsLock.Unlock()
-		return fs.opsByFav[fav]
+		ops := fs.opsByFav[fav]
+		if ops != nil {
+			atomic.AddInt32(&ops.refs, 1)
+		}
+		return ops
 	}()
 	if ops != nil {
+		defer atomic.AddInt32(&ops.refs, -1)
 		err := ops.deleteFromFavorites(ctx, fs.favs)
 		if _, ok := err.(OpsCantHandleFavorite); !ok {
 			return err
@@ -184,15 +267,22 @@ func (fs *KBFSOpsStandard) DeleteFavorite(ctx context.Context,
 	return nil
 }
 
-func (fs *KBFSOpsStandard) getOpsNoAdd(fb FolderBranch) *folderBranchOps {
+// getOpsRef returns the folderBranchOps for fb, making it if needed.
+// It won't be evicted until the returned release function is called.
+func (fs *KBFSOpsStandard) getOpsRef(fb FolderBranch) (
+	ops *folderBranchOps, release func()) {
 	if fb == (FolderBranch{}) {
 		panic("zero FolderBranch in getOps")
 	}
 
 	fs.opsLock.RLock()
 	if ops, ok := fs.ops[fb]; ok {
+		// Mark it as used and take the reference while still
+		// holding the lock, so that evictIdleOps can't miss them.
+		fs.markOpsUsed(ops)
+		atomic.AddInt32(&ops.refs, 1)
 		fs.opsLock.RUnlock()
-		return ops
+		return ops, ops.releaseRef
 	}
 
 	fs.opsLock.RUnlock()
@@ -203,31 +293,130 @@ func (fs *KBFSOpsStandard) getOpsNoAdd(fb FolderBranch) *folderBranchOps {
 	if !ok {
 		// TODO: add some interface for specifying the type of the
 		// branch; for now assume online and read-write.
-		ops = newFolderBranchOps(fs.config, fb, standard)
+		ops = newFolderBranchOps(fs.config, fb, standard, fs.flushers)
 		fs.ops[fb] = ops
+		if len(fs.ops) > fs.maxOps &&
+			atomic.CompareAndSwapInt32(&fs.evicting, 0, 1) {
+			go fs.evictIdleOps()
+		}
 	}
+	fs.markOpsUsed(ops)
+	atomic.AddInt32(&ops.refs, 1)
+	return ops, ops.releaseRef
+}
+
+// getOpsNoAdd returns the folderBranchOps for fb, making it if
+// needed, without holding a reference to it.  It's only for callers
+// that keep the folder from being idle in some other way (e.g., by
+// holding a Node in it), or that only use it briefly.
+func (fs *KBFSOpsStandard) getOpsNoAdd(fb FolderBranch) *folderBranchOps {
+	ops, release := fs.getOpsRef(fb)
+	release()
 	return ops
 }
 
-func (fs *KBFSOpsStandard) getOps(
-	ctx context.Context, fb FolderBranch) *folderBranchOps {
-	ops := fs.getOpsNoAdd(fb)
+type opsUse struct {
+	fb      FolderBranch
+	ops     *folderBranchOps
+	lastUse uint64
+}
+
+// opsUseList sorts opsUses from least to most recently used.
+type opsUseList []opsUse
+
+func (l opsUseList) Len() int           { return len(l) }
+func (l opsUseList) Less(i, j int) bool { return l[i].lastUse < l[j].lastUse }
+func (l opsUseList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+func (fs *KBFSOpsStandard) markOpsUsed(ops *folderBranchOps) {
+	atomic.StoreUint64(&ops.lastUse, atomic.AddUint64(&fs.opsUseCount, 1))
+}
+
+// evictIdleOps shuts down and forgets the least recently used idle
+// folderBranchOps, until there are no more than fs.maxOps of them
+// left (or no more idle ones).  Ops that someone holds a reference
+// to are never evicted, and neither are those handed out within the
+// last fs.maxOps uses, since their callers may not have had a chance
+// to make them non-idle yet.  Evicted folders are simply recreated
+// the next time they're accessed.
+func (fs *KBFSOpsStandard) evictIdleOps() {
+	defer atomic.StoreInt32(&fs.evicting, 0)
+
+	fs.opsLock.RLock()
+	uses := make(opsUseList, 0, len(fs.ops))
+	for fb, ops := range fs.ops {
+		uses = append(uses, opsUse{fb, ops, atomic.LoadUint64(&ops.lastUse)})
+	}
+	fs.opsLock.RUnlock()
+
+	excess := len(uses) - fs.maxOps
+	if excess <= 0 {
+		return
+	}
+	sort.Sort(uses)
+
+	current := atomic.LoadUint64(&fs.opsUseCount)
+	evicted := 0
+	for _, u := range uses {
+		if evicted >= excess || current-u.lastUse < uint64(fs.maxOps) {
+			break
+		}
+		if !u.ops.isIdle() {
+			continue
+		}
+
+		fs.opsLock.Lock()
+		if fs.ops[u.fb] != u.ops ||
+			atomic.LoadUint64(&u.ops.lastUse) != u.lastUse ||
+			atomic.LoadInt32(&u.ops.refs) != 0 {
+			// Someone used it since we looked, or is still
+			// using it.  Nobody can take a new reference once
+			// it's out of the map.
+			fs.opsLock.Unlock()
+			continue
+		}
+		delete(fs.ops, u.fb)
+		for fav, ops := range fs.opsByFav {
+			if ops == u.ops {
+				delete(fs.opsByFav, fav)
+			}
+		}
+		fs.opsLock.Unlock()
+
+		if err := u.ops.Shutdown(); err != nil {
+			fs.log.Debug("Couldn't shut down evicted ops for %s: %v",
+				u.fb.Tlf, err)
+		}
+		evicted++
+	}
+	if evicted > 0 {
+		fs.log.Debug("Evicted %d idle folder-branch ops", evicted)
+	}
+}
+
+// getOps returns the folderBranchOps for fb, and adds the folder to
+// the favorites.  Like getOpsRef, the caller must call release when
+// it's done with the ops.
+func (fs *KBFSOpsStandard) getOps(ctx context.Context, fb FolderBranch) (
+	ops *folderBranchOps, release func()) {
+	ops, release = fs.getOpsRef(fb)
 	if err := ops.addToFavorites(ctx, fs.favs, false); err != nil {
 		// Failure to favorite shouldn't cause a failure.  Just log
 		// and move on.
 		fs.log.CDebugf(ctx, "Couldn't add favorite: %v", err)
 	}
-	return ops
+	return ops, release
 }
 
-func (fs *KBFSOpsStandard) getOpsByNode(ctx context.Context,
-	node Node) *folderBranchOps {
+func (fs *KBFSOpsStandard) getOpsByNode(ctx context.Context, node Node) (
+	ops *folderBranchOps, release func()) {
 	return fs.getOps(ctx, node.GetFolderBranch())
 }
 
 func (fs *KBFSOpsStandard) getOpsByHandle(ctx context.Context,
-	handle *TlfHandle, fb FolderBranch) *folderBranchOps {
-	ops := fs.getOpsNoAdd(fb)
+	handle *TlfHandle, fb FolderBranch) (
+	ops *folderBranchOps, release func()) {
+	ops, release = fs.getOpsRef(fb)
 	if err := ops.addToFavoritesByHandle(
 		ctx, fs.favs, handle, false); err != nil {
 		// Failure to favorite shouldn't cause a failure.  Just log
@@ -241,13 +430,15 @@ func (fs *KBFSOpsStandard) getOpsByHandle(ctx context.Context,
 	// from the favorites list.  TODO: fix this when unresolved
 	// assertions are allowed and become resolved.
 	fs.opsByFav[handle.ToFavorite()] = ops
-	return ops
+	return ops, release
 }
 
 // GetTLFCryptKeys implements the KBFSOps interface for
 // KBFSOpsStandard
 func (fs *KBFSOpsStandard) GetTLFCryptKeys(ctx context.Context,
 	tlfHandle *TlfHandle) (keys []TLFCryptKey, id TlfID, err error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.GetTLFCryptKeys")
+	defer done()
 	var rmd ImmutableRootMetadata
 	_, rmd, id, err = fs.getOrInitializeNewMDMaster(
 		ctx, fs.config.MDOps(), tlfHandle, true)
@@ -281,7 +472,8 @@ func (fs *KBFSOpsStandard) getOrInitializeNewMDMaster(
 	// Init new MD.
 
 	fb := FolderBranch{Tlf: id, Branch: MasterBranch}
-	fops := fs.getOpsByHandle(ctx, h, fb)
+	fops, release := fs.getOpsByHandle(ctx, h, fb)
+	defer release()
 
 	err = fops.SetInitialHeadToNew(ctx, id, h)
 	if err != nil {
@@ -322,7 +514,8 @@ func (fs *KBFSOpsStandard) getMaybeCreateRootNode(
 		}
 		if initialized {
 			fb := FolderBranch{Tlf: id, Branch: MasterBranch}
-			fops := fs.getOpsByHandle(ctx, h, fb)
+			fops, release := fs.getOpsByHandle(ctx, h, fb)
+			defer release()
 
 			node, ei, _, err = fops.getRootNode(ctx)
 			if err != nil {
@@ -344,7 +537,8 @@ func (fs *KBFSOpsStandard) getMaybeCreateRootNode(
 				return nil, EntryInfo{}, err
 			}
 			fb := FolderBranch{Tlf: id, Branch: MasterBranch}
-			fops := fs.getOpsByHandle(ctx, h, fb)
+			fops, release := fs.getOpsByHandle(ctx, h, fb)
+			defer release()
 			if err := fops.addToFavoritesByHandle(ctx, fs.favs, h, false); err != nil {
 				// Failure to favorite shouldn't cause a failure.  Just log
 				// and move on.
@@ -371,7 +565,8 @@ func (fs *KBFSOpsStandard) getMaybeCreateRootNode(
 		return nil, EntryInfo{}, err
 	}
 
-	ops := fs.getOpsByHandle(ctx, h, fb)
+	ops, release := fs.getOpsByHandle(ctx, h, fb)
+	defer release()
 
 	err = ops.SetInitialHeadFromServer(ctx, md)
 	if err != nil {
@@ -396,6 +591,10 @@ func (fs *KBFSOpsStandard) getMaybeCreateRootNode(
 func (fs *KBFSOpsStandard) GetOrCreateRootNode(
 	ctx context.Context, h *TlfHandle, branch BranchName) (
 	node Node, ei EntryInfo, err error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.GetOrCreateRootNode")
+	defer done()
+	ctx, span := startSpan(ctx, fs.config.Tracer(), "KBFSOps.GetOrCreateRootNode")
+	defer func() { span.Finish(err) }()
 	return fs.getMaybeCreateRootNode(ctx, h, branch, true)
 }
 
@@ -405,71 +604,156 @@ func (fs *KBFSOpsStandard) GetOrCreateRootNode(
 func (fs *KBFSOpsStandard) GetRootNode(
 	ctx context.Context, h *TlfHandle, branch BranchName) (
 	node Node, ei EntryInfo, err error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.GetRootNode")
+	defer done()
 	return fs.getMaybeCreateRootNode(ctx, h, branch, false)
 }
 
 // GetDirChildren implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) GetDirChildren(ctx context.Context, dir Node) (
-	map[string]EntryInfo, error) {
-	ops := fs.getOpsByNode(ctx, dir)
+	children map[string]EntryInfo, err error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.GetDirChildren")
+	defer done()
+	ctx, span := startSpan(ctx, fs.config.Tracer(), "KBFSOps.GetDirChildren")
+	defer func() { span.Finish(err) }()
+	ops, release := fs.getOpsByNode(ctx, dir)
+	defer release()
 	return ops.GetDirChildren(ctx, dir)
 }
 
+// BatchStat implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) BatchStat(
+	ctx context.Context, dir Node, names []string) (
+	map[string]EntryInfo, map[string]error, error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.BatchStat")
+	defer done()
+	ops, release := fs.getOpsByNode(ctx, dir)
+	defer release()
+	return ops.BatchStat(ctx, dir, names)
+}
+
 // Lookup implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Lookup(ctx context.Context, dir Node, name string) (
-	Node, EntryInfo, error) {
-	ops := fs.getOpsByNode(ctx, dir)
+	node Node, ei EntryInfo, err error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.Lookup")
+	defer done()
+	ctx, span := startSpan(ctx, fs.config.Tracer(), "KBFSOps.Lookup")
+	defer func() { span.Finish(err) }()
+	ops, release := fs.getOpsByNode(ctx, dir)
+	defer release()
 	return ops.Lookup(ctx, dir, name)
 }
 
 // Stat implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Stat(ctx context.Context, node Node) (
-	EntryInfo, error) {
-	ops := fs.getOpsByNode(ctx, node)
+	ei EntryInfo, err error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.Stat")
+	defer done()
+	ctx, span := startSpan(ctx, fs.config.Tracer(), "KBFSOps.Stat")
+	defer func() { span.Finish(err) }()
+	ops, release := fs.getOpsByNode(ctx, node)
+	defer release()
 	return ops.Stat(ctx, node)
 }
 
 // CreateDir implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) CreateDir(
-	ctx context.Context, dir Node, name string) (Node, EntryInfo, error) {
-	ops := fs.getOpsByNode(ctx, dir)
+	ctx context.Context, dir Node, name string) (
+	node Node, ei EntryInfo, err error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.CreateDir")
+	defer done()
+	ctx, span := startSpan(ctx, fs.config.Tracer(), "KBFSOps.CreateDir")
+	defer func() { span.Finish(err) }()
+	ops, release := fs.getOpsByNode(ctx, dir)
+	defer release()
 	return ops.CreateDir(ctx, dir, name)
 }
 
 // CreateFile implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) CreateFile(
 	ctx context.Context, dir Node, name string, isExec bool, excl Excl) (
-	Node, EntryInfo, error) {
-	ops := fs.getOpsByNode(ctx, dir)
+	node Node, ei EntryInfo, err error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.CreateFile")
+	defer done()
+	ctx, span := startSpan(ctx, fs.config.Tracer(), "KBFSOps.CreateFile")
+	defer func() { span.Finish(err) }()
+	ops, release := fs.getOpsByNode(ctx, dir)
+	defer release()
 	return ops.CreateFile(ctx, dir, name, isExec, excl)
 }
 
+// CreateFileWithMode implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) CreateFileWithMode(
+	ctx context.Context, dir Node, name string, mode os.FileMode,
+	excl Excl) (node Node, ei EntryInfo, err error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.CreateFileWithMode")
+	defer done()
+	ctx, span := startSpan(ctx, fs.config.Tracer(),
+		"KBFSOps.CreateFileWithMode")
+	defer func() { span.Finish(err) }()
+	ops, release := fs.getOpsByNode(ctx, dir)
+	defer release()
+	return ops.CreateFileWithMode(ctx, dir, name, mode, excl)
+}
+
 // CreateLink implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) CreateLink(
 	ctx context.Context, dir Node, fromName string, toPath string) (
 	EntryInfo, error) {
-	ops := fs.getOpsByNode(ctx, dir)
+	ctx, done := fs.startOp(ctx, "KBFSOps.CreateLink")
+	defer done()
+	ops, release := fs.getOpsByNode(ctx, dir)
+	defer release()
 	return ops.CreateLink(ctx, dir, fromName, toPath)
 }
 
+// Link implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) Link(
+	ctx context.Context, file Node, dir Node, name string) error {
+	ctx, done := fs.startOp(ctx, "KBFSOps.Link")
+	defer done()
+	if file.GetFolderBranch() != dir.GetFolderBranch() {
+		return CrossDirLinkError{file.GetBasename()}
+	}
+
+	ops, release := fs.getOpsByNode(ctx, dir)
+	defer release()
+	return ops.Link(ctx, file, dir, name)
+}
+
 // RemoveDir implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) RemoveDir(
-	ctx context.Context, dir Node, name string) error {
-	ops := fs.getOpsByNode(ctx, dir)
+	ctx context.Context, dir Node, name string) (err error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.RemoveDir")
+	defer done()
+	ctx, span := startSpan(ctx, fs.config.Tracer(), "KBFSOps.RemoveDir")
+	defer func() { span.Finish(err) }()
+	ops, release := fs.getOpsByNode(ctx, dir)
+	defer release()
 	return ops.RemoveDir(ctx, dir, name)
 }
 
 // RemoveEntry implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) RemoveEntry(
-	ctx context.Context, dir Node, name string) error {
-	ops := fs.getOpsByNode(ctx, dir)
+	ctx context.Context, dir Node, name string) (err error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.RemoveEntry")
+	defer done()
+	ctx, span := startSpan(ctx, fs.config.Tracer(), "KBFSOps.RemoveEntry")
+	defer func() { span.Finish(err) }()
+	ops, release := fs.getOpsByNode(ctx, dir)
+	defer release()
 	return ops.RemoveEntry(ctx, dir, name)
 }
 
 // Rename implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Rename(
 	ctx context.Context, oldParent Node, oldName string, newParent Node,
-	newName string) error {
+	newName string) (err error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.Rename")
+	defer done()
+	ctx, span := startSpan(ctx, fs.config.Tracer(), "KBFSOps.Rename")
+	defer func() { span.Finish(err) }()
 	oldFB := oldParent.GetFolderBranch()
 	newFB := newParent.GetFolderBranch()
 
@@ -478,7 +762,8 @@ func (fs *KBFSOpsStandard) Rename(
 		return RenameAcrossDirsError{}
 	}
 
-	ops := fs.getOpsByNode(ctx, oldParent)
+	ops, release := fs.getOpsByNode(ctx, oldParent)
+	defer release()
 	return ops.Rename(ctx, oldParent, oldName, newParent, newName)
 }
 
@@ -486,55 +771,238 @@ func (fs *KBFSOpsStandard) Rename(
 func (fs *KBFSOpsStandard) Read(
 	ctx context.Context, file Node, dest []byte, off int64) (
 	numRead int64, err error) {
-	ops := fs.getOpsByNode(ctx, file)
+	ctx, done := fs.startOp(ctx, "KBFSOps.Read")
+	defer done()
+	ctx, span := startSpan(ctx, fs.config.Tracer(), "KBFSOps.Read")
+	defer func() { span.Finish(err) }()
+	ops, release := fs.getOpsByNode(ctx, file)
+	defer release()
 	return ops.Read(ctx, file, dest, off)
 }
 
+// ReadSlices implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) ReadSlices(
+	ctx context.Context, file Node, off, size int64) ([][]byte, error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.ReadSlices")
+	defer done()
+	ops, release := fs.getOpsByNode(ctx, file)
+	defer release()
+	return ops.ReadSlices(ctx, file, off, size)
+}
+
 // Write implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Write(
-	ctx context.Context, file Node, data []byte, off int64) error {
-	ops := fs.getOpsByNode(ctx, file)
+	ctx context.Context, file Node, data []byte, off int64) (err error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.Write")
+	defer done()
+	ctx, span := startSpan(ctx, fs.config.Tracer(), "KBFSOps.Write")
+	defer func() { span.Finish(err) }()
+	ops, release := fs.getOpsByNode(ctx, file)
+	defer release()
 	return ops.Write(ctx, file, data, off)
 }
 
 // Truncate implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Truncate(
-	ctx context.Context, file Node, size uint64) error {
-	ops := fs.getOpsByNode(ctx, file)
+	ctx context.Context, file Node, size uint64) (err error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.Truncate")
+	defer done()
+	ctx, span := startSpan(ctx, fs.config.Tracer(), "KBFSOps.Truncate")
+	defer func() { span.Finish(err) }()
+	ops, release := fs.getOpsByNode(ctx, file)
+	defer release()
 	return ops.Truncate(ctx, file, size)
 }
 
+// Allocate implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) Allocate(
+	ctx context.Context, file Node, off, length uint64,
+	mode AllocateMode) error {
+	ctx, done := fs.startOp(ctx, "KBFSOps.Allocate")
+	defer done()
+	ops, release := fs.getOpsByNode(ctx, file)
+	defer release()
+	return ops.Allocate(ctx, file, off, length, mode)
+}
+
+// GetDataRanges implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetDataRanges(
+	ctx context.Context, file Node) ([]DataRange, error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.GetDataRanges")
+	defer done()
+	ops, release := fs.getOpsByNode(ctx, file)
+	defer release()
+	return ops.GetDataRanges(ctx, file)
+}
+
+// GetAllocatedSize implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetAllocatedSize(
+	ctx context.Context, file Node) (uint64, error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.GetAllocatedSize")
+	defer done()
+	ops, release := fs.getOpsByNode(ctx, file)
+	defer release()
+	return ops.GetAllocatedSize(ctx, file)
+}
+
 // SetEx implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) SetEx(
 	ctx context.Context, file Node, ex bool) error {
-	ops := fs.getOpsByNode(ctx, file)
+	ctx, done := fs.startOp(ctx, "KBFSOps.SetEx")
+	defer done()
+	ops, release := fs.getOpsByNode(ctx, file)
+	defer release()
 	return ops.SetEx(ctx, file, ex)
 }
 
 // SetMtime implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) SetMtime(
 	ctx context.Context, file Node, mtime *time.Time) error {
-	ops := fs.getOpsByNode(ctx, file)
+	ctx, done := fs.startOp(ctx, "KBFSOps.SetMtime")
+	defer done()
+	ops, release := fs.getOpsByNode(ctx, file)
+	defer release()
 	return ops.SetMtime(ctx, file, mtime)
 }
 
+// SetMode implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) SetMode(
+	ctx context.Context, node Node, mode os.FileMode) error {
+	ctx, done := fs.startOp(ctx, "KBFSOps.SetMode")
+	defer done()
+	ops, release := fs.getOpsByNode(ctx, node)
+	defer release()
+	return ops.SetMode(ctx, node, mode)
+}
+
+// SetOwner implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) SetOwner(
+	ctx context.Context, node Node, uid, gid int) error {
+	ctx, done := fs.startOp(ctx, "KBFSOps.SetOwner")
+	defer done()
+	ops, release := fs.getOpsByNode(ctx, node)
+	defer release()
+	return ops.SetOwner(ctx, node, uid, gid)
+}
+
+// SetXattr implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) SetXattr(
+	ctx context.Context, node Node, name string, value []byte) error {
+	ctx, done := fs.startOp(ctx, "KBFSOps.SetXattr")
+	defer done()
+	ops, release := fs.getOpsByNode(ctx, node)
+	defer release()
+	return ops.SetXattr(ctx, node, name, value)
+}
+
+// GetXattr implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetXattr(
+	ctx context.Context, node Node, name string) ([]byte, error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.GetXattr")
+	defer done()
+	ops, release := fs.getOpsByNode(ctx, node)
+	defer release()
+	return ops.GetXattr(ctx, node, name)
+}
+
+// ListXattr implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) ListXattr(
+	ctx context.Context, node Node) ([]string, error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.ListXattr")
+	defer done()
+	ops, release := fs.getOpsByNode(ctx, node)
+	defer release()
+	return ops.ListXattr(ctx, node)
+}
+
+// RemoveXattr implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) RemoveXattr(
+	ctx context.Context, node Node, name string) error {
+	ctx, done := fs.startOp(ctx, "KBFSOps.RemoveXattr")
+	defer done()
+	ops, release := fs.getOpsByNode(ctx, node)
+	defer release()
+	return ops.RemoveXattr(ctx, node, name)
+}
+
+// FileSyncState implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) FileSyncState(
+	ctx context.Context, file Node) (SyncState, error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.FileSyncState")
+	defer done()
+	ops, release := fs.getOpsByNode(ctx, file)
+	defer release()
+	return ops.FileSyncState(ctx, file)
+}
+
 // Sync implements the KBFSOps interface for KBFSOpsStandard
-func (fs *KBFSOpsStandard) Sync(ctx context.Context, file Node) error {
-	ops := fs.getOpsByNode(ctx, file)
+func (fs *KBFSOpsStandard) Sync(ctx context.Context, file Node) (
+	err error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.Sync")
+	defer done()
+	ctx, span := startSpan(ctx, fs.config.Tracer(), "KBFSOps.Sync")
+	defer func() { span.Finish(err) }()
+	ops, release := fs.getOpsByNode(ctx, file)
+	defer release()
 	return ops.Sync(ctx, file)
 }
 
+// SyncWithDurability implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) SyncWithDurability(ctx context.Context,
+	file Node, durability WriteDurability) (err error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.SyncWithDurability")
+	defer done()
+	ctx, span := startSpan(ctx, fs.config.Tracer(), "KBFSOps.SyncWithDurability")
+	defer func() { span.Finish(err) }()
+	ops, release := fs.getOpsByNode(ctx, file)
+	defer release()
+	return ops.SyncWithDurability(ctx, file, durability)
+}
+
+// SetSyncDurability implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) SetSyncDurability(ctx context.Context,
+	folderBranch FolderBranch, durability WriteDurability) error {
+	ctx, done := fs.startOp(ctx, "KBFSOps.SetSyncDurability")
+	defer done()
+	ops, release := fs.getOps(ctx, folderBranch)
+	defer release()
+	return ops.SetSyncDurability(ctx, folderBranch, durability)
+}
+
 // FolderStatus implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) FolderStatus(
 	ctx context.Context, folderBranch FolderBranch) (
 	FolderBranchStatus, <-chan StatusUpdate, error) {
-	ops := fs.getOps(ctx, folderBranch)
+	ctx, done := fs.startOp(ctx, "KBFSOps.FolderStatus")
+	defer done()
+	ops, release := fs.getOps(ctx, folderBranch)
+	defer release()
 	return ops.FolderStatus(ctx, folderBranch)
 }
 
+// GetConflictStatus implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetConflictStatus(
+	ctx context.Context, folderBranch FolderBranch) (ConflictStatus, error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.GetConflictStatus")
+	defer done()
+	ops, release := fs.getOps(ctx, folderBranch)
+	defer release()
+	return ops.GetConflictStatus(ctx, folderBranch)
+}
+
+// SlowOpReports implements the KBFSOps interface for KBFSOpsStandard.
+func (fs *KBFSOpsStandard) SlowOpReports() []SlowOpReport {
+	return fs.slowOps.getReports()
+}
+
 // Status implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Status(ctx context.Context) (
 	KBFSStatus, <-chan StatusUpdate, error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.Status")
+	defer done()
 	username, _, err := fs.config.KBPKI().GetCurrentUserInfo(ctx)
 	var usageBytes int64 = -1
 	var limitBytes int64 = -1
@@ -543,14 +1011,10 @@ func (fs *KBFSOpsStandard) Status(ctx context.Context) (
 	// service/GUI by handling multiple simultaneous passphrase
 	// requests at once.
 	if err == nil && fs.config.MDServer().IsConnected() {
-		quotaInfo, err := fs.config.BlockServer().GetUserQuotaInfo(ctx)
+		quotaInfo, err := fs.quotaUsage.Get(ctx)
 		if err == nil {
 			limitBytes = quotaInfo.Limit
-			if quotaInfo.Total != nil {
-				usageBytes = quotaInfo.Total.Bytes[UsageWrite]
-			} else {
-				usageBytes = 0
-			}
+			usageBytes = quotaInfo.UsedBytes()
 		}
 	}
 	failures, ch := fs.currentStatus.CurrentStatus()
@@ -560,59 +1024,437 @@ func (fs *KBFSOpsStandard) Status(ctx context.Context) (
 		status := jServer.Status()
 		jServerStatus = &status
 	}
+	var diskLimiterStatus *DiskLimiterStatus
+	if limiter := getDiskLimiter(fs.config); limiter != nil {
+		status := limiter.status()
+		diskLimiterStatus = &status
+	}
+	rekeys := fs.rekeyStatuses(ctx)
 	return KBFSStatus{
 		CurrentUser:     username.String(),
 		IsConnected:     fs.config.MDServer().IsConnected(),
+		Offline:         fs.config.Offline(),
+		NetworkState:    fs.config.NetworkState().String(),
 		UsageBytes:      usageBytes,
 		LimitBytes:      limitBytes,
 		FailingServices: failures,
 		JournalServer:   jServerStatus,
+		DiskLimiter:     diskLimiterStatus,
+		Rekeys:          rekeys,
+		Crypto:          fs.config.CryptoCapabilities(),
+		BlockTransfers:  fs.config.BlockTransferMeter().Status(),
 	}, ch, err
 }
 
+// OpenFolderBranches returns the folder-branches that have been
+// opened on this device, and not evicted since, for diagnostics.
+func (fs *KBFSOpsStandard) OpenFolderBranches() []FolderBranch {
+	fs.opsLock.RLock()
+	defer fs.opsLock.RUnlock()
+	fbs := make([]FolderBranch, 0, len(fs.ops))
+	for fb := range fs.ops {
+		fbs = append(fbs, fb)
+	}
+	return fbs
+}
+
+func (fs *KBFSOpsStandard) rekeyStatuses(
+	ctx context.Context) map[string]TLFRekeyStatus {
+	fs.opsLock.RLock()
+	opses := make([]*folderBranchOps, 0, len(fs.ops))
+	for _, ops := range fs.ops {
+		opses = append(opses, ops)
+	}
+	fs.opsLock.RUnlock()
+
+	var rekeys map[string]TLFRekeyStatus
+	for _, ops := range opses {
+		if _, _, ok := ops.status.getRekeyStatus(); !ok {
+			continue
+		}
+		ops.status.updatePendingDevices(ctx)
+		status, tlfPath, ok := ops.status.getRekeyStatus()
+		if !ok {
+			continue
+		}
+		if rekeys == nil {
+			rekeys = make(map[string]TLFRekeyStatus)
+		}
+		rekeys[tlfPath] = status
+	}
+	return rekeys
+}
+
 // UnstageForTesting implements the KBFSOps interface for KBFSOpsStandard
 // TODO: remove once we have automatic conflict resolution
 func (fs *KBFSOpsStandard) UnstageForTesting(
 	ctx context.Context, folderBranch FolderBranch) error {
-	ops := fs.getOps(ctx, folderBranch)
+	ctx, done := fs.startOp(ctx, "KBFSOps.UnstageForTesting")
+	defer done()
+	ops, release := fs.getOps(ctx, folderBranch)
+	defer release()
 	return ops.UnstageForTesting(ctx, folderBranch)
 }
 
+// SetManualConflictResolution implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) SetManualConflictResolution(
+	ctx context.Context, folderBranch FolderBranch, manual bool) error {
+	ctx, done := fs.startOp(ctx, "KBFSOps.SetManualConflictResolution")
+	defer done()
+	ops, release := fs.getOps(ctx, folderBranch)
+	defer release()
+	return ops.SetManualConflictResolution(ctx, folderBranch, manual)
+}
+
+// ResolveMerged implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) ResolveMerged(
+	ctx context.Context, folderBranch FolderBranch) error {
+	ctx, done := fs.startOp(ctx, "KBFSOps.ResolveMerged")
+	defer done()
+	ops, release := fs.getOps(ctx, folderBranch)
+	defer release()
+	return ops.ResolveMerged(ctx, folderBranch)
+}
+
+// ResolveKeepLocal implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) ResolveKeepLocal(
+	ctx context.Context, folderBranch FolderBranch) error {
+	ctx, done := fs.startOp(ctx, "KBFSOps.ResolveKeepLocal")
+	defer done()
+	ops, release := fs.getOps(ctx, folderBranch)
+	defer release()
+	return ops.ResolveKeepLocal(ctx, folderBranch)
+}
+
+// ResolveKeepRemote implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) ResolveKeepRemote(
+	ctx context.Context, folderBranch FolderBranch) error {
+	ctx, done := fs.startOp(ctx, "KBFSOps.ResolveKeepRemote")
+	defer done()
+	ops, release := fs.getOps(ctx, folderBranch)
+	defer release()
+	return ops.ResolveKeepRemote(ctx, folderBranch)
+}
+
+// PreviewConflictResolution implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) PreviewConflictResolution(
+	ctx context.Context, folderBranch FolderBranch) (ConflictPreview, error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.PreviewConflictResolution")
+	defer done()
+	ops, release := fs.getOps(ctx, folderBranch)
+	defer release()
+	return ops.PreviewConflictResolution(ctx, folderBranch)
+}
+
+// PauseWrites implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) PauseWrites(
+	ctx context.Context, folderBranch FolderBranch) error {
+	ctx, done := fs.startOp(ctx, "KBFSOps.PauseWrites")
+	defer done()
+	ops, release := fs.getOps(ctx, folderBranch)
+	defer release()
+	return ops.PauseWrites(ctx, folderBranch)
+}
+
+// ResumeWrites implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) ResumeWrites(
+	ctx context.Context, folderBranch FolderBranch) error {
+	ctx, done := fs.startOp(ctx, "KBFSOps.ResumeWrites")
+	defer done()
+	ops, release := fs.getOps(ctx, folderBranch)
+	defer release()
+	return ops.ResumeWrites(ctx, folderBranch)
+}
+
+// WriteFence implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) WriteFence(ctx context.Context,
+	folderBranch FolderBranch, durability WriteDurability) (
+	*WriteFence, error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.WriteFence")
+	defer done()
+	ops, release := fs.getOps(ctx, folderBranch)
+	defer release()
+	return ops.WriteFence(ctx, folderBranch, durability)
+}
+
+// LockRange implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) LockRange(
+	ctx context.Context, file Node, lock RangeLock) error {
+	ctx, done := fs.startOp(ctx, "KBFSOps.LockRange")
+	defer done()
+	ops, release := fs.getOpsByNode(ctx, file)
+	defer release()
+	return ops.LockRange(ctx, file, lock)
+}
+
+// UnlockRange implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) UnlockRange(
+	ctx context.Context, file Node, lock RangeLock) error {
+	ctx, done := fs.startOp(ctx, "KBFSOps.UnlockRange")
+	defer done()
+	ops, release := fs.getOpsByNode(ctx, file)
+	defer release()
+	return ops.UnlockRange(ctx, file, lock)
+}
+
+// GetRangeLockConflict implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetRangeLockConflict(
+	ctx context.Context, file Node, lock RangeLock) (*RangeLock, error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.GetRangeLockConflict")
+	defer done()
+	ops, release := fs.getOpsByNode(ctx, file)
+	defer release()
+	return ops.GetRangeLockConflict(ctx, file, lock)
+}
+
+// AuditTLF implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) AuditTLF(
+	ctx context.Context, handle *TlfHandle) (TLFAuditReport, error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.AuditTLF")
+	defer done()
+	_, md, id, err := fs.getOrInitializeNewMDMaster(
+		ctx, fs.config.MDOps(), handle, false)
+	if err != nil {
+		return TLFAuditReport{}, err
+	}
+	if md == (ImmutableRootMetadata{}) {
+		// Nothing has been written yet, so there's nothing to check.
+		return TLFAuditReport{Tlf: id}, nil
+	}
+	return auditTLF(ctx, fs.config, md)
+}
+
+// FsckTLF implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) FsckTLF(ctx context.Context, handle *TlfHandle,
+	repair bool) (TLFFsckReport, error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.FsckTLF")
+	defer done()
+	_, md, id, err := fs.getOrInitializeNewMDMaster(
+		ctx, fs.config.MDOps(), handle, false)
+	if err != nil {
+		return TLFFsckReport{}, err
+	}
+	if md == (ImmutableRootMetadata{}) {
+		// Nothing has been written yet, so there's nothing to check.
+		return TLFFsckReport{Audit: TLFAuditReport{Tlf: id}}, nil
+	}
+	return fsckTLF(ctx, fs.config, md, repair)
+}
+
 // Rekey implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Rekey(ctx context.Context, id TlfID) error {
+	ctx, done := fs.startOp(ctx, "KBFSOps.Rekey")
+	defer done()
 	// We currently only support rekeys of master branches.
-	ops := fs.getOpsNoAdd(FolderBranch{Tlf: id, Branch: MasterBranch})
+	ops, release := fs.getOpsRef(FolderBranch{Tlf: id, Branch: MasterBranch})
+	defer release()
 	return ops.Rekey(ctx, id)
 }
 
+// RotateKeyGeneration implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) RotateKeyGeneration(
+	ctx context.Context, id TlfID) error {
+	ctx, done := fs.startOp(ctx, "KBFSOps.RotateKeyGeneration")
+	defer done()
+	// Like rekeys, this only makes sense on master branches.
+	ops, release := fs.getOpsRef(FolderBranch{Tlf: id, Branch: MasterBranch})
+	defer release()
+	return ops.RotateKeyGeneration(ctx, id)
+}
+
 // SyncFromServerForTesting implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) SyncFromServerForTesting(
 	ctx context.Context, folderBranch FolderBranch) error {
-	ops := fs.getOps(ctx, folderBranch)
+	ctx, done := fs.startOp(ctx, "KBFSOps.SyncFromServerForTesting")
+	defer done()
+	ops, release := fs.getOps(ctx, folderBranch)
+	defer release()
 	return ops.SyncFromServerForTesting(ctx, folderBranch)
 }
 
 // GetUpdateHistory implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) GetUpdateHistory(ctx context.Context,
 	folderBranch FolderBranch) (history TLFUpdateHistory, err error) {
-	ops := fs.getOps(ctx, folderBranch)
+	ctx, done := fs.startOp(ctx, "KBFSOps.GetUpdateHistory")
+	defer done()
+	ops, release := fs.getOps(ctx, folderBranch)
+	defer release()
 	return ops.GetUpdateHistory(ctx, folderBranch)
 }
 
 // GetEditHistory implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) GetEditHistory(ctx context.Context,
 	folderBranch FolderBranch) (edits TlfWriterEdits, err error) {
-	ops := fs.getOps(ctx, folderBranch)
+	ctx, done := fs.startOp(ctx, "KBFSOps.GetEditHistory")
+	defer done()
+	ops, release := fs.getOps(ctx, folderBranch)
+	defer release()
 	return ops.GetEditHistory(ctx, folderBranch)
 }
 
+// GetFileHistory implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetFileHistory(
+	ctx context.Context, file Node, limit int) ([]FileVersion, error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.GetFileHistory")
+	defer done()
+	ops, release := fs.getOpsByNode(ctx, file)
+	defer release()
+	return ops.GetFileHistory(ctx, file, limit)
+}
+
+// OpenFileAtRevision implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) OpenFileAtRevision(
+	ctx context.Context, file Node, rev MetadataRevision) (
+	*FileVersionReader, error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.OpenFileAtRevision")
+	defer done()
+	ops, release := fs.getOpsByNode(ctx, file)
+	defer release()
+	return ops.OpenFileAtRevision(ctx, file, rev)
+}
+
+// BeginReadSnapshot implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) BeginReadSnapshot(
+	ctx context.Context, folderBranch FolderBranch) (*ReadSnapshot, error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.BeginReadSnapshot")
+	defer done()
+	ops, release := fs.getOps(ctx, folderBranch)
+	defer release()
+	return ops.BeginReadSnapshot(ctx, folderBranch)
+}
+
+// BeginReadSnapshotAtRevision implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) BeginReadSnapshotAtRevision(
+	ctx context.Context, folderBranch FolderBranch, rev MetadataRevision) (
+	*ReadSnapshot, error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.BeginReadSnapshotAtRevision")
+	defer done()
+	ops, release := fs.getOps(ctx, folderBranch)
+	defer release()
+	return ops.BeginReadSnapshotAtRevision(ctx, folderBranch, rev)
+}
+
+// GetRevisionAtTime implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetRevisionAtTime(
+	ctx context.Context, folderBranch FolderBranch, t time.Time) (
+	MetadataRevision, error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.GetRevisionAtTime")
+	defer done()
+	ops, release := fs.getOps(ctx, folderBranch)
+	defer release()
+	return ops.GetRevisionAtTime(ctx, folderBranch, t)
+}
+
+// SetTrashRetention implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) SetTrashRetention(
+	ctx context.Context, root Node, retention time.Duration) error {
+	ctx, done := fs.startOp(ctx, "KBFSOps.SetTrashRetention")
+	defer done()
+	ops, release := fs.getOpsByNode(ctx, root)
+	defer release()
+	return ops.SetTrashRetention(ctx, root, retention)
+}
+
+// ListTrash implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) ListTrash(ctx context.Context, root Node) (
+	[]TrashEntry, error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.ListTrash")
+	defer done()
+	ops, release := fs.getOpsByNode(ctx, root)
+	defer release()
+	return ops.ListTrash(ctx, root)
+}
+
+// Undelete implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) Undelete(
+	ctx context.Context, root Node, id string) error {
+	ctx, done := fs.startOp(ctx, "KBFSOps.Undelete")
+	defer done()
+	ops, release := fs.getOpsByNode(ctx, root)
+	defer release()
+	return ops.Undelete(ctx, root, id)
+}
+
+// SetWriterSharding implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) SetWriterSharding(
+	ctx context.Context, dir Node, sharded bool) error {
+	ctx, done := fs.startOp(ctx, "KBFSOps.SetWriterSharding")
+	defer done()
+	ops, release := fs.getOpsByNode(ctx, dir)
+	defer release()
+	return ops.SetWriterSharding(ctx, dir, sharded)
+}
+
 // GetNodeMetadata implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) GetNodeMetadata(ctx context.Context, node Node) (
 	NodeMetadata, error) {
-	ops := fs.getOpsByNode(ctx, node)
+	ctx, done := fs.startOp(ctx, "KBFSOps.GetNodeMetadata")
+	defer done()
+	ops, release := fs.getOpsByNode(ctx, node)
+	defer release()
 	return ops.GetNodeMetadata(ctx, node)
 }
 
+// GetSubtreeUsage implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetSubtreeUsage(ctx context.Context, node Node) (
+	SubtreeUsage, error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.GetSubtreeUsage")
+	defer done()
+	ops, release := fs.getOpsByNode(ctx, node)
+	defer release()
+	return ops.GetSubtreeUsage(ctx, node)
+}
+
+// SetSyncSubscription implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) SetSyncSubscription(
+	ctx context.Context, node Node, subscribed bool) error {
+	ctx, done := fs.startOp(ctx, "KBFSOps.SetSyncSubscription")
+	defer done()
+	ops, release := fs.getOpsByNode(ctx, node)
+	defer release()
+	return ops.SetSyncSubscription(ctx, node, subscribed)
+}
+
+// GetSyncStatus implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetSyncStatus(
+	ctx context.Context, folderBranch FolderBranch) (TLFSyncStatus, error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.GetSyncStatus")
+	defer done()
+	ops, release := fs.getOps(ctx, folderBranch)
+	defer release()
+	return ops.GetSyncStatus(ctx, folderBranch)
+}
+
+// GetUserQuotaInfo implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetUserQuotaInfo(ctx context.Context) (
+	*UserQuotaInfo, error) {
+	ctx, done := fs.startOp(ctx, "KBFSOps.GetUserQuotaInfo")
+	defer done()
+	return fs.quotaUsage.Get(ctx)
+}
+
+var _ reconnectListener = (*KBFSOpsStandard)(nil)
+
+// onReconnect implements the reconnectListener interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) onReconnect(ctx context.Context) {
+	fs.opsLock.RLock()
+	defer fs.opsLock.RUnlock()
+	for _, ops := range fs.ops {
+		ops.onReconnect(ctx)
+	}
+}
+
 // Notifier:
 var _ Notifier = (*KBFSOpsStandard)(nil)
 
@@ -621,7 +1463,8 @@ func (fs *KBFSOpsStandard) RegisterForChanges(
 	folderBranches []FolderBranch, obs Observer) error {
 	for _, fb := range folderBranches {
 		// TODO: add branch parameter to notifier interface
-		ops := fs.getOpsNoAdd(fb)
+		ops, release := fs.getOpsRef(fb)
+		defer release()
 		return ops.RegisterForChanges(obs)
 	}
 	return nil
@@ -632,16 +1475,21 @@ func (fs *KBFSOpsStandard) UnregisterFromChanges(
 	folderBranches []FolderBranch, obs Observer) error {
 	for _, fb := range folderBranches {
 		// TODO: add branch parameter to notifier interface
-		ops := fs.getOpsNoAdd(fb)
+		ops, release := fs.getOpsRef(fb)
+		defer release()
 		return ops.UnregisterFromChanges(obs)
 	}
 	return nil
 }
 
 func (fs *KBFSOpsStandard) onTLFBranchChange(tlfID TlfID, newBID BranchID) {
-	ops := fs.getOpsNoAdd(FolderBranch{Tlf: tlfID, Branch: MasterBranch})
+	ops, release := fs.getOpsRef(
+		FolderBranch{Tlf: tlfID, Branch: MasterBranch})
 	// Launch in a new goroutine to avoid deadlocks.
-	go ops.onTLFBranchChange(newBID)
+	go func() {
+		defer release()
+		ops.onTLFBranchChange(newBID)
+	}()
 }
 
 func (fs *KBFSOpsStandard) onMDFlush(tlfID TlfID, bid BranchID,
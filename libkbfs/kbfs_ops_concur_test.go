@@ -12,7 +12,6 @@ import (
 	"testing"
 	"time"
 
-	"github.com/golang/mock/gomock"
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/logger"
 	"github.com/keybase/client/go/protocol/keybase1"
@@ -517,6 +516,11 @@ func (km *mdRecordingKeyManager) GetTLFCryptKeyOfAllGenerations(
 	return km.delegate.GetTLFCryptKeyOfAllGenerations(ctx, kmd)
 }
 
+func (km *mdRecordingKeyManager) GetExtraMetadata(
+	ctx context.Context, md BareRootMetadata) (ExtraMetadata, error) {
+	return km.delegate.GetExtraMetadata(ctx, md)
+}
+
 func (km *mdRecordingKeyManager) Rekey(
 	ctx context.Context, md *RootMetadata, promptPaper bool) (
 	bool, *TLFCryptKey, error) {
@@ -524,6 +528,12 @@ func (km *mdRecordingKeyManager) Rekey(
 	return km.delegate.Rekey(ctx, md, promptPaper)
 }
 
+func (km *mdRecordingKeyManager) RekeyWithNewKeyGeneration(
+	ctx context.Context, md *RootMetadata) (bool, *TLFCryptKey, error) {
+	km.setLastKMD(md)
+	return km.delegate.RekeyWithNewKeyGeneration(ctx, md)
+}
+
 // Test that a sync can happen concurrently with a write. This is a
 // regression test for KBFS-558.
 func TestKBFSOpsConcurBlockSyncWrite(t *testing.T) {
@@ -557,7 +567,12 @@ func TestKBFSOpsConcurBlockSyncWrite(t *testing.T) {
 	lState := makeFBOLockState()
 
 	fbo := kbfsOps.(*KBFSOpsStandard).getOpsNoAdd(rootNode.GetFolderBranch())
-	if fbo.blocks.GetState(lState) != dirtyState {
+	state, err := GetFolderBranchOpsStateForTesting(
+		config, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't get state: %v", err)
+	}
+	if !state.Dirty {
 		t.Fatal("Unexpectedly not in dirty state")
 	}
 
@@ -582,10 +597,14 @@ func TestKBFSOpsConcurBlockSyncWrite(t *testing.T) {
 		t.Errorf("Couldn't write file: %v", err)
 	}
 
-	deferredWriteCount := fbo.blocks.getDeferredWriteCountForTest(lState)
-	if deferredWriteCount != 1 {
+	state, err = GetFolderBranchOpsStateForTesting(
+		config, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't get state: %v", err)
+	}
+	if state.DeferredWrites != 1 {
 		t.Errorf("Unexpected deferred write count %d",
-			deferredWriteCount)
+			state.DeferredWrites)
 	}
 
 	// Unstall the sync.
@@ -645,7 +664,12 @@ func TestKBFSOpsConcurBlockSyncTruncate(t *testing.T) {
 	lState := makeFBOLockState()
 
 	fbo := kbfsOps.(*KBFSOpsStandard).getOpsNoAdd(rootNode.GetFolderBranch())
-	if fbo.blocks.GetState(lState) != dirtyState {
+	state, err := GetFolderBranchOpsStateForTesting(
+		config, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't get state: %v", err)
+	}
+	if !state.Dirty {
 		t.Fatal("Unexpectedly not in dirty state")
 	}
 
@@ -670,10 +694,14 @@ func TestKBFSOpsConcurBlockSyncTruncate(t *testing.T) {
 		t.Errorf("Couldn't truncate file: %v", err)
 	}
 
-	deferredWriteCount := fbo.blocks.getDeferredWriteCountForTest(lState)
-	if deferredWriteCount != 1 {
+	state, err = GetFolderBranchOpsStateForTesting(
+		config, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't get state: %v", err)
+	}
+	if state.DeferredWrites != 1 {
 		t.Errorf("Unexpected deferred write count %d",
-			deferredWriteCount)
+			state.DeferredWrites)
 	}
 
 	// Unstall the sync.
@@ -919,9 +947,8 @@ func TestKBFSOpsConcurWriteParallelBlocksCanceled(t *testing.T) {
 	defer CleanupCancellationDelayer(ctx)
 	defer CheckConfigAndShutdown(t, config)
 
-	// give it a remote block server with a fake client
-	fc := NewFakeBServerClient(config, nil, nil, nil)
-	b := newBlockServerRemoteWithClient(config, fc)
+	// give it a fake block server
+	b := newFakeBlockServer(config)
 	config.BlockServer().Shutdown()
 	config.SetBlockServer(b)
 
@@ -952,16 +979,13 @@ func TestKBFSOpsConcurWriteParallelBlocksCanceled(t *testing.T) {
 		t.Errorf("Couldn't write file: %v", err)
 	}
 
-	// now set a control channel, let a couple blocks go in, and then
+	// now hold puts at a gate, let a couple blocks go in, and then
 	// cancel the context
-	readyChan := make(chan struct{})
-	goChan := make(chan struct{})
-	finishChan := make(chan struct{})
-	fc.readyChan = readyChan
-	fc.goChan = goChan
-	fc.finishChan = finishChan
-
-	prevNBlocks := fc.numBlocks()
+	gate := newFakeBlockServerGate()
+	readyChan, goChan, finishChan := gate.ready, gate.proceed, gate.finished
+	b.setDefault(fakeBServerPut, fakeBlockServerStep{gate: gate})
+
+	prevNBlocks := b.numBlocks()
 	ctx, cancel := context.WithCancel(ctx)
 	go func() {
 		// let the first initialBlocks blocks through.
@@ -996,7 +1020,7 @@ func TestKBFSOpsConcurWriteParallelBlocksCanceled(t *testing.T) {
 	if err != context.Canceled {
 		t.Errorf("Sync did not get canceled error: %v", err)
 	}
-	nowNBlocks := fc.numBlocks()
+	nowNBlocks := b.numBlocks()
 	if nowNBlocks != prevNBlocks+2 {
 		t.Errorf("Unexpected number of blocks; prev = %d, now = %d",
 			prevNBlocks, nowNBlocks)
@@ -1017,9 +1041,7 @@ func TestKBFSOpsConcurWriteParallelBlocksCanceled(t *testing.T) {
 
 	// As a regression for KBFS-635, test that a second sync succeeds,
 	// and that future operations also succeed.
-	fc.readyChan = nil
-	fc.goChan = nil
-	fc.finishChan = nil
+	b.setDefault(fakeBServerPut, fakeBlockServerStep{})
 	ctx = BackgroundContextWithCancellationDelayer()
 	defer CleanupCancellationDelayer(ctx)
 	if err := kbfsOps.Sync(ctx, fileNode); err != nil {
@@ -1029,11 +1051,111 @@ func TestKBFSOpsConcurWriteParallelBlocksCanceled(t *testing.T) {
 	if _, _, err := kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl); err != nil {
 		t.Fatalf("Couldn't create file after sync: %v", err)
 	}
+	if n := b.maxInFlight(fakeBServerPut); n > maxParallelBlockPuts {
+		t.Errorf("%d puts ran at once; expected at most %d", n,
+			maxParallelBlockPuts)
+	}
+	if err := b.checkInvariants(); err != nil {
+		t.Error(err)
+	}
 
 	// Avoid checking state when using a fake block server.
 	config.MDServer().Shutdown()
 }
 
+// blockOpsHoldReady holds the holdAt'th call to Ready (counting
+// from 1) until release is closed.
+type blockOpsHoldReady struct {
+	BlockOps
+	release <-chan struct{}
+
+	lock    sync.Mutex
+	readies int
+	holdAt  int
+}
+
+func (b *blockOpsHoldReady) Ready(ctx context.Context, kmd KeyMetadata,
+	block Block) (BlockID, int, ReadyBlockData, error) {
+	b.lock.Lock()
+	b.readies++
+	hold := b.readies == b.holdAt
+	b.lock.Unlock()
+	if hold {
+		select {
+		case <-b.release:
+		case <-time.After(10 * time.Second):
+			return BlockID{}, 0, ReadyBlockData{},
+				errors.New("Timed out waiting for a put")
+		case <-ctx.Done():
+			return BlockID{}, 0, ReadyBlockData{}, ctx.Err()
+		}
+	}
+	return b.BlockOps.Ready(ctx, kmd, block)
+}
+
+// bserverPutSignal closes putStarted when its first Put starts.
+type bserverPutSignal struct {
+	BlockServer
+	once       sync.Once
+	putStarted chan struct{}
+}
+
+func (b *bserverPutSignal) Put(ctx context.Context, tlfID TlfID, id BlockID,
+	context BlockContext, buf []byte,
+	serverHalf BlockCryptKeyServerHalf) error {
+	b.once.Do(func() { close(b.putStarted) })
+	return b.BlockServer.Put(ctx, tlfID, id, context, buf, serverHalf)
+}
+
+// Test that a sync starts putting the first blocks of a file while
+// later ones are still being readied.
+func TestKBFSOpsConcurSyncPipelinesPuts(t *testing.T) {
+	config, _, ctx := kbfsOpsConcurInit(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	// make blocks small, and ready them one at a time
+	blockSize := int64(5)
+	config.BlockSplitter().(*BlockSplitterSimple).maxSize = blockSize
+	caps := config.CryptoCapabilities()
+	caps.BlockReadyWorkers = 1
+	config.SetCryptoCapabilities(caps)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	data := make([]byte, 4*blockSize)
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+
+	// Hold the readying of the second block until the first one
+	// is being put.
+	bserv := &bserverPutSignal{
+		BlockServer: config.BlockServer(),
+		putStarted:  make(chan struct{}),
+	}
+	config.SetBlockServer(bserv)
+	bops := &blockOpsHoldReady{
+		BlockOps: config.BlockOps(),
+		release:  bserv.putStarted,
+		holdAt:   2,
+	}
+	config.SetBlockOps(bops)
+
+	err = kbfsOps.Sync(ctx, fileNode)
+	if err != nil {
+		t.Fatalf("Couldn't sync file: %v", err)
+	}
+
+	config.SetBlockOps(bops.BlockOps)
+	config.SetBlockServer(bserv.BlockServer)
+}
+
 // Test that, when writing multiple blocks in parallel, one error will
 // cancel the remaining puts.
 func TestKBFSOpsConcurWriteParallelBlocksError(t *testing.T) {
@@ -1041,21 +1163,11 @@ func TestKBFSOpsConcurWriteParallelBlocksError(t *testing.T) {
 	defer CleanupCancellationDelayer(ctx)
 	defer CheckConfigAndShutdown(t, config)
 
-	// give it a mock'd block server
-	ctr := NewSafeTestReporter(t)
-	mockCtrl := gomock.NewController(ctr)
-	defer mockCtrl.Finish()
-	defer ctr.CheckForFailures()
-	b := NewMockBlockServer(mockCtrl)
+	// give it a fake block server
+	b := newFakeBlockServer(config)
 	config.BlockServer().Shutdown()
 	config.SetBlockServer(b)
 
-	// from the folder creation, then 2 for file creation
-	c := b.EXPECT().Put(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(),
-		gomock.Any(), gomock.Any()).Times(3).Return(nil)
-	b.EXPECT().ArchiveBlockReferences(gomock.Any(), gomock.Any(),
-		gomock.Any()).AnyTimes().Return(nil)
-
 	// make blocks small
 	blockSize := int64(5)
 	config.BlockSplitter().(*BlockSplitterSimple).maxSize = blockSize
@@ -1079,45 +1191,26 @@ func TestKBFSOpsConcurWriteParallelBlocksError(t *testing.T) {
 		t.Errorf("Couldn't write file: %v", err)
 	}
 
-	// let two blocks through and fail the third:
-	c = b.EXPECT().Put(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(),
-		gomock.Any(), gomock.Any()).Times(2).After(c).Return(nil)
+	// let two blocks through and fail the third, and hold the rest
+	// until the failure cancels them.
 	putErr := errors.New("This is a forced error on put")
-	errPtrChan := make(chan BlockPointer)
-	c = b.EXPECT().Put(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(),
-		gomock.Any(), gomock.Any()).
-		Do(func(ctx context.Context, tlfID TlfID, id BlockID,
-			context BlockContext, buf []byte,
-			serverHalf BlockCryptKeyServerHalf) {
-			errPtrChan <- BlockPointer{
-				ID:           id,
-				BlockContext: context,
-			}
-		}).After(c).Return(putErr)
-	// let the rest through
-	proceedChan := make(chan struct{})
-	b.EXPECT().Put(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(),
-		gomock.Any(), gomock.Any()).AnyTimes().
-		Do(func(ctx context.Context, tlfID TlfID, id BlockID,
-			context BlockContext, buf []byte,
-			serverHalf BlockCryptKeyServerHalf) {
-			<-proceedChan
-		}).After(c).Return(nil)
-	b.EXPECT().Shutdown().AnyTimes()
-
-	var errPtr BlockPointer
-	go func() {
-		errPtr = <-errPtrChan
-		close(proceedChan)
-	}()
+	b.script(fakeBServerPut, fakeBlockServerStep{}, fakeBlockServerStep{},
+		fakeBlockServerStep{err: putErr})
+	b.setDefault(fakeBServerPut, fakeBlockServerStep{
+		gate: &fakeBlockServerGate{proceed: make(chan struct{})},
+	})
 
 	err = kbfsOps.Sync(ctx, fileNode)
 	if err != putErr {
 		t.Errorf("Sync did not get the expected error: %v", err)
 	}
 
-	// wait for proceedChan to close, so we know the errPtr has been set
-	<-proceedChan
+	var errPtr BlockPointer
+	for _, call := range b.getCalls() {
+		if call.op == fakeBServerPut && call.err == putErr {
+			errPtr = BlockPointer{ID: call.id, BlockContext: call.ctx}
+		}
+	}
 
 	// Make sure the error'd file didn't make it to the actual cache
 	// -- it's still in the permanent cache because the file might
@@ -1127,8 +1220,9 @@ func TestKBFSOpsConcurWriteParallelBlocksError(t *testing.T) {
 		t.Errorf("Failed block put for %v left block in cache", errPtr)
 	}
 
-	// State checking won't happen on the mock block server since we
-	// leave ourselves in a dirty state.
+	// Avoid checking state, since we leave ourselves in a dirty
+	// state.
+	config.MDServer().Shutdown()
 }
 
 // Test that writes that happen on a multi-block file concurrently
@@ -1394,6 +1488,7 @@ func TestKBFSOpsConcurCanceledSyncSucceeds(t *testing.T) {
 
 	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
 	unpauseDeleting := make(chan struct{})
+	ops.fbm.startDeleting()
 	ops.fbm.blocksToDeletePauseChan <- unpauseDeleting
 
 	// start the sync
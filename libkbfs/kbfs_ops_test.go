@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"runtime"
 	"testing"
 	"time"
 
@@ -97,6 +98,10 @@ func kbfsOpsInit(t *testing.T, changeMd bool) (mockCtrl *gomock.Controller,
 	config.mockKbpki.EXPECT().FavoriteAdd(gomock.Any(), gomock.Any()).
 		AnyTimes().Return(nil)
 
+	// None of these tests have enough blocks in a file to need more
+	// than one level of indirect blocks.
+	config.mockBsplit.EXPECT().MaxPtrsPerBlock().AnyTimes().Return(1 << 20)
+
 	interposeDaemonKBPKI(config, "alice", "bob", "charlie")
 
 	// make the context identifiable, to verify that it is passed
@@ -5178,6 +5183,42 @@ func TestKBFSOpsBackgroundFlush(t *testing.T) {
 	<-c
 }
 
+func TestKBFSOpsBackgroundFlushAge(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+	clock, t0 := newTestClockAndTimeNow()
+	config.SetClock(clock)
+	config.SetBackgroundFlushAge(30 * time.Second)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1}, 0)
+	require.NoError(t, err)
+
+	// A freshly dirtied file is left alone, unless the flush is
+	// forced by a full buffer.
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	require.Len(t, ops.getBackgroundFlushRefs(ctx, lState, false), 0)
+	require.Len(t, ops.getBackgroundFlushRefs(ctx, lState, true), 1)
+
+	// Once it's old enough, the background flusher syncs it.
+	clock.Set(t0.Add(30 * time.Second))
+	require.Len(t, ops.getBackgroundFlushRefs(ctx, lState, false), 1)
+	go ops.backgroundFlusher(1 * time.Millisecond)
+	deadline := time.Now().Add(10 * time.Second)
+	for ops.blocks.GetState(lState) != cleanState {
+		require.True(t, time.Now().Before(deadline),
+			"Timed out waiting for the background flush")
+		time.Sleep(10 * time.Millisecond)
+	}
+	status, _, err := kbfsOps.FolderStatus(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	require.Len(t, status.DirtyPaths, 0)
+}
+
 func TestKBFSOpsWriteRenameStat(t *testing.T) {
 	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
 	defer CleanupCancellationDelayer(ctx)
@@ -5271,6 +5312,57 @@ func TestKBFSOpsWriteRenameGetDirChildren(t *testing.T) {
 	}
 }
 
+func TestKBFSOpsBatchStat(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer config.Shutdown()
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	// Leave the write unsynced, so the dirty entry is what's stat'd.
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2}, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write to file: %v", err)
+	}
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "d")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %v", err)
+	}
+
+	eis, errs, err := kbfsOps.BatchStat(
+		ctx, rootNode, []string{"a", "missing", "d"})
+	if err != nil {
+		t.Fatalf("Couldn't batch stat: %v", err)
+	}
+	children, err := kbfsOps.GetDirChildren(ctx, rootNode)
+	if err != nil {
+		t.Fatalf("Couldn't get children: %v", err)
+	}
+	for _, name := range []string{"a", "d"} {
+		if eis[name] != children[name] {
+			t.Errorf("Entry info for %s was %+v, not %+v",
+				name, eis[name], children[name])
+		}
+	}
+	if eis["a"].Size != 2 {
+		t.Errorf("Size %d unexpectedly not 2", eis["a"].Size)
+	}
+	if _, ok := eis["missing"]; ok {
+		t.Errorf("Got entry info for a missing name")
+	}
+	if len(errs) != 1 {
+		t.Errorf("Unexpected errors: %v", errs)
+	}
+	if _, ok := errs["missing"].(NoSuchNameError); !ok {
+		t.Errorf("Unexpected error for a missing name: %v", errs["missing"])
+	}
+}
+
 func TestKBFSOpsCreateFileWithArchivedBlock(t *testing.T) {
 	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
 	defer CleanupCancellationDelayer(ctx)
@@ -5432,6 +5524,30 @@ func TestKBFSOpsEmptyTlfSize(t *testing.T) {
 	}
 }
 
+func TestKBFSOpsFolderStatusHealth(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte("hello"), 0)
+	require.NoError(t, err)
+
+	status, _, err := kbfsOps.FolderStatus(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	require.True(t, status.IsConnected)
+	require.False(t, status.Staged)
+	require.False(t, status.CRInProgress)
+	require.Equal(t, MetadataRevisionInitial+1, status.Revision)
+	require.Len(t, status.DirtyPaths, 1)
+
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+}
+
 type cryptoFixedTlf struct {
 	Crypto
 	tlf TlfID
@@ -5491,3 +5607,625 @@ func TestKBFSOpsMaliciousMDServerRange(t *testing.T) {
 	// have MDOps do the handle check, that'll trigger first.
 	require.IsType(t, MDPrevRootMismatch{}, err)
 }
+
+func TestKBFSOpsPauseWrites(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer config.Shutdown()
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	fb := rootNode.GetFolderBranch()
+
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1}, 0)
+	require.NoError(t, err)
+
+	err = kbfsOps.PauseWrites(ctx, fb)
+	require.NoError(t, err)
+	status, _, err := kbfsOps.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	require.True(t, status.WritesPaused)
+
+	// Every mutating operation should now fail...
+	expectedErr := WritesPausedError{fb.Tlf}
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	require.Equal(t, expectedErr, err)
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "c")
+	require.Equal(t, expectedErr, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{2}, 1)
+	require.Equal(t, expectedErr, err)
+	err = kbfsOps.Rename(ctx, rootNode, "a", rootNode, "b")
+	require.Equal(t, expectedErr, err)
+	err = kbfsOps.RemoveEntry(ctx, rootNode, "a")
+	require.Equal(t, expectedErr, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.Equal(t, expectedErr, err)
+
+	// ...but reads still work.
+	buf := make([]byte, 1)
+	n, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), n)
+	rootEntries, err := kbfsOps.GetDirChildren(ctx, rootNode)
+	require.NoError(t, err)
+	require.Len(t, rootEntries, 1)
+
+	err = kbfsOps.ResumeWrites(ctx, fb)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	// Once the file is clean, syncing it is fine even while paused.
+	err = kbfsOps.PauseWrites(ctx, fb)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	err = kbfsOps.ResumeWrites(ctx, fb)
+	require.NoError(t, err)
+	status, _, err = kbfsOps.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	require.False(t, status.WritesPaused)
+}
+
+func TestKBFSOpsWriteFence(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer config.Shutdown()
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	fb := rootNode.GetFolderBranch()
+
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1}, 0)
+	require.NoError(t, err)
+
+	// A fence can't be released while writes are paused and the
+	// file is still dirty.
+	err = kbfsOps.PauseWrites(ctx, fb)
+	require.NoError(t, err)
+	wf, err := kbfsOps.WriteFence(ctx, fb, WriteDurabilityServer)
+	require.NoError(t, err)
+	err = wf.Wait(ctx)
+	require.Equal(t, WritesPausedError{fb.Tlf}, err)
+	require.True(t, wf.Released())
+	require.Equal(t, err, wf.Err())
+
+	err = kbfsOps.ResumeWrites(ctx, fb)
+	require.NoError(t, err)
+	wf, err = kbfsOps.WriteFence(ctx, fb, WriteDurabilityServer)
+	require.NoError(t, err)
+	err = wf.Wait(ctx)
+	require.NoError(t, err)
+	require.Equal(t, WriteDurabilityServer, wf.Durability())
+
+	// The write made before the fence should now be on the server.
+	ops := getOps(config, fb.Tlf)
+	lState := makeFBOLockState()
+	require.Equal(t, cleanState, ops.blocks.GetState(lState))
+	err = kbfsOps.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+	buf := make([]byte, 1)
+	n, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), n)
+	require.Equal(t, []byte{1}, buf)
+
+	// With nothing dirty, a fence is released right away.
+	wf, err = kbfsOps.WriteFence(ctx, fb, WriteDurabilityLocal)
+	require.NoError(t, err)
+	err = wf.Wait(ctx)
+	require.NoError(t, err)
+}
+
+func TestKBFSOpsReadSlices(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	// Use the smallest possible block size.
+	bsplitter, err := NewBlockSplitterSimple(20, 8*1024, config.Codec())
+	require.NoError(t, err)
+	config.SetBlockSplitter(bsplitter)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i + 1)
+	}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	// Leave a hole after the data.
+	err = kbfsOps.Truncate(ctx, fileNode, 150)
+	require.NoError(t, err)
+
+	readAll := func(off, size int64) ([][]byte, []byte) {
+		slices, err := kbfsOps.ReadSlices(ctx, fileNode, off, size)
+		require.NoError(t, err)
+		var buf []byte
+		for _, s := range slices {
+			buf = append(buf, s...)
+		}
+		return slices, buf
+	}
+	expected := append(append([]byte(nil), data...), make([]byte, 50)...)
+
+	// Data from dirty blocks is copied, so a later write doesn't
+	// change it.
+	dirtySlices, buf := readAll(0, 200)
+	require.Equal(t, expected, buf)
+	err = kbfsOps.Write(ctx, fileNode, []byte{0}, 0)
+	require.NoError(t, err)
+	require.Equal(t, byte(1), dirtySlices[0][0])
+	expected[0] = 0
+
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	// Clean data is returned straight from the cached block.
+	slices, buf := readAll(0, 1)
+	require.Equal(t, expected[:1], buf)
+	require.Len(t, slices, 1)
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	p := ops.nodeCache.PathFromNode(fileNode)
+	block, err := config.BlockCache().Get(p.tailPointer())
+	require.NoError(t, err)
+	for block.(*FileBlock).IsInd {
+		block, err = config.BlockCache().Get(
+			block.(*FileBlock).IPtrs[0].BlockPointer)
+		require.NoError(t, err)
+	}
+	require.True(t, &block.(*FileBlock).Contents[0] == &slices[0][0])
+
+	// EOF.
+	slices, _ = readAll(150, 10)
+	require.Len(t, slices, 0)
+}
+
+func TestKBFSOpsReadAheadWindow(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	// Use the smallest possible block size.
+	bsplitter, err := NewBlockSplitterSimple(20, 8*1024, config.Codec())
+	require.NoError(t, err)
+	config.SetBlockSplitter(bsplitter)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := make([]byte, 400)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	p := ops.nodeCache.PathFromNode(fileNode)
+	fblock, err := ops.blocks.GetFileBlockForReading(ctx, makeFBOLockState(),
+		ops.getHead(makeFBOLockState()), p.tailPointer(), p.Branch, p)
+	require.NoError(t, err)
+	require.True(t, fblock.IsInd)
+
+	// Start with nothing cached.
+	config.SetBlockCache(NewBlockCacheStandard(100, 1<<20))
+
+	readAt := func(off int64) {
+		buf := make([]byte, 10)
+		n, err := kbfsOps.Read(ctx, fileNode, buf, off)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(buf)), n)
+		require.Equal(t, data[off:off+n], buf)
+	}
+	requireWindow := func(expected int) {
+		status, _, err := kbfsOps.FolderStatus(
+			ctx, rootNode.GetFolderBranch())
+		require.NoError(t, err)
+		require.Equal(t,
+			map[string]int{p.String(): expected}, status.ReadaheadWindows)
+	}
+
+	// Sequential reads scale the window up.
+	readAt(0)
+	requireWindow(1)
+	readAt(10)
+	requireWindow(2)
+	readAt(20)
+	requireWindow(4)
+
+	// The block after the one being read gets prefetched.
+	nextPtr := fblock.IPtrs[2].BlockPointer
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := config.BlockCache().Get(nextPtr); err == nil {
+			break
+		}
+		require.True(t, time.Now().Before(deadline),
+			"Timed out waiting for prefetch")
+		time.Sleep(time.Millisecond)
+	}
+
+	// A random read drops it back to zero.
+	readAt(300)
+	requireWindow(0)
+	readAt(310)
+	requireWindow(1)
+
+	// The window is capped by MaxReadaheadBlocks, and zero turns
+	// readahead off.
+	config.SetMaxReadaheadBlocks(2)
+	readAt(320)
+	requireWindow(2)
+	readAt(330)
+	requireWindow(2)
+	config.SetMaxReadaheadBlocks(0)
+	readAt(340)
+	requireWindow(0)
+}
+
+func makeManyFakeTlfIDs(n int) []TlfID {
+	ids := make([]TlfID, n)
+	for i := range ids {
+		ids[i] = FakeTlfID(0, false)
+		ids[i].id[0] = byte(i)
+		ids[i].id[1] = byte(i >> 8)
+	}
+	return ids
+}
+
+func TestKBFSOpsEvictIdleOps(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer config.Shutdown()
+
+	// The root node keeps its folder in use.
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	busyFB := rootNode.GetFolderBranch()
+
+	kbfsOps := config.KBFSOps().(*KBFSOpsStandard)
+	var fbs []FolderBranch
+	for _, id := range makeManyFakeTlfIDs(5) {
+		fb := FolderBranch{id, MasterBranch}
+		kbfsOps.getOpsNoAdd(fb)
+		fbs = append(fbs, fb)
+	}
+
+	kbfsOps.maxOps = 2
+	kbfsOps.evictIdleOps()
+
+	// The busy folder is the least recently used, but can't be
+	// evicted, and the two most recently used ones are kept.
+	func() {
+		kbfsOps.opsLock.RLock()
+		defer kbfsOps.opsLock.RUnlock()
+		require.Len(t, kbfsOps.ops, 3)
+		require.Contains(t, kbfsOps.ops, busyFB)
+		require.Contains(t, kbfsOps.ops, fbs[3])
+		require.Contains(t, kbfsOps.ops, fbs[4])
+	}()
+
+	// Keep the root node alive until here.
+	_, err := kbfsOps.GetDirChildren(ctx, rootNode)
+	require.NoError(t, err)
+}
+
+func TestKBFSOpsEvictSkipsReferencedOps(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer config.Shutdown()
+
+	kbfsOps := config.KBFSOps().(*KBFSOpsStandard)
+	var fbs []FolderBranch
+	for _, id := range makeManyFakeTlfIDs(5) {
+		fbs = append(fbs, FolderBranch{id, MasterBranch})
+	}
+	// Someone is still using the first folder, which is otherwise
+	// idle and the least recently used.
+	held, release := kbfsOps.getOpsRef(fbs[0])
+	for _, fb := range fbs[1:] {
+		kbfsOps.getOpsNoAdd(fb)
+	}
+
+	kbfsOps.maxOps = 2
+	kbfsOps.evictIdleOps()
+	func() {
+		kbfsOps.opsLock.RLock()
+		defer kbfsOps.opsLock.RUnlock()
+		require.Len(t, kbfsOps.ops, 3)
+		require.Equal(t, held, kbfsOps.ops[fbs[0]])
+		require.Contains(t, kbfsOps.ops, fbs[3])
+		require.Contains(t, kbfsOps.ops, fbs[4])
+	}()
+
+	// Once it's released, it can go.
+	release()
+	kbfsOps.evictIdleOps()
+	func() {
+		kbfsOps.opsLock.RLock()
+		defer kbfsOps.opsLock.RUnlock()
+		require.Len(t, kbfsOps.ops, 2)
+		require.NotContains(t, kbfsOps.ops, fbs[0])
+	}()
+}
+
+func TestKBFSOpsEvictKeepsInMemoryState(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer config.Shutdown()
+
+	kbfsOps := config.KBFSOps().(*KBFSOpsStandard)
+	var fbs []FolderBranch
+	var ops []*folderBranchOps
+	for _, id := range makeManyFakeTlfIDs(5) {
+		fb := FolderBranch{id, MasterBranch}
+		fbs = append(fbs, fb)
+		ops = append(ops, kbfsOps.getOpsNoAdd(fb))
+	}
+
+	// The first folder has a sync durability that the config
+	// doesn't know about, so a recreated one would lose it, and the
+	// second holds a byte-range lock.
+	ops[0].syncDurabilityLock.Lock()
+	ops[0].syncDurability = WriteDurabilityServer
+	ops[0].syncDurabilityLock.Unlock()
+	ops[1].rangeLocks.lock.Lock()
+	ops[1].rangeLocks.held["f"] = []RangeLock{{RangeLockWrite, 0, 10, 1}}
+	ops[1].rangeLocks.lock.Unlock()
+
+	kbfsOps.maxOps = 2
+	kbfsOps.evictIdleOps()
+	func() {
+		kbfsOps.opsLock.RLock()
+		defer kbfsOps.opsLock.RUnlock()
+		require.Len(t, kbfsOps.ops, 4)
+		require.Equal(t, ops[0], kbfsOps.ops[fbs[0]])
+		require.Equal(t, ops[1], kbfsOps.ops[fbs[1]])
+		require.NotContains(t, kbfsOps.ops, fbs[2])
+	}()
+
+	// Once the durability is persisted, the first one can go.
+	err := config.SetSyncDurabilityForTLF(fbs[0].Tlf, WriteDurabilityServer)
+	require.NoError(t, err)
+	kbfsOps.evictIdleOps()
+	func() {
+		kbfsOps.opsLock.RLock()
+		defer kbfsOps.opsLock.RUnlock()
+		require.Len(t, kbfsOps.ops, 3)
+		require.NotContains(t, kbfsOps.ops, fbs[0])
+	}()
+
+	ops[1].rangeLocks.lock.Lock()
+	delete(ops[1].rangeLocks.held, "f")
+	ops[1].rangeLocks.lock.Unlock()
+}
+
+// Folders that have just been opened shouldn't start any
+// goroutines of their own until they have something to do.
+func TestKBFSOpsIdleTLFsStartNoGoroutines(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer config.Shutdown()
+
+	kbfsOps := config.KBFSOps().(*KBFSOpsStandard)
+	ids := makeManyFakeTlfIDs(100)
+	kbfsOps.maxOps = len(ids)
+	start := runtime.NumGoroutine()
+	for _, id := range ids {
+		kbfsOps.getOpsNoAdd(FolderBranch{id, MasterBranch})
+	}
+	// Leave some slack for unrelated background goroutines.
+	require.True(t, runtime.NumGoroutine()-start < len(ids)/10,
+		"%d goroutines for %d folders",
+		runtime.NumGoroutine()-start, len(ids))
+}
+
+func benchmarkKBFSOpsReadCached(b *testing.B, readSize int64,
+	read func(ctx context.Context, kbfsOps KBFSOps, file Node,
+		buf []byte, off int64) error) {
+	config := MakeTestConfigOrBust(b, "test_user")
+	defer config.Shutdown()
+	ctx := BackgroundContextWithCancellationDelayer()
+	defer CleanupCancellationDelayer(ctx)
+
+	const fileSize = 8 << 20
+	fixture := MakeTLFFixtureOrBust(b, ctx, config, nil, "test_user", false,
+		TLFFixtureSpec{
+			Seed:        1,
+			FilesPerDir: 1,
+			FileSize:    FixedFileSize(fileSize),
+		})
+	kbfsOps := config.KBFSOps()
+	fileNode, err := fixture.Lookup(ctx, "f0")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	buf := make([]byte, readSize)
+	b.SetBytes(readSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err = read(ctx, kbfsOps, fileNode, buf,
+			(int64(i)*readSize)%fileSize)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func kbfsOpsReadCopy(ctx context.Context, kbfsOps KBFSOps, file Node,
+	buf []byte, off int64) error {
+	_, err := kbfsOps.Read(ctx, file, buf, off)
+	return err
+}
+
+func kbfsOpsReadSlices(ctx context.Context, kbfsOps KBFSOps, file Node,
+	buf []byte, off int64) error {
+	_, err := kbfsOps.ReadSlices(ctx, file, off, int64(len(buf)))
+	return err
+}
+
+func BenchmarkKBFSOpsReadCached128k(b *testing.B) {
+	benchmarkKBFSOpsReadCached(b, 128<<10, kbfsOpsReadCopy)
+}
+
+func BenchmarkKBFSOpsReadSlicesCached128k(b *testing.B) {
+	benchmarkKBFSOpsReadCached(b, 128<<10, kbfsOpsReadSlices)
+}
+
+// BenchmarkKBFSOpsManyTLFs opens 5000 folders and reports the heap
+// and the number of goroutines each open folder costs.  The folders
+// have no MD, so the one goroutine per folder that waits for updates
+// from the server isn't counted.
+func BenchmarkKBFSOpsManyTLFs(b *testing.B) {
+	const numTLFs = 5000
+	ids := makeManyFakeTlfIDs(numTLFs)
+	var memStats runtime.MemStats
+	b.StopTimer()
+	for i := 0; i < b.N; i++ {
+		config := MakeTestConfigOrBust(b, "test_user")
+		kbfsOps := config.KBFSOps().(*KBFSOpsStandard)
+		kbfsOps.maxOps = numTLFs
+		runtime.GC()
+		runtime.ReadMemStats(&memStats)
+		startHeap := int64(memStats.HeapAlloc)
+		startGoroutines := runtime.NumGoroutine()
+
+		b.StartTimer()
+		for _, id := range ids {
+			kbfsOps.getOpsNoAdd(FolderBranch{id, MasterBranch})
+		}
+		b.StopTimer()
+
+		runtime.GC()
+		runtime.ReadMemStats(&memStats)
+		b.ReportMetric(
+			float64(int64(memStats.HeapAlloc)-startHeap)/numTLFs,
+			"heap-B/tlf")
+		b.ReportMetric(
+			float64(runtime.NumGoroutine()-startGoroutines)/numTLFs,
+			"goroutines/tlf")
+		config.Shutdown()
+	}
+}
+
+func TestKBFSOpsAppendUsesTailBlocks(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+	bsplit, err := NewBlockSplitterSimple(64, 8*1024, config.Codec())
+	require.NoError(t, err)
+	config.SetBlockSplitter(bsplit)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "log", false, NoExcl)
+	require.NoError(t, err)
+	topBlock := func() *FileBlock {
+		p := ops.nodeCache.PathFromNode(fileNode)
+		lState := makeFBOLockState()
+		block, err := ops.blocks.GetFileBlockForReading(ctx, lState,
+			ops.getHead(lState), p.tailPointer(), p.Branch, p)
+		require.NoError(t, err)
+		return block
+	}
+
+	var expected []byte
+	appendAndSync := func(data []byte) {
+		err := kbfsOps.Write(ctx, fileNode, data, int64(len(expected)))
+		require.NoError(t, err)
+		err = kbfsOps.Sync(ctx, fileNode)
+		require.NoError(t, err)
+		expected = append(expected, data...)
+	}
+	appendAndSync(make([]byte, 150))
+	start := append([]IndirectFilePtr(nil), topBlock().IPtrs...)
+	require.True(t, len(start) > 1)
+
+	// Each synced append gets a block of its own, and leaves the
+	// blocks before it alone.
+	for i := 1; i < maxTailBlocks; i++ {
+		appendAndSync([]byte{byte(i), byte(i)})
+		iptrs := topBlock().IPtrs
+		require.Len(t, iptrs, len(start)+i)
+		require.Equal(t, start, iptrs[:len(start)])
+	}
+
+	// The next one compacts the partial blocks into full ones.
+	appendAndSync([]byte{0xff})
+	iptrs := topBlock().IPtrs
+	require.True(t, len(iptrs) < len(start)+maxTailBlocks-1,
+		"%d blocks", len(iptrs))
+	require.Equal(t, start[:len(start)-1], iptrs[:len(start)-1])
+	buf := make([]byte, len(expected)+1)
+	n, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, expected, buf[:n])
+
+	// Another device, with nothing cached, reads it all back.
+	config2 := ConfigAsUser(config, "test_user")
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(t, config2, "test_user", false)
+	fileNode2, _, err := config2.KBFSOps().Lookup(ctx, rootNode2, "log")
+	require.NoError(t, err)
+	n, err = config2.KBFSOps().Read(ctx, fileNode2, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, expected, buf[:n])
+}
+
+// benchmarkKBFSOpsAppendLog appends records of the given size to a
+// fresh file, like a log writer would, syncing after every
+// recordsPerSync of them, until the file reaches logSize.
+func benchmarkKBFSOpsAppendLog(b *testing.B, logSize, recordSize int64,
+	recordsPerSync int) {
+	config := MakeTestConfigOrBust(b, "test_user")
+	defer config.Shutdown()
+	ctx := BackgroundContextWithCancellationDelayer()
+	defer CleanupCancellationDelayer(ctx)
+
+	rootNode := GetRootNodeOrBust(b, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	record := make([]byte, recordSize)
+	b.SetBytes(logSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fileNode, _, err := kbfsOps.CreateFile(
+			ctx, rootNode, fmt.Sprintf("log%d", i), false, NoExcl)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for off, n := int64(0), 1; off < logSize; off, n = off+recordSize, n+1 {
+			err = kbfsOps.Write(ctx, fileNode, record, off)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if n%recordsPerSync != 0 {
+				continue
+			}
+			err = kbfsOps.Sync(ctx, fileNode)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkKBFSOpsAppendLog4mb(b *testing.B) {
+	benchmarkKBFSOpsAppendLog(b, 4<<20, 256, 256)
+}
+
+// Syncing in the middle of blocks exercises the tail blocks.
+func BenchmarkKBFSOpsAppendLog256kbSyncEvery4kb(b *testing.B) {
+	benchmarkKBFSOpsAppendLog(b, 256<<10, 256, 16)
+}
@@ -0,0 +1,262 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKBFSOpsXattrs(t *testing.T) {
+	var userName libkb.NormalizedUsername = "u1"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, userName.String(), false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	small := []byte("small")
+	big := bytes.Repeat([]byte{1}, maxInlineXattrSize+1)
+	err = kbfsOps.SetXattr(ctx, fileNode, "user.small", small)
+	require.NoError(t, err)
+	err = kbfsOps.SetXattr(ctx, fileNode, "user.big", big)
+	require.NoError(t, err)
+	err = kbfsOps.SetXattr(ctx, fileNode, "user.empty", nil)
+	require.NoError(t, err)
+
+	names, err := kbfsOps.ListXattr(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, []string{"user.big", "user.empty", "user.small"}, names)
+
+	// A fresh config has to fetch the big value's block.
+	config2 := ConfigAsUser(config, userName)
+	defer CheckConfigAndShutdown(t, config2)
+	rootNode2 := GetRootNodeOrBust(t, config2, userName.String(), false)
+	fileNode2, _, err := config2.KBFSOps().Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	for name, expected := range map[string][]byte{
+		"user.small": small,
+		"user.big":   big,
+		"user.empty": nil,
+	} {
+		value, err := config2.KBFSOps().GetXattr(ctx, fileNode2, name)
+		require.NoError(t, err)
+		require.Equal(t, len(expected), len(value), name)
+		require.True(t, bytes.Equal(expected, value), name)
+	}
+
+	err = kbfsOps.RemoveXattr(ctx, fileNode, "user.big")
+	require.NoError(t, err)
+	_, err = kbfsOps.GetXattr(ctx, fileNode, "user.big")
+	require.Equal(t, NoSuchXattrError{"user.big"}, err)
+	err = kbfsOps.RemoveXattr(ctx, fileNode, "user.big")
+	require.Equal(t, NoSuchXattrError{"user.big"}, err)
+
+	err = kbfsOps.SetXattr(ctx, fileNode, "", small)
+	require.IsType(t, InvalidXattrNameError{}, err)
+	err = kbfsOps.SetXattr(ctx, fileNode, "user.huge",
+		make([]byte, maxXattrSize+1))
+	require.IsType(t, XattrTooBigError{}, err)
+
+	// The root has no xattrs, and can't get any.
+	names, err = kbfsOps.ListXattr(ctx, rootNode)
+	require.NoError(t, err)
+	require.Len(t, names, 0)
+	err = kbfsOps.SetXattr(ctx, rootNode, "user.small", small)
+	require.Equal(t, NoRootXattrsError{}, err)
+
+	// Other attribute changes leave the xattrs alone.
+	err = kbfsOps.SetEx(ctx, fileNode, true)
+	require.NoError(t, err)
+	value, err := kbfsOps.GetXattr(ctx, fileNode, "user.small")
+	require.NoError(t, err)
+	require.Equal(t, small, value)
+}
+
+// Tests that CR merges xattr changes made on both branches.  When
+// both branches change the same xattr, the merged value keeps the
+// name and the unmerged value is kept under a conflict name.
+func TestCRMergesXattrs(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	dirNode1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "d")
+	require.NoError(t, err)
+	fileNode1, _, err := kbfsOps1.CreateFile(ctx, dirNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	dirNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "d")
+	require.NoError(t, err)
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, dirNode2, "a")
+	require.NoError(t, err)
+
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+
+	big1 := bytes.Repeat([]byte{1}, maxInlineXattrSize+1)
+	big2 := bytes.Repeat([]byte{2}, maxInlineXattrSize+1)
+	for _, n := range []Node{dirNode1, fileNode1} {
+		err = kbfsOps1.SetXattr(ctx, n, "user.merged", []byte{1})
+		require.NoError(t, err)
+		err = kbfsOps1.SetXattr(ctx, n, "user.both", []byte{1})
+		require.NoError(t, err)
+		err = kbfsOps1.SetXattr(ctx, n, "user.big", big1)
+		require.NoError(t, err)
+	}
+	for _, n := range []Node{dirNode2, fileNode2} {
+		err = kbfsOps2.SetXattr(ctx, n, "user.unmerged", []byte{2})
+		require.NoError(t, err)
+		err = kbfsOps2.SetXattr(ctx, n, "user.both", []byte{2})
+		require.NoError(t, err)
+		err = kbfsOps2.SetXattr(ctx, n, "user.big", big2)
+		require.NoError(t, err)
+		err = kbfsOps2.SetXattr(ctx, n, "user.bigunmerged", big2)
+		require.NoError(t, err)
+		// Replace a big unmerged value, so CR has to drop the
+		// block of the first one.
+		err = kbfsOps2.SetXattr(ctx, n, "user.bigunmerged", big1)
+		require.NoError(t, err)
+	}
+	// A file created on the unmerged branch keeps its big xattr.
+	newNode2, _, err := kbfsOps2.CreateFile(ctx, dirNode2, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps2.SetXattr(ctx, newNode2, "user.big", big2)
+	require.NoError(t, err)
+
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2,
+		rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	expected := map[string][]byte{
+		"user.both":        {1},
+		"user.merged":      {1},
+		"user.unmerged":    {2},
+		"user.big":         big1,
+		"user.bigunmerged": big1,
+	}
+	// The unmerged values of the xattrs changed on both branches.
+	expectedConflicts := map[string][]byte{
+		"user.both": {2},
+		"user.big":  big2,
+	}
+	checks := []struct {
+		kbfsOps KBFSOps
+		node    Node
+	}{
+		{kbfsOps1, dirNode1}, {kbfsOps1, fileNode1},
+		{kbfsOps2, dirNode2}, {kbfsOps2, fileNode2},
+	}
+	for _, check := range checks {
+		names, err := check.kbfsOps.ListXattr(ctx, check.node)
+		require.NoError(t, err)
+		require.Len(t, names, len(expected)+len(expectedConflicts))
+		for name, value := range expected {
+			got, err := check.kbfsOps.GetXattr(ctx, check.node, name)
+			require.NoError(t, err)
+			require.Equal(t, value, got, name)
+		}
+		conflicts := make(map[string][]byte)
+		for _, name := range names {
+			if _, ok := expected[name]; ok {
+				continue
+			}
+			got, err := check.kbfsOps.GetXattr(ctx, check.node, name)
+			require.NoError(t, err)
+			if bytes.Equal(got, big2) {
+				conflicts["user.big"] = got
+			} else {
+				conflicts["user.both"] = got
+			}
+		}
+		require.Equal(t, expectedConflicts, conflicts)
+	}
+
+	newNode1, _, err := kbfsOps1.Lookup(ctx, dirNode1, "b")
+	require.NoError(t, err)
+	got, err := kbfsOps1.GetXattr(ctx, newNode1, "user.big")
+	require.NoError(t, err)
+	require.Equal(t, big2, got)
+
+	// No conflict copies of the entries were needed.
+	children, err := kbfsOps1.GetDirChildren(ctx, dirNode1)
+	require.NoError(t, err)
+	require.Len(t, children, 2)
+}
+
+// Tests that CR keeps a big xattr set on the unmerged branch for a
+// file that was removed on the merged branch.
+func TestCRXattrOnMergedRemovedFile(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	_, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+
+	err = kbfsOps1.RemoveEntry(ctx, rootNode1, "a")
+	require.NoError(t, err)
+	big := bytes.Repeat([]byte{2}, maxInlineXattrSize+1)
+	err = kbfsOps2.SetXattr(ctx, fileNode2, "user.big", big)
+	require.NoError(t, err)
+
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2,
+		rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	fileNode1, _, err := kbfsOps1.Lookup(ctx, rootNode1, "a")
+	require.NoError(t, err)
+	got, err := kbfsOps1.GetXattr(ctx, fileNode1, "user.big")
+	require.NoError(t, err)
+	require.Equal(t, big, got)
+}
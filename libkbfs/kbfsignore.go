@@ -0,0 +1,154 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	gopath "path"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// KBFSIgnoreFileName is the name of the file listing patterns for
+// files that should be kept local-only rather than synced.  An
+// ignore file in a TLF's root directory applies to files anywhere in
+// the TLF, and one in any other directory applies to the files
+// directly in that directory, taking precedence over the root one.
+//
+// Each line is a shell pattern, as understood by path.Match, that's
+// matched against file names.  Blank lines and lines starting with
+// "#" are skipped, and a leading "!" re-includes files that an
+// earlier pattern ignored.  The last matching pattern wins.
+// Directories, and ignore files themselves, are never ignored.
+const KBFSIgnoreFileName = ".kbfsignore"
+
+type ignorePattern struct {
+	glob   string
+	negate bool
+}
+
+// IgnorePatterns is the parsed contents of one ignore file.
+type IgnorePatterns struct {
+	patterns []ignorePattern
+}
+
+// ParseIgnorePatterns parses the contents of an ignore file.
+// Malformed patterns are skipped.
+func ParseIgnorePatterns(data []byte) IgnorePatterns {
+	var ip IgnorePatterns
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		glob := strings.TrimSpace(string(line))
+		if glob == "" || strings.HasPrefix(glob, "#") {
+			continue
+		}
+		negate := false
+		if strings.HasPrefix(glob, "!") {
+			negate = true
+			glob = glob[1:]
+		}
+		if _, err := gopath.Match(glob, ""); err != nil {
+			continue
+		}
+		ip.patterns = append(ip.patterns, ignorePattern{glob, negate})
+	}
+	return ip
+}
+
+// Match returns whether any of the patterns match name, and if so,
+// whether the last one to match ignores it or re-includes it.
+func (ip IgnorePatterns) Match(name string) (matched, ignored bool) {
+	for _, p := range ip.patterns {
+		// The patterns were checked when parsed.
+		if ok, _ := gopath.Match(p.glob, name); ok {
+			matched = true
+			ignored = !p.negate
+		}
+	}
+	return matched, ignored
+}
+
+// GetIgnorePatterns reads the ignore file in the given directory.
+// It returns no patterns if there isn't one.
+func GetIgnorePatterns(ctx context.Context, kbfsOps KBFSOps, dir Node) (
+	IgnorePatterns, error) {
+	node, ei, err := kbfsOps.Lookup(ctx, dir, KBFSIgnoreFileName)
+	if _, ok := err.(NoSuchNameError); ok {
+		return IgnorePatterns{}, nil
+	} else if err != nil {
+		return IgnorePatterns{}, err
+	}
+	if ei.Type != File && ei.Type != Exec {
+		return IgnorePatterns{}, nil
+	}
+	buf := make([]byte, ei.Size)
+	n, err := kbfsOps.Read(ctx, node, buf, 0)
+	if err != nil {
+		return IgnorePatterns{}, err
+	}
+	return ParseIgnorePatterns(buf[:n]), nil
+}
+
+// IsIgnored returns whether a file (not a directory) with the given
+// name in dir should be kept local-only, according to the ignore files in dir and in
+// root, the root directory of dir's TLF.
+func IsIgnored(ctx context.Context, kbfsOps KBFSOps, root, dir Node,
+	name string) (bool, error) {
+	if name == KBFSIgnoreFileName {
+		return false, nil
+	}
+	if dir.GetID() != root.GetID() {
+		ip, err := GetIgnorePatterns(ctx, kbfsOps, dir)
+		if err != nil {
+			return false, err
+		}
+		if matched, ignored := ip.Match(name); matched {
+			return ignored, nil
+		}
+	}
+	ip, err := GetIgnorePatterns(ctx, kbfsOps, root)
+	if err != nil {
+		return false, err
+	}
+	_, ignored := ip.Match(name)
+	return ignored, nil
+}
+
+// IsPathIgnored returns whether a file at the given slash-separated
+// path, relative to root, should be kept local-only.  Every
+// directory along the path must exist, though the file itself
+// needn't.  Paths of existing directories are never ignored.
+func IsPathIgnored(ctx context.Context, kbfsOps KBFSOps, root Node,
+	p string) (bool, error) {
+	dirName, name := gopath.Split(gopath.Clean("/" + p))
+	dir := root
+	dirPath := path{root.GetFolderBranch(),
+		[]pathNode{{Name: root.GetBasename()}}}
+	for _, elem := range strings.Split(dirName, "/") {
+		if elem == "" {
+			continue
+		}
+		node, ei, err := kbfsOps.Lookup(ctx, dir, elem)
+		if err != nil {
+			return false, err
+		}
+		dirPath = dirPath.ChildPathNoPtr(elem)
+		if ei.Type != Dir {
+			return false, NotDirError{dirPath}
+		}
+		dir = node
+	}
+	if name == "" {
+		// The root itself.
+		return false, nil
+	}
+	_, ei, err := kbfsOps.Lookup(ctx, dir, name)
+	if err == nil && ei.Type == Dir {
+		return false, nil
+	} else if _, ok := err.(NoSuchNameError); err != nil && !ok {
+		return false, err
+	}
+	return IsIgnored(ctx, kbfsOps, root, dir, name)
+}
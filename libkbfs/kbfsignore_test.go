@@ -0,0 +1,91 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIgnorePatternsMatch(t *testing.T) {
+	ip := ParseIgnorePatterns([]byte(`
+# Editor files.
+*.swp
+*~
+
+[
+*.o
+!keep.o
+`))
+
+	tests := []struct {
+		name             string
+		matched, ignored bool
+	}{
+		{"a.swp", true, true},
+		{"a~", true, true},
+		{"a.o", true, true},
+		{"keep.o", true, false},
+		{"a.c", false, false},
+		{"# Editor files.", false, false},
+	}
+	for _, test := range tests {
+		matched, ignored := ip.Match(test.name)
+		require.Equal(t, test.matched, matched, test.name)
+		require.Equal(t, test.ignored, ignored, test.name)
+	}
+}
+
+func TestIsPathIgnored(t *testing.T) {
+	var userName libkb.NormalizedUsername = "u1"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, userName.String(), false)
+	kbfsOps := config.KBFSOps()
+	writeIgnoreFile := func(dir Node, data string) {
+		node, _, err := kbfsOps.CreateFile(
+			ctx, dir, KBFSIgnoreFileName, false, NoExcl)
+		require.NoError(t, err)
+		err = kbfsOps.Write(ctx, node, []byte(data), 0)
+		require.NoError(t, err)
+		err = kbfsOps.Sync(ctx, node)
+		require.NoError(t, err)
+	}
+	writeIgnoreFile(rootNode, "*.swp\n*.o\n.kbfsignore\nb\n")
+	aNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	writeIgnoreFile(aNode, "!*.o\n*.c\n")
+	_, _, err = kbfsOps.CreateDir(ctx, aNode, "b")
+	require.NoError(t, err)
+
+	tests := []struct {
+		path    string
+		ignored bool
+	}{
+		{"x.swp", true},
+		{"x.o", true},
+		{"x.c", false},
+		{KBFSIgnoreFileName, false},
+		{"a/x.swp", true},
+		{"a/x.o", false},
+		{"a/x.c", true},
+		{"a/b/x.o", true},
+		{"a/b/x.c", false},
+		{"a/b", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		ignored, err := IsPathIgnored(ctx, kbfsOps, rootNode, test.path)
+		require.NoError(t, err, test.path)
+		require.Equal(t, test.ignored, ignored, test.path)
+	}
+
+	_, err = IsPathIgnored(ctx, kbfsOps, rootNode, "a/.kbfsignore/x.c")
+	require.IsType(t, NotDirError{}, err)
+}
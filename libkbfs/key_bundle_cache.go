@@ -0,0 +1,307 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+	"github.com/keybase/client/go/logger"
+)
+
+type keyBundleCacheKey struct {
+	writer bool
+	h      Hash
+}
+
+func (k keyBundleCacheKey) subdir() string {
+	if k.writer {
+		return "writer"
+	}
+	return "reader"
+}
+
+type keyBundleCacheEntry struct {
+	// bundle is either a TLFWriterKeyBundleV3 or a
+	// TLFReaderKeyBundleV3.  It is nil for entries that have
+	// only been found on disk, and haven't been read yet.
+	bundle interface{}
+	size   uint64
+}
+
+// KeyBundleCacheStandard is an LRU-based implementation of the
+// KeyBundleCache interface, capped by the total encoded size of the
+// cached bundles.  If it has a directory, every cached bundle is
+// also written there, so the cache survives restarts; bundles read
+// back from disk are checked against their IDs before being used.
+type KeyBundleCacheStandard struct {
+	codec Codec
+	log   logger.Logger
+	// dirPath is empty if this cache is purely in-memory.
+	dirPath       string
+	capacityBytes uint64
+
+	// lock protects lru and totalBytes, and makes sure that
+	// eviction and the corresponding disk updates happen
+	// atomically.
+	lock       sync.Mutex
+	lru        *simplelru.LRU
+	totalBytes uint64
+}
+
+var _ KeyBundleCache = (*KeyBundleCacheStandard)(nil)
+
+func newKeyBundleCacheStandard(codec Codec, log logger.Logger,
+	dirPath string, capacityBytes uint64) *KeyBundleCacheStandard {
+	if capacityBytes == 0 {
+		capacityBytes = math.MaxUint64
+	}
+	// The LRU itself is bounded only by capacityBytes, so give
+	// it an effectively infinite entry count.
+	head, err := simplelru.NewLRU(math.MaxInt32, nil)
+	if err != nil {
+		panic(err.Error())
+	}
+	return &KeyBundleCacheStandard{
+		codec:         codec,
+		log:           log,
+		dirPath:       dirPath,
+		capacityBytes: capacityBytes,
+		lru:           head,
+	}
+}
+
+// NewKeyBundleCacheStandard constructs a new in-memory
+// KeyBundleCacheStandard holding at most capacityBytes worth of
+// encoded key bundles.  A capacity of 0 means no limit.
+func NewKeyBundleCacheStandard(
+	codec Codec, capacityBytes uint64) *KeyBundleCacheStandard {
+	return newKeyBundleCacheStandard(codec, nil, "", capacityBytes)
+}
+
+// NewKeyBundleCacheDisk constructs a new KeyBundleCacheStandard that
+// persists its key bundles in the given directory, holding at most
+// capacityBytes worth of encoded key bundles.  A capacity of 0 means
+// no limit.  Any bundles already in the directory are indexed (but
+// not read), oldest first, so that they're evicted before anything
+// put in this session.
+func NewKeyBundleCacheDisk(codec Codec, log logger.Logger, dirPath string,
+	capacityBytes uint64) (*KeyBundleCacheStandard, error) {
+	k := newKeyBundleCacheStandard(codec, log, dirPath, capacityBytes)
+	for _, writer := range []bool{true, false} {
+		err := k.loadIndex(writer)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+func (k *KeyBundleCacheStandard) loadIndex(writer bool) error {
+	dir := filepath.Join(k.dirPath,
+		keyBundleCacheKey{writer: writer}.subdir())
+	fileInfos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	sort.Sort(byModTime(fileInfos))
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	for _, fi := range fileInfos {
+		h, err := HashFromString(fi.Name())
+		if err != nil {
+			// Not one of ours; leave it alone.
+			continue
+		}
+		if uint64(fi.Size()) > k.capacityBytes {
+			// Can't happen unless the capacity shrank.
+			err := os.Remove(filepath.Join(dir, fi.Name()))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		k.addLocked(keyBundleCacheKey{writer, h},
+			keyBundleCacheEntry{size: uint64(fi.Size())})
+	}
+	return nil
+}
+
+type byModTime []os.FileInfo
+
+func (fis byModTime) Len() int      { return len(fis) }
+func (fis byModTime) Swap(i, j int) { fis[i], fis[j] = fis[j], fis[i] }
+func (fis byModTime) Less(i, j int) bool {
+	return fis[i].ModTime().Before(fis[j].ModTime())
+}
+
+// diskUsage returns the directory the cache is stored in, or "" if
+// it's purely in-memory, along with how many bytes it takes up and
+// may take up.
+func (k *KeyBundleCacheStandard) diskUsage() (
+	dirPath string, bytes, capacityBytes uint64) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return k.dirPath, k.totalBytes, k.capacityBytes
+}
+
+func (k *KeyBundleCacheStandard) path(key keyBundleCacheKey) string {
+	return filepath.Join(k.dirPath, key.subdir(), key.h.String())
+}
+
+func (k *KeyBundleCacheStandard) removeLocked(key keyBundleCacheKey) {
+	tmp, ok := k.lru.Peek(key)
+	if !ok {
+		return
+	}
+	k.lru.Remove(key)
+	k.totalBytes -= tmp.(keyBundleCacheEntry).size
+	if k.dirPath == "" {
+		return
+	}
+	err := os.Remove(k.path(key))
+	if err != nil && !os.IsNotExist(err) && k.log != nil {
+		k.log.Warning("Couldn't remove key bundle %s: %v", key.h, err)
+	}
+}
+
+func (k *KeyBundleCacheStandard) addLocked(
+	key keyBundleCacheKey, entry keyBundleCacheEntry) {
+	for k.totalBytes+entry.size > k.capacityBytes {
+		oldest, _, _ := k.lru.GetOldest()
+		k.removeLocked(oldest.(keyBundleCacheKey))
+	}
+	k.lru.Add(key, entry)
+	k.totalBytes += entry.size
+}
+
+// get returns the decoded bundle for the given key, reading (and
+// verifying) it from disk if necessary.  It returns nil if the
+// bundle isn't cached.
+func (k *KeyBundleCacheStandard) get(
+	key keyBundleCacheKey, bundle interface{}) interface{} {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	tmp, ok := k.lru.Get(key)
+	if !ok {
+		return nil
+	}
+	entry := tmp.(keyBundleCacheEntry)
+	if entry.bundle != nil {
+		return entry.bundle
+	}
+
+	buf, err := ioutil.ReadFile(k.path(key))
+	if err != nil {
+		k.log.Warning("Couldn't read key bundle %s: %v", key.h, err)
+		k.removeLocked(key)
+		return nil
+	}
+	// Check integrity before trusting anything on disk.
+	err = key.h.Verify(buf)
+	if err != nil {
+		k.log.Warning("Removing corrupt key bundle %s: %v", key.h, err)
+		k.removeLocked(key)
+		return nil
+	}
+	err = k.codec.Decode(buf, bundle)
+	if err != nil {
+		k.log.Warning("Removing undecodable key bundle %s: %v", key.h, err)
+		k.removeLocked(key)
+		return nil
+	}
+	entry.bundle = bundle
+	k.lru.Add(key, entry)
+	return bundle
+}
+
+func (k *KeyBundleCacheStandard) put(
+	key keyBundleCacheKey, bundle interface{}) error {
+	buf, err := k.codec.Encode(bundle)
+	if err != nil {
+		return err
+	}
+	h, err := DefaultHash(buf)
+	if err != nil {
+		return err
+	}
+	if h != key.h {
+		return KeyBundleIDMismatchError{key.h.String(), h.String()}
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if tmp, ok := k.lru.Get(key); ok {
+		if tmp.(keyBundleCacheEntry).bundle == nil {
+			entry := tmp.(keyBundleCacheEntry)
+			entry.bundle = bundle
+			k.lru.Add(key, entry)
+		}
+		return nil
+	}
+
+	if uint64(len(buf)) > k.capacityBytes {
+		// It would be evicted right away anyway.
+		return nil
+	}
+
+	if k.dirPath != "" {
+		path := k.path(key)
+		err = os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(path, buf, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	k.addLocked(key, keyBundleCacheEntry{bundle, uint64(len(buf))})
+	return nil
+}
+
+// GetTLFReaderKeyBundle implements the KeyBundleCache interface for
+// KeyBundleCacheStandard.
+func (k *KeyBundleCacheStandard) GetTLFReaderKeyBundle(
+	id TLFReaderKeyBundleID) (TLFReaderKeyBundleV3, bool) {
+	bundle := k.get(keyBundleCacheKey{false, id.h}, &TLFReaderKeyBundleV3{})
+	if bundle == nil {
+		return TLFReaderKeyBundleV3{}, false
+	}
+	return *bundle.(*TLFReaderKeyBundleV3), true
+}
+
+// GetTLFWriterKeyBundle implements the KeyBundleCache interface for
+// KeyBundleCacheStandard.
+func (k *KeyBundleCacheStandard) GetTLFWriterKeyBundle(
+	id TLFWriterKeyBundleID) (TLFWriterKeyBundleV3, bool) {
+	bundle := k.get(keyBundleCacheKey{true, id.h}, &TLFWriterKeyBundleV3{})
+	if bundle == nil {
+		return TLFWriterKeyBundleV3{}, false
+	}
+	return *bundle.(*TLFWriterKeyBundleV3), true
+}
+
+// PutTLFReaderKeyBundle implements the KeyBundleCache interface for
+// KeyBundleCacheStandard.
+func (k *KeyBundleCacheStandard) PutTLFReaderKeyBundle(
+	id TLFReaderKeyBundleID, rkb TLFReaderKeyBundleV3) error {
+	return k.put(keyBundleCacheKey{false, id.h}, &rkb)
+}
+
+// PutTLFWriterKeyBundle implements the KeyBundleCache interface for
+// KeyBundleCacheStandard.
+func (k *KeyBundleCacheStandard) PutTLFWriterKeyBundle(
+	id TLFWriterKeyBundleID, wkb TLFWriterKeyBundleV3) error {
+	return k.put(keyBundleCacheKey{true, id.h}, &wkb)
+}
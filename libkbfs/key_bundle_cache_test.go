@@ -0,0 +1,143 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func makeTestKeyBundlesForCache(t *testing.T, codec Codec, i byte) (
+	TLFWriterKeyBundleID, TLFWriterKeyBundleV3,
+	TLFReaderKeyBundleID, TLFReaderKeyBundleV3) {
+	wkb := TLFWriterKeyBundleV3{
+		Keys: make(UserDeviceKeyInfoMap),
+		TLFEphemeralPublicKeys: TLFEphemeralPublicKeys{
+			MakeTLFEphemeralPublicKey([32]byte{i}),
+		},
+	}
+	rkb := TLFReaderKeyBundleV3{
+		TLFReaderKeyBundleV2{
+			RKeys: make(UserDeviceKeyInfoMap),
+			TLFReaderEphemeralPublicKeys: TLFEphemeralPublicKeys{
+				MakeTLFEphemeralPublicKey([32]byte{i}),
+			},
+		},
+	}
+	wkbID, err := makeTLFWriterKeyBundleID(codec, wkb)
+	require.NoError(t, err)
+	rkbID, err := makeTLFReaderKeyBundleID(codec, rkb)
+	require.NoError(t, err)
+	return wkbID, wkb, rkbID, rkb
+}
+
+func TestKeyBundleCacheBasic(t *testing.T) {
+	codec := NewCodecMsgpack()
+	cache := NewKeyBundleCacheStandard(codec, 0)
+	wkbID, wkb, rkbID, rkb := makeTestKeyBundlesForCache(t, codec, 1)
+
+	_, ok := cache.GetTLFWriterKeyBundle(wkbID)
+	require.False(t, ok)
+	_, ok = cache.GetTLFReaderKeyBundle(rkbID)
+	require.False(t, ok)
+
+	err := cache.PutTLFWriterKeyBundle(wkbID, wkb)
+	require.NoError(t, err)
+	err = cache.PutTLFReaderKeyBundle(rkbID, rkb)
+	require.NoError(t, err)
+	// Putting the same bundle twice is fine.
+	err = cache.PutTLFWriterKeyBundle(wkbID, wkb)
+	require.NoError(t, err)
+
+	gotWKB, ok := cache.GetTLFWriterKeyBundle(wkbID)
+	require.True(t, ok)
+	require.Equal(t, wkb, gotWKB)
+	gotRKB, ok := cache.GetTLFReaderKeyBundle(rkbID)
+	require.True(t, ok)
+	require.Equal(t, rkb, gotRKB)
+
+	// A bundle under the wrong ID is rejected.
+	_, wkb2, _, _ := makeTestKeyBundlesForCache(t, codec, 2)
+	err = cache.PutTLFWriterKeyBundle(wkbID, wkb2)
+	require.IsType(t, KeyBundleIDMismatchError{}, err)
+}
+
+func TestKeyBundleCacheEviction(t *testing.T) {
+	codec := NewCodecMsgpack()
+	wkbID1, wkb1, _, _ := makeTestKeyBundlesForCache(t, codec, 1)
+	buf, err := codec.Encode(wkb1)
+	require.NoError(t, err)
+
+	// Room for exactly two bundles.
+	cache := NewKeyBundleCacheStandard(codec, uint64(2*len(buf)))
+	wkbID2, wkb2, _, _ := makeTestKeyBundlesForCache(t, codec, 2)
+	wkbID3, wkb3, _, _ := makeTestKeyBundlesForCache(t, codec, 3)
+
+	err = cache.PutTLFWriterKeyBundle(wkbID1, wkb1)
+	require.NoError(t, err)
+	err = cache.PutTLFWriterKeyBundle(wkbID2, wkb2)
+	require.NoError(t, err)
+	// Touch the first one, so the second one is evicted next.
+	_, ok := cache.GetTLFWriterKeyBundle(wkbID1)
+	require.True(t, ok)
+	err = cache.PutTLFWriterKeyBundle(wkbID3, wkb3)
+	require.NoError(t, err)
+
+	_, ok = cache.GetTLFWriterKeyBundle(wkbID1)
+	require.True(t, ok)
+	_, ok = cache.GetTLFWriterKeyBundle(wkbID2)
+	require.False(t, ok)
+	_, ok = cache.GetTLFWriterKeyBundle(wkbID3)
+	require.True(t, ok)
+}
+
+func TestKeyBundleCacheDisk(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "key_bundle_cache")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	codec := NewCodecMsgpack()
+	log := logger.NewTestLogger(t)
+	cache, err := NewKeyBundleCacheDisk(codec, log, tempdir, 0)
+	require.NoError(t, err)
+
+	wkbID, wkb, rkbID, rkb := makeTestKeyBundlesForCache(t, codec, 1)
+	err = cache.PutTLFWriterKeyBundle(wkbID, wkb)
+	require.NoError(t, err)
+	err = cache.PutTLFReaderKeyBundle(rkbID, rkb)
+	require.NoError(t, err)
+
+	// A new cache on the same directory should find both bundles.
+	cache, err = NewKeyBundleCacheDisk(codec, log, tempdir, 0)
+	require.NoError(t, err)
+	gotWKB, ok := cache.GetTLFWriterKeyBundle(wkbID)
+	require.True(t, ok)
+	require.Equal(t, wkb, gotWKB)
+	gotRKB, ok := cache.GetTLFReaderKeyBundle(rkbID)
+	require.True(t, ok)
+	require.Equal(t, rkb, gotRKB)
+
+	// Corrupt the reader bundle on disk; the next cache instance
+	// should notice and drop it.
+	rkbPath := filepath.Join(tempdir, "reader", rkbID.h.String())
+	err = ioutil.WriteFile(rkbPath, []byte("garbage"), 0600)
+	require.NoError(t, err)
+	cache, err = NewKeyBundleCacheDisk(codec, log, tempdir, 0)
+	require.NoError(t, err)
+	_, ok = cache.GetTLFReaderKeyBundle(rkbID)
+	require.False(t, ok)
+	_, err = os.Stat(rkbPath)
+	require.True(t, os.IsNotExist(err))
+	_, ok = cache.GetTLFWriterKeyBundle(wkbID)
+	require.True(t, ok)
+}
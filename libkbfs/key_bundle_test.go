@@ -122,7 +122,7 @@ func TestKeyBundleFillInDevices(t *testing.T) {
 
 	// Make a wkb with empty writer key maps
 	wkb := TLFWriterKeyBundleV2{
-		WKeys: make(UserDeviceKeyInfoMap),
+		WKeys:                  make(UserDeviceKeyInfoMap),
 		TLFEphemeralPublicKeys: make(TLFEphemeralPublicKeys, 1),
 	}
 
@@ -130,3 +130,33 @@ func (h TLFWriterKeyBundleID) MarshalBinary() (data []byte, err error) {
 func (h *TLFWriterKeyBundleID) UnmarshalBinary(data []byte) error {
 	return h.h.UnmarshalBinary(data)
 }
+
+// makeTLFWriterKeyBundleID returns the TLFWriterKeyBundleID for the
+// given bundle, i.e. the hash of its serialization.
+func makeTLFWriterKeyBundleID(codec Codec, wkb TLFWriterKeyBundleV3) (
+	TLFWriterKeyBundleID, error) {
+	buf, err := codec.Encode(wkb)
+	if err != nil {
+		return TLFWriterKeyBundleID{}, err
+	}
+	h, err := DefaultHash(buf)
+	if err != nil {
+		return TLFWriterKeyBundleID{}, err
+	}
+	return TLFWriterKeyBundleID{h}, nil
+}
+
+// makeTLFReaderKeyBundleID returns the TLFReaderKeyBundleID for the
+// given bundle, i.e. the hash of its serialization.
+func makeTLFReaderKeyBundleID(codec Codec, rkb TLFReaderKeyBundleV3) (
+	TLFReaderKeyBundleID, error) {
+	buf, err := codec.Encode(rkb)
+	if err != nil {
+		return TLFReaderKeyBundleID{}, err
+	}
+	h, err := DefaultHash(buf)
+	if err != nil {
+		return TLFReaderKeyBundleID{}, err
+	}
+	return TLFReaderKeyBundleID{h}, nil
+}
@@ -50,6 +50,9 @@ func (km *KeyManagerStandard) GetTLFCryptKeyForMDDecryption(
 func (km *KeyManagerStandard) GetTLFCryptKeyForBlockDecryption(
 	ctx context.Context, kmd KeyMetadata, blockPtr BlockPointer) (
 	tlfCryptKey TLFCryptKey, err error) {
+	if blockPtr.KeyGen >= FirstSubdirKeyGen {
+		return km.getTLFSubdirCryptKey(ctx, kmd, blockPtr.KeyGen)
+	}
 	return km.getTLFCryptKeyUsingCurrentDevice(ctx, kmd, blockPtr.KeyGen, true)
 }
 
@@ -68,6 +71,51 @@ func (km *KeyManagerStandard) GetTLFCryptKeyOfAllGenerations(
 	return keys, nil
 }
 
+// GetExtraMetadata implements the KeyManager interface for
+// KeyManagerStandard.
+func (km *KeyManagerStandard) GetExtraMetadata(
+	ctx context.Context, md BareRootMetadata) (ExtraMetadata, error) {
+	md3, ok := md.(*BareRootMetadataV3)
+	if !ok || md3.TlfID().IsPublic() {
+		return nil, nil
+	}
+	wkbID := md3.WriterMetadata.WKeyBundleID
+	rkbID := md3.RKeyBundleID
+
+	kbcache := km.config.KeyBundleCache()
+	wkb, wok := kbcache.GetTLFWriterKeyBundle(wkbID)
+	rkb, rok := kbcache.GetTLFReaderKeyBundle(rkbID)
+	if wok && rok {
+		return &ExtraMetadataV3{wkb: &wkb, rkb: &rkb}, nil
+	}
+
+	km.log.CDebugf(ctx, "Fetching key bundles (%s, %s) for TLF %s",
+		wkbID, rkbID, md3.TlfID())
+	fetchedWkb, fetchedRkb, err := km.config.MDServer().GetKeyBundles(
+		ctx, md3.TlfID(), wkbID, rkbID)
+	if err != nil {
+		return nil, err
+	}
+	if fetchedWkb == nil || fetchedRkb == nil {
+		return nil, MDServerErrorBadRequest{
+			Reason: fmt.Sprintf("Missing key bundles (%s, %s) for TLF %s",
+				wkbID, rkbID, md3.TlfID())}
+	}
+
+	// Putting the bundles into the cache also verifies that they
+	// hash to the IDs we asked for, so a misbehaving server can't
+	// hand us the wrong keys.
+	err = kbcache.PutTLFWriterKeyBundle(wkbID, *fetchedWkb)
+	if err != nil {
+		return nil, err
+	}
+	err = kbcache.PutTLFReaderKeyBundle(rkbID, *fetchedRkb)
+	if err != nil {
+		return nil, err
+	}
+	return &ExtraMetadataV3{wkb: fetchedWkb, rkb: fetchedRkb}, nil
+}
+
 func (km *KeyManagerStandard) getTLFCryptKeyUsingCurrentDevice(
 	ctx context.Context, kmd KeyMetadata, keyGen KeyGen, cache bool) (
 	tlfCryptKey TLFCryptKey, err error) {
@@ -388,11 +436,29 @@ func (km *KeyManagerStandard) generateKeyMapForUsers(ctx context.Context, users
 }
 
 // Rekey implements the KeyManager interface for KeyManagerStandard.
-// TODO make this less terrible.
 func (km *KeyManagerStandard) Rekey(ctx context.Context, md *RootMetadata, promptPaper bool) (
 	rekeyDone bool, cryptKey *TLFCryptKey, err error) {
-	km.log.CDebugf(ctx, "Rekey %s (prompt for paper key: %t)",
-		md.TlfID(), promptPaper)
+	return km.rekey(ctx, md, promptPaper, false)
+}
+
+// RekeyWithNewKeyGeneration implements the KeyManager interface for
+// KeyManagerStandard.
+func (km *KeyManagerStandard) RekeyWithNewKeyGeneration(
+	ctx context.Context, md *RootMetadata) (
+	rekeyDone bool, cryptKey *TLFCryptKey, err error) {
+	if md.TlfID().IsPublic() {
+		return false, nil, fmt.Errorf(
+			"Can't add a key generation to public TLF %v", md.TlfID())
+	}
+	return km.rekey(ctx, md, false, true)
+}
+
+// TODO make this less terrible.
+func (km *KeyManagerStandard) rekey(ctx context.Context, md *RootMetadata,
+	promptPaper bool, forceNewKeyGen bool) (
+	rekeyDone bool, cryptKey *TLFCryptKey, err error) {
+	km.log.CDebugf(ctx, "Rekey %s (prompt for paper key: %t, "+
+		"force new key gen: %t)", md.TlfID(), promptPaper, forceNewKeyGen)
 	defer func() { km.deferLog.CDebugf(ctx, "Rekey %s done: %#v", md.TlfID(), err) }()
 
 	currKeyGen := md.LatestKeyGeneration()
@@ -480,6 +546,10 @@ func (km *KeyManagerStandard) Rekey(ctx context.Context, md *RootMetadata, promp
 		return false, nil, NewReadAccessError(resolvedHandle, username)
 	}
 
+	if !isWriter && forceNewKeyGen {
+		return false, nil, NewWriteAccessError(resolvedHandle, username)
+	}
+
 	// All writer keys in the desired keyset
 	wKeys, err := km.generateKeyMapForUsers(ctx, resolvedHandle.ResolvedWriters())
 	if err != nil {
@@ -517,7 +587,7 @@ func (km *KeyManagerStandard) Rekey(ctx context.Context, md *RootMetadata, promp
 
 		wRemoved := km.usersWithRemovedDevices(ctx, md.TlfID(), wDkim, wKeys)
 		rRemoved := km.usersWithRemovedDevices(ctx, md.TlfID(), rDkim, rKeys)
-		incKeyGen = len(wRemoved) > 0 || len(rRemoved) > 0
+		incKeyGen = forceNewKeyGen || len(wRemoved) > 0 || len(rRemoved) > 0
 
 		promotedReaders = make(map[keybase1.UID]bool, len(rRemoved))
 
@@ -657,6 +657,11 @@ func TestKeyManagerRekeyAddAndRevokeDevice(t *testing.T) {
 		t.Fatalf("Got unexpected error when reading with new key: %v", err)
 	}
 
+	// user 1 can see that the new device is waiting for keys.
+	status, _, err := kbfsOps1.FolderStatus(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+	require.Len(t, status.Rekey.DevicesPending, 1)
+
 	// Set the KBPKI so we can count the identify calls
 	countKBPKI := &identifyCountingKBPKI{
 		KBPKI: config1.KBPKI(),
@@ -673,6 +678,11 @@ func TestKeyManagerRekeyAddAndRevokeDevice(t *testing.T) {
 		t.Fatalf("Couldn't rekey: %v", err)
 	}
 
+	status, _, err = kbfsOps1.FolderStatus(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+	require.Len(t, status.Rekey.DevicesPending, 0)
+	require.Equal(t, "", status.Rekey.LastError)
+
 	// Only u2 should be identified as part of the rekey.
 	if g, e := countKBPKI.getIdentifyCalls(), 1; g != e {
 		t.Errorf("Expected %d identify calls, but got %d", e, g)
@@ -1768,3 +1778,29 @@ func TestKeyManagerRekeyAddDeviceWithPromptViaFolderAccess(t *testing.T) {
 
 	GetRootNodeOrBust(t, config2Dev2, name, false)
 }
+
+func TestKeyManagerGetExtraMetadataMissingBundles(t *testing.T) {
+	mockCtrl, config, ctx := keyManagerInit(t)
+	defer keyManagerShutdown(mockCtrl, config)
+
+	wkbID, _, rkbID, _ := makeTestKeyBundlesForCache(t, config.Codec(), 1)
+	md := &BareRootMetadataV3{
+		WriterMetadata: WriterMetadataV3{
+			ID:           FakeTlfID(1, false),
+			WKeyBundleID: wkbID,
+		},
+		RKeyBundleID: rkbID,
+	}
+
+	// A server that returns no bundles and no error must not crash
+	// the key manager.
+	config.mockKbcache.EXPECT().GetTLFWriterKeyBundle(wkbID).
+		Return(TLFWriterKeyBundleV3{}, false)
+	config.mockKbcache.EXPECT().GetTLFReaderKeyBundle(rkbID).
+		Return(TLFReaderKeyBundleV3{}, false)
+	config.mockMdserv.EXPECT().GetKeyBundles(
+		gomock.Any(), md.TlfID(), wkbID, rkbID).Return(nil, nil, nil)
+
+	_, err := config.KeyManager().GetExtraMetadata(ctx, md)
+	require.IsType(t, MDServerErrorBadRequest{}, err)
+}
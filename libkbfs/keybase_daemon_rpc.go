@@ -49,7 +49,7 @@ func NewKeybaseDaemonRPC(config Config, kbCtx Context, log logger.Logger, debug
 		k.daemonLog.Configure("", true, "")
 	}
 	conn := NewSharedKeybaseConnection(kbCtx, config, k)
-	k.fillClients(conn.GetClient())
+	k.fillClients(newPendingRPCClient("service", conn.GetClient()))
 	k.shutdownFn = conn.Shutdown
 	return k
 }
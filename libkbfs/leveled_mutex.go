@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // The leveledMutex, leveledRWMutex, and lockState types enables a
@@ -88,6 +89,10 @@ type exclusionState struct {
 type lockState struct {
 	levelToString func(mutexLevel) string
 
+	// The priority with which this execution flow queues for any
+	// mutex whose locker is a priorityLocker.
+	priority lockPriority
+
 	// Protects exclusionStates.
 	exclusionStatesLock exclusiveLock
 	// The stack of held mutexes, ordered by increasing level.
@@ -146,12 +151,24 @@ func (state *lockState) doLock(
 		}
 	}
 
-	lock.Lock()
+	tracking := atomic.LoadInt32(&lockTracking) != 0
+	if tracking {
+		state.trackWaiting(exclusionState{level, exclusionType})
+	}
+
+	if pl, ok := lock.(priorityLocker); ok {
+		pl.lockWithPriority(state.priority)
+	} else {
+		lock.Lock()
+	}
 
 	state.exclusionStates = append(state.exclusionStates, exclusionState{
 		level:         level,
 		exclusionType: exclusionType,
 	})
+	if tracking {
+		state.trackHeld()
+	}
 	return nil
 }
 
@@ -207,9 +224,207 @@ func (state *lockState) doUnlock(
 	lock.Unlock()
 
 	state.exclusionStates = state.exclusionStates[:len(state.exclusionStates)-1]
+	if atomic.LoadInt32(&lockTracking) != 0 {
+		state.trackHeld()
+	}
 	return nil
 }
 
+// lockTracking is the number of users (slowOpWatchdogs) that want
+// to know which mutexes each execution flow holds or waits for.
+// While it's non-zero, every lockState that holds or waits for a
+// mutex is in trackedLockStates.
+var lockTracking int32
+
+// lockSequencing is non-zero while a lockSequencer is set with
+// setLockSequencer.
+var lockSequencing int32
+
+// lockSequencer is told about every leveled mutex operation while
+// it's set, so that it can decide in which order goroutines get to
+// take mutexes.  Mutexes are identified by their underlying
+// lockers, and holders by their lockStates, since an execution flow
+// may unlock a mutex from a different goroutine than it locked it
+// from.
+type lockSequencer interface {
+	// beforeLock is called before state takes the mutex identified
+	// by key, and may block for as long as it likes.
+	beforeLock(state *lockState, key interface{}, name string,
+		exclusive bool)
+	// afterUnlock is called after state releases the mutex
+	// identified by key.
+	afterUnlock(state *lockState, key interface{}, exclusive bool)
+	// handOff is called on a goroutine that's about to wait for a
+	// new goroutine to carry on its work.  The new goroutine calls
+	// the returned takeOver function first, and the function that
+	// returns once it's done.
+	handOff() (takeOver func() (done func()))
+}
+
+var currentLockSequencer struct {
+	lock      sync.RWMutex
+	sequencer lockSequencer
+}
+
+// setLockSequencer makes s the lockSequencer of every leveled mutex
+// operation, or stops sequencing them if s is nil.
+func setLockSequencer(s lockSequencer) {
+	currentLockSequencer.lock.Lock()
+	defer currentLockSequencer.lock.Unlock()
+	currentLockSequencer.sequencer = s
+	if s != nil {
+		atomic.StoreInt32(&lockSequencing, 1)
+	} else {
+		atomic.StoreInt32(&lockSequencing, 0)
+	}
+}
+
+func getLockSequencer() lockSequencer {
+	if atomic.LoadInt32(&lockSequencing) == 0 {
+		return nil
+	}
+	currentLockSequencer.lock.RLock()
+	defer currentLockSequencer.lock.RUnlock()
+	return currentLockSequencer.sequencer
+}
+
+func (state *lockState) sequenceLock(
+	key interface{}, level mutexLevel, exclusive bool) {
+	if s := getLockSequencer(); s != nil {
+		s.beforeLock(state, key, state.levelToString(level), exclusive)
+	}
+}
+
+// goHandingOff runs f in a new goroutine that carries on the work of
+// the calling goroutine, which must wait for it, as far as the
+// current lockSequencer is concerned.
+func goHandingOff(f func()) {
+	takeOver := func() (done func()) { return func() {} }
+	if s := getLockSequencer(); s != nil {
+		takeOver = s.handOff()
+	}
+	go func() {
+		defer takeOver()()
+		f()
+	}()
+}
+
+func (state *lockState) sequenceUnlock(key interface{}, exclusive bool) {
+	if s := getLockSequencer(); s != nil {
+		s.afterUnlock(state, key, exclusive)
+	}
+}
+
+// lockTrack is what a tracked lockState holds and waits for.
+type lockTrack struct {
+	levelToString func(mutexLevel) string
+	goroutine     uint64
+	held          []exclusionState
+	waiting       *exclusionState
+	waitingSince  time.Time
+}
+
+var trackedLockStates = struct {
+	lock   sync.Mutex
+	states map[*lockState]*lockTrack
+}{states: make(map[*lockState]*lockTrack)}
+
+// startLockTracking makes every lockState track its mutexes until the
+// matching stopLockTracking call.
+func startLockTracking() {
+	atomic.AddInt32(&lockTracking, 1)
+}
+
+func stopLockTracking() {
+	if atomic.AddInt32(&lockTracking, -1) != 0 {
+		return
+	}
+	trackedLockStates.lock.Lock()
+	defer trackedLockStates.lock.Unlock()
+	trackedLockStates.states = make(map[*lockState]*lockTrack)
+}
+
+// getTrackLocked returns the lockTrack for state, making it if need
+// be.  trackedLockStates.lock must be held.
+func (state *lockState) getTrackLocked() *lockTrack {
+	track := trackedLockStates.states[state]
+	if track == nil {
+		track = &lockTrack{
+			levelToString: state.levelToString,
+			goroutine:     currentGoroutineID(),
+		}
+		trackedLockStates.states[state] = track
+	}
+	return track
+}
+
+// trackWaiting records that state is about to wait for the given
+// mutex.  state.exclusionStatesLock must be held.
+func (state *lockState) trackWaiting(waiting exclusionState) {
+	trackedLockStates.lock.Lock()
+	defer trackedLockStates.lock.Unlock()
+	track := state.getTrackLocked()
+	track.waiting = &waiting
+	track.waitingSince = time.Now()
+}
+
+// trackHeld records the mutexes state holds now, and that it's not
+// waiting for any.  state.exclusionStatesLock must be held.
+func (state *lockState) trackHeld() {
+	trackedLockStates.lock.Lock()
+	defer trackedLockStates.lock.Unlock()
+	if len(state.exclusionStates) == 0 {
+		delete(trackedLockStates.states, state)
+		return
+	}
+	track := state.getTrackLocked()
+	track.held = append(track.held[:0], state.exclusionStates...)
+	track.waiting = nil
+}
+
+// LockStatus describes the leveled mutexes, like those of a
+// folderBranchOps, that an execution flow holds or is waiting for.
+type LockStatus struct {
+	// Goroutine is the ID of the goroutine that last started
+	// holding or waiting for a mutex in the flow.
+	Goroutine uint64
+	// Held lists the held mutexes, in locking order,
+	// e.g. "mdWriterLock" or "headLock (R)".
+	Held []string `json:",omitempty"`
+	// Waiting is the mutex the flow is waiting for, if any.
+	Waiting      string     `json:",omitempty"`
+	WaitingSince *time.Time `json:",omitempty"`
+}
+
+func (es exclusionState) describe(levelToString func(mutexLevel) string) string {
+	if es.exclusionType == readExclusion {
+		return levelToString(es.level) + " (R)"
+	}
+	return levelToString(es.level)
+}
+
+// trackedLockStatuses returns the status of every execution flow
+// holding or waiting for a mutex, as long as lock tracking is on.
+func trackedLockStatuses() []LockStatus {
+	trackedLockStates.lock.Lock()
+	defer trackedLockStates.lock.Unlock()
+	statuses := make([]LockStatus, 0, len(trackedLockStates.states))
+	for _, track := range trackedLockStates.states {
+		status := LockStatus{Goroutine: track.goroutine}
+		for _, es := range track.held {
+			status.Held = append(
+				status.Held, es.describe(track.levelToString))
+		}
+		if track.waiting != nil {
+			status.Waiting = track.waiting.describe(track.levelToString)
+			since := track.waitingSince
+			status.WaitingSince = &since
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
 // getExclusionType returns returns the exclusionType for the given
 // mutexLevel, or nonExclusion if there is none.
 func (state *lockState) getExclusionType(level mutexLevel) exclusionType {
@@ -246,6 +461,7 @@ func makeLeveledMutex(level mutexLevel, locker sync.Locker) leveledMutex {
 }
 
 func (m leveledMutex) Lock(lockState *lockState) {
+	lockState.sequenceLock(m.locker, m.level, true)
 	err := lockState.doLock(m.level, writeExclusion, m.locker)
 	if err != nil {
 		panic(err)
@@ -257,6 +473,7 @@ func (m leveledMutex) Unlock(lockState *lockState) {
 	if err != nil {
 		panic(err)
 	}
+	lockState.sequenceUnlock(m.locker, true)
 }
 
 type unexpectedExclusionError struct {
@@ -304,8 +521,8 @@ func (m leveledMutex) AssertLocked(lockState *lockState) {
 	et := lockState.getExclusionType(m.level)
 	if et != writeExclusion {
 		panic(unexpectedExclusionTypeError{
-			levelToString: lockState.levelToString,
-			level:         m.level,
+			levelToString:         lockState.levelToString,
+			level:                 m.level,
 			expectedExclusionType: writeExclusion,
 			exclusionType:         et,
 		})
@@ -335,6 +552,7 @@ func makeLeveledRWMutex(level mutexLevel, rwLocker rwLocker) leveledRWMutex {
 }
 
 func (rw leveledRWMutex) Lock(lockState *lockState) {
+	lockState.sequenceLock(rw.rwLocker, rw.level, true)
 	err := lockState.doLock(rw.level, writeExclusion, rw.rwLocker)
 	if err != nil {
 		panic(err)
@@ -346,9 +564,11 @@ func (rw leveledRWMutex) Unlock(lockState *lockState) {
 	if err != nil {
 		panic(err)
 	}
+	lockState.sequenceUnlock(rw.rwLocker, true)
 }
 
 func (rw leveledRWMutex) RLock(lockState *lockState) {
+	lockState.sequenceLock(rw.rwLocker, rw.level, false)
 	err := lockState.doLock(rw.level, readExclusion, rw.rwLocker.RLocker())
 	if err != nil {
 		panic(err)
@@ -360,6 +580,7 @@ func (rw leveledRWMutex) RUnlock(lockState *lockState) {
 	if err != nil {
 		panic(err)
 	}
+	lockState.sequenceUnlock(rw.rwLocker, false)
 }
 
 // AssertUnlocked does nothing if m is unlocked with respect to the
@@ -381,8 +602,8 @@ func (rw leveledRWMutex) AssertLocked(lockState *lockState) {
 	et := lockState.getExclusionType(rw.level)
 	if et != writeExclusion {
 		panic(unexpectedExclusionTypeError{
-			levelToString: lockState.levelToString,
-			level:         rw.level,
+			levelToString:         lockState.levelToString,
+			level:                 rw.level,
 			expectedExclusionType: writeExclusion,
 			exclusionType:         et,
 		})
@@ -395,8 +616,8 @@ func (rw leveledRWMutex) AssertRLocked(lockState *lockState) {
 	et := lockState.getExclusionType(rw.level)
 	if et != readExclusion {
 		panic(unexpectedExclusionTypeError{
-			levelToString: lockState.levelToString,
-			level:         rw.level,
+			levelToString:         lockState.levelToString,
+			level:                 rw.level,
 			expectedExclusionType: readExclusion,
 			exclusionType:         et,
 		})
@@ -0,0 +1,210 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// LocalFilesLimitBytesDefault is the default limit on the bytes the
+// contents of local-only files may take up on disk.
+const LocalFilesLimitBytesDefault = 1 << 30
+
+// LocalFileStore keeps the contents of local-only files, the ones
+// the frontends keep out of KBFS because they match an ignore file
+// (see KBFSIgnoreFileName), in a directory on local disk.  Their
+// total size is limited, and the store is emptied whenever it's
+// opened, since nothing refers to the files of an earlier run.
+type LocalFileStore struct {
+	dir   string
+	limit int64
+
+	lock   sync.Mutex
+	used   int64
+	nextID uint64
+}
+
+func newLocalFileStore(dir string, limit int64) (*LocalFileStore, error) {
+	// Clear out anything left from the last run.
+	err := os.RemoveAll(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalFileStore{dir: dir, limit: limit}, nil
+}
+
+type localFileStoreGetter interface {
+	getLocalFileStore() *LocalFileStore
+}
+
+// GetLocalFileStore returns the local-only file store of the given
+// config, or nil if local-only files aren't enabled.
+func GetLocalFileStore(config Config) *LocalFileStore {
+	if getter, ok := config.(localFileStoreGetter); ok {
+		return getter.getLocalFileStore()
+	}
+	return nil
+}
+
+// Create makes a new empty file in the store.
+func (s *LocalFileStore) Create() (*LocalFileData, error) {
+	s.lock.Lock()
+	s.nextID++
+	id := s.nextID
+	s.lock.Unlock()
+
+	f, err := os.OpenFile(filepath.Join(s.dir, fmt.Sprintf("%d", id)),
+		os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalFileData{store: s, f: f}, nil
+}
+
+// grow counts n more bytes against the limit, or returns
+// DiskLimitReachedError if that would go over it.
+func (s *LocalFileStore) grow(n int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.limit > 0 && s.used+n > s.limit {
+		return DiskLimitReachedError{s.used, s.limit}
+	}
+	s.used += n
+	return nil
+}
+
+func (s *LocalFileStore) shrink(n int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.used -= n
+}
+
+var errLocalFileRemoved = errors.New("Local-only file was removed")
+
+// LocalFileData is the contents of one local-only file in a
+// LocalFileStore.  It's safe for concurrent use.
+type LocalFileData struct {
+	store *LocalFileStore
+
+	lock sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// Size returns the size of the file.
+func (d *LocalFileData) Size() uint64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return uint64(d.size)
+}
+
+// ReadAt reads into p from off, and returns how many bytes it read,
+// which is less than len(p) only at the end of the file.
+func (d *LocalFileData) ReadAt(p []byte, off int64) (int, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.f == nil {
+		return 0, errLocalFileRemoved
+	}
+	if off >= d.size {
+		return 0, nil
+	}
+	if int64(len(p)) > d.size-off {
+		p = p[:d.size-off]
+	}
+	n, err := d.f.ReadAt(p, off)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// resizeLocked counts the change in size against the store's limit.
+func (d *LocalFileData) resizeLocked(size int64) error {
+	if size > d.size {
+		err := d.store.grow(size - d.size)
+		if err != nil {
+			return err
+		}
+	} else {
+		d.store.shrink(d.size - size)
+	}
+	d.size = size
+	return nil
+}
+
+// WriteAt writes p at off, growing the file if needed.  Returns
+// DiskLimitReachedError if the store has no room for the growth.
+func (d *LocalFileData) WriteAt(p []byte, off int64) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.f == nil {
+		return errLocalFileRemoved
+	}
+	oldSize := d.size
+	if end := off + int64(len(p)); end > d.size {
+		err := d.resizeLocked(end)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := d.f.WriteAt(p, off)
+	if err != nil {
+		// Give back the growth, since the file didn't take it up.
+		_ = d.resizeLocked(oldSize)
+		_ = d.f.Truncate(oldSize)
+		return err
+	}
+	return nil
+}
+
+// Truncate grows or shrinks the file to size.
+func (d *LocalFileData) Truncate(size uint64) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.f == nil {
+		return errLocalFileRemoved
+	}
+	oldSize := d.size
+	err := d.resizeLocked(int64(size))
+	if err != nil {
+		return err
+	}
+	err = d.f.Truncate(int64(size))
+	if err != nil {
+		_ = d.resizeLocked(oldSize)
+		return err
+	}
+	return nil
+}
+
+// Remove deletes the file from the store.  It can't be used
+// afterwards.
+func (d *LocalFileData) Remove() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.f == nil {
+		return nil
+	}
+	d.store.shrink(d.size)
+	d.size = 0
+	name := d.f.Name()
+	closeErr := d.f.Close()
+	d.f = nil
+	err := os.Remove(name)
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
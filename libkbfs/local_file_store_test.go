@@ -0,0 +1,116 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func makeTestLocalFileStore(t *testing.T, limit int64) (
+	*LocalFileStore, string) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "local_file_store")
+	require.NoError(t, err)
+	// Anything already in the directory is cleared out.
+	err = ioutil.WriteFile(filepath.Join(tempdir, "stale"), []byte{1}, 0600)
+	require.NoError(t, err)
+	s, err := newLocalFileStore(tempdir, limit)
+	require.NoError(t, err)
+	fis, err := ioutil.ReadDir(tempdir)
+	require.NoError(t, err)
+	require.Len(t, fis, 0)
+	return s, tempdir
+}
+
+func TestLocalFileStoreReadWriteTruncate(t *testing.T) {
+	s, tempdir := makeTestLocalFileStore(t, 0)
+	defer os.RemoveAll(tempdir)
+
+	d, err := s.Create()
+	require.NoError(t, err)
+	err = d.WriteAt([]byte("world"), 7)
+	require.NoError(t, err)
+	err = d.WriteAt([]byte("hello,"), 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(12), d.Size())
+
+	buf := make([]byte, 20)
+	n, err := d.ReadAt(buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, "hello,\x00world", string(buf[:n]))
+	n, err = d.ReadAt(buf, 12)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	err = d.Truncate(5)
+	require.NoError(t, err)
+	n, err = d.ReadAt(buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf[:n]))
+	err = d.Truncate(7)
+	require.NoError(t, err)
+	n, err = d.ReadAt(buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, "hello\x00\x00", string(buf[:n]))
+}
+
+func TestLocalFileStoreLimit(t *testing.T) {
+	s, tempdir := makeTestLocalFileStore(t, 10)
+	defer os.RemoveAll(tempdir)
+
+	d1, err := s.Create()
+	require.NoError(t, err)
+	d2, err := s.Create()
+	require.NoError(t, err)
+	err = d1.WriteAt(make([]byte, 6), 0)
+	require.NoError(t, err)
+
+	// Both the write and the truncate would take the store over its
+	// limit, and leave the file as it was.
+	err = d2.WriteAt(make([]byte, 5), 0)
+	require.IsType(t, DiskLimitReachedError{}, err)
+	err = d2.Truncate(5)
+	require.IsType(t, DiskLimitReachedError{}, err)
+	require.Equal(t, uint64(0), d2.Size())
+	err = d2.WriteAt(make([]byte, 4), 0)
+	require.NoError(t, err)
+
+	// Shrinking or removing a file makes room again.
+	err = d1.Truncate(1)
+	require.NoError(t, err)
+	err = d2.WriteAt(make([]byte, 5), 4)
+	require.NoError(t, err)
+	err = d2.Remove()
+	require.NoError(t, err)
+	err = d1.WriteAt(make([]byte, 10), 0)
+	require.NoError(t, err)
+}
+
+func TestLocalFileStoreRemove(t *testing.T) {
+	s, tempdir := makeTestLocalFileStore(t, 0)
+	defer os.RemoveAll(tempdir)
+
+	d, err := s.Create()
+	require.NoError(t, err)
+	err = d.WriteAt([]byte("hello"), 0)
+	require.NoError(t, err)
+	err = d.Remove()
+	require.NoError(t, err)
+	fis, err := ioutil.ReadDir(tempdir)
+	require.NoError(t, err)
+	require.Len(t, fis, 0)
+
+	_, err = d.ReadAt(make([]byte, 5), 0)
+	require.Equal(t, errLocalFileRemoved, err)
+	err = d.WriteAt([]byte("hello"), 0)
+	require.Equal(t, errLocalFileRemoved, err)
+	// Removing it again is a no-op.
+	err = d.Remove()
+	require.NoError(t, err)
+}
@@ -0,0 +1,140 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"golang.org/x/net/context"
+)
+
+// TLFHistoryBundleEntry is one signed MD object in a
+// TLFHistoryBundle, encoded just as the MD server hands it out.
+type TLFHistoryBundleEntry struct {
+	Version MetadataVer
+	RMDS    []byte
+}
+
+// TLFHistoryBundle is a portable copy of a range of a TLF's merged MD
+// history, which can be checked by VerifyTLFHistoryBundle without
+// any access to KBFS servers.  It is suitable for encoding with the
+// KBFS codec.
+//
+// The MD server doesn't yet hand out Merkle inclusion proofs, so a
+// bundle can only show that its revisions are validly signed and
+// form an unbroken chain, not that the chain is the one the server
+// shows everyone else.
+type TLFHistoryBundle struct {
+	Tlf     TlfID
+	Entries []TLFHistoryBundleEntry
+}
+
+// TLFHistoryRevision is what VerifyTLFHistoryBundle vouches for about
+// one revision.  An auditor still needs to check, against each user's
+// sigchain, that the given keys belonged to the given users.
+type TLFHistoryRevision struct {
+	Revision MetadataRevision
+	ID       MdID
+	PrevRoot MdID
+	// Writer signed the file data changes, with WriterKID.
+	Writer    keybase1.UID
+	WriterKID keybase1.KID
+	// LastModifyingUser signed the MD as a whole (which might
+	// only have changed keys), with LastModifyingKID.
+	LastModifyingUser keybase1.UID
+	LastModifyingKID  keybase1.KID
+}
+
+// ExportTLFHistory fetches the merged revisions from start to stop
+// (inclusive) of the given TLF from the MD server, and bundles them
+// up without any further processing.
+func ExportTLFHistory(ctx context.Context, config Config, id TlfID,
+	start, stop MetadataRevision) (TLFHistoryBundle, error) {
+	bundle := TLFHistoryBundle{Tlf: id}
+	codec := config.Codec()
+	for start <= stop {
+		rmdses, err := config.MDServer().GetRange(
+			ctx, id, NullBranchID, Merged, start, stop)
+		if err != nil {
+			return TLFHistoryBundle{}, err
+		}
+		if len(rmdses) == 0 {
+			break
+		}
+		for _, rmds := range rmdses {
+			buf, err := codec.Encode(rmds)
+			if err != nil {
+				return TLFHistoryBundle{}, err
+			}
+			bundle.Entries = append(bundle.Entries, TLFHistoryBundleEntry{
+				Version: rmds.MD.Version(),
+				RMDS:    buf,
+			})
+		}
+		// The server may return fewer revisions than asked for.
+		start = rmdses[len(rmdses)-1].MD.RevisionNumber() + 1
+	}
+	return bundle, nil
+}
+
+// VerifyTLFHistoryBundle checks that every MD in the bundle belongs
+// to the bundle's TLF, is merged, and is validly signed, and that
+// each one is a valid successor of the one before it.  It returns
+// what it verified about each revision, in order.
+func VerifyTLFHistoryBundle(codec Codec, crypto cryptoPure,
+	bundle TLFHistoryBundle) ([]TLFHistoryRevision, error) {
+	var revs []TLFHistoryRevision
+	var prev *RootMetadataSigned
+	var prevID MdID
+	// Check the signatures of all the revisions at once.
+	sigs := newSigBatch(crypto)
+	for i, e := range bundle.Entries {
+		rmds, err := DecodeRootMetadataSigned(
+			codec, bundle.Tlf, e.Version, e.Version, e.RMDS)
+		if err != nil {
+			return nil, fmt.Errorf("Entry %d: %v", i, err)
+		}
+		md := rmds.MD
+		if md.TlfID() != bundle.Tlf {
+			return nil, MDTlfIDMismatch{bundle.Tlf, md.TlfID()}
+		}
+		if md.MergedStatus() != Merged {
+			return nil, fmt.Errorf("Revision %d is not merged",
+				md.RevisionNumber())
+		}
+		// MDv3 TODO: pass actual key bundles
+		err = rmds.IsValidAndSigned(codec, sigs, nil)
+		if err != nil {
+			return nil, fmt.Errorf("Revision %d: %v", md.RevisionNumber(), err)
+		}
+		if prev != nil {
+			err = prev.MD.CheckValidSuccessor(prevID, md)
+			if err != nil {
+				return nil, err
+			}
+		}
+		id, err := crypto.MakeMdID(md)
+		if err != nil {
+			return nil, err
+		}
+
+		revs = append(revs, TLFHistoryRevision{
+			Revision:          md.RevisionNumber(),
+			ID:                id,
+			PrevRoot:          md.GetPrevRoot(),
+			Writer:            md.LastModifyingWriter(),
+			WriterKID:         md.LastModifyingWriterKID(),
+			LastModifyingUser: md.GetLastModifyingUser(),
+			LastModifyingKID:  rmds.SigInfo.VerifyingKey.KID(),
+		})
+		prev, prevID = rmds, id
+	}
+	err := sigs.verify()
+	if err != nil {
+		return nil, fmt.Errorf("Could not verify bundle: %v", err)
+	}
+	return revs, nil
+}
@@ -0,0 +1,60 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportAndVerifyTLFHistory(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer config.Shutdown()
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	_, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	require.NoError(t, err)
+
+	tlf := rootNode.GetFolderBranch().Tlf
+	bundle, err := ExportTLFHistory(ctx, config, tlf,
+		MetadataRevisionInitial, MetadataRevisionInitial+10)
+	require.NoError(t, err)
+	require.Len(t, bundle.Entries, 3)
+
+	revs, err := VerifyTLFHistoryBundle(config.Codec(), config.Crypto(), bundle)
+	require.NoError(t, err)
+	require.Len(t, revs, 3)
+	for i, rev := range revs {
+		require.Equal(t, MetadataRevisionInitial+MetadataRevision(i),
+			rev.Revision)
+		if i > 0 {
+			require.Equal(t, revs[i-1].ID, rev.PrevRoot)
+		}
+	}
+
+	// Dropping a revision from the middle breaks the chain.
+	gapped := TLFHistoryBundle{
+		Tlf:     tlf,
+		Entries: []TLFHistoryBundleEntry{bundle.Entries[0], bundle.Entries[2]},
+	}
+	_, err = VerifyTLFHistoryBundle(config.Codec(), config.Crypto(), gapped)
+	require.IsType(t, MDRevisionMismatch{}, err)
+
+	// So does tampering with the encoded MD.
+	tampered := TLFHistoryBundle{
+		Tlf:     tlf,
+		Entries: append([]TLFHistoryBundleEntry(nil), bundle.Entries...),
+	}
+	buf := append([]byte(nil), tampered.Entries[1].RMDS...)
+	buf[len(buf)-1] ^= 0xff
+	tampered.Entries[1].RMDS = buf
+	_, err = VerifyTLFHistoryBundle(config.Codec(), config.Crypto(), tampered)
+	require.Error(t, err)
+}
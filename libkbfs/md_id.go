@@ -40,6 +40,12 @@ func (id MdID) MarshalBinary() (data []byte, err error) {
 	return id.h.MarshalBinary()
 }
 
+// MarshalJSON implements the encoding.json.Marshaler interface for
+// MdID.
+func (id MdID) MarshalJSON() ([]byte, error) {
+	return id.h.MarshalJSON()
+}
+
 // UnmarshalBinary implements the encoding.BinaryUnmarshaler interface
 // for MdID. Returns an error if the given byte array is non-empty and
 // the MdID is invalid.
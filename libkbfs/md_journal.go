@@ -163,17 +163,17 @@ func (j mdJournal) mdPath(id MdID) string {
 func (j mdJournal) getMD(currentUID keybase1.UID,
 	currentVerifyingKey VerifyingKey, id MdID, verifyBranchID bool) (
 	BareRootMetadata, time.Time, error) {
-	// Read file.
-
-	path := j.mdPath(id)
-	data, err := ioutil.ReadFile(path)
-	if err != nil {
-		return nil, time.Time{}, err
-	}
+	return j.getMDWithCrypto(
+		j.crypto, currentUID, currentVerifyingKey, id, verifyBranchID)
+}
 
-	// TODO: the file needs to encode the version
-	var rmd BareRootMetadataV2
-	err = j.codec.Decode(data, &rmd)
+// getMDWithCrypto is like getMD, but checks the writer signature
+// with the given crypto, which may be a sigBatch that defers the
+// check.
+func (j mdJournal) getMDWithCrypto(crypto cryptoPure,
+	currentUID keybase1.UID, currentVerifyingKey VerifyingKey, id MdID,
+	verifyBranchID bool) (BareRootMetadata, time.Time, error) {
+	rmd, err := j.readMD(id)
 	if err != nil {
 		return nil, time.Time{}, err
 	}
@@ -181,7 +181,7 @@ func (j mdJournal) getMD(currentUID keybase1.UID,
 	// Check integrity.
 
 	// TODO: MakeMdID serializes rmd -- use data instead.
-	mdID, err := j.crypto.MakeMdID(&rmd)
+	mdID, err := j.crypto.MakeMdID(rmd)
 	if err != nil {
 		return nil, time.Time{}, err
 	}
@@ -197,7 +197,7 @@ func (j mdJournal) getMD(currentUID keybase1.UID,
 	}
 
 	// MDv3 TODO: pass key bundles when needed
-	err = rmd.IsValidAndSigned(j.codec, j.crypto, nil)
+	err = rmd.IsValidAndSigned(j.codec, crypto, nil)
 	if err != nil {
 		return nil, time.Time{}, err
 	}
@@ -208,19 +208,47 @@ func (j mdJournal) getMD(currentUID keybase1.UID,
 			j.branchID, rmd.BID())
 	}
 
-	fi, err := os.Stat(path)
+	fi, err := os.Stat(j.mdPath(id))
 	if err != nil {
 		return nil, time.Time{}, err
 	}
 
-	return &rmd, fi.ModTime(), nil
+	return rmd, fi.ModTime(), nil
+}
+
+// readMD reads and decodes the metadata object with the given ID,
+// without checking it in any way.
+func (j mdJournal) readMD(id MdID) (*BareRootMetadataV2, error) {
+	p := j.mdPath(id)
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeJournalMD(j.codec, p, data)
+}
+
+// decodeJournalMD decodes data, read from the given path, as a
+// journaled metadata object.
+func decodeJournalMD(codec Codec, p string, data []byte) (
+	*BareRootMetadataV2, error) {
+	// TODO: the file needs to encode the version
+	var rmd BareRootMetadataV2
+	err := codec.Decode(data, &rmd)
+	if err != nil {
+		return nil, JournalEntryDecodeError{p, err}
+	}
+	return &rmd, nil
 }
 
 // putMD stores the given metadata under its ID, if it's not already
 // stored.
+// putMD writes rmd to its own file. If localTimestamp is non-zero,
+// the file's modification time is set to it, instead of being left
+// as the time of the write.
 func (j mdJournal) putMD(
 	currentUID keybase1.UID, currentVerifyingKey VerifyingKey,
-	rmd BareRootMetadata) (MdID, error) {
+	rmd BareRootMetadata, localTimestamp time.Time) (MdID, error) {
 	// MDv3 TODO: pass key bundles when needed
 	err := rmd.IsValidAndSigned(j.codec, j.crypto, nil)
 	if err != nil {
@@ -264,6 +292,13 @@ func (j mdJournal) putMD(
 		return MdID{}, err
 	}
 
+	if !localTimestamp.IsZero() {
+		err = os.Chtimes(path, localTimestamp, localTimestamp)
+		if err != nil {
+			return MdID{}, err
+		}
+	}
+
 	return id, nil
 }
 
@@ -391,11 +426,15 @@ func (j *mdJournal) convertToBranch(
 
 	tempJournal := makeMdIDJournal(j.codec, journalTempDir)
 
-	var prevID MdID
-
+	brmds := make([]MutableBareRootMetadata, len(allMdIDs))
+	timestamps := make([]time.Time, len(allMdIDs))
+	bufs := make([][]byte, len(allMdIDs))
+	// The old writer signatures are all checked at once, before
+	// the new ones are made.
+	sigs := newSigBatch(j.crypto)
 	for i, id := range allMdIDs {
-		ibrmd, _, err := j.getMD(
-			currentUID, currentVerifyingKey, id, true)
+		ibrmd, ts, err := j.getMDWithCrypto(
+			sigs, currentUID, currentVerifyingKey, id, true)
 		if err != nil {
 			return NullBranchID, err
 		}
@@ -409,17 +448,32 @@ func (j *mdJournal) convertToBranch(
 		// Delete the old "merged" version from the cache.
 		mdcache.Delete(tlfID, ibrmd.RevisionNumber(), NullBranchID)
 
-		// Re-sign the writer metadata.
 		buf, err := brmd.GetSerializedWriterMetadata(j.codec)
 		if err != nil {
 			return NullBranchID, err
 		}
+		brmds[i] = brmd
+		timestamps[i] = ts
+		bufs[i] = buf
+	}
 
-		sigInfo, err := signer.Sign(ctx, buf)
-		if err != nil {
-			return NullBranchID, err
-		}
-		brmd.SetWriterMetadataSigInfo(sigInfo)
+	err = sigs.verify()
+	if err != nil {
+		return NullBranchID, err
+	}
+
+	// Re-sign all the writer metadata at once, since the writer
+	// metadata doesn't depend on the prev root.
+	sigInfos, err := signer.SignBatch(ctx, bufs)
+	if err != nil {
+		return NullBranchID, err
+	}
+
+	var prevID MdID
+
+	for i, id := range allMdIDs {
+		brmd := brmds[i]
+		brmd.SetWriterMetadataSigInfo(sigInfos[i])
 
 		j.log.CDebugf(ctx, "Old prev root of rev=%s is %s",
 			brmd.RevisionNumber(), brmd.GetPrevRoot())
@@ -430,13 +484,11 @@ func (j *mdJournal) convertToBranch(
 			brmd.SetPrevRoot(prevID)
 		}
 
-		// TODO: this rewrites the file, and so the modification time
-		// no longer tracks when exactly the original operation is
-		// done, so future ImmutableBareMetadatas for this MD will
-		// have a slightly wrong localTimestamp.  Instead, we might
-		// want to pass in the timestamp and do an explicit
-		// os.Chtimes() on the file after writing it.
-		newID, err := j.putMD(currentUID, currentVerifyingKey, brmd)
+		// Rewriting the file would otherwise change its
+		// modification time, and with it the localTimestamp of
+		// this MD, so keep the original one.
+		newID, err := j.putMD(
+			currentUID, currentVerifyingKey, brmd, timestamps[i])
 		if err != nil {
 			return NullBranchID, err
 		}
@@ -619,20 +671,26 @@ func (j mdJournal) getRange(
 		return nil, err
 	}
 	var rmds []ImmutableBareRootMetadata
+	// Check the writer signatures of the whole range at once.
+	sigs := newSigBatch(j.crypto)
 	for i, mdID := range mdIDs {
 		expectedRevision := realStart + MetadataRevision(i)
-		rmd, ts, err := j.getMD(
-			currentUID, currentVerifyingKey, mdID, true)
+		rmd, ts, err := j.getMDWithCrypto(
+			sigs, currentUID, currentVerifyingKey, mdID, true)
 		if err != nil {
 			return nil, err
 		}
 		if expectedRevision != rmd.RevisionNumber() {
-			panic(fmt.Errorf("expected revision %v, got %v",
-				expectedRevision, rmd.RevisionNumber()))
+			return nil, MDRangeRevisionError{
+				expectedRevision, rmd.RevisionNumber()}
 		}
 		irmd := MakeImmutableBareRootMetadata(rmd, mdID, ts)
 		rmds = append(rmds, irmd)
 	}
+	err = sigs.verify()
+	if err != nil {
+		return nil, err
+	}
 
 	return rmds, nil
 }
@@ -806,7 +864,21 @@ func (j *mdJournal) put(
 		return MdID{}, err
 	}
 
-	id, err := j.putMD(currentUID, currentVerifyingKey, brmd)
+	// The localTimestamp of an MD comes from the wall clock, so
+	// if the clock jumped back since head was written, use head's
+	// timestamp instead; read snapshots rely on the timestamps
+	// never going backwards across revisions.
+	var localTimestamp time.Time
+	if head != (ImmutableBareRootMetadata{}) &&
+		time.Now().Before(head.localTimestamp) {
+		j.log.CDebugf(ctx, "Clock is behind head rev=%s; using "+
+			"its timestamp %s", head.RevisionNumber(),
+			head.localTimestamp)
+		localTimestamp = head.localTimestamp
+	}
+
+	id, err := j.putMD(
+		currentUID, currentVerifyingKey, brmd, localTimestamp)
 	if err != nil {
 		return MdID{}, err
 	}
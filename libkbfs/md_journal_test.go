@@ -10,6 +10,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"golang.org/x/net/context"
 
@@ -430,6 +431,45 @@ func TestMDJournalPutCase4(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestMDJournalTimestampsAfterClockJump(t *testing.T) {
+	uid, verifyingKey, _, _, id, signer, ekg, bsplit, tempdir, j :=
+		setupMDJournalTest(t)
+	defer teardownMDJournalTest(t, tempdir)
+
+	ctx := context.Background()
+	md := makeMDForTest(t, id, MetadataRevision(10), uid, fakeMdID(1))
+	mdID, err := j.put(ctx, uid, verifyingKey, signer, ekg, bsplit, md)
+	require.NoError(t, err)
+
+	// Pretend the clock jumped back an hour after the first put.
+	later := time.Now().Add(time.Hour).Truncate(time.Second)
+	err = os.Chtimes(j.mdPath(mdID), later, later)
+	require.NoError(t, err)
+
+	md = makeMDForTest(t, id, MetadataRevision(11), uid, mdID)
+	_, err = j.put(ctx, uid, verifyingKey, signer, ekg, bsplit, md)
+	require.NoError(t, err)
+
+	// MDv3 TODO: pass actual key bundles
+	head, err := j.getHead(uid, verifyingKey, nil)
+	require.NoError(t, err)
+	require.True(t, head.localTimestamp.Equal(later))
+
+	// Branch conversion should keep the timestamps.
+	ibrmds, err := j.getRange(uid, verifyingKey, nil, 1, 20)
+	require.NoError(t, err)
+	_, err = j.convertToBranch(ctx, uid, verifyingKey, signer, id,
+		NewMDCacheStandard(10))
+	require.NoError(t, err)
+	converted, err := j.getRange(uid, verifyingKey, nil, 1, 20)
+	require.NoError(t, err)
+	require.Equal(t, len(ibrmds), len(converted))
+	for i := range ibrmds {
+		require.True(t, converted[i].localTimestamp.Equal(
+			ibrmds[i].localTimestamp))
+	}
+}
+
 func testMDJournalGCd(t *testing.T, j *mdJournal) {
 	filepath.Walk(j.j.j.dir, func(path string, _ os.FileInfo, _ error) error {
 		// We should only find the root directory here.
@@ -520,6 +560,15 @@ func (s *limitedCryptoSigner) Sign(ctx context.Context, msg []byte) (
 	return s.cryptoSigner.Sign(ctx, msg)
 }
 
+func (s *limitedCryptoSigner) SignBatch(ctx context.Context, msgs [][]byte) (
+	[]SignatureInfo, error) {
+	if s.remaining < len(msgs) {
+		return nil, errors.New("Not enough Sign calls left")
+	}
+	s.remaining -= len(msgs)
+	return s.cryptoSigner.SignBatch(ctx, msgs)
+}
+
 func TestMDJournalBranchConversionAtomic(t *testing.T) {
 	uid, verifyingKey, codec, crypto, id, signer, ekg, bsplit, tempdir, j :=
 		setupMDJournalTest(t)
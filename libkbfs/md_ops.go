@@ -140,12 +140,26 @@ func (md *MDOpsStandard) verifyWriterKey(ctx context.Context,
 	}
 }
 
+// getExtraMetadata fetches the key bundles for the given MD, if they
+// are stored separately from it.
+func (md *MDOpsStandard) getExtraMetadata(
+	ctx context.Context, brmd BareRootMetadata) (ExtraMetadata, error) {
+	if brmd.Version() < SegregatedKeyBundlesVer || brmd.TlfID().IsPublic() {
+		return nil, nil
+	}
+	return md.config.KeyManager().GetExtraMetadata(ctx, brmd)
+}
+
 func (md *MDOpsStandard) processMetadata(ctx context.Context,
 	handle *TlfHandle, rmds *RootMetadataSigned, getRangeLock *sync.Mutex) (
 	ImmutableRootMetadata, error) {
+	extra, err := md.getExtraMetadata(ctx, rmds.MD)
+	if err != nil {
+		return ImmutableRootMetadata{}, err
+	}
+
 	// First, verify validity and signatures.
-	// MDv3 TODO: pass key bundles
-	err := rmds.IsValidAndSigned(md.config.Codec(), md.config.Crypto(), nil)
+	err = rmds.IsValidAndSigned(md.config.Codec(), md.config.Crypto(), extra)
 	if err != nil {
 		return ImmutableRootMetadata{}, MDMismatchError{
 			rmds.MD.RevisionNumber(), handle.GetCanonicalPath(),
@@ -175,6 +189,7 @@ func (md *MDOpsStandard) processMetadata(ctx context.Context,
 	rmd := RootMetadata{
 		bareMd:    rmds.MD,
 		tlfHandle: handle,
+		extra:     extra,
 	}
 
 	// Try to decrypt using the keys available in this md.  If that
@@ -222,8 +237,11 @@ func (md *MDOpsStandard) GetForHandle(ctx context.Context, handle *TlfHandle,
 		return id, ImmutableRootMetadata{}, nil
 	}
 
-	// MDv3 TODO: pass key bunldes when needed
-	bareMdHandle, err := rmds.MD.MakeBareTlfHandle(nil)
+	extra, err := md.getExtraMetadata(ctx, rmds.MD)
+	if err != nil {
+		return TlfID{}, ImmutableRootMetadata{}, err
+	}
+	bareMdHandle, err := rmds.MD.MakeBareTlfHandle(extra)
 	if err != nil {
 		return TlfID{}, ImmutableRootMetadata{}, err
 	}
@@ -306,7 +324,10 @@ func (md *MDOpsStandard) processMetadataWithID(ctx context.Context,
 }
 
 func (md *MDOpsStandard) getForTLF(ctx context.Context, id TlfID,
-	bid BranchID, mStatus MergeStatus) (ImmutableRootMetadata, error) {
+	bid BranchID, mStatus MergeStatus) (
+	irmd ImmutableRootMetadata, err error) {
+	ctx, span := startSpan(ctx, nil, "MDOps.Get")
+	defer func() { span.Finish(err) }()
 	rmds, err := md.config.MDServer().GetForTLF(ctx, id, bid, mStatus)
 	if err != nil {
 		return ImmutableRootMetadata{}, err
@@ -315,8 +336,11 @@ func (md *MDOpsStandard) getForTLF(ctx context.Context, id TlfID,
 		// Possible if mStatus is Unmerged
 		return ImmutableRootMetadata{}, nil
 	}
-	// MDv3 TODO: pass key bundle when needed
-	bareHandle, err := rmds.MD.MakeBareTlfHandle(nil)
+	extra, err := md.getExtraMetadata(ctx, rmds.MD)
+	if err != nil {
+		return ImmutableRootMetadata{}, err
+	}
+	bareHandle, err := rmds.MD.MakeBareTlfHandle(extra)
 	if err != nil {
 		return ImmutableRootMetadata{}, err
 	}
@@ -367,8 +391,15 @@ func (md *MDOpsStandard) processRange(ctx context.Context, id TlfID,
 	worker := func() {
 		defer wg.Done()
 		for rmds := range rmdsChan {
-			// MDv3 TODO: pass key bundles when needed
-			bareHandle, err := rmds.MD.MakeBareTlfHandle(nil)
+			extra, err := md.getExtraMetadata(ctx, rmds.MD)
+			if err != nil {
+				select {
+				case errChan <- err:
+				default:
+				}
+				return
+			}
+			bareHandle, err := rmds.MD.MakeBareTlfHandle(extra)
 			if err != nil {
 				select {
 				case errChan <- err:
@@ -465,7 +496,11 @@ func (md *MDOpsStandard) processRange(ctx context.Context, id TlfID,
 
 func (md *MDOpsStandard) getRange(ctx context.Context, id TlfID,
 	bid BranchID, mStatus MergeStatus, start, stop MetadataRevision) (
-	[]ImmutableRootMetadata, error) {
+	irmds []ImmutableRootMetadata, err error) {
+	ctx, span := startSpan(ctx, nil, "MDOps.GetRange")
+	span.SetTag("start", start)
+	span.SetTag("stop", stop)
+	defer func() { span.Finish(err) }()
 	rmds, err := md.config.MDServer().GetRange(
 		ctx, id, bid, mStatus, start, stop)
 	if err != nil {
@@ -491,7 +526,10 @@ func (md *MDOpsStandard) GetUnmergedRange(ctx context.Context, id TlfID,
 }
 
 func (md *MDOpsStandard) put(
-	ctx context.Context, rmd *RootMetadata) (MdID, error) {
+	ctx context.Context, rmd *RootMetadata) (id MdID, err error) {
+	ctx, span := startSpan(ctx, nil, "MDOps.Put")
+	span.SetTag("revision", rmd.Revision())
+	defer func() { span.Finish(err) }()
 	_, me, err := md.config.KBPKI().GetCurrentUserInfo(ctx)
 	if err != nil {
 		return MdID{}, err
@@ -128,8 +128,11 @@ func verifyMDForPublic(config *ConfigMock, rmds *RootMetadataSigned,
 	packedData := []byte{4, 3, 2, 1}
 	config.mockCodec.EXPECT().Encode(gomock.Any()).Return(packedData, nil).AnyTimes()
 
-	config.mockCrypto.EXPECT().Verify(packedData, rmds.MD.GetWriterMetadataSigInfo()).Return(nil)
-	config.mockCrypto.EXPECT().Verify(packedData, rmds.SigInfo).Return(verifyErr)
+	// The writer and root signatures are verified together.
+	config.mockCrypto.EXPECT().VerifyBatch(
+		[][]byte{packedData, packedData},
+		[]SignatureInfo{rmds.MD.GetWriterMetadataSigInfo(), rmds.SigInfo}).
+		Return(verifyErr)
 	if verifyErr != nil {
 		return
 	}
@@ -172,10 +175,9 @@ func verifyMDForPrivateHelper(
 			gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
 	}
 
-	config.mockCrypto.EXPECT().Verify(packedData, rmds.SigInfo).
-		MinTimes(minTimes).MaxTimes(maxTimes).Return(nil)
-	config.mockCrypto.EXPECT().
-		Verify(packedData, rmds.MD.GetWriterMetadataSigInfo()).
+	config.mockCrypto.EXPECT().VerifyBatch(
+		[][]byte{packedData, packedData},
+		[]SignatureInfo{rmds.MD.GetWriterMetadataSigInfo(), rmds.SigInfo}).
 		MinTimes(minTimes).MaxTimes(maxTimes).Return(nil)
 }
 
@@ -0,0 +1,135 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	metrics "github.com/rcrowley/go-metrics"
+	"golang.org/x/net/context"
+)
+
+// measuredMDOps lists the stallable MD ops that get their own timer.
+// StallableMDAfterPut and StallableMDAfterPutUnmerged mark the end of
+// a put rather than an operation of their own, so they're covered by
+// the put timers.
+var measuredMDOps = []StallableMDOp{
+	StallableMDGetForHandle,
+	StallableMDGetForTLF,
+	StallableMDGetLatestHandleForTLF,
+	StallableMDGetUnmergedForTLF,
+	StallableMDGetRange,
+	StallableMDGetUnmergedRange,
+	StallableMDPut,
+	StallableMDPutUnmerged,
+	StallableMDPruneBranch,
+}
+
+// MDOpsMeasured delegates to another MDOps instance but also keeps
+// track of stats.  Its timers are named after the corresponding
+// StallableMDOp, so that tests that stall an op and the metrics for
+// it use the same names.
+type MDOpsMeasured struct {
+	delegate MDOps
+	timers   map[StallableMDOp]metrics.Timer
+}
+
+var _ MDOps = MDOpsMeasured{}
+
+// NewMDOpsMeasured creates and returns a new MDOpsMeasured instance
+// with the given delegate and registry.
+func NewMDOpsMeasured(delegate MDOps, r metrics.Registry) MDOpsMeasured {
+	timers := make(map[StallableMDOp]metrics.Timer, len(measuredMDOps))
+	for _, op := range measuredMDOps {
+		timers[op] = metrics.GetOrRegisterTimer("MDOps."+string(op), r)
+	}
+	return MDOpsMeasured{
+		delegate: delegate,
+		timers:   timers,
+	}
+}
+
+// GetForHandle implements the MDOps interface for MDOpsMeasured.
+func (m MDOpsMeasured) GetForHandle(
+	ctx context.Context, handle *TlfHandle, mStatus MergeStatus) (
+	tlfID TlfID, rmd ImmutableRootMetadata, err error) {
+	m.timers[StallableMDGetForHandle].Time(func() {
+		tlfID, rmd, err = m.delegate.GetForHandle(ctx, handle, mStatus)
+	})
+	return tlfID, rmd, err
+}
+
+// GetForTLF implements the MDOps interface for MDOpsMeasured.
+func (m MDOpsMeasured) GetForTLF(ctx context.Context, id TlfID) (
+	rmd ImmutableRootMetadata, err error) {
+	m.timers[StallableMDGetForTLF].Time(func() {
+		rmd, err = m.delegate.GetForTLF(ctx, id)
+	})
+	return rmd, err
+}
+
+// GetUnmergedForTLF implements the MDOps interface for
+// MDOpsMeasured.
+func (m MDOpsMeasured) GetUnmergedForTLF(ctx context.Context, id TlfID,
+	bid BranchID) (rmd ImmutableRootMetadata, err error) {
+	m.timers[StallableMDGetUnmergedForTLF].Time(func() {
+		rmd, err = m.delegate.GetUnmergedForTLF(ctx, id, bid)
+	})
+	return rmd, err
+}
+
+// GetRange implements the MDOps interface for MDOpsMeasured.
+func (m MDOpsMeasured) GetRange(ctx context.Context, id TlfID,
+	start, stop MetadataRevision) (rmds []ImmutableRootMetadata, err error) {
+	m.timers[StallableMDGetRange].Time(func() {
+		rmds, err = m.delegate.GetRange(ctx, id, start, stop)
+	})
+	return rmds, err
+}
+
+// GetUnmergedRange implements the MDOps interface for MDOpsMeasured.
+func (m MDOpsMeasured) GetUnmergedRange(ctx context.Context, id TlfID,
+	bid BranchID, start, stop MetadataRevision) (
+	rmds []ImmutableRootMetadata, err error) {
+	m.timers[StallableMDGetUnmergedRange].Time(func() {
+		rmds, err = m.delegate.GetUnmergedRange(ctx, id, bid, start, stop)
+	})
+	return rmds, err
+}
+
+// Put implements the MDOps interface for MDOpsMeasured.
+func (m MDOpsMeasured) Put(ctx context.Context, rmd *RootMetadata) (
+	mdID MdID, err error) {
+	m.timers[StallableMDPut].Time(func() {
+		mdID, err = m.delegate.Put(ctx, rmd)
+	})
+	return mdID, err
+}
+
+// PutUnmerged implements the MDOps interface for MDOpsMeasured.
+func (m MDOpsMeasured) PutUnmerged(ctx context.Context, rmd *RootMetadata) (
+	mdID MdID, err error) {
+	m.timers[StallableMDPutUnmerged].Time(func() {
+		mdID, err = m.delegate.PutUnmerged(ctx, rmd)
+	})
+	return mdID, err
+}
+
+// PruneBranch implements the MDOps interface for MDOpsMeasured.
+func (m MDOpsMeasured) PruneBranch(
+	ctx context.Context, id TlfID, bid BranchID) (err error) {
+	m.timers[StallableMDPruneBranch].Time(func() {
+		err = m.delegate.PruneBranch(ctx, id, bid)
+	})
+	return err
+}
+
+// GetLatestHandleForTLF implements the MDOps interface for
+// MDOpsMeasured.
+func (m MDOpsMeasured) GetLatestHandleForTLF(ctx context.Context, id TlfID) (
+	h BareTlfHandle, err error) {
+	m.timers[StallableMDGetLatestHandleForTLF].Time(func() {
+		h, err = m.delegate.GetLatestHandleForTLF(ctx, id)
+	})
+	return h, err
+}
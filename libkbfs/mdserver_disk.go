@@ -23,18 +23,21 @@ import (
 type mdServerDiskShared struct {
 	dirPath string
 
-	// Protects handleDb, branchDb, tlfStorage, and
-	// truncateLockManager. After Shutdown() is called, handleDb,
-	// branchDb, tlfStorage, and truncateLockManager are nil.
+	// Protects handleDb, branchDb, tlfStorage, and the lock
+	// managers. After Shutdown() is called, handleDb, branchDb,
+	// tlfStorage, and the lock managers are nil.
 	lock sync.RWMutex
 	// Bare TLF handle -> TLF ID
 	handleDb *leveldb.DB
 	// (TLF ID, device KID) -> branch ID
 	branchDb   *leveldb.DB
 	tlfStorage map[TlfID]*mdServerTlfStorage
+	// Key bundle ID -> key bundle, for segregated key bundles.
+	keyBundleDb KeyBundleCache
 	// Always use memory for the lock storage, so it gets wiped
 	// after a restart.
 	truncateLockManager *mdServerLocalTruncateLockManager
+	rangeLockManager    *mdServerLocalRangeLockManager
 
 	updateManager *mdServerLocalUpdateManager
 
@@ -66,13 +69,22 @@ func newMDServerDisk(config mdServerLocalConfig, dirPath string,
 		return nil, err
 	}
 	log := config.MakeLogger("MDSD")
+	keyBundlePath := filepath.Join(dirPath, "key_bundles")
+	keyBundleDb, err := NewKeyBundleCacheDisk(
+		config.Codec(), log, keyBundlePath, 0)
+	if err != nil {
+		return nil, err
+	}
 	truncateLockManager := newMDServerLocalTruncatedLockManager()
+	rangeLockManager := newMDServerLocalRangeLockManager()
 	shared := mdServerDiskShared{
 		dirPath:             dirPath,
 		handleDb:            handleDb,
 		branchDb:            branchDb,
 		tlfStorage:          make(map[TlfID]*mdServerTlfStorage),
+		keyBundleDb:         keyBundleDb,
 		truncateLockManager: &truncateLockManager,
+		rangeLockManager:    &rangeLockManager,
 		updateManager:       newMDServerLocalUpdateManager(),
 		shutdownFunc:        shutdownFunc,
 	}
@@ -373,6 +385,11 @@ func (md *MDServerDisk) Put(ctx context.Context, rmds *RootMetadataSigned,
 		return err
 	}
 
+	err = putExtraMetadata(md.keyBundleDb, rmds.MD, extra)
+	if err != nil {
+		return MDServerErrorBadRequest{Reason: err.Error()}
+	}
+
 	recordBranchID, err := tlfStorage.put(
 		currentUID, currentVerifyingKey, rmds)
 	if err != nil {
@@ -478,6 +495,58 @@ func (md *MDServerDisk) TruncateUnlock(ctx context.Context, id TlfID) (
 	return md.truncateLockManager.truncateUnlock(key.kid, id)
 }
 
+// LockRange implements the MDServer interface for MDServerDisk.
+func (md *MDServerDisk) LockRange(ctx context.Context, id TlfID,
+	file string, lock RangeLock, lease time.Duration) error {
+	key, err := md.config.currentInfoGetter().GetCurrentCryptPublicKey(ctx)
+	if err != nil {
+		return MDServerError{err}
+	}
+
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	if md.rangeLockManager == nil {
+		return errMDServerDiskShutdown
+	}
+	return md.rangeLockManager.lockRange(
+		key.kid, id, file, lock, md.config.Clock().Now(), lease)
+}
+
+// UnlockRange implements the MDServer interface for MDServerDisk.
+func (md *MDServerDisk) UnlockRange(ctx context.Context, id TlfID,
+	file string, lock RangeLock) error {
+	key, err := md.config.currentInfoGetter().GetCurrentCryptPublicKey(ctx)
+	if err != nil {
+		return MDServerError{err}
+	}
+
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	if md.rangeLockManager == nil {
+		return errMDServerDiskShutdown
+	}
+	return md.rangeLockManager.unlockRange(
+		key.kid, id, file, lock, md.config.Clock().Now())
+}
+
+// GetRangeLockConflict implements the MDServer interface for
+// MDServerDisk.
+func (md *MDServerDisk) GetRangeLockConflict(ctx context.Context,
+	id TlfID, file string, lock RangeLock) (*RangeLock, error) {
+	key, err := md.config.currentInfoGetter().GetCurrentCryptPublicKey(ctx)
+	if err != nil {
+		return nil, MDServerError{err}
+	}
+
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	if md.rangeLockManager == nil {
+		return nil, errMDServerDiskShutdown
+	}
+	return md.rangeLockManager.getConflict(
+		key.kid, id, file, lock, md.config.Clock().Now()), nil
+}
+
 // Shutdown implements the MDServer interface for MDServerDisk.
 func (md *MDServerDisk) Shutdown() {
 	md.lock.Lock()
@@ -496,6 +565,8 @@ func (md *MDServerDisk) Shutdown() {
 
 	tlfStorage := md.tlfStorage
 	md.tlfStorage = nil
+	md.truncateLockManager = nil
+	md.rangeLockManager = nil
 
 	for _, s := range tlfStorage {
 		s.shutdown()
@@ -621,3 +692,13 @@ func (md *MDServerDisk) GetLatestHandleForTLF(_ context.Context, id TlfID) (
 func (md *MDServerDisk) OffsetFromServerTime() (time.Duration, bool) {
 	return 0, true
 }
+
+// GetKeyBundles implements the MDServer interface for MDServerDisk.
+func (md *MDServerDisk) GetKeyBundles(_ context.Context, _ TlfID,
+	wkbID TLFWriterKeyBundleID, rkbID TLFReaderKeyBundleID) (
+	*TLFWriterKeyBundleV3, *TLFReaderKeyBundleV3, error) {
+	if md.isShutdown() {
+		return nil, nil, errMDServerDiskShutdown
+	}
+	return getKeyBundlesFromStore(md.keyBundleDb, wkbID, rkbID)
+}
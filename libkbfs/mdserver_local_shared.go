@@ -7,6 +7,7 @@ package libkbfs
 import (
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/keybase/client/go/protocol/keybase1"
 )
@@ -95,6 +96,121 @@ func (m mdServerLocalTruncateLockManager) truncateUnlock(
 	return false, MDServerErrorLocked{}
 }
 
+type mdServerLocalRangeLockKey struct {
+	id   TlfID
+	file string
+}
+
+// mdServerLocalDeviceRangeLocks are the byte-range locks held by one
+// device on one file.  They share a single lease, which is extended
+// whenever the device takes another lock on the file.
+type mdServerLocalDeviceRangeLocks struct {
+	locks []RangeLock
+	// expires is zero if the locks never expire.
+	expires time.Time
+}
+
+// mdServerLocalRangeLockManager manages the advisory byte-range
+// locks for a set of TLFs.  Locks are held by (device KID, owner)
+// pairs.  Note that it is not goroutine-safe.
+type mdServerLocalRangeLockManager struct {
+	// (TLF ID, file) -> device KID -> locks.
+	locksDb map[mdServerLocalRangeLockKey]map[keybase1.KID]mdServerLocalDeviceRangeLocks
+}
+
+func newMDServerLocalRangeLockManager() mdServerLocalRangeLockManager {
+	return mdServerLocalRangeLockManager{
+		locksDb: make(map[mdServerLocalRangeLockKey]map[keybase1.KID]mdServerLocalDeviceRangeLocks),
+	}
+}
+
+// liveLocks returns the unexpired locks held by each device on the
+// given file, dropping any expired ones along the way.
+func (m mdServerLocalRangeLockManager) liveLocks(
+	key mdServerLocalRangeLockKey,
+	now time.Time) map[keybase1.KID]mdServerLocalDeviceRangeLocks {
+	devices := m.locksDb[key]
+	for kid, dl := range devices {
+		if !dl.expires.IsZero() && !now.Before(dl.expires) {
+			delete(devices, kid)
+		}
+	}
+	if len(devices) == 0 {
+		delete(m.locksDb, key)
+		return nil
+	}
+	return devices
+}
+
+func (m mdServerLocalRangeLockManager) getConflict(
+	deviceKID keybase1.KID, id TlfID, file string, lock RangeLock,
+	now time.Time) *RangeLock {
+	devices := m.liveLocks(mdServerLocalRangeLockKey{id, file}, now)
+	for kid, dl := range devices {
+		for _, l := range dl.locks {
+			if kid == deviceKID && l.Owner == lock.Owner {
+				continue
+			}
+			if l.conflictsWith(lock) {
+				return &l
+			}
+		}
+	}
+	return nil
+}
+
+// lockRange takes the given lock for deviceKID, extending the lease
+// on all its locks on the file by lease.  A lease of 0 means the
+// locks never expire.
+func (m mdServerLocalRangeLockManager) lockRange(
+	deviceKID keybase1.KID, id TlfID, file string, lock RangeLock,
+	now time.Time, lease time.Duration) error {
+	if err := lock.checkValid(); err != nil {
+		return err
+	}
+	if conflict := m.getConflict(
+		deviceKID, id, file, lock, now); conflict != nil {
+		return RangeLockConflictError{file, *conflict}
+	}
+
+	key := mdServerLocalRangeLockKey{id, file}
+	devices := m.liveLocks(key, now)
+	if devices == nil {
+		devices = make(map[keybase1.KID]mdServerLocalDeviceRangeLocks)
+		m.locksDb[key] = devices
+	}
+	dl := devices[deviceKID]
+	dl.locks = lockRange(dl.locks, lock)
+	dl.expires = time.Time{}
+	if lease > 0 {
+		dl.expires = now.Add(lease)
+	}
+	devices[deviceKID] = dl
+	return nil
+}
+
+func (m mdServerLocalRangeLockManager) unlockRange(
+	deviceKID keybase1.KID, id TlfID, file string, unlock RangeLock,
+	now time.Time) error {
+	key := mdServerLocalRangeLockKey{id, file}
+	devices := m.liveLocks(key, now)
+	dl, ok := devices[deviceKID]
+	if !ok {
+		// Already unlocked.
+		return nil
+	}
+	dl.locks = unlockRange(dl.locks, unlock)
+	if len(dl.locks) > 0 {
+		devices[deviceKID] = dl
+		return nil
+	}
+	delete(devices, deviceKID)
+	if len(devices) == 0 {
+		delete(m.locksDb, key)
+	}
+	return nil
+}
+
 // mdServerLocalUpdateManager manages the observers for a set of TLFs
 // referenced by multiple mdServerLocal instances sharing the same
 // data. It is goroutine-safe.
@@ -161,3 +277,41 @@ func (m *mdServerLocalUpdateManager) registerForUpdate(
 	m.observers[id][server] = c
 	return c
 }
+
+// putExtraMetadata stores any key bundles in extra that are
+// referenced by md into the given store, which also checks that they
+// match the IDs in md.
+func putExtraMetadata(store KeyBundleCache, md BareRootMetadata,
+	extra ExtraMetadata) error {
+	md3, ok := md.(*BareRootMetadataV3)
+	if !ok {
+		return nil
+	}
+	wkb, rkb, ok := getKeyBundlesV3(extra)
+	if !ok {
+		return nil
+	}
+	err := store.PutTLFWriterKeyBundle(md3.WriterMetadata.WKeyBundleID, *wkb)
+	if err != nil {
+		return err
+	}
+	return store.PutTLFReaderKeyBundle(md3.RKeyBundleID, *rkb)
+}
+
+// getKeyBundlesFromStore looks up the given key bundles in the given
+// store, on behalf of a local MD server.
+func getKeyBundlesFromStore(store KeyBundleCache,
+	wkbID TLFWriterKeyBundleID, rkbID TLFReaderKeyBundleID) (
+	*TLFWriterKeyBundleV3, *TLFReaderKeyBundleV3, error) {
+	wkb, ok := store.GetTLFWriterKeyBundle(wkbID)
+	if !ok {
+		return nil, nil, MDServerErrorBadRequest{
+			Reason: fmt.Sprintf("Unknown writer key bundle %s", wkbID)}
+	}
+	rkb, ok := store.GetTLFReaderKeyBundle(rkbID)
+	if !ok {
+		return nil, nil, MDServerErrorBadRequest{
+			Reason: fmt.Sprintf("Unknown reader key bundle %s", rkbID)}
+	}
+	return &wkb, &rkb, nil
+}
@@ -43,9 +43,9 @@ type mdBlockMemList struct {
 }
 
 type mdServerMemShared struct {
-	// Protects all *db variables and truncateLockManager. After
-	// Shutdown() is called, all *db variables and
-	// truncateLockManager are nil.
+	// Protects all *db variables, truncateLockManager, and
+	// rangeLockManager. After Shutdown() is called, all *db
+	// variables and the lock managers are nil.
 	lock sync.RWMutex
 	// Bare TLF handle -> TLF ID
 	handleDb map[mdHandleKey]TlfID
@@ -56,6 +56,9 @@ type mdServerMemShared struct {
 	// (TLF ID, device KID) -> branch ID
 	branchDb            map[mdBranchKey]BranchID
 	truncateLockManager *mdServerLocalTruncateLockManager
+	rangeLockManager    *mdServerLocalRangeLockManager
+	// Key bundle ID -> key bundle, for segregated key bundles.
+	keyBundleDb KeyBundleCache
 
 	updateManager *mdServerLocalUpdateManager
 }
@@ -66,6 +69,11 @@ type MDServerMemory struct {
 	log    logger.Logger
 
 	*mdServerMemShared
+
+	// netsim, if non-nil, simulates the network between this
+	// user's device and the server.  It's protected by the shared
+	// lock.
+	netsim *NetworkSimulator
 }
 
 var _ mdServerLocal = (*MDServerMemory)(nil)
@@ -79,20 +87,57 @@ func NewMDServerMemory(config mdServerLocalConfig) (*MDServerMemory, error) {
 	branchDb := make(map[mdBranchKey]BranchID)
 	log := config.MakeLogger("MDSM")
 	truncateLockManager := newMDServerLocalTruncatedLockManager()
+	rangeLockManager := newMDServerLocalRangeLockManager()
 	shared := mdServerMemShared{
 		handleDb:            handleDb,
 		latestHandleDb:      latestHandleDb,
 		mdDb:                mdDb,
 		branchDb:            branchDb,
 		truncateLockManager: &truncateLockManager,
+		rangeLockManager:    &rangeLockManager,
+		keyBundleDb:         NewKeyBundleCacheStandard(config.Codec(), 0),
 		updateManager:       newMDServerLocalUpdateManager(),
 	}
-	mdserv := &MDServerMemory{config, log, &shared}
+	mdserv := &MDServerMemory{config: config, log: log, mdServerMemShared: &shared}
 	return mdserv, nil
 }
 
 var errMDServerMemoryShutdown = errors.New("MDServerMemory is shutdown")
 
+// SetNetworkSimulator makes calls to md go through the given network
+// simulator, or through none if it's nil.  Copies of md made for
+// other users and devices afterwards start with the same simulator,
+// but setting it on one copy doesn't change it on the others.
+func (md *MDServerMemory) SetNetworkSimulator(ns *NetworkSimulator) {
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	md.netsim = ns
+}
+
+func (md *MDServerMemory) networkSimulator() *NetworkSimulator {
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	return md.netsim
+}
+
+// encodedSize returns the size of the given MD objects on the wire,
+// for the network simulator.  Objects that can't be encoded don't
+// count.
+func (md *MDServerMemory) encodedSize(rmdses ...*RootMetadataSigned) int {
+	size := 0
+	for _, rmds := range rmdses {
+		if rmds == nil {
+			continue
+		}
+		buf, err := md.config.Codec().Encode(rmds)
+		if err != nil {
+			continue
+		}
+		size += len(buf)
+	}
+	return size
+}
+
 func (md *MDServerMemory) getHandleID(ctx context.Context, handle BareTlfHandle,
 	mStatus MergeStatus) (tlfID TlfID, created bool, err error) {
 	handleBytes, err := md.config.Codec().Encode(handle)
@@ -134,6 +179,12 @@ func (md *MDServerMemory) getHandleID(ctx context.Context, handle BareTlfHandle,
 // GetForHandle implements the MDServer interface for MDServerMemory.
 func (md *MDServerMemory) GetForHandle(ctx context.Context, handle BareTlfHandle,
 	mStatus MergeStatus) (TlfID, *RootMetadataSigned, error) {
+	ns := md.networkSimulator()
+	err := ns.request(ctx, "GetForHandle", 0)
+	if err != nil {
+		return NullTlfID, nil, err
+	}
+
 	id, created, err := md.getHandleID(ctx, handle, mStatus)
 	if err != nil {
 		return NullTlfID, nil, err
@@ -143,7 +194,11 @@ func (md *MDServerMemory) GetForHandle(ctx context.Context, handle BareTlfHandle
 		return id, nil, nil
 	}
 
-	rmds, err := md.GetForTLF(ctx, id, NullBranchID, mStatus)
+	rmds, err := md.getForTLF(ctx, id, NullBranchID, mStatus)
+	if err != nil {
+		return NullTlfID, nil, err
+	}
+	err = ns.reply(ctx, "GetForHandle", md.encodedSize(rmds))
 	if err != nil {
 		return NullTlfID, nil, err
 	}
@@ -191,6 +246,24 @@ func (md *MDServerMemory) checkGetParams(
 
 // GetForTLF implements the MDServer interface for MDServerMemory.
 func (md *MDServerMemory) GetForTLF(ctx context.Context, id TlfID,
+	bid BranchID, mStatus MergeStatus) (*RootMetadataSigned, error) {
+	ns := md.networkSimulator()
+	err := ns.request(ctx, "GetForTLF", 0)
+	if err != nil {
+		return nil, err
+	}
+	rmds, err := md.getForTLF(ctx, id, bid, mStatus)
+	if err != nil {
+		return nil, err
+	}
+	err = ns.reply(ctx, "GetForTLF", md.encodedSize(rmds))
+	if err != nil {
+		return nil, err
+	}
+	return rmds, nil
+}
+
+func (md *MDServerMemory) getForTLF(ctx context.Context, id TlfID,
 	bid BranchID, mStatus MergeStatus) (*RootMetadataSigned, error) {
 	// MDv3 TODO: pass actual key bundles
 	bid, err := md.checkGetParams(ctx, id, bid, mStatus, nil)
@@ -269,6 +342,25 @@ func (md *MDServerMemory) GetRange(ctx context.Context, id TlfID,
 	bid BranchID, mStatus MergeStatus, start, stop MetadataRevision) (
 	[]*RootMetadataSigned, error) {
 	md.log.CDebugf(ctx, "GetRange %d %d (%s)", start, stop, mStatus)
+	ns := md.networkSimulator()
+	err := ns.request(ctx, "GetRange", 0)
+	if err != nil {
+		return nil, err
+	}
+	rmdses, err := md.getRange(ctx, id, bid, mStatus, start, stop)
+	if err != nil {
+		return nil, err
+	}
+	err = ns.reply(ctx, "GetRange", md.encodedSize(rmdses...))
+	if err != nil {
+		return nil, err
+	}
+	return rmdses, nil
+}
+
+func (md *MDServerMemory) getRange(ctx context.Context, id TlfID,
+	bid BranchID, mStatus MergeStatus, start, stop MetadataRevision) (
+	[]*RootMetadataSigned, error) {
 	// MDv3 TODO: pass actual key bundles
 	bid, err := md.checkGetParams(ctx, id, bid, mStatus, nil)
 	if err != nil {
@@ -317,8 +409,8 @@ func (md *MDServerMemory) GetRange(ctx context.Context, id TlfID,
 		rmds.untrustedServerTimestamp = blocks[i].timestamp
 		expectedRevision := blockList.initialRevision + MetadataRevision(i)
 		if expectedRevision != rmds.MD.RevisionNumber() {
-			panic(fmt.Errorf("expected revision %v, got %v",
-				expectedRevision, rmds.MD.RevisionNumber()))
+			return nil, MDServerError{MDRangeRevisionError{
+				expectedRevision, rmds.MD.RevisionNumber()}}
 		}
 		rmdses = append(rmdses, rmds)
 	}
@@ -329,6 +421,10 @@ func (md *MDServerMemory) GetRange(ctx context.Context, id TlfID,
 // Put implements the MDServer interface for MDServerMemory.
 func (md *MDServerMemory) Put(ctx context.Context, rmds *RootMetadataSigned,
 	extra ExtraMetadata) error {
+	err := md.networkSimulator().request(ctx, "Put", md.encodedSize(rmds))
+	if err != nil {
+		return err
+	}
 
 	currentUID, currentVerifyingKey, err :=
 		getCurrentUIDAndVerifyingKey(ctx, md.config.currentInfoGetter())
@@ -382,7 +478,7 @@ func (md *MDServerMemory) Put(ctx context.Context, rmds *RootMetadataSigned,
 	if mStatus == Unmerged && head == nil {
 		// currHead for unmerged history might be on the main branch
 		prevRev := rmds.MD.RevisionNumber() - 1
-		rmdses, err := md.GetRange(ctx, id, NullBranchID, Merged, prevRev, prevRev)
+		rmdses, err := md.getRange(ctx, id, NullBranchID, Merged, prevRev, prevRev)
 		if err != nil {
 			return MDServerError{err}
 		}
@@ -427,6 +523,11 @@ func (md *MDServerMemory) Put(ctx context.Context, rmds *RootMetadataSigned,
 		}
 	}
 
+	err = putExtraMetadata(md.keyBundleDb, rmds.MD, extra)
+	if err != nil {
+		return MDServerErrorBadRequest{Reason: err.Error()}
+	}
+
 	encodedMd, err := md.config.Codec().Encode(rmds)
 	if err != nil {
 		return MDServerError{err}
@@ -469,6 +570,11 @@ func (md *MDServerMemory) Put(ctx context.Context, rmds *RootMetadataSigned,
 
 // PruneBranch implements the MDServer interface for MDServerMemory.
 func (md *MDServerMemory) PruneBranch(ctx context.Context, id TlfID, bid BranchID) error {
+	err := md.networkSimulator().request(ctx, "PruneBranch", 0)
+	if err != nil {
+		return err
+	}
+
 	if bid == NullBranchID {
 		return MDServerErrorBadRequest{Reason: "Invalid branch ID"}
 	}
@@ -547,6 +653,11 @@ func (md *MDServerMemory) getCurrentDeviceKIDBytes(ctx context.Context) (
 // TruncateLock implements the MDServer interface for MDServerMemory.
 func (md *MDServerMemory) TruncateLock(ctx context.Context, id TlfID) (
 	bool, error) {
+	err := md.networkSimulator().request(ctx, "TruncateLock", 0)
+	if err != nil {
+		return false, err
+	}
+
 	md.lock.Lock()
 	defer md.lock.Unlock()
 	if md.truncateLockManager == nil {
@@ -564,6 +675,11 @@ func (md *MDServerMemory) TruncateLock(ctx context.Context, id TlfID) (
 // TruncateUnlock implements the MDServer interface for MDServerMemory.
 func (md *MDServerMemory) TruncateUnlock(ctx context.Context, id TlfID) (
 	bool, error) {
+	err := md.networkSimulator().request(ctx, "TruncateUnlock", 0)
+	if err != nil {
+		return false, err
+	}
+
 	md.lock.Lock()
 	defer md.lock.Unlock()
 	if md.truncateLockManager == nil {
@@ -578,6 +694,73 @@ func (md *MDServerMemory) TruncateUnlock(ctx context.Context, id TlfID) (
 	return md.truncateLockManager.truncateUnlock(myKID, id)
 }
 
+// LockRange implements the MDServer interface for MDServerMemory.
+func (md *MDServerMemory) LockRange(ctx context.Context, id TlfID,
+	file string, lock RangeLock, lease time.Duration) error {
+	err := md.networkSimulator().request(ctx, "LockRange", 0)
+	if err != nil {
+		return err
+	}
+
+	myKID, err := md.getCurrentDeviceKID(ctx)
+	if err != nil {
+		return err
+	}
+
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	if md.rangeLockManager == nil {
+		return errMDServerMemoryShutdown
+	}
+	return md.rangeLockManager.lockRange(
+		myKID, id, file, lock, md.config.Clock().Now(), lease)
+}
+
+// UnlockRange implements the MDServer interface for MDServerMemory.
+func (md *MDServerMemory) UnlockRange(ctx context.Context, id TlfID,
+	file string, lock RangeLock) error {
+	err := md.networkSimulator().request(ctx, "UnlockRange", 0)
+	if err != nil {
+		return err
+	}
+
+	myKID, err := md.getCurrentDeviceKID(ctx)
+	if err != nil {
+		return err
+	}
+
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	if md.rangeLockManager == nil {
+		return errMDServerMemoryShutdown
+	}
+	return md.rangeLockManager.unlockRange(
+		myKID, id, file, lock, md.config.Clock().Now())
+}
+
+// GetRangeLockConflict implements the MDServer interface for
+// MDServerMemory.
+func (md *MDServerMemory) GetRangeLockConflict(ctx context.Context,
+	id TlfID, file string, lock RangeLock) (*RangeLock, error) {
+	err := md.networkSimulator().request(ctx, "GetRangeLockConflict", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	myKID, err := md.getCurrentDeviceKID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	if md.rangeLockManager == nil {
+		return nil, errMDServerMemoryShutdown
+	}
+	return md.rangeLockManager.getConflict(
+		myKID, id, file, lock, md.config.Clock().Now()), nil
+}
+
 // Shutdown implements the MDServer interface for MDServerMemory.
 func (md *MDServerMemory) Shutdown() {
 	md.lock.Lock()
@@ -586,6 +769,7 @@ func (md *MDServerMemory) Shutdown() {
 	md.latestHandleDb = nil
 	md.branchDb = nil
 	md.truncateLockManager = nil
+	md.rangeLockManager = nil
 }
 
 // IsConnected implements the MDServer interface for MDServerMemory.
@@ -602,7 +786,12 @@ func (md *MDServerMemory) copy(config mdServerLocalConfig) mdServerLocal {
 	// purpose, so that the MD server that gets a Put will notify all
 	// observers correctly no matter where they got on the list.
 	log := config.MakeLogger("")
-	return &MDServerMemory{config, log, md.mdServerMemShared}
+	return &MDServerMemory{
+		config:            config,
+		log:               log,
+		mdServerMemShared: md.mdServerMemShared,
+		netsim:            md.networkSimulator(),
+	}
 }
 
 // isShutdown returns whether the logical, shared MDServer instance
@@ -660,7 +849,7 @@ func (md *MDServerMemory) addNewAssertionForTest(uid keybase1.UID,
 
 func (md *MDServerMemory) getCurrentMergedHeadRevision(
 	ctx context.Context, id TlfID) (rev MetadataRevision, err error) {
-	head, err := md.GetForTLF(ctx, id, NullBranchID, Merged)
+	head, err := md.getForTLF(ctx, id, NullBranchID, Merged)
 	if err != nil {
 		return 0, err
 	}
@@ -687,3 +876,13 @@ func (md *MDServerMemory) GetLatestHandleForTLF(_ context.Context, id TlfID) (
 func (md *MDServerMemory) OffsetFromServerTime() (time.Duration, bool) {
 	return 0, true
 }
+
+// GetKeyBundles implements the MDServer interface for MDServerMemory.
+func (md *MDServerMemory) GetKeyBundles(_ context.Context, _ TlfID,
+	wkbID TLFWriterKeyBundleID, rkbID TLFReaderKeyBundleID) (
+	*TLFWriterKeyBundleV3, *TLFReaderKeyBundleV3, error) {
+	if md.isShutdown() {
+		return nil, nil, errMDServerMemoryShutdown
+	}
+	return getKeyBundlesFromStore(md.keyBundleDb, wkbID, rkbID)
+}
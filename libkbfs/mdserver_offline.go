@@ -0,0 +1,212 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// MDServerOffline delegates to another MDServer, except while the
+// config it was made with is offline, when every call that would
+// reach the server fails right away with an OfflineUnavailableError
+// instead of waiting for the connection to time out.
+type MDServerOffline struct {
+	config   Config
+	delegate MDServer
+}
+
+var _ MDServer = MDServerOffline{}
+
+// NewMDServerOffline creates and returns a new MDServerOffline
+// instance with the given delegate, which checks whether the given
+// config is offline before each call.
+func NewMDServerOffline(config Config, delegate MDServer) MDServerOffline {
+	return MDServerOffline{config: config, delegate: delegate}
+}
+
+func (md MDServerOffline) checkOnline(op string) error {
+	if md.config.Offline() {
+		return OfflineUnavailableError{op}
+	}
+	return nil
+}
+
+// RefreshAuthToken implements the MDServer interface for
+// MDServerOffline.  While offline, the token is left to be refreshed
+// when the server is next used.
+func (md MDServerOffline) RefreshAuthToken(ctx context.Context) {
+	if md.config.Offline() {
+		return
+	}
+	md.delegate.RefreshAuthToken(ctx)
+}
+
+// GetForHandle implements the MDServer interface for MDServerOffline.
+func (md MDServerOffline) GetForHandle(ctx context.Context,
+	handle BareTlfHandle, mStatus MergeStatus) (
+	TlfID, *RootMetadataSigned, error) {
+	if err := md.checkOnline("Getting metadata"); err != nil {
+		return TlfID{}, nil, err
+	}
+	return md.delegate.GetForHandle(ctx, handle, mStatus)
+}
+
+// GetForTLF implements the MDServer interface for MDServerOffline.
+func (md MDServerOffline) GetForTLF(ctx context.Context, id TlfID,
+	bid BranchID, mStatus MergeStatus) (*RootMetadataSigned, error) {
+	if err := md.checkOnline("Getting metadata"); err != nil {
+		return nil, err
+	}
+	return md.delegate.GetForTLF(ctx, id, bid, mStatus)
+}
+
+// GetRange implements the MDServer interface for MDServerOffline.
+func (md MDServerOffline) GetRange(ctx context.Context, id TlfID,
+	bid BranchID, mStatus MergeStatus, start, stop MetadataRevision) (
+	[]*RootMetadataSigned, error) {
+	if err := md.checkOnline("Getting metadata"); err != nil {
+		return nil, err
+	}
+	return md.delegate.GetRange(ctx, id, bid, mStatus, start, stop)
+}
+
+// Put implements the MDServer interface for MDServerOffline.
+func (md MDServerOffline) Put(ctx context.Context, rmds *RootMetadataSigned,
+	extra ExtraMetadata) error {
+	if err := md.checkOnline("Putting metadata"); err != nil {
+		return err
+	}
+	return md.delegate.Put(ctx, rmds, extra)
+}
+
+// PruneBranch implements the MDServer interface for MDServerOffline.
+func (md MDServerOffline) PruneBranch(
+	ctx context.Context, id TlfID, bid BranchID) error {
+	if err := md.checkOnline("Pruning a branch"); err != nil {
+		return err
+	}
+	return md.delegate.PruneBranch(ctx, id, bid)
+}
+
+// RegisterForUpdate implements the MDServer interface for
+// MDServerOffline.
+func (md MDServerOffline) RegisterForUpdate(ctx context.Context, id TlfID,
+	currHead MetadataRevision) (<-chan error, error) {
+	if err := md.checkOnline("Registering for updates"); err != nil {
+		return nil, err
+	}
+	return md.delegate.RegisterForUpdate(ctx, id, currHead)
+}
+
+// CheckForRekeys implements the MDServer interface for
+// MDServerOffline.
+func (md MDServerOffline) CheckForRekeys(ctx context.Context) <-chan error {
+	if err := md.checkOnline("Checking for rekeys"); err != nil {
+		c := make(chan error, 1)
+		c <- err
+		return c
+	}
+	return md.delegate.CheckForRekeys(ctx)
+}
+
+// TruncateLock implements the MDServer interface for MDServerOffline.
+func (md MDServerOffline) TruncateLock(
+	ctx context.Context, id TlfID) (bool, error) {
+	if err := md.checkOnline("Taking the truncate lock"); err != nil {
+		return false, err
+	}
+	return md.delegate.TruncateLock(ctx, id)
+}
+
+// TruncateUnlock implements the MDServer interface for
+// MDServerOffline.
+func (md MDServerOffline) TruncateUnlock(
+	ctx context.Context, id TlfID) (bool, error) {
+	if err := md.checkOnline("Releasing the truncate lock"); err != nil {
+		return false, err
+	}
+	return md.delegate.TruncateUnlock(ctx, id)
+}
+
+// LockRange implements the MDServer interface for MDServerOffline.
+func (md MDServerOffline) LockRange(ctx context.Context, id TlfID,
+	file string, lock RangeLock, lease time.Duration) error {
+	if err := md.checkOnline("Locking " + file); err != nil {
+		return err
+	}
+	return md.delegate.LockRange(ctx, id, file, lock, lease)
+}
+
+// UnlockRange implements the MDServer interface for MDServerOffline.
+func (md MDServerOffline) UnlockRange(ctx context.Context, id TlfID,
+	file string, lock RangeLock) error {
+	if err := md.checkOnline("Unlocking " + file); err != nil {
+		return err
+	}
+	return md.delegate.UnlockRange(ctx, id, file, lock)
+}
+
+// GetRangeLockConflict implements the MDServer interface for
+// MDServerOffline.
+func (md MDServerOffline) GetRangeLockConflict(ctx context.Context,
+	id TlfID, file string, lock RangeLock) (*RangeLock, error) {
+	if err := md.checkOnline("Checking the locks on " + file); err != nil {
+		return nil, err
+	}
+	return md.delegate.GetRangeLockConflict(ctx, id, file, lock)
+}
+
+// DisableRekeyUpdatesForTesting implements the MDServer interface for
+// MDServerOffline.
+func (md MDServerOffline) DisableRekeyUpdatesForTesting() {
+	md.delegate.DisableRekeyUpdatesForTesting()
+}
+
+// Shutdown implements the MDServer interface for MDServerOffline.
+func (md MDServerOffline) Shutdown() {
+	md.delegate.Shutdown()
+}
+
+// IsConnected implements the MDServer interface for MDServerOffline.
+func (md MDServerOffline) IsConnected() bool {
+	return !md.config.Offline() && md.delegate.IsConnected()
+}
+
+// GetLatestHandleForTLF implements the MDServer interface for
+// MDServerOffline.
+func (md MDServerOffline) GetLatestHandleForTLF(ctx context.Context,
+	id TlfID) (BareTlfHandle, error) {
+	if err := md.checkOnline("Getting the latest handle"); err != nil {
+		return BareTlfHandle{}, err
+	}
+	return md.delegate.GetLatestHandleForTLF(ctx, id)
+}
+
+// OffsetFromServerTime implements the MDServer interface for
+// MDServerOffline.
+func (md MDServerOffline) OffsetFromServerTime() (time.Duration, bool) {
+	return md.delegate.OffsetFromServerTime()
+}
+
+// GetKeyBundles implements the MDServer interface for MDServerOffline.
+func (md MDServerOffline) GetKeyBundles(ctx context.Context, tlfID TlfID,
+	wkbID TLFWriterKeyBundleID, rkbID TLFReaderKeyBundleID) (
+	*TLFWriterKeyBundleV3, *TLFReaderKeyBundleV3, error) {
+	if err := md.checkOnline("Getting key bundles"); err != nil {
+		return nil, nil, err
+	}
+	return md.delegate.GetKeyBundles(ctx, tlfID, wkbID, rkbID)
+}
+
+// unwrapMDServer returns the MDServer that mdServer delegates to, if
+// it's an MDServerOffline, and mdServer itself otherwise.
+func unwrapMDServer(mdServer MDServer) MDServer {
+	if md, ok := mdServer.(MDServerOffline); ok {
+		return md.delegate
+	}
+	return mdServer
+}
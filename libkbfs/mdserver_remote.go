@@ -86,7 +86,8 @@ func NewMDServerRemote(config Config, srvAddr string, ctx Context) *MDServerRemo
 		ctx.NewRPCLogFactory(), libkb.WrapError,
 		config.MakeLogger(""), LogTagsFromContext)
 	mdServer.conn = conn
-	mdServer.client = keybase1.MetadataClient{Cli: conn.GetClient()}
+	mdServer.client = keybase1.MetadataClient{
+		Cli: newPendingRPCClient("mdserver", conn.GetClient())}
 
 	// Check for rekey opportunities periodically.
 	rekeyCtx, rekeyCancel := context.WithCancel(context.Background())
@@ -276,11 +277,18 @@ func (md *MDServerRemote) resetPingTicker(intervalSeconds int) {
 		md.pingOnce(ctx)
 
 		ticker := time.NewTicker(time.Duration(intervalSeconds) * time.Second)
+		// The server offset is relative to our wall clock, so
+		// re-measure it right away if that jumps.
+		jumpChan, unregister := md.config.ClockJumpDetector().Register()
+		defer unregister()
 		for {
 			select {
 			case <-ticker.C:
 				md.pingOnce(ctx)
 
+			case <-jumpChan:
+				md.pingOnce(ctx)
+
 			case <-ctx.Done():
 				md.log.CDebugf(ctx, "MDServerRemote: stopping ping ticker")
 				ticker.Stop()
@@ -406,6 +414,12 @@ func (md *MDServerRemote) get(ctx context.Context, id TlfID,
 		return id, nil, err
 	}
 
+	var bytes int
+	for _, block := range response.MdBlocks {
+		bytes += len(block.Block)
+	}
+	md.config.UsageMeter().recordMDRPC(id, 0, bytes)
+
 	// deserialize blocks
 	rmdses := make([]*RootMetadataSigned, len(response.MdBlocks))
 	for i, block := range response.MdBlocks {
@@ -475,6 +489,9 @@ func (md *MDServerRemote) Put(ctx context.Context, rmds *RootMetadataSigned,
 		},
 		LogTags: nil,
 	}
+	// MDv3 TODO: send the key bundles in extra along with the MD
+	// once the metadata protocol can carry them.
+	md.config.UsageMeter().recordMDRPC(rmds.MD.TlfID(), len(rmdsBytes), 0)
 	return md.client.PutMetadata(ctx, arg)
 }
 
@@ -485,6 +502,7 @@ func (md *MDServerRemote) PruneBranch(ctx context.Context, id TlfID, bid BranchI
 		BranchID: bid.String(),
 		LogTags:  nil,
 	}
+	md.config.UsageMeter().recordMDRPC(id, 0, 0)
 	return md.client.PruneBranch(ctx, arg)
 }
 
@@ -542,6 +560,7 @@ func (md *MDServerRemote) RegisterForUpdate(ctx context.Context, id TlfID,
 	}
 
 	// register
+	md.config.UsageMeter().recordMDRPC(id, 0, 0)
 	var c chan error
 	err := md.conn.DoCommand(ctx, "register", func(rawClient rpc.GenericClient) error {
 		// set up the server to receive updates, since we may
@@ -606,6 +625,28 @@ func (md *MDServerRemote) TruncateUnlock(ctx context.Context, id TlfID) (
 	return md.client.TruncateUnlock(ctx, id.String())
 }
 
+// LockRange implements the MDServer interface for MDServerRemote.
+// The mdserver protocol has no byte-range lock RPCs, so the remote
+// server never coordinates locks, and folderRangeLocks falls back to
+// coordinating them within this process.
+func (md *MDServerRemote) LockRange(ctx context.Context, id TlfID,
+	file string, lock RangeLock, lease time.Duration) error {
+	return RangeLocksUnsupportedError{}
+}
+
+// UnlockRange implements the MDServer interface for MDServerRemote.
+func (md *MDServerRemote) UnlockRange(ctx context.Context, id TlfID,
+	file string, lock RangeLock) error {
+	return RangeLocksUnsupportedError{}
+}
+
+// GetRangeLockConflict implements the MDServer interface for
+// MDServerRemote.
+func (md *MDServerRemote) GetRangeLockConflict(ctx context.Context,
+	id TlfID, file string, lock RangeLock) (*RangeLock, error) {
+	return nil, RangeLocksUnsupportedError{}
+}
+
 // GetLatestHandleForTLF implements the MDServer interface for MDServerRemote.
 func (md *MDServerRemote) GetLatestHandleForTLF(ctx context.Context, id TlfID) (
 	BareTlfHandle, error) {
@@ -628,6 +669,15 @@ func (md *MDServerRemote) OffsetFromServerTime() (time.Duration, bool) {
 	return md.serverOffset, md.serverOffsetKnown
 }
 
+// GetKeyBundles implements the MDServer interface for MDServerRemote.
+func (md *MDServerRemote) GetKeyBundles(ctx context.Context, tlfID TlfID,
+	wkbID TLFWriterKeyBundleID, rkbID TLFReaderKeyBundleID) (
+	*TLFWriterKeyBundleV3, *TLFReaderKeyBundleV3, error) {
+	// MDv3 TODO: fetch the bundles once the mdserver protocol
+	// supports it.
+	return nil, nil, KeyBundlesUnsupportedError{}
+}
+
 // CheckForRekeys implements the MDServer interface.
 func (md *MDServerRemote) CheckForRekeys(ctx context.Context) <-chan error {
 	// Wait 5 seconds before asking for rekeys, because the server
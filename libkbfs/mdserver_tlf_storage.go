@@ -242,8 +242,8 @@ func (s *mdServerTlfStorage) getRangeReadLocked(
 			return nil, MDServerError{err}
 		}
 		if expectedRevision != rmds.MD.RevisionNumber() {
-			panic(fmt.Errorf("expected revision %v, got %v",
-				expectedRevision, rmds.MD.RevisionNumber()))
+			return nil, MDServerError{MDRangeRevisionError{
+				expectedRevision, rmds.MD.RevisionNumber()}}
 		}
 		rmdses = append(rmdses, rmds)
 	}
@@ -10,6 +10,8 @@ import (
 	keybase1 "github.com/keybase/client/go/protocol/keybase1"
 	go_metrics "github.com/rcrowley/go-metrics"
 	context "golang.org/x/net/context"
+	io "io"
+	os "os"
 	reflect "reflect"
 	time "time"
 )
@@ -281,6 +283,18 @@ func (_mr *_MockKBFSOpsRecorder) GetDirChildren(arg0, arg1 interface{}) *gomock.
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetDirChildren", arg0, arg1)
 }
 
+func (_m *MockKBFSOps) BatchStat(ctx context.Context, dir Node, names []string) (map[string]EntryInfo, map[string]error, error) {
+	ret := _m.ctrl.Call(_m, "BatchStat", ctx, dir, names)
+	ret0, _ := ret[0].(map[string]EntryInfo)
+	ret1, _ := ret[1].(map[string]error)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockKBFSOpsRecorder) BatchStat(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BatchStat", arg0, arg1, arg2)
+}
+
 func (_m *MockKBFSOps) Lookup(ctx context.Context, dir Node, name string) (Node, EntryInfo, error) {
 	ret := _m.ctrl.Call(_m, "Lookup", ctx, dir, name)
 	ret0, _ := ret[0].(Node)
@@ -328,6 +342,18 @@ func (_mr *_MockKBFSOpsRecorder) CreateFile(arg0, arg1, arg2, arg3, arg4 interfa
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "CreateFile", arg0, arg1, arg2, arg3, arg4)
 }
 
+func (_m *MockKBFSOps) CreateFileWithMode(ctx context.Context, dir Node, name string, mode os.FileMode, excl Excl) (Node, EntryInfo, error) {
+	ret := _m.ctrl.Call(_m, "CreateFileWithMode", ctx, dir, name, mode, excl)
+	ret0, _ := ret[0].(Node)
+	ret1, _ := ret[1].(EntryInfo)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockKBFSOpsRecorder) CreateFileWithMode(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "CreateFileWithMode", arg0, arg1, arg2, arg3, arg4)
+}
+
 func (_m *MockKBFSOps) CreateLink(ctx context.Context, dir Node, fromName string, toPath string) (EntryInfo, error) {
 	ret := _m.ctrl.Call(_m, "CreateLink", ctx, dir, fromName, toPath)
 	ret0, _ := ret[0].(EntryInfo)
@@ -339,6 +365,16 @@ func (_mr *_MockKBFSOpsRecorder) CreateLink(arg0, arg1, arg2, arg3 interface{})
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "CreateLink", arg0, arg1, arg2, arg3)
 }
 
+func (_m *MockKBFSOps) Link(ctx context.Context, file Node, dir Node, name string) error {
+	ret := _m.ctrl.Call(_m, "Link", ctx, file, dir, name)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) Link(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Link", arg0, arg1, arg2, arg3)
+}
+
 func (_m *MockKBFSOps) RemoveDir(ctx context.Context, dir Node, dirName string) error {
 	ret := _m.ctrl.Call(_m, "RemoveDir", ctx, dir, dirName)
 	ret0, _ := ret[0].(error)
@@ -380,6 +416,17 @@ func (_mr *_MockKBFSOpsRecorder) Read(arg0, arg1, arg2, arg3 interface{}) *gomoc
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Read", arg0, arg1, arg2, arg3)
 }
 
+func (_m *MockKBFSOps) ReadSlices(ctx context.Context, file Node, off int64, size int64) ([][]byte, error) {
+	ret := _m.ctrl.Call(_m, "ReadSlices", ctx, file, off, size)
+	ret0, _ := ret[0].([][]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) ReadSlices(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ReadSlices", arg0, arg1, arg2, arg3)
+}
+
 func (_m *MockKBFSOps) Write(ctx context.Context, file Node, data []byte, off int64) error {
 	ret := _m.ctrl.Call(_m, "Write", ctx, file, data, off)
 	ret0, _ := ret[0].(error)
@@ -400,6 +447,38 @@ func (_mr *_MockKBFSOpsRecorder) Truncate(arg0, arg1, arg2 interface{}) *gomock.
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Truncate", arg0, arg1, arg2)
 }
 
+func (_m *MockKBFSOps) Allocate(ctx context.Context, file Node, off uint64, length uint64, mode AllocateMode) error {
+	ret := _m.ctrl.Call(_m, "Allocate", ctx, file, off, length, mode)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) Allocate(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Allocate", arg0, arg1, arg2, arg3, arg4)
+}
+
+func (_m *MockKBFSOps) GetDataRanges(ctx context.Context, file Node) ([]DataRange, error) {
+	ret := _m.ctrl.Call(_m, "GetDataRanges", ctx, file)
+	ret0, _ := ret[0].([]DataRange)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetDataRanges(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetDataRanges", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) GetAllocatedSize(ctx context.Context, file Node) (uint64, error) {
+	ret := _m.ctrl.Call(_m, "GetAllocatedSize", ctx, file)
+	ret0, _ := ret[0].(uint64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetAllocatedSize(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetAllocatedSize", arg0, arg1)
+}
+
 func (_m *MockKBFSOps) SetEx(ctx context.Context, file Node, ex bool) error {
 	ret := _m.ctrl.Call(_m, "SetEx", ctx, file, ex)
 	ret0, _ := ret[0].(error)
@@ -420,6 +499,79 @@ func (_mr *_MockKBFSOpsRecorder) SetMtime(arg0, arg1, arg2 interface{}) *gomock.
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetMtime", arg0, arg1, arg2)
 }
 
+func (_m *MockKBFSOps) SetMode(ctx context.Context, node Node, mode os.FileMode) error {
+	ret := _m.ctrl.Call(_m, "SetMode", ctx, node, mode)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) SetMode(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetMode", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) SetOwner(ctx context.Context, node Node, uid int, gid int) error {
+	ret := _m.ctrl.Call(_m, "SetOwner", ctx, node, uid, gid)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) SetOwner(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetOwner", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockKBFSOps) SetXattr(ctx context.Context, node Node, name string, value []byte) error {
+	ret := _m.ctrl.Call(_m, "SetXattr", ctx, node, name, value)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) SetXattr(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetXattr", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockKBFSOps) GetXattr(ctx context.Context, node Node, name string) ([]byte, error) {
+	ret := _m.ctrl.Call(_m, "GetXattr", ctx, node, name)
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetXattr(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetXattr", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) ListXattr(ctx context.Context, node Node) ([]string, error) {
+	ret := _m.ctrl.Call(_m, "ListXattr", ctx, node)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) ListXattr(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ListXattr", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) RemoveXattr(ctx context.Context, node Node, name string) error {
+	ret := _m.ctrl.Call(_m, "RemoveXattr", ctx, node, name)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) RemoveXattr(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RemoveXattr", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) FileSyncState(ctx context.Context, file Node) (SyncState, error) {
+	ret := _m.ctrl.Call(_m, "FileSyncState", ctx, file)
+	ret0, _ := ret[0].(SyncState)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) FileSyncState(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "FileSyncState", arg0, arg1)
+}
+
 func (_m *MockKBFSOps) Sync(ctx context.Context, file Node) error {
 	ret := _m.ctrl.Call(_m, "Sync", ctx, file)
 	ret0, _ := ret[0].(error)
@@ -430,6 +582,26 @@ func (_mr *_MockKBFSOpsRecorder) Sync(arg0, arg1 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Sync", arg0, arg1)
 }
 
+func (_m *MockKBFSOps) SyncWithDurability(ctx context.Context, file Node, durability WriteDurability) error {
+	ret := _m.ctrl.Call(_m, "SyncWithDurability", ctx, file, durability)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) SyncWithDurability(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SyncWithDurability", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) SetSyncDurability(ctx context.Context, folderBranch FolderBranch, durability WriteDurability) error {
+	ret := _m.ctrl.Call(_m, "SetSyncDurability", ctx, folderBranch, durability)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) SetSyncDurability(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetSyncDurability", arg0, arg1, arg2)
+}
+
 func (_m *MockKBFSOps) FolderStatus(ctx context.Context, folderBranch FolderBranch) (FolderBranchStatus, <-chan StatusUpdate, error) {
 	ret := _m.ctrl.Call(_m, "FolderStatus", ctx, folderBranch)
 	ret0, _ := ret[0].(FolderBranchStatus)
@@ -442,6 +614,17 @@ func (_mr *_MockKBFSOpsRecorder) FolderStatus(arg0, arg1 interface{}) *gomock.Ca
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "FolderStatus", arg0, arg1)
 }
 
+func (_m *MockKBFSOps) GetConflictStatus(ctx context.Context, folderBranch FolderBranch) (ConflictStatus, error) {
+	ret := _m.ctrl.Call(_m, "GetConflictStatus", ctx, folderBranch)
+	ret0, _ := ret[0].(ConflictStatus)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetConflictStatus(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetConflictStatus", arg0, arg1)
+}
+
 func (_m *MockKBFSOps) Status(ctx context.Context) (KBFSStatus, <-chan StatusUpdate, error) {
 	ret := _m.ctrl.Call(_m, "Status", ctx)
 	ret0, _ := ret[0].(KBFSStatus)
@@ -454,6 +637,27 @@ func (_mr *_MockKBFSOpsRecorder) Status(arg0 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Status", arg0)
 }
 
+func (_m *MockKBFSOps) SlowOpReports() []SlowOpReport {
+	ret := _m.ctrl.Call(_m, "SlowOpReports")
+	ret0, _ := ret[0].([]SlowOpReport)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) SlowOpReports() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SlowOpReports")
+}
+
+func (_m *MockKBFSOps) Health(ctx context.Context) (KBFSHealth, error) {
+	ret := _m.ctrl.Call(_m, "Health", ctx)
+	ret0, _ := ret[0].(KBFSHealth)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) Health(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Health", arg0)
+}
+
 func (_m *MockKBFSOps) UnstageForTesting(ctx context.Context, folderBranch FolderBranch) error {
 	ret := _m.ctrl.Call(_m, "UnstageForTesting", ctx, folderBranch)
 	ret0, _ := ret[0].(error)
@@ -464,6 +668,141 @@ func (_mr *_MockKBFSOpsRecorder) UnstageForTesting(arg0, arg1 interface{}) *gomo
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "UnstageForTesting", arg0, arg1)
 }
 
+func (_m *MockKBFSOps) SetManualConflictResolution(ctx context.Context, folderBranch FolderBranch, manual bool) error {
+	ret := _m.ctrl.Call(_m, "SetManualConflictResolution", ctx, folderBranch, manual)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) SetManualConflictResolution(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetManualConflictResolution", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) ResolveMerged(ctx context.Context, folderBranch FolderBranch) error {
+	ret := _m.ctrl.Call(_m, "ResolveMerged", ctx, folderBranch)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) ResolveMerged(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ResolveMerged", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) ResolveKeepLocal(ctx context.Context, folderBranch FolderBranch) error {
+	ret := _m.ctrl.Call(_m, "ResolveKeepLocal", ctx, folderBranch)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) ResolveKeepLocal(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ResolveKeepLocal", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) ResolveKeepRemote(ctx context.Context, folderBranch FolderBranch) error {
+	ret := _m.ctrl.Call(_m, "ResolveKeepRemote", ctx, folderBranch)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) ResolveKeepRemote(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ResolveKeepRemote", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) PreviewConflictResolution(ctx context.Context, folderBranch FolderBranch) (ConflictPreview, error) {
+	ret := _m.ctrl.Call(_m, "PreviewConflictResolution", ctx, folderBranch)
+	ret0, _ := ret[0].(ConflictPreview)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) PreviewConflictResolution(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "PreviewConflictResolution", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) PauseWrites(ctx context.Context, folderBranch FolderBranch) error {
+	ret := _m.ctrl.Call(_m, "PauseWrites", ctx, folderBranch)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) PauseWrites(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "PauseWrites", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) ResumeWrites(ctx context.Context, folderBranch FolderBranch) error {
+	ret := _m.ctrl.Call(_m, "ResumeWrites", ctx, folderBranch)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) ResumeWrites(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ResumeWrites", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) WriteFence(ctx context.Context, folderBranch FolderBranch, durability WriteDurability) (*WriteFence, error) {
+	ret := _m.ctrl.Call(_m, "WriteFence", ctx, folderBranch, durability)
+	ret0, _ := ret[0].(*WriteFence)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) WriteFence(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "WriteFence", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) LockRange(ctx context.Context, file Node, lock RangeLock) error {
+	ret := _m.ctrl.Call(_m, "LockRange", ctx, file, lock)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) LockRange(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "LockRange", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) UnlockRange(ctx context.Context, file Node, lock RangeLock) error {
+	ret := _m.ctrl.Call(_m, "UnlockRange", ctx, file, lock)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) UnlockRange(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "UnlockRange", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) GetRangeLockConflict(ctx context.Context, file Node, lock RangeLock) (*RangeLock, error) {
+	ret := _m.ctrl.Call(_m, "GetRangeLockConflict", ctx, file, lock)
+	ret0, _ := ret[0].(*RangeLock)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetRangeLockConflict(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetRangeLockConflict", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) AuditTLF(ctx context.Context, handle *TlfHandle) (TLFAuditReport, error) {
+	ret := _m.ctrl.Call(_m, "AuditTLF", ctx, handle)
+	ret0, _ := ret[0].(TLFAuditReport)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) AuditTLF(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "AuditTLF", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) FsckTLF(ctx context.Context, handle *TlfHandle, repair bool) (TLFFsckReport, error) {
+	ret := _m.ctrl.Call(_m, "FsckTLF", ctx, handle, repair)
+	ret0, _ := ret[0].(TLFFsckReport)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) FsckTLF(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "FsckTLF", arg0, arg1, arg2)
+}
+
 func (_m *MockKBFSOps) Rekey(ctx context.Context, id TlfID) error {
 	ret := _m.ctrl.Call(_m, "Rekey", ctx, id)
 	ret0, _ := ret[0].(error)
@@ -474,6 +813,16 @@ func (_mr *_MockKBFSOpsRecorder) Rekey(arg0, arg1 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Rekey", arg0, arg1)
 }
 
+func (_m *MockKBFSOps) RotateKeyGeneration(ctx context.Context, id TlfID) error {
+	ret := _m.ctrl.Call(_m, "RotateKeyGeneration", ctx, id)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) RotateKeyGeneration(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RotateKeyGeneration", arg0, arg1)
+}
+
 func (_m *MockKBFSOps) SyncFromServerForTesting(ctx context.Context, folderBranch FolderBranch) error {
 	ret := _m.ctrl.Call(_m, "SyncFromServerForTesting", ctx, folderBranch)
 	ret0, _ := ret[0].(error)
@@ -506,6 +855,113 @@ func (_mr *_MockKBFSOpsRecorder) GetEditHistory(arg0, arg1 interface{}) *gomock.
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetEditHistory", arg0, arg1)
 }
 
+func (_m *MockKBFSOps) GetFileHistory(ctx context.Context, file Node, limit int) ([]FileVersion, error) {
+	ret := _m.ctrl.Call(_m, "GetFileHistory", ctx, file, limit)
+	ret0, _ := ret[0].([]FileVersion)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetFileHistory(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetFileHistory", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) OpenFileAtRevision(ctx context.Context, file Node, rev MetadataRevision) (*FileVersionReader, error) {
+	ret := _m.ctrl.Call(_m, "OpenFileAtRevision", ctx, file, rev)
+	ret0, _ := ret[0].(*FileVersionReader)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) OpenFileAtRevision(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "OpenFileAtRevision", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) BeginReadSnapshot(ctx context.Context, folderBranch FolderBranch) (*ReadSnapshot, error) {
+	ret := _m.ctrl.Call(_m, "BeginReadSnapshot", ctx, folderBranch)
+	ret0, _ := ret[0].(*ReadSnapshot)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) BeginReadSnapshot(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BeginReadSnapshot", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) BeginReadSnapshotAtRevision(ctx context.Context, folderBranch FolderBranch, rev MetadataRevision) (*ReadSnapshot, error) {
+	ret := _m.ctrl.Call(_m, "BeginReadSnapshotAtRevision", ctx, folderBranch, rev)
+	ret0, _ := ret[0].(*ReadSnapshot)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) BeginReadSnapshotAtRevision(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BeginReadSnapshotAtRevision", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) GetRevisionAtTime(ctx context.Context, folderBranch FolderBranch, t time.Time) (MetadataRevision, error) {
+	ret := _m.ctrl.Call(_m, "GetRevisionAtTime", ctx, folderBranch, t)
+	ret0, _ := ret[0].(MetadataRevision)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetRevisionAtTime(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetRevisionAtTime", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) SetTrashRetention(ctx context.Context, root Node, retention time.Duration) error {
+	ret := _m.ctrl.Call(_m, "SetTrashRetention", ctx, root, retention)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) SetTrashRetention(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetTrashRetention", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) ListTrash(ctx context.Context, root Node) ([]TrashEntry, error) {
+	ret := _m.ctrl.Call(_m, "ListTrash", ctx, root)
+	ret0, _ := ret[0].([]TrashEntry)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) ListTrash(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ListTrash", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) Undelete(ctx context.Context, root Node, id string) error {
+	ret := _m.ctrl.Call(_m, "Undelete", ctx, root, id)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) Undelete(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Undelete", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) SetWriterSharding(ctx context.Context, dir Node, sharded bool) error {
+	ret := _m.ctrl.Call(_m, "SetWriterSharding", ctx, dir, sharded)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) SetWriterSharding(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetWriterSharding", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) GetUserQuotaInfo(ctx context.Context) (*UserQuotaInfo, error) {
+	ret := _m.ctrl.Call(_m, "GetUserQuotaInfo", ctx)
+	ret0, _ := ret[0].(*UserQuotaInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetUserQuotaInfo(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetUserQuotaInfo", arg0)
+}
+
 func (_m *MockKBFSOps) GetNodeMetadata(ctx context.Context, node Node) (NodeMetadata, error) {
 	ret := _m.ctrl.Call(_m, "GetNodeMetadata", ctx, node)
 	ret0, _ := ret[0].(NodeMetadata)
@@ -517,6 +973,38 @@ func (_mr *_MockKBFSOpsRecorder) GetNodeMetadata(arg0, arg1 interface{}) *gomock
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetNodeMetadata", arg0, arg1)
 }
 
+func (_m *MockKBFSOps) GetSubtreeUsage(ctx context.Context, node Node) (SubtreeUsage, error) {
+	ret := _m.ctrl.Call(_m, "GetSubtreeUsage", ctx, node)
+	ret0, _ := ret[0].(SubtreeUsage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetSubtreeUsage(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetSubtreeUsage", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) SetSyncSubscription(ctx context.Context, node Node, subscribed bool) error {
+	ret := _m.ctrl.Call(_m, "SetSyncSubscription", ctx, node, subscribed)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) SetSyncSubscription(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetSyncSubscription", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) GetSyncStatus(ctx context.Context, folderBranch FolderBranch) (TLFSyncStatus, error) {
+	ret := _m.ctrl.Call(_m, "GetSyncStatus", ctx, folderBranch)
+	ret0, _ := ret[0].(TLFSyncStatus)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetSyncStatus(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetSyncStatus", arg0, arg1)
+}
+
 func (_m *MockKBFSOps) Shutdown() error {
 	ret := _m.ctrl.Call(_m, "Shutdown")
 	ret0, _ := ret[0].(error)
@@ -1237,6 +1725,17 @@ func (_mr *_MockKeyManagerRecorder) GetTLFCryptKeyOfAllGenerations(arg0, arg1 in
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetTLFCryptKeyOfAllGenerations", arg0, arg1)
 }
 
+func (_m *MockKeyManager) GetExtraMetadata(ctx context.Context, md BareRootMetadata) (ExtraMetadata, error) {
+	ret := _m.ctrl.Call(_m, "GetExtraMetadata", ctx, md)
+	ret0, _ := ret[0].(ExtraMetadata)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKeyManagerRecorder) GetExtraMetadata(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetExtraMetadata", arg0, arg1)
+}
+
 func (_m *MockKeyManager) Rekey(ctx context.Context, md *RootMetadata, promptPaper bool) (bool, *TLFCryptKey, error) {
 	ret := _m.ctrl.Call(_m, "Rekey", ctx, md, promptPaper)
 	ret0, _ := ret[0].(bool)
@@ -1249,6 +1748,18 @@ func (_mr *_MockKeyManagerRecorder) Rekey(arg0, arg1, arg2 interface{}) *gomock.
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Rekey", arg0, arg1, arg2)
 }
 
+func (_m *MockKeyManager) RekeyWithNewKeyGeneration(ctx context.Context, md *RootMetadata) (bool, *TLFCryptKey, error) {
+	ret := _m.ctrl.Call(_m, "RekeyWithNewKeyGeneration", ctx, md)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(*TLFCryptKey)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockKeyManagerRecorder) RekeyWithNewKeyGeneration(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RekeyWithNewKeyGeneration", arg0, arg1)
+}
+
 // Mock of Reporter interface
 type MockReporter struct {
 	ctrl     *gomock.Controller
@@ -1304,6 +1815,14 @@ func (_mr *_MockReporterRecorder) NotifySyncStatus(arg0, arg1 interface{}) *gomo
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "NotifySyncStatus", arg0, arg1)
 }
 
+func (_m *MockReporter) ReportEvent(ctx context.Context, event ReportEvent) {
+	_m.ctrl.Call(_m, "ReportEvent", ctx, event)
+}
+
+func (_mr *_MockReporterRecorder) ReportEvent(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ReportEvent", arg0, arg1)
+}
+
 func (_m *MockReporter) Shutdown() {
 	_m.ctrl.Call(_m, "Shutdown")
 }
@@ -1810,6 +2329,16 @@ func (_mr *_MockcryptoPureRecorder) Verify(arg0, arg1 interface{}) *gomock.Call
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Verify", arg0, arg1)
 }
 
+func (_m *MockcryptoPure) VerifyBatch(msgs [][]byte, sigInfos []SignatureInfo) error {
+	ret := _m.ctrl.Call(_m, "VerifyBatch", msgs, sigInfos)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockcryptoPureRecorder) VerifyBatch(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "VerifyBatch", arg0, arg1)
+}
+
 func (_m *MockcryptoPure) EncryptTLFCryptKeyClientHalf(privateKey TLFEphemeralPrivateKey, publicKey CryptPublicKey, clientHalf TLFCryptKeyClientHalf) (EncryptedTLFCryptKeyClientHalf, error) {
 	ret := _m.ctrl.Call(_m, "EncryptTLFCryptKeyClientHalf", privateKey, publicKey, clientHalf)
 	ret0, _ := ret[0].(EncryptedTLFCryptKeyClientHalf)
@@ -1843,16 +2372,16 @@ func (_mr *_MockcryptoPureRecorder) DecryptPrivateMetadata(arg0, arg1 interface{
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "DecryptPrivateMetadata", arg0, arg1)
 }
 
-func (_m *MockcryptoPure) EncryptBlock(block Block, key BlockCryptKey) (int, EncryptedBlock, error) {
-	ret := _m.ctrl.Call(_m, "EncryptBlock", block, key)
+func (_m *MockcryptoPure) EncryptBlock(block Block, key BlockCryptKey, compression BlockCompressionType) (int, EncryptedBlock, error) {
+	ret := _m.ctrl.Call(_m, "EncryptBlock", block, key, compression)
 	ret0, _ := ret[0].(int)
 	ret1, _ := ret[1].(EncryptedBlock)
 	ret2, _ := ret[2].(error)
 	return ret0, ret1, ret2
 }
 
-func (_mr *_MockcryptoPureRecorder) EncryptBlock(arg0, arg1 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "EncryptBlock", arg0, arg1)
+func (_mr *_MockcryptoPureRecorder) EncryptBlock(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "EncryptBlock", arg0, arg1, arg2)
 }
 
 func (_m *MockcryptoPure) DecryptBlock(encryptedBlock EncryptedBlock, key BlockCryptKey, block Block) error {
@@ -1951,6 +2480,17 @@ func (_mr *_MockcryptoSignerRecorder) SignToString(arg0, arg1 interface{}) *gomo
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SignToString", arg0, arg1)
 }
 
+func (_m *MockcryptoSigner) SignBatch(ctx context.Context, msgs [][]byte) ([]SignatureInfo, error) {
+	ret := _m.ctrl.Call(_m, "SignBatch", ctx, msgs)
+	ret0, _ := ret[0].([]SignatureInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockcryptoSignerRecorder) SignBatch(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SignBatch", arg0, arg1)
+}
+
 // Mock of Crypto interface
 type MockCrypto struct {
 	ctrl     *gomock.Controller
@@ -2139,6 +2679,16 @@ func (_mr *_MockCryptoRecorder) Verify(arg0, arg1 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Verify", arg0, arg1)
 }
 
+func (_m *MockCrypto) VerifyBatch(msgs [][]byte, sigInfos []SignatureInfo) error {
+	ret := _m.ctrl.Call(_m, "VerifyBatch", msgs, sigInfos)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockCryptoRecorder) VerifyBatch(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "VerifyBatch", arg0, arg1)
+}
+
 func (_m *MockCrypto) EncryptTLFCryptKeyClientHalf(privateKey TLFEphemeralPrivateKey, publicKey CryptPublicKey, clientHalf TLFCryptKeyClientHalf) (EncryptedTLFCryptKeyClientHalf, error) {
 	ret := _m.ctrl.Call(_m, "EncryptTLFCryptKeyClientHalf", privateKey, publicKey, clientHalf)
 	ret0, _ := ret[0].(EncryptedTLFCryptKeyClientHalf)
@@ -2172,16 +2722,16 @@ func (_mr *_MockCryptoRecorder) DecryptPrivateMetadata(arg0, arg1 interface{}) *
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "DecryptPrivateMetadata", arg0, arg1)
 }
 
-func (_m *MockCrypto) EncryptBlock(block Block, key BlockCryptKey) (int, EncryptedBlock, error) {
-	ret := _m.ctrl.Call(_m, "EncryptBlock", block, key)
+func (_m *MockCrypto) EncryptBlock(block Block, key BlockCryptKey, compression BlockCompressionType) (int, EncryptedBlock, error) {
+	ret := _m.ctrl.Call(_m, "EncryptBlock", block, key, compression)
 	ret0, _ := ret[0].(int)
 	ret1, _ := ret[1].(EncryptedBlock)
 	ret2, _ := ret[2].(error)
 	return ret0, ret1, ret2
 }
 
-func (_mr *_MockCryptoRecorder) EncryptBlock(arg0, arg1 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "EncryptBlock", arg0, arg1)
+func (_mr *_MockCryptoRecorder) EncryptBlock(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "EncryptBlock", arg0, arg1, arg2)
 }
 
 func (_m *MockCrypto) DecryptBlock(encryptedBlock EncryptedBlock, key BlockCryptKey, block Block) error {
@@ -2259,6 +2809,17 @@ func (_mr *_MockCryptoRecorder) SignToString(arg0, arg1 interface{}) *gomock.Cal
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SignToString", arg0, arg1)
 }
 
+func (_m *MockCrypto) SignBatch(ctx context.Context, msgs [][]byte) ([]SignatureInfo, error) {
+	ret := _m.ctrl.Call(_m, "SignBatch", ctx, msgs)
+	ret0, _ := ret[0].([]SignatureInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockCryptoRecorder) SignBatch(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SignBatch", arg0, arg1)
+}
+
 func (_m *MockCrypto) DecryptTLFCryptKeyClientHalf(ctx context.Context, publicKey TLFEphemeralPublicKey, encryptedClientHalf EncryptedTLFCryptKeyClientHalf) (TLFCryptKeyClientHalf, error) {
 	ret := _m.ctrl.Call(_m, "DecryptTLFCryptKeyClientHalf", ctx, publicKey, encryptedClientHalf)
 	ret0, _ := ret[0].(TLFCryptKeyClientHalf)
@@ -2711,6 +3272,37 @@ func (_mr *_MockMDServerRecorder) TruncateUnlock(arg0, arg1 interface{}) *gomock
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "TruncateUnlock", arg0, arg1)
 }
 
+func (_m *MockMDServer) LockRange(ctx context.Context, id TlfID, file string, lock RangeLock, lease time.Duration) error {
+	ret := _m.ctrl.Call(_m, "LockRange", ctx, id, file, lock, lease)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockMDServerRecorder) LockRange(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "LockRange", arg0, arg1, arg2, arg3, arg4)
+}
+
+func (_m *MockMDServer) UnlockRange(ctx context.Context, id TlfID, file string, lock RangeLock) error {
+	ret := _m.ctrl.Call(_m, "UnlockRange", ctx, id, file, lock)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockMDServerRecorder) UnlockRange(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "UnlockRange", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockMDServer) GetRangeLockConflict(ctx context.Context, id TlfID, file string, lock RangeLock) (*RangeLock, error) {
+	ret := _m.ctrl.Call(_m, "GetRangeLockConflict", ctx, id, file, lock)
+	ret0, _ := ret[0].(*RangeLock)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockMDServerRecorder) GetRangeLockConflict(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetRangeLockConflict", arg0, arg1, arg2, arg3)
+}
+
 func (_m *MockMDServer) DisableRekeyUpdatesForTesting() {
 	_m.ctrl.Call(_m, "DisableRekeyUpdatesForTesting")
 }
@@ -2759,6 +3351,18 @@ func (_mr *_MockMDServerRecorder) OffsetFromServerTime() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "OffsetFromServerTime")
 }
 
+func (_m *MockMDServer) GetKeyBundles(ctx context.Context, tlfID TlfID, wkbID TLFWriterKeyBundleID, rkbID TLFReaderKeyBundleID) (*TLFWriterKeyBundleV3, *TLFReaderKeyBundleV3, error) {
+	ret := _m.ctrl.Call(_m, "GetKeyBundles", ctx, tlfID, wkbID, rkbID)
+	ret0, _ := ret[0].(*TLFWriterKeyBundleV3)
+	ret1, _ := ret[1].(*TLFReaderKeyBundleV3)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockMDServerRecorder) GetKeyBundles(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetKeyBundles", arg0, arg1, arg2, arg3)
+}
+
 // Mock of mdServerLocal interface
 type MockmdServerLocal struct {
 	ctrl     *gomock.Controller
@@ -2933,6 +3537,18 @@ func (_mr *_MockmdServerLocalRecorder) OffsetFromServerTime() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "OffsetFromServerTime")
 }
 
+func (_m *MockmdServerLocal) GetKeyBundles(ctx context.Context, tlfID TlfID, wkbID TLFWriterKeyBundleID, rkbID TLFReaderKeyBundleID) (*TLFWriterKeyBundleV3, *TLFReaderKeyBundleV3, error) {
+	ret := _m.ctrl.Call(_m, "GetKeyBundles", ctx, tlfID, wkbID, rkbID)
+	ret0, _ := ret[0].(*TLFWriterKeyBundleV3)
+	ret1, _ := ret[1].(*TLFReaderKeyBundleV3)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockmdServerLocalRecorder) GetKeyBundles(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetKeyBundles", arg0, arg1, arg2, arg3)
+}
+
 func (_m *MockmdServerLocal) addNewAssertionForTest(uid keybase1.UID, newAssertion keybase1.SocialAssertion) error {
 	ret := _m.ctrl.Call(_m, "addNewAssertionForTest", uid, newAssertion)
 	ret0, _ := ret[0].(error)
@@ -3238,6 +3854,26 @@ func (_mr *_MockBlockSplitterRecorder) ShouldEmbedBlockChanges(arg0 interface{})
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "ShouldEmbedBlockChanges", arg0)
 }
 
+func (_m *MockBlockSplitter) MaxDirEntriesPerBlock() int {
+	ret := _m.ctrl.Call(_m, "MaxDirEntriesPerBlock")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+func (_mr *_MockBlockSplitterRecorder) MaxDirEntriesPerBlock() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "MaxDirEntriesPerBlock")
+}
+
+func (_m *MockBlockSplitter) MaxPtrsPerBlock() int {
+	ret := _m.ctrl.Call(_m, "MaxPtrsPerBlock")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+func (_mr *_MockBlockSplitterRecorder) MaxPtrsPerBlock() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "MaxPtrsPerBlock")
+}
+
 // Mock of KeyServer interface
 type MockKeyServer struct {
 	ctrl     *gomock.Controller
@@ -3343,6 +3979,59 @@ func (_mr *_MockObserverRecorder) TlfHandleChange(arg0, arg1 interface{}) *gomoc
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "TlfHandleChange", arg0, arg1)
 }
 
+// Mock of ConflictObserver interface
+type MockConflictObserver struct {
+	ctrl     *gomock.Controller
+	recorder *_MockConflictObserverRecorder
+}
+
+// Recorder for MockConflictObserver (not exported)
+type _MockConflictObserverRecorder struct {
+	mock *MockConflictObserver
+}
+
+func NewMockConflictObserver(ctrl *gomock.Controller) *MockConflictObserver {
+	mock := &MockConflictObserver{ctrl: ctrl}
+	mock.recorder = &_MockConflictObserverRecorder{mock}
+	return mock
+}
+
+func (_m *MockConflictObserver) EXPECT() *_MockConflictObserverRecorder {
+	return _m.recorder
+}
+
+func (_m *MockConflictObserver) LocalChange(ctx context.Context, node Node, write WriteRange) {
+	_m.ctrl.Call(_m, "LocalChange", ctx, node, write)
+}
+
+func (_mr *_MockConflictObserverRecorder) LocalChange(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "LocalChange", arg0, arg1, arg2)
+}
+
+func (_m *MockConflictObserver) BatchChanges(ctx context.Context, changes []NodeChange) {
+	_m.ctrl.Call(_m, "BatchChanges", ctx, changes)
+}
+
+func (_mr *_MockConflictObserverRecorder) BatchChanges(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BatchChanges", arg0, arg1)
+}
+
+func (_m *MockConflictObserver) TlfHandleChange(ctx context.Context, newHandle *TlfHandle) {
+	_m.ctrl.Call(_m, "TlfHandleChange", ctx, newHandle)
+}
+
+func (_mr *_MockConflictObserverRecorder) TlfHandleChange(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "TlfHandleChange", arg0, arg1)
+}
+
+func (_m *MockConflictObserver) ConflictResolutionEvent(ctx context.Context, event ConflictEvent) {
+	_m.ctrl.Call(_m, "ConflictResolutionEvent", ctx, event)
+}
+
+func (_mr *_MockConflictObserverRecorder) ConflictResolutionEvent(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ConflictResolutionEvent", arg0, arg1)
+}
+
 // Mock of Notifier interface
 type MockNotifier struct {
 	ctrl     *gomock.Controller
@@ -3446,6 +4135,38 @@ func (_mr *_MockConflictRenamerRecorder) ConflictRename(arg0, arg1 interface{})
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "ConflictRename", arg0, arg1)
 }
 
+// Mock of ConflictFileMerger interface
+type MockConflictFileMerger struct {
+	ctrl     *gomock.Controller
+	recorder *_MockConflictFileMergerRecorder
+}
+
+// Recorder for MockConflictFileMerger (not exported)
+type _MockConflictFileMergerRecorder struct {
+	mock *MockConflictFileMerger
+}
+
+func NewMockConflictFileMerger(ctrl *gomock.Controller) *MockConflictFileMerger {
+	mock := &MockConflictFileMerger{ctrl: ctrl}
+	mock.recorder = &_MockConflictFileMergerRecorder{mock}
+	return mock
+}
+
+func (_m *MockConflictFileMerger) EXPECT() *_MockConflictFileMergerRecorder {
+	return _m.recorder
+}
+
+func (_m *MockConflictFileMerger) MergeFile(ctx context.Context, name string, base io.Reader, local io.Reader, remote io.Reader) ([]byte, error) {
+	ret := _m.ctrl.Call(_m, "MergeFile", ctx, name, base, local, remote)
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockConflictFileMergerRecorder) MergeFile(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "MergeFile", arg0, arg1, arg2, arg3, arg4)
+}
+
 // Mock of Config interface
 type MockConfig struct {
 	ctrl     *gomock.Controller
@@ -3545,34 +4266,70 @@ func (_m *MockConfig) MDCache() MDCache {
 	return ret0
 }
 
-func (_mr *_MockConfigRecorder) MDCache() *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "MDCache")
+func (_mr *_MockConfigRecorder) MDCache() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "MDCache")
+}
+
+func (_m *MockConfig) SetMDCache(_param0 MDCache) {
+	_m.ctrl.Call(_m, "SetMDCache", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetMDCache(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetMDCache", arg0)
+}
+
+func (_m *MockConfig) KeyCache() KeyCache {
+	ret := _m.ctrl.Call(_m, "KeyCache")
+	ret0, _ := ret[0].(KeyCache)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) KeyCache() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "KeyCache")
+}
+
+func (_m *MockConfig) SetKeyCache(_param0 KeyCache) {
+	_m.ctrl.Call(_m, "SetKeyCache", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetKeyCache(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetKeyCache", arg0)
+}
+
+func (_m *MockConfig) KeyBundleCache() KeyBundleCache {
+	ret := _m.ctrl.Call(_m, "KeyBundleCache")
+	ret0, _ := ret[0].(KeyBundleCache)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) KeyBundleCache() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "KeyBundleCache")
 }
 
-func (_m *MockConfig) SetMDCache(_param0 MDCache) {
-	_m.ctrl.Call(_m, "SetMDCache", _param0)
+func (_m *MockConfig) SetKeyBundleCache(_param0 KeyBundleCache) {
+	_m.ctrl.Call(_m, "SetKeyBundleCache", _param0)
 }
 
-func (_mr *_MockConfigRecorder) SetMDCache(arg0 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetMDCache", arg0)
+func (_mr *_MockConfigRecorder) SetKeyBundleCache(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetKeyBundleCache", arg0)
 }
 
-func (_m *MockConfig) KeyCache() KeyCache {
-	ret := _m.ctrl.Call(_m, "KeyCache")
-	ret0, _ := ret[0].(KeyCache)
+func (_m *MockConfig) CRJournal() CRJournal {
+	ret := _m.ctrl.Call(_m, "CRJournal")
+	ret0, _ := ret[0].(CRJournal)
 	return ret0
 }
 
-func (_mr *_MockConfigRecorder) KeyCache() *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "KeyCache")
+func (_mr *_MockConfigRecorder) CRJournal() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "CRJournal")
 }
 
-func (_m *MockConfig) SetKeyCache(_param0 KeyCache) {
-	_m.ctrl.Call(_m, "SetKeyCache", _param0)
+func (_m *MockConfig) SetCRJournal(_param0 CRJournal) {
+	_m.ctrl.Call(_m, "SetCRJournal", _param0)
 }
 
-func (_mr *_MockConfigRecorder) SetKeyCache(arg0 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetKeyCache", arg0)
+func (_mr *_MockConfigRecorder) SetCRJournal(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetCRJournal", arg0)
 }
 
 func (_m *MockConfig) BlockCache() BlockCache {
@@ -3791,6 +4548,104 @@ func (_mr *_MockConfigRecorder) SetBlockSplitter(arg0 interface{}) *gomock.Call
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetBlockSplitter", arg0)
 }
 
+func (_m *MockConfig) BlockSplitterForTLF(_param0 TlfID) BlockSplitter {
+	ret := _m.ctrl.Call(_m, "BlockSplitterForTLF", _param0)
+	ret0, _ := ret[0].(BlockSplitter)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) BlockSplitterForTLF(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BlockSplitterForTLF", arg0)
+}
+
+func (_m *MockConfig) SetBlockChunkingForTLF(_param0 TlfID, _param1 BlockChunking) error {
+	ret := _m.ctrl.Call(_m, "SetBlockChunkingForTLF", _param0, _param1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) SetBlockChunkingForTLF(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetBlockChunkingForTLF", arg0, arg1)
+}
+
+func (_m *MockConfig) BlockCompression() BlockCompressionType {
+	ret := _m.ctrl.Call(_m, "BlockCompression")
+	ret0, _ := ret[0].(BlockCompressionType)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) BlockCompression() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BlockCompression")
+}
+
+func (_m *MockConfig) SetBlockCompression(_param0 BlockCompressionType) {
+	_m.ctrl.Call(_m, "SetBlockCompression", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetBlockCompression(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetBlockCompression", arg0)
+}
+
+func (_m *MockConfig) BlockCompressionForTLF(_param0 TlfID) BlockCompressionType {
+	ret := _m.ctrl.Call(_m, "BlockCompressionForTLF", _param0)
+	ret0, _ := ret[0].(BlockCompressionType)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) BlockCompressionForTLF(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BlockCompressionForTLF", arg0)
+}
+
+func (_m *MockConfig) SetBlockCompressionForTLF(_param0 TlfID, _param1 BlockCompressionType) error {
+	ret := _m.ctrl.Call(_m, "SetBlockCompressionForTLF", _param0, _param1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) SetBlockCompressionForTLF(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetBlockCompressionForTLF", arg0, arg1)
+}
+
+func (_m *MockConfig) ManualConflictResolutionForTLF(_param0 TlfID) bool {
+	ret := _m.ctrl.Call(_m, "ManualConflictResolutionForTLF", _param0)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) ManualConflictResolutionForTLF(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ManualConflictResolutionForTLF", arg0)
+}
+
+func (_m *MockConfig) SetManualConflictResolutionForTLF(_param0 TlfID, _param1 bool) error {
+	ret := _m.ctrl.Call(_m, "SetManualConflictResolutionForTLF", _param0, _param1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) SetManualConflictResolutionForTLF(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetManualConflictResolutionForTLF", arg0, arg1)
+}
+
+func (_m *MockConfig) SyncDurabilityForTLF(_param0 TlfID) WriteDurability {
+	ret := _m.ctrl.Call(_m, "SyncDurabilityForTLF", _param0)
+	ret0, _ := ret[0].(WriteDurability)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) SyncDurabilityForTLF(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SyncDurabilityForTLF", arg0)
+}
+
+func (_m *MockConfig) SetSyncDurabilityForTLF(_param0 TlfID, _param1 WriteDurability) error {
+	ret := _m.ctrl.Call(_m, "SetSyncDurabilityForTLF", _param0, _param1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) SetSyncDurabilityForTLF(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetSyncDurabilityForTLF", arg0, arg1)
+}
+
 func (_m *MockConfig) Notifier() Notifier {
 	ret := _m.ctrl.Call(_m, "Notifier")
 	ret0, _ := ret[0].(Notifier)
@@ -3827,6 +4682,36 @@ func (_mr *_MockConfigRecorder) SetClock(arg0 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetClock", arg0)
 }
 
+func (_m *MockConfig) BlockTransferMeter() *BlockTransferMeter {
+	ret := _m.ctrl.Call(_m, "BlockTransferMeter")
+	ret0, _ := ret[0].(*BlockTransferMeter)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) BlockTransferMeter() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BlockTransferMeter")
+}
+
+func (_m *MockConfig) UsageMeter() *UsageMeter {
+	ret := _m.ctrl.Call(_m, "UsageMeter")
+	ret0, _ := ret[0].(*UsageMeter)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) UsageMeter() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "UsageMeter")
+}
+
+func (_m *MockConfig) ClockJumpDetector() *ClockJumpDetector {
+	ret := _m.ctrl.Call(_m, "ClockJumpDetector")
+	ret0, _ := ret[0].(*ClockJumpDetector)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) ClockJumpDetector() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ClockJumpDetector")
+}
+
 func (_m *MockConfig) ConflictRenamer() ConflictRenamer {
 	ret := _m.ctrl.Call(_m, "ConflictRenamer")
 	ret0, _ := ret[0].(ConflictRenamer)
@@ -3845,6 +4730,24 @@ func (_mr *_MockConfigRecorder) SetConflictRenamer(arg0 interface{}) *gomock.Cal
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetConflictRenamer", arg0)
 }
 
+func (_m *MockConfig) ConflictFileMerger() ConflictFileMerger {
+	ret := _m.ctrl.Call(_m, "ConflictFileMerger")
+	ret0, _ := ret[0].(ConflictFileMerger)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) ConflictFileMerger() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ConflictFileMerger")
+}
+
+func (_m *MockConfig) SetConflictFileMerger(_param0 ConflictFileMerger) {
+	_m.ctrl.Call(_m, "SetConflictFileMerger", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetConflictFileMerger(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetConflictFileMerger", arg0)
+}
+
 func (_m *MockConfig) MetadataVersion() MetadataVer {
 	ret := _m.ctrl.Call(_m, "MetadataVersion")
 	ret0, _ := ret[0].(MetadataVer)
@@ -3941,6 +4844,150 @@ func (_mr *_MockConfigRecorder) SetDoBackgroundFlushes(arg0 interface{}) *gomock
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetDoBackgroundFlushes", arg0)
 }
 
+func (_m *MockConfig) BackgroundFlushAge() time.Duration {
+	ret := _m.ctrl.Call(_m, "BackgroundFlushAge")
+	ret0, _ := ret[0].(time.Duration)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) BackgroundFlushAge() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BackgroundFlushAge")
+}
+
+func (_m *MockConfig) SetBackgroundFlushAge(_param0 time.Duration) {
+	_m.ctrl.Call(_m, "SetBackgroundFlushAge", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetBackgroundFlushAge(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetBackgroundFlushAge", arg0)
+}
+
+func (_m *MockConfig) MDCoalesceWindow() time.Duration {
+	ret := _m.ctrl.Call(_m, "MDCoalesceWindow")
+	ret0, _ := ret[0].(time.Duration)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) MDCoalesceWindow() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "MDCoalesceWindow")
+}
+
+func (_m *MockConfig) SetMDCoalesceWindow(_param0 time.Duration) {
+	_m.ctrl.Call(_m, "SetMDCoalesceWindow", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetMDCoalesceWindow(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetMDCoalesceWindow", arg0)
+}
+
+func (_m *MockConfig) MaxReadaheadBlocks() int {
+	ret := _m.ctrl.Call(_m, "MaxReadaheadBlocks")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) MaxReadaheadBlocks() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "MaxReadaheadBlocks")
+}
+
+func (_m *MockConfig) SetMaxReadaheadBlocks(_param0 int) {
+	_m.ctrl.Call(_m, "SetMaxReadaheadBlocks", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetMaxReadaheadBlocks(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetMaxReadaheadBlocks", arg0)
+}
+
+func (_m *MockConfig) SlowOpThreshold() time.Duration {
+	ret := _m.ctrl.Call(_m, "SlowOpThreshold")
+	ret0, _ := ret[0].(time.Duration)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) SlowOpThreshold() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SlowOpThreshold")
+}
+
+func (_m *MockConfig) SetSlowOpThreshold(_param0 time.Duration) {
+	_m.ctrl.Call(_m, "SetSlowOpThreshold", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetSlowOpThreshold(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetSlowOpThreshold", arg0)
+}
+
+func (_m *MockConfig) StateCheckPeriod() time.Duration {
+	ret := _m.ctrl.Call(_m, "StateCheckPeriod")
+	ret0, _ := ret[0].(time.Duration)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) StateCheckPeriod() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "StateCheckPeriod")
+}
+
+func (_m *MockConfig) SetStateCheckPeriod(_param0 time.Duration) {
+	_m.ctrl.Call(_m, "SetStateCheckPeriod", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetStateCheckPeriod(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetStateCheckPeriod", arg0)
+}
+
+func (_m *MockConfig) DiskLimitFraction() float64 {
+	ret := _m.ctrl.Call(_m, "DiskLimitFraction")
+	ret0, _ := ret[0].(float64)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) DiskLimitFraction() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "DiskLimitFraction")
+}
+
+func (_m *MockConfig) SetDiskLimitFraction(_param0 float64) {
+	_m.ctrl.Call(_m, "SetDiskLimitFraction", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetDiskLimitFraction(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetDiskLimitFraction", arg0)
+}
+
+func (_m *MockConfig) Offline() bool {
+	ret := _m.ctrl.Call(_m, "Offline")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) Offline() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Offline")
+}
+
+func (_m *MockConfig) SetOffline(_param0 bool) {
+	_m.ctrl.Call(_m, "SetOffline", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetOffline(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetOffline", arg0)
+}
+
+func (_m *MockConfig) NetworkState() NetworkState {
+	ret := _m.ctrl.Call(_m, "NetworkState")
+	ret0, _ := ret[0].(NetworkState)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) NetworkState() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "NetworkState")
+}
+
+func (_m *MockConfig) SetNetworkState(_param0 NetworkState) {
+	_m.ctrl.Call(_m, "SetNetworkState", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetNetworkState(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetNetworkState", arg0)
+}
+
 func (_m *MockConfig) RekeyWithPromptWaitTime() time.Duration {
 	ret := _m.ctrl.Call(_m, "RekeyWithPromptWaitTime")
 	ret0, _ := ret[0].(time.Duration)
@@ -4033,6 +5080,24 @@ func (_mr *_MockConfigRecorder) SetMetricsRegistry(arg0 interface{}) *gomock.Cal
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetMetricsRegistry", arg0)
 }
 
+func (_m *MockConfig) Tracer() Tracer {
+	ret := _m.ctrl.Call(_m, "Tracer")
+	ret0, _ := ret[0].(Tracer)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) Tracer() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Tracer")
+}
+
+func (_m *MockConfig) SetTracer(_param0 Tracer) {
+	_m.ctrl.Call(_m, "SetTracer", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetTracer(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetTracer", arg0)
+}
+
 func (_m *MockConfig) TLFValidDuration() time.Duration {
 	ret := _m.ctrl.Call(_m, "TLFValidDuration")
 	ret0, _ := ret[0].(time.Duration)
@@ -4071,6 +5136,74 @@ func (_mr *_MockConfigRecorder) CheckStateOnShutdown() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "CheckStateOnShutdown")
 }
 
+// Mock of Span interface
+type MockSpan struct {
+	ctrl     *gomock.Controller
+	recorder *_MockSpanRecorder
+}
+
+// Recorder for MockSpan (not exported)
+type _MockSpanRecorder struct {
+	mock *MockSpan
+}
+
+func NewMockSpan(ctrl *gomock.Controller) *MockSpan {
+	mock := &MockSpan{ctrl: ctrl}
+	mock.recorder = &_MockSpanRecorder{mock}
+	return mock
+}
+
+func (_m *MockSpan) EXPECT() *_MockSpanRecorder {
+	return _m.recorder
+}
+
+func (_m *MockSpan) SetTag(key string, value interface{}) {
+	_m.ctrl.Call(_m, "SetTag", key, value)
+}
+
+func (_mr *_MockSpanRecorder) SetTag(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetTag", arg0, arg1)
+}
+
+func (_m *MockSpan) Finish(err error) {
+	_m.ctrl.Call(_m, "Finish", err)
+}
+
+func (_mr *_MockSpanRecorder) Finish(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Finish", arg0)
+}
+
+// Mock of Tracer interface
+type MockTracer struct {
+	ctrl     *gomock.Controller
+	recorder *_MockTracerRecorder
+}
+
+// Recorder for MockTracer (not exported)
+type _MockTracerRecorder struct {
+	mock *MockTracer
+}
+
+func NewMockTracer(ctrl *gomock.Controller) *MockTracer {
+	mock := &MockTracer{ctrl: ctrl}
+	mock.recorder = &_MockTracerRecorder{mock}
+	return mock
+}
+
+func (_m *MockTracer) EXPECT() *_MockTracerRecorder {
+	return _m.recorder
+}
+
+func (_m *MockTracer) StartSpan(ctx context.Context, name string, parent Span) Span {
+	ret := _m.ctrl.Call(_m, "StartSpan", ctx, name, parent)
+	ret0, _ := ret[0].(Span)
+	return ret0
+}
+
+func (_mr *_MockTracerRecorder) StartSpan(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "StartSpan", arg0, arg1, arg2)
+}
+
 // Mock of NodeCache interface
 type MockNodeCache struct {
 	ctrl     *gomock.Controller
@@ -4149,6 +5282,16 @@ func (_mr *_MockNodeCacheRecorder) PathFromNode(arg0 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "PathFromNode", arg0)
 }
 
+func (_m *MockNodeCache) NumNodes() int {
+	ret := _m.ctrl.Call(_m, "NumNodes")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+func (_mr *_MockNodeCacheRecorder) NumNodes() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "NumNodes")
+}
+
 // Mock of crAction interface
 type MockcrAction struct {
 	ctrl     *gomock.Controller
@@ -5392,40 +6535,97 @@ func (_m *MockKeyBundleCache) EXPECT() *_MockKeyBundleCacheRecorder {
 	return _m.recorder
 }
 
-func (_m *MockKeyBundleCache) GetTLFReaderKeyBundleV2(_param0 TLFReaderKeyBundleID) (TLFReaderKeyBundleV2, bool) {
-	ret := _m.ctrl.Call(_m, "GetTLFReaderKeyBundleV2", _param0)
-	ret0, _ := ret[0].(TLFReaderKeyBundleV2)
+func (_m *MockKeyBundleCache) GetTLFReaderKeyBundle(_param0 TLFReaderKeyBundleID) (TLFReaderKeyBundleV3, bool) {
+	ret := _m.ctrl.Call(_m, "GetTLFReaderKeyBundle", _param0)
+	ret0, _ := ret[0].(TLFReaderKeyBundleV3)
 	ret1, _ := ret[1].(bool)
 	return ret0, ret1
 }
 
-func (_mr *_MockKeyBundleCacheRecorder) GetTLFReaderKeyBundleV2(arg0 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetTLFReaderKeyBundleV2", arg0)
+func (_mr *_MockKeyBundleCacheRecorder) GetTLFReaderKeyBundle(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetTLFReaderKeyBundle", arg0)
 }
 
-func (_m *MockKeyBundleCache) GetTLFWriterKeyBundleV2(_param0 TLFWriterKeyBundleID) (TLFWriterKeyBundleV3, bool) {
-	ret := _m.ctrl.Call(_m, "GetTLFWriterKeyBundleV2", _param0)
+func (_m *MockKeyBundleCache) GetTLFWriterKeyBundle(_param0 TLFWriterKeyBundleID) (TLFWriterKeyBundleV3, bool) {
+	ret := _m.ctrl.Call(_m, "GetTLFWriterKeyBundle", _param0)
 	ret0, _ := ret[0].(TLFWriterKeyBundleV3)
 	ret1, _ := ret[1].(bool)
 	return ret0, ret1
 }
 
-func (_mr *_MockKeyBundleCacheRecorder) GetTLFWriterKeyBundleV2(arg0 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetTLFWriterKeyBundleV2", arg0)
+func (_mr *_MockKeyBundleCacheRecorder) GetTLFWriterKeyBundle(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetTLFWriterKeyBundle", arg0)
+}
+
+func (_m *MockKeyBundleCache) PutTLFReaderKeyBundle(_param0 TLFReaderKeyBundleID, _param1 TLFReaderKeyBundleV3) error {
+	ret := _m.ctrl.Call(_m, "PutTLFReaderKeyBundle", _param0, _param1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKeyBundleCacheRecorder) PutTLFReaderKeyBundle(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "PutTLFReaderKeyBundle", arg0, arg1)
+}
+
+func (_m *MockKeyBundleCache) PutTLFWriterKeyBundle(_param0 TLFWriterKeyBundleID, _param1 TLFWriterKeyBundleV3) error {
+	ret := _m.ctrl.Call(_m, "PutTLFWriterKeyBundle", _param0, _param1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKeyBundleCacheRecorder) PutTLFWriterKeyBundle(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "PutTLFWriterKeyBundle", arg0, arg1)
+}
+
+// Mock of CRJournal interface
+type MockCRJournal struct {
+	ctrl     *gomock.Controller
+	recorder *_MockCRJournalRecorder
+}
+
+// Recorder for MockCRJournal (not exported)
+type _MockCRJournalRecorder struct {
+	mock *MockCRJournal
+}
+
+func NewMockCRJournal(ctrl *gomock.Controller) *MockCRJournal {
+	mock := &MockCRJournal{ctrl: ctrl}
+	mock.recorder = &_MockCRJournalRecorder{mock}
+	return mock
+}
+
+func (_m *MockCRJournal) EXPECT() *_MockCRJournalRecorder {
+	return _m.recorder
+}
+
+func (_m *MockCRJournal) GetPendingResolution(_param0 TlfID) (CRJournalEntry, bool, error) {
+	ret := _m.ctrl.Call(_m, "GetPendingResolution", _param0)
+	ret0, _ := ret[0].(CRJournalEntry)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockCRJournalRecorder) GetPendingResolution(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetPendingResolution", arg0)
 }
 
-func (_m *MockKeyBundleCache) PutTLFReaderKeyBundleV2(_param0 TLFReaderKeyBundleV2) {
-	_m.ctrl.Call(_m, "PutTLFReaderKeyBundleV2", _param0)
+func (_m *MockCRJournal) PutPendingResolution(_param0 CRJournalEntry) error {
+	ret := _m.ctrl.Call(_m, "PutPendingResolution", _param0)
+	ret0, _ := ret[0].(error)
+	return ret0
 }
 
-func (_mr *_MockKeyBundleCacheRecorder) PutTLFReaderKeyBundleV2(arg0 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "PutTLFReaderKeyBundleV2", arg0)
+func (_mr *_MockCRJournalRecorder) PutPendingResolution(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "PutPendingResolution", arg0)
 }
 
-func (_m *MockKeyBundleCache) PutTLFWriterKeyBundleV2(_param0 TLFWriterKeyBundleV3) {
-	_m.ctrl.Call(_m, "PutTLFWriterKeyBundleV2", _param0)
+func (_m *MockCRJournal) ClearPendingResolution(_param0 TlfID) error {
+	ret := _m.ctrl.Call(_m, "ClearPendingResolution", _param0)
+	ret0, _ := ret[0].(error)
+	return ret0
 }
 
-func (_mr *_MockKeyBundleCacheRecorder) PutTLFWriterKeyBundleV2(arg0 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "PutTLFWriterKeyBundleV2", arg0)
+func (_mr *_MockCRJournalRecorder) ClearPendingResolution(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ClearPendingResolution", arg0)
 }
@@ -0,0 +1,240 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// LatencyDistribution describes how long simulated calls take to go
+// to a server and back, not counting the time to transfer their
+// data.  Latencies are Min plus an exponentially-distributed tail
+// with mean Mean-Min, capped at Max, which is roughly what real
+// networks look like.
+type LatencyDistribution struct {
+	// Min is the least latency of any call.
+	Min time.Duration
+	// Mean is the mean latency.  If it isn't more than Min,
+	// every call takes exactly Min.
+	Mean time.Duration
+	// Max, if positive, caps the latency of any call.
+	Max time.Duration
+}
+
+func (ld LatencyDistribution) sample(rng *rand.Rand) time.Duration {
+	latency := ld.Min
+	if ld.Mean > ld.Min {
+		latency += time.Duration(rng.ExpFloat64() * float64(ld.Mean-ld.Min))
+	}
+	if ld.Max > 0 && latency > ld.Max {
+		latency = ld.Max
+	}
+	return latency
+}
+
+// NetworkProfile describes the simulated network between a client
+// and an in-memory server.
+type NetworkProfile struct {
+	// Latency is the latency distribution of calls whose op isn't
+	// in OpLatency.
+	Latency   LatencyDistribution
+	OpLatency map[string]LatencyDistribution
+	// ErrorRate is the chance of a call whose op isn't in
+	// OpErrorRate failing, without reaching the server.
+	ErrorRate   float64
+	OpErrorRate map[string]float64
+	// Err is what failed calls fail with.  If nil, a
+	// SimulatedNetworkError is used.
+	Err error
+	// UploadBandwidth and DownloadBandwidth are how many bytes
+	// per second can be sent to and received from the server,
+	// shared by all calls at once.  Zero means unlimited.
+	UploadBandwidth   int64
+	DownloadBandwidth int64
+}
+
+// SimulatedNetworkError is the error failed simulated calls fail
+// with, unless their NetworkProfile names another.
+type SimulatedNetworkError struct {
+	Op string
+}
+
+// Error implements the error interface for SimulatedNetworkError.
+func (e SimulatedNetworkError) Error() string {
+	return fmt.Sprintf("Simulated network error in %s", e.Op)
+}
+
+// NetworkOpStats are the statistics a NetworkSimulator keeps for one
+// op.
+type NetworkOpStats struct {
+	Calls    int
+	Failures int
+	// Sent and Received count the bytes of data sent to and
+	// received from the server.
+	Sent     int64
+	Received int64
+	// Delay is the total time calls were held up for.
+	Delay time.Duration
+}
+
+// NetworkSimulator delays and fails the calls to an in-memory
+// server the way a network described by a NetworkProfile would.
+// The delays are real, so tests should keep them to a few
+// milliseconds; the statistics it keeps are what performance tests
+// should check.  Random choices come from a seeded source, so the
+// latencies and failures of a sequence of calls can be replayed,
+// though concurrent calls may still draw them in any order.
+type NetworkSimulator struct {
+	lock    sync.Mutex
+	rng     *rand.Rand
+	profile NetworkProfile
+	// uploadFree and downloadFree are when the simulated links
+	// are next free to transfer data.
+	uploadFree   time.Time
+	downloadFree time.Time
+	stats        map[string]NetworkOpStats
+}
+
+// NewNetworkSimulator returns a NetworkSimulator simulating the given
+// profile, with random choices seeded by seed.
+func NewNetworkSimulator(
+	seed int64, profile NetworkProfile) *NetworkSimulator {
+	return &NetworkSimulator{
+		rng:     rand.New(rand.NewSource(seed)),
+		profile: profile,
+		stats:   make(map[string]NetworkOpStats),
+	}
+}
+
+// SetProfile changes the simulated network for calls from now on.
+func (ns *NetworkSimulator) SetProfile(profile NetworkProfile) {
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+	ns.profile = profile
+}
+
+// Stats returns the statistics of the calls simulated so far, by
+// op.
+func (ns *NetworkSimulator) Stats() map[string]NetworkOpStats {
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+	stats := make(map[string]NetworkOpStats, len(ns.stats))
+	for op, s := range ns.stats {
+		stats[op] = s
+	}
+	return stats
+}
+
+// ResetStats clears the statistics.
+func (ns *NetworkSimulator) ResetStats() {
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+	ns.stats = make(map[string]NetworkOpStats)
+}
+
+// transferDoneLocked reserves the next turn on a link with the given
+// bandwidth to transfer n bytes, and returns when the transfer will
+// be done.  ns.lock must be held.
+func transferDoneLocked(
+	now time.Time, free *time.Time, bandwidth int64, n int) time.Time {
+	if bandwidth <= 0 || n <= 0 {
+		return now
+	}
+	start := now
+	if free.After(start) {
+		start = *free
+	}
+	*free = start.Add(time.Duration(int64(n) * int64(time.Second) / bandwidth))
+	return *free
+}
+
+func (ns *NetworkSimulator) wait(
+	ctx context.Context, op string, d time.Duration) error {
+	ns.lock.Lock()
+	s := ns.stats[op]
+	s.Delay += d
+	ns.stats[op] = s
+	ns.lock.Unlock()
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// request simulates sending a call for op, with sent bytes of data,
+// to the server, and the latency of the round trip.  If it returns
+// an error, the call should fail with it without being handled.  A
+// nil NetworkSimulator simulates a perfect network, here and in
+// reply.
+func (ns *NetworkSimulator) request(
+	ctx context.Context, op string, sent int) error {
+	if ns == nil {
+		return nil
+	}
+	ns.lock.Lock()
+	p := ns.profile
+	latency, ok := p.OpLatency[op]
+	if !ok {
+		latency = p.Latency
+	}
+	errorRate, ok := p.OpErrorRate[op]
+	if !ok {
+		errorRate = p.ErrorRate
+	}
+	failed := errorRate > 0 && ns.rng.Float64() < errorRate
+	d := latency.sample(ns.rng)
+	now := time.Now()
+	d += transferDoneLocked(now, &ns.uploadFree, p.UploadBandwidth,
+		sent).Sub(now)
+	s := ns.stats[op]
+	s.Calls++
+	s.Sent += int64(sent)
+	if failed {
+		s.Failures++
+	}
+	ns.stats[op] = s
+	ns.lock.Unlock()
+
+	if err := ns.wait(ctx, op, d); err != nil {
+		return err
+	}
+	if failed {
+		if p.Err != nil {
+			return p.Err
+		}
+		return SimulatedNetworkError{op}
+	}
+	return nil
+}
+
+// reply simulates receiving received bytes of data from the server
+// in reply to a call for op.
+func (ns *NetworkSimulator) reply(
+	ctx context.Context, op string, received int) error {
+	if ns == nil {
+		return nil
+	}
+	ns.lock.Lock()
+	now := time.Now()
+	d := transferDoneLocked(now, &ns.downloadFree,
+		ns.profile.DownloadBandwidth, received).Sub(now)
+	s := ns.stats[op]
+	s.Received += int64(received)
+	ns.stats[op] = s
+	ns.lock.Unlock()
+	return ns.wait(ctx, op, d)
+}
@@ -0,0 +1,154 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestNetworkSimulatorSeeded(t *testing.T) {
+	ctx := context.Background()
+	outcomes := func(seed int64) (outcomes []bool) {
+		ns := NewNetworkSimulator(seed, NetworkProfile{
+			ErrorRate:   0.5,
+			OpErrorRate: map[string]float64{"Put": 0},
+		})
+		for i := 0; i < 20; i++ {
+			err := ns.request(ctx, "Get", 0)
+			outcomes = append(outcomes, err != nil)
+			require.NoError(t, ns.request(ctx, "Put", 0))
+		}
+		stats := ns.Stats()
+		require.Equal(t, 20, stats["Get"].Calls)
+		require.Equal(t, 0, stats["Put"].Failures)
+		return outcomes
+	}
+	require.Equal(t, outcomes(42), outcomes(42))
+	require.Contains(t, outcomes(42), true)
+	require.Contains(t, outcomes(42), false)
+}
+
+func TestNetworkSimulatorLatencyAndBandwidth(t *testing.T) {
+	ctx := context.Background()
+	ns := NewNetworkSimulator(1, NetworkProfile{
+		Latency: LatencyDistribution{
+			Min: time.Millisecond, Mean: 2 * time.Millisecond,
+			Max: 5 * time.Millisecond,
+		},
+		OpLatency: map[string]LatencyDistribution{
+			"Put": {Min: 3 * time.Millisecond},
+		},
+		UploadBandwidth: 1 << 20,
+	})
+	start := time.Now()
+	require.NoError(t, ns.request(ctx, "Get", 0))
+	require.NoError(t, ns.request(ctx, "Put", 10<<10))
+	require.NoError(t, ns.reply(ctx, "Put", 10<<10))
+	elapsed := time.Since(start)
+
+	stats := ns.Stats()
+	get := stats["Get"]
+	require.True(t, get.Delay >= time.Millisecond && get.Delay <= 5*time.Millisecond,
+		"Get delay %s", get.Delay)
+	// 10 KiB at 1 MiB/s takes about 10ms, on top of the latency.
+	// Downloads are unlimited.
+	put := stats["Put"]
+	require.True(t, put.Delay >= 12*time.Millisecond, "Put delay %s", put.Delay)
+	require.Equal(t, int64(10<<10), put.Sent)
+	require.Equal(t, int64(10<<10), put.Received)
+	require.True(t, elapsed >= get.Delay+put.Delay)
+
+	ns.ResetStats()
+	require.Empty(t, ns.Stats())
+
+	// Canceling the context cuts the delay short.
+	ns.SetProfile(NetworkProfile{Latency: LatencyDistribution{Min: time.Hour}})
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	require.Equal(t, context.Canceled, ns.request(ctx, "Get", 0))
+}
+
+func TestBServerMemoryNetworkSimulator(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "user1")
+	defer config.Shutdown()
+	ctx := context.Background()
+	_, currentUID, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+	crypto := config.Crypto()
+	bserver := NewBlockServerMemory(blockServerLocalConfigAdapter{config})
+	ns := NewNetworkSimulator(1, NetworkProfile{})
+	bserver.SetNetworkSimulator(ns)
+
+	tlfID := FakeTlfID(2, false)
+	data := []byte{1, 2, 3, 4}
+	bID, err := crypto.MakePermanentBlockID(data)
+	require.NoError(t, err)
+	bCtx := BlockContext{currentUID, "", zeroBlockRefNonce}
+	serverHalf, err := crypto.MakeRandomBlockCryptKeyServerHalf()
+	require.NoError(t, err)
+	require.NoError(t, bserver.Put(ctx, tlfID, bID, bCtx, data, serverHalf))
+	_, _, err = bserver.Get(ctx, tlfID, bID, bCtx)
+	require.NoError(t, err)
+
+	require.Equal(t, map[string]NetworkOpStats{
+		"Put": {Calls: 1, Sent: 4},
+		"Get": {Calls: 1, Received: 4},
+	}, ns.Stats())
+
+	ns.SetProfile(NetworkProfile{OpErrorRate: map[string]float64{"Get": 1}})
+	_, _, err = bserver.Get(ctx, tlfID, bID, bCtx)
+	require.Equal(t, SimulatedNetworkError{"Get"}, err)
+}
+
+func TestNetworkSimulatorKBFSOps(t *testing.T) {
+	config1 := MakeTestConfigOrBust(t, "alice", "bob")
+	defer CheckConfigAndShutdown(t, config1)
+	config2 := ConfigAsUser(config1, "bob")
+	defer CheckConfigAndShutdown(t, config2)
+	ctx := BackgroundContextWithCancellationDelayer()
+	defer CleanupCancellationDelayer(ctx)
+
+	// Only alice's calls to the MD server go through the
+	// simulator, but both users' block calls do.
+	mdNS := NewNetworkSimulator(1, NetworkProfile{
+		Latency: LatencyDistribution{Min: time.Millisecond},
+	})
+	config1.MDServer().(*MDServerMemory).SetNetworkSimulator(mdNS)
+	blockNS := NewNetworkSimulator(1, NetworkProfile{
+		DownloadBandwidth: 10 << 20,
+	})
+	config1.BlockServer().(*BlockServerMemory).SetNetworkSimulator(blockNS)
+
+	name := "alice,bob"
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	fileNode1, _, err := kbfsOps1.CreateFile(
+		ctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := []byte{1, 2, 3, 4, 5}
+	require.NoError(t, kbfsOps1.Write(ctx, fileNode1, data, 0))
+	require.NoError(t, kbfsOps1.Sync(ctx, fileNode1))
+
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	buf := make([]byte, len(data))
+	n, err := kbfsOps2.Read(ctx, fileNode2, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, data, buf[:n])
+
+	mdStats := mdNS.Stats()
+	require.True(t, mdStats["Put"].Calls >= 2)
+	require.True(t, mdStats["Put"].Sent > 0)
+	require.True(t, mdStats["Put"].Delay >= 2*time.Millisecond)
+	blockStats := blockNS.Stats()
+	require.True(t, blockStats["Put"].Calls >= 2)
+	require.True(t, blockStats["Get"].Received > 0)
+}
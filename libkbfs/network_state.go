@@ -0,0 +1,70 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+)
+
+// NetworkState describes the network this device is on, as reported
+// by a connectivity notifier of the OS, or by the app embedding KBFS,
+// so that background work can adapt to it.
+type NetworkState int
+
+const (
+	// NetworkUnmetered is a network where data is cheap, like
+	// Wi-Fi or a wired connection.  It's the default, until
+	// something reports otherwise.
+	NetworkUnmetered NetworkState = iota
+	// NetworkMetered is a network where data costs money, like a
+	// cellular one.  Background journal flushes of more than
+	// meteredFlushMaxBytes, and fetches for synced TLFs, wait for
+	// an unmetered network.
+	NetworkMetered
+	// NetworkNone means there's no network at all.  KBFS then acts
+	// as if it were offline, without waiting for the servers to
+	// time out.
+	NetworkNone
+)
+
+func (s NetworkState) String() string {
+	switch s {
+	case NetworkUnmetered:
+		return "unmetered"
+	case NetworkMetered:
+		return "metered"
+	case NetworkNone:
+		return "none"
+	default:
+		return fmt.Sprintf("NetworkState(%d)", s)
+	}
+}
+
+// ParseNetworkState returns the NetworkState named by s, as returned
+// by its String method.
+func ParseNetworkState(s string) (NetworkState, error) {
+	for _, state := range []NetworkState{
+		NetworkUnmetered, NetworkMetered, NetworkNone} {
+		if s == state.String() {
+			return state, nil
+		}
+	}
+	return NetworkUnmetered, fmt.Errorf("Unknown network state %q", s)
+}
+
+// meteredFlushMaxBytes is the most unflushed block data that a
+// journal flushes in the background while on a metered network.
+// Larger flushes wait for an unmetered one, unless asked for
+// explicitly.
+const meteredFlushMaxBytes = 1024 * 1024
+
+// reconnectListener is told when KBFS can reach the network again
+// after being offline, so that work which has been backing off, like
+// registering for MD updates, can be retried right away.
+type reconnectListener interface {
+	onReconnect(ctx context.Context)
+}
@@ -279,3 +279,48 @@ func (ncs *nodeCacheStandard) PathFromNode(node Node) (p path) {
 	p.FolderBranch = ncs.folderBranch
 	return
 }
+
+// NumNodes implements the NodeCache interface for nodeCacheStandard.
+func (ncs *nodeCacheStandard) NumNodes() int {
+	ncs.lock.RLock()
+	defer ncs.lock.RUnlock()
+	return len(ncs.nodes)
+}
+
+// relPathFromNode returns the names leading from root down to node,
+// if node is root or one of its (linked) descendants.  Unlike
+// comparing two calls to PathFromNode, this doesn't race with
+// renames, since it's done under one lock and by node identity.
+func (ncs *nodeCacheStandard) relPathFromNode(root, node Node) (
+	names []string, ok bool) {
+	ncs.lock.RLock()
+	defer ncs.lock.RUnlock()
+
+	rs, ok := root.(*nodeStandard)
+	if !ok {
+		return nil, false
+	}
+	ns, ok := node.(*nodeStandard)
+	if !ok {
+		return nil, false
+	}
+
+	for ns != nil {
+		core := ns.core
+		if core == rs.core {
+			// need to reverse the names
+			for i := len(names)/2 - 1; i >= 0; i-- {
+				opp := len(names) - 1 - i
+				names[i], names[opp] = names[opp], names[i]
+			}
+			return names, true
+		}
+		if core.parent == nil {
+			// Either the TLF root, or unlinked.
+			return nil, false
+		}
+		names = append(names, core.pathNode.Name)
+		ns = core.parent
+	}
+	return nil, false
+}
@@ -28,6 +28,12 @@ func (ol *observerList) add(o Observer) {
 	ol.observers = append(ol.observers, o)
 }
 
+func (ol *observerList) len() int {
+	ol.lock.RLock()
+	defer ol.lock.RUnlock()
+	return len(ol.observers)
+}
+
 func (ol *observerList) remove(o Observer) {
 	ol.lock.Lock()
 	defer ol.lock.Unlock()
@@ -57,6 +63,17 @@ func (ol *observerList) batchChanges(
 	}
 }
 
+func (ol *observerList) conflictResolutionEvent(
+	ctx context.Context, event ConflictEvent) {
+	ol.lock.RLock()
+	defer ol.lock.RUnlock()
+	for _, o := range ol.observers {
+		if co, ok := o.(ConflictObserver); ok {
+			co.ConflictResolutionEvent(ctx, event)
+		}
+	}
+}
+
 func (ol *observerList) tlfHandleChange(
 	ctx context.Context, newHandle *TlfHandle) {
 	ol.lock.RLock()
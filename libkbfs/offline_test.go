@@ -0,0 +1,86 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKBFSOpsOffline(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "offline")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+	config.SetMDServer(NewMDServerOffline(config, config.MDServer()))
+	config.SetBlockServer(NewBlockServerOffline(config, config.BlockServer()))
+	config.EnableJournaling(tempdir)
+	jServer, err := GetJournalServer(config)
+	require.NoError(t, err)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	tlfID := rootNode.GetFolderBranch().Tlf
+	err = jServer.Enable(ctx, tlfID, TLFJournalBackgroundWorkEnabled)
+	require.NoError(t, err)
+
+	kbfsOps := config.KBFSOps()
+	aNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, aNode, []byte("hello"), 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, aNode)
+	require.NoError(t, err)
+	err = jServer.Wait(ctx, tlfID)
+	require.NoError(t, err)
+
+	config.SetOffline(true)
+	require.False(t, config.MDServer().IsConnected())
+
+	// Cached data is still readable.
+	buf := make([]byte, 5)
+	n, err := kbfsOps.Read(ctx, aNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf[:n]))
+
+	// Writes go into the journal, and stay there.
+	bNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, bNode, []byte("world"), 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, bNode)
+	require.NoError(t, err)
+	err = jServer.Flush(ctx, tlfID)
+	require.IsType(t, OfflineUnavailableError{}, err)
+	status, err := jServer.JournalStatus(tlfID)
+	require.NoError(t, err)
+	require.NotZero(t, status.UnflushedBytes)
+
+	// Anything else fails right away.
+	_, err = config.MDServer().GetForTLF(
+		ctx, tlfID, NullBranchID, Merged)
+	require.IsType(t, OfflineUnavailableError{}, err)
+	config.ResetCaches()
+	_, err = kbfsOps.Read(ctx, aNode, buf, 0)
+	require.IsType(t, OfflineUnavailableError{}, err)
+
+	// Coming back online flushes the journal.
+	config.SetOffline(false)
+	err = jServer.Wait(ctx, tlfID)
+	require.NoError(t, err)
+	status, err = jServer.JournalStatus(tlfID)
+	require.NoError(t, err)
+	require.Zero(t, status.UnflushedBytes)
+	n, err = kbfsOps.Read(ctx, aNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf[:n]))
+}
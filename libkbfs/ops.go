@@ -222,6 +222,9 @@ type createOp struct {
 	NewName string      `codec:"n"`
 	Dir     blockUpdate `codec:"d"`
 	Type    EntryType   `codec:"t"`
+	// Link, if set, is the name of the existing file in the same
+	// directory that this create op made a hard link to.
+	Link string `codec:"l,omitempty"`
 
 	// If true, this create op represents half of a rename operation.
 	// This op should never be persisted.
@@ -296,6 +299,9 @@ func (co *createOp) checkValid() error {
 
 func (co *createOp) String() string {
 	res := fmt.Sprintf("create %s (%s)", co.NewName, co.Type)
+	if co.Link != "" {
+		res += fmt.Sprintf(" (link to %s)", co.Link)
+	}
 	if co.renamed {
 		res += " (renamed)"
 	}
@@ -352,7 +358,10 @@ func (co *createOp) CheckConflict(renamer ConflictRenamer, mergedOp op,
 }
 
 func (co *createOp) GetDefaultAction(mergedPath path) crAction {
-	if co.forceCopy {
+	// The file may have gotten a different pointer in the merged
+	// branch, so rather than risk a dangling link, an unmerged hard
+	// link is resolved into a copy of the file.
+	if co.forceCopy || co.Link != "" {
 		return &renameUnmergedAction{
 			fromName: co.NewName,
 			toName:   co.NewName,
@@ -574,10 +583,10 @@ func (w WriteRange) End() uint64 {
 // operation and `other` overlap in some way.  Specifically, it
 // returns true if:
 //
-// - both operations are writes and their write ranges overlap;
-// - one operation is a write and one is a truncate, and the truncate is
-//   within the write's range or before it; or
-// - both operations are truncates.
+//   - both operations are writes and their write ranges overlap;
+//   - one operation is a write and one is a truncate, and the truncate is
+//     within the write's range or before it; or
+//   - both operations are truncates.
 func (w WriteRange) Affects(other WriteRange) bool {
 	if w.isTruncate() {
 		if other.isTruncate() {
@@ -818,6 +827,9 @@ const (
 	exAttr attrChange = iota
 	mtimeAttr
 	sizeAttr // only used during conflict resolution
+	xattrAttr
+	modeAttr
+	ownerAttr
 )
 
 func (ac attrChange) String() string {
@@ -828,10 +840,35 @@ func (ac attrChange) String() string {
 		return "mtime"
 	case sizeAttr:
 		return "size"
+	case xattrAttr:
+		return "xattr"
+	case modeAttr:
+		return "mode"
+	case ownerAttr:
+		return "owner"
 	}
 	return "<invalid attrChange>"
 }
 
+// canBeDirAttr returns whether ac can be set on a directory, as well
+// as on a file.
+func (ac attrChange) canBeDirAttr() bool {
+	switch ac {
+	case mtimeAttr, xattrAttr, modeAttr, ownerAttr:
+		return true
+	}
+	return false
+}
+
+// attrsOverlap returns whether setting a and b touch the same part
+// of an entry.  Setting the mode also sets the exec bit.
+func attrsOverlap(a, b attrChange) bool {
+	if a == b {
+		return true
+	}
+	return (a == exAttr && b == modeAttr) || (a == modeAttr && b == exAttr)
+}
+
 // setAttrOp is an op that represents changing the attributes of a
 // file/subdirectory with in a directory.
 type setAttrOp struct {
@@ -840,6 +877,9 @@ type setAttrOp struct {
 	Dir  blockUpdate  `codec:"d"`
 	Attr attrChange   `codec:"a"`
 	File BlockPointer `codec:"f"`
+	// XattrName is the extended attribute changed by an xattrAttr
+	// change.
+	XattrName string `codec:"x,omitempty"`
 }
 
 func newSetAttrOp(name string, oldDir BlockPointer,
@@ -868,7 +908,7 @@ func (sao *setAttrOp) AddUpdate(oldPtr BlockPointer, newPtr BlockPointer) {
 }
 
 func (sao *setAttrOp) SizeExceptUpdates() uint64 {
-	return uint64(len(sao.Name))
+	return uint64(len(sao.Name) + len(sao.XattrName))
 }
 
 func (sao *setAttrOp) AllUpdates() []blockUpdate {
@@ -886,14 +926,50 @@ func (sao *setAttrOp) checkValid() error {
 }
 
 func (sao *setAttrOp) String() string {
+	if sao.Attr == xattrAttr {
+		return fmt.Sprintf("setAttr %s (%s %s)", sao.Name, sao.Attr,
+			sao.XattrName)
+	}
 	return fmt.Sprintf("setAttr %s (%s)", sao.Name, sao.Attr)
 }
 
+// xattrNames returns the names of the extended attributes changed
+// by this op, if any.
+func (sao *setAttrOp) xattrNames() []string {
+	if sao.Attr != xattrAttr {
+		return nil
+	}
+	return []string{sao.XattrName}
+}
+
 func (sao *setAttrOp) CheckConflict(renamer ConflictRenamer, mergedOp op,
 	isFile bool) (crAction, error) {
 	switch realMergedOp := mergedOp.(type) {
 	case *setAttrOp:
-		if realMergedOp.Attr == sao.Attr {
+		if realMergedOp.Attr == sao.Attr && sao.Attr == xattrAttr {
+			if realMergedOp.XattrName != sao.XattrName {
+				return nil, nil
+			}
+			// The merged value of an extended attribute keeps its
+			// name, and the unmerged value is kept under a
+			// conflict name, rather than making a conflict copy of
+			// the whole entry.
+			return &copyUnmergedAttrAction{
+				fromName: sao.getFinalPath().tailName(),
+				toName:   mergedOp.getFinalPath().tailName(),
+				attr:     []attrChange{xattrAttr},
+				xattrRenames: map[string]string{
+					sao.XattrName: renamer.ConflictRename(
+						sao, sao.XattrName),
+				},
+			}, nil
+		} else if attrsOverlap(realMergedOp.Attr, sao.Attr) &&
+			(sao.Attr == modeAttr || sao.Attr == ownerAttr ||
+				realMergedOp.Attr == modeAttr) {
+			// Likewise the merged permissions and owner win,
+			// since they're easy to set again.
+			return &dropUnmergedAction{sao}, nil
+		} else if realMergedOp.Attr == sao.Attr {
 			var symPath string
 			var causedByAttr attrChange
 			if !isFile {
@@ -927,6 +1003,7 @@ func (sao *setAttrOp) GetDefaultAction(mergedPath path) crAction {
 		fromName: sao.getFinalPath().tailName(),
 		toName:   mergedPath.tailName(),
 		attr:     []attrChange{sao.Attr},
+		xattrs:   sao.xattrNames(),
 	}
 }
 
@@ -1087,10 +1164,12 @@ func invertOpForLocalNotifications(oldOp op) (newOp op, err error) {
 		copy(so.Writes, op.Writes)
 		newOp = so
 	case *setAttrOp:
-		newOp, err = newSetAttrOp(op.Name, op.Dir.Ref, op.Attr, op.File)
+		sao, err := newSetAttrOp(op.Name, op.Dir.Ref, op.Attr, op.File)
 		if err != nil {
 			return nil, err
 		}
+		sao.XattrName = op.XattrName
+		newOp = sao
 	case *gcOp:
 		newOp = op
 	}
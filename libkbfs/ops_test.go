@@ -237,6 +237,7 @@ func makeFakeCreateOpFuture(t *testing.T) createOpFuture {
 			"new name",
 			makeFakeBlockUpdate(t),
 			Exec,
+			"link name",
 			false,
 			false,
 			"",
@@ -372,8 +373,9 @@ func makeFakeSetAttrOpFuture(t *testing.T) setAttrOpFuture {
 			makeFakeOpCommon(t, true),
 			"name",
 			makeFakeBlockUpdate(t),
-			mtimeAttr,
+			xattrAttr,
 			makeFakeBlockPointer(t),
+			"user.name",
 		},
 		makeExtraOrBust("setAttrOp", t),
 	}
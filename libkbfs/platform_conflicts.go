@@ -0,0 +1,278 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	gopath "path"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+
+	"golang.org/x/net/context"
+	"golang.org/x/text/unicode/norm"
+)
+
+// PlatformConflictKind is a way in which an entry that's fine on one
+// platform can be a problem on another.
+type PlatformConflictKind int
+
+const (
+	// CaseConflict means the entry's name differs only in case, or
+	// in its Unicode normalization, from another in the same
+	// directory, so only one of them is visible on a file system
+	// that ignores those differences, like those of macOS and
+	// Windows.
+	CaseConflict PlatformConflictKind = iota + 1
+	// InvalidWindowsName means the entry's name can't be used on
+	// Windows: it has a reserved character, ends with a dot or a
+	// space, or is a reserved device name like CON or LPT1.
+	InvalidWindowsName
+	// PathTooLong means the entry's full path on a Windows mount is
+	// longer than MAX_PATH allows.
+	PathTooLong
+)
+
+func (k PlatformConflictKind) String() string {
+	switch k {
+	case CaseConflict:
+		return "case conflict"
+	case InvalidWindowsName:
+		return "invalid Windows name"
+	case PathTooLong:
+		return "path too long"
+	default:
+		return fmt.Sprintf("PlatformConflictKind(%d)", int(k))
+	}
+}
+
+// maxWindowsPathLength is MAX_PATH, less the terminating NUL.
+const maxWindowsPathLength = 259
+
+// windowsMountPrefix stands in for the drive that KBFS is mounted on
+// in Windows paths.
+const windowsMountPrefix = `K:\`
+
+const windowsReservedChars = `<>:"/\|?*`
+
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// PlatformConflict describes one problem found by
+// ScanPlatformConflicts.
+type PlatformConflict struct {
+	Kind PlatformConflictKind
+	// Path is the slash-separated path of the entry, relative to
+	// the TLF root.
+	Path string
+	// SuggestedName is a name in the same directory that would fix
+	// the problem, or empty if renaming the entry alone can't.
+	SuggestedName string
+}
+
+func isValidWindowsName(name string) bool {
+	for _, r := range name {
+		if r < 0x20 || strings.ContainsRune(windowsReservedChars, r) {
+			return false
+		}
+	}
+	if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+		return false
+	}
+	base := name
+	if i := strings.Index(base, "."); i >= 0 {
+		base = base[:i]
+	}
+	return !windowsReservedNames[strings.ToUpper(base)]
+}
+
+// toValidWindowsName replaces the characters of name that Windows
+// doesn't allow with underscores, and changes reserved names to
+// something else.
+func toValidWindowsName(name string) string {
+	runes := []rune(name)
+	for i, r := range runes {
+		if r < 0x20 || strings.ContainsRune(windowsReservedChars, r) {
+			runes[i] = '_'
+		}
+	}
+	for i := len(runes) - 1; i >= 0 && (runes[i] == '.' || runes[i] == ' '); i-- {
+		runes[i] = '_'
+	}
+	name = string(runes)
+	if !isValidWindowsName(name) {
+		// Only a reserved name is left.
+		name = "_" + name
+	}
+	return name
+}
+
+// foldRune returns the smallest rune that r is equivalent to under
+// simple case folding.
+func foldRune(r rune) rune {
+	folded := r
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		if f < folded {
+			folded = f
+		}
+	}
+	return folded
+}
+
+// foldName returns a key for name that's the same for every name that
+// differs from it only in case or in Unicode normalization, so that
+// "Café" and "cafe\u0301" share one.
+func foldName(name string) string {
+	return strings.Map(foldRune, norm.NFC.String(name))
+}
+
+// uniqueName returns name, or if another entry in the directory
+// already has it regardless of case and normalization, a numbered
+// variant of it that doesn't.  taken holds the folded names in use.
+func uniqueName(name string, taken map[string]bool) string {
+	if !taken[foldName(name)] {
+		return name
+	}
+	ext := gopath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, i, ext)
+		if !taken[foldName(candidate)] {
+			return candidate
+		}
+	}
+}
+
+func windowsPathLength(prefix, p string) int {
+	return len(utf16.Encode([]rune(prefix + strings.Replace(p, "/", `\`, -1))))
+}
+
+func scanDirForPlatformConflicts(ctx context.Context, kbfsOps KBFSOps,
+	dir Node, dirPath, windowsPrefix string) (
+	conflicts []PlatformConflict, err error) {
+	children, err := kbfsOps.GetDirChildren(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(children))
+	taken := make(map[string]bool)
+	for name := range children {
+		names = append(names, name)
+		taken[foldName(name)] = true
+	}
+	sort.Strings(names)
+
+	// The first name, in sorted order, of each group that differs
+	// only in case or normalization keeps it.
+	firstByCase := make(map[string]string)
+	for _, name := range names {
+		p := gopath.Join(dirPath, name)
+		var kinds []PlatformConflictKind
+		newName := name
+		if !isValidWindowsName(name) {
+			kinds = append(kinds, InvalidWindowsName)
+			newName = toValidWindowsName(name)
+		}
+		folded := foldName(name)
+		if first, ok := firstByCase[folded]; ok && first != name {
+			kinds = append(kinds, CaseConflict)
+		} else {
+			firstByCase[folded] = name
+		}
+		if len(kinds) > 0 {
+			newName = uniqueName(newName, taken)
+			taken[foldName(newName)] = true
+			for _, kind := range kinds {
+				conflicts = append(conflicts, PlatformConflict{
+					Kind:          kind,
+					Path:          p,
+					SuggestedName: newName,
+				})
+			}
+		}
+
+		if windowsPathLength(windowsPrefix, p) > maxWindowsPathLength {
+			conflicts = append(conflicts, PlatformConflict{
+				Kind: PathTooLong,
+				Path: p,
+			})
+		}
+
+		if children[name].Type == Dir {
+			child, _, err := kbfsOps.Lookup(ctx, dir, name)
+			if err != nil {
+				return nil, err
+			}
+			childConflicts, err := scanDirForPlatformConflicts(
+				ctx, kbfsOps, child, p, windowsPrefix)
+			if err != nil {
+				return nil, err
+			}
+			conflicts = append(conflicts, childConflicts...)
+		}
+	}
+	return conflicts, nil
+}
+
+// ScanPlatformConflicts walks the TLF with the given root node, and
+// returns every entry whose name or path would be a problem on some
+// other platform that KBFS runs on.  An entry with more than one
+// problem is listed once for each.
+func ScanPlatformConflicts(ctx context.Context, kbfsOps KBFSOps,
+	root Node) ([]PlatformConflict, error) {
+	tlfType := "private"
+	if root.GetFolderBranch().Tlf.IsPublic() {
+		tlfType = "public"
+	}
+	windowsPrefix := windowsMountPrefix + tlfType + `\` +
+		root.GetBasename() + `\`
+	return scanDirForPlatformConflicts(ctx, kbfsOps, root, "", windowsPrefix)
+}
+
+// FixPlatformConflicts renames each entry in conflicts to its
+// suggested name, in the TLF with the given root node.  Conflicts
+// without a suggested name are skipped.  Entries are renamed deepest
+// first, so that the paths of the rest stay valid.
+func FixPlatformConflicts(ctx context.Context, kbfsOps KBFSOps,
+	root Node, conflicts []PlatformConflict) error {
+	renames := make(map[string]string)
+	var paths []string
+	for _, c := range conflicts {
+		if c.SuggestedName == "" {
+			continue
+		}
+		if _, ok := renames[c.Path]; !ok {
+			paths = append(paths, c.Path)
+		}
+		renames[c.Path] = c.SuggestedName
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+
+	for _, p := range paths {
+		dirName, name := gopath.Split(p)
+		dir := root
+		for _, elem := range strings.Split(dirName, "/") {
+			if elem == "" {
+				continue
+			}
+			node, _, err := kbfsOps.Lookup(ctx, dir, elem)
+			if err != nil {
+				return err
+			}
+			dir = node
+		}
+		err := kbfsOps.Rename(ctx, dir, name, dir, renames[p])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
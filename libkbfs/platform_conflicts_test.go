@@ -0,0 +1,113 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestToValidWindowsName(t *testing.T) {
+	tests := []struct {
+		name, valid string
+	}{
+		{"ok.txt", "ok.txt"},
+		{"a:b?c", "a_b_c"},
+		{"trailing. ", "trailing__"},
+		{"con", "_con"},
+		{"Lpt1.tar.gz", "_Lpt1.tar.gz"},
+		{"console", "console"},
+		{"tab\there", "tab_here"},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.valid, toValidWindowsName(test.name), test.name)
+		require.True(t, isValidWindowsName(test.valid), test.valid)
+	}
+}
+
+func TestFoldName(t *testing.T) {
+	same := [][]string{
+		{"Café", "café", "cafe\u0301", "CAFE\u0301"},
+		{"Σίσυφος", "σίσυφοσ", "ΣΊΣΥΦΟΣ"},
+		{"Kelvin", "\u212aelvin"},
+	}
+	for _, names := range same {
+		for _, name := range names[1:] {
+			require.Equal(t, foldName(names[0]), foldName(name), name)
+		}
+	}
+	require.NotEqual(t, foldName("cafe"), foldName("café"))
+}
+
+func TestScanPlatformConflictsNormalization(t *testing.T) {
+	var userName libkb.NormalizedUsername = "u1"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, userName.String(), false)
+	kbfsOps := config.KBFSOps()
+	// The precomposed name sorts after the decomposed one.
+	for _, name := range []string{"caf\u00e9", "Cafe\u0301"} {
+		_, _, err := kbfsOps.CreateFile(ctx, rootNode, name, false, NoExcl)
+		require.NoError(t, err)
+	}
+
+	conflicts, err := ScanPlatformConflicts(ctx, kbfsOps, rootNode)
+	require.NoError(t, err)
+	require.Equal(t, []PlatformConflict{
+		{CaseConflict, "caf\u00e9", "caf\u00e9 (1)"},
+	}, conflicts)
+}
+
+func TestScanAndFixPlatformConflicts(t *testing.T) {
+	var userName libkb.NormalizedUsername = "u1"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, userName.String(), false)
+	kbfsOps := config.KBFSOps()
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	for _, name := range []string{"A", "a", "b:c", "con.txt", "ok"} {
+		_, _, err := kbfsOps.CreateFile(ctx, dirNode, name, false, NoExcl)
+		require.NoError(t, err)
+	}
+	// Nest enough long names to go past MAX_PATH.
+	longName := strings.Repeat("x", 100)
+	longNode := rootNode
+	for i := 0; i < 3; i++ {
+		longNode, _, err = kbfsOps.CreateDir(ctx, longNode, longName)
+		require.NoError(t, err)
+	}
+	longPath := strings.Join([]string{longName, longName, longName}, "/")
+
+	conflicts, err := ScanPlatformConflicts(ctx, kbfsOps, rootNode)
+	require.NoError(t, err)
+	require.Equal(t, []PlatformConflict{
+		{CaseConflict, "d/a", "a (1)"},
+		{InvalidWindowsName, "d/b:c", "b_c"},
+		{InvalidWindowsName, "d/con.txt", "_con.txt"},
+		{PathTooLong, longPath, ""},
+	}, conflicts)
+
+	err = FixPlatformConflicts(ctx, kbfsOps, rootNode, conflicts)
+	require.NoError(t, err)
+	children, err := kbfsOps.GetDirChildren(ctx, dirNode)
+	require.NoError(t, err)
+	for _, name := range []string{"A", "a (1)", "b_c", "_con.txt", "ok"} {
+		require.Contains(t, children, name)
+	}
+
+	// Only the problem that renaming can't fix is left.
+	conflicts, err = ScanPlatformConflicts(ctx, kbfsOps, rootNode)
+	require.NoError(t, err)
+	require.Equal(t, []PlatformConflict{{PathTooLong, longPath, ""}},
+		conflicts)
+}
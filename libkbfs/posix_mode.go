@@ -0,0 +1,150 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"os"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"golang.org/x/net/context"
+)
+
+// POSIX permission bits, as stored in EntryInfo.Mode.
+const (
+	posixSetuid   = 04000
+	posixSetgid   = 02000
+	posixSticky   = 01000
+	posixPermMask = 07777
+	posixExecMask = 0111
+	posixReadMask = 0444
+	posixUserExec = 0100
+)
+
+// posixBitsFromFileMode converts the permission bits of mode,
+// including the setuid, setgid and sticky bits, to POSIX bits.
+func posixBitsFromFileMode(mode os.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= posixSetuid
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= posixSetgid
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= posixSticky
+	}
+	return bits
+}
+
+// fileModeFromPosixBits is the inverse of posixBitsFromFileMode.
+func fileModeFromPosixBits(bits uint32) os.FileMode {
+	mode := os.FileMode(bits) & os.ModePerm
+	if bits&posixSetuid != 0 {
+		mode |= os.ModeSetuid
+	}
+	if bits&posixSetgid != 0 {
+		mode |= os.ModeSetgid
+	}
+	if bits&posixSticky != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// setExOnPosixBits returns bits changed to match a file's exec
+// status, which follows the user-exec bit.  Making a file executable
+// makes every readable class executable, as "chmod +x" would under
+// the usual umask; making it non-executable clears every exec bit.
+func setExOnPosixBits(bits uint32, ex bool) uint32 {
+	switch {
+	case ex == (bits&posixUserExec != 0):
+		return bits
+	case !ex:
+		return bits &^ posixExecMask
+	default:
+		return bits | (bits&posixReadMask)>>2 | posixUserExec
+	}
+}
+
+// PosixMode returns the mode that readers should present for this
+// entry, including the type bits.  The rules are:
+//
+//   * If Mode has never been set, files get 0644, executables 0755,
+//     and directories 0700, or 0755 in public TLFs.  Symlinks
+//     always get 0777.
+//   * Otherwise the stored bits are used, except that the user-exec
+//     bit of a file always follows Type, since clients that predate
+//     Mode can still change it with SetEx, which leaves Mode alone.
+//
+// Nothing here is enforced by KBFS itself, which only knows about
+// readers and writers of the whole TLF.
+func (ei EntryInfo) PosixMode(public bool) os.FileMode {
+	var typeBits os.FileMode
+	var bits uint32
+	switch ei.Type {
+	case Sym:
+		return os.ModeSymlink | 0777
+	case Dir:
+		typeBits = os.ModeDir
+		bits = 0700
+		if public {
+			bits = 0755
+		}
+	case Exec:
+		bits = 0755
+	default:
+		bits = 0644
+	}
+	if ei.Mode != nil {
+		bits = *ei.Mode & posixPermMask
+		if ei.Type == File || ei.Type == Exec {
+			bits = setExOnPosixBits(bits, ei.Type == Exec)
+		}
+	}
+	return typeBits | fileModeFromPosixBits(bits)
+}
+
+// PosixOwner returns the uid and gid hints for this entry, and
+// whether either has been set by user.  An unset one is returned as
+// -1.  The hints are just the numeric IDs given to SetOwner on one
+// of OwnerUser's devices, so they mean nothing on another user's
+// devices, which number their users independently; there they're
+// ignored.  Mapping IDs between one user's devices is up to the
+// caller.
+func (ei EntryInfo) PosixOwner(user keybase1.UID) (uid, gid int, ok bool) {
+	uid, gid = -1, -1
+	if ei.OwnerUser == "" || ei.OwnerUser != user {
+		return uid, gid, false
+	}
+	if ei.UID != nil {
+		uid = int(*ei.UID)
+	}
+	if ei.GID != nil {
+		gid = int(*ei.GID)
+	}
+	return uid, gid, ei.UID != nil || ei.GID != nil
+}
+
+// PosixOwnerForCurrentUser returns the owner hints of ei, as
+// PosixOwner does, for the user logged in to config.  Without a
+// logged-in user, no hints apply.
+func PosixOwnerForCurrentUser(ctx context.Context, config Config,
+	ei EntryInfo) (uid, gid int, ok bool) {
+	_, user, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return -1, -1, false
+	}
+	return ei.PosixOwner(user)
+}
+
+// copyModeAttr copies the mode set by SetMode from one entry to
+// another, including the exec bit if they're both files.
+func copyModeAttr(to *DirEntry, from DirEntry) {
+	to.Mode = from.Mode
+	if (to.Type == File || to.Type == Exec) &&
+		(from.Type == File || from.Type == Exec) {
+		to.Type = from.Type
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"os"
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPosixModeDefaults(t *testing.T) {
+	require.Equal(t, os.FileMode(0644), EntryInfo{Type: File}.PosixMode(false))
+	require.Equal(t, os.FileMode(0755), EntryInfo{Type: Exec}.PosixMode(true))
+	require.Equal(t, os.ModeDir|0700, EntryInfo{Type: Dir}.PosixMode(false))
+	require.Equal(t, os.ModeDir|0755, EntryInfo{Type: Dir}.PosixMode(true))
+	require.Equal(t, os.ModeSymlink|0777,
+		EntryInfo{Type: Sym}.PosixMode(false))
+}
+
+func TestPosixModeFollowsType(t *testing.T) {
+	bits := uint32(04640)
+	ei := EntryInfo{Type: File, Mode: &bits}
+	require.Equal(t, os.ModeSetuid|0640, ei.PosixMode(false))
+
+	// An older client made it executable without touching Mode.
+	ei.Type = Exec
+	require.Equal(t, os.ModeSetuid|0750, ei.PosixMode(false))
+
+	// ... or non-executable.
+	bits = 0751
+	ei.Type = File
+	require.Equal(t, os.FileMode(0640), ei.PosixMode(false))
+
+	// Group and other exec bits alone don't make a file executable.
+	bits = 0610
+	require.Equal(t, os.FileMode(0610), ei.PosixMode(false))
+
+	bits = 01777
+	require.Equal(t, os.ModeDir|os.ModeSticky|0777,
+		EntryInfo{Type: Dir, Mode: &bits}.PosixMode(false))
+}
+
+func TestKBFSOpsSetModeAndOwner(t *testing.T) {
+	var userName libkb.NormalizedUsername = "u1"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, userName.String(), false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "b")
+	require.NoError(t, err)
+
+	err = kbfsOps.SetMode(ctx, fileNode, 0600)
+	require.NoError(t, err)
+	err = kbfsOps.SetMode(ctx, dirNode, 0750|os.ModeSetgid)
+	require.NoError(t, err)
+	err = kbfsOps.SetOwner(ctx, fileNode, 1000, -1)
+	require.NoError(t, err)
+	err = kbfsOps.SetOwner(ctx, fileNode, -1, 1001)
+	require.NoError(t, err)
+
+	// The TLF root keeps its defaults.
+	err = kbfsOps.SetMode(ctx, rootNode, 0777)
+	require.NoError(t, err)
+	err = kbfsOps.SetOwner(ctx, rootNode, 1000, 1000)
+	require.NoError(t, err)
+
+	// Everything survives a fresh config.
+	config2 := ConfigAsUser(config, userName)
+	defer CheckConfigAndShutdown(t, config2)
+	kbfsOps2 := config2.KBFSOps()
+	rootNode2 := GetRootNodeOrBust(t, config2, userName.String(), false)
+	fileNode2, ei, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), ei.PosixMode(false))
+	uid, gid, ok := PosixOwnerForCurrentUser(ctx, config2, ei)
+	require.True(t, ok)
+	require.Equal(t, 1000, uid)
+	require.Equal(t, 1001, gid)
+	_, ei, err = kbfsOps2.Lookup(ctx, rootNode2, "b")
+	require.NoError(t, err)
+	require.Equal(t, os.ModeDir|os.ModeSetgid|0750, ei.PosixMode(false))
+	ei, err = kbfsOps2.Stat(ctx, rootNode2)
+	require.NoError(t, err)
+	require.Nil(t, ei.Mode)
+	_, _, ok = PosixOwnerForCurrentUser(ctx, config2, ei)
+	require.False(t, ok)
+
+	// The user-exec bit is the exec bit.
+	err = kbfsOps2.SetMode(ctx, fileNode2, 0700)
+	require.NoError(t, err)
+	ei, err = kbfsOps2.Stat(ctx, fileNode2)
+	require.NoError(t, err)
+	require.Equal(t, Exec, ei.Type)
+	err = kbfsOps2.SetEx(ctx, fileNode2, false)
+	require.NoError(t, err)
+	ei, err = kbfsOps2.Stat(ctx, fileNode2)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), ei.PosixMode(false))
+}
+
+// Tests that CR keeps the merged mode when both branches set it, and
+// otherwise merges mode and owner changes.
+func TestCRMergesModeAndOwner(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	dirNode1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "d")
+	require.NoError(t, err)
+	fileNode1, _, err := kbfsOps1.CreateFile(ctx, dirNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	dirNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "d")
+	require.NoError(t, err)
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, dirNode2, "a")
+	require.NoError(t, err)
+
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+
+	err = kbfsOps1.SetMode(ctx, fileNode1, 0600)
+	require.NoError(t, err)
+	err = kbfsOps1.SetOwner(ctx, dirNode1, 1000, 1000)
+	require.NoError(t, err)
+
+	err = kbfsOps2.SetMode(ctx, fileNode2, 0755)
+	require.NoError(t, err)
+	err = kbfsOps2.SetMode(ctx, dirNode2, 0750)
+	require.NoError(t, err)
+
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2,
+		rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	checks := []struct {
+		kbfsOps KBFSOps
+		dir     Node
+		file    Node
+	}{
+		{kbfsOps1, dirNode1, fileNode1},
+		{kbfsOps2, dirNode2, fileNode2},
+	}
+	for _, check := range checks {
+		ei, err := check.kbfsOps.Stat(ctx, check.file)
+		require.NoError(t, err)
+		require.Equal(t, File, ei.Type)
+		require.Equal(t, os.FileMode(0600), ei.PosixMode(false))
+
+		ei, err = check.kbfsOps.Stat(ctx, check.dir)
+		require.NoError(t, err)
+		require.Equal(t, os.ModeDir|0750, ei.PosixMode(false))
+		uid, gid, _ := PosixOwnerForCurrentUser(ctx, config1, ei)
+		require.Equal(t, 1000, uid)
+		require.Equal(t, 1000, gid)
+		// The hints are u1's, so they mean nothing to u2.
+		_, _, ok := PosixOwnerForCurrentUser(ctx, config2, ei)
+		require.False(t, ok)
+
+		// No conflict copies were needed.
+		children, err := check.kbfsOps.GetDirChildren(ctx, check.dir)
+		require.NoError(t, err)
+		require.Len(t, children, 1)
+	}
+}
+
+// Tests that owner hints only apply to the user who set them, and
+// that setting them replaces another user's.
+func TestKBFSOpsSetOwnerOtherUser(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	fileNode1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps1.SetOwner(ctx, fileNode1, 1000, 1001)
+	require.NoError(t, err)
+
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	fileNode2, ei, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	_, _, ok := PosixOwnerForCurrentUser(ctx, config2, ei)
+	require.False(t, ok)
+
+	// u2 only sets a uid, so u1's gid doesn't carry over.
+	err = kbfsOps2.SetOwner(ctx, fileNode2, 500, -1)
+	require.NoError(t, err)
+	ei, err = kbfsOps2.Stat(ctx, fileNode2)
+	require.NoError(t, err)
+	uid, gid, ok := PosixOwnerForCurrentUser(ctx, config2, ei)
+	require.True(t, ok)
+	require.Equal(t, 500, uid)
+	require.Equal(t, -1, gid)
+
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+	ei, err = kbfsOps1.Stat(ctx, fileNode1)
+	require.NoError(t, err)
+	_, _, ok = PosixOwnerForCurrentUser(ctx, config1, ei)
+	require.False(t, ok)
+}
+
+// Tests that CreateFileWithMode sets the mode in the create's own
+// revision.
+func TestKBFSOpsCreateFileWithMode(t *testing.T) {
+	var userName libkb.NormalizedUsername = "u1"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, userName.String(), false)
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	rev := ops.getCurrMDRevision(makeFBOLockState())
+
+	fileNode, ei, err := kbfsOps.CreateFileWithMode(
+		ctx, rootNode, "a", 0750|os.ModeSetgid, NoExcl)
+	require.NoError(t, err)
+	require.Equal(t, Exec, ei.Type)
+	require.Equal(t, os.ModeSetgid|0750, ei.PosixMode(false))
+	require.Equal(t, rev+1, ops.getCurrMDRevision(makeFBOLockState()))
+
+	_, ei, err = kbfsOps.CreateFileWithMode(ctx, rootNode, "b", 0600, NoExcl)
+	require.NoError(t, err)
+	require.Equal(t, File, ei.Type)
+	require.Equal(t, os.FileMode(0600), ei.PosixMode(false))
+
+	ei, err = kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, os.ModeSetgid|0750, ei.PosixMode(false))
+}
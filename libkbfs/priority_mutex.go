@@ -0,0 +1,177 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"sync"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"golang.org/x/net/context"
+)
+
+// lockPriority says how urgently an execution flow needs a
+// priorityMutex.
+type lockPriority int
+
+const (
+	// lockPriorityForeground is for work done on behalf of a user
+	// request, like a Create or a Write.  It's the default.
+	lockPriorityForeground lockPriority = iota
+	// lockPriorityBackground is for maintenance work nobody is
+	// directly waiting on, like conflict resolution, rekeying,
+	// background syncs, and journal branch conversion.
+	lockPriorityBackground
+	numLockPriorities
+)
+
+func (p lockPriority) String() string {
+	switch p {
+	case lockPriorityForeground:
+		return "Foreground"
+	case lockPriorityBackground:
+		return "Background"
+	default:
+		return fmt.Sprintf("lockPriority(%d)", int(p))
+	}
+}
+
+// priorityMutexMaxForegroundRun is how many times in a row a
+// priorityMutex may be handed to a foreground waiter while a
+// background one is waiting, before the background one gets a turn.
+const priorityMutexMaxForegroundRun = 8
+
+// priorityLocker is a sync.Locker that can also be locked with a
+// given priority.  Lock is the same as locking with
+// lockPriorityForeground.
+type priorityLocker interface {
+	sync.Locker
+	lockWithPriority(p lockPriority)
+}
+
+// priorityMutex is a mutex that queues its waiters fairly, in the
+// order they arrived, but with all foreground waiters ahead of any
+// background ones.  An unlock hands the mutex straight to the next
+// waiter, so a newcomer can never barge ahead of the queue, and a
+// background waiter only ever waits for a bounded number of
+// foreground ones.
+type priorityMutex struct {
+	// queued counts the waiters of each priority, across every
+	// priorityMutex sharing the same registry.
+	queued [numLockPriorities]metrics.Counter
+
+	lock sync.Mutex
+	held bool
+	// waiters holds, for each priority, a channel per waiter,
+	// which is closed once the mutex is handed to it.
+	waiters       [numLockPriorities][]chan struct{}
+	foregroundRun int
+}
+
+var _ priorityLocker = (*priorityMutex)(nil)
+
+// newPriorityMutex returns a new priorityMutex, whose queue lengths
+// are also counted in the given registry (if non-nil) under
+// name.Waiting<Priority>.
+func newPriorityMutex(name string, r metrics.Registry) *priorityMutex {
+	m := &priorityMutex{}
+	for p := lockPriority(0); p < numLockPriorities; p++ {
+		if r == nil {
+			m.queued[p] = metrics.NilCounter{}
+			continue
+		}
+		m.queued[p] = metrics.GetOrRegisterCounter(
+			fmt.Sprintf("%s.Waiting%s", name, p), r)
+	}
+	return m
+}
+
+// Lock implements the sync.Locker interface for priorityMutex.
+func (m *priorityMutex) Lock() {
+	m.lockWithPriority(lockPriorityForeground)
+}
+
+func (m *priorityMutex) lockWithPriority(p lockPriority) {
+	m.lock.Lock()
+	if !m.held {
+		m.held = true
+		m.lock.Unlock()
+		return
+	}
+	ch := make(chan struct{})
+	m.waiters[p] = append(m.waiters[p], ch)
+	m.queued[p].Inc(1)
+	m.lock.Unlock()
+
+	<-ch
+	m.queued[p].Dec(1)
+}
+
+// nextLocked dequeues and returns the next waiter to hand the mutex
+// to, or nil if there's none.
+func (m *priorityMutex) nextLocked() chan struct{} {
+	fg := len(m.waiters[lockPriorityForeground]) > 0
+	bg := len(m.waiters[lockPriorityBackground]) > 0
+	var p lockPriority
+	switch {
+	case fg && (!bg || m.foregroundRun < priorityMutexMaxForegroundRun):
+		p = lockPriorityForeground
+		if bg {
+			m.foregroundRun++
+		}
+	case bg:
+		p = lockPriorityBackground
+		m.foregroundRun = 0
+	default:
+		return nil
+	}
+	ch := m.waiters[p][0]
+	m.waiters[p] = m.waiters[p][1:]
+	return ch
+}
+
+// Unlock implements the sync.Locker interface for priorityMutex.
+func (m *priorityMutex) Unlock() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.held {
+		panic("Unlock of unlocked priorityMutex")
+	}
+	if ch := m.nextLocked(); ch != nil {
+		// The mutex stays held, by the next waiter now.
+		close(ch)
+		return
+	}
+	m.held = false
+}
+
+// queueLengths returns how many waiters of each priority are queued
+// for the mutex.
+func (m *priorityMutex) queueLengths() (foreground, background int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.waiters[lockPriorityForeground]),
+		len(m.waiters[lockPriorityBackground])
+}
+
+type ctxLockPriorityKeyType int
+
+const ctxLockPriorityKey ctxLockPriorityKeyType = 0
+
+// ctxWithLockPriority returns a copy of ctx that makes MD writes done
+// under it queue for mdWriterLock with the given priority.
+func ctxWithLockPriority(
+	ctx context.Context, p lockPriority) context.Context {
+	return context.WithValue(ctx, ctxLockPriorityKey, p)
+}
+
+// lockPriorityFromContext returns the priority set by
+// ctxWithLockPriority, or lockPriorityForeground if there's none.
+func lockPriorityFromContext(ctx context.Context) lockPriority {
+	if p, ok := ctx.Value(ctxLockPriorityKey).(lockPriority); ok {
+		return p
+	}
+	return lockPriorityForeground
+}
@@ -0,0 +1,106 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/require"
+)
+
+// queuePriorityMutexWaiter starts a goroutine that locks m with the
+// given priority, sends id on order once it has the lock, and then
+// unlocks it.  It returns once the goroutine is queued.
+func queuePriorityMutexWaiter(t *testing.T, m *priorityMutex,
+	p lockPriority, id int, order chan<- int) {
+	fg, bg := m.queueLengths()
+	go func() {
+		m.lockWithPriority(p)
+		order <- id
+		m.Unlock()
+	}()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		newFg, newBg := m.queueLengths()
+		if newFg+newBg > fg+bg {
+			return
+		}
+		require.True(t, time.Now().Before(deadline),
+			"Timed out waiting for waiter %d to queue", id)
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func readPriorityMutexOrder(t *testing.T, order <-chan int, n int) []int {
+	var ids []int
+	for i := 0; i < n; i++ {
+		select {
+		case id := <-order:
+			ids = append(ids, id)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timed out after %v", ids)
+		}
+	}
+	return ids
+}
+
+func TestPriorityMutexForegroundFirst(t *testing.T) {
+	r := metrics.NewRegistry()
+	m := newPriorityMutex("Test", r)
+	m.Lock()
+
+	order := make(chan int, 4)
+	queuePriorityMutexWaiter(t, m, lockPriorityBackground, 1, order)
+	queuePriorityMutexWaiter(t, m, lockPriorityForeground, 2, order)
+	queuePriorityMutexWaiter(t, m, lockPriorityBackground, 3, order)
+	queuePriorityMutexWaiter(t, m, lockPriorityForeground, 4, order)
+
+	fg, bg := m.queueLengths()
+	require.Equal(t, 2, fg)
+	require.Equal(t, 2, bg)
+	require.Equal(t, int64(2),
+		r.Get("Test.WaitingForeground").(metrics.Counter).Count())
+	require.Equal(t, int64(2),
+		r.Get("Test.WaitingBackground").(metrics.Counter).Count())
+
+	// Foreground waiters go first, and each priority is FIFO.
+	m.Unlock()
+	require.Equal(t, []int{2, 4, 1, 3}, readPriorityMutexOrder(t, order, 4))
+
+	m.Lock()
+	defer m.Unlock()
+	fg, bg = m.queueLengths()
+	require.Equal(t, 0, fg)
+	require.Equal(t, 0, bg)
+	require.Equal(t, int64(0),
+		r.Get("Test.WaitingForeground").(metrics.Counter).Count())
+}
+
+func TestPriorityMutexBackgroundNotStarved(t *testing.T) {
+	m := newPriorityMutex("Test", nil)
+	m.Lock()
+
+	n := priorityMutexMaxForegroundRun + 2
+	order := make(chan int, n+1)
+	queuePriorityMutexWaiter(t, m, lockPriorityBackground, 0, order)
+	for i := 1; i <= n; i++ {
+		queuePriorityMutexWaiter(t, m, lockPriorityForeground, i, order)
+	}
+
+	// The background waiter gets a turn after a bounded run of
+	// foreground ones.
+	m.Unlock()
+	ids := readPriorityMutexOrder(t, order, n+1)
+	require.Equal(t, 0, ids[priorityMutexMaxForegroundRun])
+}
+
+func TestPriorityMutexUnlockOfUnlocked(t *testing.T) {
+	m := newPriorityMutex("Test", nil)
+	require.Panics(t, func() {
+		m.Unlock()
+	})
+}
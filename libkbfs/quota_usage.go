@@ -0,0 +1,72 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"golang.org/x/net/context"
+)
+
+// quotaUsageRefreshInterval is how long a fetched UserQuotaInfo is
+// served before the block server is asked again.  Things like statfs
+// get called far more often than usage changes noticeably.
+const quotaUsageRefreshInterval = 10 * time.Second
+
+// quotaUsage caches the current user's quota info from the block
+// server.
+type quotaUsage struct {
+	config Config
+	log    logger.Logger
+
+	// lock is held across fetches, so that callers arriving during
+	// one wait for it rather than making their own.
+	lock    sync.Mutex
+	uid     keybase1.UID
+	info    *UserQuotaInfo
+	fetched time.Time
+}
+
+func newQuotaUsage(config Config, log logger.Logger) *quotaUsage {
+	return &quotaUsage{config: config, log: log}
+}
+
+// Get returns the current user's quota info, fetching it if the
+// cached copy is older than quotaUsageRefreshInterval.  If a fetch
+// fails, the cached copy is returned anyway, if there is one for the
+// same user.
+func (q *quotaUsage) Get(ctx context.Context) (*UserQuotaInfo, error) {
+	_, uid, err := q.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.uid != uid {
+		q.uid = uid
+		q.info = nil
+	}
+	now := q.config.Clock().Now()
+	if q.info != nil && now.Sub(q.fetched) < quotaUsageRefreshInterval {
+		return q.info, nil
+	}
+
+	info, err := q.config.BlockServer().GetUserQuotaInfo(ctx)
+	if err != nil {
+		if q.info != nil {
+			q.log.CDebugf(ctx, "Using quota info from %s, since "+
+				"refreshing it failed: %v", q.fetched, err)
+			return q.info, nil
+		}
+		return nil, err
+	}
+	q.info = info
+	q.fetched = now
+	return info, nil
+}
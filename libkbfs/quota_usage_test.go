@@ -0,0 +1,68 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type quotaCountingBServer struct {
+	BlockServer
+	calls int
+	info  *UserQuotaInfo
+	err   error
+}
+
+func (b *quotaCountingBServer) GetUserQuotaInfo(ctx context.Context) (
+	*UserQuotaInfo, error) {
+	b.calls++
+	return b.info, b.err
+}
+
+func TestQuotaUsageCaching(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "u1")
+	defer CheckConfigAndShutdown(t, config)
+	clock := newTestClockNow()
+	config.SetClock(clock)
+	bserv := &quotaCountingBServer{
+		BlockServer: config.BlockServer(),
+		info:        &UserQuotaInfo{Limit: 100, Total: NewUsageStat()},
+	}
+	bserv.info.Total.Bytes[UsageWrite] = 40
+	config.SetBlockServer(bserv)
+	ctx := context.Background()
+
+	info, err := config.KBFSOps().GetUserQuotaInfo(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(100), info.Limit)
+	require.Equal(t, int64(40), info.UsedBytes())
+
+	// Within the refresh interval, the cached info is used.
+	_, err = config.KBFSOps().GetUserQuotaInfo(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, bserv.calls)
+
+	// After it, the block server is asked again, but a failure
+	// still gets the old info.
+	clock.Add(quotaUsageRefreshInterval)
+	bserv.err = errors.New("fake error")
+	info, err = config.KBFSOps().GetUserQuotaInfo(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(40), info.UsedBytes())
+	require.Equal(t, 2, bserv.calls)
+
+	bserv.err = nil
+	bserv.info = &UserQuotaInfo{Limit: 200}
+	clock.Add(time.Second)
+	info, err = config.KBFSOps().GetUserQuotaInfo(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(200), info.Limit)
+	require.Equal(t, int64(0), info.UsedBytes())
+}
@@ -0,0 +1,356 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"golang.org/x/net/context"
+)
+
+// RangeLockType is the type of an advisory byte-range lock.
+type RangeLockType int
+
+const (
+	// RangeLockRead is a shared lock; any number of holders may
+	// have overlapping read locks.
+	RangeLockRead RangeLockType = iota + 1
+	// RangeLockWrite is an exclusive lock.
+	RangeLockWrite
+)
+
+func (t RangeLockType) String() string {
+	switch t {
+	case RangeLockRead:
+		return "read"
+	case RangeLockWrite:
+		return "write"
+	default:
+		return fmt.Sprintf("RangeLockType(%d)", int(t))
+	}
+}
+
+// RangeLockToEOF is the End of a lock that covers everything from
+// its Start to the end of the file, however long the file gets.
+const RangeLockToEOF = math.MaxUint64
+
+const (
+	// rangeLockLease is how long the MD server keeps a lock for
+	// without hearing from its holder.
+	rangeLockLease = 1 * time.Minute
+	// rangeLockRenewPeriod is how often held locks are renewed.
+	rangeLockRenewPeriod = rangeLockLease / 3
+)
+
+// RangeLock describes an advisory lock on the bytes [Start, End) of
+// a file, with POSIX (fcntl F_SETLK) semantics: read locks are
+// shared, write locks are exclusive, and locks are held by an owner
+// rather than by a file handle.  A holder taking a lock on a range
+// where it already holds one replaces the old lock on that range,
+// and unlocking part of a lock leaves the rest of it held.
+type RangeLock struct {
+	Type  RangeLockType
+	Start uint64
+	End   uint64
+	// Owner distinguishes lock holders on the same device, e.g.
+	// FUSE lock owners or Windows process IDs.  Locks on
+	// different devices never have the same holder, even if
+	// their Owners match.
+	Owner uint64
+}
+
+func (l RangeLock) String() string {
+	end := "EOF"
+	if l.End != RangeLockToEOF {
+		end = fmt.Sprintf("%d", l.End)
+	}
+	return fmt.Sprintf("%s[%d,%s) owner=%d", l.Type, l.Start, end, l.Owner)
+}
+
+func (l RangeLock) checkValid() error {
+	if l.Type != RangeLockRead && l.Type != RangeLockWrite {
+		return InvalidRangeLockError{l}
+	}
+	if l.Start >= l.End {
+		return InvalidRangeLockError{l}
+	}
+	return nil
+}
+
+func (l RangeLock) overlaps(other RangeLock) bool {
+	return l.Start < other.End && other.Start < l.End
+}
+
+// conflictsWith returns whether l and other can't both be held by
+// different holders.
+func (l RangeLock) conflictsWith(other RangeLock) bool {
+	return l.overlaps(other) &&
+		(l.Type == RangeLockWrite || other.Type == RangeLockWrite)
+}
+
+// withoutRange returns the parts of l that lie outside r's range.
+func (l RangeLock) withoutRange(r RangeLock) []RangeLock {
+	if !l.overlaps(r) {
+		return []RangeLock{l}
+	}
+	var rest []RangeLock
+	if l.Start < r.Start {
+		before := l
+		before.End = r.Start
+		rest = append(rest, before)
+	}
+	if r.End < l.End {
+		after := l
+		after.Start = r.End
+		rest = append(rest, after)
+	}
+	return rest
+}
+
+// unlockRange returns locks, a set of locks held by one device,
+// after removing unlock's range from those held by unlock.Owner.
+func unlockRange(locks []RangeLock, unlock RangeLock) []RangeLock {
+	var result []RangeLock
+	for _, l := range locks {
+		if l.Owner != unlock.Owner {
+			result = append(result, l)
+			continue
+		}
+		result = append(result, l.withoutRange(unlock)...)
+	}
+	return result
+}
+
+// lockRange returns locks, a set of locks held by one device, after
+// lock has been taken.
+func lockRange(locks []RangeLock, lock RangeLock) []RangeLock {
+	return append(unlockRange(locks, lock), lock)
+}
+
+// folderRangeLocks keeps track of the byte-range locks held by this
+// device in one TLF, and renews their leases on the MD server until
+// they're released.  If the MD server can't coordinate locks, as the
+// remote one can't, it falls back to coordinating them just among the
+// users of this process, i.e. the Dokan and WebDAV frontends.  (FUSE
+// leaves locking to the kernel, which also only coordinates locks on
+// one device.)
+type folderRangeLocks struct {
+	config       Config
+	log          logger.Logger
+	id           TlfID
+	shutdownChan chan struct{}
+
+	// lock protects held, and serializes lock changes so that
+	// renewals never resurrect a lock that's just been released.
+	lock sync.Mutex
+	// held maps a file's path within the TLF to the locks held
+	// on it by this device.
+	held map[string][]RangeLock
+	// fallback is non-nil once the MD server has said it can't
+	// coordinate locks.
+	fallback *mdServerLocalRangeLockManager
+	// renewStart starts renewLoop with the first lock, since most
+	// folders never have any.
+	renewStart sync.Once
+}
+
+func newFolderRangeLocks(
+	config Config, id TlfID, log logger.Logger) *folderRangeLocks {
+	frl := &folderRangeLocks{
+		config:       config,
+		log:          log,
+		id:           id,
+		shutdownChan: make(chan struct{}),
+		held:         make(map[string][]RangeLock),
+	}
+	return frl
+}
+
+// localLockKID stands in for the device KID when locks are only
+// coordinated within this process.
+const localLockKID = keybase1.KID("")
+
+func (frl *folderRangeLocks) lockOnServerLocked(
+	ctx context.Context, file string, lock RangeLock) error {
+	if frl.fallback == nil {
+		err := frl.config.MDServer().LockRange(
+			ctx, frl.id, file, lock, rangeLockLease)
+		if _, ok := err.(RangeLocksUnsupportedError); !ok {
+			return err
+		}
+		frl.log.CDebugf(ctx, "The MD server can't coordinate byte-range "+
+			"locks; only coordinating them locally")
+		m := newMDServerLocalRangeLockManager()
+		frl.fallback = &m
+	}
+	// Local locks never expire, since we know when they're
+	// released.
+	return frl.fallback.lockRange(localLockKID, frl.id, file, lock,
+		frl.config.Clock().Now(), 0)
+}
+
+func (frl *folderRangeLocks) lockRange(
+	ctx context.Context, file string, lock RangeLock) error {
+	if err := lock.checkValid(); err != nil {
+		return err
+	}
+
+	frl.lock.Lock()
+	defer frl.lock.Unlock()
+	err := frl.lockOnServerLocked(ctx, file, lock)
+	if err != nil {
+		return err
+	}
+	frl.held[file] = lockRange(frl.held[file], lock)
+	frl.renewStart.Do(func() { go frl.renewLoop() })
+	return nil
+}
+
+// isHolding returns true if this device holds any locks in the
+// folder.
+func (frl *folderRangeLocks) isHolding() bool {
+	frl.lock.Lock()
+	defer frl.lock.Unlock()
+	return len(frl.held) > 0
+}
+
+func (frl *folderRangeLocks) unlockRange(
+	ctx context.Context, file string, unlock RangeLock) error {
+	frl.lock.Lock()
+	defer frl.lock.Unlock()
+	var err error
+	if frl.fallback != nil {
+		err = frl.fallback.unlockRange(localLockKID, frl.id, file, unlock,
+			frl.config.Clock().Now())
+	} else {
+		err = frl.config.MDServer().UnlockRange(ctx, frl.id, file, unlock)
+	}
+	if err != nil {
+		return err
+	}
+
+	locks := unlockRange(frl.held[file], unlock)
+	if len(locks) == 0 {
+		delete(frl.held, file)
+	} else {
+		frl.held[file] = locks
+	}
+	return nil
+}
+
+func (frl *folderRangeLocks) getConflict(
+	ctx context.Context, file string, lock RangeLock) (*RangeLock, error) {
+	if err := lock.checkValid(); err != nil {
+		return nil, err
+	}
+
+	frl.lock.Lock()
+	defer frl.lock.Unlock()
+	if frl.fallback != nil {
+		return frl.fallback.getConflict(localLockKID, frl.id, file, lock,
+			frl.config.Clock().Now()), nil
+	}
+	conflict, err := frl.config.MDServer().GetRangeLockConflict(
+		ctx, frl.id, file, lock)
+	if _, ok := err.(RangeLocksUnsupportedError); ok {
+		// Nothing can have been locked on the server.
+		return nil, nil
+	}
+	return conflict, err
+}
+
+func (frl *folderRangeLocks) renewAll(ctx context.Context) {
+	frl.lock.Lock()
+	defer frl.lock.Unlock()
+	if frl.fallback != nil {
+		return
+	}
+	for file, locks := range frl.held {
+		var kept []RangeLock
+		for _, l := range locks {
+			err := frl.config.MDServer().LockRange(
+				ctx, frl.id, file, l, rangeLockLease)
+			if _, ok := err.(RangeLockConflictError); ok {
+				// Our lease must have lapsed, and someone
+				// else got in first.
+				frl.log.CWarningf(ctx, "Lost lock %s on %s: %v", l, file, err)
+				continue
+			} else if err != nil {
+				// Keep it, and hope the next renewal works.
+				frl.log.CDebugf(ctx, "Couldn't renew lock %s on %s: %v",
+					l, file, err)
+			}
+			kept = append(kept, l)
+		}
+		if len(kept) == 0 {
+			delete(frl.held, file)
+		} else {
+			frl.held[file] = kept
+		}
+	}
+}
+
+func (frl *folderRangeLocks) renewLoop() {
+	ticker := time.NewTicker(rangeLockRenewPeriod)
+	defer ticker.Stop()
+	// After a suspend, the leases have probably run out on the
+	// server even though the ticker hasn't fired yet.
+	jumpChan, unregister := frl.config.ClockJumpDetector().Register()
+	defer unregister()
+	for {
+		select {
+		case <-ticker.C:
+			ctx := ctxWithRandomIDReplayable(context.Background(),
+				CtxFBOIDKey, CtxFBOOpID, frl.log)
+			frl.renewAll(ctx)
+		case <-jumpChan:
+			ctx := ctxWithRandomIDReplayable(context.Background(),
+				CtxFBOIDKey, CtxFBOOpID, frl.log)
+			frl.renewAll(ctx)
+			ticker.Reset(rangeLockRenewPeriod)
+		case <-frl.shutdownChan:
+			return
+		}
+	}
+}
+
+// shutdown stops renewing, and makes a best effort at releasing
+// everything still held.
+func (frl *folderRangeLocks) shutdown(ctx context.Context) {
+	close(frl.shutdownChan)
+
+	frl.lock.Lock()
+	defer frl.lock.Unlock()
+	if frl.fallback != nil {
+		return
+	}
+	for file, locks := range frl.held {
+		for _, l := range locks {
+			err := frl.config.MDServer().UnlockRange(ctx, frl.id, file, l)
+			if err != nil {
+				frl.log.CDebugf(ctx, "Couldn't release lock %s on %s: %v",
+					l, file, err)
+			}
+		}
+	}
+	frl.held = nil
+}
+
+// rangeLockFileName returns the name under which the MD server knows
+// the file at p: its path within the TLF.  Locks are tied to this
+// path, so renaming a locked file leaves its locks behind.
+func rangeLockFileName(p path) string {
+	names := make([]string, 0, len(p.path)-1)
+	for _, pn := range p.path[1:] {
+		names = append(names, pn.Name)
+	}
+	return strings.Join(names, "/")
+}
@@ -0,0 +1,138 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRangeLockSplitAndReplace(t *testing.T) {
+	locks := lockRange(nil, RangeLock{RangeLockWrite, 0, 100, 1})
+	locks = lockRange(locks, RangeLock{RangeLockRead, 0, 10, 2})
+
+	// Downgrading the middle of owner 1's lock splits it.
+	locks = lockRange(locks, RangeLock{RangeLockRead, 40, 60, 1})
+	require.Equal(t, []RangeLock{
+		{RangeLockWrite, 0, 40, 1},
+		{RangeLockWrite, 60, 100, 1},
+		{RangeLockRead, 0, 10, 2},
+		{RangeLockRead, 40, 60, 1},
+	}, locks)
+
+	// Unlocking only touches the given owner.
+	locks = unlockRange(locks, RangeLock{Start: 0, End: 50, Owner: 1})
+	require.Equal(t, []RangeLock{
+		{RangeLockWrite, 60, 100, 1},
+		{RangeLockRead, 0, 10, 2},
+		{RangeLockRead, 50, 60, 1},
+	}, locks)
+}
+
+func TestMDServerLocalRangeLockManager(t *testing.T) {
+	m := newMDServerLocalRangeLockManager()
+	kid1, kid2 := keybase1.KID("kid1"), keybase1.KID("kid2")
+	id := FakeTlfID(1, false)
+	now := time.Now()
+
+	err := m.lockRange(kid1, id, "a", RangeLock{RangeLockRead, 0, 10, 1},
+		now, time.Minute)
+	require.NoError(t, err)
+
+	// Read locks are shared, across devices and owners.
+	err = m.lockRange(kid2, id, "a", RangeLock{RangeLockRead, 5, 15, 1},
+		now, time.Minute)
+	require.NoError(t, err)
+
+	// The same owner number on a different device is a different
+	// holder.
+	err = m.lockRange(kid2, id, "a", RangeLock{RangeLockWrite, 0, 5, 1},
+		now, time.Minute)
+	require.Equal(t, RangeLockConflictError{
+		"a", RangeLock{RangeLockRead, 0, 10, 1}}, err)
+
+	// Other files and TLFs are independent.
+	err = m.lockRange(kid2, id, "b", RangeLock{RangeLockWrite, 0, 5, 1},
+		now, time.Minute)
+	require.NoError(t, err)
+	err = m.lockRange(kid2, FakeTlfID(2, false), "a",
+		RangeLock{RangeLockWrite, 0, 5, 1}, now, time.Minute)
+	require.NoError(t, err)
+
+	// A device can upgrade its own lock once nobody else shares
+	// the range.
+	err = m.unlockRange(kid2, id, "a", RangeLock{Start: 0, End: 15, Owner: 1},
+		now)
+	require.NoError(t, err)
+	err = m.lockRange(kid1, id, "a", RangeLock{RangeLockWrite, 0, 10, 1},
+		now, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, &RangeLock{RangeLockWrite, 0, 10, 1},
+		m.getConflict(kid2, id, "a", RangeLock{RangeLockRead, 9, 10, 1}, now))
+	require.Nil(t,
+		m.getConflict(kid1, id, "a", RangeLock{RangeLockRead, 9, 10, 1}, now))
+
+	// Once the lease lapses, the lock is gone.
+	later := now.Add(time.Minute)
+	require.Nil(t, m.getConflict(
+		kid2, id, "a", RangeLock{RangeLockWrite, 0, RangeLockToEOF, 1}, later))
+
+	err = m.lockRange(kid1, id, "a", RangeLock{Type: RangeLockRead}, now, 0)
+	require.IsType(t, InvalidRangeLockError{}, err)
+}
+
+// Tests that byte-range locks taken through KBFSOps coordinate
+// between devices.
+func TestKBFSOpsRangeLocksAcrossDevices(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	fileNode1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+
+	lock := RangeLock{RangeLockWrite, 0, RangeLockToEOF, 1}
+	err = kbfsOps1.LockRange(ctx, fileNode1, lock)
+	require.NoError(t, err)
+
+	err = kbfsOps2.LockRange(ctx, fileNode2, lock)
+	require.IsType(t, RangeLockConflictError{}, err)
+	conflict, err := kbfsOps2.GetRangeLockConflict(ctx, fileNode2, lock)
+	require.NoError(t, err)
+	require.Equal(t, &lock, conflict)
+
+	// Releasing part of the lock frees just that part.
+	err = kbfsOps1.UnlockRange(ctx, fileNode1, RangeLock{Start: 0, End: 10,
+		Owner: 1})
+	require.NoError(t, err)
+	err = kbfsOps2.LockRange(ctx, fileNode2,
+		RangeLock{RangeLockRead, 0, 10, 1})
+	require.NoError(t, err)
+	err = kbfsOps2.LockRange(ctx, fileNode2,
+		RangeLock{RangeLockRead, 0, 11, 1})
+	require.IsType(t, RangeLockConflictError{}, err)
+
+	err = kbfsOps1.UnlockRange(ctx, fileNode1, lock)
+	require.NoError(t, err)
+	err = kbfsOps2.LockRange(ctx, fileNode2, lock)
+	require.NoError(t, err)
+}
@@ -0,0 +1,46 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// rateLimiter spaces out requests so they stay under a given rate.
+// The zero value is ready to use.
+type rateLimiter struct {
+	lock sync.Mutex
+	next time.Time
+}
+
+// wait blocks until another request may be sent without exceeding
+// perSecond requests per second, or until ctx is done.  A
+// non-positive perSecond means there's no limit.
+func (l *rateLimiter) wait(ctx context.Context, perSecond int) error {
+	if perSecond <= 0 {
+		return nil
+	}
+	l.lock.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Second / time.Duration(perSecond))
+	l.lock.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
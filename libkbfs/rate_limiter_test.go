@@ -0,0 +1,36 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var l rateLimiter
+	ctx := context.Background()
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := l.wait(ctx, 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("5 requests at 100/s took only %s", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	l.next = time.Now().Add(time.Hour)
+	if err := l.wait(ctx, 1); err != context.Canceled {
+		t.Errorf("Unexpected error waiting with a canceled context: %v", err)
+	}
+	if err := l.wait(ctx, 0); err != nil {
+		t.Errorf("Unlimited wait failed: %v", err)
+	}
+}
@@ -0,0 +1,283 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// ReadSnapshot is a read-only view of a folder as of a single MD
+// revision, returned by KBFSOps.BeginReadSnapshot.  Reads through a
+// snapshot all see the same revision, no matter what updates are
+// applied to the live view in the meantime, so several files can be
+// read consistently with each other.
+//
+// Paths are slash-separated and relative to the root of the folder
+// ("" for the root itself).  Symlinks aren't followed.  Local writes
+// that haven't been synced yet may be visible, just as they are to
+// FileVersionReader.
+//
+// Callers must Close a snapshot when they're done with it, so that
+// quota reclamation can delete the blocks it was keeping alive.
+type ReadSnapshot struct {
+	fbo *folderBranchOps
+	md  ImmutableRootMetadata
+
+	closeLock sync.Mutex
+	closed    bool
+}
+
+// BeginReadSnapshot implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) BeginReadSnapshot(
+	ctx context.Context, folderBranch FolderBranch) (
+	snap *ReadSnapshot, err error) {
+	fbo.log.CDebugf(ctx, "BeginReadSnapshot")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return nil, WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	lState := makeFBOLockState()
+	md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+	if err != nil {
+		return nil, err
+	}
+	return fbo.pinReadSnapshot(ctx, md), nil
+}
+
+func (fbo *folderBranchOps) pinReadSnapshot(ctx context.Context,
+	md ImmutableRootMetadata) *ReadSnapshot {
+	fbo.fbm.pinRevision(md.Revision())
+	fbo.log.CDebugf(ctx, "Pinned revision %d for a read snapshot",
+		md.Revision())
+	return &ReadSnapshot{fbo: fbo, md: md}
+}
+
+// BeginReadSnapshotAtRevision implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) BeginReadSnapshotAtRevision(
+	ctx context.Context, folderBranch FolderBranch, rev MetadataRevision) (
+	snap *ReadSnapshot, err error) {
+	fbo.log.CDebugf(ctx, "BeginReadSnapshotAtRevision %d", rev)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return nil, WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	// Make sure the folder has been identified, like any other read.
+	lState := makeFBOLockState()
+	_, err = fbo.getMDForReadNeedIdentify(ctx, lState)
+	if err != nil {
+		return nil, err
+	}
+
+	if rev < MetadataRevisionInitial {
+		return nil, NoArchivedRevisionError{Revision: rev}
+	}
+	rmds, err := getMDRange(
+		ctx, fbo.config, fbo.id(), NullBranchID, rev, rev, Merged)
+	if err != nil {
+		return nil, err
+	}
+	if len(rmds) != 1 {
+		return nil, NoArchivedRevisionError{Revision: rev}
+	}
+	return fbo.pinReadSnapshot(ctx, rmds[0]), nil
+}
+
+// GetRevisionAtTime implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) GetRevisionAtTime(
+	ctx context.Context, folderBranch FolderBranch, t time.Time) (
+	rev MetadataRevision, err error) {
+	fbo.log.CDebugf(ctx, "GetRevisionAtTime %s", t)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %d %v", rev, err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return MetadataRevisionUninitialized,
+			WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	head, err := fbo.config.MDOps().GetForTLF(ctx, fbo.id())
+	if err != nil {
+		return MetadataRevisionUninitialized, err
+	}
+	if head == (ImmutableRootMetadata{}) {
+		return MetadataRevisionUninitialized, NoArchivedRevisionError{Time: t}
+	}
+	if !head.localTimestamp.After(t) {
+		return head.Revision(), nil
+	}
+
+	// Revisions are applied in order, so their timestamps only go
+	// up; find the last one at or before t.
+	lo, hi := MetadataRevisionInitial, head.Revision()
+	found := MetadataRevisionUninitialized
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		md, err := getSingleMD(
+			ctx, fbo.config, fbo.id(), NullBranchID, mid, Merged)
+		if err != nil {
+			return MetadataRevisionUninitialized, err
+		}
+		if md.localTimestamp.After(t) {
+			hi = mid
+		} else {
+			found = mid
+			lo = mid + 1
+		}
+	}
+	if found == MetadataRevisionUninitialized {
+		return MetadataRevisionUninitialized, NoArchivedRevisionError{Time: t}
+	}
+	return found, nil
+}
+
+// Revision returns the MD revision the snapshot is pinned to.
+func (s *ReadSnapshot) Revision() MetadataRevision {
+	return s.md.Revision()
+}
+
+// Close releases the snapshot.  Reads through it fail afterwards.
+func (s *ReadSnapshot) Close() {
+	s.closeLock.Lock()
+	defer s.closeLock.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.fbo.fbm.unpinRevision(s.md.Revision())
+}
+
+func (s *ReadSnapshot) checkOpen() error {
+	s.closeLock.Lock()
+	defer s.closeLock.Unlock()
+	if s.closed {
+		return ReadSnapshotClosedError{s.md.Revision()}
+	}
+	return nil
+}
+
+// resolve returns the path to, and the entry for, p as of the
+// snapshot's revision.
+func (s *ReadSnapshot) resolve(ctx context.Context, lState *lockState,
+	p string) (path, DirEntry, error) {
+	if err := s.checkOpen(); err != nil {
+		return path{}, DirEntry{}, err
+	}
+	fbo := s.fbo
+	de := s.md.data.Dir
+	fullPath := path{
+		FolderBranch: fbo.folderBranch,
+		path: []pathNode{{
+			BlockPointer: de.BlockPointer,
+			Name:         string(s.md.GetTlfHandle().GetCanonicalName()),
+		}},
+	}
+	for _, name := range strings.Split(p, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		if de.Type != Dir {
+			return path{}, DirEntry{}, NotDirError{fullPath}
+		}
+		if isTrashDir(fullPath, name) {
+			return path{}, DirEntry{}, NoSuchNameError{name}
+		}
+		dblock, err := fbo.blocks.GetDirBlockForReading(ctx, lState,
+			s.md.ReadOnly(), fullPath.tailPointer(), fbo.branch(), fullPath)
+		if err != nil {
+			return path{}, DirEntry{}, err
+		}
+		child, ok := dblock.Children[name]
+		if !ok {
+			return path{}, DirEntry{}, NoSuchNameError{name}
+		}
+		de = child
+		fullPath = fullPath.ChildPath(name, de.BlockPointer)
+	}
+	return fullPath, de, nil
+}
+
+// Stat returns the entry info for p as of the snapshot's revision.
+func (s *ReadSnapshot) Stat(ctx context.Context, p string) (
+	ei EntryInfo, err error) {
+	fbo := s.fbo
+	fbo.log.CDebugf(ctx, "ReadSnapshot.Stat %d %s", s.Revision(), p)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	lState := makeFBOLockState()
+	_, de, err := s.resolve(ctx, lState, p)
+	if err != nil {
+		return EntryInfo{}, err
+	}
+	return de.EntryInfo, nil
+}
+
+// GetDirChildren returns the entries of the directory at p as of the
+// snapshot's revision.
+func (s *ReadSnapshot) GetDirChildren(ctx context.Context, p string) (
+	children map[string]EntryInfo, err error) {
+	fbo := s.fbo
+	fbo.log.CDebugf(ctx, "ReadSnapshot.GetDirChildren %d %s",
+		s.Revision(), p)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	lState := makeFBOLockState()
+	dirPath, de, err := s.resolve(ctx, lState, p)
+	if err != nil {
+		return nil, err
+	}
+	if de.Type != Dir {
+		return nil, NotDirError{dirPath}
+	}
+	dblock, err := fbo.blocks.GetDirBlockForReading(ctx, lState,
+		s.md.ReadOnly(), dirPath.tailPointer(), fbo.branch(), dirPath)
+	if err != nil {
+		return nil, err
+	}
+	children = make(map[string]EntryInfo, len(dblock.Children))
+	for name, child := range dblock.Children {
+		if isTrashDir(dirPath, name) {
+			continue
+		}
+		children[name] = child.EntryInfo
+	}
+	return children, nil
+}
+
+// Read reads from the file at p, as of the snapshot's revision, into
+// dest at the given offset, like KBFSOps.Read.
+func (s *ReadSnapshot) Read(ctx context.Context, p string, dest []byte,
+	off int64) (n int64, err error) {
+	fbo := s.fbo
+	fbo.log.CDebugf(ctx, "ReadSnapshot.Read %d %s %d %d",
+		s.Revision(), p, len(dest), off)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	lState := makeFBOLockState()
+	filePath, de, err := s.resolve(ctx, lState, p)
+	if err != nil {
+		return 0, err
+	}
+	if de.Type != File && de.Type != Exec {
+		return 0, NotFileError{filePath}
+	}
+
+	if off >= int64(de.Size) {
+		return 0, nil
+	}
+	if rem := int64(de.Size) - off; int64(len(dest)) > rem {
+		dest = dest[:rem]
+	}
+	return fbo.blocks.Read(ctx, lState, s.md.ReadOnly(), filePath, dest, off)
+}
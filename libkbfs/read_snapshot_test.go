@@ -0,0 +1,126 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKBFSOpsReadSnapshot(t *testing.T) {
+	var userName libkb.NormalizedUsername = "u1"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, userName.String(), false)
+	kbfsOps := config.KBFSOps()
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	writeFile := func(dir Node, name, data string) Node {
+		node, _, err := kbfsOps.Lookup(ctx, dir, name)
+		if _, ok := err.(NoSuchNameError); ok {
+			node, _, err = kbfsOps.CreateFile(ctx, dir, name, false, NoExcl)
+		}
+		require.NoError(t, err)
+		require.NoError(t, kbfsOps.Truncate(ctx, node, 0))
+		require.NoError(t, kbfsOps.Write(ctx, node, []byte(data), 0))
+		require.NoError(t, kbfsOps.Sync(ctx, node))
+		return node
+	}
+	writeFile(rootNode, "config", "v1")
+	writeFile(dirNode, "data", "data for v1")
+
+	snap, err := kbfsOps.BeginReadSnapshot(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	rev := snap.Revision()
+
+	// Change everything in the live view.
+	writeFile(rootNode, "config", "version 2")
+	writeFile(dirNode, "data", "v2")
+	writeFile(dirNode, "new", "new")
+	require.NoError(t, kbfsOps.RemoveEntry(ctx, rootNode, "config"))
+
+	read := func(p string) string {
+		buf := make([]byte, 100)
+		n, err := snap.Read(ctx, p, buf, 0)
+		require.NoError(t, err)
+		return string(buf[:n])
+	}
+	require.Equal(t, "v1", read("config"))
+	require.Equal(t, "data for v1", read("d/data"))
+	ei, err := snap.Stat(ctx, "d/data")
+	require.NoError(t, err)
+	require.Equal(t, uint64(len("data for v1")), ei.Size)
+	children, err := snap.GetDirChildren(ctx, "d")
+	require.NoError(t, err)
+	require.Len(t, children, 1)
+	_, err = snap.Stat(ctx, "d/new")
+	require.IsType(t, NoSuchNameError{}, err)
+	_, err = snap.Read(ctx, "d", make([]byte, 1), 0)
+	require.IsType(t, NotFileError{}, err)
+
+	fbo := kbfsOps.(*KBFSOpsStandard).getOpsNoAdd(rootNode.GetFolderBranch())
+	require.Equal(t, rev, fbo.fbm.oldestPinnedRevision())
+	snap.Close()
+	require.Equal(t, MetadataRevisionUninitialized,
+		fbo.fbm.oldestPinnedRevision())
+	_, err = snap.Stat(ctx, "config")
+	require.IsType(t, ReadSnapshotClosedError{}, err)
+}
+
+func TestKBFSOpsReadSnapshotAtRevision(t *testing.T) {
+	var userName libkb.NormalizedUsername = "u1"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+	clock := newTestClockNow()
+	config.SetClock(clock)
+
+	rootNode := GetRootNodeOrBust(t, config, userName.String(), false)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	// Write a version of the file a minute apart, noting the time
+	// and revision of each.
+	var times []time.Time
+	var revs []MetadataRevision
+	for _, data := range []string{"one", "two", "three"} {
+		clock.Add(time.Minute)
+		require.NoError(t, kbfsOps.Truncate(ctx, fileNode, 0))
+		require.NoError(t, kbfsOps.Write(ctx, fileNode, []byte(data), 0))
+		require.NoError(t, kbfsOps.Sync(ctx, fileNode))
+		snap, err := kbfsOps.BeginReadSnapshot(ctx, fb)
+		require.NoError(t, err)
+		times = append(times, clock.Now())
+		revs = append(revs, snap.Revision())
+		snap.Close()
+	}
+
+	for i, data := range []string{"one", "two", "three"} {
+		snap, err := kbfsOps.BeginReadSnapshotAtRevision(ctx, fb, revs[i])
+		require.NoError(t, err)
+		buf := make([]byte, 10)
+		n, err := snap.Read(ctx, "a", buf, 0)
+		require.NoError(t, err)
+		require.Equal(t, data, string(buf[:n]))
+		snap.Close()
+
+		rev, err := kbfsOps.GetRevisionAtTime(
+			ctx, fb, times[i].Add(30*time.Second))
+		require.NoError(t, err)
+		require.Equal(t, revs[i], rev)
+	}
+
+	_, err = kbfsOps.BeginReadSnapshotAtRevision(ctx, fb, revs[2]+1)
+	require.IsType(t, NoArchivedRevisionError{}, err)
+	_, err = kbfsOps.GetRevisionAtTime(ctx, fb, times[0].Add(-time.Hour))
+	require.IsType(t, NoArchivedRevisionError{}, err)
+}
@@ -142,6 +142,8 @@ func (rkq *RekeyQueueStandard) processRekeys(ctx context.Context, hasWorkCh chan
 					// Assign an ID to this rekey operation so we can track it.
 					newCtx := ctxWithRandomIDReplayable(ctx, CtxRekeyIDKey,
 						CtxRekeyOpID, nil)
+					newCtx = ctxWithLockPriority(
+						newCtx, lockPriorityBackground)
 					err := rkq.config.KBFSOps().Rekey(newCtx, id)
 					if ch := rkq.dequeue(); ch != nil {
 						ch <- err
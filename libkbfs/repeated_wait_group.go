@@ -45,6 +45,13 @@ func (rwg *RepeatedWaitGroup) Add(delta int) {
 	}
 }
 
+// count returns the number of outstanding tasks.
+func (rwg *RepeatedWaitGroup) count() int {
+	rwg.lock.Lock()
+	defer rwg.lock.Unlock()
+	return rwg.num
+}
+
 // Wait blocks until either the underlying task count goes to 0, or
 // the given context is canceled.
 func (rwg *RepeatedWaitGroup) Wait(ctx context.Context) error {
@@ -26,6 +26,7 @@ const (
 	errorParamUsageBytes        = "usageBytes"
 	errorParamLimitBytes        = "limitBytes"
 	errorParamRenameOldFilename = "oldFilename"
+	errorParamConflictCopy      = "conflictCopy"
 
 	// error operation modes
 	errorModeRead  = "read"
@@ -60,11 +61,31 @@ var noErrorNames = map[string]bool{
 	"node_modules":   true, // Some npm shell configuration
 }
 
-// ReporterKBPKI implements the Notify function of the Reporter
-// interface in addition to embedding ReporterSimple for error
-// tracking.  Notify will make RPCs to the keybase daemon.
+// ReporterKBPKI is a ReporterPipeline with a sink, registered as
+// GUIReportSinkName, that sends notifications, and the errors the
+// GUI knows how to show, to the keybase daemon.
 type ReporterKBPKI struct {
-	*ReporterSimple
+	*ReporterPipeline
+}
+
+// GUIReportSinkName is the name of the sink of a ReporterKBPKI that
+// sends notifications to the keybase daemon.
+const GUIReportSinkName = "gui"
+
+// NewReporterKBPKI creates a new ReporterKBPKI.
+func NewReporterKBPKI(config Config, maxErrors, bufSize int) *ReporterKBPKI {
+	r := &ReporterKBPKI{NewReporterPipeline(config.Clock(), maxErrors)}
+	// The pipeline is new, so the name can't be taken.
+	_ = r.AddSink(GUIReportSinkName, newGUIReportSink(config, bufSize),
+		ReportFilter{})
+	return r
+}
+
+// guiReportSink is a ReportSink that sends notifications to the
+// keybase daemon, which passes them on to the GUI.  Sends are made
+// in the background; when bufSize of them are waiting, more are
+// dropped.
+type guiReportSink struct {
 	config           Config
 	log              logger.Logger
 	notifyBuffer     chan *keybase1.FSNotification
@@ -72,28 +93,25 @@ type ReporterKBPKI struct {
 	canceler         func()
 }
 
-// NewReporterKBPKI creates a new ReporterKBPKI.
-func NewReporterKBPKI(config Config, maxErrors, bufSize int) *ReporterKBPKI {
-	r := &ReporterKBPKI{
-		ReporterSimple:   NewReporterSimple(config.Clock(), maxErrors),
+var _ ReportSink = (*guiReportSink)(nil)
+
+func newGUIReportSink(config Config, bufSize int) *guiReportSink {
+	s := &guiReportSink{
 		config:           config,
 		log:              config.MakeLogger(""),
 		notifyBuffer:     make(chan *keybase1.FSNotification, bufSize),
 		notifySyncBuffer: make(chan *keybase1.FSPathSyncStatus, bufSize),
 	}
 	var ctx context.Context
-	ctx, r.canceler = context.WithCancel(context.Background())
-	go r.send(ctx)
-	return r
+	ctx, s.canceler = context.WithCancel(context.Background())
+	go s.send(ctx)
+	return s
 }
 
-// ReportErr implements the Reporter interface for ReporterKBPKI.
-func (r *ReporterKBPKI) ReportErr(ctx context.Context,
-	tlfName CanonicalTlfName, public bool, mode ErrorModeType, err error) {
-	r.ReporterSimple.ReportErr(ctx, tlfName, public, mode, err)
-
-	// Fire off error popups
-	var n *keybase1.FSNotification
+// errorNotificationFor returns the error popup for the given error,
+// or nil if it's not one the GUI knows how to show.
+func errorNotificationFor(tlfName CanonicalTlfName, public bool,
+	mode ErrorModeType, err error) *keybase1.FSNotification {
 	params := make(map[string]string)
 	var code keybase1.FSErrorType = -1
 	switch e := err.(type) {
@@ -151,69 +169,75 @@ func (r *ReporterKBPKI) ReportErr(ctx context.Context,
 		code = keybase1.FSErrorType_TIMEOUT
 	}
 
-	if code >= 0 {
-		n = errorNotification(err, code, tlfName, public, mode, params)
-		r.Notify(ctx, n)
+	if code < 0 {
+		return nil
 	}
+	return errorNotification(err, code, tlfName, public, mode, params)
 }
 
-// Notify implements the Reporter interface for ReporterKBPKI.
+// Report implements the ReportSink interface for guiReportSink.
 //
 // TODO: might be useful to get the debug tags out of ctx and store
 //       them in the notifyBuffer as well so that send() can put
 //       them back in its context.
-func (r *ReporterKBPKI) Notify(ctx context.Context, notification *keybase1.FSNotification) {
-	select {
-	case r.notifyBuffer <- notification:
-	default:
-		r.log.CDebugf(ctx, "ReporterKBPKI: notify buffer full, dropping %+v",
-			notification)
+func (s *guiReportSink) Report(ctx context.Context, event ReportEvent) {
+	n := event.Notification
+	switch event.Type {
+	case EventError, EventQuotaWarning:
+		// Fire off error popups
+		n = errorNotificationFor(
+			event.TlfName, event.Public, event.Mode, event.Err)
+	case EventSyncStatus:
+		select {
+		case s.notifySyncBuffer <- event.SyncStatus:
+		default:
+			s.log.CDebugf(ctx, "ReporterKBPKI: notify sync buffer full, "+
+				"dropping %+v", event.SyncStatus)
+		}
+		return
+	}
+	if n == nil {
+		// The other events have no notification of their own;
+		// those that matter to the GUI, like rekeys, are also
+		// notified directly.
+		return
 	}
-}
-
-// NotifySyncStatus implements the Reporter interface for ReporterKBPKI.
-//
-// TODO: might be useful to get the debug tags out of ctx and store
-//       them in the notifyBuffer as well so that send() can put
-//       them back in its context.
-func (r *ReporterKBPKI) NotifySyncStatus(ctx context.Context,
-	status *keybase1.FSPathSyncStatus) {
 	select {
-	case r.notifySyncBuffer <- status:
+	case s.notifyBuffer <- n:
 	default:
-		r.log.CDebugf(ctx, "ReporterKBPKI: notify sync buffer full, "+
-			"dropping %+v", status)
+		s.log.CDebugf(ctx, "ReporterKBPKI: notify buffer full, dropping %+v",
+			n)
 	}
 }
 
-// Shutdown implements the Reporter interface for ReporterKBPKI.
-func (r *ReporterKBPKI) Shutdown() {
-	r.canceler()
-	close(r.notifyBuffer)
-	close(r.notifySyncBuffer)
+// Shutdown implements the ReportSink interface for guiReportSink.
+func (s *guiReportSink) Shutdown() {
+	s.canceler()
+	close(s.notifyBuffer)
+	close(s.notifySyncBuffer)
 }
 
 // send takes notifications out of notifyBuffer and notifySyncBuffer
 // and sends them to the keybase daemon.
-func (r *ReporterKBPKI) send(ctx context.Context) {
+func (s *guiReportSink) send(ctx context.Context) {
 	for {
 		select {
-		case notification, ok := <-r.notifyBuffer:
+		case notification, ok := <-s.notifyBuffer:
 			if !ok {
 				return
 			}
-			if err := r.config.KeybaseService().Notify(ctx,
+			if err := s.config.KeybaseService().Notify(ctx,
 				notification); err != nil {
-				r.log.CDebugf(ctx, "ReporterDaemon: error sending "+
+				s.log.CDebugf(ctx, "ReporterDaemon: error sending "+
 					"notification: %s", err)
 			}
-		case status, ok := <-r.notifySyncBuffer:
+		case status, ok := <-s.notifySyncBuffer:
 			if !ok {
 				return
 			}
-			if err := r.config.KeybaseService().NotifySyncStatus(ctx,
+			if err := s.config.KeybaseService().NotifySyncStatus(ctx,
 				status); err != nil {
-				r.log.CDebugf(ctx, "ReporterDaemon: error sending "+
+				s.log.CDebugf(ctx, "ReporterDaemon: error sending "+
 					"sync status: %s", err)
 			}
 		}
@@ -305,6 +329,19 @@ func fileRenameNotification(oldFile path, newFile path, writer keybase1.UID,
 	return n
 }
 
+// conflictCopyNotification creates FSNotifications for conflict
+// copies of files made by conflict resolution.
+func conflictCopyNotification(
+	filename string, public bool) *keybase1.FSNotification {
+	return &keybase1.FSNotification{
+		PublicTopLevelFolder: public,
+		Filename:             filename,
+		StatusCode:           keybase1.FSStatusCode_FINISH,
+		NotificationType:     keybase1.FSNotificationType_FILE_CREATED,
+		Params:               map[string]string{errorParamConflictCopy: "true"},
+	}
+}
+
 // connectionNotification creates FSNotifications based on whether
 // or not KBFS is online.
 func connectionNotification(status keybase1.FSStatusCode) *keybase1.FSNotification {
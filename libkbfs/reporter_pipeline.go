@@ -0,0 +1,396 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"golang.org/x/net/context"
+)
+
+// ReportSeverity is how serious a reported event is.
+type ReportSeverity int
+
+const (
+	// SeverityDebug is for events only worth seeing while
+	// debugging, like sync status updates.
+	SeverityDebug ReportSeverity = iota
+	// SeverityInfo is for events that show KBFS at work, like
+	// completed rekeys.
+	SeverityInfo
+	// SeverityWarning is for events that may need the user's
+	// attention soon, like quota warnings and journal stalls.
+	SeverityWarning
+	// SeverityError is for errors.
+	SeverityError
+)
+
+var reportSeverityNames = []string{"debug", "info", "warning", "error"}
+
+func (s ReportSeverity) String() string {
+	if s < 0 || int(s) >= len(reportSeverityNames) {
+		return fmt.Sprintf("ReportSeverity(%d)", int(s))
+	}
+	return reportSeverityNames[s]
+}
+
+// MarshalText implements the encoding.TextMarshaler interface for
+// ReportSeverity.
+func (s ReportSeverity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// ParseReportSeverity parses the name of a ReportSeverity, as
+// returned by String.
+func ParseReportSeverity(s string) (ReportSeverity, error) {
+	for i, name := range reportSeverityNames {
+		if s == name {
+			return ReportSeverity(i), nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown report severity %q", s)
+}
+
+// ReportEventType is what a reported event is about.
+type ReportEventType int
+
+const (
+	// EventError is an error passed to Reporter.ReportErr.
+	EventError ReportEventType = iota
+	// EventNotification is a notification passed to
+	// Reporter.Notify.
+	EventNotification
+	// EventSyncStatus is a sync status passed to
+	// Reporter.NotifySyncStatus.
+	EventSyncStatus
+	// EventJournalStall is sent when the journal of a TLF stops
+	// flushing because of an error, and again, with
+	// SeverityInfo, once it flushes again.
+	EventJournalStall
+	// EventQuotaWarning is sent when the user is close to, or
+	// over, their quota.
+	EventQuotaWarning
+	// EventCROutcome is sent when conflict resolution of a TLF
+	// finishes, successfully or not.
+	EventCROutcome
+	// EventRekeyComplete is sent when this device finishes
+	// rekeying a TLF.
+	EventRekeyComplete
+)
+
+var reportEventTypeNames = []string{
+	"error", "notification", "sync-status", "journal-stall",
+	"quota-warning", "cr-outcome", "rekey-complete",
+}
+
+func (t ReportEventType) String() string {
+	if t < 0 || int(t) >= len(reportEventTypeNames) {
+		return fmt.Sprintf("ReportEventType(%d)", int(t))
+	}
+	return reportEventTypeNames[t]
+}
+
+// MarshalText implements the encoding.TextMarshaler interface for
+// ReportEventType.
+func (t ReportEventType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// ParseReportEventType parses the name of a ReportEventType, as
+// returned by String.
+func ParseReportEventType(s string) (ReportEventType, error) {
+	for i, name := range reportEventTypeNames {
+		if s == name {
+			return ReportEventType(i), nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown report event type %q", s)
+}
+
+// ReportEvent is one thing reported to a Reporter.  It is suitable
+// for encoding directly as JSON.
+type ReportEvent struct {
+	Time     time.Time
+	Type     ReportEventType
+	Severity ReportSeverity
+	// TlfName and Public name the TLF the event is about, if it's
+	// known; TlfID identifies it otherwise.
+	TlfName CanonicalTlfName `json:",omitempty"`
+	Public  bool
+	TlfID   string `json:",omitempty"`
+	// Message describes the event; for errors it's the error
+	// string.
+	Message string
+	// Err is the error the event is about, if any.
+	Err error `json:"-"`
+	// Mode is whether the error happened while reading or
+	// writing, for EventError and EventQuotaWarning.
+	Mode   ErrorModeType     `json:"-"`
+	Params map[string]string `json:",omitempty"`
+	// Tags are the log tags of the context the event was reported
+	// in.
+	Tags         map[string]string          `json:",omitempty"`
+	Notification *keybase1.FSNotification   `json:",omitempty"`
+	SyncStatus   *keybase1.FSPathSyncStatus `json:",omitempty"`
+}
+
+// ReportSink is where a ReporterPipeline sends events.
+type ReportSink interface {
+	// Report handles one event.  It's called synchronously by
+	// whatever reported the event, so it mustn't block for long.
+	Report(ctx context.Context, event ReportEvent)
+	// Shutdown frees any resources held by the sink.
+	Shutdown()
+}
+
+// ReportFilter selects which events a sink gets.  The zero value
+// selects every event.
+type ReportFilter struct {
+	// MinSeverity is the least severe events to pass.
+	MinSeverity ReportSeverity
+	// Types, if non-empty, are the only event types to pass.
+	Types []ReportEventType
+	// TLFs, if non-empty, are the only TLFs whose events pass,
+	// by canonical name or TLF ID.  Events not about any TLF are
+	// dropped.
+	TLFs []string
+}
+
+func (f ReportFilter) matches(event ReportEvent) bool {
+	if event.Severity < f.MinSeverity {
+		return false
+	}
+	if len(f.Types) > 0 {
+		found := false
+		for _, t := range f.Types {
+			if t == event.Type {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(f.TLFs) == 0 {
+		return true
+	}
+	for _, tlf := range f.TLFs {
+		if (event.TlfName != "" && tlf == string(event.TlfName)) ||
+			(event.TlfID != "" && tlf == event.TlfID) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseReportFilter parses a filter of the form
+// "severity=S,type=T,tlf=N", where each part may be left out, and
+// type and tlf may be repeated.  An empty string selects every
+// event.
+func ParseReportFilter(s string) (ReportFilter, error) {
+	var f ReportFilter
+	if s == "" {
+		return f, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return ReportFilter{}, fmt.Errorf(
+				"Report filter setting %q isn't key=value", part)
+		}
+		switch kv[0] {
+		case "severity":
+			severity, err := ParseReportSeverity(kv[1])
+			if err != nil {
+				return ReportFilter{}, err
+			}
+			f.MinSeverity = severity
+		case "type":
+			t, err := ParseReportEventType(kv[1])
+			if err != nil {
+				return ReportFilter{}, err
+			}
+			f.Types = append(f.Types, t)
+		case "tlf":
+			f.TLFs = append(f.TLFs, kv[1])
+		default:
+			return ReportFilter{}, fmt.Errorf(
+				"Unknown report filter setting %q", kv[0])
+		}
+	}
+	return f, nil
+}
+
+type registeredSink struct {
+	name   string
+	sink   ReportSink
+	filter ReportFilter
+}
+
+// ReporterPipeline is a Reporter that remembers the last errors like
+// ReporterSimple, and sends every event reported to it to the sinks
+// registered with AddSink whose filters it passes.
+type ReporterPipeline struct {
+	*ReporterSimple
+	clock Clock
+
+	lock  sync.RWMutex
+	sinks []registeredSink
+}
+
+var _ Reporter = (*ReporterPipeline)(nil)
+
+// NewReporterPipeline creates a new ReporterPipeline with no sinks,
+// that remembers the last maxErrors errors, or all of them if
+// maxErrors < 1.
+func NewReporterPipeline(clock Clock, maxErrors int) *ReporterPipeline {
+	return &ReporterPipeline{
+		ReporterSimple: NewReporterSimple(clock, maxErrors),
+		clock:          clock,
+	}
+}
+
+// AddSink registers sink under the given name, to get the events that
+// pass filter.
+func (r *ReporterPipeline) AddSink(
+	name string, sink ReportSink, filter ReportFilter) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, s := range r.sinks {
+		if s.name == name {
+			return fmt.Errorf("Report sink %q already registered", name)
+		}
+	}
+	r.sinks = append(r.sinks, registeredSink{name, sink, filter})
+	return nil
+}
+
+// RemoveSink unregisters the sink with the given name and shuts it
+// down.  It returns false if there's no such sink.
+func (r *ReporterPipeline) RemoveSink(name string) bool {
+	r.lock.Lock()
+	var removed ReportSink
+	for i, s := range r.sinks {
+		if s.name == name {
+			removed = s.sink
+			r.sinks = append(r.sinks[:i:i], r.sinks[i+1:]...)
+			break
+		}
+	}
+	r.lock.Unlock()
+	if removed == nil {
+		return false
+	}
+	removed.Shutdown()
+	return true
+}
+
+// SinkNames returns the names of the registered sinks, in the order
+// they were added.
+func (r *ReporterPipeline) SinkNames() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	names := make([]string, 0, len(r.sinks))
+	for _, s := range r.sinks {
+		names = append(names, s.name)
+	}
+	return names
+}
+
+func (r *ReporterPipeline) dispatch(ctx context.Context, event ReportEvent) {
+	if event.Time.IsZero() {
+		event.Time = r.clock.Now()
+	}
+	if event.Message == "" && event.Err != nil {
+		event.Message = event.Err.Error()
+	}
+	if event.Tags == nil {
+		event.Tags = LogTagsFromContextToMap(ctx)
+	}
+	r.lock.RLock()
+	sinks := r.sinks
+	r.lock.RUnlock()
+	for _, s := range sinks {
+		if s.filter.matches(event) {
+			s.sink.Report(ctx, event)
+		}
+	}
+}
+
+// ReportErr implements the Reporter interface for ReporterPipeline.
+// Quota warnings are sent on as EventQuotaWarning events.
+func (r *ReporterPipeline) ReportErr(ctx context.Context,
+	tlfName CanonicalTlfName, public bool, mode ErrorModeType, err error) {
+	r.ReporterSimple.ReportErr(ctx, tlfName, public, mode, err)
+	event := ReportEvent{
+		Type:     EventError,
+		Severity: SeverityError,
+		TlfName:  tlfName,
+		Public:   public,
+		Err:      err,
+		Mode:     mode,
+	}
+	if _, ok := err.(OverQuotaWarning); ok {
+		event.Type = EventQuotaWarning
+		event.Severity = SeverityWarning
+	}
+	r.dispatch(ctx, event)
+}
+
+// Notify implements the Reporter interface for ReporterPipeline.
+func (r *ReporterPipeline) Notify(ctx context.Context,
+	notification *keybase1.FSNotification) {
+	severity := SeverityInfo
+	if notification.StatusCode == keybase1.FSStatusCode_ERROR {
+		severity = SeverityError
+	}
+	message := notification.Status
+	if message == "" {
+		message = notification.Filename
+	}
+	r.dispatch(ctx, ReportEvent{
+		Type:         EventNotification,
+		Severity:     severity,
+		Public:       notification.PublicTopLevelFolder,
+		Message:      message,
+		Params:       notification.Params,
+		Notification: notification,
+	})
+}
+
+// NotifySyncStatus implements the Reporter interface for
+// ReporterPipeline.
+func (r *ReporterPipeline) NotifySyncStatus(ctx context.Context,
+	status *keybase1.FSPathSyncStatus) {
+	r.dispatch(ctx, ReportEvent{
+		Type:       EventSyncStatus,
+		Severity:   SeverityDebug,
+		Public:     status.PublicTopLevelFolder,
+		Message:    status.Path,
+		SyncStatus: status,
+	})
+}
+
+// ReportEvent implements the Reporter interface for ReporterPipeline.
+func (r *ReporterPipeline) ReportEvent(ctx context.Context, event ReportEvent) {
+	r.dispatch(ctx, event)
+}
+
+// Shutdown implements the Reporter interface for ReporterPipeline.
+func (r *ReporterPipeline) Shutdown() {
+	r.lock.Lock()
+	sinks := r.sinks
+	r.sinks = nil
+	r.lock.Unlock()
+	for _, s := range sinks {
+		s.sink.Shutdown()
+	}
+	r.ReporterSimple.Shutdown()
+}
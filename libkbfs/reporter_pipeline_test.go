@@ -0,0 +1,192 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// testReportSink remembers every event reported to it.
+type testReportSink struct {
+	lock     sync.Mutex
+	events   []ReportEvent
+	shutdown bool
+}
+
+func (s *testReportSink) Report(_ context.Context, event ReportEvent) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.events = append(s.events, event)
+}
+
+func (s *testReportSink) Shutdown() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.shutdown = true
+}
+
+func (s *testReportSink) types() []ReportEventType {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var types []ReportEventType
+	for _, event := range s.events {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+func TestParseReportFilter(t *testing.T) {
+	f, err := ParseReportFilter("")
+	require.NoError(t, err)
+	require.Equal(t, ReportFilter{}, f)
+
+	f, err = ParseReportFilter(
+		"severity=warning,type=journal-stall,type=cr-outcome,tlf=jdoe")
+	require.NoError(t, err)
+	require.Equal(t, ReportFilter{
+		MinSeverity: SeverityWarning,
+		Types:       []ReportEventType{EventJournalStall, EventCROutcome},
+		TLFs:        []string{"jdoe"},
+	}, f)
+
+	for _, s := range []string{
+		"severity", "severity=loud", "type=nope", "color=red",
+	} {
+		_, err = ParseReportFilter(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestReportFilterMatches(t *testing.T) {
+	event := ReportEvent{
+		Type:     EventJournalStall,
+		Severity: SeverityWarning,
+		TlfName:  "jdoe",
+		TlfID:    FakeTlfID(1, false).String(),
+	}
+	require.True(t, ReportFilter{}.matches(event))
+	require.True(t, ReportFilter{MinSeverity: SeverityWarning}.matches(event))
+	require.False(t, ReportFilter{MinSeverity: SeverityError}.matches(event))
+	require.True(t, ReportFilter{
+		Types: []ReportEventType{EventCROutcome, EventJournalStall},
+	}.matches(event))
+	require.False(t, ReportFilter{
+		Types: []ReportEventType{EventCROutcome},
+	}.matches(event))
+	require.True(t, ReportFilter{TLFs: []string{"jdoe"}}.matches(event))
+	require.True(t, ReportFilter{TLFs: []string{event.TlfID}}.matches(event))
+	require.False(t, ReportFilter{TLFs: []string{"alice"}}.matches(event))
+	require.False(t, ReportFilter{TLFs: []string{"jdoe"}}.matches(
+		ReportEvent{Type: EventNotification}))
+}
+
+func TestReporterPipelineSinks(t *testing.T) {
+	clock := newTestClockNow()
+	r := NewReporterPipeline(clock, 10)
+	all := &testReportSink{}
+	warnings := &testReportSink{}
+	require.NoError(t, r.AddSink("all", all, ReportFilter{}))
+	require.NoError(t, r.AddSink("warnings", warnings,
+		ReportFilter{MinSeverity: SeverityWarning}))
+	require.Error(t, r.AddSink("all", all, ReportFilter{}))
+	require.Equal(t, []string{"all", "warnings"}, r.SinkNames())
+
+	ctx := context.Background()
+	r.ReportErr(ctx, "jdoe", false, WriteMode, errors.New("oops"))
+	r.ReportErr(ctx, "jdoe", false, WriteMode,
+		OverQuotaWarning{UsageBytes: 90, LimitBytes: 100})
+	r.Notify(ctx, &keybase1.FSNotification{Filename: "/keybase/private/jdoe"})
+	r.NotifySyncStatus(ctx, &keybase1.FSPathSyncStatus{Path: "/a"})
+	r.ReportEvent(ctx, ReportEvent{
+		Type:     EventRekeyComplete,
+		Severity: SeverityInfo,
+		TlfName:  "jdoe",
+	})
+
+	require.Equal(t, []ReportEventType{
+		EventError, EventQuotaWarning, EventNotification, EventSyncStatus,
+		EventRekeyComplete,
+	}, all.types())
+	require.Equal(t, []ReportEventType{EventError, EventQuotaWarning},
+		warnings.types())
+	require.Equal(t, SeverityWarning, warnings.events[1].Severity)
+	require.Equal(t, "oops", all.events[0].Message)
+	require.Equal(t, clock.Now(), all.events[0].Time)
+
+	// Errors are still remembered for the status file.
+	require.Len(t, r.AllKnownErrors(), 2)
+
+	require.True(t, r.RemoveSink("warnings"))
+	require.False(t, r.RemoveSink("warnings"))
+	require.True(t, warnings.shutdown)
+	require.Equal(t, []string{"all"}, r.SinkNames())
+
+	r.Shutdown()
+	require.True(t, all.shutdown)
+}
+
+func TestMetricsReportSink(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "jdoe")
+	defer CheckConfigAndShutdown(t, config)
+	registry := config.MetricsRegistry()
+	if registry == nil {
+		t.Skip("Metrics are disabled")
+	}
+	s := NewMetricsReportSink(registry)
+	event := ReportEvent{Type: EventCROutcome, Severity: SeverityError}
+	s.Report(context.Background(), event)
+	s.Report(context.Background(), event)
+	counter, ok := registry.Get("Reporter.cr-outcome.error").(interface {
+		Count() int64
+	})
+	require.True(t, ok)
+	require.Equal(t, int64(2), counter.Count())
+}
+
+func TestWebhookReportSink(t *testing.T) {
+	events := make(chan map[string]interface{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			var event map[string]interface{}
+			err := json.NewDecoder(req.Body).Decode(&event)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			events <- event
+		}))
+	defer server.Close()
+
+	s := NewWebhookReportSink(server.URL, 10, logger.NewTestLogger(t))
+	defer s.Shutdown()
+	s.Report(context.Background(), ReportEvent{
+		Time:     time.Now(),
+		Type:     EventJournalStall,
+		Severity: SeverityWarning,
+		TlfName:  "jdoe",
+		Message:  "stuck",
+	})
+
+	select {
+	case event := <-events:
+		require.Equal(t, "journal-stall", event["Type"])
+		require.Equal(t, "warning", event["Severity"])
+		require.Equal(t, "jdoe", event["TlfName"])
+		require.Equal(t, "stuck", event["Message"])
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for the webhook")
+	}
+}
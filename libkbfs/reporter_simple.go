@@ -52,6 +52,7 @@ func (r *ReporterSimple) ReportErr(ctx context.Context,
 		Time:  r.clock.Now(),
 		Error: err,
 		Stack: stack[:n],
+		Tags:  LogTagsFromContextToMap(ctx),
 	}
 	r.currErrorIndex++
 	if r.maxErrors < 1 {
@@ -97,6 +98,11 @@ func (r *ReporterSimple) NotifySyncStatus(_ context.Context,
 	// ignore notifications
 }
 
+// ReportEvent implements the Reporter interface for ReporterSimple.
+func (r *ReporterSimple) ReportEvent(_ context.Context, _ ReportEvent) {
+	// ignore events
+}
+
 // Shutdown implements the Reporter interface for ReporterSimple.
 func (r *ReporterSimple) Shutdown() {
 
@@ -0,0 +1,169 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	metrics "github.com/rcrowley/go-metrics"
+	"golang.org/x/net/context"
+)
+
+const (
+	// LogReportSinkName, MetricsReportSinkName and
+	// WebhookReportSinkName are the names the sinks set up by
+	// Init are registered under.
+	LogReportSinkName     = "log"
+	MetricsReportSinkName = "metrics"
+	WebhookReportSinkName = "webhook"
+
+	// webhookTimeout is how long a webhook may take to accept an
+	// event.
+	webhookTimeout = 10 * time.Second
+)
+
+// logReportSink is a ReportSink that logs every event, at the log
+// level matching its severity.
+type logReportSink struct {
+	log logger.Logger
+}
+
+var _ ReportSink = logReportSink{}
+
+// NewLogReportSink returns a ReportSink that logs every event to
+// log.
+func NewLogReportSink(log logger.Logger) ReportSink {
+	return logReportSink{log}
+}
+
+// Report implements the ReportSink interface for logReportSink.
+func (s logReportSink) Report(ctx context.Context, event ReportEvent) {
+	tlf := string(event.TlfName)
+	if tlf == "" {
+		tlf = event.TlfID
+	}
+	format := "Reported %s event for TLF %q: %s"
+	switch event.Severity {
+	case SeverityDebug:
+		s.log.CDebugf(ctx, format, event.Type, tlf, event.Message)
+	case SeverityInfo:
+		s.log.CInfof(ctx, format, event.Type, tlf, event.Message)
+	case SeverityWarning:
+		s.log.CWarningf(ctx, format, event.Type, tlf, event.Message)
+	default:
+		s.log.CErrorf(ctx, format, event.Type, tlf, event.Message)
+	}
+}
+
+// Shutdown implements the ReportSink interface for logReportSink.
+func (s logReportSink) Shutdown() {}
+
+// metricsReportSink is a ReportSink that counts the events of each
+// type and severity.
+type metricsReportSink struct {
+	registry metrics.Registry
+}
+
+var _ ReportSink = metricsReportSink{}
+
+// NewMetricsReportSink returns a ReportSink that counts events in
+// registry, as "Reporter.<type>.<severity>".
+func NewMetricsReportSink(registry metrics.Registry) ReportSink {
+	return metricsReportSink{registry}
+}
+
+// Report implements the ReportSink interface for metricsReportSink.
+func (s metricsReportSink) Report(_ context.Context, event ReportEvent) {
+	name := fmt.Sprintf("Reporter.%s.%s", event.Type, event.Severity)
+	metrics.GetOrRegisterCounter(name, s.registry).Inc(1)
+}
+
+// Shutdown implements the ReportSink interface for metricsReportSink.
+func (s metricsReportSink) Shutdown() {}
+
+// webhookReportSink is a ReportSink that POSTs each event, encoded
+// as JSON, to a URL.  Posts are made in the background, one at a
+// time; when bufSize of them are waiting, more are dropped.
+type webhookReportSink struct {
+	url      string
+	client   *http.Client
+	log      logger.Logger
+	events   chan ReportEvent
+	canceler func()
+	doneCh   chan struct{}
+}
+
+var _ ReportSink = (*webhookReportSink)(nil)
+
+// NewWebhookReportSink returns a ReportSink that POSTs every event,
+// encoded as JSON, to url.
+func NewWebhookReportSink(
+	url string, bufSize int, log logger.Logger) ReportSink {
+	s := &webhookReportSink{
+		url:    url,
+		client: &http.Client{Timeout: webhookTimeout},
+		log:    log,
+		events: make(chan ReportEvent, bufSize),
+		doneCh: make(chan struct{}),
+	}
+	var ctx context.Context
+	ctx, s.canceler = context.WithCancel(context.Background())
+	go s.send(ctx)
+	return s
+}
+
+// Report implements the ReportSink interface for webhookReportSink.
+func (s *webhookReportSink) Report(ctx context.Context, event ReportEvent) {
+	select {
+	case s.events <- event:
+	default:
+		s.log.CDebugf(ctx, "Webhook buffer full, dropping %s event",
+			event.Type)
+	}
+}
+
+func (s *webhookReportSink) post(ctx context.Context, event ReportEvent) error {
+	buf, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *webhookReportSink) send(ctx context.Context) {
+	defer close(s.doneCh)
+	for event := range s.events {
+		if err := s.post(ctx, event); err != nil {
+			s.log.CDebugf(ctx, "Couldn't post %s event to webhook: %v",
+				event.Type, err)
+		}
+	}
+}
+
+// Shutdown implements the ReportSink interface for webhookReportSink.
+// Events still waiting are dropped.
+func (s *webhookReportSink) Shutdown() {
+	s.canceler()
+	close(s.events)
+	<-s.doneCh
+}
@@ -66,6 +66,12 @@ type PrivateMetadata struct {
 	TLFPrivateKey TLFPrivateKey
 	// The block changes done as part of the update that created this MD
 	Changes BlockChanges
+	// Subdirectory keys derived from the TLF keys; see
+	// TLFSubdirKeyInfo.
+	SubdirKeys []TLFSubdirKeyInfo `codec:"sk,omitempty"`
+	// The trash mode state of the TLF, if it was ever turned on;
+	// see TrashInfo.
+	Trash *TrashInfo `codec:"tr,omitempty"`
 
 	codec.UnknownFieldSetHandler
 
@@ -116,6 +122,19 @@ type RootMetadata struct {
 	// ExtraMetadata currently contains key bundles for post-v2
 	// metadata.
 	extra ExtraMetadata
+
+	// coalesceUntil, if non-zero, tells the write journal that
+	// this MD may be replaced, until then, by one with the same
+	// revision that includes its ops plus some newer ones.
+	// replacesHead marks such a replacement.  Both are only ever
+	// set locally, and are never copied or encoded.
+	coalesceUntil time.Time
+	replacesHead  bool
+	// shardOnly marks an MD whose only change is creating entries in
+	// this device's writer shards (see ShardsDirName).  If its put
+	// loses a race, the op can be redone on the new head instead of
+	// going through conflict resolution.  Only ever set locally.
+	shardOnly bool
 }
 
 var _ KeyMetadata = (*RootMetadata)(nil)
@@ -791,7 +810,9 @@ func (rmds *RootMetadataSigned) IsValidAndSigned(
 		return errors.New("Missing RootMetadata signature")
 	}
 
-	err := rmds.MD.IsValidAndSigned(codec, crypto, extra)
+	// Check the writer signature along with the root one below.
+	sigs := newSigBatch(crypto)
+	err := rmds.MD.IsValidAndSigned(codec, sigs, extra)
 	if err != nil {
 		return err
 	}
@@ -821,9 +842,14 @@ func (rmds *RootMetadataSigned) IsValidAndSigned(
 		return err
 	}
 
-	err = crypto.Verify(buf, rmds.SigInfo)
+	err = sigs.Verify(buf, rmds.SigInfo)
+	if err != nil {
+		return err
+	}
+	err = sigs.verify()
 	if err != nil {
-		return fmt.Errorf("Could not verify root metadata: %v", err)
+		return fmt.Errorf("Could not verify root and writer metadata: %v",
+			err)
 	}
 
 	return nil
@@ -856,13 +882,14 @@ func DecodeRootMetadataSigned(codec Codec, tlf TlfID, ver, max MetadataVer, buf
 		return nil, NewMetadataVersionError{tlf, ver}
 	}
 	if ver > SegregatedKeyBundlesVer {
-		// Shouldn't be possible at the moment.
-		panic("Invalid metadata version")
+		// Shouldn't be possible at the moment, unless max is
+		// wrong.
+		return nil, NewMetadataVersionError{tlf, ver}
 	}
 	if ver < SegregatedKeyBundlesVer {
 		var brmds BareRootMetadataSignedV2
 		if err := codec.Decode(buf, &brmds); err != nil {
-			return nil, err
+			return nil, MDDecodeError{tlf, ver, err}
 		}
 		return &RootMetadataSigned{
 			MD:      &brmds.MD,
@@ -871,7 +898,7 @@ func DecodeRootMetadataSigned(codec Codec, tlf TlfID, ver, max MetadataVer, buf
 	}
 	var brmds BareRootMetadataSignedV3
 	if err := codec.Decode(buf, &brmds); err != nil {
-		return nil, err
+		return nil, MDDecodeError{tlf, ver, err}
 	}
 	return &RootMetadataSigned{
 		MD:      &brmds.MD,
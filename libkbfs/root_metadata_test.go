@@ -69,6 +69,8 @@ func makeFakePrivateMetadataFuture(t *testing.T) privateMetadataFuture {
 				},
 				0,
 			},
+			nil,
+			nil,
 			codec.UnknownFieldSetHandler{},
 			BlockChanges{},
 		},
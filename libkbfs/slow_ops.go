@@ -0,0 +1,363 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	rpc "github.com/keybase/go-framed-msgpack-rpc"
+	"golang.org/x/net/context"
+)
+
+const (
+	// slowOpReportsToKeep is how many SlowOpReports a
+	// slowOpWatchdog remembers.
+	slowOpReportsToKeep = 20
+	// The most the stacks of all goroutines may take up when
+	// dumping those of slow ops.
+	maxGoroutineStacksSize = 64 << 20
+)
+
+// currentGoroutineID returns the ID of the calling goroutine, as it
+// appears in stack dumps.
+func currentGoroutineID() uint64 {
+	var buf [64]byte
+	n := runtime.Stack(buf[:], false)
+	// The dump starts with "goroutine <ID> [running]:".
+	fields := bytes.Fields(buf[:n])
+	if len(fields) < 2 {
+		return 0
+	}
+	id, err := strconv.ParseUint(string(fields[1]), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return id
+}
+
+// goroutineStacks returns the stacks of the goroutines with the given
+// IDs that are still around.
+func goroutineStacks(ids map[uint64]bool) map[uint64]string {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) || len(buf) >= maxGoroutineStacksSize {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	stacks := make(map[uint64]string)
+	for _, stack := range bytes.Split(buf, []byte("\n\n")) {
+		fields := bytes.Fields(stack)
+		if len(fields) < 2 {
+			continue
+		}
+		id, err := strconv.ParseUint(string(fields[1]), 10, 64)
+		if err != nil || !ids[id] {
+			continue
+		}
+		stacks[id] = string(stack)
+	}
+	return stacks
+}
+
+// PendingRPC is an RPC to a server or to the Keybase service that
+// hasn't returned yet.
+type PendingRPC struct {
+	// Server is what the RPC was made to, e.g. "bserver".
+	Server string
+	Method string
+	Start  time.Time
+	// Tags are the log tags of the RPC's context, which are sent
+	// along with it, like the OPID of the KBFSOps call that made
+	// it.
+	Tags map[string]string `json:",omitempty"`
+}
+
+type pendingRPCTracker struct {
+	lock   sync.Mutex
+	lastID uint64
+	calls  map[uint64]PendingRPC
+}
+
+// pendingRPCs tracks every RPC made through a pendingRPCClient.
+var pendingRPCs = &pendingRPCTracker{calls: make(map[uint64]PendingRPC)}
+
+func (t *pendingRPCTracker) start(ctx context.Context, server, method string) (
+	done func()) {
+	call := PendingRPC{
+		Server: server,
+		Method: method,
+		Start:  time.Now(),
+		Tags:   LogTagsFromContextToMap(ctx),
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.lastID++
+	id := t.lastID
+	t.calls[id] = call
+	return func() {
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		delete(t.calls, id)
+	}
+}
+
+func (t *pendingRPCTracker) status() []PendingRPC {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	calls := make([]PendingRPC, 0, len(t.calls))
+	for _, call := range t.calls {
+		calls = append(calls, call)
+	}
+	return calls
+}
+
+// pendingRPCClient is an rpc.GenericClient that keeps track of the
+// calls it has in flight, for slow-op diagnostics.
+type pendingRPCClient struct {
+	server string
+	client rpc.GenericClient
+}
+
+var _ rpc.GenericClient = pendingRPCClient{}
+
+func newPendingRPCClient(server string, client rpc.GenericClient) rpc.GenericClient {
+	return pendingRPCClient{server, client}
+}
+
+// Call implements the rpc.GenericClient interface for pendingRPCClient.
+func (c pendingRPCClient) Call(ctx context.Context, method string,
+	arg interface{}, res interface{}) error {
+	done := pendingRPCs.start(ctx, c.server, method)
+	defer done()
+	return c.client.Call(ctx, method, arg, res)
+}
+
+// Notify implements the rpc.GenericClient interface for pendingRPCClient.
+func (c pendingRPCClient) Notify(ctx context.Context, method string,
+	arg interface{}) error {
+	done := pendingRPCs.start(ctx, c.server, method)
+	defer done()
+	return c.client.Notify(ctx, method, arg)
+}
+
+// SlowOpReport is the diagnostic dumped for a KBFSOps call that's
+// taken longer than Config.SlowOpThreshold().
+type SlowOpReport struct {
+	// Time is when the op was noticed to be slow.
+	Time time.Time
+	// Op is the name of the call, e.g. "KBFSOps.Write".
+	Op      string
+	Elapsed time.Duration
+	// Tags are the log tags of the op's context, including its
+	// OPID, which can be used to find its log lines and RPCs.
+	Tags map[string]string `json:",omitempty"`
+	// Goroutine is the ID of the goroutine that made the call.
+	Goroutine uint64
+	// Stacks holds the stacks of the op's goroutine and of every
+	// goroutine holding or waiting for an FBO lock, by goroutine
+	// ID.
+	Stacks map[uint64]string `json:",omitempty"`
+	// Locks lists every execution flow holding or waiting for an
+	// FBO lock.  It says nothing about which folder the locks
+	// belong to; the stacks do.
+	Locks          []LockStatus         `json:",omitempty"`
+	PendingRPCs    []PendingRPC         `json:",omitempty"`
+	Journal        *JournalServerStatus `json:",omitempty"`
+	BlockTransfers BlockTransferStatus
+}
+
+type watchedOp struct {
+	ctx       context.Context
+	name      string
+	goroutine uint64
+	start     time.Time
+	reported  bool
+}
+
+// slowOpWatchdog keeps track of the KBFSOps calls in progress, and
+// dumps a SlowOpReport for each one that takes longer than
+// Config.SlowOpThreshold(), to the log and to a small in-memory
+// buffer.
+type slowOpWatchdog struct {
+	config     Config
+	log        logger.Logger
+	shutdownCh chan struct{}
+
+	lock      sync.Mutex
+	lastOpID  uint64
+	ops       map[uint64]*watchedOp
+	reports   []SlowOpReport
+	trackLock bool
+}
+
+func newSlowOpWatchdog(config Config, log logger.Logger) *slowOpWatchdog {
+	return &slowOpWatchdog{
+		config:     config,
+		log:        log,
+		shutdownCh: make(chan struct{}),
+		ops:        make(map[uint64]*watchedOp),
+	}
+}
+
+// startOp starts watching the op named name, running in the calling
+// goroutine with the given context, until the returned function is
+// called.
+func (w *slowOpWatchdog) startOp(ctx context.Context, name string) (
+	done func()) {
+	if w.config.SlowOpThreshold() <= 0 {
+		return func() {}
+	}
+	op := &watchedOp{
+		ctx:       ctx,
+		name:      name,
+		goroutine: currentGoroutineID(),
+		start:     time.Now(),
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.lastOpID++
+	id := w.lastOpID
+	w.ops[id] = op
+	return func() {
+		w.lock.Lock()
+		defer w.lock.Unlock()
+		delete(w.ops, id)
+	}
+}
+
+// setLockTracking turns lock tracking on or off on behalf of w.
+func (w *slowOpWatchdog) setLockTracking(track bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if track == w.trackLock {
+		return
+	}
+	w.trackLock = track
+	if track {
+		startLockTracking()
+	} else {
+		stopLockTracking()
+	}
+}
+
+// checkInterval returns how often to look for slow ops, so that none
+// goes unnoticed for much longer than threshold.
+func checkInterval(threshold time.Duration) time.Duration {
+	interval := threshold / 4
+	if threshold <= 0 || interval > time.Second {
+		// Also how often a newly-set threshold gets noticed.
+		return time.Second
+	}
+	if interval < 10*time.Millisecond {
+		return 10 * time.Millisecond
+	}
+	return interval
+}
+
+func (w *slowOpWatchdog) loop() {
+	defer w.setLockTracking(false)
+	for {
+		threshold := w.config.SlowOpThreshold()
+		w.setLockTracking(threshold > 0)
+		select {
+		case <-time.After(checkInterval(threshold)):
+		case <-w.shutdownCh:
+			return
+		}
+		if threshold > 0 {
+			w.check(threshold)
+		}
+	}
+}
+
+// check dumps a report for each op that's been going for longer than
+// threshold, and hasn't been reported yet.
+func (w *slowOpWatchdog) check(threshold time.Duration) {
+	now := time.Now()
+	var slowOps []watchedOp
+	func() {
+		w.lock.Lock()
+		defer w.lock.Unlock()
+		for _, op := range w.ops {
+			if op.reported || now.Sub(op.start) < threshold {
+				continue
+			}
+			op.reported = true
+			slowOps = append(slowOps, *op)
+		}
+	}()
+	if len(slowOps) == 0 {
+		return
+	}
+
+	// Everything but the op itself is shared by the reports.
+	locks := trackedLockStatuses()
+	rpcs := pendingRPCs.status()
+	var journal *JournalServerStatus
+	if jServer, err := GetJournalServer(w.config); err == nil {
+		status := jServer.Status()
+		journal = &status
+	}
+	var transfers BlockTransferStatus
+	if meter := w.config.BlockTransferMeter(); meter != nil {
+		transfers = meter.Status()
+	}
+	goroutines := make(map[uint64]bool)
+	for _, op := range slowOps {
+		goroutines[op.goroutine] = true
+	}
+	for _, lock := range locks {
+		goroutines[lock.Goroutine] = true
+	}
+	stacks := goroutineStacks(goroutines)
+
+	for _, op := range slowOps {
+		report := SlowOpReport{
+			Time:           now,
+			Op:             op.name,
+			Elapsed:        now.Sub(op.start),
+			Tags:           LogTagsFromContextToMap(op.ctx),
+			Goroutine:      op.goroutine,
+			Stacks:         stacks,
+			Locks:          locks,
+			PendingRPCs:    rpcs,
+			Journal:        journal,
+			BlockTransfers: transfers,
+		}
+		encoded, err := json.Marshal(report)
+		if err != nil {
+			w.log.CWarningf(op.ctx, "Couldn't encode slow op report: %v", err)
+		}
+		w.log.CWarningf(op.ctx, "%s has been running for %s: %s",
+			op.name, report.Elapsed, encoded)
+
+		w.lock.Lock()
+		w.reports = append(w.reports, report)
+		if len(w.reports) > slowOpReportsToKeep {
+			w.reports = w.reports[len(w.reports)-slowOpReportsToKeep:]
+		}
+		w.lock.Unlock()
+	}
+}
+
+// getReports returns the most recent reports, oldest first.
+func (w *slowOpWatchdog) getReports() []SlowOpReport {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return append([]SlowOpReport(nil), w.reports...)
+}
+
+func (w *slowOpWatchdog) shutdown() {
+	close(w.shutdownCh)
+}
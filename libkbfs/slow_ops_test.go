@@ -0,0 +1,154 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/json"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestCurrentGoroutineID(t *testing.T) {
+	id := currentGoroutineID()
+	require.NotEqual(t, uint64(0), id)
+	idCh := make(chan uint64)
+	go func() {
+		idCh <- currentGoroutineID()
+	}()
+	otherID := <-idCh
+	require.NotEqual(t, id, otherID)
+
+	stacks := goroutineStacks(map[uint64]bool{id: true})
+	require.Len(t, stacks, 1)
+	require.Contains(t, stacks[id], "TestCurrentGoroutineID")
+}
+
+// TestKBFSOpsSlowOpWatchdog checks that an op stuck behind an FBO lock
+// gets reported, along with who holds the lock.
+func TestKBFSOpsSlowOpWatchdog(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	require.Empty(t, kbfsOps.SlowOpReports())
+
+	config.SetSlowOpThreshold(50 * time.Millisecond)
+	defer config.SetSlowOpThreshold(0)
+	// Locks are only tracked once the watchdog notices the threshold.
+	for atomic.LoadInt32(&lockTracking) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ops, release := kbfsOps.(*KBFSOpsStandard).getOpsByNode(ctx, rootNode)
+	defer release()
+	lState := makeFBOLockState()
+	ops.mdWriterLock.Lock(lState)
+	locked := true
+	defer func() {
+		if locked {
+			ops.mdWriterLock.Unlock(lState)
+		}
+	}()
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+		errCh <- err
+	}()
+
+	var reports []SlowOpReport
+	for start := time.Now(); len(reports) == 0; {
+		require.True(t, time.Since(start) < 10*time.Second,
+			"No slow op reported")
+		time.Sleep(10 * time.Millisecond)
+		reports = kbfsOps.SlowOpReports()
+	}
+	ops.mdWriterLock.Unlock(lState)
+	locked = false
+	select {
+	case err := <-errCh:
+		require.NoError(t, err)
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+
+	require.Len(t, reports, 1)
+	r := reports[0]
+	require.Equal(t, "KBFSOps.CreateFile", r.Op)
+	require.True(t, r.Elapsed >= 50*time.Millisecond)
+	require.NotEqual(t, "", r.Tags[CtxKBFSOpsOpID])
+	require.Contains(t, r.Stacks[r.Goroutine], "CreateFile")
+
+	var holding, waiting bool
+	for _, l := range r.Locks {
+		if len(l.Held) > 0 && l.Held[0] == "mdWriterLock" {
+			holding = true
+			require.Contains(t, r.Stacks[l.Goroutine],
+				"TestKBFSOpsSlowOpWatchdog")
+		}
+		if l.Waiting == "mdWriterLock" {
+			waiting = true
+			// The op may wait in a goroutine of its own.
+			require.Contains(t, r.Stacks[l.Goroutine], "doMDWriteWithRetry")
+		}
+	}
+	require.True(t, holding, "Lock holder not reported: %+v", r.Locks)
+	require.True(t, waiting, "Lock waiter not reported: %+v", r.Locks)
+
+	// It's only reported once, and can be sent out as JSON.
+	time.Sleep(100 * time.Millisecond)
+	require.Len(t, kbfsOps.SlowOpReports(), 1)
+	_, err := json.Marshal(r)
+	require.NoError(t, err)
+}
+
+func TestPendingRPCClient(t *testing.T) {
+	var methods []string
+	inner := &blockingRPCClient{
+		called:  make(chan struct{}),
+		unblock: make(chan struct{}),
+	}
+	client := newPendingRPCClient("test", inner)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- client.Call(context.Background(), "test.slow", nil, nil)
+	}()
+	<-inner.called
+	for _, call := range pendingRPCs.status() {
+		if call.Server == "test" {
+			methods = append(methods, call.Method)
+		}
+	}
+	require.Equal(t, []string{"test.slow"}, methods)
+	close(inner.unblock)
+	require.NoError(t, <-errCh)
+	for _, call := range pendingRPCs.status() {
+		require.False(t, strings.HasPrefix(call.Method, "test."))
+	}
+}
+
+type blockingRPCClient struct {
+	called  chan struct{}
+	unblock chan struct{}
+}
+
+func (c *blockingRPCClient) Call(ctx context.Context, method string,
+	arg interface{}, res interface{}) error {
+	close(c.called)
+	<-c.unblock
+	return nil
+}
+
+func (c *blockingRPCClient) Notify(ctx context.Context, method string,
+	arg interface{}) error {
+	return nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+// DataRange is a range of a file that holds data.  Everything in a
+// file that isn't covered by one is a hole, which reads as zeroes
+// and takes up no block storage.
+type DataRange struct {
+	Off uint64
+	Len uint64
+}
+
+// End returns the offset just past the range.
+func (r DataRange) End() uint64 {
+	return r.Off + r.Len
+}
+
+// addDataRange appends the range [start, end) to ranges, which must
+// be sorted and end at or before start, merging it with the last
+// range if they touch.
+func addDataRange(ranges []DataRange, start, end uint64) []DataRange {
+	if end <= start {
+		return ranges
+	}
+	if n := len(ranges); n > 0 && ranges[n-1].End() == start {
+		ranges[n-1].Len += end - start
+		return ranges
+	}
+	return append(ranges, DataRange{start, end - start})
+}
+
+// DataBytes returns the total number of bytes in ranges.
+func DataBytes(ranges []DataRange) uint64 {
+	var total uint64
+	for _, r := range ranges {
+		total += r.Len
+	}
+	return total
+}
+
+// SeekData returns the first offset at or after off that holds data,
+// given a file's data ranges, as lseek(2) does for SEEK_DATA.  ok is
+// false if there's no data at or after off, in which case lseek
+// fails with ENXIO.
+func SeekData(ranges []DataRange, off uint64) (dataOff uint64, ok bool) {
+	for _, r := range ranges {
+		if off < r.Off {
+			return r.Off, true
+		}
+		if off < r.End() {
+			return off, true
+		}
+	}
+	return 0, false
+}
+
+// SeekHole returns the first offset at or after off that is in a
+// hole, given a file's data ranges and size, as lseek(2) does for
+// SEEK_HOLE.  The end of the file counts as a hole.  ok is false if
+// off is at or past the end of the file, in which case lseek fails
+// with ENXIO.
+func SeekHole(ranges []DataRange, size uint64, off uint64) (
+	holeOff uint64, ok bool) {
+	if off >= size {
+		return 0, false
+	}
+	for _, r := range ranges {
+		if off < r.Off {
+			return off, true
+		}
+		if off < r.End() {
+			off = r.End()
+		}
+	}
+	return off, true
+}
+
+// AllocateMode is a set of flags that say what KBFSOps.Allocate
+// should do with a range of a file, mirroring fallocate(2)'s mode.
+type AllocateMode int
+
+const (
+	// AllocateKeepSize leaves the file's size alone, even if the
+	// range extends past its end.
+	AllocateKeepSize AllocateMode = 1 << iota
+	// AllocatePunchHole zeroes the range rather than preallocating
+	// it, dropping any blocks it covers entirely.  It must be
+	// combined with AllocateKeepSize.
+	AllocatePunchHole
+)
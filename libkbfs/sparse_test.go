@@ -0,0 +1,394 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestSeekDataAndHole(t *testing.T) {
+	var ranges []DataRange
+	ranges = addDataRange(ranges, 0, 10)
+	ranges = addDataRange(ranges, 10, 20)
+	ranges = addDataRange(ranges, 30, 30)
+	ranges = addDataRange(ranges, 100, 110)
+	require.Equal(t, []DataRange{{0, 20}, {100, 10}}, ranges)
+	require.Equal(t, uint64(30), DataBytes(ranges))
+
+	const size = 200
+	seekDataTests := []struct {
+		off  uint64
+		data uint64
+		ok   bool
+	}{
+		{0, 0, true},
+		{15, 15, true},
+		{20, 100, true},
+		{109, 109, true},
+		{110, 0, false},
+	}
+	for _, test := range seekDataTests {
+		data, ok := SeekData(ranges, test.off)
+		require.Equal(t, test.ok, ok, "SeekData(%d)", test.off)
+		require.Equal(t, test.data, data, "SeekData(%d)", test.off)
+	}
+
+	seekHoleTests := []struct {
+		off  uint64
+		hole uint64
+		ok   bool
+	}{
+		{0, 20, true},
+		{20, 20, true},
+		{100, 110, true},
+		{150, 150, true},
+		{size, 0, false},
+	}
+	for _, test := range seekHoleTests {
+		hole, ok := SeekHole(ranges, size, test.off)
+		require.Equal(t, test.ok, ok, "SeekHole(%d)", test.off)
+		require.Equal(t, test.hole, hole, "SeekHole(%d)", test.off)
+	}
+}
+
+func TestKBFSOpsWritePastEOFLeavesHole(t *testing.T) {
+	var userName libkb.NormalizedUsername = "u1"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, userName.String(), false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	err = kbfsOps.Write(ctx, fileNode, []byte("hello"), 0)
+	require.NoError(t, err)
+	// A small gap just gets filled in.
+	err = kbfsOps.Write(ctx, fileNode, []byte("world"), 10)
+	require.NoError(t, err)
+	const holeOff = 10 * truncateExtendCutoffPoint
+	err = kbfsOps.Write(ctx, fileNode, []byte("!"), holeOff)
+	require.NoError(t, err)
+
+	expected := []DataRange{{0, 15}, {holeOff, 1}}
+	ranges, err := kbfsOps.GetDataRanges(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, expected, ranges)
+
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	ranges, err = kbfsOps.GetDataRanges(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, expected, ranges)
+
+	ei, err := kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, uint64(holeOff+1), ei.Size)
+	buf := make([]byte, 5)
+	n, err := kbfsOps.Read(ctx, fileNode, buf, holeOff-5)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), n)
+	require.Equal(t, make([]byte, 5), buf)
+
+	// Filling in part of the hole.
+	err = kbfsOps.Write(ctx, fileNode, []byte("x"), holeOff/2)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	n, err = kbfsOps.Read(ctx, fileNode, buf[:1], holeOff/2)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), n)
+	require.Equal(t, byte('x'), buf[0])
+	ranges, err = kbfsOps.GetDataRanges(ctx, fileNode)
+	require.NoError(t, err)
+	data, ok := SeekData(ranges, 15)
+	require.True(t, ok)
+	require.True(t, data <= holeOff/2)
+	hole, ok := SeekHole(ranges, ei.Size, holeOff/2)
+	require.True(t, ok)
+	require.True(t, hole > holeOff/2 && hole < holeOff)
+}
+
+func TestKBFSOpsGetAllocatedSize(t *testing.T) {
+	var userName libkb.NormalizedUsername = "u1"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, userName.String(), false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	// Without holes, the whole file counts.
+	err = kbfsOps.Write(ctx, fileNode, []byte("hello"), 0)
+	require.NoError(t, err)
+	size, err := kbfsOps.GetAllocatedSize(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), size)
+
+	const holeOff = 10 * truncateExtendCutoffPoint
+	err = kbfsOps.Write(ctx, fileNode, []byte("!"), holeOff)
+	require.NoError(t, err)
+	size, err = kbfsOps.GetAllocatedSize(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), size)
+
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	size, err = kbfsOps.GetAllocatedSize(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), size)
+
+	// Once the child blocks are out of the cache, their encoded
+	// sizes stand in for them, which still leaves out the hole.
+	config.ResetCaches()
+	rootNode = GetRootNodeOrBust(t, config, userName.String(), false)
+	fileNode, _, err = kbfsOps.Lookup(ctx, rootNode, "a")
+	require.NoError(t, err)
+	size, err = kbfsOps.GetAllocatedSize(ctx, fileNode)
+	require.NoError(t, err)
+	require.True(t, size >= 6 && size < truncateExtendCutoffPoint,
+		"allocated size %d", size)
+}
+
+func TestKBFSOpsAllocate(t *testing.T) {
+	var userName libkb.NormalizedUsername = "u1"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, userName.String(), false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte("hello"), 0)
+	require.NoError(t, err)
+
+	err = kbfsOps.Allocate(ctx, fileNode, 0, 1000, 0)
+	require.NoError(t, err)
+	ei, err := kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1000), ei.Size)
+
+	// Preallocating within the file, or without changing the size,
+	// leaves it alone.
+	err = kbfsOps.Allocate(ctx, fileNode, 0, 10, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Allocate(ctx, fileNode, 0, 2000, AllocateKeepSize)
+	require.NoError(t, err)
+	ei, err = kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1000), ei.Size)
+
+	err = kbfsOps.Allocate(ctx, fileNode, 0, 10, AllocatePunchHole)
+	require.IsType(t, InvalidAllocateModeError{}, err)
+
+	// Punching a hole in a file that can't have any just zeroes it.
+	err = kbfsOps.Allocate(
+		ctx, fileNode, 1, 3, AllocateKeepSize|AllocatePunchHole)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("h\x00\x00\x00o"), buf)
+}
+
+func TestKBFSOpsPunchHoleDropsBlocks(t *testing.T) {
+	var userName libkb.NormalizedUsername = "u1"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, userName.String(), false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	// Make a file that can have holes, and then fill most of it in,
+	// so that it's made of many blocks.
+	const size = 10 * truncateExtendCutoffPoint
+	err = kbfsOps.Write(ctx, fileNode, []byte("!"), size-1)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte("x"), size/2)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	ranges, err := kbfsOps.GetDataRanges(ctx, fileNode)
+	require.NoError(t, err)
+	before := DataBytes(ranges)
+
+	const holeOff, holeLen = size / 4, size / 2
+	err = kbfsOps.Allocate(ctx, fileNode, holeOff, holeLen,
+		AllocateKeepSize|AllocatePunchHole)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	ei, err := kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, uint64(size), ei.Size)
+	ranges, err = kbfsOps.GetDataRanges(ctx, fileNode)
+	require.NoError(t, err)
+	require.True(t, DataBytes(ranges) < before-holeLen/4,
+		"%d bytes of data left of %d", DataBytes(ranges), before)
+	hole, ok := SeekHole(ranges, ei.Size, holeOff)
+	require.True(t, ok)
+	require.True(t, hole < holeOff+holeLen)
+
+	buf := make([]byte, holeLen+2)
+	_, err = kbfsOps.Read(ctx, fileNode, buf, holeOff-1)
+	require.NoError(t, err)
+	require.Equal(t, make([]byte, len(buf)), buf)
+	_, err = kbfsOps.Read(ctx, fileNode, buf[:1], size-1)
+	require.NoError(t, err)
+	require.Equal(t, byte('!'), buf[0])
+}
+
+func TestKBFSOpsPunchHoleZeroesManyBlocks(t *testing.T) {
+	var userName libkb.NormalizedUsername = "u1"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, userName.String(), false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	// A file written front to back can't have holes, so punching
+	// one writes zeroes over more than one chunk's worth.
+	const size = 3 * punchHoleZeroChunkBytes
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = 'x'
+	}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	const holeOff, holeLen = 100, 2*punchHoleZeroChunkBytes + 50
+	err = kbfsOps.Allocate(ctx, fileNode, holeOff, holeLen,
+		AllocateKeepSize|AllocatePunchHole)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	for i := holeOff; i < holeOff+holeLen; i++ {
+		data[i] = 0
+	}
+	buf := make([]byte, size)
+	_, err = kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data, buf))
+}
+
+// quotaLimitedBServer is a BlockServer that reports a fixed quota.
+type quotaLimitedBServer struct {
+	BlockServer
+	used, limit int64
+}
+
+func (b quotaLimitedBServer) GetUserQuotaInfo(ctx context.Context) (
+	*UserQuotaInfo, error) {
+	info := &UserQuotaInfo{Total: NewUsageStat(), Limit: b.limit}
+	info.Total.Bytes[UsageWrite] = b.used
+	return info, nil
+}
+
+func TestKBFSOpsAllocateOverQuota(t *testing.T) {
+	var userName libkb.NormalizedUsername = "u1"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, userName.String(), false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	config.SetBlockServer(quotaLimitedBServer{
+		BlockServer: config.BlockServer(),
+		used:        900,
+		limit:       1000,
+	})
+	err = kbfsOps.Allocate(ctx, fileNode, 0, 100, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Allocate(ctx, fileNode, 0, 101, AllocateKeepSize)
+	require.IsType(t, BServerErrorOverQuota{}, err)
+	ei, err := kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, uint64(100), ei.Size)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+}
+
+func TestKBFSOpsAllocateReservesJournalSpace(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "allocate_journal")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	var userName libkb.NormalizedUsername = "u1"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+	config.EnableJournaling(tempdir)
+	jServer, err := GetJournalServer(config)
+	require.NoError(t, err)
+
+	rootNode := GetRootNodeOrBust(t, config, userName.String(), false)
+	tlfID := rootNode.GetFolderBranch().Tlf
+	err = jServer.Enable(ctx, tlfID, TLFJournalBackgroundWorkPaused)
+	require.NoError(t, err)
+
+	// Limit the journals to 512 KiB.
+	config.SetDiskLimitFraction(0.5)
+	limiter := getDiskLimiter(config)
+	require.NotNil(t, limiter)
+	limiter.lock.Lock()
+	limiter.freeBytes = func(string) (int64, error) {
+		return 1 << 20, nil
+	}
+	limiter.sampledAt = time.Time{}
+	limiter.lock.Unlock()
+
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	before := limiter.status().JournalBytes
+
+	const reserved = 400 << 10
+	err = kbfsOps.Allocate(ctx, fileNode, 0, reserved, AllocateKeepSize)
+	require.NoError(t, err)
+	require.Equal(t, before+reserved, limiter.status().JournalBytes)
+	err = kbfsOps.Allocate(ctx, fileNode, 0, 200<<10, AllocateKeepSize)
+	require.IsType(t, DiskLimitReachedError{}, err)
+
+	// Syncing the file gives the reservation back.
+	err = kbfsOps.Write(ctx, fileNode, []byte("hello"), 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	require.True(t, limiter.status().JournalBytes < before+reserved)
+
+	err = jServer.Flush(ctx, tlfID)
+	require.NoError(t, err)
+	jServer.ResumeBackgroundWork(ctx, tlfID)
+}
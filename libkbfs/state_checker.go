@@ -7,24 +7,138 @@ package libkbfs
 import (
 	"errors"
 	"fmt"
-	"reflect"
 	"time"
 
 	"github.com/keybase/client/go/logger"
 	"golang.org/x/net/context"
 )
 
+// StateCheckProblemKind is the kind of a problem found by a
+// StateChecker.
+type StateCheckProblemKind int
+
+const (
+	// StateCheckLeakedBlock is a block that the MD history says is
+	// still referenced, but that isn't reachable from the head.  It
+	// counts against the TLF's quota, but can never be reclaimed.
+	StateCheckLeakedBlock StateCheckProblemKind = iota + 1
+	// StateCheckMissingRef is a block reachable from the head that
+	// no revision in the MD history references.
+	StateCheckMissingRef
+	// StateCheckMissingServerRef is a reference the MD history
+	// says the block server should have, which it doesn't, or has
+	// in the wrong state.
+	StateCheckMissingServerRef
+	// StateCheckExtraServerRef is a reference the block server
+	// has that the MD history doesn't account for.  Only local
+	// block servers can list their references, so only they can
+	// turn these up.
+	StateCheckExtraServerRef
+	// StateCheckSizeMismatch is a head MD whose disk usage doesn't
+	// match the bytes referenced by the MD history, or by the
+	// blocks reachable from the head.
+	StateCheckSizeMismatch
+	// StateCheckRootMismatch is a head MD whose root block isn't
+	// the one the TLF's loaded root node points to.
+	StateCheckRootMismatch
+	// StateCheckMissedGC is a revision that was old enough to be
+	// garbage-collected by the last quota reclamation, but wasn't.
+	StateCheckMissedGC
+)
+
+func (k StateCheckProblemKind) String() string {
+	switch k {
+	case StateCheckLeakedBlock:
+		return "leaked block"
+	case StateCheckMissingRef:
+		return "missing ref"
+	case StateCheckMissingServerRef:
+		return "missing server ref"
+	case StateCheckExtraServerRef:
+		return "extra server ref"
+	case StateCheckSizeMismatch:
+		return "size mismatch"
+	case StateCheckRootMismatch:
+		return "root mismatch"
+	case StateCheckMissedGC:
+		return "missed gc"
+	default:
+		return fmt.Sprintf("StateCheckProblemKind(%d)", int(k))
+	}
+}
+
+// StateCheckProblem is one inconsistency found by a StateChecker.
+type StateCheckProblem struct {
+	Kind StateCheckProblemKind
+	// Ptr is the block involved, if any.
+	Ptr BlockPointer
+	// Revision is the MD revision involved, if any.
+	Revision MetadataRevision
+	// Expected and Actual are the sizes or counts that differ,
+	// for size mismatches.
+	Expected uint64
+	Actual   uint64
+	// Detail describes the problem further.
+	Detail string
+}
+
+func (p StateCheckProblem) String() string {
+	s := p.Kind.String()
+	if p.Ptr != zeroPtr {
+		s += fmt.Sprintf(" %v", p.Ptr)
+	}
+	if p.Revision != MetadataRevisionUninitialized {
+		s += fmt.Sprintf(" at revision %d", p.Revision)
+	}
+	if p.Detail != "" {
+		s += ": " + p.Detail
+	}
+	return s
+}
+
+// StateCheckReport is the result of a StateChecker check of a TLF.
+type StateCheckReport struct {
+	Tlf TlfID
+	// Revision is the head revision the check was done against.
+	Revision MetadataRevision
+	// RevisionsChecked is the number of merged revisions whose
+	// block changes were replayed.
+	RevisionsChecked int
+	// LiveBlocks is the number of blocks reachable from the head.
+	LiveBlocks int
+	// ServerChecked is set if the block server's references were
+	// checked against the MD history.
+	ServerChecked bool
+	Problems      []StateCheckProblem
+}
+
+// IsClean returns true if the check found no problems.
+func (r StateCheckReport) IsClean() bool {
+	return len(r.Problems) == 0
+}
+
+// StateCheckOptions control a StateChecker check of a live TLF.
+type StateCheckOptions struct {
+	// RequestsPerSecond, if positive, limits how many MD batches
+	// and blocks the check fetches each second, so that it doesn't
+	// crowd out the requests of whoever is using the TLF.
+	RequestsPerSecond int
+}
+
 // StateChecker verifies that the server-side state for KBFS is
-// consistent.  Useful mostly for testing because it isn't scalable
-// and loads all the state in memory.
+// consistent, by replaying the block changes of every merged MD
+// revision of a TLF and comparing the result with the blocks
+// reachable from the head and with the block server's references.
+// CheckMergedState is meant for tests, and Check for live TLFs.
 type StateChecker struct {
-	config Config
-	log    logger.Logger
+	config  Config
+	log     logger.Logger
+	limiter rateLimiter
 }
 
 // NewStateChecker returns a new StateChecker instance.
 func NewStateChecker(config Config) *StateChecker {
-	return &StateChecker{config, config.MakeLogger("")}
+	return &StateChecker{config: config, log: config.MakeLogger("")}
 }
 
 // findAllFileBlocks adds all file blocks found under this block to
@@ -32,7 +146,11 @@ func NewStateChecker(config Config) *StateChecker {
 // block.
 func (sc *StateChecker) findAllFileBlocks(ctx context.Context,
 	lState *lockState, ops *folderBranchOps, kmd KeyMetadata,
-	file path, blockSizes map[BlockPointer]uint32) error {
+	file path, blockSizes map[BlockPointer]uint32,
+	opts StateCheckOptions) error {
+	if err := sc.limiter.wait(ctx, opts.RequestsPerSecond); err != nil {
+		return err
+	}
 	fblock, err := ops.blocks.GetFileBlockForReading(ctx, lState, kmd,
 		file.tailPointer(), file.Branch, file)
 	if err != nil {
@@ -43,14 +161,9 @@ func (sc *StateChecker) findAllFileBlocks(ctx context.Context,
 		return nil
 	}
 
-	parentPath := file.parentPath()
-	for _, childPtr := range fblock.IPtrs {
-		blockSizes[childPtr.BlockPointer] = childPtr.EncodedSize
-		p := parentPath.ChildPath(file.tailName(), childPtr.BlockPointer)
-		err := sc.findAllFileBlocks(ctx, lState, ops, kmd, p, blockSizes)
-		if err != nil {
-			return err
-		}
+	// The top block comes with the pointers to every block under it.
+	for _, info := range fileBlockChildInfos(fblock) {
+		blockSizes[info.BlockPointer] = info.EncodedSize
 	}
 	return nil
 }
@@ -60,14 +173,31 @@ func (sc *StateChecker) findAllFileBlocks(ctx context.Context,
 // subdirectories.
 func (sc *StateChecker) findAllBlocksInPath(ctx context.Context,
 	lState *lockState, ops *folderBranchOps, kmd KeyMetadata,
-	dir path, blockSizes map[BlockPointer]uint32) error {
+	dir path, blockSizes map[BlockPointer]uint32,
+	opts StateCheckOptions) error {
+	if err := sc.limiter.wait(ctx, opts.RequestsPerSecond); err != nil {
+		return err
+	}
 	dblock, err := ops.blocks.GetDirBlockForReading(ctx, lState, kmd,
 		dir.tailPointer(), dir.Branch, dir)
 	if err != nil {
 		return err
 	}
 
+	// The shards of a sharded directory.
+	for _, iptr := range dblock.IPtrs {
+		blockSizes[iptr.BlockPointer] = iptr.EncodedSize
+	}
+
 	for name, de := range dblock.Children {
+		// Extended attributes too big to be inline have blocks of
+		// their own.
+		for _, v := range de.Xattrs {
+			if v.Block.BlockPointer != zeroPtr {
+				blockSizes[v.Block.BlockPointer] = v.Block.EncodedSize
+			}
+		}
+
 		if de.Type == Sym {
 			continue
 		}
@@ -76,13 +206,15 @@ func (sc *StateChecker) findAllBlocksInPath(ctx context.Context,
 		p := dir.ChildPath(name, de.BlockPointer)
 
 		if de.Type == Dir {
-			err := sc.findAllBlocksInPath(ctx, lState, ops, kmd, p, blockSizes)
+			err := sc.findAllBlocksInPath(
+				ctx, lState, ops, kmd, p, blockSizes, opts)
 			if err != nil {
 				return err
 			}
 		} else {
 			// If it's a file, check to see if it's indirect.
-			err := sc.findAllFileBlocks(ctx, lState, ops, kmd, p, blockSizes)
+			err := sc.findAllFileBlocks(
+				ctx, lState, ops, kmd, p, blockSizes, opts)
 			if err != nil {
 				return err
 			}
@@ -94,7 +226,7 @@ func (sc *StateChecker) findAllBlocksInPath(ctx context.Context,
 func (sc *StateChecker) getLastGCData(ctx context.Context,
 	tlf TlfID) (time.Time, MetadataRevision) {
 	config, ok := sc.config.(*ConfigLocal)
-	if !ok {
+	if !ok || config.allKnownConfigsForTesting == nil {
 		return time.Time{}, MetadataRevisionUninitialized
 	}
 
@@ -118,252 +250,547 @@ func (sc *StateChecker) getLastGCData(ctx context.Context,
 	return latestTime.Add(-sc.config.QuotaReclamationMinUnrefAge()), latestRev
 }
 
-// CheckMergedState verifies that the state for the given tlf is
-// consistent.
-func (sc *StateChecker) CheckMergedState(ctx context.Context, tlf TlfID) error {
-	// Blow away MD cache so we don't have any lingering re-embedded
-	// block changes (otherwise we won't be able to learn their sizes).
-	sc.config.SetMDCache(NewMDCacheStandard(5000))
+// stateCheckHistory is what replaying the block changes of a TLF's
+// merged MD history says the block server should hold.
+type stateCheckHistory struct {
+	expectedLiveBlocks map[BlockPointer]bool
+	expectedRef        uint64
+	// archivedBlocks maps each unreferenced block that hasn't been
+	// deleted to the revision that unreferenced it.
+	archivedBlocks map[BlockPointer]MetadataRevision
+	// actualLiveBlocks starts with the unembedded block changes,
+	// which are live but not reachable from the root.
+	actualLiveBlocks map[BlockPointer]uint32
+	// gcRevision is the latest revision covered by a GC op.  All
+	// unref'd pointers from that revision or earlier should be
+	// deleted from the block server.
+	gcRevision MetadataRevision
+	// mtimes holds the root mtime of each revision that isn't
+	// just a GC op, to check against the last quota reclamation.
+	mtimes    map[MetadataRevision]time.Time
+	revisions int
+	head      ImmutableRootMetadata
+}
 
-	// Fetch all the MD updates for this folder, and use the block
-	// change lists to build up the set of currently referenced blocks.
-	rmds, err := getMergedMDUpdates(ctx, sc.config, tlf,
-		MetadataRevisionInitial)
-	if err != nil {
-		return err
+func newStateCheckHistory() *stateCheckHistory {
+	return &stateCheckHistory{
+		expectedLiveBlocks: make(map[BlockPointer]bool),
+		archivedBlocks:     make(map[BlockPointer]MetadataRevision),
+		actualLiveBlocks:   make(map[BlockPointer]uint32),
+		gcRevision:         MetadataRevisionUninitialized,
+		mtimes:             make(map[MetadataRevision]time.Time),
 	}
-	if len(rmds) == 0 {
-		sc.log.CDebugf(ctx, "No state to check for folder %s", tlf)
-		return nil
-	}
-
-	lState := makeFBOLockState()
+}
 
-	// Re-embed block changes.
-	kbfsOps, ok := sc.config.KBFSOps().(*KBFSOpsStandard)
-	if !ok {
-		return errors.New("Unexpected KBFSOps type")
+// add replays the block changes of rmd, which must be the revision
+// after the last one added.
+func (h *stateCheckHistory) add(ctx context.Context, log logger.Logger,
+	rmd ImmutableRootMetadata) {
+	h.head = rmd
+	// Don't process copies.
+	if rmd.IsWriterMetadataCopiedSet() {
+		return
+	}
+	h.revisions++
+	// Any unembedded block changes also count towards the actual size
+	if info := rmd.data.cachedChanges.Info; info.BlockPointer != zeroPtr {
+		log.CDebugf(ctx, "Unembedded block change: %v, %d",
+			info.BlockPointer, info.EncodedSize)
+		h.actualLiveBlocks[info.BlockPointer] = info.EncodedSize
 	}
 
-	fb := FolderBranch{tlf, MasterBranch}
-	ops := kbfsOps.getOpsNoAdd(fb)
-	lastGCRevisionTime, lastGCRev := sc.getLastGCData(ctx, tlf)
-
-	// Build the expected block list.
-	expectedLiveBlocks := make(map[BlockPointer]bool)
-	expectedRef := uint64(0)
-	archivedBlocks := make(map[BlockPointer]bool)
-	actualLiveBlocks := make(map[BlockPointer]uint32)
-
-	// See what the last GC op revision is.  All unref'd pointers from
-	// that revision or earlier should be deleted from the block
-	// server.
-	gcRevision := MetadataRevisionUninitialized
-	for _, rmd := range rmds {
-		// Don't process copies.
-		if rmd.IsWriterMetadataCopiedSet() {
-			continue
+	var hasGCOp bool
+	for _, op := range rmd.data.Changes.Ops {
+		gcOp, isGCOp := op.(*gcOp)
+		if isGCOp {
+			hasGCOp = true
+			h.gcRevision = gcOp.LatestRev
 		}
 
-		for _, op := range rmd.data.Changes.Ops {
-			gcOp, ok := op.(*gcOp)
-			if !ok {
-				continue
+		opRefs := make(map[BlockPointer]bool)
+		for _, ptr := range op.Refs() {
+			if ptr != zeroPtr {
+				h.expectedLiveBlocks[ptr] = true
+				opRefs[ptr] = true
 			}
-			gcRevision = gcOp.LatestRev
 		}
-	}
-
-	for _, rmd := range rmds {
-		// Don't process copies.
-		if rmd.IsWriterMetadataCopiedSet() {
-			continue
-		}
-		// Any unembedded block changes also count towards the actual size
-		if info := rmd.data.cachedChanges.Info; info.BlockPointer != zeroPtr {
-			sc.log.CDebugf(ctx, "Unembedded block change: %v, %d",
-				info.BlockPointer, info.EncodedSize)
-			actualLiveBlocks[info.BlockPointer] = info.EncodedSize
-		}
-
-		var hasGCOp bool
-		for _, op := range rmd.data.Changes.Ops {
-			_, isGCOp := op.(*gcOp)
-			hasGCOp = hasGCOp || isGCOp
-
-			opRefs := make(map[BlockPointer]bool)
-			for _, ptr := range op.Refs() {
+		if !isGCOp {
+			for _, ptr := range op.Unrefs() {
+				delete(h.expectedLiveBlocks, ptr)
 				if ptr != zeroPtr {
-					expectedLiveBlocks[ptr] = true
-					opRefs[ptr] = true
-				}
-			}
-			if _, ok := op.(*gcOp); !ok {
-				for _, ptr := range op.Unrefs() {
-					delete(expectedLiveBlocks, ptr)
-					if ptr != zeroPtr {
-						// If the revision has been garbage-collected,
-						// or if the pointer has been referenced and
-						// unreferenced within the same op (which
-						// indicates a failed and retried sync), the
-						// corresponding block should already be
-						// cleaned up.
-						if rmd.Revision() <= gcRevision || opRefs[ptr] {
-							delete(archivedBlocks, ptr)
-						} else {
-							archivedBlocks[ptr] = true
-						}
-					}
-				}
-			}
-			for _, update := range op.AllUpdates() {
-				delete(expectedLiveBlocks, update.Unref)
-				if update.Unref != zeroPtr && update.Ref != update.Unref {
-					if rmd.Revision() <= gcRevision {
-						delete(archivedBlocks, update.Unref)
+					// If the pointer has been referenced and
+					// unreferenced within the same op (which
+					// indicates a failed and retried sync), the
+					// corresponding block should already be
+					// cleaned up.  So should it be if its
+					// revision gets garbage-collected, which
+					// finish sorts out.
+					if opRefs[ptr] {
+						delete(h.archivedBlocks, ptr)
 					} else {
-						archivedBlocks[update.Unref] = true
+						h.archivedBlocks[ptr] = rmd.Revision()
 					}
 				}
-				if update.Ref != zeroPtr {
-					expectedLiveBlocks[update.Ref] = true
-				}
 			}
 		}
-		expectedRef += rmd.RefBytes()
-		expectedRef -= rmd.UnrefBytes()
+		for _, update := range op.AllUpdates() {
+			delete(h.expectedLiveBlocks, update.Unref)
+			if update.Unref != zeroPtr && update.Ref != update.Unref {
+				h.archivedBlocks[update.Unref] = rmd.Revision()
+			}
+			if update.Ref != zeroPtr {
+				h.expectedLiveBlocks[update.Ref] = true
+			}
+		}
+	}
+	h.expectedRef += rmd.RefBytes()
+	h.expectedRef -= rmd.UnrefBytes()
 
-		if len(rmd.data.Changes.Ops) == 1 && hasGCOp {
-			// Don't check GC status for GC revisions
-			continue
+	// Don't check GC status for GC revisions
+	if !(len(rmd.data.Changes.Ops) == 1 && hasGCOp) {
+		h.mtimes[rmd.Revision()] = time.Unix(0, rmd.data.Dir.Mtime)
+	}
+}
+
+// finish drops the archived blocks that garbage collection should
+// have deleted, and checks that every revision old enough to be
+// collected by the last quota reclamation was.  Note that this
+// assumes that if QR is ever run, it will be run completely and not
+// left partially done due to there being too many pointers to
+// collect in one sweep.
+func (h *stateCheckHistory) finish(lastGCRevisionTime time.Time,
+	lastGCRev MetadataRevision) (problems []StateCheckProblem) {
+	for ptr, rev := range h.archivedBlocks {
+		if rev <= h.gcRevision {
+			delete(h.archivedBlocks, ptr)
 		}
+	}
+	for rev, mtime := range h.mtimes {
+		if !lastGCRevisionTime.Before(mtime) && rev <= lastGCRev &&
+			rev > h.gcRevision {
+			problems = append(problems, StateCheckProblem{
+				Kind:     StateCheckMissedGC,
+				Revision: rev,
+				Detail: fmt.Sprintf("Happened on or before the last "+
+					"gc time %s rev %d, but was not included in the "+
+					"latest gc op revision %d", lastGCRevisionTime,
+					lastGCRev, h.gcRevision),
+			})
+		}
+	}
+	return problems
+}
+
+// addMergedHistoryOnline fetches the merged MD history of tlf from
+// the server, without going through or disturbing the MD cache, and
+// adds it to h.  It returns nil if the TLF has no history yet.
+func (sc *StateChecker) addMergedHistoryOnline(ctx context.Context,
+	tlf TlfID, opts StateCheckOptions) (*stateCheckHistory, error) {
+	head, err := sc.config.MDOps().GetForTLF(ctx, tlf)
+	if err != nil {
+		return nil, err
+	}
+	if head == (ImmutableRootMetadata{}) {
+		return nil, nil
+	}
 
-		// Make sure that if this revision should be covered by a GC
-		// op, it is.  Note that this assumes that if QR is ever run,
-		// it will be run completely and not left partially done due
-		// to there being too many pointers to collect in one sweep.
-		mtime := time.Unix(0, rmd.data.Dir.Mtime)
-		if !lastGCRevisionTime.Before(mtime) && rmd.Revision() <= lastGCRev &&
-			rmd.Revision() > gcRevision {
-			return fmt.Errorf("Revision %d happened on or before the last "+
-				"gc time %s rev %d, but was not included in the latest "+
-				"gc op revision %d", rmd.Revision(), lastGCRevisionTime,
-				lastGCRev, gcRevision)
+	h := newStateCheckHistory()
+	for start := MetadataRevisionInitial; start <= head.Revision(); {
+		err := sc.limiter.wait(ctx, opts.RequestsPerSecond)
+		if err != nil {
+			return nil, err
 		}
+		end := start + maxMDsAtATime - 1 // range is inclusive
+		if end > head.Revision() {
+			end = head.Revision()
+		}
+		rmds, err := sc.config.MDOps().GetRange(ctx, tlf, start, end)
+		if err != nil {
+			return nil, err
+		}
+		if len(rmds) != int(end-start)+1 {
+			return nil, fmt.Errorf("Got %d MD revisions for range "+
+				"%d-%d of %s", len(rmds), start, end, tlf)
+		}
+		for _, rmd := range rmds {
+			// Revisions from before a rekey may only be
+			// readable with the keys in the head.
+			if isReadableOrError(ctx, sc.config, rmd.ReadOnly()) != nil {
+				rmdCopy, err := rmd.deepCopy(sc.config.Codec(), true)
+				if err != nil {
+					return nil, err
+				}
+				err = decryptMDPrivateData(
+					ctx, sc.config, rmdCopy, head.ReadOnly())
+				if err != nil {
+					return nil, err
+				}
+				rmd = MakeImmutableRootMetadata(
+					rmdCopy, rmd.mdID, rmd.localTimestamp)
+			}
+			h.add(ctx, sc.log, rmd)
+		}
+		start = end + 1
 	}
+	return h, nil
+}
+
+// compare checks h against the blocks reachable from its head, and
+// against the block server's references.  If requireHead is set, the
+// TLF's loaded root node must match the head's root, even if the TLF
+// is at a different revision.
+func (sc *StateChecker) compare(ctx context.Context,
+	ops *folderBranchOps, h *stateCheckHistory, requireHead bool, opts StateCheckOptions) (
+	report StateCheckReport, err error) {
+	currMD := h.head
+	tlf := ops.id()
+	report.Tlf = tlf
+	report.Revision = currMD.Revision()
+	report.RevisionsChecked = h.revisions
 	sc.log.CDebugf(ctx, "Folder %v has %d expected live blocks, total %d bytes",
-		tlf, len(expectedLiveBlocks), expectedRef)
+		tlf, len(h.expectedLiveBlocks), h.expectedRef)
 
-	currMD := rmds[len(rmds)-1]
 	expectedUsage := currMD.DiskUsage()
-	if expectedUsage != expectedRef {
-		return fmt.Errorf("Expected ref bytes %d doesn't match latest disk "+
-			"usage %d", expectedRef, expectedUsage)
+	if expectedUsage != h.expectedRef {
+		report.Problems = append(report.Problems, StateCheckProblem{
+			Kind:     StateCheckSizeMismatch,
+			Revision: currMD.Revision(),
+			Expected: h.expectedRef,
+			Actual:   expectedUsage,
+			Detail: fmt.Sprintf("Expected ref bytes %d doesn't match "+
+				"latest disk usage %d", h.expectedRef, expectedUsage),
+		})
 	}
 
-	// Then, using the current MD head, start at the root of the FS
-	// and recursively walk the directory tree to find all the blocks
-	// that are currently accessible.
+	fb := FolderBranch{tlf, MasterBranch}
+	lState := makeFBOLockState()
+
+	// Make sure the TLF's root node agrees with the head.  A live
+	// TLF may have moved on from the head being checked, in which
+	// case the walk below starts from the head's own root instead.
 	rootNode, _, _, err := ops.getRootNode(ctx)
 	if err != nil {
-		return err
+		return StateCheckReport{}, err
 	}
 	rootPath := ops.nodeCache.PathFromNode(rootNode)
-	if g, e := rootPath.tailPointer(), currMD.data.Dir.BlockPointer; g != e {
-		return fmt.Errorf("Current MD root pointer %v doesn't match root "+
-			"node pointer %v", e, g)
+	if requireHead ||
+		ops.getHead(lState).Revision() == currMD.Revision() {
+		if g, e := rootPath.tailPointer(), currMD.data.Dir.BlockPointer; g != e {
+			report.Problems = append(report.Problems, StateCheckProblem{
+				Kind:     StateCheckRootMismatch,
+				Ptr:      e,
+				Revision: currMD.Revision(),
+				Detail: fmt.Sprintf("Current MD root pointer %v doesn't "+
+					"match root node pointer %v", e, g),
+			})
+		}
 	}
+	rootPath = path{fb, []pathNode{{
+		currMD.data.Dir.BlockPointer, rootPath.tailName(),
+	}}}
+
+	// Then, starting at the root of the head, recursively walk the
+	// directory tree to find all the blocks that are currently
+	// accessible.
+	actualLiveBlocks := h.actualLiveBlocks
 	actualLiveBlocks[rootPath.tailPointer()] = currMD.data.Dir.EncodedSize
 	if err := sc.findAllBlocksInPath(ctx, lState, ops, currMD.ReadOnly(),
-		rootPath, actualLiveBlocks); err != nil {
-		return err
+		rootPath, actualLiveBlocks, opts); err != nil {
+		return StateCheckReport{}, err
 	}
 	sc.log.CDebugf(ctx, "Folder %v has %d actual live blocks",
 		tlf, len(actualLiveBlocks))
+	report.LiveBlocks = len(actualLiveBlocks)
 
-	// Compare the two and see if there are any differences. Don't use
-	// reflect.DeepEqual so we can print out exactly what's wrong.
-	var extraBlocks []BlockPointer
+	// Compare the two, noting exactly what's wrong.
+	blockProblems := false
 	actualSize := uint64(0)
 	for ptr, size := range actualLiveBlocks {
 		actualSize += uint64(size)
-		if !expectedLiveBlocks[ptr] {
-			extraBlocks = append(extraBlocks, ptr)
+		if !h.expectedLiveBlocks[ptr] {
+			blockProblems = true
+			report.Problems = append(report.Problems, StateCheckProblem{
+				Kind:   StateCheckMissingRef,
+				Ptr:    ptr,
+				Detail: "Reachable, but not referenced by any revision",
+			})
 		}
 	}
-	if len(extraBlocks) != 0 {
-		sc.log.CWarningf(ctx, "%v: Extra live blocks found: %v",
-			tlf, extraBlocks)
-		return fmt.Errorf("Folder %v has inconsistent state", tlf)
-	}
-	var missingBlocks []BlockPointer
-	for ptr := range expectedLiveBlocks {
+	for ptr := range h.expectedLiveBlocks {
 		if _, ok := actualLiveBlocks[ptr]; !ok {
-			missingBlocks = append(missingBlocks, ptr)
+			blockProblems = true
+			report.Problems = append(report.Problems, StateCheckProblem{
+				Kind:   StateCheckLeakedBlock,
+				Ptr:    ptr,
+				Detail: "Referenced, but not reachable from the head",
+			})
 		}
 	}
-	if len(missingBlocks) != 0 {
-		sc.log.CWarningf(ctx, "%v: Expected live blocks not found: %v",
-			tlf, missingBlocks)
-		return fmt.Errorf("Folder %v has inconsistent state", tlf)
+
+	if !blockProblems && actualSize != h.expectedRef {
+		report.Problems = append(report.Problems, StateCheckProblem{
+			Kind:     StateCheckSizeMismatch,
+			Revision: currMD.Revision(),
+			Expected: h.expectedRef,
+			Actual:   actualSize,
+			Detail: fmt.Sprintf("Actual size %d doesn't match "+
+				"expected size %d", actualSize, h.expectedRef),
+		})
 	}
 
-	if actualSize != expectedRef {
-		return fmt.Errorf("Actual size %d doesn't match expected size %d",
-			actualSize, expectedRef)
+	problems, err := sc.checkServer(ctx, tlf, h, opts)
+	if err != nil {
+		return StateCheckReport{}, err
 	}
+	report.ServerChecked = true
+	report.Problems = append(report.Problems, problems...)
+	return report, nil
+}
 
-	// Check that the set of referenced blocks matches exactly what
-	// the block server knows about.
-	bserverLocal, ok := sc.config.BlockServer().(blockServerLocal)
+// checkServer checks that the block server's references for tlf
+// match what h says they should be.  A local block server can list
+// all its references, so they're compared exactly.  Otherwise, each
+// block h says should be live is fetched, to make sure the server
+// still has it.
+func (sc *StateChecker) checkServer(ctx context.Context, tlf TlfID,
+	h *stateCheckHistory, opts StateCheckOptions) (
+	problems []StateCheckProblem, err error) {
+	bserver := unwrapBlockServer(sc.config.BlockServer())
+	bserverLocal, ok := bserver.(blockServerLocal)
 	if !ok {
-		if jbs, jok := sc.config.BlockServer().(journalBlockServer); jok {
-			bserverLocal, ok = jbs.BlockServer.(blockServerLocal)
-			if !ok {
-				sc.log.CDebugf(ctx, "Bad block server: %T", jbs.BlockServer)
+		sc.log.CDebugf(ctx, "Checking live blocks one by one against %T",
+			bserver)
+		for ptr := range h.expectedLiveBlocks {
+			err := sc.limiter.wait(ctx, opts.RequestsPerSecond)
+			if err != nil {
+				return nil, err
+			}
+			_, _, err = sc.config.BlockServer().Get(
+				ctx, tlf, ptr.ID, ptr.BlockContext)
+			switch err.(type) {
+			case nil:
+			case BServerErrorBlockNonExistent, BServerErrorBlockDeleted:
+				problems = append(problems, StateCheckProblem{
+					Kind:   StateCheckMissingServerRef,
+					Ptr:    ptr,
+					Detail: err.Error(),
+				})
+			default:
+				return nil, err
 			}
 		}
+		return problems, nil
 	}
-	if !ok {
-		return errors.New("StateChecker only works against " +
-			"BlockServerLocal")
-	}
+
 	bserverKnownBlocks, err := bserverLocal.getAll(ctx, tlf)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	blockRefsByID := make(map[BlockID]map[BlockRefNonce]blockRefLocalStatus)
-	for ptr := range expectedLiveBlocks {
+	for ptr := range h.expectedLiveBlocks {
 		if _, ok := blockRefsByID[ptr.ID]; !ok {
 			blockRefsByID[ptr.ID] = make(map[BlockRefNonce]blockRefLocalStatus)
 		}
 		blockRefsByID[ptr.ID][ptr.RefNonce] = liveBlockRef
 	}
-	for ptr := range archivedBlocks {
+	for ptr := range h.archivedBlocks {
 		if _, ok := blockRefsByID[ptr.ID]; !ok {
 			blockRefsByID[ptr.ID] = make(map[BlockRefNonce]blockRefLocalStatus)
 		}
 		blockRefsByID[ptr.ID][ptr.RefNonce] = archivedBlockRef
 	}
 
-	if g, e := bserverKnownBlocks, blockRefsByID; !reflect.DeepEqual(g, e) {
-		for id, eRefs := range e {
-			if gRefs := g[id]; !reflect.DeepEqual(gRefs, eRefs) {
-				sc.log.CDebugf(ctx, "Refs for ID %v don't match.  "+
-					"Got %v, expected %v", id, gRefs, eRefs)
+	for id, eRefs := range blockRefsByID {
+		gRefs := bserverKnownBlocks[id]
+		for nonce, eStatus := range eRefs {
+			ptr := BlockPointer{ID: id}
+			ptr.RefNonce = nonce
+			if gStatus, ok := gRefs[nonce]; !ok {
+				problems = append(problems, StateCheckProblem{
+					Kind:   StateCheckMissingServerRef,
+					Ptr:    ptr,
+					Detail: fmt.Sprintf("Expected a %s ref", eStatus),
+				})
+			} else if gStatus != eStatus {
+				problems = append(problems, StateCheckProblem{
+					Kind: StateCheckMissingServerRef,
+					Ptr:  ptr,
+					Detail: fmt.Sprintf("Expected a %s ref, got a %s one",
+						eStatus, gStatus),
+				})
 			}
 		}
-		for id, gRefs := range g {
-			if _, ok := e[id]; !ok {
-				sc.log.CDebugf(ctx, "Did not find matching expected "+
-					"ID for found block %v (with refs %v)", id, gRefs)
+	}
+	for id, gRefs := range bserverKnownBlocks {
+		for nonce, gStatus := range gRefs {
+			if _, ok := blockRefsByID[id][nonce]; ok {
+				continue
 			}
+			ptr := BlockPointer{ID: id}
+			ptr.RefNonce = nonce
+			problems = append(problems, StateCheckProblem{
+				Kind:   StateCheckExtraServerRef,
+				Ptr:    ptr,
+				Detail: fmt.Sprintf("Unexpected %s ref", gStatus),
+			})
 		}
-
-		return fmt.Errorf("Folder %v has inconsistent state", tlf)
 	}
 
 	// TODO: Check the archived and deleted blocks as well.
-	return nil
+	return problems, nil
+}
+
+// Check verifies the state of a live TLF, as of the head the MD
+// server has when the check starts, and reports any problems it
+// finds.  Unlike CheckMergedState, it leaves the config's caches
+// alone, and fetches what it needs at the rate opts allows.  Changes
+// made to the TLF during the check can show up as spurious
+// problems, so it returns StateCheckBusyError for a TLF with
+// unsynced local changes, or one whose head moved on while it was
+// checked.  Another device's sync that's still putting blocks can't
+// be detected that way, so findings should be confirmed by checking
+// again.
+func (sc *StateChecker) Check(ctx context.Context, tlf TlfID,
+	opts StateCheckOptions) (StateCheckReport, error) {
+	kbfsOps, ok := sc.config.KBFSOps().(*KBFSOpsStandard)
+	if !ok {
+		return StateCheckReport{}, errors.New("Unexpected KBFSOps type")
+	}
+	return sc.check(
+		ctx, kbfsOps.getOpsNoAdd(FolderBranch{tlf, MasterBranch}), opts)
+}
+
+func (sc *StateChecker) check(ctx context.Context, ops *folderBranchOps,
+	opts StateCheckOptions) (StateCheckReport, error) {
+	tlf := ops.id()
+	lState := makeFBOLockState()
+	if ops.blocks.GetState(lState) == dirtyState ||
+		!ops.isMasterBranch(lState) {
+		return StateCheckReport{}, StateCheckBusyError{tlf}
+	}
+
+	h, err := sc.addMergedHistoryOnline(ctx, tlf, opts)
+	if err != nil {
+		return StateCheckReport{}, err
+	}
+	if h == nil {
+		sc.log.CDebugf(ctx, "No state to check for folder %s", tlf)
+		return StateCheckReport{Tlf: tlf}, nil
+	}
+	// Quota reclamation is only tracked in tests.
+	problems := h.finish(time.Time{}, MetadataRevisionUninitialized)
+	report, err := sc.compare(ctx, ops, h, false, opts)
+	if err != nil {
+		return StateCheckReport{}, err
+	}
+	report.Problems = append(problems, report.Problems...)
+	if report.IsClean() {
+		return report, nil
+	}
+
+	// Anything written to the TLF while it was checked makes the
+	// block server disagree with the history, so only report
+	// problems if nothing was.
+	head, err := sc.config.MDOps().GetForTLF(ctx, tlf)
+	if err != nil {
+		return StateCheckReport{}, err
+	}
+	if head.Revision() != report.Revision ||
+		ops.blocks.GetState(lState) == dirtyState {
+		return StateCheckReport{}, StateCheckBusyError{tlf}
+	}
+	return report, nil
+}
+
+// CheckMergedState verifies that the state for the given tlf is
+// consistent.  It's meant for tests, since it replaces the config's
+// MD cache, and returns an error describing the first problem it
+// finds.
+func (sc *StateChecker) CheckMergedState(ctx context.Context, tlf TlfID) error {
+	// Blow away MD cache so we don't have any lingering re-embedded
+	// block changes (otherwise we won't be able to learn their sizes).
+	sc.config.SetMDCache(NewMDCacheStandard(5000))
+
+	// Fetch all the MD updates for this folder, and use the block
+	// change lists to build up the set of currently referenced blocks.
+	rmds, err := getMergedMDUpdates(ctx, sc.config, tlf,
+		MetadataRevisionInitial)
+	if err != nil {
+		return err
+	}
+	if len(rmds) == 0 {
+		sc.log.CDebugf(ctx, "No state to check for folder %s", tlf)
+		return nil
+	}
+
+	h := newStateCheckHistory()
+	for _, rmd := range rmds {
+		h.add(ctx, sc.log, rmd)
+	}
+	problems := h.finish(sc.getLastGCData(ctx, tlf))
+	if len(problems) != 0 {
+		return errors.New(problems[0].String())
+	}
+
+	kbfsOps, ok := sc.config.KBFSOps().(*KBFSOpsStandard)
+	if !ok {
+		return errors.New("Unexpected KBFSOps type")
+	}
+	ops := kbfsOps.getOpsNoAdd(FolderBranch{tlf, MasterBranch})
+	report, err := sc.compare(ctx, ops, h, true, StateCheckOptions{})
+	if err != nil {
+		return err
+	}
+	if report.IsClean() {
+		return nil
+	}
+	for _, problem := range report.Problems {
+		sc.log.CWarningf(ctx, "%v: %s", tlf, problem)
+	}
+	return fmt.Errorf("Folder %v has inconsistent state: %s",
+		tlf, report.Problems[0])
+}
+
+// stateCheckBackgroundRate is how many requests per second the
+// background state check makes, at most.
+const stateCheckBackgroundRate = 10
+
+// backgroundStateChecker checks the state of fbo's TLF every period,
+// until fbo shuts down, and logs any problems found.
+func (fbo *folderBranchOps) backgroundStateChecker(period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	sc := NewStateChecker(fbo.config)
+	for {
+		select {
+		case <-ticker.C:
+		case <-fbo.shutdownChan:
+			return
+		}
+
+		err := fbo.runUnlessShutdown(func(ctx context.Context) error {
+			ctx = ctxWithLockPriority(ctx, lockPriorityBackground)
+			report, err := sc.check(ctx, fbo, StateCheckOptions{
+				RequestsPerSecond: stateCheckBackgroundRate,
+			})
+			if err != nil {
+				return err
+			}
+			if report.IsClean() {
+				fbo.log.CDebugf(ctx, "State check of revision %d is clean",
+					report.Revision)
+				return nil
+			}
+			for _, problem := range report.Problems {
+				fbo.log.CWarningf(ctx, "State check of revision %d: %s",
+					report.Revision, problem)
+			}
+			return nil
+		})
+		if err != nil {
+			fbo.log.CDebugf(context.Background(),
+				"Couldn't check state: %v", err)
+		}
+	}
 }
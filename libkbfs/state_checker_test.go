@@ -0,0 +1,85 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateCheckerCheck(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+	ctx := BackgroundContextWithCancellationDelayer()
+	defer CleanupCancellationDelayer(ctx)
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	tlf := rootNode.GetFolderBranch().Tlf
+	kbfsOps := config.KBFSOps()
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	fileNode, _, err := kbfsOps.CreateFile(ctx, dirNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	require.NoError(t, kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0))
+
+	// Unsynced changes keep the TLF from being checked.
+	sc := NewStateChecker(config)
+	opts := StateCheckOptions{RequestsPerSecond: 1000}
+	_, err = sc.Check(ctx, tlf, opts)
+	require.Equal(t, StateCheckBusyError{tlf}, err)
+
+	require.NoError(t, kbfsOps.Sync(ctx, fileNode))
+	report, err := sc.Check(ctx, tlf, opts)
+	require.NoError(t, err)
+	require.True(t, report.IsClean(), "%v", report.Problems)
+	require.Equal(t, tlf, report.Tlf)
+	require.Equal(t, report.RevisionsChecked, int(report.Revision))
+	// The root, the directory and the file.
+	require.Equal(t, 3, report.LiveBlocks)
+	require.True(t, report.ServerChecked)
+}
+
+func TestStateCheckerCheckLeak(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "alice")
+	defer CheckConfigAndShutdown(t, config)
+	ctx := BackgroundContextWithCancellationDelayer()
+	defer CleanupCancellationDelayer(ctx)
+
+	rootNode := GetRootNodeOrBust(t, config, "alice", false)
+	tlf := rootNode.GetFolderBranch().Tlf
+	_, _, err := config.KBFSOps().CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+
+	// Put a block no MD refers to, as a sync that failed after
+	// its block puts would.
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+	data := []byte{1, 2, 3, 4}
+	id, err := config.Crypto().MakePermanentBlockID(data)
+	require.NoError(t, err)
+	bCtx := BlockContext{uid, "", zeroBlockRefNonce}
+	serverHalf, err := config.Crypto().MakeRandomBlockCryptKeyServerHalf()
+	require.NoError(t, err)
+	bserver := config.BlockServer()
+	require.NoError(t, bserver.Put(ctx, tlf, id, bCtx, data, serverHalf))
+
+	sc := NewStateChecker(config)
+	report, err := sc.Check(ctx, tlf, StateCheckOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []StateCheckProblem{{
+		Kind:   StateCheckExtraServerRef,
+		Ptr:    BlockPointer{ID: id},
+		Detail: "Unexpected live ref",
+	}}, report.Problems)
+	require.Error(t, sc.CheckMergedState(ctx, tlf))
+
+	_, err = bserver.RemoveBlockReferences(
+		ctx, tlf, map[BlockID][]BlockContext{id: {bCtx}})
+	require.NoError(t, err)
+	report, err = sc.Check(ctx, tlf, StateCheckOptions{})
+	require.NoError(t, err)
+	require.True(t, report.IsClean(), "%v", report.Problems)
+}
@@ -0,0 +1,213 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/keybase/client/go/logger"
+	"golang.org/x/net/context"
+)
+
+// LogFormat is how the body of each log message, along with the tags
+// of the context it was logged in, is written out.
+type LogFormat int
+
+const (
+	// LogFormatText writes the message as is, followed by the tags
+	// in the logger's own "[tags:...]" suffix.
+	LogFormatText LogFormat = iota
+	// LogFormatKeyValue writes the message as a quoted msg=
+	// field, followed by a key=value field for each tag.
+	LogFormatKeyValue
+	// LogFormatJSON writes the message and the tags as the fields
+	// of a JSON object.
+	LogFormatJSON
+)
+
+func (f LogFormat) String() string {
+	switch f {
+	case LogFormatText:
+		return "text"
+	case LogFormatKeyValue:
+		return "kv"
+	case LogFormatJSON:
+		return "json"
+	default:
+		return fmt.Sprintf("LogFormat(%d)", f)
+	}
+}
+
+// ParseLogFormat returns the LogFormat named by s, as returned by its
+// String method.
+func ParseLogFormat(s string) (LogFormat, error) {
+	for _, f := range []LogFormat{
+		LogFormatText, LogFormatKeyValue, LogFormatJSON} {
+		if s == f.String() {
+			return f, nil
+		}
+	}
+	return LogFormatText, fmt.Errorf("Unknown log format %q", s)
+}
+
+// logMsgKey is the field holding the message itself, in the
+// structured log formats.
+const logMsgKey = "msg"
+
+// formatStructuredLog renders the message given by fmts and args,
+// along with the log tags of ctx (which may be nil), in the given
+// structured format.
+func formatStructuredLog(format LogFormat, ctx context.Context,
+	fmts string, args []interface{}) string {
+	msg := fmt.Sprintf(fmts, args...)
+	tags := LogTagsFromContextToMap(ctx)
+	switch format {
+	case LogFormatJSON:
+		fields := make(map[string]string, len(tags)+1)
+		for tag, value := range tags {
+			fields[tag] = value
+		}
+		fields[logMsgKey] = msg
+		// Marshaling a map of strings can't fail.
+		buf, _ := json.Marshal(fields)
+		return string(buf)
+	default:
+		names := make([]string, 0, len(tags))
+		for tag := range tags {
+			names = append(names, tag)
+		}
+		sort.Strings(names)
+		fields := []string{logMsgKey + "=" + strconv.Quote(msg)}
+		for _, tag := range names {
+			value := tags[tag]
+			if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+				value = strconv.Quote(value)
+			}
+			fields = append(fields, tag+"="+value)
+		}
+		return strings.Join(fields, " ")
+	}
+}
+
+// structuredLogger is a logger.Logger that renders every message in a
+// structured LogFormat, with the tags of its context as fields,
+// before passing it on to another logger.
+type structuredLogger struct {
+	log    logger.Logger
+	format LogFormat
+}
+
+var _ logger.Logger = structuredLogger{}
+
+// NewStructuredLogger returns a logger that writes every message
+// through log, rendered in the given format.  For LogFormatText, that
+// is just log.
+func NewStructuredLogger(
+	log logger.Logger, format LogFormat) logger.Logger {
+	if format == LogFormatText {
+		return log
+	}
+	// Account for the extra call through this logger, so the right
+	// file and line still get printed.
+	return structuredLogger{log.CloneWithAddedDepth(1), format}
+}
+
+func (l structuredLogger) msg(ctx context.Context, fmts string,
+	args []interface{}) string {
+	return formatStructuredLog(l.format, ctx, fmts, args)
+}
+
+func (l structuredLogger) Debug(fmts string, args ...interface{}) {
+	l.log.Debug("%s", l.msg(nil, fmts, args))
+}
+
+func (l structuredLogger) CDebugf(ctx context.Context, fmts string,
+	args ...interface{}) {
+	l.log.Debug("%s", l.msg(ctx, fmts, args))
+}
+
+func (l structuredLogger) Info(fmts string, args ...interface{}) {
+	l.log.Info("%s", l.msg(nil, fmts, args))
+}
+
+func (l structuredLogger) CInfof(ctx context.Context, fmts string,
+	args ...interface{}) {
+	l.log.Info("%s", l.msg(ctx, fmts, args))
+}
+
+func (l structuredLogger) Notice(fmts string, args ...interface{}) {
+	l.log.Notice("%s", l.msg(nil, fmts, args))
+}
+
+func (l structuredLogger) CNoticef(ctx context.Context, fmts string,
+	args ...interface{}) {
+	l.log.Notice("%s", l.msg(ctx, fmts, args))
+}
+
+func (l structuredLogger) Warning(fmts string, args ...interface{}) {
+	l.log.Warning("%s", l.msg(nil, fmts, args))
+}
+
+func (l structuredLogger) CWarningf(ctx context.Context, fmts string,
+	args ...interface{}) {
+	l.log.Warning("%s", l.msg(ctx, fmts, args))
+}
+
+func (l structuredLogger) Error(fmts string, args ...interface{}) {
+	l.log.Error("%s", l.msg(nil, fmts, args))
+}
+
+func (l structuredLogger) Errorf(fmts string, args ...interface{}) {
+	l.log.Errorf("%s", l.msg(nil, fmts, args))
+}
+
+func (l structuredLogger) CErrorf(ctx context.Context, fmts string,
+	args ...interface{}) {
+	l.log.Errorf("%s", l.msg(ctx, fmts, args))
+}
+
+func (l structuredLogger) Critical(fmts string, args ...interface{}) {
+	l.log.Critical("%s", l.msg(nil, fmts, args))
+}
+
+func (l structuredLogger) CCriticalf(ctx context.Context, fmts string,
+	args ...interface{}) {
+	l.log.Critical("%s", l.msg(ctx, fmts, args))
+}
+
+func (l structuredLogger) Fatalf(fmts string, args ...interface{}) {
+	l.log.Fatalf("%s", l.msg(nil, fmts, args))
+}
+
+func (l structuredLogger) CFatalf(ctx context.Context, fmts string,
+	args ...interface{}) {
+	l.log.Fatalf("%s", l.msg(ctx, fmts, args))
+}
+
+func (l structuredLogger) Profile(fmts string, args ...interface{}) {
+	l.log.Profile("%s", l.msg(nil, fmts, args))
+}
+
+func (l structuredLogger) Configure(style string, debug bool,
+	filename string) {
+	l.log.Configure(style, debug, filename)
+}
+
+func (l structuredLogger) RotateLogFile() error {
+	return l.log.RotateLogFile()
+}
+
+func (l structuredLogger) CloneWithAddedDepth(depth int) logger.Logger {
+	return structuredLogger{l.log.CloneWithAddedDepth(depth), l.format}
+}
+
+func (l structuredLogger) SetExternalHandler(
+	handler logger.ExternalHandler) {
+	l.log.SetExternalHandler(handler)
+}
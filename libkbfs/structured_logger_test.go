@@ -0,0 +1,74 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestParseLogFormat(t *testing.T) {
+	for _, f := range []LogFormat{
+		LogFormatText, LogFormatKeyValue, LogFormatJSON} {
+		parsed, err := ParseLogFormat(f.String())
+		require.NoError(t, err)
+		require.Equal(t, f, parsed)
+	}
+	_, err := ParseLogFormat("xml")
+	require.Error(t, err)
+}
+
+func TestFormatStructuredLog(t *testing.T) {
+	type ctxKey int
+	ctx := logger.NewContextWithLogTags(context.Background(),
+		logger.CtxLogTags{ctxKey(0): "OPID", ctxKey(1): "FID"})
+	ctx = context.WithValue(ctx, ctxKey(0), "abc")
+	ctx = context.WithValue(ctx, ctxKey(1), "x y")
+
+	require.Equal(t, `msg="wrote 3 bytes" FID="x y" OPID=abc`,
+		formatStructuredLog(LogFormatKeyValue, ctx, "wrote %d bytes",
+			[]interface{}{3}))
+	require.Equal(t, `msg="no tags"`,
+		formatStructuredLog(LogFormatKeyValue, nil, "no tags", nil))
+
+	var fields map[string]string
+	err := json.Unmarshal([]byte(formatStructuredLog(LogFormatJSON, ctx,
+		"wrote %d bytes", []interface{}{3})), &fields)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"msg":  "wrote 3 bytes",
+		"OPID": "abc",
+		"FID":  "x y",
+	}, fields)
+}
+
+func TestKBFSOpsCtxWithOpID(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+	fs := config.KBFSOps().(*KBFSOpsStandard)
+
+	ctx1 := fs.ctxWithOpID(ctx)
+	id, ok := ctx1.Value(CtxKBFSOpsIDKey).(string)
+	require.True(t, ok)
+	require.NotEqual(t, "", id)
+	require.Equal(t, id, LogTagsFromContextToMap(ctx1)[CtxKBFSOpsOpID])
+
+	// A call made within another one keeps its ID.
+	require.Equal(t, id, fs.ctxWithOpID(ctx1).Value(CtxKBFSOpsIDKey))
+	// But every new call gets a new one.
+	require.NotEqual(t, id, fs.ctxWithOpID(ctx).Value(CtxKBFSOpsIDKey))
+
+	// Reported errors carry the ID of the call they happened in.
+	config.Reporter().ReportErr(ctx1, "", false, WriteMode,
+		NoSuchUserError{"nobody"})
+	errs := config.Reporter().AllKnownErrors()
+	require.Len(t, errs, 1)
+	require.Equal(t, id, errs[0].Tags[CtxKBFSOpsOpID])
+}
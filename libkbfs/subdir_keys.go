@@ -0,0 +1,142 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+
+	"golang.org/x/net/context"
+)
+
+// FirstSubdirKeyGen is the first key generation reserved for
+// subdirectory keys.  A block pointer with a KeyGen at or above this
+// was encrypted under a subdirectory key derived from one of the
+// TLF's real key generations, rather than under a TLF key directly.
+const FirstSubdirKeyGen KeyGen = 1 << 24
+
+// maxSubdirKeyDepth bounds how deep a chain of subdirectory keys can
+// be, so that a corrupt MD can't send key lookups around in a loop.
+const maxSubdirKeyDepth = 64
+
+const subdirKeyDerivationLabel = "Keybase-Derived-TLF-Subdir-Key-1"
+
+// TLFSubdirKeySalt makes a subdirectory key unique among the
+// children of its parent key.
+type TLFSubdirKeySalt [32]byte
+
+// TLFSubdirKeyInfo records one subdirectory key in a TLF's private
+// metadata.  The key itself is never stored: anyone who can get the
+// parent key can derive it, and in the future a subdirectory key can
+// be handed to extra readers without giving them the parent.
+type TLFSubdirKeyInfo struct {
+	// KeyGen is the key generation that block pointers use to
+	// refer to this key.  It is always at least
+	// FirstSubdirKeyGen.
+	KeyGen KeyGen `codec:"g"`
+	// Parent is the key this one is derived from: either a real
+	// TLF key generation, or another subdirectory key.
+	Parent KeyGen `codec:"p"`
+	// Salt is mixed into the derivation.
+	Salt TLFSubdirKeySalt `codec:"s"`
+	// Dir is the original pointer of the directory the key
+	// covers, for bookkeeping.
+	Dir BlockPointer `codec:"d"`
+}
+
+// DeriveTLFSubdirCryptKey derives the subdirectory key with the given
+// salt from parent, which may itself be a TLF key or a subdirectory
+// key.
+func DeriveTLFSubdirCryptKey(
+	parent TLFCryptKey, salt TLFSubdirKeySalt) TLFCryptKey {
+	mac := hmac.New(sha256.New, parent.data[:])
+	mac.Write([]byte(subdirKeyDerivationLabel))
+	mac.Write(salt[:])
+	var key TLFCryptKey
+	copy(key.data[:], mac.Sum(nil))
+	return key
+}
+
+// getSubdirKeyInfo returns the info for the subdirectory key with the
+// given key generation, if it's recorded in this MD.
+func (md *RootMetadata) getSubdirKeyInfo(keyGen KeyGen) (
+	TLFSubdirKeyInfo, bool) {
+	for _, info := range md.data.SubdirKeys {
+		if info.KeyGen == keyGen {
+			return info, true
+		}
+	}
+	return TLFSubdirKeyInfo{}, false
+}
+
+// addSubdirKey records a new subdirectory key for dir, derived from
+// parent, and returns the key generation that block pointers should
+// use to refer to it.
+func (md *RootMetadata) addSubdirKey(
+	parent KeyGen, dir BlockPointer) (KeyGen, error) {
+	if md.TlfID().IsPublic() {
+		return 0, InvalidPublicTLFOperation{md.TlfID(), "addSubdirKey"}
+	}
+	if parent < FirstSubdirKeyGen {
+		if parent < FirstValidKeyGen || parent > md.LatestKeyGeneration() {
+			return 0, InvalidKeyGenerationError{md.TlfID(), parent}
+		}
+	} else if _, ok := md.getSubdirKeyInfo(parent); !ok {
+		return 0, InvalidKeyGenerationError{md.TlfID(), parent}
+	}
+
+	info := TLFSubdirKeyInfo{
+		KeyGen: FirstSubdirKeyGen + KeyGen(len(md.data.SubdirKeys)),
+		Parent: parent,
+		Dir:    dir,
+	}
+	if err := cryptoRandRead(info.Salt[:]); err != nil {
+		return 0, err
+	}
+	md.data.SubdirKeys = append(md.data.SubdirKeys, info)
+	return info.KeyGen, nil
+}
+
+// subdirKeyMetadata is implemented by KeyMetadata objects that can
+// look up subdirectory keys.
+type subdirKeyMetadata interface {
+	getSubdirKeyInfo(keyGen KeyGen) (TLFSubdirKeyInfo, bool)
+}
+
+// getTLFSubdirCryptKey gets the subdirectory key with the given key
+// generation, by walking up to the TLF key it's ultimately derived
+// from and then deriving back down.
+func (km *KeyManagerStandard) getTLFSubdirCryptKey(ctx context.Context,
+	kmd KeyMetadata, keyGen KeyGen) (TLFCryptKey, error) {
+	skmd, ok := kmd.(subdirKeyMetadata)
+	if !ok {
+		return TLFCryptKey{}, InvalidKeyGenerationError{kmd.TlfID(), keyGen}
+	}
+
+	var salts []TLFSubdirKeySalt
+	gen := keyGen
+	for gen >= FirstSubdirKeyGen {
+		if len(salts) >= maxSubdirKeyDepth {
+			return TLFCryptKey{}, fmt.Errorf(
+				"Subdirectory key %d is nested too deeply", keyGen)
+		}
+		info, ok := skmd.getSubdirKeyInfo(gen)
+		if !ok {
+			return TLFCryptKey{}, InvalidKeyGenerationError{kmd.TlfID(), gen}
+		}
+		salts = append(salts, info.Salt)
+		gen = info.Parent
+	}
+
+	key, err := km.getTLFCryptKeyUsingCurrentDevice(ctx, kmd, gen, true)
+	if err != nil {
+		return TLFCryptKey{}, err
+	}
+	for i := len(salts) - 1; i >= 0; i-- {
+		key = DeriveTLFSubdirCryptKey(key, salts[i])
+	}
+	return key, nil
+}
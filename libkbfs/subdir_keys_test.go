@@ -0,0 +1,73 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeriveTLFSubdirCryptKey(t *testing.T) {
+	parent := MakeTLFCryptKey([32]byte{0x1})
+	var salt1, salt2 TLFSubdirKeySalt
+	salt1[0] = 0x1
+	salt2[0] = 0x2
+
+	key1 := DeriveTLFSubdirCryptKey(parent, salt1)
+	require.Equal(t, key1, DeriveTLFSubdirCryptKey(parent, salt1))
+	require.NotEqual(t, key1, DeriveTLFSubdirCryptKey(parent, salt2))
+	require.NotEqual(t, parent, key1)
+	require.NotEqual(t, key1,
+		DeriveTLFSubdirCryptKey(MakeTLFCryptKey([32]byte{0x2}), salt1))
+}
+
+func TestSubdirKeyBlockDecryption(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	dirNode, _, err := config.KBFSOps().CreateDir(ctx, rootNode, "shared")
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	md, err := ops.getHead(lState).deepCopy(config.Codec(), true)
+	require.NoError(t, err)
+	dirPtr := ops.nodeCache.PathFromNode(dirNode).tailPointer()
+
+	keyGen := md.LatestKeyGeneration()
+	subGen, err := md.addSubdirKey(keyGen, dirPtr)
+	require.NoError(t, err)
+	require.Equal(t, FirstSubdirKeyGen, subGen)
+	subSubGen, err := md.addSubdirKey(subGen, dirPtr)
+	require.NoError(t, err)
+	_, err = md.addSubdirKey(subSubGen+1, dirPtr)
+	require.IsType(t, InvalidKeyGenerationError{}, err)
+
+	// The subdirectory keys must survive a copy of the MD.
+	md, err = md.deepCopy(config.Codec(), true)
+	require.NoError(t, err)
+	require.Len(t, md.data.SubdirKeys, 2)
+
+	km := config.KeyManager()
+	tlfKey, err := km.GetTLFCryptKeyForEncryption(ctx, md)
+	require.NoError(t, err)
+	subKey, err := km.GetTLFCryptKeyForBlockDecryption(
+		ctx, md, BlockPointer{KeyGen: subGen})
+	require.NoError(t, err)
+	require.Equal(t, DeriveTLFSubdirCryptKey(
+		tlfKey, md.data.SubdirKeys[0].Salt), subKey)
+	subSubKey, err := km.GetTLFCryptKeyForBlockDecryption(
+		ctx, md, BlockPointer{KeyGen: subSubGen})
+	require.NoError(t, err)
+	require.Equal(t, DeriveTLFSubdirCryptKey(
+		subKey, md.data.SubdirKeys[1].Salt), subSubKey)
+
+	_, err = km.GetTLFCryptKeyForBlockDecryption(
+		ctx, md, BlockPointer{KeyGen: subSubGen + 1})
+	require.IsType(t, InvalidKeyGenerationError{}, err)
+}
@@ -0,0 +1,159 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// SubdirView is a view of a TLF that is rooted at one of its
+// subdirectories, for giving an app or container access to just one
+// part of a folder.  Nodes under the root are ordinary Nodes, and
+// work with KBFSOps as usual; the view translates between full TLF
+// paths and paths relative to its root.
+//
+// The view follows its root directory through renames.  Nodes that
+// have been unlinked are no longer in the view.
+type SubdirView struct {
+	config Config
+	root   Node
+}
+
+// NewSubdirView returns a view rooted at the directory at subdir, a
+// slash-separated path relative to tlfRoot (which must be the root
+// node of a TLF).  An empty subdir gives a view of the whole TLF.
+func NewSubdirView(ctx context.Context, config Config, tlfRoot Node,
+	subdir string) (*SubdirView, error) {
+	root := tlfRoot
+	for _, name := range strings.Split(subdir, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		if name == ".." {
+			return nil, errors.New("A subdirectory view can't contain \"..\"")
+		}
+		child, ei, err := config.KBFSOps().Lookup(ctx, root, name)
+		if err != nil {
+			return nil, err
+		}
+		if ei.Type != Dir {
+			p := path{FolderBranch: tlfRoot.GetFolderBranch()}
+			if child != nil {
+				p, _ = nodePath(child)
+			}
+			return nil, NotDirError{p}
+		}
+		root = child
+	}
+	return &SubdirView{config: config, root: root}, nil
+}
+
+// nodePath returns the current full path of node, if it is a node
+// from a standard node cache.
+func nodePath(node Node) (path, bool) {
+	ns, ok := node.(*nodeStandard)
+	if !ok {
+		return path{}, false
+	}
+	return ns.core.cache.PathFromNode(ns), true
+}
+
+// Root returns the node at the root of the view.
+func (v *SubdirView) Root() Node {
+	return v.root
+}
+
+// FolderBranch returns the folder-branch the view is part of.
+func (v *SubdirView) FolderBranch() FolderBranch {
+	return v.root.GetFolderBranch()
+}
+
+// RelPath returns the slash-separated path of node relative to the
+// root of the view ("" for the root itself), and false if node isn't
+// in the view.
+func (v *SubdirView) RelPath(node Node) (string, bool) {
+	rs, ok := v.root.(*nodeStandard)
+	if !ok || node.GetFolderBranch() != v.FolderBranch() {
+		return "", false
+	}
+	names, ok := rs.core.cache.relPathFromNode(v.root, node)
+	if !ok {
+		return "", false
+	}
+	return strings.Join(names, "/"), true
+}
+
+// Contains returns true if node is the root of the view, or under
+// it.
+func (v *SubdirView) Contains(node Node) bool {
+	_, ok := v.RelPath(node)
+	return ok
+}
+
+// TranslatePath converts a full path within the TLF, in the
+// "tlfname/dir/file" form that KBFSOps uses in statuses, into a path
+// relative to the root of the view.  It returns false if the path
+// isn't in the view.
+func (v *SubdirView) TranslatePath(fullPath string) (string, bool) {
+	rootPath, ok := nodePath(v.root)
+	if !ok || !rootPath.isValid() {
+		return "", false
+	}
+	prefix := rootPath.String()
+	if fullPath == prefix {
+		return "", true
+	}
+	if !strings.HasPrefix(fullPath, prefix+"/") {
+		return "", false
+	}
+	return fullPath[len(prefix)+1:], true
+}
+
+// FilterChanges returns just the changes to nodes in the view, for
+// passing along to an Observer that should only see the view.
+func (v *SubdirView) FilterChanges(changes []NodeChange) []NodeChange {
+	var filtered []NodeChange
+	for _, c := range changes {
+		if v.Contains(c.Node) {
+			filtered = append(filtered, c)
+		}
+	}
+	return filtered
+}
+
+func (v *SubdirView) translateSummaries(
+	summaries []*crChainSummary) []*crChainSummary {
+	var translated []*crChainSummary
+	for _, s := range summaries {
+		if p, ok := v.TranslatePath(s.Path); ok {
+			translated = append(translated, &crChainSummary{p, s.Ops})
+		}
+	}
+	return translated
+}
+
+// ConflictStatus returns the conflict status of the view's
+// folder-branch, with the paths in it translated into the view.
+// Changes and conflict copies outside the view are left out.
+func (v *SubdirView) ConflictStatus(ctx context.Context) (
+	ConflictStatus, error) {
+	cs, err := v.config.KBFSOps().GetConflictStatus(ctx, v.FolderBranch())
+	if err != nil {
+		return ConflictStatus{}, err
+	}
+	cs.Unmerged = v.translateSummaries(cs.Unmerged)
+	cs.Merged = v.translateSummaries(cs.Merged)
+	var files []string
+	for _, f := range cs.ConflictFiles {
+		if p, ok := v.TranslatePath(f); ok {
+			files = append(files, p)
+		}
+	}
+	cs.ConflictFiles = files
+	return cs, nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubdirView(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	a, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	b, _, err := kbfsOps.CreateDir(ctx, a, "b")
+	require.NoError(t, err)
+	f, _, err := kbfsOps.CreateFile(ctx, b, "f", false, NoExcl)
+	require.NoError(t, err)
+	x, _, err := kbfsOps.CreateFile(ctx, a, "x", false, NoExcl)
+	require.NoError(t, err)
+
+	_, err = NewSubdirView(ctx, config, rootNode, "a/x")
+	require.IsType(t, NotDirError{}, err)
+	_, err = NewSubdirView(ctx, config, rootNode, "a/../a")
+	require.Error(t, err)
+
+	view, err := NewSubdirView(ctx, config, rootNode, "/a/b/")
+	require.NoError(t, err)
+	require.Equal(t, b.GetID(), view.Root().GetID())
+	require.Equal(t, rootNode.GetFolderBranch(), view.FolderBranch())
+
+	p, ok := view.RelPath(b)
+	require.True(t, ok)
+	require.Equal(t, "", p)
+	p, ok = view.RelPath(f)
+	require.True(t, ok)
+	require.Equal(t, "f", p)
+	require.False(t, view.Contains(x))
+	require.False(t, view.Contains(a))
+
+	changes := view.FilterChanges([]NodeChange{{Node: f}, {Node: x}})
+	require.Len(t, changes, 1)
+	require.Equal(t, f.GetID(), changes[0].Node.GetID())
+
+	// The view follows its root when it's renamed.
+	err = kbfsOps.Rename(ctx, a, "b", rootNode, "c")
+	require.NoError(t, err)
+	p, ok = view.RelPath(f)
+	require.True(t, ok)
+	require.Equal(t, "f", p)
+	p, ok = view.TranslatePath("test_user/c/f")
+	require.True(t, ok)
+	require.Equal(t, "f", p)
+	_, ok = view.TranslatePath("test_user/a/b/f")
+	require.False(t, ok)
+	_, ok = view.TranslatePath("test_user/cc")
+	require.False(t, ok)
+
+	// Unlinked nodes aren't in the view anymore.
+	err = kbfsOps.RemoveEntry(ctx, view.Root(), "f")
+	require.NoError(t, err)
+	require.False(t, view.Contains(f))
+}
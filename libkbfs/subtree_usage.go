@@ -0,0 +1,314 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"golang.org/x/net/context"
+)
+
+// SubtreeUsage describes how much space a file or directory, and
+// everything under it, takes up.  It is suitable for encoding
+// directly as JSON.
+type SubtreeUsage struct {
+	// LogicalBytes is the total size of the files, as read.
+	LogicalBytes uint64
+	// BlockBytes is the total encoded size of the blocks
+	// reachable from the node, as stored on the block server.
+	BlockBytes uint64
+	// ArchivedBytes is the size of the blocks that only older
+	// revisions still reference, as unreferenced since the last
+	// quota reclamation.  Those don't belong to any one path, so
+	// it is only set for the root of a TLF.
+	ArchivedBytes uint64 `json:",omitempty"`
+
+	// CreatorBytes breaks BlockBytes down by the user who created
+	// each block, and so was charged quota for it.
+	CreatorBytes map[keybase1.UID]uint64 `json:",omitempty"`
+
+	Files    int
+	Dirs     int
+	Symlinks int
+
+	// Children breaks the usage down by each direct child of the
+	// node, if it's a directory.  Their own Children aren't set.
+	Children map[string]SubtreeUsage `json:",omitempty"`
+}
+
+func (u *SubtreeUsage) addBlock(info BlockInfo) {
+	u.BlockBytes += uint64(info.EncodedSize)
+	if u.CreatorBytes == nil {
+		u.CreatorBytes = make(map[keybase1.UID]uint64)
+	}
+	u.CreatorBytes[info.GetCreator()] += uint64(info.EncodedSize)
+}
+
+func (u *SubtreeUsage) add(other SubtreeUsage) {
+	u.LogicalBytes += other.LogicalBytes
+	u.BlockBytes += other.BlockBytes
+	if len(other.CreatorBytes) > 0 && u.CreatorBytes == nil {
+		u.CreatorBytes = make(map[keybase1.UID]uint64)
+	}
+	for uid, bytes := range other.CreatorBytes {
+		u.CreatorBytes[uid] += bytes
+	}
+	u.Files += other.Files
+	u.Dirs += other.Dirs
+	u.Symlinks += other.Symlinks
+}
+
+// subtreeUsageWalker walks the blocks under a node for
+// GetSubtreeUsage.  Block fetches are limited by sem, but only the
+// fetches, so that a directory waiting on its children doesn't hold
+// up the walk.
+type subtreeUsageWalker struct {
+	fbo *folderBranchOps
+	kmd KeyMetadata
+	sem chan struct{}
+	// beforeGet, if non-nil, is called with each block before it's
+	// fetched, while holding sem.
+	beforeGet func(ctx context.Context, info BlockInfo) error
+}
+
+func (w *subtreeUsageWalker) acquire(ctx context.Context) error {
+	select {
+	case w.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *subtreeUsageWalker) getDirBlock(
+	ctx context.Context, p path, info BlockInfo) (*DirBlock, error) {
+	if err := w.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer func() { <-w.sem }()
+	if w.beforeGet != nil {
+		if err := w.beforeGet(ctx, info); err != nil {
+			return nil, err
+		}
+	}
+	return w.fbo.blocks.GetDirBlockForReading(
+		ctx, makeFBOLockState(), w.kmd, info.BlockPointer, p.Branch, p)
+}
+
+func (w *subtreeUsageWalker) getFileBlock(
+	ctx context.Context, p path, info BlockInfo) (*FileBlock, error) {
+	if err := w.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer func() { <-w.sem }()
+	if w.beforeGet != nil {
+		if err := w.beforeGet(ctx, info); err != nil {
+			return nil, err
+		}
+	}
+	return w.fbo.blocks.GetFileBlockForReading(
+		ctx, makeFBOLockState(), w.kmd, info.BlockPointer, p.Branch, p)
+}
+
+// addFileBlocks adds the file block with the given info, and every
+// block under it, to usage.  Whether a block is indirect can't be
+// told from its pointer, so each one is fetched.
+func (w *subtreeUsageWalker) addFileBlocks(ctx context.Context, p path,
+	info BlockInfo, usage *SubtreeUsage) error {
+	usage.addBlock(info)
+	fblock, err := w.getFileBlock(ctx, p, info)
+	if err != nil {
+		return err
+	}
+	if !fblock.IsInd {
+		return nil
+	}
+	// A file with more than one level of indirect blocks comes with
+	// the pointers to the ones in between.
+	for _, parents := range fblock.parents {
+		for _, iptr := range parents {
+			usage.addBlock(iptr.BlockInfo)
+		}
+	}
+	for _, iptr := range fblock.IPtrs {
+		err := w.addFileBlocks(ctx, p, iptr.BlockInfo, usage)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dirEntries returns the entries of the directory block with the
+// given info, after adding that block and any shards of it to usage.
+func (w *subtreeUsageWalker) dirEntries(ctx context.Context, p path,
+	info BlockInfo, usage *SubtreeUsage) (map[string]DirEntry, error) {
+	usage.addBlock(info)
+	dblock, err := w.getDirBlock(ctx, p, info)
+	if err != nil {
+		return nil, err
+	}
+	// A sharded directory comes with the entries of all its shards.
+	for _, iptr := range dblock.IPtrs {
+		usage.addBlock(iptr.BlockInfo)
+	}
+	return dblock.Children, nil
+}
+
+func (w *subtreeUsageWalker) walkEntry(
+	ctx context.Context, p path, de DirEntry) (SubtreeUsage, error) {
+	switch de.Type {
+	case Dir:
+		usage, _, err := w.walkDir(ctx, p, de)
+		return usage, err
+	case Sym:
+		return SubtreeUsage{Symlinks: 1}, nil
+	default:
+		usage := SubtreeUsage{LogicalBytes: de.Size, Files: 1}
+		err := w.addFileBlocks(ctx, p, de.BlockInfo, &usage)
+		if err != nil {
+			return SubtreeUsage{}, err
+		}
+		return usage, nil
+	}
+}
+
+// walkDir returns the usage of the directory at p, and of each of its
+// children.  Children are walked in parallel.
+func (w *subtreeUsageWalker) walkDir(ctx context.Context, p path,
+	de DirEntry) (SubtreeUsage, map[string]SubtreeUsage, error) {
+	usage := SubtreeUsage{Dirs: 1}
+	entries, err := w.dirEntries(ctx, p, de.BlockInfo, &usage)
+	if err != nil {
+		return SubtreeUsage{}, nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	results := make([]SubtreeUsage, len(names))
+	errs := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		childDE := entries[name]
+		childPath := p.ChildPath(name, childDE.BlockPointer)
+		if childDE.Type == Sym {
+			// No blocks to fetch, so don't bother with a
+			// goroutine.
+			results[i], errs[i] = w.walkEntry(ctx, childPath, childDE)
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = w.walkEntry(ctx, childPath, childDE)
+		}(i)
+	}
+	wg.Wait()
+
+	children := make(map[string]SubtreeUsage, len(names))
+	for i, name := range names {
+		if errs[i] != nil {
+			return SubtreeUsage{}, nil, errs[i]
+		}
+		usage.add(results[i])
+		children[name] = results[i]
+	}
+	return usage, children, nil
+}
+
+// getArchivedBytes returns how many bytes were unreferenced by the
+// merged revisions up to head that the last quota reclamation
+// hasn't covered yet, which the block server is still keeping
+// archived.
+func (fbo *folderBranchOps) getArchivedBytes(
+	ctx context.Context, head ReadOnlyRootMetadata) (uint64, error) {
+	var bytes uint64
+	lastGCRev := MetadataRevisionUninitialized
+	currHead := head.Revision()
+	for currHead >= MetadataRevisionInitial {
+		startRev := currHead - maxMDsAtATime + 1 // (MetadataRevision is signed)
+		if startRev < MetadataRevisionInitial {
+			startRev = MetadataRevisionInitial
+		}
+		rmds, err := getMDRange(ctx, fbo.config, fbo.id(), NullBranchID,
+			startRev, currHead, Merged)
+		if err != nil {
+			return 0, err
+		}
+		if len(rmds) == 0 {
+			break
+		}
+
+		for i := len(rmds) - 1; i >= 0; i-- {
+			rmd := rmds[i]
+			if rmd.Revision() <= lastGCRev {
+				return bytes, nil
+			}
+			isGC := false
+			for _, op := range rmd.data.Changes.Ops {
+				if gco, ok := op.(*gcOp); ok {
+					isGC = true
+					if lastGCRev == MetadataRevisionUninitialized {
+						lastGCRev = gco.LatestRev
+					}
+				}
+			}
+			if !isGC {
+				bytes += rmd.UnrefBytes()
+			}
+		}
+		currHead = rmds[0].Revision() - 1
+	}
+	return bytes, nil
+}
+
+// GetSubtreeUsage implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) GetSubtreeUsage(
+	ctx context.Context, node Node) (usage SubtreeUsage, err error) {
+	fbo.log.CDebugf(ctx, "GetSubtreeUsage %p", node.GetID())
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	de, err := fbo.statEntry(ctx, node)
+	if err != nil {
+		return SubtreeUsage{}, err
+	}
+	lState := makeFBOLockState()
+	md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+	if err != nil {
+		return SubtreeUsage{}, err
+	}
+	nodePath, err := fbo.pathFromNodeForRead(node)
+	if err != nil {
+		return SubtreeUsage{}, err
+	}
+
+	w := &subtreeUsageWalker{
+		fbo: fbo,
+		kmd: md.ReadOnly(),
+		sem: make(chan struct{},
+			fbo.config.BlockTransferMeter().GetParallelism()),
+	}
+	if de.Type != Dir {
+		return w.walkEntry(ctx, nodePath, de)
+	}
+	usage, children, err := w.walkDir(ctx, nodePath, de)
+	if err != nil {
+		return SubtreeUsage{}, err
+	}
+	usage.Children = children
+	if !nodePath.hasValidParent() {
+		usage.ArchivedBytes, err = fbo.getArchivedBytes(ctx, md.ReadOnly())
+		if err != nil {
+			return SubtreeUsage{}, err
+		}
+	}
+	return usage, nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKBFSOpsGetSubtreeUsage(t *testing.T) {
+	var userName libkb.NormalizedUsername = "u1"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	// Use small blocks, so that the big file is indirect.
+	bsplitter, err := NewBlockSplitterSimple(20, 8*1024, config.Codec())
+	require.NoError(t, err)
+	config.SetBlockSplitter(bsplitter)
+
+	rootNode := GetRootNodeOrBust(t, config, userName.String(), false)
+	kbfsOps := config.KBFSOps()
+	writeFile := func(dir Node, name string, data []byte) {
+		node, _, err := kbfsOps.Lookup(ctx, dir, name)
+		if _, ok := err.(NoSuchNameError); ok {
+			node, _, err = kbfsOps.CreateFile(ctx, dir, name, false, NoExcl)
+		}
+		require.NoError(t, err)
+		require.NoError(t, kbfsOps.Truncate(ctx, node, 0))
+		require.NoError(t, kbfsOps.Write(ctx, node, data, 0))
+		require.NoError(t, kbfsOps.Sync(ctx, node))
+	}
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	writeFile(rootNode, "small", []byte("small"))
+	writeFile(dirNode, "big", make([]byte, 100))
+	writeFile(dirNode, "big", make([]byte, 150))
+	_, err = kbfsOps.CreateLink(ctx, dirNode, "link", "big")
+	require.NoError(t, err)
+
+	usage, err := kbfsOps.GetSubtreeUsage(ctx, rootNode)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5+150), usage.LogicalBytes)
+	require.Equal(t, 2, usage.Files)
+	require.Equal(t, 2, usage.Dirs)
+	require.Equal(t, 1, usage.Symlinks)
+	require.Len(t, usage.Children, 2)
+	require.Equal(t, uint64(150), usage.Children["d"].LogicalBytes)
+	require.Nil(t, usage.Children["d"].Children)
+
+	// The block bytes must match what the server actually stores
+	// for every reachable block.
+	md, err := config.KBFSOps().(*KBFSOpsStandard).
+		getOpsNoAdd(rootNode.GetFolderBranch()).
+		getMDForReadNeedIdentify(ctx, makeFBOLockState())
+	require.NoError(t, err)
+	auditor := newTLFAuditor(config, md)
+	report, err := auditor.audit(ctx, md)
+	require.NoError(t, err)
+	require.True(t, report.IsClean())
+	require.Equal(t, auditor.reachableBytes, usage.BlockBytes)
+	// A single writer created every block.
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	require.NoError(t, err)
+	require.Equal(t, map[keybase1.UID]uint64{uid: usage.BlockBytes},
+		usage.CreatorBytes)
+	// Rewriting the big file archived its old blocks.
+	require.NotZero(t, usage.ArchivedBytes)
+
+	dirUsage, err := kbfsOps.GetSubtreeUsage(ctx, dirNode)
+	require.NoError(t, err)
+	require.Equal(t, uint64(150), dirUsage.LogicalBytes)
+	require.Equal(t, usage.Children["d"].BlockBytes, dirUsage.BlockBytes)
+	require.Zero(t, dirUsage.ArchivedBytes)
+}
@@ -0,0 +1,782 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"golang.org/x/net/context"
+)
+
+const (
+	// syncRetryInterval is how long a syncer whose last pass
+	// failed waits before trying again, unless something else
+	// wakes it up first.
+	syncRetryInterval = time.Minute
+)
+
+// CtxSyncTagKey is the type used for unique context tags within
+// background sync work.
+type CtxSyncTagKey int
+
+const (
+	// CtxSyncIDKey is the type of the tag for unique operation IDs
+	// within background sync work.
+	CtxSyncIDKey CtxSyncTagKey = iota
+)
+
+// CtxSyncOpID is the display name for the unique operation sync ID
+// tag.
+const CtxSyncOpID = "SYNCID"
+
+// TLFSyncStatus describes how much of a TLF subscribed to with
+// KBFSOps.SetSyncSubscription is stored on local disk.  It is
+// suitable for encoding directly as JSON.
+type TLFSyncStatus struct {
+	// Paths are the subscribed paths, relative to the root of the
+	// TLF, which is "".
+	Paths []string
+	// Revision is the last revision whose blocks were all
+	// stored, or MetadataRevisionUninitialized if none was yet.
+	Revision MetadataRevision
+	// Syncing is whether blocks are being checked or fetched right
+	// now.
+	Syncing bool
+	// BlocksFetched is how many blocks the current pass, or the
+	// last one if none is running, fetched from the block server.
+	BlocksFetched int
+	// BytesCached is how many bytes of the blocks under Paths the
+	// current or last pass found on local disk, or fetched.
+	BytesCached uint64
+	// BytesTotal is how many bytes the blocks under Paths take
+	// up.  While a pass is running it's only an estimate, based
+	// on the last pass.
+	BytesTotal  uint64
+	PercentDone float64
+	LastError   string `json:",omitempty"`
+	// WaitingForUnmetered is whether the last pass stopped because
+	// blocks were missing while on a metered network.  Syncing
+	// picks up again once on an unmetered one.
+	WaitingForUnmetered bool `json:",omitempty"`
+}
+
+// errSyncWaitingForUnmetered stops a sync pass that would have to
+// fetch blocks over a metered network.
+var errSyncWaitingForUnmetered = errors.New(
+	"Waiting for an unmetered network to fetch blocks")
+
+// syncSubscription is what's stored on disk for each subscribed TLF,
+// so that syncing resumes after a restart.
+type syncSubscription struct {
+	Name   CanonicalTlfName
+	Public bool
+	Paths  []string
+}
+
+// syncCache keeps every block of the subscribed paths of each TLF,
+// as of its current head, in a diskBlockCache, so that they stay
+// readable while offline.  Each subscribed TLF has a tlfSyncer,
+// which walks its subscribed paths again whenever the TLF changes,
+// fetching any blocks that are missing and then dropping those no
+// longer reachable.
+type syncCache struct {
+	config Config
+	log    logger.Logger
+	cache  *diskBlockCache
+
+	lock    sync.Mutex
+	syncers map[TlfID]*tlfSyncer
+}
+
+func makeSyncCache(config Config, log logger.Logger, dir string,
+	limiter *diskLimiter) *syncCache {
+	return &syncCache{
+		config:  config,
+		log:     log,
+		cache:   makeDiskBlockCache(dir, limiter),
+		syncers: make(map[TlfID]*tlfSyncer),
+	}
+}
+
+type syncCacheGetter interface {
+	getSyncCache() *syncCache
+}
+
+// getSyncCache returns the sync cache of the given config, or nil if
+// there isn't one.
+func getSyncCache(config Config) *syncCache {
+	if getter, ok := config.(syncCacheGetter); ok {
+		return getter.getSyncCache()
+	}
+	return nil
+}
+
+func (sc *syncCache) subscriptionPath(tlfID TlfID) string {
+	return filepath.Join(sc.cache.tlfPath(tlfID), "subscription")
+}
+
+func (sc *syncCache) getSyncer(tlfID TlfID) *tlfSyncer {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	return sc.syncers[tlfID]
+}
+
+// isSubscribed returns whether any path of the given TLF is
+// subscribed to.
+func (sc *syncCache) isSubscribed(tlfID TlfID) bool {
+	return sc.getSyncer(tlfID) != nil
+}
+
+// nodeSyncPath returns the path of the given node relative to the
+// root of its TLF, as stored in subscriptions.
+func nodeSyncPath(p path) string {
+	names := make([]string, 0, len(p.path)-1)
+	for _, pn := range p.path[1:] {
+		names = append(names, pn.Name)
+	}
+	return strings.Join(names, "/")
+}
+
+// syncPathCovers returns whether subscribing to parent also covers
+// child.
+func syncPathCovers(parent, child string) bool {
+	return parent == "" || parent == child ||
+		strings.HasPrefix(child, parent+"/")
+}
+
+// setSubscription subscribes to, or unsubscribes from, the given node
+// of the TLF of fbo.  Unsubscribing from a path that isn't subscribed
+// to is a no-op, even if a path above it is.
+func (sc *syncCache) setSubscription(ctx context.Context,
+	fbo *folderBranchOps, node Node, subscribed bool) error {
+	p, err := fbo.pathFromNodeForRead(node)
+	if err != nil {
+		return err
+	}
+	pathStr := nodeSyncPath(p)
+	tlfID := fbo.id()
+
+	sc.lock.Lock()
+	s := sc.syncers[tlfID]
+	if !subscribed {
+		if s == nil || !s.removeNode(pathStr) {
+			sc.lock.Unlock()
+			return nil
+		}
+		if s.numNodes() > 0 {
+			sc.lock.Unlock()
+			s.signal(true)
+			return s.persist()
+		}
+		delete(sc.syncers, tlfID)
+		sc.lock.Unlock()
+		// The syncer's fetches go through the block server, which
+		// takes sc.lock, so it must be shut down without it.
+		sc.log.CDebugf(ctx, "No more sync subscriptions for %s", tlfID)
+		s.shutdown()
+		return sc.cache.removeTLF(tlfID)
+	}
+	defer sc.lock.Unlock()
+
+	if s == nil {
+		handle := fbo.getHead(makeFBOLockState()).GetTlfHandle()
+		s = newTLFSyncer(sc, fbo, handle.GetCanonicalName())
+		err := fbo.RegisterForChanges(s)
+		if err != nil {
+			s.cancel()
+			return err
+		}
+		sc.syncers[tlfID] = s
+	}
+	if !s.addNode(pathStr, node) {
+		return nil
+	}
+	s.signal(true)
+	return s.persist()
+}
+
+// getStatus returns the sync status of the given TLF, or false if
+// it isn't subscribed to.
+func (sc *syncCache) getStatus(tlfID TlfID) (TLFSyncStatus, bool) {
+	s := sc.getSyncer(tlfID)
+	if s == nil {
+		return TLFSyncStatus{}, false
+	}
+	return s.getStatus(), true
+}
+
+// signalWork wakes up every syncer, for instance once the block
+// server is reachable again.
+func (sc *syncCache) signalWork() {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	for _, s := range sc.syncers {
+		s.signal(false)
+	}
+}
+
+// resumeSubscriptions subscribes again to every path recorded on
+// disk.  Paths that can't be found anymore are dropped.
+func (sc *syncCache) resumeSubscriptions(ctx context.Context) {
+	fis, err := ioutil.ReadDir(sc.cache.dir)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		sc.log.CWarningf(ctx, "Couldn't list sync subscriptions: %v", err)
+		return
+	}
+	for _, fi := range fis {
+		tlfID, err := ParseTlfID(fi.Name())
+		if err != nil {
+			continue
+		}
+		err = sc.resumeSubscription(ctx, tlfID)
+		if err != nil {
+			sc.log.CWarningf(ctx,
+				"Couldn't resume sync subscription for %s: %v",
+				tlfID, err)
+		}
+	}
+}
+
+func (sc *syncCache) resumeSubscription(
+	ctx context.Context, tlfID TlfID) error {
+	buf, err := ioutil.ReadFile(sc.subscriptionPath(tlfID))
+	if os.IsNotExist(err) {
+		// Left over from an unsubscribe that didn't finish.
+		return sc.cache.removeTLF(tlfID)
+	} else if err != nil {
+		return err
+	}
+	var sub syncSubscription
+	err = sc.config.Codec().Decode(buf, &sub)
+	if err != nil {
+		return err
+	}
+
+	handle, err := ParseTlfHandle(
+		ctx, sc.config.KBPKI(), string(sub.Name), sub.Public)
+	if err != nil {
+		return err
+	}
+	kbfsOps := sc.config.KBFSOps()
+	rootNode, _, err := kbfsOps.GetRootNode(ctx, handle, MasterBranch)
+	if err != nil {
+		return err
+	}
+	if rootNode == nil {
+		return nil
+	}
+	for _, pathStr := range sub.Paths {
+		node := rootNode
+		if pathStr != "" {
+			for _, name := range strings.Split(pathStr, "/") {
+				node, _, err = kbfsOps.Lookup(ctx, node, name)
+				if err != nil {
+					break
+				}
+			}
+		}
+		if _, ok := err.(NoSuchNameError); ok {
+			sc.log.CDebugf(ctx, "Dropping sync subscription for %s/%s: %v",
+				sub.Name, pathStr, err)
+			continue
+		} else if err != nil {
+			return err
+		}
+		err = kbfsOps.SetSyncSubscription(ctx, node, true)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shutdown stops every syncer, without dropping any subscriptions.
+func (sc *syncCache) shutdown() {
+	sc.lock.Lock()
+	syncers := sc.syncers
+	sc.syncers = make(map[TlfID]*tlfSyncer)
+	sc.lock.Unlock()
+	for _, s := range syncers {
+		s.shutdown()
+	}
+}
+
+// syncCacheBlockServer serves the blocks of subscribed TLFs out of
+// the sync cache when it has them, and adds the ones it doesn't to
+// it as they're fetched or put.  It sits under the journal, if
+// there is one, but over the offline wrapper, so it keeps serving
+// while offline.
+type syncCacheBlockServer struct {
+	sc *syncCache
+	BlockServer
+}
+
+var _ BlockServer = syncCacheBlockServer{}
+
+func (s syncCacheBlockServer) Get(
+	ctx context.Context, tlfID TlfID, id BlockID, context BlockContext) (
+	[]byte, BlockCryptKeyServerHalf, error) {
+	if !s.sc.isSubscribed(tlfID) {
+		return s.BlockServer.Get(ctx, tlfID, id, context)
+	}
+
+	data, serverHalf, err := s.sc.cache.get(tlfID, id)
+	switch err.(type) {
+	case nil:
+		return data, serverHalf, nil
+	case blockNonExistentError:
+	default:
+		s.sc.log.CDebugf(ctx, "Couldn't read %s from the sync cache: %v",
+			id, err)
+	}
+
+	data, serverHalf, err = s.BlockServer.Get(ctx, tlfID, id, context)
+	if err != nil {
+		return nil, BlockCryptKeyServerHalf{}, err
+	}
+	if err := s.sc.cache.put(tlfID, id, data, serverHalf); err != nil {
+		s.sc.log.CDebugf(ctx, "Couldn't add %s to the sync cache: %v",
+			id, err)
+	}
+	return data, serverHalf, nil
+}
+
+func (s syncCacheBlockServer) Put(
+	ctx context.Context, tlfID TlfID, id BlockID, context BlockContext,
+	buf []byte, serverHalf BlockCryptKeyServerHalf) error {
+	err := s.BlockServer.Put(ctx, tlfID, id, context, buf, serverHalf)
+	if err != nil {
+		return err
+	}
+	if s.sc.isSubscribed(tlfID) {
+		if err := s.sc.cache.put(tlfID, id, buf, serverHalf); err != nil {
+			s.sc.log.CDebugf(ctx, "Couldn't add %s to the sync cache: %v",
+				id, err)
+		}
+	}
+	return nil
+}
+
+// tlfSyncer keeps the subscribed paths of one TLF synced.  It's
+// registered as an observer of the TLF, which also keeps the TLF
+// from being unloaded while subscribed.
+type tlfSyncer struct {
+	sc  *syncCache
+	fbo *folderBranchOps
+	log logger.Logger
+
+	workCh chan struct{}
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	lock   sync.Mutex
+	name   CanonicalTlfName
+	nodes  map[string]Node
+	status TLFSyncStatus
+	// force makes the next pass walk the paths even if the head
+	// hasn't changed since the last complete one.
+	force bool
+	// lastTotal is the BytesTotal of the last complete pass.
+	lastTotal uint64
+	// seen is every block the current pass has stored so far.
+	seen map[BlockID]bool
+}
+
+var _ Observer = (*tlfSyncer)(nil)
+
+func newTLFSyncer(sc *syncCache, fbo *folderBranchOps,
+	name CanonicalTlfName) *tlfSyncer {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &tlfSyncer{
+		sc:     sc,
+		fbo:    fbo,
+		log:    fbo.log,
+		workCh: make(chan struct{}, 1),
+		cancel: cancel,
+		done:   make(chan struct{}),
+		name:   name,
+		nodes:  make(map[string]Node),
+		status: TLFSyncStatus{Revision: MetadataRevisionUninitialized},
+	}
+	go s.loop(ctx)
+	return s
+}
+
+// addNode subscribes to the given path, and returns false if it was
+// already covered.  Subscribed paths under it are dropped.
+func (s *tlfSyncer) addNode(pathStr string, node Node) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for p := range s.nodes {
+		if syncPathCovers(p, pathStr) {
+			return false
+		}
+	}
+	for p := range s.nodes {
+		if syncPathCovers(pathStr, p) {
+			delete(s.nodes, p)
+		}
+	}
+	s.nodes[pathStr] = node
+	return true
+}
+
+// removeNode unsubscribes from the given path, and returns false if
+// it wasn't subscribed to.
+func (s *tlfSyncer) removeNode(pathStr string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.nodes[pathStr]; !ok {
+		return false
+	}
+	delete(s.nodes, pathStr)
+	return true
+}
+
+func (s *tlfSyncer) numNodes() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.nodes)
+}
+
+func (s *tlfSyncer) pathsLocked() []string {
+	paths := make([]string, 0, len(s.nodes))
+	for p := range s.nodes {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// persist records the subscription on disk.
+func (s *tlfSyncer) persist() error {
+	s.lock.Lock()
+	sub := syncSubscription{
+		Name:   s.name,
+		Public: s.fbo.id().IsPublic(),
+		Paths:  s.pathsLocked(),
+	}
+	s.lock.Unlock()
+
+	buf, err := s.sc.config.Codec().Encode(sub)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(s.sc.cache.tlfPath(s.fbo.id()), 0700)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.sc.subscriptionPath(s.fbo.id()), buf)
+}
+
+// signal wakes up the syncer.  If force is true, the paths are
+// walked again even if the head hasn't changed.
+func (s *tlfSyncer) signal(force bool) {
+	if force {
+		s.lock.Lock()
+		s.force = true
+		s.lock.Unlock()
+	}
+	select {
+	case s.workCh <- struct{}{}:
+	default:
+	}
+}
+
+func (s *tlfSyncer) shutdown() {
+	s.cancel()
+	<-s.done
+	if err := s.fbo.UnregisterFromChanges(s); err != nil {
+		s.log.Warning("Couldn't unregister the syncer: %v", err)
+	}
+}
+
+func (s *tlfSyncer) getStatus() TLFSyncStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	status := s.status
+	status.Paths = s.pathsLocked()
+	return status
+}
+
+// LocalChange implements the Observer interface for tlfSyncer.
+// Local changes are picked up once they're synced.
+func (s *tlfSyncer) LocalChange(
+	ctx context.Context, node Node, write WriteRange) {
+}
+
+// BatchChanges implements the Observer interface for tlfSyncer.
+func (s *tlfSyncer) BatchChanges(ctx context.Context, changes []NodeChange) {
+	s.signal(false)
+}
+
+// TlfHandleChange implements the Observer interface for tlfSyncer.
+func (s *tlfSyncer) TlfHandleChange(
+	ctx context.Context, newHandle *TlfHandle) {
+	s.lock.Lock()
+	s.name = newHandle.GetCanonicalName()
+	s.lock.Unlock()
+	if err := s.persist(); err != nil {
+		s.log.CWarningf(ctx, "Couldn't record the new TLF name: %v", err)
+	}
+}
+
+func (s *tlfSyncer) loop(ctx context.Context) {
+	defer close(s.done)
+	var retryCh <-chan time.Time
+	for {
+		select {
+		case <-s.workCh:
+		case <-retryCh:
+		case <-ctx.Done():
+			return
+		}
+		retryCh = nil
+
+		ctx := ctxWithRandomIDReplayable(ctx, CtxSyncIDKey, CtxSyncOpID,
+			s.log)
+		err := s.syncOnce(ctx)
+		if ctx.Err() != nil {
+			return
+		} else if err == errSyncWaitingForUnmetered {
+			// The sync cache signals us once on an unmetered
+			// network.
+			s.log.CDebugf(ctx, "Sync pass for %s waiting for an "+
+				"unmetered network", s.fbo.id())
+		} else if err != nil {
+			s.log.CDebugf(ctx, "Sync pass for %s failed: %v", s.fbo.id(), err)
+			retryCh = time.After(syncRetryInterval)
+		}
+	}
+}
+
+// beginPass sets up the status for a new pass over the given head,
+// and returns the nodes to walk, or false if the head was already
+// synced.
+func (s *tlfSyncer) beginPass(
+	md ImmutableRootMetadata) (map[string]Node, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.force && s.status.Revision == md.Revision() {
+		return nil, false
+	}
+	s.force = false
+	s.seen = make(map[BlockID]bool)
+	s.status.Syncing = true
+	s.status.BlocksFetched = 0
+	s.status.BytesCached = 0
+	s.updateTotalLocked()
+	nodes := make(map[string]Node, len(s.nodes))
+	for p, n := range s.nodes {
+		nodes[p] = n
+	}
+	return nodes, true
+}
+
+func (s *tlfSyncer) updateTotalLocked() {
+	s.status.BytesTotal = s.lastTotal
+	if s.status.BytesCached > s.status.BytesTotal {
+		s.status.BytesTotal = s.status.BytesCached
+	}
+	switch {
+	case s.status.BytesTotal == 0 && s.status.Syncing:
+		s.status.PercentDone = 0
+	case s.status.BytesTotal == 0:
+		s.status.PercentDone = 100
+	default:
+		s.status.PercentDone = 100 * float64(s.status.BytesCached) /
+			float64(s.status.BytesTotal)
+	}
+}
+
+// endPass records the result of a pass over the given revision.
+func (s *tlfSyncer) endPass(rev MetadataRevision, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.status.Syncing = false
+	s.status.WaitingForUnmetered = err == errSyncWaitingForUnmetered
+	switch {
+	case err == errSyncWaitingForUnmetered:
+		s.force = true
+	case err != nil:
+		// Make sure the same head gets walked again.
+		s.force = true
+		s.status.LastError = err.Error()
+	default:
+		s.status.Revision = rev
+		s.status.LastError = ""
+		s.lastTotal = s.status.BytesCached
+	}
+	s.updateTotalLocked()
+}
+
+// ensureCached stores the given block on disk, fetching it if it
+// isn't there yet.  It's called by the walker before each block is
+// read.
+func (s *tlfSyncer) ensureCached(ctx context.Context, info BlockInfo) error {
+	tlfID := s.fbo.id()
+	ok, size, err := s.sc.cache.has(tlfID, info.ID)
+	if err != nil {
+		return err
+	}
+	fetched := false
+	if !ok {
+		if s.sc.config.NetworkState() == NetworkMetered {
+			return errSyncWaitingForUnmetered
+		}
+		// Go through the whole stack, so that blocks still
+		// waiting in the journal are found too.
+		buf, serverHalf, err := s.sc.config.BlockServer().Get(
+			ctx, tlfID, info.ID, info.BlockContext)
+		if err != nil {
+			return err
+		}
+		err = s.sc.cache.put(tlfID, info.ID, buf, serverHalf)
+		if err != nil {
+			return err
+		}
+		size = int64(len(buf))
+		fetched = true
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.seen[info.ID] {
+		return nil
+	}
+	s.seen[info.ID] = true
+	s.status.BytesCached += uint64(size)
+	if fetched {
+		s.status.BlocksFetched++
+	}
+	s.updateTotalLocked()
+	return nil
+}
+
+// syncPath walks the subscribed path p, and everything under it,
+// through the given walker.  The directory blocks above p are walked
+// too, since p can't be reached without them.
+func (s *tlfSyncer) syncPath(ctx context.Context, w *subtreeUsageWalker,
+	md ImmutableRootMetadata, p path) error {
+	var usage SubtreeUsage
+	de := md.data.Dir
+	for i := 1; i < len(p.path); i++ {
+		parentPath := path{FolderBranch: p.FolderBranch, path: p.path[:i]}
+		entries, err := w.dirEntries(ctx, parentPath, de.BlockInfo, &usage)
+		if err != nil {
+			return err
+		}
+		name := p.path[i].Name
+		childDE, ok := entries[name]
+		if !ok {
+			return NoSuchNameError{name}
+		}
+		de = childDE
+	}
+	_, err := w.walkEntry(ctx, p, de)
+	return err
+}
+
+// syncOnce walks the subscribed paths as of the current head, and
+// then drops any blocks that weren't reached.
+func (s *tlfSyncer) syncOnce(ctx context.Context) (err error) {
+	md, err := s.fbo.getMDForReadNoIdentify(ctx, makeFBOLockState())
+	if err != nil {
+		return err
+	}
+	nodes, ok := s.beginPass(md)
+	if !ok {
+		return nil
+	}
+	s.log.CDebugf(ctx, "Syncing %s at revision %d", s.fbo.id(), md.Revision())
+	defer func() { s.endPass(md.Revision(), err) }()
+
+	parallelism := s.fbo.config.BlockTransferMeter().GetParallelism()
+	w := &subtreeUsageWalker{
+		fbo:       s.fbo,
+		kmd:       md.ReadOnly(),
+		sem:       make(chan struct{}, parallelism),
+		beforeGet: s.ensureCached,
+	}
+	renamed := false
+	for pathStr, node := range nodes {
+		p, err := s.fbo.pathFromNodeForRead(node)
+		if err != nil {
+			return err
+		}
+		if p.hasValidParent() && node.GetBasename() == "" {
+			s.log.CDebugf(ctx, "Dropping unlinked sync path %s", pathStr)
+			s.removeNode(pathStr)
+			renamed = true
+			continue
+		}
+		if newPathStr := nodeSyncPath(p); newPathStr != pathStr {
+			s.removeNode(pathStr)
+			s.addNode(newPathStr, node)
+			renamed = true
+		}
+		err = s.syncPath(ctx, w, md, p)
+		if err != nil {
+			return err
+		}
+	}
+	if renamed {
+		if err := s.persist(); err != nil {
+			return err
+		}
+	}
+
+	s.lock.Lock()
+	keep := s.seen
+	s.lock.Unlock()
+	_, err = s.sc.cache.prune(s.fbo.id(), keep)
+	return err
+}
+
+// SetSyncSubscription implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) SetSyncSubscription(
+	ctx context.Context, node Node, subscribed bool) (err error) {
+	fbo.log.CDebugf(ctx, "SetSyncSubscription %p %t",
+		node.GetID(), subscribed)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNode(node)
+	if err != nil {
+		return err
+	}
+	if fbo.branch() != MasterBranch {
+		return WrongOpsError{fbo.folderBranch, node.GetFolderBranch()}
+	}
+	sc := getSyncCache(fbo.config)
+	if sc == nil {
+		return SyncCacheDisabledError{}
+	}
+	return sc.setSubscription(ctx, fbo, node, subscribed)
+}
+
+// GetSyncStatus implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) GetSyncStatus(
+	ctx context.Context, folderBranch FolderBranch) (TLFSyncStatus, error) {
+	if folderBranch != fbo.folderBranch {
+		return TLFSyncStatus{}, WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+	if sc := getSyncCache(fbo.config); sc != nil {
+		if status, ok := sc.getStatus(fbo.id()); ok {
+			return status, nil
+		}
+	}
+	return TLFSyncStatus{}, NotSyncSubscribedError{fbo.id()}
+}
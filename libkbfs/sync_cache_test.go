@@ -0,0 +1,130 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// waitForSyncedRevision waits for the subscribed paths of the given
+// folder-branch to be synced up to at least the given revision.
+func waitForSyncedRevision(ctx context.Context, t *testing.T,
+	config Config, fb FolderBranch, rev MetadataRevision) TLFSyncStatus {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		status, err := config.KBFSOps().GetSyncStatus(ctx, fb)
+		require.NoError(t, err)
+		if !status.Syncing && status.Revision >= rev {
+			return status
+		}
+		require.True(t, time.Now().Before(deadline),
+			"Timed out waiting for sync: %+v", status)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestKBFSOpsSyncSubscription(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "sync_cache")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+	// Another device, for remote updates.
+	config2 := ConfigAsUser(config, "test_user")
+	defer CheckConfigAndShutdown(t, config2)
+	// The state checker needs to see the local block server.
+	bserver := config.BlockServer()
+	defer config.SetBlockServer(bserver)
+	config.SetBlockServer(NewBlockServerOffline(config, bserver))
+	config.EnableSyncCache(tempdir)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	writeFile := func(dir Node, name string, data string) Node {
+		node, _, err := kbfsOps.CreateFile(ctx, dir, name, false, NoExcl)
+		require.NoError(t, err)
+		err = kbfsOps.Write(ctx, node, []byte(data), 0)
+		require.NoError(t, err)
+		err = kbfsOps.Sync(ctx, node)
+		require.NoError(t, err)
+		return node
+	}
+	readFile := func(node Node) (string, error) {
+		buf := make([]byte, 10)
+		n, err := kbfsOps.Read(ctx, node, buf, 0)
+		return string(buf[:n]), err
+	}
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	fNode := writeFile(dirNode, "f", "hello")
+	gNode := writeFile(rootNode, "g", "world")
+
+	_, err = kbfsOps.GetSyncStatus(ctx, fb)
+	require.IsType(t, NotSyncSubscribedError{}, err)
+	err = kbfsOps.SetSyncSubscription(ctx, dirNode, true)
+	require.NoError(t, err)
+	status, _, err := kbfsOps.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	syncStatus := waitForSyncedRevision(ctx, t, config, fb, status.Revision)
+	require.Equal(t, []string{"d"}, syncStatus.Paths)
+	require.NotZero(t, syncStatus.BlocksFetched)
+	require.Equal(t, syncStatus.BytesTotal, syncStatus.BytesCached)
+	require.Equal(t, float64(100), syncStatus.PercentDone)
+	require.Empty(t, syncStatus.LastError)
+
+	// Only the subscribed path stays readable while offline.
+	config.SetOffline(true)
+	config.ResetCaches()
+	data, err := readFile(fNode)
+	require.NoError(t, err)
+	require.Equal(t, "hello", data)
+	_, err = readFile(gNode)
+	require.IsType(t, OfflineUnavailableError{}, err)
+	config.SetOffline(false)
+
+	// Remote updates get synced too.
+	kbfsOps2 := config2.KBFSOps()
+	rootNode2 := GetRootNodeOrBust(t, config2, "test_user", false)
+	dirNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "d")
+	require.NoError(t, err)
+	fNode2, _, err := kbfsOps2.Lookup(ctx, dirNode2, "f")
+	require.NoError(t, err)
+	err = kbfsOps2.Write(ctx, fNode2, []byte("HELLO"), 0)
+	require.NoError(t, err)
+	err = kbfsOps2.Sync(ctx, fNode2)
+	require.NoError(t, err)
+	err = kbfsOps.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+	status, _, err = kbfsOps.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	waitForSyncedRevision(ctx, t, config, fb, status.Revision)
+
+	config.SetOffline(true)
+	config.ResetCaches()
+	data, err = readFile(fNode)
+	require.NoError(t, err)
+	require.Equal(t, "HELLO", data)
+	config.SetOffline(false)
+
+	// Unsubscribing drops the cached blocks.
+	err = kbfsOps.SetSyncSubscription(ctx, dirNode, false)
+	require.NoError(t, err)
+	_, err = kbfsOps.GetSyncStatus(ctx, fb)
+	require.IsType(t, NotSyncSubscribedError{}, err)
+	fis, err := ioutil.ReadDir(tempdir)
+	require.NoError(t, err)
+	require.Len(t, fis, 0)
+}
@@ -0,0 +1,66 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package test
+
+import (
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+func normalizedUsernames(users []string) []libkb.NormalizedUsername {
+	names := make([]libkb.NormalizedUsername, 0, len(users))
+	for _, user := range users {
+		names = append(names, libkb.NewNormalizedUsername(user))
+	}
+	return names
+}
+
+// MakeConfig returns a config with in-memory servers, that knows
+// about the given users and is logged in as the first of them.  It
+// logs to t, and fails it if anything goes wrong.  Background
+// flushes and quota reclamation are off, as they are in libkbfs's
+// own tests, so writes are only sent to the servers by Sync.
+func MakeConfig(t logger.TestLogBackend,
+	users ...string) *libkbfs.ConfigLocal {
+	if len(users) == 0 {
+		t.Fatal("MakeConfig needs at least one user")
+	}
+	return libkbfs.MakeTestConfigOrBust(t, normalizedUsernames(users)...)
+}
+
+// ConfigAsUser returns a config that shares config's servers, and
+// is logged in as user instead.  user must be one of the users
+// config was made with.
+func ConfigAsUser(config *libkbfs.ConfigLocal,
+	user string) *libkbfs.ConfigLocal {
+	return libkbfs.ConfigAsUser(config, libkb.NewNormalizedUsername(user))
+}
+
+// CheckAndShutdown shuts config down, failing t if it can't.  Before
+// the last config sharing a set of servers shuts down, each TLF it
+// used has its server-side state checked, as
+// libkbfs.StateChecker.CheckMergedState does, and any inconsistency
+// fails t too.
+func CheckAndShutdown(t logger.TestLogBackend, config libkbfs.Config) {
+	libkbfs.CheckConfigAndShutdown(t, config)
+}
+
+// RootNode returns the root node of the TLF with the given
+// canonical name, as seen by config, creating the TLF if needed.
+func RootNode(t logger.TestLogBackend, config libkbfs.Config,
+	name string, public bool) libkbfs.Node {
+	return libkbfs.GetRootNodeOrBust(t, config, name, public)
+}
+
+// Context returns a context for calling KBFSOps methods with, and a
+// function to call when done with it.  Syncs and other writes need
+// their contexts to delay cancellation, as the mounted file systems
+// arrange, and fail with plain contexts.
+func Context() (ctx context.Context, done func()) {
+	ctx = libkbfs.BackgroundContextWithCancellationDelayer()
+	return ctx, func() { libkbfs.CleanupCancellationDelayer(ctx) }
+}
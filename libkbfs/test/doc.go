@@ -0,0 +1,24 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// Package test helps projects that embed libkbfs write integration
+// tests against a full KBFS stack, running entirely in memory.  It
+// wraps the helpers libkbfs's own tests use, which may change
+// between releases, in an API that won't: functions here only ever
+// gain options, and keep their behavior.
+//
+// A typical test makes a Cluster of users sharing in-memory servers,
+// and works with each user's Config and TLF root nodes:
+//
+//	c := test.NewCluster(t, test.ClusterOptions{}, "alice", "bob")
+//	defer c.Shutdown()
+//	ctx, cancel := test.Context()
+//	defer cancel()
+//	root := c.Root("alice", "alice,bob", false)
+//	...
+//
+// Stallers stop chosen MD or block server calls, so tests can make
+// things happen while one is in flight, and SimulateNetwork slows
+// the in-memory servers down and makes them fail.
+package test
@@ -0,0 +1,135 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// ClusterOptions control how NewCluster sets up its users.
+type ClusterOptions struct {
+	// Journal, if set, gives each user a write journal in a
+	// temporary directory, removed on Shutdown.  Writes then reach
+	// the servers in the background, and Sync waits for them.
+	Journal bool
+	// BackgroundFlushes, if set, has each user flush dirty data in
+	// the background, as real clients do, instead of only on Sync.
+	BackgroundFlushes bool
+	// Clock, if non-nil, is the clock every user's config uses.
+	Clock libkbfs.Clock
+}
+
+// Cluster is a set of users, each logged in on their own config,
+// that share one set of in-memory servers: a whole KBFS deployment
+// in one process.
+type Cluster struct {
+	t          logger.TestLogBackend
+	users      []string
+	configs    map[string]*libkbfs.ConfigLocal
+	journalDir string
+}
+
+// NewCluster returns a Cluster of the given users, which must be at
+// least one.  It fails t if anything goes wrong.
+func NewCluster(t logger.TestLogBackend, opts ClusterOptions,
+	users ...string) *Cluster {
+	c := &Cluster{
+		t:       t,
+		users:   users,
+		configs: make(map[string]*libkbfs.ConfigLocal, len(users)),
+	}
+	config := MakeConfig(t, users...)
+	c.configs[users[0]] = config
+	for _, user := range users[1:] {
+		c.configs[user] = ConfigAsUser(config, user)
+	}
+
+	if opts.Journal {
+		dir, err := ioutil.TempDir(os.TempDir(), "kbfs_cluster_journal")
+		if err != nil {
+			t.Fatalf("Couldn't make a journal directory: %v", err)
+		}
+		c.journalDir = dir
+	}
+	for user, config := range c.configs {
+		if opts.Clock != nil {
+			config.SetClock(opts.Clock)
+		}
+		if opts.BackgroundFlushes {
+			config.SetDoBackgroundFlushes(true)
+		}
+		if c.journalDir != "" {
+			config.EnableJournaling(filepath.Join(c.journalDir, user))
+		}
+	}
+	return c
+}
+
+// Users returns the users of c, in the order NewCluster got them.
+func (c *Cluster) Users() []string {
+	return append([]string(nil), c.users...)
+}
+
+// Config returns the config user is logged in on.
+func (c *Cluster) Config(user string) *libkbfs.ConfigLocal {
+	config, ok := c.configs[user]
+	if !ok {
+		c.t.Fatalf("%s isn't in the cluster", user)
+	}
+	return config
+}
+
+// Root returns the root node of the TLF with the given canonical
+// name, as user sees it, creating the TLF if needed.
+func (c *Cluster) Root(user, name string, public bool) libkbfs.Node {
+	return RootNode(c.t, c.Config(user), name, public)
+}
+
+// Sync makes every change user has made to the TLF with the given
+// canonical name visible on the servers, flushing user's journal if
+// it has one, and then brings every other user's view of the TLF up
+// to date.  Files with unsynced writes must be synced first.
+func (c *Cluster) Sync(ctx context.Context, user, name string,
+	public bool) error {
+	fb := c.Root(user, name, public).GetFolderBranch()
+	config := c.Config(user)
+	err := libkbfs.WaitForTLFJournal(
+		ctx, config, fb.Tlf, config.MakeLogger(""))
+	if err != nil {
+		return err
+	}
+	for _, other := range c.users {
+		if other == user {
+			continue
+		}
+		fb := c.Root(other, name, public).GetFolderBranch()
+		err := c.configs[other].KBFSOps().SyncFromServerForTesting(ctx, fb)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Shutdown shuts down every user's config, last user first, failing
+// c's test if any of them can't shut down cleanly, or finds its TLFs
+// in an inconsistent state on the way.  It then removes the
+// journals, if any.
+func (c *Cluster) Shutdown() {
+	for i := len(c.users) - 1; i >= 0; i-- {
+		CheckAndShutdown(c.t, c.configs[c.users[i]])
+	}
+	if c.journalDir != "" {
+		if err := os.RemoveAll(c.journalDir); err != nil {
+			c.t.Errorf("Couldn't remove %s: %v", c.journalDir, err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/stretchr/testify/require"
+)
+
+func testClusterWriteAndRead(t *testing.T, opts ClusterOptions) {
+	c := NewCluster(t, opts, "alice", "bob")
+	defer c.Shutdown()
+	ctx, done := Context()
+	defer done()
+	require.Equal(t, []string{"alice", "bob"}, c.Users())
+
+	name := "alice,bob"
+	kbfsOps1 := c.Config("alice").KBFSOps()
+	fileNode1, _, err := kbfsOps1.CreateFile(
+		ctx, c.Root("alice", name, false), "a", false, libkbfs.NoExcl)
+	require.NoError(t, err)
+	data := []byte{1, 2, 3}
+	require.NoError(t, kbfsOps1.Write(ctx, fileNode1, data, 0))
+	require.NoError(t, kbfsOps1.Sync(ctx, fileNode1))
+	require.NoError(t, c.Sync(ctx, "alice", name, false))
+
+	kbfsOps2 := c.Config("bob").KBFSOps()
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, c.Root("bob", name, false), "a")
+	require.NoError(t, err)
+	buf := make([]byte, len(data))
+	n, err := kbfsOps2.Read(ctx, fileNode2, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, data, buf[:n])
+}
+
+func TestClusterWriteAndRead(t *testing.T) {
+	testClusterWriteAndRead(t, ClusterOptions{})
+}
+
+func TestClusterWriteAndReadJournal(t *testing.T) {
+	clock := &libkbfs.TestClock{}
+	clock.Set(time.Now())
+	testClusterWriteAndRead(t, ClusterOptions{
+		Journal:           true,
+		BackgroundFlushes: true,
+		Clock:             clock,
+	})
+}
+
+func TestStallMDOp(t *testing.T) {
+	config := MakeConfig(t, "alice")
+	defer CheckAndShutdown(t, config)
+	ctx, done := Context()
+	defer done()
+	root := RootNode(t, config, "alice", false)
+
+	onStalled, unstall, stallCtx := StallMDOp(
+		ctx, config, StallableMDPut, 1)
+	errChan := make(chan error, 1)
+	go func() {
+		_, _, err := config.KBFSOps().CreateDir(stallCtx, root, "a")
+		errChan <- err
+	}()
+	<-onStalled
+	select {
+	case err := <-errChan:
+		t.Fatalf("CreateDir finished while stalled: %v", err)
+	default:
+	}
+	unstall <- struct{}{}
+	require.NoError(t, <-errChan)
+}
+
+func TestSimulateNetwork(t *testing.T) {
+	config := MakeConfig(t, "alice")
+	defer CheckAndShutdown(t, config)
+	ctx, done := Context()
+	defer done()
+
+	md, block := SimulateNetwork(config, 1, libkbfs.NetworkProfile{})
+	require.NotNil(t, md)
+	require.NotNil(t, block)
+	root := RootNode(t, config, "alice", false)
+	_, _, err := config.KBFSOps().CreateDir(ctx, root, "a")
+	require.NoError(t, err)
+	require.True(t, md.Stats()["Put"].Calls > 0)
+	require.True(t, block.Stats()["Put"].Calls > 0)
+}
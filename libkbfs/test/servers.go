@@ -0,0 +1,44 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package test
+
+import (
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+// MDServer returns config's in-memory MD server, or nil if it
+// doesn't use one.  Configs made by MakeConfig use one unless the
+// KEYBASE_TEST_MDSERVER_ADDR environment variable says otherwise.
+func MDServer(config libkbfs.Config) *libkbfs.MDServerMemory {
+	mdServer, _ := config.MDServer().(*libkbfs.MDServerMemory)
+	return mdServer
+}
+
+// BlockServer returns config's in-memory block server, or nil if it
+// doesn't use one.  Configs made by MakeConfig use one unless the
+// KEYBASE_TEST_BSERVER_ADDR environment variable says otherwise.
+func BlockServer(config libkbfs.Config) *libkbfs.BlockServerMemory {
+	bServer, _ := config.BlockServer().(*libkbfs.BlockServerMemory)
+	return bServer
+}
+
+// SimulateNetwork makes the calls config's in-memory servers get
+// take the time, and fail at the rate, that profile says.  Configs
+// that share the servers are affected too.  It returns the
+// simulators for the MD and block servers, from which the traffic
+// can be read and the profile changed, or nil for a server that
+// isn't in memory.
+func SimulateNetwork(config libkbfs.Config, seed int64,
+	profile libkbfs.NetworkProfile) (md, block *libkbfs.NetworkSimulator) {
+	if mdServer := MDServer(config); mdServer != nil {
+		md = libkbfs.NewNetworkSimulator(seed, profile)
+		mdServer.SetNetworkSimulator(md)
+	}
+	if bServer := BlockServer(config); bServer != nil {
+		block = libkbfs.NewNetworkSimulator(seed, profile)
+		bServer.SetNetworkSimulator(block)
+	}
+	return md, block
+}
@@ -0,0 +1,57 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package test
+
+import (
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// The block server calls a staller can stop.
+const (
+	StallableBlockGet = libkbfs.StallableBlockGet
+	StallableBlockPut = libkbfs.StallableBlockPut
+)
+
+// The MD calls a staller can stop.
+const (
+	StallableMDGetForHandle          = libkbfs.StallableMDGetForHandle
+	StallableMDGetForTLF             = libkbfs.StallableMDGetForTLF
+	StallableMDGetLatestHandleForTLF = libkbfs.StallableMDGetLatestHandleForTLF
+	StallableMDGetUnmergedForTLF     = libkbfs.StallableMDGetUnmergedForTLF
+	StallableMDGetRange              = libkbfs.StallableMDGetRange
+	StallableMDGetUnmergedRange      = libkbfs.StallableMDGetUnmergedRange
+	StallableMDPut                   = libkbfs.StallableMDPut
+	StallableMDAfterPut              = libkbfs.StallableMDAfterPut
+	StallableMDPutUnmerged           = libkbfs.StallableMDPutUnmerged
+	StallableMDAfterPutUnmerged      = libkbfs.StallableMDAfterPutUnmerged
+	StallableMDPruneBranch           = libkbfs.StallableMDPruneBranch
+)
+
+// NewStaller returns a staller that can stop any of config's calls
+// of a chosen kind, whatever context they're made with.
+func NewStaller(config libkbfs.Config) *libkbfs.NaïveStaller {
+	return libkbfs.NewNaïveStaller(config)
+}
+
+// StallBlockOp stops config's block server calls of the given kind,
+// made with the returned context, up to maxStalls at a time.  Each
+// stalled call sends on onStalled, and waits for a send on unstall.
+func StallBlockOp(ctx context.Context, config libkbfs.Config,
+	op libkbfs.StallableBlockOp, maxStalls int) (
+	onStalled <-chan struct{}, unstall chan<- struct{},
+	newCtx context.Context) {
+	return libkbfs.StallBlockOp(ctx, config, op, maxStalls)
+}
+
+// StallMDOp stops config's MD calls of the given kind, made with the
+// returned context, up to maxStalls at a time.  Each stalled call
+// sends on onStalled, and waits for a send on unstall.
+func StallMDOp(ctx context.Context, config libkbfs.Config,
+	op libkbfs.StallableMDOp, maxStalls int) (
+	onStalled <-chan struct{}, unstall chan<- struct{},
+	newCtx context.Context) {
+	return libkbfs.StallMDOp(ctx, config, op, maxStalls)
+}
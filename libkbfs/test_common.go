@@ -221,17 +221,25 @@ func ConfigAsUser(config *ConfigLocal, loggedInUser libkb.NormalizedUsername) *C
 	crypto := NewCryptoLocal(config.Codec(), signingKey, cryptPrivateKey)
 	c.SetCrypto(crypto)
 	c.noBGFlush = config.noBGFlush
-
-	if s, ok := config.BlockServer().(*BlockServerRemote); ok {
+	c.bgFlushAge = config.BackgroundFlushAge()
+	c.mdCoalesce = config.MDCoalesceWindow()
+	c.readahead = config.MaxReadaheadBlocks()
+	c.bxfers.SetParallelism(
+		config.BlockTransferMeter().ConfiguredParallelism())
+
+	// The new config shares the servers of config, but not its
+	// journal or offline mode, so look past their wrappers.
+	bserver := unwrapBlockServer(config.BlockServer())
+	if s, ok := bserver.(*BlockServerRemote); ok {
 		blockServer := NewBlockServerRemote(c, s.RemoteAddress(), env.NewContext())
 		c.SetBlockServer(blockServer)
 	} else {
-		c.SetBlockServer(config.BlockServer())
+		c.SetBlockServer(bserver)
 	}
 
 	var mdServer MDServer
 	var keyServer KeyServer
-	if s, ok := config.MDServer().(*MDServerRemote); ok {
+	if s, ok := unwrapMDServer(config.MDServer()).(*MDServerRemote); ok {
 		// connect to server
 		mdServer = NewMDServerRemote(c, s.RemoteAddress(), env.NewContext())
 		// for now the MD server also acts as the key server.
@@ -240,7 +248,7 @@ func ConfigAsUser(config *ConfigLocal, loggedInUser libkb.NormalizedUsername) *C
 		// copy the existing mdServer but update the config
 		// this way the current device KID is paired with
 		// the proper user yet the DB state is all shared.
-		mdServerToCopy := config.MDServer().(mdServerLocal)
+		mdServerToCopy := unwrapMDServer(config.MDServer()).(mdServerLocal)
 		mdServer = mdServerToCopy.copy(mdServerLocalConfigAdapter{c})
 
 		// use the same db but swap configs
@@ -395,7 +403,7 @@ func AddNewAssertionForTest(
 	}
 
 	// Let the mdserver know about the name change
-	md, ok := config.MDServer().(mdServerLocal)
+	md, ok := unwrapMDServer(config.MDServer()).(mdServerLocal)
 	if !ok {
 		return errors.New("Bad md server")
 	}
@@ -456,6 +464,20 @@ func DisableUpdatesForTesting(config Config, folderBranch FolderBranch) (
 	return c, nil
 }
 
+// GetFolderBranchOpsStateForTesting returns a snapshot of the
+// internal state of the given folder-branch; see
+// FolderBranchOpsState.
+func GetFolderBranchOpsStateForTesting(config Config,
+	folderBranch FolderBranch) (FolderBranchOpsState, error) {
+	kbfsOps, ok := config.KBFSOps().(*KBFSOpsStandard)
+	if !ok {
+		return FolderBranchOpsState{}, errors.New("Unexpected KBFSOps type")
+	}
+
+	ops := kbfsOps.getOpsNoAdd(folderBranch)
+	return ops.getStateForTesting(), nil
+}
+
 // DisableCRForTesting stops conflict resolution for the given folder.
 // RestartCRForTesting should be called to restart it.
 func DisableCRForTesting(config Config, folderBranch FolderBranch) error {
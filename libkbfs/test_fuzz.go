@@ -0,0 +1,170 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"runtime/debug"
+)
+
+// The functions below are fuzzing targets for the decoders of data
+// that KBFS gets from servers or reads back from its journals, where
+// a compromised server or a corrupted disk could hand it anything.
+// Each decodes its input and runs the checks done on the result
+// before it's trusted, and returns an error if the input is
+// malformed.  None of them may panic on any input.  They're run by
+// go-fuzz through the wrappers in fuzz.go, and on a seed corpus by
+// the tests.
+
+// fuzzCodec returns a codec set up like the one in ConfigLocal.
+func fuzzCodec() Codec {
+	codec := NewCodecMsgpack()
+	RegisterOps(codec)
+	return codec
+}
+
+// fuzzRootMetadataSigned decodes data as a signed MD object of the
+// given version, the way MDServerRemote does, and checks it the way
+// MDOpsStandard does before verifying its keys.
+func fuzzRootMetadataSigned(ver MetadataVer, data []byte) error {
+	codec := fuzzCodec()
+	crypto := MakeCryptoCommon(codec)
+	rmds, err := DecodeRootMetadataSigned(
+		codec, FakeTlfID(1, false), ver, ver, data)
+	if err != nil {
+		return err
+	}
+	// Public V3 TLFs, and all V2 ones, don't need key bundles to
+	// make a handle.
+	if _, err := rmds.MD.MakeBareTlfHandle(nil); err != nil {
+		return err
+	}
+	if err := rmds.IsValidAndSigned(codec, crypto, nil); err != nil {
+		return err
+	}
+	_, err = crypto.MakeMdID(rmds.MD)
+	return err
+}
+
+// fuzzBlock decodes data as a padded, but unencrypted, block of each
+// type, the way CryptoCommon.DecryptBlock does.
+func fuzzBlock(data []byte) error {
+	crypto := MakeCryptoCommon(fuzzCodec())
+	var lastErr error
+	for _, block := range []Block{NewFileBlock(), NewDirBlock()} {
+		err := crypto.decodePaddedBlock(data, block)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		block.DataVersion()
+	}
+	return lastErr
+}
+
+// fuzzJournalEntry decodes data as each kind of journal entry, and
+// checks it the way the journals do when reading it back.
+func fuzzJournalEntry(data []byte) error {
+	codec := fuzzCodec()
+	var firstErr error
+	for _, decode := range []func() error{
+		func() error {
+			j := makeDiskJournal(
+				codec, "", reflect.TypeOf(blockJournalEntry{}))
+			entry, err := j.decodeJournalEntry("", data)
+			if err != nil {
+				return err
+			}
+			return entry.(blockJournalEntry).check()
+		},
+		func() error {
+			j := makeDiskJournal(codec, "", reflect.TypeOf(MdID{}))
+			_, err := j.decodeJournalEntry("", data)
+			return err
+		},
+		func() error {
+			var entry CRJournalEntry
+			return codec.Decode(data, &entry)
+		},
+		func() error {
+			_, err := decodeJournalMD(codec, "", data)
+			return err
+		},
+	} {
+		if err := decode(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// fuzzTargets are all the fuzzing targets, by name.
+var fuzzTargets = map[string]func(data []byte) error{
+	"RootMetadataSignedV2": func(data []byte) error {
+		return fuzzRootMetadataSigned(PreExtraMetadataVer, data)
+	},
+	"RootMetadataSignedV3": func(data []byte) error {
+		return fuzzRootMetadataSigned(SegregatedKeyBundlesVer, data)
+	},
+	"Block":        fuzzBlock,
+	"JournalEntry": fuzzJournalEntry,
+}
+
+// fuzzMutate returns a copy of data with a few random bytes
+// changed, inserted, removed, or copied from elsewhere in it.
+func fuzzMutate(rng *rand.Rand, data []byte) []byte {
+	out := append([]byte(nil), data...)
+	for n := 1 + rng.Intn(4); n > 0; n-- {
+		if len(out) == 0 {
+			out = append(out, byte(rng.Intn(256)))
+			continue
+		}
+		i := rng.Intn(len(out))
+		switch rng.Intn(5) {
+		case 0:
+			out[i] = byte(rng.Intn(256))
+		case 1:
+			out[i] ^= 1 << uint(rng.Intn(8))
+		case 2:
+			out = append(out[:i], append(
+				[]byte{byte(rng.Intn(256))}, out[i:]...)...)
+		case 3:
+			out = append(out[:i], out[i+1:]...)
+		case 4:
+			j := rng.Intn(len(out))
+			copy(out[i:], out[j:j+rng.Intn(len(out)-j)+1])
+		}
+	}
+	return out
+}
+
+// runFuzzTarget runs the named target on data and mutations of it,
+// and returns an error describing the first input it panics on.
+func runFuzzTarget(name string, seed int64, mutations int,
+	corpus ...[]byte) (err error) {
+	target, ok := fuzzTargets[name]
+	if !ok {
+		return fmt.Errorf("No fuzzing target %s", name)
+	}
+	rng := rand.New(rand.NewSource(seed))
+	var input []byte
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s panicked on %x: %v\n%s",
+				name, input, r, debug.Stack())
+		}
+	}()
+	for _, data := range corpus {
+		input = data
+		_ = target(input)
+		for i := 0; i < mutations; i++ {
+			input = fuzzMutate(rng, data)
+			_ = target(input)
+		}
+	}
+	return nil
+}
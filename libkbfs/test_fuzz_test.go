@@ -0,0 +1,158 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// fuzzMutations is how many mutations of each seed input the tests
+// run the fuzzing targets on.
+const fuzzMutations = 2000
+
+// makeFuzzRMDSSeed returns an encoded, validly-signed MD object for
+// md, which should be empty.
+func makeFuzzRMDSSeed(t *testing.T, config Config,
+	md MutableBareRootMetadata, public bool) []byte {
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(context.Background())
+	require.NoError(t, err)
+	var readers []keybase1.UID
+	if public {
+		readers = []keybase1.UID{keybase1.PublicUID}
+	}
+	h, err := MakeBareTlfHandle(
+		[]keybase1.UID{uid}, readers, nil, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, md.Update(FakeTlfID(1, public), h))
+	md.SetSerializedPrivateMetadata([]byte{0x1})
+	md.SetRevision(MetadataRevisionInitial + 1)
+	md.SetLastModifyingWriter(uid)
+	md.SetLastModifyingUser(uid)
+	md.SetPrevRoot(fakeMdID(1))
+	if !public {
+		_, err = md.FakeInitialRekey(config.Codec(), h)
+		require.NoError(t, err)
+	}
+	rmds := &RootMetadataSigned{MD: md}
+	signRMDSForTest(t, config.Codec(), config.Crypto(), rmds)
+	buf, err := config.Codec().Encode(rmds)
+	require.NoError(t, err)
+	return buf
+}
+
+func TestFuzzRootMetadataSigned(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "alice")
+	defer config.Shutdown()
+
+	v2 := makeFuzzRMDSSeed(t, config, &BareRootMetadataV2{}, false)
+	require.NoError(t, fuzzTargets["RootMetadataSignedV2"](v2))
+	v2Public := makeFuzzRMDSSeed(t, config, &BareRootMetadataV2{}, true)
+	require.NoError(t, fuzzTargets["RootMetadataSignedV2"](v2Public))
+	require.NoError(t, runFuzzTarget(
+		"RootMetadataSignedV2", 1, fuzzMutations, v2, v2Public))
+
+	// V3 MDs can't be checked fully without their key bundles, but
+	// this one must at least decode.
+	v3 := makeFuzzRMDSSeed(t, config, &BareRootMetadataV3{}, true)
+	_, err := DecodeRootMetadataSigned(config.Codec(), FakeTlfID(1, true),
+		SegregatedKeyBundlesVer, SegregatedKeyBundlesVer, v3)
+	require.NoError(t, err)
+	require.NoError(t, runFuzzTarget(
+		"RootMetadataSignedV3", 1, fuzzMutations, v3, v2))
+
+	// Garbage decodes to an error of the right type.
+	err = fuzzTargets["RootMetadataSignedV2"]([]byte{0xc1})
+	require.IsType(t, MDDecodeError{}, err)
+	// An unknown field that claims to be huge doesn't make the
+	// decoder allocate that much.
+	err = fuzzTargets["RootMetadataSignedV2"]([]byte{
+		0x81, 0xa1, 'x', 0xc6, 0x7f, 0xff, 0xff, 0xff})
+	require.IsType(t, MDDecodeError{}, err)
+	require.Equal(t, io.ErrUnexpectedEOF, err.(MDDecodeError).Err)
+}
+
+func TestFuzzBlock(t *testing.T) {
+	codec := fuzzCodec()
+	crypto := MakeCryptoCommon(codec)
+	var seeds [][]byte
+	for _, block := range []Block{
+		&FileBlock{Contents: []byte{1, 2, 3}},
+		&FileBlock{
+			CommonBlock: CommonBlock{IsInd: true},
+			IPtrs: []IndirectFilePtr{{
+				BlockInfo: BlockInfo{
+					BlockPointer: BlockPointer{ID: fakeBlockID(1)},
+				},
+				Off:   0,
+				Holes: true,
+			}},
+		},
+		&DirBlock{Children: map[string]DirEntry{
+			"a": {EntryInfo: EntryInfo{Type: File, Size: 3}},
+		}},
+	} {
+		encoded, err := codec.Encode(block)
+		require.NoError(t, err)
+		padded, err := crypto.padBlock(encoded)
+		require.NoError(t, err)
+		seeds = append(seeds, padded)
+	}
+	require.NoError(t, runFuzzTarget("Block", 1, fuzzMutations, seeds...))
+
+	err := fuzzBlock([]byte{1, 2})
+	require.IsType(t, PaddedBlockReadError{}, err)
+}
+
+func TestFuzzJournalEntry(t *testing.T) {
+	codec := fuzzCodec()
+	var seeds [][]byte
+	for _, entry := range []interface{}{
+		blockJournalEntry{
+			Op: blockPutOp,
+			Contexts: map[BlockID][]BlockContext{
+				fakeBlockID(1): {
+					BlockContext{Creator: keybase1.MakeTestUID(1)},
+				},
+			},
+		},
+		blockJournalEntry{
+			Op: removeRefsOp,
+			Contexts: map[BlockID][]BlockContext{
+				fakeBlockID(1): nil,
+			},
+		},
+		fakeMdID(1),
+		CRJournalEntry{
+			Tlf:    FakeTlfID(1, false),
+			Blocks: []BlockPointer{{ID: fakeBlockID(1)}},
+		},
+		BareRootMetadataV2{
+			WriterMetadataV2: WriterMetadataV2{ID: FakeTlfID(1, false)},
+		},
+	} {
+		buf, err := codec.Encode(entry)
+		require.NoError(t, err)
+		seeds = append(seeds, buf)
+	}
+	require.NoError(t, runFuzzTarget(
+		"JournalEntry", 1, fuzzMutations, seeds...))
+
+	// An entry for an unknown op is caught when it's read back.
+	buf, err := codec.Encode(blockJournalEntry{Op: 17})
+	require.NoError(t, err)
+	j := makeDiskJournal(codec, "", reflect.TypeOf(blockJournalEntry{}))
+	entry, err := j.decodeJournalEntry("", buf)
+	require.NoError(t, err)
+	require.Error(t, entry.(blockJournalEntry).check())
+
+	_, err = j.decodeJournalEntry("0", []byte{0xc1})
+	require.IsType(t, JournalEntryDecodeError{}, err)
+}
@@ -0,0 +1,494 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// simMaxStepsDefault is how many scheduling decisions a
+	// Simulation makes before giving up on a run that doesn't end.
+	simMaxStepsDefault = 100000
+	// simStuckTimeoutDefault is how long, in real time, a
+	// Simulation waits for a running thread to reach its next point
+	// before deciding it's blocked on something the simulation
+	// can't see.
+	simStuckTimeoutDefault = 10 * time.Second
+)
+
+type simThreadState int
+
+const (
+	// simRunning threads are between points.
+	simRunning simThreadState = iota
+	// simRunnable threads wait at a point for their turn.
+	simRunnable
+	// simBlocked threads wait for a mutex another thread holds.
+	simBlocked
+	// simSleeping threads wait for the virtual clock to reach
+	// wakeAt.
+	simSleeping
+	simDone
+)
+
+var simThreadStateNames = []string{
+	"running", "runnable", "blocked", "sleeping", "done",
+}
+
+func (s simThreadState) String() string {
+	return simThreadStateNames[s]
+}
+
+// simThread is a goroutine run by a Simulation.
+type simThread struct {
+	name      string
+	state     simThreadState
+	point     string
+	wakeAt    time.Time
+	blockedOn interface{}
+	err       error
+	// turn gets a value when it's the thread's turn to run.
+	turn chan struct{}
+}
+
+// simMutex is who holds a leveled mutex, as far as a Simulation
+// knows.
+type simMutex struct {
+	writer  *lockState
+	readers map[*lockState]int
+}
+
+// SimStep is one scheduling decision of a Simulation: which thread
+// it let go on from which point.
+type SimStep struct {
+	Thread string
+	Point  string
+}
+
+func (s SimStep) String() string {
+	return fmt.Sprintf("%s@%s", s.Thread, s.Point)
+}
+
+// Simulation runs goroutines ("threads") one at a time, switching
+// between them only at well-defined points, so that a concurrency
+// test takes the same interleaving every time it's run with the same
+// seed or schedule.  The points are:
+//
+//   - the start of each thread;
+//   - every leveled mutex lock, e.g. of a folderBranchOps;
+//   - every MDOps, BlockOps, KeyOps and KeybaseService call;
+//   - every explicit call to Point or Sleep.
+//
+// At each point, the running thread waits until the Simulation picks
+// it among the threads that are ready to go on, either as told by a
+// schedule, or at random from a seeded source.  Threads that wait
+// for a mutex held by another thread aren't ready until it's
+// released, and threads that Sleep aren't ready until the virtual
+// clock reaches their deadline; the clock jumps ahead whenever no
+// thread is ready.  Run returns the steps taken, so that a failing
+// interleaving can be replayed exactly with SetSchedule.
+//
+// Goroutines started by the threads, like background flushes and
+// prefetches, aren't sequenced, and run as usual; a thread that
+// waits on one, or on a mutex that isn't leveled, is only noticed
+// as stuck if it doesn't reach its next point within the stuck
+// timeout.  Only one Simulation can be installed at a time.
+type Simulation struct {
+	clock        *VirtualClock
+	seed         int64
+	maxSteps     int
+	stuckTimeout time.Duration
+
+	lock     sync.Mutex
+	cond     *sync.Cond
+	rng      *rand.Rand
+	schedule []string
+	threads  []*simThread
+	byGID    map[uint64]*simThread
+	mutexes  map[interface{}]*simMutex
+	trace    []SimStep
+}
+
+var _ lockSequencer = (*Simulation)(nil)
+
+// NewSimulation returns a Simulation that picks threads at random,
+// seeded by seed, and whose virtual clock starts at clock's time.
+func NewSimulation(seed int64, clock *VirtualClock) *Simulation {
+	s := &Simulation{
+		clock:        clock,
+		seed:         seed,
+		maxSteps:     simMaxStepsDefault,
+		stuckTimeout: simStuckTimeoutDefault,
+		rng:          rand.New(rand.NewSource(seed)),
+		byGID:        make(map[uint64]*simThread),
+		mutexes:      make(map[interface{}]*simMutex),
+	}
+	s.cond = sync.NewCond(&s.lock)
+	return s
+}
+
+// Clock returns the virtual clock of s.
+func (s *Simulation) Clock() *VirtualClock {
+	return s.clock
+}
+
+// SetSchedule makes s pick the threads with the given names, in
+// order, before going back to picking at random.  Passing the
+// threads of the steps of an earlier run (see Schedule) replays it.
+func (s *Simulation) SetSchedule(threads []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.schedule = append([]string(nil), threads...)
+}
+
+// Install makes s sequence the threads of config: it gets the
+// virtual clock, its calls go through fi (or a FaultInjector
+// without rules, if fi is nil), and its leveled mutexes are
+// sequenced.  It returns a function that undoes all that.
+func (s *Simulation) Install(config Config, fi *FaultInjector) (undo func()) {
+	if getLockSequencer() != nil {
+		panic("Another Simulation is already installed")
+	}
+	if fi == nil {
+		fi = NewFaultInjector(s.seed, nil)
+	}
+	fi.SetCallHook(func(_ context.Context, layer FaultLayer, op string) {
+		s.Point(fmt.Sprintf("%s.%s", layer, op))
+	})
+	oldClock := config.Clock()
+	config.SetClock(s.clock)
+	undoFaults := InjectFaults(config, fi)
+	setLockSequencer(s)
+	return func() {
+		setLockSequencer(nil)
+		undoFaults()
+		fi.SetCallHook(nil)
+		config.SetClock(oldClock)
+	}
+}
+
+// Go starts a thread with the given name, which must be unique,
+// running f.  It may be called from other threads.  The thread
+// doesn't start until Run gives it its first turn.
+func (s *Simulation) Go(name string, f func() error) {
+	t := &simThread{
+		name:  name,
+		state: simRunning,
+		turn:  make(chan struct{}, 1),
+	}
+	s.lock.Lock()
+	for _, other := range s.threads {
+		if other.name == name {
+			s.lock.Unlock()
+			panic(fmt.Sprintf("Simulation thread %q already exists", name))
+		}
+	}
+	s.threads = append(s.threads, t)
+	s.lock.Unlock()
+
+	go func() {
+		s.lock.Lock()
+		gid := currentGoroutineID()
+		s.byGID[gid] = t
+		s.parkLocked(t, "start", simRunnable)
+		s.lock.Unlock()
+
+		err := f()
+
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		t.state = simDone
+		t.err = err
+		delete(s.byGID, gid)
+		s.cond.Broadcast()
+	}()
+}
+
+// currentLocked returns the thread running on this goroutine, if
+// any.
+func (s *Simulation) currentLocked() *simThread {
+	return s.byGID[currentGoroutineID()]
+}
+
+// parkLocked makes t wait, at the given point and in the given
+// state, until Run gives it a turn.  s.lock must be held; it's
+// released while waiting.
+func (s *Simulation) parkLocked(
+	t *simThread, point string, state simThreadState) {
+	t.point = point
+	t.state = state
+	s.cond.Broadcast()
+	s.lock.Unlock()
+	<-t.turn
+	s.lock.Lock()
+}
+
+// Point makes the calling thread wait at the named point until it's
+// picked to go on.  It does nothing when called from a goroutine
+// that isn't a thread of s.
+func (s *Simulation) Point(point string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if t := s.currentLocked(); t != nil {
+		s.parkLocked(t, point, simRunnable)
+	}
+}
+
+// Sleep makes the calling thread wait until the virtual clock has
+// moved on by d.  Other goroutines just wait for the clock.
+func (s *Simulation) Sleep(d time.Duration) {
+	s.lock.Lock()
+	t := s.currentLocked()
+	if t == nil {
+		s.lock.Unlock()
+		<-s.clock.After(d)
+		return
+	}
+	defer s.lock.Unlock()
+	t.wakeAt = s.clock.Now().Add(d)
+	s.parkLocked(t, "sleep", simSleeping)
+}
+
+// beforeLock implements the lockSequencer interface for Simulation.
+func (s *Simulation) beforeLock(
+	state *lockState, key interface{}, name string, exclusive bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	t := s.currentLocked()
+	if t == nil {
+		return
+	}
+	s.parkLocked(t, "lock "+name, simRunnable)
+	for !s.tryHoldLocked(state, key, exclusive) {
+		t.blockedOn = key
+		s.parkLocked(t, "wait "+name, simBlocked)
+	}
+}
+
+// tryHoldLocked records that state holds the mutex identified by key,
+// unless another lockState holds it in a conflicting way.
+func (s *Simulation) tryHoldLocked(
+	state *lockState, key interface{}, exclusive bool) bool {
+	m := s.mutexes[key]
+	if m == nil {
+		m = &simMutex{readers: make(map[*lockState]int)}
+		s.mutexes[key] = m
+	}
+	if m.writer != nil || (exclusive && len(m.readers) > 0) {
+		return false
+	}
+	if exclusive {
+		m.writer = state
+	} else {
+		m.readers[state]++
+	}
+	return true
+}
+
+// afterUnlock implements the lockSequencer interface for Simulation.
+func (s *Simulation) afterUnlock(
+	state *lockState, key interface{}, exclusive bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	m := s.mutexes[key]
+	if m == nil {
+		return
+	}
+	switch {
+	case exclusive && m.writer == state:
+		m.writer = nil
+	case !exclusive && m.readers[state] > 0:
+		m.readers[state]--
+		if m.readers[state] == 0 {
+			delete(m.readers, state)
+		}
+	default:
+		// Taken outside of the simulation.
+		return
+	}
+	if m.writer == nil && len(m.readers) == 0 {
+		delete(s.mutexes, key)
+	}
+	// Let the waiters try again.
+	for _, t := range s.threads {
+		if t.state == simBlocked && t.blockedOn == key {
+			t.state = simRunnable
+			t.blockedOn = nil
+		}
+	}
+}
+
+// handOff implements the lockSequencer interface for Simulation.  The
+// new goroutine runs as the same thread as the calling one, until
+// it's done.
+func (s *Simulation) handOff() (takeOver func() (done func())) {
+	s.lock.Lock()
+	t := s.currentLocked()
+	s.lock.Unlock()
+	if t == nil {
+		return func() (done func()) { return func() {} }
+	}
+	return func() (done func()) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		gid := currentGoroutineID()
+		s.byGID[gid] = t
+		return func() {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			delete(s.byGID, gid)
+		}
+	}
+}
+
+// waitIdleLocked waits until no thread is running, or fails if one
+// doesn't stop within the stuck timeout.
+func (s *Simulation) waitIdleLocked() error {
+	deadline := time.Now().Add(s.stuckTimeout)
+	timer := time.AfterFunc(s.stuckTimeout, func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.cond.Broadcast()
+	})
+	defer timer.Stop()
+	for {
+		var running []string
+		for _, t := range s.threads {
+			if t.state == simRunning {
+				running = append(running, t.name)
+			}
+		}
+		if len(running) == 0 {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("Simulation threads %s didn't reach a point "+
+				"within %s; they may be blocked outside the simulation",
+				strings.Join(running, ", "), s.stuckTimeout)
+		}
+		s.cond.Wait()
+	}
+}
+
+// wakeSleepersLocked moves the virtual clock on to the next deadline
+// of a sleeping thread or a clock timer, and makes the threads due by
+// then runnable.  It returns false if there's nothing to wait for.
+func (s *Simulation) wakeSleepersLocked() bool {
+	next, ok := s.clock.NextDeadline()
+	for _, t := range s.threads {
+		if t.state == simSleeping && (!ok || t.wakeAt.Before(next)) {
+			next, ok = t.wakeAt, true
+		}
+	}
+	if !ok {
+		return false
+	}
+	s.clock.AdvanceTo(next)
+	for _, t := range s.threads {
+		if t.state == simSleeping && !t.wakeAt.After(next) {
+			t.state = simRunnable
+		}
+	}
+	return true
+}
+
+func (s *Simulation) describeLocked() string {
+	descs := make([]string, 0, len(s.threads))
+	for _, t := range s.threads {
+		descs = append(descs, fmt.Sprintf("%s %s at %q",
+			t.name, t.state, t.point))
+	}
+	return strings.Join(descs, "; ")
+}
+
+// Run gives the threads turns until they're all done, and returns
+// the first error returned by any of them, in the order they were
+// started, or an error if the threads deadlock, get stuck, or take
+// too many steps.
+func (s *Simulation) Run() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for {
+		err := s.waitIdleLocked()
+		if err != nil {
+			return err
+		}
+
+		var runnable []*simThread
+		done := true
+		for _, t := range s.threads {
+			if t.state == simRunnable {
+				runnable = append(runnable, t)
+			}
+			if t.state != simDone {
+				done = false
+			}
+		}
+		if done {
+			for _, t := range s.threads {
+				if t.err != nil {
+					return t.err
+				}
+			}
+			return nil
+		}
+		if len(runnable) == 0 {
+			if s.wakeSleepersLocked() {
+				continue
+			}
+			return fmt.Errorf("Simulation deadlocked: %s", s.describeLocked())
+		}
+		if len(s.trace) >= s.maxSteps {
+			return fmt.Errorf("Simulation took more than %d steps: %s",
+				s.maxSteps, s.describeLocked())
+		}
+
+		var next *simThread
+		if len(s.schedule) > 0 {
+			name := s.schedule[0]
+			s.schedule = s.schedule[1:]
+			for _, t := range runnable {
+				if t.name == name {
+					next = t
+					break
+				}
+			}
+			if next == nil {
+				return fmt.Errorf("Simulation step %d: thread %q isn't "+
+					"runnable: %s", len(s.trace), name, s.describeLocked())
+			}
+		} else {
+			next = runnable[s.rng.Intn(len(runnable))]
+		}
+		s.trace = append(s.trace, SimStep{next.name, next.point})
+		next.state = simRunning
+		next.turn <- struct{}{}
+	}
+}
+
+// Trace returns the steps taken so far.
+func (s *Simulation) Trace() []SimStep {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]SimStep(nil), s.trace...)
+}
+
+// Schedule returns the threads picked so far, in order, suitable for
+// passing to SetSchedule to replay the run.
+func (s *Simulation) Schedule() []string {
+	trace := s.Trace()
+	threads := make([]string, 0, len(trace))
+	for _, step := range trace {
+		threads = append(threads, step.Thread)
+	}
+	return threads
+}
@@ -0,0 +1,209 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVirtualClockTimers(t *testing.T) {
+	start := time.Unix(1, 0)
+	clock := NewVirtualClock(start)
+	late := clock.After(2 * time.Second)
+	early := clock.After(time.Second)
+	alsoEarly := clock.After(time.Second)
+
+	deadline, ok := clock.NextDeadline()
+	require.True(t, ok)
+	require.Equal(t, start.Add(time.Second), deadline)
+
+	clock.Advance(1500 * time.Millisecond)
+	require.Equal(t, start.Add(1500*time.Millisecond), clock.Now())
+	require.Equal(t, start.Add(time.Second), <-early)
+	require.Equal(t, start.Add(time.Second), <-alsoEarly)
+	select {
+	case <-late:
+		t.Fatal("Timer fired early")
+	default:
+	}
+
+	clock.AdvanceTo(start.Add(3 * time.Second))
+	require.Equal(t, start.Add(2*time.Second), <-late)
+	_, ok = clock.NextDeadline()
+	require.False(t, ok)
+}
+
+// runSimCounters runs two threads that each take a leveled mutex and
+// bump a shared counter a few times, and returns the trace and the
+// order the bumps happened in.
+func runSimCounters(t *testing.T, seed int64, schedule []string) (
+	[]SimStep, []string) {
+	sim := NewSimulation(seed, NewVirtualClock(time.Unix(0, 0)))
+	if schedule != nil {
+		sim.SetSchedule(schedule)
+	}
+	setLockSequencer(sim)
+	defer setLockSequencer(nil)
+
+	mu := makeLeveledMutex(mutexLevel(fboMDWriter), &sync.Mutex{})
+	var order []string
+	for _, name := range []string{"a", "b"} {
+		name := name
+		sim.Go(name, func() error {
+			for i := 0; i < 3; i++ {
+				lState := makeFBOLockState()
+				mu.Lock(lState)
+				order = append(order, fmt.Sprintf("%s%d", name, i))
+				mu.Unlock(lState)
+				sim.Sleep(time.Second)
+			}
+			return nil
+		})
+	}
+	require.NoError(t, sim.Run())
+	require.Equal(t, time.Unix(3, 0), sim.Clock().Now())
+	return sim.Trace(), order
+}
+
+func TestSimulationDeterministic(t *testing.T) {
+	trace, order := runSimCounters(t, 1, nil)
+	require.Len(t, order, 6)
+
+	trace2, order2 := runSimCounters(t, 1, nil)
+	require.Equal(t, trace, trace2)
+	require.Equal(t, order, order2)
+
+	// Replaying the schedule under a different seed takes the same
+	// steps.
+	var schedule []string
+	for _, step := range trace {
+		schedule = append(schedule, step.Thread)
+	}
+	trace3, order3 := runSimCounters(t, 2, schedule)
+	require.Equal(t, trace, trace3)
+	require.Equal(t, order, order3)
+}
+
+func TestSimulationMutexBlocks(t *testing.T) {
+	sim := NewSimulation(1, NewVirtualClock(time.Unix(0, 0)))
+	setLockSequencer(sim)
+	defer setLockSequencer(nil)
+
+	mu := makeLeveledMutex(mutexLevel(fboMDWriter), &sync.Mutex{})
+	holder := makeFBOLockState()
+	sim.Go("holder", func() error {
+		mu.Lock(holder)
+		sim.Point("holding")
+		sim.Point("still holding")
+		mu.Unlock(holder)
+		return nil
+	})
+	sim.Go("waiter", func() error {
+		lState := makeFBOLockState()
+		mu.Lock(lState)
+		mu.Unlock(lState)
+		return errors.New("waiter done")
+	})
+	// Once the holder has the lock, the waiter can't get past it
+	// until the holder lets go, whatever the schedule says.
+	sim.SetSchedule([]string{"holder", "holder", "waiter", "waiter"})
+	require.EqualError(t, sim.Run(), "waiter done")
+	require.Equal(t, []SimStep{
+		{"holder", "start"},
+		{"holder", "lock mdWriterLock"},
+		{"waiter", "start"},
+		{"waiter", "lock mdWriterLock"},
+		{"holder", "holding"},
+		{"holder", "still holding"},
+		{"waiter", "wait mdWriterLock"},
+	}, sim.Trace())
+}
+
+func TestSimulationDeadlock(t *testing.T) {
+	sim := NewSimulation(1, NewVirtualClock(time.Unix(0, 0)))
+	setLockSequencer(sim)
+	defer setLockSequencer(nil)
+
+	mu := makeLeveledMutex(mutexLevel(fboMDWriter), &sync.Mutex{})
+	sim.Go("a", func() error {
+		mu.Lock(makeFBOLockState())
+		return nil
+	})
+	sim.Go("b", func() error {
+		mu.Lock(makeFBOLockState())
+		return nil
+	})
+	err := sim.Run()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "deadlocked")
+	require.Contains(t, err.Error(), "blocked at \"wait mdWriterLock\"")
+}
+
+// runSimWritesDuringSync is a simulated version of
+// testKBFSOpsConcurWritesDuringSync: one thread syncs a file while
+// others write to it.
+func runSimWritesDuringSync(t *testing.T, seed int64) []SimStep {
+	config, _, ctx := kbfsOpsConcurInit(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := []byte{1, 2, 3, 4, 5}
+	require.NoError(t, kbfsOps.Write(ctx, fileNode, data, 0))
+
+	sim := NewSimulation(seed, NewVirtualClock(time.Unix(0, 0)))
+	undo := sim.Install(config, nil)
+	defer undo()
+
+	sim.Go("sync", func() error {
+		return kbfsOps.Sync(ctx, fileNode)
+	})
+	for i := 0; i < 3; i++ {
+		i := i
+		sim.Go(fmt.Sprintf("write%d", i), func() error {
+			return kbfsOps.Write(
+				ctx, fileNode, []byte{byte(10 + i)}, int64(len(data)+i))
+		})
+	}
+	require.NoError(t, sim.Run())
+	undo()
+
+	require.NoError(t, kbfsOps.Sync(ctx, fileNode))
+	buf := make([]byte, 16)
+	n, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	expected := append(data, 10, 11, 12)
+	if !bytes.Equal(expected, buf[:n]) {
+		t.Fatalf("Expected %v, got %v", expected, buf[:n])
+	}
+	return sim.Trace()
+}
+
+func TestSimulationWritesDuringSync(t *testing.T) {
+	trace := runSimWritesDuringSync(t, 1)
+	require.Equal(t, trace, runSimWritesDuringSync(t, 1))
+	sawPut := false
+	for _, step := range trace {
+		if step.Point == "md.Put" {
+			sawPut = true
+		}
+	}
+	require.True(t, sawPut, "No MD put in %v", trace)
+
+	// Other interleavings must leave the same data behind.
+	for seed := int64(2); seed < 10; seed++ {
+		runSimWritesDuringSync(t, seed)
+	}
+}
@@ -0,0 +1,445 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"github.com/keybase/client/go/logger"
+	"golang.org/x/net/context"
+)
+
+// FileSizeDist picks the size of a generated file.
+type FileSizeDist func(r *rand.Rand) int
+
+// FixedFileSize returns a FileSizeDist that always picks size.
+func FixedFileSize(size int) FileSizeDist {
+	return func(*rand.Rand) int {
+		return size
+	}
+}
+
+// UniformFileSize returns a FileSizeDist that picks sizes uniformly
+// from [min, max].
+func UniformFileSize(min, max int) FileSizeDist {
+	return func(r *rand.Rand) int {
+		return min + r.Intn(max-min+1)
+	}
+}
+
+// TLFFixtureSpec describes the shape of a TLF built by
+// MakeTLFFixture.
+type TLFFixtureSpec struct {
+	// Seed determines every size and byte of content chosen by
+	// the generator, and which files get rewritten, so the same
+	// spec always yields the same TLF.
+	Seed int64
+	// Depth is the number of levels of directories below the root.
+	Depth int
+	// Fanout is the number of subdirectories in each directory
+	// above the bottom level.
+	Fanout int
+	// FilesPerDir is the number of files in each directory,
+	// including the root.
+	FilesPerDir int
+	// FileSize picks the size of each file.  If nil, files are
+	// empty.
+	FileSize FileSizeDist
+	// Revisions is the number of extra revisions made once the
+	// tree is built, each of which rewrites a random file.
+	Revisions int
+	// Conflicts is the number of distinct files that a second
+	// user rewrites at the same time as the first, leaving the
+	// second user on an unmerged branch with CR paused.
+	Conflicts int
+	// BatchFiles creates all the files in each directory in a
+	// single revision, rather than one revision per file.  Each
+	// create copies the whole directory, so this is the only
+	// practical way to build directories with tens of thousands
+	// of entries.  The files must be empty.
+	BatchFiles bool
+}
+
+// TLFFixture is a TLF built by MakeTLFFixture.  Directories are
+// named "d<n>" and files "f<n>", and paths are relative to the TLF
+// root, separated by "/".
+type TLFFixture struct {
+	Spec TLFFixtureSpec
+	// Root is the TLF's root node, as seen by the config that
+	// built it.
+	Root Node
+	// Dirs lists every generated directory, parents first.
+	Dirs []string
+	// Files maps each generated file to its contents on the
+	// merged branch.
+	Files map[string][]byte
+	// Unmerged maps each conflicted file to the contents written
+	// to it on the second user's unmerged branch.
+	Unmerged map[string][]byte
+
+	config         Config
+	conflictConfig Config
+	conflictRoot   Node
+	resumeUpdates  chan<- struct{}
+}
+
+// FileNames returns the paths of all the generated files, in the
+// order they were created.
+func (f *TLFFixture) FileNames() []string {
+	var names []string
+	for _, dir := range append([]string{""}, f.Dirs...) {
+		for i := 0; i < f.Spec.FilesPerDir; i++ {
+			names = append(names, joinFixturePath(dir, fmt.Sprintf("f%d", i)))
+		}
+	}
+	return names
+}
+
+func joinFixturePath(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// lookupFixturePath returns the node at the given path under root.
+func lookupFixturePath(ctx context.Context, kbfsOps KBFSOps, root Node,
+	p string) (Node, error) {
+	n := root
+	for _, name := range strings.Split(p, "/") {
+		var err error
+		n, _, err = kbfsOps.Lookup(ctx, n, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// Lookup returns the node at path p of the fixture, as seen by the
+// config that built it.
+func (f *TLFFixture) Lookup(ctx context.Context, p string) (Node, error) {
+	return lookupFixturePath(ctx, f.config.KBFSOps(), f.Root, p)
+}
+
+// rewriteFixtureFile replaces the contents of file with data, in a
+// single revision.
+func rewriteFixtureFile(ctx context.Context, kbfsOps KBFSOps, file Node,
+	data []byte) error {
+	err := kbfsOps.Truncate(ctx, file, 0)
+	if err != nil {
+		return err
+	}
+	err = kbfsOps.Write(ctx, file, data, 0)
+	if err != nil {
+		return err
+	}
+	return kbfsOps.Sync(ctx, file)
+}
+
+func (f *TLFFixture) newContents(r *rand.Rand) []byte {
+	if f.Spec.FileSize == nil {
+		return nil
+	}
+	data := make([]byte, f.Spec.FileSize(r))
+	r.Read(data)
+	return data
+}
+
+// MakeTLFFixture builds a TLF with the given name and the shape in
+// spec, under config.  If spec.Conflicts is non-zero, conflictConfig
+// must be logged in as another writer of the TLF; once this returns,
+// it's on an unmerged branch, with updates and CR paused until
+// ResolveConflicts is called.
+func MakeTLFFixture(ctx context.Context, config Config,
+	conflictConfig Config, name string, public bool,
+	spec TLFFixtureSpec) (*TLFFixture, error) {
+	if (spec.Revisions > 0 || spec.Conflicts > 0) && spec.FilesPerDir == 0 {
+		return nil, errors.New("Revisions and conflicts need some files")
+	}
+	if spec.Conflicts > 0 && conflictConfig == nil {
+		return nil, errors.New("Conflicts need a second config")
+	}
+	if spec.BatchFiles && spec.FileSize != nil {
+		return nil, errors.New("Batched files must be empty")
+	}
+
+	root, err := GetRootNodeForTest(config, name, public)
+	if err != nil {
+		return nil, err
+	}
+	f := &TLFFixture{
+		Spec:     spec,
+		Root:     root,
+		Files:    make(map[string][]byte),
+		Unmerged: make(map[string][]byte),
+		config:   config,
+	}
+	r := rand.New(rand.NewSource(spec.Seed))
+	kbfsOps := config.KBFSOps()
+
+	// Build the tree breadth-first.
+	type fixtureDir struct {
+		node  Node
+		path  string
+		level int
+	}
+	files := make(map[string]Node)
+	queue := []fixtureDir{{root, "", 0}}
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+		if spec.BatchFiles && spec.FilesPerDir > 0 {
+			fileNames := make([]string, spec.FilesPerDir)
+			for i := range fileNames {
+				fileNames[i] = fmt.Sprintf("f%d", i)
+			}
+			nodes, err := createEmptyFilesForTesting(
+				ctx, config, dir.node, fileNames)
+			if err != nil {
+				return nil, err
+			}
+			for i, file := range nodes {
+				p := joinFixturePath(dir.path, fileNames[i])
+				files[p] = file
+				f.Files[p] = nil
+			}
+		}
+		for i := 0; i < spec.FilesPerDir && !spec.BatchFiles; i++ {
+			p := joinFixturePath(dir.path, fmt.Sprintf("f%d", i))
+			file, _, err := kbfsOps.CreateFile(
+				ctx, dir.node, fmt.Sprintf("f%d", i), false, NoExcl)
+			if err != nil {
+				return nil, err
+			}
+			data := f.newContents(r)
+			if len(data) > 0 {
+				err = rewriteFixtureFile(ctx, kbfsOps, file, data)
+				if err != nil {
+					return nil, err
+				}
+			}
+			files[p] = file
+			f.Files[p] = data
+		}
+		if dir.level == spec.Depth {
+			continue
+		}
+		for i := 0; i < spec.Fanout; i++ {
+			p := joinFixturePath(dir.path, fmt.Sprintf("d%d", i))
+			child, _, err := kbfsOps.CreateDir(
+				ctx, dir.node, fmt.Sprintf("d%d", i))
+			if err != nil {
+				return nil, err
+			}
+			f.Dirs = append(f.Dirs, p)
+			queue = append(queue, fixtureDir{child, p, dir.level + 1})
+		}
+	}
+
+	names := f.FileNames()
+	for i := 0; i < spec.Revisions; i++ {
+		p := names[r.Intn(len(names))]
+		data := f.newContents(r)
+		err := rewriteFixtureFile(ctx, kbfsOps, files[p], data)
+		if err != nil {
+			return nil, err
+		}
+		f.Files[p] = data
+	}
+
+	if spec.Conflicts > 0 {
+		err := f.makeConflicts(ctx, r, conflictConfig, name, public, files)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// createEmptyFilesForTesting creates an empty file in dir for each
+// of names, all in one revision, and returns their nodes in the same
+// order.
+func createEmptyFilesForTesting(ctx context.Context, config Config,
+	dir Node, names []string) (nodes []Node, err error) {
+	fbo := config.KBFSOps().(*KBFSOpsStandard).getOpsNoAdd(
+		dir.GetFolderBranch())
+	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			nodes = nil
+			dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
+			if err != nil {
+				return err
+			}
+			md, err := fbo.getMDForWriteLocked(ctx, lState)
+			if err != nil {
+				return err
+			}
+			_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+			if err != nil {
+				return err
+			}
+			dblock, err := fbo.blocks.GetDir(
+				ctx, lState, md.ReadOnly(), dirPath, blockWrite)
+			if err != nil {
+				return err
+			}
+
+			bps := newBlockPutState(len(names))
+			now := fbo.nowUnixNano()
+			des := make([]DirEntry, 0, len(names))
+			for _, name := range names {
+				if _, ok := dblock.Children[name]; ok {
+					return NameExistsError{name}
+				}
+				co, err := newCreateOp(name, dirPath.tailPointer(), File)
+				if err != nil {
+					return err
+				}
+				md.AddOp(co)
+				info, _, err := fbo.readyBlockMultiple(
+					ctx, md.ReadOnly(), NewFileBlock(), uid, bps)
+				if err != nil {
+					return err
+				}
+				md.AddRefBlock(info)
+				de := DirEntry{
+					BlockInfo: info,
+					EntryInfo: EntryInfo{
+						Type:  File,
+						Mtime: now,
+						Ctime: now,
+					},
+				}
+				dblock.Children[name] = de
+				des = append(des, de)
+			}
+
+			_, err = fbo.syncBlockAndFinalizeWithBlocksLocked(
+				ctx, lState, md, dblock, *dirPath.parentPath(),
+				dirPath.tailName(), Dir, true, true, zeroPtr, NoExcl, bps)
+			if err != nil {
+				return err
+			}
+
+			for i, de := range des {
+				n, err := fbo.nodeCache.GetOrCreate(
+					de.BlockPointer, names[i], dir)
+				if err != nil {
+					return err
+				}
+				nodes = append(nodes, n)
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+func (f *TLFFixture) makeConflicts(ctx context.Context, r *rand.Rand,
+	conflictConfig Config, name string, public bool,
+	files map[string]Node) error {
+	names := f.FileNames()
+	if f.Spec.Conflicts > len(names) {
+		return fmt.Errorf("Can't make %d conflicts with only %d files",
+			f.Spec.Conflicts, len(names))
+	}
+	var conflicted []string
+	for _, i := range r.Perm(len(names))[:f.Spec.Conflicts] {
+		conflicted = append(conflicted, names[i])
+	}
+
+	root2, err := GetRootNodeForTest(conflictConfig, name, public)
+	if err != nil {
+		return err
+	}
+	kbfsOps2 := conflictConfig.KBFSOps()
+	fb := root2.GetFolderBranch()
+	err = kbfsOps2.SyncFromServerForTesting(ctx, fb)
+	if err != nil {
+		return err
+	}
+	files2 := make(map[string]Node)
+	for _, p := range conflicted {
+		files2[p], err = lookupFixturePath(ctx, kbfsOps2, root2, p)
+		if err != nil {
+			return err
+		}
+	}
+
+	c, err := DisableUpdatesForTesting(conflictConfig, fb)
+	if err != nil {
+		return err
+	}
+	f.conflictConfig = conflictConfig
+	f.conflictRoot = root2
+	f.resumeUpdates = c
+	err = DisableCRForTesting(conflictConfig, fb)
+	if err != nil {
+		return err
+	}
+
+	// Pick all the contents first, so that they don't depend on
+	// the order of the writes below.
+	merged := make(map[string][]byte)
+	for _, p := range conflicted {
+		merged[p] = f.newContents(r)
+		f.Unmerged[p] = f.newContents(r)
+	}
+	kbfsOps := f.config.KBFSOps()
+	for _, p := range conflicted {
+		err := rewriteFixtureFile(ctx, kbfsOps, files[p], merged[p])
+		if err != nil {
+			return err
+		}
+		f.Files[p] = merged[p]
+	}
+	for _, p := range conflicted {
+		err := rewriteFixtureFile(ctx, kbfsOps2, files2[p], f.Unmerged[p])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ResolveConflicts resumes updates and CR for the second user, and
+// waits for both users to see the resolved TLF.  It does nothing if
+// the fixture has no conflicts.
+func (f *TLFFixture) ResolveConflicts(ctx context.Context) error {
+	if f.resumeUpdates == nil {
+		return nil
+	}
+	f.resumeUpdates <- struct{}{}
+	f.resumeUpdates = nil
+	fb := f.conflictRoot.GetFolderBranch()
+	err := RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), f.conflictConfig, fb)
+	if err != nil {
+		return err
+	}
+	err = f.conflictConfig.KBFSOps().SyncFromServerForTesting(ctx, fb)
+	if err != nil {
+		return err
+	}
+	return f.config.KBFSOps().SyncFromServerForTesting(ctx, fb)
+}
+
+// MakeTLFFixtureOrBust is like MakeTLFFixture, but fails the test on
+// error.
+func MakeTLFFixtureOrBust(t logger.TestLogBackend, ctx context.Context,
+	config Config, conflictConfig Config, name string, public bool,
+	spec TLFFixtureSpec) *TLFFixture {
+	f, err := MakeTLFFixture(ctx, config, conflictConfig, name, public, spec)
+	if err != nil {
+		t.Fatalf("Couldn't make fixture for %s: %v", name, err)
+	}
+	return f
+}
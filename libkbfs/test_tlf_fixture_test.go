@@ -0,0 +1,131 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/stretchr/testify/require"
+)
+
+func checkTLFFixtureContents(t *testing.T, config Config, root Node,
+	files map[string][]byte) {
+	ctx := BackgroundContextWithCancellationDelayer()
+	defer CleanupCancellationDelayer(ctx)
+	kbfsOps := config.KBFSOps()
+	for p, expected := range files {
+		file, err := lookupFixturePath(ctx, kbfsOps, root, p)
+		require.NoError(t, err)
+		buf := make([]byte, len(expected)+1)
+		n, err := kbfsOps.Read(ctx, file, buf, 0)
+		require.NoError(t, err)
+		require.Equal(t, len(expected), int(n), p)
+		require.True(t, bytes.Equal(expected, buf[:n]), p)
+	}
+}
+
+func TestTLFFixtureDeterministic(t *testing.T) {
+	spec := TLFFixtureSpec{
+		Seed:        7,
+		Depth:       2,
+		Fanout:      2,
+		FilesPerDir: 2,
+		FileSize:    UniformFileSize(0, 100),
+		Revisions:   5,
+	}
+
+	var fixtures []*TLFFixture
+	for i := 0; i < 2; i++ {
+		config := MakeTestConfigOrBust(t, "u1")
+		defer CheckConfigAndShutdown(t, config)
+		ctx := BackgroundContextWithCancellationDelayer()
+		defer CleanupCancellationDelayer(ctx)
+
+		f := MakeTLFFixtureOrBust(t, ctx, config, nil, "u1", false, spec)
+		checkTLFFixtureContents(t, config, f.Root, f.Files)
+		fixtures = append(fixtures, f)
+	}
+
+	require.Equal(t, []string{
+		"d0", "d1", "d0/d0", "d0/d1", "d1/d0", "d1/d1",
+	}, fixtures[0].Dirs)
+	require.Len(t, fixtures[0].Files, 14)
+	require.Equal(t, fixtures[0].Dirs, fixtures[1].Dirs)
+	require.Equal(t, fixtures[0].Files, fixtures[1].Files)
+}
+
+func TestTLFFixtureConflicts(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+	f := MakeTLFFixtureOrBust(t, ctx, config1, config2, name, false,
+		TLFFixtureSpec{
+			Seed:        1,
+			FilesPerDir: 4,
+			FileSize:    FixedFileSize(10),
+			Conflicts:   2,
+		})
+	require.Len(t, f.Unmerged, 2)
+
+	// The second user is left on its unmerged branch.
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	status, _, err := config2.KBFSOps().FolderStatus(
+		ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	require.True(t, status.Staged)
+	unmergedFiles := make(map[string][]byte)
+	for p, data := range f.Files {
+		unmergedFiles[p] = data
+	}
+	for p, data := range f.Unmerged {
+		unmergedFiles[p] = data
+	}
+	checkTLFFixtureContents(t, config2, rootNode2, unmergedFiles)
+
+	err = f.ResolveConflicts(ctx)
+	require.NoError(t, err)
+	checkTLFFixtureContents(t, config1, f.Root, f.Files)
+	children, err := config1.KBFSOps().GetDirChildren(ctx, f.Root)
+	require.NoError(t, err)
+	// Each unmerged rewrite survives as a conflict copy.
+	require.Len(t, children, 4+2)
+}
+
+func TestTLFFixtureBatchFiles(t *testing.T) {
+	config := MakeTestConfigOrBust(t, "u1")
+	defer CheckConfigAndShutdown(t, config)
+	ctx := BackgroundContextWithCancellationDelayer()
+	defer CleanupCancellationDelayer(ctx)
+
+	f := MakeTLFFixtureOrBust(t, ctx, config, nil, "u1", false,
+		TLFFixtureSpec{
+			Seed:        1,
+			Depth:       1,
+			Fanout:      2,
+			FilesPerDir: 50,
+			Revisions:   3,
+			BatchFiles:  true,
+		})
+	require.Len(t, f.Files, 150)
+	checkTLFFixtureContents(t, config, f.Root, f.Files)
+
+	// Each directory's files were made in one revision, so there
+	// are at most: the first revision, one per directory for its
+	// files, one per subdirectory for its creation, and the
+	// rewrites.
+	status, _, err := config.KBFSOps().FolderStatus(
+		ctx, f.Root.GetFolderBranch())
+	require.NoError(t, err)
+	require.True(t, status.Revision <= MetadataRevision(1+3+2+3),
+		"Too many revisions: %d", status.Revision)
+}
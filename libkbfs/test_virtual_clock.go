@@ -0,0 +1,106 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// virtualTimer is a timer of a VirtualClock.
+type virtualTimer struct {
+	when time.Time
+	// seq orders timers that fire at the same time by when they
+	// were made.
+	seq uint64
+	ch  chan time.Time
+}
+
+// VirtualClock is a Clock whose time only moves when told to, and
+// whose timers fire in order of their deadlines, ties broken by the
+// order they were made in, as it moves.  Unlike TestClock, it can
+// stand in for the timers of the code under test, so that timeouts
+// don't depend on how fast the test machine is.
+type VirtualClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	seq    uint64
+	timers []*virtualTimer
+}
+
+var _ Clock = (*VirtualClock)(nil)
+
+// NewVirtualClock returns a VirtualClock starting at start.
+func NewVirtualClock(start time.Time) *VirtualClock {
+	return &VirtualClock{now: start}
+}
+
+// Now implements the Clock interface for VirtualClock.
+func (c *VirtualClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// After returns a channel that gets the time once the clock has
+// moved on by d, like time.After.
+func (c *VirtualClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.seq++
+	c.timers = append(c.timers, &virtualTimer{c.now.Add(d), c.seq, ch})
+	sort.Sort(virtualTimersByDeadline(c.timers))
+	return ch
+}
+
+// NextDeadline returns when the earliest pending timer fires, if
+// there's one.
+func (c *VirtualClock) NextDeadline() (time.Time, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.timers) == 0 {
+		return time.Time{}, false
+	}
+	return c.timers[0].when, true
+}
+
+// AdvanceTo moves the clock to t, if that's later than now, firing
+// the timers due by then in order.
+func (c *VirtualClock) AdvanceTo(t time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for len(c.timers) > 0 && !c.timers[0].when.After(t) {
+		timer := c.timers[0]
+		c.timers = c.timers[1:]
+		c.now = timer.when
+		timer.ch <- timer.when
+	}
+	if t.After(c.now) {
+		c.now = t
+	}
+}
+
+// Advance moves the clock on by d, firing the timers due by then in
+// order.
+func (c *VirtualClock) Advance(d time.Duration) {
+	c.AdvanceTo(c.Now().Add(d))
+}
+
+type virtualTimersByDeadline []*virtualTimer
+
+func (t virtualTimersByDeadline) Len() int      { return len(t) }
+func (t virtualTimersByDeadline) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t virtualTimersByDeadline) Less(i, j int) bool {
+	if !t[i].when.Equal(t[j].when) {
+		return t[i].when.Before(t[j].when)
+	}
+	return t[i].seq < t[j].seq
+}
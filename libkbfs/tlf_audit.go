@@ -0,0 +1,250 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// BlockAuditProblem describes a single block reference that failed
+// a TLF audit.
+type BlockAuditProblem struct {
+	// Path describes where in the TLF the reference was found,
+	// e.g. "/a/b" or "/a/b (off=4096)".
+	Path string
+	Ptr  BlockPointer
+	Err  error
+}
+
+// TLFAuditReport is the result of auditing all the blocks reachable
+// from the head of a TLF.
+type TLFAuditReport struct {
+	Tlf      TlfID
+	Revision MetadataRevision
+	// BlocksChecked is the number of block references that were
+	// fetched and verified.
+	BlocksChecked int
+	// Missing holds references that the block server doesn't
+	// know about (or has already deleted).
+	Missing []BlockAuditProblem
+	// Corrupt holds blocks that were fetched, but whose contents
+	// don't match their ID or couldn't be decrypted or decoded.
+	Corrupt []BlockAuditProblem
+	// DuplicateRefs holds references that are reachable from
+	// more than one place in the TLF.  The server counts each
+	// reference once, so removing either place would drop the
+	// block out from under the other.
+	DuplicateRefs []BlockAuditProblem
+}
+
+// IsClean returns true if the audit found no problems.
+func (r TLFAuditReport) IsClean() bool {
+	return len(r.Missing) == 0 && len(r.Corrupt) == 0 &&
+		len(r.DuplicateRefs) == 0
+}
+
+type tlfAuditor struct {
+	config Config
+	kmd    KeyMetadata
+	seen   map[BlockPointer]string
+	report TLFAuditReport
+	// reachableBytes is the total size of the distinct blocks
+	// fetched so far.
+	reachableBytes uint64
+}
+
+func newTLFAuditor(config Config, md ImmutableRootMetadata) *tlfAuditor {
+	return &tlfAuditor{
+		config: config,
+		kmd:    md,
+		seen:   make(map[BlockPointer]string),
+		report: TLFAuditReport{
+			Tlf:      md.TlfID(),
+			Revision: md.Revision(),
+		},
+	}
+}
+
+// getBlock fetches, verifies and decrypts the block for the given
+// pointer into block, recording any problems in the report.  It
+// returns false if the block couldn't be used, and only returns an
+// error if the audit can't continue.
+func (a *tlfAuditor) getBlock(ctx context.Context, p string,
+	ptr BlockPointer, block Block) (bool, error) {
+	if firstPath, ok := a.seen[ptr]; ok {
+		a.report.DuplicateRefs = append(a.report.DuplicateRefs,
+			BlockAuditProblem{p, ptr,
+				fmt.Errorf("Also referenced from %s", firstPath)})
+		return false, nil
+	}
+	a.seen[ptr] = p
+	a.report.BlocksChecked++
+
+	buf, serverHalf, err := a.config.BlockServer().Get(
+		ctx, a.kmd.TlfID(), ptr.ID, ptr.BlockContext)
+	switch err.(type) {
+	case nil:
+	case BServerErrorBlockNonExistent, BServerErrorBlockDeleted:
+		a.report.Missing = append(a.report.Missing,
+			BlockAuditProblem{p, ptr, err})
+		return false, nil
+	default:
+		return false, err
+	}
+
+	a.reachableBytes += uint64(len(buf))
+
+	crypto := a.config.Crypto()
+	tlfCryptKey, err := a.config.KeyManager().
+		GetTLFCryptKeyForBlockDecryption(ctx, a.kmd, ptr)
+	if err != nil {
+		return false, err
+	}
+
+	err = func() error {
+		if err := crypto.VerifyBlockID(buf, ptr.ID); err != nil {
+			return err
+		}
+		blockCryptKey, err := crypto.UnmaskBlockCryptKey(
+			serverHalf, tlfCryptKey)
+		if err != nil {
+			return err
+		}
+		var encryptedBlock EncryptedBlock
+		err = a.config.Codec().Decode(buf, &encryptedBlock)
+		if err != nil {
+			return err
+		}
+		return crypto.DecryptBlock(encryptedBlock, blockCryptKey, block)
+	}()
+	if err != nil {
+		a.report.Corrupt = append(a.report.Corrupt,
+			BlockAuditProblem{p, ptr, err})
+		return false, nil
+	}
+	return true, nil
+}
+
+func (a *tlfAuditor) auditFile(
+	ctx context.Context, p string, ptr BlockPointer) error {
+	var fblock FileBlock
+	ok, err := a.getBlock(ctx, p, ptr, &fblock)
+	if err != nil || !ok || !fblock.IsInd {
+		return err
+	}
+	for _, iptr := range fblock.IPtrs {
+		err := a.auditFile(ctx, fmt.Sprintf("%s (off=%d)", p, iptr.Off),
+			iptr.BlockPointer)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *tlfAuditor) auditDir(
+	ctx context.Context, p string, ptr BlockPointer) error {
+	var dblock DirBlock
+	ok, err := a.getBlock(ctx, p, ptr, &dblock)
+	if err != nil || !ok {
+		return err
+	}
+	return a.auditDirEntries(ctx, p, &dblock, make(map[BlockPointer]bool))
+}
+
+// auditDirEntries audits the entries of the directory at p that
+// dblock, or its shards, hold.  linked holds the pointers of the
+// files with several hard links that have been audited already.
+// Those links all live in the same directory, and share one
+// reference to the file, so only the first of them is followed.
+func (a *tlfAuditor) auditDirEntries(ctx context.Context, p string,
+	dblock *DirBlock, linked map[BlockPointer]bool) error {
+	// The shards of a sharded directory hold its entries.
+	for _, iptr := range dblock.IPtrs {
+		var shard DirBlock
+		ok, err := a.getBlock(ctx, p, iptr.BlockPointer, &shard)
+		if err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+		err = a.auditDirEntries(ctx, p, &shard, linked)
+		if err != nil {
+			return err
+		}
+	}
+	for name, de := range dblock.Children {
+		childPath := strings.TrimSuffix(p, "/") + "/" + name
+		if (de.Type == File || de.Type == Exec) && de.LinkCount() > 1 {
+			if linked[de.BlockPointer] {
+				continue
+			}
+			linked[de.BlockPointer] = true
+		}
+		var err error
+		switch de.Type {
+		case Dir:
+			err = a.auditDir(ctx, childPath, de.BlockPointer)
+		case File, Exec:
+			err = a.auditFile(ctx, childPath, de.BlockPointer)
+		default:
+			// Symlinks have no blocks of their own.
+		}
+		if err != nil {
+			return err
+		}
+		err = a.auditXattrs(ctx, childPath, de)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// auditXattrs audits the blocks of the big xattr values of the entry
+// at p.
+func (a *tlfAuditor) auditXattrs(
+	ctx context.Context, p string, de DirEntry) error {
+	for name, v := range de.Xattrs {
+		if v.Block.BlockPointer == zeroPtr {
+			continue
+		}
+		var fblock FileBlock
+		_, err := a.getBlock(ctx, fmt.Sprintf("%s (xattr %s)", p, name),
+			v.Block.BlockPointer, &fblock)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// audit checks every block reachable from md, including the MD's
+// changes block if it has one.  Fetching each block with its own
+// context also checks that the server still has a live reference
+// for it.
+func (a *tlfAuditor) audit(
+	ctx context.Context, md ImmutableRootMetadata) (TLFAuditReport, error) {
+	data := md.Data()
+	if changes := data.ChangesBlockInfo(); changes != (BlockInfo{}) {
+		err := a.auditFile(ctx, "(MD changes)", changes.BlockPointer)
+		if err != nil {
+			return TLFAuditReport{}, err
+		}
+	}
+	err := a.auditDir(ctx, "/", data.Dir.BlockPointer)
+	if err != nil {
+		return TLFAuditReport{}, err
+	}
+	return a.report, nil
+}
+
+func auditTLF(ctx context.Context, config Config,
+	md ImmutableRootMetadata) (TLFAuditReport, error) {
+	return newTLFAuditor(config, md).audit(ctx, md)
+}
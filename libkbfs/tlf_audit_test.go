@@ -0,0 +1,116 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKBFSOpsAuditTLF(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer config.Shutdown()
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	fileNode, _, err := kbfsOps.CreateFile(ctx, dirNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	err = kbfsOps.SyncFromServerForTesting(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	h, err := ParseTlfHandle(ctx, config.KBPKI(), "test_user", false)
+	require.NoError(t, err)
+	report, err := kbfsOps.AuditTLF(ctx, h)
+	require.NoError(t, err)
+	require.True(t, report.IsClean(), "%+v", report)
+	require.Equal(t, rootNode.GetFolderBranch().Tlf, report.Tlf)
+	// Root dir, "a", "b", and the MD changes block if any.
+	require.True(t, report.BlocksChecked >= 3)
+
+	// Drop the only reference to the file's block behind KBFS's
+	// back; the audit should notice.
+	md, err := kbfsOps.GetNodeMetadata(ctx, fileNode)
+	require.NoError(t, err)
+	ptr := md.BlockInfo.BlockPointer
+	_, err = config.BlockServer().RemoveBlockReferences(ctx, report.Tlf,
+		map[BlockID][]BlockContext{ptr.ID: {ptr.BlockContext}})
+	require.NoError(t, err)
+
+	report, err = kbfsOps.AuditTLF(ctx, h)
+	require.NoError(t, err)
+	require.False(t, report.IsClean())
+	require.Len(t, report.Missing, 1)
+	require.Equal(t, ptr, report.Missing[0].Ptr)
+	require.Equal(t, "/a/b", report.Missing[0].Path)
+	require.Len(t, report.Corrupt, 0)
+}
+
+func TestKBFSOpsAuditTLFHardLinks(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	err = kbfsOps.Link(ctx, fileNode, rootNode, "b")
+	require.NoError(t, err)
+
+	// The links share one reference to the file's block, which
+	// isn't a duplicate.
+	h, err := ParseTlfHandle(ctx, config.KBPKI(), "test_user", false)
+	require.NoError(t, err)
+	report, err := kbfsOps.AuditTLF(ctx, h)
+	require.NoError(t, err)
+	require.True(t, report.IsClean(), "%+v", report)
+}
+
+func TestKBFSOpsAuditTLFXattrs(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer config.Shutdown()
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SetXattr(ctx, fileNode, "user.big",
+		make([]byte, maxInlineXattrSize+1))
+	require.NoError(t, err)
+
+	h, err := ParseTlfHandle(ctx, config.KBPKI(), "test_user", false)
+	require.NoError(t, err)
+	report, err := kbfsOps.AuditTLF(ctx, h)
+	require.NoError(t, err)
+	require.True(t, report.IsClean(), "%+v", report)
+
+	// Drop the reference to the xattr's block; the audit should
+	// notice.
+	de, err := getOps(config, report.Tlf).statEntry(ctx, fileNode)
+	require.NoError(t, err)
+	ptr := de.Xattrs["user.big"].Block.BlockPointer
+	_, err = config.BlockServer().RemoveBlockReferences(ctx, report.Tlf,
+		map[BlockID][]BlockContext{ptr.ID: {ptr.BlockContext}})
+	require.NoError(t, err)
+
+	report, err = kbfsOps.AuditTLF(ctx, h)
+	require.NoError(t, err)
+	require.Len(t, report.Missing, 1)
+	require.Equal(t, ptr, report.Missing[0].Ptr)
+	require.Equal(t, "/a (xattr user.big)", report.Missing[0].Path)
+}
@@ -157,6 +157,11 @@ type TlfEditHistory struct {
 	wg       RepeatedWaitGroup
 	cancel   context.CancelFunc
 
+	// processStart starts the processing goroutine on the first
+	// update, rather than for every folder that's opened.
+	processStart sync.Once
+	processCtx   context.Context
+
 	lock     sync.Mutex
 	edits    TlfWriterEdits
 	shutdown bool
@@ -168,13 +173,13 @@ func NewTlfEditHistory(config Config, fbo *folderBranchOps,
 	log logger.Logger) *TlfEditHistory {
 	processCtx, cancel := context.WithCancel(context.Background())
 	teh := &TlfEditHistory{
-		config:   config,
-		fbo:      fbo,
-		log:      log,
-		rmdsChan: make(chan []ImmutableRootMetadata, 100),
-		cancel:   cancel,
+		config:     config,
+		fbo:        fbo,
+		log:        log,
+		rmdsChan:   make(chan []ImmutableRootMetadata, 100),
+		cancel:     cancel,
+		processCtx: processCtx,
 	}
-	go teh.process(processCtx)
 	return teh
 }
 
@@ -642,6 +647,7 @@ func (teh *TlfEditHistory) UpdateHistory(ctx context.Context,
 	}
 	defer teh.sends.Done()
 
+	teh.processStart.Do(func() { go teh.process(teh.processCtx) })
 	teh.wg.Add(1)
 	select {
 	case teh.rmdsChan <- rmds:
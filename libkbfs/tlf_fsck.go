@@ -0,0 +1,221 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+)
+
+// MDChainProblem describes a merged MD revision of a TLF that isn't
+// a valid successor of the one before it, or couldn't be fetched and
+// verified at all.
+type MDChainProblem struct {
+	Revision MetadataRevision
+	Err      error
+}
+
+// JournalDataProblem describes a block put in a TLF's journal whose
+// data has gone missing or been corrupted, which stops the journal
+// from flushing.
+type JournalDataProblem struct {
+	Ptr BlockPointer
+	// Repaired is set if the data was fetched back from the
+	// server and put back into the journal.
+	Repaired bool
+	// Err says why the data couldn't be restored, if a repair
+	// was attempted.
+	Err error
+}
+
+// TLFFsckReport is the result of checking a TLF's MD chain, its
+// blocks, and its journal, if it has one.
+type TLFFsckReport struct {
+	// Audit is the result of checking every block reachable from
+	// the head, which also checks that the server still has a
+	// live reference for each one.
+	Audit TLFAuditReport
+	// MDRevisionsChecked is the number of merged MD revisions
+	// whose signatures, writers and predecessor links were
+	// checked.
+	MDRevisionsChecked int
+	MDChain            []MDChainProblem
+	// DiskUsage is the usage the head MD accounts to the TLF's
+	// quota, and ReachableBytes is the size of the blocks that
+	// are actually reachable from the head.
+	DiskUsage      uint64
+	ReachableBytes uint64
+	// Journaled is set if the TLF's journal was checked.
+	Journaled   bool
+	JournalData []JournalDataProblem
+}
+
+// DiskUsageMismatch returns true if the head's disk usage doesn't
+// match the blocks reachable from it.  Only meaningful when the
+// audit found no missing or corrupt blocks.
+func (r TLFFsckReport) DiskUsageMismatch() bool {
+	return len(r.Audit.Missing) == 0 && len(r.Audit.Corrupt) == 0 &&
+		r.DiskUsage != r.ReachableBytes
+}
+
+// IsClean returns true if the check found no problems, or repaired
+// all the ones it found.
+func (r TLFFsckReport) IsClean() bool {
+	for _, problem := range r.JournalData {
+		if !problem.Repaired {
+			return false
+		}
+	}
+	return r.Audit.IsClean() && len(r.MDChain) == 0 &&
+		!r.DiskUsageMismatch()
+}
+
+// checkMDChain fetches every merged revision up to head, in batches,
+// and checks that each was made by a writer of the TLF as of that
+// revision, and is a valid successor of the revision before it.
+// Fetching through MDOps checks the signatures.  It stops at the
+// first batch that can't be fetched, since nothing after it can be
+// linked back to the start.
+func checkMDChain(ctx context.Context, config Config,
+	head ImmutableRootMetadata) (checked int, problems []MDChainProblem) {
+	var prev ImmutableRootMetadata
+	for start := MetadataRevisionInitial; start <= head.Revision(); start += maxMDsAtATime {
+		end := start + maxMDsAtATime - 1 // range is inclusive
+		if end > head.Revision() {
+			end = head.Revision()
+		}
+		rmds, err := getMDRange(
+			ctx, config, head.TlfID(), NullBranchID, start, end, Merged)
+		if err != nil {
+			return checked, append(problems, MDChainProblem{start, err})
+		}
+
+		for _, rmd := range rmds {
+			checked++
+			writer := rmd.LastModifyingWriter()
+			if !rmd.GetTlfHandle().IsWriter(writer) {
+				problems = append(problems, MDChainProblem{rmd.Revision(),
+					fmt.Errorf("Last modified by %s, who isn't a writer",
+						writer)})
+			}
+			if prev != (ImmutableRootMetadata{}) {
+				err := prev.CheckValidSuccessor(
+					prev.MdID(), rmd.ReadOnlyRootMetadata)
+				if err != nil {
+					problems = append(problems,
+						MDChainProblem{rmd.Revision(), err})
+				}
+			}
+			prev = rmd
+		}
+
+		if len(rmds) < int(end-start)+1 {
+			return checked, append(problems, MDChainProblem{
+				start + MetadataRevision(len(rmds)),
+				fmt.Errorf("Server returned only %d of revisions %d to %d",
+					len(rmds), start, end)})
+		}
+	}
+	return checked, problems
+}
+
+// checkPutsMissingData reports the block puts in the journal whose
+// data has gone missing or been corrupted.  If repair is true, it fetches the data for
+// each one back from the server, which works if the put had already
+// been flushed before the data went missing.
+func (j *tlfJournal) checkPutsMissingData(ctx context.Context,
+	repair bool) ([]JournalDataProblem, error) {
+	missing, err := func() ([]BlockPointer, error) {
+		j.journalLock.RLock()
+		defer j.journalLock.RUnlock()
+		if err := j.checkEnabledLocked(); err != nil {
+			return nil, err
+		}
+		return j.blockJournal.getPutsMissingData(ctx)
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	problems := make([]JournalDataProblem, 0, len(missing))
+	for _, ptr := range missing {
+		problem := JournalDataProblem{Ptr: ptr}
+		if repair {
+			problem.Err = j.restoreBlockData(ctx, ptr)
+			problem.Repaired = problem.Err == nil
+		}
+		problems = append(problems, problem)
+	}
+	return problems, nil
+}
+
+// restoreBlockData fetches the data for ptr from the server, and
+// puts it back into the journal.
+func (j *tlfJournal) restoreBlockData(
+	ctx context.Context, ptr BlockPointer) error {
+	// Don't hold the journal lock over the network.
+	buf, serverHalf, err := j.delegateBlockServer.Get(
+		ctx, j.tlfID, ptr.ID, ptr.BlockContext)
+	if err != nil {
+		return err
+	}
+
+	j.journalLock.Lock()
+	defer j.journalLock.Unlock()
+	if err := j.checkEnabledLocked(); err != nil {
+		return err
+	}
+	before := j.blockJournal.unflushedBytes
+	err = j.blockJournal.restoreData(ctx, ptr.ID, buf, serverHalf)
+	j.config.diskLimiter().addJournalBytes(
+		j.blockJournal.unflushedBytes - before)
+	if err != nil {
+		return err
+	}
+	j.signalWork()
+	return nil
+}
+
+// CheckJournalData reports the block puts in the given TLF's journal
+// whose data has gone missing, and if repair is true, tries to
+// restore each one's data from the server.
+func (j *JournalServer) CheckJournalData(ctx context.Context, tlfID TlfID,
+	repair bool) ([]JournalDataProblem, error) {
+	tlfJournal, ok := j.getTLFJournal(tlfID)
+	if !ok {
+		return nil, fmt.Errorf("Journal not enabled for %s", tlfID)
+	}
+	return tlfJournal.checkPutsMissingData(ctx, repair)
+}
+
+// fsckTLF checks md's TLF, starting with its journal, if it has one,
+// so that any repairs there are seen by the rest of the checks.
+// Only the journal is ever changed, and only if repair is true.
+func fsckTLF(ctx context.Context, config Config, md ImmutableRootMetadata,
+	repair bool) (report TLFFsckReport, err error) {
+	if jServer, err := GetJournalServer(config); err == nil {
+		if _, err := jServer.JournalStatus(md.TlfID()); err == nil {
+			report.Journaled = true
+			report.JournalData, err = jServer.CheckJournalData(
+				ctx, md.TlfID(), repair)
+			if err != nil {
+				return TLFFsckReport{}, err
+			}
+		}
+	}
+
+	report.MDRevisionsChecked, report.MDChain =
+		checkMDChain(ctx, config, md)
+
+	a := newTLFAuditor(config, md)
+	report.Audit, err = a.audit(ctx, md)
+	if err != nil {
+		return TLFFsckReport{}, err
+	}
+	report.DiskUsage = md.DiskUsage()
+	report.ReachableBytes = a.reachableBytes
+	return report, nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKBFSOpsFsckTLF(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+
+	fixture := MakeTLFFixtureOrBust(t, ctx, config, nil, "test_user", false,
+		TLFFixtureSpec{
+			Seed:        1,
+			Depth:       1,
+			Fanout:      1,
+			FilesPerDir: 1,
+			FileSize:    UniformFileSize(1, 100),
+			Revisions:   2,
+		})
+	rootNode := fixture.Root
+	kbfsOps := config.KBFSOps()
+	// Leave some unreferenced blocks behind too.
+	_, _, err := kbfsOps.CreateFile(ctx, rootNode, "c", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.RemoveEntry(ctx, rootNode, "c")
+	require.NoError(t, err)
+
+	h, err := ParseTlfHandle(ctx, config.KBPKI(), "test_user", false)
+	require.NoError(t, err)
+	report, err := kbfsOps.FsckTLF(ctx, h, false)
+	require.NoError(t, err)
+	require.True(t, report.IsClean(), "%+v", report)
+	require.False(t, report.Journaled)
+	// The root's creation, two revisions for each of the fixture's
+	// two non-empty files, one for its directory, its two
+	// rewrites, and the create and remove above.
+	require.Equal(t, 10, report.MDRevisionsChecked)
+	require.Equal(t, report.DiskUsage, report.ReachableBytes)
+}
+
+func TestKBFSOpsFsckTLFJournalRepair(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "tlf_fsck")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+	config.EnableJournaling(tempdir)
+	jServer, err := GetJournalServer(config)
+	require.NoError(t, err)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	tlfID := rootNode.GetFolderBranch().Tlf
+	err = jServer.Enable(ctx, tlfID, TLFJournalBackgroundWorkPaused)
+	require.NoError(t, err)
+
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte("hello"), 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	// Pretend the file's block was flushed, but its data was then
+	// lost from the journal before the put entry was removed.
+	md, err := kbfsOps.GetNodeMetadata(ctx, fileNode)
+	require.NoError(t, err)
+	ptr := md.BlockInfo.BlockPointer
+	tlfJournal, ok := jServer.getTLFJournal(tlfID)
+	require.True(t, ok)
+	buf, serverHalf, err := tlfJournal.getBlockDataWithContext(
+		ptr.ID, ptr.BlockContext)
+	require.NoError(t, err)
+	err = tlfJournal.delegateBlockServer.Put(
+		ctx, tlfID, ptr.ID, ptr.BlockContext, buf, serverHalf)
+	require.NoError(t, err)
+	err = os.RemoveAll(tlfJournal.blockJournal.blockPath(ptr.ID))
+	require.NoError(t, err)
+
+	h, err := ParseTlfHandle(ctx, config.KBPKI(), "test_user", false)
+	require.NoError(t, err)
+	report, err := kbfsOps.FsckTLF(ctx, h, false)
+	require.NoError(t, err)
+	require.True(t, report.Journaled)
+	require.False(t, report.IsClean())
+	// The journal only knows the block's ID and context.
+	journalPtr := BlockPointer{ID: ptr.ID, BlockContext: ptr.BlockContext}
+	require.Equal(t, []JournalDataProblem{{Ptr: journalPtr}},
+		report.JournalData)
+
+	report, err = kbfsOps.FsckTLF(ctx, h, true)
+	require.NoError(t, err)
+	require.True(t, report.IsClean(), "%+v", report)
+	require.Equal(t,
+		[]JournalDataProblem{{Ptr: journalPtr, Repaired: true}},
+		report.JournalData)
+
+	report, err = kbfsOps.FsckTLF(ctx, h, false)
+	require.NoError(t, err)
+	require.True(t, report.IsClean(), "%+v", report)
+	require.Len(t, report.JournalData, 0)
+
+	err = jServer.Flush(ctx, tlfID)
+	require.NoError(t, err)
+	jServer.ResumeBackgroundWork(ctx, tlfID)
+}
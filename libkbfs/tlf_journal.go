@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/keybase/client/go/logger"
 	"github.com/keybase/client/go/protocol/keybase1"
@@ -27,7 +28,11 @@ type tlfJournalConfig interface {
 	currentInfoGetter() currentInfoGetter
 	encryptionKeyGetter() encryptionKeyGetter
 	MDServer() MDServer
+	NetworkState() NetworkState
+	BlockTransferMeter() *BlockTransferMeter
+	Tracer() Tracer
 	MakeLogger(module string) logger.Logger
+	diskLimiter() *diskLimiter
 }
 
 // tlfJournalConfigWrapper is an adapter for Config objects to the
@@ -44,6 +49,10 @@ func (ca tlfJournalConfigAdapter) encryptionKeyGetter() encryptionKeyGetter {
 	return ca.Config.KeyManager()
 }
 
+func (ca tlfJournalConfigAdapter) diskLimiter() *diskLimiter {
+	return getDiskLimiter(ca.Config)
+}
+
 // TLFJournalStatus represents the status of a TLF's journal for
 // display in diagnostics. It is suitable for encoding directly as
 // JSON.
@@ -53,6 +62,13 @@ type TLFJournalStatus struct {
 	BranchID       string
 	BlockOpCount   uint64
 	UnflushedBytes int64 // (signed because os.FileInfo.Size() is signed)
+	// FlushDeferred is whether background flushes are waiting
+	// for an unmetered network, since there's too much to flush
+	// on a metered one.
+	FlushDeferred bool `json:",omitempty"`
+	// LastFlushError is why the last background flush failed,
+	// if it did.  It's cleared by the next one that works.
+	LastFlushError string `json:",omitempty"`
 }
 
 // TLFJournalBackgroundWorkStatus indicates whether a journal should
@@ -147,6 +163,15 @@ type tlfJournal struct {
 	blockJournal *blockJournal
 	mdJournal    *mdJournal
 	disabled     bool
+	// coalesceRev is the merged MD revision, if any, that may
+	// still be replaced by a later put of the same revision (see
+	// RootMetadata.coalesceUntil), until coalesceUntil.  It isn't
+	// flushed before then.
+	coalesceRev   MetadataRevision
+	coalesceUntil time.Time
+	// lastFlushErr is the error from the last background flush,
+	// if it failed and not just because KBFS is offline.
+	lastFlushErr error
 
 	bwDelegate tlfJournalBWDelegate
 }
@@ -196,6 +221,10 @@ func makeTLFJournal(
 		bwDelegate:          bwDelegate,
 	}
 
+	// Blocks left over from before count against the disk limit
+	// too, though they're never held up.
+	config.diskLimiter().addJournalBytes(blockJournal.unflushedBytes)
+
 	go j.doBackgroundWorkLoop(bws)
 
 	// Signal work to pick up any existing journal entries.
@@ -205,6 +234,22 @@ func makeTLFJournal(
 	return j, nil
 }
 
+// isTLFJournalEmpty returns whether the journal in tlfDir has no
+// block or MD entries, without reading it in.
+func isTLFJournalEmpty(codec Codec, tlfDir string) (bool, error) {
+	for _, name := range []string{"block_journal", "md_journal"} {
+		length, err := makeDiskJournal(
+			codec, filepath.Join(tlfDir, name), nil).length()
+		if err != nil {
+			return false, err
+		}
+		if length > 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
 func (j *tlfJournal) signalWork() {
 	j.wg.Add(1)
 	select {
@@ -312,7 +357,15 @@ func (j *tlfJournal) doBackgroundWorkLoop(bws TLFJournalBackgroundWorkStatus) {
 			needShutdown := false
 			select {
 			case err := <-errCh:
-				if err != nil {
+				j.setLastFlushErr(ctx, err)
+				if _, ok := err.(OfflineUnavailableError); ok {
+					// The work is retried once
+					// KBFS is back online.
+					j.log.CDebugf(ctx,
+						"Background work for %s waits "+
+							"until online: %v",
+						j.tlfID, err)
+				} else if err != nil {
 					j.log.CWarningf(ctx,
 						"Background work error for %s: %v",
 						j.tlfID, err)
@@ -382,11 +435,35 @@ func (j *tlfJournal) doBackgroundWork(ctx context.Context) <-chan error {
 	// TODO: Handle panics.
 	go func() {
 		defer j.wg.Done()
+		if j.flushDeferred() {
+			// The journal server signals this journal again
+			// once on an unmetered network.
+			j.log.CDebugf(ctx, "Deferring the flush of %s until "+
+				"on an unmetered network", j.tlfID)
+			errCh <- nil
+			return
+		}
 		errCh <- j.flush(ctx)
 	}()
 	return errCh
 }
 
+func (j *tlfJournal) flushDeferredLocked() bool {
+	return j.config.NetworkState() == NetworkMetered &&
+		j.blockJournal.unflushedBytes > meteredFlushMaxBytes
+}
+
+// flushDeferred returns whether background flushes should wait for
+// an unmetered network.
+func (j *tlfJournal) flushDeferred() bool {
+	j.journalLock.RLock()
+	defer j.journalLock.RUnlock()
+	if err := j.checkEnabledLocked(); err != nil {
+		return false
+	}
+	return j.flushDeferredLocked()
+}
+
 // We don't guarantee that pause/resume requests will be processed in
 // strict FIFO order. In particular, multiple pause requests are
 // collapsed into one (also multiple resume requests), so it's
@@ -422,15 +499,45 @@ func (j *tlfJournal) getJournalEnds(ctx context.Context) (
 		return 0, 0, err
 	}
 
+	// Leave an MD that may still be replaced for later.
+	if j.coalescingLocked(j.coalesceRev) && mdEnd > j.coalesceRev {
+		mdEnd = j.coalesceRev
+	}
+
 	return blockEnd, mdEnd, nil
 }
 
+// coalescingLocked returns whether rev may still be replaced by a
+// later put of the same revision.
+func (j *tlfJournal) coalescingLocked(rev MetadataRevision) bool {
+	return rev != MetadataRevisionUninitialized && rev == j.coalesceRev &&
+		j.mdJournal.branchID == NullBranchID &&
+		time.Now().Before(j.coalesceUntil)
+}
+
+// closeCoalesceWindow makes the MD that may still be replaced, if
+// any, final and ready to be flushed, and returns whether there was
+// one.
+func (j *tlfJournal) closeCoalesceWindow() bool {
+	j.journalLock.Lock()
+	defer j.journalLock.Unlock()
+	wasOpen := j.coalesceRev != MetadataRevisionUninitialized
+	j.coalesceRev = MetadataRevisionUninitialized
+	return wasOpen
+}
+
 func (j *tlfJournal) flush(ctx context.Context) (err error) {
 	j.flushLock.Lock()
 	defer j.flushLock.Unlock()
 
 	flushedBlockEntries := 0
 	flushedMDEntries := 0
+	ctx, span := startSpan(ctx, j.config.Tracer(), "Journal.Flush")
+	defer func() {
+		span.SetTag("blocks", flushedBlockEntries)
+		span.SetTag("mds", flushedMDEntries)
+		span.Finish(err)
+	}()
 	defer func() {
 		if err != nil {
 			j.deferLog.CDebugf(ctx,
@@ -467,6 +574,7 @@ func (j *tlfJournal) flush(ctx context.Context) (err error) {
 
 		// TODO: Flush MDs in batch.
 
+		numMDsFlushed := 0
 		for {
 			flushed, err := j.flushOneMDOp(ctx, mdEnd)
 			if err != nil {
@@ -475,7 +583,17 @@ func (j *tlfJournal) flush(ctx context.Context) (err error) {
 			if !flushed {
 				break
 			}
-			flushedMDEntries++
+			numMDsFlushed++
+		}
+		flushedMDEntries += numMDsFlushed
+
+		if numFlushed == 0 && numMDsFlushed == 0 {
+			// What's left is an MD that may still be
+			// replaced; it's flushed once its coalescing
+			// window closes.
+			j.log.CDebugf(ctx, "Leaving revision %d unflushed "+
+				"for now", mdEnd)
+			break
 		}
 	}
 
@@ -488,6 +606,12 @@ var errTLFJournalShutdown = errors.New("tlfJournal is shutdown")
 var errTLFJournalDisabled = errors.New("tlfJournal is disabled")
 var errTLFJournalNotEmpty = errors.New("tlfJournal is not empty")
 
+// errTLFJournalCoalesceClosed is returned when a put tries to replace
+// an MD whose coalescing window has closed, or which has already
+// been flushed.  The caller should retry with a new revision.
+var errTLFJournalCoalesceClosed = errors.New(
+	"tlfJournal can no longer replace the MD")
+
 func (j *tlfJournal) checkEnabledLocked() error {
 	if j.blockJournal == nil || j.mdJournal == nil {
 		return errTLFJournalShutdown
@@ -518,8 +642,12 @@ func (j *tlfJournal) removeFlushedBlockEntries(ctx context.Context,
 		return err
 	}
 
-	return j.blockJournal.removeFlushedEntries(ctx, entries, j.tlfID,
+	before := j.blockJournal.unflushedBytes
+	err := j.blockJournal.removeFlushedEntries(ctx, entries, j.tlfID,
 		j.config.Reporter())
+	j.config.diskLimiter().releaseJournalBytes(
+		before - j.blockJournal.unflushedBytes)
+	return err
 }
 
 func (j *tlfJournal) flushBlockEntries(
@@ -537,7 +665,8 @@ func (j *tlfJournal) flushBlockEntries(
 	var tlfName CanonicalTlfName
 	err = flushBlockEntries(ctx, j.log, j.delegateBlockServer,
 		j.config.BlockCache(), j.config.Reporter(),
-		j.tlfID, tlfName, entries)
+		j.tlfID, tlfName, entries,
+		j.config.BlockTransferMeter().PutParallelism())
 	if err != nil {
 		return 0, err
 	}
@@ -580,6 +709,7 @@ func (j *tlfJournal) convertMDsToBranchAndGetNextEntry(
 	if err != nil {
 		return MdID{}, nil, err
 	}
+	j.coalesceRev = MetadataRevisionUninitialized
 
 	if j.onBranchChange != nil {
 		j.onBranchChange.onTLFBranchChange(j.tlfID, bid)
@@ -701,6 +831,41 @@ func (j *tlfJournal) getJournalEntryCounts() (
 	return blockEntryCount, mdEntryCount, nil
 }
 
+// setLastFlushErr records the result of a background flush, and
+// reports the journal stalling or flushing again.
+func (j *tlfJournal) setLastFlushErr(ctx context.Context, err error) {
+	if _, ok := err.(OfflineUnavailableError); ok ||
+		err == context.Canceled {
+		// Not a problem with the journal.
+		return
+	}
+	stalled := func() bool {
+		j.journalLock.Lock()
+		defer j.journalLock.Unlock()
+		stalled := j.lastFlushErr != nil
+		j.lastFlushErr = err
+		return stalled
+	}()
+	switch {
+	case err != nil && !stalled:
+		j.config.Reporter().ReportEvent(ctx, ReportEvent{
+			Type:     EventJournalStall,
+			Severity: SeverityWarning,
+			TlfID:    j.tlfID.String(),
+			Public:   j.tlfID.IsPublic(),
+			Err:      err,
+		})
+	case err == nil && stalled:
+		j.config.Reporter().ReportEvent(ctx, ReportEvent{
+			Type:     EventJournalStall,
+			Severity: SeverityInfo,
+			TlfID:    j.tlfID.String(),
+			Public:   j.tlfID.IsPublic(),
+			Message:  "Journal flushing again",
+		})
+	}
+}
+
 func (j *tlfJournal) getJournalStatus() (TLFJournalStatus, error) {
 	j.journalLock.RLock()
 	defer j.journalLock.RUnlock()
@@ -720,12 +885,18 @@ func (j *tlfJournal) getJournalStatus() (TLFJournalStatus, error) {
 	if err != nil {
 		return TLFJournalStatus{}, err
 	}
+	var lastFlushErr string
+	if j.lastFlushErr != nil {
+		lastFlushErr = j.lastFlushErr.Error()
+	}
 	return TLFJournalStatus{
 		BranchID:       j.mdJournal.getBranchID().String(),
 		RevisionStart:  earliestRevision,
 		RevisionEnd:    latestRevision,
 		BlockOpCount:   blockEntryCount,
 		UnflushedBytes: j.blockJournal.unflushedBytes,
+		FlushDeferred:  j.flushDeferredLocked(),
+		LastFlushError: lastFlushErr,
 	}, nil
 }
 
@@ -755,6 +926,10 @@ func (j *tlfJournal) shutdown() {
 	if err != nil {
 		panic(err)
 	}
+	// The blocks stay on disk, but they're counted again when the
+	// journal is next made.
+	j.config.diskLimiter().releaseJournalBytes(
+		j.blockJournal.unflushedBytes)
 	// Make further accesses error out.
 	j.blockJournal = nil
 	j.mdJournal = nil
@@ -827,13 +1002,29 @@ func (j *tlfJournal) getBlockDataWithContext(
 func (j *tlfJournal) putBlockData(
 	ctx context.Context, id BlockID, context BlockContext, buf []byte,
 	serverHalf BlockCryptKeyServerHalf) error {
+	// Wait for room on disk before taking the lock, so that
+	// flushes can make some.
+	limiter := j.config.diskLimiter()
+	reserved := int64(len(buf))
+	err := limiter.beforeBlockPut(ctx, reserved)
+	if err != nil {
+		return err
+	}
+	var stored int64
+	defer func() {
+		// putData doesn't store blocks it already has.
+		limiter.releaseJournalBytes(reserved - stored)
+	}()
+
 	j.journalLock.Lock()
 	defer j.journalLock.Unlock()
 	if err := j.checkEnabledLocked(); err != nil {
 		return err
 	}
 
-	err := j.blockJournal.putData(ctx, id, context, buf, serverHalf)
+	before := j.blockJournal.unflushedBytes
+	err = j.blockJournal.putData(ctx, id, context, buf, serverHalf)
+	stored = j.blockJournal.unflushedBytes - before
 	if err != nil {
 		return err
 	}
@@ -964,12 +1155,38 @@ func (j *tlfJournal) putMD(ctx context.Context, rmd *RootMetadata) (
 		return MdID{}, err
 	}
 
+	if rmd.replacesHead {
+		mdEnd, err := j.mdJournal.end()
+		if err != nil {
+			return MdID{}, err
+		}
+		if !j.coalescingLocked(rmd.Revision()) ||
+			mdEnd != rmd.Revision()+1 {
+			return MdID{}, errTLFJournalCoalesceClosed
+		}
+	}
+
 	mdID, err := j.mdJournal.put(ctx, uid, key, j.config.Crypto(),
 		j.config.encryptionKeyGetter(), j.config.BlockSplitter(), rmd)
 	if err != nil {
 		return MdID{}, err
 	}
 
+	switch {
+	case rmd.replacesHead:
+		// Still within the same window; there's nothing new to
+		// flush yet.
+		return mdID, nil
+	case !rmd.coalesceUntil.IsZero() && rmd.MergedStatus() == Merged:
+		j.coalesceRev = rmd.Revision()
+		j.coalesceUntil = rmd.coalesceUntil
+		// Flush the revisions before this one now, and this
+		// one once its window closes.
+		time.AfterFunc(rmd.coalesceUntil.Sub(time.Now()), j.signalWork)
+	default:
+		j.coalesceRev = MetadataRevisionUninitialized
+	}
+
 	j.signalWork()
 
 	return mdID, nil
@@ -993,11 +1210,16 @@ func (j *tlfJournal) clearMDs(ctx context.Context, bid BranchID) error {
 	}
 
 	// No need to signal work in this case.
+	j.coalesceRev = MetadataRevisionUninitialized
 	// MDv3 TODO: pass actual key bundles
 	return j.mdJournal.clear(ctx, uid, key, bid, nil)
 }
 
 func (j *tlfJournal) wait(ctx context.Context) error {
+	// Waiting means the caller wants everything on the server.
+	if j.closeCoalesceWindow() {
+		j.signalWork()
+	}
 	workLeft, err := j.wg.WaitUnlessPaused(ctx)
 	if err != nil {
 		return err
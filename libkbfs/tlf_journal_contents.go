@@ -0,0 +1,118 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"math"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// TLFJournalMDEntry describes a single MD in a TLF's journal.
+type TLFJournalMDEntry struct {
+	Revision       MetadataRevision
+	ID             MdID
+	LocalTimestamp time.Time
+	// MD is the decoded metadata object, if it could be read at
+	// all, even if it then failed verification.
+	MD BareRootMetadata `json:",omitempty"`
+	// Err is set if the MD couldn't be read, or didn't verify.
+	Err string `json:",omitempty"`
+}
+
+// TLFJournalBlockEntry describes a single block operation in a TLF's
+// journal.
+type TLFJournalBlockEntry struct {
+	Ordinal  uint64
+	Op       string
+	Contexts map[string][]BlockContext `json:",omitempty"`
+	Err      string                    `json:",omitempty"`
+}
+
+// TLFJournalContents is a read-only snapshot of everything in a TLF's
+// journal, for use by recovery and support tooling.  It is suitable
+// for encoding directly as JSON.
+type TLFJournalContents struct {
+	Status   TLFJournalStatus
+	MDs      []TLFJournalMDEntry
+	BlockOps []TLFJournalBlockEntry
+}
+
+// getJournalContents reads every entry in the journal.  Entries that
+// can't be read or verified are reported with an error instead of
+// failing the whole call, since a wedged journal is exactly what
+// this is for.
+func (j *tlfJournal) getJournalContents(ctx context.Context) (
+	TLFJournalContents, error) {
+	uid, key, err :=
+		getCurrentUIDAndVerifyingKey(ctx, j.config.currentInfoGetter())
+	if err != nil {
+		return TLFJournalContents{}, err
+	}
+
+	status, err := j.getJournalStatus()
+	if err != nil {
+		return TLFJournalContents{}, err
+	}
+	contents := TLFJournalContents{Status: status}
+
+	j.journalLock.RLock()
+	defer j.journalLock.RUnlock()
+	if err := j.checkEnabledLocked(); err != nil {
+		return TLFJournalContents{}, err
+	}
+
+	start, mdIDs, err := j.mdJournal.j.getRange(
+		MetadataRevisionInitial, math.MaxInt64)
+	if err != nil {
+		return TLFJournalContents{}, err
+	}
+	for i, mdID := range mdIDs {
+		entry := TLFJournalMDEntry{
+			Revision: start + MetadataRevision(i),
+			ID:       mdID,
+		}
+		// MDv3 TODO: pass actual key bundles
+		rmd, ts, err := j.mdJournal.getMD(uid, key, mdID, true)
+		if err != nil {
+			entry.Err = err.Error()
+			if rmd, err := j.mdJournal.readMD(mdID); err == nil {
+				entry.MD = rmd
+			}
+		} else {
+			entry.MD = rmd
+			entry.LocalTimestamp = ts
+		}
+		contents.MDs = append(contents.MDs, entry)
+	}
+
+	first, err := j.blockJournal.j.readEarliestOrdinal()
+	if os.IsNotExist(err) {
+		return contents, nil
+	} else if err != nil {
+		return TLFJournalContents{}, err
+	}
+	last, err := j.blockJournal.j.readLatestOrdinal()
+	if err != nil {
+		return TLFJournalContents{}, err
+	}
+	for o := first; o <= last; o++ {
+		entry := TLFJournalBlockEntry{Ordinal: uint64(o)}
+		e, err := j.blockJournal.readJournalEntry(o)
+		if err != nil {
+			entry.Err = err.Error()
+		} else {
+			entry.Op = e.Op.String()
+			entry.Contexts = make(map[string][]BlockContext, len(e.Contexts))
+			for id, contexts := range e.Contexts {
+				entry.Contexts[id.String()] = contexts
+			}
+		}
+		contents.BlockOps = append(contents.BlockOps, entry)
+	}
+	return contents, nil
+}
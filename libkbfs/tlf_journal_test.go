@@ -5,6 +5,7 @@
 package libkbfs
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"reflect"
@@ -74,6 +75,7 @@ type testTLFJournalConfig struct {
 	cig      singleCurrentInfoGetter
 	ekg      singleEncryptionKeyGetter
 	mdserver MDServer
+	netState NetworkState
 }
 
 func (c testTLFJournalConfig) BlockSplitter() BlockSplitter {
@@ -116,10 +118,26 @@ func (c testTLFJournalConfig) MDServer() MDServer {
 	return c.mdserver
 }
 
+func (c testTLFJournalConfig) NetworkState() NetworkState {
+	return c.netState
+}
+
+func (c testTLFJournalConfig) BlockTransferMeter() *BlockTransferMeter {
+	return nil
+}
+
+func (c testTLFJournalConfig) Tracer() Tracer {
+	return nil
+}
+
 func (c testTLFJournalConfig) MakeLogger(module string) logger.Logger {
 	return logger.NewTestLogger(c.t)
 }
 
+func (c testTLFJournalConfig) diskLimiter() *diskLimiter {
+	return nil
+}
+
 func (c testTLFJournalConfig) makeBlock(data []byte) (
 	BlockID, BlockContext, BlockCryptKeyServerHalf) {
 	id, err := c.crypto.MakePermanentBlockID(data)
@@ -188,7 +206,7 @@ func setupTLFJournalTest(
 	config = &testTLFJournalConfig{
 		t, FakeTlfID(1, false), bsplitter, codec, crypto,
 		nil, NewMDCacheStandard(10), NewReporterSimple(newTestClockNow(), 10),
-		cig, ekg, mdserver,
+		cig, ekg, mdserver, NetworkUnmetered,
 	}
 
 	// Time out individual tests after 10 seconds.
@@ -422,6 +440,43 @@ func TestTLFJournalSecondBlockOpWhileBusy(t *testing.T) {
 	putBlock(ctx, t, config, tlfJournal, []byte{1, 2, 3, 4, 5})
 }
 
+func TestTLFJournalMeteredFlushDeferred(t *testing.T) {
+	tempdir, config, ctx, cancel, tlfJournal, delegate :=
+		setupTLFJournalTest(t, TLFJournalBackgroundWorkEnabled)
+	defer teardownTLFJournalTest(
+		tempdir, config, ctx, cancel, tlfJournal, delegate)
+
+	config.netState = NetworkMetered
+
+	// Small flushes still happen on a metered network.
+	putBlock(ctx, t, config, tlfJournal, []byte{1, 2, 3, 4})
+	delegate.requireNextState(ctx, bwBusy)
+	delegate.requireNextState(ctx, bwIdle)
+	status, err := tlfJournal.getJournalStatus()
+	require.NoError(t, err)
+	require.Equal(t, int64(0), status.UnflushedBytes)
+	require.False(t, status.FlushDeferred)
+
+	// Large ones wait for an unmetered network.
+	data := make([]byte, meteredFlushMaxBytes+1)
+	putBlock(ctx, t, config, tlfJournal, data)
+	delegate.requireNextState(ctx, bwBusy)
+	delegate.requireNextState(ctx, bwIdle)
+	status, err = tlfJournal.getJournalStatus()
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), status.UnflushedBytes)
+	require.True(t, status.FlushDeferred)
+
+	config.netState = NetworkUnmetered
+	tlfJournal.signalWork()
+	delegate.requireNextState(ctx, bwBusy)
+	delegate.requireNextState(ctx, bwIdle)
+	status, err = tlfJournal.getJournalStatus()
+	require.NoError(t, err)
+	require.Equal(t, int64(0), status.UnflushedBytes)
+	require.False(t, status.FlushDeferred)
+}
+
 type hangingMDServer struct {
 	MDServer
 	// Closed on put.
@@ -878,3 +933,32 @@ func TestTLFJournalFlushOrdering(t *testing.T) {
 		"Expected %v or %v, got %v", expectedPuts1,
 		expectedPuts2, puts)
 }
+
+func TestTLFJournalContents(t *testing.T) {
+	tempdir, config, ctx, cancel, tlfJournal, delegate :=
+		setupTLFJournalTest(t, TLFJournalBackgroundWorkPaused)
+	defer teardownTLFJournalTest(
+		tempdir, config, ctx, cancel, tlfJournal, delegate)
+
+	contents, err := tlfJournal.getJournalContents(ctx)
+	require.NoError(t, err)
+	require.Len(t, contents.MDs, 0)
+	require.Len(t, contents.BlockOps, 0)
+
+	putBlock(ctx, t, config, tlfJournal, []byte{1, 2, 3, 4})
+	putOneMD(ctx, config, tlfJournal)
+
+	contents, err = tlfJournal.getJournalContents(ctx)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), contents.Status.BlockOpCount)
+	require.Len(t, contents.MDs, 1)
+	require.Equal(t, MetadataRevisionInitial, contents.MDs[0].Revision)
+	require.Equal(t, "", contents.MDs[0].Err)
+	require.NotNil(t, contents.MDs[0].MD)
+	require.Len(t, contents.BlockOps, 1)
+	require.Equal(t, blockPutOp.String(), contents.BlockOps[0].Op)
+	require.Len(t, contents.BlockOps[0].Contexts, 1)
+
+	_, err = json.Marshal(contents)
+	require.NoError(t, err)
+}
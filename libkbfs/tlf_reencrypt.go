@@ -0,0 +1,628 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// reencryptChunkSize is how much of a file ReencryptJob reads and
+// rewrites at a time.
+const reencryptChunkSize = 512 * 1024
+
+// OldKeyGenRanges returns whether any of the blocks of the given
+// file are encrypted with an older key generation than the latest,
+// and the ranges of the file that need to be rewritten to fix that:
+// the data of each block of data on an older one, or, if only the
+// top block or indirect blocks are on an older one, the first byte
+// of data, since rewriting any of it rewrites them all.  An empty
+// file has no ranges, but can still be rewritten (see Rewrite).
+func (fbo *folderBlockOps) OldKeyGenRanges(
+	ctx context.Context, lState *lockState, kmd KeyMetadata,
+	file path) (old bool, ranges []DataRange, err error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	latest := kmd.LatestKeyGeneration()
+	de, err := fbo.getDirtyEntryLocked(ctx, lState, kmd, file)
+	if err != nil {
+		return false, nil, err
+	}
+	fblock, err := fbo.getFileTreeLocked(
+		ctx, lState, kmd, file.tailPointer(), file.Branch, file)
+	if err != nil {
+		return false, nil, err
+	}
+	if !fblock.IsInd || de.Size == 0 {
+		if file.tailPointer().KeyGen >= latest {
+			return false, nil, nil
+		}
+		if de.Size == 0 {
+			return true, nil, nil
+		}
+		return true, []DataRange{{0, de.Size}}, nil
+	}
+
+	var first *DataRange
+	for i, iptr := range fblock.IPtrs {
+		start := uint64(iptr.Off)
+		end := de.Size
+		if i+1 < len(fblock.IPtrs) {
+			end = uint64(fblock.IPtrs[i+1].Off)
+		}
+		// Rewriting a hole would fill it in, so only the block's
+		// own contents count.
+		if fblock.hasHoles() {
+			block, err := fbo.getFileBlockLocked(
+				ctx, lState, kmd, iptr.BlockPointer, file, blockRead)
+			if err != nil {
+				return false, nil, err
+			}
+			if e := start + uint64(len(block.Contents)); e < end {
+				end = e
+			}
+		}
+		if end <= start {
+			continue
+		}
+		if first == nil {
+			first = &DataRange{start, 1}
+		}
+		if iptr.KeyGen < latest {
+			ranges = addDataRange(ranges, start, end)
+		}
+	}
+	if len(ranges) > 0 || first == nil {
+		return len(ranges) > 0, ranges, nil
+	}
+
+	old = file.tailPointer().KeyGen < latest
+	for _, level := range fblock.parents {
+		for _, iptr := range level {
+			old = old || iptr.KeyGen < latest
+		}
+	}
+	if !old {
+		return false, nil, nil
+	}
+	return true, []DataRange{*first}, nil
+}
+
+// Rewrite reads up to n bytes of the given file at off, and writes
+// them back unchanged, dirtying the blocks that hold them so that
+// the next sync re-encrypts them with the latest key generation.
+// The read and write happen together under blockLock, so a
+// concurrent Write can't be lost.  If the file is empty, and n is 0,
+// its top block is dirtied instead.  If the file had no other
+// changes, syncing it leaves its times alone.  It returns the number
+// of bytes rewritten, which is less than n only at the end of the
+// file.
+func (fbo *folderBlockOps) Rewrite(
+	ctx context.Context, lState *lockState, kmd KeyMetadata,
+	file Node, off, n int64) (int64, error) {
+	c, err := fbo.config.DirtyBlockCache().RequestPermissionToDirty(ctx,
+		fbo.id(), n)
+	if err != nil {
+		return 0, err
+	}
+	defer fbo.config.DirtyBlockCache().UpdateUnsyncedBytes(fbo.id(),
+		-n, false)
+	err = fbo.maybeWaitOnDeferredWrites(ctx, lState, file, c)
+	if err != nil {
+		return 0, err
+	}
+
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+
+	filePath, err := fbo.pathFromNodeForBlockWriteLocked(lState, file)
+	if err != nil {
+		return 0, err
+	}
+
+	data := make([]byte, 0, n)
+	_, err = fbo.readLocked(ctx, lState, kmd, filePath, off, n,
+		func(d []byte, _ bool) {
+			data = append(data, d...)
+		})
+	if err != nil {
+		return 0, err
+	}
+	dirty := fbo.config.DirtyBlockCache().IsDirty(
+		fbo.id(), filePath.tailPointer(), filePath.Branch)
+	if len(data) == 0 {
+		if n != 0 || dirty {
+			return 0, nil
+		}
+		return 0, fbo.rewriteEmptyLocked(ctx, lState, kmd, filePath)
+	}
+	if !dirty {
+		fbo.rewriteOnly[filePath.tailPointer()] = true
+	}
+
+	defer func() {
+		fbo.doDeferWrite = false
+	}()
+
+	_, dirtyPtrs, newlyDirtiedChildBytes, err := fbo.writeDataLocked(
+		ctx, lState, kmd, filePath, data, off)
+	if err != nil {
+		return 0, err
+	}
+
+	if fbo.doDeferWrite {
+		// As in Write, redo the rewrite once the ongoing sync is
+		// done.
+		fbo.log.CDebugf(ctx, "Deferring a rewrite to file %v off=%d "+
+			"len=%d", filePath.tailPointer(), off, len(data))
+		fbo.deferredDirtyDeletes = append(fbo.deferredDirtyDeletes,
+			dirtyPtrs...)
+		fbo.deferredWrites = append(fbo.deferredWrites,
+			func(ctx context.Context, lState *lockState, kmd KeyMetadata, f path) error {
+				df := fbo.getOrCreateDirtyFileLocked(lState, filePath)
+				df.updateNotYetSyncingBytes(-newlyDirtiedChildBytes)
+				_, _, _, err = fbo.writeDataLocked(
+					ctx, lState, kmd, f, data, off)
+				return err
+			})
+	}
+
+	return int64(len(data)), nil
+}
+
+// rewriteEmptyLocked dirties the top block of the given clean file,
+// if it's empty, so that the next sync readies it again.
+func (fbo *folderBlockOps) rewriteEmptyLocked(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, file path) error {
+	fbo.blockLock.AssertLocked(lState)
+
+	fblock, _, err := fbo.writeGetFileLocked(ctx, lState, kmd, file)
+	if err != nil {
+		return err
+	}
+	de, err := fbo.getDirtyEntryLocked(ctx, lState, kmd, file)
+	if err != nil {
+		return err
+	}
+	if de.Size != 0 {
+		return nil
+	}
+
+	fbo.getOrCreateDirtyFileLocked(lState, file)
+	si, err := fbo.getOrCreateSyncInfoLocked(lState, de)
+	if err != nil {
+		return err
+	}
+	si.op.addTruncate(0)
+	fbo.deCache[file.tailPointer().ref()] = de
+	fbo.rewriteOnly[file.tailPointer()] = true
+	return fbo.cacheBlockIfNotYetDirtyLocked(
+		lState, file.tailPointer(), file, fblock)
+}
+
+// reencryptFile rewrites the parts of file whose blocks are
+// encrypted with an older key generation than the latest, and syncs
+// it.  It returns whether it rewrote anything, and the number of
+// bytes rewritten.
+func (fbo *folderBranchOps) reencryptFile(ctx context.Context,
+	file Node) (old bool, rewritten int64, err error) {
+	fbo.log.CDebugf(ctx, "reencryptFile %p", file.GetID())
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNodeForWrite(file)
+	if err != nil {
+		return false, 0, err
+	}
+
+	err = runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+		md, err := fbo.getMDLocked(ctx, lState, mdReadNeedIdentify)
+		if err != nil {
+			return err
+		}
+		filePath, err := fbo.pathFromNodeForRead(file)
+		if err != nil {
+			return err
+		}
+		var ranges []DataRange
+		old, ranges, err = fbo.blocks.OldKeyGenRanges(
+			ctx, lState, md.ReadOnly(), filePath)
+		if err != nil {
+			return err
+		}
+		if old && len(ranges) == 0 {
+			_, err = fbo.blocks.Rewrite(
+				ctx, lState, md.ReadOnly(), file, 0, 0)
+			if err != nil {
+				return err
+			}
+			fbo.status.addDirtyNode(file)
+		}
+		for _, r := range ranges {
+			for off, end := int64(r.Off), int64(r.End()); off < end; {
+				n := end - off
+				if n > reencryptChunkSize {
+					n = reencryptChunkSize
+				}
+				n, err = fbo.blocks.Rewrite(
+					ctx, lState, md.ReadOnly(), file, off, n)
+				if err != nil {
+					return err
+				}
+				if n == 0 {
+					// The file was truncated in the meantime.
+					break
+				}
+				fbo.status.addDirtyNode(file)
+				rewritten += n
+				off += n
+			}
+		}
+		return nil
+	})
+	if err != nil || !old {
+		return old, rewritten, err
+	}
+	return old, rewritten, fbo.Sync(ctx, file)
+}
+
+// reencryptXattrsLocked rewrites the blocks of the extended
+// attributes of the given entry that are too big to be inline, and
+// are encrypted with an older key generation than the latest.  It
+// returns the number of attributes rewritten.
+func (fbo *folderBranchOps) reencryptXattrsLocked(ctx context.Context,
+	lState *lockState, file path) (int, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	// The root can't have any xattrs.
+	if !file.hasValidParent() {
+		return 0, nil
+	}
+
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return 0, err
+	}
+	if md.data.Dir.BlockPointer != file.path[0].BlockPointer {
+		fbo.log.CDebugf(ctx, "Skipping xattrs of a removed file %v",
+			file.tailPointer())
+		return 0, nil
+	}
+
+	dblock, de, err := fbo.blocks.GetDirtyParentAndEntry(
+		ctx, lState, md.ReadOnly(), file)
+	if err != nil {
+		return 0, err
+	}
+	latest := md.LatestKeyGeneration()
+	var names []string
+	for name, v := range de.Xattrs {
+		if v.Block.BlockPointer != zeroPtr && v.Block.KeyGen < latest {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return 0, nil
+	}
+	sort.Strings(names)
+
+	_, uid, err := fbo.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return 0, err
+	}
+	parentPath := file.parentPath()
+	bps := newBlockPutState(len(names))
+	newXattrs := make(map[string]XattrValue, len(names))
+	for _, name := range names {
+		oldValue := de.Xattrs[name]
+		value, err := fbo.readXattrValue(ctx, lState, file, oldValue)
+		if err != nil {
+			return 0, err
+		}
+		sao, err := newSetAttrOp(file.tailName(), parentPath.tailPointer(),
+			xattrAttr, file.tailPointer())
+		if err != nil {
+			return 0, err
+		}
+		sao.XattrName = name
+		md.AddOp(sao)
+
+		block := NewFileBlock().(*FileBlock)
+		block.Contents = value
+		info, _, err := fbo.readyBlockMultiple(
+			ctx, md.ReadOnly(), block, uid, bps)
+		if err != nil {
+			return 0, err
+		}
+		md.AddRefBlock(info)
+		md.AddUnrefBlock(oldValue.Block)
+		newXattrs[name] = XattrValue{Block: info}
+	}
+
+	// The values didn't change, so neither does the ctime.
+	de.Xattrs = copyXattrs(de.Xattrs, newXattrs, names)
+	setEntryAndLinks(dblock, file.tailName(), de)
+	_, err = fbo.syncBlockAndFinalizeWithBlocksLocked(
+		ctx, lState, md, dblock, *parentPath.parentPath(), parentPath.tailName(),
+		Dir, false, false, zeroPtr, NoExcl, bps)
+	if err != nil {
+		return 0, err
+	}
+	return len(names), nil
+}
+
+// reencryptDirLocked rewrites the given directory's block, and any
+// shards, if any of them are encrypted with an older key generation
+// than the latest.  It returns whether it rewrote anything.
+func (fbo *folderBranchOps) reencryptDirLocked(ctx context.Context,
+	lState *lockState, dir path) (bool, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return false, err
+	}
+	if md.data.Dir.BlockPointer != dir.path[0].BlockPointer {
+		fbo.log.CDebugf(ctx, "Skipping a removed directory %v",
+			dir.tailPointer())
+		return false, nil
+	}
+
+	dblock, err := fbo.blocks.GetDir(
+		ctx, lState, md.ReadOnly(), dir, blockWrite)
+	if err != nil {
+		return false, err
+	}
+	latest := md.LatestKeyGeneration()
+	old := dir.tailPointer().KeyGen < latest
+	for _, iptr := range dblock.IPtrs {
+		old = old || iptr.KeyGen < latest
+	}
+	if !old {
+		return false, nil
+	}
+
+	// Record the rewrite as a no-op change of the directory's mtime,
+	// or, for the root, which has no parent to name it in, as a
+	// rekey.
+	if dir.hasValidParent() {
+		parentPath := dir.parentPath()
+		sao, err := newSetAttrOp(dir.tailName(), parentPath.tailPointer(),
+			mtimeAttr, dir.tailPointer())
+		if err != nil {
+			return false, err
+		}
+		md.AddOp(sao)
+	} else {
+		md.AddOp(newRekeyOp())
+	}
+
+	_, err = fbo.syncBlockAndFinalizeLocked(
+		ctx, lState, md, dblock, *dir.parentPath(), dir.tailName(), Dir,
+		false, false, zeroPtr, NoExcl)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// reencryptEntry rewrites the large extended attributes of node,
+// and, if it's a directory, its own blocks, that are encrypted with
+// an older key generation than the latest, each as its own revision.
+func (fbo *folderBranchOps) reencryptEntry(ctx context.Context,
+	node Node, isDir bool) (xattrs int, dirRewritten bool, err error) {
+	fbo.log.CDebugf(ctx, "reencryptEntry %p", node.GetID())
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNodeForWrite(node)
+	if err != nil {
+		return 0, false, err
+	}
+
+	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			p, err := fbo.pathFromNodeForMDWriteLocked(lState, node)
+			if err != nil {
+				return err
+			}
+			xattrs, err = fbo.reencryptXattrsLocked(ctx, lState, p)
+			return err
+		})
+	if err != nil || !isDir {
+		return xattrs, false, err
+	}
+
+	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			p, err := fbo.pathFromNodeForMDWriteLocked(lState, node)
+			if err != nil {
+				return err
+			}
+			dirRewritten, err = fbo.reencryptDirLocked(ctx, lState, p)
+			return err
+		})
+	return xattrs, dirRewritten, err
+}
+
+// ReencryptProgress describes how far along a ReencryptJob is.
+type ReencryptProgress struct {
+	// KeyGen is the key generation that files are being
+	// rewritten under.
+	KeyGen KeyGen
+	// FilesScanned counts every file looked at so far, and
+	// FilesRewritten the ones that had blocks on an older
+	// generation.
+	FilesScanned   int
+	FilesRewritten int
+	BytesRewritten int64
+	// DirsRewritten counts the directories whose own blocks were
+	// rewritten, rather than as a side effect of a change under
+	// them, and XattrsRewritten the extended attributes too big to
+	// be inline.
+	DirsRewritten   int
+	XattrsRewritten int
+	// Done is set once the job has finished, successfully or not.
+	Done bool
+}
+
+// ReencryptJob rewrites, in the background, every block in a TLF
+// that is still encrypted with an older key generation, so that
+// those generations can be fully retired (e.g., after a device
+// compromise and a call to KBFSOps.RotateKeyGeneration).  That
+// covers the blocks of data and indirect blocks of files, directory
+// blocks and their shards, and the blocks of large extended
+// attributes.  Files are rewritten in place with their contents and
+// times preserved; the old blocks become unreferenced and are
+// eventually reclaimed by quota reclamation.
+type ReencryptJob struct {
+	config Config
+	ops    *folderBranchOps
+	// releaseOps drops the job's reference to ops.
+	releaseOps func()
+	rootNode   Node
+	cancel     context.CancelFunc
+	doneChan   chan struct{}
+
+	lock     sync.Mutex
+	progress ReencryptProgress
+	err      error
+}
+
+// StartReencryptTLF starts a ReencryptJob for the TLF with the given
+// root node.
+func StartReencryptTLF(
+	ctx context.Context, config Config, rootNode Node) *ReencryptJob {
+	ctx, cancel := context.WithCancel(ctx)
+	j := &ReencryptJob{
+		config:   config,
+		rootNode: rootNode,
+		cancel:   cancel,
+		doneChan: make(chan struct{}),
+	}
+	if kbfsOps, ok := config.KBFSOps().(*KBFSOpsStandard); ok {
+		j.ops, j.releaseOps = kbfsOps.getOpsByNode(ctx, rootNode)
+	}
+	go j.run(ctx)
+	return j
+}
+
+// Progress returns a snapshot of the job's progress so far.
+func (j *ReencryptJob) Progress() ReencryptProgress {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.progress
+}
+
+// Cancel stops the job.  Any file that was in the middle of being
+// rewritten is left dirty, to be synced normally.
+func (j *ReencryptJob) Cancel() {
+	j.cancel()
+}
+
+// Wait blocks until the job is done, and returns its error, if any.
+func (j *ReencryptJob) Wait() error {
+	<-j.doneChan
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.err
+}
+
+func (j *ReencryptJob) updateProgress(f func(p *ReencryptProgress)) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	f(&j.progress)
+}
+
+func (j *ReencryptJob) run(ctx context.Context) {
+	defer close(j.doneChan)
+	err := func() error {
+		if j.ops == nil {
+			return errors.New("Re-encryption needs the standard KBFSOps")
+		}
+		defer j.releaseOps()
+		md, err := j.config.MDOps().GetForTLF(
+			ctx, j.rootNode.GetFolderBranch().Tlf)
+		if err != nil {
+			return err
+		}
+		keyGen := md.LatestKeyGeneration()
+		j.updateProgress(func(p *ReencryptProgress) {
+			p.KeyGen = keyGen
+		})
+		return j.reencryptDir(ctx, j.rootNode)
+	}()
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.progress.Done = true
+	j.err = err
+}
+
+// reencryptDir re-encrypts everything under dir, and then dir
+// itself, which is usually rewritten already by the changes to its
+// children.
+func (j *ReencryptJob) reencryptDir(ctx context.Context, dir Node) error {
+	children, err := j.ops.GetDirChildren(ctx, dir)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ei := children[name]
+		if ei.Type == Sym {
+			continue
+		}
+		child, _, err := j.ops.Lookup(ctx, dir, name)
+		if err != nil {
+			return err
+		}
+		if ei.Type == Dir {
+			err = j.reencryptDir(ctx, child)
+		} else {
+			err = j.reencryptFile(ctx, child)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return j.reencryptEntry(ctx, dir, true)
+}
+
+func (j *ReencryptJob) reencryptFile(ctx context.Context, file Node) error {
+	old, rewritten, err := j.ops.reencryptFile(ctx, file)
+	if err != nil {
+		return err
+	}
+	j.updateProgress(func(p *ReencryptProgress) {
+		p.FilesScanned++
+		if old {
+			p.FilesRewritten++
+			p.BytesRewritten += rewritten
+		}
+	})
+	return j.reencryptEntry(ctx, file, false)
+}
+
+func (j *ReencryptJob) reencryptEntry(
+	ctx context.Context, node Node, isDir bool) error {
+	xattrs, dirRewritten, err := j.ops.reencryptEntry(ctx, node, isDir)
+	if err != nil {
+		return err
+	}
+	j.updateProgress(func(p *ReencryptProgress) {
+		p.XattrsRewritten += xattrs
+		if dirRewritten {
+			p.DirsRewritten++
+		}
+	})
+	return nil
+}
@@ -0,0 +1,208 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestKBFSOpsRotateKeyGenerationAndReencrypt(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer config.Shutdown()
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	tlfID := rootNode.GetFolderBranch().Tlf
+	kbfsOps := config.KBFSOps()
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	fileNode, _, err := kbfsOps.CreateFile(ctx, dirNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	data := []byte{1, 2, 3, 4}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	oldEI, err := kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+
+	err = kbfsOps.RotateKeyGeneration(ctx, tlfID)
+	require.NoError(t, err)
+	md, err := config.MDOps().GetForTLF(ctx, tlfID)
+	require.NoError(t, err)
+	require.Equal(t, KeyGen(FirstValidKeyGen+1), md.LatestKeyGeneration())
+
+	// Existing blocks stay on the old key generation...
+	nmd, err := kbfsOps.GetNodeMetadata(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, KeyGen(FirstValidKeyGen), nmd.BlockInfo.KeyGen)
+
+	// ...until the re-encryption job rewrites them.
+	job := StartReencryptTLF(ctx, config, rootNode)
+	err = job.Wait()
+	require.NoError(t, err)
+	progress := job.Progress()
+	require.True(t, progress.Done)
+	require.Equal(t, KeyGen(FirstValidKeyGen+1), progress.KeyGen)
+	require.Equal(t, 1, progress.FilesRewritten)
+	require.Equal(t, int64(len(data)), progress.BytesRewritten)
+
+	nmd, err = kbfsOps.GetNodeMetadata(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, KeyGen(FirstValidKeyGen+1), nmd.BlockInfo.KeyGen)
+	buf := make([]byte, len(data))
+	n, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, buf)
+	newEI, err := kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, oldEI.Mtime, newEI.Mtime)
+
+	// A second run has nothing left to do.
+	job = StartReencryptTLF(ctx, config, rootNode)
+	err = job.Wait()
+	require.NoError(t, err)
+	require.Equal(t, 0, job.Progress().FilesRewritten)
+}
+
+// requireFileTreeKeyGen checks that every block of the file with the
+// given top pointer is encrypted with keyGen.
+func requireFileTreeKeyGen(ctx context.Context, t *testing.T,
+	config Config, ops *folderBranchOps, ptr BlockPointer, keyGen KeyGen) {
+	require.Equal(t, keyGen, ptr.KeyGen)
+	fblock := NewFileBlock().(*FileBlock)
+	err := config.BlockOps().Get(
+		ctx, ops.getHead(makeFBOLockState()), ptr, fblock)
+	require.NoError(t, err)
+	for _, iptr := range fblock.IPtrs {
+		requireFileTreeKeyGen(ctx, t, config, ops, iptr.BlockPointer, keyGen)
+	}
+}
+
+func TestReencryptJobAllBlocks(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	// Use the smallest possible block size, so that files get
+	// several levels of indirect blocks and directories shard.
+	bsplitter, err := NewBlockSplitterSimple(20, 8*1024, config.Codec())
+	require.NoError(t, err)
+	config.SetBlockSplitter(bsplitter)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	tlfID := rootNode.GetFolderBranch().Tlf
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "f", false, NoExcl)
+	require.NoError(t, err)
+	data := make([]byte, 1200)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	value := make([]byte, 2*maxInlineXattrSize)
+	err = kbfsOps.SetXattr(ctx, fileNode, "user.big", value)
+	require.NoError(t, err)
+	emptyNode, _, err := kbfsOps.CreateFile(
+		ctx, rootNode, "empty", false, NoExcl)
+	require.NoError(t, err)
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	for i := 0; i < 2*minDirEntriesPerBlock; i++ {
+		_, _, err = kbfsOps.CreateDir(ctx, dirNode, fmt.Sprintf("e%d", i))
+		require.NoError(t, err)
+	}
+	pendingNode, _, err := kbfsOps.CreateFile(
+		ctx, rootNode, "pending", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, pendingNode, data[:10], 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, pendingNode)
+	require.NoError(t, err)
+	oldEI, err := kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+
+	err = kbfsOps.RotateKeyGeneration(ctx, tlfID)
+	require.NoError(t, err)
+	newKeyGen := KeyGen(FirstValidKeyGen + 1)
+
+	// A write that's still pending when the job runs is kept, and
+	// still changes the mtime.
+	oldPendingEI, err := kbfsOps.Stat(ctx, pendingNode)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, pendingNode, []byte{0xff}, 0)
+	require.NoError(t, err)
+
+	job := StartReencryptTLF(ctx, config, rootNode)
+	err = job.Wait()
+	require.NoError(t, err)
+	progress := job.Progress()
+	require.Equal(t, 3, progress.FilesScanned)
+	require.Equal(t, 3, progress.FilesRewritten)
+	require.Equal(t, 1, progress.XattrsRewritten)
+
+	ops := getOps(config, tlfID)
+	ptrOf := func(n Node) BlockPointer {
+		return ops.nodeCache.PathFromNode(n).tailPointer()
+	}
+	requireFileTreeKeyGen(ctx, t, config, ops, ptrOf(fileNode), newKeyGen)
+	requireFileTreeKeyGen(ctx, t, config, ops, ptrOf(emptyNode), newKeyGen)
+	requireFileTreeKeyGen(
+		ctx, t, config, ops, ptrOf(pendingNode), newKeyGen)
+	require.Equal(t, newKeyGen, ptrOf(rootNode).KeyGen)
+	top := getRawDirBlockOrBust(ctx, t, config, ops, ptrOf(dirNode))
+	require.True(t, top.IsInd)
+	require.Equal(t, newKeyGen, ptrOf(dirNode).KeyGen)
+	for _, iptr := range top.IPtrs {
+		require.Equal(t, newKeyGen, iptr.KeyGen)
+	}
+	for i := 0; i < 2*minDirEntriesPerBlock; i++ {
+		child, _, err := kbfsOps.Lookup(ctx, dirNode, fmt.Sprintf("e%d", i))
+		require.NoError(t, err)
+		require.Equal(t, newKeyGen, ptrOf(child).KeyGen)
+	}
+
+	buf := make([]byte, len(data))
+	n, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, buf)
+	newEI, err := kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, oldEI.Mtime, newEI.Mtime)
+	require.Equal(t, oldEI.Ctime, newEI.Ctime)
+	gotValue, err := kbfsOps.GetXattr(ctx, fileNode, "user.big")
+	require.NoError(t, err)
+	require.Equal(t, value, gotValue)
+	de, err := ops.statEntry(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, newKeyGen, de.Xattrs["user.big"].Block.KeyGen)
+
+	buf = make([]byte, 10)
+	n, err = kbfsOps.Read(ctx, pendingNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), n)
+	require.Equal(t, append([]byte{0xff}, data[1:10]...), buf)
+	pendingEI, err := kbfsOps.Stat(ctx, pendingNode)
+	require.NoError(t, err)
+	require.NotEqual(t, oldPendingEI.Mtime, pendingEI.Mtime)
+
+	// A second run has nothing left to do.
+	job = StartReencryptTLF(ctx, config, rootNode)
+	err = job.Wait()
+	require.NoError(t, err)
+	progress = job.Progress()
+	require.Equal(t, 0, progress.FilesRewritten)
+	require.Equal(t, 0, progress.DirsRewritten)
+	require.Equal(t, 0, progress.XattrsRewritten)
+}
@@ -0,0 +1,62 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/keybase/go-codec/codec"
+)
+
+// tlfSettingsFileName is the name of the file, in the directory
+// given to ConfigLocal.EnableTLFSettingsPersistence, that holds the
+// settings made for individual TLFs on this device.
+const tlfSettingsFileName = "settings"
+
+// tlfSettingsRecord is how the settings made for individual TLFs are
+// persisted, keyed by the string form of the TLF ID.
+type tlfSettingsRecord struct {
+	Compression map[string]BlockCompressionType `codec:"c,omitempty"`
+	Chunking    map[string]BlockChunking        `codec:"k,omitempty"`
+	ManualCR    map[string]bool                 `codec:"m,omitempty"`
+	Durability  map[string]WriteDurability      `codec:"d,omitempty"`
+
+	codec.UnknownFieldSetHandler
+}
+
+// readTLFSettings returns the settings persisted in dir, which are
+// empty if none have been yet.
+func readTLFSettings(codec Codec, dir string) (tlfSettingsRecord, error) {
+	var record tlfSettingsRecord
+	buf, err := ioutil.ReadFile(filepath.Join(dir, tlfSettingsFileName))
+	switch {
+	case os.IsNotExist(err):
+		return record, nil
+	case err != nil:
+		return tlfSettingsRecord{}, err
+	}
+	err = codec.Decode(buf, &record)
+	if err != nil {
+		return tlfSettingsRecord{}, err
+	}
+	return record, nil
+}
+
+// writeTLFSettings persists record in dir, replacing whatever was
+// there.
+func writeTLFSettings(
+	codec Codec, dir string, record tlfSettingsRecord) error {
+	buf, err := codec.Encode(record)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, tlfSettingsFileName), buf)
+}
@@ -0,0 +1,49 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLFSettingsPersisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kbfs_tlf_settings")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+	err = config.EnableTLFSettingsPersistence(dir)
+	require.NoError(t, err)
+	tlfID := FakeTlfID(1, false)
+	err = config.SetBlockCompressionForTLF(tlfID, BlockCompressionFlate)
+	require.NoError(t, err)
+	err = config.SetBlockChunkingForTLF(tlfID, BlockChunkingContent)
+	require.NoError(t, err)
+	require.IsType(t, &BlockSplitterCDC{}, config.BlockSplitterForTLF(tlfID))
+
+	config2 := MakeTestConfigOrBust(t, "test_user")
+	defer CheckConfigAndShutdown(t, config2)
+	require.Equal(t, BlockCompressionNone,
+		config2.BlockCompressionForTLF(tlfID))
+	require.IsType(t, &BlockSplitterSimple{},
+		config2.BlockSplitterForTLF(tlfID))
+	err = config2.EnableTLFSettingsPersistence(dir)
+	require.NoError(t, err)
+	require.Equal(t, BlockCompressionFlate,
+		config2.BlockCompressionForTLF(tlfID))
+	require.IsType(t, &BlockSplitterCDC{}, config2.BlockSplitterForTLF(tlfID))
+
+	// Other TLFs keep the defaults.
+	otherID := FakeTlfID(2, false)
+	require.Equal(t, BlockCompressionNone,
+		config2.BlockCompressionForTLF(otherID))
+	require.Equal(t, config2.BlockSplitter(),
+		config2.BlockSplitterForTLF(otherID))
+}
@@ -0,0 +1,215 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// tombstoneGraceWindow is how long after another device removes a
+// file that local writes to it still count as racing with the
+// removal.
+const tombstoneGraceWindow = 10 * time.Minute
+
+// tombstone marks a file that another device removed while this
+// device may still have had it open.
+//
+// Updates aren't applied while this device has dirty data, so a
+// remote removal only ever reaches a file before or after a local
+// write, never during one.  If it arrives after the write has been
+// synced, conflict resolution brings the file back with the new
+// data.  Without a tombstone, if it arrives first, any later writes
+// through an open handle would be dropped when synced, since the file
+// is no longer linked anywhere.  Instead, writes synced within the
+// grace window bring the file back in its old directory, just as
+// conflict resolution would have: under its old name if that's still
+// free, and as a conflict copy otherwise.
+type tombstone struct {
+	parent    Node
+	name      string
+	removedAt time.Time
+	// copy is the node the writes were preserved in, once they've
+	// been synced for the first time, so that later syncs through
+	// the same handle go to the same place.
+	copy Node
+}
+
+// addTombstonesLocked records a tombstone for each open file that
+// op removes.  It must be called before the op unlinks the file from
+// the node cache, and only for ops made by other devices.
+func (fbo *folderBranchOps) addTombstonesLocked(
+	ctx context.Context, lState *lockState, op op) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	ro, ok := op.(*rmOp)
+	if !ok {
+		return
+	}
+	// The op's pointer updates haven't been applied to the node
+	// cache yet.
+	parent := fbo.nodeCache.Get(ro.Dir.Unref.ref())
+	if parent == nil {
+		return
+	}
+
+	now := fbo.config.Clock().Now()
+	for ref, ts := range fbo.tombstones {
+		if now.Sub(ts.removedAt) > tombstoneGraceWindow {
+			delete(fbo.tombstones, ref)
+		}
+	}
+	for _, ptr := range ro.Unrefs() {
+		if fbo.nodeCache.Get(ptr.ref()) == nil {
+			continue
+		}
+		fbo.log.CDebugf(ctx, "Adding a tombstone for %s (%v)",
+			ro.OldName, ptr)
+		fbo.tombstones[ptr.ref()] = &tombstone{
+			parent:    parent,
+			name:      ro.OldName,
+			removedAt: now,
+		}
+	}
+}
+
+// getTombstoneLocked returns the tombstone for the given removed
+// file, or nil if there isn't one or its grace window has passed.
+func (fbo *folderBranchOps) getTombstoneLocked(
+	lState *lockState, ref blockRef) *tombstone {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	ts, ok := fbo.tombstones[ref]
+	if !ok {
+		return nil
+	}
+	if fbo.config.Clock().Now().Sub(ts.removedAt) > tombstoneGraceWindow {
+		delete(fbo.tombstones, ref)
+		return nil
+	}
+	return ts
+}
+
+// preserveRemovedFileLocked syncs the dirty contents of file, which
+// has been removed by another device, into a new file next to where
+// it used to be, as described in the tombstone docs.
+func (fbo *folderBranchOps) preserveRemovedFileLocked(
+	ctx context.Context, lState *lockState, md *RootMetadata, file path,
+	ts *tombstone) (err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	de, err := fbo.blocks.GetDirtyEntry(ctx, lState, md.ReadOnly(), file)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, de.Size)
+	n, err := fbo.blocks.Read(ctx, lState, md.ReadOnly(), file, data, 0)
+	if err != nil {
+		return err
+	}
+	data = data[:n]
+
+	if ts.copy != nil {
+		copyPath, err := fbo.pathFromNodeForMDWriteLocked(lState, ts.copy)
+		if err != nil {
+			return err
+		}
+		if md.data.Dir.BlockPointer != copyPath.path[0].BlockPointer {
+			// The copy has been removed too, so start over.
+			ts.copy = nil
+		}
+	}
+
+	entryType := File
+	if de.Type == Exec {
+		entryType = Exec
+	}
+	if ts.copy == nil {
+		parentPath, err := fbo.pathFromNodeForMDWriteLocked(lState, ts.parent)
+		if err != nil {
+			return err
+		}
+		if md.data.Dir.BlockPointer != parentPath.path[0].BlockPointer {
+			fbo.log.CDebugf(ctx, "The directory of removed file %s is "+
+				"gone too; dropping its writes", ts.name)
+			return nil
+		}
+
+		name := ts.name
+		node, _, err := fbo.createEntryLocked(
+			ctx, lState, ts.parent, name, entryType, NoExcl)
+		if _, ok := err.(NameExistsError); ok {
+			name, err = fbo.conflictNameForLocalWriteLocked(ctx, lState, ts)
+			if err != nil {
+				return err
+			}
+			node, _, err = fbo.createEntryLocked(
+				ctx, lState, ts.parent, name, entryType, NoExcl)
+		}
+		if err != nil {
+			return err
+		}
+		fbo.log.CDebugf(ctx, "Preserving writes to removed file %s as %s",
+			ts.name, name)
+		ts.copy = node
+	}
+
+	// The entry creation made a new revision.
+	md, err = fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+	err = fbo.blocks.Truncate(ctx, lState, md.ReadOnly(), ts.copy, 0)
+	if err != nil {
+		return err
+	}
+	err = fbo.blocks.Write(ctx, lState, md.ReadOnly(), ts.copy, data, 0)
+	if err != nil {
+		return err
+	}
+	copyPath, err := fbo.pathFromNodeForMDWriteLocked(lState, ts.copy)
+	if err != nil {
+		return err
+	}
+	_, err = fbo.syncLocked(ctx, lState, copyPath)
+	if err != nil {
+		return err
+	}
+	// Keep the file's local contents around, rather than clearing
+	// them like a normal skipped sync would, so that later writes
+	// through the same handle apply on top of them and the next sync
+	// copies the whole file again.  Only do this once the data is
+	// safely in the copy, in case this whole sync gets retried.
+	return fbo.blocks.ReleaseDirtyBytes(lState, file)
+}
+
+// conflictNameForLocalWriteLocked returns the name for a conflict
+// copy of the file marked by ts, written by the current device.
+func (fbo *folderBranchOps) conflictNameForLocalWriteLocked(
+	ctx context.Context, lState *lockState, ts *tombstone) (string, error) {
+	parentPath, err := fbo.pathFromNodeForMDWriteLocked(lState, ts.parent)
+	if err != nil {
+		return "", err
+	}
+	_, uid, err := fbo.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return "", err
+	}
+	key, err := fbo.config.KBPKI().GetCurrentVerifyingKey(ctx)
+	if err != nil {
+		return "", err
+	}
+	winfo, err := newWriterInfo(ctx, fbo.config, uid, key.KID())
+	if err != nil {
+		return "", err
+	}
+	co, err := newCreateOp(ts.name, parentPath.tailPointer(), File)
+	if err != nil {
+		return "", err
+	}
+	co.setWriterInfo(winfo)
+	return fbo.config.ConflictRenamer().ConflictRename(co, ts.name), nil
+}
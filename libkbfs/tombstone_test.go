@@ -0,0 +1,146 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// tombstoneTestSetup creates file "a" containing "hello" as one
+// device, removes it as another device, and applies the removal to
+// the first device while it still has the file open.  It returns
+// both configs, the open file, and the other device's root node.
+func tombstoneTestSetup(t *testing.T, ctx context.Context,
+	userName libkb.NormalizedUsername) (
+	config1, config2 *ConfigLocal, fileNode1, rootNode2 Node) {
+	config1, _, _ = kbfsOpsInitNoMocks(t, userName)
+	clock := newTestClockNow()
+	config1.SetClock(clock)
+
+	rootNode1 := GetRootNodeOrBust(t, config1, userName.String(), false)
+	kbfsOps1 := config1.KBFSOps()
+	fileNode1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps1.Write(ctx, fileNode1, []byte("hello"), 0)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(ctx, fileNode1)
+	require.NoError(t, err)
+
+	config2 = ConfigAsUser(config1, userName)
+	rootNode2 = GetRootNodeOrBust(t, config2, userName.String(), false)
+	err = config2.KBFSOps().RemoveEntry(ctx, rootNode2, "a")
+	require.NoError(t, err)
+
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+	return config1, config2, fileNode1, rootNode2
+}
+
+func readWholeFile(t *testing.T, ctx context.Context, kbfsOps KBFSOps,
+	dir Node, name string) string {
+	node, ei, err := kbfsOps.Lookup(ctx, dir, name)
+	require.NoError(t, err)
+	buf := make([]byte, ei.Size)
+	n, err := kbfsOps.Read(ctx, node, buf, 0)
+	require.NoError(t, err)
+	return string(buf[:n])
+}
+
+func TestTombstonePreservesRacingWrite(t *testing.T) {
+	var userName libkb.NormalizedUsername = "u1"
+	ctx := BackgroundContextWithCancellationDelayer()
+	defer CleanupCancellationDelayer(ctx)
+	config1, config2, fileNode1, rootNode2 :=
+		tombstoneTestSetup(t, ctx, userName)
+	defer CheckConfigAndShutdown(t, config1)
+	defer CheckConfigAndShutdown(t, config2)
+
+	kbfsOps1 := config1.KBFSOps()
+	err := kbfsOps1.Write(ctx, fileNode1, []byte("goodbye"), 0)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(ctx, fileNode1)
+	require.NoError(t, err)
+
+	// Later writes through the same handle go to the same place.
+	err = kbfsOps1.Write(ctx, fileNode1, []byte("!"), 7)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(ctx, fileNode1)
+	require.NoError(t, err)
+
+	kbfsOps2 := config2.KBFSOps()
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	children, err := kbfsOps2.GetDirChildren(ctx, rootNode2)
+	require.NoError(t, err)
+	require.Len(t, children, 1)
+	require.Equal(t, "goodbye!",
+		readWholeFile(t, ctx, kbfsOps2, rootNode2, "a"))
+}
+
+func TestTombstoneMakesConflictCopyWhenNameTaken(t *testing.T) {
+	var userName libkb.NormalizedUsername = "u1"
+	ctx := BackgroundContextWithCancellationDelayer()
+	defer CleanupCancellationDelayer(ctx)
+	config1, config2, fileNode1, rootNode2 :=
+		tombstoneTestSetup(t, ctx, userName)
+	defer CheckConfigAndShutdown(t, config1)
+	defer CheckConfigAndShutdown(t, config2)
+
+	kbfsOps2 := config2.KBFSOps()
+	newNode2, _, err := kbfsOps2.CreateFile(ctx, rootNode2, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps2.Write(ctx, newNode2, []byte("new"), 0)
+	require.NoError(t, err)
+	err = kbfsOps2.Sync(ctx, newNode2)
+	require.NoError(t, err)
+
+	kbfsOps1 := config1.KBFSOps()
+	err = kbfsOps1.SyncFromServerForTesting(ctx, fileNode1.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps1.Write(ctx, fileNode1, []byte("goodbye"), 0)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(ctx, fileNode1)
+	require.NoError(t, err)
+
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	children, err := kbfsOps2.GetDirChildren(ctx, rootNode2)
+	require.NoError(t, err)
+	require.Len(t, children, 2)
+	require.Equal(t, "new", readWholeFile(t, ctx, kbfsOps2, rootNode2, "a"))
+	cre := WriterDeviceDateConflictRenamer{}
+	name := cre.ConflictRenameHelper(config1.Clock().Now(), "u1", "dev1", "a")
+	require.Equal(t, "goodbye",
+		readWholeFile(t, ctx, kbfsOps2, rootNode2, name))
+}
+
+func TestTombstoneExpires(t *testing.T) {
+	var userName libkb.NormalizedUsername = "u1"
+	ctx := BackgroundContextWithCancellationDelayer()
+	defer CleanupCancellationDelayer(ctx)
+	config1, config2, fileNode1, rootNode2 :=
+		tombstoneTestSetup(t, ctx, userName)
+	defer CheckConfigAndShutdown(t, config1)
+	defer CheckConfigAndShutdown(t, config2)
+
+	config1.Clock().(*TestClock).Add(tombstoneGraceWindow + 1)
+
+	kbfsOps1 := config1.KBFSOps()
+	err := kbfsOps1.Write(ctx, fileNode1, []byte("goodbye"), 0)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(ctx, fileNode1)
+	require.NoError(t, err)
+
+	kbfsOps2 := config2.KBFSOps()
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	children, err := kbfsOps2.GetDirChildren(ctx, rootNode2)
+	require.NoError(t, err)
+	require.Len(t, children, 0)
+}
@@ -0,0 +1,191 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"golang.org/x/net/context"
+)
+
+type ctxSpanKeyType int
+
+const ctxSpanKey ctxSpanKeyType = 0
+
+// ctxSpan is the span in progress in a context, along with the
+// Tracer that made it, so that steps taken under it can be traced
+// too without knowing the Tracer themselves.
+type ctxSpan struct {
+	tracer Tracer
+	span   Span
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetTag(key string, value interface{}) {}
+
+func (noopSpan) Finish(err error) {}
+
+// startSpan starts a span named name, as a step of the span in ctx if
+// there is one, or else with tracer as the first span of a new
+// trace, and returns a context carrying it.  With neither, nothing
+// is traced.  tracer may be nil for steps that are only worth tracing
+// as part of a bigger operation.
+func startSpan(ctx context.Context, tracer Tracer, name string) (
+	context.Context, Span) {
+	var parent Span
+	if cs, ok := ctx.Value(ctxSpanKey).(ctxSpan); ok {
+		tracer, parent = cs.tracer, cs.span
+	}
+	if tracer == nil {
+		return ctx, noopSpan{}
+	}
+	span := tracer.StartSpan(ctx, name, parent)
+	cs := ctxSpan{tracer, span}
+	return NewContextReplayable(ctx, func(ctx context.Context) context.Context {
+		return context.WithValue(ctx, ctxSpanKey, cs)
+	}), span
+}
+
+// FinishedSpan is a span of a TracerStandard, as handed to its
+// SpanExporter.
+type FinishedSpan struct {
+	// TraceID is the same for every span of an operation.  It's
+	// the ID of the KBFSOps call (CtxKBFSOpsOpID) the operation is
+	// part of, if any.
+	TraceID string
+	// SpanID is unique among the spans of the TracerStandard.
+	SpanID string
+	// ParentID is the SpanID of the span this one is a step of,
+	// and is empty for the first span of a trace.
+	ParentID string
+	Name     string
+	Start    time.Time
+	End      time.Time
+	// Tags hold the tags set on the span.  The first span of a
+	// trace also gets the log tags of its context, which are the
+	// same ones sent along with any RPC made under it.
+	Tags map[string]interface{}
+	Err  error
+}
+
+// SpanExporter is where a TracerStandard sends every span once it's
+// finished, e.g. to log it or to pass it on to a tracing system.
+type SpanExporter interface {
+	ExportSpan(span FinishedSpan)
+}
+
+// TracerStandard is a Tracer that times spans with a Clock, and
+// hands each one to a SpanExporter once it's finished.
+type TracerStandard struct {
+	// lastSpanID must be first in the struct for 64-bit alignment.
+	lastSpanID uint64
+	clock      Clock
+	exporter   SpanExporter
+	log        logger.Logger
+}
+
+var _ Tracer = (*TracerStandard)(nil)
+
+// NewTracerStandard constructs a new TracerStandard object.
+func NewTracerStandard(clock Clock, exporter SpanExporter,
+	log logger.Logger) *TracerStandard {
+	return &TracerStandard{clock: clock, exporter: exporter, log: log}
+}
+
+type spanStandard struct {
+	tracer *TracerStandard
+
+	lock     sync.Mutex
+	span     FinishedSpan
+	finished bool
+}
+
+// StartSpan implements the Tracer interface for TracerStandard.
+func (t *TracerStandard) StartSpan(ctx context.Context, name string,
+	parent Span) Span {
+	s := &spanStandard{tracer: t}
+	s.span.SpanID = strconv.FormatUint(
+		atomic.AddUint64(&t.lastSpanID, 1), 16)
+	s.span.Name = name
+	s.span.Start = t.clock.Now()
+	if p, ok := parent.(*spanStandard); ok {
+		// The IDs of a span never change, so no need to lock.
+		s.span.TraceID = p.span.TraceID
+		s.span.ParentID = p.span.SpanID
+		return s
+	}
+
+	tags := LogTagsFromContextToMap(ctx)
+	s.span.TraceID = tags[CtxKBFSOpsOpID]
+	if s.span.TraceID == "" {
+		id, err := MakeRandomRequestID()
+		if err != nil {
+			t.log.CWarningf(ctx, "Couldn't generate a trace ID: %v", err)
+			id = s.span.SpanID
+		}
+		s.span.TraceID = id
+	}
+	if len(tags) > 0 {
+		s.span.Tags = make(map[string]interface{}, len(tags))
+		for tag, value := range tags {
+			s.span.Tags[tag] = value
+		}
+	}
+	return s
+}
+
+// SetTag implements the Span interface for spanStandard.
+func (s *spanStandard) SetTag(key string, value interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.finished {
+		// The exporter owns the tags now.
+		return
+	}
+	if s.span.Tags == nil {
+		s.span.Tags = make(map[string]interface{})
+	}
+	s.span.Tags[key] = value
+}
+
+// Finish implements the Span interface for spanStandard.
+func (s *spanStandard) Finish(err error) {
+	span := func() FinishedSpan {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.finished {
+			return FinishedSpan{}
+		}
+		s.finished = true
+		s.span.End = s.tracer.clock.Now()
+		s.span.Err = err
+		return s.span
+	}()
+	if span.SpanID == "" {
+		return
+	}
+	s.tracer.exporter.ExportSpan(span)
+}
+
+type spanLogExporter struct {
+	log logger.Logger
+}
+
+// NewSpanLogExporter returns a SpanExporter that logs every span, at
+// debug level, to log.
+func NewSpanLogExporter(log logger.Logger) SpanExporter {
+	return spanLogExporter{log}
+}
+
+func (e spanLogExporter) ExportSpan(span FinishedSpan) {
+	e.log.Debug("Span %s took %s: trace=%s id=%s parent=%s tags=%v err=%v",
+		span.Name, span.End.Sub(span.Start), span.TraceID, span.SpanID,
+		span.ParentID, span.Tags, span.Err)
+}
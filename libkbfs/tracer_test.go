@@ -0,0 +1,121 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type testSpanExporter struct {
+	lock  sync.Mutex
+	spans []FinishedSpan
+}
+
+func (e *testSpanExporter) ExportSpan(span FinishedSpan) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.spans = append(e.spans, span)
+}
+
+func (e *testSpanExporter) getSpans() []FinishedSpan {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return append([]FinishedSpan(nil), e.spans...)
+}
+
+func TestTracerStandard(t *testing.T) {
+	ctx := context.Background()
+	exporter := &testSpanExporter{}
+	tracer := NewTracerStandard(wallClock{}, exporter, logger.NewTestLogger(t))
+
+	// Without a tracer, or a span to hang off of, nothing's traced.
+	noopCtx, span := startSpan(ctx, nil, "untraced")
+	require.Equal(t, ctx, noopCtx)
+	span.Finish(nil)
+	require.Empty(t, exporter.getSpans())
+
+	rootCtx, root := startSpan(ctx, tracer, "root")
+	root.SetTag("k", "v")
+	childCtx, child := startSpan(rootCtx, nil, "child")
+	_, grandchild := startSpan(childCtx, nil, "grandchild")
+	grandchild.Finish(nil)
+	errChild := errors.New("child failed")
+	child.Finish(errChild)
+	root.Finish(nil)
+	// Only the first Finish counts.
+	root.Finish(errChild)
+
+	spans := exporter.getSpans()
+	require.Len(t, spans, 3)
+	gs, cs, rs := spans[0], spans[1], spans[2]
+	require.Equal(t, "root", rs.Name)
+	require.Equal(t, "", rs.ParentID)
+	require.NotEqual(t, "", rs.TraceID)
+	require.Equal(t, "v", rs.Tags["k"])
+	require.NoError(t, rs.Err)
+	require.Equal(t, "child", cs.Name)
+	require.Equal(t, rs.SpanID, cs.ParentID)
+	require.Equal(t, errChild, cs.Err)
+	require.Equal(t, "grandchild", gs.Name)
+	require.Equal(t, cs.SpanID, gs.ParentID)
+	for _, s := range spans {
+		require.Equal(t, rs.TraceID, s.TraceID)
+		require.False(t, s.End.Before(s.Start))
+	}
+}
+
+func TestKBFSOpsTraceSync(t *testing.T) {
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "f", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+
+	exporter := &testSpanExporter{}
+	config.SetTracer(
+		NewTracerStandard(config.Clock(), exporter, config.MakeLogger("")))
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+	config.SetTracer(nil)
+
+	spans := exporter.getSpans()
+	byID := make(map[string]FinishedSpan)
+	var root FinishedSpan
+	for _, s := range spans {
+		byID[s.SpanID] = s
+		if s.ParentID == "" {
+			require.Equal(t, "", root.SpanID, "More than one root span")
+			root = s
+		}
+	}
+	require.Equal(t, "KBFSOps.Sync", root.Name)
+	// The trace is identified by the op ID sent along with RPCs.
+	require.Equal(t, root.TraceID, root.Tags[CtxKBFSOpsOpID])
+
+	names := make(map[string]bool)
+	for _, s := range spans {
+		require.Equal(t, root.TraceID, s.TraceID)
+		// Every span leads back up to the root.
+		for p := s; p.ParentID != ""; {
+			var ok bool
+			p, ok = byID[p.ParentID]
+			require.True(t, ok)
+		}
+		names[s.Name] = true
+	}
+	require.True(t, names["BlockServer.Put"])
+	require.True(t, names["MDOps.Put"])
+}
@@ -0,0 +1,593 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/keybase/go-codec/codec"
+	"golang.org/x/net/context"
+)
+
+// TrashDirName is the name of the hidden directory, in the root of a
+// TLF, that holds removed entries while the TLF is in trash mode.
+//
+// Whether a TLF is in trash mode, and how long removed entries are
+// kept, is recorded in its private metadata; see TrashInfo.
+// Removing an entry moves it into the directory under an ID made
+// from the time of the removal, and records the entry's old path
+// under that ID in the same MD revision.  The directory is made of
+// ordinary entries, so it works across devices like any other
+// change.
+//
+// Names starting with ".kbfs" can't be made by users, so the
+// directory can't clash with theirs, and it's hidden from them:
+// it's only reachable through ListTrash and Undelete.
+const TrashDirName = ".kbfs_trash"
+
+// TrashInfo is the trash mode state of a TLF, kept in its private
+// metadata.  The TLF is in trash mode while Retention is positive
+// and TrashDirName exists.
+type TrashInfo struct {
+	// Retention is how long removed entries are kept.
+	Retention time.Duration `codec:"r"`
+	// RetentionSetAt is when Retention was last set, in Unix
+	// nanoseconds, so that conflict resolution can keep the latest
+	// setting.
+	RetentionSetAt int64 `codec:"t"`
+	// Origins maps the ID of each entry in TrashDirName to its old
+	// path, relative to the TLF root.
+	Origins map[string]string `codec:"o,omitempty"`
+
+	codec.UnknownFieldSetHandler
+}
+
+// mergeTrashInfo returns the trash mode state for a conflict
+// resolution: the later of the two retention settings, and the
+// origins of the entries moved into the trash on either branch.
+func mergeTrashInfo(merged, unmerged *TrashInfo) *TrashInfo {
+	if unmerged == nil {
+		return merged
+	}
+	if merged == nil {
+		merged = &TrashInfo{}
+	}
+	res := *merged
+	if unmerged.RetentionSetAt > merged.RetentionSetAt {
+		res.Retention = unmerged.Retention
+		res.RetentionSetAt = unmerged.RetentionSetAt
+	}
+	res.Origins = make(map[string]string,
+		len(merged.Origins)+len(unmerged.Origins))
+	for id, origin := range merged.Origins {
+		res.Origins[id] = origin
+	}
+	for id, origin := range unmerged.Origins {
+		res.Origins[id] = origin
+	}
+	return &res
+}
+
+// TrashEntry describes an entry removed while its TLF was in trash
+// mode.
+type TrashEntry struct {
+	// ID names the entry for Undelete.
+	ID string
+	// Path is where the entry used to be, relative to the TLF root.
+	Path    string
+	Type    EntryType
+	Removed time.Time
+}
+
+type trashEntriesNewestFirst []TrashEntry
+
+func (t trashEntriesNewestFirst) Len() int      { return len(t) }
+func (t trashEntriesNewestFirst) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t trashEntriesNewestFirst) Less(i, j int) bool {
+	return t[i].Removed.After(t[j].Removed)
+}
+
+func isTrashDir(dir path, name string) bool {
+	return !dir.hasValidParent() && name == TrashDirName
+}
+
+func trashRetention(md ReadOnlyRootMetadata) time.Duration {
+	if md.data.Trash == nil {
+		return 0
+	}
+	return md.data.Trash.Retention
+}
+
+// getTrash returns the path of the trash directory and its block, if
+// it exists in md.  The path is invalid otherwise.
+func (fbo *folderBranchOps) getTrash(ctx context.Context,
+	lState *lockState, md ReadOnlyRootMetadata) (
+	trashPath path, tblock *DirBlock, err error) {
+	rootPath := path{
+		FolderBranch: fbo.folderBranch,
+		path: []pathNode{{
+			md.data.Dir.BlockPointer,
+			string(md.GetTlfHandle().GetCanonicalName()),
+		}},
+	}
+	rblock, err := fbo.blocks.GetDir(ctx, lState, md, rootPath, blockRead)
+	if err != nil {
+		return path{}, nil, err
+	}
+	de, ok := rblock.Children[TrashDirName]
+	if !ok || de.Type != Dir {
+		return path{}, nil, nil
+	}
+	trashPath = rootPath.ChildPath(TrashDirName, de.BlockPointer)
+	tblock, err = fbo.blocks.GetDir(ctx, lState, md, trashPath, blockRead)
+	if err != nil {
+		return path{}, nil, err
+	}
+	return trashPath, tblock, nil
+}
+
+// pruneTrashOrigins drops the origins of entries that are no longer
+// in the trash, which conflict resolution can leave behind.
+func pruneTrashOrigins(info *TrashInfo, tblock *DirBlock) {
+	for id := range info.Origins {
+		if _, ok := tblock.Children[id]; !ok {
+			delete(info.Origins, id)
+		}
+	}
+}
+
+// moveToTrashLocked moves the entry name in dirPath into the trash,
+// as part of md, if its TLF is in trash mode, and returns whether it
+// did.  Otherwise the caller should remove the entry as usual.
+// Other hard links to a file keep its data alive, so removing one of
+// them doesn't need the trash.
+func (fbo *folderBranchOps) moveToTrashLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, dirPath path, name string) (
+	trashed bool, err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	if isTrashDir(dirPath, name) {
+		return false, NoSuchNameError{name}
+	}
+	if trashRetention(md.ReadOnly()) <= 0 {
+		return false, nil
+	}
+	trashPath, tblock, err := fbo.getTrash(ctx, lState, md.ReadOnly())
+	if err != nil || !trashPath.isValid() {
+		return false, err
+	}
+	pblock, err := fbo.blocks.GetDir(
+		ctx, lState, md.ReadOnly(), dirPath, blockRead)
+	if err != nil {
+		return false, err
+	}
+	de, ok := pblock.Children[name]
+	if !ok || de.LinkCount() > 1 {
+		return false, nil
+	}
+
+	var origin []string
+	for _, pn := range dirPath.path[1:] {
+		origin = append(origin, pn.Name)
+	}
+	origin = append(origin, name)
+
+	removed := fbo.nowUnixNano()
+	id := strconv.FormatInt(removed, 10)
+	for {
+		if _, taken := tblock.Children[id]; !taken {
+			break
+		}
+		removed++
+		id = strconv.FormatInt(removed, 10)
+	}
+
+	fbo.log.CDebugf(ctx, "Moving %s to the trash as %s",
+		strings.Join(origin, "/"), id)
+	// The origin goes into the same revision as the move, so the
+	// entry is never in the trash without one.
+	pruneTrashOrigins(md.data.Trash, tblock)
+	if md.data.Trash.Origins == nil {
+		md.data.Trash.Origins = make(map[string]string)
+	}
+	md.data.Trash.Origins[id] = strings.Join(origin, "/")
+	err = fbo.renameWithMDLocked(ctx, lState, md, dirPath, name, trashPath, id)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// unrefTreeLocked unreferences the blocks of the entry name in dir,
+// along with those of everything under it if it's a directory, so
+// that it can be removed with a single op.
+func (fbo *folderBranchOps) unrefTreeLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, dir path, de DirEntry,
+	name string) error {
+	err := fbo.unrefEntry(ctx, lState, md, dir, de, name)
+	if err != nil || de.Type != Dir {
+		return err
+	}
+	childPath := dir.ChildPath(name, de.BlockPointer)
+	dblock, err := fbo.blocks.GetDir(
+		ctx, lState, md.ReadOnly(), childPath, blockRead)
+	if err != nil {
+		return err
+	}
+	// Hard links share their blocks.
+	unrefed := make(map[BlockPointer]bool)
+	for childName, childDe := range dblock.Children {
+		if unrefed[childDe.BlockPointer] {
+			continue
+		}
+		unrefed[childDe.BlockPointer] = true
+		err := fbo.unrefTreeLocked(
+			ctx, lState, md, childPath, childDe, childName)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeTreesLocked permanently removes the given entries of dirPath,
+// along with everything under them, in a single revision made from
+// md.  There's one rm op per entry, but only the last one updates
+// the directory's pointer; the others get an identity update for the
+// old one, like the ops of a conflict resolution.
+func (fbo *folderBranchOps) removeTreesLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, dirPath path,
+	names []string) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	dblock, err := fbo.blocks.GetDir(
+		ctx, lState, md.ReadOnly(), dirPath, blockWrite)
+	if err != nil {
+		return err
+	}
+	for i, name := range names {
+		de, ok := dblock.Children[name]
+		if !ok {
+			return NoSuchNameError{name}
+		}
+		ro, err := newRmOp(name, dirPath.tailPointer())
+		if err != nil {
+			return err
+		}
+		if i < len(names)-1 {
+			err = ro.Dir.setRef(dirPath.tailPointer())
+			if err != nil {
+				return err
+			}
+		}
+		md.AddOp(ro)
+		err = fbo.unrefTreeLocked(ctx, lState, md, dirPath, de, name)
+		if err != nil {
+			return err
+		}
+		delete(dblock.Children, name)
+	}
+
+	_, err = fbo.syncBlockAndFinalizeLocked(
+		ctx, lState, md, dblock, *dirPath.parentPath(), dirPath.tailName(),
+		Dir, true, true, zeroPtr, NoExcl)
+	return err
+}
+
+// trashEntryTime returns the time at which the trash entry with the
+// given ID was removed.
+func trashEntryTime(id string) (time.Time, bool) {
+	removed, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, removed), true
+}
+
+// expireTrash permanently removes the trash entries that are older
+// than the retention period of the TLF, all in one revision.  It's
+// run periodically by the folderBlockManager.
+func (fbo *folderBranchOps) expireTrash(ctx context.Context) error {
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			md, err := fbo.getMDForWriteLocked(ctx, lState)
+			if err != nil {
+				return err
+			}
+			trashPath, tblock, err := fbo.getTrash(
+				ctx, lState, md.ReadOnly())
+			if err != nil || !trashPath.isValid() {
+				return err
+			}
+
+			retention := trashRetention(md.ReadOnly())
+			if retention <= 0 {
+				// Conflict resolution can bring back a trash
+				// that another device emptied.
+				fbo.log.CDebugf(ctx, "Removing the trash of a TLF "+
+					"that's not in trash mode")
+				return fbo.removeTreesLocked(ctx, lState, md,
+					*trashPath.parentPath(), []string{TrashDirName})
+			}
+
+			now := fbo.config.Clock().Now()
+			var expired []string
+			for id := range tblock.Children {
+				removed, ok := trashEntryTime(id)
+				if ok && now.Sub(removed) >= retention {
+					expired = append(expired, id)
+				}
+			}
+			if len(expired) == 0 {
+				return nil
+			}
+			sort.Strings(expired)
+			fbo.log.CDebugf(ctx, "Expiring %v from the trash", expired)
+			pruneTrashOrigins(md.data.Trash, tblock)
+			for _, id := range expired {
+				delete(md.data.Trash.Origins, id)
+			}
+			return fbo.removeTreesLocked(
+				ctx, lState, md, trashPath, expired)
+		})
+}
+
+// setTrashRetentionLocked records retention in the TLF's private
+// metadata, along with the change to the trash directory that goes
+// with it.
+func (fbo *folderBranchOps) setTrashRetentionLocked(ctx context.Context,
+	lState *lockState, retention time.Duration) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+	trashPath, _, err := fbo.getTrash(ctx, lState, md.ReadOnly())
+	if err != nil {
+		return err
+	}
+
+	var info TrashInfo
+	if md.data.Trash != nil {
+		info = *md.data.Trash
+	}
+	if retention < 0 {
+		retention = 0
+	}
+	if retention == info.Retention &&
+		(retention == 0) == !trashPath.isValid() {
+		return nil
+	}
+	info.Retention = retention
+	info.RetentionSetAt = fbo.nowUnixNano()
+	md.data.Trash = &info
+
+	rootPath := path{
+		FolderBranch: fbo.folderBranch,
+		path: []pathNode{{
+			md.data.Dir.BlockPointer,
+			string(md.GetTlfHandle().GetCanonicalName()),
+		}},
+	}
+	switch {
+	case retention == 0 && !trashPath.isValid():
+		// Nothing to empty.
+		return nil
+
+	case retention == 0:
+		// Turning off trash mode empties the trash.
+		info.Origins = nil
+		return fbo.removeTreesLocked(
+			ctx, lState, md, rootPath, []string{TrashDirName})
+
+	case !trashPath.isValid():
+		info.Origins = nil
+		co, err := newCreateOp(
+			TrashDirName, rootPath.tailPointer(), Dir)
+		if err != nil {
+			return err
+		}
+		md.AddOp(co)
+		_, err = fbo.syncNewBlockAndFinalizeLocked(ctx, lState, md,
+			&DirBlock{Children: make(map[string]DirEntry)}, rootPath,
+			TrashDirName, Dir, nil, true, true, zeroPtr, NoExcl, nil)
+		return err
+
+	default:
+		// The new retention rides along with a touch of the trash
+		// directory's mtime.
+		rblock, err := fbo.blocks.GetDir(
+			ctx, lState, md.ReadOnly(), rootPath, blockWrite)
+		if err != nil {
+			return err
+		}
+		de := rblock.Children[TrashDirName]
+		de.Mtime = fbo.nowUnixNano()
+		de.Ctime = de.Mtime
+		sao, err := newSetAttrOp(TrashDirName, rootPath.tailPointer(),
+			mtimeAttr, trashPath.tailPointer())
+		if err != nil {
+			return err
+		}
+		md.AddOp(sao)
+		rblock.Children[TrashDirName] = de
+		_, err = fbo.syncBlockAndFinalizeLocked(
+			ctx, lState, md, rblock, *rootPath.parentPath(),
+			rootPath.tailName(), Dir, false, false, zeroPtr, NoExcl)
+		return err
+	}
+}
+
+// SetTrashRetention implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) SetTrashRetention(ctx context.Context,
+	root Node, retention time.Duration) (err error) {
+	fbo.log.CDebugf(ctx, "SetTrashRetention %p %s", root.GetID(), retention)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNodeForWrite(root)
+	if err != nil {
+		return err
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			return fbo.setTrashRetentionLocked(ctx, lState, retention)
+		})
+}
+
+// ListTrash implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) ListTrash(ctx context.Context, root Node) (
+	entries []TrashEntry, err error) {
+	fbo.log.CDebugf(ctx, "ListTrash %p", root.GetID())
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNode(root)
+	if err != nil {
+		return nil, err
+	}
+
+	lState := makeFBOLockState()
+	md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+	if err != nil {
+		return nil, err
+	}
+	trashPath, tblock, err := fbo.getTrash(ctx, lState, md.ReadOnly())
+	if err != nil || !trashPath.isValid() || md.data.Trash == nil {
+		return nil, err
+	}
+
+	for id, origin := range md.data.Trash.Origins {
+		de, ok := tblock.Children[id]
+		if !ok {
+			continue
+		}
+		removed, ok := trashEntryTime(id)
+		if !ok {
+			continue
+		}
+		entries = append(entries, TrashEntry{
+			ID:      id,
+			Path:    origin,
+			Type:    de.Type,
+			Removed: removed,
+		})
+	}
+	sort.Sort(trashEntriesNewestFirst(entries))
+	return entries, nil
+}
+
+func (fbo *folderBranchOps) undeleteLocked(ctx context.Context,
+	lState *lockState, id string) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+	trashPath, tblock, err := fbo.getTrash(ctx, lState, md.ReadOnly())
+	if err != nil {
+		return err
+	}
+	if !trashPath.isValid() || md.data.Trash == nil {
+		return NoSuchNameError{id}
+	}
+	origin, ok := md.data.Trash.Origins[id]
+	if _, idOk := tblock.Children[id]; !ok || !idOk {
+		return NoSuchNameError{id}
+	}
+	rootNode, err := fbo.nodeCache.GetOrCreate(md.data.Dir.BlockPointer,
+		string(md.GetTlfHandle().GetCanonicalName()), nil)
+	if err != nil {
+		return err
+	}
+
+	// Recreate any directories along the way that are gone too.
+	components := strings.Split(origin, "/")
+	name := components[len(components)-1]
+	dir := rootNode
+	for _, component := range components[:len(components)-1] {
+		md, err := fbo.getMDForWriteLocked(ctx, lState)
+		if err != nil {
+			return err
+		}
+		dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
+		if err != nil {
+			return err
+		}
+		dblock, err := fbo.blocks.GetDir(
+			ctx, lState, md.ReadOnly(), dirPath, blockRead)
+		if err != nil {
+			return err
+		}
+		de, ok := dblock.Children[component]
+		if !ok {
+			dir, _, err = fbo.createEntryLocked(
+				ctx, lState, dir, component, Dir, NoExcl)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if de.Type != Dir {
+			return NotDirError{dirPath.ChildPathNoPtr(component)}
+		}
+		dir, err = fbo.nodeCache.GetOrCreate(de.BlockPointer, component, dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	md, err = fbo.getMDForCoalescedWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+	dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
+	if err != nil {
+		return err
+	}
+	dblock, err := fbo.blocks.GetDir(
+		ctx, lState, md.ReadOnly(), dirPath, blockRead)
+	if err != nil {
+		return err
+	}
+	if _, ok := dblock.Children[name]; ok {
+		return NameExistsError{name}
+	}
+	trashPath, _, err = fbo.getTrash(ctx, lState, md.ReadOnly())
+	if err != nil {
+		return err
+	}
+
+	fbo.log.CDebugf(ctx, "Restoring %s from the trash to %s", id, origin)
+	delete(md.data.Trash.Origins, id)
+	return fbo.renameWithMDLocked(ctx, lState, md, trashPath, id, dirPath, name)
+}
+
+// Undelete implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) Undelete(
+	ctx context.Context, root Node, id string) (err error) {
+	fbo.log.CDebugf(ctx, "Undelete %p %s", root.GetID(), id)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNodeForWrite(root)
+	if err != nil {
+		return err
+	}
+
+	err = fbo.throttleRevision(ctx, root)
+	if err != nil {
+		return err
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			return fbo.undeleteLocked(ctx, lState, id)
+		})
+}
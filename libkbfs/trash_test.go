@@ -0,0 +1,173 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKBFSOpsTrash(t *testing.T) {
+	var userName libkb.NormalizedUsername = "u1"
+	config, _, ctx := kbfsOpsInitNoMocks(t, userName)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config)
+	clock := newTestClockNow()
+	config.SetClock(clock)
+
+	rootNode := GetRootNodeOrBust(t, config, userName.String(), false)
+	kbfsOps := config.KBFSOps()
+	err := kbfsOps.SetTrashRetention(ctx, rootNode, time.Hour)
+	require.NoError(t, err)
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	require.Equal(t, time.Hour,
+		trashRetention(ops.getHead(lState).ReadOnly()))
+
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	fileNode, _, err := kbfsOps.CreateFile(ctx, dirNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte("hello"), 0)
+	require.NoError(t, err)
+	err = kbfsOps.Sync(ctx, fileNode)
+	require.NoError(t, err)
+
+	// Remove the file and then its directory, like rm -rf.  Each
+	// move into the trash is a single revision.
+	rev := ops.getCurrMDRevision(lState)
+	err = kbfsOps.RemoveEntry(ctx, dirNode, "a")
+	require.NoError(t, err)
+	require.Equal(t, rev+1, ops.getCurrMDRevision(lState))
+	clock.Add(time.Minute)
+	err = kbfsOps.RemoveDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+
+	// The trash is hidden.
+	children, err := kbfsOps.GetDirChildren(ctx, rootNode)
+	require.NoError(t, err)
+	require.Len(t, children, 0)
+	_, _, err = kbfsOps.Lookup(ctx, rootNode, TrashDirName)
+	require.IsType(t, NoSuchNameError{}, err)
+	err = kbfsOps.RemoveDir(ctx, rootNode, TrashDirName)
+	require.IsType(t, NoSuchNameError{}, err)
+
+	entries, err := kbfsOps.ListTrash(ctx, rootNode)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, "d", entries[0].Path)
+	require.Equal(t, Dir, entries[0].Type)
+	require.Equal(t, "d/a", entries[1].Path)
+	require.Equal(t, File, entries[1].Type)
+
+	// Undeleting the file brings back its directory too.
+	err = kbfsOps.Undelete(ctx, rootNode, entries[1].ID)
+	require.NoError(t, err)
+	dirNode, _, err = kbfsOps.Lookup(ctx, rootNode, "d")
+	require.NoError(t, err)
+	fileNode, _, err = kbfsOps.Lookup(ctx, dirNode, "a")
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+
+	// The old directory can't go back over the new one.
+	err = kbfsOps.Undelete(ctx, rootNode, entries[0].ID)
+	require.IsType(t, NameExistsError{}, err)
+
+	// Entries expire after the retention period, all at once.
+	otherNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "e")
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, otherNode, "f", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.RemoveDir(ctx, rootNode, "e")
+	require.IsType(t, DirNotEmptyError{}, err)
+	err = kbfsOps.RemoveEntry(ctx, otherNode, "f")
+	require.NoError(t, err)
+	err = kbfsOps.RemoveDir(ctx, rootNode, "e")
+	require.NoError(t, err)
+	clock.Add(time.Hour + time.Minute)
+	rev = ops.getCurrMDRevision(lState)
+	err = ops.expireTrash(ctx)
+	require.NoError(t, err)
+	require.Equal(t, rev+1, ops.getCurrMDRevision(lState))
+	entries, err = kbfsOps.ListTrash(ctx, rootNode)
+	require.NoError(t, err)
+	require.Len(t, entries, 0)
+	require.Len(t, ops.getHead(lState).data.Trash.Origins, 0)
+
+	// Turning off trash mode removes for good.
+	err = kbfsOps.RemoveEntry(ctx, dirNode, "a")
+	require.NoError(t, err)
+	rev = ops.getCurrMDRevision(lState)
+	err = kbfsOps.SetTrashRetention(ctx, rootNode, 0)
+	require.NoError(t, err)
+	require.Equal(t, rev+1, ops.getCurrMDRevision(lState))
+	fileNode, _, err = kbfsOps.CreateFile(ctx, dirNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.RemoveEntry(ctx, dirNode, "a")
+	require.NoError(t, err)
+	entries, err = kbfsOps.ListTrash(ctx, rootNode)
+	require.NoError(t, err)
+	require.Len(t, entries, 0)
+}
+
+// Entries moved into the trash on an unmerged branch, and the latest
+// retention setting, survive conflict resolution.
+func TestKBFSOpsTrashConflict(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	err := kbfsOps1.SetTrashRetention(ctx, rootNode1, time.Hour)
+	require.NoError(t, err)
+	_, _, err = kbfsOps1.CreateFile(ctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+	_, _, err = kbfsOps1.CreateFile(ctx, rootNode1, "b", false, NoExcl)
+	require.NoError(t, err)
+
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	fb := rootNode2.GetFolderBranch()
+	c, err := DisableUpdatesForTesting(config2, fb)
+	require.NoError(t, err)
+
+	err = kbfsOps1.RemoveEntry(ctx, rootNode1, "a")
+	require.NoError(t, err)
+	err = kbfsOps2.RemoveEntry(ctx, rootNode2, "b")
+	require.NoError(t, err)
+	err = kbfsOps2.SetTrashRetention(ctx, rootNode2, 2*time.Hour)
+	require.NoError(t, err)
+
+	c <- struct{}{}
+	err = kbfsOps2.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	for _, config := range []Config{config1, config2} {
+		rootNode := GetRootNodeOrBust(t, config, name, false)
+		entries, err := config.KBFSOps().ListTrash(ctx, rootNode)
+		require.NoError(t, err)
+		require.Len(t, entries, 2)
+		paths := []string{entries[0].Path, entries[1].Path}
+		require.Contains(t, paths, "a")
+		require.Contains(t, paths, "b")
+		ops := getOps(config, fb.Tlf)
+		require.Equal(t, 2*time.Hour,
+			trashRetention(ops.getHead(makeFBOLockState()).ReadOnly()))
+	}
+}
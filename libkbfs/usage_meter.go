@@ -0,0 +1,289 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"golang.org/x/net/context"
+)
+
+const (
+	// usageDaysToKeep is how many days of usage a UsageMeter
+	// remembers, counting today.
+	usageDaysToKeep = 30
+	// usageFlushInterval is how often a UsageMeter writes the
+	// usage to disk, if it changed.
+	usageFlushInterval = time.Minute
+	usageFileName      = "usage"
+	usageDateFormat    = "2006-01-02"
+)
+
+// TLFUsage counts what was sent to and received from the block and
+// MD servers on behalf of one TLF.  Bytes are those of the blocks
+// and MD objects, not counting RPC framing.
+type TLFUsage struct {
+	// Name is the canonical path of the TLF, once this device has
+	// opened it.
+	Name      string `json:",omitempty"`
+	BytesUp   uint64
+	BytesDown uint64
+	BlockRPCs uint64
+	MDRPCs    uint64
+}
+
+func (u *TLFUsage) add(other TLFUsage) {
+	u.BytesUp += other.BytesUp
+	u.BytesDown += other.BytesDown
+	u.BlockRPCs += other.BlockRPCs
+	u.MDRPCs += other.MDRPCs
+}
+
+// UsageDay is the usage of each TLF on one day, in local time.
+type UsageDay struct {
+	// Date is formatted as "2006-01-02".
+	Date string
+	// TLFs is keyed by TLF ID.
+	TLFs map[string]TLFUsage
+}
+
+// usageRecord is what a UsageMeter persists.
+type usageRecord struct {
+	Days []UsageDay
+	// Names maps TLF IDs to canonical paths.
+	Names map[string]string
+}
+
+// UsageMeter counts the bytes and RPCs each TLF costs on the network,
+// in daily buckets, so that users on metered connections can tell
+// which folders used up their data.  It keeps the last
+// usageDaysToKeep days, on disk if enabled with
+// ConfigLocal.EnableUsagePersistence.  All methods are safe to call
+// on a nil UsageMeter, which counts nothing.
+type UsageMeter struct {
+	clock Clock
+
+	lock   sync.Mutex
+	record usageRecord
+	// dir, codec and log are only set if the usage is persisted.
+	dir        string
+	codec      Codec
+	log        logger.Logger
+	dirty      bool
+	shutdownCh chan struct{}
+	doneCh     chan struct{}
+}
+
+// NewUsageMeter returns a UsageMeter with no usage yet, that buckets
+// usage by the days of the given clock.
+func NewUsageMeter(clock Clock) *UsageMeter {
+	return &UsageMeter{
+		clock:  clock,
+		record: usageRecord{Names: make(map[string]string)},
+	}
+}
+
+func (m *UsageMeter) path() string {
+	return filepath.Join(m.dir, usageFileName)
+}
+
+// enablePersistence loads any usage previously written to dir, adds
+// it to what's been counted so far, and starts writing the usage
+// there periodically, and on shutdown.
+func (m *UsageMeter) enablePersistence(
+	codec Codec, log logger.Logger, dir string) error {
+	if m == nil {
+		return nil
+	}
+	var old usageRecord
+	buf, err := ioutil.ReadFile(filepath.Join(dir, usageFileName))
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	default:
+		err = codec.Decode(buf, &old)
+		if err != nil {
+			return err
+		}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.shutdownCh != nil {
+		panic("Usage persistence enabled twice")
+	}
+	for _, day := range old.Days {
+		for tlf, u := range day.TLFs {
+			m.addLocked(day.Date, tlf, u)
+		}
+	}
+	for tlf, name := range old.Names {
+		if _, ok := m.record.Names[tlf]; !ok {
+			m.record.Names[tlf] = name
+		}
+	}
+	m.dir = dir
+	m.codec = codec
+	m.log = log
+	m.shutdownCh = make(chan struct{})
+	m.doneCh = make(chan struct{})
+	go m.flushLoop()
+	return nil
+}
+
+// addLocked adds u to the usage of tlf on the given date, keeping
+// the days sorted and at most usageDaysToKeep of them.
+func (m *UsageMeter) addLocked(date, tlf string, u TLFUsage) {
+	days := m.record.Days
+	i := len(days)
+	for i > 0 && days[i-1].Date > date {
+		i--
+	}
+	if i == 0 || days[i-1].Date != date {
+		days = append(days, UsageDay{})
+		copy(days[i+1:], days[i:])
+		days[i] = UsageDay{Date: date, TLFs: make(map[string]TLFUsage)}
+		i++
+	}
+	total := days[i-1].TLFs[tlf]
+	total.add(u)
+	days[i-1].TLFs[tlf] = total
+	if len(days) > usageDaysToKeep {
+		days = days[len(days)-usageDaysToKeep:]
+	}
+	m.record.Days = days
+	m.dirty = true
+}
+
+func (m *UsageMeter) add(tlfID TlfID, u TLFUsage) {
+	if m == nil || tlfID == NullTlfID {
+		return
+	}
+	date := m.clock.Now().Format(usageDateFormat)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.addLocked(date, tlfID.String(), u)
+}
+
+// recordBlockRPC counts one RPC to the block server on behalf of
+// tlfID, which sent and received the given number of bytes.
+func (m *UsageMeter) recordBlockRPC(tlfID TlfID, up, down int) {
+	m.add(tlfID, TLFUsage{
+		BytesUp:   uint64(up),
+		BytesDown: uint64(down),
+		BlockRPCs: 1,
+	})
+}
+
+// recordMDRPC counts one RPC to the MD server on behalf of tlfID,
+// which sent and received the given number of bytes.
+func (m *UsageMeter) recordMDRPC(tlfID TlfID, up, down int) {
+	m.add(tlfID, TLFUsage{
+		BytesUp:   uint64(up),
+		BytesDown: uint64(down),
+		MDRPCs:    1,
+	})
+}
+
+// setTLFName records the canonical path of the TLF with the given
+// ID, for reports.
+func (m *UsageMeter) setTLFName(tlfID TlfID, name string) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.record.Names[tlfID.String()] == name {
+		return
+	}
+	m.record.Names[tlfID.String()] = name
+	m.dirty = true
+}
+
+// Days returns the usage of each remembered day, oldest first, with
+// the names of the TLFs filled in where known.
+func (m *UsageMeter) Days() []UsageDay {
+	if m == nil {
+		return nil
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	days := make([]UsageDay, 0, len(m.record.Days))
+	for _, day := range m.record.Days {
+		tlfs := make(map[string]TLFUsage, len(day.TLFs))
+		for tlf, u := range day.TLFs {
+			u.Name = m.record.Names[tlf]
+			tlfs[tlf] = u
+		}
+		days = append(days, UsageDay{Date: day.Date, TLFs: tlfs})
+	}
+	return days
+}
+
+// flush writes the usage to disk, if it's persisted and has changed.
+func (m *UsageMeter) flush() error {
+	m.lock.Lock()
+	if m.dir == "" || !m.dirty {
+		m.lock.Unlock()
+		return nil
+	}
+	buf, err := m.codec.Encode(m.record)
+	m.dirty = false
+	m.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(m.dir, 0700)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(m.path(), buf)
+}
+
+func (m *UsageMeter) flushLoop() {
+	defer close(m.doneCh)
+	ticker := time.NewTicker(usageFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.shutdownCh:
+			return
+		}
+		if err := m.flush(); err != nil {
+			m.log.CWarningf(context.Background(),
+				"Couldn't write usage: %v", err)
+		}
+	}
+}
+
+// shutdown stops writing the usage periodically, and writes it one
+// last time.
+func (m *UsageMeter) shutdown() error {
+	if m == nil {
+		return nil
+	}
+	m.lock.Lock()
+	shutdownCh, doneCh := m.shutdownCh, m.doneCh
+	m.lock.Unlock()
+	if shutdownCh == nil {
+		return nil
+	}
+	select {
+	case <-shutdownCh:
+		// Already shut down.
+		return nil
+	default:
+	}
+	close(shutdownCh)
+	<-doneCh
+	return m.flush()
+}
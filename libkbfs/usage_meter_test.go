@@ -0,0 +1,100 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsageMeterDays(t *testing.T) {
+	clock, now := newTestClockAndTimeNow()
+	m := NewUsageMeter(clock)
+	tlf1 := FakeTlfID(1, false)
+	tlf2 := FakeTlfID(2, true)
+
+	m.recordBlockRPC(tlf1, 100, 0)
+	m.recordBlockRPC(tlf1, 0, 50)
+	m.recordMDRPC(tlf2, 10, 20)
+	m.recordMDRPC(NullTlfID, 10, 20)
+	m.setTLFName(tlf1, "/keybase/private/jdoe")
+	clock.Add(24 * time.Hour)
+	m.recordMDRPC(tlf1, 0, 0)
+
+	days := m.Days()
+	require.Len(t, days, 2)
+	require.Equal(t, now.Format(usageDateFormat), days[0].Date)
+	require.Equal(t, map[string]TLFUsage{
+		tlf1.String(): {
+			Name:      "/keybase/private/jdoe",
+			BytesUp:   100,
+			BytesDown: 50,
+			BlockRPCs: 2,
+		},
+		tlf2.String(): {BytesUp: 10, BytesDown: 20, MDRPCs: 1},
+	}, days[0].TLFs)
+	require.Equal(t, map[string]TLFUsage{
+		tlf1.String(): {Name: "/keybase/private/jdoe", MDRPCs: 1},
+	}, days[1].TLFs)
+
+	// Only the last usageDaysToKeep days are kept.
+	for i := 0; i < usageDaysToKeep; i++ {
+		clock.Add(24 * time.Hour)
+		m.recordBlockRPC(tlf2, 1, 1)
+	}
+	days = m.Days()
+	require.Len(t, days, usageDaysToKeep)
+	require.Equal(t, clock.Now().Format(usageDateFormat),
+		days[len(days)-1].Date)
+
+	// A nil meter counts nothing.
+	var nilMeter *UsageMeter
+	nilMeter.recordBlockRPC(tlf1, 1, 1)
+	require.Nil(t, nilMeter.Days())
+	require.NoError(t, nilMeter.shutdown())
+}
+
+func TestUsageMeterPersistence(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "usage_meter")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	codec := NewCodecMsgpack()
+	log := logger.NewTestLogger(t)
+	clock := newTestClockNow()
+	tlf := FakeTlfID(1, false)
+	m := NewUsageMeter(clock)
+	// Usage counted before persistence is enabled isn't lost.
+	m.recordBlockRPC(tlf, 100, 0)
+	require.NoError(t, m.enablePersistence(codec, log, tempdir))
+	m.recordBlockRPC(tlf, 0, 50)
+	m.setTLFName(tlf, "/keybase/private/jdoe")
+	require.NoError(t, m.shutdown())
+	days := m.Days()
+
+	// Simulate a restart.
+	m = NewUsageMeter(clock)
+	m.recordMDRPC(tlf, 1, 2)
+	require.NoError(t, m.enablePersistence(codec, log, tempdir))
+	defer m.shutdown()
+	require.Equal(t, []UsageDay{{
+		Date: days[0].Date,
+		TLFs: map[string]TLFUsage{tlf.String(): {
+			Name:      "/keybase/private/jdoe",
+			BytesUp:   101,
+			BytesDown: 52,
+			BlockRPCs: 2,
+			MDRPCs:    1,
+		}},
+	}}, m.Days())
+}
@@ -19,9 +19,9 @@ import (
 // in fn should be considered visible only if nil is returned.
 func runUnlessCanceled(ctx context.Context, fn func() error) error {
 	c := make(chan error, 1) // buffered, in case the request is canceled
-	go func() {
+	goHandingOff(func() {
 		c <- fn()
-	}()
+	})
 
 	select {
 	case <-ctx.Done():
@@ -0,0 +1,109 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+)
+
+// WriteDurability says how durable the writes covered by a
+// WriteFence must be before the fence is released.
+type WriteDurability int
+
+const (
+	// WriteDurabilityLocal means the writes have been synced out of
+	// the in-memory dirty caches, so that they're in the local
+	// journal (if journaling is enabled) or on the servers (if not).
+	WriteDurabilityLocal WriteDurability = iota
+	// WriteDurabilityServer means the writes have also been flushed
+	// from the local journal to the servers.
+	WriteDurabilityServer
+)
+
+func (d WriteDurability) String() string {
+	switch d {
+	case WriteDurabilityLocal:
+		return "local"
+	case WriteDurabilityServer:
+		return "server"
+	default:
+		return fmt.Sprintf("WriteDurability(%d)", int(d))
+	}
+}
+
+// ParseWriteDurability returns the WriteDurability named by s, as
+// returned by its String method.
+func ParseWriteDurability(s string) (WriteDurability, error) {
+	for _, d := range []WriteDurability{
+		WriteDurabilityLocal, WriteDurabilityServer} {
+		if s == d.String() {
+			return d, nil
+		}
+	}
+	return WriteDurabilityLocal, fmt.Errorf("Unknown write durability %q", s)
+}
+
+// WriteFence is a token returned by KBFSOps.WriteFence.  It is
+// released once every write issued to its folder-branch before the
+// fence was made is durable at the requested level.  It may also
+// cover some writes issued after the fence, but never fewer than
+// those before it.
+type WriteFence struct {
+	durability WriteDurability
+	done       chan struct{}
+	err        error
+}
+
+func newWriteFence(durability WriteDurability) *WriteFence {
+	return &WriteFence{durability: durability, done: make(chan struct{})}
+}
+
+// release must be called exactly once.
+func (wf *WriteFence) release(err error) {
+	wf.err = err
+	close(wf.done)
+}
+
+// Durability returns the durability level this fence waits for.
+func (wf *WriteFence) Durability() WriteDurability {
+	return wf.durability
+}
+
+// Released returns true if the fence has been released, whether or
+// not it succeeded.
+func (wf *WriteFence) Released() bool {
+	select {
+	case <-wf.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Err returns the error that released the fence, if any.  It
+// returns nil while the fence is still pending, so callers should
+// check Released first.
+func (wf *WriteFence) Err() error {
+	select {
+	case <-wf.done:
+		return wf.err
+	default:
+		return nil
+	}
+}
+
+// Wait blocks until the fence is released, and returns the error
+// that released it, if any.  A nil return means every write covered
+// by the fence is durable at the requested level.
+func (wf *WriteFence) Wait(ctx context.Context) error {
+	select {
+	case <-wf.done:
+		return wf.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
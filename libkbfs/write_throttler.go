@@ -0,0 +1,137 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// writeThrottleWindow is how far back writeThrottler looks
+	// when counting recent revisions.
+	writeThrottleWindow = time.Minute
+	// writeThrottleMaxFolderRevs is how many revisions this device
+	// can make to one folder within writeThrottleWindow before
+	// further revisions are delayed.
+	writeThrottleMaxFolderRevs = 1000
+	// writeThrottleMaxNodeRevs is like writeThrottleMaxFolderRevs,
+	// but for revisions touching a single file or directory; a
+	// process rewriting the same file in a loop hits this first.
+	writeThrottleMaxNodeRevs = 200
+	// writeThrottleDelayStep is how much extra delay each revision
+	// over the limit adds.
+	writeThrottleDelayStep = 10 * time.Millisecond
+	// writeThrottleMaxDelay caps the delay added to any one
+	// revision.
+	writeThrottleMaxDelay = 5 * time.Second
+)
+
+// writeThrottler keeps track of how quickly this device is making
+// revisions to a folder, both overall and per node, and computes a
+// delay for new revisions once a runaway write pattern is detected.
+// This protects shared folders (and the user's quota) from
+// misbehaving applications, without failing any of their writes.
+type writeThrottler struct {
+	clock         Clock
+	window        time.Duration
+	maxFolderRevs int
+	maxNodeRevs   int
+	delayStep     time.Duration
+	maxDelay      time.Duration
+
+	lock       sync.Mutex
+	folderRevs []time.Time
+	nodeRevs   map[NodeID][]time.Time
+	throttled  bool
+}
+
+func newWriteThrottler(clock Clock) *writeThrottler {
+	return &writeThrottler{
+		clock:         clock,
+		window:        writeThrottleWindow,
+		maxFolderRevs: writeThrottleMaxFolderRevs,
+		maxNodeRevs:   writeThrottleMaxNodeRevs,
+		delayStep:     writeThrottleDelayStep,
+		maxDelay:      writeThrottleMaxDelay,
+		nodeRevs:      make(map[NodeID][]time.Time),
+	}
+}
+
+// pruneRevs drops all times in revs that are before cutoff; revs
+// must be sorted.
+func pruneRevs(revs []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(revs) && revs[i].Before(cutoff) {
+		i++
+	}
+	return revs[i:]
+}
+
+func (wt *writeThrottler) delayForLocked(count, limit int) time.Duration {
+	if count <= limit {
+		return 0
+	}
+	delay := time.Duration(count-limit) * wt.delayStep
+	if delay > wt.maxDelay {
+		delay = wt.maxDelay
+	}
+	return delay
+}
+
+// recordRev records a new revision touching the given node, and
+// returns how long the caller should wait before making it.
+// newlyThrottled is true if this is the first revision to be delayed
+// since the write rate was last back to normal.
+func (wt *writeThrottler) recordRev(id NodeID) (
+	delay time.Duration, newlyThrottled bool) {
+	wt.lock.Lock()
+	defer wt.lock.Unlock()
+
+	now := wt.clock.Now()
+	cutoff := now.Add(-wt.window)
+	wt.folderRevs = append(pruneRevs(wt.folderRevs, cutoff), now)
+	nodeRevs := append(pruneRevs(wt.nodeRevs[id], cutoff), now)
+	wt.nodeRevs[id] = nodeRevs
+
+	// Every node in the map has a revision in folderRevs (or had
+	// one that has since expired), so once the map is bigger than
+	// that, clean out nodes that haven't been touched in a while.
+	if len(wt.nodeRevs) > len(wt.folderRevs) {
+		for otherID, revs := range wt.nodeRevs {
+			if revs[len(revs)-1].Before(cutoff) {
+				delete(wt.nodeRevs, otherID)
+			}
+		}
+	}
+
+	delay = wt.delayForLocked(len(wt.folderRevs), wt.maxFolderRevs)
+	nodeDelay := wt.delayForLocked(len(nodeRevs), wt.maxNodeRevs)
+	if nodeDelay > delay {
+		delay = nodeDelay
+	}
+
+	wasThrottled := wt.throttled
+	wt.throttled = delay > 0
+	return delay, wt.throttled && !wasThrottled
+}
+
+// wait blocks for the given delay, or until ctx is canceled.
+func (wt *writeThrottler) wait(
+	ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
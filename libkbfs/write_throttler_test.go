@@ -0,0 +1,70 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestWriteThrottlerNodeLoop(t *testing.T) {
+	clock := newTestClockNow()
+	wt := newWriteThrottler(clock)
+	wt.maxFolderRevs = 10
+	wt.maxNodeRevs = 3
+
+	loopID := &nodeCore{}
+	for i := 0; i < 3; i++ {
+		delay, newlyThrottled := wt.recordRev(loopID)
+		require.Equal(t, time.Duration(0), delay)
+		require.False(t, newlyThrottled)
+	}
+
+	// The fourth revision to the same node trips the per-node
+	// limit, but only reports it once.
+	delay, newlyThrottled := wt.recordRev(loopID)
+	require.Equal(t, wt.delayStep, delay)
+	require.True(t, newlyThrottled)
+	delay, newlyThrottled = wt.recordRev(loopID)
+	require.Equal(t, 2*wt.delayStep, delay)
+	require.False(t, newlyThrottled)
+
+	// Other nodes are still under their own limit, and under the
+	// folder limit.
+	delay, _ = wt.recordRev(&nodeCore{})
+	require.Equal(t, time.Duration(0), delay)
+
+	// Once the window passes, everything is back to normal, and
+	// stale nodes get cleaned up.
+	clock.Add(wt.window + time.Second)
+	delay, newlyThrottled = wt.recordRev(loopID)
+	require.Equal(t, time.Duration(0), delay)
+	require.False(t, newlyThrottled)
+	require.Len(t, wt.nodeRevs, 1)
+}
+
+func TestWriteThrottlerFolderLimit(t *testing.T) {
+	clock := newTestClockNow()
+	wt := newWriteThrottler(clock)
+	wt.maxFolderRevs = 5
+	wt.maxDelay = 3 * wt.delayStep
+
+	var delay time.Duration
+	for i := 0; i < 10; i++ {
+		delay, _ = wt.recordRev(&nodeCore{})
+	}
+	require.Equal(t, wt.maxDelay, delay)
+}
+
+func TestWriteThrottlerWaitCanceled(t *testing.T) {
+	wt := newWriteThrottler(wallClock{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := wt.wait(ctx, time.Hour)
+	require.Equal(t, context.Canceled, err)
+}
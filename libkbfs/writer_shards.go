@@ -0,0 +1,384 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// ShardsDirName is the name of the hidden directory that makes the
+// directory holding it sharded between writers.
+//
+// Each device that creates an entry in a sharded directory puts it
+// in its own shard, a subdirectory of this one named after the user
+// and device, so devices appending to the same directory never edit
+// the same directory block.  That cuts down how often they contend
+// for the folder's MD revisions, and what it costs when they do:
+// while journaled, a device folds the creates in its shard into one
+// revision for at least shardCoalesceWindow, and a put that loses
+// the race is redone on top of the winner's revision rather than
+// going unmerged and through conflict resolution.  Devices still
+// share the one MD history, so puts aren't contention-free.
+//
+// Readers see the entries of all the shards merged with the
+// directory's own entries, which win any name they share with a
+// shard entry.  When shards clash on a name, the entry created first
+// keeps it, and the others are shown with the shard name appended in
+// parentheses.
+const ShardsDirName = ".kbfs_shards"
+
+const (
+	// shardCoalesceWindow is the least time a device keeps folding
+	// creates in its writer shards into the same MD revision, when
+	// the folder is journaled.
+	shardCoalesceWindow = 1 * time.Second
+	// maxShardPutRaces is how many times in a row a put for a
+	// writer shard is redone after losing a race, before it falls
+	// back to an unmerged put and conflict resolution.
+	maxShardPutRaces = 5
+)
+
+// errShardPutRaced means a put that only created entries in this
+// device's writer shards lost the race for its revision, and the op
+// should be redone on top of the new head.
+var errShardPutRaced = errors.New(
+	"Writer shard MD put lost a race and needs to be redone")
+
+// isWriterShardPath returns whether p is the shards directory of a
+// sharded directory, or one of the shards in it.  New entries there
+// are only ever made by the device that owns the shard.
+func isWriterShardPath(p path) bool {
+	if p.tailName() == ShardsDirName {
+		return true
+	}
+	return p.hasValidParent() && p.parentPath().tailName() == ShardsDirName
+}
+
+// getMDForShardWriteLocked is getMDForCoalescedWriteLocked for
+// creating an entry in a writer shard.
+func (fbo *folderBranchOps) getMDForShardWriteLocked(
+	ctx context.Context, lState *lockState) (*RootMetadata, error) {
+	window := fbo.config.MDCoalesceWindow()
+	if window < shardCoalesceWindow {
+		window = shardCoalesceWindow
+	}
+	md, err := fbo.getMDForCoalescedWriteWithWindowLocked(
+		ctx, lState, window)
+	if err != nil {
+		return nil, err
+	}
+	// A revision that other ops were folded into can't just be
+	// redone.
+	md.shardOnly = !md.replacesHead
+	return md, nil
+}
+
+// shardedEntry locates an entry shown in a sharded directory.
+type shardedEntry struct {
+	// shard is the name of the shard holding the entry, or empty if
+	// it's directly in the sharded directory.
+	shard    string
+	shardPtr BlockPointer
+	// name is the entry's name within its shard.
+	name string
+	ei   EntryInfo
+}
+
+type shardedEntriesOldestFirst []shardedEntry
+
+func (s shardedEntriesOldestFirst) Len() int      { return len(s) }
+func (s shardedEntriesOldestFirst) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s shardedEntriesOldestFirst) Less(i, j int) bool {
+	if s[i].ei.Ctime != s[j].ei.Ctime {
+		return s[i].ei.Ctime < s[j].ei.Ctime
+	}
+	return s[i].shard < s[j].shard
+}
+
+func shardCollisionName(name, shard string) string {
+	return fmt.Sprintf("%s (%s)", name, shard)
+}
+
+// getShardedChildren returns the children of dirPath as shown to
+// readers, along with the pointer of its shards directory.  The
+// children are nil if dirPath isn't sharded.
+func (fbo *folderBranchOps) getShardedChildren(ctx context.Context,
+	lState *lockState, md ReadOnlyRootMetadata, dirPath path) (
+	children map[string]shardedEntry, shardsPtr BlockPointer, err error) {
+	dblock, err := fbo.blocks.GetDir(ctx, lState, md, dirPath, blockRead)
+	if err != nil {
+		return nil, BlockPointer{}, err
+	}
+	sde, ok := dblock.Children[ShardsDirName]
+	if !ok || sde.Type != Dir {
+		return nil, BlockPointer{}, nil
+	}
+
+	own, err := fbo.blocks.GetDirtyDirChildren(ctx, lState, md, dirPath)
+	if err != nil {
+		return nil, BlockPointer{}, err
+	}
+	children = make(map[string]shardedEntry, len(own))
+	for name, ei := range own {
+		if name == ShardsDirName || isTrashDir(dirPath, name) {
+			continue
+		}
+		children[name] = shardedEntry{name: name, ei: ei}
+	}
+
+	shardsPath := dirPath.ChildPath(ShardsDirName, sde.BlockPointer)
+	sblock, err := fbo.blocks.GetDir(ctx, lState, md, shardsPath, blockRead)
+	if err != nil {
+		return nil, BlockPointer{}, err
+	}
+	byName := make(map[string][]shardedEntry)
+	for shard, de := range sblock.Children {
+		if de.Type != Dir {
+			continue
+		}
+		shardPath := shardsPath.ChildPath(shard, de.BlockPointer)
+		entries, err := fbo.blocks.GetDirtyDirChildren(
+			ctx, lState, md, shardPath)
+		if err != nil {
+			return nil, BlockPointer{}, err
+		}
+		for name, ei := range entries {
+			byName[name] = append(byName[name], shardedEntry{
+				shard:    shard,
+				shardPtr: de.BlockPointer,
+				name:     name,
+				ei:       ei,
+			})
+		}
+	}
+
+	for name, entries := range byName {
+		sort.Sort(shardedEntriesOldestFirst(entries))
+		for i, se := range entries {
+			shown := name
+			if _, taken := children[shown]; taken || i > 0 {
+				shown = shardCollisionName(name, se.shard)
+			}
+			if _, taken := children[shown]; taken {
+				fbo.log.CDebugf(ctx, "Hiding %s in shard %s, since %s "+
+					"is taken", name, se.shard, shown)
+				continue
+			}
+			children[shown] = se
+		}
+	}
+	return children, sde.BlockPointer, nil
+}
+
+// getShardNode returns the node of the given shard of dir.
+func (fbo *folderBranchOps) getShardNode(dir Node, shardsPtr BlockPointer,
+	shard string, shardPtr BlockPointer) (Node, error) {
+	shardsNode, err := fbo.nodeCache.GetOrCreate(
+		shardsPtr, ShardsDirName, dir)
+	if err != nil {
+		return nil, err
+	}
+	return fbo.nodeCache.GetOrCreate(shardPtr, shard, shardsNode)
+}
+
+// ownShardName returns the name of the current device's shard.
+func (fbo *folderBranchOps) ownShardName(ctx context.Context) (
+	string, error) {
+	_, uid, err := fbo.config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return "", err
+	}
+	key, err := fbo.config.KBPKI().GetCurrentVerifyingKey(ctx)
+	if err != nil {
+		return "", err
+	}
+	winfo, err := newWriterInfo(ctx, fbo.config, uid, key.KID())
+	if err != nil {
+		return "", err
+	}
+	device := winfo.deviceName
+	if device == "" {
+		device = key.KID().String()
+	}
+	return strings.Replace(winfo.name.String()+"."+device, "/", "_", -1), nil
+}
+
+// routeShardedLocked returns the directory node and name that the
+// entry shown as name in dir really has.  If there's no such entry
+// and create is set, it returns where to create one instead, which
+// is the current device's shard, making the shard first if needed.
+// Outside of sharded directories, it returns dir and name as they
+// are.
+func (fbo *folderBranchOps) routeShardedLocked(ctx context.Context,
+	lState *lockState, dir Node, name string, create bool) (
+	Node, string, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	md, err := fbo.getMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return nil, "", err
+	}
+	dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
+	if err != nil {
+		return nil, "", err
+	}
+	children, shardsPtr, err := fbo.getShardedChildren(
+		ctx, lState, md.ReadOnly(), dirPath)
+	if err != nil || children == nil {
+		return dir, name, err
+	}
+	if name == ShardsDirName {
+		if create {
+			return nil, "", DisallowedPrefixError{name, disallowedPrefixes[0]}
+		}
+		return nil, "", NoSuchNameError{name}
+	}
+
+	se, ok := children[name]
+	if ok && create && se.shard != "" && fbo.shardPutRaces > 0 {
+		// A create being redone after losing a race still goes
+		// into this device's shard, as it would have if it had
+		// won, even if another shard took the name meanwhile.
+		ok = false
+	}
+	if ok {
+		if se.shard == "" {
+			return dir, name, nil
+		}
+		shardNode, err := fbo.getShardNode(
+			dir, shardsPtr, se.shard, se.shardPtr)
+		if err != nil {
+			return nil, "", err
+		}
+		return shardNode, se.name, nil
+	}
+	if !create {
+		return dir, name, nil
+	}
+
+	shard, err := fbo.ownShardName(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	shardsNode, err := fbo.nodeCache.GetOrCreate(
+		shardsPtr, ShardsDirName, dir)
+	if err != nil {
+		return nil, "", err
+	}
+	shardsPath, err := fbo.pathFromNodeForMDWriteLocked(lState, shardsNode)
+	if err != nil {
+		return nil, "", err
+	}
+	sblock, err := fbo.blocks.GetDir(
+		ctx, lState, md.ReadOnly(), shardsPath, blockRead)
+	if err != nil {
+		return nil, "", err
+	}
+	if de, ok := sblock.Children[shard]; ok {
+		shardNode, err := fbo.nodeCache.GetOrCreate(
+			de.BlockPointer, shard, shardsNode)
+		if err != nil {
+			return nil, "", err
+		}
+		return shardNode, name, nil
+	}
+	fbo.log.CDebugf(ctx, "Making shard %s", shard)
+	shardNode, _, err := fbo.createEntryLocked(
+		ctx, lState, shardsNode, shard, Dir, NoExcl)
+	if err != nil {
+		return nil, "", err
+	}
+	return shardNode, name, nil
+}
+
+// SetWriterSharding implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) SetWriterSharding(ctx context.Context,
+	dir Node, sharded bool) (err error) {
+	fbo.log.CDebugf(ctx, "SetWriterSharding %p %t", dir.GetID(), sharded)
+	defer func() { fbo.deferLog.CDebugf(ctx, "Done: %v", err) }()
+
+	err = fbo.checkNodeForWrite(dir)
+	if err != nil {
+		return err
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			md, err := fbo.getMDForWriteLocked(ctx, lState)
+			if err != nil {
+				return err
+			}
+			dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
+			if err != nil {
+				return err
+			}
+			children, _, err := fbo.getShardedChildren(
+				ctx, lState, md.ReadOnly(), dirPath)
+			if err != nil {
+				return err
+			}
+
+			if sharded {
+				if children != nil {
+					return nil
+				}
+				_, _, err := fbo.createEntryLocked(
+					ctx, lState, dir, ShardsDirName, Dir, NoExcl)
+				return err
+			}
+
+			if children == nil {
+				return nil
+			}
+			// Move every shard entry back under the name it's
+			// shown with, so nothing changes for readers.
+			var names []string
+			for name, se := range children {
+				if se.shard != "" {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				shardNode, shardName, err := fbo.routeShardedLocked(
+					ctx, lState, dir, name, false)
+				if err != nil {
+					return err
+				}
+				shardPath, err := fbo.pathFromNodeForMDWriteLocked(
+					lState, shardNode)
+				if err != nil {
+					return err
+				}
+				dirPath, err := fbo.pathFromNodeForMDWriteLocked(
+					lState, dir)
+				if err != nil {
+					return err
+				}
+				err = fbo.renameLocked(
+					ctx, lState, shardPath, shardName, dirPath, name)
+				if err != nil {
+					return err
+				}
+			}
+			md, err = fbo.getMDForWriteLocked(ctx, lState)
+			if err != nil {
+				return err
+			}
+			dirPath, err = fbo.pathFromNodeForMDWriteLocked(lState, dir)
+			if err != nil {
+				return err
+			}
+			return fbo.removeTreesLocked(
+				ctx, lState, md, dirPath, []string{ShardsDirName})
+		})
+}
@@ -0,0 +1,216 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKBFSOpsWriterSharding(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	dirNode1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "drop")
+	require.NoError(t, err)
+	_, _, err = kbfsOps1.CreateFile(ctx, dirNode1, "own", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps1.SetWriterSharding(ctx, dirNode1, true)
+	require.NoError(t, err)
+
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	dirNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "drop")
+	require.NoError(t, err)
+
+	// Both writers add "a" without seeing each other's.
+	fb := rootNode2.GetFolderBranch()
+	c, err := DisableUpdatesForTesting(config2, fb)
+	require.NoError(t, err)
+	fileNode1, _, err := kbfsOps1.CreateFile(ctx, dirNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps1.Write(ctx, fileNode1, []byte("one"), 0)
+	require.NoError(t, err)
+	err = kbfsOps1.Sync(ctx, fileNode1)
+	require.NoError(t, err)
+	fileNode2, _, err := kbfsOps2.CreateFile(ctx, dirNode2, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps2.Write(ctx, fileNode2, []byte("two"), 0)
+	require.NoError(t, err)
+	err = kbfsOps2.Sync(ctx, fileNode2)
+	require.NoError(t, err)
+
+	c <- struct{}{}
+	err = kbfsOps2.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+
+	// Both writers see both files, one under a shard-qualified name,
+	// and nothing was renamed as a conflict.
+	for _, c := range []struct {
+		kbfsOps KBFSOps
+		dir     Node
+	}{{kbfsOps1, dirNode1}, {kbfsOps2, dirNode2}} {
+		children, err := c.kbfsOps.GetDirChildren(ctx, c.dir)
+		require.NoError(t, err)
+		require.Len(t, children, 3)
+		require.Contains(t, children, "own")
+		require.Contains(t, children, "a")
+		var other string
+		for name := range children {
+			if strings.HasPrefix(name, "a (") {
+				other = name
+			}
+		}
+		require.NotEqual(t, "", other)
+		contents := []string{
+			readWholeFile(t, ctx, c.kbfsOps, c.dir, "a"),
+			readWholeFile(t, ctx, c.kbfsOps, c.dir, other),
+		}
+		require.Contains(t, contents, "one")
+		require.Contains(t, contents, "two")
+
+		_, _, err = c.kbfsOps.Lookup(ctx, c.dir, ShardsDirName)
+		require.IsType(t, NoSuchNameError{}, err)
+		_, _, err = c.kbfsOps.CreateFile(ctx, c.dir, "a", false, NoExcl)
+		require.IsType(t, NameExistsError{}, err)
+	}
+
+	// Entries in other writers' shards can be renamed and removed.
+	children, err := kbfsOps1.GetDirChildren(ctx, dirNode1)
+	require.NoError(t, err)
+	for name := range children {
+		if strings.HasPrefix(name, "a (") {
+			err = kbfsOps1.Rename(ctx, dirNode1, name, dirNode1, "b")
+			require.NoError(t, err)
+		}
+	}
+	err = kbfsOps1.RemoveEntry(ctx, dirNode1, "a")
+	require.NoError(t, err)
+
+	// Turning sharding off keeps everything where readers see it.
+	err = kbfsOps1.SetWriterSharding(ctx, dirNode1, false)
+	require.NoError(t, err)
+	children, err = kbfsOps1.GetDirChildren(ctx, dirNode1)
+	require.NoError(t, err)
+	require.Len(t, children, 2)
+	require.Contains(t, children, "own")
+	require.Contains(t, children, "b")
+	_, _, err = kbfsOps1.Lookup(ctx, dirNode1, ShardsDirName)
+	require.IsType(t, NoSuchNameError{}, err)
+}
+
+func TestKBFSOpsWriterShardPutRaceRedone(t *testing.T) {
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx := kbfsOpsConcurInit(t, userName1, userName2)
+	defer CleanupCancellationDelayer(ctx)
+	defer CheckConfigAndShutdown(t, config1)
+
+	config2 := ConfigAsUser(config1.(*ConfigLocal), userName2)
+	defer CheckConfigAndShutdown(t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+	rootNode1 := GetRootNodeOrBust(t, config1, name, false)
+	kbfsOps1 := config1.KBFSOps()
+	dirNode1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "drop")
+	require.NoError(t, err)
+	err = kbfsOps1.SetWriterSharding(ctx, dirNode1, true)
+	require.NoError(t, err)
+
+	rootNode2 := GetRootNodeOrBust(t, config2, name, false)
+	kbfsOps2 := config2.KBFSOps()
+	dirNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "drop")
+	require.NoError(t, err)
+
+	// u2's creates lose the race to u1's, but are redone on top of
+	// them instead of going unmerged.
+	fb := rootNode2.GetFolderBranch()
+	c, err := DisableUpdatesForTesting(config2, fb)
+	require.NoError(t, err)
+	defer func() { c <- struct{}{} }()
+	_, _, err = kbfsOps1.CreateFile(ctx, dirNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+	_, _, err = kbfsOps2.CreateFile(ctx, dirNode2, "b", false, NoExcl)
+	require.NoError(t, err)
+	_, _, err = kbfsOps1.CreateFile(ctx, dirNode1, "c", false, NoExcl)
+	require.NoError(t, err)
+	_, _, err = kbfsOps2.CreateFile(ctx, dirNode2, "d", false, NoExcl)
+	require.NoError(t, err)
+
+	ops2 := getOps(config2, fb.Tlf)
+	require.True(t, ops2.isMasterBranch(makeFBOLockState()))
+	children, err := kbfsOps2.GetDirChildren(ctx, dirNode2)
+	require.NoError(t, err)
+	require.Len(t, children, 4)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		require.Contains(t, children, name)
+	}
+
+	err = kbfsOps1.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+	children, err = kbfsOps1.GetDirChildren(ctx, dirNode1)
+	require.NoError(t, err)
+	require.Len(t, children, 4)
+}
+
+func TestKBFSOpsWriterShardCoalescing(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "journal_server")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	config, _, ctx := kbfsOpsInitNoMocks(t, "test_user")
+	defer CheckConfigAndShutdown(t, config)
+	config.EnableJournaling(tempdir)
+	jServer, err := GetJournalServer(config)
+	require.NoError(t, err)
+
+	rootNode := GetRootNodeOrBust(t, config, "test_user", false)
+	fb := rootNode.GetFolderBranch()
+	err = jServer.Enable(ctx, fb.Tlf, TLFJournalBackgroundWorkEnabled)
+	require.NoError(t, err)
+	kbfsOps := config.KBFSOps()
+	headRevision := func() MetadataRevision {
+		status, _, err := kbfsOps.FolderStatus(ctx, fb)
+		require.NoError(t, err)
+		return status.Revision
+	}
+
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "drop")
+	require.NoError(t, err)
+	err = kbfsOps.SetWriterSharding(ctx, dirNode, true)
+	require.NoError(t, err)
+	startRev := headRevision()
+
+	// Without a configured coalescing window, creates in the
+	// device's shard still share a revision.
+	for _, name := range []string{"a", "b", "c"} {
+		_, _, err = kbfsOps.CreateFile(ctx, dirNode, name, false, NoExcl)
+		require.NoError(t, err)
+	}
+	require.Equal(t, startRev+1, headRevision())
+
+	err = jServer.Wait(ctx, fb.Tlf)
+	require.NoError(t, err)
+	children, err := kbfsOps.GetDirChildren(ctx, dirNode)
+	require.NoError(t, err)
+	require.Len(t, children, 3)
+}
@@ -0,0 +1,85 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libnfs
+
+import (
+	"fmt"
+
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+// nfsStatus is an NFSv3 status code (nfsstat3).  Non-OK statuses
+// are also errors, so calls can return them directly.
+type nfsStatus uint32
+
+const (
+	nfs3OK             nfsStatus = 0
+	nfs3ErrPerm        nfsStatus = 1
+	nfs3ErrNoEnt       nfsStatus = 2
+	nfs3ErrIO          nfsStatus = 5
+	nfs3ErrAcces       nfsStatus = 13
+	nfs3ErrExist       nfsStatus = 17
+	nfs3ErrXDev        nfsStatus = 18
+	nfs3ErrNotDir      nfsStatus = 20
+	nfs3ErrIsDir       nfsStatus = 21
+	nfs3ErrInval       nfsStatus = 22
+	nfs3ErrFBig        nfsStatus = 27
+	nfs3ErrNoSpc       nfsStatus = 28
+	nfs3ErrROFS        nfsStatus = 30
+	nfs3ErrNameTooLong nfsStatus = 63
+	nfs3ErrNotEmpty    nfsStatus = 66
+	nfs3ErrDQuot       nfsStatus = 69
+	nfs3ErrStale       nfsStatus = 70
+	nfs3ErrBadHandle   nfsStatus = 10001
+	nfs3ErrNotSync     nfsStatus = 10002
+	nfs3ErrBadCookie   nfsStatus = 10003
+	nfs3ErrNotSupp     nfsStatus = 10004
+	nfs3ErrTooSmall    nfsStatus = 10005
+	nfs3ErrServerFault nfsStatus = 10006
+)
+
+// Error implements the error interface for nfsStatus.
+func (s nfsStatus) Error() string {
+	return fmt.Sprintf("NFS3 status %d", uint32(s))
+}
+
+// errToStatus returns the NFS status to report for err.
+func errToStatus(err error) nfsStatus {
+	switch err := err.(type) {
+	case nil:
+		return nfs3OK
+	case nfsStatus:
+		return err
+	case libkbfs.NoSuchNameError, libkbfs.NoSuchUserError,
+		libkbfs.BadTLFNameError, libfs.TlfDoesNotExist:
+		return nfs3ErrNoEnt
+	case libkbfs.NameExistsError:
+		return nfs3ErrExist
+	case libkbfs.DirNotEmptyError:
+		return nfs3ErrNotEmpty
+	case libkbfs.NotDirError:
+		return nfs3ErrNotDir
+	case libkbfs.NotFileError:
+		return nfs3ErrIsDir
+	case libkbfs.ReadAccessError, libkbfs.WriteAccessError,
+		libkbfs.MDServerErrorUnauthorized, libkbfs.NeedSelfRekeyError,
+		libkbfs.NeedOtherRekeyError, libkbfs.WritesPausedError:
+		return nfs3ErrAcces
+	case libkbfs.NameTooLongError:
+		return nfs3ErrNameTooLong
+	case libkbfs.FileTooBigError:
+		return nfs3ErrFBig
+	case libkbfs.DirTooBigError:
+		return nfs3ErrNoSpc
+	case libkbfs.BServerErrorOverQuota:
+		return nfs3ErrDQuot
+	case libkbfs.CrossDirLinkError:
+		return nfs3ErrXDev
+	case libkbfs.EmptyNameError, libkbfs.DisallowedPrefixError:
+		return nfs3ErrInval
+	}
+	return nfs3ErrIO
+}
@@ -0,0 +1,135 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libnfs
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ExportOptions restrict what the NFS server exports, and to whom.
+type ExportOptions struct {
+	// Subdir, if set, exports just the given directory (such as
+	// "private/alice" or "private/alice/project") instead of the
+	// whole of KBFS.  Clients can't reach anything outside it.
+	Subdir string
+	// ReadOnly, if true, fails every call that would change
+	// anything.
+	ReadOnly bool
+	// AllowedNetworks lists the networks clients may connect from.
+	// If empty, only clients on the loopback interface may connect.
+	AllowedNetworks []*net.IPNet
+	// OwnerUID is the uid of the user the files are served for.
+	// Calls are only handled if their AUTH_SYS credentials are for
+	// this uid, except that root may mount the export and look at
+	// its attributes, as NFS clients do when mounting.
+	OwnerUID uint32
+	// Secret, if set, lets calls come from unprivileged ports, as
+	// long as they carry it as the machine name of their AUTH_SYS
+	// credentials.  Otherwise calls must come from a privileged
+	// port, i.e. from root on the client machine, so that other
+	// users there can't claim to be OwnerUID.  The secret is sent
+	// in the clear, so it only helps on networks that can't be
+	// snooped on.
+	Secret string
+}
+
+// ParseAllowedNetworks parses a comma-separated list of networks in
+// CIDR notation (like "192.168.1.0/24"), or of single IP addresses,
+// for ExportOptions.AllowedNetworks.
+func ParseAllowedNetworks(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			ip := net.ParseIP(field)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid IP address %q", field)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks,
+				&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// allowed returns whether a client at addr may connect.
+func (o ExportOptions) allowed(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	if len(o.AllowedNetworks) == 0 {
+		return tcpAddr.IP.IsLoopback()
+	}
+	for _, network := range o.AllowedNetworks {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// privilegedPort is the first port that any user may bind to.
+const privilegedPort = 1024
+
+// isMountTimeCall returns whether the given call is one that NFS
+// clients make as root while mounting, and that neither reads nor
+// changes any file.
+func isMountTimeCall(prog, proc uint32) bool {
+	switch prog {
+	case mountProgram:
+		return true
+	case nfsProgram:
+		switch proc {
+		case nfsProcNull, nfsProcGetattr, nfsProcFsstat, nfsProcFsinfo,
+			nfsProcPathconf:
+			return true
+		}
+	}
+	return false
+}
+
+// authorized returns whether a call to the given program and
+// procedure, made with cred from a client at addr, may be handled.
+func (o ExportOptions) authorized(
+	addr net.Addr, prog, proc uint32, cred rpcCred) bool {
+	if cred.uid != o.OwnerUID &&
+		!(cred.uid == 0 && isMountTimeCall(prog, proc)) {
+		return false
+	}
+	if o.Secret != "" && subtle.ConstantTimeCompare(
+		[]byte(cred.machine), []byte(o.Secret)) == 1 {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	return ok && tcpAddr.Port < privilegedPort
+}
+
+// subdirComponents returns the path components of Subdir.
+func (o ExportOptions) subdirComponents() []string {
+	var components []string
+	for _, c := range strings.Split(o.Subdir, "/") {
+		if c != "" {
+			components = append(components, c)
+		}
+	}
+	return components
+}
@@ -0,0 +1,344 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libnfs
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// FS serves KBFS, or a directory in it, to NFS clients.  It
+// translates NFS calls onto KBFSOps.
+type FS struct {
+	config  libkbfs.Config
+	log     logger.Logger
+	options ExportOptions
+	handles *handleTable
+	// startTime is reported as the time of the directories that
+	// aren't in any TLF.
+	startTime time.Time
+
+	exportLock sync.Mutex
+	exportRoot *fsNode
+}
+
+// NewFS creates an FS that exports KBFS as described by options.
+func NewFS(config libkbfs.Config, options ExportOptions) (*FS, error) {
+	handles, err := newHandleTable(len(options.subdirComponents()) == 0)
+	if err != nil {
+		return nil, err
+	}
+	return &FS{
+		config:    config,
+		log:       config.MakeLogger("kbfsnfs"),
+		options:   options,
+		handles:   handles,
+		startTime: time.Now(),
+	}, nil
+}
+
+// WithContext adds request-specific values to the context of an NFS
+// call.
+func (f *FS) WithContext(ctx context.Context) context.Context {
+	id, errRandomReqID := libkbfs.MakeRandomRequestID()
+	if errRandomReqID != nil {
+		f.log.Errorf("Couldn't make request ID: %v", errRandomReqID)
+	}
+
+	ctx, err := libkbfs.NewContextWithCancellationDelayer(
+		libkbfs.NewContextReplayable(ctx, func(ctx context.Context) context.Context {
+			logTags := make(logger.CtxLogTags)
+			logTags[CtxIDKey] = CtxOpID
+			ctx = logger.NewContextWithLogTags(ctx, logTags)
+
+			if errRandomReqID == nil {
+				// Add a unique ID to this context, identifying a
+				// particular request.
+				ctx = context.WithValue(ctx, CtxIDKey, id)
+			}
+			return ctx
+		}))
+	if err != nil {
+		panic(err) // this should never happen
+	}
+	return ctx
+}
+
+func (f *FS) reportErr(ctx context.Context, mode libkbfs.ErrorModeType,
+	err error) {
+	if err == nil {
+		return
+	}
+	if _, ok := err.(nfsStatus); ok {
+		f.log.CDebugf(ctx, "NFS error: %v", err)
+		return
+	}
+	f.config.Reporter().ReportErr(ctx, "", false, mode, err)
+	// Most errors, like a lookup of a missing name, are expected.
+	f.log.CDebugf(ctx, err.Error())
+}
+
+// getExportRoot returns the node at the root of the export, looking
+// it up the first time.
+func (f *FS) getExportRoot(ctx context.Context) (*fsNode, error) {
+	f.exportLock.Lock()
+	defer f.exportLock.Unlock()
+	if f.exportRoot != nil {
+		return f.exportRoot, nil
+	}
+
+	n := f.handles.get(rootNodeID)
+	for _, name := range f.options.subdirComponents() {
+		if name == "." || name == ".." {
+			return nil, nfs3ErrInval
+		}
+		var err error
+		n, err = f.lookupChild(ctx, n, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if isDir, err := f.isDir(ctx, n); err != nil {
+		return nil, err
+	} else if !isDir {
+		return nil, nfs3ErrNotDir
+	}
+	f.handles.setExported(n)
+	f.exportRoot = n
+	return n, nil
+}
+
+func (f *FS) isExportRoot(n *fsNode) bool {
+	f.exportLock.Lock()
+	defer f.exportLock.Unlock()
+	return n == f.exportRoot
+}
+
+// parseTLF parses a TLF name, canonical or not.
+func (f *FS) parseTLF(ctx context.Context, name string, public bool) (
+	*libkbfs.TlfHandle, error) {
+	h, err := libkbfs.ParseTlfHandle(ctx, f.config.KBPKI(), name, public)
+	if nc, ok := err.(libkbfs.TlfNameNotCanonical); ok {
+		h, err = libkbfs.ParseTlfHandle(
+			ctx, f.config.KBPKI(), nc.NameToTry, public)
+	}
+	return h, err
+}
+
+// kbfsNode returns the libkbfs.Node for n, which must be of
+// kbfsKind, loading the TLF if n is the root of one that hasn't been
+// used yet.
+func (f *FS) kbfsNode(ctx context.Context, n *fsNode) (libkbfs.Node, error) {
+	if n.kind != kbfsKind {
+		return nil, nfs3ErrAcces
+	}
+	if node := f.handles.nodeOf(n); node != nil {
+		return node, nil
+	}
+	h, err := f.parseTLF(ctx, string(n.tlfName), n.public)
+	if err != nil {
+		return nil, err
+	}
+	node, _, err := f.config.KBFSOps().GetOrCreateRootNode(
+		ctx, h, libkbfs.MasterBranch)
+	if err != nil {
+		return nil, err
+	}
+	return f.handles.setNode(n, node), nil
+}
+
+// lookup returns the node called name in the directory dir.
+func (f *FS) lookup(ctx context.Context, dir *fsNode, name string) (
+	*fsNode, error) {
+	switch name {
+	case ".":
+		return dir, nil
+	case "..":
+		// Clients can't get out of the export.
+		if f.isExportRoot(dir) {
+			return dir, nil
+		}
+		parent := f.handles.parentOf(dir)
+		if parent == nil {
+			return nil, nfs3ErrStale
+		}
+		return parent, nil
+	}
+	return f.lookupChild(ctx, dir, name)
+}
+
+func (f *FS) lookupChild(ctx context.Context, dir *fsNode, name string) (
+	*fsNode, error) {
+	switch dir.kind {
+	case rootKind:
+		switch name {
+		case PrivateName:
+			return f.handles.get(privateNodeID), nil
+		case PublicName:
+			return f.handles.get(publicNodeID), nil
+		}
+		return nil, nfs3ErrNoEnt
+	case folderListKind:
+		h, err := f.parseTLF(ctx, name, dir.public)
+		if err != nil {
+			return nil, err
+		}
+		return f.handles.getOrAddTLF(dir, h.GetCanonicalName()), nil
+	}
+
+	node, err := f.kbfsNode(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	child, _, err := f.config.KBFSOps().Lookup(ctx, node, name)
+	if err != nil {
+		return nil, err
+	}
+	return f.handles.getOrAdd(child, dir), nil
+}
+
+func (f *FS) isDir(ctx context.Context, n *fsNode) (bool, error) {
+	if n.kind != kbfsKind {
+		return true, nil
+	}
+	node, err := f.kbfsNode(ctx, n)
+	if err != nil {
+		return false, err
+	}
+	ei, err := f.config.KBFSOps().Stat(ctx, node)
+	if err != nil {
+		return false, err
+	}
+	return ei.Type == libkbfs.Dir, nil
+}
+
+// dirEntry is an entry of a directory listing.
+type dirEntry struct {
+	name string
+	node *fsNode
+}
+
+type dirEntriesByName []dirEntry
+
+func (d dirEntriesByName) Len() int           { return len(d) }
+func (d dirEntriesByName) Less(i, j int) bool { return d[i].name < d[j].name }
+func (d dirEntriesByName) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// readDir lists the directory dir, sorted by name so that READDIR
+// cookies can be indexes into it.
+func (f *FS) readDir(ctx context.Context, dir *fsNode) ([]dirEntry, error) {
+	var entries []dirEntry
+	switch dir.kind {
+	case rootKind:
+		entries = []dirEntry{
+			{PrivateName, f.handles.get(privateNodeID)},
+			{PublicName, f.handles.get(publicNodeID)},
+		}
+	case folderListKind:
+		if _, _, err := f.config.KBPKI().GetCurrentUserInfo(ctx); err != nil {
+			// Logged out, so there are no favorites.
+			return nil, nil
+		}
+		favs, err := f.config.KBFSOps().GetFavorites(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, fav := range favs {
+			if fav.Public != dir.public {
+				continue
+			}
+			entries = append(entries, dirEntry{fav.Name,
+				f.handles.getOrAddTLF(
+					dir, libkbfs.CanonicalTlfName(fav.Name))})
+		}
+	case kbfsKind:
+		node, err := f.kbfsNode(ctx, dir)
+		if err != nil {
+			return nil, err
+		}
+		children, err := f.config.KBFSOps().GetDirChildren(ctx, node)
+		if err != nil {
+			return nil, err
+		}
+		for name := range children {
+			child, _, err := f.config.KBFSOps().Lookup(ctx, node, name)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries,
+				dirEntry{name, f.handles.getOrAdd(child, dir)})
+		}
+	}
+	sort.Sort(dirEntriesByName(entries))
+	return entries, nil
+}
+
+// attr returns the attributes of n, as seen by a client calling as
+// cred.
+func (f *FS) attr(ctx context.Context, n *fsNode, cred rpcCred) (
+	a fattr3, err error) {
+	a.fileID = n.id
+	a.uid = cred.uid
+	a.gid = cred.gid
+	if n.kind != kbfsKind {
+		a.ftype = nf3Dir
+		a.mode = 0755
+		a.nlink = 2
+		a.atime, a.mtime, a.ctime = f.startTime, f.startTime, f.startTime
+		return a, nil
+	}
+
+	node, err := f.kbfsNode(ctx, n)
+	if err != nil {
+		return fattr3{}, err
+	}
+	kbfsOps := f.config.KBFSOps()
+	ei, err := kbfsOps.Stat(ctx, node)
+	if err != nil {
+		if _, ok := err.(libkbfs.NoSuchNameError); ok {
+			return fattr3{}, nfs3ErrStale
+		}
+		return fattr3{}, err
+	}
+
+	a.mode = uint32(ei.PosixMode(n.public).Perm())
+	a.size = ei.Size
+	a.used = ei.Size
+	a.mtime = time.Unix(0, ei.Mtime)
+	a.atime = a.mtime
+	a.ctime = time.Unix(0, ei.Ctime)
+	if uid, gid, ok := libkbfs.PosixOwnerForCurrentUser(
+		ctx, f.config, ei); ok {
+		if uid >= 0 {
+			a.uid = uint32(uid)
+		}
+		if gid >= 0 {
+			a.gid = uint32(gid)
+		}
+	}
+	switch ei.Type {
+	case libkbfs.Dir:
+		a.ftype = nf3Dir
+		a.nlink = 2
+	case libkbfs.Sym:
+		a.ftype = nf3Lnk
+		a.nlink = 1
+	default:
+		a.ftype = nf3Reg
+		a.nlink = ei.LinkCount()
+		// Holes don't count towards the space a file uses.
+		used, err := kbfsOps.GetAllocatedSize(ctx, node)
+		if err != nil {
+			return fattr3{}, err
+		}
+		a.used = used
+	}
+	return a, nil
+}
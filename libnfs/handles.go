@@ -0,0 +1,318 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libnfs
+
+import (
+	"container/list"
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+// nodeKind says which part of the namespace an fsNode is in.
+type nodeKind int
+
+const (
+	// rootKind is the root of KBFS, containing "private" and
+	// "public".
+	rootKind nodeKind = iota
+	// folderListKind lists the user's private or public favorite
+	// TLFs.
+	folderListKind
+	// kbfsKind is a file, directory or symlink in a TLF, including
+	// the root directory of the TLF.
+	kbfsKind
+)
+
+// fsNode is what an NFS file handle refers to.
+type fsNode struct {
+	id     uint64
+	kind   nodeKind
+	public bool
+	// node is set for kbfsKind once it's known; see
+	// handleTable.getOrAddTLF.
+	node libkbfs.Node
+	// tlfName is set for the root of a TLF.
+	tlfName libkbfs.CanonicalTlfName
+	// parent is the ID of the directory this node was last found
+	// in.  It's only meaningful for directories, which can't have
+	// more than one parent.
+	parent uint64
+	// exported is true if this node is within the export, and so
+	// may be used by clients.
+	exported bool
+	// lru is this node's element of handleTable.lru, or nil if the
+	// node is never evicted.
+	lru *list.Element
+}
+
+const (
+	rootNodeID    uint64 = 1
+	privateNodeID uint64 = 2
+	publicNodeID  uint64 = 3
+	firstKBFSID   uint64 = 4
+
+	// fileHandleSize is the size of the handles this server makes:
+	// the table verifier, then the node ID.
+	fileHandleSize = 16
+	// maxFileHandleSize is the largest handle NFSv3 allows.
+	maxFileHandleSize = 64
+
+	// maxEvictableNodes is the default number of nodes a handleTable
+	// keeps, besides the ones that are never evicted.
+	maxEvictableNodes = 100000
+)
+
+// handleTable maps NFS file handles to the nodes they refer to.
+//
+// The table keeps the libkbfs.Node of each node it has handed a
+// handle out for.  That keeps the node in the node cache of its TLF,
+// which keeps its NodeID stable across renames and changes made by
+// other devices, so a node keeps the same handle (and file ID) while
+// it's in the table.
+//
+// NFS clients can hold on to a handle indefinitely, though, so the
+// table only keeps the maxNodes most recently used nodes, besides the
+// fixed ones and the root of the export.  An evicted node's handle is
+// stale from then on, and a client that looks the node up again gets
+// a new one.  Using a node counts as using the directories it's in,
+// so that a directory is only evicted after everything in it.
+type handleTable struct {
+	// verifier is chosen at random when the server starts, so that
+	// handles from an earlier run are detected as stale instead of
+	// referring to whichever node got the same ID this time.
+	verifier uint64
+	maxNodes int
+
+	lock     sync.Mutex
+	nextID   uint64
+	byID     map[uint64]*fsNode
+	byNodeID map[libkbfs.NodeID]*fsNode
+	byTLF    map[tlfKey]*fsNode
+	// lru holds the evictable nodes, the most recently used first.
+	lru *list.List
+}
+
+type tlfKey struct {
+	public bool
+	name   libkbfs.CanonicalTlfName
+}
+
+func newHandleTable(wholeKBFSExported bool) (*handleTable, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	t := &handleTable{
+		verifier: binary.BigEndian.Uint64(b[:]),
+		maxNodes: maxEvictableNodes,
+		nextID:   firstKBFSID,
+		byID:     make(map[uint64]*fsNode),
+		byNodeID: make(map[libkbfs.NodeID]*fsNode),
+		byTLF:    make(map[tlfKey]*fsNode),
+		lru:      list.New(),
+	}
+	t.byID[rootNodeID] = &fsNode{id: rootNodeID, kind: rootKind,
+		parent: rootNodeID, exported: wholeKBFSExported}
+	t.byID[privateNodeID] = &fsNode{id: privateNodeID,
+		kind: folderListKind, parent: rootNodeID,
+		exported: wholeKBFSExported}
+	t.byID[publicNodeID] = &fsNode{id: publicNodeID, kind: folderListKind,
+		public: true, parent: rootNodeID, exported: wholeKBFSExported}
+	return t, nil
+}
+
+// encode returns the file handle for n.
+func (t *handleTable) encode(n *fsNode) []byte {
+	fh := make([]byte, fileHandleSize)
+	binary.BigEndian.PutUint64(fh, t.verifier)
+	binary.BigEndian.PutUint64(fh[8:], n.id)
+	return fh
+}
+
+// decode returns the exported node a file handle refers to.
+func (t *handleTable) decode(fh []byte) (*fsNode, error) {
+	if len(fh) != fileHandleSize {
+		return nil, nfs3ErrBadHandle
+	}
+	if binary.BigEndian.Uint64(fh) != t.verifier {
+		return nil, nfs3ErrStale
+	}
+	n := t.get(binary.BigEndian.Uint64(fh[8:]))
+	if n == nil || !t.isExported(n) {
+		return nil, nfs3ErrStale
+	}
+	return n, nil
+}
+
+func (t *handleTable) get(id uint64) *fsNode {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	n := t.byID[id]
+	if n != nil {
+		t.touchLocked(n)
+	}
+	return n
+}
+
+// touchLocked marks n, and the directories it's in, as the most
+// recently used nodes.
+func (t *handleTable) touchLocked(n *fsNode) {
+	// The bound only guards against a cycle of parents.
+	for i := 0; n != nil && i <= len(t.byID); i++ {
+		if n.lru != nil {
+			t.lru.MoveToFront(n.lru)
+		}
+		if n.parent == n.id {
+			return
+		}
+		n = t.byID[n.parent]
+	}
+}
+
+// addLocked adds the new node n, evicting the least recently used
+// nodes if there are too many.
+func (t *handleTable) addLocked(n *fsNode) {
+	t.byID[n.id] = n
+	n.lru = t.lru.PushFront(n)
+	t.touchLocked(n)
+	for t.lru.Len() > t.maxNodes {
+		t.evictLocked(t.lru.Back().Value.(*fsNode))
+	}
+}
+
+func (t *handleTable) evictLocked(n *fsNode) {
+	t.lru.Remove(n.lru)
+	n.lru = nil
+	delete(t.byID, n.id)
+	if n.node != nil && t.byNodeID[n.node.GetID()] == n {
+		delete(t.byNodeID, n.node.GetID())
+	}
+	key := tlfKey{n.public, n.tlfName}
+	if n.tlfName != "" && t.byTLF[key] == n {
+		delete(t.byTLF, key)
+	}
+}
+
+// getOrAdd returns the fsNode for node, which was found in parent,
+// adding one if needed.
+func (t *handleTable) getOrAdd(node libkbfs.Node, parent *fsNode) *fsNode {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if n, ok := t.byNodeID[node.GetID()]; ok {
+		n.parent = parent.id
+		n.exported = n.exported || parent.exported
+		t.touchLocked(n)
+		return n
+	}
+	n := &fsNode{
+		id:       t.nextID,
+		kind:     kbfsKind,
+		public:   parent.public,
+		node:     node,
+		parent:   parent.id,
+		exported: parent.exported,
+	}
+	t.nextID++
+	t.byNodeID[node.GetID()] = n
+	t.addLocked(n)
+	return n
+}
+
+// getOrAddTLF returns the fsNode for the root of the TLF called
+// name in the folder list list, adding one if needed.  A new one
+// doesn't have a libkbfs.Node until it's used, so that listing the
+// favorites doesn't have to load every TLF.
+func (t *handleTable) getOrAddTLF(
+	list *fsNode, name libkbfs.CanonicalTlfName) *fsNode {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	key := tlfKey{list.public, name}
+	if n, ok := t.byTLF[key]; ok {
+		n.exported = n.exported || list.exported
+		t.touchLocked(n)
+		return n
+	}
+	n := &fsNode{
+		id:       t.nextID,
+		kind:     kbfsKind,
+		public:   list.public,
+		tlfName:  name,
+		parent:   list.id,
+		exported: list.exported,
+	}
+	t.nextID++
+	t.byTLF[key] = n
+	t.addLocked(n)
+	return n
+}
+
+// nodeOf returns the libkbfs.Node of n, or nil if it isn't known
+// yet.
+func (t *handleTable) nodeOf(n *fsNode) libkbfs.Node {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return n.node
+}
+
+// setNode records node as the libkbfs.Node of the TLF root n, and
+// returns whichever node n ends up with.
+func (t *handleTable) setNode(n *fsNode, node libkbfs.Node) libkbfs.Node {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if n.node != nil {
+		return n.node
+	}
+	n.node = node
+	// Don't let a TLF root that was evicted meanwhile come back.
+	if t.byID[n.id] == n {
+		t.byNodeID[node.GetID()] = n
+	}
+	return node
+}
+
+// setExported marks n, the root of the export, as exported, and
+// makes sure it's never evicted.
+func (t *handleTable) setExported(n *fsNode) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	n.exported = true
+	if n.lru != nil {
+		t.lru.Remove(n.lru)
+		n.lru = nil
+	} else if t.byID[n.id] != n {
+		// It was evicted since it was looked up.
+		t.byID[n.id] = n
+		if n.node != nil {
+			t.byNodeID[n.node.GetID()] = n
+		}
+		if n.tlfName != "" {
+			t.byTLF[tlfKey{n.public, n.tlfName}] = n
+		}
+	}
+}
+
+// isExported returns whether n is within the export.
+func (t *handleTable) isExported(n *fsNode) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return n.exported
+}
+
+// parentOf returns the node n was last found in.
+func (t *handleTable) parentOf(n *fsNode) *fsNode {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.byID[n.parent]
+}
+
+// moved records that n is now in the directory newParent.
+func (t *handleTable) moved(n *fsNode, newParent *fsNode) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	n.parent = newParent.id
+}
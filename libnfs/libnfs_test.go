@@ -0,0 +1,202 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libnfs
+
+import (
+	"net"
+	"testing"
+)
+
+func TestXDRRoundTrip(t *testing.T) {
+	w := &xdrWriter{}
+	w.uint32(7)
+	w.uint64(1 << 40)
+	w.bool(true)
+	w.string("hello")
+	w.opaque([]byte{1, 2, 3, 4})
+	if len(w.bytes())%4 != 0 {
+		t.Fatalf("Unaligned encoding of %d bytes", len(w.bytes()))
+	}
+
+	r := &xdrReader{buf: w.bytes()}
+	if v := r.uint32(); v != 7 {
+		t.Errorf("uint32: got %d", v)
+	}
+	if v := r.uint64(); v != 1<<40 {
+		t.Errorf("uint64: got %d", v)
+	}
+	if !r.bool() {
+		t.Errorf("bool: got false")
+	}
+	if s := r.string(16); s != "hello" {
+		t.Errorf("string: got %q", s)
+	}
+	if b := r.opaque(16); len(b) != 4 || b[3] != 4 {
+		t.Errorf("opaque: got %v", b)
+	}
+	if r.err != nil {
+		t.Fatalf("Unexpected error: %v", r.err)
+	}
+
+	r.uint32()
+	if r.err != errXDRShort {
+		t.Errorf("Expected errXDRShort, got %v", r.err)
+	}
+}
+
+func TestXDRTooLong(t *testing.T) {
+	w := &xdrWriter{}
+	w.string("too long")
+	r := &xdrReader{buf: w.bytes()}
+	r.string(4)
+	if r.err != errXDRTooLong {
+		t.Errorf("Expected errXDRTooLong, got %v", r.err)
+	}
+}
+
+func TestHandleTableDecode(t *testing.T) {
+	h, err := newHandleTable(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := h.get(rootNodeID)
+	if _, err := h.decode(h.encode(root)); err != nfs3ErrStale {
+		t.Errorf("Unexported node: expected stale, got %v", err)
+	}
+
+	private := h.get(privateNodeID)
+	h.setExported(private)
+	tlf := h.getOrAddTLF(private, "alice")
+	if h.getOrAddTLF(private, "alice") != tlf {
+		t.Errorf("TLF got a second node")
+	}
+	n, err := h.decode(h.encode(tlf))
+	if err != nil || n != tlf {
+		t.Errorf("Got %v, %v decoding a TLF handle", n, err)
+	}
+	if h.parentOf(tlf) != private {
+		t.Errorf("Wrong parent for the TLF")
+	}
+
+	if _, err := h.decode([]byte{1, 2, 3}); err != nfs3ErrBadHandle {
+		t.Errorf("Short handle: expected bad handle, got %v", err)
+	}
+	fh := h.encode(tlf)
+	fh[0]++
+	if _, err := h.decode(fh); err != nfs3ErrStale {
+		t.Errorf("Wrong verifier: expected stale, got %v", err)
+	}
+}
+
+func TestHandleTableEviction(t *testing.T) {
+	h, err := newHandleTable(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.maxNodes = 2
+	private := h.get(privateNodeID)
+	alice := h.getOrAddTLF(private, "alice")
+	bob := h.getOrAddTLF(private, "bob")
+	aliceHandle := h.encode(alice)
+
+	// Using alice makes bob the least recently used.
+	if _, err := h.decode(aliceHandle); err != nil {
+		t.Fatal(err)
+	}
+	h.getOrAddTLF(private, "charlie")
+	if _, err := h.decode(h.encode(bob)); err != nfs3ErrStale {
+		t.Errorf("Evicted node: expected stale, got %v", err)
+	}
+	if h.getOrAddTLF(private, "bob") == bob {
+		t.Errorf("Evicted node came back")
+	}
+	if _, err := h.decode(aliceHandle); err != nfs3ErrStale {
+		t.Errorf("Evicted node: expected stale, got %v", err)
+	}
+	if h.get(rootNodeID) == nil || h.get(privateNodeID) == nil {
+		t.Errorf("Fixed node evicted")
+	}
+
+	// The root of the export is never evicted.
+	dave := h.getOrAddTLF(private, "dave")
+	h.setExported(dave)
+	h.getOrAddTLF(private, "eve")
+	h.getOrAddTLF(private, "frank")
+	if _, err := h.decode(h.encode(dave)); err != nil {
+		t.Errorf("Export root evicted: %v", err)
+	}
+}
+
+func TestExportAuthorized(t *testing.T) {
+	o := ExportOptions{OwnerUID: 1000}
+	privileged := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 800}
+	unprivileged := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000}
+	owner := rpcCred{uid: 1000}
+	root := rpcCred{uid: 0}
+	other := rpcCred{uid: 1001}
+	for _, c := range []struct {
+		addr     net.Addr
+		prog     uint32
+		proc     uint32
+		cred     rpcCred
+		expected bool
+	}{
+		{privileged, nfsProgram, nfsProcRead, owner, true},
+		{unprivileged, nfsProgram, nfsProcRead, owner, false},
+		{privileged, nfsProgram, nfsProcRead, other, false},
+		{privileged, nfsProgram, nfsProcRead, root, false},
+		{privileged, nfsProgram, nfsProcFsinfo, root, true},
+		{privileged, mountProgram, mountProcMnt, root, true},
+		{unprivileged, mountProgram, mountProcMnt, root, false},
+	} {
+		if o.authorized(c.addr, c.prog, c.proc, c.cred) != c.expected {
+			t.Errorf("%+v: expected authorized=%t", c, c.expected)
+		}
+	}
+
+	o.Secret = "s3cret"
+	if !o.authorized(unprivileged, nfsProgram, nfsProcRead,
+		rpcCred{machine: "s3cret", uid: 1000}) {
+		t.Errorf("Secret refused")
+	}
+	if o.authorized(unprivileged, nfsProgram, nfsProcRead,
+		rpcCred{machine: "guess", uid: 1000}) {
+		t.Errorf("Wrong secret allowed")
+	}
+	if o.authorized(unprivileged, nfsProgram, nfsProcRead,
+		rpcCred{machine: "s3cret", uid: 1001}) {
+		t.Errorf("Secret allowed the wrong uid")
+	}
+}
+
+func TestExportAllowed(t *testing.T) {
+	var o ExportOptions
+	if !o.allowed(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")}) {
+		t.Errorf("Loopback refused by default")
+	}
+	if o.allowed(&net.TCPAddr{IP: net.ParseIP("10.0.0.1")}) {
+		t.Errorf("Remote address allowed by default")
+	}
+
+	networks, err := ParseAllowedNetworks("10.0.0.0/8, 192.168.1.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.AllowedNetworks = networks
+	for addr, expected := range map[string]bool{
+		"10.1.2.3":    true,
+		"192.168.1.5": true,
+		"192.168.1.6": false,
+		"127.0.0.1":   false,
+	} {
+		if o.allowed(&net.TCPAddr{IP: net.ParseIP(addr)}) != expected {
+			t.Errorf("Address %s: expected allowed=%t", addr, expected)
+		}
+	}
+
+	if _, err := ParseAllowedNetworks("not-an-ip"); err == nil {
+		t.Errorf("Bad network parsed")
+	}
+}
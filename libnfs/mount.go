@@ -0,0 +1,131 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libnfs
+
+import (
+	"strings"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// MOUNT v3 (RFC 1813 appendix I) constants.
+const (
+	mountProgram = 100005
+	mountVersion = 3
+
+	mountProcNull    = 0
+	mountProcMnt     = 1
+	mountProcDump    = 2
+	mountProcUmnt    = 3
+	mountProcUmntAll = 4
+	mountProcExport  = 5
+
+	mountPathLen = 1024
+)
+
+// mountServer implements the MOUNT program, which hands clients the
+// file handle of the directory they mount.
+type mountServer struct {
+	fs *FS
+}
+
+var _ rpcProgram = mountServer{}
+
+func (s mountServer) handle(ctx context.Context, call *rpcCall,
+	w *xdrWriter) error {
+	switch call.proc {
+	case mountProcNull:
+		return nil
+	case mountProcMnt:
+		dirPath := call.args.string(mountPathLen)
+		if call.args.err != nil {
+			return errGarbageArgs
+		}
+		n, err := s.mount(ctx, dirPath)
+		s.fs.reportErr(ctx, libkbfs.ReadMode, err)
+		w.uint32(uint32(errToStatus(err)))
+		if err == nil {
+			w.opaque(s.fs.handles.encode(n))
+			w.uint32(1)
+			w.uint32(authUnix)
+		}
+		return nil
+	case mountProcDump:
+		// Mounts aren't tracked, since NFSv3 doesn't need them.
+		w.bool(false)
+		return nil
+	case mountProcUmnt:
+		call.args.string(mountPathLen)
+		if call.args.err != nil {
+			return errGarbageArgs
+		}
+		return nil
+	case mountProcUmntAll:
+		return nil
+	case mountProcExport:
+		w.bool(true)
+		w.string("/")
+		w.bool(false) // no groups
+		w.bool(false)
+		return nil
+	}
+	return errProcUnavail
+}
+
+// mount returns the directory at dirPath, relative to the export
+// root.  Clients may also name the export root by its path in KBFS.
+func (s mountServer) mount(ctx context.Context, dirPath string) (
+	*fsNode, error) {
+	n, err := s.fs.getExportRoot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	components := strings.Split(dirPath, "/")
+	subdir := s.fs.options.subdirComponents()
+	if hasPrefix(nonEmpty(components), subdir) {
+		components = nonEmpty(components)[len(subdir):]
+	}
+	for _, name := range components {
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			return nil, nfs3ErrAcces
+		}
+		n, err = s.fs.lookupChild(ctx, n, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if isDir, err := s.fs.isDir(ctx, n); err != nil {
+		return nil, err
+	} else if !isDir {
+		return nil, nfs3ErrNotDir
+	}
+	return n, nil
+}
+
+func nonEmpty(components []string) []string {
+	var result []string
+	for _, c := range components {
+		if c != "" {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+func hasPrefix(components, prefix []string) bool {
+	if len(prefix) == 0 || len(components) < len(prefix) {
+		return false
+	}
+	for i, c := range prefix {
+		if components[i] != c {
+			return false
+		}
+	}
+	return true
+}
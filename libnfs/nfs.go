@@ -0,0 +1,1048 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libnfs
+
+import (
+	"encoding/binary"
+	"math"
+	"os"
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// NFSv3 (RFC 1813) constants.
+const (
+	nfsProgram = 100003
+	nfsVersion = 3
+
+	nfsProcNull        = 0
+	nfsProcGetattr     = 1
+	nfsProcSetattr     = 2
+	nfsProcLookup      = 3
+	nfsProcAccess      = 4
+	nfsProcReadlink    = 5
+	nfsProcRead        = 6
+	nfsProcWrite       = 7
+	nfsProcCreate      = 8
+	nfsProcMkdir       = 9
+	nfsProcSymlink     = 10
+	nfsProcMknod       = 11
+	nfsProcRemove      = 12
+	nfsProcRmdir       = 13
+	nfsProcRename      = 14
+	nfsProcLink        = 15
+	nfsProcReaddir     = 16
+	nfsProcReaddirplus = 17
+	nfsProcFsstat      = 18
+	nfsProcFsinfo      = 19
+	nfsProcPathconf    = 20
+	nfsProcCommit      = 21
+
+	nf3Reg = 1
+	nf3Dir = 2
+	nf3Lnk = 5
+
+	access3Read    = 0x01
+	access3Lookup  = 0x02
+	access3Modify  = 0x04
+	access3Extend  = 0x08
+	access3Delete  = 0x10
+	access3Execute = 0x20
+
+	writeUnstable = 0
+	writeFileSync = 2
+
+	createUnchecked = 0
+	createGuarded   = 1
+	createExclusive = 2
+
+	timeDontChange     = 0
+	timeSetToServer    = 1
+	timeSetToClientArg = 2
+
+	fsf3Link        = 0x01
+	fsf3Symlink     = 0x02
+	fsf3Homogeneous = 0x08
+	fsf3CanSetTime  = 0x10
+
+	// maxIOSize is the most data a READ or WRITE moves.
+	maxIOSize = 1024 * 1024
+	// maxNameSize and maxPathSize bound the names and symlink
+	// targets in calls.
+	maxNameSize = 1024
+	maxPathSize = 4096
+	// nfsFsid identifies KBFS as a file system to clients.
+	nfsFsid = 0x6b626673 // "kbfs"
+)
+
+// fattr3 holds the attributes of a file, as sent to clients.
+type fattr3 struct {
+	ftype  uint32
+	mode   uint32
+	nlink  uint32
+	uid    uint32
+	gid    uint32
+	size   uint64
+	used   uint64
+	fileID uint64
+	atime  time.Time
+	mtime  time.Time
+	ctime  time.Time
+}
+
+func writeTime(w *xdrWriter, t time.Time) {
+	w.uint32(uint32(t.Unix()))
+	w.uint32(uint32(t.Nanosecond()))
+}
+
+func readTime(r *xdrReader) time.Time {
+	sec := r.uint32()
+	nsec := r.uint32()
+	return time.Unix(int64(sec), int64(nsec))
+}
+
+func (a fattr3) encode(w *xdrWriter) {
+	w.uint32(a.ftype)
+	w.uint32(a.mode)
+	w.uint32(a.nlink)
+	w.uint32(a.uid)
+	w.uint32(a.gid)
+	w.uint64(a.size)
+	w.uint64(a.used)
+	w.uint32(0) // rdev
+	w.uint32(0)
+	w.uint64(nfsFsid)
+	w.uint64(a.fileID)
+	writeTime(w, a.atime)
+	writeTime(w, a.mtime)
+	writeTime(w, a.ctime)
+}
+
+// sattr3 holds the attributes a client wants to set; nil fields
+// aren't changed.
+type sattr3 struct {
+	mode  *uint32
+	uid   *uint32
+	gid   *uint32
+	size  *uint64
+	mtime *time.Time
+}
+
+func readSattr(r *xdrReader) (s sattr3) {
+	if r.bool() {
+		mode := r.uint32()
+		s.mode = &mode
+	}
+	if r.bool() {
+		uid := r.uint32()
+		s.uid = &uid
+	}
+	if r.bool() {
+		gid := r.uint32()
+		s.gid = &gid
+	}
+	if r.bool() {
+		size := r.uint64()
+		s.size = &size
+	}
+	// KBFS doesn't keep access times.
+	if r.uint32() == timeSetToClientArg {
+		readTime(r)
+	}
+	switch r.uint32() {
+	case timeSetToServer:
+		now := time.Now()
+		s.mtime = &now
+	case timeSetToClientArg:
+		mtime := readTime(r)
+		s.mtime = &mtime
+	}
+	return s
+}
+
+// nfsServer implements the NFSv3 program on top of an FS.
+type nfsServer struct {
+	fs *FS
+}
+
+var _ rpcProgram = nfsServer{}
+
+// postOpAttr encodes the attributes of n if they can be had, as
+// NFS replies may but don't have to include them.
+func (s nfsServer) postOpAttr(ctx context.Context, w *xdrWriter,
+	n *fsNode, cred rpcCred) {
+	if n == nil {
+		w.bool(false)
+		return
+	}
+	a, err := s.fs.attr(ctx, n, cred)
+	if err != nil {
+		w.bool(false)
+		return
+	}
+	w.bool(true)
+	a.encode(w)
+}
+
+// wccData encodes the weak cache consistency data for n.  There's no
+// way to get the attributes from before an operation atomically, so
+// it only has the ones from after.
+func (s nfsServer) wccData(ctx context.Context, w *xdrWriter, n *fsNode,
+	cred rpcCred) {
+	w.bool(false)
+	s.postOpAttr(ctx, w, n, cred)
+}
+
+func (s nfsServer) readHandle(r *xdrReader) (*fsNode, error) {
+	fh := r.opaque(maxFileHandleSize)
+	if r.err != nil {
+		return nil, errGarbageArgs
+	}
+	return s.fs.handles.decode(fh)
+}
+
+// checkWritable returns an error if the export doesn't allow changes.
+func (s nfsServer) checkWritable() error {
+	if s.fs.options.ReadOnly {
+		return nfs3ErrROFS
+	}
+	return nil
+}
+
+func (s nfsServer) handle(ctx context.Context, call *rpcCall,
+	w *xdrWriter) error {
+	if call.proc == nfsProcNull {
+		return nil
+	}
+	// Make sure the export root exists before any of its handles
+	// are used.
+	if _, err := s.fs.getExportRoot(ctx); err != nil {
+		s.fs.reportErr(ctx, libkbfs.ReadMode, err)
+		w.uint32(uint32(errToStatus(err)))
+		return nil
+	}
+
+	var proc func(context.Context, *rpcCall, *xdrWriter) error
+	mode := libkbfs.WriteMode
+	switch call.proc {
+	case nfsProcGetattr:
+		proc, mode = s.getattr, libkbfs.ReadMode
+	case nfsProcSetattr:
+		proc = s.setattr
+	case nfsProcLookup:
+		proc, mode = s.lookup, libkbfs.ReadMode
+	case nfsProcAccess:
+		proc, mode = s.access, libkbfs.ReadMode
+	case nfsProcReadlink:
+		proc, mode = s.readlink, libkbfs.ReadMode
+	case nfsProcRead:
+		proc, mode = s.read, libkbfs.ReadMode
+	case nfsProcWrite:
+		proc = s.write
+	case nfsProcCreate:
+		proc = s.create
+	case nfsProcMkdir:
+		proc = s.mkdir
+	case nfsProcSymlink:
+		proc = s.symlink
+	case nfsProcMknod:
+		proc = s.mknod
+	case nfsProcRemove:
+		proc = s.remove
+	case nfsProcRmdir:
+		proc = s.rmdir
+	case nfsProcRename:
+		proc = s.rename
+	case nfsProcLink:
+		proc = s.link
+	case nfsProcReaddir:
+		proc, mode = s.readdir, libkbfs.ReadMode
+	case nfsProcReaddirplus:
+		proc, mode = s.readdirplus, libkbfs.ReadMode
+	case nfsProcFsstat:
+		proc, mode = s.fsstat, libkbfs.ReadMode
+	case nfsProcFsinfo:
+		proc, mode = s.fsinfo, libkbfs.ReadMode
+	case nfsProcPathconf:
+		proc, mode = s.pathconf, libkbfs.ReadMode
+	case nfsProcCommit:
+		proc = s.commit
+	default:
+		return errProcUnavail
+	}
+	err := proc(ctx, call, w)
+	if err == errGarbageArgs {
+		return err
+	}
+	s.fs.reportErr(ctx, mode, err)
+	return nil
+}
+
+// Each of the procedures below decodes its arguments, and encodes
+// its results, whether or not it succeeds.  The error it returns is
+// just for reporting, except for errGarbageArgs.
+
+func (s nfsServer) getattr(ctx context.Context, call *rpcCall,
+	w *xdrWriter) error {
+	n, err := s.readHandle(call.args)
+	if err == errGarbageArgs {
+		return err
+	}
+	var a fattr3
+	if err == nil {
+		a, err = s.fs.attr(ctx, n, call.cred)
+	}
+	w.uint32(uint32(errToStatus(err)))
+	if err == nil {
+		a.encode(w)
+	}
+	return err
+}
+
+// setAttrs applies the changes in sa to n.
+func (s nfsServer) setAttrs(ctx context.Context, n *fsNode,
+	sa sattr3) error {
+	if sa.mode == nil && sa.uid == nil && sa.gid == nil &&
+		sa.size == nil && sa.mtime == nil {
+		return nil
+	}
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+	node, err := s.fs.kbfsNode(ctx, n)
+	if err != nil {
+		return err
+	}
+	kbfsOps := s.fs.config.KBFSOps()
+	if sa.size != nil {
+		if err := kbfsOps.Truncate(ctx, node, *sa.size); err != nil {
+			return err
+		}
+	}
+	if sa.mode != nil {
+		err := kbfsOps.SetMode(ctx, node, os.FileMode(*sa.mode&07777))
+		if err != nil {
+			return err
+		}
+	}
+	if sa.uid != nil || sa.gid != nil {
+		uid, gid := -1, -1
+		if sa.uid != nil {
+			uid = int(*sa.uid)
+		}
+		if sa.gid != nil {
+			gid = int(*sa.gid)
+		}
+		if err := kbfsOps.SetOwner(ctx, node, uid, gid); err != nil {
+			return err
+		}
+	}
+	if sa.mtime != nil {
+		if err := kbfsOps.SetMtime(ctx, node, sa.mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s nfsServer) setattr(ctx context.Context, call *rpcCall,
+	w *xdrWriter) error {
+	n, err := s.readHandle(call.args)
+	sa := readSattr(call.args)
+	var guard *time.Time
+	if call.args.bool() {
+		ctime := readTime(call.args)
+		guard = &ctime
+	}
+	if call.args.err != nil || err == errGarbageArgs {
+		return errGarbageArgs
+	}
+
+	if err == nil && guard != nil {
+		var a fattr3
+		a, err = s.fs.attr(ctx, n, call.cred)
+		if err == nil && (a.ctime.Unix() != guard.Unix() ||
+			a.ctime.Nanosecond() != guard.Nanosecond()) {
+			err = nfs3ErrNotSync
+		}
+	}
+	if err == nil {
+		err = s.setAttrs(ctx, n, sa)
+	}
+	w.uint32(uint32(errToStatus(err)))
+	s.wccData(ctx, w, n, call.cred)
+	return err
+}
+
+func (s nfsServer) readDirOp(r *xdrReader) (*fsNode, string, error) {
+	dir, err := s.readHandle(r)
+	name := r.string(maxNameSize)
+	if r.err != nil || err == errGarbageArgs {
+		return nil, "", errGarbageArgs
+	}
+	return dir, name, err
+}
+
+func (s nfsServer) lookup(ctx context.Context, call *rpcCall,
+	w *xdrWriter) error {
+	dir, name, err := s.readDirOp(call.args)
+	if err == errGarbageArgs {
+		return err
+	}
+	var n *fsNode
+	if err == nil {
+		n, err = s.fs.lookup(ctx, dir, name)
+	}
+	w.uint32(uint32(errToStatus(err)))
+	if err == nil {
+		w.opaque(s.fs.handles.encode(n))
+		s.postOpAttr(ctx, w, n, call.cred)
+	}
+	s.postOpAttr(ctx, w, dir, call.cred)
+	return err
+}
+
+func (s nfsServer) access(ctx context.Context, call *rpcCall,
+	w *xdrWriter) error {
+	n, err := s.readHandle(call.args)
+	requested := call.args.uint32()
+	if call.args.err != nil || err == errGarbageArgs {
+		return errGarbageArgs
+	}
+	var a fattr3
+	if err == nil {
+		a, err = s.fs.attr(ctx, n, call.cred)
+	}
+	w.uint32(uint32(errToStatus(err)))
+	if err != nil {
+		w.bool(false)
+		return err
+	}
+	w.bool(true)
+	a.encode(w)
+
+	// KBFS itself decides who may write; this is just a hint for
+	// the client.
+	allowed := uint32(access3Read | access3Lookup)
+	if a.ftype == nf3Dir || a.mode&0111 != 0 {
+		allowed |= access3Execute
+	}
+	if !s.fs.options.ReadOnly {
+		switch n.kind {
+		case kbfsKind:
+			allowed |= access3Modify | access3Extend | access3Delete
+		case folderListKind:
+			allowed |= access3Delete
+		}
+	}
+	w.uint32(requested & allowed)
+	return nil
+}
+
+func (s nfsServer) readlink(ctx context.Context, call *rpcCall,
+	w *xdrWriter) error {
+	n, err := s.readHandle(call.args)
+	if err == errGarbageArgs {
+		return err
+	}
+	var target string
+	if err == nil {
+		var node libkbfs.Node
+		node, err = s.fs.kbfsNode(ctx, n)
+		if err == nil {
+			var ei libkbfs.EntryInfo
+			ei, err = s.fs.config.KBFSOps().Stat(ctx, node)
+			if err == nil && ei.Type != libkbfs.Sym {
+				err = nfs3ErrInval
+			}
+			target = ei.SymPath
+		}
+	}
+	w.uint32(uint32(errToStatus(err)))
+	s.postOpAttr(ctx, w, n, call.cred)
+	if err == nil {
+		w.string(target)
+	}
+	return err
+}
+
+func (s nfsServer) read(ctx context.Context, call *rpcCall,
+	w *xdrWriter) error {
+	n, err := s.readHandle(call.args)
+	off := call.args.uint64()
+	count := call.args.uint32()
+	if call.args.err != nil || err == errGarbageArgs {
+		return errGarbageArgs
+	}
+	if count > maxIOSize {
+		count = maxIOSize
+	}
+
+	var data []byte
+	eof := false
+	if err == nil {
+		var node libkbfs.Node
+		node, err = s.fs.kbfsNode(ctx, n)
+		if err == nil {
+			data = make([]byte, count)
+			var read int64
+			read, err = s.fs.config.KBFSOps().Read(
+				ctx, node, data, int64(off))
+			data = data[:read]
+		}
+	}
+	var a fattr3
+	if err == nil {
+		a, err = s.fs.attr(ctx, n, call.cred)
+		eof = off+uint64(len(data)) >= a.size
+	}
+	w.uint32(uint32(errToStatus(err)))
+	if err != nil {
+		w.bool(false)
+		return err
+	}
+	w.bool(true)
+	a.encode(w)
+	w.uint32(uint32(len(data)))
+	w.bool(eof)
+	w.opaque(data)
+	return nil
+}
+
+func (s nfsServer) write(ctx context.Context, call *rpcCall,
+	w *xdrWriter) error {
+	n, err := s.readHandle(call.args)
+	off := call.args.uint64()
+	call.args.uint32() // count, which is the same as len(data)
+	stable := call.args.uint32()
+	data := call.args.opaque(maxIOSize)
+	if call.args.err != nil || err == errGarbageArgs {
+		return errGarbageArgs
+	}
+
+	committed := uint32(writeUnstable)
+	if err == nil {
+		err = s.checkWritable()
+	}
+	if err == nil {
+		var node libkbfs.Node
+		node, err = s.fs.kbfsNode(ctx, n)
+		if err == nil {
+			err = s.fs.config.KBFSOps().Write(ctx, node, data, int64(off))
+		}
+		if err == nil && stable != writeUnstable {
+			err = s.fs.config.KBFSOps().Sync(ctx, node)
+			committed = writeFileSync
+		}
+	}
+	w.uint32(uint32(errToStatus(err)))
+	s.wccData(ctx, w, n, call.cred)
+	if err == nil {
+		w.uint32(uint32(len(data)))
+		w.uint32(committed)
+		s.writeVerifier(w)
+	}
+	return err
+}
+
+// writeVerifier encodes a value that changes whenever the server
+// restarts, so clients know to resend writes that were never
+// committed.
+func (s nfsServer) writeVerifier(w *xdrWriter) {
+	var verf [8]byte
+	binary.BigEndian.PutUint64(verf[:], s.fs.handles.verifier)
+	w.fixed(verf[:])
+}
+
+// createResult encodes the result of a call that makes a new entry
+// in dir.
+func (s nfsServer) createResult(ctx context.Context, w *xdrWriter,
+	n, dir *fsNode, cred rpcCred, err error) error {
+	w.uint32(uint32(errToStatus(err)))
+	if err == nil {
+		w.bool(true)
+		w.opaque(s.fs.handles.encode(n))
+		s.postOpAttr(ctx, w, n, cred)
+	}
+	s.wccData(ctx, w, dir, cred)
+	return err
+}
+
+// dirNode returns the libkbfs.Node of dir, checking that entries can
+// be made in it.
+func (s nfsServer) dirNode(ctx context.Context, dir *fsNode) (
+	libkbfs.Node, error) {
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+	return s.fs.kbfsNode(ctx, dir)
+}
+
+// exclusiveMtime turns the verifier of an exclusive CREATE into the
+// mtime it's stored as, so a retransmitted CREATE can be told apart
+// from one that clashes with an existing file.
+func exclusiveMtime(verf []byte) time.Time {
+	return time.Unix(int64(binary.BigEndian.Uint32(verf)),
+		int64(binary.BigEndian.Uint32(verf[4:])%1e9))
+}
+
+func (s nfsServer) create(ctx context.Context, call *rpcCall,
+	w *xdrWriter) error {
+	dir, name, err := s.readDirOp(call.args)
+	if err == errGarbageArgs {
+		return err
+	}
+	how := call.args.uint32()
+	var sa sattr3
+	var verf []byte
+	switch how {
+	case createUnchecked, createGuarded:
+		sa = readSattr(call.args)
+	case createExclusive:
+		verf = call.args.fixed(8)
+	default:
+		return errGarbageArgs
+	}
+	if call.args.err != nil {
+		return errGarbageArgs
+	}
+
+	var n *fsNode
+	if err == nil {
+		n, err = s.createFile(ctx, dir, name, how, sa, verf)
+	}
+	return s.createResult(ctx, w, n, dir, call.cred, err)
+}
+
+func (s nfsServer) createFile(ctx context.Context, dir *fsNode,
+	name string, how uint32, sa sattr3, verf []byte) (*fsNode, error) {
+	dirNode, err := s.dirNode(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	kbfsOps := s.fs.config.KBFSOps()
+
+	if how != createGuarded {
+		node, ei, err := kbfsOps.Lookup(ctx, dirNode, name)
+		switch err.(type) {
+		case nil:
+			n := s.fs.handles.getOrAdd(node, dir)
+			if how == createExclusive {
+				// Only a retransmission of this same call may
+				// succeed.
+				if ei.Type == libkbfs.Dir ||
+					!time.Unix(0, ei.Mtime).Equal(exclusiveMtime(verf)) {
+					return nil, nfs3ErrExist
+				}
+				return n, nil
+			}
+			if ei.Type == libkbfs.Dir {
+				return nil, nfs3ErrIsDir
+			}
+			return n, s.setAttrs(ctx, n, sa)
+		case libkbfs.NoSuchNameError:
+		default:
+			return nil, err
+		}
+	}
+
+	isExec := sa.mode != nil && *sa.mode&0100 != 0
+	node, _, err := kbfsOps.CreateFile(
+		ctx, dirNode, name, isExec, libkbfs.WithExcl)
+	if err != nil {
+		return nil, err
+	}
+	n := s.fs.handles.getOrAdd(node, dir)
+	if how == createExclusive {
+		mtime := exclusiveMtime(verf)
+		return n, kbfsOps.SetMtime(ctx, node, &mtime)
+	}
+	// The mode was taken care of by isExec.
+	sa.mode = nil
+	return n, s.setAttrs(ctx, n, sa)
+}
+
+func (s nfsServer) mkdir(ctx context.Context, call *rpcCall,
+	w *xdrWriter) error {
+	dir, name, err := s.readDirOp(call.args)
+	if err == errGarbageArgs {
+		return err
+	}
+	readSattr(call.args)
+	if call.args.err != nil {
+		return errGarbageArgs
+	}
+
+	var n *fsNode
+	if err == nil {
+		var dirNode, node libkbfs.Node
+		dirNode, err = s.dirNode(ctx, dir)
+		if err == nil {
+			node, _, err = s.fs.config.KBFSOps().CreateDir(
+				ctx, dirNode, name)
+		}
+		if err == nil {
+			n = s.fs.handles.getOrAdd(node, dir)
+		}
+	}
+	return s.createResult(ctx, w, n, dir, call.cred, err)
+}
+
+func (s nfsServer) symlink(ctx context.Context, call *rpcCall,
+	w *xdrWriter) error {
+	dir, name, err := s.readDirOp(call.args)
+	if err == errGarbageArgs {
+		return err
+	}
+	readSattr(call.args)
+	target := call.args.string(maxPathSize)
+	if call.args.err != nil {
+		return errGarbageArgs
+	}
+
+	var n *fsNode
+	if err == nil {
+		var dirNode, node libkbfs.Node
+		dirNode, err = s.dirNode(ctx, dir)
+		if err == nil {
+			_, err = s.fs.config.KBFSOps().CreateLink(
+				ctx, dirNode, name, target)
+		}
+		if err == nil {
+			node, _, err = s.fs.config.KBFSOps().Lookup(ctx, dirNode, name)
+		}
+		if err == nil {
+			n = s.fs.handles.getOrAdd(node, dir)
+		}
+	}
+	return s.createResult(ctx, w, n, dir, call.cred, err)
+}
+
+func (s nfsServer) mknod(ctx context.Context, call *rpcCall,
+	w *xdrWriter) error {
+	dir, _, err := s.readDirOp(call.args)
+	if err == errGarbageArgs {
+		return err
+	}
+	// KBFS has no devices, sockets or FIFOs.
+	if err == nil {
+		err = nfs3ErrNotSupp
+	}
+	w.uint32(uint32(errToStatus(err)))
+	s.wccData(ctx, w, dir, call.cred)
+	return err
+}
+
+func (s nfsServer) remove(ctx context.Context, call *rpcCall,
+	w *xdrWriter) error {
+	dir, name, err := s.readDirOp(call.args)
+	if err == errGarbageArgs {
+		return err
+	}
+	if err == nil {
+		var dirNode libkbfs.Node
+		dirNode, err = s.dirNode(ctx, dir)
+		if err == nil {
+			err = s.fs.config.KBFSOps().RemoveEntry(ctx, dirNode, name)
+		}
+	}
+	w.uint32(uint32(errToStatus(err)))
+	s.wccData(ctx, w, dir, call.cred)
+	return err
+}
+
+func (s nfsServer) rmdir(ctx context.Context, call *rpcCall,
+	w *xdrWriter) error {
+	dir, name, err := s.readDirOp(call.args)
+	if err == errGarbageArgs {
+		return err
+	}
+	if err == nil {
+		err = s.checkWritable()
+	}
+	if err == nil {
+		if dir.kind == folderListKind {
+			// Removing a TLF just removes it from the favorites.
+			var h *libkbfs.TlfHandle
+			h, err = s.fs.parseTLF(ctx, name, dir.public)
+			if err == nil {
+				err = s.fs.config.KBFSOps().DeleteFavorite(
+					ctx, h.ToFavorite())
+			}
+		} else {
+			var dirNode libkbfs.Node
+			dirNode, err = s.dirNode(ctx, dir)
+			if err == nil {
+				err = s.fs.config.KBFSOps().RemoveDir(ctx, dirNode, name)
+			}
+		}
+	}
+	w.uint32(uint32(errToStatus(err)))
+	s.wccData(ctx, w, dir, call.cred)
+	return err
+}
+
+func (s nfsServer) rename(ctx context.Context, call *rpcCall,
+	w *xdrWriter) error {
+	fromDir, fromName, err := s.readDirOp(call.args)
+	if err == errGarbageArgs {
+		return err
+	}
+	toDir, toName, toErr := s.readDirOp(call.args)
+	if toErr == errGarbageArgs {
+		return toErr
+	}
+	if err == nil {
+		err = toErr
+	}
+
+	if err == nil {
+		err = s.rename2(ctx, fromDir, fromName, toDir, toName)
+	}
+	w.uint32(uint32(errToStatus(err)))
+	s.wccData(ctx, w, fromDir, call.cred)
+	s.wccData(ctx, w, toDir, call.cred)
+	return err
+}
+
+func (s nfsServer) rename2(ctx context.Context, fromDir *fsNode,
+	fromName string, toDir *fsNode, toName string) error {
+	fromNode, err := s.dirNode(ctx, fromDir)
+	if err != nil {
+		return err
+	}
+	toNode, err := s.dirNode(ctx, toDir)
+	if err != nil {
+		return err
+	}
+	kbfsOps := s.fs.config.KBFSOps()
+	err = kbfsOps.Rename(ctx, fromNode, fromName, toNode, toName)
+	if err != nil {
+		return err
+	}
+	// Keep track of where a renamed directory is now, for "..".
+	if node, _, err := kbfsOps.Lookup(ctx, toNode, toName); err == nil {
+		s.fs.handles.moved(s.fs.handles.getOrAdd(node, toDir), toDir)
+	}
+	return nil
+}
+
+func (s nfsServer) link(ctx context.Context, call *rpcCall,
+	w *xdrWriter) error {
+	n, err := s.readHandle(call.args)
+	if err == errGarbageArgs {
+		return err
+	}
+	dir, name, dirErr := s.readDirOp(call.args)
+	if dirErr == errGarbageArgs {
+		return dirErr
+	}
+	if err == nil {
+		err = dirErr
+	}
+
+	if err == nil {
+		var node, dirNode libkbfs.Node
+		node, err = s.fs.kbfsNode(ctx, n)
+		if err == nil {
+			dirNode, err = s.dirNode(ctx, dir)
+		}
+		if err == nil {
+			err = s.fs.config.KBFSOps().Link(ctx, node, dirNode, name)
+		}
+	}
+	w.uint32(uint32(errToStatus(err)))
+	s.postOpAttr(ctx, w, n, call.cred)
+	s.wccData(ctx, w, dir, call.cred)
+	return err
+}
+
+// Sizes used to keep READDIR and READDIRPLUS results under the size
+// the client asked for.
+const (
+	readdirResultOverhead = 4 + 4 + 84 + 8 + 4 + 4
+	readdirEntryOverhead  = 4 + 8 + 4 + 8
+	readdirPlusOverhead   = 4 + 84 + 4 + 4 + fileHandleSize
+)
+
+func (s nfsServer) readdirCommon(ctx context.Context, call *rpcCall,
+	w *xdrWriter, plus bool) error {
+	dir, err := s.readHandle(call.args)
+	cookie := call.args.uint64()
+	call.args.fixed(8) // cookie verifier
+	count := call.args.uint32()
+	if plus {
+		// The first count is just for the names; the second
+		// bounds the whole result.
+		count = call.args.uint32()
+	}
+	if call.args.err != nil || err == errGarbageArgs {
+		return errGarbageArgs
+	}
+
+	var entries []dirEntry
+	if err == nil {
+		entries, err = s.fs.readDir(ctx, dir)
+	}
+	if err == nil && cookie > uint64(len(entries)) {
+		err = nfs3ErrBadCookie
+	}
+	w.uint32(uint32(errToStatus(err)))
+	s.postOpAttr(ctx, w, dir, call.cred)
+	if err != nil {
+		return err
+	}
+	w.fixed(make([]byte, 8)) // cookie verifier
+
+	size := readdirResultOverhead
+	i := int(cookie)
+	for ; i < len(entries); i++ {
+		e := entries[i]
+		entrySize := readdirEntryOverhead + len(e.name) + pad4(len(e.name))
+		if plus {
+			entrySize += readdirPlusOverhead
+		}
+		if size+entrySize > int(count) {
+			break
+		}
+		size += entrySize
+
+		w.bool(true)
+		w.uint64(e.node.id)
+		w.string(e.name)
+		w.uint64(uint64(i + 1))
+		if plus {
+			s.postOpAttr(ctx, w, e.node, call.cred)
+			w.bool(true)
+			w.opaque(s.fs.handles.encode(e.node))
+		}
+	}
+	if i == int(cookie) && i < len(entries) {
+		// Not even one entry fit.
+		w.buf.Reset()
+		w.uint32(uint32(nfs3ErrTooSmall))
+		s.postOpAttr(ctx, w, dir, call.cred)
+		return nfs3ErrTooSmall
+	}
+	w.bool(false)
+	w.bool(i == len(entries))
+	return nil
+}
+
+func (s nfsServer) readdir(ctx context.Context, call *rpcCall,
+	w *xdrWriter) error {
+	return s.readdirCommon(ctx, call, w, false)
+}
+
+func (s nfsServer) readdirplus(ctx context.Context, call *rpcCall,
+	w *xdrWriter) error {
+	return s.readdirCommon(ctx, call, w, true)
+}
+
+func (s nfsServer) fsstat(ctx context.Context, call *rpcCall,
+	w *xdrWriter) error {
+	n, err := s.readHandle(call.args)
+	if err == errGarbageArgs {
+		return err
+	}
+	w.uint32(uint32(errToStatus(err)))
+	s.postOpAttr(ctx, w, n, call.cred)
+	if err != nil {
+		return err
+	}
+	// As with FUSE, the size of the file system is the user's quota,
+	// and what's left of it is free.  Without quota info, e.g. while
+	// logged out, the space looks unlimited.
+	var total, free uint64 = math.MaxInt64, math.MaxInt64
+	quotaInfo, err := s.fs.config.KBFSOps().GetUserQuotaInfo(ctx)
+	if err != nil {
+		s.fs.log.CDebugf(ctx, "Couldn't get quota info for fsstat: %v", err)
+	} else {
+		total = uint64(quotaInfo.Limit)
+		free = 0
+		if used := quotaInfo.UsedBytes(); used < quotaInfo.Limit {
+			free = uint64(quotaInfo.Limit - used)
+		}
+	}
+	const lots = math.MaxInt64
+	w.uint64(total) // total bytes
+	w.uint64(free)  // free bytes
+	w.uint64(free)  // available bytes
+	w.uint64(lots)  // total files
+	w.uint64(lots)  // free files
+	w.uint64(lots)  // available files
+	w.uint32(0)     // invarsec
+	return nil
+}
+
+func (s nfsServer) fsinfo(ctx context.Context, call *rpcCall,
+	w *xdrWriter) error {
+	n, err := s.readHandle(call.args)
+	if err == errGarbageArgs {
+		return err
+	}
+	w.uint32(uint32(errToStatus(err)))
+	s.postOpAttr(ctx, w, n, call.cred)
+	if err != nil {
+		return err
+	}
+	w.uint32(maxIOSize) // rtmax
+	w.uint32(maxIOSize) // rtpref
+	w.uint32(4096)      // rtmult
+	w.uint32(maxIOSize) // wtmax
+	w.uint32(maxIOSize) // wtpref
+	w.uint32(4096)      // wtmult
+	w.uint32(64 * 1024) // dtpref
+	w.uint64(s.fs.config.MaxFileBytes())
+	w.uint32(0) // time_delta: nanoseconds
+	w.uint32(1)
+	w.uint32(fsf3Link | fsf3Symlink | fsf3Homogeneous | fsf3CanSetTime)
+	return nil
+}
+
+func (s nfsServer) pathconf(ctx context.Context, call *rpcCall,
+	w *xdrWriter) error {
+	n, err := s.readHandle(call.args)
+	if err == errGarbageArgs {
+		return err
+	}
+	w.uint32(uint32(errToStatus(err)))
+	s.postOpAttr(ctx, w, n, call.cred)
+	if err != nil {
+		return err
+	}
+	w.uint32(math.MaxUint16) // linkmax
+	w.uint32(s.fs.config.MaxNameBytes())
+	w.bool(true)  // no_trunc
+	w.bool(true)  // chown_restricted
+	w.bool(false) // case_insensitive
+	w.bool(true)  // case_preserving
+	return nil
+}
+
+func (s nfsServer) commit(ctx context.Context, call *rpcCall,
+	w *xdrWriter) error {
+	n, err := s.readHandle(call.args)
+	call.args.uint64() // offset
+	call.args.uint32() // count
+	if call.args.err != nil || err == errGarbageArgs {
+		return errGarbageArgs
+	}
+	if err == nil {
+		var node libkbfs.Node
+		node, err = s.fs.kbfsNode(ctx, n)
+		if err == nil {
+			err = s.fs.config.KBFSOps().Sync(ctx, node)
+		}
+	}
+	w.uint32(uint32(errToStatus(err)))
+	s.wccData(ctx, w, n, call.cred)
+	if err == nil {
+		s.writeVerifier(w)
+	}
+	return err
+}
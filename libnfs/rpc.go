@@ -0,0 +1,328 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libnfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/keybase/client/go/logger"
+	"golang.org/x/net/context"
+)
+
+// ONC RPC (RFC 5531) message constants.
+const (
+	rpcVersion = 2
+
+	msgTypeCall  = 0
+	msgTypeReply = 1
+
+	replyAccepted = 0
+	replyDenied   = 1
+
+	acceptSuccess      = 0
+	acceptProgUnavail  = 1
+	acceptProgMismatch = 2
+	acceptProcUnavail  = 3
+	acceptGarbageArgs  = 4
+	acceptSystemErr    = 5
+
+	rejectRPCMismatch = 0
+	rejectAuthError   = 1
+
+	authNone = 0
+	authUnix = 1
+
+	authBadCred = 1
+	authTooWeak = 5
+
+	// maxAuthSize is the largest credential or verifier body
+	// allowed by the protocol.
+	maxAuthSize = 400
+	// maxRecordSize bounds the size of a single call, which is
+	// mostly the data of a WRITE.
+	maxRecordSize = maxIOSize + 64*1024
+	// maxCallsPerConn bounds the number of calls from one connection
+	// that are handled at once.
+	maxCallsPerConn = 16
+)
+
+// errProcUnavail and errGarbageArgs are returned by an rpcProgram to
+// reject a call with the corresponding accept status.
+var (
+	errProcUnavail = errors.New("procedure unavailable")
+	errGarbageArgs = errors.New("garbage arguments")
+)
+
+// rpcCred is the identity a call was made with, from its AUTH_SYS
+// credentials.
+type rpcCred struct {
+	machine string
+	uid     uint32
+	gid     uint32
+}
+
+// rpcCall is a decoded call, whose arguments have yet to be decoded
+// by the rpcProgram it's for.
+type rpcCall struct {
+	proc   uint32
+	cred   rpcCred
+	args   *xdrReader
+	remote net.Addr
+}
+
+// rpcProgram handles the calls for one version of an ONC RPC program.
+type rpcProgram interface {
+	// handle decodes the arguments of call, runs it, and encodes
+	// its results into w.  An error from handle fails the call as a
+	// whole; errors of the program itself are part of its results.
+	handle(ctx context.Context, call *rpcCall, w *xdrWriter) error
+}
+
+// rpcServer serves ONC RPC programs over TCP, using the record
+// marking of RFC 5531 section 11.
+type rpcServer struct {
+	log logger.Logger
+	// programs holds the rpcProgram for each program number and
+	// version.
+	programs map[uint32]map[uint32]rpcProgram
+	// allowed reports whether a client at the given address may
+	// connect at all.
+	allowed func(net.Addr) bool
+	// authorized reports whether a call to the given program and
+	// procedure, made with cred from the given address, may be
+	// handled.
+	authorized func(remote net.Addr, prog, proc uint32, cred rpcCred) bool
+	// withContext adds request-specific values to the context of
+	// each call.
+	withContext func(context.Context) context.Context
+}
+
+func (s *rpcServer) register(prog, vers uint32, p rpcProgram) {
+	if s.programs == nil {
+		s.programs = make(map[uint32]map[uint32]rpcProgram)
+	}
+	if s.programs[prog] == nil {
+		s.programs[prog] = make(map[uint32]rpcProgram)
+	}
+	s.programs[prog][vers] = p
+}
+
+// serve accepts connections on l until ctx is canceled or l fails.
+func (s *rpcServer) serve(ctx context.Context, l net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return nil
+			default:
+				return err
+			}
+		}
+		if !s.allowed(conn.RemoteAddr()) {
+			s.log.CWarningf(ctx, "Refusing connection from %s",
+				conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		s.log.CDebugf(ctx, "Accepted connection from %s", conn.RemoteAddr())
+		go s.serveConn(ctx, conn)
+	}
+}
+
+func readRecord(r io.Reader) ([]byte, error) {
+	var record []byte
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, err
+		}
+		h := binary.BigEndian.Uint32(header[:])
+		size := int(h & 0x7fffffff)
+		if len(record)+size > maxRecordSize {
+			return nil, fmt.Errorf("RPC record bigger than %d bytes",
+				maxRecordSize)
+		}
+		fragment := make([]byte, size)
+		if _, err := io.ReadFull(r, fragment); err != nil {
+			return nil, err
+		}
+		record = append(record, fragment...)
+		if h&0x80000000 != 0 {
+			return record, nil
+		}
+	}
+}
+
+func writeRecord(w io.Writer, record []byte) error {
+	buf := make([]byte, 4+len(record))
+	binary.BigEndian.PutUint32(buf, 0x80000000|uint32(len(record)))
+	copy(buf[4:], record)
+	_, err := w.Write(buf)
+	return err
+}
+
+func (s *rpcServer) serveConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	var writeLock sync.Mutex
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	calls := make(chan struct{}, maxCallsPerConn)
+	for {
+		record, err := readRecord(conn)
+		if err != nil {
+			if err != io.EOF {
+				s.log.CDebugf(ctx, "Closing connection from %s: %v",
+					conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		calls <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-calls }()
+			reply := s.handleRecord(ctx, record, conn.RemoteAddr())
+			if reply == nil {
+				return
+			}
+			writeLock.Lock()
+			defer writeLock.Unlock()
+			if err := writeRecord(conn, reply); err != nil {
+				s.log.CDebugf(ctx, "Couldn't reply to %s: %v",
+					conn.RemoteAddr(), err)
+				conn.Close()
+			}
+		}()
+	}
+}
+
+func parseUnixCred(body []byte) (cred rpcCred, err error) {
+	r := &xdrReader{buf: body}
+	r.uint32() // stamp
+	cred.machine = r.string(255)
+	cred.uid = r.uint32()
+	cred.gid = r.uint32()
+	n := r.uint32() // auxiliary gids
+	if n > 16 {
+		return rpcCred{}, errXDRTooLong
+	}
+	r.next(4 * int(n))
+	return cred, r.err
+}
+
+// handleRecord handles one call, and returns the record to reply
+// with, or nil if the record can't be replied to at all.
+func (s *rpcServer) handleRecord(ctx context.Context, record []byte,
+	remote net.Addr) []byte {
+	r := &xdrReader{buf: record}
+	xid := r.uint32()
+	if r.uint32() != msgTypeCall || r.err != nil {
+		return nil
+	}
+	rpcvers := r.uint32()
+	prog := r.uint32()
+	vers := r.uint32()
+	proc := r.uint32()
+	credFlavor := r.uint32()
+	credBody := r.opaque(maxAuthSize)
+	r.uint32() // verifier flavor
+	r.opaque(maxAuthSize)
+
+	w := &xdrWriter{}
+	w.uint32(xid)
+	w.uint32(msgTypeReply)
+	if r.err != nil {
+		w.uint32(replyDenied)
+		w.uint32(rejectAuthError)
+		w.uint32(authBadCred)
+		return w.bytes()
+	}
+	if rpcvers != rpcVersion {
+		w.uint32(replyDenied)
+		w.uint32(rejectRPCMismatch)
+		w.uint32(rpcVersion)
+		w.uint32(rpcVersion)
+		return w.bytes()
+	}
+
+	// Only AUTH_SYS is accepted, since every call has to be made
+	// for a user that's allowed to see the files.
+	if credFlavor != authUnix {
+		w.uint32(replyDenied)
+		w.uint32(rejectAuthError)
+		w.uint32(authTooWeak)
+		return w.bytes()
+	}
+	cred, err := parseUnixCred(credBody)
+	if err != nil {
+		w.uint32(replyDenied)
+		w.uint32(rejectAuthError)
+		w.uint32(authBadCred)
+		return w.bytes()
+	}
+	if !s.authorized(remote, prog, proc, cred) {
+		s.log.CDebugf(ctx, "Refusing call %d.%d.%d from uid %d at %s",
+			prog, vers, proc, cred.uid, remote)
+		w.uint32(replyDenied)
+		w.uint32(rejectAuthError)
+		w.uint32(authTooWeak)
+		return w.bytes()
+	}
+	call := &rpcCall{proc: proc, cred: cred, args: r, remote: remote}
+
+	w.uint32(replyAccepted)
+	w.uint32(authNone)
+	w.opaque(nil)
+
+	versions, ok := s.programs[prog]
+	if !ok {
+		w.uint32(acceptProgUnavail)
+		return w.bytes()
+	}
+	p, ok := versions[vers]
+	if !ok {
+		low, high := ^uint32(0), uint32(0)
+		for v := range versions {
+			if v < low {
+				low = v
+			}
+			if v > high {
+				high = v
+			}
+		}
+		w.uint32(acceptProgMismatch)
+		w.uint32(low)
+		w.uint32(high)
+		return w.bytes()
+	}
+
+	results := &xdrWriter{}
+	err = p.handle(s.withContext(ctx), call, results)
+	switch err {
+	case nil:
+		w.uint32(acceptSuccess)
+		w.fixed(results.bytes())
+	case errProcUnavail:
+		w.uint32(acceptProcUnavail)
+	case errGarbageArgs:
+		w.uint32(acceptGarbageArgs)
+	default:
+		s.log.CWarningf(ctx, "Call %d.%d.%d from %s failed: %v",
+			prog, vers, proc, remote, err)
+		w.uint32(acceptSystemErr)
+	}
+	return w.bytes()
+}
@@ -0,0 +1,75 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libnfs
+
+import (
+	"net"
+
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// StartOptions are options for starting up
+type StartOptions struct {
+	KbfsParams libkbfs.InitParams
+	Export     ExportOptions
+	// ListenAddr is the TCP address to serve both NFS and MOUNT on.
+	ListenAddr string
+}
+
+// Start the NFS server, and serve until interrupted.
+func Start(options StartOptions, kbCtx libkbfs.Context) *libfs.Error {
+	// InitLog errors are non-fatal and are ignored.
+	log, err := libkbfs.InitLog(options.KbfsParams, kbCtx)
+	if err != nil {
+		return libfs.InitError(err.Error())
+	}
+
+	log.Debug("Listening on %s", options.ListenAddr)
+	l, err := net.Listen("tcp", options.ListenAddr)
+	if err != nil {
+		return libfs.MountError(err.Error())
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	onInterruptFn := func() {
+		cancel()
+		libkbfs.Shutdown()
+	}
+
+	log.Debug("Initializing")
+
+	config, err := libkbfs.Init(kbCtx, options.KbfsParams, nil, onInterruptFn, log)
+	if err != nil {
+		return libfs.InitError(err.Error())
+	}
+
+	defer libkbfs.Shutdown()
+
+	log.Debug("Creating filesystem")
+	fs, err := NewFS(config, options.Export)
+	if err != nil {
+		return libfs.InitError(err.Error())
+	}
+	server := &rpcServer{
+		log:         fs.log,
+		allowed:     options.Export.allowed,
+		authorized:  options.Export.authorized,
+		withContext: fs.WithContext,
+	}
+	server.register(nfsProgram, nfsVersion, nfsServer{fs})
+	server.register(mountProgram, mountVersion, mountServer{fs})
+
+	log.Debug("Serving filesystem")
+	if err := server.serve(ctx, l); err != nil {
+		return libfs.MountError(err.Error())
+	}
+
+	log.Debug("Ending")
+	return nil
+}
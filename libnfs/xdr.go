@@ -0,0 +1,131 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libnfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// errXDRShort is returned when a message ends before a value that
+// should be in it.
+var errXDRShort = errors.New("XDR data too short")
+
+// errXDRTooLong is returned when a variable-length value is longer
+// than its maximum.
+var errXDRTooLong = errors.New("XDR value too long")
+
+// xdrReader decodes the XDR (RFC 4506) values of a message.  The
+// first error sticks, so callers can decode a whole argument struct
+// and check err once at the end.
+type xdrReader struct {
+	buf []byte
+	err error
+}
+
+func (r *xdrReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.buf) {
+		r.err = errXDRShort
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *xdrReader) uint32() uint32 {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *xdrReader) uint64() uint64 {
+	b := r.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (r *xdrReader) bool() bool {
+	return r.uint32() != 0
+}
+
+// fixed reads a fixed-length opaque of n bytes.
+func (r *xdrReader) fixed(n int) []byte {
+	b := r.next(n)
+	r.next(pad4(n))
+	return b
+}
+
+// opaque reads a variable-length opaque of at most max bytes.
+func (r *xdrReader) opaque(max int) []byte {
+	n := r.uint32()
+	if r.err != nil {
+		return nil
+	}
+	if n > uint32(max) {
+		r.err = errXDRTooLong
+		return nil
+	}
+	return r.fixed(int(n))
+}
+
+func (r *xdrReader) string(max int) string {
+	return string(r.opaque(max))
+}
+
+func pad4(n int) int {
+	return (4 - n%4) % 4
+}
+
+// xdrWriter encodes XDR values into a buffer.
+type xdrWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *xdrWriter) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	w.buf.Write(b[:])
+}
+
+func (w *xdrWriter) uint64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	w.buf.Write(b[:])
+}
+
+func (w *xdrWriter) bool(v bool) {
+	if v {
+		w.uint32(1)
+	} else {
+		w.uint32(0)
+	}
+}
+
+func (w *xdrWriter) fixed(b []byte) {
+	w.buf.Write(b)
+	w.buf.Write(make([]byte, pad4(len(b))))
+}
+
+func (w *xdrWriter) opaque(b []byte) {
+	w.uint32(uint32(len(b)))
+	w.fixed(b)
+}
+
+func (w *xdrWriter) string(s string) {
+	w.opaque([]byte(s))
+}
+
+func (w *xdrWriter) bytes() []byte {
+	return w.buf.Bytes()
+}
@@ -0,0 +1,123 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libsftp
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// SFTP has no authentication of its own, so clients are authenticated
+// by sshd.  To make that Keybase-backed, sshd is pointed at
+// `kbfssftp -authorized-keys` as its AuthorizedKeysCommand, which
+// lists the current Ed25519 device and paper keys of the Keybase user
+// logged in on the host as SSH keys.  A client therefore has to hold
+// the secret half of one of that user's Keybase keys to log in.  With
+// ExposeAuthInfo, sshd also tells the subsystem which key a session
+// used, and Start refuses sessions that didn't use one of them.
+
+const sshEd25519 = "ssh-ed25519"
+
+// sshPublicKey returns key in the authorized_keys format, without a
+// comment, or "" if it isn't an Ed25519 key and so can't be used for
+// SSH.
+func sshPublicKey(key libkbfs.VerifyingKey) string {
+	pub := libkb.KIDToNaclSigningKeyPublic(key.KID().ToBytes())
+	if pub == nil {
+		return ""
+	}
+	// The SSH wire format: a length-prefixed key type, followed
+	// by the length-prefixed key.
+	var blob []byte
+	for _, s := range [][]byte{[]byte(sshEd25519), pub[:]} {
+		var l [4]byte
+		binary.BigEndian.PutUint32(l[:], uint32(len(s)))
+		blob = append(blob, l[:]...)
+		blob = append(blob, s...)
+	}
+	return sshEd25519 + " " + base64.StdEncoding.EncodeToString(blob)
+}
+
+// AuthorizedKeys returns an authorized_keys line for each of the
+// current, unrevoked Ed25519 device and paper keys of the Keybase
+// user logged in to KBFS.
+func AuthorizedKeys(ctx context.Context, config libkbfs.Config) (
+	[]string, error) {
+	_, uid, err := config.KBPKI().GetCurrentUserInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	userInfo, err := config.KeybaseService().LoadUserPlusKeys(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, key := range userInfo.VerifyingKeys {
+		sshKey := sshPublicKey(key)
+		if sshKey == "" {
+			continue
+		}
+		// Comments can't have spaces, and device names can.
+		deviceName := strings.Replace(
+			userInfo.KIDNames[key.KID()], " ", "_", -1)
+		lines = append(lines, fmt.Sprintf("%s keybase:%s:%s",
+			sshKey, userInfo.Name, deviceName))
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("%s has no Ed25519 keys", userInfo.Name)
+	}
+	return lines, nil
+}
+
+// errNoAuthInfo is returned when sshd didn't say how the client
+// authenticated.
+var errNoAuthInfo = errors.New(
+	"SSH_USER_AUTH isn't set; set ExposeAuthInfo in sshd_config")
+
+// checkAuthInfo returns nil if the sshd auth info file at path shows
+// the session authenticated with one of the keys in authorizedKeys,
+// which are in the format returned by AuthorizedKeys.
+func checkAuthInfo(path string, authorizedKeys []string) error {
+	if path == "" {
+		return errNoAuthInfo
+	}
+	keys := make(map[string]bool, len(authorizedKeys))
+	for _, line := range authorizedKeys {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 {
+			keys[fields[0]+" "+fields[1]] = true
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// Each line is an auth method, followed by its details; for
+	// public keys, the key type and key.
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 3 && fields[0] == "publickey" &&
+			keys[fields[1]+" "+fields[2]] {
+			return nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("The SSH session didn't authenticate " +
+		"with a Keybase device or paper key")
+}
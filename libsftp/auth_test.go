@@ -0,0 +1,63 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libsftp
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+func TestSSHPublicKey(t *testing.T) {
+	key := libkbfs.MakeFakeVerifyingKeyOrBust("alice")
+	sshKey := sshPublicKey(key)
+	// Every Ed25519 key starts with the encoded key type, and a
+	// 32-byte length.
+	if !strings.HasPrefix(sshKey,
+		"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAI") {
+		t.Errorf("Unexpected SSH key %q", sshKey)
+	}
+}
+
+func TestCheckAuthInfo(t *testing.T) {
+	keys := []string{
+		sshPublicKey(libkbfs.MakeFakeVerifyingKeyOrBust("alice")) +
+			" keybase:alice:dev1",
+	}
+	other := sshPublicKey(libkbfs.MakeFakeVerifyingKeyOrBust("bob"))
+
+	f, err := ioutil.TempFile("", "sftp_auth_info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	if err := checkAuthInfo("", keys); err != errNoAuthInfo {
+		t.Errorf("Got %v with no auth info", err)
+	}
+
+	for _, test := range []struct {
+		info string
+		ok   bool
+	}{
+		{"publickey " + strings.Fields(keys[0])[0] + " " +
+			strings.Fields(keys[0])[1] + "\n", true},
+		{"password\npublickey " + other + "\n", false},
+		{"password\n", false},
+	} {
+		err := ioutil.WriteFile(f.Name(), []byte(test.info), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkAuthInfo(f.Name(), keys)
+		if (err == nil) != test.ok {
+			t.Errorf("Got %v for %q", err, test.info)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libsftp
+
+import (
+	"fmt"
+
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+// sftpStatus is an SFTP status code.  Statuses other than OK are
+// also errors, so handlers can return them directly.
+type sftpStatus uint32
+
+const (
+	fxOK               sftpStatus = 0
+	fxEOF              sftpStatus = 1
+	fxNoSuchFile       sftpStatus = 2
+	fxPermissionDenied sftpStatus = 3
+	fxFailure          sftpStatus = 4
+	fxBadMessage       sftpStatus = 5
+	fxOpUnsupported    sftpStatus = 8
+)
+
+// Error implements the error interface for sftpStatus.
+func (s sftpStatus) Error() string {
+	switch s {
+	case fxOK:
+		return "Success"
+	case fxEOF:
+		return "End of file"
+	case fxNoSuchFile:
+		return "No such file"
+	case fxPermissionDenied:
+		return "Permission denied"
+	case fxBadMessage:
+		return "Bad message"
+	case fxOpUnsupported:
+		return "Operation unsupported"
+	}
+	return fmt.Sprintf("SFTP status %d", uint32(s))
+}
+
+// errToStatus returns the SFTP status to report for err.  SFTP
+// version 3 has few codes, so most errors are just failures, with
+// the error message as the explanation.
+func errToStatus(err error) sftpStatus {
+	switch err := err.(type) {
+	case nil:
+		return fxOK
+	case sftpStatus:
+		return err
+	case libkbfs.NoSuchNameError, libkbfs.NoSuchUserError,
+		libkbfs.BadTLFNameError, libfs.TlfDoesNotExist:
+		return fxNoSuchFile
+	case libkbfs.ReadAccessError, libkbfs.WriteAccessError,
+		libkbfs.MDServerErrorUnauthorized, libkbfs.NeedSelfRekeyError,
+		libkbfs.NeedOtherRekeyError:
+		return fxPermissionDenied
+	}
+	return fxFailure
+}
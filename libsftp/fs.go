@@ -0,0 +1,286 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libsftp
+
+import (
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// maxSymlinkDepth bounds how many symlinks are followed to resolve a
+// single path.
+const maxSymlinkDepth = 16
+
+// entryKind says which part of the namespace an entry is in.
+type entryKind int
+
+const (
+	// rootKind is the root of KBFS, containing "private" and
+	// "public".
+	rootKind entryKind = iota
+	// folderListKind lists the user's private or public favorite
+	// TLFs.
+	folderListKind
+	// kbfsKind is a file, directory or symlink in a TLF, including
+	// the root directory of the TLF.
+	kbfsKind
+)
+
+// entry is a resolved path.
+type entry struct {
+	path   string
+	kind   entryKind
+	public bool
+	// node is nil for symlinks, and for anything that isn't of
+	// kbfsKind.
+	node libkbfs.Node
+	ei   libkbfs.EntryInfo
+}
+
+func (e entry) isDir() bool {
+	return e.kind != kbfsKind || e.ei.Type == libkbfs.Dir
+}
+
+// FS serves KBFS to an SFTP client.  Paths are like those under a
+// KBFS mount: "/private/alice/dir/file".
+type FS struct {
+	config libkbfs.Config
+	log    logger.Logger
+	// uid and gid own everything whose owner was never set with
+	// SetOwner; they're those of the server process, which sshd
+	// runs as the logged-in user.
+	uid, gid uint32
+	// startTime is reported as the time of the directories that
+	// aren't in any TLF.
+	startTime time.Time
+}
+
+// NewFS creates an FS serving KBFS as seen by the user logged in to
+// config.
+func NewFS(config libkbfs.Config) *FS {
+	return &FS{
+		config:    config,
+		log:       config.MakeLogger("kbfssftp"),
+		uid:       uint32(os.Getuid()),
+		gid:       uint32(os.Getgid()),
+		startTime: time.Now(),
+	}
+}
+
+// WithContext adds request-specific values to the context of an
+// SFTP request.
+func (f *FS) WithContext(ctx context.Context) context.Context {
+	id, errRandomReqID := libkbfs.MakeRandomRequestID()
+	if errRandomReqID != nil {
+		f.log.Errorf("Couldn't make request ID: %v", errRandomReqID)
+	}
+
+	ctx, err := libkbfs.NewContextWithCancellationDelayer(
+		libkbfs.NewContextReplayable(ctx, func(ctx context.Context) context.Context {
+			logTags := make(logger.CtxLogTags)
+			logTags[CtxIDKey] = CtxOpID
+			ctx = logger.NewContextWithLogTags(ctx, logTags)
+
+			if errRandomReqID == nil {
+				// Add a unique ID to this context, identifying a
+				// particular request.
+				ctx = context.WithValue(ctx, CtxIDKey, id)
+			}
+			return ctx
+		}))
+	if err != nil {
+		panic(err) // this should never happen
+	}
+	return ctx
+}
+
+func (f *FS) reportErr(ctx context.Context, mode libkbfs.ErrorModeType,
+	err error) {
+	if err == nil {
+		return
+	}
+	if _, ok := err.(sftpStatus); ok {
+		f.log.CDebugf(ctx, "SFTP error: %v", err)
+		return
+	}
+	f.config.Reporter().ReportErr(ctx, "", false, mode, err)
+	// Most errors, like a lookup of a missing name, are expected.
+	f.log.CDebugf(ctx, err.Error())
+}
+
+// cleanPath makes p absolute and removes any "." and "..", which
+// can't go above the root.  Relative paths are relative to the root.
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+func splitPath(p string) []string {
+	if p == "/" {
+		return nil
+	}
+	return strings.Split(p[1:], "/")
+}
+
+// resolve looks up the entry at p.  If follow is true, and p is a
+// symlink, it returns what the symlink points to instead.
+func (f *FS) resolve(ctx context.Context, p string, follow bool) (
+	entry, error) {
+	return f.resolveDepth(ctx, cleanPath(p), follow, 0)
+}
+
+func (f *FS) resolveDepth(ctx context.Context, p string, follow bool,
+	depth int) (entry, error) {
+	e := entry{path: "/", kind: rootKind}
+	components := splitPath(p)
+	for i, name := range components {
+		var err error
+		e, err = f.lookup(ctx, e, name)
+		if err != nil {
+			return entry{}, err
+		}
+		last := i == len(components)-1
+		if e.kind != kbfsKind || e.ei.Type != libkbfs.Sym ||
+			(last && !follow) {
+			continue
+		}
+
+		// Symlinks within KBFS are always relative; absolute ones
+		// point outside of it, which SFTP clients can't get to.
+		if depth >= maxSymlinkDepth || path.IsAbs(e.ei.SymPath) {
+			return entry{}, fxNoSuchFile
+		}
+		target := path.Join(path.Dir(e.path), e.ei.SymPath)
+		if !last {
+			target = path.Join(
+				append([]string{target}, components[i+1:]...)...)
+		}
+		return f.resolveDepth(ctx, target, follow, depth+1)
+	}
+	return e, nil
+}
+
+// resolveParent resolves the directory containing p, and returns it
+// along with the last component of p.
+func (f *FS) resolveParent(ctx context.Context, p string) (
+	entry, string, error) {
+	p = cleanPath(p)
+	if p == "/" {
+		return entry{}, "", fxPermissionDenied
+	}
+	dir, err := f.resolve(ctx, path.Dir(p), true)
+	if err != nil {
+		return entry{}, "", err
+	}
+	if !dir.isDir() {
+		return entry{}, "", libkbfs.NotDirError{}
+	}
+	return dir, path.Base(p), nil
+}
+
+// parseTLF parses a TLF name, canonical or not.
+func (f *FS) parseTLF(ctx context.Context, name string, public bool) (
+	*libkbfs.TlfHandle, error) {
+	h, err := libkbfs.ParseTlfHandle(ctx, f.config.KBPKI(), name, public)
+	if nc, ok := err.(libkbfs.TlfNameNotCanonical); ok {
+		h, err = libkbfs.ParseTlfHandle(
+			ctx, f.config.KBPKI(), nc.NameToTry, public)
+	}
+	return h, err
+}
+
+// lookup returns the entry called name in the directory dir.
+func (f *FS) lookup(ctx context.Context, dir entry, name string) (
+	entry, error) {
+	p := path.Join(dir.path, name)
+	switch dir.kind {
+	case rootKind:
+		switch name {
+		case PrivateName:
+			return entry{path: p, kind: folderListKind}, nil
+		case PublicName:
+			return entry{path: p, kind: folderListKind, public: true}, nil
+		}
+		return entry{}, fxNoSuchFile
+	case folderListKind:
+		h, err := f.parseTLF(ctx, name, dir.public)
+		if err != nil {
+			return entry{}, err
+		}
+		node, ei, err := f.config.KBFSOps().GetOrCreateRootNode(
+			ctx, h, libkbfs.MasterBranch)
+		if err != nil {
+			return entry{}, err
+		}
+		return entry{path: p, kind: kbfsKind, public: dir.public,
+			node: node, ei: ei}, nil
+	}
+
+	if dir.node == nil {
+		return entry{}, libkbfs.NotDirError{}
+	}
+	node, ei, err := f.config.KBFSOps().Lookup(ctx, dir.node, name)
+	if err != nil {
+		return entry{}, err
+	}
+	return entry{path: p, kind: kbfsKind, public: dir.public,
+		node: node, ei: ei}, nil
+}
+
+// dirEntry is one entry of a directory listing.
+type dirEntry struct {
+	name string
+	e    entry
+}
+
+// readDir lists the directory dir.
+func (f *FS) readDir(ctx context.Context, dir entry) ([]dirEntry, error) {
+	var entries []dirEntry
+	switch dir.kind {
+	case rootKind:
+		for _, name := range []string{PrivateName, PublicName} {
+			e, err := f.lookup(ctx, dir, name)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, dirEntry{name, e})
+		}
+	case folderListKind:
+		if _, _, err := f.config.KBPKI().GetCurrentUserInfo(ctx); err != nil {
+			// Logged out, so there are no favorites.
+			return nil, nil
+		}
+		favs, err := f.config.KBFSOps().GetFavorites(ctx)
+		if err != nil {
+			return nil, err
+		}
+		// Don't load every TLF just to list them; they're shown
+		// with the same attributes as the folder lists.
+		for _, fav := range favs {
+			if fav.Public != dir.public {
+				continue
+			}
+			entries = append(entries, dirEntry{fav.Name, entry{
+				path: path.Join(dir.path, fav.Name), kind: folderListKind,
+				public: dir.public}})
+		}
+	case kbfsKind:
+		children, err := f.config.KBFSOps().GetDirChildren(ctx, dir.node)
+		if err != nil {
+			return nil, err
+		}
+		for name, ei := range children {
+			entries = append(entries, dirEntry{name, entry{
+				path: path.Join(dir.path, name), kind: kbfsKind,
+				public: dir.public, ei: ei}})
+		}
+	}
+	return entries, nil
+}
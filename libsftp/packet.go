@@ -0,0 +1,178 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libsftp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// SFTP version 3 (draft-ietf-secsh-filexfer-02) constants.
+const (
+	sftpVersion = 3
+
+	fxpInit     = 1
+	fxpVersion  = 2
+	fxpOpen     = 3
+	fxpClose    = 4
+	fxpRead     = 5
+	fxpWrite    = 6
+	fxpLstat    = 7
+	fxpFstat    = 8
+	fxpSetstat  = 9
+	fxpFsetstat = 10
+	fxpOpendir  = 11
+	fxpReaddir  = 12
+	fxpRemove   = 13
+	fxpMkdir    = 14
+	fxpRmdir    = 15
+	fxpRealpath = 16
+	fxpStat     = 17
+	fxpRename   = 18
+	fxpReadlink = 19
+	fxpSymlink  = 20
+	fxpStatus   = 101
+	fxpHandle   = 102
+	fxpData     = 103
+	fxpName     = 104
+	fxpAttrs    = 105
+	fxpExtended = 200
+
+	fxfRead   = 0x01
+	fxfWrite  = 0x02
+	fxfAppend = 0x04
+	fxfCreat  = 0x08
+	fxfTrunc  = 0x10
+	fxfExcl   = 0x20
+
+	attrSize        = 0x01
+	attrUIDGID      = 0x02
+	attrPermissions = 0x04
+	attrACModTime   = 0x08
+	attrExtended    = 0x80000000
+
+	// maxPacketSize bounds the packets clients may send; every
+	// client keeps well under it.
+	maxPacketSize = 256 * 1024
+	// maxReadSize is the most data a single READ returns.
+	maxReadSize = 64 * 1024
+)
+
+// errShortPacket is returned when a packet ends before a value that
+// should be in it.
+var errShortPacket = errors.New("SFTP packet too short")
+
+// packetReader decodes the values of a packet, in the SSH wire
+// format (RFC 4251 section 5).  Like the XDR reader of libnfs, the
+// first error sticks.
+type packetReader struct {
+	buf []byte
+	err error
+}
+
+func (r *packetReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.buf) {
+		r.err = errShortPacket
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *packetReader) byte() byte {
+	b := r.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *packetReader) uint32() uint32 {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *packetReader) uint64() uint64 {
+	b := r.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (r *packetReader) bytes() []byte {
+	return r.next(int(r.uint32()))
+}
+
+func (r *packetReader) string() string {
+	return string(r.bytes())
+}
+
+// packetWriter encodes the values of a packet.
+type packetWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *packetWriter) byte(v byte) {
+	w.buf.WriteByte(v)
+}
+
+func (w *packetWriter) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	w.buf.Write(b[:])
+}
+
+func (w *packetWriter) uint64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	w.buf.Write(b[:])
+}
+
+func (w *packetWriter) bytes(b []byte) {
+	w.uint32(uint32(len(b)))
+	w.buf.Write(b)
+}
+
+func (w *packetWriter) string(s string) {
+	w.uint32(uint32(len(s)))
+	w.buf.WriteString(s)
+}
+
+// readPacket reads one length-prefixed packet from r.
+func readPacket(r io.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size == 0 || size > maxPacketSize {
+		return nil, fmt.Errorf("Bad SFTP packet size %d", size)
+	}
+	packet := make([]byte, size)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// writePacket writes the packet in p to w, with its length.
+func writePacket(w io.Writer, p *packetWriter) error {
+	buf := make([]byte, 4+p.buf.Len())
+	binary.BigEndian.PutUint32(buf, uint32(p.buf.Len()))
+	copy(buf[4:], p.buf.Bytes())
+	_, err := w.Write(buf)
+	return err
+}
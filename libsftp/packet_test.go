@@ -0,0 +1,88 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libsftp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	w := &packetWriter{}
+	w.byte(fxpOpen)
+	w.uint32(42)
+	w.string("/private/alice/a")
+	w.uint64(1 << 40)
+	attrs{flags: attrSize | attrPermissions | attrACModTime,
+		size: 5, perms: sIFREG | 0644, atime: 1, mtime: 2}.encode(w)
+
+	var buf bytes.Buffer
+	if err := writePacket(&buf, w); err != nil {
+		t.Fatal(err)
+	}
+	packet, err := readPacket(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &packetReader{buf: packet}
+	if b := r.byte(); b != fxpOpen {
+		t.Errorf("Got type %d", b)
+	}
+	if v := r.uint32(); v != 42 {
+		t.Errorf("Got id %d", v)
+	}
+	if s := r.string(); s != "/private/alice/a" {
+		t.Errorf("Got path %q", s)
+	}
+	if v := r.uint64(); v != 1<<40 {
+		t.Errorf("Got uint64 %d", v)
+	}
+	a := readAttrs(r)
+	if a.flags&attrUIDGID != 0 || a.size != 5 || a.perms != sIFREG|0644 ||
+		a.mtime != 2 {
+		t.Errorf("Got attrs %+v", a)
+	}
+	if r.err != nil || len(r.buf) != 0 {
+		t.Fatalf("Error %v, with %d bytes left", r.err, len(r.buf))
+	}
+
+	r.uint32()
+	if r.err != errShortPacket {
+		t.Errorf("Expected errShortPacket, got %v", r.err)
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	for p, expected := range map[string]string{
+		"":                     "/",
+		".":                    "/",
+		"..":                   "/",
+		"private/alice":        "/private/alice",
+		"/private/alice/../..": "/",
+		"/public//bob/./x/":    "/public/bob/x",
+	} {
+		if cleaned := cleanPath(p); cleaned != expected {
+			t.Errorf("cleanPath(%q) = %q, not %q", p, cleaned, expected)
+		}
+	}
+	if c := splitPath("/"); len(c) != 0 {
+		t.Errorf("Root split into %v", c)
+	}
+	if c := splitPath("/private/alice"); len(c) != 2 || c[1] != "alice" {
+		t.Errorf("Path split into %v", c)
+	}
+}
+
+func TestLongName(t *testing.T) {
+	a := attrs{perms: sIFLNK | 0777, uid: 1000, gid: 1000, size: 3}
+	if s := longName("link", a); s[:10] != "lrwxrwxrwx" {
+		t.Errorf("Got %q for a symlink", s)
+	}
+	a.perms = sIFDIR | 0755
+	if s := longName("dir", a); s[:10] != "drwxr-xr-x" {
+		t.Errorf("Got %q for a directory", s)
+	}
+}
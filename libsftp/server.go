@@ -0,0 +1,742 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libsftp
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// Unix file type bits, which SFTP puts in the permissions attribute.
+const (
+	sIFDIR = 0040000
+	sIFREG = 0100000
+	sIFLNK = 0120000
+)
+
+// attrs are the attributes sent in, or received from, a packet.
+// Only those in flags are valid.
+type attrs struct {
+	flags uint32
+	size  uint64
+	uid   uint32
+	gid   uint32
+	perms uint32
+	atime uint32
+	mtime uint32
+}
+
+func readAttrs(r *packetReader) (a attrs) {
+	a.flags = r.uint32()
+	if a.flags&attrSize != 0 {
+		a.size = r.uint64()
+	}
+	if a.flags&attrUIDGID != 0 {
+		a.uid = r.uint32()
+		a.gid = r.uint32()
+	}
+	if a.flags&attrPermissions != 0 {
+		a.perms = r.uint32()
+	}
+	if a.flags&attrACModTime != 0 {
+		a.atime = r.uint32()
+		a.mtime = r.uint32()
+	}
+	if a.flags&attrExtended != 0 {
+		for n := r.uint32(); n > 0 && r.err == nil; n-- {
+			r.string()
+			r.string()
+		}
+	}
+	return a
+}
+
+func (a attrs) encode(w *packetWriter) {
+	w.uint32(a.flags)
+	if a.flags&attrSize != 0 {
+		w.uint64(a.size)
+	}
+	if a.flags&attrUIDGID != 0 {
+		w.uint32(a.uid)
+		w.uint32(a.gid)
+	}
+	if a.flags&attrPermissions != 0 {
+		w.uint32(a.perms)
+	}
+	if a.flags&attrACModTime != 0 {
+		w.uint32(a.atime)
+		w.uint32(a.mtime)
+	}
+}
+
+// attrsOf returns the attributes of e.
+func (f *FS) attrsOf(ctx context.Context, e entry) attrs {
+	a := attrs{
+		flags: attrSize | attrUIDGID | attrPermissions | attrACModTime,
+		uid:   f.uid,
+		gid:   f.gid,
+	}
+	if e.kind != kbfsKind {
+		a.perms = sIFDIR | 0755
+		a.atime = uint32(f.startTime.Unix())
+		a.mtime = a.atime
+		return a
+	}
+
+	mode := e.ei.PosixMode(e.public)
+	a.perms = uint32(mode.Perm())
+	switch e.ei.Type {
+	case libkbfs.Dir:
+		a.perms |= sIFDIR
+	case libkbfs.Sym:
+		a.perms |= sIFLNK
+	default:
+		a.perms |= sIFREG
+	}
+	a.size = e.ei.Size
+	a.mtime = uint32(time.Unix(0, e.ei.Mtime).Unix())
+	a.atime = a.mtime
+	if uid, gid, ok := libkbfs.PosixOwnerForCurrentUser(
+		ctx, f.config, e.ei); ok {
+		if uid >= 0 {
+			a.uid = uint32(uid)
+		}
+		if gid >= 0 {
+			a.gid = uint32(gid)
+		}
+	}
+	return a
+}
+
+// longName formats a directory entry like "ls -l" does, which is
+// what clients show for it.
+func longName(name string, a attrs) string {
+	mode := os.FileMode(a.perms & 0777)
+	switch a.perms &^ 07777 {
+	case sIFDIR:
+		mode |= os.ModeDir
+	case sIFLNK:
+		mode |= os.ModeSymlink
+	}
+	modeStr := []byte(mode.String())
+	if modeStr[0] == 'L' {
+		modeStr[0] = 'l'
+	}
+	return fmt.Sprintf("%s 1 %-8d %-8d %8d %s %s", modeStr, a.uid, a.gid,
+		a.size, time.Unix(int64(a.mtime), 0).Format("Jan _2 15:04"), name)
+}
+
+// openHandle is a file or directory opened by the client.
+type openHandle struct {
+	e entry
+	// appendOnly is true if every write goes to the end of the file.
+	appendOnly bool
+	written    bool
+	// listed is true once a directory's entries have been sent.
+	listed bool
+}
+
+// Server serves SFTP requests on one connection, such as the stdin
+// and stdout given to an SSH subsystem.
+type Server struct {
+	fs         *FS
+	handles    map[string]*openHandle
+	nextHandle uint64
+}
+
+// NewServer returns a server for a single SFTP session on fs.
+func NewServer(fs *FS) *Server {
+	return &Server{fs: fs, handles: make(map[string]*openHandle)}
+}
+
+// Serve handles requests from rw until the client goes away.
+// Requests are handled one at a time, in order.
+func (s *Server) Serve(ctx context.Context, rw io.ReadWriter) error {
+	defer s.closeAll(ctx)
+
+	packet, err := readPacket(rw)
+	if err != nil {
+		return err
+	}
+	r := &packetReader{buf: packet}
+	if t := r.byte(); t != fxpInit {
+		return fmt.Errorf("Expected an SFTP init packet, got type %d", t)
+	}
+	w := &packetWriter{}
+	w.byte(fxpVersion)
+	w.uint32(sftpVersion)
+	if err := writePacket(rw, w); err != nil {
+		return err
+	}
+
+	for {
+		packet, err := readPacket(rw)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		r := &packetReader{buf: packet}
+		t := r.byte()
+		id := r.uint32()
+		if r.err != nil {
+			return r.err
+		}
+		w := &packetWriter{}
+		s.handle(s.fs.WithContext(ctx), t, id, r, w)
+		if err := writePacket(rw, w); err != nil {
+			return err
+		}
+	}
+}
+
+// closeAll syncs the files the client didn't close.
+func (s *Server) closeAll(ctx context.Context) {
+	for h := range s.handles {
+		if err := s.closeHandle(ctx, h); err != nil {
+			s.fs.log.CDebugf(ctx, "Couldn't close %s: %v", h, err)
+		}
+	}
+}
+
+func writeStatus(w *packetWriter, id uint32, err error) {
+	status := errToStatus(err)
+	w.byte(fxpStatus)
+	w.uint32(id)
+	w.uint32(uint32(status))
+	msg := status.Error()
+	if _, ok := err.(sftpStatus); !ok && err != nil {
+		msg = err.Error()
+	}
+	w.string(msg)
+	w.string("en")
+}
+
+// handle handles a request of type t, and writes the response to w.
+func (s *Server) handle(ctx context.Context, t byte, id uint32,
+	r *packetReader, w *packetWriter) {
+	var err error
+	mode := libkbfs.WriteMode
+	switch t {
+	case fxpOpen:
+		err = s.open(ctx, id, r, w)
+	case fxpClose:
+		err = s.close(ctx, r)
+	case fxpRead:
+		mode = libkbfs.ReadMode
+		err = s.read(ctx, id, r, w)
+	case fxpWrite:
+		err = s.write(ctx, r)
+	case fxpLstat, fxpStat:
+		mode = libkbfs.ReadMode
+		err = s.stat(ctx, id, r, w, t == fxpStat)
+	case fxpFstat:
+		mode = libkbfs.ReadMode
+		err = s.fstat(ctx, id, r, w)
+	case fxpSetstat:
+		err = s.setstat(ctx, r)
+	case fxpFsetstat:
+		err = s.fsetstat(ctx, r)
+	case fxpOpendir:
+		mode = libkbfs.ReadMode
+		err = s.opendir(ctx, id, r, w)
+	case fxpReaddir:
+		mode = libkbfs.ReadMode
+		err = s.readdir(ctx, id, r, w)
+	case fxpRemove:
+		err = s.remove(ctx, r)
+	case fxpMkdir:
+		err = s.mkdir(ctx, r)
+	case fxpRmdir:
+		err = s.rmdir(ctx, r)
+	case fxpRealpath:
+		mode = libkbfs.ReadMode
+		err = s.realpath(r, id, w)
+	case fxpRename:
+		err = s.rename(ctx, r)
+	case fxpReadlink:
+		mode = libkbfs.ReadMode
+		err = s.readlink(ctx, id, r, w)
+	case fxpSymlink:
+		err = s.symlink(ctx, r)
+	default:
+		err = fxOpUnsupported
+	}
+	if r.err != nil {
+		err = fxBadMessage
+	}
+	if err == nil && w.buf.Len() > 0 {
+		return
+	}
+	s.fs.reportErr(ctx, mode, err)
+	w.buf.Reset()
+	writeStatus(w, id, err)
+}
+
+// The request handlers below either write their response and return
+// nil, or return the error to send as a status.  A handler that
+// returns nil without writing a response succeeded with status OK.
+
+func (s *Server) addHandle(h *openHandle) string {
+	name := strconv.FormatUint(s.nextHandle, 10)
+	s.nextHandle++
+	s.handles[name] = h
+	return name
+}
+
+func (s *Server) getHandle(r *packetReader) (*openHandle, error) {
+	h, ok := s.handles[r.string()]
+	if !ok {
+		return nil, fxFailure
+	}
+	return h, nil
+}
+
+func writeHandle(w *packetWriter, id uint32, handle string) {
+	w.byte(fxpHandle)
+	w.uint32(id)
+	w.string(handle)
+}
+
+func (s *Server) open(ctx context.Context, id uint32, r *packetReader,
+	w *packetWriter) error {
+	p := r.string()
+	pflags := r.uint32()
+	a := readAttrs(r)
+	if r.err != nil {
+		return nil
+	}
+
+	kbfsOps := s.fs.config.KBFSOps()
+	e, err := s.fs.resolve(ctx, p, true)
+	switch errToStatus(err) {
+	case fxOK:
+		if pflags&fxfCreat != 0 && pflags&fxfExcl != 0 {
+			return libkbfs.NameExistsError{Name: path.Base(p)}
+		}
+	case fxNoSuchFile:
+		if pflags&fxfCreat == 0 {
+			return err
+		}
+		dir, name, err := s.fs.resolveParent(ctx, p)
+		if err != nil {
+			return err
+		}
+		if dir.node == nil {
+			return fxPermissionDenied
+		}
+		isExec := a.flags&attrPermissions != 0 && a.perms&0100 != 0
+		node, ei, err := kbfsOps.CreateFile(
+			ctx, dir.node, name, isExec, libkbfs.WithExcl)
+		if err != nil {
+			return err
+		}
+		e = entry{path: path.Join(dir.path, name), kind: kbfsKind,
+			public: dir.public, node: node, ei: ei}
+	default:
+		return err
+	}
+	if e.isDir() {
+		return libkbfs.NotFileError{}
+	}
+	if pflags&fxfTrunc != 0 {
+		if err := kbfsOps.Truncate(ctx, e.node, 0); err != nil {
+			return err
+		}
+	}
+
+	handle := s.addHandle(&openHandle{
+		e:          e,
+		appendOnly: pflags&fxfAppend != 0,
+		written:    pflags&(fxfCreat|fxfTrunc) != 0,
+	})
+	writeHandle(w, id, handle)
+	return nil
+}
+
+func (s *Server) closeHandle(ctx context.Context, handle string) error {
+	h, ok := s.handles[handle]
+	if !ok {
+		return fxFailure
+	}
+	delete(s.handles, handle)
+	if !h.written {
+		return nil
+	}
+	return s.fs.config.KBFSOps().Sync(ctx, h.e.node)
+}
+
+func (s *Server) close(ctx context.Context, r *packetReader) error {
+	handle := r.string()
+	if r.err != nil {
+		return nil
+	}
+	return s.closeHandle(ctx, handle)
+}
+
+func (s *Server) read(ctx context.Context, id uint32, r *packetReader,
+	w *packetWriter) error {
+	h, err := s.getHandle(r)
+	off := r.uint64()
+	size := r.uint32()
+	if r.err != nil || err != nil {
+		return err
+	}
+	if h.e.isDir() {
+		return libkbfs.NotFileError{}
+	}
+	if size > maxReadSize {
+		size = maxReadSize
+	}
+	data := make([]byte, size)
+	n, err := s.fs.config.KBFSOps().Read(ctx, h.e.node, data, int64(off))
+	if err != nil {
+		return err
+	}
+	if n == 0 && size > 0 {
+		return fxEOF
+	}
+	w.byte(fxpData)
+	w.uint32(id)
+	w.bytes(data[:n])
+	return nil
+}
+
+func (s *Server) write(ctx context.Context, r *packetReader) error {
+	h, err := s.getHandle(r)
+	off := r.uint64()
+	data := r.bytes()
+	if r.err != nil || err != nil {
+		return err
+	}
+	if h.e.isDir() {
+		return libkbfs.NotFileError{}
+	}
+	kbfsOps := s.fs.config.KBFSOps()
+	if h.appendOnly {
+		ei, err := kbfsOps.Stat(ctx, h.e.node)
+		if err != nil {
+			return err
+		}
+		off = ei.Size
+	}
+	if err := kbfsOps.Write(ctx, h.e.node, data, int64(off)); err != nil {
+		return err
+	}
+	h.written = true
+	return nil
+}
+
+func writeAttrs(w *packetWriter, id uint32, a attrs) {
+	w.byte(fxpAttrs)
+	w.uint32(id)
+	a.encode(w)
+}
+
+func (s *Server) stat(ctx context.Context, id uint32, r *packetReader,
+	w *packetWriter, follow bool) error {
+	p := r.string()
+	if r.err != nil {
+		return nil
+	}
+	e, err := s.fs.resolve(ctx, p, follow)
+	if err != nil {
+		return err
+	}
+	writeAttrs(w, id, s.fs.attrsOf(ctx, e))
+	return nil
+}
+
+func (s *Server) fstat(ctx context.Context, id uint32, r *packetReader,
+	w *packetWriter) error {
+	h, err := s.getHandle(r)
+	if r.err != nil || err != nil {
+		return err
+	}
+	// The entry info from when the file was opened is out of date
+	// once it has been written to.
+	e := h.e
+	if e.node != nil {
+		ei, err := s.fs.config.KBFSOps().Stat(ctx, e.node)
+		if err != nil {
+			return err
+		}
+		e.ei = ei
+	}
+	writeAttrs(w, id, s.fs.attrsOf(ctx, e))
+	return nil
+}
+
+// setAttrs applies the attributes in a to e.
+func (s *Server) setAttrs(ctx context.Context, e entry, a attrs) error {
+	if a.flags&^attrExtended == 0 {
+		return nil
+	}
+	if e.node == nil {
+		return fxPermissionDenied
+	}
+	kbfsOps := s.fs.config.KBFSOps()
+	if a.flags&attrSize != 0 {
+		if err := kbfsOps.Truncate(ctx, e.node, a.size); err != nil {
+			return err
+		}
+	}
+	if a.flags&attrPermissions != 0 {
+		err := kbfsOps.SetMode(ctx, e.node, os.FileMode(a.perms&0777))
+		if err != nil {
+			return err
+		}
+	}
+	if a.flags&attrUIDGID != 0 {
+		err := kbfsOps.SetOwner(ctx, e.node, int(a.uid), int(a.gid))
+		if err != nil {
+			return err
+		}
+	}
+	if a.flags&attrACModTime != 0 {
+		mtime := time.Unix(int64(a.mtime), 0)
+		if err := kbfsOps.SetMtime(ctx, e.node, &mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) setstat(ctx context.Context, r *packetReader) error {
+	p := r.string()
+	a := readAttrs(r)
+	if r.err != nil {
+		return nil
+	}
+	e, err := s.fs.resolve(ctx, p, true)
+	if err != nil {
+		return err
+	}
+	return s.setAttrs(ctx, e, a)
+}
+
+func (s *Server) fsetstat(ctx context.Context, r *packetReader) error {
+	h, err := s.getHandle(r)
+	a := readAttrs(r)
+	if r.err != nil || err != nil {
+		return err
+	}
+	if a.flags&attrSize != 0 {
+		h.written = true
+	}
+	return s.setAttrs(ctx, h.e, a)
+}
+
+func (s *Server) opendir(ctx context.Context, id uint32, r *packetReader,
+	w *packetWriter) error {
+	p := r.string()
+	if r.err != nil {
+		return nil
+	}
+	e, err := s.fs.resolve(ctx, p, true)
+	if err != nil {
+		return err
+	}
+	if !e.isDir() {
+		return libkbfs.NotDirError{}
+	}
+	writeHandle(w, id, s.addHandle(&openHandle{e: e}))
+	return nil
+}
+
+// readdir sends the whole listing in response to the first request,
+// and EOF after that.
+func (s *Server) readdir(ctx context.Context, id uint32, r *packetReader,
+	w *packetWriter) error {
+	h, err := s.getHandle(r)
+	if r.err != nil || err != nil {
+		return err
+	}
+	if !h.e.isDir() {
+		return libkbfs.NotDirError{}
+	}
+	if h.listed {
+		return fxEOF
+	}
+	entries, err := s.fs.readDir(ctx, h.e)
+	if err != nil {
+		return err
+	}
+	h.listed = true
+
+	dirAttrs := s.fs.attrsOf(ctx, h.e)
+	w.byte(fxpName)
+	w.uint32(id)
+	w.uint32(uint32(len(entries) + 2))
+	for _, name := range []string{".", ".."} {
+		w.string(name)
+		w.string(longName(name, dirAttrs))
+		dirAttrs.encode(w)
+	}
+	for _, de := range entries {
+		a := s.fs.attrsOf(ctx, de.e)
+		w.string(de.name)
+		w.string(longName(de.name, a))
+		a.encode(w)
+	}
+	return nil
+}
+
+func (s *Server) remove(ctx context.Context, r *packetReader) error {
+	p := r.string()
+	if r.err != nil {
+		return nil
+	}
+	dir, name, err := s.fs.resolveParent(ctx, p)
+	if err != nil {
+		return err
+	}
+	if dir.node == nil {
+		return fxPermissionDenied
+	}
+	return s.fs.config.KBFSOps().RemoveEntry(ctx, dir.node, name)
+}
+
+func (s *Server) mkdir(ctx context.Context, r *packetReader) error {
+	p := r.string()
+	a := readAttrs(r)
+	if r.err != nil {
+		return nil
+	}
+	dir, name, err := s.fs.resolveParent(ctx, p)
+	if err != nil {
+		return err
+	}
+	if dir.node == nil {
+		return fxPermissionDenied
+	}
+	node, _, err := s.fs.config.KBFSOps().CreateDir(ctx, dir.node, name)
+	if err != nil {
+		return err
+	}
+	if a.flags&attrPermissions == 0 {
+		return nil
+	}
+	return s.fs.config.KBFSOps().SetMode(
+		ctx, node, os.FileMode(a.perms&0777))
+}
+
+func (s *Server) rmdir(ctx context.Context, r *packetReader) error {
+	p := r.string()
+	if r.err != nil {
+		return nil
+	}
+	dir, name, err := s.fs.resolveParent(ctx, p)
+	if err != nil {
+		return err
+	}
+	switch dir.kind {
+	case rootKind:
+		return fxPermissionDenied
+	case folderListKind:
+		// Removing a TLF just removes it from the favorites.
+		h, err := s.fs.parseTLF(ctx, name, dir.public)
+		if err != nil {
+			return err
+		}
+		return s.fs.config.KBFSOps().DeleteFavorite(ctx, h.ToFavorite())
+	}
+	return s.fs.config.KBFSOps().RemoveDir(ctx, dir.node, name)
+}
+
+func (s *Server) realpath(r *packetReader, id uint32,
+	w *packetWriter) error {
+	p := r.string()
+	if r.err != nil {
+		return nil
+	}
+	p = cleanPath(p)
+	w.byte(fxpName)
+	w.uint32(id)
+	w.uint32(1)
+	w.string(p)
+	w.string(p)
+	attrs{}.encode(w)
+	return nil
+}
+
+func (s *Server) rename(ctx context.Context, r *packetReader) error {
+	oldPath := r.string()
+	newPath := r.string()
+	if r.err != nil {
+		return nil
+	}
+	oldDir, oldName, err := s.fs.resolveParent(ctx, oldPath)
+	if err != nil {
+		return err
+	}
+	newDir, newName, err := s.fs.resolveParent(ctx, newPath)
+	if err != nil {
+		return err
+	}
+	if oldDir.node == nil || newDir.node == nil {
+		return fxPermissionDenied
+	}
+	// SFTP version 3 says a rename must not replace an existing
+	// file.
+	_, _, err = s.fs.config.KBFSOps().Lookup(ctx, newDir.node, newName)
+	switch err.(type) {
+	case nil:
+		return libkbfs.NameExistsError{Name: newName}
+	case libkbfs.NoSuchNameError:
+	default:
+		return err
+	}
+	return s.fs.config.KBFSOps().Rename(
+		ctx, oldDir.node, oldName, newDir.node, newName)
+}
+
+func (s *Server) readlink(ctx context.Context, id uint32, r *packetReader,
+	w *packetWriter) error {
+	p := r.string()
+	if r.err != nil {
+		return nil
+	}
+	e, err := s.fs.resolve(ctx, p, false)
+	if err != nil {
+		return err
+	}
+	if e.kind != kbfsKind || e.ei.Type != libkbfs.Sym {
+		return fxFailure
+	}
+	w.byte(fxpName)
+	w.uint32(id)
+	w.uint32(1)
+	w.string(e.ei.SymPath)
+	w.string(e.ei.SymPath)
+	attrs{}.encode(w)
+	return nil
+}
+
+func (s *Server) symlink(ctx context.Context, r *packetReader) error {
+	// OpenSSH sends the target first and the link path second, the
+	// opposite of the draft; every client follows OpenSSH.
+	target := r.string()
+	linkPath := r.string()
+	if r.err != nil {
+		return nil
+	}
+	dir, name, err := s.fs.resolveParent(ctx, linkPath)
+	if err != nil {
+		return err
+	}
+	if dir.node == nil {
+		return fxPermissionDenied
+	}
+	_, err = s.fs.config.KBFSOps().CreateLink(ctx, dir.node, name, target)
+	return err
+}
@@ -0,0 +1,114 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libsftp
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// StartOptions are options for starting up
+type StartOptions struct {
+	KbfsParams libkbfs.InitParams
+	// AuthInfoFile is the file where sshd says how the client
+	// authenticated, from $SSH_USER_AUTH.
+	AuthInfoFile string
+	// AllowAnySSHKey serves clients however sshd authenticated
+	// them, rather than only those that used one of the Keybase
+	// keys listed by AuthorizedKeys.
+	AllowAnySSHKey bool
+}
+
+// Start KBFS, and serve one SFTP session on rw until the client
+// goes away.
+//
+// KBFS is accessed as the Keybase user logged in on the host, so
+// unless options.AllowAnySSHKey is set, the session is only served
+// if the client logged in to sshd with one of that user's device or
+// paper keys.
+func Start(options StartOptions, kbCtx libkbfs.Context,
+	rw io.ReadWriter) *libfs.Error {
+	// InitLog errors are non-fatal and are ignored.
+	log, err := libkbfs.InitLog(options.KbfsParams, kbCtx)
+	if err != nil {
+		return libfs.InitError(err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	onInterruptFn := func() {
+		cancel()
+		libkbfs.Shutdown()
+	}
+
+	log.Debug("Initializing")
+
+	config, err := libkbfs.Init(kbCtx, options.KbfsParams, nil, onInterruptFn, log)
+	if err != nil {
+		return libfs.InitError(err.Error())
+	}
+
+	defer libkbfs.Shutdown()
+
+	// Without a logged-in user, there'd be nothing to serve but
+	// public TLFs, read-only, which isn't worth an SSH login.
+	if _, _, err := config.KBPKI().GetCurrentUserInfo(ctx); err != nil {
+		return libfs.InitError(err.Error())
+	}
+
+	if !options.AllowAnySSHKey {
+		keys, err := AuthorizedKeys(ctx, config)
+		if err != nil {
+			return libfs.InitError(err.Error())
+		}
+		err = checkAuthInfo(options.AuthInfoFile, keys)
+		if err != nil {
+			log.Warning("Refusing SFTP session: %v", err)
+			return libfs.InitError(err.Error())
+		}
+	}
+
+	log.Debug("Serving filesystem")
+	if err := NewServer(NewFS(config)).Serve(ctx, rw); err != nil {
+		return libfs.MountError(err.Error())
+	}
+
+	log.Debug("Ending")
+	return nil
+}
+
+// PrintAuthorizedKeys starts KBFS, and writes the Keybase device and
+// paper keys of the logged-in user to w in the authorized_keys
+// format, for use as sshd's AuthorizedKeysCommand.
+func PrintAuthorizedKeys(options StartOptions, kbCtx libkbfs.Context,
+	w io.Writer) *libfs.Error {
+	log, err := libkbfs.InitLog(options.KbfsParams, kbCtx)
+	if err != nil {
+		return libfs.InitError(err.Error())
+	}
+
+	ctx := context.Background()
+	config, err := libkbfs.Init(kbCtx, options.KbfsParams, nil, nil, log)
+	if err != nil {
+		return libfs.InitError(err.Error())
+	}
+
+	defer libkbfs.Shutdown()
+
+	keys, err := AuthorizedKeys(ctx, config)
+	if err != nil {
+		return libfs.InitError(err.Error())
+	}
+	for _, key := range keys {
+		if _, err := fmt.Fprintln(w, key); err != nil {
+			return libfs.InitError(err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libwebdav
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// AccessOptions say who may make requests to an FS.
+type AccessOptions struct {
+	// Password must be sent with every request, with any user
+	// name, through HTTP Basic authentication.  It must not be
+	// empty.  It's sent in the clear unless the server is behind
+	// TLS, so it only helps on networks that can't be snooped on.
+	Password string
+	// AllowedHosts lists the values, like "localhost:8080", that
+	// the Host header of a request may have, compared without
+	// regard to case.  Checking it keeps web pages from reaching
+	// the server through DNS rebinding.
+	AllowedHosts []string
+}
+
+// MakeSessionPassword returns a random password, for a server that
+// only needs one for as long as it runs.
+func MakeSessionPassword() (string, error) {
+	var b [24]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b[:]), nil
+}
+
+// HostsForListenAddr returns the Host header values that requests to
+// a server listening on addr may have: addr itself, and also
+// "localhost" for a loopback address.  An address that leaves out the
+// port also matches, for port 80.
+func HostsForListenAddr(addr string) ([]string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	hosts := []string{host}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		hosts = append(hosts, "localhost")
+	}
+	var allowed []string
+	for _, h := range hosts {
+		hostPort := net.JoinHostPort(h, port)
+		allowed = append(allowed, hostPort)
+		if port == "80" {
+			allowed = append(allowed, strings.TrimSuffix(hostPort, ":80"))
+		}
+	}
+	return allowed, nil
+}
+
+// hostAllowed returns whether r was addressed to one of the allowed
+// hosts.
+func (o AccessOptions) hostAllowed(r *http.Request) bool {
+	for _, host := range o.AllowedHosts {
+		if strings.EqualFold(r.Host, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticated returns whether r carries the password.
+func (o AccessOptions) authenticated(r *http.Request) bool {
+	_, password, ok := r.BasicAuth()
+	return ok && o.Password != "" && subtle.ConstantTimeCompare(
+		[]byte(password), []byte(o.Password)) == 1
+}
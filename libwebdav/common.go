@@ -0,0 +1,24 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libwebdav
+
+const (
+	// PublicName is the name of the parent of all public top-level folders.
+	PublicName = "public"
+
+	// PrivateName is the name of the parent of all private top-level folders.
+	PrivateName = "private"
+
+	// CtxOpID is the display name for the unique operation WebDAV ID tag.
+	CtxOpID = "WID"
+)
+
+// CtxTagKey is the type used for unique context tags
+type CtxTagKey int
+
+const (
+	// CtxIDKey is the type of the tag for unique operation IDs.
+	CtxIDKey CtxTagKey = iota
+)
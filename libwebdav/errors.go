@@ -0,0 +1,58 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libwebdav
+
+import (
+	"net/http"
+
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+// httpError is an HTTP status to fail a request with.  Handlers can
+// return one directly when no KBFS error is involved.
+type httpError int
+
+// Error implements the error interface for httpError.
+func (e httpError) Error() string {
+	return http.StatusText(int(e))
+}
+
+// WebDAV (RFC 4918) statuses, which net/http doesn't define.
+const (
+	statusMultiStatus         = 207
+	statusLocked              = 423
+	statusInsufficientStorage = 507
+)
+
+// errToHTTPStatus returns the HTTP status to report for err.
+func errToHTTPStatus(err error) int {
+	switch err := err.(type) {
+	case nil:
+		return http.StatusOK
+	case httpError:
+		return int(err)
+	case libkbfs.NoSuchNameError, libkbfs.NoSuchUserError,
+		libkbfs.BadTLFNameError, libfs.TlfDoesNotExist:
+		return http.StatusNotFound
+	case libkbfs.ReadAccessError, libkbfs.WriteAccessError,
+		libkbfs.MDServerErrorUnauthorized, libkbfs.NeedSelfRekeyError,
+		libkbfs.NeedOtherRekeyError:
+		return http.StatusForbidden
+	case libkbfs.NameExistsError, libkbfs.DirNotEmptyError,
+		libkbfs.NotDirError, libkbfs.NotFileError:
+		return http.StatusConflict
+	case libkbfs.NameTooLongError, libkbfs.EmptyNameError,
+		libkbfs.DisallowedPrefixError:
+		return http.StatusBadRequest
+	case libkbfs.FileTooBigError:
+		return http.StatusRequestEntityTooLarge
+	case libkbfs.BServerErrorOverQuota, libkbfs.DirTooBigError:
+		return statusInsufficientStorage
+	case libkbfs.RangeLockConflictError:
+		return statusLocked
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,340 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libwebdav
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// maxSymlinkDepth bounds how many symlinks are followed to resolve a
+// single path.
+const maxSymlinkDepth = 16
+
+// entryKind says which part of the namespace an entry is in.
+type entryKind int
+
+const (
+	// rootKind is the root of KBFS, containing "private" and
+	// "public".
+	rootKind entryKind = iota
+	// folderListKind lists the user's private or public favorite
+	// TLFs.
+	folderListKind
+	// kbfsKind is a file or directory in a TLF, including the root
+	// directory of the TLF.
+	kbfsKind
+)
+
+// entry is a resolved path.  Symlinks are always followed, since
+// WebDAV has no way to show them.
+type entry struct {
+	path   string
+	kind   entryKind
+	public bool
+	// node is nil for anything that isn't of kbfsKind.
+	node libkbfs.Node
+	ei   libkbfs.EntryInfo
+}
+
+func (e entry) isDir() bool {
+	return e.kind != kbfsKind || e.ei.Type == libkbfs.Dir
+}
+
+// FS serves KBFS over WebDAV.  URL paths are like the paths under a
+// KBFS mount: "/private/alice/dir/file".
+type FS struct {
+	config libkbfs.Config
+	access AccessOptions
+	log    logger.Logger
+	locks  *lockTable
+	// startTime is reported as the time of the directories that
+	// aren't in any TLF.
+	startTime time.Time
+}
+
+// NewFS creates an FS serving KBFS as seen by the user logged in to
+// config, to the clients access allows.
+func NewFS(config libkbfs.Config, access AccessOptions) *FS {
+	f := &FS{
+		config:    config,
+		access:    access,
+		log:       config.MakeLogger("kbfswebdav"),
+		startTime: time.Now(),
+	}
+	f.locks = newLockTable(f)
+	return f
+}
+
+// WithContext adds request-specific values to the context of a
+// WebDAV request.
+func (f *FS) WithContext(ctx context.Context) context.Context {
+	id, errRandomReqID := libkbfs.MakeRandomRequestID()
+	if errRandomReqID != nil {
+		f.log.Errorf("Couldn't make request ID: %v", errRandomReqID)
+	}
+
+	ctx, err := libkbfs.NewContextWithCancellationDelayer(
+		libkbfs.NewContextReplayable(ctx, func(ctx context.Context) context.Context {
+			logTags := make(logger.CtxLogTags)
+			logTags[CtxIDKey] = CtxOpID
+			ctx = logger.NewContextWithLogTags(ctx, logTags)
+
+			if errRandomReqID == nil {
+				// Add a unique ID to this context, identifying a
+				// particular request.
+				ctx = context.WithValue(ctx, CtxIDKey, id)
+			}
+			return ctx
+		}))
+	if err != nil {
+		panic(err) // this should never happen
+	}
+	return ctx
+}
+
+func (f *FS) reportErr(ctx context.Context, mode libkbfs.ErrorModeType,
+	err error) {
+	if err == nil {
+		return
+	}
+	if _, ok := err.(httpError); ok {
+		f.log.CDebugf(ctx, "HTTP error: %v", err)
+		return
+	}
+	f.config.Reporter().ReportErr(ctx, "", false, mode, err)
+	// Most errors, like a lookup of a missing name, are expected.
+	f.log.CDebugf(ctx, err.Error())
+}
+
+// cleanPath makes p absolute and removes any "." and "..", which
+// can't go above the root.
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+// resolve looks up the entry at p, following symlinks.
+func (f *FS) resolve(ctx context.Context, p string) (entry, error) {
+	return f.resolveDepth(ctx, cleanPath(p), 0)
+}
+
+func (f *FS) resolveDepth(ctx context.Context, p string, depth int) (
+	entry, error) {
+	e := entry{path: "/", kind: rootKind}
+	if p == "/" {
+		return e, nil
+	}
+	components := strings.Split(p[1:], "/")
+	for i, name := range components {
+		var err error
+		e, err = f.lookup(ctx, e, name)
+		if err != nil {
+			return entry{}, err
+		}
+		if e.kind != kbfsKind || e.ei.Type != libkbfs.Sym {
+			continue
+		}
+
+		// Symlinks within KBFS are always relative; absolute ones
+		// point outside of it.
+		if depth >= maxSymlinkDepth || path.IsAbs(e.ei.SymPath) {
+			return entry{}, httpError(404)
+		}
+		target := path.Join(append(
+			[]string{path.Dir(e.path), e.ei.SymPath},
+			components[i+1:]...)...)
+		return f.resolveDepth(ctx, target, depth+1)
+	}
+	return e, nil
+}
+
+// resolveParent resolves the directory containing p, and returns it
+// along with the last component of p.  WebDAV calls for 409 Conflict
+// when the parent of a new resource doesn't exist.
+func (f *FS) resolveParent(ctx context.Context, p string) (
+	entry, string, error) {
+	p = cleanPath(p)
+	if p == "/" {
+		return entry{}, "", httpError(403)
+	}
+	dir, err := f.resolve(ctx, path.Dir(p))
+	if errToHTTPStatus(err) == 404 {
+		return entry{}, "", httpError(409)
+	} else if err != nil {
+		return entry{}, "", err
+	}
+	if !dir.isDir() {
+		return entry{}, "", httpError(409)
+	}
+	return dir, path.Base(p), nil
+}
+
+// parseTLF parses a TLF name, canonical or not.
+func (f *FS) parseTLF(ctx context.Context, name string, public bool) (
+	*libkbfs.TlfHandle, error) {
+	h, err := libkbfs.ParseTlfHandle(ctx, f.config.KBPKI(), name, public)
+	if nc, ok := err.(libkbfs.TlfNameNotCanonical); ok {
+		h, err = libkbfs.ParseTlfHandle(
+			ctx, f.config.KBPKI(), nc.NameToTry, public)
+	}
+	return h, err
+}
+
+// lookup returns the entry called name in the directory dir,
+// without following it if it's a symlink.
+func (f *FS) lookup(ctx context.Context, dir entry, name string) (
+	entry, error) {
+	p := path.Join(dir.path, name)
+	switch dir.kind {
+	case rootKind:
+		switch name {
+		case PrivateName:
+			return entry{path: p, kind: folderListKind}, nil
+		case PublicName:
+			return entry{path: p, kind: folderListKind, public: true}, nil
+		}
+		return entry{}, httpError(404)
+	case folderListKind:
+		h, err := f.parseTLF(ctx, name, dir.public)
+		if err != nil {
+			return entry{}, err
+		}
+		node, ei, err := f.config.KBFSOps().GetOrCreateRootNode(
+			ctx, h, libkbfs.MasterBranch)
+		if err != nil {
+			return entry{}, err
+		}
+		return entry{path: p, kind: kbfsKind, public: dir.public,
+			node: node, ei: ei}, nil
+	}
+
+	if !dir.isDir() {
+		return entry{}, libkbfs.NotDirError{}
+	}
+	node, ei, err := f.config.KBFSOps().Lookup(ctx, dir.node, name)
+	if err != nil {
+		return entry{}, err
+	}
+	return entry{path: p, kind: kbfsKind, public: dir.public,
+		node: node, ei: ei}, nil
+}
+
+// readDir returns the entries of the directory dir, following
+// symlinks.  Entries that can't be resolved, like dangling symlinks,
+// are left out.
+func (f *FS) readDir(ctx context.Context, dir entry) ([]entry, error) {
+	var names []string
+	switch dir.kind {
+	case rootKind:
+		names = []string{PrivateName, PublicName}
+	case folderListKind:
+		if _, _, err := f.config.KBPKI().GetCurrentUserInfo(ctx); err != nil {
+			// Logged out, so there are no favorites.
+			return nil, nil
+		}
+		favs, err := f.config.KBFSOps().GetFavorites(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, fav := range favs {
+			if fav.Public == dir.public {
+				names = append(names, fav.Name)
+			}
+		}
+	case kbfsKind:
+		children, err := f.config.KBFSOps().GetDirChildren(ctx, dir.node)
+		if err != nil {
+			return nil, err
+		}
+		for name := range children {
+			names = append(names, name)
+		}
+	}
+
+	entries := make([]entry, 0, len(names))
+	for _, name := range names {
+		e, err := f.resolve(ctx, path.Join(dir.path, name))
+		if err != nil {
+			f.log.CDebugf(ctx, "Skipping %s in listing: %v", name, err)
+			continue
+		}
+		// Keep the name the entry was listed under, rather than
+		// what a symlink points to.
+		e.path = path.Join(dir.path, name)
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// etag returns the entity tag of e.  For files and directories in
+// TLFs, it comes from the pointer to the block holding the entry,
+// which changes with every change that's synced, and from the mtime
+// and size, which also change with local writes that haven't been.
+func (f *FS) etag(ctx context.Context, e entry) (string, error) {
+	if e.kind != kbfsKind {
+		return fmt.Sprintf(`"kbfs-%x"`, f.startTime.UnixNano()), nil
+	}
+	if e.node == nil {
+		// An unfollowed symlink, which has no block of its own.
+		return fmt.Sprintf(`"sym-%x-%x"`, e.ei.Mtime, e.ei.Size), nil
+	}
+	md, err := f.config.KBFSOps().GetNodeMetadata(ctx, e.node)
+	if err != nil {
+		return "", err
+	}
+	ptr := md.BlockInfo.BlockPointer
+	return fmt.Sprintf(`"%s-%s-%x-%x"`, ptr.ID, ptr.RefNonce, e.ei.Mtime,
+		e.ei.Size), nil
+}
+
+// fileReader reads a KBFS file, for http.ServeContent.
+type fileReader struct {
+	ctx  context.Context
+	ops  libkbfs.KBFSOps
+	node libkbfs.Node
+	size int64
+	off  int64
+}
+
+var _ io.ReadSeeker = (*fileReader)(nil)
+
+func (r *fileReader) Read(p []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	n, err := r.ops.Read(r.ctx, r.node, p, r.off)
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 && len(p) > 0 {
+		return 0, io.EOF
+	}
+	r.off += n
+	return int(n), nil
+}
+
+func (r *fileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, fmt.Errorf("Bad whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("Negative offset %d", offset)
+	}
+	r.off = offset
+	return offset, nil
+}
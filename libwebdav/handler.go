@@ -0,0 +1,493 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libwebdav
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// writeChunkSize is how much of a PUT body is written to KBFS at a
+// time.
+const writeChunkSize = 512 * 1024
+
+var _ http.Handler = (*FS)(nil)
+
+// ServeHTTP implements the http.Handler interface for FS, serving
+// WebDAV (RFC 4918) classes 1 and 2.
+func (f *FS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := f.WithContext(context.Background())
+	p := cleanPath(r.URL.Path)
+	f.log.CDebugf(ctx, "%s %s", r.Method, p)
+
+	if !f.access.hostAllowed(r) {
+		f.log.CDebugf(ctx, "Refusing request for host %q", r.Host)
+		http.Error(w, http.StatusText(http.StatusForbidden),
+			http.StatusForbidden)
+		return
+	}
+	if !f.access.authenticated(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="KBFS"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized),
+			http.StatusUnauthorized)
+		return
+	}
+
+	var err error
+	mode := libkbfs.WriteMode
+	switch r.Method {
+	case "OPTIONS":
+		mode = libkbfs.ReadMode
+		w.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, "+
+			"MKCOL, COPY, MOVE, PROPFIND, PROPPATCH, LOCK, UNLOCK")
+		w.Header().Set("DAV", "1, 2")
+		// Some Microsoft clients won't use WebDAV without this.
+		w.Header().Set("MS-Author-Via", "DAV")
+	case "GET", "HEAD":
+		mode = libkbfs.ReadMode
+		err = f.get(ctx, w, r, p)
+	case "PUT":
+		err = f.put(ctx, w, r, p)
+	case "DELETE":
+		err = f.delete(ctx, w, r, p)
+	case "MKCOL":
+		err = f.mkcol(ctx, w, r, p)
+	case "COPY", "MOVE":
+		err = f.copyOrMove(ctx, w, r, p)
+	case "PROPFIND":
+		mode = libkbfs.ReadMode
+		err = f.propfind(ctx, w, r, p)
+	case "PROPPATCH":
+		err = f.proppatch(ctx, w, r, p)
+	case "LOCK":
+		err = f.lock(ctx, w, r, p)
+	case "UNLOCK":
+		err = f.unlock(ctx, w, r, p)
+	default:
+		err = httpError(http.StatusMethodNotAllowed)
+	}
+	if err != nil {
+		f.reportErr(ctx, mode, err)
+		status := errToHTTPStatus(err)
+		http.Error(w, http.StatusText(status), status)
+	}
+}
+
+// The handlers below either write a response and return nil, or
+// return an error to respond with instead.
+
+func (f *FS) get(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, p string) error {
+	e, err := f.resolve(ctx, p)
+	if err != nil {
+		return err
+	}
+	etag, err := f.etag(ctx, e)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("ETag", etag)
+
+	if e.isDir() {
+		return f.listDir(ctx, w, r, e)
+	}
+	if ct := mime.TypeByExtension(path.Ext(p)); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	// ServeContent takes care of Range, If-None-Match and
+	// If-Modified-Since.
+	http.ServeContent(w, r, path.Base(p), time.Unix(0, e.ei.Mtime),
+		&fileReader{ctx: ctx, ops: f.config.KBFSOps(), node: e.node,
+			size: int64(e.ei.Size)})
+	return nil
+}
+
+// listDir responds to a GET of a directory with a plain HTML
+// listing, for web browsers.
+func (f *FS) listDir(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, dir entry) error {
+	entries, err := f.readDir(ctx, dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, e := range entries {
+		name := path.Base(e.path)
+		if e.isDir() {
+			name += "/"
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == "HEAD" {
+		return nil
+	}
+	fmt.Fprintf(w, "<html><body><h1>%s</h1><ul>\n", html.EscapeString(dir.path))
+	for _, name := range names {
+		fmt.Fprintf(w, "<li><a href=\"%s\">%s</a></li>\n",
+			(&url.URL{Path: name}).EscapedPath(), html.EscapeString(name))
+	}
+	fmt.Fprintf(w, "</ul></body></html>\n")
+	return nil
+}
+
+// checkPreconditions checks the If-Match and If-None-Match headers
+// of a request that changes e, which is nil if it doesn't exist.
+func (f *FS) checkPreconditions(ctx context.Context, r *http.Request,
+	e *entry) error {
+	ifMatch := r.Header.Get("If-Match")
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if ifMatch == "" && ifNoneMatch == "" {
+		return nil
+	}
+	if e == nil {
+		if ifMatch != "" {
+			return httpError(http.StatusPreconditionFailed)
+		}
+		return nil
+	}
+	if ifNoneMatch == "*" {
+		return httpError(http.StatusPreconditionFailed)
+	}
+	etag, err := f.etag(ctx, *e)
+	if err != nil {
+		return err
+	}
+	if ifMatch != "" && ifMatch != "*" && !strings.Contains(ifMatch, etag) {
+		return httpError(http.StatusPreconditionFailed)
+	}
+	if ifNoneMatch != "" && strings.Contains(ifNoneMatch, etag) {
+		return httpError(http.StatusPreconditionFailed)
+	}
+	return nil
+}
+
+// resolveIfExists is like resolve, but returns nil if there's
+// nothing at p.
+func (f *FS) resolveIfExists(ctx context.Context, p string) (
+	*entry, error) {
+	e, err := f.resolve(ctx, p)
+	if errToHTTPStatus(err) == http.StatusNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (f *FS) put(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, p string) error {
+	existing, err := f.resolveIfExists(ctx, p)
+	if err != nil {
+		return err
+	}
+	if existing != nil && existing.isDir() {
+		return httpError(http.StatusMethodNotAllowed)
+	}
+	if err := f.checkPreconditions(ctx, r, existing); err != nil {
+		return err
+	}
+	if err := f.locks.checkWrite(
+		ctx, existing, p, r.Header.Get("If")); err != nil {
+		return err
+	}
+
+	kbfsOps := f.config.KBFSOps()
+	var node libkbfs.Node
+	if existing != nil {
+		node = existing.node
+		if err := kbfsOps.Truncate(ctx, node, 0); err != nil {
+			return err
+		}
+	} else {
+		dir, name, err := f.resolveParent(ctx, p)
+		if err != nil {
+			return err
+		}
+		if dir.node == nil {
+			return httpError(http.StatusForbidden)
+		}
+		node, _, err = kbfsOps.CreateFile(
+			ctx, dir.node, name, false, libkbfs.WithExcl)
+		if err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, writeChunkSize)
+	var off int64
+	for {
+		n, readErr := io.ReadFull(r.Body, buf)
+		if n > 0 {
+			if err := kbfsOps.Write(ctx, node, buf[:n], off); err != nil {
+				return err
+			}
+			off += int64(n)
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		} else if readErr != nil {
+			return readErr
+		}
+	}
+	if err := kbfsOps.Sync(ctx, node); err != nil {
+		return err
+	}
+
+	if existing != nil {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+	return nil
+}
+
+// removeAll removes name from dir, along with everything in it if
+// it's a directory.
+func (f *FS) removeAll(ctx context.Context, dir libkbfs.Node,
+	name string) error {
+	kbfsOps := f.config.KBFSOps()
+	node, ei, err := kbfsOps.Lookup(ctx, dir, name)
+	if err != nil {
+		return err
+	}
+	if ei.Type != libkbfs.Dir {
+		return kbfsOps.RemoveEntry(ctx, dir, name)
+	}
+	children, err := kbfsOps.GetDirChildren(ctx, node)
+	if err != nil {
+		return err
+	}
+	for child := range children {
+		if err := f.removeAll(ctx, node, child); err != nil {
+			return err
+		}
+	}
+	return kbfsOps.RemoveDir(ctx, dir, name)
+}
+
+func (f *FS) delete(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, p string) error {
+	dir, name, err := f.resolveParent(ctx, p)
+	if err != nil {
+		return err
+	}
+	e, err := f.lookup(ctx, dir, name)
+	if err != nil {
+		return err
+	}
+	if err := f.checkPreconditions(ctx, r, &e); err != nil {
+		return err
+	}
+	if err := f.locks.checkWrite(ctx, &e, p, r.Header.Get("If")); err != nil {
+		return err
+	}
+
+	switch dir.kind {
+	case rootKind:
+		return httpError(http.StatusForbidden)
+	case folderListKind:
+		// Deleting a TLF just removes it from the favorites.
+		h, err := f.parseTLF(ctx, name, dir.public)
+		if err != nil {
+			return err
+		}
+		err = f.config.KBFSOps().DeleteFavorite(ctx, h.ToFavorite())
+		if err != nil {
+			return err
+		}
+	default:
+		if err := f.removeAll(ctx, dir.node, name); err != nil {
+			return err
+		}
+	}
+	f.locks.releaseAll(ctx, cleanPath(p))
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (f *FS) mkcol(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, p string) error {
+	if r.ContentLength > 0 {
+		return httpError(http.StatusUnsupportedMediaType)
+	}
+	dir, name, err := f.resolveParent(ctx, p)
+	if err != nil {
+		return err
+	}
+	if dir.node == nil {
+		return httpError(http.StatusForbidden)
+	}
+	_, _, err = f.config.KBFSOps().CreateDir(ctx, dir.node, name)
+	if _, ok := err.(libkbfs.NameExistsError); ok {
+		return httpError(http.StatusMethodNotAllowed)
+	} else if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+// destinationPath returns the path in the Destination header of r,
+// which must be on this server.
+func destinationPath(r *http.Request) (string, error) {
+	dest, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || dest.Path == "" {
+		return "", httpError(http.StatusBadRequest)
+	}
+	if dest.Host != "" && dest.Host != r.Host {
+		return "", httpError(http.StatusBadGateway)
+	}
+	return cleanPath(dest.Path), nil
+}
+
+// copyFile copies the contents of the file from into a new file
+// called name in dir.
+func (f *FS) copyFile(ctx context.Context, from entry, dir libkbfs.Node,
+	name string) error {
+	kbfsOps := f.config.KBFSOps()
+	to, _, err := kbfsOps.CreateFile(ctx, dir, name,
+		from.ei.Type == libkbfs.Exec, libkbfs.WithExcl)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, writeChunkSize)
+	for off := int64(0); off < int64(from.ei.Size); {
+		n, err := kbfsOps.Read(ctx, from.node, buf, off)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		if err := kbfsOps.Write(ctx, to, buf[:n], off); err != nil {
+			return err
+		}
+		off += n
+	}
+	return kbfsOps.Sync(ctx, to)
+}
+
+// copyAll copies from, and if it's a directory and deep is true,
+// everything in it, to name in dir.
+func (f *FS) copyAll(ctx context.Context, from entry, dir libkbfs.Node,
+	name string, deep bool) error {
+	if !from.isDir() {
+		return f.copyFile(ctx, from, dir, name)
+	}
+	to, _, err := f.config.KBFSOps().CreateDir(ctx, dir, name)
+	if err != nil || !deep {
+		return err
+	}
+	children, err := f.readDir(ctx, from)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		err := f.copyAll(ctx, child, to, path.Base(child.path), deep)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *FS) copyOrMove(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, p string) error {
+	isMove := r.Method == "MOVE"
+	destPath, err := destinationPath(r)
+	if err != nil {
+		return err
+	}
+	if destPath == p || strings.HasPrefix(destPath, p+"/") {
+		return httpError(http.StatusForbidden)
+	}
+
+	fromDir, fromName, err := f.resolveParent(ctx, p)
+	if err != nil {
+		return err
+	}
+	from, err := f.lookup(ctx, fromDir, fromName)
+	if err != nil {
+		return err
+	}
+	if from.kind != kbfsKind || fromDir.kind != kbfsKind {
+		return httpError(http.StatusForbidden)
+	}
+	if isMove {
+		err := f.locks.checkWrite(ctx, &from, p, r.Header.Get("If"))
+		if err != nil {
+			return err
+		}
+	} else if from.ei.Type == libkbfs.Sym {
+		// Copy what the symlink points to.
+		if from, err = f.resolve(ctx, p); err != nil {
+			return err
+		}
+	}
+
+	toDir, toName, err := f.resolveParent(ctx, destPath)
+	if err != nil {
+		return err
+	}
+	if toDir.node == nil {
+		return httpError(http.StatusForbidden)
+	}
+	existing, err := f.lookup(ctx, toDir, toName)
+	replaced := false
+	switch errToHTTPStatus(err) {
+	case http.StatusOK:
+		if r.Header.Get("Overwrite") == "F" {
+			return httpError(http.StatusPreconditionFailed)
+		}
+		err := f.locks.checkWrite(
+			ctx, &existing, destPath, r.Header.Get("If"))
+		if err != nil {
+			return err
+		}
+		if err := f.removeAll(ctx, toDir.node, toName); err != nil {
+			return err
+		}
+		f.locks.releaseAll(ctx, destPath)
+		replaced = true
+	case http.StatusNotFound:
+	default:
+		return err
+	}
+
+	if isMove {
+		err = f.config.KBFSOps().Rename(
+			ctx, fromDir.node, fromName, toDir.node, toName)
+		if err == nil {
+			f.locks.releaseAll(ctx, p)
+		}
+	} else {
+		deep := r.Header.Get("Depth") != "0"
+		err = f.copyAll(ctx, from, toDir.node, toName, deep)
+	}
+	if err != nil {
+		return err
+	}
+
+	if replaced {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+	return nil
+}
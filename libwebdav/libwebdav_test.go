@@ -0,0 +1,193 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libwebdav
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+func TestParseTimeout(t *testing.T) {
+	for header, expected := range map[string]time.Duration{
+		"":                            defaultLockTimeout,
+		"Second-600":                  600 * time.Second,
+		"Infinite, Second-4100000000": maxLockTimeout,
+		"Second-bogus, Second-30":     30 * time.Second,
+		"Second-99999":                maxLockTimeout,
+		"Minute-5":                    defaultLockTimeout,
+	} {
+		if timeout := parseTimeout(header); timeout != expected {
+			t.Errorf("%q: expected %s, got %s", header, expected, timeout)
+		}
+	}
+}
+
+func TestLockTokenFromIf(t *testing.T) {
+	token := lockTokenFromIf(`(<opaquelocktoken:abc> ["etag"])`)
+	if token != "opaquelocktoken:abc" {
+		t.Errorf("Got token %q", token)
+	}
+	if token := lockTokenFromIf(`(["etag"])`); token != "" {
+		t.Errorf("Got token %q with none in the header", token)
+	}
+}
+
+const testPassword = "pw"
+
+// newTestFS returns an FS that doRequest can make requests to.
+func newTestFS(config libkbfs.Config) *FS {
+	return NewFS(config, AccessOptions{
+		Password: testPassword,
+		// The host of httptest requests.
+		AllowedHosts: []string{"example.com"},
+	})
+}
+
+func doRequest(t *testing.T, f *FS, method, p, body string,
+	header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, p, strings.NewReader(body))
+	r.SetBasicAuth("", testPassword)
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, r)
+	return w
+}
+
+func TestPutGetRangeAndETag(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	f := newTestFS(config)
+
+	const p = "/private/jdoe/file.txt"
+	if w := doRequest(t, f, "PUT", p, "hello world", nil); w.Code != http.StatusCreated {
+		t.Fatalf("PUT: got %d", w.Code)
+	}
+
+	w := doRequest(t, f, "GET", p, "", map[string]string{"Range": "bytes=6-"})
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("GET range: got %d", w.Code)
+	}
+	if body, _ := ioutil.ReadAll(w.Body); string(body) != "world" {
+		t.Errorf("GET range: got %q", body)
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatalf("No ETag")
+	}
+
+	w = doRequest(t, f, "GET", p, "", map[string]string{"If-None-Match": etag})
+	if w.Code != http.StatusNotModified {
+		t.Errorf("Conditional GET: got %d", w.Code)
+	}
+
+	if w := doRequest(t, f, "PUT", p, "bye", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("Second PUT: got %d", w.Code)
+	}
+	w = doRequest(t, f, "GET", p, "", nil)
+	if newETag := w.Header().Get("ETag"); newETag == etag {
+		t.Errorf("ETag %s didn't change after a write", etag)
+	}
+	w = doRequest(t, f, "PUT", p, "again", map[string]string{"If-Match": etag})
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("PUT with a stale If-Match: got %d", w.Code)
+	}
+}
+
+func TestLockBlocksOtherWriters(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	f := newTestFS(config)
+
+	const p = "/private/jdoe/locked"
+	const lockBody = `<?xml version="1.0"?><D:lockinfo xmlns:D="DAV:">` +
+		`<D:lockscope><D:exclusive/></D:lockscope>` +
+		`<D:locktype><D:write/></D:locktype></D:lockinfo>`
+	w := doRequest(t, f, "LOCK", p, lockBody, nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("LOCK: got %d", w.Code)
+	}
+	token := w.Header().Get("Lock-Token")
+
+	if w := doRequest(t, f, "PUT", p, "x", nil); w.Code != statusLocked {
+		t.Errorf("PUT without the token: got %d", w.Code)
+	}
+	if w := doRequest(t, f, "LOCK", p, lockBody, nil); w.Code != statusLocked {
+		t.Errorf("Second LOCK: got %d", w.Code)
+	}
+	w = doRequest(t, f, "PUT", p, "x",
+		map[string]string{"If": "(" + token + ")"})
+	if w.Code != http.StatusNoContent {
+		t.Errorf("PUT with the token: got %d", w.Code)
+	}
+
+	w = doRequest(t, f, "UNLOCK", p, "", map[string]string{"Lock-Token": token})
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("UNLOCK: got %d", w.Code)
+	}
+	if w := doRequest(t, f, "DELETE", p, "", nil); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE after UNLOCK: got %d", w.Code)
+	}
+}
+
+func TestAccessChecks(t *testing.T) {
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(t, config)
+	f := newTestFS(config)
+
+	r := httptest.NewRequest("PROPFIND", "/", nil)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("No password: got %d", w.Code)
+	}
+	if w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("No WWW-Authenticate header")
+	}
+
+	r = httptest.NewRequest("PROPFIND", "/", nil)
+	r.SetBasicAuth("", "wrong")
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Wrong password: got %d", w.Code)
+	}
+
+	r = httptest.NewRequest("PROPFIND", "/", nil)
+	r.Host = "evil.example.net"
+	r.SetBasicAuth("", testPassword)
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Unexpected host: got %d", w.Code)
+	}
+}
+
+func TestHostsForListenAddr(t *testing.T) {
+	hosts, err := HostsForListenAddr("127.0.0.1:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"127.0.0.1:8080", "localhost:8080"}
+	if !reflect.DeepEqual(hosts, expected) {
+		t.Errorf("Expected %v, got %v", expected, hosts)
+	}
+	hosts, err = HostsForListenAddr("[::1]:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"[::1]:80", "[::1]", "localhost:80", "localhost"}
+	if !reflect.DeepEqual(hosts, expected) {
+		t.Errorf("Expected %v, got %v", expected, hosts)
+	}
+}
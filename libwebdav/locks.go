@@ -0,0 +1,261 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libwebdav
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const (
+	// defaultLockTimeout is how long a WebDAV lock lasts if the
+	// client doesn't ask for a timeout.
+	defaultLockTimeout = 10 * time.Minute
+	// maxLockTimeout bounds the timeout a client may ask for, so
+	// that a client that goes away can't keep a file locked for
+	// long.
+	maxLockTimeout = 1 * time.Hour
+)
+
+// davLock is a WebDAV lock on a file.  Each one is backed by a KBFS
+// advisory lock on the whole file, so it conflicts with locks taken
+// through other frontends and on other devices too.
+type davLock struct {
+	token     string
+	path      string
+	node      libkbfs.Node
+	exclusive bool
+	// owner is the KBFS lock owner, unique to this WebDAV lock.
+	owner uint64
+	// ownerXML is the owner element the client sent, which is
+	// returned to it verbatim.
+	ownerXML string
+	timeout  time.Duration
+	expiry   *time.Timer
+	// localOnly is true if the MD server couldn't take the KBFS
+	// lock, so the lock only holds against other WebDAV clients.
+	localOnly bool
+}
+
+func (l *davLock) rangeLock() libkbfs.RangeLock {
+	lockType := libkbfs.RangeLockRead
+	if l.exclusive {
+		lockType = libkbfs.RangeLockWrite
+	}
+	return libkbfs.RangeLock{
+		Type:  lockType,
+		Start: 0,
+		End:   libkbfs.RangeLockToEOF,
+		Owner: l.owner,
+	}
+}
+
+// lockTable tracks the WebDAV locks held through this server.
+type lockTable struct {
+	fs *FS
+
+	lock      sync.Mutex
+	nextOwner uint64
+	byToken   map[string]*davLock
+	byPath    map[string][]*davLock
+}
+
+func newLockTable(fs *FS) *lockTable {
+	return &lockTable{
+		fs:        fs,
+		nextOwner: 1,
+		byToken:   make(map[string]*davLock),
+		byPath:    make(map[string][]*davLock),
+	}
+}
+
+func makeLockToken() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return "opaquelocktoken:" + hex.EncodeToString(b[:]), nil
+}
+
+// parseTimeout parses a Timeout header, like "Second-600" or
+// "Infinite, Second-4100000000".
+func parseTimeout(header string) time.Duration {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "Infinite" {
+			return maxLockTimeout
+		}
+		if !strings.HasPrefix(t, "Second-") {
+			continue
+		}
+		secs, err := strconv.ParseUint(t[len("Second-"):], 10, 32)
+		if err != nil {
+			continue
+		}
+		timeout := time.Duration(secs) * time.Second
+		if timeout > maxLockTimeout {
+			timeout = maxLockTimeout
+		}
+		return timeout
+	}
+	return defaultLockTimeout
+}
+
+// create takes a new lock on the file e.
+func (t *lockTable) create(ctx context.Context, e entry, exclusive bool,
+	ownerXML string, timeout time.Duration) (*davLock, error) {
+	token, err := makeLockToken()
+	if err != nil {
+		return nil, err
+	}
+	t.lock.Lock()
+	owner := t.nextOwner
+	t.nextOwner++
+	t.lock.Unlock()
+
+	l := &davLock{
+		token:     token,
+		path:      e.path,
+		node:      e.node,
+		exclusive: exclusive,
+		owner:     owner,
+		ownerXML:  ownerXML,
+		timeout:   timeout,
+	}
+	err = t.fs.config.KBFSOps().LockRange(ctx, e.node, l.rangeLock())
+	switch err.(type) {
+	case nil:
+	case libkbfs.RangeLocksUnsupportedError:
+		t.fs.log.CDebugf(ctx, "Locking %s only for WebDAV clients", e.path)
+		l.localOnly = true
+	default:
+		return nil, err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.byToken[token] = l
+	t.byPath[l.path] = append(t.byPath[l.path], l)
+	l.expiry = time.AfterFunc(timeout, func() {
+		t.fs.log.Debug("WebDAV lock %s on %s expired", l.token, l.path)
+		if err := t.release(context.Background(), l.token); err != nil {
+			t.fs.log.Debug("Couldn't release %s: %v", l.token, err)
+		}
+	})
+	return l, nil
+}
+
+// refresh restarts the timeout of the lock with the given token.
+func (t *lockTable) refresh(token string, timeout time.Duration) (
+	*davLock, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	l, ok := t.byToken[token]
+	if !ok {
+		return nil, httpError(412)
+	}
+	l.timeout = timeout
+	l.expiry.Reset(timeout)
+	return l, nil
+}
+
+// release gives up the lock with the given token.
+func (t *lockTable) release(ctx context.Context, token string) error {
+	t.lock.Lock()
+	l, ok := t.byToken[token]
+	if ok {
+		l.expiry.Stop()
+		delete(t.byToken, token)
+		locks := t.byPath[l.path]
+		for i, other := range locks {
+			if other == l {
+				locks = append(locks[:i], locks[i+1:]...)
+				break
+			}
+		}
+		if len(locks) == 0 {
+			delete(t.byPath, l.path)
+		} else {
+			t.byPath[l.path] = locks
+		}
+	}
+	t.lock.Unlock()
+	if !ok {
+		return httpError(409)
+	}
+	if l.localOnly {
+		return nil
+	}
+	return t.fs.config.KBFSOps().UnlockRange(ctx, l.node, l.rangeLock())
+}
+
+// releaseAll gives up every lock on p, which was deleted or moved.
+func (t *lockTable) releaseAll(ctx context.Context, p string) {
+	t.lock.Lock()
+	var tokens []string
+	for _, l := range t.byPath[p] {
+		tokens = append(tokens, l.token)
+	}
+	t.lock.Unlock()
+	for _, token := range tokens {
+		if err := t.release(ctx, token); err != nil {
+			t.fs.log.CDebugf(ctx, "Couldn't release %s: %v", token, err)
+		}
+	}
+}
+
+// locksOn returns the locks held on p.
+func (t *lockTable) locksOn(p string) []*davLock {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return append([]*davLock(nil), t.byPath[p]...)
+}
+
+// checkWrite returns an error unless p may be changed by a request
+// with the given If header: either no one has locked it, or the
+// request has the token of a lock on it.  Locks held elsewhere
+// through KBFS are checked too, if e is a file.
+func (t *lockTable) checkWrite(ctx context.Context, e *entry, p string,
+	ifHeader string) error {
+	locks := t.locksOn(p)
+	for _, l := range locks {
+		if strings.Contains(ifHeader, "<"+l.token+">") {
+			return nil
+		}
+	}
+	if len(locks) > 0 {
+		return httpError(statusLocked)
+	}
+	if e == nil || e.node == nil || e.isDir() {
+		// Only files can have KBFS locks.
+		return nil
+	}
+	conflict, err := t.fs.config.KBFSOps().GetRangeLockConflict(
+		ctx, e.node, libkbfs.RangeLock{
+			Type:  libkbfs.RangeLockWrite,
+			Start: 0,
+			End:   libkbfs.RangeLockToEOF,
+		})
+	switch err.(type) {
+	case nil:
+	case libkbfs.RangeLocksUnsupportedError:
+		// Without a server to coordinate with, only the locks
+		// taken here count.
+		return nil
+	default:
+		return err
+	}
+	if conflict != nil {
+		return httpError(statusLocked)
+	}
+	return nil
+}
@@ -0,0 +1,509 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libwebdav
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const davNS = "DAV:"
+
+// propNames is a list of property names in a request body.
+type propNames []xml.Name
+
+// UnmarshalXML implements the xml.Unmarshaler interface for
+// propNames, collecting the names of the children of the element.
+func (pn *propNames) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			*pn = append(*pn, t.Name)
+			if err := d.Skip(); err != nil {
+				return err
+			}
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+type propfindRequest struct {
+	XMLName  xml.Name   `xml:"DAV: propfind"`
+	AllProp  *struct{}  `xml:"DAV: allprop"`
+	PropName *struct{}  `xml:"DAV: propname"`
+	Prop     *propNames `xml:"DAV: prop"`
+}
+
+// liveProps are the properties every resource has, in the order
+// they're listed.
+var liveProps = []string{
+	"resourcetype", "displayname", "getlastmodified", "getetag",
+	"getcontentlength", "getcontenttype", "supportedlock",
+	"lockdiscovery",
+}
+
+// multistatus accumulates a 207 Multi-Status response body.
+type multistatus struct {
+	buf bytes.Buffer
+}
+
+func newMultistatus() *multistatus {
+	ms := &multistatus{}
+	ms.buf.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n")
+	ms.buf.WriteString(`<D:multistatus xmlns:D="DAV:">` + "\n")
+	return ms
+}
+
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+func href(e entry) string {
+	p := e.path
+	if e.isDir() && p != "/" {
+		p += "/"
+	}
+	return xmlEscape((&url.URL{Path: p}).EscapedPath())
+}
+
+// propElement formats a property name as an empty element.
+func propElement(name xml.Name) string {
+	if name.Space == davNS {
+		return "<D:" + name.Local + "/>"
+	}
+	return fmt.Sprintf(`<x:%s xmlns:x="%s"/>`, name.Local,
+		xmlEscape(name.Space))
+}
+
+// response adds a response for e, with propstats grouped by status.
+func (ms *multistatus) response(e entry, found []string,
+	notFound []xml.Name) {
+	fmt.Fprintf(&ms.buf, "<D:response><D:href>%s</D:href>\n", href(e))
+	if len(found) > 0 {
+		ms.buf.WriteString("<D:propstat><D:prop>")
+		for _, prop := range found {
+			ms.buf.WriteString(prop)
+		}
+		ms.buf.WriteString("</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat>\n")
+	}
+	if len(notFound) > 0 {
+		ms.buf.WriteString("<D:propstat><D:prop>")
+		for _, name := range notFound {
+			ms.buf.WriteString(propElement(name))
+		}
+		ms.buf.WriteString("</D:prop><D:status>HTTP/1.1 404 Not Found</D:status></D:propstat>\n")
+	}
+	ms.buf.WriteString("</D:response>\n")
+}
+
+func (ms *multistatus) write(w http.ResponseWriter) {
+	ms.buf.WriteString("</D:multistatus>\n")
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(statusMultiStatus)
+	w.Write(ms.buf.Bytes())
+}
+
+// lockDiscovery formats the activelock elements for locks.
+func lockDiscovery(locks []*davLock) string {
+	var buf bytes.Buffer
+	buf.WriteString("<D:lockdiscovery>")
+	for _, l := range locks {
+		scope := "shared"
+		if l.exclusive {
+			scope = "exclusive"
+		}
+		fmt.Fprintf(&buf, "<D:activelock><D:locktype><D:write/></D:locktype>"+
+			"<D:lockscope><D:%s/></D:lockscope><D:depth>0</D:depth>%s"+
+			"<D:timeout>Second-%d</D:timeout>"+
+			"<D:locktoken><D:href>%s</D:href></D:locktoken>"+
+			"</D:activelock>", scope, l.ownerXML,
+			int64(l.timeout/time.Second), l.token)
+	}
+	buf.WriteString("</D:lockdiscovery>")
+	return buf.String()
+}
+
+// prop returns the value of the DAV: property name of e, formatted as
+// an element, or "" if e doesn't have it.
+func (f *FS) prop(ctx context.Context, e entry, name string) (
+	string, error) {
+	mtime := f.startTime
+	if e.kind == kbfsKind {
+		mtime = time.Unix(0, e.ei.Mtime)
+	}
+	switch name {
+	case "resourcetype":
+		if e.isDir() {
+			return "<D:resourcetype><D:collection/></D:resourcetype>", nil
+		}
+		return "<D:resourcetype/>", nil
+	case "displayname":
+		return "<D:displayname>" + xmlEscape(path.Base(e.path)) +
+			"</D:displayname>", nil
+	case "getlastmodified":
+		return "<D:getlastmodified>" + mtime.UTC().Format(http.TimeFormat) +
+			"</D:getlastmodified>", nil
+	case "getetag":
+		etag, err := f.etag(ctx, e)
+		if err != nil {
+			return "", err
+		}
+		return "<D:getetag>" + xmlEscape(etag) + "</D:getetag>", nil
+	case "getcontentlength":
+		if e.isDir() {
+			return "", nil
+		}
+		return fmt.Sprintf("<D:getcontentlength>%d</D:getcontentlength>",
+			e.ei.Size), nil
+	case "getcontenttype":
+		if e.isDir() {
+			return "", nil
+		}
+		ct := mime.TypeByExtension(path.Ext(e.path))
+		if ct == "" {
+			ct = "application/octet-stream"
+		}
+		return "<D:getcontenttype>" + xmlEscape(ct) +
+			"</D:getcontenttype>", nil
+	case "supportedlock":
+		if e.isDir() {
+			return "<D:supportedlock/>", nil
+		}
+		return "<D:supportedlock>" +
+			"<D:lockentry><D:lockscope><D:exclusive/></D:lockscope>" +
+			"<D:locktype><D:write/></D:locktype></D:lockentry>" +
+			"<D:lockentry><D:lockscope><D:shared/></D:lockscope>" +
+			"<D:locktype><D:write/></D:locktype></D:lockentry>" +
+			"</D:supportedlock>", nil
+	case "lockdiscovery":
+		return lockDiscovery(f.locks.locksOn(e.path)), nil
+	}
+	return "", nil
+}
+
+// propfindEntry adds the response for e to ms.
+func (f *FS) propfindEntry(ctx context.Context, ms *multistatus, e entry,
+	req propfindRequest) error {
+	var found []string
+	var notFound []xml.Name
+	switch {
+	case req.PropName != nil:
+		for _, name := range liveProps {
+			found = append(found, "<D:"+name+"/>")
+		}
+	case req.Prop != nil:
+		for _, name := range *req.Prop {
+			var value string
+			if name.Space == davNS {
+				var err error
+				value, err = f.prop(ctx, e, name.Local)
+				if err != nil {
+					return err
+				}
+			}
+			if value == "" {
+				notFound = append(notFound, name)
+			} else {
+				found = append(found, value)
+			}
+		}
+	default:
+		for _, name := range liveProps {
+			value, err := f.prop(ctx, e, name)
+			if err != nil {
+				return err
+			}
+			if value != "" {
+				found = append(found, value)
+			}
+		}
+	}
+	ms.response(e, found, notFound)
+	return nil
+}
+
+func (f *FS) propfind(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, p string) error {
+	depth := r.Header.Get("Depth")
+	if depth != "0" && depth != "1" {
+		// Listing a whole tree could mean loading every TLF.
+		return httpError(http.StatusForbidden)
+	}
+	var req propfindRequest
+	err := xml.NewDecoder(r.Body).Decode(&req)
+	if err != nil && err != io.EOF {
+		return httpError(http.StatusBadRequest)
+	}
+
+	e, err := f.resolve(ctx, p)
+	if err != nil {
+		return err
+	}
+	ms := newMultistatus()
+	if err := f.propfindEntry(ctx, ms, e, req); err != nil {
+		return err
+	}
+	if depth == "1" && e.isDir() {
+		entries, err := f.readDir(ctx, e)
+		if err != nil {
+			return err
+		}
+		for _, child := range entries {
+			if err := f.propfindEntry(ctx, ms, child, req); err != nil {
+				return err
+			}
+		}
+	}
+	ms.write(w)
+	return nil
+}
+
+// proppatchRequest is a PROPPATCH body; only the names of the
+// properties in it matter.
+type proppatchRequest struct {
+	XMLName xml.Name `xml:"DAV: propertyupdate"`
+	Set     []struct {
+		Prop propValues `xml:"DAV: prop"`
+	} `xml:"DAV: set"`
+	Remove []struct {
+		Prop propNames `xml:"DAV: prop"`
+	} `xml:"DAV: remove"`
+}
+
+// propValues is a list of properties and their text values.
+type propValues []struct {
+	name  xml.Name
+	value string
+}
+
+// UnmarshalXML implements the xml.Unmarshaler interface for
+// propValues.
+func (pv *propValues) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			var value struct {
+				Text string `xml:",chardata"`
+			}
+			if err := d.DecodeElement(&value, &t); err != nil {
+				return err
+			}
+			*pv = append(*pv, struct {
+				name  xml.Name
+				value string
+			}{t.Name, strings.TrimSpace(value.Text)})
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+// win32LastModifiedTime is the property Windows sets the mtime of a
+// copied file with.
+var win32LastModifiedTime = xml.Name{
+	Space: "urn:schemas-microsoft-com:", Local: "Win32LastModifiedTime"}
+
+// proppatch sets the mtime when asked to, and refuses to set any
+// other property, since KBFS has nowhere to keep dead properties.
+func (f *FS) proppatch(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, p string) error {
+	var req proppatchRequest
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		return httpError(http.StatusBadRequest)
+	}
+	e, err := f.resolve(ctx, p)
+	if err != nil {
+		return err
+	}
+	if err := f.locks.checkWrite(ctx, &e, e.path, r.Header.Get("If")); err != nil {
+		return err
+	}
+
+	var ok, forbidden []xml.Name
+	for _, set := range req.Set {
+		for _, prop := range set.Prop {
+			if prop.name != win32LastModifiedTime || e.node == nil {
+				forbidden = append(forbidden, prop.name)
+				continue
+			}
+			mtime, err := http.ParseTime(prop.value)
+			if err != nil {
+				forbidden = append(forbidden, prop.name)
+				continue
+			}
+			err = f.config.KBFSOps().SetMtime(ctx, e.node, &mtime)
+			if err != nil {
+				return err
+			}
+			ok = append(ok, prop.name)
+		}
+	}
+	for _, remove := range req.Remove {
+		forbidden = append(forbidden, remove.Prop...)
+	}
+
+	ms := newMultistatus()
+	fmt.Fprintf(&ms.buf, "<D:response><D:href>%s</D:href>\n", href(e))
+	for _, group := range []struct {
+		names  []xml.Name
+		status string
+	}{{ok, "200 OK"}, {forbidden, "403 Forbidden"}} {
+		if len(group.names) == 0 {
+			continue
+		}
+		ms.buf.WriteString("<D:propstat><D:prop>")
+		for _, name := range group.names {
+			ms.buf.WriteString(propElement(name))
+		}
+		fmt.Fprintf(&ms.buf, "</D:prop><D:status>HTTP/1.1 %s</D:status>"+
+			"</D:propstat>\n", group.status)
+	}
+	ms.buf.WriteString("</D:response>\n")
+	ms.write(w)
+	return nil
+}
+
+// lockInfo is a LOCK request body.
+type lockInfo struct {
+	XMLName   xml.Name  `xml:"DAV: lockinfo"`
+	Exclusive *struct{} `xml:"DAV: lockscope>exclusive"`
+	Shared    *struct{} `xml:"DAV: lockscope>shared"`
+	Owner     struct {
+		InnerXML string `xml:",innerxml"`
+	} `xml:"DAV: owner"`
+}
+
+// lockTokenFromIf returns the first lock token in an If header.
+func lockTokenFromIf(header string) string {
+	start := strings.Index(header, "<opaquelocktoken:")
+	if start < 0 {
+		return ""
+	}
+	end := strings.Index(header[start:], ">")
+	if end < 0 {
+		return ""
+	}
+	return header[start+1 : start+end]
+}
+
+func writeLockResponse(w http.ResponseWriter, l *davLock, status int) {
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Header().Set("Lock-Token", "<"+l.token+">")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>`+"\n"+
+		`<D:prop xmlns:D="DAV:">%s</D:prop>`+"\n",
+		lockDiscovery([]*davLock{l}))
+}
+
+// lock takes or refreshes a write lock on a file.  Locks are backed
+// by KBFS advisory locks, which only cover files, so collections
+// can't be locked.
+func (f *FS) lock(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, p string) error {
+	timeout := parseTimeout(r.Header.Get("Timeout"))
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		// A refresh of an existing lock.
+		l, err := f.locks.refresh(lockTokenFromIf(r.Header.Get("If")), timeout)
+		if err != nil {
+			return err
+		}
+		writeLockResponse(w, l, http.StatusOK)
+		return nil
+	}
+	var info lockInfo
+	if err := xml.Unmarshal(body, &info); err != nil {
+		return httpError(http.StatusBadRequest)
+	}
+	ownerXML := ""
+	if info.Owner.InnerXML != "" {
+		ownerXML = "<D:owner>" + info.Owner.InnerXML + "</D:owner>"
+	}
+
+	status := http.StatusOK
+	existing, err := f.resolveIfExists(ctx, p)
+	if err != nil {
+		return err
+	}
+	e := entry{}
+	if existing != nil {
+		e = *existing
+	} else {
+		// Locking a name that doesn't exist makes an empty file,
+		// which clients then PUT into.
+		dir, name, err := f.resolveParent(ctx, p)
+		if err != nil {
+			return err
+		}
+		if dir.node == nil {
+			return httpError(http.StatusForbidden)
+		}
+		node, ei, err := f.config.KBFSOps().CreateFile(
+			ctx, dir.node, name, false, libkbfs.WithExcl)
+		if err != nil {
+			return err
+		}
+		e = entry{path: path.Join(dir.path, name), kind: kbfsKind,
+			public: dir.public, node: node, ei: ei}
+		status = http.StatusCreated
+	}
+	if e.isDir() {
+		return httpError(http.StatusForbidden)
+	}
+	// A new lock can't be taken where there's already an exclusive
+	// one, or where there's a shared one and it's to be exclusive.
+	exclusive := info.Shared == nil
+	for _, other := range f.locks.locksOn(e.path) {
+		if exclusive || other.exclusive {
+			return httpError(statusLocked)
+		}
+	}
+
+	l, err := f.locks.create(ctx, e, exclusive, ownerXML, timeout)
+	if err != nil {
+		return err
+	}
+	writeLockResponse(w, l, status)
+	return nil
+}
+
+func (f *FS) unlock(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, p string) error {
+	token := strings.Trim(r.Header.Get("Lock-Token"), "<> ")
+	if token == "" {
+		return httpError(http.StatusBadRequest)
+	}
+	if err := f.locks.release(ctx, token); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libwebdav
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// StartOptions are options for starting up
+type StartOptions struct {
+	KbfsParams libkbfs.InitParams
+	// ListenAddr is the TCP address to serve WebDAV on.
+	ListenAddr string
+	// Access says who may make requests.  Clients that have the
+	// password see KBFS as the logged-in user does.
+	Access AccessOptions
+}
+
+// Start the WebDAV server, and serve until interrupted.
+func Start(options StartOptions, kbCtx libkbfs.Context) *libfs.Error {
+	// InitLog errors are non-fatal and are ignored.
+	log, err := libkbfs.InitLog(options.KbfsParams, kbCtx)
+	if err != nil {
+		return libfs.InitError(err.Error())
+	}
+
+	log.Debug("Listening on %s", options.ListenAddr)
+	l, err := net.Listen("tcp", options.ListenAddr)
+	if err != nil {
+		return libfs.MountError(err.Error())
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	onInterruptFn := func() {
+		cancel()
+		libkbfs.Shutdown()
+	}
+
+	log.Debug("Initializing")
+
+	config, err := libkbfs.Init(kbCtx, options.KbfsParams, nil, onInterruptFn, log)
+	if err != nil {
+		return libfs.InitError(err.Error())
+	}
+
+	defer libkbfs.Shutdown()
+
+	log.Debug("Serving filesystem")
+	server := &http.Server{Handler: NewFS(config, options.Access)}
+	go func() {
+		<-ctx.Done()
+		// Closing the listener makes Serve return.
+		l.Close()
+	}()
+	if err := server.Serve(l); err != nil && ctx.Err() == nil {
+		return libfs.MountError(err.Error())
+	}
+
+	log.Debug("Ending")
+	return nil
+}
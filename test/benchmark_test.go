@@ -127,6 +127,71 @@ func benchmarkReadSeqHoleN(b *testing.B, n int64, mask int64) {
 	)
 }
 
+// BenchmarkReadCached8mb4k reads sequentially, in 4k reads, from an
+// 8mb file whose blocks are all cached.
+func BenchmarkReadCached8mb4k(b *testing.B) {
+	benchmarkReadSeqCachedN(b, 4*1024, 0x7FFFFF)
+}
+func BenchmarkReadCached8mb64k(b *testing.B) {
+	benchmarkReadSeqCachedN(b, 64*1024, 0x7FFFFF)
+}
+func BenchmarkReadCached8mb128k(b *testing.B) {
+	benchmarkReadSeqCachedN(b, 128*1024, 0x7FFFFF)
+}
+func BenchmarkReadCached8mb512k(b *testing.B) {
+	benchmarkReadSeqCachedN(b, 512*1024, 0x7FFFFF)
+}
+
+func benchmarkReadSeqCachedN(b *testing.B, n int64, mask int64) {
+	// Every read sees the same repeating pattern, since n is a
+	// multiple of its period.
+	pattern := func(n int64) []byte {
+		buf := make([]byte, n)
+		for i := range buf {
+			buf[i] = byte(i)
+		}
+		return buf
+	}
+	buf := pattern(n)
+	b.SetBytes(n)
+	test(silentBenchmark{b},
+		users("alice"),
+		as(alice,
+			custom(func(cb func(fileOp) error) error {
+				err := cb(mkfile("bench", ""))
+				if err != nil {
+					return err
+				}
+				// Write real data, so the reads come from cached
+				// blocks rather than holes, and read it all once
+				// to make sure it's cached.
+				data := pattern(512 * 1024)
+				for off := int64(0); off <= mask; off += int64(len(data)) {
+					err = cb(pwriteBS("bench", data, off))
+					if err != nil {
+						return err
+					}
+				}
+				for off := int64(0); off <= mask; off += int64(len(data)) {
+					err = cb(preadBS("bench", data, off))
+					if err != nil {
+						return err
+					}
+				}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					err = cb(preadBS("bench", buf, (int64(i)*n)&mask))
+					if err != nil {
+						return err
+					}
+				}
+				b.StopTimer()
+				return nil
+			}),
+		),
+	)
+}
+
 func benchmarkDoBenchWrites(b *testing.B, cb func(fileOp) error,
 	numWritesPerFile int, buf []byte, startIter int) error {
 	for i := startIter; i < b.N+startIter; i++ {
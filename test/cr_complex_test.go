@@ -874,3 +874,68 @@ func TestCrConflictMoveAndSetMtimeWrittenFile(t *testing.T) {
 		),
 	)
 }
+
+// alice creates and removes a file in a new directory, while bob
+// creates the same directory with two files in it
+func TestCrBothCreateDirUnmergedCreatesTwoFiles(t *testing.T) {
+	test(t,
+		users("alice", "bob"),
+		as(alice,
+			mkfile("b/c", "hello"),
+		),
+		as(bob,
+			disableUpdates(),
+		),
+		as(alice,
+			mkfile("a/b", "world"),
+			rm("a/b"),
+		),
+		as(bob, noSync(),
+			mkfile("a/b", "goodbye"),
+			mkfile("a/c", "again"),
+			reenableUpdates(),
+			lsdir("a/", m{"b$": "FILE", "c$": "FILE"}),
+			read("a/b", "goodbye"),
+			read("a/c", "again"),
+		),
+		as(alice,
+			lsdir("a/", m{"b$": "FILE", "c$": "FILE"}),
+			read("a/b", "goodbye"),
+			read("a/c", "again"),
+		),
+	)
+}
+
+// alice creates and removes a file in a new directory, while bob
+// creates the same directory and moves a file into it
+func TestCrBothCreateDirUnmergedMovesFileIn(t *testing.T) {
+	test(t,
+		users("alice", "bob"),
+		as(alice,
+			mkfile("b/c", "hello"),
+		),
+		as(bob,
+			disableUpdates(),
+		),
+		as(alice,
+			mkfile("a/b", "world"),
+			rm("a/b"),
+		),
+		as(bob, noSync(),
+			mkfile("d", "again"),
+			mkfile("a/b", "goodbye"),
+			rename("d", "a/c"),
+			reenableUpdates(),
+			lsdir("", m{"a$": "DIR", "b$": "DIR"}),
+			lsdir("a/", m{"b$": "FILE", "c$": "FILE"}),
+			read("a/b", "goodbye"),
+			read("a/c", "again"),
+		),
+		as(alice,
+			lsdir("", m{"a$": "DIR", "b$": "DIR"}),
+			lsdir("a/", m{"b$": "FILE", "c$": "FILE"}),
+			read("a/b", "goodbye"),
+			read("a/c", "again"),
+		),
+	)
+}
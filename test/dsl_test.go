@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"fmt"
 	"path"
+	"reflect"
 	"regexp"
 	"sort"
 	"strings"
@@ -46,6 +47,25 @@ type opt struct {
 	clock                    *libkbfs.TestClock
 	isParallel               bool
 	journal                  bool
+	// numDevices is how many devices each user starts out with, if
+	// more than one.
+	numDevices map[libkb.NormalizedUsername]int
+
+	// devicesLock protects the fields below it.
+	devicesLock sync.Mutex
+	// extraDevices are the devices of each user beyond the first,
+	// which is in users.
+	extraDevices map[libkb.NormalizedUsername][]device
+	// partitioned holds the devices cut off from the servers, and
+	// the root nodes they had then, since they can't look them up
+	// again.
+	partitioned map[User]Node
+}
+
+// device is one of a user's devices, beyond the first.
+type device struct {
+	user    User
+	staller *libkbfs.NaïveStaller
 }
 
 func test(t testing.TB, actions ...optionOp) {
@@ -83,6 +103,15 @@ func sequential(actions ...optionOp) optionOp {
 }
 
 func (o *opt) close() {
+	// Shutting down checks the state against the servers.
+	for u := range o.partitioned {
+		o.expectSuccess("Reconnect", o.engine.SetPartitioned(u, false))
+	}
+	for _, devices := range o.extraDevices {
+		for _, d := range devices {
+			o.expectSuccess("Shutdown", o.engine.Shutdown(d.user))
+		}
+	}
 	for _, user := range o.users {
 		o.expectSuccess("Shutdown", o.engine.Shutdown(user))
 	}
@@ -95,9 +124,93 @@ func (o *opt) runInitOnce() {
 		o.users = o.engine.InitTest(o.t, o.blockSize, o.blockChangeSize,
 			o.bwKBps, o.timeout, o.usernames, o.clock, o.journal)
 		o.stallers = o.makeStallers()
+		for _, u := range o.usernames {
+			for i := 1; i < o.numDevices[u]; i++ {
+				o.addDevice(u)
+			}
+		}
 	})
 }
 
+func (o *opt) addDevice(u libkb.NormalizedUsername) {
+	user, err := o.engine.AddDevice(o.users[u])
+	o.expectSuccess("AddDevice", err)
+	if err != nil {
+		return
+	}
+	o.devicesLock.Lock()
+	defer o.devicesLock.Unlock()
+	if o.extraDevices == nil {
+		o.extraDevices = make(map[libkb.NormalizedUsername][]device)
+	}
+	o.extraDevices[u] = append(o.extraDevices[u],
+		device{user, o.engine.MakeNaïveStaller(user)})
+}
+
+// device returns the handle and staller of the given device of the
+// given user, where device 0 is the one the user started out with.
+func (o *opt) device(u libkb.NormalizedUsername, i int) (
+	User, *libkbfs.NaïveStaller) {
+	if i == 0 {
+		return o.users[u], o.stallers[u]
+	}
+	o.devicesLock.Lock()
+	defer o.devicesLock.Unlock()
+	if i > len(o.extraDevices[u]) {
+		o.t.Fatalf("User %s has no device %d", u, i)
+	}
+	d := o.extraDevices[u][i-1]
+	return d.user, d.staller
+}
+
+// allDevices returns every device of every user, with names for
+// them, in a stable order.
+func (o *opt) allDevices() (names []string, devices []User) {
+	o.devicesLock.Lock()
+	defer o.devicesLock.Unlock()
+	for _, u := range o.usernames {
+		names = append(names, u.String())
+		devices = append(devices, o.users[u])
+		for i, d := range o.extraDevices[u] {
+			names = append(names, fmt.Sprintf("%s device %d", u, i+1))
+			devices = append(devices, d.user)
+		}
+	}
+	return names, devices
+}
+
+func (o *opt) setPartitioned(u User, partitioned bool, root Node) error {
+	err := o.engine.SetPartitioned(u, partitioned)
+	if err != nil {
+		return err
+	}
+	o.devicesLock.Lock()
+	defer o.devicesLock.Unlock()
+	if o.partitioned == nil {
+		o.partitioned = make(map[User]Node)
+	}
+	if partitioned {
+		o.partitioned[u] = root
+	} else {
+		delete(o.partitioned, u)
+	}
+	return nil
+}
+
+// partitionedRoot returns whether the device is cut off from the
+// servers, and if so, its root node.
+func (o *opt) partitionedRoot(u User) (Node, bool) {
+	o.devicesLock.Lock()
+	defer o.devicesLock.Unlock()
+	root, ok := o.partitioned[u]
+	return root, ok
+}
+
+func (o *opt) isPartitioned(u User) bool {
+	_, ok := o.partitionedRoot(u)
+	return ok
+}
+
 func (o *opt) makeStallers() (
 	stallers map[libkb.NormalizedUsername]*libkbfs.NaïveStaller) {
 	stallers = make(map[libkb.NormalizedUsername]*libkbfs.NaïveStaller)
@@ -170,6 +283,27 @@ func users(ns ...username) optionOp {
 	}
 }
 
+// devices makes the given user start out with n devices.  as acts on
+// the first one; asDevice acts on any of them.
+func devices(u username, n int) optionOp {
+	return func(o *opt) {
+		if o.numDevices == nil {
+			o.numDevices = make(map[libkb.NormalizedUsername]int)
+		}
+		o.numDevices[libkb.NewNormalizedUsername(string(u))] = n
+	}
+}
+
+// addDevice adds a new device for the given user, after the ones it
+// already has.  Existing TLFs need a rekey before the new device can
+// read them.
+func addDevice(u username) optionOp {
+	return func(o *opt) {
+		o.runInitOnce()
+		o.addDevice(libkb.NewNormalizedUsername(string(u)))
+	}
+}
+
 func inPrivateTlf(name string) optionOp {
 	return func(o *opt) {
 		o.tlfName = name
@@ -284,15 +418,18 @@ func addTime(d time.Duration) fileOp {
 }
 
 func as(user username, fops ...fileOp) optionOp {
+	return asDevice(user, 0, fops...)
+}
+
+// asDevice is like as, on the given device of the user, where device
+// 0 is the one the user started out with.
+func asDevice(user username, dev int, fops ...fileOp) optionOp {
 	return func(o *opt) {
-		o.t.Log("as", user)
+		o.t.Log("as", user, "device", dev)
 		o.runInitOnce()
 		u := libkb.NewNormalizedUsername(string(user))
-		ctx := &ctx{
-			opt:     o,
-			user:    o.users[u],
-			staller: o.stallers[u],
-		}
+		ctx := &ctx{opt: o}
+		ctx.user, ctx.staller = o.device(u, dev)
 
 		for _, fop := range fops {
 			desc, err := runFileOp(ctx, fop)
@@ -305,6 +442,12 @@ func as(user username, fops ...fileOp) optionOp {
 // not called directly.
 func initRoot() fileOp {
 	return fileOp{func(c *ctx) error {
+		// A device cut off from the servers can only use what it
+		// already has.
+		if root, ok := c.partitionedRoot(c.user); ok {
+			c.rootNode = root
+			return nil
+		}
 		if !c.noSyncInit {
 			// Do this before GetRootDir so that we pick
 			// up any TLF name changes.
@@ -607,6 +750,134 @@ func flushJournal() fileOp {
 	}, IsInit}
 }
 
+// disconnect cuts the device off from the servers, as in a network
+// partition, until reconnect is called.
+func disconnect() fileOp {
+	return fileOp{func(c *ctx) error {
+		return c.setPartitioned(c.user, true, c.rootNode)
+	}, Defaults}
+}
+
+// reconnect undoes disconnect.
+func reconnect() fileOp {
+	return fileOp{func(c *ctx) error {
+		return c.setPartitioned(c.user, false, nil)
+	}, Defaults}
+}
+
+// clockSkew makes the clock of the device run ahead of the shared
+// test clock by d, or behind it if d is negative.
+func clockSkew(d time.Duration) fileOp {
+	return fileOp{func(c *ctx) error {
+		return c.engine.SetClockSkew(c.user, d)
+	}, Defaults}
+}
+
+const (
+	convergedAttempts   = 50
+	convergedRetryDelay = 100 * time.Millisecond
+)
+
+// converged checks that all devices of all users end up seeing the
+// same contents in the TLF, once each has flushed its journal and
+// caught up with the server.  It tries again for a while, since
+// conflict resolution and journal flushes happen in the background.
+// All devices must be connected.
+func converged() optionOp {
+	return func(o *opt) {
+		o.t.Log("converged")
+		o.runInitOnce()
+		names, devices := o.allDevices()
+		for i, u := range devices {
+			if o.isPartitioned(u) {
+				o.t.Fatalf("Can't converge while %s is disconnected",
+					names[i])
+			}
+		}
+		var err error
+		for i := 0; i < convergedAttempts; i++ {
+			if i > 0 {
+				o.t.Logf("Not converged yet: %v", err)
+				time.Sleep(convergedRetryDelay)
+			}
+			if err = o.checkConverged(names, devices); err == nil {
+				return
+			}
+		}
+		o.expectSuccess("converged", err)
+	}
+}
+
+func (o *opt) checkConverged(names []string, devices []User) error {
+	var first map[string]string
+	for i, u := range devices {
+		err := o.engine.SyncFromServerForTesting(u, o.tlfName, o.tlfIsPublic)
+		if err != nil {
+			return fmt.Errorf("%s: %v", names[i], err)
+		}
+		root, err := o.engine.GetRootDir(
+			u, o.tlfName, o.tlfIsPublic, o.expectedCanonicalTlfName)
+		if err != nil {
+			return fmt.Errorf("%s: %v", names[i], err)
+		}
+		contents := make(map[string]string)
+		err = o.readTree(u, root, "", contents)
+		if err != nil {
+			return fmt.Errorf("%s: %v", names[i], err)
+		}
+		if i == 0 {
+			first = contents
+		} else if !reflect.DeepEqual(first, contents) {
+			return fmt.Errorf("%s sees %v, but %s sees %v",
+				names[0], first, names[i], contents)
+		}
+	}
+	return nil
+}
+
+// readTree fills contents with the type, and the contents or link
+// target, of every entry under dir, by path.
+func (o *opt) readTree(
+	u User, dir Node, dirPath string, contents map[string]string) error {
+	children, err := o.engine.GetDirChildrenTypes(u, dir)
+	if err != nil {
+		return err
+	}
+	for name, typ := range children {
+		p := path.Join(dirPath, name)
+		node, symPath, err := o.engine.Lookup(u, dir, name)
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case "DIR":
+			contents[p] = typ
+			err = o.readTree(u, node, p, contents)
+		case "SYM":
+			contents[p] = typ + " " + symPath
+		default:
+			var buf bytes.Buffer
+			data := make([]byte, 4096)
+			for {
+				n, err := o.engine.ReadFile(
+					u, node, int64(buf.Len()), data)
+				if err != nil {
+					return err
+				}
+				if n == 0 {
+					break
+				}
+				buf.Write(data[:n])
+			}
+			contents[p] = typ + " " + buf.String()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func lsfavoritesOp(c *ctx, expected []string, public bool) error {
 	favorites, err := c.engine.GetFavorites(c.user, public)
 	if err != nil {
@@ -786,9 +1057,23 @@ func (c *ctx) getNode(filepath string, create createType, sym symBehavior) (
 // crnameAtTime returns the name of a conflict file, at a given
 // duration past the default time.
 func crnameAtTime(path string, user username, d time.Duration) string {
+	return crnameAtTimeOnDevice(path, user, "dev1", d)
+}
+
+// crnameAtTimeOnDevice returns the name of a conflict file made on
+// the named device, at a given duration past the default time.
+func crnameAtTimeOnDevice(
+	path string, user username, device string, d time.Duration) string {
 	cre := libkbfs.WriterDeviceDateConflictRenamer{}
 	return cre.ConflictRenameHelper(time.Unix(0, 0).Add(d), string(user),
-		"dev1", path)
+		device, path)
+}
+
+// crnameAtTimeOnDeviceEsc is crnameAtTimeOnDevice with regular
+// expression escapes.
+func crnameAtTimeOnDeviceEsc(
+	path string, user username, device string, d time.Duration) string {
+	return regexp.QuoteMeta(crnameAtTimeOnDevice(path, user, device, d))
 }
 
 // crnameAtTimeEsc returns the name of a conflict file with regular
@@ -130,6 +130,20 @@ type Engine interface {
 	// FlushJournal is called by the test harness as the given
 	// user to wait for the journal to flush, if enabled.
 	FlushJournal(u User, tlfName string, isPublic bool) (err error)
+	// AddDevice is called by the test harness to add a new device
+	// for the given user, which all the existing users and devices
+	// learn about.  It returns a handle for the user on the new
+	// device, which shares the servers and clock of the others.
+	AddDevice(u User) (User, error)
+	// SetPartitioned is called by the test harness to cut the given
+	// user's device off from the servers, or to reconnect it.
+	// While cut off, calls that need the servers fail right away,
+	// as in offline mode.
+	SetPartitioned(u User, partitioned bool) error
+	// SetClockSkew is called by the test harness to make the clock
+	// of the given user's device run ahead of the shared test clock
+	// by skew, or behind it if skew is negative.
+	SetClockSkew(u User, skew time.Duration) error
 	// Shutdown is called by the test harness when it is done with the
 	// given user.
 	Shutdown(u User) error
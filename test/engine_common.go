@@ -5,9 +5,13 @@
 package test
 
 import (
+	"fmt"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
 )
 
 func setBlockSizes(t testing.TB, config libkbfs.Config, blockSize, blockChangeSize int64) {
@@ -41,3 +45,67 @@ func maybeSetBw(t testing.TB, config libkbfs.Config, bwKBps int) {
 		config.SetDoBackgroundFlushes(true)
 	}
 }
+
+// makePartitionable wraps the servers of config so that calls to them
+// fail while config is offline, which is how the test harness cuts a
+// device off from the servers.  It must be called before journaling
+// is enabled, since the journal keeps the block server it's given.
+func makePartitionable(config *libkbfs.ConfigLocal) {
+	config.SetMDServer(
+		libkbfs.NewMDServerOffline(config, config.MDServer()))
+	config.SetBlockServer(
+		libkbfs.NewBlockServerOffline(config, config.BlockServer()))
+}
+
+// addDeviceConfig registers a new device, for the user config is
+// logged in as, with each of configs, and returns a new config logged
+// in as that device.  If journalDir isn't empty, the new config
+// journals into its own directory under it.
+func addDeviceConfig(t testing.TB, config *libkbfs.ConfigLocal,
+	configs []*libkbfs.ConfigLocal, clock libkbfs.Clock,
+	journalDir string) (*libkbfs.ConfigLocal, error) {
+	name, uid, err := config.KBPKI().GetCurrentUserInfo(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	// Every config has its own copy of the users and their devices,
+	// kept in step, so the new device gets the same index in all of
+	// them.
+	var index int
+	for _, c := range configs {
+		index = libkbfs.AddDeviceForLocalUserOrBust(t, c, uid)
+	}
+
+	c := libkbfs.ConfigAsUser(config, name)
+	libkbfs.SwitchDeviceForLocalUserOrBust(t, c, index)
+	c.SetClock(clock)
+	makePartitionable(c)
+	if journalDir != "" {
+		c.EnableJournaling(
+			filepath.Join(journalDir, fmt.Sprintf("%s.%d", name, index)))
+	}
+	return c, nil
+}
+
+// skewedClock is a Clock running ahead of another one by skew, or
+// behind it if skew is negative, like that of a device whose clock is
+// set wrong.
+type skewedClock struct {
+	libkbfs.Clock
+	skew time.Duration
+}
+
+// Now implements the Clock interface for skewedClock.
+func (c skewedClock) Now() time.Time {
+	return c.Clock.Now().Add(c.skew)
+}
+
+// journalDirOf returns the directory config journals into, or "" if
+// it doesn't journal.
+func journalDirOf(config libkbfs.Config) string {
+	jServer, err := libkbfs.GetJournalServer(config)
+	if err != nil {
+		return ""
+	}
+	return jServer.Status().RootDir
+}
@@ -35,6 +35,12 @@ type fsEngine struct {
 	createUser createUserFn
 	// journal directory
 	journalDir string
+	// the clock shared by all users, before any skew
+	clock libkbfs.Clock
+	// opTimeout is passed to createUser for new devices
+	opTimeout time.Duration
+	// configs of all the users and devices, for adding devices
+	configs []*libkbfs.ConfigLocal
 }
 type fsNode struct {
 	path string
@@ -356,6 +362,34 @@ func (*fsEngine) FlushJournal(user User, tlfName string,
 		[]byte("on"), 0644)
 }
 
+// AddDevice is called by the test harness to add a new device for
+// the given user, mounted like the other users.
+func (e *fsEngine) AddDevice(user User) (User, error) {
+	u := user.(*fsUser)
+	c, err := addDeviceConfig(e.t, u.config, e.configs, e.clock, e.journalDir)
+	if err != nil {
+		return nil, err
+	}
+	e.configs = append(e.configs, c)
+	return e.createUser(e.t, len(e.configs)-1, c, e.opTimeout), nil
+}
+
+// SetPartitioned is called by the test harness to cut the given
+// user's device off from the servers, or to reconnect it.
+func (*fsEngine) SetPartitioned(user User, partitioned bool) error {
+	u := user.(*fsUser)
+	u.config.SetOffline(partitioned)
+	return nil
+}
+
+// SetClockSkew is called by the test harness to skew the clock of the
+// given user's device.
+func (e *fsEngine) SetClockSkew(user User, skew time.Duration) error {
+	u := user.(*fsUser)
+	u.config.SetClock(skewedClock{e.clock, skew})
+	return nil
+}
+
 // Shutdown is called by the test harness when it is done with the
 // given user.
 func (e *fsEngine) Shutdown(user User) error {
@@ -363,25 +397,16 @@ func (e *fsEngine) Shutdown(user User) error {
 	u.cancel()
 	u.close()
 
-	// Get the user name before shutting everything down.
-	var userName libkb.NormalizedUsername
-	if e.journalDir != "" {
-		var err error
-		userName, _, err =
-			u.config.KBPKI().GetCurrentUserInfo(context.Background())
-		if err != nil {
-			return err
-		}
-	}
+	// Get the journal directory before shutting everything down.
+	journalDir := journalDirOf(u.config)
 
 	if err := u.config.Shutdown(); err != nil {
 		return err
 	}
 
-	if e.journalDir != "" {
+	if journalDir != "" {
 		// Remove the user journal.
-		if err := os.RemoveAll(
-			filepath.Join(e.journalDir, userName.String())); err != nil {
+		if err := os.RemoveAll(journalDir); err != nil {
 			return err
 		}
 		// Remove the overall journal dir if it's empty.
@@ -480,6 +505,9 @@ func (e *fsEngine) InitTest(t testing.TB, blockSize int64,
 		t.Logf("Ignoring op timeout for FS test")
 	}
 
+	e.clock = clock
+	e.opTimeout = opTimeout
+
 	// create the first user specially
 	config0 := libkbfs.MakeTestConfigOrBust(t, users...)
 	config0.SetClock(clock)
@@ -498,8 +526,10 @@ func (e *fsEngine) InitTest(t testing.TB, blockSize int64,
 	}
 
 	for i, name := range users {
+		makePartitionable(cfgs[i])
 		res[name] = e.createUser(t, i, cfgs[i], opTimeout)
 	}
+	e.configs = cfgs
 
 	if journal {
 		jdir, err := ioutil.TempDir(os.TempDir(), "kbfs_journal")
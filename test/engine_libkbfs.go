@@ -31,6 +31,8 @@ type LibKBFS struct {
 	opTimeout time.Duration
 	// journal directory
 	journalDir string
+	// the clock shared by all users, before any skew
+	clock libkbfs.Clock
 }
 
 // Check that LibKBFS fully implements the Engine interface.
@@ -63,6 +65,7 @@ func (k *LibKBFS) InitTest(t testing.TB, blockSize int64, blockChangeSize int64,
 	setBlockSizes(t, config, blockSize, blockChangeSize)
 	maybeSetBw(t, config, bwKBps)
 	k.opTimeout = opTimeout
+	k.clock = clock
 
 	config.SetClock(clock)
 	userMap[users[0]] = config
@@ -78,6 +81,10 @@ func (k *LibKBFS) InitTest(t testing.TB, blockSize int64, blockChangeSize int64,
 		k.updateChannels[c] = make(map[libkbfs.FolderBranch]chan<- struct{})
 	}
 
+	for _, c := range userMap {
+		makePartitionable(c.(*libkbfs.ConfigLocal))
+	}
+
 	if journal {
 		jdir, err := ioutil.TempDir(os.TempDir(), "kbfs_journal")
 		if err != nil {
@@ -645,6 +652,36 @@ func (k *LibKBFS) FlushJournal(u User, tlfName string, isPublic bool) error {
 	return jServer.Flush(ctx, dir.GetFolderBranch().Tlf)
 }
 
+// AddDevice implements the Engine interface.
+func (k *LibKBFS) AddDevice(u User) (User, error) {
+	config := u.(*libkbfs.ConfigLocal)
+	configs := make([]*libkbfs.ConfigLocal, 0, len(k.refs))
+	for c := range k.refs {
+		configs = append(configs, c.(*libkbfs.ConfigLocal))
+	}
+	c, err := addDeviceConfig(k.t, config, configs, k.clock, k.journalDir)
+	if err != nil {
+		return nil, err
+	}
+	k.refs[c] = make(map[libkbfs.Node]bool)
+	k.updateChannels[c] = make(map[libkbfs.FolderBranch]chan<- struct{})
+	return c, nil
+}
+
+// SetPartitioned implements the Engine interface.
+func (k *LibKBFS) SetPartitioned(u User, partitioned bool) error {
+	config := u.(*libkbfs.ConfigLocal)
+	config.SetOffline(partitioned)
+	return nil
+}
+
+// SetClockSkew implements the Engine interface.
+func (k *LibKBFS) SetClockSkew(u User, skew time.Duration) error {
+	config := u.(*libkbfs.ConfigLocal)
+	config.SetClock(skewedClock{k.clock, skew})
+	return nil
+}
+
 // Shutdown implements the Engine interface.
 func (k *LibKBFS) Shutdown(u User) error {
 	config := u.(*libkbfs.ConfigLocal)
@@ -655,26 +692,17 @@ func (k *LibKBFS) Shutdown(u User) error {
 	k.updateChannels[config] = make(map[libkbfs.FolderBranch]chan<- struct{})
 	delete(k.updateChannels, config)
 
-	// Get the user name before shutting everything down.
-	var userName libkb.NormalizedUsername
-	if k.journalDir != "" {
-		var err error
-		userName, _, err =
-			config.KBPKI().GetCurrentUserInfo(context.Background())
-		if err != nil {
-			return err
-		}
-	}
+	// Get the journal directory before shutting everything down.
+	journalDir := journalDirOf(config)
 
 	// shutdown
 	if err := config.Shutdown(); err != nil {
 		return err
 	}
 
-	if k.journalDir != "" {
+	if journalDir != "" {
 		// Remove the user journal.
-		if err := os.RemoveAll(
-			filepath.Join(k.journalDir, userName.String())); err != nil {
+		if err := os.RemoveAll(journalDir); err != nil {
 			return err
 		}
 		// Remove the overall journal dir if it's empty.
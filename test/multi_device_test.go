@@ -0,0 +1,126 @@
+// Copyright 2016 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// These tests involve users with several devices, network
+// partitions and clock skew.
+
+package test
+
+import (
+	"testing"
+	"time"
+)
+
+// alice writes on one device, and sees it on another.
+func TestMultiDeviceSimple(t *testing.T) {
+	test(t,
+		users("alice", "bob"), devices(alice, 2),
+		as(alice,
+			mkfile("a/b", "hello"),
+		),
+		asDevice(alice, 1,
+			read("a/b", "hello"),
+			write("a/c", "world"),
+		),
+		as(bob,
+			read("a/c", "world"),
+		),
+		converged(),
+	)
+}
+
+// alice adds a device, which can read the TLF once it's rekeyed.
+func TestMultiDeviceAddDeviceRekey(t *testing.T) {
+	test(t,
+		users("alice", "bob"),
+		as(alice,
+			mkfile("a", "hello"),
+		),
+		addDevice(alice),
+		as(bob,
+			rekey(),
+		),
+		asDevice(alice, 1,
+			read("a", "hello"),
+			mkfile("b", "world"),
+		),
+		converged(),
+	)
+}
+
+// alice's second device writes to its journal while cut off from the
+// servers, while her first device makes a conflicting change.  Once
+// reconnected, the journal flushes, conflict resolution runs, and all
+// devices agree.
+func TestMultiDevicePartitionedJournalConflict(t *testing.T) {
+	test(t, journal(),
+		users("alice", "bob"), devices(alice, 2),
+		as(alice,
+			mkdir("a"),
+		),
+		asDevice(alice, 1,
+			enableJournal(),
+			lsdir("a/", m{}),
+			disconnect(),
+			mkfile("a/b", "offline"),
+			read("a/b", "offline"),
+		),
+		as(alice,
+			mkfile("a/c", "online"),
+		),
+		asDevice(alice, 1,
+			lsdir("a/", m{"b$": "FILE"}),
+			reconnect(),
+		),
+		converged(),
+		as(bob,
+			read("a/b", "offline"),
+			read("a/c", "online"),
+		),
+	)
+}
+
+// Both of alice's devices are cut off and write the same file; the
+// one reconnecting second gets the conflicted copy, named after its
+// skewed clock.
+func TestMultiDevicePartitionedClockSkew(t *testing.T) {
+	skew := 48 * time.Hour
+	test(t, journal(),
+		users("alice", "bob"), devices(alice, 2),
+		as(alice,
+			mkdir("a"),
+			enableJournal(),
+		),
+		asDevice(alice, 1,
+			enableJournal(),
+			clockSkew(skew),
+			lsdir("a/", m{}),
+		),
+		as(alice,
+			disconnect(),
+			write("a/b", "first"),
+		),
+		asDevice(alice, 1,
+			disconnect(),
+			write("a/b", "second"),
+		),
+		as(alice,
+			reconnect(),
+			flushJournal(),
+		),
+		asDevice(alice, 1,
+			reconnect(),
+		),
+		converged(),
+		as(bob,
+			lsdir("a/", m{
+				"b$": "FILE",
+				crnameAtTimeOnDeviceEsc("b", alice, "unknown", skew): "FILE",
+			}),
+			read("a/b", "first"),
+			read(crnameAtTimeOnDevice("a/b", alice, "unknown", skew),
+				"second"),
+		),
+	)
+}